@@ -57,11 +57,14 @@ func NewInternalAPI(
 	// a sync.Cond object that can be used to notify workers when there are new
 	// events to be sent out.
 	workerStates := make([]types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
+	transports := make(map[string]http.RoundTripper, len(base.Cfg.Derived.ApplicationServices))
 	for i, appservice := range base.Cfg.Derived.ApplicationServices {
 		m := sync.Mutex{}
+		transports[appservice.ID] = makeTransport(appservice)
 		ws := types.ApplicationServiceWorkerState{
 			AppService: appservice,
 			Cond:       sync.NewCond(&m),
+			Transport:  transports[appservice.ID],
 		}
 		workerStates[i] = ws
 
@@ -79,7 +82,8 @@ func NewInternalAPI(
 		HTTPClient: &http.Client{
 			Timeout: time.Second * 30,
 		},
-		Cfg: base.Cfg,
+		Transports: transports,
+		Cfg:        base.Cfg,
 	}
 
 	// Only consume if we actually have ASes to track, else we'll just chew cycles needlessly.
@@ -101,6 +105,17 @@ func NewInternalAPI(
 	return appserviceQueryAPI
 }
 
+// makeTransport returns the transport to use for requests to an application
+// service, limiting how many can be in flight if it has been configured to.
+func makeTransport(as config.ApplicationService) http.RoundTripper {
+	if as.Transactions.MaxConcurrentRequests == 0 {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = as.Transactions.MaxConcurrentRequests
+	return transport
+}
+
 // generateAppServiceAccounts creates a dummy account based off the
 // `sender_localpart` field of each application service if it doesn't
 // exist already
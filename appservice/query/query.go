@@ -34,6 +34,9 @@ const userIDExistsPath = "/users/"
 // AppServiceQueryAPI is an implementation of api.AppServiceQueryAPI
 type AppServiceQueryAPI struct {
 	HTTPClient *http.Client
+	// The transport to use for each application service, keyed by ID.
+	// Application services without one use the transport of HTTPClient.
+	Transports map[string]http.RoundTripper
 	Cfg        *config.Dendrite
 }
 
@@ -68,7 +71,7 @@ func (a *AppServiceQueryAPI) RoomAliasExists(
 			}
 			req = req.WithContext(ctx)
 
-			resp, err := a.HTTPClient.Do(req)
+			resp, err := a.httpClient(appservice.ID).Do(req)
 			if resp != nil {
 				defer func() {
 					err = resp.Body.Close()
@@ -134,7 +137,7 @@ func (a *AppServiceQueryAPI) UserIDExists(
 			if err != nil {
 				return err
 			}
-			resp, err := a.HTTPClient.Do(req.WithContext(ctx))
+			resp, err := a.httpClient(appservice.ID).Do(req.WithContext(ctx))
 			if resp != nil {
 				defer func() {
 					err = resp.Body.Close()
@@ -170,6 +173,19 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	return nil
 }
 
+// httpClient returns the HTTP client to use for requests to the given
+// application service.
+func (a *AppServiceQueryAPI) httpClient(appserviceID string) *http.Client {
+	transport, ok := a.Transports[appserviceID]
+	if !ok {
+		return a.HTTPClient
+	}
+	return &http.Client{
+		Timeout:   a.HTTPClient.Timeout,
+		Transport: transport,
+	}
+}
+
 // makeHTTPClient creates an HTTP client with certain options that will be used for all query requests to application services
 func makeHTTPClient() *http.Client {
 	return &http.Client{
@@ -13,6 +13,7 @@
 package types
 
 import (
+	"net/http"
 	"sync"
 
 	"github.com/matrix-org/dendrite/internal/config"
@@ -34,6 +35,10 @@ type ApplicationServiceWorkerState struct {
 	EventsReady bool
 	// Backoff exponent (2^x secs). Max 6, aka 64s.
 	Backoff int
+	// The transport for requests to the application service. It is shared
+	// with the query API so that the limit on concurrent requests covers
+	// both.
+	Transport http.RoundTripper
 }
 
 // NotifyNewEvents wakes up all waiting goroutines, notifying that events remain
@@ -32,8 +32,6 @@ import (
 )
 
 var (
-	// Maximum size of events sent in each transaction.
-	transactionBatchSize = 50
 	// Timeout for sending a single transaction to an application service.
 	transactionTimeout = time.Second * 60
 )
@@ -67,7 +65,8 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 
 	// Create a HTTP client for sending requests to app services
 	client := &http.Client{
-		Timeout: transactionTimeout,
+		Timeout:   transactionTimeout,
+		Transport: ws.Transport,
 	}
 
 	// Initial check for any leftover events to send from last time
@@ -83,12 +82,21 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 	}
 
 	// Loop forever and keep waiting for more events to send
+	var lastSent time.Time
 	for {
 		// Wait for more events if we've sent all the events in the database
 		ws.WaitForNewEvents()
 
+		// If the application service wants transactions no more often than
+		// the push interval then let more events build up in the meantime.
+		if wait := time.Until(lastSent.Add(ws.AppService.Transactions.PushInterval)); wait > 0 {
+			time.Sleep(wait)
+		}
+
 		// Batch events up into a transaction
-		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID)
+		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(
+			ctx, db, ws.AppService.ID, ws.AppService.Transactions.MaxEvents,
+		)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"appservice": ws.AppService.ID,
@@ -108,6 +116,7 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 
 		// We sent successfully, hooray!
 		ws.Backoff = 0
+		lastSent = time.Now()
 
 		// Transactions have a maximum event size, so there may still be some events
 		// left over to send. Keep sending until none are left
@@ -152,6 +161,7 @@ func createTransaction(
 	ctx context.Context,
 	db storage.Database,
 	appserviceID string,
+	maxEvents int,
 ) (
 	transactionJSON []byte,
 	txnID, maxID int,
@@ -159,7 +169,7 @@ func createTransaction(
 	err error,
 ) {
 	// Retrieve the latest events from the DB (will return old events if they weren't successfully sent)
-	txnID, maxID, events, eventsRemaining, err := db.GetEventsWithAppServiceID(ctx, appserviceID, transactionBatchSize)
+	txnID, maxID, events, eventsRemaining, err := db.GetEventsWithAppServiceID(ctx, appserviceID, maxEvents)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"appservice": appserviceID,
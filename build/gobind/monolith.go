@@ -117,7 +117,8 @@ func (m *DendriteMonolith) Start() {
 
 	serverKeyAPI := &signing.YggdrasilKeys{}
 	keyRing := serverKeyAPI.KeyRing()
-	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, cfg.Derived.ApplicationServices)
+	stateAPI := currentstateserver.NewInternalAPI(base.Cfg, base.KafkaConsumer)
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, cfg.Derived.ApplicationServices, nil, stateAPI)
 
 	rsAPI := roomserver.NewInternalAPI(
 		base, keyRing, federation,
@@ -137,8 +138,6 @@ func (m *DendriteMonolith) Start() {
 	// This is different to rsAPI which can be the http client which doesn't need this dependency
 	rsAPI.SetFederationSenderAPI(fsAPI)
 
-	stateAPI := currentstateserver.NewInternalAPI(base.Cfg, base.KafkaConsumer)
-
 	monolith := setup.Monolith{
 		Config:        base.Cfg,
 		AccountDB:     accountDB,
@@ -148,6 +147,7 @@ func (m *DendriteMonolith) Start() {
 		KeyRing:       keyRing,
 		KafkaConsumer: base.KafkaConsumer,
 		KafkaProducer: base.KafkaProducer,
+		Caches:        base.Caches,
 
 		AppserviceAPI:       asAPI,
 		EDUInternalAPI:      eduInputAPI,
@@ -159,7 +159,7 @@ func (m *DendriteMonolith) Start() {
 			ygg, fsAPI, federation,
 		),
 	}
-	monolith.AddAllPublicRoutes(base.PublicAPIMux)
+	monolith.AddAllPublicRoutes(base.PublicAPIMux, base.DendriteAdminMux)
 
 	httputil.SetupHTTPAPI(
 		base.BaseMux,
@@ -78,10 +78,16 @@ func VerifyUserFromRequest(
 			}
 		}
 	}
+	if res.Expired {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Access token has expired", true),
+		}
+	}
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
-			JSON: jsonerror.UnknownToken("Unknown token"),
+			JSON: jsonerror.UnknownToken("Unknown token", false),
 		}
 	}
 	return res.Device, nil
@@ -0,0 +1,37 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// RegistrationToken is a token which admins hand out to let people register
+// when the server requires one.
+type RegistrationToken struct {
+	Token string `json:"token"`
+	// How many registrations the token can be used for, or nil if there is no limit.
+	UsesAllowed *int32 `json:"uses_allowed"`
+	// How many registrations have been completed with the token.
+	Completed int32 `json:"completed"`
+	// When the token stops being accepted, or nil if it never expires.
+	ExpiryTime *gomatrixserverlib.Timestamp `json:"expiry_time"`
+}
+
+// Valid returns whether the token can still be used to register at the given time.
+func (t *RegistrationToken) Valid(now gomatrixserverlib.Timestamp) bool {
+	if t.UsesAllowed != nil && t.Completed >= *t.UsesAllowed {
+		return false
+	}
+	return t.ExpiryTime == nil || *t.ExpiryTime > now
+}
@@ -14,8 +14,27 @@
 
 package authtypes
 
+import "github.com/matrix-org/gomatrixserverlib"
+
 // ThreePID represents a third-party identifier
 type ThreePID struct {
 	Address string `json:"address"`
 	Medium  string `json:"medium"`
 }
+
+// ThreePIDSession is an attempt to validate that a user owns a third-party
+// identifier, by sending it a token which the user has to submit back.
+type ThreePIDSession struct {
+	SessionID    string
+	ClientSecret string
+	Medium       string
+	Address      string
+	Token        string
+	SendAttempt  int
+	// How many tokens have been sent for the session since it last expired.
+	SendCount int
+	// When the token stops being accepted.
+	ExpiresTS gomatrixserverlib.Timestamp
+	// When the token was submitted, or zero if it hasn't been yet.
+	ValidatedTS gomatrixserverlib.Timestamp
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// CheckThreePIDSession returns whether the validation session with the given ID
+// and client secret has been validated and, if so, the third-party identifier
+// it validated and its medium.
+type CheckThreePIDSession func(ctx context.Context, sessionID, clientSecret string) (bool, string, string, error)
+
+// GetLocalpartForThreePID returns the localpart of the account which the
+// third-party identifier belongs to, or an empty string if there isn't one.
+type GetLocalpartForThreePID func(ctx context.Context, threepid, medium string) (string, error)
+
+type ThreePIDCredentials struct {
+	SessionID    string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+}
+
+type EmailIdentityRequest struct {
+	ThreePIDCreds ThreePIDCredentials `json:"threepid_creds"`
+}
+
+// LoginTypeEmailIdentity implements https://matrix.org/docs/spec/client_server/r0.6.1#email-based-identity-homeserver
+type LoginTypeEmailIdentity struct {
+	CheckThreePIDSession CheckThreePIDSession
+	// If set, logins are for the account which the email address belongs to,
+	// and fail if it doesn't belong to one.
+	GetLocalpartForThreePID GetLocalpartForThreePID
+}
+
+func (t *LoginTypeEmailIdentity) Name() string {
+	return authtypes.LoginTypeEmail
+}
+
+func (t *LoginTypeEmailIdentity) Request() interface{} {
+	return &EmailIdentityRequest{}
+}
+
+// Login returns a login with the validated email address as its third-party
+// identifier. Unless GetLocalpartForThreePID is set, it is up to the caller to
+// map it to an account.
+func (t *LoginTypeEmailIdentity) Login(ctx context.Context, req interface{}) (*Login, *util.JSONResponse) {
+	r := req.(*EmailIdentityRequest)
+	if r.ThreePIDCreds.SessionID == "" || r.ThreePIDCreds.ClientSecret == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.BadJSON("'threepid_creds' must contain 'sid' and 'client_secret'."),
+		}
+	}
+	verified, address, medium, err := t.CheckThreePIDSession(ctx, r.ThreePIDCreds.SessionID, r.ThreePIDCreds.ClientSecret)
+	if err != nil || !verified {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden("the email address has not been validated"),
+		}
+	}
+	login := &Login{
+		Type: authtypes.LoginTypeEmail,
+		Identifier: LoginIdentifier{
+			Type:    "m.id.thirdparty",
+			Medium:  medium,
+			Address: address,
+		},
+	}
+	if t.GetLocalpartForThreePID != nil {
+		localpart, err := t.GetLocalpartForThreePID(ctx, address, medium)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("GetLocalpartForThreePID failed")
+			resErr := jsonerror.InternalServerError()
+			return nil, &resErr
+		}
+		if localpart == "" {
+			return nil, &util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("the email address is not associated with an account on this server"),
+			}
+		}
+		login.User = localpart
+	}
+	return login, nil
+}
+
+// NewEmailIdentityUserInteractive returns a UI auth which only accepts email
+// addresses validated by the homeserver. This is used for password resets,
+// where the user doesn't have any other way of authenticating.
+func NewEmailIdentityUserInteractive(check CheckThreePIDSession) *UserInteractive {
+	typeEmail := &LoginTypeEmailIdentity{
+		CheckThreePIDSession: check,
+	}
+	return &UserInteractive{
+		Flows: []userInteractiveFlow{
+			{
+				Stages: []string{typeEmail.Name()},
+			},
+		},
+		Types: map[string]Type{
+			typeEmail.Name(): typeEmail,
+		},
+		Sessions:     make(map[string][]string),
+		sessionUsers: make(map[string]string),
+	}
+}
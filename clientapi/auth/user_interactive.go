@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"sync"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
@@ -71,6 +72,9 @@ type Login struct {
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
+
+	// Whether the client wants a refresh token, see MSC2918.
+	RefreshToken bool `json:"refresh_token"`
 }
 
 // Username returns the user localpart/user_id in this request, if it exists.
@@ -108,15 +112,22 @@ type UserInteractive struct {
 	Types map[string]Type
 	// Map of session ID to completed login types, will need to be extended in future
 	Sessions map[string][]string
+	// Map of session ID to the user ID that the session was started for, so that
+	// a session can't be picked up and completed by a different user.
+	sessionUsers map[string]string
+	// Protects Sessions and sessionUsers, which are accessed by concurrent requests.
+	sessionsMu sync.Mutex
 }
 
-func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.Dendrite) *UserInteractive {
+// NewUserInteractive returns a UI auth which accepts passwords and, if typeEmail
+// is given, email addresses which belong to the user's account.
+func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.Dendrite, typeEmail *LoginTypeEmailIdentity) *UserInteractive {
 	typePassword := &LoginTypePassword{
 		GetAccountByPassword: getAccByPass,
 		Config:               cfg,
 	}
 	// TODO: Add SSO login
-	return &UserInteractive{
+	u := &UserInteractive{
 		Flows: []userInteractiveFlow{
 			{
 				Stages: []string{typePassword.Name()},
@@ -125,8 +136,16 @@ func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.Dendrite)
 		Types: map[string]Type{
 			typePassword.Name(): typePassword,
 		},
-		Sessions: make(map[string][]string),
+		Sessions:     make(map[string][]string),
+		sessionUsers: make(map[string]string),
+	}
+	if typeEmail != nil {
+		u.Flows = append(u.Flows, userInteractiveFlow{
+			Stages: []string{typeEmail.Name()},
+		})
+		u.Types[typeEmail.Name()] = typeEmail
 	}
+	return u
 }
 
 func (u *UserInteractive) IsSingleStageFlow(authType string) bool {
@@ -139,8 +158,12 @@ func (u *UserInteractive) IsSingleStageFlow(authType string) bool {
 }
 
 func (u *UserInteractive) AddCompletedStage(sessionID, authType string) {
+	u.sessionsMu.Lock()
+	defer u.sessionsMu.Unlock()
 	// TODO: Handle multi-stage flows
+	// The session is forgotten once completed so that it can't be reused.
 	delete(u.Sessions, sessionID)
+	delete(u.sessionUsers, sessionID)
 }
 
 // Challenge returns an HTTP 401 with the supported flows for authenticating
@@ -160,15 +183,19 @@ func (u *UserInteractive) Challenge(sessionID string) *util.JSONResponse {
 	}
 }
 
-// NewSession returns a challenge with a new session ID and remembers the session ID
-func (u *UserInteractive) NewSession() *util.JSONResponse {
+// NewSession returns a challenge with a new session ID and remembers the session ID,
+// along with the user that it was started for.
+func (u *UserInteractive) NewSession(userID string) *util.JSONResponse {
 	sessionID, err := GenerateAccessToken()
 	if err != nil {
 		logrus.WithError(err).Error("failed to generate session ID")
 		res := jsonerror.InternalServerError()
 		return &res
 	}
+	u.sessionsMu.Lock()
 	u.Sessions[sessionID] = []string{}
+	u.sessionUsers[sessionID] = userID
+	u.sessionsMu.Unlock()
 	return u.Challenge(sessionID)
 }
 
@@ -206,7 +233,7 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	// https://matrix.org/docs/spec/client_server/r0.6.1#user-interactive-api-in-the-rest-api
 	hasResponse := gjson.GetBytes(bodyBytes, "auth").Exists()
 	if !hasResponse {
-		return nil, u.NewSession()
+		return nil, u.NewSession(device.UserID)
 	}
 
 	// extract the type so we know which login type to use
@@ -221,7 +248,17 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 
 	// retrieve the session
 	sessionID := gjson.GetBytes(bodyBytes, "auth.session").Str
-	if _, ok = u.Sessions[sessionID]; !ok {
+	u.sessionsMu.Lock()
+	_, sessionExists := u.Sessions[sessionID]
+	sessionUserID := u.sessionUsers[sessionID]
+	u.sessionsMu.Unlock()
+	if sessionExists && sessionUserID != device.UserID {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("auth.session was not started by this user"),
+		}
+	}
+	if !sessionExists {
 		// if the login type is part of a single stage flow then allow them to omit the session ID
 		if !u.IsSingleStageFlow(authType) {
 			return nil, &util.JSONResponse{
@@ -35,7 +35,7 @@ func getAccountByPassword(ctx context.Context, localpart, plaintextPassword stri
 func setup() *UserInteractive {
 	cfg := &config.Dendrite{}
 	cfg.Matrix.ServerName = serverName
-	return NewUserInteractive(getAccountByPassword, cfg)
+	return NewUserInteractive(getAccountByPassword, cfg, nil)
 }
 
 func TestUserInteractiveChallenge(t *testing.T) {
@@ -172,3 +172,159 @@ func TestUserInteractivePasswordBadLogin(t *testing.T) {
 		}
 	}
 }
+
+func TestUserInteractiveSessionNotReusableByOtherUser(t *testing.T) {
+	uia := setup()
+	lookup["carol herpassword"] = &api.Account{
+		Localpart:  "carol",
+		ServerName: serverName,
+		UserID:     fmt.Sprintf("@carol:%s", serverName),
+	}
+	carolDevice := &api.Device{
+		UserID: fmt.Sprintf("@carol:%s", serverName),
+		ID:     "carol_device",
+	}
+	malloryDevice := &api.Device{
+		UserID: fmt.Sprintf("@mallory:%s", serverName),
+		ID:     "mallory_device",
+	}
+	// start a session as carol
+	_, errRes := uia.Verify(ctx, []byte(`{}`), carolDevice)
+	if errRes == nil {
+		t.Fatalf("Verify succeeded with {} but expected failure")
+	}
+	var challenge struct {
+		Session string `json:"session"`
+	}
+	b, err := json.Marshal(errRes.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal challenge: %s", err)
+	}
+	if err = json.Unmarshal(b, &challenge); err != nil || challenge.Session == "" {
+		t.Fatalf("challenge did not contain a session: %s", string(b))
+	}
+	body := []byte(fmt.Sprintf(`{
+		"auth": {
+			"type": "m.login.password",
+			"identifier": {
+				"type": "m.id.user",
+				"user": "carol"
+			},
+			"password": "herpassword",
+			"session": "%s"
+		}
+	}`, challenge.Session))
+	// another user can't complete carol's session
+	_, errRes = uia.Verify(ctx, body, malloryDevice)
+	if errRes == nil {
+		t.Fatalf("Verify succeeded for a session started by another user")
+	}
+	if errRes.Code != 403 {
+		t.Errorf("got code %d want code 403", errRes.Code)
+	}
+	// carol can
+	if _, errRes = uia.Verify(ctx, body, carolDevice); errRes != nil {
+		t.Errorf("Verify failed but expected success: %+v", errRes)
+	}
+}
+
+func TestUserInteractiveEmailIdentity(t *testing.T) {
+	uia := NewEmailIdentityUserInteractive(func(ctx context.Context, sessionID, clientSecret string) (bool, string, string, error) {
+		if sessionID == "validated" && clientSecret == "secret" {
+			return true, "alice@example.com", "email", nil
+		}
+		return false, "", "", nil
+	})
+	noDevice := &api.Device{}
+	login, errRes := uia.Verify(ctx, []byte(`{
+		"auth": {
+			"type": "m.login.email.identity",
+			"threepid_creds": {
+				"sid": "validated",
+				"client_secret": "secret"
+			}
+		}
+	}`), noDevice)
+	if errRes != nil {
+		t.Fatalf("Verify failed for a validated session: %+v", errRes)
+	}
+	if medium, address := login.ThirdPartyID(); medium != "email" || address != "alice@example.com" {
+		t.Errorf("got third-party ID %s %s, want email alice@example.com", medium, address)
+	}
+
+	_, errRes = uia.Verify(ctx, []byte(`{
+		"auth": {
+			"type": "m.login.email.identity",
+			"threepid_creds": {
+				"sid": "unvalidated",
+				"client_secret": "secret"
+			}
+		}
+	}`), noDevice)
+	if errRes == nil || errRes.Code != 401 {
+		t.Errorf("expected HTTP 401 for an unvalidated session, got %+v", errRes)
+	}
+
+	_, errRes = uia.Verify(ctx, []byte(`{
+		"auth": {
+			"type": "m.login.password",
+			"user": "alice",
+			"password": "herpassword"
+		}
+	}`), noDevice)
+	if errRes == nil || errRes.Code != 400 {
+		t.Errorf("expected HTTP 400 for password auth, got %+v", errRes)
+	}
+}
+
+func TestUserInteractiveEmailIdentityForAccount(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = serverName
+	uia := NewUserInteractive(getAccountByPassword, cfg, &LoginTypeEmailIdentity{
+		CheckThreePIDSession: func(ctx context.Context, sessionID, clientSecret string) (bool, string, string, error) {
+			if sessionID == "alice" {
+				return true, "alice@example.com", "email", nil
+			}
+			return true, "nobody@example.com", "email", nil
+		},
+		GetLocalpartForThreePID: func(ctx context.Context, threepid, medium string) (string, error) {
+			if threepid == "alice@example.com" && medium == "email" {
+				return "alice", nil
+			}
+			return "", nil
+		},
+	})
+	aliceDevice := &api.Device{
+		UserID: fmt.Sprintf("@alice:%s", serverName),
+		ID:     "alice_device",
+	}
+	login, errRes := uia.Verify(ctx, []byte(`{
+		"auth": {
+			"type": "m.login.email.identity",
+			"threepid_creds": {
+				"sid": "alice",
+				"client_secret": "secret"
+			}
+		}
+	}`), aliceDevice)
+	if errRes != nil {
+		t.Fatalf("Verify failed for alice's email address: %+v", errRes)
+	}
+	if login.Username() != "alice" {
+		t.Errorf("got username %q, want alice", login.Username())
+	}
+
+	// addresses which don't belong to an account can't be used
+	_, errRes = uia.Verify(ctx, []byte(`{
+		"auth": {
+			"type": "m.login.email.identity",
+			"threepid_creds": {
+				"sid": "nobody",
+				"client_secret": "secret"
+			}
+		}
+	}`), aliceDevice)
+	if errRes == nil || errRes.Code != 401 {
+		t.Errorf("expected HTTP 401 for an address without an account, got %+v", errRes)
+	}
+}
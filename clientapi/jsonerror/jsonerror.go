@@ -15,6 +15,7 @@
 package jsonerror
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -64,6 +65,12 @@ func NotJSON(msg string) *MatrixError {
 	return &MatrixError{"M_NOT_JSON", msg}
 }
 
+// TooLarge is an error when the client supplies a request that exceeds a
+// size limit on the server.
+func TooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_TOO_LARGE", msg}
+}
+
 // NotFound is an error when the client tries to access an unknown resource.
 func NotFound(msg string) *MatrixError {
 	return &MatrixError{"M_NOT_FOUND", msg}
@@ -87,10 +94,22 @@ func MissingToken(msg string) *MatrixError {
 	return &MatrixError{"M_MISSING_TOKEN", msg}
 }
 
+// UnknownTokenError is returned when the access token isn't recognised.
+type UnknownTokenError struct {
+	MatrixError
+	// If true, the client should log in again without throwing away its
+	// local state, e.g. because the token has expired rather than having
+	// been logged out.
+	SoftLogout bool `json:"soft_logout"`
+}
+
 // UnknownToken is an error when the client tries to access a resource which
 // requires authentication and supplies an unrecognised token
-func UnknownToken(msg string) *MatrixError {
-	return &MatrixError{"M_UNKNOWN_TOKEN", msg}
+func UnknownToken(msg string, softLogout bool) *UnknownTokenError {
+	return &UnknownTokenError{
+		MatrixError: MatrixError{"M_UNKNOWN_TOKEN", msg},
+		SoftLogout:  softLogout,
+	}
 }
 
 // WeakPassword is an error which is returned when the client tries to register
@@ -111,6 +130,18 @@ func UserInUse(msg string) *MatrixError {
 	return &MatrixError{"M_USER_IN_USE", msg}
 }
 
+// RoomInUse is an error returned when the client tries to create a room with
+// an alias that is already taken.
+func RoomInUse(msg string) *MatrixError {
+	return &MatrixError{"M_ROOM_IN_USE", msg}
+}
+
+// BadAlias is an error returned when the client sets a canonical alias or
+// alternative alias which doesn't point to the room.
+func BadAlias(msg string) *MatrixError {
+	return &MatrixError{"M_BAD_ALIAS", msg}
+}
+
 // ASExclusive is an error returned when an application service tries to
 // register an username that is outside of its registered namespace, or if a
 // user attempts to register a username or room alias within an exclusive
@@ -125,6 +156,22 @@ func GuestAccessForbidden(msg string) *MatrixError {
 	return &MatrixError{"M_GUEST_ACCESS_FORBIDDEN", msg}
 }
 
+// CaptchaNeededError is returned when the client must solve a captcha
+// before the request will be considered, e.g. after too many failed logins.
+type CaptchaNeededError struct {
+	MatrixError
+	PublicKey string `json:"public_key"`
+}
+
+// CaptchaNeeded is an error returned when a captcha response is required
+// but wasn't supplied.
+func CaptchaNeeded(msg, publicKey string) *CaptchaNeededError {
+	return &CaptchaNeededError{
+		MatrixError: MatrixError{"M_CAPTCHA_NEEDED", msg},
+		PublicKey:   publicKey,
+	}
+}
+
 type IncompatibleRoomVersionError struct {
 	RoomVersion string `json:"room_version"`
 	Error       string `json:"error"`
@@ -161,6 +208,89 @@ func LimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
 	}
 }
 
+// Normalise makes sure that an error response has a body in the standard
+// error format, with an errcode that suits the status code if there isn't
+// one already. Responses built with util.MessageResponse or util.ErrorResponse,
+// or with a plain string or no body at all, are converted. Objects with fields
+// other than "message" are left alone, as some errors such as those for
+// user-interactive auth don't need an errcode. Successful responses are
+// returned unchanged.
+func Normalise(res util.JSONResponse) util.JSONResponse {
+	if res.Code < http.StatusBadRequest {
+		return res
+	}
+	msg, replace := errorMessage(res.JSON)
+	if !replace {
+		return res
+	}
+	if msg == "" {
+		msg = http.StatusText(res.Code)
+	}
+	res.JSON = &MatrixError{errCodeForStatus(res.Code), msg}
+	return res
+}
+
+// errorMessage returns the message from an error response body which isn't
+// in the standard error format, or false if the body should be left alone.
+func errorMessage(body interface{}) (string, bool) {
+	switch b := body.(type) {
+	case nil:
+		return "", true
+	case string:
+		return b, true
+	}
+	j, err := json.Marshal(body)
+	if err != nil {
+		return "", true
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(j, &fields); err != nil {
+		// not an object, e.g. an array, so there's no message in it
+		return "", true
+	}
+	if _, ok := fields["errcode"]; ok {
+		return "", false
+	}
+	var msg string
+	if e, ok := body.(error); ok {
+		msg = e.Error()
+	}
+	switch len(fields) {
+	case 0:
+		return msg, true
+	case 1:
+		message, ok := fields["message"]
+		if !ok {
+			return "", false
+		}
+		_ = json.Unmarshal(message, &msg)
+		return msg, true
+	default:
+		return "", false
+	}
+}
+
+// errCodeForStatus returns the errcode which best describes an error with
+// the given HTTP status code.
+func errCodeForStatus(code int) string {
+	switch code {
+	case http.StatusUnauthorized:
+		return "M_UNAUTHORIZED"
+	case http.StatusForbidden:
+		return "M_FORBIDDEN"
+	case http.StatusNotFound:
+		return "M_NOT_FOUND"
+	case http.StatusMethodNotAllowed:
+		return "M_UNRECOGNIZED"
+	case http.StatusRequestEntityTooLarge:
+		return "M_TOO_LARGE"
+	case http.StatusTooManyRequests:
+		return "M_LIMIT_EXCEEDED"
+	default:
+		return "M_UNKNOWN"
+	}
+}
+
 // NotTrusted is an error which is returned when the client asks the server to
 // proxy a request (e.g. 3PID association) to a server that isn't trusted
 func NotTrusted(serverName string) *MatrixError {
@@ -16,7 +16,11 @@ package jsonerror
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
 	"testing"
+
+	"github.com/matrix-org/util"
 )
 
 func TestLimitExceeded(t *testing.T) {
@@ -42,3 +46,52 @@ func TestForbidden(t *testing.T) {
 		t.Errorf("TestForbidden: want %s, got %s", want, string(jsonBytes))
 	}
 }
+
+func TestUnknownToken(t *testing.T) {
+	e := UnknownToken("expired", true)
+	jsonBytes, err := json.Marshal(&e)
+	if err != nil {
+		t.Fatalf("TestUnknownToken: Failed to marshal UnknownToken error. %s", err.Error())
+	}
+	want := `{"errcode":"M_UNKNOWN_TOKEN","error":"expired","soft_logout":true}`
+	if string(jsonBytes) != want {
+		t.Errorf("TestUnknownToken: want %s, got %s", want, string(jsonBytes))
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	uiaFlows := struct {
+		Flows   []string `json:"flows"`
+		Session string   `json:"session"`
+	}{[]string{"m.login.dummy"}, "abc"}
+	testCases := []struct {
+		name string
+		res  util.JSONResponse
+		want string
+	}{
+		{"success", util.JSONResponse{Code: http.StatusOK, JSON: struct {
+			Message string `json:"message"`
+		}{"fine"}}, `{"message":"fine"}`},
+		{"matrix error", util.JSONResponse{Code: http.StatusForbidden, JSON: Forbidden("no")}, `{"errcode":"M_FORBIDDEN","error":"no"}`},
+		{"limit exceeded", util.JSONResponse{Code: http.StatusTooManyRequests, JSON: LimitExceeded("slow down", 100)}, `{"errcode":"M_LIMIT_EXCEEDED","error":"slow down","retry_after_ms":100}`},
+		{"message response", util.MessageResponse(http.StatusForbidden, "go away"), `{"errcode":"M_FORBIDDEN","error":"go away"}`},
+		{"error response", util.ErrorResponse(errors.New("broken")), `{"errcode":"M_UNKNOWN","error":"broken"}`},
+		{"string", util.JSONResponse{Code: http.StatusNotFound, JSON: "missing"}, `{"errcode":"M_NOT_FOUND","error":"missing"}`},
+		{"no body", util.JSONResponse{Code: http.StatusTooManyRequests}, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too Many Requests"}`},
+		{"plain error", util.JSONResponse{Code: http.StatusInternalServerError, JSON: errors.New("oops")}, `{"errcode":"M_UNKNOWN","error":"oops"}`},
+		{"uia flows", util.JSONResponse{Code: http.StatusUnauthorized, JSON: uiaFlows}, `{"flows":["m.login.dummy"],"session":"abc"}`},
+	}
+	for _, tc := range testCases {
+		res := Normalise(tc.res)
+		if res.Code != tc.res.Code {
+			t.Errorf("%s: got code %d, want %d", tc.name, res.Code, tc.res.Code)
+		}
+		jsonBytes, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal response: %s", tc.name, err)
+		}
+		if string(jsonBytes) != tc.want {
+			t.Errorf("%s: want %s, got %s", tc.name, tc.want, string(jsonBytes))
+		}
+	}
+}
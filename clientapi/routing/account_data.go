@@ -22,7 +22,10 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
 )
@@ -38,6 +41,9 @@ func GetAccountData(
 			JSON: jsonerror.Forbidden("userID does not match the current user"),
 		}
 	}
+	if resErr := validateAccountDataRoomID(roomID); resErr != nil {
+		return *resErr
+	}
 
 	dataReq := api.QueryAccountDataRequest{
 		UserID:   userID,
@@ -47,7 +53,7 @@ func GetAccountData(
 	dataRes := api.QueryAccountDataResponse{}
 	if err := userAPI.QueryAccountData(req.Context(), &dataReq, &dataRes); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountData failed")
-		return util.ErrorResponse(fmt.Errorf("userAPI.QueryAccountData: %w", err))
+		return jsonerror.InternalServerError()
 	}
 
 	var data json.RawMessage
@@ -57,6 +63,24 @@ func GetAccountData(
 	} else {
 		data, ok = dataRes.GlobalAccountData[dataType]
 	}
+	if ok && roomID == "" && dataType == "m.push_rules" {
+		// Only the changes to the server-default rules are stored, so the
+		// complete push rules are sent instead.
+		localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+		ruleSets, err := pushrules.AccountRuleSetsFromAccountData(data, localpart, domain)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("pushrules.AccountRuleSetsFromAccountData failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: ruleSets,
+		}
+	}
 	if ok {
 		return util.JSONResponse{
 			Code: http.StatusOK,
@@ -66,7 +90,7 @@ func GetAccountData(
 
 	return util.JSONResponse{
 		Code: http.StatusNotFound,
-		JSON: jsonerror.Forbidden("data not found"),
+		JSON: jsonerror.NotFound("data not found"),
 	}
 }
 
@@ -74,6 +98,7 @@ func GetAccountData(
 func SaveAccountData(
 	req *http.Request, userAPI api.UserInternalAPI, device *api.Device,
 	userID string, roomID string, dataType string, syncProducer *producers.SyncAPIProducer,
+	cfg *config.Dendrite,
 ) util.JSONResponse {
 	if userID != device.UserID {
 		return util.JSONResponse{
@@ -84,6 +109,18 @@ func SaveAccountData(
 
 	defer req.Body.Close() // nolint: errcheck
 
+	if resErr := validateAccountDataRoomID(roomID); resErr != nil {
+		return *resErr
+	}
+	if roomID == "" && dataType == "m.push_rules" {
+		// Push rules have their own endpoints, which check that the rules are
+		// valid before saving them.
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Cannot set m.push_rules through this API, use the /pushrules endpoints instead"),
+		}
+	}
+
 	if req.Body == http.NoBody {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -97,13 +134,19 @@ func SaveAccountData(
 		return jsonerror.InternalServerError()
 	}
 
-	if !json.Valid(body) {
+	if err = validateAccountData(roomID, dataType, body); err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON("Bad JSON content"),
+			JSON: jsonerror.BadJSON(err.Error()),
 		}
 	}
 
+	if resErr := checkAccountDataLimits(
+		req, userAPI, &cfg.Matrix.AccountDataLimits, userID, roomID, dataType, len(body),
+	); resErr != nil {
+		return *resErr
+	}
+
 	dataReq := api.InputAccountDataRequest{
 		UserID:      userID,
 		DataType:    dataType,
@@ -112,8 +155,8 @@ func SaveAccountData(
 	}
 	dataRes := api.InputAccountDataResponse{}
 	if err := userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountData failed")
-		return util.ErrorResponse(err)
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
+		return jsonerror.InternalServerError()
 	}
 
 	// TODO: user API should do this since it's account data
@@ -127,3 +170,108 @@ func SaveAccountData(
 		JSON: struct{}{},
 	}
 }
+
+// validateAccountDataRoomID checks that the room ID in a per-room account
+// data path, if there is one, is actually a room ID.
+func validateAccountDataRoomID(roomID string) *util.JSONResponse {
+	if roomID == "" {
+		return nil
+	}
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("roomID must be a valid room ID"),
+		}
+	}
+	return nil
+}
+
+// validateAccountData checks that account data content is a JSON object.
+// The global types which other parts of the server read, m.direct and
+// m.ignored_user_list, must also have the structure that the spec gives them.
+func validateAccountData(roomID, dataType string, body []byte) error {
+	var content map[string]json.RawMessage
+	if err := json.Unmarshal(body, &content); err != nil {
+		return fmt.Errorf("account data content must be a JSON object")
+	}
+	if roomID != "" {
+		return nil
+	}
+	switch dataType {
+	case "m.direct":
+		var direct map[string][]string
+		if err := json.Unmarshal(body, &direct); err != nil {
+			return fmt.Errorf("m.direct must map user IDs to lists of room IDs")
+		}
+		for userID := range direct {
+			if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+				return fmt.Errorf("m.direct contains an invalid user ID %q", userID)
+			}
+		}
+	case "m.ignored_user_list":
+		var ignored struct {
+			IgnoredUsers map[string]json.RawMessage `json:"ignored_users"`
+		}
+		if err := json.Unmarshal(body, &ignored); err != nil {
+			return fmt.Errorf("m.ignored_user_list must contain an ignored_users object")
+		}
+		for userID := range ignored.IgnoredUsers {
+			if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+				return fmt.Errorf("m.ignored_user_list contains an invalid user ID %q", userID)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAccountDataLimits checks that storing account data of the given size
+// would stay within both the size limit for the data type and the total
+// account data quota for the user. The existing data of the same type is
+// not counted towards the quota, since it will be replaced.
+func checkAccountDataLimits(
+	req *http.Request, userAPI api.UserInternalAPI, limits *config.AccountDataLimits,
+	userID, roomID, dataType string, size int,
+) *util.JSONResponse {
+	if maxSize := limits.MaxEventSizeBytesForType(dataType); maxSize > 0 && config.FileSizeBytes(size) > maxSize {
+		return &util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.TooLarge(fmt.Sprintf("Account data of type %q must not be larger than %d bytes", dataType, maxSize)),
+		}
+	}
+
+	maxTotalSize := limits.MaxTotalSizeBytesForUser()
+	if maxTotalSize <= 0 {
+		return nil
+	}
+	dataReq := api.QueryAccountDataRequest{
+		UserID: userID,
+	}
+	dataRes := api.QueryAccountDataResponse{}
+	if err := userAPI.QueryAccountData(req.Context(), &dataReq, &dataRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountData failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	totalSize := config.FileSizeBytes(size)
+	for globalType, data := range dataRes.GlobalAccountData {
+		if roomID == "" && globalType == dataType {
+			continue
+		}
+		totalSize += config.FileSizeBytes(len(data))
+	}
+	for dataRoomID, roomData := range dataRes.RoomAccountData {
+		for roomType, data := range roomData {
+			if dataRoomID == roomID && roomType == dataType {
+				continue
+			}
+			totalSize += config.FileSizeBytes(len(data))
+		}
+	}
+	if totalSize > maxTotalSize {
+		return &util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.TooLarge(fmt.Sprintf("Storing this account data would exceed the quota of %d bytes per user", maxTotalSize)),
+		}
+	}
+	return nil
+}
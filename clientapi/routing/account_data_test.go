@@ -0,0 +1,103 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestValidateAccountData(t *testing.T) {
+	testCases := []struct {
+		roomID   string
+		dataType string
+		body     string
+		wantErr  bool
+	}{
+		{dataType: "im.vector.setting", body: `{"theme":"dark"}`},
+		{dataType: "im.vector.setting", body: `"dark"`, wantErr: true},
+		{dataType: "im.vector.setting", body: `[]`, wantErr: true},
+		{dataType: "m.direct", body: `{"@bob:localhost":["!abc:localhost"]}`},
+		{dataType: "m.direct", body: `{"@bob:localhost":"!abc:localhost"}`, wantErr: true},
+		{dataType: "m.direct", body: `{"bob":["!abc:localhost"]}`, wantErr: true},
+		{dataType: "m.ignored_user_list", body: `{"ignored_users":{"@bob:localhost":{}}}`},
+		{dataType: "m.ignored_user_list", body: `{"ignored_users":["@bob:localhost"]}`, wantErr: true},
+		{dataType: "m.ignored_user_list", body: `{"ignored_users":{"bob":{}}}`, wantErr: true},
+		// The special global types aren't checked in rooms.
+		{roomID: "!abc:localhost", dataType: "m.direct", body: `{"bob":"x"}`},
+	}
+	for _, tc := range testCases {
+		err := validateAccountData(tc.roomID, tc.dataType, []byte(tc.body))
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("validateAccountData(%q, %q, %s): got error %v, want error %v", tc.roomID, tc.dataType, tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+// fakeAccountDataUserAPI returns the given account data for every user.
+type fakeAccountDataUserAPI struct {
+	api.UserInternalAPI
+	global map[string]json.RawMessage
+	rooms  map[string]map[string]json.RawMessage
+}
+
+func (u *fakeAccountDataUserAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
+	res.GlobalAccountData = u.global
+	res.RoomAccountData = u.rooms
+	return nil
+}
+
+func TestCheckAccountDataLimits(t *testing.T) {
+	maxEventSize := config.FileSizeBytes(100)
+	maxTotalSize := config.FileSizeBytes(200)
+	limits := &config.AccountDataLimits{
+		MaxEventSizeBytes:       &maxEventSize,
+		MaxEventSizeBytesByType: map[string]config.FileSizeBytes{"m.push_rules": 150},
+		MaxTotalSizeBytes:       &maxTotalSize,
+	}
+	// 120 bytes of account data are stored already.
+	userAPI := &fakeAccountDataUserAPI{
+		global: map[string]json.RawMessage{"m.push_rules": make([]byte, 80)},
+		rooms: map[string]map[string]json.RawMessage{
+			"!abc:localhost": {"m.tag": make([]byte, 40)},
+		},
+	}
+	testCases := []struct {
+		name     string
+		roomID   string
+		dataType string
+		size     int
+		wantCode int
+	}{
+		{name: "within the limits", dataType: "im.vector.setting", size: 80},
+		{name: "too large for the type", dataType: "im.vector.setting", size: 101, wantCode: http.StatusRequestEntityTooLarge},
+		{name: "larger limit for the type", dataType: "m.push_rules", size: 150},
+		{name: "over the quota", dataType: "im.vector.setting", size: 90, wantCode: http.StatusRequestEntityTooLarge},
+		// the data being replaced doesn't count towards the quota
+		{name: "replacing room data", roomID: "!abc:localhost", dataType: "m.tag", size: 80},
+		{name: "same type in another room", roomID: "!def:localhost", dataType: "m.tag", size: 90, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/user/@alice:localhost/account_data/"+tc.dataType, nil)
+		resErr := checkAccountDataLimits(req, userAPI, limits, "@alice:localhost", tc.roomID, tc.dataType, tc.size)
+		gotCode := 0
+		if resErr != nil {
+			gotCode = resErr.Code
+		}
+		if gotCode != tc.wantCode {
+			t.Errorf("%s: got status %d, want %d", tc.name, gotCode, tc.wantCode)
+		}
+	}
+
+	// Without limits, anything goes and the stored account data isn't needed.
+	if resErr := checkAccountDataLimits(
+		httptest.NewRequest(http.MethodPut, "/", nil), nil, &config.AccountDataLimits{},
+		"@alice:localhost", "", "im.vector.setting", 1<<20,
+	); resErr != nil {
+		t.Errorf("got status %d without any limits, want no error", resErr.Code)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// AdminDestinations implements:
+//     GET /_dendrite/admin/destinations?server_name=example.com&server_name=example.org
+// Every server which was sent anything recently is returned when no server
+// names are given.
+func AdminDestinations(
+	req *http.Request, federationSender federationSenderAPI.FederationSenderInternalAPI,
+) util.JSONResponse {
+	var queryReq federationSenderAPI.QueryDestinationHealthRequest
+	for _, serverName := range req.URL.Query()["server_name"] {
+		queryReq.ServerNames = append(queryReq.ServerNames, gomatrixserverlib.ServerName(serverName))
+	}
+	var queryRes federationSenderAPI.QueryDestinationHealthResponse
+	if err := federationSender.QueryDestinationHealth(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("federationSender.QueryDestinationHealth failed")
+		return jsonerror.InternalServerError()
+	}
+	if queryRes.Destinations == nil {
+		queryRes.Destinations = []federationSenderAPI.DestinationHealth{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// AdminListProvisionedUsers implements:
+//     GET /_dendrite/admin/provisioned_users?from=0&limit=100
+func AdminListProvisionedUsers(req *http.Request, userAPI api.UserInternalAPI) util.JSONResponse {
+	query := req.URL.Query()
+	var queryReq api.QueryProvisionedUsersRequest
+	var err error
+	if v := query.Get("from"); v != "" {
+		if queryReq.Offset, err = strconv.Atoi(v); err != nil || queryReq.Offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from must be a non-negative number"),
+			}
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if queryReq.Limit, err = strconv.Atoi(v); err != nil || queryReq.Limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive number"),
+			}
+		}
+	}
+	var queryRes api.QueryProvisionedUsersResponse
+	if err = userAPI.QueryProvisionedUsers(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryProvisionedUsers failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
+
+// AdminProvisionUsers implements:
+//     POST /_dendrite/admin/provisioned_users
+// It creates or updates the accounts for users in an external directory. Each
+// user which can't be provisioned has an error in the results, rather than
+// failing the whole request.
+func AdminProvisionUsers(req *http.Request, userAPI api.UserInternalAPI) util.JSONResponse {
+	var performReq api.PerformUserProvisioningRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &performReq); resErr != nil {
+		return *resErr
+	}
+	var performRes api.PerformUserProvisioningResponse
+	if err := userAPI.PerformUserProvisioning(req.Context(), &performReq, &performRes); err != nil {
+		// This only fails for requests with too many users.
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: performRes,
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+)
+
+func TestAdminProvisionUsers(t *testing.T) {
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create devices database: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, "localhost", nil, nil, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/provisioned_users", strings.NewReader(
+		`{"users":[{"external_id":"1","localpart":"alice"},{"external_id":"2","localpart":"bob"},{"external_id":"3"}]}`,
+	))
+	res := AdminProvisionUsers(req, userAPI)
+	performRes, _ := res.JSON.(api.PerformUserProvisioningResponse)
+	if res.Code != http.StatusOK || len(performRes.Results) != 3 {
+		t.Fatalf("got status %d and %+v provisioning users", res.Code, res.JSON)
+	}
+	if r := performRes.Results[0]; !r.Created || r.UserID != "@alice:localhost" || r.Error != "" {
+		t.Errorf("got result %+v, want alice to have been created", r)
+	}
+	if r := performRes.Results[2]; r.Created || r.Error == "" {
+		t.Errorf("got result %+v, want an error for a new user without a localpart", r)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/_dendrite/admin/provisioned_users", strings.NewReader(`{"users":`))
+	if res = AdminProvisionUsers(req, userAPI); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a malformed request, want %d", res.Code, http.StatusBadRequest)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/provisioned_users?from=1&limit=1", nil)
+	res = AdminListProvisionedUsers(req, userAPI)
+	queryRes, _ := res.JSON.(api.QueryProvisionedUsersResponse)
+	if res.Code != http.StatusOK || queryRes.TotalUsers != 2 || len(queryRes.Users) != 1 || queryRes.Users[0].UserID != "@bob:localhost" {
+		t.Errorf("got status %d and %+v listing provisioned users, want bob of 2 users", res.Code, res.JSON)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/provisioned_users?limit=0", nil)
+	if res = AdminListProvisionedUsers(req, userAPI); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a zero limit, want %d", res.Code, http.StatusBadRequest)
+	}
+}
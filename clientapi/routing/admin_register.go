@@ -0,0 +1,245 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// sharedSecretNonceLifetime is how long a nonce for shared secret
+// registration can be used for after it was handed out.
+const sharedSecretNonceLifetime = time.Minute
+
+// sharedSecretNonces hands out the nonces for shared secret registration and
+// makes sure that each can only be used once. Nonces carry their expiry and
+// are signed with a key derived from the shared secret, so nothing needs
+// storing until one is used by a request with a correct MAC, which only
+// holders of the shared secret can make. As the key is the same everywhere,
+// a nonce handed out by one client API server can be used with any other, or
+// after a restart.
+// The used nonces are only remembered in memory, so each nonce can be used
+// once per client API server while it lasts, rather than once in all. Nothing
+// more is needed, as requests with a correct MAC need the shared secret
+// anyway, and each one can only register a user which doesn't exist yet.
+// It shouldn't be passed by value because it contains a mutex.
+type sharedSecretNonces struct {
+	key []byte
+	sync.Mutex
+	used map[string]time.Time // nonce -> expiry
+}
+
+func newSharedSecretNonces(sharedSecret string) *sharedSecretNonces {
+	// The key is derived rather than being the shared secret itself, which is
+	// also the key of the MACs over the nonces.
+	mac := hmac.New(sha256.New, []byte(sharedSecret))
+	_, _ = mac.Write([]byte("shared secret registration nonces"))
+	return &sharedSecretNonces{
+		key:  mac.Sum(nil),
+		used: make(map[string]time.Time),
+	}
+}
+
+func (n *sharedSecretNonces) sign(payload string) string {
+	mac := hmac.New(sha256.New, n.key)
+	_, _ = mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// create hands out a new nonce.
+func (n *sharedSecretNonces) create(now time.Time) string {
+	payload := strconv.FormatInt(now.Add(sharedSecretNonceLifetime).UnixNano(), 10) + "." + util.RandomString(16)
+	return payload + "." + n.sign(payload)
+}
+
+// expiry returns when the nonce expires, or false if it wasn't handed out by
+// create.
+func (n *sharedSecretNonces) expiry(nonce string) (time.Time, bool) {
+	i := strings.LastIndexByte(nonce, '.')
+	if i < 0 || !hmac.Equal([]byte(nonce[i+1:]), []byte(n.sign(nonce[:i]))) {
+		return time.Time{}, false
+	}
+	expiry, err := strconv.ParseInt(strings.SplitN(nonce, ".", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, expiry), true
+}
+
+// valid returns whether the nonce was handed out and hasn't expired or been
+// used.
+func (n *sharedSecretNonces) valid(nonce string, now time.Time) bool {
+	expiry, ok := n.expiry(nonce)
+	if !ok || !now.Before(expiry) {
+		return false
+	}
+	n.Lock()
+	defer n.Unlock()
+	_, used := n.used[nonce]
+	return !used
+}
+
+// consume returns whether the nonce is valid, and stops it from being used
+// again. The nonces which have expired since they were used are forgotten.
+func (n *sharedSecretNonces) consume(nonce string, now time.Time) bool {
+	expiry, ok := n.expiry(nonce)
+	if !ok || !now.Before(expiry) {
+		return false
+	}
+	n.Lock()
+	defer n.Unlock()
+	for usedNonce, usedExpiry := range n.used {
+		if !now.Before(usedExpiry) {
+			delete(n.used, usedNonce)
+		}
+	}
+	if _, used := n.used[nonce]; used {
+		return false
+	}
+	n.used[nonce] = expiry
+	return true
+}
+
+type sharedSecretRegisterRequest struct {
+	Nonce       string                      `json:"nonce"`
+	Username    string                      `json:"username"`
+	DisplayName string                      `json:"displayname"`
+	Password    string                      `json:"password"`
+	Admin       bool                        `json:"admin"`
+	UserType    *string                     `json:"user_type"`
+	Mac         gomatrixserverlib.HexString `json:"mac"`
+}
+
+// SharedSecretRegistrationNonce implements:
+//     GET /_dendrite/admin/register
+func SharedSecretRegistrationNonce(cfg *config.Dendrite, nonces *sharedSecretNonces) util.JSONResponse {
+	if cfg.Matrix.RegistrationSharedSecret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Shared secret registration is not enabled"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Nonce string `json:"nonce"`
+		}{nonces.create(time.Now())},
+	}
+}
+
+// SharedSecretRegister implements:
+//     POST /_dendrite/admin/register
+// It works in the same way as Synapse's shared secret registration, so that
+// the same tools can be used with either. The MAC is the HMAC-SHA1, keyed with
+// the shared secret, of the nonce, username, password and "admin" or
+// "notadmin", separated by NUL bytes. It works even if registration is
+// otherwise disabled.
+func SharedSecretRegister(
+	req *http.Request, userAPI userapi.UserInternalAPI, accountDB accounts.Database,
+	stateAPI currentstateAPI.CurrentStateInternalAPI, cfg *config.Dendrite, nonces *sharedSecretNonces,
+) util.JSONResponse {
+	ctx := req.Context()
+	if cfg.Matrix.RegistrationSharedSecret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Shared secret registration is not enabled"),
+		}
+	}
+	var r sharedSecretRegisterRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if !nonces.valid(r.Nonce, time.Now()) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unrecognised nonce"),
+		}
+	}
+	if r.UserType != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("user_type is not supported"),
+		}
+	}
+	if resErr := validateUsername(r.Username); resErr != nil {
+		return *resErr
+	}
+	// The parts of the MAC are separated by NUL bytes, so the password can't
+	// contain any.
+	if strings.Contains(r.Password, "\x00") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("password must not contain NUL bytes"),
+		}
+	}
+	if resErr := validatePassword(r.Password); resErr != nil {
+		return *resErr
+	}
+
+	adminString := "notadmin"
+	if r.Admin {
+		adminString = "admin"
+	}
+	mac := hmac.New(sha1.New, []byte(cfg.Matrix.RegistrationSharedSecret))
+	_, _ = mac.Write([]byte(strings.Join([]string{r.Nonce, r.Username, r.Password, adminString}, "\x00")))
+	if !hmac.Equal(r.Mac, mac.Sum(nil)) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("HMAC incorrect"),
+		}
+	}
+	// Only requests with a correct MAC use the nonce up, so that requests
+	// without the shared secret can't fill up the used nonces.
+	if !nonces.consume(r.Nonce, time.Now()) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unrecognised nonce"),
+		}
+	}
+
+	res := completeRegistration(ctx, userAPI, r.Username, r.Password, "", false, r.Admin, false, nil, nil, 0)
+	if res.Code != http.StatusOK {
+		return res
+	}
+	if r.DisplayName != "" {
+		if err := accountDB.SetDisplayName(ctx, r.Username, r.DisplayName); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.SetDisplayName failed")
+			return jsonerror.InternalServerError()
+		}
+		userID := userutil.MakeUserID(r.Username, cfg.Matrix.ServerName)
+		if err := updateUserDirectory(ctx, accountDB, stateAPI, userID, r.Username); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("updateUserDirectory failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+package routing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+)
+
+func TestSharedSecretNonces(t *testing.T) {
+	nonces := newSharedSecretNonces("secret")
+	now := time.Now()
+	nonce := nonces.create(now)
+	if !nonces.valid(nonce, now) || !nonces.valid(nonce, now) {
+		t.Fatalf("expected a new nonce to be valid until it is used")
+	}
+	if !nonces.consume(nonce, now) {
+		t.Fatalf("expected a new nonce to be accepted")
+	}
+	if nonces.valid(nonce, now) || nonces.consume(nonce, now) {
+		t.Fatalf("expected a nonce to only be accepted once")
+	}
+	nonce = nonces.create(now)
+	if nonces.consume(nonce, now.Add(sharedSecretNonceLifetime)) {
+		t.Fatalf("expected an expired nonce to be rejected")
+	}
+	// The expiry is signed, so it can't be pushed back.
+	parts := strings.SplitN(nonces.create(now), ".", 2)
+	if nonces.valid(fmt.Sprintf("%d.%s", now.Add(time.Hour).UnixNano(), parts[1]), now.Add(sharedSecretNonceLifetime)) {
+		t.Fatalf("expected a nonce with a changed expiry to be rejected")
+	}
+	if nonces.valid("made-up", now) || newSharedSecretNonces("other").valid(nonces.create(now), now) {
+		t.Fatalf("expected a nonce which wasn't handed out to be rejected")
+	}
+	// Nonces can be used with other client API servers with the same shared
+	// secret, but are only remembered as used by each server itself.
+	other := newSharedSecretNonces("secret")
+	nonce = nonces.create(now)
+	if !nonces.consume(nonce, now) || !other.consume(nonce, now) || other.consume(nonce, now) {
+		t.Fatalf("expected a nonce to be accepted once by each server with the same shared secret")
+	}
+}
+
+func TestSharedSecretRegister(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create devices database: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, "localhost", nil, nil, nil)
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.RegistrationSharedSecret = "secret"
+	nonces := newSharedSecretNonces("secret")
+	macFor := func(nonce, username, password, admin string) string {
+		mac := hmac.New(sha1.New, []byte("secret"))
+		_, _ = mac.Write([]byte(strings.Join([]string{nonce, username, password, admin}, "\x00")))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	register := func(nonce, admin, mac string) int {
+		body := fmt.Sprintf(`{"nonce":%q,"username":"alice","displayname":"Alice","password":"correct horse","admin":%t,"mac":%q}`, nonce, admin == "admin", mac)
+		req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/register", strings.NewReader(body))
+		return SharedSecretRegister(req, userAPI, accountDB, nil, cfg, nonces).Code
+	}
+
+	// The MAC is for a different nonce.
+	nonce := nonces.create(time.Now())
+	if code := register(nonce, "admin", macFor("other", "alice", "correct horse", "admin")); code != http.StatusForbidden {
+		t.Errorf("got status %d for the wrong MAC, want %d", code, http.StatusForbidden)
+	}
+	// The MAC says the user shouldn't be an admin.
+	if code := register(nonce, "admin", macFor(nonce, "alice", "correct horse", "notadmin")); code != http.StatusForbidden {
+		t.Errorf("got status %d for a MAC without admin, want %d", code, http.StatusForbidden)
+	}
+	if code := register("made-up", "admin", macFor("made-up", "alice", "correct horse", "admin")); code != http.StatusBadRequest {
+		t.Errorf("got status %d for a nonce which wasn't handed out, want %d", code, http.StatusBadRequest)
+	}
+
+	// The failed attempts didn't use up the nonce.
+	if code := register(nonce, "admin", macFor(nonce, "alice", "correct horse", "admin")); code != http.StatusOK {
+		t.Fatalf("got status %d registering with the right MAC, want %d", code, http.StatusOK)
+	}
+	acc, err := accountDB.GetAccountByLocalpart(ctx, "alice")
+	if err != nil {
+		t.Fatalf("failed to get the registered account: %s", err)
+	}
+	if !acc.IsAdmin {
+		t.Errorf("the registered account isn't an admin")
+	}
+	profile, err := accountDB.GetProfileByLocalpart(ctx, "alice")
+	if err != nil {
+		t.Fatalf("failed to get the registered account's profile: %s", err)
+	}
+	if profile.DisplayName != "Alice" {
+		t.Errorf("got display name %q, want %q", profile.DisplayName, "Alice")
+	}
+	if _, err = accountDB.GetAccountByPassword(ctx, "alice", "correct horse"); err != nil {
+		t.Errorf("can't log in with the registered password: %s", err)
+	}
+
+	if code := register(nonce, "admin", macFor(nonce, "alice", "correct horse", "admin")); code != http.StatusBadRequest {
+		t.Errorf("got status %d for a reused nonce, want %d", code, http.StatusBadRequest)
+	}
+
+	cfg.Matrix.RegistrationSharedSecret = ""
+	if code := register(nonces.create(time.Now()), "notadmin", ""); code != http.StatusBadRequest {
+		t.Errorf("got status %d with shared secret registration disabled, want %d", code, http.StatusBadRequest)
+	}
+}
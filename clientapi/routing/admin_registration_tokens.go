@@ -0,0 +1,261 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	registrationTokenChars         = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._~-"
+	defaultRegistrationTokenLength = 16
+	maxRegistrationTokenLength     = 64
+)
+
+// The characters which the spec allows in registration tokens.
+var registrationTokenRegex = regexp.MustCompile(`^[A-Za-z0-9._~-]{1,64}$`)
+
+type adminRegistrationTokensResponse struct {
+	RegistrationTokens []authtypes.RegistrationToken `json:"registration_tokens"`
+}
+
+type adminNewRegistrationTokenRequest struct {
+	// The token to create, or empty to generate one of the given length.
+	Token       string                       `json:"token"`
+	Length      int                          `json:"length"`
+	UsesAllowed *int32                       `json:"uses_allowed"`
+	ExpiryTime  *gomatrixserverlib.Timestamp `json:"expiry_time"`
+}
+
+// AdminListRegistrationTokens implements:
+//     GET /_dendrite/admin/registration_tokens?valid=true
+// Lists all of the tokens, or only those which can or can't still be used if
+// valid is given.
+func AdminListRegistrationTokens(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+	tokens, err := accountDB.GetRegistrationTokens(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationTokens failed")
+		return jsonerror.InternalServerError()
+	}
+	if valid := req.URL.Query().Get("valid"); valid != "" {
+		if valid != "true" && valid != "false" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("valid must be true or false"),
+			}
+		}
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		filtered := tokens[:0]
+		for i := range tokens {
+			if tokens[i].Valid(now) == (valid == "true") {
+				filtered = append(filtered, tokens[i])
+			}
+		}
+		tokens = filtered
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminRegistrationTokensResponse{tokens},
+	}
+}
+
+// AdminNewRegistrationToken implements:
+//     POST /_dendrite/admin/registration_tokens/new
+func AdminNewRegistrationToken(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+	var body adminNewRegistrationTokenRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	token := &authtypes.RegistrationToken{
+		Token:       body.Token,
+		UsesAllowed: body.UsesAllowed,
+		ExpiryTime:  body.ExpiryTime,
+	}
+	if resErr := validateRegistrationToken(token); resErr != nil {
+		return *resErr
+	}
+	if token.Token == "" {
+		if body.Length == 0 {
+			body.Length = defaultRegistrationTokenLength
+		}
+		if body.Length < 0 || body.Length > maxRegistrationTokenLength {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("length must be between 1 and %d", maxRegistrationTokenLength)),
+			}
+		}
+		var err error
+		if token.Token, err = generateRegistrationToken(body.Length); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("generateRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+	} else if !registrationTokenRegex.MatchString(token.Token) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf(
+				"token can only contain the characters A-Z, a-z, 0-9, or '._~-', and at most %d of them", maxRegistrationTokenLength,
+			)),
+		}
+	}
+
+	created, err := accountDB.CreateRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !created {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The token already exists"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: token,
+	}
+}
+
+// AdminGetRegistrationToken implements:
+//     GET /_dendrite/admin/registration_tokens/{token}
+func AdminGetRegistrationToken(req *http.Request, accountDB accounts.Database, token string) util.JSONResponse {
+	t, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return registrationTokenResponse(t)
+}
+
+// AdminUpdateRegistrationToken implements:
+//     PUT /_dendrite/admin/registration_tokens/{token}
+// Fields which are left out of the request are left alone, and fields which
+// are null are unset.
+func AdminUpdateRegistrationToken(req *http.Request, accountDB accounts.Database, token string) util.JSONResponse {
+	ctx := req.Context()
+	var body map[string]json.RawMessage
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	t, err := accountDB.GetRegistrationToken(ctx, token)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if t == nil {
+		return registrationTokenResponse(nil)
+	}
+	if v, ok := body["uses_allowed"]; ok {
+		t.UsesAllowed = nil
+		if err = json.Unmarshal(v, &t.UsesAllowed); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("uses_allowed must be a number or null"),
+			}
+		}
+	}
+	if v, ok := body["expiry_time"]; ok {
+		t.ExpiryTime = nil
+		if err = json.Unmarshal(v, &t.ExpiryTime); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("expiry_time must be a number or null"),
+			}
+		}
+	}
+	if resErr := validateRegistrationToken(t); resErr != nil {
+		return *resErr
+	}
+
+	t, err = accountDB.UpdateRegistrationToken(ctx, token, t.UsesAllowed, t.ExpiryTime)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.UpdateRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return registrationTokenResponse(t)
+}
+
+// AdminDeleteRegistrationToken implements:
+//     DELETE /_dendrite/admin/registration_tokens/{token}
+func AdminDeleteRegistrationToken(req *http.Request, accountDB accounts.Database, token string) util.JSONResponse {
+	deleted, err := accountDB.RemoveRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !deleted {
+		return registrationTokenResponse(nil)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func registrationTokenResponse(t *authtypes.RegistrationToken) util.JSONResponse {
+	if t == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The registration token does not exist"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: t,
+	}
+}
+
+// validateRegistrationToken returns an error response if the token's use
+// limit or expiry time don't make sense.
+func validateRegistrationToken(t *authtypes.RegistrationToken) *util.JSONResponse {
+	if t.UsesAllowed != nil && *t.UsesAllowed < 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("uses_allowed must not be negative"),
+		}
+	}
+	if t.ExpiryTime != nil && t.ExpiryTime.Time().Before(time.Now()) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("expiry_time must not be in the past"),
+		}
+	}
+	return nil
+}
+
+func generateRegistrationToken(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(registrationTokenChars)))
+	for i := range b {
+		c, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = registrationTokenChars[c.Int64()]
+	}
+	return string(b), nil
+}
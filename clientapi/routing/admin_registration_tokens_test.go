@@ -0,0 +1,114 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+func TestRegistrationTokens(t *testing.T) {
+	ctx := context.Background()
+	db, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.RegistrationRequiresToken = true
+	valid := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/org.matrix.msc3231/register/org.matrix.msc3231.login.registration_token/validity?token=abc", nil)
+		res := RegistrationTokenValidity(req, cfg, db)
+		if res.Code != http.StatusOK {
+			t.Fatalf("got status %d checking validity", res.Code)
+		}
+		return res.JSON.(registrationTokenValidityResponse).Valid
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/registration_tokens/new", strings.NewReader(`{"token":"abc","uses_allowed":1}`))
+	if res := AdminNewRegistrationToken(req, db); res.Code != http.StatusOK {
+		t.Fatalf("got status %d creating a token", res.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/_dendrite/admin/registration_tokens/new", strings.NewReader(`{"token":"abc"}`))
+	if res := AdminNewRegistrationToken(req, db); res.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d creating a duplicate token, want %d", res.Code, http.StatusBadRequest)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/_dendrite/admin/registration_tokens/new", strings.NewReader(`{"length":10}`))
+	res := AdminNewRegistrationToken(req, db)
+	if generated := res.JSON.(*authtypes.RegistrationToken).Token; !registrationTokenRegex.MatchString(generated) || len(generated) != 10 {
+		t.Fatalf("generated an invalid token %q", generated)
+	}
+
+	if !valid() {
+		t.Fatalf("expected a new token to be valid")
+	}
+	if used, err := db.UseRegistrationToken(ctx, "abc"); err != nil || !used {
+		t.Fatalf("UseRegistrationToken returned %v, %v", used, err)
+	}
+	if used, err := db.UseRegistrationToken(ctx, "abc"); err != nil || used {
+		t.Fatalf("expected a used up token to be rejected, got %v, %v", used, err)
+	}
+	if valid() {
+		t.Fatalf("expected a used up token to be invalid")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/registration_tokens?valid=false", nil)
+	res = AdminListRegistrationTokens(req, db)
+	if tokens := res.JSON.(adminRegistrationTokensResponse).RegistrationTokens; len(tokens) != 1 || tokens[0].Token != "abc" || tokens[0].Completed != 1 {
+		t.Fatalf("expected only the used up token to be listed, got %+v", tokens)
+	}
+
+	// Removing the use limit makes the token valid again.
+	req = httptest.NewRequest(http.MethodPut, "/_dendrite/admin/registration_tokens/abc", strings.NewReader(`{"uses_allowed":null}`))
+	res = AdminUpdateRegistrationToken(req, db, "abc")
+	if body, _ := json.Marshal(res.JSON); res.Code != http.StatusOK || !strings.Contains(string(body), `"uses_allowed":null`) {
+		t.Fatalf("got status %d and body %s updating the token", res.Code, body)
+	}
+	if !valid() {
+		t.Fatalf("expected a token without a use limit to be valid")
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/_dendrite/admin/registration_tokens/abc", nil)
+	if res = AdminDeleteRegistrationToken(req, db, "abc"); res.Code != http.StatusOK {
+		t.Fatalf("got status %d deleting the token", res.Code)
+	}
+	if valid() {
+		t.Fatalf("expected a deleted token to be invalid")
+	}
+}
+
+func TestRegistrationTokenRoutes(t *testing.T) {
+	routes := setupTestRoutes(t)
+	publicAPIMux, dendriteAdminMux := routes.publicAPIMux, routes.dendriteAdminMux
+
+	serve := func(router *mux.Router, path string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+	// Checking tokens is rate limited separately from registering, with the
+	// same limit of two requests at once.
+	validity := "/_matrix/client/unstable/org.matrix.msc3231/register/org.matrix.msc3231.login.registration_token/validity?token=abc"
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve(publicAPIMux, validity); code != want {
+			t.Fatalf("got status %d for request %d, want %d", code, i, want)
+		}
+	}
+	if code := serve(publicAPIMux, "/_matrix/client/r0/register/m.login.registration_token/validity?token=abc"); code != http.StatusNotFound {
+		t.Errorf("got status %d for the r0 validity path, want %d", code, http.StatusNotFound)
+	}
+
+	// The admin API is only served under /_dendrite/admin.
+	if code := serve(dendriteAdminMux, "/_dendrite/admin/registration_tokens"); code != http.StatusUnauthorized {
+		t.Errorf("got status %d without an access token, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve(publicAPIMux, "/_matrix/client/r0/admin/registration_tokens"); code != http.StatusNotFound {
+		t.Errorf("got status %d for the r0 admin path, want %d", code, http.StatusNotFound)
+	}
+}
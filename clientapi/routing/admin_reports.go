@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// AdminListEventReports implements:
+//     GET /_dendrite/admin/event_reports?room_id=!abc:example.com&include_resolved=true&from=0&limit=50
+func AdminListEventReports(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+	queryReq := roomserverAPI.QueryEventReportsRequest{
+		RoomID: query.Get("room_id"),
+	}
+	var err error
+	if v := query.Get("include_resolved"); v != "" {
+		if queryReq.IncludeResolved, err = strconv.ParseBool(v); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("include_resolved must be a boolean"),
+			}
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		if queryReq.Offset, err = strconv.Atoi(v); err != nil || queryReq.Offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from must be a non-negative number"),
+			}
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if queryReq.Limit, err = strconv.Atoi(v); err != nil || queryReq.Limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive number"),
+			}
+		}
+	}
+	var queryRes roomserverAPI.QueryEventReportsResponse
+	if err = rsAPI.QueryEventReports(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryEventReports failed")
+		return jsonerror.InternalServerError()
+	}
+	if queryRes.Reports == nil {
+		queryRes.Reports = []roomserverAPI.EventReport{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
+
+// AdminResolveEventReport implements:
+//     POST /_dendrite/admin/event_reports/{reportID}/resolve
+// The report is marked as resolved by the admin making the request.
+func AdminResolveEventReport(
+	req *http.Request, device *api.Device, rsAPI roomserverAPI.RoomserverInternalAPI, reportID string,
+) util.JSONResponse {
+	id, err := strconv.ParseInt(reportID, 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("the report ID must be a number"),
+		}
+	}
+	var resolveRes roomserverAPI.PerformResolveEventReportResponse
+	rsAPI.PerformResolveEventReport(req.Context(), &roomserverAPI.PerformResolveEventReportRequest{
+		ReportID:   id,
+		ResolvedBy: device.UserID,
+	}, &resolveRes)
+	if resolveRes.Error != nil {
+		return resolveRes.Error.JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// fakeEventReportsRoomserverAPI only implements the event report APIs.
+type fakeEventReportsRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	queried  *api.QueryEventReportsRequest
+	resolved *api.PerformResolveEventReportRequest
+}
+
+func (r *fakeEventReportsRoomserverAPI) QueryEventReports(
+	ctx context.Context, req *api.QueryEventReportsRequest, res *api.QueryEventReportsResponse,
+) error {
+	r.queried = req
+	res.Reports = []api.EventReport{{ID: 1, RoomID: "!room:localhost"}}
+	res.TotalReports = 1
+	return nil
+}
+
+func (r *fakeEventReportsRoomserverAPI) PerformResolveEventReport(
+	ctx context.Context, req *api.PerformResolveEventReportRequest, res *api.PerformResolveEventReportResponse,
+) {
+	if req.ReportID != 1 {
+		res.Error = &api.PerformError{Code: api.PerformErrorNoRoom, Msg: "unknown report"}
+		return
+	}
+	r.resolved = req
+}
+
+func TestAdminEventReports(t *testing.T) {
+	rsAPI := &fakeEventReportsRoomserverAPI{}
+	admin := &userapi.Device{UserID: "@admin:localhost"}
+
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/event_reports?room_id=!room:localhost&include_resolved=true&from=10&limit=5", nil)
+	res := AdminListEventReports(req, rsAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d listing reports, want %d", res.Code, http.StatusOK)
+	}
+	want := api.QueryEventReportsRequest{RoomID: "!room:localhost", IncludeResolved: true, Offset: 10, Limit: 5}
+	if *rsAPI.queried != want {
+		t.Errorf("got query %+v, want %+v", *rsAPI.queried, want)
+	}
+	for _, query := range []string{"include_resolved=maybe", "from=-1", "limit=0"} {
+		req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/event_reports?"+query, nil)
+		if res = AdminListEventReports(req, rsAPI); res.Code != http.StatusBadRequest {
+			t.Errorf("got status %d for %s, want %d", res.Code, query, http.StatusBadRequest)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/_dendrite/admin/event_reports/1/resolve", nil)
+	if res = AdminResolveEventReport(req, admin, rsAPI, "1"); res.Code != http.StatusOK {
+		t.Fatalf("got status %d resolving a report, want %d", res.Code, http.StatusOK)
+	}
+	if rsAPI.resolved.ResolvedBy != admin.UserID {
+		t.Errorf("the report was resolved by %q, want %q", rsAPI.resolved.ResolvedBy, admin.UserID)
+	}
+	if res = AdminResolveEventReport(req, admin, rsAPI, "2"); res.Code == http.StatusOK {
+		t.Errorf("resolving an unknown report should fail")
+	}
+	if res = AdminResolveEventReport(req, admin, rsAPI, "one"); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a malformed report ID, want %d", res.Code, http.StatusBadRequest)
+	}
+}
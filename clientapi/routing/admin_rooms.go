@@ -0,0 +1,207 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type adminPurgeRoomRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type adminPurgeRoomResponse struct {
+	KickedUsers []string `json:"kicked_users"`
+}
+
+type adminAuthDebugRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// AdminListRooms implements:
+//     GET /_dendrite/admin/rooms?room_version=5&min_members=2&encrypted=true&order_by=joined_members&dir=b&from=0&limit=50
+func AdminListRooms(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var queryReq roomserverAPI.QueryRoomsRequest
+	if err := queryRoomsRequestFromQuery(req, &queryReq); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	var queryRes roomserverAPI.QueryRoomsResponse
+	if err := rsAPI.QueryRooms(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRooms failed")
+		return jsonerror.InternalServerError()
+	}
+	if queryRes.Rooms == nil {
+		queryRes.Rooms = []roomserverAPI.RoomDetails{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
+
+// queryRoomsRequestFromQuery fills in a QueryRoomsRequest from the query
+// parameters of a request to AdminListRooms.
+func queryRoomsRequestFromQuery(req *http.Request, queryReq *roomserverAPI.QueryRoomsRequest) error {
+	query := req.URL.Query()
+	var err error
+	queryReq.RoomVersion = gomatrixserverlib.RoomVersion(query.Get("room_version"))
+	if v := query.Get("min_members"); v != "" {
+		if queryReq.MinJoinedMembers, err = strconv.Atoi(v); err != nil {
+			return errors.New("min_members must be a number")
+		}
+	}
+	if v := query.Get("max_members"); v != "" {
+		var maxMembers int
+		if maxMembers, err = strconv.Atoi(v); err != nil {
+			return errors.New("max_members must be a number")
+		}
+		queryReq.MaxJoinedMembers = &maxMembers
+	}
+	if v := query.Get("encrypted"); v != "" {
+		var encrypted bool
+		if encrypted, err = strconv.ParseBool(v); err != nil {
+			return errors.New("encrypted must be a boolean")
+		}
+		queryReq.Encrypted = &encrypted
+	}
+	if v := query.Get("public"); v != "" {
+		var public bool
+		if public, err = strconv.ParseBool(v); err != nil {
+			return errors.New("public must be a boolean")
+		}
+		queryReq.Public = &public
+	}
+	queryReq.OrderBy = query.Get("order_by")
+	switch query.Get("dir") {
+	case "", "f":
+	case "b":
+		queryReq.Descending = true
+	default:
+		return errors.New("dir must be 'f' or 'b'")
+	}
+	if v := query.Get("from"); v != "" {
+		if queryReq.Offset, err = strconv.Atoi(v); err != nil || queryReq.Offset < 0 {
+			return errors.New("from must be a non-negative number")
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if queryReq.Limit, err = strconv.Atoi(v); err != nil || queryReq.Limit <= 0 {
+			return errors.New("limit must be a positive number")
+		}
+	}
+	return nil
+}
+
+// AdminPurgeRoom implements:
+//     POST /_dendrite/admin/purge_room
+// The local members are made to leave the room, and then everything that this
+// server knows about it is deleted, including the users' account data for it.
+func AdminPurgeRoom(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	var body adminPurgeRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if _, _, err := gomatrixserverlib.SplitID('!', body.RoomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("room_id must be a valid room ID"),
+		}
+	}
+
+	var purgeRes roomserverAPI.PerformPurgeRoomResponse
+	rsAPI.PerformPurgeRoom(req.Context(), &roomserverAPI.PerformPurgeRoomRequest{
+		RoomID: body.RoomID,
+	}, &purgeRes)
+	if purgeRes.Error != nil {
+		return purgeRes.Error.JSONResponse()
+	}
+	if err := userAPI.PerformRoomAccountDataDeletion(req.Context(), &userapi.PerformRoomAccountDataDeletionRequest{
+		RoomID: body.RoomID,
+	}, &userapi.PerformRoomAccountDataDeletionResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformRoomAccountDataDeletion failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminPurgeRoomResponse{KickedUsers: purgeRes.EvacuatedUsers}
+	if res.KickedUsers == nil {
+		res.KickedUsers = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminAuthDebug implements:
+//     GET /_dendrite/admin/auth_debug/{roomID}
+//     PUT /_dendrite/admin/auth_debug/{roomID}
+// GET returns the event auth decisions recorded for the room, and PUT turns
+// recording them on or off.
+func AdminAuthDebug(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("the room ID is invalid"),
+		}
+	}
+
+	if req.Method == http.MethodPut {
+		var body adminAuthDebugRequest
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+		var performRes roomserverAPI.PerformAuthDebugResponse
+		rsAPI.PerformAuthDebug(req.Context(), &roomserverAPI.PerformAuthDebugRequest{
+			RoomID:  roomID,
+			Enabled: body.Enabled,
+		}, &performRes)
+		if performRes.Error != nil {
+			return performRes.Error.JSONResponse()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	var queryRes roomserverAPI.QueryAuthDecisionsResponse
+	if err := rsAPI.QueryAuthDecisions(req.Context(), &roomserverAPI.QueryAuthDecisionsRequest{
+		RoomID: roomID,
+	}, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryAuthDecisions failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
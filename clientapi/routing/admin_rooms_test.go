@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// fakeAdminRoomsRoomserverAPI only implements the APIs used by the room admin APIs.
+type fakeAdminRoomsRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	authDebug map[string]bool
+	queried   *api.QueryRoomsRequest
+}
+
+func (r *fakeAdminRoomsRoomserverAPI) QueryRooms(
+	ctx context.Context, req *api.QueryRoomsRequest, res *api.QueryRoomsResponse,
+) error {
+	r.queried = req
+	return nil
+}
+
+func (r *fakeAdminRoomsRoomserverAPI) PerformAuthDebug(
+	ctx context.Context, req *api.PerformAuthDebugRequest, res *api.PerformAuthDebugResponse,
+) {
+	r.authDebug[req.RoomID] = req.Enabled
+}
+
+func (r *fakeAdminRoomsRoomserverAPI) QueryAuthDecisions(
+	ctx context.Context, req *api.QueryAuthDecisionsRequest, res *api.QueryAuthDecisionsResponse,
+) error {
+	res.Enabled = r.authDebug[req.RoomID]
+	res.Decisions = []api.AuthDecision{}
+	if res.Enabled {
+		res.Decisions = append(res.Decisions, api.AuthDecision{EventID: "$event:localhost", Allowed: true})
+	}
+	return nil
+}
+
+func TestAdminAuthDebug(t *testing.T) {
+	rsAPI := &fakeAdminRoomsRoomserverAPI{authDebug: make(map[string]bool)}
+	roomID := "!room:localhost"
+	query := func() api.QueryAuthDecisionsResponse {
+		req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/auth_debug/"+roomID, nil)
+		res := AdminAuthDebug(req, rsAPI, roomID)
+		if res.Code != http.StatusOK {
+			t.Fatalf("got status %d querying auth decisions, want %d", res.Code, http.StatusOK)
+		}
+		return res.JSON.(api.QueryAuthDecisionsResponse)
+	}
+
+	if res := query(); res.Enabled || len(res.Decisions) != 0 {
+		t.Errorf("got %+v, want no decisions before recording is turned on", res)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/_dendrite/admin/auth_debug/"+roomID, strings.NewReader(`{"enabled":true}`))
+	if res := AdminAuthDebug(req, rsAPI, roomID); res.Code != http.StatusOK {
+		t.Fatalf("got status %d turning recording on, want %d", res.Code, http.StatusOK)
+	}
+	if res := query(); !res.Enabled || len(res.Decisions) != 1 {
+		t.Errorf("got %+v, want the recorded decisions", res)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/_dendrite/admin/auth_debug/"+roomID, strings.NewReader(`{"enabled":`))
+	if res := AdminAuthDebug(req, rsAPI, roomID); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a malformed request, want %d", res.Code, http.StatusBadRequest)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/auth_debug/room", nil)
+	if res := AdminAuthDebug(req, rsAPI, "room"); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid room ID, want %d", res.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAdminListRooms(t *testing.T) {
+	rsAPI := &fakeAdminRoomsRoomserverAPI{}
+
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/rooms?room_version=5&min_members=2&max_members=10&encrypted=true&public=false&order_by=joined_members&dir=b&from=20&limit=10", nil)
+	res := AdminListRooms(req, rsAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d listing rooms, want %d", res.Code, http.StatusOK)
+	}
+	if rooms := res.JSON.(api.QueryRoomsResponse).Rooms; rooms == nil {
+		t.Errorf("rooms should be an empty list, not null")
+	}
+	got := rsAPI.queried
+	if got.RoomVersion != "5" || got.MinJoinedMembers != 2 || got.MaxJoinedMembers == nil || *got.MaxJoinedMembers != 10 ||
+		got.Encrypted == nil || !*got.Encrypted || got.Public == nil || *got.Public ||
+		got.OrderBy != "joined_members" || !got.Descending || got.Offset != 20 || got.Limit != 10 {
+		t.Errorf("got query %+v", *got)
+	}
+
+	for _, query := range []string{"min_members=two", "encrypted=maybe", "dir=up", "from=-1", "limit=0"} {
+		req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/rooms?"+query, nil)
+		if res = AdminListRooms(req, rsAPI); res.Code != http.StatusBadRequest {
+			t.Errorf("got status %d for %s, want %d", res.Code, query, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// adminUser is how accounts are described by the admin API, in the same
+// format as Synapse's admin API.
+type adminUser struct {
+	Name         string `json:"name"`
+	IsGuest      bool   `json:"is_guest"`
+	Admin        bool   `json:"admin"`
+	Deactivated  bool   `json:"deactivated"`
+	AppServiceID string `json:"appservice_id,omitempty"`
+	DisplayName  string `json:"displayname,omitempty"`
+	AvatarURL    string `json:"avatar_url,omitempty"`
+}
+
+type adminUsersResponse struct {
+	Users []adminUser `json:"users"`
+	// The "from" to request the next page with, if there is one.
+	NextToken string `json:"next_token,omitempty"`
+	Total     int    `json:"total"`
+}
+
+type adminUserRequest struct {
+	Password    string  `json:"password"`
+	DisplayName *string `json:"displayname"`
+	Admin       *bool   `json:"admin"`
+	Deactivated *bool   `json:"deactivated"`
+	// Whether changing the password logs out all of the user's devices.
+	// Defaults to true if omitted.
+	LogoutDevices *bool `json:"logout_devices"`
+}
+
+type adminResetPasswordRequest struct {
+	NewPassword string `json:"new_password"`
+	// Defaults to true if omitted.
+	LogoutDevices *bool `json:"logout_devices"`
+}
+
+type adminUserAdminRequest struct {
+	Admin bool `json:"admin"`
+}
+
+type adminDeactivateRequest struct {
+	// Whether to erase the user's profile, third-party identifiers and the
+	// events they've sent, as well as deactivating the account.
+	Erase bool `json:"erase"`
+}
+
+func makeAdminUser(acc *api.Account) adminUser {
+	return adminUser{
+		Name:         acc.UserID,
+		IsGuest:      acc.IsGuest,
+		Admin:        acc.IsAdmin,
+		Deactivated:  acc.Deactivated,
+		AppServiceID: acc.AppServiceID,
+	}
+}
+
+// AdminListUsers implements:
+//     GET /_dendrite/admin/users?from=0&limit=100
+func AdminListUsers(req *http.Request, userAPI api.UserInternalAPI) util.JSONResponse {
+	query := req.URL.Query()
+	var queryReq api.QueryAccountsRequest
+	var err error
+	if v := query.Get("from"); v != "" {
+		if queryReq.Offset, err = strconv.Atoi(v); err != nil || queryReq.Offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from must be a non-negative number"),
+			}
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if queryReq.Limit, err = strconv.Atoi(v); err != nil || queryReq.Limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive number"),
+			}
+		}
+	}
+	var queryRes api.QueryAccountsResponse
+	if err = userAPI.QueryAccounts(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccounts failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := adminUsersResponse{
+		Users: make([]adminUser, 0, len(queryRes.Accounts)),
+		Total: queryRes.TotalAccounts,
+	}
+	for i := range queryRes.Accounts {
+		res.Users = append(res.Users, makeAdminUser(&queryRes.Accounts[i]))
+	}
+	if next := queryReq.Offset + len(queryRes.Accounts); len(queryRes.Accounts) > 0 && next < queryRes.TotalAccounts {
+		res.NextToken = strconv.Itoa(next)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminGetUser implements:
+//     GET /_dendrite/admin/users/{userID}
+func AdminGetUser(
+	req *http.Request, accountDB accounts.Database, userID string, cfg *config.Dendrite,
+) util.JSONResponse {
+	localpart, err := userutil.ParseUsernameParam(userID, &cfg.Matrix.ServerName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	return adminUserResponse(req.Context(), accountDB, localpart, http.StatusOK)
+}
+
+// AdminPutUser implements:
+//     PUT /_dendrite/admin/users/{userID}
+// Creates the account if it doesn't exist, otherwise updates it. Fields which
+// are left out of the request are left alone.
+func AdminPutUser(
+	req *http.Request, device *api.Device, userAPI api.UserInternalAPI, accountDB accounts.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI, stateAPI currentstateAPI.CurrentStateInternalAPI,
+	userID string, cfg *config.Dendrite,
+) util.JSONResponse {
+	ctx := req.Context()
+	localpart, err := userutil.ParseUsernameParam(userID, &cfg.Matrix.ServerName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	userID = userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+	var body adminUserRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if body.Password != "" {
+		if resErr := validatePassword(body.Password); resErr != nil {
+			return *resErr
+		}
+	}
+	if body.Admin != nil && !*body.Admin && userID == device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("You can't stop yourself from being an admin"),
+		}
+	}
+
+	acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err != nil && err != sql.ErrNoRows {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	code := http.StatusOK
+	if acc == nil {
+		if resErr := validateUsername(localpart); resErr != nil {
+			return *resErr
+		}
+		var accRes api.PerformAccountCreationResponse
+		err = userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			AccountType: api.AccountTypeUser,
+			Localpart:   localpart,
+			Password:    body.Password,
+			OnConflict:  api.ConflictAbort,
+			IsAdmin:     body.Admin != nil && *body.Admin,
+		}, &accRes)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountCreation failed")
+			return jsonerror.InternalServerError()
+		}
+		acc, code = accRes.Account, http.StatusCreated
+	} else if body.Password != "" {
+		var passwordRes api.PerformPasswordUpdateResponse
+		err = userAPI.PerformPasswordUpdate(ctx, &api.PerformPasswordUpdateRequest{
+			UserID:        userID,
+			Password:      body.Password,
+			LogoutDevices: body.LogoutDevices == nil || *body.LogoutDevices,
+		}, &passwordRes)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("userAPI.PerformPasswordUpdate failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	// Only the profile is changed, the user's membership events in their
+	// rooms are left alone.
+	if body.DisplayName != nil {
+		if err = accountDB.SetDisplayName(ctx, localpart, *body.DisplayName); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.SetDisplayName failed")
+			return jsonerror.InternalServerError()
+		}
+		if err = updateUserDirectory(ctx, accountDB, stateAPI, userID, localpart); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("updateUserDirectory failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	if body.Admin != nil && *body.Admin != acc.IsAdmin {
+		if resErr := setAdmin(ctx, userAPI, userID, *body.Admin); resErr != nil {
+			return *resErr
+		}
+	}
+	if body.Deactivated != nil && *body.Deactivated != acc.Deactivated {
+		if *body.Deactivated {
+			var deactivateRes api.PerformAccountDeactivationResponse
+			err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+				Localpart: localpart,
+			}, &deactivateRes)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
+				return jsonerror.InternalServerError()
+			}
+			leaveAllRooms(ctx, userID, rsAPI, stateAPI)
+		} else if err = accountDB.ReactivateAccount(ctx, localpart); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.ReactivateAccount failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	return adminUserResponse(ctx, accountDB, localpart, code)
+}
+
+// AdminResetPassword implements:
+//     POST /_dendrite/admin/reset_password/{userID}
+func AdminResetPassword(
+	req *http.Request, userAPI api.UserInternalAPI, accountDB accounts.Database,
+	userID string, cfg *config.Dendrite,
+) util.JSONResponse {
+	ctx := req.Context()
+	localpart, err := userutil.ParseUsernameParam(userID, &cfg.Matrix.ServerName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	var body adminResetPasswordRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if body.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'new_password' must be supplied."),
+		}
+	}
+	if resErr := validatePassword(body.NewPassword); resErr != nil {
+		return *resErr
+	}
+	if _, err = accountDB.GetAccountByLocalpart(ctx, localpart); err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist"),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var passwordRes api.PerformPasswordUpdateResponse
+	err = userAPI.PerformPasswordUpdate(ctx, &api.PerformPasswordUpdateRequest{
+		UserID:        userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+		Password:      body.NewPassword,
+		LogoutDevices: body.LogoutDevices == nil || *body.LogoutDevices,
+	}, &passwordRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformPasswordUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminUserAdmin implements:
+//     GET /_dendrite/admin/users/{userID}/admin
+//     PUT /_dendrite/admin/users/{userID}/admin
+func AdminUserAdmin(
+	req *http.Request, device *api.Device, userAPI api.UserInternalAPI, accountDB accounts.Database,
+	userID string, cfg *config.Dendrite,
+) util.JSONResponse {
+	ctx := req.Context()
+	localpart, err := userutil.ParseUsernameParam(userID, &cfg.Matrix.ServerName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	userID = userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+	acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist"),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	if req.Method == http.MethodGet {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: adminUserAdminRequest{Admin: acc.IsAdmin},
+		}
+	}
+
+	var body adminUserAdminRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if !body.Admin && userID == device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("You can't stop yourself from being an admin"),
+		}
+	}
+	if resErr := setAdmin(ctx, userAPI, userID, body.Admin); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminDeactivateUser implements:
+//     POST /_dendrite/admin/deactivate/{userID}
+func AdminDeactivateUser(
+	req *http.Request, userAPI api.UserInternalAPI, accountDB accounts.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI, stateAPI currentstateAPI.CurrentStateInternalAPI,
+	userID string, cfg *config.Dendrite,
+) util.JSONResponse {
+	ctx := req.Context()
+	localpart, err := userutil.ParseUsernameParam(userID, &cfg.Matrix.ServerName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	userID = userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+	var body adminDeactivateRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if _, err = accountDB.GetAccountByLocalpart(ctx, localpart); err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist"),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var deactivateRes api.PerformAccountDeactivationResponse
+	err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart:          localpart,
+		RemovePersonalData: body.Erase,
+	}, &deactivateRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
+		return jsonerror.InternalServerError()
+	}
+	// Redacting every event the user has sent can take a long time, so it
+	// happens after the request has been answered, along with leaving rooms.
+	go eraseAndLeaveAllRooms(context.Background(), userID, body.Erase, rsAPI, stateAPI)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: deactivateResponse{
+			// Third-party identifiers aren't unbound from identity servers.
+			IDServerUnbindResult: "no-support",
+		},
+	}
+}
+
+// eraseAndLeaveAllRooms redacts the events that a deactivated user has sent if
+// erase is set, and then makes them leave all of their rooms. The events have
+// to be redacted first, since the redactions are sent by the user. Failures are
+// only logged: events which were already redacted are skipped, so deactivating
+// the user again retries the redactions.
+func eraseAndLeaveAllRooms(
+	ctx context.Context, userID string, erase bool,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI,
+) {
+	if erase {
+		var roomsRes currentstateAPI.QueryRoomsForUserResponse
+		err := stateAPI.QueryRoomsForUser(ctx, &currentstateAPI.QueryRoomsForUserRequest{
+			UserID:         userID,
+			WantMembership: gomatrixserverlib.Join,
+		}, &roomsRes)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("user_id", userID).Error("stateAPI.QueryRoomsForUser failed")
+			return
+		}
+		var redactRes roomserverAPI.PerformUserRedactionResponse
+		rsAPI.PerformUserRedaction(ctx, &roomserverAPI.PerformUserRedactionRequest{
+			UserID:  userID,
+			RoomIDs: roomsRes.RoomIDs,
+		}, &redactRes)
+		if redactRes.Error != nil {
+			// Leaving the rooms would stop the remaining events being redacted.
+			util.GetLogger(ctx).WithError(redactRes.Error).WithField("user_id", userID).Error("rsAPI.PerformUserRedaction failed")
+			return
+		}
+		util.GetLogger(ctx).WithField("user_id", userID).Infof("Redacted %d events of erased user", redactRes.RedactedEvents)
+	}
+	leaveAllRooms(ctx, userID, rsAPI, stateAPI)
+}
+
+func setAdmin(ctx context.Context, userAPI api.UserInternalAPI, userID string, isAdmin bool) *util.JSONResponse {
+	var adminRes api.PerformAdminUpdateResponse
+	err := userAPI.PerformAdminUpdate(ctx, &api.PerformAdminUpdateRequest{
+		UserID:  userID,
+		IsAdmin: isAdmin,
+	}, &adminRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAdminUpdate failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
+
+// adminUserResponse returns the account with the given localpart, along with
+// its profile.
+func adminUserResponse(ctx context.Context, accountDB accounts.Database, localpart string, code int) util.JSONResponse {
+	acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist"),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	profile, err := accountDB.GetProfileByLocalpart(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetProfileByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	user := makeAdminUser(acc)
+	user.DisplayName = profile.DisplayName
+	user.AvatarURL = profile.AvatarURL
+	return util.JSONResponse{
+		Code: code,
+		JSON: user,
+	}
+}
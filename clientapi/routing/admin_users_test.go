@@ -0,0 +1,118 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+)
+
+func TestAdminUsers(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create devices database: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, "localhost", nil, nil, nil)
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	admin := &api.Device{UserID: "@admin:localhost"}
+	if _, err = accountDB.CreateAccount(ctx, "admin", "adminpassword", ""); err != nil {
+		t.Fatalf("failed to create the admin account: %s", err)
+	}
+
+	putUser := func(userID, body string) (int, adminUser) {
+		req := httptest.NewRequest(http.MethodPut, "/_dendrite/admin/users/"+userID, strings.NewReader(body))
+		res := AdminPutUser(req, admin, userAPI, accountDB, nil, nil, userID, cfg)
+		user, _ := res.JSON.(adminUser)
+		return res.Code, user
+	}
+
+	// Creating a user, then updating it.
+	if code, user := putUser("@alice:localhost", `{"password":"alicepassword","displayname":"Alice"}`); code != http.StatusCreated || user.Name != "@alice:localhost" || user.DisplayName != "Alice" || user.Admin {
+		t.Fatalf("got status %d and user %+v creating a user", code, user)
+	}
+	if code, user := putUser("@alice:localhost", `{"admin":true}`); code != http.StatusOK || !user.Admin || user.DisplayName != "Alice" {
+		t.Fatalf("got status %d and user %+v making the user an admin", code, user)
+	}
+	if code, _ := putUser("@alice:remote", `{}`); code != http.StatusBadRequest {
+		t.Fatalf("got status %d creating a remote user, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := putUser("@admin:localhost", `{"admin":false}`); code != http.StatusBadRequest {
+		t.Fatalf("got status %d demoting ourselves, want %d", code, http.StatusBadRequest)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_dendrite/admin/users/@alice:localhost", nil)
+	if res := AdminGetUser(req, accountDB, "@alice:localhost", cfg); res.Code != http.StatusOK || !res.JSON.(adminUser).Admin {
+		t.Fatalf("got status %d and body %+v getting the user", res.Code, res.JSON)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/users/@nobody:localhost", nil)
+	if res := AdminGetUser(req, accountDB, "@nobody:localhost", cfg); res.Code != http.StatusNotFound {
+		t.Fatalf("got status %d getting an unknown user, want %d", res.Code, http.StatusNotFound)
+	}
+
+	// The admin flag can also be changed on its own.
+	req = httptest.NewRequest(http.MethodPut, "/_dendrite/admin/users/@alice:localhost/admin", strings.NewReader(`{"admin":false}`))
+	if res := AdminUserAdmin(req, admin, userAPI, accountDB, "@alice:localhost", cfg); res.Code != http.StatusOK {
+		t.Fatalf("got status %d removing the admin flag", res.Code)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/users/@alice:localhost/admin", nil)
+	if res := AdminUserAdmin(req, admin, userAPI, accountDB, "@alice:localhost", cfg); res.Code != http.StatusOK || res.JSON.(adminUserAdminRequest).Admin {
+		t.Fatalf("got status %d and body %+v getting the admin flag", res.Code, res.JSON)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/_dendrite/admin/reset_password/@alice:localhost", strings.NewReader(`{"new_password":"newalicepassword","logout_devices":false}`))
+	if res := AdminResetPassword(req, userAPI, accountDB, "@alice:localhost", cfg); res.Code != http.StatusOK {
+		t.Fatalf("got status %d resetting the password", res.Code)
+	}
+	if _, err = accountDB.GetAccountByPassword(ctx, "alice", "newalicepassword"); err != nil {
+		t.Fatalf("expected the new password to work: %s", err)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/_dendrite/admin/reset_password/@nobody:localhost", strings.NewReader(`{"new_password":"newpassword"}`))
+	if res := AdminResetPassword(req, userAPI, accountDB, "@nobody:localhost", cfg); res.Code != http.StatusNotFound {
+		t.Fatalf("got status %d resetting the password of an unknown user, want %d", res.Code, http.StatusNotFound)
+	}
+
+	// Listing the users a page at a time.
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/users?limit=1", nil)
+	res := AdminListUsers(req, userAPI)
+	page := res.JSON.(adminUsersResponse)
+	if res.Code != http.StatusOK || page.Total != 2 || len(page.Users) != 1 || page.Users[0].Name != "@admin:localhost" || page.NextToken != "1" {
+		t.Fatalf("got status %d and body %+v listing the first page of users", res.Code, page)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/users?limit=1&from="+page.NextToken, nil)
+	res = AdminListUsers(req, userAPI)
+	page = res.JSON.(adminUsersResponse)
+	if res.Code != http.StatusOK || len(page.Users) != 1 || page.Users[0].Name != "@alice:localhost" || page.NextToken != "" {
+		t.Fatalf("got status %d and body %+v listing the last page of users", res.Code, page)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/_dendrite/admin/users?limit=0", nil)
+	if res = AdminListUsers(req, userAPI); res.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d listing users with a bad limit, want %d", res.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+// maxAnnotationsPerEvent is the most annotations, with distinct keys, which a
+// user can make on a single event.
+const maxAnnotationsPerEvent = 50
+
+// annotationKey returns the event ID and key of the annotation in the event
+// content, or empty strings if the event isn't an annotation.
+func annotationKey(content []byte) (relatesToID, key string) {
+	relatesTo := gjson.GetBytes(content, "m\\.relates_to")
+	if relatesTo.Get("rel_type").Str != "m.annotation" {
+		return "", ""
+	}
+	relatesToID, key = relatesTo.Get("event_id").Str, relatesTo.Get("key").Str
+	if relatesToID == "" || key == "" {
+		return "", ""
+	}
+	return relatesToID, key
+}
+
+// claimAnnotation stops a user from annotating an event with the same key
+// more than once, or from annotating it too many times with different keys.
+// The annotation is claimed in the roomserver before it is sent, so that
+// annotations which are sent at the same time can't both get through. The
+// claim has to be released if the event isn't sent after all.
+func claimAnnotation(
+	ctx context.Context, event *gomatrixserverlib.Event, rsAPI api.RoomserverInternalAPI,
+) *util.JSONResponse {
+	relatesToID, key := annotationKey(event.Content())
+	if relatesToID == "" || event.StateKey() != nil {
+		return nil
+	}
+
+	var res api.PerformClaimAnnotationResponse
+	err := rsAPI.PerformClaimAnnotation(ctx, &api.PerformClaimAnnotationRequest{
+		EventID:     event.EventID(),
+		RelatesToID: relatesToID,
+		Sender:      event.Sender(),
+		Type:        event.Type(),
+		Key:         key,
+		Limit:       maxAnnotationsPerEvent,
+	}, &res)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.PerformClaimAnnotation failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if res.Duplicate {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_DUPLICATE_ANNOTATION",
+				Err:     "you have already annotated this event with the same key",
+			},
+		}
+	}
+	if res.LimitReached {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(fmt.Sprintf("you can't annotate an event more than %d times", maxAnnotationsPerEvent)),
+		}
+	}
+	return nil
+}
+
+// releaseAnnotation gives up the claim on an annotation which couldn't be
+// sent, so that the user can try again.
+func releaseAnnotation(
+	ctx context.Context, event *gomatrixserverlib.Event, rsAPI api.RoomserverInternalAPI,
+) {
+	if relatesToID, _ := annotationKey(event.Content()); relatesToID == "" || event.StateKey() != nil {
+		return
+	}
+	err := rsAPI.PerformClaimAnnotation(ctx, &api.PerformClaimAnnotationRequest{
+		EventID: event.EventID(),
+		Release: true,
+	}, &api.PerformClaimAnnotationResponse{})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.PerformClaimAnnotation failed to release annotation")
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// maxBatchSendEvents is the most events, state and timeline together, which
+// can be sent in a single batch.
+const maxBatchSendEvents = 1000
+
+type batchSendRequest struct {
+	State  []batchSendEvent `json:"state"`
+	Events []batchSendEvent `json:"events"`
+}
+
+type batchSendEvent struct {
+	Type           string                      `json:"type"`
+	StateKey       *string                     `json:"state_key,omitempty"`
+	Sender         string                      `json:"sender"`
+	Content        json.RawMessage             `json:"content"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+type batchSendResponse struct {
+	StateEventIDs []string `json:"state_event_ids"`
+	EventIDs      []string `json:"event_ids"`
+}
+
+// BatchSend implements POST /_matrix/client/unstable/rooms/{roomID}/batch_send
+// This is not in the spec: it lets an application service import the history
+// of a bridged room in one request rather than one request per event. The
+// state events are sent first and then the timeline events, each in the order
+// given, with every event following on from the one before it. Events keep
+// the origin_server_ts they were given, except that an event is never older
+// than the one before it in the batch.
+//
+// If prev_event_id is given then the batch is inserted into the history of
+// the room straight after that event, in the spirit of MSC2716. The events
+// are backfilled rather than sent as new events: they don't change the
+// current state of the room, aren't sent over federation and only show up
+// for clients when paginating through /messages.
+// nolint: gocyclo
+func BatchSend(
+	req *http.Request, device *userapi.Device, roomID string,
+	cfg *config.Dendrite, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var appService *config.ApplicationService
+	for i := range cfg.Derived.ApplicationServices {
+		asToken := cfg.Derived.ApplicationServices[i].ASToken
+		if subtle.ConstantTimeCompare([]byte(asToken), []byte(device.AccessToken)) == 1 {
+			appService = &cfg.Derived.ApplicationServices[i]
+			break
+		}
+	}
+	if appService == nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Only application services can send events in bulk"),
+		}
+	}
+
+	var r batchSendRequest
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+	if len(r.State)+len(r.Events) > maxBatchSendEvents {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(fmt.Sprintf("A batch can contain at most %d events", maxBatchSendEvents)),
+		}
+	}
+	senderUserID := fmt.Sprintf("@%s:%s", appService.SenderLocalpart, cfg.Matrix.ServerName)
+	batch := append(append([]batchSendEvent{}, r.State...), r.Events...)
+	for i, ev := range batch {
+		if i < len(r.State) && ev.StateKey == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("State event %d has no state_key", i)),
+			}
+		}
+		if ev.Sender != senderUserID && !appService.IsInterestedInUserID(ev.Sender) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(fmt.Sprintf("Sender %s is outside of the application service's namespace", ev.Sender)),
+			}
+		}
+		if _, domain, err := gomatrixserverlib.SplitID('@', ev.Sender); err != nil || domain != cfg.Matrix.ServerName {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("Sender %s must be a local user", ev.Sender)),
+			}
+		}
+	}
+
+	builders := make([]gomatrixserverlib.EventBuilder, len(batch))
+	for i, ev := range batch {
+		builders[i] = gomatrixserverlib.EventBuilder{
+			Sender:   ev.Sender,
+			RoomID:   roomID,
+			Type:     ev.Type,
+			StateKey: ev.StateKey,
+		}
+		content := ev.Content
+		if len(content) == 0 {
+			content = json.RawMessage("{}")
+		}
+		if err := builders[i].SetContent(content); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("Event %d has invalid content: %s", i, err)),
+			}
+		}
+	}
+
+	ctx := req.Context()
+	var start *batchSendStart
+	prevEventID := req.URL.Query().Get("prev_event_id")
+	if prevEventID != "" {
+		start, resErr = historicalBatchStart(ctx, rsAPI, roomID, prevEventID, builders)
+	} else {
+		start, resErr = latestBatchStart(ctx, rsAPI, roomID)
+	}
+	if resErr != nil {
+		return *resErr
+	}
+
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range start.state {
+		if err := authEvents.AddEvent(&start.state[i].Event); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("authEvents.AddEvent failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	prevEvents := start.prevEvents
+	depth := start.depth
+	var lastTS time.Time
+	builtEvents := make([]gomatrixserverlib.HeaderedEvent, 0, len(batch))
+	for i, ev := range batch {
+		builder := &builders[i]
+		builder.Depth = depth
+		builder.PrevEvents = prevEvents
+
+		evTime := time.Now()
+		if ev.OriginServerTS != 0 {
+			evTime = ev.OriginServerTS.Time()
+		}
+		if evTime.Before(lastTS) {
+			evTime = lastTS
+		}
+		lastTS = evTime
+
+		built, err := buildEvent(builder, &authEvents, cfg, evTime, start.roomVersion)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("Event %d is invalid: %s", i, err)),
+			}
+		}
+		if err = gomatrixserverlib.Allowed(*built, &authEvents); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(fmt.Sprintf("Event %d is not allowed: %s", i, err)),
+			}
+		}
+		if built.StateKey() != nil {
+			if err = authEvents.AddEvent(built); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("authEvents.AddEvent failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		builtEvents = append(builtEvents, built.Headered(start.roomVersion))
+		prevEvents = []gomatrixserverlib.EventReference{built.EventReference()}
+		if !start.historical {
+			depth++
+		}
+	}
+
+	if len(builtEvents) > 0 {
+		var err error
+		if start.historical {
+			_, err = roomserverAPI.SendInputRoomEvents(ctx, rsAPI, historicalInputEvents(builtEvents))
+		} else {
+			_, err = roomserverAPI.SendEvents(ctx, rsAPI, builtEvents, cfg.Matrix.ServerName, nil)
+		}
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Sending batch to roomserver failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	util.GetLogger(ctx).WithFields(logrus.Fields{
+		"room_id":         roomID,
+		"appservice_id":   appService.ID,
+		"state_events":    len(r.State),
+		"timeline_events": len(r.Events),
+		"prev_event_id":   prevEventID,
+	}).Info("Sent batch of events to roomserver")
+
+	res := batchSendResponse{
+		StateEventIDs: []string{},
+		EventIDs:      []string{},
+	}
+	for i, ev := range builtEvents {
+		if i < len(r.State) {
+			res.StateEventIDs = append(res.StateEventIDs, ev.EventID())
+		} else {
+			res.EventIDs = append(res.EventIDs, ev.EventID())
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// batchSendStart is the point in the room which a batch follows on from.
+type batchSendStart struct {
+	roomVersion gomatrixserverlib.RoomVersion
+	// The state which the first event in the batch is authorised against.
+	state      []gomatrixserverlib.HeaderedEvent
+	prevEvents []gomatrixserverlib.EventReference
+	depth      int64
+	// Whether the batch is being inserted into the past of the room rather
+	// than after the latest events.
+	historical bool
+}
+
+// latestBatchStart returns the point after the latest events in the room, so
+// that the batch is sent as new events.
+func latestBatchStart(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) (*batchSendStart, *util.JSONResponse) {
+	var queryRes roomserverAPI.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, &queryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if !queryRes.RoomExists {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+	prevEvents := queryRes.LatestEvents
+	if len(prevEvents) > 20 {
+		prevEvents = prevEvents[:20]
+	}
+	return &batchSendStart{
+		roomVersion: queryRes.RoomVersion,
+		state:       queryRes.StateEvents,
+		prevEvents:  prevEvents,
+		depth:       queryRes.Depth,
+	}, nil
+}
+
+// historicalBatchStart returns the point just after the given event, so that
+// the batch is inserted into the history of the room. Every event in the
+// batch is given the depth of that event, which orders the batch after it but
+// before anything that followed it in the room.
+func historicalBatchStart(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomID, prevEventID string, builders []gomatrixserverlib.EventBuilder,
+) (*batchSendStart, *util.JSONResponse) {
+	var eventsRes roomserverAPI.QueryEventsByIDResponse
+	if err := rsAPI.QueryEventsByID(ctx, &roomserverAPI.QueryEventsByIDRequest{
+		EventIDs: []string{prevEventID},
+	}, &eventsRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryEventsByID failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("prev_event_id was not found in the room"),
+		}
+	}
+	prevEvent := eventsRes.Events[0]
+
+	// Only fetch the state needed to authorise the events in the batch.
+	var stateNeeded []gomatrixserverlib.StateKeyTuple
+	seen := map[gomatrixserverlib.StateKeyTuple]bool{}
+	for i := range builders {
+		eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builders[i])
+		if err != nil {
+			return nil, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("Event %d is invalid: %s", i, err)),
+			}
+		}
+		for _, tuple := range eventsNeeded.Tuples() {
+			if !seen[tuple] {
+				seen[tuple] = true
+				stateNeeded = append(stateNeeded, tuple)
+			}
+		}
+	}
+	var stateRes roomserverAPI.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &roomserverAPI.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{prevEventID},
+		StateToFetch: stateNeeded,
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryStateAfterEvents failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if !stateRes.RoomExists || !stateRes.PrevEventsExist {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The state at prev_event_id is not known"),
+		}
+	}
+	return &batchSendStart{
+		roomVersion: stateRes.RoomVersion,
+		state:       stateRes.StateEvents,
+		prevEvents:  []gomatrixserverlib.EventReference{prevEvent.EventReference()},
+		depth:       prevEvent.Depth(),
+		historical:  true,
+	}, nil
+}
+
+// historicalInputEvents sends the events to the roomserver as backfilled
+// events, so that they don't become the latest events in the room or get sent
+// to clients and other servers as new messages.
+func historicalInputEvents(events []gomatrixserverlib.HeaderedEvent) []roomserverAPI.InputRoomEvent {
+	ires := make([]roomserverAPI.InputRoomEvent, len(events))
+	for i, event := range events {
+		ires[i] = roomserverAPI.InputRoomEvent{
+			Kind:         roomserverAPI.KindBackfill,
+			Event:        event,
+			AuthEventIDs: event.AuthEventIDs(),
+			SendAsServer: roomserverAPI.DoNotSendToOtherServers,
+		}
+	}
+	return ires
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// maxBulkInvites is the most users which can be invited in a single request.
+// The invites are sent one at a time, so that each one follows on from the
+// last in the room, and invites to remote users wait for the remote server
+// to sign them, so this is kept small enough for a request not to take
+// too long.
+const maxBulkInvites = 100
+
+type bulkInviteRequest struct {
+	UserIDs []string `json:"user_ids"`
+	Reason  string   `json:"reason"`
+}
+
+type bulkInviteResponse struct {
+	Invited []string               `json:"invited"`
+	Failed  map[string]interface{} `json:"failed"`
+}
+
+// BulkInvite implements POST /_matrix/client/unstable/rooms/{roomID}/bulk_invite
+// This is not in the spec: it invites many users to a room in one request.
+// Each invite succeeds or fails on its own, and the response lists the users
+// who were invited along with the error for each user who wasn't.
+func BulkInvite(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device,
+	roomID string, cfg *config.Dendrite,
+	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+) util.JSONResponse {
+	var body bulkInviteRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if len(body.UserIDs) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'user_ids' must be supplied."),
+		}
+	}
+	if len(body.UserIDs) > maxBulkInvites {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("At most %d users can be invited at once", maxBulkInvites)),
+		}
+	}
+	evTime, err := httputil.ParseTSParam(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	verReq := roomserverAPI.QueryRoomVersionForRoomRequest{RoomID: roomID}
+	verRes := roomserverAPI.QueryRoomVersionForRoomResponse{}
+	if err = rsAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+
+	res := bulkInviteResponse{
+		Invited: []string{},
+		Failed:  map[string]interface{}{},
+	}
+	seen := make(map[string]bool, len(body.UserIDs))
+	for _, userID := range body.UserIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		if _, _, err = gomatrixserverlib.SplitID('@', userID); err != nil {
+			res.Failed[userID] = jsonerror.InvalidArgumentValue("Invalid user ID")
+			continue
+		}
+		inviteRes := sendInvite(
+			req.Context(), accountDB, device, roomID, userID, body.Reason,
+			cfg, evTime, verRes.RoomVersion, rsAPI, asAPI,
+		)
+		if inviteRes.Code == http.StatusOK {
+			res.Invited = append(res.Invited, userID)
+		} else {
+			res.Failed[userID] = inviteRes.JSON
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// fakeBulkInviteRoomserverAPI only implements the APIs used to send invites.
+// It checks that each invite follows on from the one before it.
+type fakeBulkInviteRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	latest  gomatrixserverlib.EventReference
+	depth   int64
+	invited []string
+	forked  bool
+}
+
+func (r *fakeBulkInviteRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context, req *api.QueryRoomVersionForRoomRequest, res *api.QueryRoomVersionForRoomResponse,
+) error {
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	return nil
+}
+
+func (r *fakeBulkInviteRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse,
+) error {
+	res.RoomExists = true
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	res.LatestEvents = []gomatrixserverlib.EventReference{r.latest}
+	res.Depth = r.depth + 1
+	return nil
+}
+
+func (r *fakeBulkInviteRoomserverAPI) PerformInvite(
+	ctx context.Context, req *api.PerformInviteRequest, res *api.PerformInviteResponse,
+) {
+	if *req.Event.StateKey() == "@banned:remote" {
+		res.Error = &api.PerformError{Code: api.PerformErrorNotAllowed, Msg: "banned"}
+		return
+	}
+	if prev := req.Event.PrevEventIDs(); len(prev) != 1 || prev[0] != r.latest.EventID {
+		r.forked = true
+	}
+	r.latest = req.Event.EventReference()
+	r.depth++
+	r.invited = append(r.invited, *req.Event.StateKey())
+}
+
+func TestBulkInvite(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:auto"
+	cfg.Matrix.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rsAPI := &fakeBulkInviteRoomserverAPI{latest: gomatrixserverlib.EventReference{EventID: "$create"}}
+	device := &userapi.Device{UserID: "@alice:localhost"}
+
+	bulkInvite := func(userIDs []string) util.JSONResponse {
+		body, err := json.Marshal(bulkInviteRequest{UserIDs: userIDs})
+		if err != nil {
+			t.Fatalf("failed to marshal the request: %s", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/unstable/rooms/!room:localhost/bulk_invite", strings.NewReader(string(body)))
+		return BulkInvite(req, nil, device, "!room:localhost", cfg, rsAPI, nil)
+	}
+
+	userIDs := []string{"@bob:remote", "@charlie:remote", "@bob:remote", "not a user", "@banned:remote", "@dave:other"}
+	res := bulkInvite(userIDs)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	invites := res.JSON.(bulkInviteResponse)
+	want := []string{"@bob:remote", "@charlie:remote", "@dave:other"}
+	if strings.Join(invites.Invited, ",") != strings.Join(want, ",") || strings.Join(rsAPI.invited, ",") != strings.Join(want, ",") {
+		t.Fatalf("got invited %v and sent %v, want %v", invites.Invited, rsAPI.invited, want)
+	}
+	if _, ok := invites.Failed["not a user"]; !ok || len(invites.Failed) != 2 {
+		t.Fatalf("expected the invalid user ID to fail, got %+v", invites.Failed)
+	}
+	if _, ok := invites.Failed["@banned:remote"]; !ok {
+		t.Fatalf("expected the rejected invite to fail, got %+v", invites.Failed)
+	}
+	// Each invite has to build on the one before, rather than all of them
+	// branching off the same events.
+	if rsAPI.forked {
+		t.Fatalf("an invite was not built on top of the previous one")
+	}
+
+	tooMany := make([]string, maxBulkInvites+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("@user%d:remote", i)
+	}
+	if res = bulkInvite(tooMany); res.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d for %d users, want %d", res.Code, len(tooMany), http.StatusBadRequest)
+	}
+}
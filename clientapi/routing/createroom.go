@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -38,16 +39,17 @@ import (
 
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 type createRoomRequest struct {
-	Invite          []string                      `json:"invite"`
-	Name            string                        `json:"name"`
-	Visibility      string                        `json:"visibility"`
-	Topic           string                        `json:"topic"`
-	Preset          string                        `json:"preset"`
-	CreationContent map[string]interface{}        `json:"creation_content"`
-	InitialState    []fledglingEvent              `json:"initial_state"`
-	RoomAliasName   string                        `json:"room_alias_name"`
-	GuestCanJoin    bool                          `json:"guest_can_join"`
-	RoomVersion     gomatrixserverlib.RoomVersion `json:"room_version"`
+	Invite                    []string                      `json:"invite"`
+	Name                      string                        `json:"name"`
+	Visibility                string                        `json:"visibility"`
+	Topic                     string                        `json:"topic"`
+	Preset                    string                        `json:"preset"`
+	CreationContent           map[string]interface{}        `json:"creation_content"`
+	InitialState              []fledglingEvent              `json:"initial_state"`
+	RoomAliasName             string                        `json:"room_alias_name"`
+	GuestCanJoin              bool                          `json:"guest_can_join"`
+	RoomVersion               gomatrixserverlib.RoomVersion `json:"room_version"`
+	PowerLevelContentOverride json.RawMessage               `json:"power_level_content_override"`
 }
 
 const (
@@ -58,6 +60,9 @@ const (
 
 const (
 	historyVisibilityShared = "shared"
+	// encryptionAlgorithmMegolm is the algorithm used for rooms which are
+	// encrypted by default.
+	encryptionAlgorithmMegolm = "m.megolm.v1.aes-sha2"
 	// TODO: These should be implemented once history visibility is implemented
 	// historyVisibilityWorldReadable = "world_readable"
 	// historyVisibilityInvited       = "invited"
@@ -119,6 +124,17 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 	return nil
 }
 
+// hasInitialState returns whether the request's initial_state contains an
+// event of the given type.
+func (r createRoomRequest) hasInitialState(eventType string) bool {
+	for _, e := range r.InitialState {
+		if e.Type == eventType {
+			return true
+		}
+	}
+	return false
+}
+
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 type createRoomResponse struct {
 	RoomID    string `json:"room_id"`
@@ -142,19 +158,6 @@ func CreateRoom(
 	// TODO (#267): Check room ID doesn't clash with an existing one, and we
 	//              probably shouldn't be using pseudo-random strings, maybe GUIDs?
 	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
-	return createRoom(req, device, cfg, roomID, accountDB, rsAPI, asAPI)
-}
-
-// createRoom implements /createRoom
-// nolint: gocyclo
-func createRoom(
-	req *http.Request, device *api.Device,
-	cfg *config.Dendrite, roomID string,
-	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
-	asAPI appserviceAPI.AppServiceQueryAPI,
-) util.JSONResponse {
-	logger := util.GetLogger(req.Context())
-	userID := device.UserID
 	var r createRoomRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
 	if resErr != nil {
@@ -162,8 +165,17 @@ func createRoom(
 	}
 	// TODO: apply rate-limit
 
-	if resErr = r.Validate(); resErr != nil {
-		return *resErr
+	if !cfg.Matrix.RoomCreation.MayCreateRoom(device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to create rooms on this server"),
+		}
+	}
+	if r.RoomAliasName != "" && !cfg.Matrix.RoomCreation.MayCreateAlias(device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to create room aliases on this server"),
+		}
 	}
 
 	evTime, err := httputil.ParseTSParam(req)
@@ -173,6 +185,36 @@ func createRoom(
 			JSON: jsonerror.InvalidArgumentValue(err.Error()),
 		}
 	}
+	return createRoom(req.Context(), r, device, cfg, roomID, accountDB, rsAPI, asAPI, evTime)
+}
+
+// createRoom implements /createRoom. The server's room creation policy has
+// to have been checked already, since server notices rooms are exempt from it.
+// nolint: gocyclo
+func createRoom(
+	ctx context.Context, r createRoomRequest, device *api.Device,
+	cfg *config.Dendrite, roomID string,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+	asAPI appserviceAPI.AppServiceQueryAPI, evTime time.Time,
+) util.JSONResponse {
+	logger := util.GetLogger(ctx)
+	userID := device.UserID
+	if resErr := r.Validate(); resErr != nil {
+		return *resErr
+	}
+
+	// The server's defaults are applied first so that the request can
+	// override them in turn.
+	powerLevelContent := eventutil.InitialPowerLevelsContent(userID)
+	cfg.Matrix.RoomCreation.PowerLevelContentOverride.Apply(&powerLevelContent)
+	if len(r.PowerLevelContentOverride) > 0 {
+		if err := json.Unmarshal(r.PowerLevelContentOverride, &powerLevelContent); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("malformed power_level_content_override"),
+			}
+		}
+	}
 
 	// Clobber keys: creator, room_version
 
@@ -205,9 +247,9 @@ func createRoom(
 		"roomVersion": r.CreationContent["room_version"],
 	}).Info("Creating new room")
 
-	profile, err := appserviceAPI.RetrieveUserProfile(req.Context(), userID, asAPI, accountDB)
+	profile, err := appserviceAPI.RetrieveUserProfile(ctx, userID, asAPI, accountDB)
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("appserviceAPI.RetrieveUserProfile failed")
+		util.GetLogger(ctx).WithError(err).Error("appserviceAPI.RetrieveUserProfile failed")
 		return jsonerror.InternalServerError()
 	}
 
@@ -220,13 +262,16 @@ func createRoom(
 		}
 
 		var aliasResp roomserverAPI.GetRoomIDForAliasResponse
-		err = rsAPI.GetRoomIDForAlias(req.Context(), &hasAliasReq, &aliasResp)
+		err = rsAPI.GetRoomIDForAlias(ctx, &hasAliasReq, &aliasResp)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+			util.GetLogger(ctx).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
 			return jsonerror.InternalServerError()
 		}
 		if aliasResp.RoomID != "" {
-			return util.MessageResponse(400, "Alias already exists")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.RoomInUse("Alias already exists"),
+			}
 		}
 	}
 
@@ -265,20 +310,21 @@ func createRoom(
 	//  5- m.room.history_visibility
 	//  6- m.room.canonical_alias (opt)
 	//  7- m.room.guest_access (opt)
-	//  8- other initial state items
-	//  9- m.room.name (opt)
-	//  10- m.room.topic (opt)
-	//  11- invite events (opt) - with is_direct flag if applicable TODO
-	//  12- 3pid invite events (opt) TODO
-	//  13- m.room.aliases event for HS (if alias specified) TODO
-	// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
+	//  8- m.room.encryption (opt)
+	//  9- other initial state items
+	//  10- m.room.name (opt)
+	//  11- m.room.topic (opt)
+	//  12- invite events (opt) - with is_direct flag if applicable TODO
+	//  13- 3pid invite events (opt) TODO
+	//  14- m.room.aliases event for HS (if alias specified) TODO
+	// This differs from Synapse slightly. Synapse would vary the ordering of 3-8
 	// depending on if those events were in "initial_state" or not. This made it
 	// harder to reason about, hence sticking to a strict static ordering.
 	// TODO: Synapse has txn/token ID on each event. Do we need to do this here?
 	eventsToMake := []fledglingEvent{
 		{"m.room.create", "", r.CreationContent},
 		{"m.room.member", userID, membershipContent},
-		{"m.room.power_levels", "", eventutil.InitialPowerLevelsContent(userID)},
+		{"m.room.power_levels", "", powerLevelContent},
 		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: joinRules}},
 		{"m.room.history_visibility", "", eventutil.HistoryVisibilityContent{HistoryVisibility: historyVisibility}},
 	}
@@ -291,6 +337,9 @@ func createRoom(
 	if r.GuestCanJoin {
 		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.guest_access", "", eventutil.GuestAccessContent{GuestAccess: "can_join"}})
 	}
+	if cfg.Matrix.RoomCreation.EncryptPrivateRooms && joinRules == gomatrixserverlib.Invite && !r.hasInitialState("m.room.encryption") {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.encryption", "", eventutil.EncryptionContent{Algorithm: encryptionAlgorithmMegolm}})
+	}
 	eventsToMake = append(eventsToMake, r.InitialState...)
 	if r.Name != "" {
 		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.name", "", eventutil.NameContent{Name: r.Name}})
@@ -314,7 +363,7 @@ func createRoom(
 		}
 		err = builder.SetContent(e.Content)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+			util.GetLogger(ctx).WithError(err).Error("builder.SetContent failed")
 			return jsonerror.InternalServerError()
 		}
 		if i > 0 {
@@ -323,12 +372,12 @@ func createRoom(
 		var ev *gomatrixserverlib.Event
 		ev, err = buildEvent(&builder, &authEvents, cfg, evTime, roomVersion)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("buildEvent failed")
+			util.GetLogger(ctx).WithError(err).Error("buildEvent failed")
 			return jsonerror.InternalServerError()
 		}
 
 		if err = gomatrixserverlib.Allowed(*ev, &authEvents); err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.Allowed failed")
+			util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.Allowed failed")
 			return jsonerror.InternalServerError()
 		}
 
@@ -336,15 +385,15 @@ func createRoom(
 		builtEvents = append(builtEvents, (*ev).Headered(roomVersion))
 		err = authEvents.AddEvent(ev)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("authEvents.AddEvent failed")
+			util.GetLogger(ctx).WithError(err).Error("authEvents.AddEvent failed")
 			return jsonerror.InternalServerError()
 		}
 	}
 
 	// send events to the room server
-	_, err = roomserverAPI.SendEvents(req.Context(), rsAPI, builtEvents, cfg.Matrix.ServerName, nil)
+	_, err = roomserverAPI.SendEvents(ctx, rsAPI, builtEvents, cfg.Matrix.ServerName, nil)
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
+		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
 
@@ -359,14 +408,17 @@ func createRoom(
 		}
 
 		var aliasResp roomserverAPI.SetRoomAliasResponse
-		err = rsAPI.SetRoomAlias(req.Context(), &aliasReq, &aliasResp)
+		err = rsAPI.SetRoomAlias(ctx, &aliasReq, &aliasResp)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.SetRoomAlias failed")
+			util.GetLogger(ctx).WithError(err).Error("aliasAPI.SetRoomAlias failed")
 			return jsonerror.InternalServerError()
 		}
 
 		if aliasResp.AliasExists {
-			return util.MessageResponse(400, "Alias already exists")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.RoomInUse("Alias already exists"),
+			}
 		}
 	}
 
@@ -374,11 +426,11 @@ func createRoom(
 	for _, invitee := range r.Invite {
 		// Build the invite event.
 		inviteEvent, err := buildMembershipEvent(
-			req.Context(), invitee, "", accountDB, device, gomatrixserverlib.Invite,
+			ctx, invitee, "", accountDB, device, gomatrixserverlib.Invite,
 			roomID, true, cfg, evTime, rsAPI, asAPI,
 		)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
+			util.GetLogger(ctx).WithError(err).Error("buildMembershipEvent failed")
 			continue
 		}
 		// Build some stripped state for the invite.
@@ -399,13 +451,13 @@ func createRoom(
 		}
 		// Send the invite event to the roomserver.
 		if perr := roomserverAPI.SendInvite(
-			req.Context(), rsAPI,
+			ctx, rsAPI,
 			inviteEvent.Headered(roomVersion),
 			strippedState,         // invite room state
 			cfg.Matrix.ServerName, // send as server
 			nil,                   // transaction ID
 		); perr != nil {
-			util.GetLogger(req.Context()).WithError(perr).Error("SendInvite failed")
+			util.GetLogger(ctx).WithError(perr).Error("SendInvite failed")
 			return perr.JSONResponse()
 		}
 	}
@@ -413,13 +465,13 @@ func createRoom(
 	if r.Visibility == "public" {
 		// expose this room in the published room list
 		var pubRes roomserverAPI.PerformPublishResponse
-		rsAPI.PerformPublish(req.Context(), &roomserverAPI.PerformPublishRequest{
+		rsAPI.PerformPublish(ctx, &roomserverAPI.PerformPublishRequest{
 			RoomID:     roomID,
 			Visibility: "public",
 		}, &pubRes)
 		if pubRes.Error != nil {
 			// treat as non-fatal since the room is already made by this point
-			util.GetLogger(req.Context()).WithError(pubRes.Error).Error("failed to visibility:public")
+			util.GetLogger(ctx).WithError(pubRes.Error).Error("failed to visibility:public")
 		}
 	}
 
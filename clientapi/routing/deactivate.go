@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type deactivateResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// Deactivate handles POST requests to /account/deactivate
+func Deactivate(
+	req *http.Request,
+	userInteractiveAuth *auth.UserInteractive,
+	userAPI api.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI,
+	device *api.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// make sure that the access token being used matches the login creds used for user interactive auth, else
+	// 1 compromised access token could be used to deactivate the account.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot deactivate another user's account"),
+		}
+	}
+
+	var deactivateRes api.PerformAccountDeactivationResponse
+	err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart: localpart,
+	}, &deactivateRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
+		return jsonerror.InternalServerError()
+	}
+
+	leaveAllRooms(ctx, device.UserID, rsAPI, stateAPI)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: deactivateResponse{
+			// Third-party identifiers aren't unbound from identity servers.
+			IDServerUnbindResult: "no-support",
+		},
+	}
+}
+
+// leaveAllRooms makes a deactivated user leave all of the rooms that they are
+// joined to. The account can't be used any more, so failing to leave its rooms
+// is only logged rather than failing the request.
+func leaveAllRooms(
+	ctx context.Context, userID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI,
+) {
+	var roomsRes currentstateAPI.QueryRoomsForUserResponse
+	err := stateAPI.QueryRoomsForUser(ctx, &currentstateAPI.QueryRoomsForUserRequest{
+		UserID:         userID,
+		WantMembership: gomatrixserverlib.Join,
+	}, &roomsRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("stateAPI.QueryRoomsForUser failed")
+	}
+	for _, roomID := range roomsRes.RoomIDs {
+		leaveRes := roomserverAPI.PerformLeaveResponse{}
+		err = rsAPI.PerformLeave(ctx, &roomserverAPI.PerformLeaveRequest{
+			RoomID: roomID,
+			UserID: userID,
+		}, &leaveRes)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("rsAPI.PerformLeave failed")
+		}
+	}
+}
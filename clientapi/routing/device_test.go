@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	userapiAPI "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestGuestsCantDeleteDevices(t *testing.T) {
+	ctx := context.Background()
+	routes := setupTestRoutes(t)
+	publicAPIMux, deviceDB, userAPI := routes.publicAPIMux, routes.deviceDB, routes.userAPI
+
+	var guestRes userapiAPI.PerformAccountCreationResponse
+	if err := userAPI.PerformAccountCreation(ctx, &userapiAPI.PerformAccountCreationRequest{AccountType: userapiAPI.AccountTypeGuest}, &guestRes); err != nil {
+		t.Fatalf("PerformAccountCreation failed: %s", err)
+	}
+	deviceID := "GUESTDEVICE"
+	if _, err := deviceDB.CreateDevice(ctx, guestRes.Account.Localpart, &deviceID, "guest_token", nil); err != nil {
+		t.Fatalf("failed to make device: %s", err)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodGet, "/_matrix/client/r0/devices", "", http.StatusOK},
+		{http.MethodDelete, "/_matrix/client/r0/devices/" + deviceID, "{}", http.StatusForbidden},
+		{http.MethodPost, "/_matrix/client/r0/delete_devices", `{"devices":["` + deviceID + `"]}`, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer guest_token")
+		rec := httptest.NewRecorder()
+		publicAPIMux.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s %s: got status %d, want %d: %s", tc.method, tc.path, rec.Code, tc.code, rec.Body.String())
+		}
+		if tc.code == http.StatusForbidden && !strings.Contains(rec.Body.String(), "M_GUEST_ACCESS_FORBIDDEN") {
+			t.Errorf("%s %s: got %s, want M_GUEST_ACCESS_FORBIDDEN", tc.method, tc.path, rec.Body.String())
+		}
+	}
+	if _, err := deviceDB.GetDeviceByID(ctx, guestRes.Account.Localpart, deviceID); err != nil {
+		t.Fatalf("the guest's device was deleted: %s", err)
+	}
+}
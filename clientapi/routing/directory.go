@@ -15,6 +15,8 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -23,6 +25,7 @@ import (
 	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/userapi/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -46,7 +49,6 @@ func (r *roomDirectoryResponse) fillServers(servers []gomatrixserverlib.ServerNa
 func DirectoryRoom(
 	req *http.Request,
 	roomAlias string,
-	federation *gomatrixserverlib.FederationClient,
 	cfg *config.Dendrite,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	fedSenderAPI federationSenderAPI.FederationSenderInternalAPI,
@@ -75,15 +77,19 @@ func DirectoryRoom(
 		// If we don't know it locally, do a federation query.
 		// But don't send the query to ourselves.
 		if domain != cfg.Matrix.ServerName {
-			fedRes, fedErr := federation.LookupRoomAlias(req.Context(), domain, roomAlias)
-			if fedErr != nil {
+			fedReq := federationSenderAPI.PerformDirectoryLookupRequest{
+				RoomAlias:  roomAlias,
+				ServerName: domain,
+			}
+			var fedRes federationSenderAPI.PerformDirectoryLookupResponse
+			if fedErr := fedSenderAPI.PerformDirectoryLookup(req.Context(), &fedReq, &fedRes); fedErr != nil {
 				// TODO: Return 502 if the remote server errored.
 				// TODO: Return 504 if the remote server timed out.
-				util.GetLogger(req.Context()).WithError(fedErr).Error("federation.LookupRoomAlias failed")
+				util.GetLogger(req.Context()).WithError(fedErr).Error("fedSenderAPI.PerformDirectoryLookup failed")
 				return jsonerror.InternalServerError()
 			}
 			res.RoomID = fedRes.RoomID
-			res.fillServers(fedRes.Servers)
+			res.fillServers(fedRes.ServerNames)
 		}
 
 		if res.RoomID == "" {
@@ -133,6 +139,14 @@ func SetLocalAlias(
 			JSON: jsonerror.Forbidden("Alias must be on local homeserver"),
 		}
 	}
+	// The policy covers every alias a user makes, not just the ones made
+	// along with a room by /createRoom.
+	if !cfg.Matrix.RoomCreation.MayCreateAlias(device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to create room aliases on this server"),
+		}
+	}
 
 	// Check that the alias does not fall within an exclusive namespace of an
 	// application service
@@ -212,10 +226,31 @@ func RemoveLocalAlias(
 	}
 
 	if creatorQueryRes.UserID != device.UserID {
+		// Members who may change the canonical alias of the room may also
+		// delete any of its aliases.
 		// TODO: Still allow deletion if user is admin
-		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("You do not have permission to delete this alias"),
+		var roomIDRes roomserverAPI.GetRoomIDForAliasResponse
+		err := aliasAPI.GetRoomIDForAlias(req.Context(), &roomserverAPI.GetRoomIDForAliasRequest{Alias: alias}, &roomIDRes)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+			return jsonerror.InternalServerError()
+		}
+		plTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}
+		state, err := queryRoomState(req.Context(), aliasAPI, roomIDRes.RoomID, plTuple, memberTuple(device.UserID))
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("queryRoomState failed")
+			return jsonerror.InternalServerError()
+		}
+		allowed := false
+		if plEvent, ok := state[plTuple]; ok && isJoined(state, device.UserID) {
+			power, _ := gomatrixserverlib.NewPowerLevelContentFromEvent(*plEvent)
+			allowed = power.UserLevel(device.UserID) >= power.EventLevel(gomatrixserverlib.MRoomCanonicalAlias, true)
+		}
+		if !allowed {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You do not have permission to delete this alias"),
+			}
 		}
 	}
 
@@ -235,6 +270,84 @@ func RemoveLocalAlias(
 	}
 }
 
+type roomAliasesResponse struct {
+	Aliases []string `json:"aliases"`
+}
+
+// GetRoomAliases implements GET /rooms/{roomID}/aliases
+func GetRoomAliases(
+	req *http.Request, device *api.Device,
+	roomID string, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	hvTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""}
+	state, err := queryRoomState(req.Context(), rsAPI, roomID, hvTuple, memberTuple(device.UserID))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryRoomState failed")
+		return jsonerror.InternalServerError()
+	}
+	// Anyone can see the aliases of world-readable rooms.
+	var visibility eventutil.HistoryVisibilityContent
+	if hvEvent, ok := state[hvTuple]; ok {
+		_ = json.Unmarshal(hvEvent.Content(), &visibility)
+	}
+	if visibility.HistoryVisibility != "world_readable" && !isJoined(state, device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room and it isn't world-readable"),
+		}
+	}
+
+	var res roomserverAPI.GetAliasesForRoomIDResponse
+	if err = rsAPI.GetAliasesForRoomID(req.Context(), &roomserverAPI.GetAliasesForRoomIDRequest{RoomID: roomID}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetAliasesForRoomID failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Aliases == nil {
+		res.Aliases = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomAliasesResponse{res.Aliases},
+	}
+}
+
+func memberTuple(userID string) gomatrixserverlib.StateKeyTuple {
+	return gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}
+}
+
+// queryRoomState returns the current state events of a room with the given
+// types and state keys. State which isn't set is left out.
+func queryRoomState(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomID string, tuples ...gomatrixserverlib.StateKeyTuple,
+) (map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event, error) {
+	var res roomserverAPI.QueryLatestEventsAndStateResponse
+	err := rsAPI.QueryLatestEventsAndState(ctx, &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: tuples,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event, len(res.StateEvents))
+	for i := range res.StateEvents {
+		event := &res.StateEvents[i].Event
+		state[gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}] = event
+	}
+	return state, nil
+}
+
+// isJoined returns whether the state from queryRoomState includes the user's
+// membership, and they are joined.
+func isJoined(state map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event, userID string) bool {
+	event, ok := state[memberTuple(userID)]
+	if !ok {
+		return false
+	}
+	membership, err := event.Membership()
+	return err == nil && membership == gomatrixserverlib.Join
+}
+
 type roomVisibility struct {
 	Visibility string `json:"visibility"`
 }
@@ -244,8 +357,17 @@ func GetVisibility(
 	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
 	roomID string,
 ) util.JSONResponse {
+	var verRes roomserverAPI.QueryRoomVersionForRoomResponse
+	err := rsAPI.QueryRoomVersionForRoom(req.Context(), &roomserverAPI.QueryRoomVersionForRoomRequest{RoomID: roomID}, &verRes)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+
 	var res roomserverAPI.QueryPublishedRoomsResponse
-	err := rsAPI.QueryPublishedRooms(req.Context(), &roomserverAPI.QueryPublishedRoomsRequest{
+	err = rsAPI.QueryPublishedRooms(req.Context(), &roomserverAPI.QueryPublishedRoomsRequest{
 		RoomID: roomID,
 	}, &res)
 	if err != nil {
@@ -304,6 +426,12 @@ func SetVisibility(
 	if reqErr := httputil.UnmarshalJSONRequest(req, &v); reqErr != nil {
 		return *reqErr
 	}
+	if v.Visibility != gomatrixserverlib.Public && v.Visibility != "private" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("visibility must be either 'public' or 'private'"),
+		}
+	}
 
 	var publishRes roomserverAPI.PerformPublishResponse
 	rsAPI.PerformPublish(req.Context(), &roomserverAPI.PerformPublishRequest{
@@ -37,6 +37,14 @@ var (
 	publicRoomsCache []gomatrixserverlib.PublicRoom
 )
 
+const (
+	// defaultPublicRoomsLimit is the number of rooms returned per page when
+	// the request doesn't specify a limit.
+	defaultPublicRoomsLimit = 50
+	// maxPublicRoomsLimit is the most rooms we'll return in a single page.
+	maxPublicRoomsLimit = 500
+)
+
 type PublicRoomReq struct {
 	Since  string `json:"since,omitempty"`
 	Limit  int16  `json:"limit,omitempty"`
@@ -74,20 +82,15 @@ func publicRooms(ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI
 	response := gomatrixserverlib.RespPublicRooms{
 		Chunk: []gomatrixserverlib.PublicRoom{},
 	}
-	var limit int16
-	var offset int64
-	limit = request.Limit
-	if limit == 0 {
-		limit = 50
-	}
-	offset, err := strconv.ParseInt(request.Since, 10, 64)
-	// ParseInt returns 0 and an error when trying to parse an empty string
-	// In that case, we want to assign 0 so we ignore the error
-	if err != nil && len(request.Since) > 0 {
-		util.GetLogger(ctx).WithError(err).Error("strconv.ParseInt failed")
-		return nil, err
+	limit := request.Limit
+	if limit <= 0 {
+		limit = defaultPublicRoomsLimit
 	}
-	err = nil
+	if limit > maxPublicRoomsLimit {
+		limit = maxPublicRoomsLimit
+	}
+	// The since token was checked by fillPublicRoomsReq.
+	offset, _ := strconv.ParseInt(request.Since, 10, 64)
 
 	var rooms []gomatrixserverlib.PublicRoom
 	if request.Since == "" {
@@ -95,6 +98,12 @@ func publicRooms(ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI
 	} else {
 		rooms = getPublicRoomsFromCache()
 	}
+	if request.Filter.SearchTerms != "" {
+		var err error
+		if rooms, err = searchPublicRooms(ctx, stateAPI, rooms, request.Filter.SearchTerms); err != nil {
+			return nil, err
+		}
+	}
 
 	response.TotalRoomCountEstimate = len(rooms)
 
@@ -108,7 +117,7 @@ func publicRooms(ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI
 	if chunk != nil {
 		response.Chunk = chunk
 	}
-	return &response, err
+	return &response, nil
 }
 
 // fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
@@ -145,6 +154,14 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 	// iterating when !prev_batch which then fails if prev_batch==0, so add arbitrary text to
 	// make it truthy not falsey.
 	request.Since = strings.TrimPrefix(request.Since, "T")
+	if request.Since != "" {
+		if since, err := strconv.ParseInt(request.Since, 10, 64); err != nil || since < 0 {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("since is not a valid pagination token"),
+			}
+		}
+	}
 	return nil
 }
 
@@ -158,22 +175,30 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 //   limit=3&since=6  => G     (prev='3', next='')
 //
 //  A value of '-1' for prev/next indicates no position.
+//  Pages which don't start at a multiple of limit, e.g. because the list of
+//  rooms has changed, have a previous page starting at 0.
 func sliceInto(slice []gomatrixserverlib.PublicRoom, since int64, limit int16) (subset []gomatrixserverlib.PublicRoom, prev, next int) {
 	prev = -1
 	next = -1
 
+	// apply sanity caps
+	if since < 0 {
+		since = 0
+	}
+	if since > int64(len(slice)) {
+		since = int64(len(slice))
+	}
+
 	if since > 0 {
 		prev = int(since) - int(limit)
+		if prev < 0 {
+			prev = 0
+		}
 	}
 	nextIndex := int(since) + int(limit)
 	if len(slice) > nextIndex { // there are more rooms ahead of us
 		next = nextIndex
 	}
-
-	// apply sanity caps
-	if since < 0 {
-		since = 0
-	}
 	if nextIndex > len(slice) {
 		nextIndex = len(slice)
 	}
@@ -216,6 +241,78 @@ func refreshPublicRoomCache(
 	return publicRoomsCache
 }
 
+// searchPublicRooms returns the rooms which match the search term, ranked by
+// where the term matched (name, then alias, then topic) and then by total
+// joined member count (big to small). The matching is done by the full-text
+// index of the current state server, so only rooms whose state is known to
+// this server can be found.
+func searchPublicRooms(
+	ctx context.Context, stateAPI currentstateAPI.CurrentStateInternalAPI,
+	rooms []gomatrixserverlib.PublicRoom, searchTerm string,
+) ([]gomatrixserverlib.PublicRoom, error) {
+	term := strings.TrimSpace(searchTerm)
+	if term == "" {
+		return rooms, nil
+	}
+	queryReq := currentstateAPI.QuerySearchRoomsRequest{
+		SearchString: term,
+		RoomIDs:      make([]string, len(rooms)),
+	}
+	for i := range rooms {
+		queryReq.RoomIDs[i] = rooms[i].RoomID
+	}
+	var queryRes currentstateAPI.QuerySearchRoomsResponse
+	if err := stateAPI.QuerySearchRooms(ctx, &queryReq, &queryRes); err != nil {
+		return nil, err
+	}
+	type rankedRoom struct {
+		room  gomatrixserverlib.PublicRoom
+		score int
+	}
+	var ranked []rankedRoom
+	for _, room := range rooms {
+		if score := publicRoomMatchScore(room, term, queryRes.Matches[room.RoomID]); score > 0 {
+			ranked = append(ranked, rankedRoom{room, score})
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].room.JoinedMembersCount > ranked[j].room.JoinedMembersCount
+	})
+	result := make([]gomatrixserverlib.PublicRoom, len(ranked))
+	for i := range ranked {
+		result[i] = ranked[i].room
+	}
+	return result, nil
+}
+
+// publicRoomMatchScore works out how well the search term matches the room,
+// given the types of the state events it matched. A score of 0 means that the
+// room doesn't match at all.
+func publicRoomMatchScore(room gomatrixserverlib.PublicRoom, term string, matchedTypes []string) int {
+	score := 0
+	for _, evType := range matchedTypes {
+		typeScore := 0
+		switch evType {
+		case gomatrixserverlib.MRoomName:
+			typeScore = 3
+			if strings.EqualFold(room.Name, term) {
+				typeScore = 4
+			}
+		case gomatrixserverlib.MRoomCanonicalAlias:
+			typeScore = 2
+		case "m.room.topic":
+			typeScore = 1
+		}
+		if typeScore > score {
+			score = typeScore
+		}
+	}
+	return score
+}
+
 func getPublicRoomsFromCache() []gomatrixserverlib.PublicRoom {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
@@ -1,9 +1,11 @@
 package routing
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -42,6 +44,18 @@ func TestSliceInto(t *testing.T) {
 			wantNext:   -1,
 			wantSubset: slice[6:7],
 		},
+		{
+			since:      2,
+			wantPrev:   0,
+			wantNext:   5,
+			wantSubset: slice[2:5],
+		},
+		{
+			since:      10,
+			wantPrev:   4,
+			wantNext:   -1,
+			wantSubset: slice[7:7],
+		},
 	}
 	for _, tc := range testCases {
 		subset, prev, next := sliceInto(slice, tc.since, limit)
@@ -56,3 +70,63 @@ func TestSliceInto(t *testing.T) {
 		}
 	}
 }
+
+// fakeSearchRoomsStateAPI returns the given matches for the rooms which were
+// asked about, remembering the search string.
+type fakeSearchRoomsStateAPI struct {
+	currentstateAPI.CurrentStateInternalAPI
+	matches      map[string][]string
+	searchString string
+}
+
+func (s *fakeSearchRoomsStateAPI) QuerySearchRooms(
+	ctx context.Context, req *currentstateAPI.QuerySearchRoomsRequest, res *currentstateAPI.QuerySearchRoomsResponse,
+) error {
+	s.searchString = req.SearchString
+	res.Matches = make(map[string][]string)
+	for _, roomID := range req.RoomIDs {
+		if types, ok := s.matches[roomID]; ok {
+			res.Matches[roomID] = types
+		}
+	}
+	return nil
+}
+
+func TestSearchPublicRooms(t *testing.T) {
+	topicMatch := gomatrixserverlib.PublicRoom{RoomID: "!topic:a", Name: "Lounge", Topic: "All about Dendrite", JoinedMembersCount: 100}
+	aliasMatch := gomatrixserverlib.PublicRoom{RoomID: "!alias:a", Name: "Go servers", CanonicalAlias: "#dendrite-dev:a", JoinedMembersCount: 50}
+	bigNameMatch := gomatrixserverlib.PublicRoom{RoomID: "!big:a", Name: "Matrix and Dendrite", Topic: "Dendrite", JoinedMembersCount: 20}
+	smallNameMatch := gomatrixserverlib.PublicRoom{RoomID: "!small:a", Name: "Dendrite chat", JoinedMembersCount: 2}
+	exactNameMatch := gomatrixserverlib.PublicRoom{RoomID: "!exact:a", Name: "dendrite", JoinedMembersCount: 1}
+	noMatch := gomatrixserverlib.PublicRoom{RoomID: "!none:a", Name: "Synapse", JoinedMembersCount: 500}
+	rooms := []gomatrixserverlib.PublicRoom{
+		noMatch, topicMatch, aliasMatch, bigNameMatch, smallNameMatch, exactNameMatch,
+	}
+	stateAPI := &fakeSearchRoomsStateAPI{
+		matches: map[string][]string{
+			"!topic:a": {"m.room.topic"},
+			"!alias:a": {gomatrixserverlib.MRoomCanonicalAlias},
+			"!big:a":   {"m.room.topic", gomatrixserverlib.MRoomName},
+			"!small:a": {gomatrixserverlib.MRoomName},
+			"!exact:a": {gomatrixserverlib.MRoomName},
+		},
+	}
+
+	got, err := searchPublicRooms(context.Background(), stateAPI, rooms, " DENDRITE ")
+	if err != nil {
+		t.Fatalf("searchPublicRooms returned error: %s", err)
+	}
+	want := []gomatrixserverlib.PublicRoom{
+		exactNameMatch, bigNameMatch, smallNameMatch, aliasMatch, topicMatch,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("returned rooms are wrong, got %v want %v", got, want)
+	}
+	if stateAPI.searchString != "DENDRITE" {
+		t.Errorf("searched for %q, want %q", stateAPI.searchString, "DENDRITE")
+	}
+	stateAPI.matches = nil
+	if got, err = searchPublicRooms(context.Background(), stateAPI, rooms, "nothing matches this"); err != nil || len(got) != 0 {
+		t.Errorf("expected no rooms, got %v (err %v)", got, err)
+	}
+}
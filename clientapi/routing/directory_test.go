@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// fakeAliasRoomserverAPI only implements setting aliases.
+type fakeAliasRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	aliases map[string]string
+}
+
+func (r *fakeAliasRoomserverAPI) SetRoomAlias(
+	ctx context.Context, req *roomserverAPI.SetRoomAliasRequest, res *roomserverAPI.SetRoomAliasResponse,
+) error {
+	if _, ok := r.aliases[req.Alias]; ok {
+		res.AliasExists = true
+		return nil
+	}
+	r.aliases[req.Alias] = req.RoomID
+	return nil
+}
+
+func TestSetLocalAliasPolicy(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.RoomCreation.AllowedAliasCreators = []string{"@alice:localhost"}
+	rsAPI := &fakeAliasRoomserverAPI{aliases: map[string]string{}}
+	setAlias := func(userID, alias string) int {
+		req := httptest.NewRequest(http.MethodPut, "/directory/room/"+alias, strings.NewReader(`{"room_id":"!room:localhost"}`))
+		return SetLocalAlias(req, &api.Device{UserID: userID}, alias, cfg, rsAPI).Code
+	}
+
+	if code := setAlias("@bob:localhost", "#bob:localhost"); code != http.StatusForbidden {
+		t.Errorf("alias set by a user who may not create aliases: got status %d want %d", code, http.StatusForbidden)
+	}
+	if _, ok := rsAPI.aliases["#bob:localhost"]; ok {
+		t.Errorf("alias was set by a user who may not create aliases")
+	}
+	if code := setAlias("@alice:localhost", "#alice:localhost"); code != http.StatusOK {
+		t.Errorf("alias set by a user who may create aliases: got status %d want %d", code, http.StatusOK)
+	}
+	if code := setAlias("@alice:localhost", "#alice:localhost"); code != http.StatusConflict {
+		t.Errorf("alias set twice: got status %d want %d", code, http.StatusConflict)
+	}
+	if code := setAlias("@alice:localhost", "#alice:elsewhere"); code != http.StatusForbidden {
+		t.Errorf("alias on another server: got status %d want %d", code, http.StatusForbidden)
+	}
+}
@@ -18,23 +18,12 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
-	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-type getEventRequest struct {
-	req            *http.Request
-	device         *userapi.Device
-	roomID         string
-	eventID        string
-	cfg            *config.Dendrite
-	federation     *gomatrixserverlib.FederationClient
-	requestedEvent gomatrixserverlib.Event
-}
-
 // GetEvent implements GET /_matrix/client/r0/rooms/{roomId}/event/{eventId}
 // https://matrix.org/docs/spec/client_server/r0.4.0.html#get-matrix-client-r0-rooms-roomid-event-eventid
 func GetEvent(
@@ -42,9 +31,7 @@ func GetEvent(
 	device *userapi.Device,
 	roomID string,
 	eventID string,
-	cfg *config.Dendrite,
 	rsAPI api.RoomserverInternalAPI,
-	federation *gomatrixserverlib.FederationClient,
 ) util.JSONResponse {
 	eventsReq := api.QueryEventsByIDRequest{
 		EventIDs: []string{eventID},
@@ -56,7 +43,10 @@ func GetEvent(
 		return jsonerror.InternalServerError()
 	}
 
-	if len(eventsResp.Events) == 0 {
+	// The event must be in the room that it was requested from, or else
+	// users could read events from rooms by requesting them from rooms
+	// with a different history visibility.
+	if len(eventsResp.Events) == 0 || eventsResp.Events[0].RoomID() != roomID {
 		// Event not found locally
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
@@ -66,61 +56,26 @@ func GetEvent(
 
 	requestedEvent := eventsResp.Events[0].Event
 
-	r := getEventRequest{
-		req:            req,
-		device:         device,
-		roomID:         roomID,
-		eventID:        eventID,
-		cfg:            cfg,
-		federation:     federation,
-		requestedEvent: requestedEvent,
-	}
-
-	stateReq := api.QueryStateAfterEventsRequest{
-		RoomID:       r.requestedEvent.RoomID(),
-		PrevEventIDs: r.requestedEvent.PrevEventIDs(),
-		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
-			EventType: gomatrixserverlib.MRoomMember,
-			StateKey:  device.UserID,
-		}},
+	// Only return the event if the room's history visibility at the event
+	// allows the user to see it.
+	allowedReq := api.QueryUserAllowedToSeeEventsRequest{
+		UserID:   device.UserID,
+		EventIDs: []string{requestedEvent.EventID()},
 	}
-	var stateResp api.QueryStateAfterEventsResponse
-	if err := rsAPI.QueryStateAfterEvents(req.Context(), &stateReq, &stateResp); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryStateAfterEvents failed")
+	var allowedRes api.QueryUserAllowedToSeeEventsResponse
+	if err = rsAPI.QueryUserAllowedToSeeEvents(req.Context(), &allowedReq, &allowedRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryUserAllowedToSeeEvents failed")
 		return jsonerror.InternalServerError()
 	}
-
-	if !stateResp.RoomExists {
-		util.GetLogger(req.Context()).Errorf("Expected to find room for event %s but failed", r.requestedEvent.EventID())
-		return jsonerror.InternalServerError()
-	}
-
-	if !stateResp.PrevEventsExist {
-		// Missing some events locally; stateResp.StateEvents unavailable.
+	if !allowedRes.AllowedEventIDs[requestedEvent.EventID()] {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
 		}
 	}
 
-	for _, stateEvent := range stateResp.StateEvents {
-		if stateEvent.StateKeyEquals(r.device.UserID) {
-			membership, err := stateEvent.Membership()
-			if err != nil {
-				util.GetLogger(req.Context()).WithError(err).Error("stateEvent.Membership failed")
-				return jsonerror.InternalServerError()
-			}
-			if membership == gomatrixserverlib.Join {
-				return util.JSONResponse{
-					Code: http.StatusOK,
-					JSON: gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
-				}
-			}
-		}
-	}
-
 	return util.JSONResponse{
-		Code: http.StatusNotFound,
-		JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		Code: http.StatusOK,
+		JSON: gomatrixserverlib.ToClientEvent(requestedEvent, gomatrixserverlib.FormatAll),
 	}
 }
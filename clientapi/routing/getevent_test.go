@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeGetEventRoomserverAPI only implements the queries used by GetEvent.
+type fakeGetEventRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	events  map[string]gomatrixserverlib.HeaderedEvent
+	allowed map[string]bool
+}
+
+func (r *fakeGetEventRoomserverAPI) QueryEventsByID(
+	ctx context.Context, req *api.QueryEventsByIDRequest, res *api.QueryEventsByIDResponse,
+) error {
+	for _, eventID := range req.EventIDs {
+		if ev, ok := r.events[eventID]; ok {
+			res.Events = append(res.Events, ev)
+		}
+	}
+	return nil
+}
+
+func (r *fakeGetEventRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context, req *api.QueryUserAllowedToSeeEventsRequest, res *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	res.AllowedEventIDs = make(map[string]bool)
+	for _, eventID := range req.EventIDs {
+		res.AllowedEventIDs[eventID] = r.allowed[eventID]
+	}
+	return nil
+}
+
+func TestGetEvent(t *testing.T) {
+	rsAPI := &fakeGetEventRoomserverAPI{
+		events:  make(map[string]gomatrixserverlib.HeaderedEvent),
+		allowed: map[string]bool{"$visible:localhost": true},
+	}
+	for _, eventJSON := range []string{
+		`{"auth_events":[],"content":{"body":"hello"},"depth":1,"event_id":"$visible:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@bob:localhost","type":"m.room.message","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"body":"secret"},"depth":1,"event_id":"$hidden:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@bob:localhost","type":"m.room.message","hashes":{"sha256":""},"signatures":{}}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		rsAPI.events[ev.EventID()] = ev.Headered(gomatrixserverlib.RoomVersionV1)
+	}
+	device := &userapi.Device{UserID: "@alice:localhost"}
+	get := func(roomID, eventID string) int {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+roomID+"/event/"+eventID, nil)
+		return GetEvent(req, device, roomID, eventID, rsAPI).Code
+	}
+
+	if code := get("!room:localhost", "$visible:localhost"); code != http.StatusOK {
+		t.Errorf("got status %d for a visible event, want %d", code, http.StatusOK)
+	}
+	if code := get("!room:localhost", "$hidden:localhost"); code != http.StatusNotFound {
+		t.Errorf("got status %d for an event which the user can't see, want %d", code, http.StatusNotFound)
+	}
+	if code := get("!other:localhost", "$visible:localhost"); code != http.StatusNotFound {
+		t.Errorf("got status %d for an event requested from another room, want %d", code, http.StatusNotFound)
+	}
+	if code := get("!room:localhost", "$unknown:localhost"); code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown event, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// The most rooms which are returned in one page of a hierarchy.
+	maxHierarchyLimit = 50
+	// The most rooms which are summarised for one page, including those the
+	// user isn't allowed to see, so that a page with no rooms in it doesn't
+	// walk a large hierarchy all at once.
+	maxHierarchySummaries = 2 * maxHierarchyLimit
+	// The most rooms which are walked over all of the pages of a hierarchy.
+	maxHierarchyWalkRooms = 500
+	// How long a walk can be carried on with after its last page.
+	hierarchyWalkLifetime = 5 * time.Minute
+	// The most walks which are kept to be carried on with at once.
+	maxHierarchyWalks = 1000
+)
+
+type hierarchyResponse struct {
+	Rooms     []federationSenderAPI.HierarchyRoom `json:"rooms"`
+	NextBatch string                              `json:"next_batch,omitempty"`
+}
+
+// hierarchyWalk is a walk of a space hierarchy for a user, which is kept
+// between pages so that each page carries on from where the last stopped.
+type hierarchyWalk struct {
+	roomID        string
+	userID        string
+	suggestedOnly bool
+	maxDepth      int
+	stack         []hierarchyEntry
+	seen          map[string]bool
+	// Remote servers also tell us about the children of the rooms we ask
+	// them about, which saves asking about the children separately.
+	remoteRooms        map[string]*federationSenderAPI.HierarchyRoom
+	remoteInaccessible map[string]bool
+	expiry             time.Time
+}
+
+type hierarchyEntry struct {
+	roomID string
+	depth  int
+	via    []gomatrixserverlib.ServerName
+}
+
+// hierarchyWalks keeps the walks which are waiting for their next page,
+// keyed on the pagination tokens handed out for them.
+// It shouldn't be passed by value because it contains a mutex.
+type hierarchyWalks struct {
+	sync.Mutex
+	walks map[string]*hierarchyWalk
+}
+
+func newHierarchyWalks() *hierarchyWalks {
+	return &hierarchyWalks{
+		walks: make(map[string]*hierarchyWalk),
+	}
+}
+
+// pause keeps a walk and returns the pagination token for its next page,
+// forgetting the walks which have expired. If too many walks are kept, the
+// one which would expire first is forgotten.
+func (h *hierarchyWalks) pause(walk *hierarchyWalk, now time.Time) string {
+	h.Lock()
+	defer h.Unlock()
+	var soonest string
+	for token, w := range h.walks {
+		if !now.Before(w.expiry) {
+			delete(h.walks, token)
+		} else if soonest == "" || w.expiry.Before(h.walks[soonest].expiry) {
+			soonest = token
+		}
+	}
+	if len(h.walks) >= maxHierarchyWalks {
+		delete(h.walks, soonest)
+	}
+	walk.expiry = now.Add(hierarchyWalkLifetime)
+	token := util.RandomString(32)
+	h.walks[token] = walk
+	return token
+}
+
+// resume returns the walk which the pagination token was handed out for,
+// or nil if it is unknown or has expired. The token can't be used again
+// either way.
+func (h *hierarchyWalks) resume(token string, now time.Time) *hierarchyWalk {
+	h.Lock()
+	defer h.Unlock()
+	walk, ok := h.walks[token]
+	delete(h.walks, token)
+	if !ok || !now.Before(walk.expiry) {
+		return nil
+	}
+	return walk
+}
+
+// hierarchyWalker carries on with a walk for one page, asking remote
+// servers about the rooms which this server isn't in.
+type hierarchyWalker struct {
+	*hierarchyWalk
+	ctx   context.Context
+	rsAPI roomserverAPI.RoomserverInternalAPI
+	fsAPI federationSenderAPI.FederationSenderInternalAPI
+}
+
+// GetRoomHierarchy implements:
+//     GET /rooms/{roomID}/hierarchy
+// from MSC2946. The rooms are walked depth-first, starting from the given
+// room, and the pagination token refers to the walk which is kept by this
+// server until the next page is asked for.
+func GetRoomHierarchy(
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
+	walks *hierarchyWalks,
+) util.JSONResponse {
+	query := req.URL.Query()
+	limit, maxDepth := maxHierarchyLimit, -1
+	var err error
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive number"),
+			}
+		}
+		if limit > maxHierarchyLimit {
+			limit = maxHierarchyLimit
+		}
+	}
+	if v := query.Get("max_depth"); v != "" {
+		if maxDepth, err = strconv.Atoi(v); err != nil || maxDepth < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("max_depth must be a non-negative number"),
+			}
+		}
+	}
+
+	w := hierarchyWalker{
+		hierarchyWalk: &hierarchyWalk{
+			roomID:             roomID,
+			userID:             device.UserID,
+			suggestedOnly:      query.Get("suggested_only") == "true",
+			maxDepth:           maxDepth,
+			stack:              []hierarchyEntry{{roomID: roomID}},
+			seen:               map[string]bool{},
+			remoteRooms:        map[string]*federationSenderAPI.HierarchyRoom{},
+			remoteInaccessible: map[string]bool{},
+		},
+		ctx:   req.Context(),
+		rsAPI: rsAPI,
+		fsAPI: fsAPI,
+	}
+	var root *federationSenderAPI.HierarchyRoom
+	if from := query.Get("from"); from != "" {
+		// The rest of the parameters have to be the same as for the first page.
+		walk := walks.resume(from, time.Now())
+		if walk == nil || walk.roomID != w.roomID || walk.userID != w.userID ||
+			walk.suggestedOnly != w.suggestedOnly || walk.maxDepth != w.maxDepth {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from is not a valid pagination token"),
+			}
+		}
+		w.hierarchyWalk = walk
+	} else {
+		var accessible bool
+		root, accessible, err = w.summarise(hierarchyEntry{roomID: roomID})
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("hierarchyWalker.summarise failed")
+			return jsonerror.InternalServerError()
+		}
+		if root == nil {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("Room does not exist or is not known to this server"),
+			}
+		}
+		if !accessible {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You are not allowed to see this room"),
+			}
+		}
+	}
+
+	rooms, err := w.walk(root, limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("hierarchyWalker.walk failed")
+		return jsonerror.InternalServerError()
+	}
+	res := hierarchyResponse{Rooms: rooms}
+	// Larger hierarchies are cut short rather than walked entirely.
+	if len(w.stack) > 0 && len(w.seen) < maxHierarchyWalkRooms {
+		res.NextBatch = walks.pause(w.hierarchyWalk, time.Now())
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// walk carries on with the walk until a page of rooms has been found, the
+// walk has run out of rooms or it has summarised as many rooms as it may.
+// The root room's summary is used if given.
+func (w *hierarchyWalker) walk(root *federationSenderAPI.HierarchyRoom, limit int) ([]federationSenderAPI.HierarchyRoom, error) {
+	rooms := []federationSenderAPI.HierarchyRoom{}
+	summarised := 0
+	for len(w.stack) > 0 && len(rooms) < limit && summarised < maxHierarchySummaries && len(w.seen) < maxHierarchyWalkRooms {
+		entry := w.stack[len(w.stack)-1]
+		w.stack = w.stack[:len(w.stack)-1]
+		if w.seen[entry.roomID] {
+			continue
+		}
+		w.seen[entry.roomID] = true
+		room := root
+		if entry.roomID != w.roomID || root == nil {
+			var accessible bool
+			var err error
+			summarised++
+			if room, accessible, err = w.summarise(entry); err != nil {
+				return nil, err
+			}
+			if room == nil || !accessible {
+				continue
+			}
+		}
+		rooms = append(rooms, *room)
+		if w.maxDepth >= 0 && entry.depth >= w.maxDepth {
+			continue
+		}
+		// Push the children in reverse, so that they are walked in order.
+		for i := len(room.ChildrenState) - 1; i >= 0; i-- {
+			child := room.ChildrenState[i]
+			if w.seen[child.StateKey] {
+				continue
+			}
+			var content federationSenderAPI.HierarchyChildContent
+			if err := json.Unmarshal(child.Content, &content); err != nil {
+				continue
+			}
+			via := make([]gomatrixserverlib.ServerName, 0, len(content.Via))
+			for _, serverName := range content.Via {
+				via = append(via, gomatrixserverlib.ServerName(serverName))
+			}
+			w.stack = append(w.stack, hierarchyEntry{roomID: child.StateKey, depth: entry.depth + 1, via: via})
+		}
+	}
+	// Drop the rooms which have been seen since they were pushed, so that
+	// there's only a next page if there are rooms left to walk.
+	for len(w.stack) > 0 && w.seen[w.stack[len(w.stack)-1].roomID] {
+		w.stack = w.stack[:len(w.stack)-1]
+	}
+	return rooms, nil
+}
+
+// summarise returns the summary of a room and whether the user may see it,
+// or nil if the room couldn't be found.
+func (w *hierarchyWalker) summarise(entry hierarchyEntry) (*federationSenderAPI.HierarchyRoom, bool, error) {
+	room, memberships, err := roomserverAPI.GetHierarchyRoom(w.ctx, w.rsAPI, entry.roomID, w.userID, w.suggestedOnly)
+	if err != nil {
+		return nil, false, err
+	}
+	if room != nil {
+		membership := memberships[w.userID]
+		accessible := room.WorldReadable || room.JoinRule == gomatrixserverlib.Public ||
+			membership == gomatrixserverlib.Join || membership == gomatrixserverlib.Invite
+		return room, accessible, nil
+	}
+
+	// Rooms from remote servers have already been checked by them, although
+	// only for whether this server may see them.
+	if room, ok := w.remoteRooms[entry.roomID]; ok {
+		return room, true, nil
+	}
+	if w.remoteInaccessible[entry.roomID] {
+		return nil, false, nil
+	}
+	serverNames := entry.via
+	if _, domain, err := gomatrixserverlib.SplitID('!', entry.roomID); err == nil {
+		serverNames = append(serverNames, domain)
+	}
+	var res federationSenderAPI.QueryRoomHierarchyResponse
+	if err = w.fsAPI.QueryRoomHierarchy(w.ctx, &federationSenderAPI.QueryRoomHierarchyRequest{
+		RoomID:        entry.roomID,
+		ServerNames:   serverNames,
+		SuggestedOnly: w.suggestedOnly,
+	}, &res); err != nil {
+		// The room is left out if no server could tell us about it.
+		util.GetLogger(w.ctx).WithError(err).Warnf("failed to get the hierarchy of room %q", entry.roomID)
+		return nil, false, nil
+	}
+	for i := range res.Children {
+		w.remoteRooms[res.Children[i].RoomID] = &res.Children[i]
+	}
+	for _, roomID := range res.InaccessibleChildren {
+		w.remoteInaccessible[roomID] = true
+	}
+	if res.Room.ChildrenState == nil {
+		res.Room.ChildrenState = []federationSenderAPI.HierarchyChildEvent{}
+	}
+	return &res.Room, true, nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeHierarchyRoom struct {
+	joinRule string
+	joined   []string
+	children []string
+}
+
+// fakeHierarchyRoomserverAPI only implements the APIs used to summarise
+// rooms, and only returns the state which is asked for.
+type fakeHierarchyRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	t       *testing.T
+	rooms   map[string]fakeHierarchyRoom
+	queries int
+}
+
+func (r *fakeHierarchyRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse,
+) error {
+	r.queries++
+	room, ok := r.rooms[req.RoomID]
+	if !ok {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = gomatrixserverlib.RoomVersionV1
+	wanted := func(eventType, stateKey string) bool {
+		for _, eventTypeToFetch := range req.StateTypesToFetch {
+			if eventTypeToFetch == eventType {
+				return true
+			}
+		}
+		for _, tuple := range req.StateToFetch {
+			if tuple.EventType == eventType && tuple.StateKey == stateKey {
+				return true
+			}
+		}
+		return false
+	}
+	add := func(eventType, stateKey string, content interface{}) {
+		if !wanted(eventType, stateKey) {
+			return
+		}
+		contentJSON, err := json.Marshal(content)
+		if err != nil {
+			r.t.Fatalf("failed to marshal content: %s", err)
+		}
+		eventJSON := fmt.Sprintf(
+			`{"auth_events":[],"content":%s,"depth":1,"event_id":"$%s%s","origin_server_ts":0,"prev_events":[],"room_id":%q,"sender":"@creator:localhost","state_key":%q,"type":%q,"hashes":{"sha256":""},"signatures":{}}`,
+			contentJSON, eventType, stateKey, req.RoomID, stateKey, eventType,
+		)
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			r.t.Fatalf("failed to create event: %s", err)
+		}
+		res.StateEvents = append(res.StateEvents, ev.Headered(gomatrixserverlib.RoomVersionV1))
+	}
+	add(gomatrixserverlib.MRoomCreate, "", map[string]string{"creator": "@creator:localhost"})
+	add(gomatrixserverlib.MRoomName, "", map[string]string{"name": req.RoomID})
+	add(gomatrixserverlib.MRoomJoinRules, "", map[string]string{"join_rule": room.joinRule})
+	for _, userID := range room.joined {
+		add(gomatrixserverlib.MRoomMember, userID, map[string]string{"membership": gomatrixserverlib.Join})
+	}
+	for i, child := range room.children {
+		add(api.MSpaceChild, child, map[string]interface{}{"via": []string{"localhost"}, "order": fmt.Sprint(i)})
+	}
+	// State which isn't part of the summary shouldn't be asked for.
+	add("m.room.power_levels", "", map[string]interface{}{})
+	for _, ev := range res.StateEvents {
+		if ev.Type() == "m.room.power_levels" {
+			r.t.Errorf("all of the state of %s was asked for", req.RoomID)
+		}
+	}
+	return nil
+}
+
+func (r *fakeHierarchyRoomserverAPI) QueryJoinedUsers(
+	ctx context.Context, req *api.QueryJoinedUsersRequest, res *api.QueryJoinedUsersResponse,
+) error {
+	room, ok := r.rooms[req.RoomID]
+	res.RoomExists = ok
+	res.UserIDs = room.joined
+	return nil
+}
+
+// fakeHierarchyFederationSenderAPI doesn't know about any remote rooms.
+type fakeHierarchyFederationSenderAPI struct {
+	federationSenderAPI.FederationSenderInternalAPI
+	asked []string
+}
+
+func (f *fakeHierarchyFederationSenderAPI) QueryRoomHierarchy(
+	ctx context.Context, req *federationSenderAPI.QueryRoomHierarchyRequest, res *federationSenderAPI.QueryRoomHierarchyResponse,
+) error {
+	f.asked = append(f.asked, req.RoomID)
+	return fmt.Errorf("no servers know about %s", req.RoomID)
+}
+
+func TestGetRoomHierarchy(t *testing.T) {
+	rsAPI := &fakeHierarchyRoomserverAPI{t: t, rooms: map[string]fakeHierarchyRoom{
+		"!root:localhost":    {joinRule: gomatrixserverlib.Public, children: []string{"!missing:remote", "!a:localhost", "!b:localhost", "!c:localhost"}},
+		"!a:localhost":       {joinRule: gomatrixserverlib.Invite, joined: []string{"@alice:localhost"}, children: []string{"!a1:localhost", "!root:localhost"}},
+		"!a1:localhost":      {joinRule: gomatrixserverlib.Public},
+		"!b:localhost":       {joinRule: gomatrixserverlib.Invite, joined: []string{"@bob:localhost"}},
+		"!c:localhost":       {joinRule: gomatrixserverlib.Public},
+		"!private:localhost": {joinRule: gomatrixserverlib.Invite},
+	}}
+	fsAPI := &fakeHierarchyFederationSenderAPI{}
+	walks := newHierarchyWalks()
+	device := &userapi.Device{UserID: "@alice:localhost"}
+
+	get := func(roomID string, query url.Values) (int, hierarchyResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/org.matrix.msc2946/rooms/"+roomID+"/hierarchy?"+query.Encode(), nil)
+		res := GetRoomHierarchy(req, device, roomID, rsAPI, fsAPI, walks)
+		rooms, _ := res.JSON.(hierarchyResponse)
+		return res.Code, rooms
+	}
+	roomIDs := func(res hierarchyResponse) string {
+		var roomIDs []string
+		for _, room := range res.Rooms {
+			roomIDs = append(roomIDs, room.RoomID)
+		}
+		return strings.Join(roomIDs, ",")
+	}
+
+	// The rooms which the user can't see and the rooms which no server
+	// knows about are left out.
+	code, res := get("!root:localhost", url.Values{})
+	if want := "!root:localhost,!a:localhost,!a1:localhost,!c:localhost"; code != http.StatusOK || roomIDs(res) != want || res.NextBatch != "" {
+		t.Fatalf("got %d with rooms %s and next batch %q, want rooms %s", code, roomIDs(res), res.NextBatch, want)
+	}
+	if res.Rooms[1].JoinedMembersCount != 1 {
+		t.Errorf("got %d joined members of !a:localhost, want 1", res.Rooms[1].JoinedMembersCount)
+	}
+	if strings.Join(fsAPI.asked, ",") != "!missing:remote" {
+		t.Errorf("got remote rooms asked about %v, want only !missing:remote", fsAPI.asked)
+	}
+
+	code, res = get("!root:localhost", url.Values{"max_depth": {"1"}})
+	if want := "!root:localhost,!a:localhost,!c:localhost"; code != http.StatusOK || roomIDs(res) != want {
+		t.Fatalf("got %d with rooms %s for max_depth 1, want %s", code, roomIDs(res), want)
+	}
+
+	// Each page carries on from where the last one stopped.
+	code, res = get("!root:localhost", url.Values{"limit": {"2"}})
+	if want := "!root:localhost,!a:localhost"; code != http.StatusOK || roomIDs(res) != want || res.NextBatch == "" {
+		t.Fatalf("got %d with rooms %s and next batch %q for the first page, want rooms %s", code, roomIDs(res), res.NextBatch, want)
+	}
+	from := res.NextBatch
+	code, res = get("!root:localhost", url.Values{"limit": {"2"}, "from": {from}})
+	if want := "!a1:localhost,!c:localhost"; code != http.StatusOK || roomIDs(res) != want || res.NextBatch != "" {
+		t.Fatalf("got %d with rooms %s and next batch %q for the second page, want rooms %s", code, roomIDs(res), res.NextBatch, want)
+	}
+	// Pagination tokens can only be used once, and only with the same
+	// parameters as the first page.
+	if code, _ = get("!root:localhost", url.Values{"limit": {"2"}, "from": {from}}); code != http.StatusBadRequest {
+		t.Errorf("got %d for a used pagination token, want %d", code, http.StatusBadRequest)
+	}
+	_, res = get("!root:localhost", url.Values{"limit": {"1"}})
+	if code, _ = get("!root:localhost", url.Values{"limit": {"1"}, "from": {res.NextBatch}, "max_depth": {"1"}}); code != http.StatusBadRequest {
+		t.Errorf("got %d for a pagination token with a different max_depth, want %d", code, http.StatusBadRequest)
+	}
+	for _, from := range []string{"1", "-1"} {
+		if code, _ = get("!root:localhost", url.Values{"from": {from}}); code != http.StatusBadRequest {
+			t.Errorf("got %d for pagination token %q, want %d", code, from, http.StatusBadRequest)
+		}
+	}
+
+	if code, _ = get("!private:localhost", url.Values{}); code != http.StatusForbidden {
+		t.Errorf("got %d for a room the user can't see, want %d", code, http.StatusForbidden)
+	}
+	if code, _ = get("!unknown:remote", url.Values{}); code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown room, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestGetRoomHierarchyBoundsWalk(t *testing.T) {
+	// A space with more children than can be walked.
+	root := fakeHierarchyRoom{joinRule: gomatrixserverlib.Public}
+	rooms := map[string]fakeHierarchyRoom{}
+	for i := 0; i < 2*maxHierarchyWalkRooms; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		root.children = append(root.children, roomID)
+		// Most of the rooms can't be seen by the user.
+		joinRule := gomatrixserverlib.Public
+		if i%4 != 0 {
+			joinRule = gomatrixserverlib.Invite
+		}
+		rooms[roomID] = fakeHierarchyRoom{joinRule: joinRule}
+	}
+	rooms["!root:localhost"] = root
+	rsAPI := &fakeHierarchyRoomserverAPI{t: t, rooms: rooms}
+	walks := newHierarchyWalks()
+	device := &userapi.Device{UserID: "@alice:localhost"}
+
+	walked, summarised, from := 0, 0, ""
+	for page := 0; ; page++ {
+		if page > 2*maxHierarchyWalkRooms {
+			t.Fatalf("the walk didn't stop")
+		}
+		query := url.Values{}
+		if from != "" {
+			query.Set("from", from)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/org.matrix.msc2946/rooms/!root:localhost/hierarchy?"+query.Encode(), nil)
+		rsAPI.queries = 0
+		res := GetRoomHierarchy(req, device, "!root:localhost", rsAPI, nil, walks)
+		if res.Code != http.StatusOK {
+			t.Fatalf("got status %d for page %d: %+v", res.Code, page, res.JSON)
+		}
+		// The root room is summarised as well on the first page.
+		if rsAPI.queries > maxHierarchySummaries+1 {
+			t.Fatalf("summarised %d rooms for page %d, want at most %d", rsAPI.queries, page, maxHierarchySummaries)
+		}
+		hierarchy := res.JSON.(hierarchyResponse)
+		walked += len(hierarchy.Rooms)
+		summarised += rsAPI.queries
+		if from = hierarchy.NextBatch; from == "" {
+			break
+		}
+	}
+	if walked == 0 || summarised > maxHierarchyWalkRooms+1 {
+		t.Fatalf("walked %d rooms and summarised %d, want at most %d summarised", walked, summarised, maxHierarchyWalkRooms)
+	}
+}
+
+func TestHierarchyWalksExpire(t *testing.T) {
+	walks := newHierarchyWalks()
+	now := time.Now()
+	token := walks.pause(&hierarchyWalk{roomID: "!root:localhost"}, now)
+	if walk := walks.resume(token, now.Add(hierarchyWalkLifetime)); walk != nil {
+		t.Fatalf("resumed an expired walk")
+	}
+
+	var tokens []string
+	for i := 0; i < maxHierarchyWalks+1; i++ {
+		tokens = append(tokens, walks.pause(&hierarchyWalk{}, now.Add(time.Duration(i))))
+	}
+	if len(walks.walks) != maxHierarchyWalks {
+		t.Fatalf("got %d walks kept, want %d", len(walks.walks), maxHierarchyWalks)
+	}
+	if walk := walks.resume(tokens[0], now); walk != nil {
+		t.Fatalf("the walk which would expire first was kept")
+	}
+	if walk := walks.resume(tokens[maxHierarchyWalks], now); walk == nil {
+		t.Fatalf("the newest walk was forgotten")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type knockRequest struct {
+	Reason string `json:"reason"`
+}
+
+// KnockRoomByIDOrAlias implements POST /knock/{roomIdOrAlias} from MSC2403.
+func KnockRoomByIDOrAlias(
+	req *http.Request,
+	device *api.Device,
+	cfg *config.Dendrite,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomIDOrAlias string,
+) util.JSONResponse {
+	if device.IsGuest {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests cannot knock on rooms"),
+		}
+	}
+	// Knocking is asking to join, so it's restricted in the same way.
+	if !cfg.Matrix.JoinRestrictions.AllowsRoom(cfg.Matrix.ServerName, roomIDOrAlias) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Joining this room is not allowed on this server"),
+		}
+	}
+
+	var body knockRequest
+	if req.ContentLength != 0 {
+		if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+			return *reqErr
+		}
+	}
+
+	// The servers to knock through if this server isn't in the room.
+	var serverNames []gomatrixserverlib.ServerName
+	for _, serverName := range req.URL.Query()["server_name"] {
+		serverNames = append(serverNames, gomatrixserverlib.ServerName(serverName))
+	}
+
+	knockReq := roomserverAPI.PerformKnockRequest{
+		RoomIDOrAlias: roomIDOrAlias,
+		UserID:        device.UserID,
+		Reason:        body.Reason,
+		ServerNames:   serverNames,
+	}
+	knockRes := roomserverAPI.PerformKnockResponse{}
+	rsAPI.PerformKnock(req.Context(), &knockReq, &knockRes)
+	if knockRes.Error != nil {
+		return knockRes.Error.JSONResponse()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			RoomID string `json:"room_id"`
+		}{knockRes.RoomID},
+	}
+}
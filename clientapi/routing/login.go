@@ -16,17 +16,22 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
-	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/sso"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 type loginResponse struct {
@@ -34,6 +39,16 @@ type loginResponse struct {
 	AccessToken string                       `json:"access_token"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
 	DeviceID    string                       `json:"device_id"`
+	// Only set if the client asked for a refresh token.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
+}
+
+// loginRequest is the body of a password login request, which may also
+// carry a captcha response if too many logins have failed recently.
+type loginRequest struct {
+	auth.PasswordRequest
+	CaptchaResponse string `json:"captcha_response"`
 }
 
 type flows struct {
@@ -43,45 +58,102 @@ type flows struct {
 type flow struct {
 	Type   string   `json:"type"`
 	Stages []string `json:"stages"`
+	// The identity providers which can be chosen from with m.login.sso, see
+	// https://github.com/matrix-org/matrix-doc/pull/2858
+	IdentityProviders []identityProvider `json:"identity_providers,omitempty"`
+}
+
+type identityProvider struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
-func passwordLogin() flows {
+func loginFlows(ssoProviders []sso.IdentityProvider, cfg *config.Dendrite) flows {
 	f := flows{}
-	s := flow{
-		Type:   "m.login.password",
-		Stages: []string{"m.login.password"},
+	for _, loginType := range []string{"m.login.password", "m.login.token"} {
+		f.Flows = append(f.Flows, flow{
+			Type:   loginType,
+			Stages: []string{loginType},
+		})
+	}
+	if len(ssoProviders) > 0 {
+		s := flow{
+			Type:   "m.login.sso",
+			Stages: []string{"m.login.sso"},
+		}
+		for _, provider := range ssoProviders {
+			s.IdentityProviders = append(s.IdentityProviders, identityProvider{
+				ID:   provider.ID(),
+				Name: provider.Name(),
+			})
+		}
+		f.Flows = append(f.Flows, s)
+	}
+	// Older clients only know how to log in with CAS through the legacy
+	// /login/cas/redirect endpoint.
+	if len(cfg.Matrix.SSO.CASProviders) > 0 {
+		f.Flows = append(f.Flows, flow{
+			Type:   "m.login.cas",
+			Stages: []string{"m.login.cas"},
+		})
 	}
-	f.Flows = append(f.Flows, s)
 	return f
 }
 
 // Login implements GET and POST /login
 func Login(
-	req *http.Request, accountDB accounts.Database, deviceDB devices.Database,
-	cfg *config.Dendrite,
+	req *http.Request, userAPI userapi.UserInternalAPI, accountDB accounts.Database,
+	deviceDB devices.Database, ssoProviders []sso.IdentityProvider, cfg *config.Dendrite,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		// TODO: support other forms of login other than password, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: loginFlows(ssoProviders, cfg),
 		}
 	} else if req.Method == http.MethodPost {
+		defer req.Body.Close() // nolint:errcheck
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+			}
+		}
+		if gjson.GetBytes(bodyBytes, "type").Str == "m.login.token" {
+			return tokenLogin(req, bodyBytes, userAPI, deviceDB, cfg)
+		}
+
 		typePassword := auth.LoginTypePassword{
 			GetAccountByPassword: accountDB.GetAccountByPassword,
 			Config:               cfg,
 		}
-		r := typePassword.Request()
-		resErr := httputil.UnmarshalJSONRequest(req, r)
-		if resErr != nil {
+		var r loginRequest
+		if err = json.Unmarshal(bodyBytes, &r); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+		// The username is checked properly when logging in, we only need it
+		// here to know which account to count failures against.
+		localpart, _ := userutil.ParseUsernameParam(r.Username(), &cfg.Matrix.ServerName)
+		guard := newLoginGuard(req, accountDB, cfg, localpart)
+		if resErr := guard.check(req.Context(), r.CaptchaResponse); resErr != nil {
 			return *resErr
 		}
-		login, authErr := typePassword.Login(req.Context(), r)
+		login, authErr := typePassword.Login(req.Context(), &r.PasswordRequest)
 		if authErr != nil {
+			if authErr.Code == http.StatusForbidden {
+				guard.failed(req.Context(), "incorrect username or password")
+			}
 			return *authErr
 		}
+		guard.succeeded(req.Context())
 		// make a device/access token
-		return completeAuth(req.Context(), cfg.Matrix.ServerName, deviceDB, login)
+		return completeAuth(
+			req.Context(), cfg.Matrix.ServerName, deviceDB, login,
+			accessTokenLifetime(req, login.RefreshToken, cfg),
+		)
 	}
 	return util.JSONResponse{
 		Code: http.StatusMethodNotAllowed,
@@ -89,8 +161,39 @@ func Login(
 	}
 }
 
+// tokenLogin logs in with a login token issued by the user API, e.g. after the
+// user has logged in with SSO. The tokens are too long to guess, so the login
+// guard isn't needed.
+func tokenLogin(
+	req *http.Request, bodyBytes []byte, userAPI userapi.UserInternalAPI,
+	deviceDB devices.Database, cfg *config.Dendrite,
+) util.JSONResponse {
+	typeToken := auth.LoginTypeToken{
+		UserAPI: userAPI,
+	}
+	var r auth.LoginTokenRequest
+	if err := json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	login, authErr := typeToken.Login(req.Context(), &r)
+	if authErr != nil {
+		return *authErr
+	}
+	return completeAuth(
+		req.Context(), cfg.Matrix.ServerName, deviceDB, login,
+		accessTokenLifetime(req, login.RefreshToken, cfg),
+	)
+}
+
+// completeAuth creates a device for a user who has logged in. If tokenLifetime
+// is set, the device's access token expires after it and is issued along with
+// a refresh token.
 func completeAuth(
 	ctx context.Context, serverName gomatrixserverlib.ServerName, deviceDB devices.Database, login *auth.Login,
+	tokenLifetime time.Duration,
 ) util.JSONResponse {
 	token, err := auth.GenerateAccessToken()
 	if err != nil {
@@ -114,13 +217,29 @@ func completeAuth(
 		}
 	}
 
+	var refreshToken string
+	if tokenLifetime > 0 {
+		refreshToken, err = auth.GenerateAccessToken()
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("auth.GenerateAccessToken failed")
+			return jsonerror.InternalServerError()
+		}
+		expiresTS := gomatrixserverlib.AsTimestamp(time.Now().Add(tokenLifetime))
+		if err = deviceDB.SetRefreshToken(ctx, dev.AccessToken, refreshToken, expiresTS); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("deviceDB.SetRefreshToken failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: loginResponse{
-			UserID:      dev.UserID,
-			AccessToken: dev.AccessToken,
-			HomeServer:  serverName,
-			DeviceID:    dev.ID,
+			UserID:       dev.UserID,
+			AccessToken:  dev.AccessToken,
+			HomeServer:   serverName,
+			DeviceID:     dev.ID,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  tokenLifetime.Milliseconds(),
 		},
 	}
 }
@@ -0,0 +1,243 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// errLoginLockedOut is returned instead of checking a password when there
+// have been too many recent failed attempts.
+var errLoginLockedOut = errors.New("too many failed login attempts")
+
+// loginGuard protects an account, and the client trying to log into it,
+// against brute-force password guessing. Failed attempts are persisted in
+// the account database so that they survive restarts.
+type loginGuard struct {
+	accountDB accounts.Database
+	cfg       *config.Dendrite
+	// The localpart being logged into, if known.
+	localpart string
+	// The IP address of the client, if known.
+	ip string
+}
+
+func newLoginGuard(req *http.Request, accountDB accounts.Database, cfg *config.Dendrite, localpart string) *loginGuard {
+	return &loginGuard{
+		accountDB: accountDB,
+		cfg:       cfg,
+		localpart: localpart,
+		ip:        clientIP(req, cfg),
+	}
+}
+
+// clientIP returns the IP address that the request came from. The
+// X-Forwarded-For header is only believed on requests from trusted proxies,
+// and then only back to the last address which isn't a trusted proxy, as
+// anything before that could have been set by the client.
+func clientIP(req *http.Request, cfg *config.Dendrite) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !isTrustedProxy(cfg, ip) {
+		return ip
+	}
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		ip = addr
+		if !isTrustedProxy(cfg, addr) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(cfg *config.Dendrite, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range cfg.Derived.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// recentFailures returns the higher of the number of recent failures for the
+// account and for the IP address, along with how long it will be until the
+// most recent of those failures is forgotten.
+func (g *loginGuard) recentFailures(ctx context.Context) (count int, retryAfter time.Duration, err error) {
+	window := g.cfg.Matrix.LoginProtection.FailureWindow
+	since := gomatrixserverlib.AsTimestamp(time.Now().Add(-window))
+	var lastFailure gomatrixserverlib.Timestamp
+	for kind, key := range map[string]string{
+		accounts.LoginFailureAccount: g.localpart,
+		accounts.LoginFailureIP:      g.ip,
+	} {
+		if key == "" {
+			continue
+		}
+		n, last, err := g.accountDB.GetLoginFailures(ctx, kind, key, since)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n > count {
+			count = n
+		}
+		if last > lastFailure {
+			lastFailure = last
+		}
+	}
+	if count > 0 {
+		retryAfter = time.Until(lastFailure.Time().Add(window))
+	}
+	return count, retryAfter, nil
+}
+
+// check returns an error response if login attempts are currently being
+// refused, or if a captcha is needed and the given response doesn't pass.
+func (g *loginGuard) check(ctx context.Context, captchaResponse string) *util.JSONResponse {
+	protection := &g.cfg.Matrix.LoginProtection
+	if protection.Disabled {
+		return nil
+	}
+	failures, retryAfter, err := g.recentFailures(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("loginGuard.recentFailures failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if failures >= protection.MaxFailedAttempts {
+		g.logger(ctx).WithField("failures", failures).Warn("Refusing login attempt after too many failures")
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many failed login attempts", retryAfter.Milliseconds()),
+		}
+	}
+	if protection.CaptchaAfterFailedAttempts > 0 && failures >= protection.CaptchaAfterFailedAttempts {
+		if captchaResponse == "" {
+			return &util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.CaptchaNeeded(
+					"A captcha must be solved after too many failed login attempts",
+					g.cfg.Matrix.RecaptchaPublicKey,
+				),
+			}
+		}
+		if resErr := verifyRecaptcha(g.cfg, captchaResponse, g.ip); resErr != nil {
+			g.failed(ctx, "invalid captcha response")
+			return resErr
+		}
+	}
+	return nil
+}
+
+// failed records a failed login attempt against both the account and the IP
+// address, and writes it to the audit log.
+func (g *loginGuard) failed(ctx context.Context, reason string) {
+	g.logger(ctx).WithField("reason", reason).Warn("Failed login attempt")
+	protection := &g.cfg.Matrix.LoginProtection
+	if protection.Disabled {
+		return
+	}
+	now := time.Now()
+	windowStart := gomatrixserverlib.AsTimestamp(now.Add(-protection.FailureWindow))
+	for kind, key := range map[string]string{
+		accounts.LoginFailureAccount: g.localpart,
+		accounts.LoginFailureIP:      g.ip,
+	} {
+		if key == "" {
+			continue
+		}
+		if err := g.accountDB.RecordLoginFailure(ctx, kind, key, gomatrixserverlib.AsTimestamp(now), windowStart); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.RecordLoginFailure failed")
+		}
+	}
+}
+
+// succeeded clears the failed attempts against the account. Failures from
+// the IP address are kept, since a successful login to one account says
+// nothing about attempts on others.
+func (g *loginGuard) succeeded(ctx context.Context) {
+	if g.cfg.Matrix.LoginProtection.Disabled || g.localpart == "" {
+		return
+	}
+	if err := g.accountDB.ResetLoginFailures(ctx, accounts.LoginFailureAccount, g.localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.ResetLoginFailures failed")
+	}
+}
+
+func (g *loginGuard) logger(ctx context.Context) *log.Entry {
+	return util.GetLogger(ctx).WithFields(log.Fields{
+		"audit":     "login",
+		"localpart": g.localpart,
+		"ip":        g.ip,
+	})
+}
+
+// guardedGetAccountByPassword checks passwords the same way as the account
+// database does, but counts failures towards the account's login limits and
+// refuses to check passwords while the account is locked out. This stops
+// user-interactive auth from being used to get around the limits on /login.
+func guardedGetAccountByPassword(accountDB accounts.Database, cfg *config.Dendrite) auth.GetAccountByPassword {
+	return func(ctx context.Context, localpart, password string) (*api.Account, error) {
+		g := &loginGuard{
+			accountDB: accountDB,
+			cfg:       cfg,
+			localpart: localpart,
+		}
+		if !cfg.Matrix.LoginProtection.Disabled {
+			failures, _, err := g.recentFailures(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if failures >= cfg.Matrix.LoginProtection.MaxFailedAttempts {
+				g.logger(ctx).WithField("failures", failures).Warn("Refusing user-interactive auth after too many failures")
+				return nil, errLoginLockedOut
+			}
+		}
+		acc, err := accountDB.GetAccountByPassword(ctx, localpart, password)
+		if err != nil {
+			g.failed(ctx, "incorrect password during user-interactive auth")
+			return nil, err
+		}
+		g.succeeded(ctx)
+		return acc, nil
+	}
+}
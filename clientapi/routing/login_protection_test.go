@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/util"
+)
+
+type loginTest struct {
+	t         *testing.T
+	cfg       *config.Dendrite
+	accountDB accounts.Database
+	deviceDB  devices.Database
+}
+
+func newLoginTest(t *testing.T) *loginTest {
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create account database: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create device database: %s", err)
+	}
+	for _, localpart := range []string{"alice", "bob"} {
+		if _, err = accountDB.CreateAccount(context.Background(), localpart, localpart+"password", ""); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.LoginProtection.MaxFailedAttempts = 3
+	cfg.Matrix.LoginProtection.FailureWindow = time.Minute
+	return &loginTest{t: t, cfg: cfg, accountDB: accountDB, deviceDB: deviceDB}
+}
+
+// login tries to log into the account from the given IP address.
+func (lt *loginTest) login(localpart, password, ip string) util.JSONResponse {
+	body := fmt.Sprintf(`{"type":"m.login.password","identifier":{"type":"m.id.user","user":%q},"password":%q}`, localpart, password)
+	req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", strings.NewReader(body))
+	req.RemoteAddr = ip + ":1234"
+	return Login(req, nil, lt.accountDB, lt.deviceDB, nil, lt.cfg)
+}
+
+func (lt *loginTest) mustLogin(localpart, password, ip string, wantCode int, wantErrCode string) {
+	lt.t.Helper()
+	res := lt.login(localpart, password, ip)
+	if res.Code != wantCode {
+		lt.t.Fatalf("logging into %s from %s: got status %d, want %d: %+v", localpart, ip, res.Code, wantCode, res.JSON)
+	}
+	if wantErrCode == "" {
+		return
+	}
+	var errCode string
+	switch e := res.JSON.(type) {
+	case *jsonerror.MatrixError:
+		errCode = e.ErrCode
+	case *jsonerror.LimitExceededError:
+		errCode = e.ErrCode
+	case *jsonerror.CaptchaNeededError:
+		errCode = e.ErrCode
+	}
+	if errCode != wantErrCode {
+		lt.t.Fatalf("logging into %s from %s: got %+v, want %s", localpart, ip, res.JSON, wantErrCode)
+	}
+}
+
+func TestLoginLockedOutAfterFailures(t *testing.T) {
+	lt := newLoginTest(t)
+	for i := 0; i < 3; i++ {
+		lt.mustLogin("alice", "wrong", "10.0.0.1", http.StatusForbidden, "M_FORBIDDEN")
+	}
+	// Even the right password is refused now, from anywhere.
+	lt.mustLogin("alice", "alicepassword", "10.0.0.2", http.StatusTooManyRequests, "M_LIMIT_EXCEEDED")
+	// The same client can't go on to guess the passwords of other accounts.
+	lt.mustLogin("bob", "bobpassword", "10.0.0.1", http.StatusTooManyRequests, "M_LIMIT_EXCEEDED")
+	// Other accounts can still be logged into from elsewhere.
+	lt.mustLogin("bob", "bobpassword", "10.0.0.3", http.StatusOK, "")
+}
+
+func TestLoginSuccessResetsAccountFailures(t *testing.T) {
+	lt := newLoginTest(t)
+	lt.mustLogin("alice", "wrong", "10.0.0.1", http.StatusForbidden, "M_FORBIDDEN")
+	lt.mustLogin("alice", "wrong", "10.0.0.1", http.StatusForbidden, "M_FORBIDDEN")
+	lt.mustLogin("alice", "alicepassword", "10.0.0.2", http.StatusOK, "")
+	// Only the failures since the successful login count against the account.
+	lt.mustLogin("alice", "wrong", "10.0.0.3", http.StatusForbidden, "M_FORBIDDEN")
+	lt.mustLogin("alice", "wrong", "10.0.0.3", http.StatusForbidden, "M_FORBIDDEN")
+	lt.mustLogin("alice", "alicepassword", "10.0.0.4", http.StatusOK, "")
+}
+
+func TestLoginFailuresExpire(t *testing.T) {
+	lt := newLoginTest(t)
+	lt.cfg.Matrix.LoginProtection.FailureWindow = 100 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		lt.mustLogin("alice", "wrong", "10.0.0.1", http.StatusForbidden, "M_FORBIDDEN")
+	}
+	lt.mustLogin("alice", "alicepassword", "10.0.0.1", http.StatusTooManyRequests, "M_LIMIT_EXCEEDED")
+	time.Sleep(200 * time.Millisecond)
+	lt.mustLogin("alice", "alicepassword", "10.0.0.1", http.StatusOK, "")
+}
+
+func TestLoginCaptchaNeededAfterFailures(t *testing.T) {
+	lt := newLoginTest(t)
+	lt.cfg.Matrix.LoginProtection.CaptchaAfterFailedAttempts = 1
+	lt.cfg.Matrix.RecaptchaPublicKey = "public"
+	lt.mustLogin("alice", "wrong", "10.0.0.1", http.StatusForbidden, "M_FORBIDDEN")
+	lt.mustLogin("alice", "alicepassword", "10.0.0.2", http.StatusUnauthorized, "M_CAPTCHA_NEEDED")
+}
+
+func TestLoginProtectionDisabled(t *testing.T) {
+	lt := newLoginTest(t)
+	lt.cfg.Matrix.LoginProtection.Disabled = true
+	for i := 0; i < 5; i++ {
+		lt.mustLogin("alice", "wrong", "10.0.0.1", http.StatusForbidden, "M_FORBIDDEN")
+	}
+	lt.mustLogin("alice", "alicepassword", "10.0.0.1", http.StatusOK, "")
+}
+
+func TestGuardedGetAccountByPassword(t *testing.T) {
+	lt := newLoginTest(t)
+	getAccount := guardedGetAccountByPassword(lt.accountDB, lt.cfg)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := getAccount(ctx, "alice", "wrong"); err == nil {
+			t.Fatalf("got an account for the wrong password")
+		}
+	}
+	// User-interactive auth counts towards the same limits as /login.
+	if _, err := getAccount(ctx, "alice", "alicepassword"); err != errLoginLockedOut {
+		t.Fatalf("got error %v for the right password after too many failures, want %v", err, errLoginLockedOut)
+	}
+	lt.mustLogin("alice", "alicepassword", "10.0.0.1", http.StatusTooManyRequests, "M_LIMIT_EXCEEDED")
+}
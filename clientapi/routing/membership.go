@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"time"
@@ -39,127 +40,65 @@ import (
 
 var errMissingUserID = errors.New("'user_id' must be supplied")
 
+// SendBan implements:
+//     POST /rooms/{roomID}/ban
 func SendBan(
-	req *http.Request, accountDB accounts.Database, device *userapi.Device,
-	roomID string, cfg *config.Dendrite,
-	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
-	if reqErr != nil {
-		return *reqErr
-	}
-	return sendMembership(req.Context(), accountDB, device, roomID, "ban", body.Reason, cfg, body.UserID, evTime, roomVer, rsAPI, asAPI)
-}
-
-func sendMembership(ctx context.Context, accountDB accounts.Database, device *userapi.Device,
-	roomID, membership, reason string, cfg *config.Dendrite, targetUserID string, evTime time.Time,
-	roomVer gomatrixserverlib.RoomVersion,
-	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI) util.JSONResponse {
-
-	event, err := buildMembershipEvent(
-		ctx, targetUserID, reason, accountDB, device, membership,
-		roomID, false, cfg, evTime, rsAPI, asAPI,
-	)
-	if err == errMissingUserID {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.BadJSON(err.Error()),
-		}
-	} else if err == eventutil.ErrRoomNoExists {
-		return util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound(err.Error()),
-		}
-	} else if err != nil {
-		util.GetLogger(ctx).WithError(err).Error("buildMembershipEvent failed")
-		return jsonerror.InternalServerError()
-	}
-
-	_, err = roomserverAPI.SendEvents(
-		ctx, rsAPI,
-		[]gomatrixserverlib.HeaderedEvent{event.Event.Headered(roomVer)},
-		cfg.Matrix.ServerName,
-		nil,
-	)
-	if err != nil {
-		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
-		return jsonerror.InternalServerError()
-	}
-
-	return util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: struct{}{},
-	}
+	return sendModeration(req, device, roomID, rsAPI, rsAPI.PerformBan)
 }
 
+// SendKick implements:
+//     POST /rooms/{roomID}/kick
 func SendKick(
-	req *http.Request, accountDB accounts.Database, device *userapi.Device,
-	roomID string, cfg *config.Dendrite,
-	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
-	if reqErr != nil {
-		return *reqErr
-	}
-	if body.UserID == "" {
-		return util.JSONResponse{
-			Code: 400,
-			JSON: jsonerror.BadJSON("missing user_id"),
-		}
-	}
-
-	var queryRes roomserverAPI.QueryMembershipForUserResponse
-	err := rsAPI.QueryMembershipForUser(req.Context(), &roomserverAPI.QueryMembershipForUserRequest{
-		RoomID: roomID,
-		UserID: body.UserID,
-	}, &queryRes)
-	if err != nil {
-		return util.ErrorResponse(err)
-	}
-	// kick is only valid if the user is not currently banned
-	if queryRes.Membership == "ban" {
-		return util.JSONResponse{
-			Code: 403,
-			JSON: jsonerror.Unknown("cannot /kick banned users"),
-		}
-	}
-	// TODO: should we be using SendLeave instead?
-	return sendMembership(req.Context(), accountDB, device, roomID, "leave", body.Reason, cfg, body.UserID, evTime, roomVer, rsAPI, asAPI)
+	return sendModeration(req, device, roomID, rsAPI, rsAPI.PerformKick)
 }
 
+// SendUnban implements:
+//     POST /rooms/{roomID}/unban
 func SendUnban(
-	req *http.Request, accountDB accounts.Database, device *userapi.Device,
-	roomID string, cfg *config.Dendrite,
-	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
+	return sendModeration(req, device, roomID, rsAPI, rsAPI.PerformUnban)
+}
+
+// sendModeration changes the membership of the user in the request with the
+// given roomserver call, which checks that the device's user is allowed to.
+func sendModeration(
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	perform func(context.Context, *roomserverAPI.PerformModerationRequest, *roomserverAPI.PerformModerationResponse),
+) util.JSONResponse {
+	body, _, _, reqErr := extractRequestData(req, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
 	if body.UserID == "" {
 		return util.JSONResponse{
-			Code: 400,
-			JSON: jsonerror.BadJSON("missing user_id"),
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(errMissingUserID.Error()),
 		}
 	}
 
-	var queryRes roomserverAPI.QueryMembershipForUserResponse
-	err := rsAPI.QueryMembershipForUser(req.Context(), &roomserverAPI.QueryMembershipForUserRequest{
-		RoomID: roomID,
-		UserID: body.UserID,
-	}, &queryRes)
-	if err != nil {
-		return util.ErrorResponse(err)
+	var res roomserverAPI.PerformModerationResponse
+	perform(req.Context(), &roomserverAPI.PerformModerationRequest{
+		RoomID:       roomID,
+		UserID:       device.UserID,
+		TargetUserID: body.UserID,
+		Reason:       body.Reason,
+	}, &res)
+	if res.Error != nil {
+		return res.Error.JSONResponse()
 	}
-	// unban is only valid if the user is currently banned
-	if queryRes.Membership != "ban" {
-		return util.JSONResponse{
-			Code: 400,
-			JSON: jsonerror.Unknown("can only /unban users that are banned"),
-		}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
 	}
-	// TODO: should we be using SendLeave instead?
-	return sendMembership(req.Context(), accountDB, device, roomID, "leave", body.Reason, cfg, body.UserID, evTime, roomVer, rsAPI, asAPI)
 }
 
 func SendInvite(
@@ -189,8 +128,33 @@ func SendInvite(
 		}
 	}
 
+	return sendInvite(req.Context(), accountDB, device, roomID, body.UserID, body.Reason, cfg, evTime, roomVer, rsAPI, asAPI)
+}
+
+// sendInvite builds an invite for the target user and sends it to the
+// roomserver, which passes it over federation if the invitee is remote.
+func sendInvite(
+	ctx context.Context, accountDB accounts.Database, device *userapi.Device,
+	roomID, targetUserID, reason string, cfg *config.Dendrite, evTime time.Time,
+	roomVer gomatrixserverlib.RoomVersion,
+	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+) util.JSONResponse {
+	// If the invitee is a local user who has ignored the sender then we
+	// quietly drop the invite, so as not to reveal that they are ignored.
+	ignored, err := isIgnoredByLocalUser(ctx, accountDB, cfg, targetUserID, device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("isIgnoredByLocalUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if ignored {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	event, err := buildMembershipEvent(
-		req.Context(), body.UserID, body.Reason, accountDB, device, "invite",
+		ctx, targetUserID, reason, accountDB, device, "invite",
 		roomID, false, cfg, evTime, rsAPI, asAPI,
 	)
 	if err == errMissingUserID {
@@ -204,19 +168,19 @@ func SendInvite(
 			JSON: jsonerror.NotFound(err.Error()),
 		}
 	} else if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
+		util.GetLogger(ctx).WithError(err).Error("buildMembershipEvent failed")
 		return jsonerror.InternalServerError()
 	}
 
 	perr := roomserverAPI.SendInvite(
-		req.Context(), rsAPI,
+		ctx, rsAPI,
 		event.Event.Headered(roomVer),
 		nil, // ask the roomserver to draw up invite room state for us
 		cfg.Matrix.ServerName,
 		nil,
 	)
 	if perr != nil {
-		util.GetLogger(req.Context()).WithError(perr).Error("producer.SendInvite failed")
+		util.GetLogger(ctx).WithError(perr).Error("producer.SendInvite failed")
 		return perr.JSONResponse()
 	}
 	return util.JSONResponse{
@@ -225,6 +189,28 @@ func SendInvite(
 	}
 }
 
+// isIgnoredByLocalUser returns true if the target user is local to this
+// server and has the sender in their m.ignored_user_list account data.
+func isIgnoredByLocalUser(
+	ctx context.Context, accountDB accounts.Database, cfg *config.Dendrite,
+	targetUserID, senderUserID string,
+) (bool, error) {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', targetUserID)
+	if err != nil || domain != cfg.Matrix.ServerName {
+		// Malformed user IDs are rejected later when building the event.
+		return false, nil
+	}
+	data, err := accountDB.GetAccountDataByType(ctx, localpart, "", "m.ignored_user_list")
+	if err != nil || data == nil {
+		return false, err
+	}
+	var ignoredUsers eventutil.IgnoredUsers
+	if err = json.Unmarshal(data, &ignoredUsers); err != nil {
+		return false, err
+	}
+	return ignoredUsers.IsIgnored(senderUserID), nil
+}
+
 func buildMembershipEvent(
 	ctx context.Context,
 	targetUserID, reason string, accountDB accounts.Database,
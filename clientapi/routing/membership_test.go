@@ -0,0 +1,77 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestIgnoredUsersInvites(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create account database: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(ctx, "alice", "alicepassword", ""); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	ignoredUsers := json.RawMessage(`{"ignored_users":{"@mallory:localhost":{},"@eve:remote":{}}}`)
+	if err = accountDB.SaveAccountData(ctx, "alice", "", "m.ignored_user_list", ignoredUsers); err != nil {
+		t.Fatalf("failed to save account data: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+
+	for _, tt := range []struct {
+		target, sender string
+		want           bool
+	}{
+		{"@alice:localhost", "@mallory:localhost", true},
+		{"@alice:localhost", "@eve:remote", true},
+		{"@alice:localhost", "@bob:localhost", false},
+		// only the account data of local users is known
+		{"@alice:remote", "@mallory:localhost", false},
+		// users who haven't ignored anybody
+		{"@bob:localhost", "@mallory:localhost", false},
+	} {
+		got, err := isIgnoredByLocalUser(ctx, accountDB, cfg, tt.target, tt.sender)
+		if err != nil {
+			t.Fatalf("isIgnoredByLocalUser failed: %s", err)
+		}
+		if got != tt.want {
+			t.Errorf("isIgnoredByLocalUser(%s, %s): got %v, want %v", tt.target, tt.sender, got, tt.want)
+		}
+	}
+
+	// The invite from the ignored user is dropped without telling them, so
+	// it never gets as far as the roomserver.
+	device := &userapi.Device{UserID: "@mallory:localhost"}
+	res := sendInvite(
+		ctx, accountDB, device, "!room:localhost", "@alice:localhost", "",
+		cfg, time.Now(), gomatrixserverlib.RoomVersionV1, nil, nil,
+	)
+	if res.Code != http.StatusOK {
+		t.Errorf("got status %d for an invite to a user ignoring the sender, want %d", res.Code, http.StatusOK)
+	}
+}
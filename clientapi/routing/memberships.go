@@ -20,17 +20,11 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
-	"github.com/matrix-org/dendrite/internal/config"
-	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-type getMembershipResponse struct {
-	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
-}
-
 type getJoinedRoomsResponse struct {
 	JoinedRooms []string `json:"joined_rooms"`
 }
@@ -45,49 +39,67 @@ type joinedMember struct {
 	AvatarURL   string `json:"avatar_url"`
 }
 
-// GetMemberships implements GET /rooms/{roomId}/members
-func GetMemberships(
-	req *http.Request, device *userapi.Device, roomID string, joinedOnly bool,
-	_ *config.Dendrite,
-	rsAPI api.RoomserverInternalAPI,
+// GetJoinedMembers implements GET /rooms/{roomId}/joined_members
+// Unlike /members, this only works for users who are currently in the room,
+// and returns the current members along with their profiles in the room.
+func GetJoinedMembers(
+	req *http.Request, device *userapi.Device, roomID string,
+	stateAPI currentstateAPI.CurrentStateInternalAPI,
 ) util.JSONResponse {
-	queryReq := api.QueryMembershipsForRoomRequest{
-		JoinedOnly: joinedOnly,
-		RoomID:     roomID,
-		Sender:     device.UserID,
+	ctx := req.Context()
+	if resErr := checkMemberInRoom(ctx, stateAPI, device.UserID, roomID); resErr != nil {
+		return *resErr
 	}
-	var queryRes api.QueryMembershipsForRoomResponse
-	if err := rsAPI.QueryMembershipsForRoom(req.Context(), &queryReq, &queryRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipsForRoom failed")
+
+	// Find out who is joined from the denormalised memberships first, so
+	// that only the join events have to be fetched.
+	var membershipsRes currentstateAPI.QueryBulkStateContentResponse
+	err := stateAPI.QueryBulkStateContent(ctx, &currentstateAPI.QueryBulkStateContentRequest{
+		RoomIDs:        []string{roomID},
+		AllowWildcards: true,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: "*"},
+		},
+	}, &membershipsRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("stateAPI.QueryBulkStateContent failed")
 		return jsonerror.InternalServerError()
 	}
-
-	if !queryRes.HasBeenInRoom {
-		return util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+	var joinTuples []gomatrixserverlib.StateKeyTuple
+	for tuple, membership := range membershipsRes.Rooms[roomID] {
+		if membership == gomatrixserverlib.Join {
+			joinTuples = append(joinTuples, tuple)
 		}
 	}
 
-	if joinedOnly {
-		var res getJoinedMembersResponse
-		res.Joined = make(map[string]joinedMember)
-		for _, ev := range queryRes.JoinEvents {
-			var content joinedMember
-			if err := json.Unmarshal(ev.Content, &content); err != nil {
-				util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal event content")
-				return jsonerror.InternalServerError()
-			}
-			res.Joined[ev.Sender] = content
+	var stateRes currentstateAPI.QueryCurrentStateResponse
+	err = stateAPI.QueryCurrentState(ctx, &currentstateAPI.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: joinTuples,
+	}, &stateRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("stateAPI.QueryCurrentState failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := getJoinedMembersResponse{
+		Joined: make(map[string]joinedMember, len(stateRes.StateEvents)),
+	}
+	for tuple, ev := range stateRes.StateEvents {
+		// The profile fields are named differently in the member events.
+		var content gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(ev.Content(), &content); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to unmarshal event content")
+			return jsonerror.InternalServerError()
 		}
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: res,
+		res.Joined[tuple.StateKey] = joinedMember{
+			DisplayName: content.DisplayName,
+			AvatarURL:   content.AvatarURL,
 		}
 	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: getMembershipResponse{queryRes.JoinEvents},
+		JSON: res,
 	}
 }
 
@@ -98,13 +110,17 @@ func GetJoinedRooms(
 ) util.JSONResponse {
 	var res currentstateAPI.QueryRoomsForUserResponse
 	err := stateAPI.QueryRoomsForUser(req.Context(), &currentstateAPI.QueryRoomsForUserRequest{
-		UserID:         device.UserID,
-		WantMembership: "join",
+		UserID:              device.UserID,
+		WantMembership:      "join",
+		OrderByLastActivity: true,
 	}, &res)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("QueryRoomsForUser failed")
 		return jsonerror.InternalServerError()
 	}
+	if res.RoomIDs == nil {
+		res.RoomIDs = []string{}
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: getJoinedRoomsResponse{res.RoomIDs},
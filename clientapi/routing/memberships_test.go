@@ -0,0 +1,142 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeJoinedMembersStateAPI serves the given m.room.member events as the
+// current state of every room, and the given rooms as the joined rooms of
+// every user.
+type fakeJoinedMembersStateAPI struct {
+	currentstateAPI.CurrentStateInternalAPI
+	members map[string]*gomatrixserverlib.HeaderedEvent
+	roomIDs []string
+}
+
+func (s *fakeJoinedMembersStateAPI) QueryBulkStateContent(
+	ctx context.Context, req *currentstateAPI.QueryBulkStateContentRequest, res *currentstateAPI.QueryBulkStateContentResponse,
+) error {
+	res.Rooms = make(map[string]map[gomatrixserverlib.StateKeyTuple]string)
+	for _, roomID := range req.RoomIDs {
+		res.Rooms[roomID] = make(map[gomatrixserverlib.StateKeyTuple]string)
+		for userID, ev := range s.members {
+			membership, err := ev.Membership()
+			if err != nil {
+				return err
+			}
+			res.Rooms[roomID][gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}] = membership
+		}
+	}
+	return nil
+}
+
+func (s *fakeJoinedMembersStateAPI) QueryCurrentState(
+	ctx context.Context, req *currentstateAPI.QueryCurrentStateRequest, res *currentstateAPI.QueryCurrentStateResponse,
+) error {
+	res.StateEvents = make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent)
+	for _, tuple := range req.StateTuples {
+		if ev, ok := s.members[tuple.StateKey]; ok && tuple.EventType == gomatrixserverlib.MRoomMember {
+			res.StateEvents[tuple] = ev
+		}
+	}
+	return nil
+}
+
+func (s *fakeJoinedMembersStateAPI) QueryRoomsForUser(
+	ctx context.Context, req *currentstateAPI.QueryRoomsForUserRequest, res *currentstateAPI.QueryRoomsForUserResponse,
+) error {
+	res.RoomIDs = s.roomIDs
+	return nil
+}
+
+func mustMemberEvent(t *testing.T, userID, content string) *gomatrixserverlib.HeaderedEvent {
+	return mustRoomSummaryEvent(t, fmt.Sprintf(
+		`{"auth_events":[],"content":%s,"depth":1,"event_id":"$%s","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":%q,"state_key":%q,"type":"m.room.member","hashes":{"sha256":""},"signatures":{}}`,
+		content, userID[1:], userID, userID,
+	))
+}
+
+func TestGetJoinedMembers(t *testing.T) {
+	stateAPI := &fakeJoinedMembersStateAPI{
+		members: map[string]*gomatrixserverlib.HeaderedEvent{
+			"@alice:localhost":   mustMemberEvent(t, "@alice:localhost", `{"membership":"join","displayname":"Alice","avatar_url":"mxc://localhost/alice"}`),
+			"@bob:localhost":     mustMemberEvent(t, "@bob:localhost", `{"membership":"join"}`),
+			"@charlie:localhost": mustMemberEvent(t, "@charlie:localhost", `{"membership":"leave","displayname":"Charlie"}`),
+			"@dave:localhost":    mustMemberEvent(t, "@dave:localhost", `{"membership":"invite"}`),
+		},
+	}
+	get := func(userID string) (int, interface{}) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/!room:localhost/joined_members", nil)
+		res := GetJoinedMembers(req, &userapi.Device{UserID: userID}, "!room:localhost", stateAPI)
+		return res.Code, res.JSON
+	}
+
+	for _, userID := range []string{"@charlie:localhost", "@dave:localhost", "@eve:localhost"} {
+		if code, _ := get(userID); code != http.StatusForbidden {
+			t.Errorf("got status %d for %s who isn't joined to the room, want %d", code, userID, http.StatusForbidden)
+		}
+	}
+
+	code, body := get("@bob:localhost")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d for a joined user, want %d", code, http.StatusOK)
+	}
+	want := getJoinedMembersResponse{
+		Joined: map[string]joinedMember{
+			"@alice:localhost": {DisplayName: "Alice", AvatarURL: "mxc://localhost/alice"},
+			"@bob:localhost":   {},
+		},
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("got joined members %+v, want %+v", body, want)
+	}
+}
+
+func TestGetJoinedRooms(t *testing.T) {
+	tests := []struct {
+		roomIDs []string
+		want    string
+	}{
+		{nil, `{"joined_rooms":[]}`},
+		{[]string{"!a:localhost", "!b:localhost"}, `{"joined_rooms":["!a:localhost","!b:localhost"]}`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/joined_rooms", nil)
+		res := GetJoinedRooms(req, &userapi.Device{UserID: "@alice:localhost"}, &fakeJoinedMembersStateAPI{roomIDs: tt.roomIDs})
+		if res.Code != http.StatusOK {
+			t.Errorf("rooms %v: got status %d, want %d", tt.roomIDs, res.Code, http.StatusOK)
+			continue
+		}
+		got, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("rooms %v: got %s, want %s", tt.roomIDs, got, tt.want)
+		}
+	}
+}
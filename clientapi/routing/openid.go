@@ -0,0 +1,67 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type openIDTokenResponse struct {
+	AccessToken      string                       `json:"access_token"`
+	TokenType        string                       `json:"token_type"`
+	MatrixServerName gomatrixserverlib.ServerName `json:"matrix_server_name"`
+	ExpiresIn        int64                        `json:"expires_in"`
+}
+
+// CreateOpenIDToken implements
+//     POST /user/{userID}/openid/request_token
+// The token can be given to a third party, such as an integration manager,
+// which checks who the user is by sending it to the federation
+// /openid/userinfo endpoint.
+func CreateOpenIDToken(
+	req *http.Request, userAPI api.UserInternalAPI, device *api.Device, userID string,
+) util.JSONResponse {
+	if userID != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot request tokens for other users"),
+		}
+	}
+
+	var res api.PerformOpenIDTokenCreationResponse
+	err := userAPI.PerformOpenIDTokenCreation(req.Context(), &api.PerformOpenIDTokenCreationRequest{
+		UserID: userID,
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformOpenIDTokenCreation failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: openIDTokenResponse{
+			AccessToken:      res.Token,
+			TokenType:        "Bearer",
+			MatrixServerName: res.ServerName,
+			ExpiresIn:        int64(time.Until(res.ExpiresTS.Time()) / time.Second),
+		},
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+type newPasswordRequest struct {
+	NewPassword string `json:"new_password"`
+	// Defaults to true if omitted.
+	LogoutDevices *bool `json:"logout_devices"`
+}
+
+// RequestPasswordEmailToken implements:
+//     POST /account/password/email/requestToken
+func RequestPasswordEmailToken(
+	req *http.Request, accountDB accounts.Database, emailValidator *threepid.EmailValidator,
+	rateLimits *rateLimits,
+) util.JSONResponse {
+	if emailValidator == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("password resets by email are not enabled on this server"),
+		}
+	}
+	var body threepid.EmailAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if !threepid.ValidClientSecret(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("client_secret is invalid"),
+		}
+	}
+	if r := rateLimits.checkEmailAddress(body.Email); r != nil {
+		return *r
+	}
+
+	// Unlike adding an email address, a reset only makes sense for
+	// addresses which already belong to an account.
+	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Email, "email")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if localpart == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "the email address is not associated with an account on this server",
+			},
+		}
+	}
+
+	var resp reqTokenResponse
+	resp.SID, err = emailValidator.CreateSession(req.Context(), body)
+	if err == threepid.ErrTooManySends {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded(err.Error(), 0),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("emailValidator.CreateSession failed")
+		return jsonerror.InternalServerError()
+	}
+	resp.SubmitURL = emailValidator.SubmitURL()
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: resp,
+	}
+}
+
+// Password implements:
+//     POST /account/password
+// Logged in users re-authenticate with the usual UI auth. Users who have
+// forgotten their password authenticate instead with an email address which
+// was validated by RequestPasswordEmailToken.
+func Password(
+	req *http.Request, userAPI api.UserInternalAPI, accountDB accounts.Database,
+	userInteractiveAuth, passwordResetAuth *auth.UserInteractive,
+	emailValidator *threepid.EmailValidator, cfg *config.Dendrite,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	var body newPasswordRequest
+	if err = json.Unmarshal(bodyBytes, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	// Check the password before the UI auth, so that a rejected password
+	// doesn't use up the user's validation session.
+	if body.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'new_password' must be supplied."),
+		}
+	}
+	if resErr := validatePassword(body.NewPassword); resErr != nil {
+		return *resErr
+	}
+
+	var localpart, keepDeviceID string
+	if _, err = auth.ExtractAccessToken(req); err == nil {
+		device, resErr := auth.VerifyUserFromRequest(req, userAPI)
+		if resErr != nil {
+			return *resErr
+		}
+		login, resErr := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+		if resErr != nil {
+			return *resErr
+		}
+		localpart, _, err = gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+		// make sure that the access token being used matches the login creds used for user interactive auth.
+		if login.Username() != localpart && login.Username() != device.UserID {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Cannot change another user's password"),
+			}
+		}
+		keepDeviceID = device.ID
+	} else {
+		if passwordResetAuth == nil {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.MissingToken(err.Error()),
+			}
+		}
+		login, resErr := passwordResetAuth.Verify(ctx, bodyBytes, &api.Device{})
+		if resErr != nil {
+			return *resErr
+		}
+		medium, address := login.ThirdPartyID()
+		localpart, err = accountDB.GetLocalpartForThreePID(ctx, address, medium)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+			return jsonerror.InternalServerError()
+		}
+		if localpart == "" {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("the email address is not associated with an account on this server"),
+			}
+		}
+		// The validation session can only be used for a single reset.
+		sessionID := gjson.GetBytes(bodyBytes, "auth.threepid_creds.sid").Str
+		var removed bool
+		removed, err = emailValidator.RemoveSession(ctx, sessionID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("emailValidator.RemoveSession failed")
+			return jsonerror.InternalServerError()
+		}
+		if !removed {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("the email validation session has already been used"),
+			}
+		}
+	}
+
+	logoutDevices := body.LogoutDevices == nil || *body.LogoutDevices
+	var res api.PerformPasswordUpdateResponse
+	err = userAPI.PerformPasswordUpdate(ctx, &api.PerformPasswordUpdateRequest{
+		UserID:        userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+		Password:      body.NewPassword,
+		LogoutDevices: logoutDevices,
+		KeepDeviceID:  keepDeviceID,
+	}, &res)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformPasswordUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
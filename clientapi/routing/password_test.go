@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type fakePasswordUserAPI struct {
+	api.UserInternalAPI
+	updates []api.PerformPasswordUpdateRequest
+}
+
+func (u *fakePasswordUserAPI) PerformPasswordUpdate(ctx context.Context, req *api.PerformPasswordUpdateRequest, res *api.PerformPasswordUpdateResponse) error {
+	u.updates = append(u.updates, *req)
+	res.PasswordUpdated = true
+	return nil
+}
+
+func TestPasswordResetByEmail(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(ctx, "alice", "oldpassword", ""); err != nil {
+		t.Fatalf("CreateAccount failed: %s", err)
+	}
+	if err = accountDB.SaveThreePIDAssociation(ctx, "alice@localhost", "alice", "email"); err != nil {
+		t.Fatalf("SaveThreePIDAssociation failed: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.RateLimiting.Disabled = true
+	emailValidator := threepid.NewEmailValidator(accountDB, discardMailer{}, &config.Email{
+		PublicBaseURL: "https://matrix.localhost/",
+		TokenLifetime: time.Hour,
+	})
+	passwordResetAuth := auth.NewEmailIdentityUserInteractive(emailValidator.CheckAssociation)
+	limits := newRateLimits(cfg)
+	userAPI := &fakePasswordUserAPI{}
+
+	requestToken := func(email string) (int, string) {
+		body := `{"client_secret":"secret","email":"` + email + `","send_attempt":1}`
+		req := httptest.NewRequest(http.MethodPost, "/account/password/email/requestToken", strings.NewReader(body))
+		res := RequestPasswordEmailToken(req, accountDB, emailValidator, limits)
+		if r, ok := res.JSON.(reqTokenResponse); ok {
+			return res.Code, r.SID
+		}
+		return res.Code, ""
+	}
+	password := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/account/password", strings.NewReader(body))
+		return Password(req, userAPI, accountDB, nil, passwordResetAuth, emailValidator, cfg).Code
+	}
+
+	if code, _ := requestToken("bob@localhost"); code != http.StatusBadRequest {
+		t.Errorf("requesting a token for an unknown address: got status %d want %d", code, http.StatusBadRequest)
+	}
+	code, sid := requestToken("alice@localhost")
+	if code != http.StatusOK || sid == "" {
+		t.Fatalf("requesting a token: got status %d and session %q", code, sid)
+	}
+	resetBody := func(newPassword string) string {
+		b, _ := json.Marshal(map[string]interface{}{
+			"new_password": newPassword,
+			"auth": map[string]interface{}{
+				"type":           "m.login.email.identity",
+				"threepid_creds": map[string]string{"sid": sid, "client_secret": "secret"},
+			},
+		})
+		return string(b)
+	}
+
+	// The address has to be validated before the password can be reset.
+	if code = password(resetBody("newpassword")); code != http.StatusUnauthorized {
+		t.Errorf("resetting before validating: got status %d want %d", code, http.StatusUnauthorized)
+	}
+	session, err := accountDB.GetThreePIDSession(ctx, sid)
+	if err != nil || session == nil {
+		t.Fatalf("GetThreePIDSession returned %+v, %v", session, err)
+	}
+	if err = emailValidator.SubmitToken(ctx, sid, "secret", session.Token); err != nil {
+		t.Fatalf("SubmitToken failed: %s", err)
+	}
+
+	// A rejected password doesn't use up the session.
+	if code = password(resetBody("short")); code != http.StatusBadRequest {
+		t.Errorf("resetting to a weak password: got status %d want %d", code, http.StatusBadRequest)
+	}
+	if code = password(resetBody("newpassword")); code != http.StatusOK {
+		t.Fatalf("resetting: got status %d want %d", code, http.StatusOK)
+	}
+	want := api.PerformPasswordUpdateRequest{UserID: "@alice:localhost", Password: "newpassword", LogoutDevices: true}
+	if len(userAPI.updates) != 1 || userAPI.updates[0] != want {
+		t.Errorf("got password updates %+v, want %+v", userAPI.updates, want)
+	}
+
+	// The session can only be used once.
+	if code = password(resetBody("otherpassword")); code != http.StatusUnauthorized {
+		t.Errorf("reusing the session: got status %d want %d", code, http.StatusUnauthorized)
+	}
+	if len(userAPI.updates) != 1 {
+		t.Errorf("got %d password updates after reusing the session, want 1", len(userAPI.updates))
+	}
+}
+
+func TestPasswordResetByEmailDisabled(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	req := httptest.NewRequest(http.MethodPost, "/account/password/email/requestToken",
+		strings.NewReader(`{"client_secret":"secret","email":"alice@localhost","send_attempt":1}`))
+	if res := RequestPasswordEmailToken(req, nil, nil, newRateLimits(cfg)); res.Code != http.StatusBadRequest {
+		t.Errorf("requesting a token: got status %d want %d", res.Code, http.StatusBadRequest)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/account/password", strings.NewReader(`{"new_password":"newpassword"}`))
+	if res := Password(req, &fakePasswordUserAPI{}, nil, nil, nil, nil, cfg); res.Code != http.StatusUnauthorized {
+		t.Errorf("resetting without an access token: got status %d want %d", res.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const mRoomPinnedEvents = "m.room.pinned_events"
+
+type pinnedEventsContent struct {
+	Pinned []string `json:"pinned"`
+}
+
+// GetPinnedEvents implements:
+//     GET /rooms/{roomID}/pinned_events
+// This is not in the spec: it returns the content of the room's
+// m.room.pinned_events, with an empty list if nothing has been pinned.
+func GetPinnedEvents(
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI api.RoomserverInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI,
+) util.JSONResponse {
+	membershipReq := api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}
+	var membershipRes api.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(req.Context(), &membershipReq, &membershipRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.HasBeenInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+		}
+	}
+
+	pinned, err := queryPinnedEvents(req.Context(), roomID, stateAPI)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPinnedEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: pinnedEventsContent{Pinned: pinned},
+	}
+}
+
+// SetPinnedEvents implements:
+//     PUT /rooms/{roomID}/pinned_events
+// This is not in the spec: it is the same as sending m.room.pinned_events
+// with an empty state key.
+func SetPinnedEvents(
+	req *http.Request, device *userapi.Device, roomID string,
+	cfg *config.Dendrite, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	emptyString := ""
+	return SendEvent(req, device, roomID, mRoomPinnedEvents, nil, &emptyString, cfg, rsAPI, nil)
+}
+
+// queryPinnedEvents returns the IDs of the events pinned in a room, from the
+// content which the current state server extracts from m.room.pinned_events.
+func queryPinnedEvents(
+	ctx context.Context, roomID string, stateAPI currentstateAPI.CurrentStateInternalAPI,
+) ([]string, error) {
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: mRoomPinnedEvents, StateKey: ""}
+	var res currentstateAPI.QueryBulkStateContentResponse
+	err := stateAPI.QueryBulkStateContent(ctx, &currentstateAPI.QueryBulkStateContentRequest{
+		RoomIDs:     []string{roomID},
+		StateTuples: []gomatrixserverlib.StateKeyTuple{tuple},
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	pinned := []string{}
+	if contentVal := res.Rooms[roomID][tuple]; contentVal != "" {
+		// Pinned events that aren't a list of strings are treated as empty,
+		// rather than breaking the room for everyone.
+		if err = json.Unmarshal([]byte(contentVal), &pinned); err != nil {
+			util.GetLogger(ctx).WithError(err).Warnf("Room %s has invalid pinned events", roomID)
+			return []string{}, nil
+		}
+	}
+	return pinned, nil
+}
+
+// validatePinnedEvents checks that the content of an m.room.pinned_events
+// event is a list of events which exist in the room. Whether the user may pin
+// events at all is left to the power levels, which are checked when the event
+// is built.
+func validatePinnedEvents(
+	ctx context.Context, content map[string]interface{}, roomID string,
+	rsAPI api.RoomserverInternalAPI,
+) *util.JSONResponse {
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("json.Marshal failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	var pinnedEvents pinnedEventsContent
+	if err = json.Unmarshal(rawContent, &pinnedEvents); err != nil || pinnedEvents.Pinned == nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("'pinned' must be a list of event IDs"),
+		}
+	}
+	for _, eventID := range pinnedEvents.Pinned {
+		if !strings.HasPrefix(eventID, "$") {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("%q is not an event ID", eventID)),
+			}
+		}
+	}
+	if len(pinnedEvents.Pinned) == 0 {
+		return nil
+	}
+
+	var res api.QueryEventsByIDResponse
+	err = rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: pinnedEvents.Pinned}, &res)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryEventsByID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	inRoom := make(map[string]bool, len(res.Events))
+	for _, event := range res.Events {
+		if event.RoomID() == roomID {
+			inRoom[event.EventID()] = true
+		}
+	}
+	for _, eventID := range pinnedEvents.Pinned {
+		if !inRoom[eventID] {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("The event %s isn't in this room", eventID)),
+			}
+		}
+	}
+	return nil
+}
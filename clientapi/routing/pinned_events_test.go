@@ -0,0 +1,154 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakePinnedEventsRoomserverAPI only implements the queries used for pinned
+// events.
+type fakePinnedEventsRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	members map[string]bool
+	events  map[string]gomatrixserverlib.HeaderedEvent
+}
+
+func (r *fakePinnedEventsRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *api.QueryMembershipForUserRequest, res *api.QueryMembershipForUserResponse,
+) error {
+	res.HasBeenInRoom = r.members[req.UserID]
+	res.IsInRoom = r.members[req.UserID]
+	return nil
+}
+
+func (r *fakePinnedEventsRoomserverAPI) QueryEventsByID(
+	ctx context.Context, req *api.QueryEventsByIDRequest, res *api.QueryEventsByIDResponse,
+) error {
+	for _, eventID := range req.EventIDs {
+		if ev, ok := r.events[eventID]; ok {
+			res.Events = append(res.Events, ev)
+		}
+	}
+	return nil
+}
+
+// fakePinnedEventsStateAPI returns the given content value for the
+// m.room.pinned_events of every room.
+type fakePinnedEventsStateAPI struct {
+	currentstateAPI.CurrentStateInternalAPI
+	contentVal string
+}
+
+func (s *fakePinnedEventsStateAPI) QueryBulkStateContent(
+	ctx context.Context, req *currentstateAPI.QueryBulkStateContentRequest, res *currentstateAPI.QueryBulkStateContentResponse,
+) error {
+	res.Rooms = make(map[string]map[gomatrixserverlib.StateKeyTuple]string)
+	if s.contentVal == "" {
+		return nil
+	}
+	for _, roomID := range req.RoomIDs {
+		res.Rooms[roomID] = map[gomatrixserverlib.StateKeyTuple]string{
+			{EventType: mRoomPinnedEvents, StateKey: ""}: s.contentVal,
+		}
+	}
+	return nil
+}
+
+func TestGetPinnedEvents(t *testing.T) {
+	rsAPI := &fakePinnedEventsRoomserverAPI{
+		members: map[string]bool{"@alice:localhost": true},
+	}
+	get := func(userID, contentVal string) (int, interface{}) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/rooms/!room:localhost/pinned_events", nil)
+		stateAPI := &fakePinnedEventsStateAPI{contentVal: contentVal}
+		res := GetPinnedEvents(req, &userapi.Device{UserID: userID}, "!room:localhost", rsAPI, stateAPI)
+		return res.Code, res.JSON
+	}
+
+	if code, _ := get("@bob:localhost", `["$a:localhost"]`); code != http.StatusForbidden {
+		t.Errorf("got status %d for a user who was never in the room, want %d", code, http.StatusForbidden)
+	}
+	tests := []struct {
+		contentVal string
+		want       []string
+	}{
+		{"", []string{}},
+		{`[]`, []string{}},
+		{`["$a:localhost","$b:localhost"]`, []string{"$a:localhost", "$b:localhost"}},
+		// invalid pinned events are treated as if nothing was pinned
+		{`[1,2]`, []string{}},
+	}
+	for _, tt := range tests {
+		code, body := get("@alice:localhost", tt.contentVal)
+		if code != http.StatusOK {
+			t.Errorf("content %q: got status %d, want %d", tt.contentVal, code, http.StatusOK)
+			continue
+		}
+		if got := body.(pinnedEventsContent).Pinned; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("content %q: got pinned events %v, want %v", tt.contentVal, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePinnedEvents(t *testing.T) {
+	rsAPI := &fakePinnedEventsRoomserverAPI{
+		events: make(map[string]gomatrixserverlib.HeaderedEvent),
+	}
+	for _, eventJSON := range []string{
+		`{"auth_events":[],"content":{"body":"hello"},"depth":1,"event_id":"$here:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@bob:localhost","type":"m.room.message","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"body":"hello"},"depth":1,"event_id":"$elsewhere:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!other:localhost","sender":"@bob:localhost","type":"m.room.message","hashes":{"sha256":""},"signatures":{}}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		rsAPI.events[ev.EventID()] = ev.Headered(gomatrixserverlib.RoomVersionV1)
+	}
+
+	tests := []struct {
+		name     string
+		content  map[string]interface{}
+		wantCode int
+	}{
+		{"no pinned events", map[string]interface{}{"pinned": []interface{}{}}, 0},
+		{"event in the room", map[string]interface{}{"pinned": []interface{}{"$here:localhost"}}, 0},
+		{"missing list", map[string]interface{}{}, http.StatusBadRequest},
+		{"not a list", map[string]interface{}{"pinned": "$here:localhost"}, http.StatusBadRequest},
+		{"not an event ID", map[string]interface{}{"pinned": []interface{}{"here"}}, http.StatusBadRequest},
+		{"unknown event", map[string]interface{}{"pinned": []interface{}{"$unknown:localhost"}}, http.StatusBadRequest},
+		{"event in another room", map[string]interface{}{"pinned": []interface{}{"$here:localhost", "$elsewhere:localhost"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resErr := validatePinnedEvents(context.Background(), tt.content, "!room:localhost", rsAPI)
+		switch {
+		case tt.wantCode == 0 && resErr != nil:
+			t.Errorf("%s: got status %d, want the pinned events to be valid", tt.name, resErr.Code)
+		case tt.wantCode != 0 && resErr == nil:
+			t.Errorf("%s: expected the pinned events to be invalid", tt.name)
+		case tt.wantCode != 0 && resErr.Code != tt.wantCode:
+			t.Errorf("%s: got status %d, want %d", tt.name, resErr.Code, tt.wantCode)
+		}
+	}
+}
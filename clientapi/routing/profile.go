@@ -139,6 +139,10 @@ func SetAvatarURL(
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetAvatarURL failed")
 		return jsonerror.InternalServerError()
 	}
+	if err = updateUserDirectory(req.Context(), accountDB, stateAPI, userID, localpart); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("updateUserDirectory failed")
+		return jsonerror.InternalServerError()
+	}
 
 	var res currentstateAPI.QueryRoomsForUserResponse
 	err = stateAPI.QueryRoomsForUser(req.Context(), &currentstateAPI.QueryRoomsForUserRequest{
@@ -257,6 +261,10 @@ func SetDisplayName(
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetDisplayName failed")
 		return jsonerror.InternalServerError()
 	}
+	if err = updateUserDirectory(req.Context(), accountDB, stateAPI, userID, localpart); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("updateUserDirectory failed")
+		return jsonerror.InternalServerError()
+	}
 
 	var res currentstateAPI.QueryRoomsForUserResponse
 	err = stateAPI.QueryRoomsForUser(req.Context(), &currentstateAPI.QueryRoomsForUserRequest{
@@ -385,3 +393,25 @@ func buildMembershipEvents(
 
 	return evs, nil
 }
+
+// updateUserDirectory tells the user directory about the global profile of a
+// local user after it has been changed. Does nothing if stateAPI is nil.
+func updateUserDirectory(
+	ctx context.Context, accountDB accounts.Database, stateAPI currentstateAPI.CurrentStateInternalAPI,
+	userID, localpart string,
+) error {
+	if stateAPI == nil {
+		return nil
+	}
+	profile, err := accountDB.GetProfileByLocalpart(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	return stateAPI.PerformUpdateUserDirectory(ctx, &currentstateAPI.PerformUpdateUserDirectoryRequest{
+		Profiles: []currentstateAPI.UserDirectoryEntry{{
+			UserID:      userID,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}},
+	}, &currentstateAPI.PerformUpdateUserDirectoryResponse{})
+}
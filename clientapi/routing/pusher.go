@@ -0,0 +1,202 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// The longest push keys and app IDs allowed by the spec.
+	maxPushKeyLength = 512
+	maxAppIDLength   = 64
+)
+
+type pusherJSON struct {
+	PushKey           string                 `json:"pushkey"`
+	Kind              userapi.PusherKind     `json:"kind"`
+	AppID             string                 `json:"app_id"`
+	AppDisplayName    string                 `json:"app_display_name"`
+	DeviceDisplayName string                 `json:"device_display_name"`
+	ProfileTag        string                 `json:"profile_tag,omitempty"`
+	Language          string                 `json:"lang"`
+	Data              map[string]interface{} `json:"data"`
+}
+
+type pushersResponse struct {
+	Pushers []pusherJSON `json:"pushers"`
+}
+
+type setPusherRequest struct {
+	pusherJSON
+	// A null kind removes the pusher.
+	Kind   *userapi.PusherKind `json:"kind"`
+	Append bool                `json:"append"`
+}
+
+// GetPushers implements GET /pushers
+func GetPushers(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	queryReq := userapi.QueryPushersRequest{
+		UserID: device.UserID,
+	}
+	queryRes := userapi.QueryPushersResponse{}
+	if err := userAPI.QueryPushers(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryPushers failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := pushersResponse{
+		Pushers: []pusherJSON{},
+	}
+	for _, pusher := range queryRes.Pushers {
+		res.Pushers = append(res.Pushers, pusherJSON{
+			PushKey:           pusher.PushKey,
+			Kind:              pusher.Kind,
+			AppID:             pusher.AppID,
+			AppDisplayName:    pusher.AppDisplayName,
+			DeviceDisplayName: pusher.DeviceDisplayName,
+			ProfileTag:        pusher.ProfileTag,
+			Language:          pusher.Language,
+			Data:              pusher.Data,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// SetPusher implements POST /pushers/set
+func SetPusher(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	var r setPusherRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if resErr := validateSetPusherRequest(&r); resErr != nil {
+		return *resErr
+	}
+
+	if r.Kind == nil {
+		deletionReq := userapi.PerformPusherDeletionRequest{
+			UserID:  device.UserID,
+			AppID:   r.AppID,
+			PushKey: r.PushKey,
+		}
+		deletionRes := userapi.PerformPusherDeletionResponse{}
+		if err := userAPI.PerformPusherDeletion(req.Context(), &deletionReq, &deletionRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPusherDeletion failed")
+			return jsonerror.InternalServerError()
+		}
+	} else {
+		setReq := userapi.PerformPusherSetRequest{
+			UserID: device.UserID,
+			Pusher: userapi.Pusher{
+				DeviceID:          device.ID,
+				PushKey:           r.PushKey,
+				Kind:              *r.Kind,
+				AppID:             r.AppID,
+				AppDisplayName:    r.AppDisplayName,
+				DeviceDisplayName: r.DeviceDisplayName,
+				ProfileTag:        r.ProfileTag,
+				Language:          r.Language,
+				Data:              r.Data,
+			},
+			Append: r.Append,
+		}
+		setRes := userapi.PerformPusherSetResponse{}
+		if err := userAPI.PerformPusherSet(req.Context(), &setReq, &setRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPusherSet failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// validateSetPusherRequest checks that a request to set a pusher has all of
+// the fields that the spec requires. Only the app ID and push key are needed
+// to remove a pusher.
+func validateSetPusherRequest(r *setPusherRequest) *util.JSONResponse {
+	missing := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument(msg),
+		}
+	}
+	invalid := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(msg),
+		}
+	}
+
+	if r.PushKey == "" {
+		return missing("pushkey is required")
+	}
+	if len(r.PushKey) > maxPushKeyLength {
+		return invalid("pushkey is too long")
+	}
+	if r.AppID == "" {
+		return missing("app_id is required")
+	}
+	if len(r.AppID) > maxAppIDLength {
+		return invalid("app_id is too long")
+	}
+	if r.Kind == nil {
+		return nil
+	}
+
+	switch *r.Kind {
+	case userapi.HTTPKind:
+		// HTTP pushers must say where to send notifications to.
+		gateway, _ := r.Data["url"].(string)
+		u, err := url.Parse(gateway)
+		if gateway == "" {
+			return missing("data.url is required for HTTP pushers")
+		}
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return invalid("data.url must be an HTTP URL")
+		}
+	case userapi.EmailKind:
+	default:
+		return invalid("kind must be http or email")
+	}
+	if r.AppDisplayName == "" {
+		return missing("app_display_name is required")
+	}
+	if r.DeviceDisplayName == "" {
+		return missing("device_display_name is required")
+	}
+	if r.Language == "" {
+		return missing("lang is required")
+	}
+	if r.Data == nil {
+		r.Data = map[string]interface{}{}
+	}
+	return nil
+}
@@ -0,0 +1,591 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// maxPushRulesUpdateAttempts is how many times a change to the push rules of
+// a user is tried before giving up. The rules are stored together as one
+// piece of account data, so a change is tried again if another change was
+// saved between reading and saving them, which would otherwise be lost.
+const maxPushRulesUpdateAttempts = 5
+
+type putPushRuleRequest struct {
+	Actions    []*pushrules.Action    `json:"actions"`
+	Conditions []*pushrules.Condition `json:"conditions"`
+	Pattern    string                 `json:"pattern"`
+}
+
+type pushRuleEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
+type pushRuleActions struct {
+	Actions []*pushrules.Action `json:"actions"`
+}
+
+type roomNotificationMode struct {
+	Mode pushrules.RoomNotificationMode `json:"mode"`
+}
+
+// GetAllPushRules implements GET /pushrules/
+func GetAllPushRules(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req, device, userAPI, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSets,
+	}
+}
+
+// GetPushRulesByScope implements GET /pushrules/{scope}/
+func GetPushRulesByScope(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	scope string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req, device, userAPI, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	ruleSet, resErr := pushRuleSetForScope(ruleSets, scope)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSet,
+	}
+}
+
+// GetPushRulesByKind implements GET /pushrules/{scope}/{kind}/
+func GetPushRulesByKind(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	scope, kind string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req, device, userAPI, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForScopeAndKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	res := *rules
+	if res == nil {
+		res = []*pushrules.Rule{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// GetPushRuleByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}
+func GetPushRuleByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req, device, userAPI, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForScopeAndKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := findPushRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: (*rules)[i],
+	}
+}
+
+// PutPushRuleByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}
+// New rules are the most important rules of their kind set by the user,
+// unless the before or after parameters say otherwise. Changing an existing
+// rule keeps it where it is unless it is moved with those parameters.
+// nolint: gocyclo
+func PutPushRuleByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	var r putPushRuleRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if strings.HasPrefix(ruleID, ".") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Rule IDs beginning with a period are reserved for server-default rules"),
+		}
+	}
+	if r.Actions == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Push rules must have actions"),
+		}
+	}
+	if err := pushrules.ValidateActions(r.Actions); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	rule := &pushrules.Rule{
+		RuleID:  ruleID,
+		Enabled: true,
+		Actions: r.Actions,
+	}
+	switch pushrules.Kind(kind) {
+	case pushrules.OverrideKind, pushrules.UnderrideKind:
+		rule.Conditions = r.Conditions
+		if rule.Conditions == nil {
+			rule.Conditions = []*pushrules.Condition{}
+		}
+		for _, cond := range rule.Conditions {
+			if cond == nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("Conditions must not be null"),
+				}
+			}
+		}
+	case pushrules.RoomKind:
+		if _, _, err := gomatrixserverlib.SplitID('!', ruleID); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The rule ID of a room rule must be a room ID"),
+			}
+		}
+	case pushrules.SenderKind:
+		if _, _, err := gomatrixserverlib.SplitID('@', ruleID); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("The rule ID of a sender rule must be a user ID"),
+			}
+		}
+	case pushrules.ContentKind:
+		if r.Pattern == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Content rules must have a pattern"),
+			}
+		}
+		rule.Pattern = r.Pattern
+	}
+
+	before, after := req.URL.Query().Get("before"), req.URL.Query().Get("after")
+	return updatePushRules(req, device, userAPI, cfg, syncProducer, func(ruleSets *pushrules.AccountRuleSets) *util.JSONResponse {
+		rules, resErr := pushRulesForScopeAndKind(ruleSets, scope, kind)
+		if resErr != nil {
+			return resErr
+		}
+
+		// Take the rule out of the list first, so that it can be put back in
+		// somewhere else if it is being moved. New rules go below the master
+		// rule, which is always the most important.
+		rule := *rule
+		insertAt := 0
+		if len(*rules) > 0 && (*rules)[0].Default && (*rules)[0].RuleID == pushrules.MRuleMaster {
+			insertAt = 1
+		}
+		if i := findPushRule(*rules, ruleID); i >= 0 {
+			rule.Enabled = (*rules)[i].Enabled
+			insertAt = i
+			*rules = append((*rules)[:i:i], (*rules)[i+1:]...)
+		}
+		for _, relativeTo := range []string{before, after} {
+			if relativeTo == "" {
+				continue
+			}
+			i := findPushRule(*rules, relativeTo)
+			if i < 0 {
+				resErr := pushRuleNotFound()
+				return &resErr
+			}
+			if (*rules)[i].Default {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("Rules can't be placed relative to server-default rules"),
+				}
+			}
+			insertAt = i
+			if relativeTo == after {
+				insertAt = i + 1
+			}
+			break
+		}
+		*rules = append((*rules)[:insertAt:insertAt], append([]*pushrules.Rule{&rule}, (*rules)[insertAt:]...)...)
+		return nil
+	})
+}
+
+// DeletePushRuleByRuleID implements DELETE /pushrules/{scope}/{kind}/{ruleID}
+func DeletePushRuleByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	return updatePushRules(req, device, userAPI, cfg, syncProducer, func(ruleSets *pushrules.AccountRuleSets) *util.JSONResponse {
+		rules, resErr := pushRulesForScopeAndKind(ruleSets, scope, kind)
+		if resErr != nil {
+			return resErr
+		}
+		i := findPushRule(*rules, ruleID)
+		if i < 0 {
+			resErr := pushRuleNotFound()
+			return &resErr
+		}
+		if (*rules)[i].Default {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Server-default rules can't be deleted"),
+			}
+		}
+		*rules = append((*rules)[:i:i], (*rules)[i+1:]...)
+		return nil
+	})
+}
+
+// GetPushRuleAttrByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}/{attr}
+// where the attribute is either enabled or actions.
+func GetPushRuleAttrByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req, device, userAPI, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rules, resErr := pushRulesForScopeAndKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := findPushRule(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	rule := (*rules)[i]
+	switch attr {
+	case "enabled":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: pushRuleEnabled{Enabled: rule.Enabled},
+		}
+	case "actions":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: pushRuleActions{Actions: rule.Actions},
+		}
+	default:
+		return pushRuleUnknownAttr(attr)
+	}
+}
+
+// PutPushRuleAttrByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}/{attr}
+// where the attribute is either enabled or actions. Unlike the rest of a
+// rule, these can be changed for server-default rules too.
+func PutPushRuleAttrByRuleID(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	// The body is read up front, as the change may have to be made more
+	// than once.
+	var enabled pushRuleEnabled
+	var actions pushRuleActions
+	switch attr {
+	case "enabled":
+		if resErr := httputil.UnmarshalJSONRequest(req, &enabled); resErr != nil {
+			return *resErr
+		}
+	case "actions":
+		if resErr := httputil.UnmarshalJSONRequest(req, &actions); resErr != nil {
+			return *resErr
+		}
+		if actions.Actions == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("Push rules must have actions"),
+			}
+		}
+		if err := pushrules.ValidateActions(actions.Actions); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(err.Error()),
+			}
+		}
+	default:
+		return pushRuleUnknownAttr(attr)
+	}
+	return updatePushRules(req, device, userAPI, cfg, syncProducer, func(ruleSets *pushrules.AccountRuleSets) *util.JSONResponse {
+		rules, resErr := pushRulesForScopeAndKind(ruleSets, scope, kind)
+		if resErr != nil {
+			return resErr
+		}
+		i := findPushRule(*rules, ruleID)
+		if i < 0 {
+			resErr := pushRuleNotFound()
+			return &resErr
+		}
+		// The server-default rules are shared, so change a copy of the rule
+		// rather than the rule itself.
+		rule := *(*rules)[i]
+		if attr == "enabled" {
+			rule.Enabled = enabled.Enabled
+		} else {
+			rule.Actions = actions.Actions
+		}
+		(*rules)[i] = &rule
+		return nil
+	})
+}
+
+// GetRoomNotificationMode implements GET /rooms/{roomID}/notification_mode
+// This is not in the spec: it summarises the user's push rules for the room
+// as one of the modes which most clients offer.
+func GetRoomNotificationMode(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	roomID string,
+) util.JSONResponse {
+	ruleSets, resErr := queryPushRules(req, device, userAPI, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomNotificationMode{Mode: ruleSets.Global.RoomNotificationMode(roomID)},
+	}
+}
+
+// PutRoomNotificationMode implements PUT /rooms/{roomID}/notification_mode
+// This is not in the spec: it replaces the user's push rules for the room
+// with the ones for the given mode.
+func PutRoomNotificationMode(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, roomID string,
+) util.JSONResponse {
+	var r roomNotificationMode
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid room ID"),
+		}
+	}
+	return updatePushRules(req, device, userAPI, cfg, syncProducer, func(ruleSets *pushrules.AccountRuleSets) *util.JSONResponse {
+		if err := ruleSets.Global.SetRoomNotificationMode(roomID, r.Mode); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(err.Error()),
+			}
+		}
+		return nil
+	})
+}
+
+// queryPushRules returns the push rules of the user, including any
+// server-default rules which they have no rules in place of.
+func queryPushRules(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+) (*pushrules.AccountRuleSets, *util.JSONResponse) {
+	ruleSets, _, resErr := queryPushRulesAndData(req, device, userAPI, cfg)
+	return ruleSets, resErr
+}
+
+// queryPushRulesAndData returns the push rules of the user along with the
+// m.push_rules account data which they were read from.
+func queryPushRulesAndData(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+) (*pushrules.AccountRuleSets, json.RawMessage, *util.JSONResponse) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, nil, &resErr
+	}
+	dataReq := userapi.QueryAccountDataRequest{
+		UserID:   device.UserID,
+		DataType: "m.push_rules",
+	}
+	dataRes := userapi.QueryAccountDataResponse{}
+	if err = userAPI.QueryAccountData(req.Context(), &dataReq, &dataRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountData failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, nil, &resErr
+	}
+	data := dataRes.GlobalAccountData["m.push_rules"]
+	ruleSets, err := pushrules.AccountRuleSetsFromAccountData(data, localpart, cfg.Matrix.ServerName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("pushrules.AccountRuleSetsFromAccountData failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, nil, &resErr
+	}
+	return ruleSets, data, nil
+}
+
+// updatePushRules makes a change to the push rules of the user and saves
+// them, starting again from the latest rules if they were changed by another
+// request in the meantime. The change returns an error response if it can't
+// be made.
+func updatePushRules(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, change func(ruleSets *pushrules.AccountRuleSets) *util.JSONResponse,
+) util.JSONResponse {
+	for attempt := 0; attempt < maxPushRulesUpdateAttempts; attempt++ {
+		ruleSets, prev, resErr := queryPushRulesAndData(req, device, userAPI, cfg)
+		if resErr != nil {
+			return *resErr
+		}
+		if resErr = change(ruleSets); resErr != nil {
+			return *resErr
+		}
+		saved, res := savePushRules(req, device, userAPI, cfg, syncProducer, ruleSets, prev)
+		if saved || res != nil {
+			return *res
+		}
+	}
+	util.GetLogger(req.Context()).Errorf("push rules were changed by other requests %d times in a row", maxPushRulesUpdateAttempts)
+	return jsonerror.InternalServerError()
+}
+
+// savePushRules stores the push rules of the user as m.push_rules account
+// data, without the server-default rules which they haven't changed, as
+// long as it is still prev, and lets the sync API know that they
+// have changed. Returns false and no response if the push rules had been
+// changed since they were read.
+func savePushRules(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, ruleSets *pushrules.AccountRuleSets, prev json.RawMessage,
+) (bool, *util.JSONResponse) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return false, &resErr
+	}
+	data, err := pushrules.AccountDataFromAccountRuleSets(ruleSets, localpart, cfg.Matrix.ServerName)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("pushrules.AccountDataFromAccountRuleSets failed")
+		resErr := jsonerror.InternalServerError()
+		return false, &resErr
+	}
+	if resErr := checkAccountDataLimits(
+		req, userAPI, &cfg.Matrix.AccountDataLimits, device.UserID, "", "m.push_rules", len(data),
+	); resErr != nil {
+		return false, resErr
+	}
+	dataReq := userapi.InputAccountDataRequest{
+		UserID:          device.UserID,
+		DataType:        "m.push_rules",
+		AccountData:     data,
+		IfUnchanged:     true,
+		PrevAccountData: prev,
+	}
+	dataRes := userapi.InputAccountDataResponse{}
+	if err = userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
+		resErr := jsonerror.InternalServerError()
+		return false, &resErr
+	}
+	if dataRes.Changed {
+		return false, nil
+	}
+	if err = syncProducer.SendData(device.UserID, "", "m.push_rules"); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		resErr := jsonerror.InternalServerError()
+		return true, &resErr
+	}
+	return true, &util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func pushRuleSetForScope(
+	ruleSets *pushrules.AccountRuleSets, scope string,
+) (*pushrules.RuleSet, *util.JSONResponse) {
+	if scope != pushrules.GlobalScope {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown push rule scope %q", scope)),
+		}
+	}
+	return &ruleSets.Global, nil
+}
+
+func pushRulesForScopeAndKind(
+	ruleSets *pushrules.AccountRuleSets, scope, kind string,
+) (*[]*pushrules.Rule, *util.JSONResponse) {
+	ruleSet, resErr := pushRuleSetForScope(ruleSets, scope)
+	if resErr != nil {
+		return nil, resErr
+	}
+	rules := ruleSet.ForKind(pushrules.Kind(kind))
+	if rules == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown push rule kind %q", kind)),
+		}
+	}
+	return rules, nil
+}
+
+// findPushRule returns the index of the rule with the given ID, or -1 if
+// there isn't one.
+func findPushRule(rules []*pushrules.Rule, ruleID string) int {
+	for i, rule := range rules {
+		if rule.RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+func pushRuleNotFound() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Push rule not found"),
+	}
+}
+
+func pushRuleUnknownAttr(attr string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown push rule attribute %q", attr)),
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama/mocks"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+// fakePushRulesUserAPI stores the m.push_rules account data of one user.
+type fakePushRulesUserAPI struct {
+	api.UserInternalAPI
+	mu        sync.Mutex
+	pushRules json.RawMessage
+	// beforeInput is called before the push rules are saved, if set.
+	beforeInput func(u *fakePushRulesUserAPI)
+}
+
+func (u *fakePushRulesUserAPI) QueryAccountData(
+	ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse,
+) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	res.GlobalAccountData = map[string]json.RawMessage{}
+	if u.pushRules != nil {
+		res.GlobalAccountData["m.push_rules"] = u.pushRules
+	}
+	return nil
+}
+
+func (u *fakePushRulesUserAPI) InputAccountData(
+	ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse,
+) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.beforeInput != nil {
+		u.beforeInput(u)
+	}
+	if req.IfUnchanged && !bytes.Equal(u.pushRules, req.PrevAccountData) {
+		res.Changed = true
+		return nil
+	}
+	u.pushRules = req.AccountData
+	return nil
+}
+
+func (u *fakePushRulesUserAPI) ruleIDs(t *testing.T, kind pushrules.Kind) []string {
+	t.Helper()
+	ruleSets, err := pushrules.AccountRuleSetsFromAccountData(u.pushRules, "alice", "localhost")
+	if err != nil {
+		t.Fatalf("AccountRuleSetsFromAccountData failed: %s", err)
+	}
+	var ruleIDs []string
+	for _, rule := range *ruleSets.Global.ForKind(kind) {
+		ruleIDs = append(ruleIDs, rule.RuleID)
+	}
+	return ruleIDs
+}
+
+func TestPutPushRule(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &api.Device{UserID: "@alice:localhost"}
+	userAPI := &fakePushRulesUserAPI{}
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close() // nolint: errcheck
+	syncProducer := &producers.SyncAPIProducer{Producer: producer}
+	put := func(kind, ruleID, query, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/pushrules/global/"+kind+"/"+ruleID+query, strings.NewReader(body))
+		res := PutPushRuleByRuleID(req, device, userAPI, cfg, syncProducer, "global", kind, ruleID)
+		return res.Code
+	}
+
+	testCases := []struct {
+		name     string
+		kind     string
+		ruleID   string
+		query    string
+		body     string
+		wantCode int
+	}{
+		{"unknown action", "override", "a", "", `{"actions":["explode"]}`, http.StatusBadRequest},
+		{"null action", "override", "a", "", `{"actions":[null]}`, http.StatusBadRequest},
+		{"conflicting actions", "override", "a", "", `{"actions":["notify","coalesce"]}`, http.StatusBadRequest},
+		{"null condition", "override", "a", "", `{"actions":["notify"],"conditions":[null]}`, http.StatusBadRequest},
+		{"room rule without room ID", "room", "a", "", `{"actions":["dont_notify"]}`, http.StatusBadRequest},
+		{"sender rule without user ID", "sender", "a", "", `{"actions":["dont_notify"]}`, http.StatusBadRequest},
+		{"content rule without pattern", "content", "a", "", `{"actions":["notify"]}`, http.StatusBadRequest},
+		{"server-default rule ID", "override", ".m.rule.mine", "", `{"actions":["notify"]}`, http.StatusBadRequest},
+		{"relative to server-default rule", "override", "a", "?before=" + pushrules.MRuleSuppressNotices, `{"actions":["notify"]}`, http.StatusBadRequest},
+		{"first", "override", "a", "", `{"actions":["notify",{"set_tweak":"highlight"}]}`, http.StatusOK},
+		{"second", "override", "b", "", `{"actions":["notify"]}`, http.StatusOK},
+		{"after first", "override", "c", "?after=a", `{"actions":["dont_notify"]}`, http.StatusOK},
+		{"room rule", "room", "!room:localhost", "", `{"actions":["dont_notify"]}`, http.StatusOK},
+		{"sender rule", "sender", "@bob:localhost", "", `{"actions":["dont_notify"]}`, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		if tc.wantCode == http.StatusOK {
+			producer.ExpectSendMessageAndSucceed()
+		}
+		if code := put(tc.kind, tc.ruleID, tc.query, tc.body); code != tc.wantCode {
+			t.Errorf("%s: got status %d want %d", tc.name, code, tc.wantCode)
+		}
+	}
+
+	// The newest rules come first, but never above the master rule.
+	got := userAPI.ruleIDs(t, pushrules.OverrideKind)
+	want := []string{pushrules.MRuleMaster, "b", "a", "c"}
+	if len(got) < len(want) || strings.Join(got[:len(want)], ",") != strings.Join(want, ",") {
+		t.Errorf("got override rules %v, want them to start with %v", got, want)
+	}
+	if got = userAPI.ruleIDs(t, pushrules.RoomKind); len(got) != 1 || got[0] != "!room:localhost" {
+		t.Errorf("got room rules %v, want the one which was put", got)
+	}
+}
+
+func TestPutPushRuleConcurrently(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &api.Device{UserID: "@alice:localhost"}
+	userAPI := &fakePushRulesUserAPI{}
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close() // nolint: errcheck
+	syncProducer := &producers.SyncAPIProducer{Producer: producer}
+
+	// None of the rules are lost, even though they're all put at once.
+	ruleIDs := []string{"@a:localhost", "@b:localhost", "@c:localhost", "@d:localhost", "@e:localhost"}
+	var wg sync.WaitGroup
+	for _, ruleID := range ruleIDs {
+		producer.ExpectSendMessageAndSucceed()
+		wg.Add(1)
+		go func(ruleID string) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPut, "/pushrules/global/sender/"+ruleID, strings.NewReader(`{"actions":["dont_notify"]}`))
+			if res := PutPushRuleByRuleID(req, device, userAPI, cfg, syncProducer, "global", "sender", ruleID); res.Code != http.StatusOK {
+				t.Errorf("PUT %s: got status %d", ruleID, res.Code)
+			}
+		}(ruleID)
+	}
+	wg.Wait()
+	if got := userAPI.ruleIDs(t, pushrules.SenderKind); len(got) != len(ruleIDs) {
+		t.Errorf("got sender rules %v, want all of %v", got, ruleIDs)
+	}
+}
+
+func TestPutPushRuleAfterConflict(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &api.Device{UserID: "@alice:localhost"}
+	userAPI := &fakePushRulesUserAPI{}
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close() // nolint: errcheck
+	syncProducer := &producers.SyncAPIProducer{Producer: producer}
+
+	// Another rule is put by somebody else between the rules being read and
+	// saved, so the rule is put again on top of it rather than replacing it.
+	userAPI.beforeInput = func(u *fakePushRulesUserAPI) {
+		u.beforeInput = nil
+		ruleSets, err := pushrules.AccountRuleSetsFromAccountData(u.pushRules, "alice", "localhost")
+		if err != nil {
+			t.Fatalf("AccountRuleSetsFromAccountData failed: %s", err)
+		}
+		ruleSets.Global.Sender = append(ruleSets.Global.Sender, &pushrules.Rule{
+			RuleID:  "@b:localhost",
+			Enabled: true,
+			Actions: []*pushrules.Action{{Kind: pushrules.DontNotifyAction}},
+		})
+		if u.pushRules, err = json.Marshal(ruleSets); err != nil {
+			t.Fatalf("json.Marshal failed: %s", err)
+		}
+	}
+	producer.ExpectSendMessageAndSucceed()
+	req := httptest.NewRequest(http.MethodPut, "/pushrules/global/sender/@a:localhost", strings.NewReader(`{"actions":["dont_notify"]}`))
+	if res := PutPushRuleByRuleID(req, device, userAPI, cfg, syncProducer, "global", "sender", "@a:localhost"); res.Code != http.StatusOK {
+		t.Fatalf("got status %d want %d", res.Code, http.StatusOK)
+	}
+	if got := userAPI.ruleIDs(t, pushrules.SenderKind); strings.Join(got, ",") != "@a:localhost,@b:localhost" {
+		t.Errorf("got sender rules %v, want both rules", got)
+	}
+}
+
+func TestDeletePushRule(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &api.Device{UserID: "@alice:localhost"}
+	userAPI := &fakePushRulesUserAPI{}
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close() // nolint: errcheck
+	syncProducer := &producers.SyncAPIProducer{Producer: producer}
+
+	producer.ExpectSendMessageAndSucceed()
+	req := httptest.NewRequest(http.MethodPut, "/pushrules/global/sender/@bob:localhost", strings.NewReader(`{"actions":["dont_notify"]}`))
+	if res := PutPushRuleByRuleID(req, device, userAPI, cfg, syncProducer, "global", "sender", "@bob:localhost"); res.Code != http.StatusOK {
+		t.Fatalf("PUT: got status %d", res.Code)
+	}
+	del := func(kind, ruleID string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/pushrules/global/"+kind+"/"+ruleID, nil)
+		return DeletePushRuleByRuleID(req, device, userAPI, cfg, syncProducer, "global", kind, ruleID).Code
+	}
+	if code := del("override", pushrules.MRuleMaster); code != http.StatusBadRequest {
+		t.Errorf("deleting a server-default rule: got status %d want %d", code, http.StatusBadRequest)
+	}
+	if code := del("sender", "@carol:localhost"); code != http.StatusNotFound {
+		t.Errorf("deleting an unknown rule: got status %d want %d", code, http.StatusNotFound)
+	}
+	producer.ExpectSendMessageAndSucceed()
+	if code := del("sender", "@bob:localhost"); code != http.StatusOK {
+		t.Errorf("deleting a rule: got status %d want %d", code, http.StatusOK)
+	}
+	if got := userAPI.ruleIDs(t, pushrules.SenderKind); len(got) != 0 {
+		t.Errorf("got sender rules %v after deleting, want none", got)
+	}
+}
+
+func TestPutPushRuleAttr(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &api.Device{UserID: "@alice:localhost"}
+	userAPI := &fakePushRulesUserAPI{}
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close() // nolint: errcheck
+	syncProducer := &producers.SyncAPIProducer{Producer: producer}
+	put := func(attr, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/pushrules/global/override/"+pushrules.MRuleMaster+"/"+attr, strings.NewReader(body))
+		return PutPushRuleAttrByRuleID(req, device, userAPI, cfg, syncProducer, "global", "override", pushrules.MRuleMaster, attr).Code
+	}
+
+	if code := put("actions", `{"actions":["explode"]}`); code != http.StatusBadRequest {
+		t.Errorf("unknown action: got status %d want %d", code, http.StatusBadRequest)
+	}
+	if code := put("pattern", `{}`); code != http.StatusBadRequest {
+		t.Errorf("unknown attribute: got status %d want %d", code, http.StatusBadRequest)
+	}
+	producer.ExpectSendMessageAndSucceed()
+	if code := put("enabled", `{"enabled":true}`); code != http.StatusOK {
+		t.Fatalf("enabling the master rule: got status %d want %d", code, http.StatusOK)
+	}
+	ruleSets, err := pushrules.AccountRuleSetsFromAccountData(userAPI.pushRules, "alice", "localhost")
+	if err != nil {
+		t.Fatalf("AccountRuleSetsFromAccountData failed: %s", err)
+	}
+	if master := ruleSets.Global.Override[0]; master.RuleID != pushrules.MRuleMaster || !master.Enabled {
+		t.Errorf("got first override rule %+v, want the enabled master rule", master)
+	}
+	// The server-default rules shared by every account are left alone.
+	if pushrules.DefaultGlobalRuleSet("alice", "localhost").Override[0].Enabled {
+		t.Errorf("enabling the master rule for one account enabled it for all of them")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// The endpoints which are rate limited.
+const (
+	rateLimitLogin        = "login"
+	rateLimitRegistration = "registration"
+	rateLimitMessages     = "messages"
+	rateLimitJoins        = "joins"
+	rateLimitInvites      = "invites"
+	rateLimitRoomCreation = "room_creation"
+	rateLimitEmailTokens  = "email_tokens"
+	// Email tokens are also limited per address, so that many clients can't
+	// flood the same address between them.
+	rateLimitEmailAddress = "email_address"
+	// Refreshing and starting SSO logins have their own buckets, limited in
+	// the same way as logging in.
+	rateLimitRefresh = "refresh"
+	rateLimitSSO     = "sso"
+	// Checking registration tokens has its own buckets, limited in the same
+	// way as registering, so that tokens can't be guessed.
+	rateLimitRegistrationTokens = "registration_tokens"
+)
+
+// How often buckets which have refilled are forgotten.
+const rateLimitPruneInterval = time.Minute
+
+type rateLimitKey struct {
+	endpoint string
+	// The user ID of the client, or its IP address if it isn't logged in.
+	// For email addresses, the address itself.
+	client string
+}
+
+// rateLimits limits how often each client can use the rate limited
+// endpoints. Each client has a bucket per endpoint which holds up to the
+// burst of requests and refills by one request every interval.
+type rateLimits struct {
+	cfg *config.Dendrite
+	now func() time.Time
+	mu  sync.Mutex
+	// The time at which each bucket will be full again. Buckets which are
+	// already full are the same as ones which don't exist yet.
+	fullAt    map[rateLimitKey]time.Time
+	lastPrune time.Time
+}
+
+func newRateLimits(cfg *config.Dendrite) *rateLimits {
+	return &rateLimits{
+		cfg:    cfg,
+		now:    time.Now,
+		fullAt: make(map[rateLimitKey]time.Time),
+	}
+}
+
+func (l *rateLimits) limitFor(endpoint string) config.RateLimit {
+	switch endpoint {
+	case rateLimitLogin, rateLimitRefresh, rateLimitSSO:
+		return l.cfg.Matrix.RateLimiting.Login
+	case rateLimitRegistration, rateLimitRegistrationTokens:
+		return l.cfg.Matrix.RateLimiting.Registration
+	case rateLimitMessages:
+		return l.cfg.Matrix.RateLimiting.Messages
+	case rateLimitEmailTokens, rateLimitEmailAddress:
+		return l.cfg.Matrix.RateLimiting.EmailTokens
+	case rateLimitInvites:
+		return l.cfg.Matrix.RateLimiting.Invites
+	case rateLimitRoomCreation:
+		return l.cfg.Matrix.RateLimiting.RoomCreation
+	default:
+		return l.cfg.Matrix.RateLimiting.Joins
+	}
+}
+
+// check takes a request from the client's bucket for the endpoint, and
+// returns an M_LIMIT_EXCEEDED response if the bucket is empty. The device
+// is nil for endpoints which are used without logging in, in which case the
+// client is identified by its IP address.
+func (l *rateLimits) check(req *http.Request, device *userapi.Device, endpoint string) *util.JSONResponse {
+	if l.cfg.Matrix.RateLimiting.Disabled || l.isExempt(req, device) {
+		return nil
+	}
+	client := clientIP(req, l.cfg)
+	if device != nil {
+		client = device.UserID
+	}
+	return l.take(endpoint, client)
+}
+
+// checkEmailAddress takes a request from the email address's bucket for
+// requesting tokens, and returns an M_LIMIT_EXCEEDED response if it is empty.
+func (l *rateLimits) checkEmailAddress(address string) *util.JSONResponse {
+	if l.cfg.Matrix.RateLimiting.Disabled {
+		return nil
+	}
+	return l.take(rateLimitEmailAddress, strings.ToLower(address))
+}
+
+// take takes a request from the client's bucket for the endpoint.
+func (l *rateLimits) take(endpoint, client string) *util.JSONResponse {
+	key := rateLimitKey{endpoint: endpoint, client: client}
+	limit := l.limitFor(endpoint)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		for k, fullAt := range l.fullAt {
+			if !fullAt.After(now) {
+				delete(l.fullAt, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	fullAt, ok := l.fullAt[key]
+	if !ok || fullAt.Before(now) {
+		fullAt = now
+	}
+	// Taking a request pushes back the time that the bucket is full again
+	// by an interval, and the bucket is empty once that would be more than
+	// the whole burst away.
+	fullAt = fullAt.Add(limit.Interval)
+	if wait := fullAt.Sub(now) - time.Duration(limit.Burst)*limit.Interval; wait > 0 {
+		retryAfterMS := wait.Milliseconds()
+		if retryAfterMS == 0 {
+			retryAfterMS = 1
+		}
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many requests", retryAfterMS),
+		}
+	}
+	l.fullAt[key] = fullAt
+	return nil
+}
+
+// isExempt returns whether the request was made by an application service
+// which isn't rate limited. An application service's own user is never
+// limited, and neither are the users it acts as unless its registration
+// sets rate_limited.
+func (l *rateLimits) isExempt(req *http.Request, device *userapi.Device) bool {
+	token, err := auth.ExtractAccessToken(req)
+	if err != nil {
+		return false
+	}
+	for _, as := range l.cfg.Derived.ApplicationServices {
+		if as.ASToken != token {
+			continue
+		}
+		if device == nil || !as.RateLimited {
+			return true
+		}
+		return device.UserID == as.SenderLocalpart ||
+			device.UserID == userutil.MakeUserID(as.SenderLocalpart, l.cfg.Matrix.ServerName)
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestRateLimits(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.RateLimiting.Messages = config.RateLimit{Burst: 2, Interval: 10 * time.Second}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{ASToken: "limited", SenderLocalpart: "bridge", RateLimited: true},
+		{ASToken: "unlimited", SenderLocalpart: "bot", RateLimited: false},
+	}
+	now := time.Now()
+	limits := newRateLimits(cfg)
+	limits.now = func() time.Time { return now }
+
+	send := func(token string, device *userapi.Device) *jsonerror.LimitExceededError {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/rooms/!room:localhost/send/m.room.message/1", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := limits.check(req, device, rateLimitMessages)
+		if res == nil {
+			return nil
+		}
+		if res.Code != http.StatusTooManyRequests {
+			t.Fatalf("got status %d, want %d", res.Code, http.StatusTooManyRequests)
+		}
+		return res.JSON.(*jsonerror.LimitExceededError)
+	}
+
+	alice := &userapi.Device{UserID: "@alice:localhost"}
+	for i := 0; i < 2; i++ {
+		if err := send("alice_token", alice); err != nil {
+			t.Fatalf("request %d within the burst was limited: %+v", i, err)
+		}
+	}
+	err := send("alice_token", alice)
+	if err == nil || err.ErrCode != "M_LIMIT_EXCEEDED" || err.RetryAfterMS != 10000 {
+		t.Fatalf("got %+v after the burst, want M_LIMIT_EXCEEDED with a 10s retry", err)
+	}
+	// Other users have their own buckets.
+	if err = send("bob_token", &userapi.Device{UserID: "@bob:localhost"}); err != nil {
+		t.Errorf("another user was limited: %+v", err)
+	}
+	// The bucket refills by one request per interval.
+	now = now.Add(15 * time.Second)
+	if err = send("alice_token", alice); err != nil {
+		t.Errorf("request after an interval was limited: %+v", err)
+	}
+	if err = send("alice_token", alice); err == nil || err.RetryAfterMS != 5000 {
+		t.Errorf("got %+v, want a 5s retry", err)
+	}
+
+	// Application service users are limited if the registration says so,
+	// but the application service's own user never is.
+	for i := 0; i < 3; i++ {
+		if err = send("limited", &userapi.Device{UserID: "bridge"}); err != nil {
+			t.Fatalf("the application service's own user was limited: %+v", err)
+		}
+		if err = send("unlimited", &userapi.Device{UserID: "@bot_alice:localhost"}); err != nil {
+			t.Fatalf("a user of an unlimited application service was limited: %+v", err)
+		}
+	}
+	bridged := &userapi.Device{UserID: "@bridge_alice:localhost"}
+	send("limited", bridged)
+	send("limited", bridged)
+	if err = send("limited", bridged); err == nil {
+		t.Errorf("a user of a rate limited application service wasn't limited")
+	}
+}
+
+func TestEmailAddressRateLimits(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.RateLimiting.EmailTokens = config.RateLimit{Burst: 2, Interval: time.Minute}
+	limits := newRateLimits(cfg)
+
+	// The address is limited however many IP addresses the requests come
+	// from, and regardless of its case.
+	for i, address := range []string{"alice@localhost", "Alice@localhost"} {
+		if res := limits.checkEmailAddress(address); res != nil {
+			t.Fatalf("request %d within the burst was limited: %+v", i, res.JSON)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/register/email/requestToken", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i+1)
+		if res := limits.check(req, nil, rateLimitEmailTokens); res != nil {
+			t.Fatalf("request %d from a new IP address was limited: %+v", i, res.JSON)
+		}
+	}
+	if res := limits.checkEmailAddress("alice@localhost"); res == nil || res.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %+v after the burst, want a 429", res)
+	}
+	if res := limits.checkEmailAddress("bob@localhost"); res != nil {
+		t.Fatalf("another address was limited: %+v", res.JSON)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.TrustedProxies = []string{"10.0.0.1", "192.168.0.0/16"}
+	if err := cfg.Derive(); err != nil {
+		t.Fatalf("failed to derive the config: %s", err)
+	}
+	for _, tc := range []struct {
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		// X-Forwarded-For is ignored on requests which don't come from a
+		// trusted proxy.
+		{"203.0.113.1:1234", nil, "203.0.113.1"},
+		{"203.0.113.1:1234", []string{"198.51.100.1"}, "203.0.113.1"},
+		// The last address which isn't a trusted proxy is used, as the
+		// client could have set anything before it.
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		// A trusted proxy without the header, or with a malformed one, is
+		// the client as far as anyone can tell.
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"1.2.3.4, not-an-ip"}, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"192.168.1.1"}, "192.168.1.1"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, header := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		if got := clientIP(req, cfg); got != tc.want {
+			t.Errorf("clientIP from %s with X-Forwarded-For %v: got %s, want %s", tc.remoteAddr, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitedEndpoints(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.RateLimiting.Login = config.RateLimit{Burst: 1, Interval: time.Minute}
+	cfg.Matrix.RateLimiting.Invites = config.RateLimit{Burst: 2, Interval: time.Minute}
+	cfg.Matrix.RateLimiting.RoomCreation = config.RateLimit{Burst: 3, Interval: time.Minute}
+	limits := newRateLimits(cfg)
+	alice := &userapi.Device{UserID: "@alice:localhost"}
+
+	for endpoint, burst := range map[string]int{
+		rateLimitSSO:          1,
+		rateLimitInvites:      2,
+		rateLimitRoomCreation: 3,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		device := alice
+		if endpoint == rateLimitSSO {
+			device = nil
+		}
+		for i := 0; i < burst; i++ {
+			if res := limits.check(req, device, endpoint); res != nil {
+				t.Fatalf("%s: request %d within the burst was limited: %+v", endpoint, i, res.JSON)
+			}
+		}
+		if res := limits.check(req, device, endpoint); res == nil || res.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: got %+v after the burst, want a 429", endpoint, res)
+		}
+	}
+}
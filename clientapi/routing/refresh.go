@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMS  int64  `json:"expires_in_ms"`
+}
+
+// accessTokenLifetime returns how long the access token issued by a login or
+// registration should last, or 0 if it shouldn't expire because the client
+// didn't ask for a refresh token. Clients using the unstable prefix of MSC2918
+// ask with a query parameter instead of in the body.
+func accessTokenLifetime(req *http.Request, refreshToken bool, cfg *config.Dendrite) time.Duration {
+	if !refreshToken && req.URL.Query().Get("org.matrix.msc2918.refresh_token") != "true" {
+		return 0
+	}
+	return cfg.Matrix.RefreshableAccessTokenLifetime
+}
+
+// Refresh implements:
+//     POST /refresh
+// from MSC2918. The refresh token is replaced along with the access token, so
+// each refresh token can only be used once.
+func Refresh(
+	req *http.Request, deviceDB devices.Database, cfg *config.Dendrite,
+) util.JSONResponse {
+	var r refreshRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.RefreshToken == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'refresh_token' must be supplied."),
+		}
+	}
+
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	refreshToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	lifetime := cfg.Matrix.RefreshableAccessTokenLifetime
+	expiresTS := gomatrixserverlib.AsTimestamp(time.Now().Add(lifetime))
+	_, err = deviceDB.RefreshAccessToken(req.Context(), r.RefreshToken, accessToken, refreshToken, expiresTS)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Unknown refresh token", false),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RefreshAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: refreshResponse{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  lifetime.Milliseconds(),
+		},
+	}
+}
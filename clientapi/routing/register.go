@@ -39,6 +39,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -76,6 +77,16 @@ func init() {
 type sessionsDict struct {
 	sync.Mutex
 	sessions map[string][]authtypes.LoginType
+	// The registration token which each session gave, if any.
+	tokens map[string]string
+	// The email address which each session validated, if any.
+	emails map[string]registrationEmail
+}
+
+// registrationEmail is an email address which was validated during a
+// registration, to be associated with the account once it is created.
+type registrationEmail struct {
+	address string
 }
 
 // GetCompletedStages returns the completed stages for a session.
@@ -90,9 +101,55 @@ func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginTyp
 	return make([]authtypes.LoginType, 0)
 }
 
+// DeleteSession forgets a session and its completed stages.
+func (d *sessionsDict) DeleteSession(sessionID string) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.sessions, sessionID)
+	delete(d.tokens, sessionID)
+	delete(d.emails, sessionID)
+}
+
+// SetRegistrationToken records the registration token which a session gave.
+func (d *sessionsDict) SetRegistrationToken(sessionID, token string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.tokens[sessionID] = token
+}
+
+// GetRegistrationToken returns the registration token which a session gave,
+// or an empty string if it hasn't given one.
+func (d *sessionsDict) GetRegistrationToken(sessionID string) string {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.tokens[sessionID]
+}
+
+// SetEmail records the email address which a session validated.
+func (d *sessionsDict) SetEmail(sessionID string, email registrationEmail) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.emails[sessionID] = email
+}
+
+// GetEmail returns the email address which a session validated, if any.
+func (d *sessionsDict) GetEmail(sessionID string) (registrationEmail, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	email, ok := d.emails[sessionID]
+	return email, ok
+}
+
 func newSessionsDict() *sessionsDict {
 	return &sessionsDict{
 		sessions: make(map[string][]authtypes.LoginType),
+		tokens:   make(map[string]string),
+		emails:   make(map[string]registrationEmail),
 	}
 }
 
@@ -135,12 +192,20 @@ type registerRequest struct {
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
 
+	// Whether the client wants a refresh token, see MSC2918.
+	RefreshToken bool `json:"refresh_token"`
+
 	// Prevent this user from logging in
 	InhibitLogin eventutil.WeakBoolean `json:"inhibit_login"`
 
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
+
+	// Guests upgrading to a full account give their access token here.
+	GuestAccessToken string `json:"guest_access_token"`
+	// Set by prepareGuestUpgrade once the guest access token has been checked.
+	upgradeGuest bool
 }
 
 type authDict struct {
@@ -150,6 +215,10 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// Registration token
+	Token string `json:"token"`
+	// Email identity
+	ThreePIDCreds auth.ThreePIDCredentials `json:"threepid_creds"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -188,6 +257,9 @@ type registerResponse struct {
 	AccessToken string                       `json:"access_token,omitempty"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
 	DeviceID    string                       `json:"device_id,omitempty"`
+	// Only set if the client asked for a refresh token.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -220,6 +292,27 @@ func validateUsername(username string) *util.JSONResponse {
 	return nil
 }
 
+// validateReservedUsername returns an error response if the username is one
+// which the server hands out itself. Numeric usernames are given to guests
+// and to users who register without a username, and the server notices are
+// sent by their own localpart.
+func validateReservedUsername(username string, cfg *config.Dendrite) *util.JSONResponse {
+	// Don't allow numeric usernames less than MAX_INT64.
+	if _, err := strconv.ParseInt(username, 10, 64); err == nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidUsername("Numeric user IDs are reserved"),
+		}
+	}
+	if localpart := cfg.Matrix.ServerNotices.Localpart; localpart != "" && username == localpart {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UserInUse("This username is reserved by the server."),
+		}
+	}
+	return nil
+}
+
 // validateApplicationServiceUsername returns an error response if the username is invalid for an application service
 func validateApplicationServiceUsername(username string) *util.JSONResponse {
 	if len(username) > maxUsernameLength {
@@ -265,7 +358,16 @@ func validateRecaptcha(
 			JSON: jsonerror.Unknown("Captcha registration is disabled"),
 		}
 	}
+	return verifyRecaptcha(cfg, response, clientip)
+}
 
+// verifyRecaptcha returns an error response if the captcha response can't be
+// verified with the captcha server
+func verifyRecaptcha(
+	cfg *config.Dendrite,
+	response string,
+	clientip string,
+) *util.JSONResponse {
 	if response == "" {
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -402,7 +504,7 @@ func validateApplicationService(
 	if matchedApplicationService == nil {
 		return "", &util.JSONResponse{
 			Code: http.StatusUnauthorized,
-			JSON: jsonerror.UnknownToken("Supplied access_token does not match any known application service"),
+			JSON: jsonerror.UnknownToken("Supplied access_token does not match any known application service", false),
 		}
 	}
 
@@ -432,6 +534,12 @@ func validateApplicationService(
 		return "", err
 	}
 
+	// Application services can register localparts starting with '_', so
+	// make sure that they don't take the one which sends server notices.
+	if err := validateReservedUsername(username, cfg); err != nil {
+		return "", err
+	}
+
 	// No errors, registration valid
 	return matchedApplicationService.ID, nil
 }
@@ -442,6 +550,7 @@ func Register(
 	req *http.Request,
 	userAPI userapi.UserInternalAPI,
 	accountDB accounts.Database,
+	emailValidator *threepid.EmailValidator,
 	cfg *config.Dendrite,
 ) util.JSONResponse {
 	var r registerRequest
@@ -450,8 +559,19 @@ func Register(
 		return *resErr
 	}
 	if req.URL.Query().Get("kind") == "guest" {
+		if cfg.Matrix.GuestsDisabled {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guest registration is disabled"),
+			}
+		}
 		return handleGuestRegistration(req, r, cfg, userAPI)
 	}
+	if r.GuestAccessToken != "" {
+		if resErr = prepareGuestUpgrade(req.Context(), &r, userAPI, accountDB); resErr != nil {
+			return *resErr
+		}
+	}
 
 	// Retrieve or generate the sessionID
 	sessionID := r.Auth.Session
@@ -460,11 +580,10 @@ func Register(
 		sessionID = util.RandomString(sessionIDLength)
 	}
 
-	// Don't allow numeric usernames less than MAX_INT64.
-	if _, err := strconv.ParseInt(r.Username, 10, 64); err == nil {
-		return util.JSONResponse{
-			Code: http.StatusBadRequest,
-			JSON: jsonerror.InvalidUsername("Numeric user IDs are reserved"),
+	// Guests already have a numeric username, which they keep when upgrading.
+	if !r.upgradeGuest {
+		if resErr = validateReservedUsername(r.Username, cfg); resErr != nil {
+			return *resErr
 		}
 	}
 	// Auto generate a numeric username if r.Username is empty
@@ -506,7 +625,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accountDB, emailValidator)
 }
 
 func handleGuestRegistration(
@@ -561,6 +680,64 @@ func handleGuestRegistration(
 	}
 }
 
+// prepareGuestUpgrade checks that the guest access token in a registration
+// request belongs to a guest account, and if so updates the request so that
+// completing the registration upgrades that account to a full account rather
+// than creating a new one. The guest keeps their user ID, and therefore their
+// rooms, and their device unless the request asks for a different one.
+func prepareGuestUpgrade(
+	ctx context.Context,
+	r *registerRequest,
+	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+) *util.JSONResponse {
+	var res userapi.QueryAccessTokenResponse
+	err := userAPI.QueryAccessToken(ctx, &userapi.QueryAccessTokenRequest{
+		AccessToken: r.GuestAccessToken,
+	}, &res)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccessToken failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if res.Err != nil || res.Device == nil {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Unknown guest access token", false),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', res.Device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !acc.IsGuest {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Only guest accounts can be upgraded"),
+		}
+	}
+	if r.Username != "" && strings.ToLower(r.Username) != localpart {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidUsername("Guest accounts keep their user ID when upgraded"),
+		}
+	}
+	r.Username = localpart
+	if r.DeviceID == nil {
+		r.DeviceID = &res.Device.ID
+	}
+	r.upgradeGuest = true
+	return nil
+}
+
 // handleRegistrationFlow will direct and complete registration flow stages
 // that the client has requested.
 // nolint: gocyclo
@@ -570,18 +747,22 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.Dendrite,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	emailValidator *threepid.EmailValidator,
 ) util.JSONResponse {
 	// TODO: Shared secret registration (create new user scripts)
 	// TODO: Enable registration config flag
-	// TODO: Guest account upgrading
 
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
-	// TODO: email / msisdn auth types.
+	// TODO: msisdn auth type.
 
 	if cfg.Matrix.RegistrationDisabled && r.Auth.Type != authtypes.LoginTypeSharedSecret {
-		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration has been disabled"),
+		}
 	}
 
 	switch r.Auth.Type {
@@ -595,6 +776,73 @@ func handleRegistrationFlow(
 		// Add Recaptcha to the list of completed registration stages
 		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
 
+	case authtypes.LoginTypeRegistrationToken:
+		// Check that the token can be used, but only count the registration
+		// against it once the registration is completed.
+		token, err := accountDB.GetRegistrationToken(req.Context(), r.Auth.Token)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+		if token == nil || !token.Valid(gomatrixserverlib.AsTimestamp(time.Now())) {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("Invalid registration token"),
+			}
+		}
+
+		sessions.SetRegistrationToken(sessionID, token.Token)
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
+	case authtypes.LoginTypeEmail:
+		if emailValidator == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("email addresses are not validated by this server"),
+			}
+		}
+		typeEmail := auth.LoginTypeEmailIdentity{
+			CheckThreePIDSession: emailValidator.CheckAssociation,
+		}
+		login, resErr := typeEmail.Login(req.Context(), &auth.EmailIdentityRequest{ThreePIDCreds: r.Auth.ThreePIDCreds})
+		if resErr != nil {
+			return *resErr
+		}
+		// Check that the address isn't in use, but only associate it with
+		// the account once the registration is completed.
+		medium, address := login.ThirdPartyID()
+		localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), address, medium)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+			return jsonerror.InternalServerError()
+		}
+		if localpart != "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MatrixError{
+					ErrCode: "M_THREEPID_IN_USE",
+					Err:     accounts.Err3PIDInUse.Error(),
+				},
+			}
+		}
+
+		// Consume the validation session, so that it can't complete the
+		// email stage of another registration session as well.
+		removed, err := emailValidator.RemoveSession(req.Context(), r.Auth.ThreePIDCreds.SessionID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("emailValidator.RemoveSession failed")
+			return jsonerror.InternalServerError()
+		}
+		if !removed {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: jsonerror.Forbidden("the email validation session has already been used"),
+			}
+		}
+
+		sessions.SetEmail(sessionID, registrationEmail{address: address})
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
 	case authtypes.LoginTypeSharedSecret:
 		// Check shared secret against config
 		valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, r.Auth.Mac)
@@ -603,7 +851,10 @@ func handleRegistrationFlow(
 			util.GetLogger(req.Context()).WithError(err).Error("isValidMacLogin failed")
 			return jsonerror.InternalServerError()
 		} else if !valid {
-			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("HMAC incorrect"),
+			}
 		}
 
 		// Add SharedSecret to the list of completed registration stages
@@ -650,7 +901,7 @@ func handleRegistrationFlow(
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
 	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+		req, r, sessionID, cfg, userAPI, accountDB)
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -691,8 +942,9 @@ func handleApplicationServiceRegistration(
 	// Don't need to worry about appending to registration stages as
 	// application service registration is entirely separate.
 	return completeRegistration(
-		req.Context(), userAPI, r.Username, "", appserviceID,
+		req.Context(), userAPI, r.Username, "", appserviceID, false, false,
 		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		accessTokenLifetime(req, r.RefreshToken, cfg),
 	)
 }
 
@@ -706,13 +958,77 @@ func checkAndCompleteFlow(
 	sessionID string,
 	cfg *config.Dendrite,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
+		// Reserve the validated address before creating the account, as
+		// other registrations may have validated the same address.
+		email, hasEmail := sessions.GetEmail(sessionID)
+		if hasEmail {
+			err := accountDB.SaveThreePIDAssociation(req.Context(), email.address, r.Username, "email")
+			if err == accounts.Err3PIDInUse {
+				sessions.DeleteSession(sessionID)
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.MatrixError{
+						ErrCode: "M_THREEPID_IN_USE",
+						Err:     err.Error(),
+					},
+				}
+			} else if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		releaseEmail := func() {
+			if !hasEmail {
+				return
+			}
+			if err := accountDB.RemoveThreePIDAssociation(req.Context(), email.address, "email"); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
+			}
+		}
+
+		// The token may have been used up by other registrations since this
+		// session gave it, so it is only counted now.
+		token := sessions.GetRegistrationToken(sessionID)
+		if token != "" {
+			used, err := accountDB.UseRegistrationToken(req.Context(), token)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.UseRegistrationToken failed")
+				releaseEmail()
+				return jsonerror.InternalServerError()
+			}
+			if !used {
+				releaseEmail()
+				sessions.DeleteSession(sessionID)
+				return util.JSONResponse{
+					Code: http.StatusUnauthorized,
+					JSON: jsonerror.Forbidden("Invalid registration token"),
+				}
+			}
+		}
+
 		// This flow was completed, registration can continue
-		return completeRegistration(
-			req.Context(), userAPI, r.Username, r.Password, "",
+		res := completeRegistration(
+			req.Context(), userAPI, r.Username, r.Password, "", r.upgradeGuest, false,
 			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			accessTokenLifetime(req, r.RefreshToken, cfg),
 		)
+		if res.Code != http.StatusOK {
+			releaseEmail()
+			if token != "" {
+				if err := accountDB.ReleaseRegistrationToken(req.Context(), token); err != nil {
+					util.GetLogger(req.Context()).WithError(err).Error("accountDB.ReleaseRegistrationToken failed")
+				}
+			}
+		}
+		if res.Code == http.StatusOK {
+			// Forget the session so that its completed stages, e.g. a solved
+			// captcha, can't be reused to register more accounts.
+			sessions.DeleteSession(sessionID)
+		}
+		return res
 	}
 
 	// There are still more stages to complete.
@@ -743,13 +1059,19 @@ func LegacyRegister(
 	}).Info("Processing registration request")
 
 	if cfg.Matrix.RegistrationDisabled && r.Type != authtypes.LoginTypeSharedSecret {
-		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration has been disabled"),
+		}
 	}
 
 	switch r.Type {
 	case authtypes.LoginTypeSharedSecret:
 		if cfg.Matrix.RegistrationSharedSecret == "" {
-			return util.MessageResponse(http.StatusBadRequest, "Shared secret registration is disabled")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("Shared secret registration is disabled"),
+			}
 		}
 
 		valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, r.Mac)
@@ -759,13 +1081,16 @@ func LegacyRegister(
 		}
 
 		if !valid {
-			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("HMAC incorrect"),
+			}
 		}
 
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", false, nil, nil)
+		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", false, false, false, nil, nil, 0)
 	case authtypes.LoginTypeDummy:
 		// there is nothing to do
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", false, nil, nil)
+		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", false, false, false, nil, nil, 0)
 	default:
 		return util.JSONResponse{
 			Code: http.StatusNotImplemented,
@@ -804,7 +1129,8 @@ func parseAndValidateLegacyLogin(req *http.Request, r *legacyRegisterRequest) *u
 }
 
 // completeRegistration runs some rudimentary checks against the submitted
-// input, then if successful creates an account and a newly associated device
+// input, then if successful creates an account, or upgrades a guest account
+// if upgradeGuest is set, and a newly associated device
 // We pass in each individual part of the request here instead of just passing a
 // registerRequest, as this function serves requests encoded as both
 // registerRequests and legacyRegisterRequests, which share some attributes but
@@ -813,8 +1139,10 @@ func completeRegistration(
 	ctx context.Context,
 	userAPI userapi.UserInternalAPI,
 	username, password, appserviceID string,
+	upgradeGuest, isAdmin bool,
 	inhibitLogin eventutil.WeakBoolean,
 	displayName, deviceID *string,
+	tokenLifetime time.Duration,
 ) util.JSONResponse {
 	if username == "" {
 		return util.JSONResponse{
@@ -837,6 +1165,8 @@ func completeRegistration(
 		Password:     password,
 		AccountType:  userapi.AccountTypeUser,
 		OnConflict:   userapi.ConflictAbort,
+		UpgradeGuest: upgradeGuest,
+		IsAdmin:      isAdmin,
 	}, &accRes)
 	if err != nil {
 		if _, ok := err.(*userapi.ErrorConflict); ok { // user already exists
@@ -845,6 +1175,12 @@ func completeRegistration(
 				JSON: jsonerror.UserInUse("Desired user ID is already taken."),
 			}
 		}
+		if _, ok := err.(*userapi.ErrorForbidden); ok { // the guest has already been upgraded
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Only guest accounts can be upgraded"),
+			}
+		}
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: jsonerror.Unknown("failed to create account: " + err.Error()),
@@ -874,13 +1210,24 @@ func completeRegistration(
 		}
 	}
 
-	var devRes userapi.PerformDeviceCreationResponse
-	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
+	devReq := userapi.PerformDeviceCreationRequest{
 		Localpart:         username,
 		AccessToken:       token,
 		DeviceDisplayName: displayName,
 		DeviceID:          deviceID,
-	}, &devRes)
+	}
+	if tokenLifetime > 0 {
+		devReq.RefreshToken, err = auth.GenerateAccessToken()
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: jsonerror.Unknown("Failed to generate refresh token"),
+			}
+		}
+		devReq.AccessTokenExpiresTS = gomatrixserverlib.AsTimestamp(time.Now().Add(tokenLifetime))
+	}
+	var devRes userapi.PerformDeviceCreationResponse
+	err = userAPI.PerformDeviceCreation(ctx, &devReq, &devRes)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -891,10 +1238,12 @@ func completeRegistration(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			HomeServer:  accRes.Account.ServerName,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			HomeServer:   accRes.Account.ServerName,
+			DeviceID:     devRes.Device.ID,
+			RefreshToken: devReq.RefreshToken,
+			ExpiresInMS:  tokenLifetime.Milliseconds(),
 		},
 	}
 }
@@ -998,6 +1347,38 @@ type availableResponse struct {
 	Available bool `json:"available"`
 }
 
+type registrationTokenValidityResponse struct {
+	Valid bool `json:"valid"`
+}
+
+// RegistrationTokenValidity implements:
+//     GET /org.matrix.msc3231/register/org.matrix.msc3231.login.registration_token/validity?token=
+// from MSC3231, so that clients can check a token before asking for the rest of the
+// registration details.
+func RegistrationTokenValidity(
+	req *http.Request,
+	cfg *config.Dendrite,
+	accountDB accounts.Database,
+) util.JSONResponse {
+	if cfg.Matrix.RegistrationDisabled || !cfg.Matrix.RegistrationRequiresToken {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration tokens are not used on this server"),
+		}
+	}
+	token, err := accountDB.GetRegistrationToken(req.Context(), req.URL.Query().Get("token"))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: registrationTokenValidityResponse{
+			Valid: token != nil && token.Valid(gomatrixserverlib.AsTimestamp(time.Now())),
+		},
+	}
+}
+
 // RegisterAvailable checks if the username is already taken or invalid.
 func RegisterAvailable(
 	req *http.Request,
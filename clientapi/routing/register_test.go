@@ -15,11 +15,22 @@
 package routing
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/util"
 )
 
 var (
@@ -207,3 +218,144 @@ func TestValidationOfApplicationServices(t *testing.T) {
 		t.Errorf("user_id should not have been valid: @_something_else:localhost")
 	}
 }
+
+type discardMailer struct{}
+
+func (discardMailer) Send(to, subject, body string) error {
+	return nil
+}
+
+func TestRegistrationEmailStage(t *testing.T) {
+	ctx := context.Background()
+	db, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create devices database: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(db, deviceDB, "localhost", nil, nil, nil)
+	emailValidator := threepid.NewEmailValidator(db, discardMailer{}, &config.Email{
+		SMTPAddress:   "localhost:25",
+		PublicBaseURL: "https://matrix.localhost/",
+		TokenLifetime: time.Hour,
+	})
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Derived.Registration.Flows = []authtypes.Flow{
+		{Stages: []authtypes.LoginType{authtypes.LoginTypeEmail, authtypes.LoginTypeDummy}},
+	}
+	createSession := func(address string, validate bool) string {
+		sid, err := emailValidator.CreateSession(ctx, threepid.EmailAssociationRequest{Secret: "secret", Email: address, SendAttempt: 1})
+		if err != nil {
+			t.Fatalf("CreateSession failed: %s", err)
+		}
+		if validate {
+			session, err := db.GetThreePIDSession(ctx, sid)
+			if err != nil {
+				t.Fatalf("GetThreePIDSession failed: %s", err)
+			}
+			if err = emailValidator.SubmitToken(ctx, sid, "secret", session.Token); err != nil {
+				t.Fatalf("SubmitToken failed: %s", err)
+			}
+		}
+		return sid
+	}
+	register := func(sessionID, username, validationSessionID string) util.JSONResponse {
+		r := registerRequest{
+			Username: username,
+			Password: username + "spassword",
+			Auth: authDict{
+				Type:          authtypes.LoginTypeEmail,
+				Session:       sessionID,
+				ThreePIDCreds: auth.ThreePIDCredentials{SessionID: validationSessionID, ClientSecret: "secret"},
+			},
+		}
+		if validationSessionID == "" {
+			r.Auth = authDict{Type: authtypes.LoginTypeDummy, Session: sessionID}
+		}
+		req := httptest.NewRequest(http.MethodPost, "/register", nil)
+		return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, db, emailValidator)
+	}
+	localpartForEmail := func(address string) string {
+		localpart, err := db.GetLocalpartForThreePID(ctx, address, "email")
+		if err != nil {
+			t.Fatalf("GetLocalpartForThreePID failed: %s", err)
+		}
+		return localpart
+	}
+
+	// The dummy stage is still to be completed, so the account isn't created yet.
+	aliceSID := createSession("alice@localhost", true)
+	res := register("email_session", "alice", aliceSID)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d completing the email stage, want %d", res.Code, http.StatusUnauthorized)
+	}
+	if email, ok := sessions.GetEmail("email_session"); !ok || email.address != "alice@localhost" {
+		t.Errorf("session should have validated alice@localhost, got %+v", email)
+	}
+	if completed := sessions.GetCompletedStages("email_session"); len(completed) != 1 || completed[0] != authtypes.LoginTypeEmail {
+		t.Errorf("got completed stages %v, want the email stage", completed)
+	}
+
+	// The validation session was consumed by the first registration session.
+	if res = register("email_reused_session", "alice2", aliceSID); res.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d reusing a validation session, want %d", res.Code, http.StatusUnauthorized)
+	}
+	if len(sessions.GetCompletedStages("email_reused_session")) != 0 {
+		t.Errorf("a validation session should only complete the email stage once")
+	}
+
+	// Completing the flow creates the account with the address.
+	if res = register("email_session", "alice", ""); res.Code != http.StatusOK {
+		t.Fatalf("got status %d completing the registration, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	if localpart := localpartForEmail("alice@localhost"); localpart != "alice" {
+		t.Errorf("alice@localhost should be associated with alice, got %q", localpart)
+	}
+
+	res = register("email_unvalidated_session", "bob", createSession("bob@localhost", false))
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d for an unvalidated address, want %d", res.Code, http.StatusUnauthorized)
+	}
+	if len(sessions.GetCompletedStages("email_unvalidated_session")) != 0 {
+		t.Errorf("an unvalidated address should not complete the email stage")
+	}
+
+	if err = db.SaveThreePIDAssociation(ctx, "carol@localhost", "carol", "email"); err != nil {
+		t.Fatalf("SaveThreePIDAssociation failed: %s", err)
+	}
+	if res = register("email_in_use_session", "carol", createSession("carol@localhost", true)); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an address which is already in use, want %d", res.Code, http.StatusBadRequest)
+	}
+
+	// Two registrations validate the same address, only the first to
+	// complete gets it and the second doesn't create an account.
+	for _, sessionID := range []string{"email_first_session", "email_second_session"} {
+		if res = register(sessionID, "dave", createSession("dave@localhost", true)); res.Code != http.StatusUnauthorized {
+			t.Fatalf("got status %d completing the email stage, want %d", res.Code, http.StatusUnauthorized)
+		}
+	}
+	if res = register("email_first_session", "dave", ""); res.Code != http.StatusOK {
+		t.Fatalf("got status %d completing the first registration, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	res = register("email_second_session", "dave2", "")
+	if merr, _ := res.JSON.(jsonerror.MatrixError); res.Code != http.StatusBadRequest || merr.ErrCode != "M_THREEPID_IN_USE" {
+		t.Errorf("got status %d and %+v completing the second registration, want M_THREEPID_IN_USE", res.Code, res.JSON)
+	}
+	if _, err = db.GetAccountByLocalpart(ctx, "dave2"); err == nil {
+		t.Errorf("the second registration should not have created an account")
+	}
+
+	// The address is released again if the account can't be created.
+	if res = register("email_taken_session", "alice", createSession("erin@localhost", true)); res.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d completing the email stage, want %d", res.Code, http.StatusUnauthorized)
+	}
+	if res = register("email_taken_session", "alice", ""); res.Code == http.StatusOK {
+		t.Fatalf("registering a username which is taken should fail")
+	}
+	if localpart := localpartForEmail("erin@localhost"); localpart != "" {
+		t.Errorf("erin@localhost should not be associated with an account, got %q", localpart)
+	}
+}
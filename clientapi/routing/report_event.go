@@ -0,0 +1,65 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type reportEventRequest struct {
+	Reason string `json:"reason"`
+	Score  int    `json:"score"`
+}
+
+// ReportEvent implements:
+//     POST /rooms/{roomID}/report/{eventID}
+func ReportEvent(
+	req *http.Request, device *api.Device, roomID, eventID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var r reportEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Score < -100 || r.Score > 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("score must be between -100 and 0"),
+		}
+	}
+
+	var res roomserverAPI.PerformReportEventResponse
+	rsAPI.PerformReportEvent(req.Context(), &roomserverAPI.PerformReportEventRequest{
+		RoomID:  roomID,
+		EventID: eventID,
+		UserID:  device.UserID,
+		Reason:  r.Reason,
+		Score:   r.Score,
+	}, &res)
+	if res.Error != nil {
+		return res.Error.JSONResponse()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
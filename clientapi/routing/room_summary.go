@@ -0,0 +1,149 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const mRoomTombstone = "m.room.tombstone"
+
+type roomSummaryResponse struct {
+	RoomID      string                        `json:"room_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	Creator     string                        `json:"creator,omitempty"`
+	Predecessor *roomSummaryLink              `json:"predecessor,omitempty"`
+	Successor   *roomSummaryLink              `json:"successor,omitempty"`
+	// The IDs of the events pinned in the room, from m.room.pinned_events.
+	PinnedEvents []string `json:"pinned_events"`
+}
+
+// roomSummaryLink points at the room this one was upgraded from or to, along
+// with the event that recorded the upgrade.
+type roomSummaryLink struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id,omitempty"`
+	// Body is the server-supplied message from the tombstone event, if any.
+	Body string `json:"body,omitempty"`
+}
+
+type tombstoneContent struct {
+	Body            string `json:"body"`
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// GetRoomSummary implements GET /rooms/{roomId}/summary. It extracts the room
+// version, the predecessor from m.room.create and the successor from
+// m.room.tombstone so that clients can follow room upgrades without having to
+// fetch and parse the room state themselves. It also includes the pinned
+// events.
+func GetRoomSummary(
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI api.RoomserverInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI,
+) util.JSONResponse {
+	membershipReq := api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}
+	var membershipRes api.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(req.Context(), &membershipReq, &membershipRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.HasBeenInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+		}
+	}
+
+	createTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}
+	tombstoneTuple := gomatrixserverlib.StateKeyTuple{EventType: mRoomTombstone, StateKey: ""}
+	stateReq := currentstateAPI.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{createTuple, tombstoneTuple},
+	}
+	var stateRes currentstateAPI.QueryCurrentStateResponse
+	if err := stateAPI.QueryCurrentState(req.Context(), &stateReq, &stateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("stateAPI.QueryCurrentState failed")
+		return jsonerror.InternalServerError()
+	}
+
+	createEvent, ok := stateRes.StateEvents[createTuple]
+	if !ok || createEvent == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("cannot find room"),
+		}
+	}
+	var createContent gomatrixserverlib.CreateContent
+	if err := json.Unmarshal(createEvent.Content(), &createContent); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal m.room.create content")
+		return jsonerror.InternalServerError()
+	}
+
+	res := roomSummaryResponse{
+		RoomID:      roomID,
+		RoomVersion: gomatrixserverlib.RoomVersionV1,
+		Creator:     createContent.Creator,
+	}
+	// The spec says that a missing room_version means version 1.
+	if createContent.RoomVersion != nil {
+		res.RoomVersion = *createContent.RoomVersion
+	}
+	if createContent.Predecessor.RoomID != "" {
+		res.Predecessor = &roomSummaryLink{
+			RoomID:  createContent.Predecessor.RoomID,
+			EventID: createContent.Predecessor.EventID,
+		}
+	}
+
+	if tombstoneEvent, ok := stateRes.StateEvents[tombstoneTuple]; ok && tombstoneEvent != nil {
+		var content tombstoneContent
+		if err := json.Unmarshal(tombstoneEvent.Content(), &content); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal m.room.tombstone content")
+			return jsonerror.InternalServerError()
+		}
+		// A tombstone with no replacement room is how a tombstone gets
+		// "cleared", so only report a successor if there is one.
+		if content.ReplacementRoom != "" {
+			res.Successor = &roomSummaryLink{
+				RoomID:  content.ReplacementRoom,
+				EventID: tombstoneEvent.EventID(),
+				Body:    content.Body,
+			}
+		}
+	}
+
+	var err error
+	if res.PinnedEvents, err = queryPinnedEvents(req.Context(), roomID, stateAPI); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPinnedEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeRoomSummaryStateAPI returns the given events as the current state of
+// every room, along with the pinned events of fakePinnedEventsStateAPI.
+type fakeRoomSummaryStateAPI struct {
+	fakePinnedEventsStateAPI
+	state map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent
+}
+
+func (s *fakeRoomSummaryStateAPI) QueryCurrentState(
+	ctx context.Context, req *currentstateAPI.QueryCurrentStateRequest, res *currentstateAPI.QueryCurrentStateResponse,
+) error {
+	res.StateEvents = make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent)
+	for _, tuple := range req.StateTuples {
+		if ev, ok := s.state[tuple]; ok {
+			res.StateEvents[tuple] = ev
+		}
+	}
+	return nil
+}
+
+func mustRoomSummaryEvent(t *testing.T, eventJSON string) *gomatrixserverlib.HeaderedEvent {
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	h := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	return &h
+}
+
+func TestGetRoomSummary(t *testing.T) {
+	rsAPI := &fakePinnedEventsRoomserverAPI{
+		members: map[string]bool{"@alice:localhost": true},
+	}
+	createTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}
+	tombstoneTuple := gomatrixserverlib.StateKeyTuple{EventType: mRoomTombstone, StateKey: ""}
+	upgradedCreate := mustRoomSummaryEvent(t, `{"auth_events":[],"content":{"creator":"@alice:localhost","room_version":"5","predecessor":{"room_id":"!old:localhost","event_id":"$oldtombstone:localhost"}},"depth":1,"event_id":"$create:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.create","hashes":{"sha256":""},"signatures":{}}`)
+	v1Create := mustRoomSummaryEvent(t, `{"auth_events":[],"content":{"creator":"@alice:localhost"},"depth":1,"event_id":"$create:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.create","hashes":{"sha256":""},"signatures":{}}`)
+	tombstone := mustRoomSummaryEvent(t, `{"auth_events":[],"content":{"body":"This room has moved","replacement_room":"!new:localhost"},"depth":2,"event_id":"$tombstone:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.tombstone","hashes":{"sha256":""},"signatures":{}}`)
+	clearedTombstone := mustRoomSummaryEvent(t, `{"auth_events":[],"content":{},"depth":3,"event_id":"$cleared:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.tombstone","hashes":{"sha256":""},"signatures":{}}`)
+
+	tests := []struct {
+		name     string
+		userID   string
+		state    map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent
+		pinned   string
+		wantCode int
+		want     roomSummaryResponse
+	}{
+		{
+			name:     "never in the room",
+			userID:   "@bob:localhost",
+			state:    map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{createTuple: upgradedCreate},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "unknown room",
+			userID:   "@alice:localhost",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "room version defaults to 1",
+			userID:   "@alice:localhost",
+			state:    map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{createTuple: v1Create},
+			wantCode: http.StatusOK,
+			want: roomSummaryResponse{
+				RoomID:       "!room:localhost",
+				RoomVersion:  gomatrixserverlib.RoomVersionV1,
+				Creator:      "@alice:localhost",
+				PinnedEvents: []string{},
+			},
+		},
+		{
+			name:   "upgraded both ways",
+			userID: "@alice:localhost",
+			state: map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{
+				createTuple: upgradedCreate, tombstoneTuple: tombstone,
+			},
+			pinned:   `["$pinned:localhost"]`,
+			wantCode: http.StatusOK,
+			want: roomSummaryResponse{
+				RoomID:       "!room:localhost",
+				RoomVersion:  gomatrixserverlib.RoomVersionV5,
+				Creator:      "@alice:localhost",
+				Predecessor:  &roomSummaryLink{RoomID: "!old:localhost", EventID: "$oldtombstone:localhost"},
+				Successor:    &roomSummaryLink{RoomID: "!new:localhost", EventID: "$tombstone:localhost", Body: "This room has moved"},
+				PinnedEvents: []string{"$pinned:localhost"},
+			},
+		},
+		{
+			name:   "cleared tombstone",
+			userID: "@alice:localhost",
+			state: map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{
+				createTuple: v1Create, tombstoneTuple: clearedTombstone,
+			},
+			wantCode: http.StatusOK,
+			want: roomSummaryResponse{
+				RoomID:       "!room:localhost",
+				RoomVersion:  gomatrixserverlib.RoomVersionV1,
+				Creator:      "@alice:localhost",
+				PinnedEvents: []string{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		stateAPI := &fakeRoomSummaryStateAPI{
+			fakePinnedEventsStateAPI: fakePinnedEventsStateAPI{contentVal: tt.pinned},
+			state:                    tt.state,
+		}
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/rooms/!room:localhost/summary", nil)
+		res := GetRoomSummary(req, &userapi.Device{UserID: tt.userID}, "!room:localhost", rsAPI, stateAPI)
+		if res.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, res.Code, tt.wantCode)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		if got := res.JSON.(roomSummaryResponse); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got summary %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
@@ -28,6 +29,9 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// maxTagLength is the longest tag name, in bytes, which can be added to a room.
+const maxTagLength = 255
+
 // GetTags implements GET /_matrix/client/r0/user/{userID}/rooms/{roomID}/tags
 func GetTags(
 	req *http.Request,
@@ -50,6 +54,10 @@ func GetTags(
 		util.GetLogger(req.Context()).WithError(err).Error("obtainSavedTags failed")
 		return jsonerror.InternalServerError()
 	}
+	// Clients expect an empty object rather than null when there are no tags.
+	if tagContent.Tags == nil {
+		tagContent.Tags = make(map[string]gomatrix.TagProperties)
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -81,6 +89,9 @@ func PutTag(
 	if reqErr := httputil.UnmarshalJSONRequest(req, &properties); reqErr != nil {
 		return *reqErr
 	}
+	if resErr := validateTag(tag, properties); resErr != nil {
+		return *resErr
+	}
 
 	tagContent, err := obtainSavedTags(req, userID, roomID, userAPI)
 	if err != nil {
@@ -161,6 +172,24 @@ func DeleteTag(
 	}
 }
 
+// validateTag checks that a tag name isn't too long and that its order is in
+// the range [0,1], as required by the spec.
+func validateTag(tag string, properties gomatrix.TagProperties) *util.JSONResponse {
+	if tag == "" || len(tag) > maxTagLength {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("tag must be between 1 and %d bytes long", maxTagLength)),
+		}
+	}
+	if properties.Order < 0 || properties.Order > 1 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("order must be between 0 and 1"),
+		}
+	}
+	return nil
+}
+
 // obtainSavedTags gets all tags scoped to a userID and roomID
 // from the database
 func obtainSavedTags(
@@ -0,0 +1,30 @@
+package routing
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+func TestValidateTag(t *testing.T) {
+	testCases := []struct {
+		tag     string
+		order   float32
+		wantErr bool
+	}{
+		{tag: "m.favourite", order: 0.5},
+		{tag: "u.work"},
+		{tag: "m.lowpriority", order: 1},
+		{tag: "", wantErr: true},
+		{tag: strings.Repeat("a", maxTagLength+1), wantErr: true},
+		{tag: "m.favourite", order: -0.1, wantErr: true},
+		{tag: "m.favourite", order: 1.5, wantErr: true},
+	}
+	for _, tc := range testCases {
+		resErr := validateTag(tc.tag, gomatrix.TagProperties{Order: tc.order})
+		if gotErr := resErr != nil; gotErr != tc.wantErr {
+			t.Errorf("validateTag(%q, %v): got error %v, want error %v", tc.tag, tc.order, resErr, tc.wantErr)
+		}
+	}
+}
@@ -15,7 +15,6 @@
 package routing
 
 import (
-	"encoding/json"
 	"net/http"
 	"strings"
 
@@ -25,12 +24,14 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/sso"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/httputil"
-	"github.com/matrix-org/dendrite/internal/transactions"
+	"github.com/matrix-org/dendrite/internal/mail"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -50,7 +51,7 @@ const pathPrefixUnstable = "/client/unstable"
 // applied:
 // nolint: gocyclo
 func Setup(
-	publicAPIMux *mux.Router, cfg *config.Dendrite,
+	publicAPIMux, dendriteAdminMux *mux.Router, cfg *config.Dendrite,
 	eduAPI eduServerAPI.EDUServerInputAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	asAPI appserviceAPI.AppServiceQueryAPI,
@@ -59,12 +60,29 @@ func Setup(
 	userAPI userapi.UserInternalAPI,
 	federation *gomatrixserverlib.FederationClient,
 	syncProducer *producers.SyncAPIProducer,
-	transactionsCache *transactions.Cache,
 	federationSender federationSenderAPI.FederationSenderInternalAPI,
 	stateAPI currentstateAPI.CurrentStateInternalAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 ) {
-	userInteractiveAuth := auth.NewUserInteractive(accountDB.GetAccountByPassword, cfg)
+	var emailValidator *threepid.EmailValidator
+	var typeEmail *auth.LoginTypeEmailIdentity
+	if cfg.Matrix.Email.Enabled() {
+		emailValidator = threepid.NewEmailValidator(accountDB, mail.NewSMTPSender(&cfg.Matrix.Email), &cfg.Matrix.Email)
+		typeEmail = &auth.LoginTypeEmailIdentity{
+			CheckThreePIDSession:    emailValidator.CheckAssociation,
+			GetLocalpartForThreePID: accountDB.GetLocalpartForThreePID,
+		}
+	}
+	userInteractiveAuth := auth.NewUserInteractive(guardedGetAccountByPassword(accountDB, cfg), cfg, typeEmail)
+	// Users who have forgotten their password can only authenticate with an
+	// email address which the server has validated itself.
+	var passwordResetAuth *auth.UserInteractive
+	if emailValidator != nil {
+		passwordResetAuth = auth.NewEmailIdentityUserInteractive(emailValidator.CheckAssociation)
+	}
+	ssoProviders := sso.NewIdentityProviders(&cfg.Matrix.SSO, http.DefaultClient)
+	ssoSessions := sso.NewSessions()
+	rateLimits := newRateLimits(cfg)
 
 	publicAPIMux.Handle("/client/versions",
 		httputil.MakeExternalAPI("versions", func(req *http.Request) util.JSONResponse {
@@ -88,11 +106,17 @@ func Setup(
 
 	r0mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitRoomCreation); r != nil {
+				return *r
+			}
 			return CreateRoom(req, device, cfg, accountDB, rsAPI, asAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/join/{roomIDOrAlias}",
-		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitJoins); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -102,13 +126,56 @@ func Setup(
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+	if cfg.FeatureEnabled(config.FeatureKnocking) {
+		r0mux.Handle("/knock/{roomIDOrAlias}",
+			httputil.MakeAuthAPI("knock", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				if r := rateLimits.check(req, device, rateLimitJoins); r != nil {
+					return *r
+				}
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return KnockRoomByIDOrAlias(
+					req, device, cfg, rsAPI, vars["roomIDOrAlias"],
+				)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+	if cfg.FeatureEnabled(config.FeaturePeeking) {
+		r0mux.Handle("/peek/{roomIDOrAlias}",
+			httputil.MakeAuthAPI("peek", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return PeekRoomByIDOrAlias(
+					req, device, rsAPI, vars["roomIDOrAlias"],
+				)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+		r0mux.Handle("/rooms/{roomID}/unpeek",
+			httputil.MakeAuthAPI("unpeek", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return UnpeekRoomByID(
+					req, device, rsAPI, vars["roomID"],
+				)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
 	r0mux.Handle("/joined_rooms",
 		httputil.MakeAuthAPI("joined_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, stateAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/join",
-		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitJoins); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -119,7 +186,7 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/leave",
-		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -129,17 +196,47 @@ func Setup(
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/aliases",
+		httputil.MakeAuthAPI("room_aliases", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetRoomAliases(req, device, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/upgrade",
+		httputil.MakeAuthAPI("rooms_upgrade", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UpgradeRoom(req, device, cfg, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/report/{eventID}",
+		httputil.MakeAuthAPI("rooms_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportEvent(req, device, vars["roomID"], vars["eventID"], rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/ban",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendBan(req, accountDB, device, vars["roomID"], cfg, rsAPI, asAPI)
+			return SendBan(req, device, vars["roomID"], rsAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/invite",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitInvites); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -153,7 +250,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendKick(req, accountDB, device, vars["roomID"], cfg, rsAPI, asAPI)
+			return SendKick(req, device, vars["roomID"], rsAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/unban",
@@ -162,11 +259,14 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SendUnban(req, accountDB, device, vars["roomID"], cfg, rsAPI, asAPI)
+			return SendUnban(req, device, vars["roomID"], rsAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitMessages); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -175,27 +275,37 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
-		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitMessages); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			// Guests can only send messages.
+			if device.IsGuest && vars["eventType"] != "m.room.message" {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.GuestAccessForbidden("Guests can only send m.room.message events"),
+				}
+			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
-				nil, cfg, rsAPI, transactionsCache)
+				nil, cfg, rsAPI, deviceDB)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
-		httputil.MakeAuthAPI("rooms_get_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("rooms_get_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetEvent(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, federation)
+			return GetEvent(req, device, vars["roomID"], vars["eventID"], rsAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/state", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/state", httputil.MakeGuestAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
@@ -203,7 +313,7 @@ func Setup(
 		return OnIncomingStateRequest(req.Context(), rsAPI, vars["roomID"])
 	})).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/state/{type:[^/]+/?}", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/state/{type:[^/]+/?}", httputil.MakeGuestAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
@@ -217,7 +327,7 @@ func Setup(
 		return OnIncomingStateTypeRequest(req.Context(), rsAPI, vars["roomID"], eventType, "", eventFormat)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/state/{type}/{stateKey}", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/state/{type}/{stateKey}", httputil.MakeGuestAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
@@ -228,6 +338,9 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitMessages); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -244,6 +357,9 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitMessages); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -254,24 +370,45 @@ func Setup(
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		return Register(req, userAPI, accountDB, cfg)
+		if r := rateLimits.check(req, nil, rateLimitRegistration); r != nil {
+			return *r
+		}
+		return Register(req, userAPI, accountDB, emailValidator, cfg)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	v1mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
+		if r := rateLimits.check(req, nil, rateLimitRegistration); r != nil {
+			return *r
+		}
 		return LegacyRegister(req, userAPI, cfg)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
+	registrationNonces := newSharedSecretNonces(cfg.Matrix.RegistrationSharedSecret)
+	dendriteAdminMux.Handle("/admin/register", httputil.MakeExternalAPI("admin_register_nonce", func(req *http.Request) util.JSONResponse {
+		return SharedSecretRegistrationNonce(cfg, registrationNonces)
+	})).Methods(http.MethodGet, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/register", httputil.MakeExternalAPI("admin_register", func(req *http.Request) util.JSONResponse {
+		return SharedSecretRegister(req, userAPI, accountDB, stateAPI, cfg, registrationNonces)
+	})).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
 		return RegisterAvailable(req, cfg, accountDB)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	unstableMux.Handle("/org.matrix.msc3231/register/org.matrix.msc3231.login.registration_token/validity", httputil.MakeExternalAPI("registration_token_validity", func(req *http.Request) util.JSONResponse {
+		if r := rateLimits.check(req, nil, rateLimitRegistrationTokens); r != nil {
+			return *r
+		}
+		return RegistrationTokenValidity(req, cfg, accountDB)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/directory/room/{roomAlias}",
 		httputil.MakeExternalAPI("directory_room", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return DirectoryRoom(req, vars["roomAlias"], federation, cfg, rsAPI, federationSender)
+			return DirectoryRoom(req, vars["roomAlias"], cfg, rsAPI, federationSender)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -332,7 +469,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/typing/{userID}",
-		httputil.MakeAuthAPI("rooms_typing", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("rooms_typing", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -351,13 +488,13 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/sendToDevice/{eventType}/{txnID}",
-		httputil.MakeAuthAPI("send_to_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("send_to_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			txnID := vars["txnID"]
-			return SendToDevice(req, device, eduAPI, transactionsCache, vars["eventType"], &txnID)
+			return SendToDevice(req, device, eduAPI, deviceDB, vars["eventType"], &txnID)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -365,18 +502,18 @@ func Setup(
 	// rather than r0. It's an exact duplicate of the above handler.
 	// TODO: Remove this if/when sytest is fixed!
 	unstableMux.Handle("/sendToDevice/{eventType}/{txnID}",
-		httputil.MakeAuthAPI("send_to_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("send_to_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			txnID := vars["txnID"]
-			return SendToDevice(req, device, eduAPI, transactionsCache, vars["eventType"], &txnID)
+			return SendToDevice(req, device, eduAPI, deviceDB, vars["eventType"], &txnID)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/account/whoami",
-		httputil.MakeAuthAPI("whoami", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("whoami", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return Whoami(req, device)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
@@ -385,10 +522,59 @@ func Setup(
 
 	r0mux.Handle("/login",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			return Login(req, accountDB, deviceDB, cfg)
+			if req.Method == http.MethodPost {
+				if r := rateLimits.check(req, nil, rateLimitLogin); r != nil {
+					return *r
+				}
+			}
+			return Login(req, userAPI, accountDB, deviceDB, ssoProviders, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	refreshHandler := httputil.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+		if req.Method == http.MethodPost {
+			if r := rateLimits.check(req, nil, rateLimitRefresh); r != nil {
+				return *r
+			}
+		}
+		return Refresh(req, deviceDB, cfg)
+	})
+	r0mux.Handle("/refresh", refreshHandler).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/org.matrix.msc2918.refresh_token/refresh", refreshHandler).Methods(http.MethodPost, http.MethodOptions)
+
+	if len(ssoProviders) > 0 {
+		ssoRedirect := httputil.MakeHTMLAPI("login_sso_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.check(req, nil, rateLimitSSO); r != nil {
+				return r
+			}
+			return SSORedirect(w, req, ssoProviders, ssoSessions, mux.Vars(req)["idpID"], cfg)
+		})
+		r0mux.Handle("/login/sso/redirect", ssoRedirect).Methods(http.MethodGet, http.MethodOptions)
+		r0mux.Handle("/login/sso/redirect/{idpID}", ssoRedirect).Methods(http.MethodGet, http.MethodOptions)
+		r0mux.Handle("/login/sso/callback/{idpID}",
+			httputil.MakeHTMLAPI("login_sso_callback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				return SSOCallback(w, req, ssoProviders, ssoSessions, mux.Vars(req)["idpID"], accountDB, userAPI, stateAPI, cfg)
+			}),
+		).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+		r0mux.Handle("/login/sso/metadata/{idpID}",
+			httputil.MakeHTMLAPI("login_sso_metadata", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				return SSOMetadata(w, req, ssoProviders, mux.Vars(req)["idpID"], cfg)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+	}
+	if len(cfg.Matrix.SSO.CASProviders) > 0 {
+		// The legacy CAS login starts a login with the first CAS server,
+		// which then carries on like any other SSO login.
+		r0mux.Handle("/login/cas/redirect",
+			httputil.MakeHTMLAPI("login_cas_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				if r := rateLimits.check(req, nil, rateLimitSSO); r != nil {
+					return r
+				}
+				return SSORedirect(w, req, ssoProviders, ssoSessions, cfg.Matrix.SSO.CASProviders[0].ID, cfg)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+	}
+
 	r0mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTMLAPI("auth_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
 			vars := mux.Vars(req)
@@ -396,27 +582,102 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/pushers",
+		httputil.MakeAuthAPI("get_pushers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetPushers(req, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushers/set",
+		httputil.MakeAuthAPI("set_pusher", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SetPusher(req, device, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/pushrules/",
-		httputil.MakeExternalAPI("push_rules", func(req *http.Request) util.JSONResponse {
-			// TODO: Implement push rules API
-			res := json.RawMessage(`{
-					"global": {
-						"content": [],
-						"override": [],
-						"room": [],
-						"sender": [],
-						"underride": []
-					}
-				}`)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: &res,
+		httputil.MakeGuestAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetAllPushRules(req, device, userAPI, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/",
+		httputil.MakeGuestAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByScope(req, device, userAPI, cfg, vars["scope"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/",
+		httputil.MakeGuestAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByKind(req, device, userAPI, cfg, vars["scope"], vars["kind"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeGuestAuthAPI("push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return GetPushRuleByRuleID(req, device, userAPI, cfg, vars["scope"], vars["kind"], vars["ruleID"])
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("put_push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleByRuleID(req, device, userAPI, cfg, syncProducer, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("delete_push_rule", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeletePushRuleByRuleID(req, device, userAPI, cfg, syncProducer, vars["scope"], vars["kind"], vars["ruleID"])
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		httputil.MakeGuestAuthAPI("push_rule_attr", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleAttrByRuleID(req, device, userAPI, cfg, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("put_push_rule_attr", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleAttrByRuleID(req, device, userAPI, cfg, syncProducer, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
 	// Riot user settings
 
+	r0mux.Handle("/user_directory/search",
+		httputil.MakeAuthAPI("user_directory_search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SearchUserDirectory(req, device, stateAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/profile/{userID}",
 		httputil.MakeExternalAPI("profile", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -460,7 +721,7 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/profile/{userID}/displayname",
-		httputil.MakeAuthAPI("profile_displayname", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("profile_displayname", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -479,19 +740,185 @@ func Setup(
 
 	r0mux.Handle("/account/3pid",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return CheckAndSave3PIDAssociation(req, accountDB, device, cfg)
+			return CheckAndSave3PIDAssociation(req, accountDB, emailValidator, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/add",
+		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Add3PID(req, userInteractiveAuth, accountDB, emailValidator, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/delete",
+		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Forget3PID(req, accountDB, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	unstableMux.Handle("/account/3pid/delete",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return Forget3PID(req, accountDB)
+			return Forget3PID(req, accountDB, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
 		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
-			return RequestEmailToken(req, accountDB, cfg)
+			if r := rateLimits.check(req, nil, rateLimitEmailTokens); r != nil {
+				return *r
+			}
+			return RequestEmailToken(req, accountDB, emailValidator, rateLimits, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/email/submitToken",
+		httputil.MakeExternalAPI("account_3pid_submit_token", func(req *http.Request) util.JSONResponse {
+			return SubmitEmailToken(req, emailValidator)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/deactivate",
+		httputil.MakeAuthAPI("deactivate", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Deactivate(req, userInteractiveAuth, userAPI, rsAPI, stateAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	// User management for server administrators, modelled on Synapse's admin API.
+	// These aren't part of the Matrix APIs, so are served under /_dendrite.
+	dendriteAdminMux.Handle("/admin/users",
+		httputil.MakeAdminAPI("admin_users", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListUsers(req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/users/{userID}",
+		httputil.MakeAdminAPI("admin_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if req.Method == http.MethodGet {
+				return AdminGetUser(req, accountDB, vars["userID"], cfg)
+			}
+			return AdminPutUser(req, device, userAPI, accountDB, rsAPI, stateAPI, vars["userID"], cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/users/{userID}/admin",
+		httputil.MakeAdminAPI("admin_user_admin", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminUserAdmin(req, device, userAPI, accountDB, vars["userID"], cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/reset_password/{userID}",
+		httputil.MakeAdminAPI("admin_reset_password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminResetPassword(req, userAPI, accountDB, vars["userID"], cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/deactivate/{userID}",
+		httputil.MakeAdminAPI("admin_deactivate", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminDeactivateUser(req, userAPI, accountDB, rsAPI, stateAPI, vars["userID"], cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/provisioned_users",
+		httputil.MakeAdminAPI("admin_provisioned_users", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if req.Method == http.MethodGet {
+				return AdminListProvisionedUsers(req, userAPI)
+			}
+			return AdminProvisionUsers(req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/event_reports",
+		httputil.MakeAdminAPI("admin_event_reports", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListEventReports(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/event_reports/{reportID}/resolve",
+		httputil.MakeAdminAPI("admin_resolve_event_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminResolveEventReport(req, device, rsAPI, vars["reportID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/rooms",
+		httputil.MakeAdminAPI("admin_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListRooms(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/auth_debug/{roomID}",
+		httputil.MakeAdminAPI("admin_auth_debug", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminAuthDebug(req, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/destinations",
+		httputil.MakeAdminAPI("admin_destinations", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDestinations(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/purge_room",
+		httputil.MakeAdminAPI("admin_purge_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeRoom(req, rsAPI, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/send_server_notice",
+		httputil.MakeAdminAPI("admin_send_server_notice", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SendServerNotice(req, cfg, accountDB, userAPI, rsAPI, stateAPI, asAPI, syncProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/registration_tokens",
+		httputil.MakeAdminAPI("admin_registration_tokens", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListRegistrationTokens(req, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/registration_tokens/new",
+		httputil.MakeAdminAPI("admin_new_registration_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminNewRegistrationToken(req, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	dendriteAdminMux.Handle("/admin/registration_tokens/{token}",
+		httputil.MakeAdminAPI("admin_registration_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			switch req.Method {
+			case http.MethodPut:
+				return AdminUpdateRegistrationToken(req, accountDB, vars["token"])
+			case http.MethodDelete:
+				return AdminDeleteRegistrationToken(req, accountDB, vars["token"])
+			default:
+				return AdminGetRegistrationToken(req, accountDB, vars["token"])
+			}
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	r0mux.Handle("/account/password",
+		httputil.MakeExternalAPI("account_password", func(req *http.Request) util.JSONResponse {
+			return Password(req, userAPI, accountDB, userInteractiveAuth, passwordResetAuth, emailValidator, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/password/email/requestToken",
+		httputil.MakeExternalAPI("account_password_request_token", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.check(req, nil, rateLimitEmailTokens); r != nil {
+				return *r
+			}
+			return RequestPasswordEmailToken(req, accountDB, emailValidator, rateLimits)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -507,7 +934,7 @@ func Setup(
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/voip/turnServer",
-		httputil.MakeAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return RequestTurnServer(req, device, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
@@ -533,65 +960,139 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/account_data/{type}",
-		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SaveAccountData(req, userAPI, device, vars["userID"], "", vars["type"], syncProducer)
+			return SaveAccountData(req, userAPI, device, vars["userID"], "", vars["type"], syncProducer, cfg)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/rooms/{roomID}/account_data/{type}",
-		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SaveAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"], syncProducer)
+			return SaveAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"], syncProducer, cfg)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/account_data/{type}",
-		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			return GetAccountData(req, userAPI, device, vars["userID"], "", vars["type"])
 		}),
-	).Methods(http.MethodGet)
+	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/user/{userID}/rooms/{roomID}/account_data/{type}",
-		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
 			return GetAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"])
 		}),
-	).Methods(http.MethodGet)
+	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/members",
-		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/joined_members",
+		httputil.MakeAuthAPI("rooms_joined_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetMemberships(req, device, vars["roomID"], false, cfg, rsAPI)
+			return GetJoinedMembers(req, device, vars["roomID"], stateAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/joined_members",
-		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	hierarchyWalks := newHierarchyWalks()
+	unstableMux.Handle("/org.matrix.msc2946/rooms/{roomID}/hierarchy",
+		httputil.MakeAuthAPI("rooms_hierarchy", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetMemberships(req, device, vars["roomID"], true, cfg, rsAPI)
+			return GetRoomHierarchy(req, device, vars["roomID"], rsAPI, federationSender, hierarchyWalks)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	// This is not in the spec: it saves clients from parsing room state to
+	// follow room upgrades.
+	unstableMux.Handle("/rooms/{roomID}/summary",
+		httputil.MakeAuthAPI("rooms_summary", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetRoomSummary(req, device, vars["roomID"], rsAPI, stateAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/rooms/{roomID}/pinned_events",
+		httputil.MakeAuthAPI("rooms_pinned_events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPinnedEvents(req, device, vars["roomID"], rsAPI, stateAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/rooms/{roomID}/pinned_events",
+		httputil.MakeAuthAPI("rooms_pinned_events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SetPinnedEvents(req, device, vars["roomID"], cfg, rsAPI)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+	unstableMux.Handle("/rooms/{roomID}/notification_mode",
+		httputil.MakeAuthAPI("room_notification_mode", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetRoomNotificationMode(req, device, userAPI, cfg, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/rooms/{roomID}/notification_mode",
+		httputil.MakeAuthAPI("put_room_notification_mode", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutRoomNotificationMode(req, device, userAPI, cfg, syncProducer, vars["roomID"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	unstableMux.Handle("/rooms/{roomID}/bulk_invite",
+		httputil.MakeAuthAPI("rooms_bulk_invite", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.check(req, device, rateLimitInvites); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return BulkInvite(req, accountDB, device, vars["roomID"], cfg, rsAPI, asAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	// This is not in the spec: it lets application services import the
+	// history of bridged rooms without a request per event.
+	unstableMux.Handle("/rooms/{roomID}/batch_send",
+		httputil.MakeAuthAPI("rooms_batch_send", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return BatchSend(req, device, vars["roomID"], cfg, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/rooms/{roomID}/read_markers",
 		httputil.MakeExternalAPI("rooms_read_markers", func(req *http.Request) util.JSONResponse {
 			// TODO: return the read_markers.
@@ -600,13 +1101,13 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/devices",
-		httputil.MakeAuthAPI("get_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("get_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetDevicesByLocalpart(req, deviceDB, device)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/devices/{deviceID}",
-		httputil.MakeAuthAPI("get_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("get_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -616,12 +1117,12 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/devices/{deviceID}",
-		httputil.MakeAuthAPI("device_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("device_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return UpdateDeviceByID(req, deviceDB, device, vars["deviceID"])
+			return UpdateDeviceByID(req, userAPI, device, vars["deviceID"])
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -631,13 +1132,13 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return DeleteDeviceById(req, userInteractiveAuth, deviceDB, device, vars["deviceID"])
+			return DeleteDeviceById(req, userInteractiveAuth, userAPI, device, vars["deviceID"])
 		}),
 	).Methods(http.MethodDelete, http.MethodOptions)
 
 	r0mux.Handle("/delete_devices",
 		httputil.MakeAuthAPI("delete_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return DeleteDevices(req, deviceDB, device)
+			return DeleteDevices(req, userInteractiveAuth, userAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -660,6 +1161,16 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/user/{userID}/openid/request_token",
+		httputil.MakeAuthAPI("openid_request_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return CreateOpenIDToken(req, userAPI, device, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/user/{userId}/rooms/{roomId}/tags",
 		httputil.MakeAuthAPI("get_tags", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -697,14 +1208,14 @@ func Setup(
 	).Methods(http.MethodGet)
 
 	r0mux.Handle("/keys/query",
-		httputil.MakeAuthAPI("queryKeys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("queryKeys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return QueryKeys(req)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	// Supplying a device ID is deprecated.
 	r0mux.Handle("/keys/upload/{deviceID}",
-		httputil.MakeAuthAPI("keys_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("keys_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return UploadKeys(req)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
@@ -0,0 +1,72 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi"
+	userapiAPI "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+)
+
+// testRoutes are the routes set up by Setup, which can only be called once
+// because it registers metrics.
+type testRoutes struct {
+	publicAPIMux     *mux.Router
+	dendriteAdminMux *mux.Router
+	accountDB        accounts.Database
+	deviceDB         devices.Database
+	userAPI          userapiAPI.UserInternalAPI
+}
+
+var (
+	testRoutesOnce sync.Once
+	testRoutesErr  error
+	sharedRoutes   testRoutes
+)
+
+// setupTestRoutes returns the routes shared by the tests, which use
+// in-memory databases and don't have the other components.
+func setupTestRoutes(t *testing.T) *testRoutes {
+	testRoutesOnce.Do(func() {
+		if sharedRoutes.accountDB, testRoutesErr = accounts.NewDatabase("file::memory:", nil, "localhost"); testRoutesErr != nil {
+			return
+		}
+		if sharedRoutes.deviceDB, testRoutesErr = devices.NewDatabase("file::memory:", nil, "localhost"); testRoutesErr != nil {
+			return
+		}
+		sharedRoutes.userAPI = userapi.NewInternalAPI(sharedRoutes.accountDB, sharedRoutes.deviceDB, "localhost", nil, nil, nil)
+		cfg := &config.Dendrite{}
+		cfg.Matrix.ServerName = "localhost"
+		cfg.Matrix.RegistrationRequiresToken = true
+		cfg.Matrix.RateLimiting.Registration = config.RateLimit{Burst: 2, Interval: time.Minute}
+		sharedRoutes.publicAPIMux = mux.NewRouter().PathPrefix("/_matrix").Subrouter()
+		sharedRoutes.dendriteAdminMux = mux.NewRouter().PathPrefix("/_dendrite").Subrouter()
+		Setup(
+			sharedRoutes.publicAPIMux, sharedRoutes.dendriteAdminMux, cfg, nil, nil, nil,
+			sharedRoutes.accountDB, sharedRoutes.deviceDB, sharedRoutes.userAPI, nil, nil, nil, nil, nil,
+		)
+	})
+	if testRoutesErr != nil {
+		t.Fatalf("failed to set up routes: %s", testRoutesErr)
+	}
+	return &sharedRoutes
+}
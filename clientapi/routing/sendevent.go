@@ -15,20 +15,30 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/eventutil"
-	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
 )
 
+// The endpoints which the results of transactions are recorded for in the
+// device database.
+const (
+	txnEndpointSend         = "send"
+	txnEndpointSendToDevice = "sendToDevice"
+)
+
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-send-eventtype-txnid
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-state-eventtype-statekey
 type sendEventResponse struct {
@@ -45,7 +55,7 @@ func SendEvent(
 	roomID, eventType string, txnID, stateKey *string,
 	cfg *config.Dendrite,
 	rsAPI api.RoomserverInternalAPI,
-	txnCache *transactions.Cache,
+	deviceDB devices.Database,
 ) util.JSONResponse {
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
@@ -57,9 +67,18 @@ func SendEvent(
 	}
 
 	if txnID != nil {
-		// Try to fetch response from transactionsCache
-		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID); ok {
-			return *res
+		// The transaction IDs are stored in the database rather than in
+		// memory, so that retries are still recognised after a restart.
+		eventID, ok, err := deviceDB.GetTransaction(req.Context(), device.UserID, device.ID, txnEndpointSend, *txnID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetTransaction failed")
+			return jsonerror.InternalServerError()
+		}
+		if ok {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: sendEventResponse{eventID},
+			}
 		}
 	}
 
@@ -67,6 +86,9 @@ func SendEvent(
 	if resErr != nil {
 		return *resErr
 	}
+	if resErr = claimAnnotation(req.Context(), e, rsAPI); resErr != nil {
+		return *resErr
+	}
 
 	var txnAndSessionID *api.TransactionID
 	if txnID != nil {
@@ -88,6 +110,7 @@ func SendEvent(
 	)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
+		releaseAnnotation(req.Context(), e, rsAPI)
 		return jsonerror.InternalServerError()
 	}
 	util.GetLogger(req.Context()).WithFields(logrus.Fields{
@@ -96,16 +119,18 @@ func SendEvent(
 		"room_version": verRes.RoomVersion,
 	}).Info("Sent event to roomserver")
 
-	res := util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: sendEventResponse{eventID},
-	}
-	// Add response to transactionsCache
 	if txnID != nil {
-		txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+		if err = deviceDB.StoreTransaction(req.Context(), device.UserID, device.ID, txnEndpointSend, *txnID, eventID); err != nil {
+			// The event has been sent, so don't fail the request. The worst
+			// that can happen is that a retry sends the event again.
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.StoreTransaction failed")
+		}
 	}
 
-	return res
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{eventID},
+	}
 }
 
 func generateSendEvent(
@@ -131,6 +156,17 @@ func generateSendEvent(
 		}
 	}
 
+	if eventType == gomatrixserverlib.MRoomCanonicalAlias && stateKey != nil && *stateKey == "" {
+		if resErr = validateCanonicalAlias(req.Context(), r, roomID, cfg, rsAPI); resErr != nil {
+			return nil, resErr
+		}
+	}
+	if eventType == mRoomPinnedEvents && stateKey != nil && *stateKey == "" {
+		if resErr = validatePinnedEvents(req.Context(), r, roomID, rsAPI); resErr != nil {
+			return nil, resErr
+		}
+	}
+
 	// create the new event and set all the fields we can
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:   userID,
@@ -188,3 +224,55 @@ func generateSendEvent(
 	}
 	return &e.Event, nil
 }
+
+// validateCanonicalAlias checks that the alias and alt_aliases of an
+// m.room.canonical_alias event are room aliases, and that the local ones
+// point to the room.
+func validateCanonicalAlias(
+	ctx context.Context, content map[string]interface{}, roomID string,
+	cfg *config.Dendrite, rsAPI api.RoomserverInternalAPI,
+) *util.JSONResponse {
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("json.Marshal failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	var canonicalAlias eventutil.CanonicalAlias
+	if err = json.Unmarshal(rawContent, &canonicalAlias); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The canonical alias is invalid: " + err.Error()),
+		}
+	}
+	aliases := canonicalAlias.AltAliases
+	if canonicalAlias.Alias != "" {
+		aliases = append([]string{canonicalAlias.Alias}, aliases...)
+	}
+	for _, alias := range aliases {
+		_, domain, err := gomatrixserverlib.SplitID('#', alias)
+		if err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("%q is not a room alias", alias)),
+			}
+		}
+		// TODO: Check remote aliases over federation.
+		if domain != cfg.Matrix.ServerName {
+			continue
+		}
+		var res api.GetRoomIDForAliasResponse
+		if err = rsAPI.GetRoomIDForAlias(ctx, &api.GetRoomIDForAliasRequest{Alias: alias}, &res); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		if res.RoomID != roomID {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadAlias(fmt.Sprintf("The alias %s doesn't point to this room", alias)),
+			}
+		}
+	}
+	return nil
+}
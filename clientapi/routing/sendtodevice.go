@@ -14,27 +14,41 @@ package routing
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/eduserver/api"
-	"github.com/matrix-org/dendrite/internal/transactions"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
 // SendToDevice handles PUT /_matrix/client/r0/sendToDevice/{eventType}/{txnId}
-// sends the device events to the EDU Server
+// sends the device events to the EDU Server, which delivers them to local
+// devices through the sync API and to remote ones through the federation sender.
+// The transaction IDs are stored in the device database, like those for
+// sending events, so that retries are still recognised after a restart.
 func SendToDevice(
 	req *http.Request, device *userapi.Device,
 	eduAPI api.EDUServerInputAPI,
-	txnCache *transactions.Cache,
+	deviceDB devices.Database,
 	eventType string, txnID *string,
 ) util.JSONResponse {
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
 	if txnID != nil {
-		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID); ok {
-			return *res
+		_, ok, err := deviceDB.GetTransaction(req.Context(), device.UserID, device.ID, txnEndpointSendToDevice, *txnID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetTransaction failed")
+			return jsonerror.InternalServerError()
+		}
+		if ok {
+			return res
 		}
 	}
 
@@ -45,6 +59,16 @@ func SendToDevice(
 	if resErr != nil {
 		return *resErr
 	}
+	// Check everything before sending anything, so that a bad request isn't
+	// half delivered.
+	for userID := range httpReq.Messages {
+		if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("%q is not a valid user ID", userID)),
+			}
+		}
+	}
 
 	for userID, byUser := range httpReq.Messages {
 		for deviceID, message := range byUser {
@@ -57,13 +81,11 @@ func SendToDevice(
 		}
 	}
 
-	res := util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: struct{}{},
-	}
-
 	if txnID != nil {
-		txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+		if err := deviceDB.StoreTransaction(req.Context(), device.UserID, device.ID, txnEndpointSendToDevice, *txnID, ""); err != nil {
+			// The messages have been sent, so don't fail the request.
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.StoreTransaction failed")
+		}
 	}
 
 	return res
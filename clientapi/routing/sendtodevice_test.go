@@ -0,0 +1,76 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+)
+
+type fakeEDUServerInputAPI struct {
+	sent []api.InputSendToDeviceEvent
+}
+
+func (f *fakeEDUServerInputAPI) InputTypingEvent(
+	ctx context.Context, request *api.InputTypingEventRequest, response *api.InputTypingEventResponse,
+) error {
+	return nil
+}
+
+func (f *fakeEDUServerInputAPI) InputSendToDeviceEvent(
+	ctx context.Context, request *api.InputSendToDeviceEventRequest, response *api.InputSendToDeviceEventResponse,
+) error {
+	f.sent = append(f.sent, request.InputSendToDeviceEvent)
+	return nil
+}
+
+func TestSendToDevice(t *testing.T) {
+	eduAPI := &fakeEDUServerInputAPI{}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create devices database: %s", err)
+	}
+	device := &userapi.Device{UserID: "@alice:localhost", ID: "ALICE", AccessToken: "token"}
+	send := func(txnID, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/sendToDevice/m.test/"+txnID, strings.NewReader(body))
+		return SendToDevice(req, device, eduAPI, deviceDB, "m.test", &txnID).Code
+	}
+
+	body := `{"messages":{"@bob:localhost":{"BOB":{"a":1}},"@charlie:remote":{"*":{"a":2}}}}`
+	if code := send("1", body); code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", code)
+	}
+	if len(eduAPI.sent) != 2 {
+		t.Fatalf("got %d messages sent, want 2", len(eduAPI.sent))
+	}
+	for _, ev := range eduAPI.sent {
+		if ev.Sender != device.UserID || ev.Type != "m.test" {
+			t.Errorf("got message %+v, want it to be an m.test from %s", ev, device.UserID)
+		}
+	}
+
+	// retrying the transaction mustn't send the messages again, even after
+	// the device's access token has been refreshed
+	device.AccessToken = "refreshed_token"
+	if code := send("1", body); code != http.StatusOK || len(eduAPI.sent) != 2 {
+		t.Errorf("retried transaction got status %d and %d messages sent, want 200 and 2", code, len(eduAPI.sent))
+	}
+	// other devices can use the same transaction ID
+	device = &userapi.Device{UserID: "@alice:localhost", ID: "OTHER", AccessToken: "other_token"}
+	if code := send("1", body); code != http.StatusOK || len(eduAPI.sent) != 4 {
+		t.Errorf("transaction from another device got status %d and %d messages sent, want 200 and 4", code, len(eduAPI.sent))
+	}
+
+	// nothing is sent if any of the user IDs are bad
+	if code := send("2", `{"messages":{"@bob:localhost":{"BOB":{}},"bob":{"BOB":{}}}}`); code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid user ID, want 400", code)
+	}
+	if len(eduAPI.sent) != 4 {
+		t.Errorf("got %d messages sent after an invalid request, want 4", len(eduAPI.sent))
+	}
+}
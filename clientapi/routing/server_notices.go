@@ -0,0 +1,289 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// serverNoticeTag is the room tag which marks a room as the user's server
+// notices room.
+const serverNoticeTag = "m.server_notice"
+
+// serverNoticesAccountDataType is the type of the account data which marks
+// the account that sends server notices, so that an account which already
+// had the localpart isn't taken over.
+const serverNoticesAccountDataType = "org.matrix.dendrite.server_notices"
+
+// serverNoticesMutex stops concurrent notices from creating more than one
+// notices account, or more than one notices room for a user.
+var serverNoticesMutex sync.Mutex
+
+type sendServerNoticeRequest struct {
+	UserID   string          `json:"user_id"`
+	Type     string          `json:"type"`
+	StateKey *string         `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+}
+
+type sendServerNoticeResponse struct {
+	EventID string `json:"event_id"`
+}
+
+// SendServerNotice implements:
+//     POST /_dendrite/admin/send_server_notice
+// The notice is sent to the user's notices room, which is created the first
+// time that they are sent a notice. If they have left the room, they are
+// invited back to it.
+func SendServerNotice(
+	req *http.Request, cfg *config.Dendrite, accountDB accounts.Database,
+	userAPI api.UserInternalAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	ctx := req.Context()
+	if !cfg.Matrix.ServerNotices.Enabled {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Server notices are not enabled on this server"),
+		}
+	}
+	var body sendServerNoticeRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if body.Type == "" {
+		body.Type = "m.room.message"
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(body.Content, &content); err != nil || len(content) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("'content' must be a non-empty object"),
+		}
+	}
+	localpart, err := userutil.ParseUsernameParam(body.UserID, &cfg.Matrix.ServerName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	userID := userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+	if _, err = accountDB.GetAccountByLocalpart(ctx, localpart); err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist"),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+
+	evTime := time.Now()
+	serverNoticesMutex.Lock()
+	noticesDevice, err := serverNoticesDevice(ctx, cfg, accountDB)
+	if err != nil {
+		serverNoticesMutex.Unlock()
+		util.GetLogger(ctx).WithError(err).Error("serverNoticesDevice failed")
+		return jsonerror.InternalServerError()
+	}
+	roomID, resErr := serverNoticesRoom(req, cfg, noticesDevice, userID, evTime, accountDB, userAPI, rsAPI, stateAPI, asAPI, syncProducer)
+	serverNoticesMutex.Unlock()
+	if resErr != nil {
+		return *resErr
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   noticesDevice.UserID,
+		RoomID:   roomID,
+		Type:     body.Type,
+		StateKey: body.StateKey,
+	}
+	if err = builder.SetContent(content); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("builder.SetContent failed")
+		return jsonerror.InternalServerError()
+	}
+	event, err := eventutil.BuildEvent(ctx, &builder, cfg, evTime, rsAPI, nil)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("eventutil.BuildEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	if _, err = roomserverAPI.SendEvents(ctx, rsAPI, []gomatrixserverlib.HeaderedEvent{*event}, cfg.Matrix.ServerName, nil); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendServerNoticeResponse{EventID: event.EventID()},
+	}
+}
+
+// serverNoticesDevice returns a device for the user who sends server notices,
+// creating their account if it doesn't exist yet and keeping their profile
+// in line with the config. An account which wasn't created for sending
+// notices is never used, even if it has the localpart.
+func serverNoticesDevice(
+	ctx context.Context, cfg *config.Dendrite, accountDB accounts.Database,
+) (*api.Device, error) {
+	notices := &cfg.Matrix.ServerNotices
+	if _, err := accountDB.GetAccountByLocalpart(ctx, notices.Localpart); err == sql.ErrNoRows {
+		// The account is passwordless, so nobody can log in as it.
+		if _, err = accountDB.CreateAccount(ctx, notices.Localpart, "", ""); err != nil {
+			return nil, fmt.Errorf("accountDB.CreateAccount: %w", err)
+		}
+		if err = accountDB.SaveAccountData(ctx, notices.Localpart, "", serverNoticesAccountDataType, json.RawMessage(`{}`)); err != nil {
+			return nil, fmt.Errorf("accountDB.SaveAccountData: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("accountDB.GetAccountByLocalpart: %w", err)
+	} else {
+		data, err := accountDB.GetAccountDataByType(ctx, notices.Localpart, "", serverNoticesAccountDataType)
+		if err != nil {
+			return nil, fmt.Errorf("accountDB.GetAccountDataByType: %w", err)
+		}
+		if data == nil {
+			return nil, fmt.Errorf("the server notices localpart %q belongs to an account which wasn't created for server notices", notices.Localpart)
+		}
+	}
+	profile, err := accountDB.GetProfileByLocalpart(ctx, notices.Localpart)
+	if err != nil {
+		return nil, fmt.Errorf("accountDB.GetProfileByLocalpart: %w", err)
+	}
+	if profile.DisplayName != notices.DisplayName {
+		if err = accountDB.SetDisplayName(ctx, notices.Localpart, notices.DisplayName); err != nil {
+			return nil, fmt.Errorf("accountDB.SetDisplayName: %w", err)
+		}
+	}
+	if profile.AvatarURL != notices.AvatarURL {
+		if err = accountDB.SetAvatarURL(ctx, notices.Localpart, notices.AvatarURL); err != nil {
+			return nil, fmt.Errorf("accountDB.SetAvatarURL: %w", err)
+		}
+	}
+	return &api.Device{
+		UserID: userutil.MakeUserID(notices.Localpart, cfg.Matrix.ServerName),
+	}, nil
+}
+
+// serverNoticesRoom returns the user's notices room, which is a room that
+// the notices user is joined to and the user has been a member of. The user
+// is invited back to it if they've left, and if there isn't one, it is made.
+func serverNoticesRoom(
+	req *http.Request, cfg *config.Dendrite, noticesDevice *api.Device, userID string, evTime time.Time,
+	accountDB accounts.Database, userAPI api.UserInternalAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	stateAPI currentstateAPI.CurrentStateInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	syncProducer *producers.SyncAPIProducer,
+) (string, *util.JSONResponse) {
+	ctx := req.Context()
+	var noticesRes currentstateAPI.QueryRoomsForUserResponse
+	err := stateAPI.QueryRoomsForUser(ctx, &currentstateAPI.QueryRoomsForUserRequest{
+		UserID:         noticesDevice.UserID,
+		WantMembership: gomatrixserverlib.Join,
+	}, &noticesRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("stateAPI.QueryRoomsForUser failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	noticesRooms := make(map[string]bool, len(noticesRes.RoomIDs))
+	for _, roomID := range noticesRes.RoomIDs {
+		noticesRooms[roomID] = true
+	}
+	var userRes currentstateAPI.QueryRoomsForUserResponse
+	err = stateAPI.QueryRoomsForUser(ctx, &currentstateAPI.QueryRoomsForUserRequest{
+		UserID:          userID,
+		WantMembership:  gomatrixserverlib.Join,
+		WantMemberships: []string{gomatrixserverlib.Invite, gomatrixserverlib.Leave},
+	}, &userRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("stateAPI.QueryRoomsForUser failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	var leftRoomID string
+	for _, room := range userRes.Rooms {
+		if !noticesRooms[room.RoomID] {
+			continue
+		}
+		if room.Membership != gomatrixserverlib.Leave {
+			return room.RoomID, nil
+		}
+		leftRoomID = room.RoomID
+	}
+
+	if leftRoomID != "" {
+		var versionRes roomserverAPI.QueryRoomVersionForRoomResponse
+		err = rsAPI.QueryRoomVersionForRoom(ctx, &roomserverAPI.QueryRoomVersionForRoomRequest{
+			RoomID: leftRoomID,
+		}, &versionRes)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomVersionForRoom failed")
+			resErr := jsonerror.InternalServerError()
+			return "", &resErr
+		}
+		res := sendInvite(ctx, accountDB, noticesDevice, leftRoomID, userID, "", cfg, evTime, versionRes.RoomVersion, rsAPI, asAPI)
+		if res.Code != http.StatusOK {
+			return "", &res
+		}
+		return leftRoomID, nil
+	}
+
+	// Users can't send anything to their notices room, or invite anyone else
+	// to it.
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+	res := createRoom(ctx, createRoomRequest{
+		Invite:                    []string{userID},
+		Name:                      cfg.Matrix.ServerNotices.RoomName,
+		Preset:                    presetPrivateChat,
+		PowerLevelContentOverride: json.RawMessage(`{"users_default":-10}`),
+	}, noticesDevice, cfg, roomID, accountDB, rsAPI, asAPI, evTime)
+	if res.Code != http.StatusOK {
+		return "", &res
+	}
+	tags := gomatrix.TagContent{
+		Tags: map[string]gomatrix.TagProperties{serverNoticeTag: {}},
+	}
+	if err = saveTagData(req, userID, roomID, userAPI, tags); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("saveTagData failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if err = syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+		logrus.WithError(err).Error("Failed to send m.tag account data update to syncapi")
+	}
+	return roomID, nil
+}
@@ -0,0 +1,230 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama/mocks"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func TestServerNoticesDevice(t *testing.T) {
+	ctx := context.Background()
+	db, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.ServerNotices.Localpart = "_server"
+	cfg.Matrix.ServerNotices.DisplayName = "Server Alerts"
+
+	device, err := serverNoticesDevice(ctx, cfg, db)
+	if err != nil {
+		t.Fatalf("serverNoticesDevice failed: %s", err)
+	}
+	if device.UserID != "@_server:localhost" {
+		t.Fatalf("got notices user %q, want @_server:localhost", device.UserID)
+	}
+	profile, err := db.GetProfileByLocalpart(ctx, "_server")
+	if err != nil || profile.DisplayName != "Server Alerts" {
+		t.Fatalf("expected the notices account to be created with its display name, got %+v, %v", profile, err)
+	}
+
+	// The profile follows changes to the config.
+	cfg.Matrix.ServerNotices.DisplayName = "Notices"
+	cfg.Matrix.ServerNotices.AvatarURL = "mxc://localhost/avatar"
+	if _, err = serverNoticesDevice(ctx, cfg, db); err != nil {
+		t.Fatalf("serverNoticesDevice failed for an existing account: %s", err)
+	}
+	profile, err = db.GetProfileByLocalpart(ctx, "_server")
+	if err != nil || profile.DisplayName != "Notices" || profile.AvatarURL != "mxc://localhost/avatar" {
+		t.Fatalf("expected the notices profile to be updated, got %+v, %v", profile, err)
+	}
+}
+
+func TestServerNoticesDeviceRefusesExistingAccount(t *testing.T) {
+	ctx := context.Background()
+	db, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	if _, err = db.CreateAccount(ctx, "_server", "password", ""); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.ServerNotices.Localpart = "_server"
+	if _, err = serverNoticesDevice(ctx, cfg, db); err == nil {
+		t.Fatalf("expected an account which wasn't created for server notices not to be used")
+	}
+}
+
+// fakeServerNoticesRoomserverAPI only implements the APIs used to create
+// rooms and send events, recording the events which are sent.
+type fakeServerNoticesRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	events  []gomatrixserverlib.HeaderedEvent
+	invites []gomatrixserverlib.HeaderedEvent
+}
+
+func (r *fakeServerNoticesRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context, req *roomserverAPI.QueryRoomVersionForRoomRequest, res *roomserverAPI.QueryRoomVersionForRoomResponse,
+) error {
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	return nil
+}
+
+func (r *fakeServerNoticesRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *roomserverAPI.QueryLatestEventsAndStateRequest, res *roomserverAPI.QueryLatestEventsAndStateResponse,
+) error {
+	res.RoomExists = true
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	res.LatestEvents = []gomatrixserverlib.EventReference{{EventID: "$latest"}}
+	res.Depth = 10
+	return nil
+}
+
+func (r *fakeServerNoticesRoomserverAPI) InputRoomEvents(
+	ctx context.Context, req *roomserverAPI.InputRoomEventsRequest, res *roomserverAPI.InputRoomEventsResponse,
+) error {
+	for _, input := range req.InputRoomEvents {
+		r.events = append(r.events, input.Event)
+	}
+	return nil
+}
+
+func (r *fakeServerNoticesRoomserverAPI) PerformInvite(
+	ctx context.Context, req *roomserverAPI.PerformInviteRequest, res *roomserverAPI.PerformInviteResponse,
+) {
+	r.invites = append(r.invites, req.Event)
+}
+
+// fakeServerNoticesStateAPI returns the rooms which each user is in.
+type fakeServerNoticesStateAPI struct {
+	currentstateAPI.CurrentStateInternalAPI
+	rooms map[string][]currentstateAPI.RoomForUser
+}
+
+func (s *fakeServerNoticesStateAPI) QueryRoomsForUser(
+	ctx context.Context, req *currentstateAPI.QueryRoomsForUserRequest, res *currentstateAPI.QueryRoomsForUserResponse,
+) error {
+	for _, room := range s.rooms[req.UserID] {
+		res.RoomIDs = append(res.RoomIDs, room.RoomID)
+		res.Rooms = append(res.Rooms, room)
+	}
+	return nil
+}
+
+// fakeServerNoticesUserAPI records the account data which is set.
+type fakeServerNoticesUserAPI struct {
+	api.UserInternalAPI
+	accountData []api.InputAccountDataRequest
+}
+
+func (u *fakeServerNoticesUserAPI) InputAccountData(
+	ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse,
+) error {
+	u.accountData = append(u.accountData, *req)
+	return nil
+}
+
+func TestSendServerNotice(t *testing.T) {
+	ctx := context.Background()
+	db, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	if _, err = db.CreateAccount(ctx, "alice", "password", ""); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:auto"
+	cfg.Matrix.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	cfg.Matrix.ServerNotices.Enabled = true
+	cfg.Matrix.ServerNotices.Localpart = "_server"
+	cfg.Matrix.ServerNotices.RoomName = "Server Alert"
+
+	// The sync API is only told about the tag on a new notices room.
+	send := func(rsAPI *fakeServerNoticesRoomserverAPI, stateAPI *fakeServerNoticesStateAPI, userAPI *fakeServerNoticesUserAPI, tagged bool) util.JSONResponse {
+		producer := mocks.NewSyncProducer(t, nil)
+		if tagged {
+			producer.ExpectSendMessageAndSucceed()
+		}
+		defer producer.Close() // nolint: errcheck
+		body := `{"user_id":"@alice:localhost","content":{"msgtype":"m.text","body":"hello"}}`
+		req := httptest.NewRequest(http.MethodPost, "/_dendrite/admin/send_server_notice", strings.NewReader(body))
+		return SendServerNotice(req, cfg, db, userAPI, rsAPI, stateAPI, nil, &producers.SyncAPIProducer{Producer: producer})
+	}
+	eventTypes := func(events []gomatrixserverlib.HeaderedEvent) (types []string) {
+		for _, event := range events {
+			types = append(types, event.Type())
+		}
+		return
+	}
+
+	// The first notice creates the notices room, with the user invited to
+	// it and the room tagged for them.
+	rsAPI, userAPI := &fakeServerNoticesRoomserverAPI{}, &fakeServerNoticesUserAPI{}
+	res := send(rsAPI, &fakeServerNoticesStateAPI{}, userAPI, true)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d: %+v", res.Code, res.JSON)
+	}
+	if len(rsAPI.events) == 0 || rsAPI.events[0].Type() != gomatrixserverlib.MRoomCreate {
+		t.Fatalf("expected a notices room to be created, got events %v", eventTypes(rsAPI.events))
+	}
+	roomID := rsAPI.events[0].RoomID()
+	for _, event := range rsAPI.events {
+		if event.Sender() != "@_server:localhost" || event.RoomID() != roomID {
+			t.Fatalf("got event %s from %s in %s, want all from @_server:localhost in %s", event.Type(), event.Sender(), event.RoomID(), roomID)
+		}
+	}
+	if notice := rsAPI.events[len(rsAPI.events)-1]; notice.Type() != "m.room.message" {
+		t.Fatalf("expected the notice to be sent last, got events %v", eventTypes(rsAPI.events))
+	}
+	if len(rsAPI.invites) != 1 || *rsAPI.invites[0].StateKey() != "@alice:localhost" || rsAPI.invites[0].RoomID() != roomID {
+		t.Fatalf("expected @alice:localhost to be invited to %s, got %v", roomID, rsAPI.invites)
+	}
+	if len(userAPI.accountData) != 1 || userAPI.accountData[0].RoomID != roomID || !strings.Contains(string(userAPI.accountData[0].AccountData), serverNoticeTag) {
+		t.Fatalf("expected the notices room to be tagged, got %+v", userAPI.accountData)
+	}
+
+	// Users who have left their notices room are invited back to it, rather
+	// than a new one being created.
+	stateAPI := &fakeServerNoticesStateAPI{rooms: map[string][]currentstateAPI.RoomForUser{
+		"@_server:localhost": {{RoomID: "!other:localhost", Membership: gomatrixserverlib.Join}, {RoomID: roomID, Membership: gomatrixserverlib.Join}},
+		"@alice:localhost":   {{RoomID: "!elsewhere:localhost", Membership: gomatrixserverlib.Leave}, {RoomID: roomID, Membership: gomatrixserverlib.Leave}},
+	}}
+	rsAPI, userAPI = &fakeServerNoticesRoomserverAPI{}, &fakeServerNoticesUserAPI{}
+	if res = send(rsAPI, stateAPI, userAPI, false); res.Code != http.StatusOK {
+		t.Fatalf("got status %d: %+v", res.Code, res.JSON)
+	}
+	if len(rsAPI.invites) != 1 || *rsAPI.invites[0].StateKey() != "@alice:localhost" || rsAPI.invites[0].RoomID() != roomID {
+		t.Fatalf("expected @alice:localhost to be invited back to %s, got %v", roomID, rsAPI.invites)
+	}
+	if len(rsAPI.events) != 1 || rsAPI.events[0].Type() != "m.room.message" || rsAPI.events[0].RoomID() != roomID {
+		t.Fatalf("expected only the notice to be sent to %s, got events %v", roomID, eventTypes(rsAPI.events))
+	}
+
+	// Users who are still in their notices room are sent the notice there.
+	stateAPI.rooms["@alice:localhost"][1].Membership = gomatrixserverlib.Join
+	rsAPI = &fakeServerNoticesRoomserverAPI{}
+	if res = send(rsAPI, stateAPI, userAPI, false); res.Code != http.StatusOK {
+		t.Fatalf("got status %d: %+v", res.Code, res.JSON)
+	}
+	if len(rsAPI.invites) != 0 || len(rsAPI.events) != 1 || rsAPI.events[0].RoomID() != roomID {
+		t.Fatalf("expected only the notice to be sent to %s, got events %v and invites %v", roomID, eventTypes(rsAPI.events), rsAPI.invites)
+	}
+}
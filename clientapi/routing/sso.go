@@ -0,0 +1,351 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/sso"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+// ssoSessionCookie holds the ID of the user's SSO session while they are at
+// the identity provider, so that a callback can't be completed in a
+// different browser to the one that the login was started in.
+const ssoSessionCookie = "dendrite_sso_session"
+
+// ssoConfirmTemplate asks users to confirm that they trust the client which
+// asked them to log in, before sending them to it with a login token. This
+// stops a link crafted by someone else from getting them a login token.
+const ssoConfirmTemplate = `
+<html>
+<head>
+<title>Continue to your client</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>You have logged in, and are about to be sent to <strong>{{.host}}</strong>
+        which will have access to your account.</p>
+        <p>If you didn't start logging in to {{.host}} yourself, close this window.</p>
+        <p><a href="{{.redirectUrl}}">Continue to {{.host}}</a></p>
+    </div>
+</body>
+</html>
+`
+
+// SSORedirect implements:
+//     GET /login/sso/redirect
+//     GET /login/sso/redirect/{idpID}
+//     GET /login/cas/redirect
+// Without an identity provider ID, the first configured one is used.
+func SSORedirect(
+	w http.ResponseWriter, req *http.Request, providers []sso.IdentityProvider,
+	sessions *sso.Sessions, idpID string, cfg *config.Dendrite,
+) *util.JSONResponse {
+	provider := findIdentityProvider(providers, idpID)
+	if provider == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("unknown identity provider"),
+		}
+	}
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if u, err := url.Parse(redirectURL); err != nil || u.Scheme == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'redirectUrl' must be a URL"),
+		}
+	} else if !ssoRedirectSchemeAllowed(u.Scheme, cfg.Matrix.SSO.ClientRedirectSchemes) {
+		// Schemes such as javascript: would run in the context of the
+		// confirmation page rather than sending the user to a client.
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("'redirectUrl' has a scheme which clients can't be sent to"),
+		}
+	}
+	sessionID, err := sessions.Create(provider.ID(), redirectURL)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("sessions.Create failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	authURL, err := provider.AuthorizationURL(req.Context(), ssoCallbackURL(cfg, provider), sessionID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.AuthorizationURL failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	// Some identity providers send users back with a cross-site POST, which
+	// browsers only send the cookie with if it is SameSite=None. That needs
+	// the cookie to be secure though.
+	secure := strings.HasPrefix(cfg.Matrix.SSO.PublicBaseURL, "https://")
+	sameSite := http.SameSiteLaxMode
+	if secure {
+		sameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoSessionCookie,
+		Value:    sessionID,
+		Path:     sso.CallbackPath,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: sameSite,
+	})
+	http.Redirect(w, req, authURL, http.StatusFound)
+	return nil
+}
+
+// SSOCallback implements:
+//     GET /login/sso/callback/{idpID}
+//     POST /login/sso/callback/{idpID}
+// Once the identity provider says who the user is, they are sent back to the
+// client with a login token, which the client logs in with using
+// m.login.token.
+func SSOCallback(
+	w http.ResponseWriter, req *http.Request, providers []sso.IdentityProvider,
+	sessions *sso.Sessions, idpID string, accountDB accounts.Database,
+	userAPI userapi.UserInternalAPI, stateAPI currentstateAPI.CurrentStateInternalAPI, cfg *config.Dendrite,
+) *util.JSONResponse {
+	ctx := req.Context()
+	provider := findIdentityProvider(providers, idpID)
+	if provider == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("unknown identity provider"),
+		}
+	}
+	state, user, err := provider.ProcessCallback(ctx, req, ssoCallbackURL(cfg, provider))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("idp_id", idpID).Warn("SSO login failed")
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Unknown("logging in with the identity provider failed: " + err.Error()),
+		}
+	}
+	cookie, err := req.Cookie(ssoSessionCookie)
+	if err != nil || cookie.Value != state {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("the login wasn't started in this browser"),
+		}
+	}
+	session := sessions.Claim(state)
+	if session == nil || session.IdentityProviderID != idpID {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("the login has expired, please try again"),
+		}
+	}
+
+	localpart, resErr := ssoLocalpart(req, accountDB, stateAPI, idpID, user, cfg)
+	if resErr != nil {
+		return resErr
+	}
+	var res userapi.PerformLoginTokenCreationResponse
+	err = userAPI.PerformLoginTokenCreation(ctx, &userapi.PerformLoginTokenCreationRequest{
+		UserID: userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+	}, &res)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformLoginTokenCreation failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	// The redirect URL was checked when the session was created.
+	redirectURL, _ := url.Parse(session.RedirectURL)
+	query := redirectURL.Query()
+	query.Set("loginToken", res.Token)
+	redirectURL.RawQuery = query.Encode()
+	http.SetCookie(w, &http.Cookie{
+		Name:   ssoSessionCookie,
+		Path:   sso.CallbackPath,
+		MaxAge: -1,
+	})
+	if !ssoRedirectAllowed(redirectURL, cfg.Matrix.SSO.ClientRedirectURLs) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// The scheme was checked when the session was created, so the URL
+		// can be linked to even if it is a custom scheme of a mobile app,
+		// which the template would otherwise refuse.
+		t := template.Must(template.New("confirm").Parse(ssoConfirmTemplate))
+		if err = t.Execute(w, map[string]interface{}{
+			"host":        redirectURL.Host,
+			"redirectUrl": template.URL(redirectURL.String()),
+		}); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to write the confirmation page")
+		}
+		return nil
+	}
+	http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+	return nil
+}
+
+// ssoRedirectSchemeAllowed returns whether clients can ask for users to be
+// sent back to URLs with the given scheme.
+func ssoRedirectSchemeAllowed(scheme string, allowedSchemes []string) bool {
+	if strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https") {
+		return true
+	}
+	for _, allowed := range allowedSchemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ssoRedirectAllowed returns whether users can be sent straight back to the
+// redirect URL, rather than having to confirm that they trust the client.
+// The path has to be the allowed URL's path or below it, so that allowing
+// /app doesn't also allow /app-evil.
+func ssoRedirectAllowed(redirectURL *url.URL, allowedURLs []string) bool {
+	for _, allowed := range allowedURLs {
+		u, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+		if !strings.EqualFold(u.Scheme, redirectURL.Scheme) || !strings.EqualFold(u.Host, redirectURL.Host) {
+			continue
+		}
+		prefix := u.Path
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if redirectURL.Path == u.Path || strings.HasPrefix(redirectURL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SSOMetadata implements:
+//     GET /login/sso/metadata/{idpID}
+// for identity providers which need metadata about the server.
+func SSOMetadata(
+	w http.ResponseWriter, req *http.Request, providers []sso.IdentityProvider, idpID string, cfg *config.Dendrite,
+) *util.JSONResponse {
+	provider, ok := findIdentityProvider(providers, idpID).(sso.MetadataProvider)
+	if !ok {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("unknown identity provider"),
+		}
+	}
+	metadata, err := provider.Metadata(ssoCallbackURL(cfg, provider))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.Metadata failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(metadata)
+	return nil
+}
+
+// ssoLocalpart returns the localpart of the account which the user of the
+// identity provider logs in as, creating the account if this is their first
+// login and accounts are provisioned automatically.
+func ssoLocalpart(
+	req *http.Request, accountDB accounts.Database, stateAPI currentstateAPI.CurrentStateInternalAPI,
+	idpID string, user *sso.UserInfo, cfg *config.Dendrite,
+) (string, *util.JSONResponse) {
+	ctx := req.Context()
+	localpart, err := accountDB.GetLocalpartForSSOIdentity(ctx, idpID, user.Subject)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForSSOIdentity failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if localpart != "" {
+		acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+			resErr := jsonerror.InternalServerError()
+			return "", &resErr
+		}
+		if acc.Deactivated {
+			return "", &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("the account has been deactivated"),
+			}
+		}
+		return localpart, nil
+	}
+
+	if !cfg.Matrix.SSO.AutoProvisionAccounts {
+		return "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("there is no account for this user on this server"),
+		}
+	}
+	localpart = sso.MapLocalpart(user.Localpart)
+	if resErr := validateUsername(localpart); resErr != nil {
+		return "", resErr
+	}
+	if resErr := validateReservedUsername(localpart, cfg); resErr != nil {
+		return "", resErr
+	}
+	if UsernameMatchesExclusiveNamespaces(cfg, localpart) {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.ASExclusive("the user ID is reserved by an application service"),
+		}
+	}
+	if _, err = accountDB.CreateSSOAccount(ctx, idpID, user.Subject, localpart); err != nil {
+		if err == sqlutil.ErrUserExists {
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.UserInUse("the user ID " + userutil.MakeUserID(localpart, cfg.Matrix.ServerName) + " is already taken"),
+			}
+		}
+		util.GetLogger(ctx).WithError(err).Error("accountDB.CreateSSOAccount failed")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	if user.DisplayName != "" {
+		if err = accountDB.SetDisplayName(ctx, localpart, user.DisplayName); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.SetDisplayName failed")
+		}
+	}
+	userID := userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+	if err = updateUserDirectory(ctx, accountDB, stateAPI, userID, localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("updateUserDirectory failed")
+	}
+	return localpart, nil
+}
+
+func findIdentityProvider(providers []sso.IdentityProvider, idpID string) sso.IdentityProvider {
+	for _, provider := range providers {
+		if idpID == "" || provider.ID() == idpID {
+			return provider
+		}
+	}
+	return nil
+}
+
+func ssoCallbackURL(cfg *config.Dendrite, provider sso.IdentityProvider) string {
+	return strings.TrimSuffix(cfg.Matrix.SSO.PublicBaseURL, "/") + sso.CallbackPath + url.PathEscape(provider.ID())
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/sso"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+)
+
+// fakeIdentityProvider logs everyone in as the same user, passing the state
+// straight through to the callback.
+type fakeIdentityProvider struct{}
+
+func (p *fakeIdentityProvider) ID() string   { return "fake" }
+func (p *fakeIdentityProvider) Name() string { return "Fake" }
+
+func (p *fakeIdentityProvider) AuthorizationURL(ctx context.Context, callbackURL, state string) (string, error) {
+	return "https://idp.example.com/auth?state=" + url.QueryEscape(state), nil
+}
+
+func (p *fakeIdentityProvider) ProcessCallback(ctx context.Context, req *http.Request, callbackURL string) (string, *sso.UserInfo, error) {
+	return req.URL.Query().Get("state"), &sso.UserInfo{Subject: "alice", Localpart: "alice"}, nil
+}
+
+func TestSSOClientRedirect(t *testing.T) {
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create devices database: %s", err)
+	}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, "localhost", nil, nil, nil)
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.SSO.PublicBaseURL = "https://matrix.example.com"
+	cfg.Matrix.SSO.ClientRedirectURLs = []string{"https://app.example.com/client"}
+	cfg.Matrix.SSO.ClientRedirectSchemes = []string{"com.example.app"}
+	if _, err = accountDB.CreateSSOAccount(context.Background(), "fake", "alice", "alice"); err != nil {
+		t.Fatalf("failed to create the SSO account: %s", err)
+	}
+	providers := []sso.IdentityProvider{&fakeIdentityProvider{}}
+	sessions := sso.NewSessions()
+
+	// login logs in through the fake identity provider, and returns the
+	// response to the callback.
+	login := func(redirectURL string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/login/sso/redirect?redirectUrl="+url.QueryEscape(redirectURL), nil)
+		w := httptest.NewRecorder()
+		if res := SSORedirect(w, req, providers, sessions, "", cfg); res != nil {
+			t.Fatalf("got status %d starting the login", res.Code)
+		}
+		authURL, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("failed to parse the authorization URL: %s", err)
+		}
+		req = httptest.NewRequest(http.MethodGet, sso.CallbackPath+"fake?state="+url.QueryEscape(authURL.Query().Get("state")), nil)
+		for _, cookie := range w.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		if res := SSOCallback(w, req, providers, sessions, "fake", accountDB, userAPI, nil, cfg); res != nil {
+			t.Fatalf("got status %d completing the login", res.Code)
+		}
+		return w
+	}
+
+	// Allowed clients get the login token straight away.
+	for _, redirectURL := range []string{
+		"https://app.example.com/client",
+		"https://app.example.com/client/#/home",
+	} {
+		w := login(redirectURL)
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || w.Code != http.StatusFound || location.Host != "app.example.com" || location.Query().Get("loginToken") == "" {
+			t.Fatalf("got status %d redirecting to %q, want a login token for the allowed client %s", w.Code, w.Header().Get("Location"), redirectURL)
+		}
+	}
+
+	// Users have to confirm any other client, which is named on the page.
+	for _, redirectURL := range []string{
+		"https://evil.example.com/client",
+		"https://app.example.com.evil.example.com/client",
+		"https://app.example.com/other",
+		"https://app.example.com/client-evil",
+		"https://app.example.com/clientfoo",
+		"http://app.example.com/client",
+		"com.example.app://app.example.com/client",
+	} {
+		w := login(redirectURL)
+		if w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+			t.Fatalf("got status %d redirecting to %q, want a confirmation page for %s", w.Code, w.Header().Get("Location"), redirectURL)
+		}
+		host, _ := url.Parse(redirectURL)
+		if body := w.Body.String(); !strings.Contains(body, "<strong>"+host.Host+"</strong>") || !strings.Contains(body, "loginToken=") {
+			t.Fatalf("expected the confirmation page to name %s and link to it, got %s", host.Host, body)
+		}
+	}
+}
+
+func TestSSOLocalpartReserved(t *testing.T) {
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.SSO.AutoProvisionAccounts = true
+	cfg.Matrix.ServerNotices.Localpart = "notices"
+	if err = cfg.Derive(); err != nil {
+		t.Fatalf("failed to derive config: %s", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, sso.CallbackPath+"fake", nil)
+
+	for _, name := range []string{"42", "Notices"} {
+		user := &sso.UserInfo{Subject: name, Localpart: name}
+		if _, res := ssoLocalpart(req, accountDB, nil, "fake", user, cfg); res == nil || res.Code != http.StatusBadRequest {
+			t.Errorf("got %+v provisioning an account for %q, want it to be refused", res, name)
+		}
+	}
+	// The numeric localparts are still free for the server to hand out.
+	id, err := accountDB.GetNewNumericLocalpart(context.Background())
+	if err != nil {
+		t.Fatalf("GetNewNumericLocalpart failed: %s", err)
+	}
+	if available, err := accountDB.CheckAccountAvailability(context.Background(), strconv.FormatInt(id, 10)); err != nil || !available {
+		t.Errorf("numeric localpart %d was taken by an SSO account", id)
+	}
+
+	user := &sso.UserInfo{Subject: "carol", Localpart: "Carol"}
+	if localpart, res := ssoLocalpart(req, accountDB, nil, "fake", user, cfg); res != nil || localpart != "carol" {
+		t.Errorf("got %q, %+v provisioning an account for Carol, want carol", localpart, res)
+	}
+}
+
+func TestSSORedirectSchemes(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.SSO.PublicBaseURL = "https://matrix.example.com"
+	cfg.Matrix.SSO.ClientRedirectSchemes = []string{"com.example.app"}
+	providers := []sso.IdentityProvider{&fakeIdentityProvider{}}
+	sessions := sso.NewSessions()
+
+	tests := []struct {
+		redirectURL string
+		wantCode    int
+	}{
+		{"https://app.example.com/", http.StatusFound},
+		{"HTTP://app.example.com/", http.StatusFound},
+		{"com.example.app://callback", http.StatusFound},
+		{"com.example.other://callback", http.StatusBadRequest},
+		{"javascript:alert(1)", http.StatusBadRequest},
+		{"data:text/html,<script>alert(1)</script>", http.StatusBadRequest},
+		{"/relative", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/login/sso/redirect?redirectUrl="+url.QueryEscape(tt.redirectURL), nil)
+		w := httptest.NewRecorder()
+		code := http.StatusFound
+		if res := SSORedirect(w, req, providers, sessions, "", cfg); res != nil {
+			code = res.Code
+		}
+		if code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.redirectURL, code, tt.wantCode)
+		}
+	}
+}
@@ -15,8 +15,12 @@
 package routing
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"net/mail"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -31,6 +35,28 @@ import (
 
 type reqTokenResponse struct {
 	SID string `json:"sid"`
+	// The URL to submit the validation token to, if the server sent it
+	// itself rather than an identity server.
+	SubmitURL string `json:"submit_url,omitempty"`
+}
+
+type submitTokenRequest struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
+type submitTokenResponse struct {
+	Success bool `json:"success"`
+}
+
+type add3PIDRequest struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+}
+
+type forget3PIDResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
 }
 
 type threePIDsResponse struct {
@@ -40,11 +66,23 @@ type threePIDsResponse struct {
 // RequestEmailToken implements:
 //     POST /account/3pid/email/requestToken
 //     POST /register/email/requestToken
-func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *config.Dendrite) util.JSONResponse {
+func RequestEmailToken(
+	req *http.Request, accountDB accounts.Database, emailValidator *threepid.EmailValidator,
+	rateLimits *rateLimits, cfg *config.Dendrite,
+) util.JSONResponse {
 	var body threepid.EmailAssociationRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
+	if !threepid.ValidClientSecret(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("client_secret is invalid"),
+		}
+	}
+	if r := rateLimits.checkEmailAddress(body.Email); r != nil {
+		return *r
+	}
 
 	var resp reqTokenResponse
 	var err error
@@ -66,6 +104,30 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 		}
 	}
 
+	if emailValidator != nil {
+		if _, err = mail.ParseAddress(body.Email); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("email is not a valid email address"),
+			}
+		}
+		resp.SID, err = emailValidator.CreateSession(req.Context(), body)
+		if err == threepid.ErrTooManySends {
+			return util.JSONResponse{
+				Code: http.StatusTooManyRequests,
+				JSON: jsonerror.LimitExceeded(err.Error(), 0),
+			}
+		} else if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("emailValidator.CreateSession failed")
+			return jsonerror.InternalServerError()
+		}
+		resp.SubmitURL = emailValidator.SubmitURL()
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: resp,
+		}
+	}
+
 	resp.SID, err = threepid.CreateSession(req.Context(), body, cfg)
 	if err == threepid.ErrNotTrusted {
 		return util.JSONResponse{
@@ -83,16 +145,62 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 	}
 }
 
+// SubmitEmailToken implements:
+//     GET /account/3pid/email/submitToken
+//     POST /account/3pid/email/submitToken
+// The GET form is the link in validation emails.
+func SubmitEmailToken(req *http.Request, emailValidator *threepid.EmailValidator) util.JSONResponse {
+	if emailValidator == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Email addresses are validated by identity servers"),
+		}
+	}
+
+	var body submitTokenRequest
+	if req.Method == http.MethodGet {
+		query := req.URL.Query()
+		body.SID, body.ClientSecret, body.Token = query.Get("sid"), query.Get("client_secret"), query.Get("token")
+	} else if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+
+	err := emailValidator.SubmitToken(req.Context(), body.SID, body.ClientSecret, body.Token)
+	if err == threepid.ErrInvalidToken {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     err.Error(),
+			},
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("emailValidator.SubmitToken failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: submitTokenResponse{Success: true},
+	}
+}
+
 // CheckAndSave3PIDAssociation implements POST /account/3pid
 func CheckAndSave3PIDAssociation(
-	req *http.Request, accountDB accounts.Database, device *api.Device,
-	cfg *config.Dendrite,
+	req *http.Request, accountDB accounts.Database, emailValidator *threepid.EmailValidator,
+	device *api.Device, cfg *config.Dendrite,
 ) util.JSONResponse {
 	var body threepid.EmailAssociationCheckRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
+	// Sessions which the server validated itself can't be bound on an
+	// identity server, since the identity server doesn't know about them.
+	if emailValidator != nil {
+		return save3PIDFromSession(req, accountDB, emailValidator, device, body.Creds.SID, body.Creds.Secret)
+	}
+
 	// Check if the association has been validated
 	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg)
 	if err == threepid.ErrNotTrusted {
@@ -136,7 +244,112 @@ func CheckAndSave3PIDAssociation(
 		return jsonerror.InternalServerError()
 	}
 
-	if err = accountDB.SaveThreePIDAssociation(req.Context(), address, localpart, medium); err != nil {
+	return save3PID(req, accountDB, localpart, address, medium)
+}
+
+// Add3PID implements POST /account/3pid/add
+func Add3PID(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, accountDB accounts.Database,
+	emailValidator *threepid.EmailValidator, device *api.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	// make sure that the access token being used matches the login creds used for user interactive auth.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot add a third-party identifier to another user's account"),
+		}
+	}
+
+	var body add3PIDRequest
+	if err = json.Unmarshal(bodyBytes, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if emailValidator == nil {
+		// Without an identity server to ask, there is no way to tell whether
+		// the session was validated.
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Email addresses are validated by identity servers, use POST /account/3pid instead"),
+		}
+	}
+	return save3PIDFromSession(req, accountDB, emailValidator, device, body.SID, body.ClientSecret)
+}
+
+// save3PIDFromSession associates the third-party identifier which a session
+// validated with the user's account, and then removes the session.
+func save3PIDFromSession(
+	req *http.Request, accountDB accounts.Database, emailValidator *threepid.EmailValidator,
+	device *api.Device, sessionID, clientSecret string,
+) util.JSONResponse {
+	verified, address, medium, err := emailValidator.CheckAssociation(req.Context(), sessionID, clientSecret)
+	if err == threepid.ErrSessionNotFound {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     err.Error(),
+			},
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("emailValidator.CheckAssociation failed")
+		return jsonerror.InternalServerError()
+	}
+	if !verified {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "Failed to auth 3pid",
+			},
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	res := save3PID(req, accountDB, localpart, address, medium)
+	if res.Code == http.StatusOK {
+		if _, err = emailValidator.RemoveSession(req.Context(), sessionID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("emailValidator.RemoveSession failed")
+		}
+	}
+	return res
+}
+
+func save3PID(req *http.Request, accountDB accounts.Database, localpart, address, medium string) util.JSONResponse {
+	err := accountDB.SaveThreePIDAssociation(req.Context(), address, localpart, medium)
+	if err == accounts.Err3PIDInUse {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     err.Error(),
+			},
+		}
+	} else if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountsDB.SaveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
 	}
@@ -170,19 +383,36 @@ func GetAssociated3PIDs(
 }
 
 // Forget3PID implements POST /account/3pid/delete
-func Forget3PID(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+func Forget3PID(req *http.Request, accountDB accounts.Database, device *api.Device) util.JSONResponse {
 	var body authtypes.ThreePID
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
-	if err := accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
+	// Users can only remove the third-party identifiers of their own account.
+	owner, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Address, body.Medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if owner == localpart {
+		if err = accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: forget3PIDResponse{
+			// Associations aren't unbound from identity servers.
+			IDServerUnbindResult: "no-support",
+		},
 	}
 }
@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type upgradeRoomRequest struct {
+	NewVersion gomatrixserverlib.RoomVersion `json:"new_version"`
+}
+
+type upgradeRoomResponse struct {
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// UpgradeRoom implements:
+//     POST /rooms/{roomID}/upgrade
+func UpgradeRoom(
+	req *http.Request, device *api.Device,
+	cfg *config.Dendrite, roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var r upgradeRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if _, err := roomserverVersion.SupportedRoomVersion(r.NewVersion); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+	// Upgrading a room creates a new one.
+	if !cfg.Matrix.RoomCreation.MayCreateRoom(device.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to create rooms on this server"),
+		}
+	}
+
+	var res roomserverAPI.PerformRoomUpgradeResponse
+	rsAPI.PerformRoomUpgrade(req.Context(), &roomserverAPI.PerformRoomUpgradeRequest{
+		RoomID:      roomID,
+		UserID:      device.UserID,
+		RoomVersion: r.NewVersion,
+	}, &res)
+	if res.Error != nil {
+		return res.Error.JSONResponse()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: upgradeRoomResponse{
+			ReplacementRoom: res.NewRoomID,
+		},
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultUserDirectoryLimit = 10
+	maxUserDirectoryLimit     = 50
+)
+
+type userDirectorySearchRequest struct {
+	SearchTerm string `json:"search_term"`
+	Limit      int    `json:"limit"`
+}
+
+type userDirectoryResult struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type userDirectorySearchResponse struct {
+	Results []userDirectoryResult `json:"results"`
+	Limited bool                  `json:"limited"`
+}
+
+// SearchUserDirectory implements:
+//     POST /user_directory/search
+// Users are only found if they share a room with the searcher, or are joined
+// to a public room.
+func SearchUserDirectory(
+	req *http.Request, device *userapi.Device,
+	stateAPI currentstateAPI.CurrentStateInternalAPI,
+) util.JSONResponse {
+	var body userDirectorySearchRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if body.SearchTerm == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'search_term' must be supplied."),
+		}
+	}
+	limit := body.Limit
+	if limit <= 0 {
+		limit = defaultUserDirectoryLimit
+	} else if limit > maxUserDirectoryLimit {
+		limit = maxUserDirectoryLimit
+	}
+
+	var res currentstateAPI.QuerySearchUserDirectoryResponse
+	err := stateAPI.QuerySearchUserDirectory(req.Context(), &currentstateAPI.QuerySearchUserDirectoryRequest{
+		UserID:       device.UserID,
+		SearchString: body.SearchTerm,
+		Limit:        limit,
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("stateAPI.QuerySearchUserDirectory failed")
+		return jsonerror.InternalServerError()
+	}
+
+	response := userDirectorySearchResponse{
+		Results: make([]userDirectoryResult, 0, len(res.Users)),
+		Limited: res.Limited,
+	}
+	for _, user := range res.Users {
+		response.Results = append(response.Results, userDirectoryResult{
+			UserID:      user.UserID,
+			DisplayName: user.DisplayName,
+			AvatarURL:   user.AvatarURL,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: response,
+	}
+}
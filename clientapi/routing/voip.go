@@ -29,21 +29,34 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// defaultTurnUserLifetime is how long TURN credentials last for if the
+// config doesn't say.
+const defaultTurnUserLifetime = time.Hour
+
 // RequestTurnServer implements:
 //     GET /voip/turnServer
 func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.Dendrite) util.JSONResponse {
 	turnConfig := cfg.TURN
 
-	// TODO Guest Support
-	if len(turnConfig.URIs) == 0 || turnConfig.UserLifetime == "" {
+	if device.IsGuest && !turnConfig.AllowGuests {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests aren't allowed to use the TURN server"),
+		}
+	}
+
+	if len(turnConfig.URIs) == 0 {
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: struct{}{},
 		}
 	}
 
-	// Duration checked at startup, err not possible
-	duration, _ := time.ParseDuration(turnConfig.UserLifetime)
+	duration := defaultTurnUserLifetime
+	if turnConfig.UserLifetime != "" {
+		// Duration checked at startup, err not possible
+		duration, _ = time.ParseDuration(turnConfig.UserLifetime)
+	}
 
 	resp := gomatrix.RespTurnServer{
 		URIs: turnConfig.URIs,
@@ -51,17 +64,13 @@ func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.Dendri
 	}
 
 	if turnConfig.SharedSecret != "" {
-		expiry := time.Now().Add(duration).Unix()
-		mac := hmac.New(sha1.New, []byte(turnConfig.SharedSecret))
-		_, err := mac.Write([]byte(resp.Username))
-
+		var err error
+		expiry := time.Now().Add(duration)
+		resp.Username, resp.Password, err = ephemeralTurnCredentials(turnConfig.SharedSecret, device.UserID, expiry)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("mac.Write failed")
+			util.GetLogger(req.Context()).WithError(err).Error("ephemeralTurnCredentials failed")
 			return jsonerror.InternalServerError()
 		}
-
-		resp.Username = fmt.Sprintf("%d:%s", expiry, device.UserID)
-		resp.Password = base64.StdEncoding.EncodeToString(mac.Sum(nil))
 	} else if turnConfig.Username != "" && turnConfig.Password != "" {
 		resp.Username = turnConfig.Username
 		resp.Password = turnConfig.Password
@@ -77,3 +86,16 @@ func RequestTurnServer(req *http.Request, device *api.Device, cfg *config.Dendri
 		JSON: resp,
 	}
 }
+
+// ephemeralTurnCredentials generates credentials which the TURN server
+// accepts until they expire, as described by the TURN REST API that coturn
+// implements: the username is the expiry time and the user ID, and the
+// password is the HMAC-SHA1 of the username keyed with the shared secret.
+func ephemeralTurnCredentials(sharedSecret, userID string, expiry time.Time) (username, password string, err error) {
+	username = fmt.Sprintf("%d:%s", expiry.Unix(), userID)
+	mac := hmac.New(sha1.New, []byte(sharedSecret))
+	if _, err = mac.Write([]byte(username)); err != nil {
+		return "", "", err
+	}
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
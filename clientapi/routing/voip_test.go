@@ -0,0 +1,84 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrix"
+)
+
+func TestRequestTurnServerSharedSecret(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.TURN.URIs = []string{"turn:turn.localhost:3478?transport=udp"}
+	cfg.TURN.SharedSecret = "secret"
+	cfg.TURN.UserLifetime = "10m"
+	device := &api.Device{UserID: "@alice:localhost"}
+
+	before := time.Now()
+	res := RequestTurnServer(httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/voip/turnServer", nil), device, cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.Code, http.StatusOK)
+	}
+	turn, ok := res.JSON.(gomatrix.RespTurnServer)
+	if !ok {
+		t.Fatalf("got %+v, want TURN credentials", res.JSON)
+	}
+	if turn.TTL != 600 || len(turn.URIs) != 1 {
+		t.Errorf("got TTL %d and URIs %v, want 600 and the configured URI", turn.TTL, turn.URIs)
+	}
+	var expiry int64
+	if _, err := fmt.Sscanf(turn.Username, "%d:@alice:localhost", &expiry); err != nil {
+		t.Fatalf("got username %q, want the expiry time and user ID", turn.Username)
+	}
+	if want := before.Add(10 * time.Minute).Unix(); expiry < want || expiry > want+1 {
+		t.Errorf("got expiry %d, want %d", expiry, want)
+	}
+	mac := hmac.New(sha1.New, []byte("secret"))
+	_, _ = mac.Write([]byte(turn.Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); turn.Password != want {
+		t.Errorf("got password %q, want %q", turn.Password, want)
+	}
+}
+
+func TestRequestTurnServerGuests(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.TURN.URIs = []string{"turn:turn.localhost:3478?transport=udp"}
+	cfg.TURN.SharedSecret = "secret"
+	guest := &api.Device{UserID: "@1:localhost", IsGuest: true}
+
+	res := RequestTurnServer(httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/voip/turnServer", nil), guest, cfg)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("got status %d for a guest without turn_allow_guests, want %d", res.Code, http.StatusForbidden)
+	}
+
+	cfg.TURN.AllowGuests = true
+	res = RequestTurnServer(httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/voip/turnServer", nil), guest, cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d for a guest with turn_allow_guests, want %d", res.Code, http.StatusOK)
+	}
+	if turn, ok := res.JSON.(gomatrix.RespTurnServer); !ok || turn.Username == "" {
+		t.Fatalf("got %+v, want TURN credentials for the guest", res.JSON)
+	}
+}
@@ -15,20 +15,31 @@ package routing
 import (
 	"net/http"
 
+	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
 )
 
 // whoamiResponse represents an response for a `whoami` request
 type whoamiResponse struct {
-	UserID string `json:"user_id"`
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id,omitempty"`
+	IsGuest  bool   `json:"is_guest"`
 }
 
 // Whoami implements `/account/whoami` which enables client to query their account user id.
 // https://matrix.org/docs/spec/client_server/r0.3.0.html#get-matrix-client-r0-account-whoami
 func Whoami(req *http.Request, device *api.Device) util.JSONResponse {
+	res := whoamiResponse{
+		UserID:  device.UserID,
+		IsGuest: device.IsGuest,
+	}
+	// Application services don't have a real device.
+	if device.ID != types.AppServiceDeviceID {
+		res.DeviceID = device.ID
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: whoamiResponse{UserID: device.UserID},
+		JSON: res,
 	}
 }
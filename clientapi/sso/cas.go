@@ -0,0 +1,140 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// casProvider logs users in with a CAS server, validating the service tickets
+// which it sends users back with.
+// https://apereo.github.io/cas/6.1.x/protocol/CAS-Protocol-Specification.html
+type casProvider struct {
+	cfg    *config.CASProvider
+	client *http.Client
+}
+
+func newCASProvider(cfg *config.CASProvider, client *http.Client) *casProvider {
+	return &casProvider{
+		cfg:    cfg,
+		client: client,
+	}
+}
+
+func (p *casProvider) ID() string {
+	return p.cfg.ID
+}
+
+func (p *casProvider) Name() string {
+	return p.cfg.Name
+}
+
+// serviceURL returns the URL which the CAS server sends the user back to. CAS
+// has nothing like a state parameter, so the state is added to the URL.
+func (p *casProvider) serviceURL(callbackURL, state string) string {
+	return callbackURL + "?" + url.Values{"state": []string{state}}.Encode()
+}
+
+func (p *casProvider) AuthorizationURL(ctx context.Context, callbackURL, state string) (string, error) {
+	return strings.TrimSuffix(p.cfg.ServerURL, "/") + "/login?" + url.Values{
+		"service": []string{p.serviceURL(callbackURL, state)},
+	}.Encode(), nil
+}
+
+type casServiceResponse struct {
+	Success *struct {
+		User       string `xml:"user"`
+		Attributes struct {
+			Values []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"attributes"`
+	} `xml:"authenticationSuccess"`
+	Failure *struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"authenticationFailure"`
+}
+
+func (p *casProvider) ProcessCallback(ctx context.Context, req *http.Request, callbackURL string) (string, *UserInfo, error) {
+	query := req.URL.Query()
+	state := query.Get("state")
+	ticket := query.Get("ticket")
+	if ticket == "" {
+		return state, nil, fmt.Errorf("the CAS server didn't return a ticket")
+	}
+
+	// The ticket is only valid for the exact service URL which it was issued
+	// for, which has the state in it.
+	validateURL := strings.TrimSuffix(p.cfg.ServerURL, "/") + "/p3/serviceValidate?" + url.Values{
+		"service": []string{p.serviceURL(callbackURL, state)},
+		"ticket":  []string{ticket},
+	}.Encode()
+	validateReq, err := http.NewRequest(http.MethodGet, validateURL, nil)
+	if err != nil {
+		return state, nil, err
+	}
+	resp, err := p.client.Do(validateReq.WithContext(ctx))
+	if err != nil {
+		return state, nil, fmt.Errorf("failed to validate the ticket: %w", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return state, nil, fmt.Errorf("failed to validate the ticket: HTTP %d", resp.StatusCode)
+	}
+	var validation casServiceResponse
+	if err = xml.NewDecoder(resp.Body).Decode(&validation); err != nil {
+		return state, nil, fmt.Errorf("failed to validate the ticket: %w", err)
+	}
+	if validation.Failure != nil {
+		return state, nil, fmt.Errorf("the CAS server rejected the ticket: %s %s", validation.Failure.Code, strings.TrimSpace(validation.Failure.Message))
+	}
+	if validation.Success == nil || strings.TrimSpace(validation.Success.User) == "" {
+		return state, nil, fmt.Errorf("the CAS server didn't say who the user is")
+	}
+
+	username := strings.TrimSpace(validation.Success.User)
+	user := &UserInfo{Subject: username, Localpart: username}
+	attributes := map[string][]string{}
+	for _, attr := range validation.Success.Attributes.Values {
+		attributes[attr.XMLName.Local] = append(attributes[attr.XMLName.Local], strings.TrimSpace(attr.Value))
+	}
+	for name, required := range p.cfg.RequiredAttributes {
+		if !containsString(attributes[name], required) {
+			return state, nil, fmt.Errorf("the user isn't allowed to log in to this server")
+		}
+	}
+	if values := attributes[p.cfg.DisplayNameAttribute]; len(values) > 0 {
+		user.DisplayName = values[0]
+	}
+	return state, user, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// newFakeCASServer runs a CAS server which has issued the ticket "ticket" to
+// alice for the service URL with the state "state".
+func newFakeCASServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cas/p3/serviceValidate", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		query := req.URL.Query()
+		if query.Get("ticket") != "ticket" || query.Get("service") != callbackURL+"?state=state" {
+			_, _ = w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationFailure code="INVALID_TICKET">Ticket not recognized</cas:authenticationFailure>
+</cas:serviceResponse>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess>
+    <cas:user>alice</cas:user>
+    <cas:attributes>
+      <cas:displayName>Alice Liddell</cas:displayName>
+      <cas:affiliation>student</cas:affiliation>
+      <cas:affiliation>staff</cas:affiliation>
+    </cas:attributes>
+  </cas:authenticationSuccess>
+</cas:serviceResponse>`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestCASLogin(t *testing.T) {
+	server := newFakeCASServer()
+	defer server.Close()
+	cfg := &config.SSO{
+		CASProviders: []config.CASProvider{{
+			ID:                   "test",
+			ServerURL:            server.URL + "/cas/",
+			DisplayNameAttribute: "displayName",
+			RequiredAttributes:   map[string]string{"affiliation": "staff"},
+		}},
+	}
+	provider := NewIdentityProviders(cfg, server.Client())[0]
+
+	authURL, err := provider.AuthorizationURL(context.Background(), callbackURL, "state")
+	if err != nil {
+		t.Fatalf("AuthorizationURL failed: %s", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("failed to parse the authorization URL: %s", err)
+	}
+	if u.Path != "/cas/login" || u.Query().Get("service") != callbackURL+"?state=state" {
+		t.Fatalf("wrong authorization URL: %s", authURL)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callbackURL+"?state=state&ticket=ticket", nil)
+	state, user, err := provider.ProcessCallback(context.Background(), req, callbackURL)
+	if err != nil {
+		t.Fatalf("ProcessCallback failed: %s", err)
+	}
+	if state != "state" || user.Subject != "alice" || user.Localpart != "alice" || user.DisplayName != "Alice Liddell" {
+		t.Fatalf("ProcessCallback returned state %q and user %+v", state, user)
+	}
+
+	// The ticket was issued for a service URL with a different state.
+	req = httptest.NewRequest(http.MethodGet, callbackURL+"?state=other&ticket=ticket", nil)
+	if _, _, err = provider.ProcessCallback(context.Background(), req, callbackURL); err == nil {
+		t.Errorf("ProcessCallback succeeded with a ticket for another service URL")
+	}
+	req = httptest.NewRequest(http.MethodGet, callbackURL+"?state=state", nil)
+	if _, _, err = provider.ProcessCallback(context.Background(), req, callbackURL); err == nil {
+		t.Errorf("ProcessCallback succeeded without a ticket")
+	}
+
+	cfg.CASProviders[0].RequiredAttributes["affiliation"] = "faculty"
+	req = httptest.NewRequest(http.MethodGet, callbackURL+"?state=state&ticket=ticket", nil)
+	if _, _, err = provider.ProcessCallback(context.Background(), req, callbackURL); err == nil {
+		t.Errorf("ProcessCallback succeeded for a user without the required attributes")
+	}
+}
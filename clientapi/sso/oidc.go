@@ -0,0 +1,189 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// oidcProvider logs users in with the OpenID Connect authorization code flow.
+// Rather than checking the signature of the ID token, it asks the provider's
+// userinfo endpoint who the access token belongs to, which is just as good
+// since the provider is talked to directly over HTTPS.
+type oidcProvider struct {
+	cfg    *config.OIDCProvider
+	client *http.Client
+
+	// The provider's configuration, once it has been discovered.
+	discoveryMu sync.Mutex
+	discovery   *oidcDiscovery
+}
+
+// oidcDiscovery is the part of an OpenID provider's configuration which is
+// needed to log users in.
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+func newOIDCProvider(cfg *config.OIDCProvider, client *http.Client) *oidcProvider {
+	return &oidcProvider{
+		cfg:    cfg,
+		client: client,
+	}
+}
+
+func (p *oidcProvider) ID() string {
+	return p.cfg.ID
+}
+
+func (p *oidcProvider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *oidcProvider) AuthorizationURL(ctx context.Context, callbackURL, state string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", callbackURL)
+	query.Set("scope", strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " "))
+	query.Set("state", state)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (p *oidcProvider) ProcessCallback(ctx context.Context, req *http.Request, callbackURL string) (string, *UserInfo, error) {
+	query := req.URL.Query()
+	state := query.Get("state")
+	if errCode := query.Get("error"); errCode != "" {
+		return state, nil, fmt.Errorf("the identity provider returned an error: %s %s", errCode, query.Get("error_description"))
+	}
+	code := query.Get("code")
+	if code == "" {
+		return state, nil, fmt.Errorf("the identity provider didn't return an authorization code")
+	}
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return state, nil, err
+	}
+
+	// Exchange the authorization code for an access token.
+	// https://openid.net/specs/openid-connect-core-1_0.html#TokenRequest
+	form := url.Values{
+		"grant_type":   []string{"authorization_code"},
+		"code":         []string{code},
+		"redirect_uri": []string{callbackURL},
+	}
+	tokenReq, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return state, nil, err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err = p.do(ctx, tokenReq, &token); err != nil {
+		return state, nil, fmt.Errorf("failed to exchange the authorization code: %w", err)
+	}
+	if token.AccessToken == "" || !strings.EqualFold(token.TokenType, "Bearer") {
+		return state, nil, fmt.Errorf("the identity provider didn't return a bearer token")
+	}
+
+	// Ask who the access token belongs to.
+	// https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+	userinfoReq, err := http.NewRequest(http.MethodGet, discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return state, nil, err
+	}
+	userinfoReq.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var claims map[string]interface{}
+	if err = p.do(ctx, userinfoReq, &claims); err != nil {
+		return state, nil, fmt.Errorf("failed to fetch the user's details: %w", err)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return state, nil, fmt.Errorf("the identity provider didn't say who the user is")
+	}
+	user := &UserInfo{Subject: subject}
+	user.Localpart, _ = claims[p.cfg.LocalpartClaim].(string)
+	user.DisplayName, _ = claims[p.cfg.DisplayNameClaim].(string)
+	return state, user, nil
+}
+
+// discover fetches the provider's configuration, or returns it straight away
+// if it has already been fetched.
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfig
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.discoveryMu.Lock()
+	defer p.discoveryMu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	issuer := strings.TrimSuffix(p.cfg.Issuer, "/")
+	req, err := http.NewRequest(http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var discovery oidcDiscovery
+	if err = p.do(ctx, req, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover the configuration of %s: %w", issuer, err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("the configuration of %s is for a different issuer %q", issuer, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("the configuration of %s is missing endpoints", issuer)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// do sends a request to the provider and decodes the JSON response.
+func (p *oidcProvider) do(ctx context.Context, req *http.Request, res interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,449 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+const (
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlRedirectBinding    = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPOSTBinding        = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearerMethod       = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlPersistentNameID   = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+)
+
+// samlClockSkew is how far the identity provider's clock may be out when
+// checking how long assertions are valid for.
+const samlClockSkew = time.Minute
+
+// samlProvider logs users in with the SAML2 Web Browser SSO profile. Requests
+// are sent with the HTTP-Redirect binding, and responses are received with
+// the HTTP-POST binding. Either the response or the assertion in it must be
+// signed by the identity provider. Encrypted assertions aren't supported.
+type samlProvider struct {
+	cfg      *config.SAMLProvider
+	entityID string
+	client   *http.Client
+
+	// The identity provider's metadata, once it has been loaded.
+	metadataMu sync.Mutex
+	metadata   *samlIDPMetadata
+}
+
+// samlIDPMetadata is the part of an identity provider's metadata which is
+// needed to log users in.
+type samlIDPMetadata struct {
+	EntityID     string
+	SSOURL       string
+	Certificates []*x509.Certificate
+}
+
+func newSAMLProvider(cfg *config.SAMLProvider, publicBaseURL string, client *http.Client) *samlProvider {
+	entityID := cfg.EntityID
+	if entityID == "" {
+		entityID = strings.TrimSuffix(publicBaseURL, "/") + MetadataPath + url.PathEscape(cfg.ID)
+	}
+	return &samlProvider{
+		cfg:      cfg,
+		entityID: entityID,
+		client:   client,
+	}
+}
+
+func (p *samlProvider) ID() string {
+	return p.cfg.ID
+}
+
+func (p *samlProvider) Name() string {
+	return p.cfg.Name
+}
+
+// samlRequestID returns the ID of the authentication request sent for an SSO
+// session, so that the response can be matched up with the session without
+// storing anything else.
+func samlRequestID(state string) string {
+	return "_" + state
+}
+
+type samlAuthnRequest struct {
+	XMLName                     xml.Name         `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string           `xml:"ID,attr"`
+	Version                     string           `xml:"Version,attr"`
+	IssueInstant                string           `xml:"IssueInstant,attr"`
+	Destination                 string           `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string           `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string           `xml:"ProtocolBinding,attr"`
+	Issuer                      samlIssuer       `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameIDPolicy                samlNameIDPolicy `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+}
+
+type samlIssuer struct {
+	Value string `xml:",chardata"`
+}
+
+type samlNameIDPolicy struct {
+	Format      string `xml:"Format,attr"`
+	AllowCreate bool   `xml:"AllowCreate,attr"`
+}
+
+func (p *samlProvider) AuthorizationURL(ctx context.Context, callbackURL, state string) (string, error) {
+	metadata, err := p.loadMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	request, err := xml.Marshal(samlAuthnRequest{
+		ID:                          samlRequestID(state),
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC().Format(time.RFC3339),
+		Destination:                 metadata.SSOURL,
+		AssertionConsumerServiceURL: callbackURL,
+		ProtocolBinding:             samlPOSTBinding,
+		Issuer:                      samlIssuer{Value: p.entityID},
+		NameIDPolicy:                samlNameIDPolicy{Format: samlPersistentNameID, AllowCreate: true},
+	})
+	if err != nil {
+		return "", err
+	}
+	// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf section 3.4.4.1
+	var deflated bytes.Buffer
+	w, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(request); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(metadata.SSOURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	query.Set("RelayState", state)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (p *samlProvider) ProcessCallback(ctx context.Context, req *http.Request, callbackURL string) (string, *UserInfo, error) {
+	if req.Method != http.MethodPost {
+		return "", nil, fmt.Errorf("the identity provider must send the response with the HTTP-POST binding")
+	}
+	state := req.PostFormValue("RelayState")
+	data, err := base64.StdEncoding.DecodeString(removeWhitespace(req.PostFormValue("SAMLResponse")))
+	if err != nil {
+		return state, nil, fmt.Errorf("invalid SAMLResponse: %w", err)
+	}
+	response, err := parseXML(data)
+	if err != nil {
+		return state, nil, fmt.Errorf("invalid SAMLResponse: %w", err)
+	}
+	metadata, err := p.loadMetadata(ctx)
+	if err != nil {
+		return state, nil, err
+	}
+	assertion, err := p.verifyResponse(response, metadata, callbackURL, samlRequestID(state))
+	if err != nil {
+		return state, nil, err
+	}
+	user, err := p.checkAssertion(assertion, metadata, callbackURL, samlRequestID(state), time.Now())
+	return state, user, err
+}
+
+// verifyResponse checks the response and its signature, returning the
+// assertion in it which was signed by the identity provider.
+// Everything is read from the elements which were checked, so that unsigned
+// elements elsewhere in the response can't be passed off as signed.
+func (p *samlProvider) verifyResponse(response *xmlElement, metadata *samlIDPMetadata, callbackURL, requestID string) (*xmlElement, error) {
+	if response.Space != samlProtocolNamespace || response.Local != "Response" {
+		return nil, fmt.Errorf("the SAMLResponse isn't a Response")
+	}
+	responseSigned := response.ChildElement(xmldsigNamespace, "Signature") != nil
+	if responseSigned {
+		if err := verifySignature(response, metadata.Certificates); err != nil {
+			return nil, err
+		}
+	}
+	if destination := response.Attr("Destination"); destination != "" && destination != callbackURL {
+		return nil, fmt.Errorf("the response was sent to %q", destination)
+	}
+	if response.Attr("InResponseTo") != requestID {
+		return nil, fmt.Errorf("the response isn't for this login")
+	}
+	status := response.ChildElement(samlProtocolNamespace, "Status")
+	if status == nil {
+		return nil, fmt.Errorf("the response has no status")
+	}
+	if code := status.ChildElement(samlProtocolNamespace, "StatusCode"); code == nil || code.Attr("Value") != samlStatusSuccess {
+		message := ""
+		if m := status.ChildElement(samlProtocolNamespace, "StatusMessage"); m != nil {
+			message = m.Text()
+		}
+		return nil, fmt.Errorf("the identity provider didn't log the user in: %s", message)
+	}
+	if len(response.ChildElements(samlAssertionNamespace, "EncryptedAssertion")) > 0 {
+		return nil, fmt.Errorf("encrypted assertions aren't supported")
+	}
+	assertions := response.ChildElements(samlAssertionNamespace, "Assertion")
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("the response must have exactly one assertion")
+	}
+	assertion := assertions[0]
+	if assertion.ChildElement(xmldsigNamespace, "Signature") != nil || !responseSigned {
+		if err := verifySignature(assertion, metadata.Certificates); err != nil {
+			return nil, err
+		}
+	}
+	return assertion, nil
+}
+
+// checkAssertion checks that an assertion from the identity provider is about
+// a user logging in to this server, and returns who the user is.
+func (p *samlProvider) checkAssertion(
+	assertion *xmlElement, metadata *samlIDPMetadata, callbackURL, requestID string, now time.Time,
+) (*UserInfo, error) {
+	if issuer := assertion.ChildElement(samlAssertionNamespace, "Issuer"); issuer == nil || issuer.Text() != metadata.EntityID {
+		return nil, fmt.Errorf("the assertion wasn't issued by %s", metadata.EntityID)
+	}
+
+	conditions := assertion.ChildElement(samlAssertionNamespace, "Conditions")
+	if conditions == nil {
+		return nil, fmt.Errorf("the assertion has no conditions")
+	}
+	if err := checkTimeRange(conditions, now); err != nil {
+		return nil, err
+	}
+	audienceOK := false
+	for _, restriction := range conditions.ChildElements(samlAssertionNamespace, "AudienceRestriction") {
+		for _, audience := range restriction.ChildElements(samlAssertionNamespace, "Audience") {
+			audienceOK = audienceOK || audience.Text() == p.entityID
+		}
+	}
+	if !audienceOK {
+		return nil, fmt.Errorf("the assertion isn't for %s", p.entityID)
+	}
+
+	subject := assertion.ChildElement(samlAssertionNamespace, "Subject")
+	if subject == nil {
+		return nil, fmt.Errorf("the assertion has no subject")
+	}
+	nameID := subject.ChildElement(samlAssertionNamespace, "NameID")
+	if nameID == nil || nameID.Text() == "" {
+		return nil, fmt.Errorf("the assertion doesn't say who the user is")
+	}
+	confirmed := false
+	for _, confirmation := range subject.ChildElements(samlAssertionNamespace, "SubjectConfirmation") {
+		data := confirmation.ChildElement(samlAssertionNamespace, "SubjectConfirmationData")
+		if confirmation.Attr("Method") != samlBearerMethod || data == nil {
+			continue
+		}
+		if data.Attr("Recipient") != callbackURL || data.Attr("NotOnOrAfter") == "" {
+			continue
+		}
+		if inResponseTo := data.Attr("InResponseTo"); inResponseTo != "" && inResponseTo != requestID {
+			continue
+		}
+		if checkTimeRange(data, now) == nil {
+			confirmed = true
+		}
+	}
+	if !confirmed {
+		return nil, fmt.Errorf("the assertion has no valid bearer confirmation")
+	}
+
+	user := &UserInfo{Subject: nameID.Text()}
+	for _, statement := range assertion.ChildElements(samlAssertionNamespace, "AttributeStatement") {
+		for _, attr := range statement.ChildElements(samlAssertionNamespace, "Attribute") {
+			value := attr.ChildElement(samlAssertionNamespace, "AttributeValue")
+			if value == nil {
+				continue
+			}
+			name, friendlyName := attr.Attr("Name"), attr.Attr("FriendlyName")
+			if name == p.cfg.LocalpartAttribute || friendlyName == p.cfg.LocalpartAttribute {
+				user.Localpart = value.Text()
+			}
+			if name == p.cfg.DisplayNameAttribute || friendlyName == p.cfg.DisplayNameAttribute {
+				user.DisplayName = value.Text()
+			}
+		}
+	}
+	return user, nil
+}
+
+// checkTimeRange checks the NotBefore and NotOnOrAfter attributes of an
+// element, if it has them.
+func checkTimeRange(e *xmlElement, now time.Time) error {
+	if notBefore := e.Attr("NotBefore"); notBefore != "" {
+		t, err := time.Parse(time.RFC3339, notBefore)
+		if err != nil {
+			return fmt.Errorf("invalid NotBefore: %w", err)
+		}
+		if now.Add(samlClockSkew).Before(t) {
+			return fmt.Errorf("the assertion isn't valid yet")
+		}
+	}
+	if notOnOrAfter := e.Attr("NotOnOrAfter"); notOnOrAfter != "" {
+		t, err := time.Parse(time.RFC3339, notOnOrAfter)
+		if err != nil {
+			return fmt.Errorf("invalid NotOnOrAfter: %w", err)
+		}
+		if !now.Add(-samlClockSkew).Before(t) {
+			return fmt.Errorf("the assertion has expired")
+		}
+	}
+	return nil
+}
+
+type samlEntityDescriptor struct {
+	EntityID          string `xml:"entityID,attr"`
+	IDPSSODescriptors []struct {
+		KeyDescriptors []struct {
+			Use          string   `xml:"use,attr"`
+			Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SingleSignOnServices []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+// loadMetadata reads the identity provider's metadata from the config or
+// fetches it, or returns it straight away if it has already been loaded.
+func (p *samlProvider) loadMetadata(ctx context.Context) (*samlIDPMetadata, error) {
+	p.metadataMu.Lock()
+	defer p.metadataMu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	data := p.cfg.Metadata
+	if p.cfg.MetadataURL != "" {
+		req, err := http.NewRequest(http.MethodGet, p.cfg.MetadataURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the metadata of %s: %w", p.cfg.ID, err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch the metadata of %s: HTTP %d", p.cfg.ID, resp.StatusCode)
+		}
+		if data, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, err
+		}
+	}
+	metadata, err := parseSAMLIDPMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata for %s: %w", p.cfg.ID, err)
+	}
+	p.metadata = metadata
+	return p.metadata, nil
+}
+
+func parseSAMLIDPMetadata(data []byte) (*samlIDPMetadata, error) {
+	var descriptor samlEntityDescriptor
+	if err := xml.Unmarshal(data, &descriptor); err != nil {
+		return nil, err
+	}
+	metadata := &samlIDPMetadata{EntityID: descriptor.EntityID}
+	for _, idp := range descriptor.IDPSSODescriptors {
+		for _, sso := range idp.SingleSignOnServices {
+			if sso.Binding == samlRedirectBinding && metadata.SSOURL == "" {
+				metadata.SSOURL = sso.Location
+			}
+		}
+		for _, key := range idp.KeyDescriptors {
+			if key.Use != "" && key.Use != "signing" {
+				continue
+			}
+			for _, encoded := range key.Certificates {
+				der, err := base64.StdEncoding.DecodeString(removeWhitespace(encoded))
+				if err != nil {
+					return nil, fmt.Errorf("invalid certificate: %w", err)
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, fmt.Errorf("invalid certificate: %w", err)
+				}
+				metadata.Certificates = append(metadata.Certificates, cert)
+			}
+		}
+	}
+	if metadata.EntityID == "" || metadata.SSOURL == "" || len(metadata.Certificates) == 0 {
+		return nil, fmt.Errorf("the metadata must have an entity ID, a single sign-on service with the HTTP-Redirect binding and a signing certificate")
+	}
+	return metadata, nil
+}
+
+type samlSPEntityDescriptor struct {
+	XMLName         xml.Name            `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID        string              `xml:"entityID,attr"`
+	SPSSODescriptor samlSPSSODescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+}
+
+type samlSPSSODescriptor struct {
+	ProtocolSupportEnumeration string `xml:"protocolSupportEnumeration,attr"`
+	AuthnRequestsSigned        bool   `xml:"AuthnRequestsSigned,attr"`
+	WantAssertionsSigned       bool   `xml:"WantAssertionsSigned,attr"`
+	NameIDFormat               string `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+	AssertionConsumerService   struct {
+		Binding  string `xml:"Binding,attr"`
+		Location string `xml:"Location,attr"`
+		Index    int    `xml:"index,attr"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+}
+
+// Metadata returns the server's metadata, which tells the identity provider
+// where to send users back to.
+func (p *samlProvider) Metadata(callbackURL string) ([]byte, error) {
+	descriptor := samlSPEntityDescriptor{
+		EntityID: p.entityID,
+		SPSSODescriptor: samlSPSSODescriptor{
+			ProtocolSupportEnumeration: samlProtocolNamespace,
+			WantAssertionsSigned:       true,
+			NameIDFormat:               samlPersistentNameID,
+		},
+	}
+	descriptor.SPSSODescriptor.AssertionConsumerService.Binding = samlPOSTBinding
+	descriptor.SPSSODescriptor.AssertionConsumerService.Location = callbackURL
+	metadata, err := xml.MarshalIndent(descriptor, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), metadata...), nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+func TestExclusiveCanonicalization(t *testing.T) {
+	// The example from https://www.w3.org/TR/xml-exc-c14n/#sec-Enveloping
+	doc, err := parseXML([]byte(`<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org">
+<n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"/></n1:elem2>
+</n0:local>`))
+	if err != nil {
+		t.Fatalf("parseXML failed: %s", err)
+	}
+	elem2 := doc.ChildElement("http://example.net", "elem2")
+	want := `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en"><n3:stuff xmlns:n3="ftp://example.org"></n3:stuff></n1:elem2>`
+	if got := string(elem2.canonicalize(nil, nil)); got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	doc, err = parseXML([]byte(`<a xmlns="urn:a" xmlns:b="urn:b" z="1" b:y="2" x="&quot;&#10;"><c xmlns="">&lt;&gt;</c><!-- comment --></a>`))
+	if err != nil {
+		t.Fatalf("parseXML failed: %s", err)
+	}
+	want = `<a xmlns="urn:a" xmlns:b="urn:b" x="&quot;&#xA;" z="1" b:y="2"><c xmlns="">&lt;&gt;</c></a>`
+	if got := string(doc.canonicalize(nil, nil)); got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+const (
+	samlIDPEntityID = "https://idp.localhost/metadata"
+	samlSPEntityID  = "https://matrix.localhost/_matrix/client/r0/login/sso/metadata/test"
+	samlCallbackURL = "https://matrix.localhost/_matrix/client/r0/login/sso/callback/test"
+)
+
+// fakeSAMLIDP signs SAML responses like an identity provider.
+type fakeSAMLIDP struct {
+	key  *rsa.PrivateKey
+	cert []byte
+}
+
+func newFakeSAMLIDP(t *testing.T) *fakeSAMLIDP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	return &fakeSAMLIDP{key: key, cert: cert}
+}
+
+func (idp *fakeSAMLIDP) metadata() string {
+	return fmt.Sprintf(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%s">
+<IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+<KeyDescriptor use="signing"><KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><X509Data><X509Certificate>%s</X509Certificate></X509Data></KeyInfo></KeyDescriptor>
+<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.localhost/sso"/>
+</IDPSSODescriptor>
+</EntityDescriptor>`, samlIDPEntityID, base64.StdEncoding.EncodeToString(idp.cert))
+}
+
+// sign replaces the comment "<!--signature-->" in the document with an
+// enveloped signature over the element with the given ID.
+func (idp *fakeSAMLIDP) sign(t *testing.T, doc, id string) string {
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatalf("parseXML failed: %s", err)
+	}
+	var find func(e *xmlElement) *xmlElement
+	find = func(e *xmlElement) *xmlElement {
+		if e.Attr("ID") == id {
+			return e
+		}
+		for _, child := range e.Children {
+			if c, ok := child.(*xmlElement); ok {
+				if found := find(c); found != nil {
+					return found
+				}
+			}
+		}
+		return nil
+	}
+	digest := sha256.Sum256(find(root).canonicalize(nil, nil))
+	signedInfo := fmt.Sprintf(`<ds:SignedInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">`+
+		`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>`+
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>`+
+		`<ds:Reference URI="#%s"><ds:Transforms>`+
+		`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>`+
+		`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>`+
+		`</ds:Transforms><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>`+
+		`<ds:DigestValue>%s</ds:DigestValue></ds:Reference></ds:SignedInfo>`,
+		id, base64.StdEncoding.EncodeToString(digest[:]))
+	signedInfoElem, err := parseXML([]byte(signedInfo))
+	if err != nil {
+		t.Fatalf("parseXML failed: %s", err)
+	}
+	hashed := sha256.Sum256(signedInfoElem.canonicalize(nil, nil))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	signature := `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">` + signedInfo +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue></ds:Signature>`
+	return strings.Replace(doc, "<!--signature-->", signature, 1)
+}
+
+func samlResponse(requestID, audience string, notOnOrAfter time.Time) string {
+	return fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_response" Version="2.0" Destination="%[1]s" InResponseTo="%[2]s">
+<saml:Issuer>%[3]s</saml:Issuer>
+<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+<saml:Assertion ID="_assertion" Version="2.0">
+<saml:Issuer>%[3]s</saml:Issuer><!--signature-->
+<saml:Subject>
+<saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">1234</saml:NameID>
+<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+<saml:SubjectConfirmationData Recipient="%[1]s" InResponseTo="%[2]s" NotOnOrAfter="%[5]s"/>
+</saml:SubjectConfirmation>
+</saml:Subject>
+<saml:Conditions NotOnOrAfter="%[5]s"><saml:AudienceRestriction><saml:Audience>%[4]s</saml:Audience></saml:AudienceRestriction></saml:Conditions>
+<saml:AttributeStatement>
+<saml:Attribute Name="uid"><saml:AttributeValue>Alice</saml:AttributeValue></saml:Attribute>
+<saml:Attribute Name="urn:oid:2.16.840.1.113730.3.1.241" FriendlyName="displayName"><saml:AttributeValue>Alice Liddell</saml:AttributeValue></saml:Attribute>
+</saml:AttributeStatement>
+</saml:Assertion>
+</samlp:Response>`, samlCallbackURL, requestID, samlIDPEntityID, audience, notOnOrAfter.UTC().Format(time.RFC3339))
+}
+
+func TestSAMLLogin(t *testing.T) {
+	idp := newFakeSAMLIDP(t)
+	cfg := &config.SSO{
+		PublicBaseURL: "https://matrix.localhost",
+		SAMLProviders: []config.SAMLProvider{{
+			ID:                   "test",
+			Metadata:             []byte(idp.metadata()),
+			LocalpartAttribute:   "uid",
+			DisplayNameAttribute: "displayName",
+		}},
+	}
+	provider := NewIdentityProviders(cfg, http.DefaultClient)[0]
+
+	authURL, err := provider.AuthorizationURL(context.Background(), samlCallbackURL, "state")
+	if err != nil {
+		t.Fatalf("AuthorizationURL failed: %s", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("failed to parse the authorization URL: %s", err)
+	}
+	if u.Host != "idp.localhost" || u.Query().Get("SAMLRequest") == "" || u.Query().Get("RelayState") != "state" {
+		t.Fatalf("wrong authorization URL: %s", authURL)
+	}
+
+	callback := func(response string) (string, *UserInfo, error) {
+		form := url.Values{
+			"SAMLResponse": []string{base64.StdEncoding.EncodeToString([]byte(response))},
+			"RelayState":   []string{"state"},
+		}
+		req := httptest.NewRequest(http.MethodPost, samlCallbackURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return provider.ProcessCallback(context.Background(), req, samlCallbackURL)
+	}
+
+	response := idp.sign(t, samlResponse("_state", samlSPEntityID, time.Now().Add(time.Minute*5)), "_assertion")
+	state, user, err := callback(response)
+	if err != nil {
+		t.Fatalf("ProcessCallback failed: %s", err)
+	}
+	if state != "state" || user.Subject != "1234" || user.Localpart != "Alice" || user.DisplayName != "Alice Liddell" {
+		t.Fatalf("ProcessCallback returned state %q and user %+v", state, user)
+	}
+
+	for name, response := range map[string]string{
+		"unsigned":         samlResponse("_state", samlSPEntityID, time.Now().Add(time.Minute*5)),
+		"tampered":         strings.Replace(response, ">1234<", ">5678<", 1),
+		"expired":          idp.sign(t, samlResponse("_state", samlSPEntityID, time.Now().Add(-time.Hour)), "_assertion"),
+		"other audience":   idp.sign(t, samlResponse("_state", "https://other.localhost", time.Now().Add(time.Minute*5)), "_assertion"),
+		"other request":    idp.sign(t, samlResponse("_other", samlSPEntityID, time.Now().Add(time.Minute*5)), "_assertion"),
+		"signed elsewhere": idp.sign(t, samlResponse("_state", samlSPEntityID, time.Now().Add(time.Minute*5)), "_response"),
+	} {
+		if _, _, err := callback(response); err == nil {
+			t.Errorf("ProcessCallback accepted a response which was %s", name)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sso implements logging in with single sign-on identity providers.
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// sessionLifetime is how long users have to log in at the identity provider
+// after being sent there.
+const sessionLifetime = 10 * time.Minute
+
+const (
+	// CallbackPath is the path which identity providers send users back to,
+	// followed by the ID of the identity provider.
+	CallbackPath = "/_matrix/client/r0/login/sso/callback/"
+	// MetadataPath is the path which the server's metadata for identity
+	// providers which need it is served from, followed by the ID of the
+	// identity provider.
+	MetadataPath = "/_matrix/client/r0/login/sso/metadata/"
+)
+
+// IdentityProvider is a single sign-on identity provider which users can be
+// sent to to log in.
+type IdentityProvider interface {
+	// ID returns the ID of the provider in the config.
+	ID() string
+	// Name returns the name of the provider shown to users.
+	Name() string
+	// AuthorizationURL returns the URL which the user is sent to to log in.
+	// The provider sends the user back to the callback URL afterwards, along
+	// with the state.
+	AuthorizationURL(ctx context.Context, callbackURL, state string) (string, error)
+	// ProcessCallback checks the request which the provider sent the user back
+	// to the callback URL with. Returns the state which was passed to
+	// AuthorizationURL and who the user logged in as.
+	ProcessCallback(ctx context.Context, req *http.Request, callbackURL string) (state string, user *UserInfo, err error)
+}
+
+// MetadataProvider is an identity provider which needs to be given metadata
+// about the server, such as a SAML2 identity provider.
+type MetadataProvider interface {
+	IdentityProvider
+	// Metadata returns the server's metadata for the identity provider.
+	Metadata(callbackURL string) ([]byte, error)
+}
+
+// UserInfo is who a user logged in as at an identity provider.
+type UserInfo struct {
+	// The ID which the provider knows the user by, which never changes.
+	Subject string
+	// The name which the localpart of a new account for the user is made
+	// from, if the provider gave one.
+	Localpart string
+	// The display name of a new account for the user, if the provider gave
+	// one.
+	DisplayName string
+}
+
+// NewIdentityProviders returns the identity providers in the config, which
+// are contacted with the given HTTP client.
+func NewIdentityProviders(cfg *config.SSO, client *http.Client) []IdentityProvider {
+	var providers []IdentityProvider
+	for i := range cfg.OIDCProviders {
+		providers = append(providers, newOIDCProvider(&cfg.OIDCProviders[i], client))
+	}
+	for i := range cfg.SAMLProviders {
+		providers = append(providers, newSAMLProvider(&cfg.SAMLProviders[i], cfg.PublicBaseURL, client))
+	}
+	for i := range cfg.CASProviders {
+		providers = append(providers, newCASProvider(&cfg.CASProviders[i], client))
+	}
+	return providers
+}
+
+// MapLocalpart turns a name given by an identity provider into a localpart,
+// by lowercasing it and replacing the characters which aren't allowed in
+// localparts. Returns an empty string if nothing usable is left.
+func MapLocalpart(name string) string {
+	localpart := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-', r == '/':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.ToLower(name))
+	// Localparts starting with an underscore are reserved.
+	return strings.TrimLeft(localpart, "_")
+}
+
+// Session is a login which was started by sending a user to an identity
+// provider.
+type Session struct {
+	// The ID of the identity provider which the user was sent to.
+	IdentityProviderID string
+	// The URL of the client which the user is sent back to once they have
+	// logged in.
+	RedirectURL string
+	expires     time.Time
+}
+
+// Sessions remembers the logins which are waiting for users to come back from
+// identity providers.
+type Sessions struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewSessions returns an empty set of sessions.
+func NewSessions() *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Create starts a session for a user who is about to be sent to the identity
+// provider, returning its ID.
+func (s *Sessions) Create(idpID, redirectURL string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	sessionID := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[sessionID] = &Session{
+		IdentityProviderID: idpID,
+		RedirectURL:        redirectURL,
+		expires:            now.Add(sessionLifetime),
+	}
+	return sessionID, nil
+}
+
+// Claim ends a session when the user comes back from the identity provider.
+// Returns nil if there is no such session or it has expired.
+func (s *Sessions) Claim(sessionID string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return nil
+	}
+	delete(s.sessions, sessionID)
+	if time.Now().After(session.expires) {
+		return nil
+	}
+	return session
+}
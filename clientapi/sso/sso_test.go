@@ -0,0 +1,142 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+const callbackURL = "https://matrix.localhost/_matrix/client/r0/login/sso/callback/test"
+
+// newFakeOIDCServer runs an OpenID provider which issues the code "code" and
+// the access token "token" to the client "client" with secret "secret".
+func newFakeOIDCServer() *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/authorize",
+			TokenEndpoint:         server.URL + "/token",
+			UserinfoEndpoint:      server.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		clientID, clientSecret, _ := req.BasicAuth()
+		if clientID != "client" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.PostFormValue("code") != "code" || req.PostFormValue("redirect_uri") != callbackURL {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"token","token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"sub":"1234","preferred_username":"Alice","name":"Alice Liddell"}`))
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func TestOIDCLogin(t *testing.T) {
+	server := newFakeOIDCServer()
+	defer server.Close()
+	cfg := &config.SSO{
+		OIDCProviders: []config.OIDCProvider{{
+			ID:               "test",
+			Issuer:           server.URL + "/",
+			ClientID:         "client",
+			ClientSecret:     "secret",
+			Scopes:           []string{"profile"},
+			LocalpartClaim:   "preferred_username",
+			DisplayNameClaim: "name",
+		}},
+	}
+	provider := NewIdentityProviders(cfg, server.Client())[0]
+
+	authURL, err := provider.AuthorizationURL(context.Background(), callbackURL, "state")
+	if err != nil {
+		t.Fatalf("AuthorizationURL failed: %s", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("failed to parse the authorization URL: %s", err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != "client" || query.Get("redirect_uri") != callbackURL ||
+		query.Get("scope") != "openid profile" || query.Get("state") != "state" || query.Get("response_type") != "code" {
+		t.Fatalf("wrong authorization URL: %s", authURL)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callbackURL+"?code=code&state=state", nil)
+	state, user, err := provider.ProcessCallback(context.Background(), req, callbackURL)
+	if err != nil {
+		t.Fatalf("ProcessCallback failed: %s", err)
+	}
+	if state != "state" || user.Subject != "1234" || user.Localpart != "Alice" || user.DisplayName != "Alice Liddell" {
+		t.Fatalf("ProcessCallback returned state %q and user %+v", state, user)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, callbackURL+"?code=wrong&state=state", nil)
+	if _, _, err = provider.ProcessCallback(context.Background(), req, callbackURL); err == nil {
+		t.Errorf("ProcessCallback succeeded with the wrong code")
+	}
+	req = httptest.NewRequest(http.MethodGet, callbackURL+"?error=access_denied&state=state", nil)
+	if _, _, err = provider.ProcessCallback(context.Background(), req, callbackURL); err == nil {
+		t.Errorf("ProcessCallback succeeded when the provider returned an error")
+	}
+}
+
+func TestMapLocalpart(t *testing.T) {
+	for name, want := range map[string]string{
+		"alice":             "alice",
+		"Alice.Liddell":     "alice.liddell",
+		"alice@example.com": "alice_example.com",
+		"_alice":            "alice",
+		"___":               "",
+	} {
+		if got := MapLocalpart(name); got != want {
+			t.Errorf("MapLocalpart(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	sessions := NewSessions()
+	sessionID, err := sessions.Create("test", "https://client.localhost")
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	session := sessions.Claim(sessionID)
+	if session == nil || session.IdentityProviderID != "test" || session.RedirectURL != "https://client.localhost" {
+		t.Fatalf("Claim returned %+v", session)
+	}
+	if sessions.Claim(sessionID) != nil {
+		t.Errorf("a session was claimed twice")
+	}
+}
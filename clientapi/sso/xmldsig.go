@@ -0,0 +1,437 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	// Register the hashes which signatures can use.
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+)
+
+const (
+	xmldsigNamespace      = "http://www.w3.org/2000/09/xmldsig#"
+	excC14NAlgorithm      = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSigAlgorithm = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+var signatureAlgorithms = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#rsa-sha1":        crypto.SHA1,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+}
+
+var digestAlgorithms = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#sha1":  crypto.SHA1,
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+}
+
+// xmlElement is an element of a parsed XML document. Unlike encoding/xml,
+// it keeps the prefixes and namespace declarations which were used, since
+// they are needed to canonicalize the element to check its signature.
+type xmlElement struct {
+	Prefix, Local string
+	// The namespace URI of the element, resolved from its prefix.
+	Space string
+	// The attributes of the element, not including namespace declarations.
+	Attrs []xmlAttr
+	// The namespaces declared on the element, by prefix. The default
+	// namespace has an empty prefix.
+	NamespaceDecls map[string]string
+	// The namespaces in scope for the element, by prefix.
+	Namespaces map[string]string
+	Parent     *xmlElement
+	// The child elements and text of the element, of type *xmlElement or
+	// xmlText.
+	Children []interface{}
+}
+
+type xmlAttr struct {
+	Prefix, Local, Space, Value string
+}
+
+type xmlText string
+
+// parseXML parses an XML document, dropping comments and processing
+// instructions.
+func parseXML(data []byte) (*xmlElement, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root, current *xmlElement
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			elem := &xmlElement{
+				Prefix:         t.Name.Space,
+				Local:          t.Name.Local,
+				NamespaceDecls: map[string]string{},
+				Namespaces:     map[string]string{},
+				Parent:         current,
+			}
+			if current != nil {
+				for prefix, uri := range current.Namespaces {
+					elem.Namespaces[prefix] = uri
+				}
+			}
+			for _, attr := range t.Attr {
+				switch {
+				case attr.Name.Space == "xmlns":
+					elem.NamespaceDecls[attr.Name.Local] = attr.Value
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					elem.NamespaceDecls[""] = attr.Value
+				default:
+					elem.Attrs = append(elem.Attrs, xmlAttr{Prefix: attr.Name.Space, Local: attr.Name.Local, Value: attr.Value})
+				}
+			}
+			for prefix, uri := range elem.NamespaceDecls {
+				elem.Namespaces[prefix] = uri
+			}
+			if elem.Space, err = elem.resolve(elem.Prefix); err != nil {
+				return nil, err
+			}
+			for i := range elem.Attrs {
+				// Attributes without a prefix aren't in the default namespace.
+				if elem.Attrs[i].Prefix != "" {
+					if elem.Attrs[i].Space, err = elem.resolve(elem.Attrs[i].Prefix); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if current == nil {
+				if root != nil {
+					return nil, fmt.Errorf("the document has more than one root element")
+				}
+				root = elem
+			} else {
+				current.Children = append(current.Children, elem)
+			}
+			current = elem
+		case xml.EndElement:
+			if current == nil {
+				return nil, fmt.Errorf("unexpected end element")
+			}
+			current = current.Parent
+		case xml.CharData:
+			if current != nil {
+				current.Children = append(current.Children, xmlText(t))
+			}
+		case xml.Directive:
+			// Entity declarations could be used to make the signed content
+			// differ from what is read, so documents mustn't have any.
+			return nil, fmt.Errorf("the document mustn't have a DTD")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, fmt.Errorf("the document is incomplete")
+	}
+	return root, nil
+}
+
+func (e *xmlElement) resolve(prefix string) (string, error) {
+	if prefix == "xml" {
+		return "http://www.w3.org/XML/1998/namespace", nil
+	}
+	uri, ok := e.Namespaces[prefix]
+	if !ok && prefix != "" {
+		return "", fmt.Errorf("undeclared namespace prefix %q", prefix)
+	}
+	return uri, nil
+}
+
+// Attr returns the value of the attribute with the given name and no
+// namespace, or an empty string if there isn't one.
+func (e *xmlElement) Attr(local string) string {
+	for _, attr := range e.Attrs {
+		if attr.Space == "" && attr.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// ChildElements returns the child elements with the given namespace and name.
+func (e *xmlElement) ChildElements(space, local string) []*xmlElement {
+	var children []*xmlElement
+	for _, child := range e.Children {
+		if elem, ok := child.(*xmlElement); ok && elem.Space == space && elem.Local == local {
+			children = append(children, elem)
+		}
+	}
+	return children
+}
+
+// ChildElement returns the first child element with the given namespace and
+// name, or nil if there isn't one.
+func (e *xmlElement) ChildElement(space, local string) *xmlElement {
+	if children := e.ChildElements(space, local); len(children) > 0 {
+		return children[0]
+	}
+	return nil
+}
+
+// Text returns the text directly inside the element, with surrounding
+// whitespace removed.
+func (e *xmlElement) Text() string {
+	var b strings.Builder
+	for _, child := range e.Children {
+		if text, ok := child.(xmlText); ok {
+			b.WriteString(string(text))
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// canonicalize serializes the element with Exclusive XML Canonicalization,
+// leaving out the given child element if it isn't nil. Namespaces with the
+// prefixes in inclusivePrefixes are treated as in inclusive canonicalization.
+// https://www.w3.org/TR/xml-exc-c14n/
+func (e *xmlElement) canonicalize(skip *xmlElement, inclusivePrefixes []string) []byte {
+	var b bytes.Buffer
+	e.writeCanonical(&b, map[string]string{}, skip, inclusivePrefixes)
+	return b.Bytes()
+}
+
+func (e *xmlElement) writeCanonical(b *bytes.Buffer, rendered map[string]string, skip *xmlElement, inclusivePrefixes []string) {
+	// Render the namespaces which the element and its attributes use, unless
+	// an ancestor in the output already declared them the same way.
+	used := map[string]bool{e.Prefix: true}
+	for _, attr := range e.Attrs {
+		if attr.Prefix != "" {
+			used[attr.Prefix] = true
+		}
+	}
+	for _, prefix := range inclusivePrefixes {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		if _, ok := e.Namespaces[prefix]; ok {
+			used[prefix] = true
+		}
+	}
+	var prefixes []string
+	for prefix := range used {
+		if prefix == "xml" {
+			continue
+		}
+		uri := e.Namespaces[prefix]
+		renderedURI, isRendered := rendered[prefix]
+		if isRendered && renderedURI == uri {
+			continue
+		}
+		// An empty default namespace only needs declaring to undo a
+		// default namespace declared by an ancestor.
+		if !isRendered && prefix == "" && uri == "" {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	childRendered := rendered
+	if len(prefixes) > 0 {
+		childRendered = make(map[string]string, len(rendered)+len(prefixes))
+		for prefix, uri := range rendered {
+			childRendered[prefix] = uri
+		}
+	}
+
+	b.WriteByte('<')
+	b.WriteString(qualifiedName(e.Prefix, e.Local))
+	for _, prefix := range prefixes {
+		uri := e.Namespaces[prefix]
+		childRendered[prefix] = uri
+		if prefix == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:` + prefix + `="`)
+		}
+		writeEscaped(b, uri, true)
+		b.WriteByte('"')
+	}
+	attrs := append([]xmlAttr(nil), e.Attrs...)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].Space != attrs[j].Space {
+			return attrs[i].Space < attrs[j].Space
+		}
+		return attrs[i].Local < attrs[j].Local
+	})
+	for _, attr := range attrs {
+		b.WriteString(" " + qualifiedName(attr.Prefix, attr.Local) + `="`)
+		writeEscaped(b, attr.Value, true)
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+	for _, child := range e.Children {
+		switch c := child.(type) {
+		case *xmlElement:
+			if c != skip {
+				c.writeCanonical(b, childRendered, skip, inclusivePrefixes)
+			}
+		case xmlText:
+			writeEscaped(b, string(c), false)
+		}
+	}
+	b.WriteString("</" + qualifiedName(e.Prefix, e.Local) + ">")
+}
+
+func qualifiedName(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+func writeEscaped(b *bytes.Buffer, s string, attr bool) {
+	for _, r := range s {
+		switch {
+		case r == '&':
+			b.WriteString("&amp;")
+		case r == '<':
+			b.WriteString("&lt;")
+		case r == '>' && !attr:
+			b.WriteString("&gt;")
+		case r == '"' && attr:
+			b.WriteString("&quot;")
+		case r == '\t' && attr:
+			b.WriteString("&#x9;")
+		case r == '\n' && attr:
+			b.WriteString("&#xA;")
+		case r == '\r':
+			b.WriteString("&#xD;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// verifySignature checks that the element has an enveloped XML signature
+// over the whole of itself, made by one of the given certificates.
+// https://www.w3.org/TR/xmldsig-core1/
+func verifySignature(e *xmlElement, certs []*x509.Certificate) error {
+	signature := e.ChildElement(xmldsigNamespace, "Signature")
+	if signature == nil {
+		return fmt.Errorf("%s isn't signed", e.Local)
+	}
+	signedInfo := signature.ChildElement(xmldsigNamespace, "SignedInfo")
+	if signedInfo == nil {
+		return fmt.Errorf("the signature has no SignedInfo")
+	}
+	if method := signedInfo.ChildElement(xmldsigNamespace, "CanonicalizationMethod"); method == nil || method.Attr("Algorithm") != excC14NAlgorithm {
+		return fmt.Errorf("unsupported canonicalization method")
+	}
+	method := signedInfo.ChildElement(xmldsigNamespace, "SignatureMethod")
+	if method == nil {
+		return fmt.Errorf("the signature has no SignatureMethod")
+	}
+	signatureHash, ok := signatureAlgorithms[method.Attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported signature method %q", method.Attr("Algorithm"))
+	}
+
+	// The signature must only cover this element, so that nothing else in
+	// the document can be passed off as signed.
+	references := signedInfo.ChildElements(xmldsigNamespace, "Reference")
+	if len(references) != 1 {
+		return fmt.Errorf("the signature must have exactly one Reference")
+	}
+	reference := references[0]
+	if id := e.Attr("ID"); id == "" || reference.Attr("URI") != "#"+id {
+		return fmt.Errorf("the signature doesn't refer to %s", e.Local)
+	}
+	var inclusivePrefixes []string
+	if transforms := reference.ChildElement(xmldsigNamespace, "Transforms"); transforms != nil {
+		for _, transform := range transforms.ChildElements(xmldsigNamespace, "Transform") {
+			switch transform.Attr("Algorithm") {
+			case envelopedSigAlgorithm:
+			case excC14NAlgorithm:
+				inclusivePrefixes = exclusiveC14NPrefixes(transform)
+			default:
+				return fmt.Errorf("unsupported transform %q", transform.Attr("Algorithm"))
+			}
+		}
+	}
+	digestMethod := reference.ChildElement(xmldsigNamespace, "DigestMethod")
+	digestValue := reference.ChildElement(xmldsigNamespace, "DigestValue")
+	if digestMethod == nil || digestValue == nil {
+		return fmt.Errorf("the signature's Reference has no digest")
+	}
+	digestHash, ok := digestAlgorithms[digestMethod.Attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported digest method %q", digestMethod.Attr("Algorithm"))
+	}
+	wantDigest, err := base64.StdEncoding.DecodeString(removeWhitespace(digestValue.Text()))
+	if err != nil {
+		return fmt.Errorf("invalid digest: %w", err)
+	}
+	h := digestHash.New()
+	_, _ = h.Write(e.canonicalize(signature, inclusivePrefixes))
+	if !bytes.Equal(h.Sum(nil), wantDigest) {
+		return fmt.Errorf("the digest of %s doesn't match its signature", e.Local)
+	}
+
+	signatureValue := signature.ChildElement(xmldsigNamespace, "SignatureValue")
+	if signatureValue == nil {
+		return fmt.Errorf("the signature has no SignatureValue")
+	}
+	sig, err := base64.StdEncoding.DecodeString(removeWhitespace(signatureValue.Text()))
+	if err != nil {
+		return fmt.Errorf("invalid signature value: %w", err)
+	}
+	h = signatureHash.New()
+	var signedInfoPrefixes []string
+	if method := signedInfo.ChildElement(xmldsigNamespace, "CanonicalizationMethod"); method != nil {
+		signedInfoPrefixes = exclusiveC14NPrefixes(method)
+	}
+	_, _ = h.Write(signedInfo.canonicalize(nil, signedInfoPrefixes))
+	hashed := h.Sum(nil)
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(key, signatureHash, hashed, sig) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("the signature of %s wasn't made by the identity provider", e.Local)
+}
+
+// exclusiveC14NPrefixes returns the InclusiveNamespaces PrefixList of an
+// exclusive canonicalization method or transform.
+func exclusiveC14NPrefixes(e *xmlElement) []string {
+	inclusive := e.ChildElement(excC14NAlgorithm, "InclusiveNamespaces")
+	if inclusive == nil {
+		return nil
+	}
+	return strings.Fields(inclusive.Attr("PrefixList"))
+}
+
+func removeWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/mail"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// SubmitTokenPath is the client API path which validation tokens are submitted to.
+const SubmitTokenPath = "/_matrix/client/r0/account/3pid/email/submitToken"
+
+// ErrInvalidToken is returned by SubmitToken when the session doesn't exist,
+// has expired or was sent a different token.
+var ErrInvalidToken = errors.New("the validation token is invalid or has expired")
+
+// ErrSessionNotFound is returned by CheckAssociation when there is no session
+// with the given ID and client secret, or it has expired.
+var ErrSessionNotFound = errors.New("no validation session was found")
+
+// ErrTooManySends is returned by CreateSession when a client asks for the
+// token to be sent again more times than a session allows.
+var ErrTooManySends = errors.New("too many emails have been sent for this session")
+
+// How many tokens are sent for a session before it has to expire, however
+// many times the client increases the send_attempt.
+const maxSendsPerSession = 3
+
+// The characters which the spec allows in client secrets.
+var clientSecretRegex = regexp.MustCompile(`^[0-9a-zA-Z.=_\-]{1,255}$`)
+
+// ValidClientSecret returns whether a client secret is allowed by the spec.
+func ValidClientSecret(secret string) bool {
+	return clientSecretRegex.MatchString(secret)
+}
+
+// EmailValidator validates email addresses itself, by emailing them tokens
+// which the user has to submit back, rather than leaving it to an identity
+// server.
+type EmailValidator struct {
+	db     accounts.Database
+	mailer mail.Sender
+	cfg    *config.Email
+}
+
+// NewEmailValidator creates an email validator which sends emails with the
+// given sender.
+func NewEmailValidator(db accounts.Database, mailer mail.Sender, cfg *config.Email) *EmailValidator {
+	return &EmailValidator{
+		db:     db,
+		mailer: mailer,
+		cfg:    cfg,
+	}
+}
+
+// SubmitURL returns the URL which clients can submit validation tokens to.
+func (v *EmailValidator) SubmitURL() string {
+	return strings.TrimSuffix(v.cfg.PublicBaseURL, "/") + SubmitTokenPath
+}
+
+// CreateSession starts a session validating the email address in the request,
+// emailing it a token. Returns the session's ID.
+// Requests with the same client secret and email address continue the same
+// session, and the email is only sent again if the send attempt has increased.
+func (v *EmailValidator) CreateSession(ctx context.Context, req EmailAssociationRequest) (string, error) {
+	session, err := v.db.GetThreePIDSessionByClientSecret(ctx, req.Secret, "email", req.Email)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if session != nil && session.ExpiresTS.Time().After(now) {
+		if req.SendAttempt <= session.SendAttempt {
+			return session.SessionID, nil
+		}
+		if session.SendCount >= maxSendsPerSession {
+			return "", ErrTooManySends
+		}
+	} else if session != nil {
+		session.SendCount = 0
+	}
+	if session == nil {
+		sessionID, err := randomString(16)
+		if err != nil {
+			return "", err
+		}
+		session = &authtypes.ThreePIDSession{
+			SessionID:    sessionID,
+			ClientSecret: req.Secret,
+			Medium:       "email",
+			Address:      req.Email,
+		}
+	}
+	if session.Token, err = randomString(32); err != nil {
+		return "", err
+	}
+	session.SendAttempt = req.SendAttempt
+	session.SendCount++
+	session.ExpiresTS = gomatrixserverlib.AsTimestamp(now.Add(v.cfg.TokenLifetime))
+	if err = v.db.SaveThreePIDSession(ctx, session); err != nil {
+		return "", err
+	}
+
+	link := v.SubmitURL() + "?" + url.Values{
+		"sid":           []string{session.SessionID},
+		"client_secret": []string{session.ClientSecret},
+		"token":         []string{session.Token},
+	}.Encode()
+	body := fmt.Sprintf(
+		"To confirm that this is your email address, follow this link:\n\n%s\n\n"+
+			"The link works for %s. If you didn't ask for this, you can ignore this email.\n",
+		link, v.cfg.TokenLifetime,
+	)
+	if err = v.mailer.Send(req.Email, "Confirm your email address", body); err != nil {
+		return "", err
+	}
+	return session.SessionID, nil
+}
+
+// SubmitToken marks a session as validated if the token is the one which was
+// emailed for it. Returns ErrInvalidToken if it isn't.
+func (v *EmailValidator) SubmitToken(ctx context.Context, sessionID, clientSecret, token string) error {
+	session, err := v.db.GetThreePIDSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if session == nil || session.ClientSecret != clientSecret || !session.ExpiresTS.Time().After(now) ||
+		subtle.ConstantTimeCompare([]byte(session.Token), []byte(token)) != 1 {
+		return ErrInvalidToken
+	}
+	if session.ValidatedTS == 0 {
+		session.ValidatedTS = gomatrixserverlib.AsTimestamp(now)
+		return v.db.SaveThreePIDSession(ctx, session)
+	}
+	return nil
+}
+
+// CheckAssociation checks whether a session has been validated, in the same way
+// as the CheckAssociation function does for identity servers. Returns
+// ErrSessionNotFound if there is no such session.
+// If the session has been validated, also returns the related third-party
+// identifier and its medium.
+func (v *EmailValidator) CheckAssociation(ctx context.Context, sessionID, clientSecret string) (bool, string, string, error) {
+	session, err := v.db.GetThreePIDSession(ctx, sessionID)
+	if err != nil {
+		return false, "", "", err
+	}
+	if session == nil || session.ClientSecret != clientSecret || !session.ExpiresTS.Time().After(time.Now()) {
+		return false, "", "", ErrSessionNotFound
+	}
+	if session.ValidatedTS == 0 {
+		return false, "", "", nil
+	}
+	return true, session.Address, session.Medium, nil
+}
+
+// RemoveSession forgets a session once the third-party identifier that it
+// validated has been used, so that it can't be used again. Returns false if
+// the session had already been removed, e.g. by a concurrent request.
+func (v *EmailValidator) RemoveSession(ctx context.Context, sessionID string) (bool, error) {
+	return v.db.RemoveThreePIDSession(ctx, sessionID)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type sentEmail struct {
+	to, subject, body string
+}
+
+type fakeMailer struct {
+	sent []sentEmail
+}
+
+func (m *fakeMailer) Send(to, subject, body string) error {
+	m.sent = append(m.sent, sentEmail{to, subject, body})
+	return nil
+}
+
+var linkRegex = regexp.MustCompile(`https://\S+`)
+
+func TestEmailValidation(t *testing.T) {
+	ctx := context.Background()
+	db, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	mailer := &fakeMailer{}
+	v := NewEmailValidator(db, mailer, &config.Email{
+		SMTPAddress:   "localhost:25",
+		From:          "matrix@localhost",
+		PublicBaseURL: "https://matrix.localhost/",
+		TokenLifetime: time.Hour,
+	})
+
+	req := EmailAssociationRequest{Secret: "secret", Email: "alice@localhost", SendAttempt: 1}
+	sid, err := v.CreateSession(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateSession failed: %s", err)
+	}
+	// Retrying with the same send attempt mustn't send another email.
+	if again, err := v.CreateSession(ctx, req); err != nil || again != sid {
+		t.Fatalf("retried CreateSession returned %q, %v, want %q", again, err, sid)
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "alice@localhost" {
+		t.Fatalf("expected one email to alice@localhost, got %+v", mailer.sent)
+	}
+
+	link, err := url.Parse(linkRegex.FindString(mailer.sent[0].body))
+	if err != nil {
+		t.Fatalf("failed to parse the link in the email: %s", err)
+	}
+	if link.Path != SubmitTokenPath || link.Query().Get("sid") != sid {
+		t.Fatalf("wrong link in the email: %s", link)
+	}
+	token := link.Query().Get("token")
+
+	if verified, _, _, err := v.CheckAssociation(ctx, sid, "secret"); err != nil || verified {
+		t.Fatalf("session should not be validated before the token is submitted, got %v, %v", verified, err)
+	}
+	if err = v.SubmitToken(ctx, sid, "secret", "wrong"); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for the wrong token, got %v", err)
+	}
+	if err = v.SubmitToken(ctx, sid, "other", token); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for the wrong client secret, got %v", err)
+	}
+	if err = v.SubmitToken(ctx, sid, "secret", token); err != nil {
+		t.Fatalf("SubmitToken failed: %s", err)
+	}
+
+	verified, address, medium, err := v.CheckAssociation(ctx, sid, "secret")
+	if err != nil || !verified || address != "alice@localhost" || medium != "email" {
+		t.Fatalf("CheckAssociation returned %v, %q, %q, %v", verified, address, medium, err)
+	}
+	if _, _, _, err = v.CheckAssociation(ctx, sid, "other"); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound for the wrong client secret, got %v", err)
+	}
+	if removed, err := v.RemoveSession(ctx, sid); err != nil || !removed {
+		t.Fatalf("RemoveSession returned %v, %v", removed, err)
+	}
+	if _, _, _, err = v.CheckAssociation(ctx, sid, "secret"); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound after removing the session, got %v", err)
+	}
+	if removed, err := v.RemoveSession(ctx, sid); err != nil || removed {
+		t.Fatalf("RemoveSession of a removed session returned %v, %v", removed, err)
+	}
+}
+
+func TestEmailValidationResendLimit(t *testing.T) {
+	ctx := context.Background()
+	db, err := accounts.NewDatabase("file::memory:", nil, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create accounts database: %s", err)
+	}
+	mailer := &fakeMailer{}
+	v := NewEmailValidator(db, mailer, &config.Email{
+		SMTPAddress:   "localhost:25",
+		From:          "matrix@localhost",
+		PublicBaseURL: "https://matrix.localhost/",
+		TokenLifetime: time.Hour,
+	})
+
+	req := EmailAssociationRequest{Secret: "secret", Email: "alice@localhost"}
+	var sid string
+	for i := 1; i <= maxSendsPerSession; i++ {
+		req.SendAttempt = i
+		if sid, err = v.CreateSession(ctx, req); err != nil {
+			t.Fatalf("CreateSession with send attempt %d failed: %s", i, err)
+		}
+	}
+	if len(mailer.sent) != maxSendsPerSession {
+		t.Fatalf("got %d emails, want %d", len(mailer.sent), maxSendsPerSession)
+	}
+
+	// Retrying the last send attempt is still fine, but asking for another
+	// email isn't.
+	if again, err := v.CreateSession(ctx, req); err != nil || again != sid {
+		t.Fatalf("retried CreateSession returned %q, %v, want %q", again, err, sid)
+	}
+	req.SendAttempt++
+	if _, err = v.CreateSession(ctx, req); err != ErrTooManySends {
+		t.Fatalf("expected ErrTooManySends, got %v", err)
+	}
+	if len(mailer.sent) != maxSendsPerSession {
+		t.Fatalf("got %d emails after the limit, want %d", len(mailer.sent), maxSendsPerSession)
+	}
+}
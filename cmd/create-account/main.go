@@ -39,6 +39,7 @@ var (
 	password      = flag.String("password", "", "Optional. The password to register with. If not specified, this account will be password-less.")
 	serverNameStr = flag.String("servername", "localhost", "The Matrix server domain which will form the domain part of the user ID.")
 	accessToken   = flag.String("token", "", "Optional. The desired access_token to have. If not specified, a random access_token will be made.")
+	isAdmin       = flag.Bool("admin", false, "Optional. Makes the account a server administrator, who can use the admin API.")
 )
 
 func main() {
@@ -75,6 +76,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *isAdmin {
+		if err = accountDB.SetAdmin(context.Background(), *username, true); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+
 	deviceDB, err := devices.NewDatabase(*database, nil, serverName)
 	if err != nil {
 		fmt.Println(err.Error())
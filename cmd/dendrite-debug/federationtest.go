@@ -0,0 +1,269 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const federationTestUsage = `Usage: %s federation-test [arguments]
+
+Check the things which other servers need in order to federate with this
+server: that the server name resolves, that the server presents a valid TLS
+certificate, that it serves its signing key, and that another server on the
+federation can fetch that key.
+
+Arguments:
+
+`
+
+// certificateExpiryWarning is how close to expiring a TLS certificate can be
+// before the test warns about it.
+const certificateExpiryWarning = 14 * 24 * time.Hour
+
+// federationTester runs the checks for federation-test and keeps track of
+// whether any of them failed.
+type federationTester struct {
+	cfg        *config.Dendrite
+	client     *gomatrixserverlib.Client
+	testServer gomatrixserverlib.ServerName
+	timeout    time.Duration
+	// The certificate authorities which TLS certificates are checked
+	// against, or nil for the system ones.
+	rootCAs *x509.CertPool
+	// Where the results of the checks are written to.
+	out    io.Writer
+	failed bool
+}
+
+// context returns a context for a single request made by a check.
+func (t *federationTester) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), t.timeout)
+}
+
+func (t *federationTester) ok(format string, args ...interface{}) {
+	fmt.Fprintf(t.out, "[ OK ] "+format+"\n", args...)
+}
+
+func (t *federationTester) warn(format string, args ...interface{}) {
+	fmt.Fprintf(t.out, "[WARN] "+format+"\n", args...)
+}
+
+// fail reports a failed check, along with a hint about how to fix it.
+func (t *federationTester) fail(hint, format string, args ...interface{}) {
+	t.failed = true
+	fmt.Fprintf(t.out, "[FAIL] "+format+"\n", args...)
+	fmt.Fprintf(t.out, "       %s\n", hint)
+}
+
+// federationTest implements the federation-test command. Returns the exit
+// code.
+func federationTest(args []string) int {
+	flags := flag.NewFlagSet("federation-test", flag.ExitOnError)
+	configPath := flags.String("config", "dendrite.yaml", "The path to the Dendrite config file.")
+	testServer := flags.String("test-server", "matrix.org", "A server on the federation to test against.")
+	timeout := flags.Duration("timeout", 30*time.Second, "How long to wait for each request.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, federationTestUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	cfg, err := config.Load(*configPath, true)
+	if err != nil {
+		fmt.Printf("Failed to load the config: %s\n", err)
+		return 1
+	}
+
+	t := &federationTester{
+		cfg:        cfg,
+		client:     gomatrixserverlib.NewClient(),
+		testServer: gomatrixserverlib.ServerName(*testServer),
+		timeout:    *timeout,
+		out:        os.Stdout,
+	}
+
+	fmt.Printf("Testing federation for %s\n", cfg.Matrix.ServerName)
+	if results := t.checkResolution(); len(results) > 0 {
+		for _, result := range results {
+			t.checkTLS(result)
+		}
+		t.checkServerKeys()
+	}
+	t.checkTestServer()
+
+	if t.failed {
+		fmt.Println("Some checks failed: other servers won't be able to federate with this server until they are fixed.")
+		return 1
+	}
+	fmt.Println("All checks passed.")
+	return 0
+}
+
+// checkResolution resolves our own server name in the way that other servers
+// do, using .well-known and SRV records.
+func (t *federationTester) checkResolution() []gomatrixserverlib.ResolutionResult {
+	serverName := t.cfg.Matrix.ServerName
+	results, err := gomatrixserverlib.ResolveServer(serverName)
+	if err != nil || len(results) == 0 {
+		t.fail(
+			"Check that server_name in the config is the domain part of your user IDs.",
+			"Server name %s could not be resolved: %v", serverName, err,
+		)
+		return nil
+	}
+	if wellKnown, err := gomatrixserverlib.LookupWellKnown(serverName); err == nil {
+		t.ok("https://%s/.well-known/matrix/server delegates to %s", serverName, wellKnown.NewAddress)
+	} else {
+		t.ok("No .well-known delegation for %s (%s)", serverName, err)
+	}
+	for _, result := range results {
+		t.ok("Other servers will connect to %s for %s", result.Destination, serverName)
+	}
+	return results
+}
+
+// checkTLS connects to a resolved address and checks that the certificate is
+// valid for the TLS server name, which other servers require.
+func (t *federationTester) checkTLS(result gomatrixserverlib.ResolutionResult) {
+	dialer := &net.Dialer{Timeout: t.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", result.Destination, &tls.Config{
+		ServerName: result.TLSServerName,
+		RootCAs:    t.rootCAs,
+	})
+	if err != nil {
+		hint := "Check that Dendrite, or the reverse proxy in front of it, is listening on this address and can be reached from the internet."
+		// Newer versions of Go wrap the certificate errors from the handshake.
+		var unknownAuthorityErr x509.UnknownAuthorityError
+		var hostnameErr x509.HostnameError
+		if errors.As(err, &unknownAuthorityErr) {
+			hint = "Federation needs a certificate signed by a trusted certificate authority, such as Let's Encrypt, rather than a self-signed one."
+		} else if errors.As(err, &hostnameErr) {
+			hint = fmt.Sprintf("The certificate must be valid for %s.", result.TLSServerName)
+		}
+		t.fail(hint, "TLS connection to %s failed: %s", result.Destination, err)
+		return
+	}
+	defer conn.Close() // nolint: errcheck
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		t.fail("Check the TLS configuration of the server.", "%s presented no certificate", result.Destination)
+		return
+	}
+	expiry := certs[0].NotAfter
+	if time.Until(expiry) < certificateExpiryWarning {
+		t.warn("The certificate for %s expires soon, on %s", result.TLSServerName, expiry.Format(time.RFC1123))
+		return
+	}
+	t.ok("%s has a valid certificate for %s, expiring %s", result.Destination, result.TLSServerName, expiry.Format(time.RFC1123))
+}
+
+// checkServerKeys fetches our signing keys over federation and checks that
+// they match the key in the config and are correctly signed.
+func (t *federationTester) checkServerKeys() {
+	serverName := t.cfg.Matrix.ServerName
+	keyID := t.cfg.Matrix.KeyID
+	ctx, cancel := t.context()
+	defer cancel()
+	keys, err := t.client.GetServerKeys(ctx, serverName)
+	if err != nil {
+		t.fail(
+			"Check that /_matrix/key/v2/server is routed to Dendrite.",
+			"Failed to fetch the signing keys of %s: %s", serverName, err,
+		)
+		return
+	}
+	if keys.ServerName != serverName {
+		t.fail(
+			"Another server is answering requests for this server name.",
+			"The keys served are for %s rather than %s", keys.ServerName, serverName,
+		)
+		return
+	}
+	publicKey := t.cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey)
+	verifyKey, ok := keys.VerifyKeys[keyID]
+	if !ok || !ed25519.PublicKey(verifyKey.Key).Equal(publicKey) {
+		t.fail(
+			"Check that the server serving the keys is using the private key in the config.",
+			"The keys served don't include the key %s from the config", keyID,
+		)
+		return
+	}
+	if err = gomatrixserverlib.VerifyJSON(string(serverName), keyID, publicKey, keys.Raw); err != nil {
+		t.fail(
+			"Check that the server serving the keys is using the private key in the config.",
+			"The keys served aren't correctly signed: %s", err,
+		)
+		return
+	}
+	if !keys.ValidUntilTS.Time().After(time.Now()) {
+		t.fail("Check the clock of the server.", "The keys served expired at %s", keys.ValidUntilTS.Time())
+		return
+	}
+	t.ok("%s serves its signing key %s", serverName, keyID)
+}
+
+// checkTestServer checks that we can reach another server, and that it can
+// fetch our keys, which is what it has to do before it accepts any request
+// from us.
+func (t *federationTester) checkTestServer() {
+	ctx, cancel := t.context()
+	defer cancel()
+	version, err := t.client.GetVersion(ctx, t.testServer)
+	if err != nil {
+		t.fail(
+			"Check that this machine can make outgoing connections and resolve DNS.",
+			"Failed to reach %s: %s", t.testServer, err,
+		)
+		return
+	}
+	t.ok("Reached %s, which is running %s %s", t.testServer, version.Server.Name, version.Server.Version)
+
+	serverName := t.cfg.Matrix.ServerName
+	keyID := t.cfg.Matrix.KeyID
+	results, err := t.client.LookupServerKeys(ctx, t.testServer, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		{ServerName: serverName, KeyID: keyID}: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.fail(
+			"The test server could not be asked for our keys, so it may be having problems.",
+			"Failed to query %s for the keys of %s: %s", t.testServer, serverName, err,
+		)
+		return
+	}
+	for _, keys := range results {
+		if _, ok := keys.VerifyKeys[keyID]; ok && keys.ServerName == serverName {
+			t.ok("%s can fetch the signing key of %s", t.testServer, serverName)
+			return
+		}
+	}
+	t.fail(
+		"The test server couldn't reach this server: check the failures above, and that port 8448 or the delegated port isn't blocked by a firewall.",
+		"%s could not fetch the signing key %s of %s", t.testServer, keyID, serverName,
+	)
+}
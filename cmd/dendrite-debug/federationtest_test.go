@@ -0,0 +1,181 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newTestFederationTester(serverName gomatrixserverlib.ServerName) (*federationTester, ed25519.PrivateKey, *bytes.Buffer) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	var cfg config.Dendrite
+	cfg.Matrix.ServerName = serverName
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+	out := &bytes.Buffer{}
+	return &federationTester{
+		cfg:     &cfg,
+		client:  gomatrixserverlib.NewClient(),
+		timeout: 5 * time.Second,
+		out:     out,
+	}, privateKey, out
+}
+
+func TestCheckTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(srv.Certificate())
+	destination := srv.Listener.Addr().String()
+
+	closed := httptest.NewTLSServer(http.NotFoundHandler())
+	closed.Close()
+
+	testCases := []struct {
+		name          string
+		rootCAs       *x509.CertPool
+		destination   string
+		tlsServerName string
+		wantFailed    bool
+		wantOutput    string
+	}{
+		{"valid certificate", trusted, destination, "example.com", false, "[ OK ] " + destination + " has a valid certificate for example.com"},
+		{"self-signed certificate", nil, destination, "example.com", true, "rather than a self-signed one"},
+		{"wrong hostname", trusted, destination, "example.org", true, "The certificate must be valid for example.org."},
+		{"not listening", trusted, closed.Listener.Addr().String(), "example.com", true, "is listening on this address"},
+	}
+	for _, tc := range testCases {
+		tester, _, out := newTestFederationTester("example.com")
+		tester.rootCAs = tc.rootCAs
+		tester.checkTLS(gomatrixserverlib.ResolutionResult{
+			Destination:   tc.destination,
+			TLSServerName: tc.tlsServerName,
+		})
+		if tester.failed != tc.wantFailed {
+			t.Errorf("%s: got failed %v, want %v\n%s", tc.name, tester.failed, tc.wantFailed, out)
+		}
+		if !strings.Contains(out.String(), tc.wantOutput) {
+			t.Errorf("%s: output doesn't contain %q:\n%s", tc.name, tc.wantOutput, out)
+		}
+	}
+}
+
+func TestCheckServerKeys(t *testing.T) {
+	// The keys handed out for each request, signed by the server.
+	var keys gomatrixserverlib.ServerKeyFields
+	var signingKey ed25519.PrivateKey
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/key/v2/server" {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := json.Marshal(keys)
+		if err != nil {
+			panic(err)
+		}
+		if body, err = gomatrixserverlib.SignJSON(string(keys.ServerName), "ed25519:test", signingKey, body); err != nil {
+			panic(err)
+		}
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+	serverName := gomatrixserverlib.ServerName(srv.Listener.Addr().String())
+
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		serverName gomatrixserverlib.ServerName
+		keyID      gomatrixserverlib.KeyID
+		otherKey   bool
+		validUntil time.Time
+		wantFailed bool
+		wantOutput string
+	}{
+		{"valid keys", serverName, "ed25519:test", false, time.Now().Add(time.Hour), false, "serves its signing key ed25519:test"},
+		{"keys for another server", "other.example.com", "ed25519:test", false, time.Now().Add(time.Hour), true, "rather than " + string(serverName)},
+		{"missing key ID", serverName, "ed25519:other", false, time.Now().Add(time.Hour), true, "don't include the key ed25519:test"},
+		{"another private key", serverName, "ed25519:test", true, time.Now().Add(time.Hour), true, "don't include the key ed25519:test"},
+		{"expired keys", serverName, "ed25519:test", false, time.Now().Add(-time.Hour), true, "The keys served expired"},
+	}
+	for _, tc := range testCases {
+		tester, privateKey, out := newTestFederationTester(serverName)
+		signingKey = privateKey
+		publicKey := privateKey.Public().(ed25519.PublicKey)
+		if tc.otherKey {
+			signingKey = otherKey
+			publicKey = otherKey.Public().(ed25519.PublicKey)
+		}
+		keys = gomatrixserverlib.ServerKeyFields{
+			ServerName: tc.serverName,
+			VerifyKeys: map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+				tc.keyID: {Key: gomatrixserverlib.Base64Bytes(publicKey)},
+			},
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(tc.validUntil),
+		}
+		tester.checkServerKeys()
+		if tester.failed != tc.wantFailed {
+			t.Errorf("%s: got failed %v, want %v\n%s", tc.name, tester.failed, tc.wantFailed, out)
+		}
+		if !strings.Contains(out.String(), tc.wantOutput) {
+			t.Errorf("%s: output doesn't contain %q:\n%s", tc.name, tc.wantOutput, out)
+		}
+	}
+}
+
+func TestCheckServerKeysBadSignature(t *testing.T) {
+	var publicKey ed25519.PublicKey
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.Marshal(gomatrixserverlib.ServerKeyFields{
+			ServerName: gomatrixserverlib.ServerName(r.Host),
+			VerifyKeys: map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+				"ed25519:test": {Key: gomatrixserverlib.Base64Bytes(publicKey)},
+			},
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		})
+		if err != nil {
+			panic(err)
+		}
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	tester, privateKey, out := newTestFederationTester(gomatrixserverlib.ServerName(srv.Listener.Addr().String()))
+	publicKey = privateKey.Public().(ed25519.PublicKey)
+	tester.checkServerKeys()
+	if !tester.failed {
+		t.Errorf("unsigned keys passed the check:\n%s", out)
+	}
+	if want := "aren't correctly signed"; !strings.Contains(out.String(), want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out)
+	}
+}
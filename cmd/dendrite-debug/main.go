@@ -0,0 +1,51 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: %s <command> [arguments]
+
+Debugging tools for Dendrite deployments.
+
+Commands:
+
+  federation-test  Check that other servers can federate with this server.
+
+Run %s <command> --help for the arguments of a command.
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0], os.Args[0])
+	}
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "federation-test":
+		os.Exit(federationTest(os.Args[2:]))
+	default:
+		flag.Usage()
+		fmt.Printf("Unknown command %q\n", os.Args[1])
+		os.Exit(1)
+	}
+}
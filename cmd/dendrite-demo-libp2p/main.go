@@ -139,7 +139,8 @@ func main() {
 	accountDB := base.Base.CreateAccountsDB()
 	deviceDB := base.Base.CreateDeviceDB()
 	federation := createFederationClient(base)
-	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, nil)
+	stateAPI := currentstateserver.NewInternalAPI(base.Base.Cfg, base.Base.KafkaConsumer)
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, nil, nil, stateAPI)
 
 	serverKeyAPI := serverkeyapi.NewInternalAPI(
 		base.Base.Cfg, federation, base.Base.Caches,
@@ -160,7 +161,6 @@ func main() {
 		&base.Base, federation, rsAPI, keyRing,
 	)
 	rsAPI.SetFederationSenderAPI(fsAPI)
-	stateAPI := currentstateserver.NewInternalAPI(base.Base.Cfg, base.Base.KafkaConsumer)
 	provider := newPublicRoomsProvider(base.LibP2PPubsub, rsAPI, stateAPI)
 	err = provider.Start()
 	if err != nil {
@@ -176,6 +176,7 @@ func main() {
 		KeyRing:       keyRing,
 		KafkaConsumer: base.Base.KafkaConsumer,
 		KafkaProducer: base.Base.KafkaProducer,
+		Caches:        base.Base.Caches,
 
 		AppserviceAPI:          asAPI,
 		EDUInternalAPI:         eduInputAPI,
@@ -186,7 +187,7 @@ func main() {
 		UserAPI:                userAPI,
 		ExtPublicRoomsProvider: provider,
 	}
-	monolith.AddAllPublicRoutes(base.Base.PublicAPIMux)
+	monolith.AddAllPublicRoutes(base.Base.PublicAPIMux, base.Base.DendriteAdminMux)
 
 	httputil.SetupHTTPAPI(
 		base.Base.BaseMux,
@@ -101,7 +101,8 @@ func main() {
 	serverKeyAPI := &signing.YggdrasilKeys{}
 	keyRing := serverKeyAPI.KeyRing()
 
-	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, nil)
+	stateAPI := currentstateserver.NewInternalAPI(base.Cfg, base.KafkaConsumer)
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, cfg.Matrix.ServerName, nil, nil, stateAPI)
 
 	rsComponent := roomserver.NewInternalAPI(
 		base, keyRing, federation,
@@ -122,8 +123,6 @@ func main() {
 
 	embed.Embed(base.BaseMux, *instancePort, "Yggdrasil Demo")
 
-	stateAPI := currentstateserver.NewInternalAPI(base.Cfg, base.KafkaConsumer)
-
 	monolith := setup.Monolith{
 		Config:        base.Cfg,
 		AccountDB:     accountDB,
@@ -133,6 +132,7 @@ func main() {
 		KeyRing:       keyRing,
 		KafkaConsumer: base.KafkaConsumer,
 		KafkaProducer: base.KafkaProducer,
+		Caches:        base.Caches,
 
 		AppserviceAPI:       asAPI,
 		EDUInternalAPI:      eduInputAPI,
@@ -145,7 +145,7 @@ func main() {
 			ygg, fsAPI, federation,
 		),
 	}
-	monolith.AddAllPublicRoutes(base.PublicAPIMux)
+	monolith.AddAllPublicRoutes(base.PublicAPIMux, base.DendriteAdminMux)
 
 	httputil.SetupHTTPAPI(
 		base.BaseMux,
@@ -0,0 +1,117 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/moderation"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const usage = `Usage: %s [--delete|--quarantine] mxc://server/mediaid...
+
+Delete or quarantine media in the media repository. Files shared with other
+media are only removed once nothing else which can be served refers to them.
+
+Arguments:
+
+`
+
+var (
+	database   = flag.String("database", "", "The location of the media API database.")
+	basePath   = flag.String("base-path", "", "The media.base_path the media API is configured with.")
+	del        = flag.Bool("delete", false, "Delete the media and forget about it entirely.")
+	quarantine = flag.Bool("quarantine", false, "Stop serving the media, without allowing it to be fetched again.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *database == "" {
+		flag.Usage()
+		fmt.Println("Missing --database")
+		os.Exit(1)
+	}
+
+	if *basePath == "" {
+		flag.Usage()
+		fmt.Println("Missing --base-path")
+		os.Exit(1)
+	}
+
+	if *del == *quarantine {
+		flag.Usage()
+		fmt.Println("Exactly one of --delete or --quarantine must be given")
+		os.Exit(1)
+	}
+
+	absBasePath, err := filepath.Abs(*basePath)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	mediaDB, err := storage.Open(*database, nil)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, uri := range flag.Args() {
+		origin, mediaID, ok := parseMXC(uri)
+		if !ok {
+			fmt.Printf("Invalid media URI: %s\n", uri)
+			failed = true
+			continue
+		}
+		if *del {
+			err = moderation.DeleteMedia(context.Background(), mediaDB, config.Path(absBasePath), mediaID, origin)
+		} else {
+			err = moderation.QuarantineMedia(context.Background(), mediaDB, config.Path(absBasePath), mediaID, origin)
+		}
+		if err != nil {
+			fmt.Printf("Failed to process %s: %s\n", uri, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Processed %s\n", uri)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func parseMXC(uri string) (gomatrixserverlib.ServerName, types.MediaID, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "mxc://"), "/", 2)
+	if !strings.HasPrefix(uri, "mxc://") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return gomatrixserverlib.ServerName(parts[0]), types.MediaID(parts[1]), true
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/integrity"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+)
+
+const usage = `Usage: %s
+
+Check the media repository metadata against the files stored on disk, and
+report the space used by each origin and user. Nothing is removed unless
+--repair is given.
+
+Arguments:
+
+`
+
+var (
+	database       = flag.String("database", "", "The location of the media API database.")
+	basePath       = flag.String("base-path", "", "The media.base_path the media API is configured with.")
+	repair         = flag.Bool("repair", false, "Remove orphaned files and metadata for files which no longer exist.")
+	hashCheckEvery = flag.Int("hash-check-every", 10, "Hash the contents of every Nth media file to make sure it isn't corrupt. 0 disables hash checks.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *database == "" {
+		flag.Usage()
+		fmt.Println("Missing --database")
+		os.Exit(1)
+	}
+
+	if *basePath == "" {
+		flag.Usage()
+		fmt.Println("Missing --base-path")
+		os.Exit(1)
+	}
+
+	absBasePath, err := filepath.Abs(*basePath)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	mediaDB, err := storage.Open(*database, nil)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	report, err := integrity.Check(context.Background(), mediaDB, config.Path(absBasePath), integrity.Options{
+		Repair:         *repair,
+		HashCheckEvery: *hashCheckEvery,
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	action := "Found"
+	if *repair {
+		action = "Removed"
+	}
+
+	fmt.Printf("Checked %d files, hashed %d\n", report.FilesChecked, report.HashesChecked)
+	for _, path := range report.HashMismatches {
+		fmt.Printf("Hash mismatch: %s\n", path)
+	}
+	for _, path := range report.SizeMismatches {
+		fmt.Printf("Size mismatch: %s\n", path)
+	}
+	for _, media := range report.DanglingMedia {
+		fmt.Printf("%s metadata without a file: mxc://%s/%s\n", action, media.Origin, media.MediaID)
+	}
+	for _, thumbnail := range report.DanglingThumbnails {
+		fmt.Printf(
+			"%s thumbnail metadata without a file: mxc://%s/%s (%dx%d %s)\n", action,
+			thumbnail.MediaMetadata.Origin, thumbnail.MediaMetadata.MediaID,
+			thumbnail.ThumbnailSize.Width, thumbnail.ThumbnailSize.Height, thumbnail.ThumbnailSize.ResizeMethod,
+		)
+	}
+	for _, path := range report.OrphanedFiles {
+		fmt.Printf("%s orphaned file: %s\n", action, path)
+	}
+	fmt.Printf("%s %d orphaned files taking up %d bytes\n", action, len(report.OrphanedFiles), report.OrphanedBytes)
+
+	fmt.Println("Usage by origin:")
+	totals := make(map[string]*integrity.Usage, len(report.OriginUsage))
+	for origin, u := range report.OriginUsage {
+		totals[string(origin)] = u
+	}
+	printUsage(totals)
+
+	fmt.Println("Usage by user:")
+	totals = make(map[string]*integrity.Usage, len(report.UserUsage))
+	for userID, u := range report.UserUsage {
+		totals[string(userID)] = u
+	}
+	printUsage(totals)
+}
+
+func printUsage(usage map[string]*integrity.Usage) {
+	keys := make([]string, 0, len(usage))
+	for key := range usage {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s: %d files, %d bytes\n", key, usage[key].Files, usage[key].Bytes)
+	}
+}
@@ -31,16 +31,37 @@ type CurrentStateInternalAPI interface {
 	QueryRoomsForUser(ctx context.Context, req *QueryRoomsForUserRequest, res *QueryRoomsForUserResponse) error
 	// QueryBulkStateContent does a bulk query for state event content in the given rooms.
 	QueryBulkStateContent(ctx context.Context, req *QueryBulkStateContentRequest, res *QueryBulkStateContentResponse) error
+	// QuerySearchUserDirectory searches for users who share a room with the searcher or are in public rooms.
+	QuerySearchUserDirectory(ctx context.Context, req *QuerySearchUserDirectoryRequest, res *QuerySearchUserDirectoryResponse) error
+	// PerformUpdateUserDirectory stores the global profiles of local users in the user directory.
+	PerformUpdateUserDirectory(ctx context.Context, req *PerformUpdateUserDirectoryRequest, res *PerformUpdateUserDirectoryResponse) error
+	// QuerySearchRooms searches the names, canonical aliases and topics of the given rooms.
+	QuerySearchRooms(ctx context.Context, req *QuerySearchRoomsRequest, res *QuerySearchRoomsResponse) error
 }
 
 type QueryRoomsForUserRequest struct {
 	UserID string
 	// The desired membership of the user. If this is the empty string then no rooms are returned.
 	WantMembership string
+	// Any other memberships to return rooms for along with WantMembership, so that e.g. joined,
+	// invited and left rooms can be fetched in one query.
+	WantMemberships []string
+	// If true, rooms are returned ordered by the timestamp of their most recent event, newest first.
+	OrderByLastActivity bool
 }
 
 type QueryRoomsForUserResponse struct {
 	RoomIDs []string
+	// The user's membership in each room, in the same order as RoomIDs.
+	Rooms []RoomForUser
+}
+
+// RoomForUser is a room in which a user has one of the memberships asked for.
+type RoomForUser struct {
+	RoomID     string
+	Membership string
+	// The origin_server_ts of the most recent event in the room, or 0 if we haven't seen any.
+	LastActivityTS gomatrixserverlib.Timestamp
 }
 
 type QueryBulkStateContentRequest struct {
@@ -58,6 +79,7 @@ type QueryBulkStateContentRequest struct {
 	//   m.room.join_rules
 	//   m.room.member
 	//   m.room.name
+	//   m.room.pinned_events (the content value is the JSON list of event IDs)
 	//   m.room.topic
 	// Any other tuple type will result in the query failing.
 	StateTuples []gomatrixserverlib.StateKeyTuple
@@ -67,6 +89,48 @@ type QueryBulkStateContentResponse struct {
 	Rooms map[string]map[gomatrixserverlib.StateKeyTuple]string
 }
 
+type QuerySearchUserDirectoryRequest struct {
+	// The user who is searching.
+	UserID string
+	// Matched against the user IDs and display names of users, ignoring case.
+	SearchString string
+	Limit        int
+}
+
+type QuerySearchUserDirectoryResponse struct {
+	Users []UserDirectoryEntry
+	// True if there were more matching users than the limit.
+	Limited bool
+}
+
+type PerformUpdateUserDirectoryRequest struct {
+	// The global profiles of local users, replacing what the user directory has for them.
+	Profiles []UserDirectoryEntry
+}
+
+type PerformUpdateUserDirectoryResponse struct {
+}
+
+type QuerySearchRoomsRequest struct {
+	// Every word is matched against the start of the words in the room name, canonical alias and topic, ignoring case.
+	SearchString string
+	// The rooms to search.
+	RoomIDs []string
+}
+
+type QuerySearchRoomsResponse struct {
+	// The types of the state events which matched in each room, out of m.room.name, m.room.canonical_alias and
+	// m.room.topic. Rooms which didn't match are missing.
+	Matches map[string][]string
+}
+
+// UserDirectoryEntry is the profile of a user found by searching the user directory.
+type UserDirectoryEntry struct {
+	UserID      string
+	DisplayName string
+	AvatarURL   string
+}
+
 type QueryCurrentStateRequest struct {
 	RoomID      string
 	StateTuples []gomatrixserverlib.StateKeyTuple
@@ -17,6 +17,7 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/currentstateserver/storage"
@@ -30,6 +31,20 @@ import (
 type OutputRoomEventConsumer struct {
 	rsConsumer *internal.ContinualConsumer
 	db         storage.Database
+	backoff    func(attempt int) time.Duration
+}
+
+const (
+	initialPurgeBackoff = time.Second * 5
+	maxPurgeBackoff     = time.Minute * 10
+)
+
+func purgeBackoff(attempt int) time.Duration {
+	backoff := initialPurgeBackoff << uint(attempt-1)
+	if backoff > maxPurgeBackoff || backoff <= 0 {
+		return maxPurgeBackoff
+	}
+	return backoff
 }
 
 func NewOutputRoomEventConsumer(topicName string, kafkaConsumer sarama.Consumer, store storage.Database) *OutputRoomEventConsumer {
@@ -41,6 +56,7 @@ func NewOutputRoomEventConsumer(topicName string, kafkaConsumer sarama.Consumer,
 	s := &OutputRoomEventConsumer{
 		rsConsumer: consumer,
 		db:         store,
+		backoff:    purgeBackoff,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -63,6 +79,8 @@ func (c *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 	case api.OutputTypeRetireInviteEvent:
 	case api.OutputTypeRedactedEvent:
 		return c.onRedactEvent(context.Background(), *output.RedactedEvent)
+	case api.OutputTypePurgeRoom:
+		return c.onPurgeRoom(context.TODO(), *output.PurgeRoom)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -104,6 +122,13 @@ func (c *OutputRoomEventConsumer) onNewRoomEvent(
 			"del":        msg.RemovesStateEventIDs,
 		}).Panicf("roomserver output log: write event failure")
 	}
+
+	if err = c.db.UpdateRoomActivity(ctx, ev.RoomID(), ev.OriginServerTS()); err != nil {
+		log.WithFields(log.Fields{
+			"event_id":   ev.EventID(),
+			log.ErrorKey: err,
+		}).Error("roomserver output log: failed to update room activity")
+	}
 	return nil
 }
 
@@ -113,6 +138,24 @@ func (c *OutputRoomEventConsumer) onRedactEvent(
 	return c.db.RedactEvent(ctx, msg.RedactedEventID, msg.RedactedBecause)
 }
 
+// onPurgeRoom deletes a room which the roomserver has purged. A failed purge
+// is retried, as skipping it would leave the room behind for good.
+func (c *OutputRoomEventConsumer) onPurgeRoom(
+	ctx context.Context, msg api.OutputPurgeRoom,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := c.db.PurgeRoom(ctx, msg.RoomID)
+		if err == nil {
+			return nil
+		}
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Warn("roomserver output log: purge room failure, will retry")
+		time.Sleep(c.backoff(attempt))
+	}
+}
+
 // Start consuming from room servers
 func (c *OutputRoomEventConsumer) Start() error {
 	return c.rsConsumer.Start()
@@ -35,7 +35,7 @@ func AddInternalRoutes(router *mux.Router, intAPI api.CurrentStateInternalAPI) {
 // NewInternalAPI returns a concrete implementation of the internal API. Callers
 // can call functions directly on the returned API or via an HTTP interface using AddInternalRoutes.
 func NewInternalAPI(cfg *config.Dendrite, consumer sarama.Consumer) api.CurrentStateInternalAPI {
-	csDB, err := storage.NewDatabase(string(cfg.Database.CurrentState), cfg.DbProperties())
+	csDB, err := storage.NewDatabase(string(cfg.Database.CurrentState), string(cfg.Database.ReadReplicas.CurrentState), cfg.DbProperties())
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to open database")
 	}
@@ -17,6 +17,7 @@ package currentstateserver
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"reflect"
 	"testing"
@@ -178,3 +179,235 @@ func TestQueryCurrentState(t *testing.T) {
 		runCases(currStateAPI)
 	})
 }
+
+func mustMakeEvent(t *testing.T, roomID, eventType string, stateKey *string, content string, ts int64) gomatrixserverlib.HeaderedEvent {
+	ev := map[string]interface{}{
+		"event_id":         fmt.Sprintf("$%s%d:kaer.morhen", eventType, ts),
+		"room_id":          roomID,
+		"type":             eventType,
+		"sender":           "@userid:kaer.morhen",
+		"origin_server_ts": ts,
+		"content":          json.RawMessage(content),
+	}
+	if stateKey != nil {
+		ev["state_key"] = *stateKey
+	}
+	j, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatalf("failed to marshal event: %s", err)
+	}
+	e, err := gomatrixserverlib.NewEventFromTrustedJSON(j, false, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to load event: %s", err)
+	}
+	return e.Headered(testRoomVersion)
+}
+
+func TestQueryRoomsForUser(t *testing.T) {
+	currStateAPI, producer := MustMakeInternalAPI(t)
+	userID := "@userid:kaer.morhen"
+	events := []gomatrixserverlib.HeaderedEvent{
+		mustMakeEvent(t, "!joined:kaer.morhen", "m.room.member", &userID, `{"membership":"join"}`, 1000),
+		mustMakeEvent(t, "!invited:kaer.morhen", "m.room.member", &userID, `{"membership":"invite"}`, 3000),
+		mustMakeEvent(t, "!left:kaer.morhen", "m.room.member", &userID, `{"membership":"leave"}`, 2000),
+		// the joined room is the most recently active, even though its
+		// membership event is the oldest
+		mustMakeEvent(t, "!joined:kaer.morhen", "m.room.message", nil, `{"body":"hello"}`, 4000),
+		// an old event arriving later mustn't make the room look less active
+		mustMakeEvent(t, "!joined:kaer.morhen", "m.room.message", nil, `{"body":"backfilled"}`, 500),
+	}
+	for i := range events {
+		out := &roomserverAPI.OutputNewRoomEvent{Event: events[i]}
+		if events[i].StateKey() != nil {
+			out.AddsStateEventIDs = []string{events[i].EventID()}
+		}
+		MustWriteOutputEvent(t, producer, out)
+	}
+	// we have no good way to know /when/ the server has consumed the event
+	time.Sleep(100 * time.Millisecond)
+
+	testCases := []struct {
+		req  api.QueryRoomsForUserRequest
+		want []api.RoomForUser
+	}{
+		{
+			req: api.QueryRoomsForUserRequest{
+				UserID:         userID,
+				WantMembership: "invite",
+			},
+			want: []api.RoomForUser{
+				{RoomID: "!invited:kaer.morhen", Membership: "invite", LastActivityTS: 3000},
+			},
+		},
+		{
+			req: api.QueryRoomsForUserRequest{
+				UserID:              userID,
+				WantMemberships:     []string{"join", "invite", "leave"},
+				OrderByLastActivity: true,
+			},
+			want: []api.RoomForUser{
+				{RoomID: "!joined:kaer.morhen", Membership: "join", LastActivityTS: 4000},
+				{RoomID: "!invited:kaer.morhen", Membership: "invite", LastActivityTS: 3000},
+				{RoomID: "!left:kaer.morhen", Membership: "leave", LastActivityTS: 2000},
+			},
+		},
+		{
+			req: api.QueryRoomsForUserRequest{
+				UserID:              userID,
+				WantMembership:      "leave",
+				WantMemberships:     []string{"invite"},
+				OrderByLastActivity: true,
+			},
+			want: []api.RoomForUser{
+				{RoomID: "!invited:kaer.morhen", Membership: "invite", LastActivityTS: 3000},
+				{RoomID: "!left:kaer.morhen", Membership: "leave", LastActivityTS: 2000},
+			},
+		},
+		{
+			req: api.QueryRoomsForUserRequest{
+				UserID: userID,
+			},
+			want: nil,
+		},
+	}
+
+	runCases := func(testAPI api.CurrentStateInternalAPI) {
+		for _, tc := range testCases {
+			var res api.QueryRoomsForUserResponse
+			if err := testAPI.QueryRoomsForUser(context.TODO(), &tc.req, &res); err != nil {
+				t.Errorf("QueryRoomsForUser %+v returned error: %s", tc.req, err)
+				continue
+			}
+			if len(res.Rooms) != len(tc.want) || len(res.RoomIDs) != len(tc.want) {
+				t.Errorf("QueryRoomsForUser %+v got rooms %+v want %+v", tc.req, res.Rooms, tc.want)
+				continue
+			}
+			for i := range tc.want {
+				if res.Rooms[i] != tc.want[i] || res.RoomIDs[i] != tc.want[i].RoomID {
+					t.Errorf("QueryRoomsForUser %+v got rooms %+v want %+v", tc.req, res.Rooms, tc.want)
+					break
+				}
+			}
+		}
+	}
+	t.Run("HTTP API", func(t *testing.T) {
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		AddInternalRoutes(router, currStateAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewCurrentStateAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		runCases(currStateAPI)
+	})
+}
+
+func TestQuerySearchUserDirectory(t *testing.T) {
+	currStateAPI, producer := MustMakeInternalAPI(t)
+	searcher := "@userid:kaer.morhen"
+	alice := "@alice:remote"
+	alicia := "@alicia:kaer.morhen"
+	alison := "@alison:kaer.morhen"
+	albert := "@albert:kaer.morhen"
+	empty := ""
+	updateProfile := func(profile api.UserDirectoryEntry) {
+		err := currStateAPI.PerformUpdateUserDirectory(context.TODO(), &api.PerformUpdateUserDirectoryRequest{
+			Profiles: []api.UserDirectoryEntry{profile},
+		}, &api.PerformUpdateUserDirectoryResponse{})
+		if err != nil {
+			t.Fatalf("PerformUpdateUserDirectory returned error: %s", err)
+		}
+	}
+	// the global profiles of local users are known before and after they join rooms
+	updateProfile(api.UserDirectoryEntry{UserID: alicia, DisplayName: "Alicia", AvatarURL: "mxc://kaer.morhen/a"})
+	// member events only ever give per-room nicknames, which mustn't be searchable
+	events := []gomatrixserverlib.HeaderedEvent{
+		mustMakeEvent(t, "!shared:kaer.morhen", "m.room.member", &searcher, `{"membership":"join"}`, 1000),
+		mustMakeEvent(t, "!shared:kaer.morhen", "m.room.member", &alice, `{"membership":"join","displayname":"Alice the Nickname"}`, 1001),
+		mustMakeEvent(t, "!shared:kaer.morhen", "m.room.member", &albert, `{"membership":"invite","displayname":"Albert"}`, 1002),
+		mustMakeEvent(t, "!public:kaer.morhen", "m.room.join_rules", &empty, `{"join_rule":"public"}`, 1003),
+		mustMakeEvent(t, "!public:kaer.morhen", "m.room.member", &alicia, `{"membership":"join","displayname":"Ally the Nickname","avatar_url":"mxc://kaer.morhen/b"}`, 1004),
+		// users who are only in private rooms which the searcher isn't in can't be found
+		mustMakeEvent(t, "!private:kaer.morhen", "m.room.member", &alison, `{"membership":"join","displayname":"Alison the Nickname"}`, 1005),
+	}
+	for i := range events {
+		MustWriteOutputEvent(t, producer, &roomserverAPI.OutputNewRoomEvent{
+			Event:             events[i],
+			AddsStateEventIDs: []string{events[i].EventID()},
+		})
+	}
+	// we have no good way to know /when/ the server has consumed the event
+	time.Sleep(100 * time.Millisecond)
+	updateProfile(api.UserDirectoryEntry{UserID: alison, DisplayName: "Alison"})
+
+	testCases := []struct {
+		req         api.QuerySearchUserDirectoryRequest
+		want        []api.UserDirectoryEntry
+		wantLimited bool
+	}{
+		{
+			req: api.QuerySearchUserDirectoryRequest{UserID: searcher, SearchString: "ALI", Limit: 10},
+			want: []api.UserDirectoryEntry{
+				{UserID: alice},
+				{UserID: alicia, DisplayName: "Alicia", AvatarURL: "mxc://kaer.morhen/a"},
+			},
+		},
+		{
+			req:         api.QuerySearchUserDirectoryRequest{UserID: searcher, SearchString: "ali", Limit: 1},
+			want:        []api.UserDirectoryEntry{{UserID: alice}},
+			wantLimited: true,
+		},
+		{
+			req:  api.QuerySearchUserDirectoryRequest{UserID: searcher, SearchString: "remote", Limit: 10},
+			want: []api.UserDirectoryEntry{{UserID: alice}},
+		},
+		{
+			req:  api.QuerySearchUserDirectoryRequest{UserID: searcher, SearchString: "nickname", Limit: 10},
+			want: []api.UserDirectoryEntry{},
+		},
+		{
+			// wildcards in the search term are matched literally
+			req:  api.QuerySearchUserDirectoryRequest{UserID: searcher, SearchString: "a_i", Limit: 10},
+			want: []api.UserDirectoryEntry{},
+		},
+		{
+			// someone who isn't in the shared room can only find users in public rooms, and themselves
+			req: api.QuerySearchUserDirectoryRequest{UserID: alison, SearchString: "ali", Limit: 10},
+			want: []api.UserDirectoryEntry{
+				{UserID: alicia, DisplayName: "Alicia", AvatarURL: "mxc://kaer.morhen/a"},
+				{UserID: alison, DisplayName: "Alison"},
+			},
+		},
+	}
+
+	runCases := func(testAPI api.CurrentStateInternalAPI) {
+		for _, tc := range testCases {
+			var res api.QuerySearchUserDirectoryResponse
+			if err := testAPI.QuerySearchUserDirectory(context.TODO(), &tc.req, &res); err != nil {
+				t.Errorf("QuerySearchUserDirectory %+v returned error: %s", tc.req, err)
+				continue
+			}
+			if !reflect.DeepEqual(res.Users, tc.want) || res.Limited != tc.wantLimited {
+				t.Errorf("QuerySearchUserDirectory %+v got %+v (limited %v) want %+v (limited %v)", tc.req, res.Users, res.Limited, tc.want, tc.wantLimited)
+			}
+		}
+	}
+	t.Run("HTTP API", func(t *testing.T) {
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		AddInternalRoutes(router, currStateAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewCurrentStateAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		runCases(currStateAPI)
+	})
+}
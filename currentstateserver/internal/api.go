@@ -16,9 +16,11 @@ package internal
 
 import (
 	"context"
+	"sort"
 
 	"github.com/matrix-org/dendrite/currentstateserver/api"
 	"github.com/matrix-org/dendrite/currentstateserver/storage"
+	"github.com/matrix-org/dendrite/currentstateserver/storage/tables"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -41,11 +43,36 @@ func (a *CurrentStateInternalAPI) QueryCurrentState(ctx context.Context, req *ap
 }
 
 func (a *CurrentStateInternalAPI) QueryRoomsForUser(ctx context.Context, req *api.QueryRoomsForUserRequest, res *api.QueryRoomsForUserResponse) error {
-	roomIDs, err := a.DB.GetRoomsByMembership(ctx, req.UserID, req.WantMembership)
+	var memberships []string
+	if req.WantMembership != "" {
+		memberships = append(memberships, req.WantMembership)
+	}
+	memberships = append(memberships, req.WantMemberships...)
+	if len(memberships) == 0 {
+		return nil
+	}
+	rooms, err := a.DB.GetRoomsByMemberships(ctx, req.UserID, memberships)
 	if err != nil {
 		return err
 	}
-	res.RoomIDs = roomIDs
+	if req.OrderByLastActivity {
+		sort.SliceStable(rooms, func(i, j int) bool {
+			if rooms[i].LastEventTS != rooms[j].LastEventTS {
+				return rooms[i].LastEventTS > rooms[j].LastEventTS
+			}
+			return rooms[i].RoomID < rooms[j].RoomID
+		})
+	}
+	res.RoomIDs = make([]string, 0, len(rooms))
+	res.Rooms = make([]api.RoomForUser, 0, len(rooms))
+	for _, room := range rooms {
+		res.RoomIDs = append(res.RoomIDs, room.RoomID)
+		res.Rooms = append(res.Rooms, api.RoomForUser{
+			RoomID:         room.RoomID,
+			Membership:     room.Membership,
+			LastActivityTS: room.LastEventTS,
+		})
+	}
 	return nil
 }
 
@@ -68,3 +95,45 @@ func (a *CurrentStateInternalAPI) QueryBulkStateContent(ctx context.Context, req
 	}
 	return nil
 }
+
+func (a *CurrentStateInternalAPI) QuerySearchUserDirectory(ctx context.Context, req *api.QuerySearchUserDirectoryRequest, res *api.QuerySearchUserDirectoryResponse) error {
+	// ask for one more user than we need, so that we know whether the results were limited
+	profiles, err := a.DB.SearchUserDirectory(ctx, req.UserID, req.SearchString, req.Limit+1)
+	if err != nil {
+		return err
+	}
+	if len(profiles) > req.Limit {
+		profiles = profiles[:req.Limit]
+		res.Limited = true
+	}
+	res.Users = make([]api.UserDirectoryEntry, 0, len(profiles))
+	for _, profile := range profiles {
+		res.Users = append(res.Users, api.UserDirectoryEntry{
+			UserID:      profile.UserID,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		})
+	}
+	return nil
+}
+
+func (a *CurrentStateInternalAPI) PerformUpdateUserDirectory(ctx context.Context, req *api.PerformUpdateUserDirectoryRequest, res *api.PerformUpdateUserDirectoryResponse) error {
+	profiles := make([]tables.UserProfile, len(req.Profiles))
+	for i, profile := range req.Profiles {
+		profiles[i] = tables.UserProfile{
+			UserID:      profile.UserID,
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}
+	}
+	return a.DB.UpdateUserDirectory(ctx, profiles)
+}
+
+func (a *CurrentStateInternalAPI) QuerySearchRooms(ctx context.Context, req *api.QuerySearchRoomsRequest, res *api.QuerySearchRoomsResponse) error {
+	matches, err := a.DB.SearchRooms(ctx, req.SearchString, req.RoomIDs)
+	if err != nil {
+		return err
+	}
+	res.Matches = matches
+	return nil
+}
@@ -26,9 +26,12 @@ import (
 
 // HTTP paths for the internal HTTP APIs
 const (
-	QueryCurrentStatePath     = "/currentstateserver/queryCurrentState"
-	QueryRoomsForUserPath     = "/currentstateserver/queryRoomsForUser"
-	QueryBulkStateContentPath = "/currentstateserver/queryBulkStateContent"
+	QueryCurrentStatePath          = "/currentstateserver/queryCurrentState"
+	QueryRoomsForUserPath          = "/currentstateserver/queryRoomsForUser"
+	QueryBulkStateContentPath      = "/currentstateserver/queryBulkStateContent"
+	QuerySearchUserDirectoryPath   = "/currentstateserver/querySearchUserDirectory"
+	PerformUpdateUserDirectoryPath = "/currentstateserver/performUpdateUserDirectory"
+	QuerySearchRoomsPath           = "/currentstateserver/querySearchRooms"
 )
 
 // NewCurrentStateAPIClient creates a CurrentStateInternalAPI implemented by talking to a HTTP POST API.
@@ -86,3 +89,39 @@ func (h *httpCurrentStateInternalAPI) QueryBulkStateContent(
 	apiURL := h.apiURL + QueryBulkStateContentPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+func (h *httpCurrentStateInternalAPI) QuerySearchUserDirectory(
+	ctx context.Context,
+	request *api.QuerySearchUserDirectoryRequest,
+	response *api.QuerySearchUserDirectoryResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QuerySearchUserDirectory")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QuerySearchUserDirectoryPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpCurrentStateInternalAPI) PerformUpdateUserDirectory(
+	ctx context.Context,
+	request *api.PerformUpdateUserDirectoryRequest,
+	response *api.PerformUpdateUserDirectoryResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUpdateUserDirectory")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformUpdateUserDirectoryPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpCurrentStateInternalAPI) QuerySearchRooms(
+	ctx context.Context,
+	request *api.QuerySearchRoomsRequest,
+	response *api.QuerySearchRoomsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QuerySearchRooms")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QuerySearchRoomsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -64,4 +64,43 @@ func AddRoutes(internalAPIMux *mux.Router, intAPI api.CurrentStateInternalAPI) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	internalAPIMux.Handle(QuerySearchUserDirectoryPath,
+		httputil.MakeInternalAPI("querySearchUserDirectory", func(req *http.Request) util.JSONResponse {
+			request := api.QuerySearchUserDirectoryRequest{}
+			response := api.QuerySearchUserDirectoryResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := intAPI.QuerySearchUserDirectory(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(PerformUpdateUserDirectoryPath,
+		httputil.MakeInternalAPI("performUpdateUserDirectory", func(req *http.Request) util.JSONResponse {
+			request := api.PerformUpdateUserDirectoryRequest{}
+			response := api.PerformUpdateUserDirectoryResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := intAPI.PerformUpdateUserDirectory(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	internalAPIMux.Handle(QuerySearchRoomsPath,
+		httputil.MakeInternalAPI("querySearchRooms", func(req *http.Request) util.JSONResponse {
+			request := api.QuerySearchRoomsRequest{}
+			response := api.QuerySearchRoomsResponse{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := intAPI.QuerySearchRooms(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
@@ -32,9 +32,26 @@ type Database interface {
 	GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error)
 	// GetRoomsByMembership returns a list of room IDs matching the provided membership and user ID (as state_key).
 	GetRoomsByMembership(ctx context.Context, userID, membership string) ([]string, error)
+	// GetRoomsByMemberships returns the rooms which have the user (as state_key) in any of the provided memberships,
+	// along with the timestamp of the newest event in each room.
+	GetRoomsByMemberships(ctx context.Context, userID string, memberships []string) ([]tables.RoomMembership, error)
+	// UpdateRoomActivity records that an event with the given timestamp has been sent in the room.
+	UpdateRoomActivity(ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp) error
 	// GetBulkStateContent returns all state events which match a given room ID and a given state key tuple. Both must be satisfied for a match.
 	// If a tuple has the StateKey of '*' and allowWildcards=true then all state events with the EventType should be returned.
 	GetBulkStateContent(ctx context.Context, roomIDs []string, tuples []gomatrixserverlib.StateKeyTuple, allowWildcards bool) ([]tables.StrippedEvent, error)
+	// SearchUserDirectory returns up to limit users whose user ID or display name contains the search term, ignoring
+	// case. Only users who share a room with the searcher, or who are joined to a public room, are returned.
+	SearchUserDirectory(ctx context.Context, searcherID, searchTerm string, limit int) ([]tables.UserProfile, error)
+	// SearchRooms returns the types of the state events, out of the name, canonical alias and topic, which match the
+	// search term in each of the given rooms. Every word of the search term, ignoring case, has to be the start of a
+	// word in the text. Rooms without a match are missing from the map.
+	SearchRooms(ctx context.Context, searchTerm string, roomIDs []string) (map[string][]string, error)
+	// UpdateUserDirectory stores the global profiles of local users, replacing any stored for them already.
+	UpdateUserDirectory(ctx context.Context, profiles []tables.UserProfile) error
 	// Redact a state event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause gomatrixserverlib.HeaderedEvent) error
+	// PurgeRoom deletes the current state and activity of a room which the roomserver has purged, along with the
+	// user directory entries of the users who were only in the directory because they were joined to it.
+	PurgeRoom(ctx context.Context, roomID string) error
 }
@@ -62,9 +62,15 @@ const upsertRoomStateSQL = "" +
 const deleteRoomStateByEventIDSQL = "" +
 	"DELETE FROM currentstate_current_room_state WHERE event_id = $1"
 
+const deleteRoomStateForRoomSQL = "" +
+	"DELETE FROM currentstate_current_room_state WHERE room_id = $1"
+
 const selectRoomIDsWithMembershipSQL = "" +
 	"SELECT room_id FROM currentstate_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND content_value = $2"
 
+const selectRoomsWithMembershipsSQL = "" +
+	"SELECT room_id, content_value FROM currentstate_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND content_value = ANY($2)"
+
 const selectStateEventSQL = "" +
 	"SELECT headered_event_json FROM currentstate_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
 
@@ -77,14 +83,20 @@ const selectBulkStateContentSQL = "" +
 const selectBulkStateContentWildSQL = "" +
 	"SELECT room_id, type, state_key, content_value FROM currentstate_current_room_state WHERE room_id = ANY($1) AND type = ANY($2)"
 
+const selectEventsWithoutContentValueSQL = "" +
+	"SELECT headered_event_json FROM currentstate_current_room_state WHERE type = $1 AND content_value = ''"
+
 type currentRoomStateStatements struct {
-	upsertRoomStateStmt             *sql.Stmt
-	deleteRoomStateByEventIDStmt    *sql.Stmt
-	selectRoomIDsWithMembershipStmt *sql.Stmt
-	selectEventsWithEventIDsStmt    *sql.Stmt
-	selectStateEventStmt            *sql.Stmt
-	selectBulkStateContentStmt      *sql.Stmt
-	selectBulkStateContentWildStmt  *sql.Stmt
+	upsertRoomStateStmt                 *sql.Stmt
+	deleteRoomStateByEventIDStmt        *sql.Stmt
+	deleteRoomStateForRoomStmt          *sql.Stmt
+	selectRoomIDsWithMembershipStmt     *sql.Stmt
+	selectRoomsWithMembershipsStmt      *sql.Stmt
+	selectEventsWithEventIDsStmt        *sql.Stmt
+	selectStateEventStmt                *sql.Stmt
+	selectBulkStateContentStmt          *sql.Stmt
+	selectBulkStateContentWildStmt      *sql.Stmt
+	selectEventsWithoutContentValueStmt *sql.Stmt
 }
 
 func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
@@ -99,9 +111,15 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 	if s.deleteRoomStateByEventIDStmt, err = db.Prepare(deleteRoomStateByEventIDSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteRoomStateForRoomStmt, err = db.Prepare(deleteRoomStateForRoomSQL); err != nil {
+		return nil, err
+	}
 	if s.selectRoomIDsWithMembershipStmt, err = db.Prepare(selectRoomIDsWithMembershipSQL); err != nil {
 		return nil, err
 	}
+	if s.selectRoomsWithMembershipsStmt, err = db.Prepare(selectRoomsWithMembershipsSQL); err != nil {
+		return nil, err
+	}
 	if s.selectEventsWithEventIDsStmt, err = db.Prepare(selectEventsWithEventIDsSQL); err != nil {
 		return nil, err
 	}
@@ -114,6 +132,9 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 	if s.selectBulkStateContentWildStmt, err = db.Prepare(selectBulkStateContentWildSQL); err != nil {
 		return nil, err
 	}
+	if s.selectEventsWithoutContentValueStmt, err = db.Prepare(selectEventsWithoutContentValueSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -142,6 +163,31 @@ func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 	return result, rows.Err()
 }
 
+// SelectRoomsWithMemberships returns the rooms which have the given user in any of the given membership states.
+func (s *currentRoomStateStatements) SelectRoomsWithMemberships(
+	ctx context.Context,
+	txn *sql.Tx,
+	userID string,
+	memberships []string,
+) ([]tables.RoomMembership, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomsWithMembershipsStmt)
+	rows, err := stmt.QueryContext(ctx, userID, pq.StringArray(memberships))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomsWithMemberships: rows.close() failed")
+
+	var result []tables.RoomMembership
+	for rows.Next() {
+		var room tables.RoomMembership
+		if err := rows.Scan(&room.RoomID, &room.Membership); err != nil {
+			return nil, err
+		}
+		result = append(result, room)
+	}
+	return result, rows.Err()
+}
+
 func (s *currentRoomStateStatements) DeleteRoomStateByEventID(
 	ctx context.Context, txn *sql.Tx, eventID string,
 ) error {
@@ -150,6 +196,14 @@ func (s *currentRoomStateStatements) DeleteRoomStateByEventID(
 	return err
 }
 
+func (s *currentRoomStateStatements) DeleteRoomStateForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRoomStateForRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
 func (s *currentRoomStateStatements) UpsertRoomState(
 	ctx context.Context, txn *sql.Tx,
 	event gomatrixserverlib.HeaderedEvent, contentVal string,
@@ -269,3 +323,27 @@ func (s *currentRoomStateStatements) SelectBulkStateContent(
 	}
 	return strippedEvents, rows.Err()
 }
+
+func (s *currentRoomStateStatements) SelectEventsWithoutContentValue(
+	ctx context.Context, txn *sql.Tx, evType string,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventsWithoutContentValueStmt)
+	rows, err := stmt.QueryContext(ctx, evType)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsWithoutContentValue: rows.close() failed")
+	result := []gomatrixserverlib.HeaderedEvent{}
+	for rows.Next() {
+		var eventBytes []byte
+		if err := rows.Scan(&eventBytes); err != nil {
+			return nil, err
+		}
+		var ev gomatrixserverlib.HeaderedEvent
+		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+			return nil, err
+		}
+		result = append(result, ev)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/currentstateserver/storage/tables"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const roomActivitySchema = `
+-- Stores the timestamp of the newest event in every room, so that rooms can
+-- be ordered by how recently they were active.
+CREATE TABLE IF NOT EXISTS currentstate_room_activity (
+    -- The room ID
+    room_id TEXT NOT NULL PRIMARY KEY,
+    -- The origin_server_ts of the newest event seen in the room
+    last_event_ts BIGINT NOT NULL
+);
+`
+
+const upsertLastEventTSSQL = "" +
+	"INSERT INTO currentstate_room_activity (room_id, last_event_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (room_id) DO UPDATE SET last_event_ts = GREATEST(currentstate_room_activity.last_event_ts, $2)"
+
+const deleteLastEventTSSQL = "" +
+	"DELETE FROM currentstate_room_activity WHERE room_id = $1"
+
+const selectLastEventTSSQL = "" +
+	"SELECT room_id, last_event_ts FROM currentstate_room_activity WHERE room_id = ANY($1)"
+
+type roomActivityStatements struct {
+	upsertLastEventTSStmt *sql.Stmt
+	deleteLastEventTSStmt *sql.Stmt
+	selectLastEventTSStmt *sql.Stmt
+}
+
+func NewPostgresRoomActivityTable(db *sql.DB) (tables.RoomActivity, error) {
+	s := &roomActivityStatements{}
+	_, err := db.Exec(roomActivitySchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertLastEventTSStmt, err = db.Prepare(upsertLastEventTSSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteLastEventTSStmt, err = db.Prepare(deleteLastEventTSSQL); err != nil {
+		return nil, err
+	}
+	if s.selectLastEventTSStmt, err = db.Prepare(selectLastEventTSSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *roomActivityStatements) UpsertLastEventTS(
+	ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertLastEventTSStmt)
+	_, err := stmt.ExecContext(ctx, roomID, ts)
+	return err
+}
+
+func (s *roomActivityStatements) DeleteLastEventTS(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteLastEventTSStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *roomActivityStatements) SelectLastEventTS(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]gomatrixserverlib.Timestamp, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectLastEventTSStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectLastEventTS: rows.close() failed")
+
+	result := make(map[string]gomatrixserverlib.Timestamp, len(roomIDs))
+	for rows.Next() {
+		var roomID string
+		var ts gomatrixserverlib.Timestamp
+		if err = rows.Scan(&roomID, &ts); err != nil {
+			return nil, err
+		}
+		result[roomID] = ts
+	}
+	return result, rows.Err()
+}
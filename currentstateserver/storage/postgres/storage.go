@@ -1,20 +1,27 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/currentstateserver/storage/shared"
+	"github.com/matrix-org/dendrite/currentstateserver/storage/tables"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database struct {
 	shared.Database
 	db *sql.DB
 	sqlutil.PartitionOffsetStatements
+	// State queries are read from the replica if one was configured.
+	replica   *sqlutil.ReadReplica
+	replicaDB *shared.Database
 }
 
-// NewDatabase creates a new sync server database
-func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*Database, error) {
+// NewDatabase creates a new current state server database. The replica data source
+// name is optional.
+func NewDatabase(dbDataSourceName, replicaDataSourceName string, dbProperties sqlutil.DbProperties) (*Database, error) {
 	var d Database
 	var err error
 	if d.db, err = sqlutil.Open("postgres", dbDataSourceName, dbProperties); err != nil {
@@ -23,13 +30,82 @@ func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*D
 	if err = d.PartitionOffsetStatements.Prepare(d.db, "currentstate"); err != nil {
 		return nil, err
 	}
-	currRoomState, err := NewPostgresCurrentRoomStateTable(d.db)
+	if d.Database, err = prepareDatabase(d.db); err != nil {
+		return nil, err
+	}
+	if err = d.Database.BackfillPinnedEvents(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = d.Database.BackfillUserDirectory(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = d.Database.BackfillRoomSearch(context.Background()); err != nil {
+		return nil, err
+	}
+	if replicaDataSourceName == "" {
+		return &d, nil
+	}
+
+	replicaDB, err := sqlutil.OpenReadReplica(replicaDataSourceName, dbProperties)
 	if err != nil {
 		return nil, err
 	}
-	d.Database = shared.Database{
-		DB:               d.db,
-		CurrentRoomState: currRoomState,
+	replica, err := prepareDatabase(replicaDB)
+	if err != nil {
+		return nil, err
 	}
+	d.replica = sqlutil.NewReadReplica(d.db, replicaDB)
+	d.replicaDB = &replica
 	return &d, nil
 }
+
+// prepareDatabase prepares the statements for all of the tables in db.
+func prepareDatabase(db *sql.DB) (shared.Database, error) {
+	currRoomState, err := NewPostgresCurrentRoomStateTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	roomActivity, err := NewPostgresRoomActivityTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	userDirectory, err := NewPostgresUserDirectoryTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	roomSearch, err := NewPostgresRoomSearchTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	return shared.Database{
+		DB:               db,
+		CurrentRoomState: currRoomState,
+		RoomActivity:     roomActivity,
+		UserDirectory:    userDirectory,
+		RoomSearch:       roomSearch,
+		Writer:           sqlutil.NewTransactionWriter(),
+	}, nil
+}
+
+func (d *Database) readDB(onReplica bool) *shared.Database {
+	if onReplica {
+		return d.replicaDB
+	}
+	return &d.Database
+}
+
+func (d *Database) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (ev *gomatrixserverlib.HeaderedEvent, err error) {
+	err = d.replica.Read(ctx, func(onReplica bool) error {
+		ev, err = d.readDB(onReplica).GetStateEvent(ctx, roomID, evType, stateKey)
+		return err
+	})
+	return
+}
+
+func (d *Database) GetBulkStateContent(ctx context.Context, roomIDs []string, tuples []gomatrixserverlib.StateKeyTuple, allowWildcards bool) (events []tables.StrippedEvent, err error) {
+	err = d.replica.Read(ctx, func(onReplica bool) error {
+		events, err = d.readDB(onReplica).GetBulkStateContent(ctx, roomIDs, tuples, allowWildcards)
+		return err
+	})
+	return
+}
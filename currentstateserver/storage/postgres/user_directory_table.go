@@ -0,0 +1,159 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/currentstateserver/storage/tables"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const userDirectorySchema = `
+-- Stores every user, local or remote, that we have seen join a room, along with
+-- the global profiles of local users. Remote users have no profile, as the only
+-- profiles we see for them are in member events, which may be per-room nicknames.
+CREATE TABLE IF NOT EXISTS currentstate_user_directory (
+    user_id TEXT NOT NULL PRIMARY KEY,
+    display_name TEXT NOT NULL DEFAULT '',
+    avatar_url TEXT NOT NULL DEFAULT ''
+);
+`
+
+const upsertUserProfileSQL = "" +
+	"INSERT INTO currentstate_user_directory (user_id, display_name, avatar_url) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id) DO UPDATE SET display_name = excluded.display_name, avatar_url = excluded.avatar_url"
+
+const insertUserSQL = "" +
+	"INSERT INTO currentstate_user_directory (user_id) VALUES ($1)" +
+	" ON CONFLICT (user_id) DO NOTHING"
+
+const insertJoinedUsersSQL = "" +
+	"INSERT INTO currentstate_user_directory (user_id)" +
+	" SELECT DISTINCT state_key FROM currentstate_current_room_state" +
+	" WHERE type = 'm.room.member' AND content_value = 'join'" +
+	" ON CONFLICT (user_id) DO NOTHING"
+
+// Users without a profile are only there because they were joined to a room,
+// so they can go once they aren't joined to any.
+const deleteUnjoinedUsersWithoutProfileSQL = "" +
+	"DELETE FROM currentstate_user_directory" +
+	" WHERE display_name = '' AND avatar_url = '' AND user_id NOT IN (" +
+	"  SELECT state_key FROM currentstate_current_room_state" +
+	"  WHERE type = 'm.room.member' AND content_value = 'join'" +
+	" )"
+
+// Users are only visible to the searcher if they are joined to a room which the
+// searcher is joined to, or to a room which anyone can join.
+const selectVisibleUserProfilesSQL = "" +
+	"SELECT d.user_id, d.display_name, d.avatar_url FROM currentstate_user_directory d" +
+	" WHERE (LOWER(d.user_id) LIKE $1 ESCAPE '\\' OR LOWER(d.display_name) LIKE $1 ESCAPE '\\')" +
+	" AND EXISTS (" +
+	"  SELECT 1 FROM currentstate_current_room_state m" +
+	"  WHERE m.type = 'm.room.member' AND m.state_key = d.user_id AND m.content_value = 'join' AND m.room_id IN (" +
+	"   SELECT room_id FROM currentstate_current_room_state" +
+	"   WHERE type = 'm.room.member' AND state_key = $2 AND content_value = 'join'" +
+	"   UNION SELECT room_id FROM currentstate_current_room_state" +
+	"   WHERE type = 'm.room.join_rules' AND state_key = '' AND content_value = 'public'" +
+	"  )" +
+	" )" +
+	" ORDER BY d.user_id LIMIT $3"
+
+type userDirectoryStatements struct {
+	upsertUserProfileStmt                 *sql.Stmt
+	insertUserStmt                        *sql.Stmt
+	insertJoinedUsersStmt                 *sql.Stmt
+	deleteUnjoinedUsersWithoutProfileStmt *sql.Stmt
+	selectVisibleUserProfilesStmt         *sql.Stmt
+}
+
+func NewPostgresUserDirectoryTable(db *sql.DB) (tables.UserDirectory, error) {
+	s := &userDirectoryStatements{}
+	_, err := db.Exec(userDirectorySchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertUserProfileStmt, err = db.Prepare(upsertUserProfileSQL); err != nil {
+		return nil, err
+	}
+	if s.insertUserStmt, err = db.Prepare(insertUserSQL); err != nil {
+		return nil, err
+	}
+	if s.insertJoinedUsersStmt, err = db.Prepare(insertJoinedUsersSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteUnjoinedUsersWithoutProfileStmt, err = db.Prepare(deleteUnjoinedUsersWithoutProfileSQL); err != nil {
+		return nil, err
+	}
+	if s.selectVisibleUserProfilesStmt, err = db.Prepare(selectVisibleUserProfilesSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *userDirectoryStatements) UpsertUserProfile(
+	ctx context.Context, txn *sql.Tx, profile tables.UserProfile,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertUserProfileStmt)
+	_, err := stmt.ExecContext(ctx, profile.UserID, profile.DisplayName, profile.AvatarURL)
+	return err
+}
+
+func (s *userDirectoryStatements) InsertUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertUserStmt)
+	_, err := stmt.ExecContext(ctx, userID)
+	return err
+}
+
+func (s *userDirectoryStatements) InsertJoinedUsers(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertJoinedUsersStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
+
+func (s *userDirectoryStatements) DeleteUnjoinedUsersWithoutProfile(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteUnjoinedUsersWithoutProfileStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
+
+func (s *userDirectoryStatements) SelectVisibleUserProfiles(
+	ctx context.Context, txn *sql.Tx, searcherID, pattern string, limit int,
+) ([]tables.UserProfile, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectVisibleUserProfilesStmt)
+	rows, err := stmt.QueryContext(ctx, pattern, searcherID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectVisibleUserProfiles: rows.close() failed")
+
+	var result []tables.UserProfile
+	for rows.Next() {
+		var profile tables.UserProfile
+		if err = rows.Scan(&profile.UserID, &profile.DisplayName, &profile.AvatarURL); err != nil {
+			return nil, err
+		}
+		result = append(result, profile)
+	}
+	return result, rows.Err()
+}
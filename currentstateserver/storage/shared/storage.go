@@ -18,6 +18,8 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+	"unicode"
 
 	"github.com/matrix-org/dendrite/currentstateserver/storage/tables"
 	"github.com/matrix-org/dendrite/internal/eventutil"
@@ -25,9 +27,27 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// roomSearchTypes are the types of the state events whose text is indexed for
+// searching the room directory.
+var roomSearchTypes = map[string]bool{
+	gomatrixserverlib.MRoomName:           true,
+	gomatrixserverlib.MRoomCanonicalAlias: true,
+	"m.room.topic":                        true,
+}
+
+// likeEscaper escapes LIKE wildcards in search terms, so that they match literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 type Database struct {
 	DB               *sql.DB
 	CurrentRoomState tables.CurrentRoomState
+	RoomActivity     tables.RoomActivity
+	UserDirectory    tables.UserDirectory
+	RoomSearch       tables.RoomSearch
+	// Writer runs all writes one at a time, as they come both from the
+	// roomserver consumer and from user directory updates, and SQLite
+	// can't have more than one writer at once.
+	Writer *sqlutil.TransactionWriter
 }
 
 func (d *Database) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
@@ -57,10 +77,40 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 	return d.StoreStateEvents(ctx, []gomatrixserverlib.HeaderedEvent{redactedEvent.Headered(redactedBecause.RoomVersion)}, []string{redactedEventID})
 }
 
+// BackfillPinnedEvents extracts the pinned event IDs of the m.room.pinned_events
+// events which were stored before they were extracted.
+func (d *Database) BackfillPinnedEvents(ctx context.Context) error {
+	return d.Writer.Do(d.DB, func(txn *sql.Tx) error {
+		events, err := d.CurrentRoomState.SelectEventsWithoutContentValue(ctx, txn, "m.room.pinned_events")
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err = d.CurrentRoomState.UpsertRoomState(ctx, txn, event, tables.ExtractContentValue(&event)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (d *Database) StoreStateEvents(ctx context.Context, addStateEvents []gomatrixserverlib.HeaderedEvent,
 	removeStateEventIDs []string) error {
-	return sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+	return d.Writer.Do(d.DB, func(txn *sql.Tx) error {
 		// remove first, then add, as we do not ever delete state, but do replace state which is a remove followed by an add.
+		if len(removeStateEventIDs) > 0 {
+			removed, err := d.CurrentRoomState.SelectEventsWithEventIDs(ctx, txn, removeStateEventIDs)
+			if err != nil {
+				return err
+			}
+			for _, event := range removed {
+				if roomSearchTypes[event.Type()] && event.StateKeyEquals("") {
+					if err = d.RoomSearch.UpsertRoomSearchEntry(ctx, txn, event.RoomID(), event.Type(), ""); err != nil {
+						return err
+					}
+				}
+			}
+		}
 		for _, eventID := range removeStateEventIDs {
 			if err := d.CurrentRoomState.DeleteRoomStateByEventID(ctx, txn, eventID); err != nil {
 				return err
@@ -77,6 +127,18 @@ func (d *Database) StoreStateEvents(ctx context.Context, addStateEvents []gomatr
 			if err := d.CurrentRoomState.UpsertRoomState(ctx, txn, event, contentVal); err != nil {
 				return err
 			}
+			if roomSearchTypes[event.Type()] && event.StateKeyEquals("") {
+				if err := d.RoomSearch.UpsertRoomSearchEntry(ctx, txn, event.RoomID(), event.Type(), contentVal); err != nil {
+					return err
+				}
+			}
+			if event.Type() == gomatrixserverlib.MRoomMember && contentVal == gomatrixserverlib.Join {
+				// The profile in a member event may be a per-room nickname, so it isn't added to the
+				// user directory, which only has the global profiles of local users.
+				if err := d.UserDirectory.InsertUser(ctx, txn, *event.StateKey()); err != nil {
+					return err
+				}
+			}
 		}
 		return nil
 	})
@@ -85,3 +147,85 @@ func (d *Database) StoreStateEvents(ctx context.Context, addStateEvents []gomatr
 func (d *Database) GetRoomsByMembership(ctx context.Context, userID, membership string) ([]string, error) {
 	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, nil, userID, membership)
 }
+
+func (d *Database) GetRoomsByMemberships(ctx context.Context, userID string, memberships []string) ([]tables.RoomMembership, error) {
+	rooms, err := d.CurrentRoomState.SelectRoomsWithMemberships(ctx, nil, userID, memberships)
+	if err != nil || len(rooms) == 0 {
+		return rooms, err
+	}
+	roomIDs := make([]string, len(rooms))
+	for i := range rooms {
+		roomIDs[i] = rooms[i].RoomID
+	}
+	lastEventTS, err := d.RoomActivity.SelectLastEventTS(ctx, nil, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rooms {
+		rooms[i].LastEventTS = lastEventTS[rooms[i].RoomID]
+	}
+	return rooms, nil
+}
+
+func (d *Database) UpdateRoomActivity(ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp) error {
+	return d.Writer.Do(d.DB, func(txn *sql.Tx) error {
+		return d.RoomActivity.UpsertLastEventTS(ctx, txn, roomID, ts)
+	})
+}
+
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
+	return d.Writer.Do(d.DB, func(txn *sql.Tx) error {
+		if err := d.CurrentRoomState.DeleteRoomStateForRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		if err := d.UserDirectory.DeleteUnjoinedUsersWithoutProfile(ctx, txn); err != nil {
+			return err
+		}
+		if err := d.RoomSearch.DeleteRoomSearchEntriesForRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		return d.RoomActivity.DeleteLastEventTS(ctx, txn, roomID)
+	})
+}
+
+// BackfillUserDirectory adds the users who joined rooms before the user
+// directory existed to it.
+func (d *Database) BackfillUserDirectory(ctx context.Context) error {
+	return d.Writer.Do(d.DB, func(txn *sql.Tx) error {
+		return d.UserDirectory.InsertJoinedUsers(ctx, txn)
+	})
+}
+
+// BackfillRoomSearch indexes the names, canonical aliases and topics of the
+// rooms whose state was stored before the room search index existed.
+func (d *Database) BackfillRoomSearch(ctx context.Context) error {
+	return d.Writer.Do(d.DB, func(txn *sql.Tx) error {
+		return d.RoomSearch.RebuildRoomSearch(ctx, txn)
+	})
+}
+
+func (d *Database) UpdateUserDirectory(ctx context.Context, profiles []tables.UserProfile) error {
+	return d.Writer.Do(d.DB, func(txn *sql.Tx) error {
+		for _, profile := range profiles {
+			if err := d.UserDirectory.UpsertUserProfile(ctx, txn, profile); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) SearchUserDirectory(ctx context.Context, searcherID, searchTerm string, limit int) ([]tables.UserProfile, error) {
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(searchTerm)) + "%"
+	return d.UserDirectory.SelectVisibleUserProfiles(ctx, nil, searcherID, pattern, limit)
+}
+
+func (d *Database) SearchRooms(ctx context.Context, searchTerm string, roomIDs []string) (map[string][]string, error) {
+	words := strings.FieldsFunc(strings.ToLower(searchTerm), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return map[string][]string{}, nil
+	}
+	return d.RoomSearch.SelectRoomSearchMatches(ctx, nil, words, roomIDs)
+}
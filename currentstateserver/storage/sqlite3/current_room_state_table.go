@@ -51,9 +51,15 @@ const upsertRoomStateSQL = "" +
 const deleteRoomStateByEventIDSQL = "" +
 	"DELETE FROM currentstate_current_room_state WHERE event_id = $1"
 
+const deleteRoomStateForRoomSQL = "" +
+	"DELETE FROM currentstate_current_room_state WHERE room_id = $1"
+
 const selectRoomIDsWithMembershipSQL = "" +
 	"SELECT room_id FROM currentstate_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND content_value = $2"
 
+const selectRoomsWithMembershipsSQL = "" +
+	"SELECT room_id, content_value FROM currentstate_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND content_value IN ($2)"
+
 const selectStateEventSQL = "" +
 	"SELECT headered_event_json FROM currentstate_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
 
@@ -66,12 +72,17 @@ const selectBulkStateContentSQL = "" +
 const selectBulkStateContentWildSQL = "" +
 	"SELECT room_id, type, state_key, content_value FROM currentstate_current_room_state WHERE room_id IN ($1) AND type IN ($2)"
 
+const selectEventsWithoutContentValueSQL = "" +
+	"SELECT headered_event_json FROM currentstate_current_room_state WHERE type = $1 AND content_value = ''"
+
 type currentRoomStateStatements struct {
-	db                              *sql.DB
-	upsertRoomStateStmt             *sql.Stmt
-	deleteRoomStateByEventIDStmt    *sql.Stmt
-	selectRoomIDsWithMembershipStmt *sql.Stmt
-	selectStateEventStmt            *sql.Stmt
+	db                                  *sql.DB
+	upsertRoomStateStmt                 *sql.Stmt
+	deleteRoomStateByEventIDStmt        *sql.Stmt
+	deleteRoomStateForRoomStmt          *sql.Stmt
+	selectRoomIDsWithMembershipStmt     *sql.Stmt
+	selectStateEventStmt                *sql.Stmt
+	selectEventsWithoutContentValueStmt *sql.Stmt
 }
 
 func NewSqliteCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
@@ -88,12 +99,18 @@ func NewSqliteCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error)
 	if s.deleteRoomStateByEventIDStmt, err = db.Prepare(deleteRoomStateByEventIDSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteRoomStateForRoomStmt, err = db.Prepare(deleteRoomStateForRoomSQL); err != nil {
+		return nil, err
+	}
 	if s.selectRoomIDsWithMembershipStmt, err = db.Prepare(selectRoomIDsWithMembershipSQL); err != nil {
 		return nil, err
 	}
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return nil, err
 	}
+	if s.selectEventsWithoutContentValueStmt, err = db.Prepare(selectEventsWithoutContentValueSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -122,6 +139,42 @@ func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 	return result, nil
 }
 
+// SelectRoomsWithMemberships returns the rooms which have the given user in any of the given membership states.
+func (s *currentRoomStateStatements) SelectRoomsWithMemberships(
+	ctx context.Context,
+	txn *sql.Tx,
+	userID string,
+	memberships []string,
+) ([]tables.RoomMembership, error) {
+	args := make([]interface{}, 0, len(memberships)+1)
+	args = append(args, userID)
+	for _, membership := range memberships {
+		args = append(args, membership)
+	}
+	query := strings.Replace(selectRoomsWithMembershipsSQL, "($2)", sqlutil.QueryVariadicOffset(len(memberships), 1), 1)
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, query, args...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, query, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomsWithMemberships: rows.close() failed")
+
+	var result []tables.RoomMembership
+	for rows.Next() {
+		var room tables.RoomMembership
+		if err := rows.Scan(&room.RoomID, &room.Membership); err != nil {
+			return nil, err
+		}
+		result = append(result, room)
+	}
+	return result, rows.Err()
+}
+
 func (s *currentRoomStateStatements) DeleteRoomStateByEventID(
 	ctx context.Context, txn *sql.Tx, eventID string,
 ) error {
@@ -130,6 +183,14 @@ func (s *currentRoomStateStatements) DeleteRoomStateByEventID(
 	return err
 }
 
+func (s *currentRoomStateStatements) DeleteRoomStateForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRoomStateForRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
 func (s *currentRoomStateStatements) UpsertRoomState(
 	ctx context.Context, txn *sql.Tx,
 	event gomatrixserverlib.HeaderedEvent, contentVal string,
@@ -279,3 +340,27 @@ func (s *currentRoomStateStatements) SelectBulkStateContent(
 	}
 	return strippedEvents, rows.Err()
 }
+
+func (s *currentRoomStateStatements) SelectEventsWithoutContentValue(
+	ctx context.Context, txn *sql.Tx, evType string,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventsWithoutContentValueStmt)
+	rows, err := stmt.QueryContext(ctx, evType)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsWithoutContentValue: rows.close() failed")
+	result := []gomatrixserverlib.HeaderedEvent{}
+	for rows.Next() {
+		var eventBytes []byte
+		if err := rows.Scan(&eventBytes); err != nil {
+			return nil, err
+		}
+		var ev gomatrixserverlib.HeaderedEvent
+		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+			return nil, err
+		}
+		result = append(result, ev)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/matrix-org/dendrite/currentstateserver/storage/tables"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const roomActivitySchema = `
+-- Stores the timestamp of the newest event in every room.
+CREATE TABLE IF NOT EXISTS currentstate_room_activity (
+    room_id TEXT NOT NULL PRIMARY KEY,
+    last_event_ts BIGINT NOT NULL
+);
+`
+
+const upsertLastEventTSSQL = "" +
+	"INSERT INTO currentstate_room_activity (room_id, last_event_ts) VALUES ($1, $2)" +
+	" ON CONFLICT (room_id) DO UPDATE SET last_event_ts = MAX(last_event_ts, $2)"
+
+const deleteLastEventTSSQL = "" +
+	"DELETE FROM currentstate_room_activity WHERE room_id = $1"
+
+const selectLastEventTSSQL = "" +
+	"SELECT room_id, last_event_ts FROM currentstate_room_activity WHERE room_id IN ($1)"
+
+type roomActivityStatements struct {
+	db                    *sql.DB
+	upsertLastEventTSStmt *sql.Stmt
+	deleteLastEventTSStmt *sql.Stmt
+}
+
+func NewSqliteRoomActivityTable(db *sql.DB) (tables.RoomActivity, error) {
+	s := &roomActivityStatements{
+		db: db,
+	}
+	_, err := db.Exec(roomActivitySchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertLastEventTSStmt, err = db.Prepare(upsertLastEventTSSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteLastEventTSStmt, err = db.Prepare(deleteLastEventTSSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *roomActivityStatements) UpsertLastEventTS(
+	ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertLastEventTSStmt)
+	_, err := stmt.ExecContext(ctx, roomID, ts)
+	return err
+}
+
+func (s *roomActivityStatements) DeleteLastEventTS(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteLastEventTSStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *roomActivityStatements) SelectLastEventTS(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string]gomatrixserverlib.Timestamp, error) {
+	iRoomIDs := make([]interface{}, len(roomIDs))
+	for i, v := range roomIDs {
+		iRoomIDs[i] = v
+	}
+	query := strings.Replace(selectLastEventTSSQL, "($1)", sqlutil.QueryVariadic(len(iRoomIDs)), 1)
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, query, iRoomIDs...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, query, iRoomIDs...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectLastEventTS: rows.close() failed")
+
+	result := make(map[string]gomatrixserverlib.Timestamp, len(roomIDs))
+	for rows.Next() {
+		var roomID string
+		var ts gomatrixserverlib.Timestamp
+		if err = rows.Scan(&roomID, &ts); err != nil {
+			return nil, err
+		}
+		result[roomID] = ts
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/currentstateserver/storage/tables"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const roomSearchSchema = `
+-- Stores a full-text index of the names, canonical aliases and topics of rooms,
+-- for searching the room directory.
+CREATE VIRTUAL TABLE IF NOT EXISTS currentstate_room_search USING fts4(
+    room_id, type, content,
+    notindexed=room_id, notindexed=type
+);
+`
+
+const insertRoomSearchEntrySQL = "" +
+	"INSERT INTO currentstate_room_search (room_id, type, content) VALUES ($1, $2, $3)"
+
+const deleteRoomSearchEntrySQL = "" +
+	"DELETE FROM currentstate_room_search WHERE room_id = $1 AND type = $2"
+
+const deleteRoomSearchEntriesForRoomSQL = "" +
+	"DELETE FROM currentstate_room_search WHERE room_id = $1"
+
+const deleteAllRoomSearchEntriesSQL = "" +
+	"DELETE FROM currentstate_room_search"
+
+const insertAllRoomSearchEntriesSQL = "" +
+	"INSERT INTO currentstate_room_search (room_id, type, content)" +
+	" SELECT room_id, type, content_value FROM currentstate_current_room_state" +
+	" WHERE type IN ('m.room.name', 'm.room.canonical_alias', 'm.room.topic')" +
+	" AND state_key = '' AND content_value != ''"
+
+const selectRoomSearchMatchesSQL = "" +
+	"SELECT room_id, type FROM currentstate_room_search" +
+	" WHERE content MATCH $1 AND room_id IN ($2)"
+
+type roomSearchStatements struct {
+	insertRoomSearchEntryStmt          *sql.Stmt
+	deleteRoomSearchEntryStmt          *sql.Stmt
+	deleteRoomSearchEntriesForRoomStmt *sql.Stmt
+	deleteAllRoomSearchEntriesStmt     *sql.Stmt
+	insertAllRoomSearchEntriesStmt     *sql.Stmt
+	// selectRoomSearchMatchesStmt *sql.Stmt - prepared at runtime due to variadic
+	db *sql.DB
+}
+
+func NewSqliteRoomSearchTable(db *sql.DB) (tables.RoomSearch, error) {
+	s := &roomSearchStatements{
+		db: db,
+	}
+	_, err := db.Exec(roomSearchSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertRoomSearchEntryStmt, err = db.Prepare(insertRoomSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteRoomSearchEntryStmt, err = db.Prepare(deleteRoomSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteRoomSearchEntriesForRoomStmt, err = db.Prepare(deleteRoomSearchEntriesForRoomSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteAllRoomSearchEntriesStmt, err = db.Prepare(deleteAllRoomSearchEntriesSQL); err != nil {
+		return nil, err
+	}
+	if s.insertAllRoomSearchEntriesStmt, err = db.Prepare(insertAllRoomSearchEntriesSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *roomSearchStatements) UpsertRoomSearchEntry(
+	ctx context.Context, txn *sql.Tx, roomID, evType, text string,
+) error {
+	// FTS tables don't support unique constraints, so remove any existing
+	// entry for the room and type first.
+	if _, err := sqlutil.TxStmt(txn, s.deleteRoomSearchEntryStmt).ExecContext(ctx, roomID, evType); err != nil {
+		return err
+	}
+	if text == "" {
+		return nil
+	}
+	_, err := sqlutil.TxStmt(txn, s.insertRoomSearchEntryStmt).ExecContext(ctx, roomID, evType, text)
+	return err
+}
+
+func (s *roomSearchStatements) DeleteRoomSearchEntriesForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRoomSearchEntriesForRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *roomSearchStatements) RebuildRoomSearch(ctx context.Context, txn *sql.Tx) error {
+	if _, err := sqlutil.TxStmt(txn, s.deleteAllRoomSearchEntriesStmt).ExecContext(ctx); err != nil {
+		return err
+	}
+	_, err := sqlutil.TxStmt(txn, s.insertAllRoomSearchEntriesStmt).ExecContext(ctx)
+	return err
+}
+
+func (s *roomSearchStatements) SelectRoomSearchMatches(
+	ctx context.Context, txn *sql.Tx, words, roomIDs []string,
+) (map[string][]string, error) {
+	if len(words) == 0 || len(roomIDs) == 0 {
+		return nil, nil
+	}
+	// Every word has to match the start of a word in the text. The words
+	// are lower case letters and digits, so can't be mistaken for operators.
+	prefixes := make([]string, len(words))
+	for i, word := range words {
+		prefixes[i] = word + "*"
+	}
+	params := []interface{}{strings.Join(prefixes, " ")}
+	for _, roomID := range roomIDs {
+		params = append(params, roomID)
+	}
+	query := strings.Replace(selectRoomSearchMatchesSQL, "($2)", sqlutil.QueryVariadicOffset(len(roomIDs), 1), 1)
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, query, params...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, query, params...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("selectRoomSearchMatches: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomSearchMatches: rows.close() failed")
+	matches := make(map[string][]string)
+	for rows.Next() {
+		var roomID, evType string
+		if err = rows.Scan(&roomID, &evType); err != nil {
+			return nil, err
+		}
+		matches[roomID] = append(matches[roomID], evType)
+	}
+	return matches, rows.Err()
+}
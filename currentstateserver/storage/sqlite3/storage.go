@@ -1,6 +1,7 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/currentstateserver/storage/shared"
@@ -31,9 +32,34 @@ func NewDatabase(dataSourceName string) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	roomActivity, err := NewSqliteRoomActivityTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	userDirectory, err := NewSqliteUserDirectoryTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	roomSearch, err := NewSqliteRoomSearchTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:               d.db,
 		CurrentRoomState: currRoomState,
+		RoomActivity:     roomActivity,
+		UserDirectory:    userDirectory,
+		RoomSearch:       roomSearch,
+		Writer:           sqlutil.NewTransactionWriter(),
+	}
+	if err = d.Database.BackfillPinnedEvents(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = d.Database.BackfillUserDirectory(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = d.Database.BackfillRoomSearch(context.Background()); err != nil {
+		return nil, err
 	}
 	return &d, nil
 }
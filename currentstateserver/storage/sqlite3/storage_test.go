@@ -0,0 +1,282 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/currentstateserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestBackfillPinnedEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "currentstate")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dataSourceName := "file:" + filepath.Join(dir, "currentstate.db")
+	ctx := context.Background()
+
+	db, err := NewDatabase(dataSourceName)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %s", err)
+	}
+	eventJSON := `{"auth_events":[],"content":{"pinned":["$a:localhost"]},"depth":1,"event_id":"$pinned:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.pinned_events","hashes":{"sha256":""},"signatures":{}}`
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	// store the event as it was before the pinned events were extracted
+	if err = db.CurrentRoomState.UpsertRoomState(ctx, nil, ev.Headered(gomatrixserverlib.RoomVersionV1), ""); err != nil {
+		t.Fatalf("UpsertRoomState failed: %s", err)
+	}
+	if err = db.db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err)
+	}
+
+	if db, err = NewDatabase(dataSourceName); err != nil {
+		t.Fatalf("NewDatabase failed to reopen the database: %s", err)
+	}
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.pinned_events", StateKey: ""}
+	events, err := db.GetBulkStateContent(ctx, []string{"!room:localhost"}, []gomatrixserverlib.StateKeyTuple{tuple}, false)
+	if err != nil {
+		t.Fatalf("GetBulkStateContent failed: %s", err)
+	}
+	if len(events) != 1 || events[0].ContentValue != `["$a:localhost"]` {
+		t.Fatalf("expected the pinned events to be backfilled, got %+v", events)
+	}
+}
+
+func TestBackfillUserDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "currentstate")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dataSourceName := "file:" + filepath.Join(dir, "currentstate.db")
+	ctx := context.Background()
+
+	db, err := NewDatabase(dataSourceName)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %s", err)
+	}
+	for _, eventJSON := range []string{
+		`{"auth_events":[],"content":{"join_rule":"public"},"depth":1,"event_id":"$rules:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.join_rules","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"membership":"join","displayname":"Nickname"},"depth":2,"event_id":"$alice:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"@alice:localhost","type":"m.room.member","hashes":{"sha256":""},"signatures":{}}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		// store the events without adding anyone to the user directory, as
+		// happened before joined users were added to it
+		hev := ev.Headered(gomatrixserverlib.RoomVersionV1)
+		if err = db.CurrentRoomState.UpsertRoomState(ctx, nil, hev, tables.ExtractContentValue(&hev)); err != nil {
+			t.Fatalf("UpsertRoomState failed: %s", err)
+		}
+	}
+	if err = db.db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err)
+	}
+
+	if db, err = NewDatabase(dataSourceName); err != nil {
+		t.Fatalf("NewDatabase failed to reopen the database: %s", err)
+	}
+	users, err := db.SearchUserDirectory(ctx, "@bob:localhost", "alice", 10)
+	if err != nil {
+		t.Fatalf("SearchUserDirectory failed: %s", err)
+	}
+	want := []tables.UserProfile{{UserID: "@alice:localhost"}}
+	if !reflect.DeepEqual(users, want) {
+		t.Fatalf("expected the joined user to be backfilled without their nickname, got %+v want %+v", users, want)
+	}
+}
+
+func TestPurgeRoomUserDirectory(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %s", err)
+	}
+	for _, eventJSON := range []string{
+		`{"auth_events":[],"content":{"membership":"join"},"depth":1,"event_id":"$alice:remote","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:remote","state_key":"@alice:remote","type":"m.room.member","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"membership":"join"},"depth":2,"event_id":"$bob:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@bob:localhost","state_key":"@bob:localhost","type":"m.room.member","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"membership":"join"},"depth":1,"event_id":"$charlie:remote","origin_server_ts":0,"prev_events":[],"room_id":"!other:localhost","sender":"@charlie:remote","state_key":"@charlie:remote","type":"m.room.member","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"membership":"join"},"depth":3,"event_id":"$charlie2:remote","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@charlie:remote","state_key":"@charlie:remote","type":"m.room.member","hashes":{"sha256":""},"signatures":{}}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		hev := ev.Headered(gomatrixserverlib.RoomVersionV1)
+		if err = db.CurrentRoomState.UpsertRoomState(ctx, nil, hev, tables.ExtractContentValue(&hev)); err != nil {
+			t.Fatalf("UpsertRoomState failed: %s", err)
+		}
+	}
+	if err = db.BackfillUserDirectory(ctx); err != nil {
+		t.Fatalf("BackfillUserDirectory failed: %s", err)
+	}
+	if err = db.UpdateUserDirectory(ctx, []tables.UserProfile{{UserID: "@bob:localhost", DisplayName: "Bob"}}); err != nil {
+		t.Fatalf("UpdateUserDirectory failed: %s", err)
+	}
+
+	if err = db.PurgeRoom(ctx, "!room:localhost"); err != nil {
+		t.Fatalf("PurgeRoom failed: %s", err)
+	}
+	rows, err := db.db.QueryContext(ctx, "SELECT user_id FROM currentstate_user_directory ORDER BY user_id")
+	if err != nil {
+		t.Fatalf("failed to query the user directory: %s", err)
+	}
+	defer rows.Close() // nolint: errcheck
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			t.Fatalf("failed to scan the user directory: %s", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	// the users with a profile or another room are kept
+	want := []string{"@bob:localhost", "@charlie:remote"}
+	if !reflect.DeepEqual(userIDs, want) {
+		t.Fatalf("user directory after purging the room: got %v want %v", userIDs, want)
+	}
+}
+
+func TestBackfillRoomSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "currentstate")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	dataSourceName := "file:" + filepath.Join(dir, "currentstate.db")
+	ctx := context.Background()
+
+	db, err := NewDatabase(dataSourceName)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %s", err)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"auth_events":[],"content":{"name":"Dendrite Chat"},"depth":1,"event_id":"$name:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.name","hashes":{"sha256":""},"signatures":{}}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	// store the event without indexing it, as happened before rooms could be searched
+	hev := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	if err = db.CurrentRoomState.UpsertRoomState(ctx, nil, hev, tables.ExtractContentValue(&hev)); err != nil {
+		t.Fatalf("UpsertRoomState failed: %s", err)
+	}
+	if err = db.db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err)
+	}
+
+	if db, err = NewDatabase(dataSourceName); err != nil {
+		t.Fatalf("NewDatabase failed to reopen the database: %s", err)
+	}
+	matches, err := db.SearchRooms(ctx, "chat", []string{"!room:localhost"})
+	if err != nil {
+		t.Fatalf("SearchRooms failed: %s", err)
+	}
+	want := map[string][]string{"!room:localhost": {"m.room.name"}}
+	if !reflect.DeepEqual(matches, want) {
+		t.Fatalf("expected the room name to be backfilled, got %v want %v", matches, want)
+	}
+}
+
+func TestSearchRooms(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %s", err)
+	}
+	events := make(map[string]gomatrixserverlib.HeaderedEvent)
+	for _, eventJSON := range []string{
+		`{"auth_events":[],"content":{"name":"Dendrite Chat"},"depth":1,"event_id":"$name:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.name","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"alias":"#dendrite-dev:localhost"},"depth":2,"event_id":"$alias:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.canonical_alias","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"topic":"All about Go servers"},"depth":3,"event_id":"$topic:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.topic","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"name":"Dendrite Elsewhere"},"depth":1,"event_id":"$othername:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!other:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.name","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"membership":"join","displayname":"Dendrite"},"depth":4,"event_id":"$alice:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"@alice:localhost","type":"m.room.member","hashes":{"sha256":""},"signatures":{}}`,
+		`{"auth_events":[],"content":{"name":"Synapse Chat"},"depth":5,"event_id":"$newname:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":"","type":"m.room.name","hashes":{"sha256":""},"signatures":{}}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		events[ev.EventID()] = ev.Headered(gomatrixserverlib.RoomVersionV1)
+	}
+	if err = db.StoreStateEvents(ctx, []gomatrixserverlib.HeaderedEvent{
+		events["$name:localhost"], events["$alias:localhost"], events["$topic:localhost"],
+		events["$othername:localhost"], events["$alice:localhost"],
+	}, nil); err != nil {
+		t.Fatalf("StoreStateEvents failed: %s", err)
+	}
+	rooms := []string{"!room:localhost", "!other:localhost"}
+	search := func(term string, roomIDs []string, want map[string][]string) {
+		t.Helper()
+		matches, err := db.SearchRooms(ctx, term, roomIDs)
+		if err != nil {
+			t.Fatalf("SearchRooms %q failed: %s", term, err)
+		}
+		for _, types := range matches {
+			sort.Strings(types)
+		}
+		if !reflect.DeepEqual(matches, want) {
+			t.Errorf("SearchRooms %q in %v: got %v want %v", term, roomIDs, matches, want)
+		}
+	}
+
+	search("DENDRITE", rooms, map[string][]string{
+		"!room:localhost":  {"m.room.canonical_alias", "m.room.name"},
+		"!other:localhost": {"m.room.name"},
+	})
+	search("dend", []string{"!other:localhost"}, map[string][]string{
+		"!other:localhost": {"m.room.name"},
+	})
+	search("about go", rooms, map[string][]string{
+		"!room:localhost": {"m.room.topic"},
+	})
+	search("dev", rooms, map[string][]string{
+		"!room:localhost": {"m.room.canonical_alias"},
+	})
+	// words have to match the start of a word, and all of them have to match
+	search("rite", rooms, map[string][]string{})
+	search("dendrite servers", rooms, map[string][]string{})
+	search(`"*`, rooms, map[string][]string{})
+
+	// replacing the name replaces what can be found
+	if err = db.StoreStateEvents(ctx, []gomatrixserverlib.HeaderedEvent{events["$newname:localhost"]}, []string{"$name:localhost"}); err != nil {
+		t.Fatalf("StoreStateEvents failed: %s", err)
+	}
+	search("chat", rooms, map[string][]string{
+		"!room:localhost": {"m.room.name"},
+	})
+	search("dendrite", rooms, map[string][]string{
+		"!room:localhost":  {"m.room.canonical_alias"},
+		"!other:localhost": {"m.room.name"},
+	})
+
+	if err = db.PurgeRoom(ctx, "!room:localhost"); err != nil {
+		t.Fatalf("PurgeRoom failed: %s", err)
+	}
+	search("dendrite", rooms, map[string][]string{
+		"!other:localhost": {"m.room.name"},
+	})
+}
@@ -12,6 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !wasm
 // +build !wasm
 
 package storage
@@ -24,18 +25,19 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 )
 
-// NewDatabase opens a database connection.
-func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties) (Database, error) {
+// NewDatabase opens a database connection. State queries use the replica if
+// one is given, which must be a postgres database.
+func NewDatabase(dataSourceName, replicaDataSourceName string, dbProperties sqlutil.DbProperties) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return postgres.NewDatabase(dataSourceName, replicaDataSourceName, dbProperties)
 	}
 	switch uri.Scheme {
 	case "postgres":
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return postgres.NewDatabase(dataSourceName, replicaDataSourceName, dbProperties)
 	case "file":
 		return sqlite3.NewDatabase(dataSourceName)
 	default:
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return postgres.NewDatabase(dataSourceName, replicaDataSourceName, dbProperties)
 	}
 }
@@ -33,9 +33,65 @@ type CurrentRoomState interface {
 	// means there is nothing to store for this field.
 	UpsertRoomState(ctx context.Context, txn *sql.Tx, event gomatrixserverlib.HeaderedEvent, contentVal string) error
 	DeleteRoomStateByEventID(ctx context.Context, txn *sql.Tx, eventID string) error
+	// DeleteRoomStateForRoom deletes all of the current state of the given room.
+	DeleteRoomStateForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
 	// SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
 	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
+	// SelectRoomsWithMemberships returns the rooms which have the given user in any of the given membership states.
+	SelectRoomsWithMemberships(ctx context.Context, txn *sql.Tx, userID string, memberships []string) ([]RoomMembership, error)
 	SelectBulkStateContent(ctx context.Context, roomIDs []string, tuples []gomatrixserverlib.StateKeyTuple, allowWildcards bool) ([]StrippedEvent, error)
+	// SelectEventsWithoutContentValue returns the current state events of the given type which have no extracted content.
+	SelectEventsWithoutContentValue(ctx context.Context, txn *sql.Tx, evType string) ([]gomatrixserverlib.HeaderedEvent, error)
+}
+
+type RoomActivity interface {
+	// UpsertLastEventTS records the timestamp of an event in the room, unless a newer one has already been recorded.
+	UpsertLastEventTS(ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp) error
+	// SelectLastEventTS returns the timestamp of the newest event in each of the given rooms. Rooms without any events
+	// recorded are missing from the map.
+	SelectLastEventTS(ctx context.Context, txn *sql.Tx, roomIDs []string) (map[string]gomatrixserverlib.Timestamp, error)
+	DeleteLastEventTS(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
+type UserDirectory interface {
+	// UpsertUserProfile stores the global profile of a user, replacing any stored for them already.
+	UpsertUserProfile(ctx context.Context, txn *sql.Tx, profile UserProfile) error
+	// InsertUser adds a user to the directory without a profile, unless they are in it already.
+	InsertUser(ctx context.Context, txn *sql.Tx, userID string) error
+	// InsertJoinedUsers adds every user who is joined to a room to the directory, unless they are in it already.
+	InsertJoinedUsers(ctx context.Context, txn *sql.Tx) error
+	// DeleteUnjoinedUsersWithoutProfile removes the users who have no profile and aren't joined to any room.
+	DeleteUnjoinedUsersWithoutProfile(ctx context.Context, txn *sql.Tx) error
+	// SelectVisibleUserProfiles returns up to limit users whose user ID or display name matches the LIKE pattern,
+	// which must be lower case, and who share a room with the searcher or are joined to a public room.
+	SelectVisibleUserProfiles(ctx context.Context, txn *sql.Tx, searcherID, pattern string, limit int) ([]UserProfile, error)
+}
+
+type RoomSearch interface {
+	// UpsertRoomSearchEntry indexes the text of the given event type in the room, replacing any indexed for it
+	// already. An empty text removes the entry.
+	UpsertRoomSearchEntry(ctx context.Context, txn *sql.Tx, roomID, evType, text string) error
+	DeleteRoomSearchEntriesForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	// RebuildRoomSearch replaces the index with the names, canonical aliases and topics in the current room state.
+	RebuildRoomSearch(ctx context.Context, txn *sql.Tx) error
+	// SelectRoomSearchMatches returns the event types whose text in each of the given rooms has a word starting
+	// with every one of the given words, which must be lower case letters and digits. Rooms without a match are
+	// missing from the map.
+	SelectRoomSearchMatches(ctx context.Context, txn *sql.Tx, words, roomIDs []string) (map[string][]string, error)
+}
+
+// RoomMembership is the membership of a user in a room.
+type RoomMembership struct {
+	RoomID      string
+	Membership  string
+	LastEventTS gomatrixserverlib.Timestamp
+}
+
+// UserProfile is the profile of a user in the user directory.
+type UserProfile struct {
+	UserID      string
+	DisplayName string
+	AvatarURL   string
 }
 
 // StrippedEvent represents a stripped event for returning extracted content values.
@@ -47,7 +103,9 @@ type StrippedEvent struct {
 }
 
 // ExtractContentValue from the given state event. For example, given an m.room.name event with:
-//    content: { name: "Foo" }
+//
+//	content: { name: "Foo" }
+//
 // this returns "Foo".
 func ExtractContentValue(ev *gomatrixserverlib.HeaderedEvent) string {
 	content := ev.Content()
@@ -71,6 +129,16 @@ func ExtractContentValue(ev *gomatrixserverlib.HeaderedEvent) string {
 		key = "topic"
 	case "m.room.guest_access":
 		key = "guest_access"
+	case "m.room.pinned_events":
+		// the pinned event IDs are stored as their JSON list
+		result := gjson.GetBytes(content, "pinned")
+		if !result.IsArray() {
+			return ""
+		}
+		return result.Raw
+	default:
+		// nothing is extracted from events which aren't queried by content
+		return ""
 	}
 	result := gjson.GetBytes(content, key)
 	if !result.Exists() {
@@ -0,0 +1,52 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestExtractContentValue(t *testing.T) {
+	tests := []struct {
+		eventType string
+		content   string
+		want      string
+	}{
+		{"m.room.name", `{"name":"Foo"}`, "Foo"},
+		{"m.room.name", `{"name":3}`, ""},
+		{"m.room.topic", `{}`, ""},
+		{"m.room.pinned_events", `{"pinned":["$a:localhost","$b:localhost"]}`, `["$a:localhost","$b:localhost"]`},
+		{"m.room.pinned_events", `{"pinned":[]}`, `[]`},
+		{"m.room.pinned_events", `{"pinned":"$a:localhost"}`, ""},
+		// only the types which are queried by content are extracted
+		{"m.room.server_acl", `{"allow":["*"]}`, ""},
+		{"org.example.custom", `{"":"value"}`, ""},
+		{"m.room.name", `{"name":["Foo"]}`, ""},
+	}
+	for _, tt := range tests {
+		eventJSON := `{"type":"` + tt.eventType + `","state_key":"","content":` + tt.content +
+			`,"event_id":"$event:localhost","room_id":"!room:localhost","sender":"@alice:localhost"}`
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		h := ev.Headered(gomatrixserverlib.RoomVersionV1)
+		if got := ExtractContentValue(&h); got != tt.want {
+			t.Errorf("ExtractContentValue(%s %s) = %q, want %q", tt.eventType, tt.content, got, tt.want)
+		}
+	}
+}
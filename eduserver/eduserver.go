@@ -46,5 +46,6 @@ func NewInternalAPI(
 		OutputTypingEventTopic:       string(base.Cfg.Kafka.Topics.OutputTypingEvent),
 		OutputSendToDeviceEventTopic: string(base.Cfg.Kafka.Topics.OutputSendToDeviceEvent),
 		ServerName:                   base.Cfg.Matrix.ServerName,
+		TypingDisabled:               base.Cfg.Matrix.DisableTyping,
 	}
 }
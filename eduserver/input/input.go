@@ -43,6 +43,8 @@ type EDUServerInputAPI struct {
 	UserAPI userapi.UserInternalAPI
 	// our server name
 	ServerName gomatrixserverlib.ServerName
+	// If true, typing events are dropped rather than stored and produced
+	TypingDisabled bool
 }
 
 // InputTypingEvent implements api.EDUServerInputAPI
@@ -51,6 +53,9 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 	request *api.InputTypingEventRequest,
 	response *api.InputTypingEventResponse,
 ) error {
+	if t.TypingDisabled {
+		return nil
+	}
 	ite := &request.InputTypingEvent
 	if ite.Typing {
 		// user is typing, update our current state of users typing.
@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetRoomHierarchy implements GET /hierarchy/{roomID} from MSC2946. It only
+// summarises the room and its direct children, leaving the rest of the walk
+// to the requesting server.
+func GetRoomHierarchy(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomID string,
+) util.JSONResponse {
+	ctx := httpReq.Context()
+	suggestedOnly := httpReq.URL.Query().Get("suggested_only") == "true"
+	room, memberships, err := roomserverAPI.GetHierarchyRoom(ctx, rsAPI, roomID, "", suggestedOnly)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("roomserverAPI.GetHierarchyRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if room == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+	if !serverCanSeeHierarchyRoom(room, memberships, request.Origin()) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The room is not accessible to this server"),
+		}
+	}
+
+	res := federationSenderAPI.QueryRoomHierarchyResponse{
+		Room:                 *room,
+		Children:             []federationSenderAPI.HierarchyRoom{},
+		InaccessibleChildren: []string{},
+	}
+	for _, child := range room.ChildrenState {
+		childRoom, childMemberships, err := roomserverAPI.GetHierarchyRoom(ctx, rsAPI, child.StateKey, "", suggestedOnly)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("roomserverAPI.GetHierarchyRoom failed")
+			return jsonerror.InternalServerError()
+		}
+		// Children which this server isn't in are left for the requesting
+		// server to ask about elsewhere.
+		if childRoom == nil {
+			continue
+		}
+		if serverCanSeeHierarchyRoom(childRoom, childMemberships, request.Origin()) {
+			res.Children = append(res.Children, *childRoom)
+		} else {
+			res.InaccessibleChildren = append(res.InaccessibleChildren, child.StateKey)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// serverCanSeeHierarchyRoom returns whether a server may see a room in a
+// space hierarchy, which it can if anyone can join or read the room, or if
+// one of its users is in the room.
+func serverCanSeeHierarchyRoom(
+	room *federationSenderAPI.HierarchyRoom, memberships map[string]string, serverName gomatrixserverlib.ServerName,
+) bool {
+	if room.WorldReadable || room.JoinRule == gomatrixserverlib.Public {
+		return true
+	}
+	for userID, membership := range memberships {
+		if membership != gomatrixserverlib.Join {
+			continue
+		}
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == serverName {
+			return true
+		}
+	}
+	return false
+}
@@ -22,6 +22,7 @@ import (
 	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -34,6 +35,7 @@ const (
 	pathPrefixV2Keys       = "/key/v2"
 	pathPrefixV1Federation = "/federation/v1"
 	pathPrefixV2Federation = "/federation/v2"
+	pathPrefixUnstableFed  = "/federation/unstable"
 )
 
 // Setup registers HTTP handlers with the given ServeMux.
@@ -54,10 +56,17 @@ func Setup(
 	federation *gomatrixserverlib.FederationClient,
 	userAPI userapi.UserInternalAPI,
 	stateAPI currentstateAPI.CurrentStateInternalAPI,
+	toDeviceCache caching.ToDeviceMessageCache,
 ) {
 	v2keysmux := publicAPIMux.PathPrefix(pathPrefixV2Keys).Subrouter()
 	v1fedmux := publicAPIMux.PathPrefix(pathPrefixV1Federation).Subrouter()
 	v2fedmux := publicAPIMux.PathPrefix(pathPrefixV2Federation).Subrouter()
+	unstableFedMux := publicAPIMux.PathPrefix(pathPrefixUnstableFed).Subrouter()
+	if cfg.Matrix.FederationMutualTLS.RequireClientCertificates {
+		v1fedmux.Use(httputil.WrapHandlerInClientCertificateCheck)
+		v2fedmux.Use(httputil.WrapHandlerInClientCertificateCheck)
+		unstableFedMux.Use(httputil.WrapHandlerInClientCertificateCheck)
+	}
 
 	wakeup := &httputil.FederationWakeups{
 		FsAPI: fsAPI,
@@ -80,7 +89,7 @@ func Setup(
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, eduAPI, keys, federation,
+				cfg, rsAPI, eduAPI, keys, federation, toDeviceCache,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -273,6 +282,37 @@ func Setup(
 		},
 	)).Methods(http.MethodPut)
 
+	if cfg.FeatureEnabled(config.FeatureKnocking) {
+		v1fedmux.Handle("/make_knock/{roomID}/{userID}", httputil.MakeFedAPI(
+			"federation_make_knock", cfg.Matrix.ServerName, keys, wakeup,
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				remoteVersions := []gomatrixserverlib.RoomVersion{}
+				for _, v := range httpReq.URL.Query()["ver"] {
+					remoteVersions = append(remoteVersions, gomatrixserverlib.RoomVersion(v))
+				}
+				return MakeKnock(
+					httpReq, request, cfg, rsAPI, vars["roomID"], vars["userID"], remoteVersions,
+				)
+			},
+		)).Methods(http.MethodGet)
+
+		v1fedmux.Handle("/send_knock/{roomID}/{eventID}", httputil.MakeFedAPI(
+			"federation_send_knock", cfg.Matrix.ServerName, keys, wakeup,
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				return SendKnock(
+					httpReq, request, cfg, rsAPI, keys, vars["roomID"], vars["eventID"],
+				)
+			},
+		)).Methods(http.MethodPut)
+	}
+
+	v1fedmux.Handle("/openid/userinfo", httputil.MakeExternalAPI(
+		"federation_openid_userinfo",
+		func(httpReq *http.Request) util.JSONResponse {
+			return GetOpenIDUserInfo(httpReq, userAPI)
+		},
+	)).Methods(http.MethodGet)
+
 	v1fedmux.Handle("/version", httputil.MakeExternalAPI(
 		"federation_version",
 		func(httpReq *http.Request) util.JSONResponse {
@@ -294,6 +334,13 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
+	unstableFedMux.Handle("/org.matrix.msc2946/hierarchy/{roomID}", httputil.MakeFedAPI(
+		"federation_hierarchy", cfg.Matrix.ServerName, keys, wakeup,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return GetRoomHierarchy(httpReq, request, rsAPI, vars["roomID"])
+		},
+	)).Methods(http.MethodGet)
+
 	v1fedmux.Handle("/publicRooms",
 		httputil.MakeExternalAPI("federation_public_rooms", func(req *http.Request) util.JSONResponse {
 			return GetPostPublicRooms(req, rsAPI, stateAPI)
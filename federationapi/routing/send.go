@@ -19,16 +19,90 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
+// The stages that the time spent processing an incoming transaction is broken
+// down into. Time spent in the roomserver includes storing the events and
+// emitting them to Kafka, which are broken down further by the roomserver.
+const (
+	stageVerification    = "verification"
+	stageStateFetch      = "state_fetch"
+	stageStateResolution = "state_resolution"
+	stageRoomserver      = "roomserver"
+	stageEDUs            = "edus"
+)
+
+var (
+	txnProcessingDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "recv_txn_stage_duration_seconds",
+			Help:      "Time spent in each stage of processing an incoming federation transaction.",
+			Buckets:   []float64{.005, .01, .05, .1, .5, 1, 5, 10, 30, 60},
+		},
+		[]string{"stage"},
+	)
+	txnTotalDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "recv_txn_duration_seconds",
+			Help:      "Total time spent processing an incoming federation transaction.",
+			Buckets:   []float64{.005, .01, .05, .1, .5, 1, 5, 10, 30, 60},
+		},
+	)
+	slowPDUs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "recv_slow_pdus_total",
+			Help:      "Number of incoming PDUs which took longer than the slow PDU threshold to process.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(txnProcessingDuration, txnTotalDuration, slowPDUs)
+}
+
+// pduTimings accumulates the time spent in each stage of processing a single
+// PDU, including any missing events that were fetched and processed for it.
+type pduTimings map[string]time.Duration
+
+// track starts timing a stage and returns a function which stops it. Only
+// leaf operations should be tracked so that time isn't counted twice.
+func (p pduTimings) track(stage string) func() {
+	if p == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		p[stage] += time.Since(start)
+	}
+}
+
+// total returns the time spent in all stages.
+func (p pduTimings) total() (total time.Duration) {
+	for _, d := range p {
+		total += d
+	}
+	return
+}
+
 // Send implements /_matrix/federation/v1/send/{txnID}
 func Send(
 	httpReq *http.Request,
@@ -39,15 +113,19 @@ func Send(
 	eduAPI eduserverAPI.EDUServerInputAPI,
 	keys gomatrixserverlib.JSONVerifier,
 	federation *gomatrixserverlib.FederationClient,
+	toDeviceCache caching.ToDeviceMessageCache,
 ) util.JSONResponse {
 	t := txnReq{
-		context:    httpReq.Context(),
-		rsAPI:      rsAPI,
-		eduAPI:     eduAPI,
-		keys:       keys,
-		federation: federation,
-		haveEvents: make(map[string]*gomatrixserverlib.HeaderedEvent),
-		newEvents:  make(map[string]bool),
+		context:       httpReq.Context(),
+		rsAPI:         rsAPI,
+		eduAPI:        eduAPI,
+		keys:          keys,
+		federation:    federation,
+		toDeviceCache: toDeviceCache,
+		haveEvents:    make(map[string]*gomatrixserverlib.HeaderedEvent),
+		newEvents:     make(map[string]bool),
+
+		slowPDUThreshold: cfg.Metrics.SlowPDUThreshold,
 	}
 
 	var txnEvents struct {
@@ -72,7 +150,7 @@ func Send(
 
 	// TODO: Really we should have a function to convert FederationRequest to txnReq
 	t.PDUs = txnEvents.PDUs
-	t.EDUs = txnEvents.EDUs
+	t.EDUs = enabledEDUs(cfg, txnEvents.EDUs)
 	t.Origin = request.Origin()
 	t.TransactionID = txnID
 	t.Destination = cfg.Matrix.ServerName
@@ -95,6 +173,18 @@ func Send(
 	}
 }
 
+// enabledEDUs drops the EDUs for features that have been disabled, e.g.
+// typing notifications, rather than passing them on to the EDU server.
+func enabledEDUs(cfg *config.Dendrite, edus []gomatrixserverlib.EDU) []gomatrixserverlib.EDU {
+	var enabled []gomatrixserverlib.EDU
+	for _, edu := range edus {
+		if cfg.IsEDUTypeEnabled(edu.Type) {
+			enabled = append(enabled, edu)
+		}
+	}
+	return enabled
+}
+
 type txnReq struct {
 	gomatrixserverlib.Transaction
 	context    context.Context
@@ -102,11 +192,18 @@ type txnReq struct {
 	eduAPI     eduserverAPI.EDUServerInputAPI
 	keys       gomatrixserverlib.JSONVerifier
 	federation txnFederationClient
+	// cache of send-to-device message IDs that we have already delivered,
+	// used to drop duplicates when the remote server retries, may be nil
+	toDeviceCache caching.ToDeviceMessageCache
 	// local cache of events for auth checks, etc - this may include events
 	// which the roomserver is unaware of.
 	haveEvents map[string]*gomatrixserverlib.HeaderedEvent
 	// new events which the roomserver does not know about
 	newEvents map[string]bool
+	// PDUs which take longer than this to process are logged, if non-zero
+	slowPDUThreshold time.Duration
+	// the timings for the PDU currently being processed, may be nil
+	timings pduTimings
 }
 
 // A subset of FederationClient functionality that txn requires. Useful for testing.
@@ -122,27 +219,47 @@ type txnFederationClient interface {
 
 func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, *util.JSONResponse) {
 	results := make(map[string]gomatrixserverlib.PDUResult)
-
-	pdus := []gomatrixserverlib.HeaderedEvent{}
-	for _, pdu := range t.PDUs {
-		var header struct {
-			RoomID string `json:"room_id"`
+	txnStart := time.Now()
+	txnTimings := pduTimings{}
+	defer func() {
+		for stage, d := range txnTimings {
+			txnProcessingDuration.WithLabelValues(stage).Observe(d.Seconds())
 		}
-		if err := json.Unmarshal(pdu, &header); err != nil {
-			util.GetLogger(t.context).WithError(err).Warn("Transaction: Failed to extract room ID from event")
+		txnTotalDuration.Observe(time.Since(txnStart).Seconds())
+	}()
+
+	pdus := make([]gomatrixserverlib.HeaderedEvent, 0, len(t.PDUs))
+	timings := make([]pduTimings, 0, len(t.PDUs))
+	// Transactions usually carry several PDUs for the same room, so only look
+	// up the version of each room once.
+	roomVersions := make(map[string]gomatrixserverlib.RoomVersion)
+	for _, pdu := range t.PDUs {
+		t.timings = pduTimings{}
+		stopVerification := t.timings.track(stageVerification)
+		// Only the room ID is needed before the room version is known, so
+		// pick it out rather than decoding the whole event twice.
+		roomIDResult := gjson.GetBytes(pdu, "room_id")
+		if roomIDResult.Type != gjson.String {
+			util.GetLogger(t.context).Warn("Transaction: Failed to extract room ID from event")
 			// We don't know the event ID at this point so we can't return the
 			// failure in the PDU results
 			continue
 		}
-		verReq := api.QueryRoomVersionForRoomRequest{RoomID: header.RoomID}
-		verRes := api.QueryRoomVersionForRoomResponse{}
-		if err := t.rsAPI.QueryRoomVersionForRoom(t.context, &verReq, &verRes); err != nil {
-			util.GetLogger(t.context).WithError(err).Warn("Transaction: Failed to query room version for room", verReq.RoomID)
-			// We don't know the event ID at this point so we can't return the
-			// failure in the PDU results
-			continue
+		roomID := roomIDResult.Str
+		roomVersion, ok := roomVersions[roomID]
+		if !ok {
+			verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
+			verRes := api.QueryRoomVersionForRoomResponse{}
+			if err := t.rsAPI.QueryRoomVersionForRoom(t.context, &verReq, &verRes); err != nil {
+				util.GetLogger(t.context).WithError(err).Warn("Transaction: Failed to query room version for room", verReq.RoomID)
+				// We don't know the event ID at this point so we can't return the
+				// failure in the PDU results
+				continue
+			}
+			roomVersion = verRes.RoomVersion
+			roomVersions[roomID] = roomVersion
 		}
-		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, verRes.RoomVersion)
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, roomVersion)
 		if err != nil {
 			if _, ok := err.(gomatrixserverlib.BadJSONError); ok {
 				// Room version 6 states that homeservers should strictly enforce canonical JSON
@@ -160,19 +277,35 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, *util.JSONRe
 			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %s", string(pdu))
 			continue
 		}
-		if err = gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys); err != nil {
+		err = gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys)
+		stopVerification()
+		txnTimings[stageVerification] += t.timings[stageVerification]
+		if err != nil {
 			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
 			results[event.EventID()] = gomatrixserverlib.PDUResult{
 				Error: err.Error(),
 			}
 			continue
 		}
-		pdus = append(pdus, event.Headered(verRes.RoomVersion))
+		pdus = append(pdus, event.Headered(roomVersion))
+		timings = append(timings, t.timings)
 	}
 
 	// Process the events.
-	for _, e := range pdus {
-		if err := t.processEvent(e.Unwrap(), true); err != nil {
+	for i, e := range pdus {
+		// The verification time was already added to the transaction timings,
+		// so only the time spent from here on needs to be added to them.
+		verification := timings[i][stageVerification]
+		t.timings = timings[i]
+		err := t.processEvent(e.Unwrap(), true)
+		for stage, d := range t.timings {
+			if stage == stageVerification {
+				d -= verification
+			}
+			txnTimings[stage] += d
+		}
+		t.logIfSlow(e, t.timings)
+		if err != nil {
 			// If the error is due to the event itself being bad then we skip
 			// it and move onto the next event. We report an error so that the
 			// sender knows that we have skipped processing it.
@@ -213,11 +346,35 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, *util.JSONRe
 		}
 	}
 
+	t.timings = nil
+	stopEDUs := txnTimings.track(stageEDUs)
 	t.processEDUs(t.EDUs)
+	stopEDUs()
 	util.GetLogger(t.context).Infof("Processed %d PDUs from transaction %q", len(results), t.TransactionID)
 	return &gomatrixserverlib.RespSend{PDUs: results}, nil
 }
 
+// logIfSlow logs the given PDU along with where the time went if it took
+// longer than the slow PDU threshold to process.
+func (t *txnReq) logIfSlow(e gomatrixserverlib.HeaderedEvent, timings pduTimings) {
+	total := timings.total()
+	if t.slowPDUThreshold <= 0 || total < t.slowPDUThreshold {
+		return
+	}
+	slowPDUs.Inc()
+	fields := logrus.Fields{
+		"origin":         t.Origin,
+		"transaction_id": t.TransactionID,
+		"room_id":        e.RoomID(),
+		"event_id":       e.EventID(),
+		"total":          total,
+	}
+	for stage, d := range timings {
+		fields[stage] = d
+	}
+	util.GetLogger(t.context).WithFields(fields).Warn("Incoming federation PDU was slow to process")
+}
+
 // isProcessingErrorFatal returns true if the error is really bad and
 // we should stop processing the transaction, and returns false if it
 // is just some less serious error about a specific event.
@@ -296,6 +453,18 @@ func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
 				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal send-to-device events")
 				continue
 			}
+			// The remote server will retry the whole transaction if it
+			// didn't see our response, so drop messages that we've already
+			// delivered. Message IDs are only unique per origin.
+			dedupe := t.toDeviceCache != nil && directPayload.MessageID != ""
+			if dedupe && t.toDeviceCache.IsToDeviceMessageSeen(t.Origin, directPayload.MessageID) {
+				util.GetLogger(t.context).WithFields(logrus.Fields{
+					"origin":     t.Origin,
+					"message_id": directPayload.MessageID,
+				}).Info("Dropping duplicate send-to-device message")
+				continue
+			}
+			delivered := true
 			for userID, byUser := range directPayload.Messages {
 				for deviceID, message := range byUser {
 					// TODO: check that the user and the device actually exist here
@@ -305,9 +474,16 @@ func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
 							"user_id":   userID,
 							"device_id": deviceID,
 						}).Error("Failed to send send-to-device event to edu server")
+						delivered = false
 					}
 				}
 			}
+			// Only remember the message ID once everything has been handed
+			// to the EDU server, so that a retry can fill in anything that
+			// we failed to deliver.
+			if dedupe && delivered {
+				t.toDeviceCache.StoreToDeviceMessageSeen(t.Origin, directPayload.MessageID)
+			}
 		default:
 			util.GetLogger(t.context).WithField("type", e.Type).Warn("unhandled edu")
 		}
@@ -318,14 +494,17 @@ func (t *txnReq) processEvent(e gomatrixserverlib.Event, isInboundTxn bool) erro
 	prevEventIDs := e.PrevEventIDs()
 
 	// Fetch the state needed to authenticate the event.
-	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{e})
+	needed := eventutil.StateNeededForAuth([]gomatrixserverlib.Event{e})
 	stateReq := api.QueryStateAfterEventsRequest{
 		RoomID:       e.RoomID(),
 		PrevEventIDs: prevEventIDs,
 		StateToFetch: needed.Tuples(),
 	}
 	var stateResp api.QueryStateAfterEventsResponse
-	if err := t.rsAPI.QueryStateAfterEvents(t.context, &stateReq, &stateResp); err != nil {
+	stopStateFetch := t.timings.track(stageStateFetch)
+	err := t.rsAPI.QueryStateAfterEvents(t.context, &stateReq, &stateResp)
+	stopStateFetch()
+	if err != nil {
 		return err
 	}
 
@@ -344,12 +523,16 @@ func (t *txnReq) processEvent(e gomatrixserverlib.Event, isInboundTxn bool) erro
 	}
 
 	// Check that the event is allowed by the state at the event.
-	if err := checkAllowedByState(e, gomatrixserverlib.UnwrapEventHeaders(stateResp.StateEvents)); err != nil {
+	stopStateResolution := t.timings.track(stageStateResolution)
+	err = checkAllowedByState(e, gomatrixserverlib.UnwrapEventHeaders(stateResp.StateEvents))
+	stopStateResolution()
+	if err != nil {
 		return err
 	}
 
 	// pass the event to the roomserver
-	_, err := api.SendEvents(
+	defer t.timings.track(stageRoomserver)()
+	_, err = api.SendEvents(
 		t.context, t.rsAPI,
 		[]gomatrixserverlib.HeaderedEvent{
 			e.Headered(stateResp.RoomVersion),
@@ -368,7 +551,7 @@ func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserver
 			return err
 		}
 	}
-	return gomatrixserverlib.Allowed(e, &authUsingState)
+	return eventutil.Allowed(e, &authUsingState)
 }
 
 func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion, isInboundTxn bool) error {
@@ -406,7 +589,7 @@ func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVer
 	// Therefore, we cannot just query /state_ids with this event to get the state before. Instead, we need to query
 	// the state AFTER all the prev_events for this event, then apply state resolution to that to get the state before the event.
 	var states []*gomatrixserverlib.RespState
-	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{*backwardsExtremity}).Tuples()
+	needed := eventutil.StateNeededForAuth([]gomatrixserverlib.Event{*backwardsExtremity}).Tuples()
 	for _, prevEventID := range backwardsExtremity.PrevEventIDs() {
 		var prevState *gomatrixserverlib.RespState
 		prevState, err = t.lookupStateAfterEvent(roomVersion, backwardsExtremity.RoomID(), prevEventID, needed)
@@ -424,6 +607,7 @@ func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVer
 
 	// pass the event along with the state to the roomserver using a background context so we don't
 	// needlessly expire
+	defer t.timings.track(stageRoomserver)()
 	return api.SendEventWithState(context.Background(), t.rsAPI, resolvedState, e.Headered(roomVersion), t.haveEventIDs())
 }
 
@@ -466,6 +650,7 @@ func (t *txnReq) lookupStateAfterEvent(roomVersion gomatrixserverlib.RoomVersion
 }
 
 func (t *txnReq) lookupStateAfterEventLocally(roomID, eventID string, needed []gomatrixserverlib.StateKeyTuple) *gomatrixserverlib.RespState {
+	defer t.timings.track(stageStateFetch)()
 	var res api.QueryStateAfterEventsResponse
 	err := t.rsAPI.QueryStateAfterEvents(t.context, &api.QueryStateAfterEventsRequest{
 		RoomID:       roomID,
@@ -542,13 +727,18 @@ func (t *txnReq) resolveStatesAndCheck(roomVersion gomatrixserverlib.RoomVersion
 		authEventList = append(authEventList, state.AuthEvents...)
 		stateEventList = append(stateEventList, state.StateEvents...)
 	}
+	stopStateResolution := t.timings.track(stageStateResolution)
 	resolvedStateEvents, err := gomatrixserverlib.ResolveConflicts(roomVersion, stateEventList, authEventList)
+	stopStateResolution()
 	if err != nil {
 		return nil, err
 	}
 	// apply the current event
 retryAllowedState:
-	if err = checkAllowedByState(*backwardsExtremity, resolvedStateEvents); err != nil {
+	stopStateResolution = t.timings.track(stageStateResolution)
+	err = checkAllowedByState(*backwardsExtremity, resolvedStateEvents)
+	stopStateResolution()
+	if err != nil {
 		switch missing := err.(type) {
 		case gomatrixserverlib.MissingAuthEventError:
 			h, err2 := t.lookupEvent(roomVersion, missing.AuthEventID, true)
@@ -578,14 +768,17 @@ func (t *txnReq) getMissingEvents(e gomatrixserverlib.Event, roomVersion gomatri
 		return &e, nil
 	}
 	logger := util.GetLogger(t.context).WithField("event_id", e.EventID()).WithField("room_id", e.RoomID())
-	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{e})
+	needed := eventutil.StateNeededForAuth([]gomatrixserverlib.Event{e})
 	// query latest events (our trusted forward extremities)
 	req := api.QueryLatestEventsAndStateRequest{
 		RoomID:       e.RoomID(),
 		StateToFetch: needed.Tuples(),
 	}
 	var res api.QueryLatestEventsAndStateResponse
-	if err = t.rsAPI.QueryLatestEventsAndState(t.context, &req, &res); err != nil {
+	stopStateFetch := t.timings.track(stageStateFetch)
+	err = t.rsAPI.QueryLatestEventsAndState(t.context, &req, &res)
+	stopStateFetch()
+	if err != nil {
 		logger.WithError(err).Warn("Failed to query latest events")
 		return &e, nil
 	}
@@ -598,6 +791,7 @@ func (t *txnReq) getMissingEvents(e gomatrixserverlib.Event, roomVersion gomatri
 	if minDepth < 0 {
 		minDepth = 0
 	}
+	stopStateFetch = t.timings.track(stageStateFetch)
 	missingResp, err := t.federation.LookupMissingEvents(t.context, t.Origin, e.RoomID(), gomatrixserverlib.MissingEvents{
 		Limit: 20,
 		// synapse uses the min depth they've ever seen in that room
@@ -607,6 +801,7 @@ func (t *txnReq) getMissingEvents(e gomatrixserverlib.Event, roomVersion gomatri
 		// The event IDs to retrieve the previous events for.
 		LatestEvents: []string{e.EventID()},
 	}, roomVersion)
+	stopStateFetch()
 
 	// security: how we handle failures depends on whether or not this event will become the new forward extremity for the room.
 	// There's 2 scenarios to consider:
@@ -669,12 +864,17 @@ Event:
 
 func (t *txnReq) lookupMissingStateViaState(roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
 	respState *gomatrixserverlib.RespState, err error) {
+	stopStateFetch := t.timings.track(stageStateFetch)
 	state, err := t.federation.LookupState(t.context, t.Origin, roomID, eventID, roomVersion)
+	stopStateFetch()
 	if err != nil {
 		return nil, err
 	}
 	// Check that the returned state is valid.
-	if err := state.Check(t.context, t.keys, nil); err != nil {
+	stopVerification := t.timings.track(stageVerification)
+	err = state.Check(t.context, t.keys, nil)
+	stopVerification()
+	if err != nil {
 		return nil, err
 	}
 	return &state, nil
@@ -684,7 +884,9 @@ func (t *txnReq) lookupMissingStateViaStateIDs(roomID, eventID string, roomVersi
 	*gomatrixserverlib.RespState, error) {
 	util.GetLogger(t.context).Infof("lookupMissingStateViaStateIDs %s", eventID)
 	// fetch the state event IDs at the time of the event
+	stopStateFetch := t.timings.track(stageStateFetch)
 	stateIDs, err := t.federation.LookupStateIDs(t.context, t.Origin, roomID, eventID)
+	stopStateFetch()
 	if err != nil {
 		return nil, err
 	}
@@ -706,7 +908,10 @@ func (t *txnReq) lookupMissingStateViaStateIDs(roomID, eventID string, roomVersi
 		EventIDs: missingEventList,
 	}
 	var queryRes api.QueryEventsByIDResponse
-	if err = t.rsAPI.QueryEventsByID(t.context, &queryReq, &queryRes); err != nil {
+	stopStateFetch = t.timings.track(stageStateFetch)
+	err = t.rsAPI.QueryEventsByID(t.context, &queryReq, &queryRes)
+	stopStateFetch()
+	if err != nil {
 		return nil, err
 	}
 	for i := range queryRes.Events {
@@ -766,6 +971,7 @@ func (t *txnReq) createRespStateFromStateIDs(stateIDs gomatrixserverlib.RespStat
 }
 
 func (t *txnReq) lookupEvent(roomVersion gomatrixserverlib.RoomVersion, missingEventID string, localFirst bool) (*gomatrixserverlib.HeaderedEvent, error) {
+	stopStateFetch := t.timings.track(stageStateFetch)
 	if localFirst {
 		// fetch from the roomserver
 		queryReq := api.QueryEventsByIDRequest{
@@ -775,10 +981,12 @@ func (t *txnReq) lookupEvent(roomVersion gomatrixserverlib.RoomVersion, missingE
 		if err := t.rsAPI.QueryEventsByID(t.context, &queryReq, &queryRes); err != nil {
 			util.GetLogger(t.context).Warnf("Failed to query roomserver for missing event %s: %s - falling back to remote", missingEventID, err)
 		} else if len(queryRes.Events) == 1 {
+			stopStateFetch()
 			return &queryRes.Events[0], nil
 		}
 	}
 	txn, err := t.federation.GetEvent(t.context, t.Origin, missingEventID)
+	stopStateFetch()
 	if err != nil || len(txn.PDUs) == 0 {
 		util.GetLogger(t.context).WithError(err).WithField("event_id", missingEventID).Warn("failed to get missing /event for event ID")
 		return nil, err
@@ -790,7 +998,10 @@ func (t *txnReq) lookupEvent(roomVersion gomatrixserverlib.RoomVersion, missingE
 		util.GetLogger(t.context).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %q", event.EventID())
 		return nil, unmarshalError{err}
 	}
-	if err = gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys); err != nil {
+	stopVerification := t.timings.track(stageVerification)
+	err = gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys)
+	stopVerification()
+	if err != nil {
 		util.GetLogger(t.context).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
 		return nil, verifySigError{event.EventID(), err}
 	}
@@ -10,9 +10,12 @@ import (
 
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/test"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const (
@@ -57,6 +60,8 @@ func init() {
 type testEDUProducer struct {
 	// this producer keeps track of calls to InputTypingEvent
 	invocations []eduAPI.InputTypingEventRequest
+	// and calls to InputSendToDeviceEvent
+	sendToDeviceInvocations []eduAPI.InputSendToDeviceEventRequest
 }
 
 func (p *testEDUProducer) InputTypingEvent(
@@ -73,6 +78,7 @@ func (p *testEDUProducer) InputSendToDeviceEvent(
 	request *eduAPI.InputSendToDeviceEventRequest,
 	response *eduAPI.InputSendToDeviceEventResponse,
 ) error {
+	p.sendToDeviceInvocations = append(p.sendToDeviceInvocations, *request)
 	return nil
 }
 
@@ -111,6 +117,20 @@ func (t *testRoomserverAPI) PerformJoin(
 ) {
 }
 
+func (t *testRoomserverAPI) PerformPeek(
+	ctx context.Context,
+	req *api.PerformPeekRequest,
+	res *api.PerformPeekResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformUnpeek(
+	ctx context.Context,
+	req *api.PerformUnpeekRequest,
+	res *api.PerformUnpeekResponse,
+) {
+}
+
 func (t *testRoomserverAPI) PerformPublish(
 	ctx context.Context,
 	req *api.PerformPublishRequest,
@@ -118,6 +138,76 @@ func (t *testRoomserverAPI) PerformPublish(
 ) {
 }
 
+func (t *testRoomserverAPI) PerformRoomUpgrade(
+	ctx context.Context,
+	req *api.PerformRoomUpgradeRequest,
+	res *api.PerformRoomUpgradeResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformReportEvent(
+	ctx context.Context,
+	req *api.PerformReportEventRequest,
+	res *api.PerformReportEventResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformResolveEventReport(
+	ctx context.Context,
+	req *api.PerformResolveEventReportRequest,
+	res *api.PerformResolveEventReportResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformAuthDebug(
+	ctx context.Context,
+	req *api.PerformAuthDebugRequest,
+	res *api.PerformAuthDebugResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformUserRedaction(
+	ctx context.Context,
+	req *api.PerformUserRedactionRequest,
+	res *api.PerformUserRedactionResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformKick(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformBan(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformUnban(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+	res *api.PerformKnockResponse,
+) {
+}
+
+func (t *testRoomserverAPI) PerformPurgeRoom(
+	ctx context.Context,
+	req *api.PerformPurgeRoomRequest,
+	res *api.PerformPurgeRoomResponse,
+) {
+}
+
 func (t *testRoomserverAPI) PerformLeave(
 	ctx context.Context,
 	req *api.PerformLeaveRequest,
@@ -141,6 +231,15 @@ func (t *testRoomserverAPI) QueryLatestEventsAndState(
 	return nil
 }
 
+// Query the users who are joined to a room from the room server.
+func (t *testRoomserverAPI) QueryJoinedUsers(
+	ctx context.Context,
+	request *api.QueryJoinedUsersRequest,
+	response *api.QueryJoinedUsersResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Query the state after a list of events in a room from the room server.
 func (t *testRoomserverAPI) QueryStateAfterEvents(
 	ctx context.Context,
@@ -183,6 +282,38 @@ func (t *testRoomserverAPI) QueryPublishedRooms(
 	return fmt.Errorf("not implemented")
 }
 
+func (t *testRoomserverAPI) QueryRooms(
+	ctx context.Context,
+	request *api.QueryRoomsRequest,
+	response *api.QueryRoomsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryEventReports(
+	ctx context.Context,
+	request *api.QueryEventReportsRequest,
+	response *api.QueryEventReportsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) PerformClaimAnnotation(
+	ctx context.Context,
+	request *api.PerformClaimAnnotationRequest,
+	response *api.PerformClaimAnnotationResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryAuthDecisions(
+	ctx context.Context,
+	request *api.QueryAuthDecisionsRequest,
+	response *api.QueryAuthDecisionsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Query a list of membership events for a room
 func (t *testRoomserverAPI) QueryMembershipsForRoom(
 	ctx context.Context,
@@ -201,6 +332,15 @@ func (t *testRoomserverAPI) QueryServerAllowedToSeeEvent(
 	return fmt.Errorf("not implemented")
 }
 
+// Query which events a user is allowed to see
+func (t *testRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Query missing events for a room from roomserver
 func (t *testRoomserverAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -430,6 +570,38 @@ func TestBasicTransaction(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// The purpose of this test is to check that PDUs are only reported as slow when they take longer than the
+// slow PDU threshold to process.
+func TestSlowPDUs(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				StateEvents:     fromStateTuples(req.StateToFetch, nil),
+			}
+		},
+	}
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+	for _, tc := range []struct {
+		threshold time.Duration
+		wantSlow  float64
+	}{
+		{threshold: time.Hour, wantSlow: 0},
+		{threshold: time.Nanosecond, wantSlow: 1},
+	} {
+		before := testutil.ToFloat64(slowPDUs)
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+		txn.slowPDUThreshold = tc.threshold
+		mustProcessTransaction(t, txn, nil)
+		if got := testutil.ToFloat64(slowPDUs) - before; got != tc.wantSlow {
+			t.Errorf("threshold %s: got %v slow PDUs, want %v", tc.threshold, got, tc.wantSlow)
+		}
+	}
+}
+
 // The purpose of this test is to check that if the event received fails auth checks the transaction is failed.
 func TestTransactionFailAuthChecks(t *testing.T) {
 	rsAPI := &testRoomserverAPI{
@@ -678,3 +850,57 @@ func TestTransactionFetchMissingStateByStateIDs(t *testing.T) {
 	mustProcessTransaction(t, txn, nil)
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{eventB, eventC, eventD})
 }
+
+func TestTransactionDeduplicatesSendToDevice(t *testing.T) {
+	caches, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to create caches: %s", err)
+	}
+	eduProducer := &testEDUProducer{}
+	content, err := json.Marshal(gomatrixserverlib.ToDeviceMessage{
+		Sender:    "@userid:kaer.morhen",
+		Type:      "m.room_key",
+		MessageID: "abcdef",
+		Messages: map[string]map[string]json.RawMessage{
+			"@target:white.orchard": {
+				"DEVICEID": []byte(`{"foo":"bar"}`),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal send-to-device message: %s", err)
+	}
+	edus := []gomatrixserverlib.EDU{
+		{Type: gomatrixserverlib.MDirectToDevice, Origin: string(testOrigin), Content: content},
+	}
+	// Process the same EDU in two transactions, as would happen if the
+	// remote server retried the transaction.
+	for i := 0; i < 2; i++ {
+		txn := &txnReq{
+			context:       context.Background(),
+			eduAPI:        eduProducer,
+			toDeviceCache: caches,
+		}
+		txn.Origin = testOrigin
+		txn.processEDUs(edus)
+	}
+	if len(eduProducer.sendToDeviceInvocations) != 1 {
+		t.Fatalf("expected 1 send-to-device event to be delivered, got %d", len(eduProducer.sendToDeviceInvocations))
+	}
+}
+
+func TestTransactionDropsDisabledEDUs(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.DisableTyping = true
+	edus := []gomatrixserverlib.EDU{
+		{Type: gomatrixserverlib.MTyping, Origin: string(testOrigin), Content: []byte(`{}`)},
+		{Type: gomatrixserverlib.MDirectToDevice, Origin: string(testOrigin), Content: []byte(`{}`)},
+	}
+	got := enabledEDUs(cfg, edus)
+	if len(got) != 1 || got[0].Type != gomatrixserverlib.MDirectToDevice {
+		t.Fatalf("got EDUs %+v with typing disabled, want only the send-to-device EDU", got)
+	}
+	if got = enabledEDUs(&config.Dendrite{}, edus); len(got) != 2 {
+		t.Fatalf("got %d EDUs with nothing disabled, want 2", len(got))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationapi
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// cachingJSONVerifier wraps a gomatrixserverlib.JSONVerifier and remembers
+// which signatures have already been successfully verified, so that events
+// which arrive through multiple paths (e.g. in a transaction, then again in
+// a /state or /event response) are only verified once. Failed verifications
+// are never cached, as they may be caused by temporary key fetch failures.
+type cachingJSONVerifier struct {
+	inner gomatrixserverlib.JSONVerifier
+	cache caching.EventSignatureCache
+}
+
+// VerifyJSONs implements gomatrixserverlib.JSONVerifier
+func (v *cachingJSONVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	uncached := make([]gomatrixserverlib.VerifyJSONRequest, 0, len(requests))
+	uncachedIndices := make([]int, 0, len(requests))
+	for i := range requests {
+		if v.cache.IsEventSignatureVerified(requests[i]) {
+			continue
+		}
+		uncached = append(uncached, requests[i])
+		uncachedIndices = append(uncachedIndices, i)
+	}
+	if len(uncached) == 0 {
+		return results, nil
+	}
+	verified, err := v.inner.VerifyJSONs(ctx, uncached)
+	if err != nil {
+		return nil, err
+	}
+	for i := range verified {
+		results[uncachedIndices[i]] = verified[i]
+		if verified[i].Error == nil {
+			v.cache.StoreEventSignatureVerified(uncached[i])
+		}
+	}
+	return results, nil
+}
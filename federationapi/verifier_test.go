@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeJSONVerifier fails to verify the messages in fail, and counts how
+// many times each message was asked about.
+type fakeJSONVerifier struct {
+	fail     map[string]bool
+	requests map[string]int
+}
+
+func (v *fakeJSONVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		v.requests[string(req.Message)]++
+		if v.fail[string(req.Message)] {
+			results[i].Error = errors.New("bad signature")
+		}
+	}
+	return results, nil
+}
+
+func TestCachingJSONVerifier(t *testing.T) {
+	caches, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	inner := &fakeJSONVerifier{
+		fail:     map[string]bool{"bad": true},
+		requests: map[string]int{},
+	}
+	verifier := &cachingJSONVerifier{inner: inner, cache: caches}
+	request := func(message string) gomatrixserverlib.VerifyJSONRequest {
+		return gomatrixserverlib.VerifyJSONRequest{
+			ServerName: "remote",
+			AtTS:       1000,
+			Message:    []byte(message),
+		}
+	}
+	verify := func(requests ...gomatrixserverlib.VerifyJSONRequest) []gomatrixserverlib.VerifyJSONResult {
+		t.Helper()
+		results, err := verifier.VerifyJSONs(context.Background(), requests)
+		if err != nil {
+			t.Fatalf("VerifyJSONs failed: %s", err)
+		}
+		if len(results) != len(requests) {
+			t.Fatalf("got %d results for %d requests", len(results), len(requests))
+		}
+		return results
+	}
+
+	results := verify(request("good"), request("bad"))
+	if results[0].Error != nil || results[1].Error == nil {
+		t.Fatalf("got results %+v, want only the second to fail", results)
+	}
+
+	// Successes are remembered, but failures are tried again, and the results
+	// still line up with the requests.
+	results = verify(request("bad"), request("good"))
+	if results[0].Error == nil || results[1].Error != nil {
+		t.Fatalf("got results %+v, want only the first to fail", results)
+	}
+	if inner.requests["good"] != 1 {
+		t.Errorf("verified a cached success %d times, want once", inner.requests["good"])
+	}
+	if inner.requests["bad"] != 2 {
+		t.Errorf("verified a failure %d times, want it tried again", inner.requests["bad"])
+	}
+
+	// The same message checked at another time, or with validity checking,
+	// doesn't share the result.
+	later := request("good")
+	later.AtTS = 2000
+	strict := request("good")
+	strict.StrictValidityChecking = true
+	verify(later, strict)
+	if inner.requests["good"] != 3 {
+		t.Errorf("verified the message %d times, want it verified again for each request", inner.requests["good"])
+	}
+}
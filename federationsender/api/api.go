@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrix"
@@ -24,6 +25,26 @@ type FederationSenderInternalAPI interface {
 		request *QueryJoinedHostServerNamesInRoomRequest,
 		response *QueryJoinedHostServerNamesInRoomResponse,
 	) error
+	// Query whether a server shares any room with this server.
+	QueryServerSharesRoom(
+		ctx context.Context,
+		request *QueryServerSharesRoomRequest,
+		response *QueryServerSharesRoomResponse,
+	) error
+	// Query how well sending to remote servers has been going recently,
+	// for server administrators.
+	QueryDestinationHealth(
+		ctx context.Context,
+		request *QueryDestinationHealthRequest,
+		response *QueryDestinationHealthResponse,
+	) error
+	// Query a remote server for the space hierarchy below a room which this
+	// server isn't in.
+	QueryRoomHierarchy(
+		ctx context.Context,
+		request *QueryRoomHierarchyRequest,
+		response *QueryRoomHierarchyResponse,
+	) error
 	// Handle an instruction to make_join & send_join with a remote server.
 	PerformJoin(
 		ctx context.Context,
@@ -36,6 +57,12 @@ type FederationSenderInternalAPI interface {
 		request *PerformLeaveRequest,
 		response *PerformLeaveResponse,
 	) error
+	// Handle an instruction to make_knock & send_knock with a remote server.
+	PerformKnock(
+		ctx context.Context,
+		request *PerformKnockRequest,
+		response *PerformKnockResponse,
+	) error
 	// Notifies the federation sender that these servers may be online and to retry sending messages.
 	PerformServersAlive(
 		ctx context.Context,
@@ -49,6 +76,8 @@ type PerformDirectoryLookupRequest struct {
 	ServerName gomatrixserverlib.ServerName `json:"server_name"`
 }
 
+// PerformDirectoryLookupResponse is the response to PerformDirectoryLookup.
+// The room ID is empty if the remote server doesn't know the alias.
 type PerformDirectoryLookupResponse struct {
 	RoomID      string                         `json:"room_id"`
 	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
@@ -75,6 +104,21 @@ type PerformLeaveRequest struct {
 type PerformLeaveResponse struct {
 }
 
+type PerformKnockRequest struct {
+	RoomID      string            `json:"room_id"`
+	UserID      string            `json:"user_id"`
+	Reason      string            `json:"reason,omitempty"`
+	ServerNames types.ServerNames `json:"server_names"`
+}
+
+type PerformKnockResponse struct {
+	// The knock event which was accepted by the remote server.
+	KnockEvent gomatrixserverlib.HeaderedEvent `json:"knock_event"`
+	// The stripped state of the room which the remote server returned, so
+	// that clients can show what they have knocked on.
+	KnockStateEvents []gomatrixserverlib.InviteV2StrippedState `json:"knock_state_events"`
+}
+
 type PerformServersAliveRequest struct {
 	Servers []gomatrixserverlib.ServerName
 }
@@ -91,3 +135,98 @@ type QueryJoinedHostServerNamesInRoomRequest struct {
 type QueryJoinedHostServerNamesInRoomResponse struct {
 	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
 }
+
+// QueryServerSharesRoomRequest is a request to QueryServerSharesRoom
+type QueryServerSharesRoomRequest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+// QueryServerSharesRoomResponse is a response to QueryServerSharesRoom
+type QueryServerSharesRoomResponse struct {
+	SharesRoom bool `json:"shares_room"`
+}
+
+// QueryDestinationHealthRequest is a request to QueryDestinationHealth
+type QueryDestinationHealthRequest struct {
+	// Only return these servers. All of the servers which were sent
+	// anything recently are returned if empty.
+	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
+}
+
+// QueryDestinationHealthResponse is a response to QueryDestinationHealth
+type QueryDestinationHealthResponse struct {
+	// The start of the window which the stats cover.
+	WindowStart  gomatrixserverlib.Timestamp `json:"window_start"`
+	Destinations []DestinationHealth         `json:"destinations"`
+}
+
+// DestinationHealth is how well sending to a remote server has been going.
+type DestinationHealth struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// The number of requests made in the window, and how many succeeded.
+	Attempts    int     `json:"attempts"`
+	Successes   int     `json:"successes"`
+	SuccessRate float64 `json:"success_rate"`
+	// The median time which the remote server took to respond or fail.
+	MedianLatencyMS int64 `json:"median_latency_ms"`
+	// The number of requests which have failed since the last success.
+	ConsecutiveFailures uint32 `json:"consecutive_failures"`
+	// Whether requests to the server are being held back after failures,
+	// and until when.
+	BackingOff   bool                        `json:"backing_off"`
+	BackoffUntil gomatrixserverlib.Timestamp `json:"backoff_until,omitempty"`
+	// Whether the server failed too often and nothing is sent to it anymore.
+	Blacklisted bool `json:"blacklisted"`
+	// The most recent failure in the window, if there was one.
+	LastError   string                      `json:"last_error,omitempty"`
+	LastErrorTS gomatrixserverlib.Timestamp `json:"last_error_ts,omitempty"`
+	// The most recent success in the window, if there was one.
+	LastSuccessTS gomatrixserverlib.Timestamp `json:"last_success_ts,omitempty"`
+}
+
+// QueryRoomHierarchyRequest is a request to QueryRoomHierarchy
+type QueryRoomHierarchyRequest struct {
+	RoomID string `json:"room_id"`
+	// The servers to ask, which are tried in turn.
+	ServerNames types.ServerNames `json:"server_names"`
+	// Only return the children which are suggested by the space.
+	SuggestedOnly bool `json:"suggested_only"`
+}
+
+// QueryRoomHierarchyResponse is a response to QueryRoomHierarchy, in the
+// same form as the response to the federation /hierarchy API.
+type QueryRoomHierarchyResponse struct {
+	Room HierarchyRoom `json:"room"`
+	// The children of the room which the remote server knows about.
+	Children []HierarchyRoom `json:"children"`
+	// The IDs of the children which this server isn't allowed to see.
+	InaccessibleChildren []string `json:"inaccessible_children"`
+}
+
+// HierarchyRoom is a room in a space hierarchy (MSC2946), along with the
+// m.space.child events which point at its children.
+type HierarchyRoom struct {
+	gomatrixserverlib.PublicRoom
+	RoomType      string                `json:"room_type,omitempty"`
+	JoinRule      string                `json:"join_rule,omitempty"`
+	ChildrenState []HierarchyChildEvent `json:"children_state"`
+}
+
+// HierarchyChildEvent is a stripped m.space.child event, which keeps its
+// timestamp so that children can be ordered.
+type HierarchyChildEvent struct {
+	Type           string                      `json:"type"`
+	StateKey       string                      `json:"state_key"`
+	Sender         string                      `json:"sender"`
+	Content        json.RawMessage             `json:"content"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// HierarchyChildContent is the content of an m.space.child event.
+type HierarchyChildContent struct {
+	// The servers to reach the child through. Children without any are
+	// treated as having been removed from the space.
+	Via       []string `json:"via"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
+}
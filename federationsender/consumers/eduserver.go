@@ -35,6 +35,7 @@ type OutputEDUConsumer struct {
 	db                   storage.Database
 	queues               *queue.OutgoingQueues
 	ServerName           gomatrixserverlib.ServerName
+	TypingDisabled       bool
 	TypingTopic          string
 	SendToDeviceTopic    string
 }
@@ -60,6 +61,7 @@ func NewOutputEDUConsumer(
 		queues:            queues,
 		db:                store,
 		ServerName:        cfg.Matrix.ServerName,
+		TypingDisabled:    cfg.Matrix.DisableTyping,
 		TypingTopic:       string(cfg.Kafka.Topics.OutputTypingEvent),
 		SendToDeviceTopic: string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
 	}
@@ -71,8 +73,10 @@ func NewOutputEDUConsumer(
 
 // Start consuming from EDU servers
 func (t *OutputEDUConsumer) Start() error {
-	if err := t.typingConsumer.Start(); err != nil {
-		return fmt.Errorf("t.typingConsumer.Start: %w", err)
+	if !t.TypingDisabled {
+		if err := t.typingConsumer.Start(); err != nil {
+			return fmt.Errorf("t.typingConsumer.Start: %w", err)
+		}
 	}
 	if err := t.sendToDeviceConsumer.Start(); err != nil {
 		return fmt.Errorf("t.sendToDeviceConsumer.Start: %w", err)
@@ -56,6 +56,7 @@ func NewInternalAPI(
 			PrivateKey: base.Cfg.Matrix.PrivateKey,
 			ServerName: base.Cfg.Matrix.ServerName,
 		},
+		base.Cfg.IsEDUTypeEnabled,
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -73,5 +74,5 @@ func NewInternalAPI(
 		logrus.WithError(err).Panic("failed to start typing server consumer")
 	}
 
-	return internal.NewFederationSenderInternalAPI(federationSenderDB, base.Cfg, rsAPI, federation, keyRing, statistics, queues)
+	return internal.NewFederationSenderInternalAPI(federationSenderDB, base.Cfg, rsAPI, federation, keyRing, statistics, queues, base.Caches)
 }
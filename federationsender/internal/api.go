@@ -4,6 +4,7 @@ import (
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -18,6 +19,7 @@ type FederationSenderInternalAPI struct {
 	federation *gomatrixserverlib.FederationClient
 	keyRing    *gomatrixserverlib.KeyRing
 	queues     *queue.OutgoingQueues
+	aliasCache caching.RoomAliasCache
 }
 
 func NewFederationSenderInternalAPI(
@@ -27,6 +29,7 @@ func NewFederationSenderInternalAPI(
 	keyRing *gomatrixserverlib.KeyRing,
 	statistics *types.Statistics,
 	queues *queue.OutgoingQueues,
+	aliasCache caching.RoomAliasCache,
 ) *FederationSenderInternalAPI {
 	return &FederationSenderInternalAPI{
 		db:         db,
@@ -36,5 +39,6 @@ func NewFederationSenderInternalAPI(
 		keyRing:    keyRing,
 		statistics: statistics,
 		queues:     queues,
+		aliasCache: aliasCache,
 	}
 }
@@ -2,10 +2,13 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/federationsender/internal/perform"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -22,18 +25,33 @@ func (r *FederationSenderInternalAPI) PerformDirectoryLookup(
 	request *api.PerformDirectoryLookupRequest,
 	response *api.PerformDirectoryLookupResponse,
 ) (err error) {
+	// Popular aliases are looked up on every join, and remote servers can
+	// be slow to answer, so the answers are cached for a while, including
+	// the aliases which they don't know.
+	if roomID, servers, ok := r.aliasCache.GetRoomAlias(request.RoomAlias); ok {
+		response.RoomID = roomID
+		response.ServerNames = servers
+		return nil
+	}
 	dir, err := r.federation.LookupRoomAlias(
 		ctx,
 		request.ServerName,
 		request.RoomAlias,
 	)
 	if err != nil {
+		var httpErr gomatrix.HTTPError
+		if errors.As(err, &httpErr) && httpErr.Code == http.StatusNotFound {
+			r.statistics.ForServer(request.ServerName).Success()
+			r.aliasCache.StoreRoomAlias(request.RoomAlias, "", nil)
+			return nil
+		}
 		r.statistics.ForServer(request.ServerName).Failure()
 		return err
 	}
 	response.RoomID = dir.RoomID
 	response.ServerNames = dir.Servers
 	r.statistics.ForServer(request.ServerName).Success()
+	r.aliasCache.StoreRoomAlias(request.RoomAlias, dir.RoomID, dir.Servers)
 	return nil
 }
 
@@ -49,24 +67,40 @@ func (r *FederationSenderInternalAPI) PerformJoin(
 		supportedVersions = append(supportedVersions, version)
 	}
 
+	restrictions := &r.cfg.Matrix.JoinRestrictions
+	if !restrictions.AllowsRoom(r.cfg.Matrix.ServerName, request.RoomID) {
+		response.LastError = joinForbidden("Joining this room is not allowed on this server")
+		return
+	}
+
 	// Deduplicate the server names we were provided but keep the ordering
 	// as this encodes useful information about which servers are most likely
-	// to respond.
+	// to respond. Servers that we aren't allowed to join through are dropped.
 	seenSet := make(map[gomatrixserverlib.ServerName]bool)
 	var uniqueList []gomatrixserverlib.ServerName
 	for _, srv := range request.ServerNames {
-		if seenSet[srv] {
+		if seenSet[srv] || !restrictions.AllowsServer(r.cfg.Matrix.ServerName, srv) {
 			continue
 		}
 		seenSet[srv] = true
 		uniqueList = append(uniqueList, srv)
 	}
+	if len(uniqueList) == 0 && len(request.ServerNames) > 0 {
+		response.LastError = joinForbidden("Joining rooms through these servers is not allowed on this server")
+		return
+	}
 	request.ServerNames = uniqueList
 
 	// Try each server that we were provided until we land on one that
 	// successfully completes the make-join send-join dance.
 	var lastErr error
 	for _, serverName := range request.ServerNames {
+		// Don't move on to the next server if the user has given up on the
+		// join.
+		if err := ctx.Err(); err != nil {
+			lastErr = err
+			break
+		}
 		if err := r.performJoinUsingServer(
 			ctx,
 			request.RoomID,
@@ -108,6 +142,16 @@ func (r *FederationSenderInternalAPI) PerformJoin(
 	)
 }
 
+// joinForbidden returns an error for a join that isn't allowed, in the form
+// that the remote server would have refused it.
+func joinForbidden(msg string) *gomatrix.HTTPError {
+	body, _ := json.Marshal(jsonerror.Forbidden(msg))
+	return &gomatrix.HTTPError{
+		Code:    http.StatusForbidden,
+		Message: string(body),
+	}
+}
+
 func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	ctx context.Context,
 	roomID, userID string,
@@ -126,7 +170,10 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	)
 	if err != nil {
 		// TODO: Check if the user was not allowed to join the room.
-		r.statistics.ForServer(serverName).Failure()
+		// A request which was cancelled says nothing about the server.
+		if ctx.Err() == nil {
+			r.statistics.ForServer(serverName).Failure()
+		}
 		return fmt.Errorf("r.federation.MakeJoin: %w", err)
 	}
 	r.statistics.ForServer(serverName).Success()
@@ -178,11 +225,18 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 		respMakeJoin.RoomVersion,
 	)
 	if err != nil {
-		r.statistics.ForServer(serverName).Failure()
+		if ctx.Err() == nil {
+			r.statistics.ForServer(serverName).Failure()
+		}
 		return fmt.Errorf("r.federation.SendJoin: %w", err)
 	}
 	r.statistics.ForServer(serverName).Success()
 
+	// The other server now thinks that we're in the room, so the join has to
+	// be finished even if the user has given up waiting for it, otherwise we
+	// would be left with no state for a room we are joined to.
+	ctx = context.Background()
+
 	// Check that the send_join response was valid.
 	joinCtx := perform.JoinContext(r.federation, r.keyRing)
 	if err = joinCtx.CheckSendJoinResponse(
@@ -296,6 +350,108 @@ func (r *FederationSenderInternalAPI) PerformLeave(
 	)
 }
 
+// PerformKnock implements api.FederationSenderInternalAPI
+func (r *FederationSenderInternalAPI) PerformKnock(
+	ctx context.Context,
+	request *api.PerformKnockRequest,
+	response *api.PerformKnockResponse,
+) (err error) {
+	// Deduplicate the server names we were provided.
+	util.SortAndUnique(request.ServerNames)
+
+	// Only offer the room versions which let users knock.
+	var supportedVersions []gomatrixserverlib.RoomVersion
+	for roomVersion := range version.SupportedRoomVersions() {
+		if version.AllowsKnocking(roomVersion) {
+			supportedVersions = append(supportedVersions, roomVersion)
+		}
+	}
+	knockCtx := perform.KnockContext(
+		r.federation, r.cfg.Matrix.ServerName, r.cfg.Matrix.KeyID, r.cfg.Matrix.PrivateKey,
+	)
+
+	// Try each server that we were provided until we land on one that
+	// successfully completes the make-knock send-knock dance.
+	for _, serverName := range request.ServerNames {
+		respMakeKnock, err := knockCtx.MakeKnock(
+			ctx,
+			serverName,
+			request.RoomID,
+			request.UserID,
+			supportedVersions,
+		)
+		if err != nil {
+			logrus.WithError(err).Warnf("knockCtx.MakeKnock failed")
+			r.statistics.ForServer(serverName).Failure()
+			continue
+		}
+
+		// Set all the fields to be what they should be, this should be a no-op
+		// but it's possible that the remote server returned us something "odd"
+		respMakeKnock.KnockEvent.Type = gomatrixserverlib.MRoomMember
+		respMakeKnock.KnockEvent.Sender = request.UserID
+		respMakeKnock.KnockEvent.StateKey = &request.UserID
+		respMakeKnock.KnockEvent.RoomID = request.RoomID
+		respMakeKnock.KnockEvent.Redacts = ""
+		content := map[string]interface{}{
+			"membership": "knock",
+		}
+		if request.Reason != "" {
+			content["reason"] = request.Reason
+		}
+		if err = respMakeKnock.KnockEvent.SetContent(content); err != nil {
+			logrus.WithError(err).Warnf("respMakeKnock.KnockEvent.SetContent failed")
+			continue
+		}
+		if err = respMakeKnock.KnockEvent.SetUnsigned(struct{}{}); err != nil {
+			logrus.WithError(err).Warnf("respMakeKnock.KnockEvent.SetUnsigned failed")
+			continue
+		}
+
+		// Work out if we support the room version that has been supplied in
+		// the make_knock response.
+		if _, err = respMakeKnock.RoomVersion.EventFormat(); err != nil || !version.AllowsKnocking(respMakeKnock.RoomVersion) {
+			return gomatrixserverlib.UnsupportedRoomVersionError{}
+		}
+
+		// Build the knock event.
+		event, err := respMakeKnock.KnockEvent.Build(
+			time.Now(),
+			r.cfg.Matrix.ServerName,
+			r.cfg.Matrix.KeyID,
+			r.cfg.Matrix.PrivateKey,
+			respMakeKnock.RoomVersion,
+		)
+		if err != nil {
+			logrus.WithError(err).Warnf("respMakeKnock.KnockEvent.Build failed")
+			continue
+		}
+
+		// Try to perform a send_knock using the newly built event.
+		respSendKnock, err := knockCtx.SendKnock(
+			ctx,
+			serverName,
+			event,
+		)
+		if err != nil {
+			logrus.WithError(err).Warnf("knockCtx.SendKnock failed")
+			r.statistics.ForServer(serverName).Failure()
+			continue
+		}
+
+		r.statistics.ForServer(serverName).Success()
+		response.KnockEvent = event.Headered(respMakeKnock.RoomVersion)
+		response.KnockStateEvents = respSendKnock.KnockStateEvents
+		return nil
+	}
+
+	// If we reach here then we didn't complete a knock for some reason.
+	return fmt.Errorf(
+		"Failed to knock on room %q through %d server(s)",
+		request.RoomID, len(request.ServerNames),
+	)
+}
+
 // PerformServersAlive implements api.FederationSenderInternalAPI
 func (r *FederationSenderInternalAPI) PerformServersAlive(
 	ctx context.Context,
@@ -0,0 +1,93 @@
+package perform
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// This file contains helpers for the PerformKnock function, as gomatrixserverlib
+// doesn't know about make_knock and send_knock yet.
+
+// RespMakeKnock is the response to a make_knock request.
+type RespMakeKnock struct {
+	// An incomplete m.room.member event for a user on the requesting server
+	// generated by the responding server.
+	KnockEvent gomatrixserverlib.EventBuilder `json:"event"`
+	// The room version that we're trying to knock on.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+}
+
+// RespSendKnock is the response to a send_knock request.
+type RespSendKnock struct {
+	// The stripped state of the room, so that the user can see what they
+	// knocked on.
+	KnockStateEvents []gomatrixserverlib.InviteV2StrippedState `json:"knock_state_events"`
+}
+
+type knockContext struct {
+	federation *gomatrixserverlib.FederationClient
+	serverName gomatrixserverlib.ServerName
+	keyID      gomatrixserverlib.KeyID
+	privateKey ed25519.PrivateKey
+}
+
+// Returns a new knock context, which signs requests with the given key.
+func KnockContext(
+	f *gomatrixserverlib.FederationClient, serverName gomatrixserverlib.ServerName,
+	keyID gomatrixserverlib.KeyID, privateKey ed25519.PrivateKey,
+) *knockContext {
+	return &knockContext{
+		federation: f,
+		serverName: serverName,
+		keyID:      keyID,
+		privateKey: privateKey,
+	}
+}
+
+// MakeKnock asks a remote server for a knock event template for the user,
+// telling it which room versions we support.
+func (r knockContext) MakeKnock(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID, userID string,
+	roomVersions []gomatrixserverlib.RoomVersion,
+) (res RespMakeKnock, err error) {
+	query := url.Values{}
+	for _, v := range roomVersions {
+		query.Add("ver", string(v))
+	}
+	path := "/_matrix/federation/v1/make_knock/" +
+		url.PathEscape(roomID) + "/" +
+		url.PathEscape(userID) + "?" + query.Encode()
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	err = r.doRequest(ctx, req, &res)
+	return
+}
+
+// SendKnock sends a knock event built from the MakeKnock template to a remote
+// server, which returns the stripped state of the room.
+func (r knockContext) SendKnock(
+	ctx context.Context, s gomatrixserverlib.ServerName, event gomatrixserverlib.Event,
+) (res RespSendKnock, err error) {
+	path := "/_matrix/federation/v1/send_knock/" +
+		url.PathEscape(event.RoomID()) + "/" +
+		url.PathEscape(event.EventID())
+	req := gomatrixserverlib.NewFederationRequest("PUT", s, path)
+	if err = req.SetContent(event); err != nil {
+		return
+	}
+	err = r.doRequest(ctx, req, &res)
+	return
+}
+
+func (r knockContext) doRequest(ctx context.Context, req gomatrixserverlib.FederationRequest, res interface{}) error {
+	if err := req.Sign(r.serverName, r.keyID, r.privateKey); err != nil {
+		return err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return r.federation.DoRequestAndParseResponse(ctx, httpReq, res)
+}
@@ -2,9 +2,16 @@ package internal
 
 import (
 	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
 // QueryJoinedHostServerNamesInRoom implements api.FederationSenderInternalAPI
@@ -27,3 +34,134 @@ func (f *FederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 
 	return
 }
+
+// QueryServerSharesRoom implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryServerSharesRoom(
+	ctx context.Context,
+	request *api.QueryServerSharesRoomRequest,
+	response *api.QueryServerSharesRoomResponse,
+) (err error) {
+	response.SharesRoom, err = f.db.IsServerJoined(ctx, request.ServerName)
+	return
+}
+
+// QueryDestinationHealth implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryDestinationHealth(
+	ctx context.Context,
+	request *api.QueryDestinationHealthRequest,
+	response *api.QueryDestinationHealthResponse,
+) error {
+	now := time.Now()
+	response.WindowStart = gomatrixserverlib.AsTimestamp(now.Add(-types.DestinationStatsWindow))
+	attempts, err := f.db.GetDestinationAttempts(ctx, response.WindowStart)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[gomatrixserverlib.ServerName]bool, len(request.ServerNames))
+	for _, serverName := range request.ServerNames {
+		wanted[serverName] = true
+	}
+	byServer := make(map[gomatrixserverlib.ServerName][]types.DestinationAttempt)
+	for _, attempt := range attempts {
+		if len(wanted) == 0 || wanted[attempt.ServerName] {
+			byServer[attempt.ServerName] = append(byServer[attempt.ServerName], attempt)
+		}
+	}
+	// Servers which were asked for by name are returned even if nothing was
+	// sent to them in the window, since they might be blacklisted.
+	for serverName := range wanted {
+		if _, ok := byServer[serverName]; !ok {
+			byServer[serverName] = nil
+		}
+	}
+
+	response.Destinations = make([]api.DestinationHealth, 0, len(byServer))
+	for serverName, serverAttempts := range byServer {
+		health := destinationHealth(serverName, serverAttempts)
+		stats := f.statistics.ForServer(serverName)
+		health.ConsecutiveFailures = stats.FailureCount()
+		health.Blacklisted = stats.Blacklisted()
+		if backoff, duration := stats.BackoffDuration(); backoff {
+			health.BackingOff = true
+			health.BackoffUntil = gomatrixserverlib.AsTimestamp(now.Add(duration))
+		}
+		response.Destinations = append(response.Destinations, health)
+	}
+	sort.Slice(response.Destinations, func(i, j int) bool {
+		return response.Destinations[i].ServerName < response.Destinations[j].ServerName
+	})
+	return nil
+}
+
+// destinationHealth aggregates the requests made to a server, which must
+// be ordered by time.
+func destinationHealth(
+	serverName gomatrixserverlib.ServerName, attempts []types.DestinationAttempt,
+) api.DestinationHealth {
+	health := api.DestinationHealth{
+		ServerName: serverName,
+		Attempts:   len(attempts),
+	}
+	if len(attempts) == 0 {
+		return health
+	}
+	latencies := make([]time.Duration, 0, len(attempts))
+	for _, attempt := range attempts {
+		latencies = append(latencies, attempt.Latency)
+		if attempt.Error == "" {
+			health.Successes++
+			health.LastSuccessTS = attempt.Timestamp
+		} else {
+			health.LastError = attempt.Error
+			health.LastErrorTS = attempt.Timestamp
+		}
+	}
+	health.SuccessRate = float64(health.Successes) / float64(health.Attempts)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	median := latencies[len(latencies)/2]
+	if len(latencies)%2 == 0 {
+		median = (latencies[len(latencies)/2-1] + median) / 2
+	}
+	health.MedianLatencyMS = median.Milliseconds()
+	return health
+}
+
+// QueryRoomHierarchy implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryRoomHierarchy(
+	ctx context.Context,
+	request *api.QueryRoomHierarchyRequest,
+	response *api.QueryRoomHierarchyResponse,
+) error {
+	util.SortAndUnique(request.ServerNames)
+	path := "/_matrix/federation/unstable/org.matrix.msc2946/hierarchy/" + url.PathEscape(request.RoomID)
+	if request.SuggestedOnly {
+		path += "?suggested_only=true"
+	}
+	for _, serverName := range request.ServerNames {
+		if serverName == f.cfg.Matrix.ServerName {
+			continue
+		}
+		req := gomatrixserverlib.NewFederationRequest("GET", serverName, path)
+		if err := req.Sign(f.cfg.Matrix.ServerName, f.cfg.Matrix.KeyID, f.cfg.Matrix.PrivateKey); err != nil {
+			return err
+		}
+		httpReq, err := req.HTTPRequest()
+		if err != nil {
+			return err
+		}
+		var res api.QueryRoomHierarchyResponse
+		if err = f.federation.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+			logrus.WithError(err).Warnf("failed to get the hierarchy of room %q from %q", request.RoomID, serverName)
+			f.statistics.ForServer(serverName).Failure()
+			continue
+		}
+		f.statistics.ForServer(serverName).Success()
+		*response = res
+		return nil
+	}
+	return fmt.Errorf(
+		"failed to get the hierarchy of room %q through %d server(s)",
+		request.RoomID, len(request.ServerNames),
+	)
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+)
+
+func TestDestinationHealth(t *testing.T) {
+	attempts := []types.DestinationAttempt{
+		{ServerName: "remote", Timestamp: 1000, Latency: 40 * time.Millisecond},
+		{ServerName: "remote", Timestamp: 2000, Latency: 10 * time.Millisecond, Error: "connection refused"},
+		{ServerName: "remote", Timestamp: 3000, Latency: 30 * time.Millisecond},
+		{ServerName: "remote", Timestamp: 4000, Latency: 20 * time.Millisecond, Error: "timeout"},
+	}
+	health := destinationHealth("remote", attempts)
+	if health.Attempts != 4 || health.Successes != 2 || health.SuccessRate != 0.5 {
+		t.Errorf("got %d attempts, %d successes, success rate %v, want 4, 2, 0.5", health.Attempts, health.Successes, health.SuccessRate)
+	}
+	if health.MedianLatencyMS != 25 {
+		t.Errorf("got median latency %dms, want 25ms", health.MedianLatencyMS)
+	}
+	if health.LastError != "timeout" || health.LastErrorTS != 4000 || health.LastSuccessTS != 3000 {
+		t.Errorf("got last error %q at %d and last success at %d", health.LastError, health.LastErrorTS, health.LastSuccessTS)
+	}
+
+	health = destinationHealth("quiet", nil)
+	if health.Attempts != 0 || health.SuccessRate != 0 || health.MedianLatencyMS != 0 {
+		t.Errorf("expected empty health for a server with no attempts, got %+v", health)
+	}
+}
@@ -14,10 +14,14 @@ import (
 // HTTP paths for the internal HTTP API
 const (
 	FederationSenderQueryJoinedHostServerNamesInRoomPath = "/federationsender/queryJoinedHostServerNamesInRoom"
+	FederationSenderQueryServerSharesRoomPath            = "/federationsender/queryServerSharesRoom"
+	FederationSenderQueryDestinationHealthPath           = "/federationsender/queryDestinationHealth"
+	FederationSenderQueryRoomHierarchyPath               = "/federationsender/queryRoomHierarchy"
 
 	FederationSenderPerformDirectoryLookupRequestPath = "/federationsender/performDirectoryLookup"
 	FederationSenderPerformJoinRequestPath            = "/federationsender/performJoinRequest"
 	FederationSenderPerformLeaveRequestPath           = "/federationsender/performLeaveRequest"
+	FederationSenderPerformKnockRequestPath           = "/federationsender/performKnockRequest"
 	FederationSenderPerformServersAlivePath           = "/federationsender/performServersAlive"
 )
 
@@ -48,6 +52,19 @@ func (h *httpFederationSenderInternalAPI) PerformLeave(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// Handle an instruction to make_knock & send_knock with a remote server.
+func (h *httpFederationSenderInternalAPI) PerformKnock(
+	ctx context.Context,
+	request *api.PerformKnockRequest,
+	response *api.PerformKnockResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformKnockRequest")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderPerformKnockRequestPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpFederationSenderInternalAPI) PerformServersAlive(
 	ctx context.Context,
 	request *api.PerformServersAliveRequest,
@@ -73,6 +90,45 @@ func (h *httpFederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryServerSharesRoom implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryServerSharesRoom(
+	ctx context.Context,
+	request *api.QueryServerSharesRoomRequest,
+	response *api.QueryServerSharesRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerSharesRoom")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryServerSharesRoomPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryDestinationHealth implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryDestinationHealth(
+	ctx context.Context,
+	request *api.QueryDestinationHealthRequest,
+	response *api.QueryDestinationHealthResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDestinationHealth")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryDestinationHealthPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryRoomHierarchy implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryRoomHierarchy(
+	ctx context.Context,
+	request *api.QueryRoomHierarchyRequest,
+	response *api.QueryRoomHierarchyResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomHierarchy")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryRoomHierarchyPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // Handle an instruction to make_join & send_join with a remote server.
 func (h *httpFederationSenderInternalAPI) PerformJoin(
 	ctx context.Context,
@@ -32,6 +32,7 @@ import (
 )
 
 const maxPDUsPerTransaction = 50
+const maxEDUsPerTransaction = 100
 const queueIdleTimeout = time.Second * 30
 
 // destinationQueue is a queue of events for a single destination.
@@ -57,6 +58,7 @@ type destinationQueue struct {
 	pendingInvites     []*gomatrixserverlib.InviteV2Request    // owned by backgroundSend
 	notifyPDUs         chan bool                               // interrupts idle wait for PDUs
 	interruptBackoff   chan bool                               // interrupts backoff
+	attempts           chan<- types.DestinationAttempt         // requests to be recorded
 }
 
 // Send event adds the event to the pending queue for the destination.
@@ -116,6 +118,37 @@ func (oq *destinationQueue) sendEDU(ev *gomatrixserverlib.EDU) {
 	oq.incomingEDUs <- ev
 }
 
+// sendPersistentEDU adds the EDU, which has already been stored in the
+// database with the given NID, to the pending queue for the destination.
+// Unlike sendEDU, the EDU will survive a restart until it is sent.
+func (oq *destinationQueue) sendPersistentEDU(nid int64, eduType string) {
+	if oq.statistics.Blacklisted() {
+		// If the destination is blacklisted then drop the event.
+		log.Infof("%s is blacklisted; dropping EDU", oq.destination)
+		return
+	}
+	// Create a database entry that associates the given EDU NID with
+	// this destination queue. We'll then be able to retrieve the EDU
+	// later.
+	if err := oq.db.AssociateEDUWithDestination(
+		context.TODO(),
+		oq.destination, // the destination server name
+		nid,            // NID from federationsender_queue_json table
+		eduType,        // the EDU type
+	); err != nil {
+		log.WithError(err).Errorf("failed to associate EDU NID %d with destination %q", nid, oq.destination)
+		return
+	}
+	// Wake up the queue if it's asleep.
+	oq.wakeQueueIfNeeded()
+	// If we're blocking on waiting for work then tell the queue that
+	// we have something to do.
+	select {
+	case oq.notifyPDUs <- true:
+	default:
+	}
+}
+
 // sendInvite adds the invite event to the pending queue for the
 // destination. If the queue is empty then it starts a background
 // goroutine to start sending events to that destination.
@@ -144,18 +177,23 @@ func (oq *destinationQueue) wakeQueueIfNeeded() {
 	}
 }
 
-// waitForPDUs returns a channel for pending PDUs, which will be
-// used in backgroundSend select. It returns a closed channel if
-// there is something pending right now, or an open channel if
-// we're waiting for something.
+// waitForPDUs returns a channel for pending PDUs and persisted EDUs,
+// which will be used in backgroundSend select. It returns a closed
+// channel if there is something pending right now, or an open channel
+// if we're waiting for something.
 func (oq *destinationQueue) waitForPDUs() chan bool {
 	pendingPDUs, err := oq.db.GetPendingPDUCount(context.TODO(), oq.destination)
 	if err != nil {
 		log.WithError(err).Errorf("Failed to get pending PDU count on queue %q", oq.destination)
 	}
-	// If there are PDUs pending right now then we'll return a closed
-	// channel. This will mean that the backgroundSend will not block.
-	if pendingPDUs > 0 {
+	pendingEDUs, err := oq.db.GetPendingEDUCount(context.TODO(), oq.destination)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to get pending EDU count on queue %q", oq.destination)
+	}
+	// If there are PDUs or EDUs pending right now then we'll return a
+	// closed channel. This will mean that the backgroundSend will not
+	// block.
+	if pendingPDUs > 0 || pendingEDUs > 0 {
 		ch := make(chan bool, 1)
 		close(ch)
 		return ch
@@ -183,13 +221,13 @@ func (oq *destinationQueue) backgroundSend() {
 		// until we hit an idle timeout.
 		select {
 		case <-oq.waitForPDUs():
-			// We were woken up because there are new PDUs waiting in the
-			// database.
+			// We were woken up because there are new PDUs or persisted
+			// EDUs waiting in the database.
 			pendingPDUs = true
 		case edu := <-oq.incomingEDUs:
-			// EDUs are handled in-memory for now. We will try to keep
-			// the ordering intact.
-			// TODO: Certain EDU types need persistence, e.g. send-to-device
+			// Ephemeral EDUs are handled in-memory. We will try to keep
+			// the ordering intact. EDUs that need persistence, e.g.
+			// send-to-device, are instead picked up from the database.
 			oq.pendingEDUs = append(oq.pendingEDUs, edu)
 			// If there are any more things waiting in the channel queue
 			// then read them. This is safe because we guarantee only
@@ -353,9 +391,25 @@ func (oq *destinationQueue) nextTransaction(
 		return false, fmt.Errorf("oq.db.GetNextTransactionPDUs: %w", err)
 	}
 
+	// Also ask the database for any persisted EDUs, making sure that we
+	// leave room for the in-memory EDUs in the transaction.
+	var eduNIDs []int64
+	var persistedEDUs []*gomatrixserverlib.EDU
+	if limit := maxEDUsPerTransaction - len(pendingEDUs); limit > 0 {
+		eduNIDs, persistedEDUs, err = oq.db.GetNextTransactionEDUs(
+			ctx,            // context
+			oq.destination, // server name
+			limit,          // max EDUs to retrieve
+		)
+		if err != nil {
+			log.WithError(err).Errorf("failed to get next transaction EDUs for server %q", oq.destination)
+			return false, fmt.Errorf("oq.db.GetNextTransactionEDUs: %w", err)
+		}
+	}
+
 	// If we didn't get anything from the database and there are no
 	// pending EDUs then there's nothing to do - stop here.
-	if len(pdus) == 0 && len(pendingEDUs) == 0 {
+	if len(pdus) == 0 && len(persistedEDUs) == 0 && len(pendingEDUs) == 0 {
 		return false, nil
 	}
 
@@ -376,7 +430,10 @@ func (oq *destinationQueue) nextTransaction(
 		t.PDUs = append(t.PDUs, (*pdu).JSON())
 	}
 
-	// Do the same for pending EDUS in the queue.
+	// Do the same for persisted EDUs and pending EDUs in the queue.
+	for _, edu := range persistedEDUs {
+		t.EDUs = append(t.EDUs, *edu)
+	}
 	for _, edu := range pendingEDUs {
 		t.EDUs = append(t.EDUs, *edu)
 	}
@@ -389,7 +446,9 @@ func (oq *destinationQueue) nextTransaction(
 	// to a 400-ish error
 	ctx, cancel = context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
+	start := time.Now()
 	_, err = oq.client.SendTransaction(ctx, t)
+	oq.recordAttempt(start, err)
 	switch err.(type) {
 	case nil:
 		// Clean up the transaction in the database.
@@ -400,6 +459,13 @@ func (oq *destinationQueue) nextTransaction(
 		); err != nil {
 			log.WithError(err).Errorf("failed to clean transaction %q for server %q", t.TransactionID, t.Destination)
 		}
+		if err = oq.db.CleanEDUs(
+			context.Background(),
+			t.Destination,
+			eduNIDs,
+		); err != nil {
+			log.WithError(err).Errorf("failed to clean EDUs for server %q", t.Destination)
+		}
 		return true, nil
 	case gomatrix.HTTPError:
 		// Report that we failed to send the transaction and we
@@ -414,6 +480,26 @@ func (oq *destinationQueue) nextTransaction(
 	}
 }
 
+// recordAttempt queues the outcome of a request to the destination which was
+// started at the given time to be stored for the destination health admin
+// API. It never blocks: if too many requests are waiting to be stored then
+// this one is dropped.
+func (oq *destinationQueue) recordAttempt(start time.Time, err error) {
+	attempt := types.DestinationAttempt{
+		ServerName: oq.destination,
+		Timestamp:  gomatrixserverlib.AsTimestamp(start),
+		Latency:    time.Since(start),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	select {
+	case oq.attempts <- attempt:
+	default:
+		log.Warnf("too many requests waiting to be recorded; dropping request to server %q", oq.destination)
+	}
+}
+
 // nextInvite takes pending invite events from the queue and sends
 // them. Returns true if a transaction was sent or false otherwise.
 func (oq *destinationQueue) nextInvites(
@@ -429,11 +515,13 @@ func (oq *destinationQueue) nextInvites(
 			"destination":  oq.destination,
 		}).Info("sending invite")
 
+		start := time.Now()
 		inviteRes, err := oq.client.SendInviteV2(
 			context.TODO(),
 			oq.destination,
 			*inviteReq,
 		)
+		oq.recordAttempt(start, err)
 		switch e := err.(type) {
 		case nil:
 			done++
@@ -29,6 +29,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// attemptsBufferSize is how many requests to destinations can be waiting to be
+// recorded for the destination health admin API before more are dropped.
+const attemptsBufferSize = 1024
+
 // OutgoingQueues is a collection of queues for sending transactions to other
 // matrix servers
 type OutgoingQueues struct {
@@ -38,7 +42,9 @@ type OutgoingQueues struct {
 	client      *gomatrixserverlib.FederationClient
 	statistics  *types.Statistics
 	signing     *SigningInfo
-	queuesMutex sync.Mutex // protects the below
+	eduEnabled  func(eduType string) bool     // whether EDUs of a type may be sent
+	attempts    chan types.DestinationAttempt // requests to be recorded by recordAttempts
+	queuesMutex sync.Mutex                    // protects the below
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
 }
 
@@ -50,6 +56,7 @@ func NewOutgoingQueues(
 	rsAPI api.RoomserverInternalAPI,
 	statistics *types.Statistics,
 	signing *SigningInfo,
+	eduEnabled func(eduType string) bool,
 ) *OutgoingQueues {
 	queues := &OutgoingQueues{
 		db:         db,
@@ -58,8 +65,11 @@ func NewOutgoingQueues(
 		client:     client,
 		statistics: statistics,
 		signing:    signing,
+		eduEnabled: eduEnabled,
+		attempts:   make(chan types.DestinationAttempt, attemptsBufferSize),
 		queues:     map[gomatrixserverlib.ServerName]*destinationQueue{},
 	}
+	go queues.recordAttempts()
 	// Look up which servers we have pending items for and then rehydrate those queues.
 	if serverNames, err := db.GetPendingServerNames(context.Background()); err == nil {
 		for _, serverName := range serverNames {
@@ -79,6 +89,17 @@ type SigningInfo struct {
 	PrivateKey ed25519.PrivateKey
 }
 
+// recordAttempts stores the outcomes of the requests which the destination
+// queues made, so that they don't have to wait for the database to send.
+func (oqs *OutgoingQueues) recordAttempts() {
+	for attempt := range oqs.attempts {
+		windowStart := gomatrixserverlib.AsTimestamp(attempt.Timestamp.Time().Add(-types.DestinationStatsWindow))
+		if err := oqs.db.RecordDestinationAttempt(context.Background(), attempt, windowStart); err != nil {
+			log.WithError(err).Errorf("failed to record request to server %q", attempt.ServerName)
+		}
+	}
+}
+
 func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *destinationQueue {
 	oqs.queuesMutex.Lock()
 	defer oqs.queuesMutex.Unlock()
@@ -96,6 +117,7 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 			notifyPDUs:       make(chan bool, 1),
 			interruptBackoff: make(chan bool),
 			signing:          oqs.signing,
+			attempts:         oqs.attempts,
 		}
 		oqs.queues[destination] = oq
 	}
@@ -187,6 +209,13 @@ func (oqs *OutgoingQueues) SendEDU(
 		)
 	}
 
+	// Don't send EDUs for features that have been disabled, e.g. typing
+	// notifications, to remote servers.
+	if !oqs.eduEnabled(e.Type) {
+		log.WithField("edu_type", e.Type).Debug("Dropping EDU of a disabled type")
+		return nil
+	}
+
 	// Remove our own server from the list of destinations.
 	destinations = filterAndDedupeDests(oqs.origin, destinations)
 
@@ -196,6 +225,27 @@ func (oqs *OutgoingQueues) SendEDU(
 		}).Info("Sending EDU event")
 	}
 
+	// Some EDUs, like send-to-device messages, must not be lost if we
+	// restart before they have been delivered, so put those into the
+	// database rather than only holding them in memory.
+	if isPersistentEDU(e.Type) && len(destinations) > 0 {
+		ephemeralJSON, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("json.Marshal: %w", err)
+		}
+
+		nid, err := oqs.db.StoreJSON(context.TODO(), string(ephemeralJSON))
+		if err != nil {
+			return fmt.Errorf("sendedu: oqs.db.StoreJSON: %w", err)
+		}
+
+		for _, destination := range destinations {
+			oqs.getQueue(destination).sendPersistentEDU(nid, e.Type)
+		}
+
+		return nil
+	}
+
 	for _, destination := range destinations {
 		oqs.getQueue(destination).sendEDU(e)
 	}
@@ -203,6 +253,12 @@ func (oqs *OutgoingQueues) SendEDU(
 	return nil
 }
 
+// isPersistentEDU returns true if EDUs of the given type should be
+// stored in the database until they have been sent successfully.
+func isPersistentEDU(eduType string) bool {
+	return eduType == gomatrixserverlib.MDirectToDevice
+}
+
 // RetryServer attempts to resend events to the given server if we had given up.
 func (oqs *OutgoingQueues) RetryServer(srv gomatrixserverlib.ServerName) {
 	q := oqs.getQueue(srv)
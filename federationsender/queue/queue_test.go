@@ -0,0 +1,98 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeAttemptsDatabase only implements recording requests to destinations,
+// blocking until it is unblocked.
+type fakeAttemptsDatabase struct {
+	storage.Database
+	unblock  chan struct{}
+	recorded chan types.DestinationAttempt
+}
+
+func (d *fakeAttemptsDatabase) RecordDestinationAttempt(
+	ctx context.Context, attempt types.DestinationAttempt, windowStart gomatrixserverlib.Timestamp,
+) error {
+	<-d.unblock
+	d.recorded <- attempt
+	return nil
+}
+
+func TestRecordAttemptDoesNotBlock(t *testing.T) {
+	db := &fakeAttemptsDatabase{
+		unblock:  make(chan struct{}),
+		recorded: make(chan types.DestinationAttempt, attemptsBufferSize+1),
+	}
+	oqs := &OutgoingQueues{
+		db:       db,
+		attempts: make(chan types.DestinationAttempt, attemptsBufferSize),
+	}
+	go oqs.recordAttempts()
+	oq := &destinationQueue{destination: "example.com", attempts: oqs.attempts}
+
+	// The database is blocked, so this only returns if recording the
+	// attempts doesn't wait for it.
+	done := make(chan struct{})
+	go func() {
+		oq.recordAttempt(time.Now(), errors.New("failed"))
+		for i := 0; i < attemptsBufferSize+10; i++ {
+			oq.recordAttempt(time.Now(), nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("recordAttempt blocked on the database")
+	}
+
+	close(db.unblock)
+	select {
+	case attempt := <-db.recorded:
+		if attempt.ServerName != "example.com" || attempt.Error != "failed" {
+			t.Errorf("got attempt %+v, want the failed request to example.com", attempt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the attempt wasn't recorded")
+	}
+}
+
+func TestSendEDUDropsDisabledTypes(t *testing.T) {
+	oqs := &OutgoingQueues{
+		origin: "localhost",
+		eduEnabled: func(eduType string) bool {
+			return eduType != "m.typing"
+		},
+		queues: map[gomatrixserverlib.ServerName]*destinationQueue{},
+	}
+	edu := &gomatrixserverlib.EDU{Type: "m.typing", Content: []byte(`{}`)}
+	if err := oqs.SendEDU(edu, "localhost", []gomatrixserverlib.ServerName{"example.com"}); err != nil {
+		t.Fatalf("SendEDU failed: %s", err)
+	}
+	if len(oqs.queues) != 0 {
+		t.Errorf("got %d destination queues after sending a disabled EDU, want none", len(oqs.queues))
+	}
+}
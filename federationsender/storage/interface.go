@@ -26,10 +26,17 @@ type Database interface {
 	internal.PartitionStorer
 	UpdateRoom(ctx context.Context, roomID, oldEventID, newEventID string, addHosts []types.JoinedHost, removeHosts []string) (joinedHosts []types.JoinedHost, err error)
 	GetJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error)
+	IsServerJoined(ctx context.Context, serverName gomatrixserverlib.ServerName) (bool, error)
 	StoreJSON(ctx context.Context, js string) (int64, error)
 	AssociatePDUWithDestination(ctx context.Context, transactionID gomatrixserverlib.TransactionID, serverName gomatrixserverlib.ServerName, nids []int64) error
 	GetNextTransactionPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, limit int) (gomatrixserverlib.TransactionID, []*gomatrixserverlib.HeaderedEvent, error)
 	CleanTransactionPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, transactionID gomatrixserverlib.TransactionID) error
 	GetPendingPDUCount(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
+	AssociateEDUWithDestination(ctx context.Context, serverName gomatrixserverlib.ServerName, nid int64, eduType string) error
+	GetNextTransactionEDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, limit int) ([]int64, []*gomatrixserverlib.EDU, error)
+	CleanEDUs(ctx context.Context, serverName gomatrixserverlib.ServerName, nids []int64) error
+	GetPendingEDUCount(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
 	GetPendingServerNames(ctx context.Context) ([]gomatrixserverlib.ServerName, error)
+	RecordDestinationAttempt(ctx context.Context, attempt types.DestinationAttempt, windowStart gomatrixserverlib.Timestamp) error
+	GetDestinationAttempts(ctx context.Context, since gomatrixserverlib.Timestamp) ([]types.DestinationAttempt, error)
 }
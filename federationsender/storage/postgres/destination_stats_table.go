@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const destinationStatsSchema = `
+-- The outcome of each recent request to a remote server, which the
+-- destination health admin API is built from.
+CREATE TABLE IF NOT EXISTS federationsender_destination_stats (
+	-- The remote server which the request was sent to
+	server_name TEXT NOT NULL,
+	-- When the request was made
+	attempt_ts BIGINT NOT NULL,
+	-- How long the remote server took to respond, in milliseconds
+	latency_ms BIGINT NOT NULL,
+	-- Why the request failed, or empty if it succeeded
+	error TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS federationsender_destination_stats_attempt_ts
+	ON federationsender_destination_stats (attempt_ts);
+`
+
+const insertDestinationAttemptSQL = "" +
+	"INSERT INTO federationsender_destination_stats (server_name, attempt_ts, latency_ms, error)" +
+	" VALUES ($1, $2, $3, $4)"
+
+const selectDestinationAttemptsSQL = "" +
+	"SELECT server_name, attempt_ts, latency_ms, error FROM federationsender_destination_stats" +
+	" WHERE attempt_ts >= $1" +
+	" ORDER BY server_name, attempt_ts"
+
+const deleteDestinationAttemptsBeforeSQL = "" +
+	"DELETE FROM federationsender_destination_stats WHERE attempt_ts < $1"
+
+type destinationStatsStatements struct {
+	insertDestinationAttemptStmt        *sql.Stmt
+	selectDestinationAttemptsStmt       *sql.Stmt
+	deleteDestinationAttemptsBeforeStmt *sql.Stmt
+}
+
+func (s *destinationStatsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(destinationStatsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertDestinationAttemptStmt, err = db.Prepare(insertDestinationAttemptSQL); err != nil {
+		return
+	}
+	if s.selectDestinationAttemptsStmt, err = db.Prepare(selectDestinationAttemptsSQL); err != nil {
+		return
+	}
+	if s.deleteDestinationAttemptsBeforeStmt, err = db.Prepare(deleteDestinationAttemptsBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *destinationStatsStatements) insertDestinationAttempt(
+	ctx context.Context, txn *sql.Tx, attempt types.DestinationAttempt,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertDestinationAttemptStmt)
+	_, err := stmt.ExecContext(
+		ctx, attempt.ServerName, attempt.Timestamp, attempt.Latency.Milliseconds(), attempt.Error,
+	)
+	return err
+}
+
+func (s *destinationStatsStatements) selectDestinationAttempts(
+	ctx context.Context, since gomatrixserverlib.Timestamp,
+) ([]types.DestinationAttempt, error) {
+	rows, err := s.selectDestinationAttemptsStmt.QueryContext(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectDestinationAttempts: rows.close() failed")
+
+	var attempts []types.DestinationAttempt
+	for rows.Next() {
+		var attempt types.DestinationAttempt
+		var latencyMS int64
+		if err = rows.Scan(&attempt.ServerName, &attempt.Timestamp, &latencyMS, &attempt.Error); err != nil {
+			return nil, err
+		}
+		attempt.Latency = time.Duration(latencyMS) * time.Millisecond
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+func (s *destinationStatsStatements) deleteDestinationAttemptsBefore(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteDestinationAttemptsBeforeStmt)
+	_, err := stmt.ExecContext(ctx, before)
+	return err
+}
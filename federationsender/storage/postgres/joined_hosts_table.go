@@ -57,10 +57,14 @@ const selectJoinedHostsSQL = "" +
 	"SELECT event_id, server_name FROM federationsender_joined_hosts" +
 	" WHERE room_id = $1"
 
+const selectServerJoinedSQL = "" +
+	"SELECT EXISTS(SELECT 1 FROM federationsender_joined_hosts WHERE server_name = $1)"
+
 type joinedHostsStatements struct {
-	insertJoinedHostsStmt *sql.Stmt
-	deleteJoinedHostsStmt *sql.Stmt
-	selectJoinedHostsStmt *sql.Stmt
+	insertJoinedHostsStmt  *sql.Stmt
+	deleteJoinedHostsStmt  *sql.Stmt
+	selectJoinedHostsStmt  *sql.Stmt
+	selectServerJoinedStmt *sql.Stmt
 }
 
 func (s *joinedHostsStatements) prepare(db *sql.DB) (err error) {
@@ -77,6 +81,9 @@ func (s *joinedHostsStatements) prepare(db *sql.DB) (err error) {
 	if s.selectJoinedHostsStmt, err = db.Prepare(selectJoinedHostsSQL); err != nil {
 		return
 	}
+	if s.selectServerJoinedStmt, err = db.Prepare(selectServerJoinedSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -112,6 +119,13 @@ func (s *joinedHostsStatements) selectJoinedHosts(
 	return joinedHostsFromStmt(ctx, s.selectJoinedHostsStmt, roomID)
 }
 
+func (s *joinedHostsStatements) selectServerJoined(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (joined bool, err error) {
+	err = s.selectServerJoinedStmt.QueryRowContext(ctx, serverName).Scan(&joined)
+	return
+}
+
 func joinedHostsFromStmt(
 	ctx context.Context, stmt *sql.Stmt, roomID string,
 ) ([]types.JoinedHost, error) {
@@ -31,7 +31,9 @@ type Database struct {
 	joinedHostsStatements
 	roomStatements
 	queuePDUsStatements
+	queueEDUsStatements
 	queueJSONStatements
+	destinationStatsStatements
 	sqlutil.PartitionOffsetStatements
 	db *sql.DB
 }
@@ -64,10 +66,18 @@ func (d *Database) prepare() error {
 		return err
 	}
 
+	if err = d.queueEDUsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
 	if err = d.queueJSONStatements.prepare(d.db); err != nil {
 		return err
 	}
 
+	if err = d.destinationStatsStatements.prepare(d.db); err != nil {
+		return err
+	}
+
 	return d.PartitionOffsetStatements.Prepare(d.db, "federationsender")
 }
 
@@ -134,6 +144,14 @@ func (d *Database) GetJoinedHosts(
 	return d.selectJoinedHosts(ctx, roomID)
 }
 
+// IsServerJoined returns whether any user from the given server is joined
+// to a room which this server is also joined to.
+func (d *Database) IsServerJoined(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (bool, error) {
+	return d.selectServerJoined(ctx, serverName)
+}
+
 // StoreJSON adds a JSON blob into the queue JSON table and returns
 // a NID. The NID will then be used when inserting the per-destination
 // metadata entries.
@@ -265,10 +283,152 @@ func (d *Database) GetPendingPDUCount(
 	return d.selectQueuePDUCount(ctx, nil, serverName)
 }
 
+// AssociateEDUWithDestination creates an association that the
+// destination queues will use to determine which persisted EDUs
+// to send to which servers.
+func (d *Database) AssociateEDUWithDestination(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	nid int64,
+	eduType string,
+) error {
+	if err := d.insertQueueEDU(ctx, nil, eduType, serverName, nid); err != nil {
+		return fmt.Errorf("d.insertQueueEDU: %w", err)
+	}
+	return nil
+}
+
+// GetNextTransactionEDUs retrieves the oldest persisted EDUs that are
+// waiting to be sent to the given server, up to the limit specified.
+// The returned NIDs should be passed to CleanEDUs once the EDUs have
+// been sent successfully.
+func (d *Database) GetNextTransactionEDUs(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	limit int,
+) (
+	nids []int64,
+	edus []*gomatrixserverlib.EDU,
+	err error,
+) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		nids, err = d.selectQueueEDUs(ctx, txn, serverName, limit)
+		if err != nil {
+			return fmt.Errorf("d.selectQueueEDUs: %w", err)
+		}
+
+		if len(nids) == 0 {
+			return nil
+		}
+
+		blobs, err := d.selectQueueJSON(ctx, txn, nids)
+		if err != nil {
+			return fmt.Errorf("d.selectQueueJSON: %w", err)
+		}
+
+		for _, nid := range nids {
+			blob, ok := blobs[nid]
+			if !ok {
+				continue
+			}
+			var edu gomatrixserverlib.EDU
+			if err := json.Unmarshal(blob, &edu); err != nil {
+				return fmt.Errorf("json.Unmarshal: %w", err)
+			}
+			edus = append(edus, &edu)
+		}
+
+		return nil
+	})
+	return
+}
+
+// CleanEDUs removes the given persisted EDUs from the queue for the
+// given server, and removes the JSON blobs if no other destination
+// still references them. This is done when the EDUs were sent
+// successfully.
+func (d *Database) CleanEDUs(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+	nids []int64,
+) error {
+	if len(nids) == 0 {
+		return nil
+	}
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteQueueEDUs(ctx, txn, serverName, nids); err != nil {
+			return fmt.Errorf("d.deleteQueueEDUs: %w", err)
+		}
+
+		var deleteNIDs []int64
+		for _, nid := range nids {
+			count, err := d.selectQueueEDUReferenceJSONCount(ctx, txn, nid)
+			if err != nil {
+				return fmt.Errorf("d.selectQueueEDUReferenceJSONCount: %w", err)
+			}
+			if count == 0 {
+				deleteNIDs = append(deleteNIDs, nid)
+			}
+		}
+
+		if len(deleteNIDs) > 0 {
+			if err := d.deleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
+				return fmt.Errorf("d.deleteQueueJSON: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetPendingEDUCount returns the number of persisted EDUs waiting
+// to be sent for a given servername.
+func (d *Database) GetPendingEDUCount(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName,
+) (int64, error) {
+	return d.selectQueueEDUCount(ctx, nil, serverName)
+}
+
 // GetPendingServerNames returns the server names that have PDUs
-// waiting to be sent.
+// or persisted EDUs waiting to be sent.
 func (d *Database) GetPendingServerNames(
 	ctx context.Context,
 ) ([]gomatrixserverlib.ServerName, error) {
-	return d.selectQueueServerNames(ctx, nil)
+	pduServerNames, err := d.selectQueueServerNames(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("d.selectQueueServerNames: %w", err)
+	}
+	eduServerNames, err := d.selectQueueEDUServerNames(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("d.selectQueueEDUServerNames: %w", err)
+	}
+	return append(pduServerNames, eduServerNames...), nil
+}
+
+// RecordDestinationAttempt stores the outcome of a request to a remote
+// server. Outcomes from before windowStart are forgotten.
+func (d *Database) RecordDestinationAttempt(
+	ctx context.Context,
+	attempt types.DestinationAttempt,
+	windowStart gomatrixserverlib.Timestamp,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.insertDestinationAttempt(ctx, txn, attempt); err != nil {
+			return fmt.Errorf("d.insertDestinationAttempt: %w", err)
+		}
+		if err := d.deleteDestinationAttemptsBefore(ctx, txn, windowStart); err != nil {
+			return fmt.Errorf("d.deleteDestinationAttemptsBefore: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetDestinationAttempts returns the outcomes of the requests to remote
+// servers since the given time, ordered by server name and then time.
+func (d *Database) GetDestinationAttempts(
+	ctx context.Context,
+	since gomatrixserverlib.Timestamp,
+) ([]types.DestinationAttempt, error) {
+	return d.selectDestinationAttempts(ctx, since)
 }
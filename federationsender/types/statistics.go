@@ -14,6 +14,9 @@ const (
 	// just blacklist the host altogether? Bear in mind that the backoff
 	// is exponential, so the max time here to attempt is 2**failures.
 	FailuresUntilBlacklist = 16 // 16 equates to roughly 18 hours.
+	// DestinationStatsWindow is how long the outcome of each request to a
+	// remote server is kept for the destination health admin API.
+	DestinationStatsWindow = 24 * time.Hour
 )
 
 // Statistics contains information about all of the remote federated
@@ -115,6 +118,11 @@ func (s *ServerStatistics) Blacklisted() bool {
 	return s.blacklisted.Load()
 }
 
+// FailureCount returns the number of consecutive failed requests.
+func (s *ServerStatistics) FailureCount() uint32 {
+	return s.failCounter.Load()
+}
+
 // SuccessCount returns the number of successful requests. This is
 // usually useful in constructing transaction IDs.
 func (s *ServerStatistics) SuccessCount() uint32 {
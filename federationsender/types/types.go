@@ -16,6 +16,7 @@ package types
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -49,3 +50,15 @@ func (e EventIDMismatchError) Error() string {
 		e.DatabaseID, e.RoomServerID,
 	)
 }
+
+// A DestinationAttempt is the outcome of a request which the federation
+// sender made to a remote server.
+type DestinationAttempt struct {
+	ServerName gomatrixserverlib.ServerName
+	// When the request was made.
+	Timestamp gomatrixserverlib.Timestamp
+	// How long the remote server took to respond, or to fail.
+	Latency time.Duration
+	// Why the request failed, or empty if it succeeded.
+	Error string
+}
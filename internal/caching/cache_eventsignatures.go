@@ -0,0 +1,49 @@
+package caching
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	EventSignatureCacheName       = "event_signatures"
+	EventSignatureCacheMaxEntries = 16384
+	EventSignatureCacheMutable    = false
+)
+
+// EventSignatureCache contains the subset of functions needed for
+// an event signature verification cache.
+type EventSignatureCache interface {
+	// The request is keyed on the origin server name and the redacted
+	// event JSON, which contains both the event ID (or the content that
+	// the event ID is a hash of) and the signatures for the origin key,
+	// so a cache hit means that this exact event signed by this exact
+	// key has already been successfully verified.
+	IsEventSignatureVerified(request gomatrixserverlib.VerifyJSONRequest) bool
+	StoreEventSignatureVerified(request gomatrixserverlib.VerifyJSONRequest)
+}
+
+func eventSignatureCacheKey(request gomatrixserverlib.VerifyJSONRequest) string {
+	hash := sha256.Sum256(request.Message)
+	return fmt.Sprintf(
+		"%s/%d/%t/%s", request.ServerName, request.AtTS, request.StrictValidityChecking,
+		base64.RawStdEncoding.EncodeToString(hash[:]),
+	)
+}
+
+func (c Caches) IsEventSignatureVerified(request gomatrixserverlib.VerifyJSONRequest) bool {
+	val, found := c.EventSignatures.Get(eventSignatureCacheKey(request))
+	if found && val != nil {
+		if verified, ok := val.(bool); ok {
+			return verified
+		}
+	}
+	return false
+}
+
+func (c Caches) StoreEventSignatureVerified(request gomatrixserverlib.VerifyJSONRequest) {
+	c.EventSignatures.Set(eventSignatureCacheKey(request), true)
+}
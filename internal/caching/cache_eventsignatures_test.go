@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestEventSignatureCache(t *testing.T) {
+	caches, err := NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	verified := gomatrixserverlib.VerifyJSONRequest{
+		ServerName: "remote",
+		AtTS:       1000,
+		Message:    []byte(`{"event_id":"$a"}`),
+	}
+	if caches.IsEventSignatureVerified(verified) {
+		t.Fatalf("got a signature verified before it was stored")
+	}
+	caches.StoreEventSignatureVerified(verified)
+	if !caches.IsEventSignatureVerified(verified) {
+		t.Fatalf("got the stored signature not verified")
+	}
+	// Storing the same request again is fine, even though the cache is
+	// immutable.
+	caches.StoreEventSignatureVerified(verified)
+
+	// Any difference in the request means that it hasn't been verified.
+	otherServer := verified
+	otherServer.ServerName = "other"
+	otherTime := verified
+	otherTime.AtTS = 2000
+	strict := verified
+	strict.StrictValidityChecking = true
+	otherMessage := verified
+	otherMessage.Message = []byte(`{"event_id":"$b"}`)
+	for name, req := range map[string]gomatrixserverlib.VerifyJSONRequest{
+		"server name":              otherServer,
+		"timestamp":                otherTime,
+		"strict validity checking": strict,
+		"message":                  otherMessage,
+	} {
+		if caches.IsEventSignatureVerified(req) {
+			t.Errorf("got the signature verified with a different %s", name)
+		}
+	}
+}
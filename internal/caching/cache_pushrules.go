@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"github.com/matrix-org/dendrite/internal/pushrules"
+)
+
+// PushRules are mutable: users change their push rules whenever they like, so
+// the entries are removed from the cache whenever their m.push_rules account
+// data is updated.
+const (
+	PushRulesCacheName       = "push_rules"
+	PushRulesCacheMaxEntries = 1024
+	PushRulesCacheMutable    = true
+)
+
+// PushRulesCache contains the subset of functions needed for
+// a push rules cache.
+type PushRulesCache interface {
+	// GetOrLoadPushRules returns the cached global push rules of the user,
+	// or calls load and caches what it returns if there aren't any. The
+	// push rules are shared, so they mustn't be changed.
+	GetOrLoadPushRules(userID string, load func() (*pushrules.RuleSet, error)) (*pushrules.RuleSet, error)
+	InvalidatePushRules(userID string)
+}
+
+// GetOrLoadPushRules holds the lock while loading, so that push rules which
+// were loaded before the user changed them can't be cached after the change
+// has invalidated them.
+func (c Caches) GetOrLoadPushRules(userID string, load func() (*pushrules.RuleSet, error)) (*pushrules.RuleSet, error) {
+	c.pushRulesMu.Lock()
+	defer c.pushRulesMu.Unlock()
+	if val, found := c.PushRules.Get(userID); found && val != nil {
+		if ruleSet, ok := val.(*pushrules.RuleSet); ok {
+			return ruleSet, nil
+		}
+	}
+	ruleSet, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.PushRules.Set(userID, ruleSet)
+	return ruleSet, nil
+}
+
+func (c Caches) InvalidatePushRules(userID string) {
+	c.pushRulesMu.Lock()
+	defer c.pushRulesMu.Unlock()
+	c.PushRules.Unset(userID)
+}
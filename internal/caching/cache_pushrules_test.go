@@ -0,0 +1,68 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
+)
+
+func TestPushRulesCache(t *testing.T) {
+	caches, err := NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	loads := 0
+	load := func(ruleSet *pushrules.RuleSet, err error) func() (*pushrules.RuleSet, error) {
+		return func() (*pushrules.RuleSet, error) {
+			loads++
+			return ruleSet, err
+		}
+	}
+	alice := &pushrules.RuleSet{Sender: []*pushrules.Rule{{RuleID: "@alice:localhost"}}}
+	bob := &pushrules.RuleSet{Sender: []*pushrules.Rule{{RuleID: "@bob:localhost"}}}
+
+	// Errors aren't cached.
+	wantErr := errors.New("failed")
+	if _, err := caches.GetOrLoadPushRules("@alice:localhost", load(nil, wantErr)); err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+	if got, err := caches.GetOrLoadPushRules("@alice:localhost", load(alice, nil)); err != nil || got != alice {
+		t.Errorf("got %+v, %v for loaded push rules", got, err)
+	}
+	if got, err := caches.GetOrLoadPushRules("@alice:localhost", load(bob, nil)); err != nil || got != alice {
+		t.Errorf("got %+v, %v for cached push rules", got, err)
+	}
+	if got, err := caches.GetOrLoadPushRules("@bob:localhost", load(bob, nil)); err != nil || got != bob {
+		t.Errorf("got %+v, %v for another user's push rules", got, err)
+	}
+	if loads != 3 {
+		t.Errorf("loaded %d times, want 3", loads)
+	}
+
+	// Invalidated push rules are loaded again, and only those of that user.
+	caches.InvalidatePushRules("@alice:localhost")
+	if got, err := caches.GetOrLoadPushRules("@alice:localhost", load(bob, nil)); err != nil || got != bob {
+		t.Errorf("got %+v, %v after invalidating the push rules", got, err)
+	}
+	if got, err := caches.GetOrLoadPushRules("@bob:localhost", load(alice, nil)); err != nil || got != bob {
+		t.Errorf("got %+v, %v for the push rules of a user who wasn't invalidated", got, err)
+	}
+	if loads != 4 {
+		t.Errorf("loaded %d times, want 4", loads)
+	}
+}
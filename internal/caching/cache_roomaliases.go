@@ -0,0 +1,76 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Room aliases are mutable: they can be removed or pointed at another room.
+// Local aliases are removed from the cache when they change, but remote ones
+// can change without us knowing, so entries expire after a while, and sooner
+// if the alias wasn't found.
+const (
+	RoomAliasCacheName        = "room_aliases"
+	RoomAliasCacheMaxEntries  = 1024
+	RoomAliasCacheMutable     = true
+	RoomAliasCacheTTL         = 10 * time.Minute
+	RoomAliasCacheNegativeTTL = time.Minute
+)
+
+// RoomAliasCache contains the subset of functions needed for
+// a room alias cache.
+type RoomAliasCache interface {
+	// GetRoomAlias returns the room ID and, for remote aliases, the servers
+	// which an alias resolved to. An empty room ID means that the alias
+	// doesn't exist.
+	GetRoomAlias(alias string) (roomID string, servers []gomatrixserverlib.ServerName, ok bool)
+	StoreRoomAlias(alias, roomID string, servers []gomatrixserverlib.ServerName)
+	InvalidateRoomAlias(alias string)
+}
+
+type roomAliasCacheEntry struct {
+	roomID  string
+	servers []gomatrixserverlib.ServerName
+	expires time.Time
+}
+
+func (c Caches) GetRoomAlias(alias string) (string, []gomatrixserverlib.ServerName, bool) {
+	val, found := c.RoomAliases.Get(alias)
+	if found && val != nil {
+		if entry, ok := val.(roomAliasCacheEntry); ok && time.Now().Before(entry.expires) {
+			return entry.roomID, entry.servers, true
+		}
+	}
+	return "", nil, false
+}
+
+func (c Caches) StoreRoomAlias(alias, roomID string, servers []gomatrixserverlib.ServerName) {
+	ttl := RoomAliasCacheTTL
+	if roomID == "" {
+		ttl = RoomAliasCacheNegativeTTL
+	}
+	c.RoomAliases.Set(alias, roomAliasCacheEntry{
+		roomID:  roomID,
+		servers: servers,
+		expires: time.Now().Add(ttl),
+	})
+}
+
+func (c Caches) InvalidateRoomAlias(alias string) {
+	c.RoomAliases.Unset(alias)
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestRoomAliasCache(t *testing.T) {
+	caches, err := NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	servers := []gomatrixserverlib.ServerName{"remote"}
+	caches.StoreRoomAlias("#room:remote", "!room:remote", servers)
+	caches.StoreRoomAlias("#missing:remote", "", nil)
+
+	if roomID, got, ok := caches.GetRoomAlias("#room:remote"); !ok || roomID != "!room:remote" || len(got) != 1 {
+		t.Errorf("got %q, %v, %v for a cached alias", roomID, got, ok)
+	}
+	if roomID, _, ok := caches.GetRoomAlias("#missing:remote"); !ok || roomID != "" {
+		t.Errorf("got %q, %v for a cached missing alias", roomID, ok)
+	}
+	if _, _, ok := caches.GetRoomAlias("#unknown:remote"); ok {
+		t.Errorf("got a result for an uncached alias")
+	}
+
+	caches.InvalidateRoomAlias("#room:remote")
+	if _, _, ok := caches.GetRoomAlias("#room:remote"); ok {
+		t.Errorf("got a result for an invalidated alias")
+	}
+
+	// Entries which have expired are ignored.
+	caches.RoomAliases.Set("#room:remote", roomAliasCacheEntry{
+		roomID:  "!room:remote",
+		expires: time.Now().Add(-time.Second),
+	})
+	if _, _, ok := caches.GetRoomAlias("#room:remote"); ok {
+		t.Errorf("got a result for an expired alias")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// RoomInfos are mutable: the latest state snapshot of a room changes with
+// every new event, so entries are removed from the cache whenever the room's
+// latest events are updated.
+const (
+	RoomInfoCacheName       = "room_infos"
+	RoomInfoCacheMaxEntries = 1024
+	RoomInfoCacheMutable    = true
+)
+
+// RoomInfoCache contains the subset of functions needed for
+// a room info cache.
+type RoomInfoCache interface {
+	// GetOrLoadRoomInfo returns the cached room info, or calls load and caches
+	// what it returns if there isn't any. Room info which load says doesn't
+	// exist, by returning nil, isn't cached.
+	GetOrLoadRoomInfo(roomID string, load func() (*types.RoomInfo, error)) (*types.RoomInfo, error)
+	InvalidateRoomInfo(roomID string)
+}
+
+// GetOrLoadRoomInfo holds the lock while loading, so that room info which was
+// loaded before the room was changed can't be cached after the change has
+// invalidated it.
+func (c Caches) GetOrLoadRoomInfo(roomID string, load func() (*types.RoomInfo, error)) (*types.RoomInfo, error) {
+	c.roomInfosMu.Lock()
+	defer c.roomInfosMu.Unlock()
+	if val, found := c.RoomInfos.Get(roomID); found && val != nil {
+		if roomInfo, ok := val.(types.RoomInfo); ok {
+			return &roomInfo, nil
+		}
+	}
+	roomInfo, err := load()
+	if err != nil || roomInfo == nil {
+		return roomInfo, err
+	}
+	c.RoomInfos.Set(roomID, *roomInfo)
+	return roomInfo, nil
+}
+
+func (c Caches) InvalidateRoomInfo(roomID string) {
+	c.roomInfosMu.Lock()
+	defer c.roomInfosMu.Unlock()
+	c.RoomInfos.Unset(roomID)
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+func TestRoomInfoCache(t *testing.T) {
+	caches, err := NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	loads := 0
+	load := func(roomInfo *types.RoomInfo, err error) func() (*types.RoomInfo, error) {
+		return func() (*types.RoomInfo, error) {
+			loads++
+			return roomInfo, err
+		}
+	}
+
+	// Missing rooms and errors aren't cached.
+	if got, err := caches.GetOrLoadRoomInfo("!room:localhost", load(nil, nil)); got != nil || err != nil {
+		t.Errorf("got %+v, %v for a missing room", got, err)
+	}
+	wantErr := errors.New("failed")
+	if _, err := caches.GetOrLoadRoomInfo("!room:localhost", load(nil, wantErr)); err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+	if got, err := caches.GetOrLoadRoomInfo("!room:localhost", load(&types.RoomInfo{RoomNID: 1}, nil)); err != nil || got.RoomNID != 1 {
+		t.Errorf("got %+v, %v for a loaded room", got, err)
+	}
+	if got, err := caches.GetOrLoadRoomInfo("!room:localhost", load(&types.RoomInfo{RoomNID: 2}, nil)); err != nil || got.RoomNID != 1 {
+		t.Errorf("got %+v, %v for a cached room", got, err)
+	}
+	if loads != 3 {
+		t.Errorf("loaded %d times, want 3", loads)
+	}
+
+	// Room info which is being loaded while the room is invalidated is
+	// thrown away along with anything else.
+	started, release := make(chan struct{}), make(chan struct{})
+	loaded := make(chan struct{})
+	caches.InvalidateRoomInfo("!room:localhost")
+	go func() {
+		defer close(loaded)
+		_, _ = caches.GetOrLoadRoomInfo("!room:localhost", func() (*types.RoomInfo, error) {
+			close(started)
+			<-release
+			return &types.RoomInfo{RoomNID: 3}, nil
+		})
+	}()
+	<-started
+	invalidated := make(chan struct{})
+	go func() {
+		caches.InvalidateRoomInfo("!room:localhost")
+		close(invalidated)
+	}()
+	select {
+	case <-invalidated:
+		t.Fatalf("invalidated the room while it was being loaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-loaded
+	<-invalidated
+	if got, err := caches.GetOrLoadRoomInfo("!room:localhost", load(&types.RoomInfo{RoomNID: 4}, nil)); err != nil || got.RoomNID != 4 {
+		t.Errorf("got %+v, %v after invalidating, want the room info loaded again", got, err)
+	}
+}
@@ -0,0 +1,40 @@
+package caching
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	ToDeviceMessageCacheName       = "federation_to_device_messages"
+	ToDeviceMessageCacheMaxEntries = 16384
+	ToDeviceMessageCacheMutable    = false
+)
+
+// ToDeviceMessageCache contains the subset of functions needed for
+// deduplicating inbound send-to-device EDUs over federation. Remote
+// servers will retry transactions that they think have failed, so the
+// same message ID may arrive from the same origin more than once.
+type ToDeviceMessageCache interface {
+	IsToDeviceMessageSeen(origin gomatrixserverlib.ServerName, messageID string) bool
+	StoreToDeviceMessageSeen(origin gomatrixserverlib.ServerName, messageID string)
+}
+
+func toDeviceMessageCacheKey(origin gomatrixserverlib.ServerName, messageID string) string {
+	return fmt.Sprintf("%s/%s", origin, messageID)
+}
+
+func (c Caches) IsToDeviceMessageSeen(origin gomatrixserverlib.ServerName, messageID string) bool {
+	val, found := c.ToDeviceMessages.Get(toDeviceMessageCacheKey(origin, messageID))
+	if found && val != nil {
+		if seen, ok := val.(bool); ok {
+			return seen
+		}
+	}
+	return false
+}
+
+func (c Caches) StoreToDeviceMessageSeen(origin gomatrixserverlib.ServerName, messageID string) {
+	c.ToDeviceMessages.Set(toDeviceMessageCacheKey(origin, messageID), true)
+}
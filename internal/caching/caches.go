@@ -1,11 +1,22 @@
 package caching
 
+import "sync"
+
 // Caches contains a set of references to caches. They may be
 // different implementations as long as they satisfy the Cache
 // interface.
 type Caches struct {
-	RoomVersions Cache // implements RoomVersionCache
-	ServerKeys   Cache // implements ServerKeyCache
+	RoomVersions     Cache // implements RoomVersionCache
+	ServerKeys       Cache // implements ServerKeyCache
+	EventSignatures  Cache // implements EventSignatureCache
+	RoomInfos        Cache // implements RoomInfoCache
+	ToDeviceMessages Cache // implements ToDeviceMessageCache
+	RoomAliases      Cache // implements RoomAliasCache
+	PushRules        Cache // implements PushRulesCache
+	// roomInfosMu makes loading and invalidating room infos atomic
+	roomInfosMu *sync.Mutex
+	// pushRulesMu does the same for push rules
+	pushRulesMu *sync.Mutex
 }
 
 // Cache is the interface that an implementation must satisfy.
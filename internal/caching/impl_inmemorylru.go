@@ -2,6 +2,7 @@ package caching
 
 import (
 	"fmt"
+	"sync"
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/prometheus/client_golang/prometheus"
@@ -27,9 +28,61 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 	if err != nil {
 		return nil, err
 	}
+	eventSignatures, err := NewInMemoryLRUCachePartition(
+		EventSignatureCacheName,
+		EventSignatureCacheMutable,
+		EventSignatureCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	roomInfos, err := NewInMemoryLRUCachePartition(
+		RoomInfoCacheName,
+		RoomInfoCacheMutable,
+		RoomInfoCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	toDeviceMessages, err := NewInMemoryLRUCachePartition(
+		ToDeviceMessageCacheName,
+		ToDeviceMessageCacheMutable,
+		ToDeviceMessageCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	roomAliases, err := NewInMemoryLRUCachePartition(
+		RoomAliasCacheName,
+		RoomAliasCacheMutable,
+		RoomAliasCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
+	pushRules, err := NewInMemoryLRUCachePartition(
+		PushRulesCacheName,
+		PushRulesCacheMutable,
+		PushRulesCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
 	return &Caches{
-		RoomVersions: roomVersions,
-		ServerKeys:   serverKeys,
+		RoomVersions:     roomVersions,
+		ServerKeys:       serverKeys,
+		EventSignatures:  eventSignatures,
+		RoomInfos:        roomInfos,
+		ToDeviceMessages: toDeviceMessages,
+		RoomAliases:      roomAliases,
+		PushRules:        pushRules,
+		roomInfosMu:      &sync.Mutex{},
+		pushRulesMu:      &sync.Mutex{},
 	}, nil
 }
 
@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
@@ -60,10 +61,47 @@ type ApplicationService struct {
 	// Information about an application service's namespaces. Key is either
 	// "users", "aliases" or "rooms"
 	NamespaceMap map[string][]ApplicationServiceNamespace `yaml:"namespaces"`
-	// Whether rate limiting is applied to each application service user
+	// Whether rate limiting is applied to each application service user,
+	// other than the application service's own user
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
+	// How events are pushed to this application service. Anything set for
+	// this application service in the Dendrite config takes precedence.
+	Transactions ApplicationServiceTransactions `yaml:"transactions"`
+}
+
+// defaultTransactionMaxEvents is how many events are sent to an application
+// service in a single transaction unless it is configured otherwise.
+const defaultTransactionMaxEvents = 50
+
+// ApplicationServiceTransactions controls how events are pushed to an
+// application service, so that large bridges and small bots can be tuned
+// differently.
+type ApplicationServiceTransactions struct {
+	// The most events to send in a single transaction.
+	MaxEvents int `yaml:"max_events"`
+	// The shortest time to leave between transactions. Waiting lets more
+	// events build up, so that a busy application service gets fewer but
+	// bigger transactions. Zero sends events as soon as they arrive.
+	PushInterval time.Duration `yaml:"push_interval"`
+	// The most requests, counting both transactions and queries, that can
+	// be in flight to the application service at once. Zero means there is
+	// no limit.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+}
+
+// override replaces any settings with those which are set in o.
+func (t *ApplicationServiceTransactions) override(o ApplicationServiceTransactions) {
+	if o.MaxEvents != 0 {
+		t.MaxEvents = o.MaxEvents
+	}
+	if o.PushInterval != 0 {
+		t.PushInterval = o.PushInterval
+	}
+	if o.MaxConcurrentRequests != 0 {
+		t.MaxConcurrentRequests = o.MaxConcurrentRequests
+	}
 }
 
 // IsInterestedInRoomID returns a bool on whether an application service's
@@ -156,6 +194,11 @@ func loadAppServices(config *Dendrite) error {
 			return err
 		}
 
+		appservice.Transactions.override(config.ApplicationServices.Transactions[appservice.ID])
+		if appservice.Transactions.MaxEvents == 0 {
+			appservice.Transactions.MaxEvents = defaultTransactionMaxEvents
+		}
+
 		// Append the parsed application service to the global config
 		config.Derived.ApplicationServices = append(
 			config.Derived.ApplicationServices, appservice,
@@ -274,16 +317,27 @@ func checkErrors(config *Dendrite) (err error) {
 		idMap[appservice.ID] = true
 		tokenMap[appservice.ASToken] = true
 
-		// TODO: Remove once rate_limited is implemented
-		if appservice.RateLimited {
-			log.Warn("WARNING: Application service option rate_limited is currently unimplemented")
+		if appservice.Transactions.MaxEvents < 0 || appservice.Transactions.PushInterval < 0 || appservice.Transactions.MaxConcurrentRequests < 0 {
+			return configErrors([]string{fmt.Sprintf(
+				"Transaction settings for application service %s must not be negative", appservice.ID,
+			)})
 		}
+
 		// TODO: Remove once protocols is implemented
 		if len(appservice.Protocols) > 0 {
 			log.Warn("WARNING: Application service option protocols is currently unimplemented")
 		}
 	}
 
+	// Overrides in the Dendrite config must be for a known application service.
+	for id := range config.ApplicationServices.Transactions {
+		if !idMap[id] {
+			return configErrors([]string{fmt.Sprintf(
+				"Transaction settings given for unknown application service %s", id,
+			)})
+		}
+	}
+
 	return setupRegexps(config)
 }
 
@@ -17,10 +17,14 @@ package config
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -71,6 +75,8 @@ type Dendrite struct {
 		// A list of SHA256 TLS fingerprints for the X509 certificates used by the
 		// federation listener for this server.
 		TLSFingerPrints []gomatrixserverlib.TLSFingerprint `yaml:"-"`
+		// Mutual TLS between homeservers, for closed federations.
+		FederationMutualTLS FederationMutualTLS `yaml:"federation_mutual_tls"`
 		// How long a remote server can cache our server key for before requesting it again.
 		// Increasing this number will reduce the number of requests made by remote servers
 		// for our key, but increases the period a compromised key will be considered valid
@@ -99,9 +105,71 @@ type Dendrite struct {
 		// If set disables new users from registering (except via shared
 		// secrets)
 		RegistrationDisabled bool `yaml:"registration_disabled"`
+		// If set, new users must give a registration token which was created
+		// with the admin API.
+		RegistrationRequiresToken bool `yaml:"registration_requires_token"`
+		// If set, new users must validate an email address, which is then
+		// associated with their account. Needs email to be configured.
+		RegistrationRequiresEmail bool `yaml:"registration_requires_email"`
+		// If set, stops guests from registering. Existing guests can still
+		// use their accounts.
+		GuestsDisabled bool `yaml:"guests_disabled"`
+		// If set, disables presence, typing notifications or read receipts
+		// respectively. A disabled feature is dropped everywhere: updates
+		// are neither accepted from clients or remote servers, nor sent to
+		// them. Useful for deployments where these features aren't worth
+		// the traffic that they generate.
+		DisablePresence bool `yaml:"disable_presence"`
+		DisableTyping   bool `yaml:"disable_typing"`
+		DisableReceipts bool `yaml:"disable_receipts"`
+		// Limits on the size of account data that users can store, so that
+		// account data can't be used as an unbounded blob store.
+		AccountDataLimits AccountDataLimits `yaml:"account_data_limits"`
+		// How the server sends emails to users, e.g. to validate the email
+		// addresses that they add to their accounts.
+		Email Email `yaml:"email"`
+		// Protection against brute-force password guessing on /login.
+		LoginProtection LoginProtection `yaml:"login_protection"`
+		// The IP addresses or CIDR ranges of the reverse proxies in front of
+		// the client API. The X-Forwarded-For header of requests from them
+		// is used to find the client's IP address for login protection and
+		// rate limiting. It is ignored on requests from anywhere else, as
+		// clients can set it to anything.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+		// Limits on how often clients can log in, register, send messages
+		// and join rooms.
+		RateLimiting RateLimiting `yaml:"rate_limiting"`
+		// How long access tokens last when the client asks for a refresh
+		// token with them, after which the client has to refresh them.
+		// Other access tokens never expire.
+		RefreshableAccessTokenLifetime time.Duration `yaml:"refreshable_access_token_lifetime"`
+		// Identity providers which users can log in with instead of a
+		// password.
+		SSO SSO `yaml:"sso"`
+		// Limits on long-polling /sync requests.
+		SyncLimits SyncLimits `yaml:"sync_limits"`
+		// How long the sync API keeps old events and send-to-device messages.
+		SyncRetention SyncRetention `yaml:"sync_retention"`
+		// The server-wide policy for rooms created by local users.
+		RoomCreation RoomCreation `yaml:"room_creation"`
+		// Restrictions on which remote rooms local users may join.
+		JoinRestrictions JoinRestrictions `yaml:"join_restrictions"`
+		// If set, local room aliases are looked up regardless of their case,
+		// and aliases which only differ from an existing one by case can't be
+		// created.
+		CaseInsensitiveAliases bool `yaml:"case_insensitive_aliases"`
+		// Rooms which the room server records every auth decision for, to
+		// help find out why events were rejected.
+		AuthDebug AuthDebug `yaml:"auth_debug"`
+		// The user who sends server notices, and the rooms which it sends
+		// them to.
+		ServerNotices ServerNotices `yaml:"server_notices"`
 		// Perspective keyservers, to use as a backup when direct key fetch
 		// requests don't succeed
 		KeyPerspectives KeyPerspectives `yaml:"key_perspectives"`
+		// The keys which specific remote servers are expected to have. Any
+		// other key for these servers is rejected, wherever it comes from.
+		PinnedServerKeys PinnedServerKeys `yaml:"pinned_server_keys"`
 	} `yaml:"matrix"`
 
 	// The configuration specific to the media repostitory.
@@ -120,6 +188,18 @@ type Dendrite struct {
 		MaxThumbnailGenerators int `yaml:"max_thumbnail_generators"`
 		// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 		ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+		// How media from other servers is fetched and cached
+		RemoteMedia struct {
+			// Whether to pass remote media straight through to clients without storing it.
+			// Thumbnails can't be generated for remote media when this is set.
+			DisableCaching bool `yaml:"disable_caching"`
+			// The maximum total size in bytes of the cached remote media. Once it is exceeded,
+			// the least recently used remote media is removed from the cache.
+			// Note: if max_cache_size_bytes is set to 0, the size is unlimited.
+			MaxCacheSizeBytes FileSizeBytes `yaml:"max_cache_size_bytes"`
+			// Whether to only fetch media from servers which share a room with this server.
+			RequireSharedRoom bool `yaml:"require_shared_room"`
+		} `yaml:"remote_media"`
 	} `yaml:"media"`
 
 	// The configuration to use for Prometheus metrics
@@ -133,6 +213,10 @@ type Dendrite struct {
 			Username string `yaml:"username"`
 			Password string `yaml:"password"`
 		} `yaml:"basic_auth"`
+		// Incoming federation PDUs which take longer than this to process are
+		// logged along with a breakdown of where the time was spent.
+		// Defaults to 5 seconds.
+		SlowPDUThreshold time.Duration `yaml:"slow_pdu_threshold"`
 	} `yaml:"metrics"`
 
 	// The configuration for talking to kafka.
@@ -186,6 +270,9 @@ type Dendrite struct {
 		// The AppServices database stores information used by the AppService component.
 		// It is only accessed by the AppService component.
 		AppService DataSource `yaml:"appservice"`
+		// The KeyServer database stores the end-to-end encryption keys of devices.
+		// It is only accessed by the KeyServer.
+		KeyServer DataSource `yaml:"key_server"`
 		// The Naffka database is used internally by the naffka library, if used.
 		Naffka DataSource `yaml:"naffka,omitempty"`
 		// Maximum open connections to the DB (0 = use default, negative means unlimited)
@@ -194,13 +281,23 @@ type Dendrite struct {
 		MaxIdleConns int `yaml:"max_idle_conns"`
 		// maximum amount of time (in seconds) a connection may be reused (<= 0 means unlimited)
 		ConnMaxLifetimeSec int `yaml:"conn_max_lifetime"`
+		// Optional read-only postgres replicas of the databases above. Heavy
+		// reads are sent to a component's replica if one is configured, falling
+		// back to the primary database while the replica is unavailable.
+		ReadReplicas struct {
+			// Used for initial syncs.
+			SyncAPI DataSource `yaml:"sync_api"`
+			// Used for current state queries, such as those for the room directory.
+			CurrentState DataSource `yaml:"current_state"`
+			// Used for listing the rooms in the room directory.
+			RoomServer DataSource `yaml:"room_server"`
+		} `yaml:"read_replicas"`
 	} `yaml:"database"`
 
 	// TURN Server Config
 	TURN struct {
-		// TODO Guest Support
 		// Whether or not guests can request TURN credentials
-		//AllowGuests bool `yaml:"turn_allow_guests"`
+		AllowGuests bool `yaml:"turn_allow_guests"`
 		// How long the authorization should last
 		UserLifetime string `yaml:"turn_user_lifetime"`
 		// The list of TURN URIs to pass to clients
@@ -263,11 +360,19 @@ type Dendrite struct {
 	ApplicationServices struct {
 		// Configuration files for various application services
 		ConfigFiles []string `yaml:"config_files"`
+		// How events are pushed to particular application services, keyed
+		// by application service ID. These take precedence over the settings
+		// in the registration files.
+		Transactions map[string]ApplicationServiceTransactions `yaml:"transactions"`
 	} `yaml:"application_services"`
 
 	// The config for logging informations. Each hook will be added to logrus.
 	Logging []LogrusHook `yaml:"logging"`
 
+	// Experimental features which are turned on or off, overriding the
+	// defaults for this release.
+	FeatureFlags FeatureFlags `yaml:"feature_flags"`
+
 	// The config for setting a proxy to use for server->server requests
 	Proxy *struct {
 		// The protocol for the proxy (http / https / socks5)
@@ -292,6 +397,10 @@ type Dendrite struct {
 			Params map[string]interface{} `json:"params"`
 		}
 
+		// The networks of the trusted proxies, parsed from
+		// matrix.trusted_proxies.
+		TrustedProxies []*net.IPNet
+
 		// Application services parsed from their config files
 		// The paths of which were given above in the main config file
 		ApplicationServices []ApplicationService
@@ -325,6 +434,21 @@ type KeyPerspectives []struct {
 	} `yaml:"keys"`
 }
 
+// PinnedServerKeys are used to configure the only server keys which will
+// be accepted for specific remote servers, so that keys substituted by a
+// compromised perspective key server or DNS are rejected.
+type PinnedServerKeys []struct {
+	// The server name of the remote server
+	ServerName gomatrixserverlib.ServerName `yaml:"server_name"`
+	// The keys of the remote server
+	Keys []struct {
+		// The key ID, e.g. ed25519:auto
+		KeyID gomatrixserverlib.KeyID `yaml:"key_id"`
+		// The public key in base64 unpadded format
+		PublicKey string `yaml:"public_key"`
+	} `yaml:"keys"`
+}
+
 // A Path on the filesystem.
 type Path string
 
@@ -340,6 +464,453 @@ type Address string
 // FileSizeBytes is a file size in bytes
 type FileSizeBytes int64
 
+// AccountDataLimits contains the limits on how much account data a user
+// can store. A limit of zero means unlimited.
+type AccountDataLimits struct {
+	// The maximum size of a single account data event, in bytes.
+	MaxEventSizeBytes *FileSizeBytes `yaml:"max_event_size_bytes,omitempty"`
+	// Overrides of MaxEventSizeBytes for specific account data types,
+	// e.g. to allow larger m.push_rules.
+	MaxEventSizeBytesByType map[string]FileSizeBytes `yaml:"max_event_size_bytes_by_type,omitempty"`
+	// The maximum total size of all account data stored by a user, in bytes.
+	MaxTotalSizeBytes *FileSizeBytes `yaml:"max_total_size_bytes,omitempty"`
+}
+
+// MaxEventSizeBytesForType returns the maximum size of a single account
+// data event of the given type, or zero if it is unlimited.
+func (l *AccountDataLimits) MaxEventSizeBytesForType(dataType string) FileSizeBytes {
+	if size, ok := l.MaxEventSizeBytesByType[dataType]; ok {
+		return size
+	}
+	if l.MaxEventSizeBytes == nil {
+		return 0
+	}
+	return *l.MaxEventSizeBytes
+}
+
+// MaxTotalSizeBytesForUser returns the maximum total size of account
+// data for a single user, or zero if it is unlimited.
+func (l *AccountDataLimits) MaxTotalSizeBytesForUser() FileSizeBytes {
+	if l.MaxTotalSizeBytes == nil {
+		return 0
+	}
+	return *l.MaxTotalSizeBytes
+}
+
+// LoginProtection contains the limits on failed login attempts. Failed
+// attempts are counted both per account and per client IP address, and
+// the higher of the two counts is checked against the limits.
+type LoginProtection struct {
+	// If set, failed login attempts aren't counted or limited at all.
+	Disabled bool `yaml:"disabled"`
+	// The number of failed attempts after which further attempts are refused
+	// until the failure window has passed since the most recent failure.
+	MaxFailedAttempts int `yaml:"max_failed_attempts"`
+	// The number of failed attempts after which a captcha must be solved in
+	// order to try again. Requires the recaptcha keys to be configured. If
+	// zero then a captcha is never required.
+	CaptchaAfterFailedAttempts int `yaml:"captcha_after_failed_attempts"`
+	// How long failed attempts are remembered for.
+	FailureWindow time.Duration `yaml:"failure_window"`
+}
+
+// parseTrustedProxy parses an entry of matrix.trusted_proxies, which is either
+// a CIDR range or a single IP address.
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if strings.Contains(proxy, "/") {
+		_, network, err := net.ParseCIDR(proxy)
+		return network, err
+	}
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", proxy)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// RateLimiting contains the limits on how often clients can use some
+// endpoints. Logins, registrations, email token requests and SSO logins are
+// limited per client IP address, and messages, joins, knocks, invites and
+// room creation per user. Users of application services are only
+// limited if their registration sets rate_limited, and the application
+// service's own user never is.
+type RateLimiting struct {
+	// If set, no requests are rate limited.
+	Disabled bool `yaml:"disabled"`
+	// The limit on POST /login.
+	Login RateLimit `yaml:"login"`
+	// The limit on POST /register, which is also applied separately to
+	// checking the validity of registration tokens.
+	Registration RateLimit `yaml:"registration"`
+	// The limit on sending events into rooms.
+	Messages RateLimit `yaml:"messages"`
+	// The limit on joining and knocking on rooms.
+	Joins RateLimit `yaml:"joins"`
+	// The limit on inviting users to rooms. A bulk invite counts as one.
+	Invites RateLimit `yaml:"invites"`
+	// The limit on creating rooms.
+	RoomCreation RateLimit `yaml:"room_creation"`
+	// The limit on requesting email validation tokens, which is applied to
+	// the client IP address and to the email address separately.
+	EmailTokens RateLimit `yaml:"email_tokens"`
+}
+
+// RateLimit lets a client make a burst of requests at once, after which it
+// can make one more request for each interval that passes.
+type RateLimit struct {
+	Burst    int           `yaml:"burst"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (l *RateLimit) setDefaults(burst int, interval time.Duration) {
+	if l.Burst == 0 {
+		l.Burst = burst
+	}
+	if l.Interval == 0 {
+		l.Interval = interval
+	}
+}
+
+// SSO contains the single sign-on identity providers which users can log in
+// with. Users are sent to the identity provider by /login/sso/redirect, and
+// once they have logged in there they are sent back to the client with a
+// login token for an m.login.token login.
+type SSO struct {
+	// The public URL of the client API, which identity providers send users
+	// back to, e.g. "https://matrix.example.com".
+	PublicBaseURL string `yaml:"public_base_url"`
+	// If set, accounts are created for users who log in for the first time.
+	// Otherwise only users who already have an account from a previous login
+	// can log in.
+	AutoProvisionAccounts bool `yaml:"auto_provision_accounts"`
+	// The client URLs which users are sent straight back to once they have
+	// logged in. A redirect URL is allowed if it has the same scheme and host
+	// as one of these and its path is that URL's path or below it. Users are
+	// asked to confirm that they trust any other client before being sent to
+	// it with a login token.
+	ClientRedirectURLs []string `yaml:"client_redirect_urls"`
+	// The URL schemes besides http and https which clients can be sent back
+	// to, such as those of mobile apps.
+	ClientRedirectSchemes []string `yaml:"client_redirect_schemes"`
+	// OpenID Connect identity providers.
+	OIDCProviders []OIDCProvider `yaml:"oidc_providers"`
+	// SAML2 identity providers.
+	SAMLProviders []SAMLProvider `yaml:"saml_providers"`
+	// CAS servers.
+	CASProviders []CASProvider `yaml:"cas_providers"`
+}
+
+// Enabled returns whether any identity providers are configured.
+func (s *SSO) Enabled() bool {
+	return len(s.OIDCProviders) > 0 || len(s.SAMLProviders) > 0 || len(s.CASProviders) > 0
+}
+
+func (s *SSO) load(basePath string, readFile func(string) ([]byte, error)) error {
+	for i := range s.SAMLProviders {
+		provider := &s.SAMLProviders[i]
+		if provider.MetadataPath == "" {
+			continue
+		}
+		metadata, err := readFile(absPath(basePath, provider.MetadataPath))
+		if err != nil {
+			return err
+		}
+		provider.Metadata = metadata
+	}
+	return nil
+}
+
+// OIDCProvider contains the settings for an OpenID Connect identity provider.
+type OIDCProvider struct {
+	// The ID of the provider, which is part of its callback URL and is
+	// recorded against the users who log in with it, so shouldn't be changed
+	// once users have logged in.
+	ID string `yaml:"id"`
+	// The name of the provider shown to users.
+	Name string `yaml:"name"`
+	// The issuer identifier of the provider, which its configuration is
+	// discovered from, e.g. "https://accounts.example.com".
+	Issuer string `yaml:"issuer"`
+	// The credentials of the client registered with the provider.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// The scopes requested as well as "openid". Defaults to "profile".
+	Scopes []string `yaml:"scopes"`
+	// The claim which the localparts of new accounts are made from. Defaults
+	// to "preferred_username".
+	LocalpartClaim string `yaml:"localpart_claim"`
+	// The claim which the display names of new accounts are taken from.
+	// Defaults to "name".
+	DisplayNameClaim string `yaml:"display_name_claim"`
+}
+
+// SAMLProvider contains the settings for a SAML2 identity provider. The
+// identity provider needs the server's metadata, which is served from
+// /_matrix/client/r0/login/sso/metadata/<id>.
+type SAMLProvider struct {
+	// The ID of the provider, which is part of its callback URL and is
+	// recorded against the users who log in with it, so shouldn't be changed
+	// once users have logged in.
+	ID string `yaml:"id"`
+	// The name of the provider shown to users.
+	Name string `yaml:"name"`
+	// The entity ID which the server identifies itself to the provider with.
+	// Defaults to the URL of the server's metadata.
+	EntityID string `yaml:"entity_id"`
+	// Where the metadata of the identity provider is fetched from, either a
+	// URL or a file. Exactly one of them must be given.
+	MetadataURL  string `yaml:"metadata_url"`
+	MetadataPath Path   `yaml:"metadata_path"`
+	// The metadata read from MetadataPath.
+	Metadata []byte `yaml:"-"`
+	// The attribute which the localparts of new accounts are made from.
+	// Defaults to "uid".
+	LocalpartAttribute string `yaml:"localpart_attribute"`
+	// The attribute which the display names of new accounts are taken from.
+	// Defaults to "displayName".
+	DisplayNameAttribute string `yaml:"display_name_attribute"`
+}
+
+// CASProvider contains the settings for a CAS server. The localparts of new
+// accounts are made from the users' CAS usernames.
+type CASProvider struct {
+	// The ID of the provider, which is part of its callback URL and is
+	// recorded against the users who log in with it, so shouldn't be changed
+	// once users have logged in.
+	ID string `yaml:"id"`
+	// The name of the provider shown to users.
+	Name string `yaml:"name"`
+	// The base URL of the CAS server, e.g. "https://cas.example.com/cas".
+	ServerURL string `yaml:"server_url"`
+	// The attribute which the display names of new accounts are taken from.
+	// Defaults to "displayName".
+	DisplayNameAttribute string `yaml:"display_name_attribute"`
+	// Attributes which users must have, with the values that they must have,
+	// to be allowed to log in, e.g. to only allow staff.
+	RequiredAttributes map[string]string `yaml:"required_attributes"`
+}
+
+// Email contains the SMTP server which the server sends emails through. If
+// there isn't one then email addresses are validated by identity servers.
+type Email struct {
+	// The host and port of the SMTP server, e.g. "smtp.example.com:587".
+	SMTPAddress string `yaml:"smtp_address"`
+	// The credentials to send emails with, if the SMTP server needs any.
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// The address which emails are sent from.
+	From string `yaml:"from"`
+	// The public URL of the client API, which links in emails point to, e.g.
+	// "https://matrix.example.com".
+	PublicBaseURL string `yaml:"public_base_url"`
+	// How long the links in validation emails can be followed for.
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+}
+
+// Enabled returns whether the server sends emails itself.
+func (e *Email) Enabled() bool {
+	return e.SMTPAddress != ""
+}
+
+// SyncLimits contains the limits on /sync requests which are waiting for
+// new data to arrive, so that a client making lots of them at once can't
+// tie up goroutines and database connections.
+type SyncLimits struct {
+	// The number of /sync requests that a user may have waiting for new data
+	// at once, across all of their devices. Further requests are refused until
+	// one of the others returns. Negative means there is no limit.
+	MaxConcurrentRequestsPerUser int `yaml:"max_concurrent_requests_per_user"`
+	// Up to this much is taken off the timeout of each /sync request at random,
+	// so that clients which started syncing together don't keep waking up
+	// together. Negative disables the jitter.
+	TimeoutJitter time.Duration `yaml:"timeout_jitter"`
+}
+
+// SyncRetention contains the limits on how much old data the sync API keeps,
+// so that its database doesn't keep growing forever. Clients which last
+// synced before events that they hadn't seen yet were removed get a full
+// sync instead of an incremental one.
+type SyncRetention struct {
+	// Events older than this are removed. Zero keeps events forever.
+	MaxEventAge time.Duration `yaml:"max_event_age"`
+	// Only this many of the newest events in each room are kept. Zero means
+	// there is no limit. The newest event in a room is always kept.
+	MaxEventsPerRoom int `yaml:"max_events_per_room"`
+	// Only this many of the newest send-to-device messages waiting for each
+	// device are kept. Zero means there is no limit.
+	MaxSendToDeviceMessagesPerDevice int `yaml:"max_send_to_device_messages_per_device"`
+	// How often old data is removed.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Enabled returns whether any old data should be removed at all.
+func (r *SyncRetention) Enabled() bool {
+	return r.MaxEventAge > 0 || r.MaxEventsPerRoom > 0 || r.MaxSendToDeviceMessagesPerDevice > 0
+}
+
+// RoomCreation contains the policy applied when local users create rooms
+// with /createRoom.
+type RoomCreation struct {
+	// If not empty, only these users may create rooms.
+	AllowedCreators []string `yaml:"allowed_creators"`
+	// If not empty, only these users may create room aliases, either with
+	// room_alias_name or by setting them directly.
+	AllowedAliasCreators []string `yaml:"allowed_alias_creators"`
+	// If set, rooms which can only be joined by invite are created with
+	// end-to-end encryption turned on, unless the request's initial_state
+	// already chooses an encryption algorithm.
+	EncryptPrivateRooms bool `yaml:"encrypt_private_rooms"`
+	// Defaults for the initial m.room.power_levels event of new rooms. The
+	// power_level_content_override of the request is applied on top of these.
+	PowerLevelContentOverride PowerLevelContentOverride `yaml:"power_level_content_override"`
+}
+
+// MayCreateRoom returns whether the given user is allowed to create rooms.
+func (r *RoomCreation) MayCreateRoom(userID string) bool {
+	return len(r.AllowedCreators) == 0 || containsString(r.AllowedCreators, userID)
+}
+
+// MayCreateAlias returns whether the given user is allowed to create room
+// aliases.
+func (r *RoomCreation) MayCreateAlias(userID string) bool {
+	return len(r.AllowedAliasCreators) == 0 || containsString(r.AllowedAliasCreators, userID)
+}
+
+// ServerNotices contains the settings for server notices, which are messages
+// that administrators send to local users from a dedicated user. Each user
+// gets their own notices room, which they can't send messages to.
+type ServerNotices struct {
+	// If not set, server notices can't be sent.
+	Enabled bool `yaml:"enabled"`
+	// The localpart of the user who sends the notices. Its account is
+	// created when the first notice is sent. It has to start with an
+	// underscore, which users can't register localparts with.
+	Localpart string `yaml:"localpart"`
+	// The display name and avatar of the user who sends the notices.
+	DisplayName string `yaml:"display_name"`
+	AvatarURL   string `yaml:"avatar_url"`
+	// The name of the notices rooms.
+	RoomName string `yaml:"room_name"`
+}
+
+// PowerLevelContentOverride contains the values of m.room.power_levels to
+// use instead of the built-in defaults. Levels which aren't given are left
+// alone, and the events and notifications levels are merged into the
+// defaults rather than replacing them.
+type PowerLevelContentOverride struct {
+	Ban           *int64           `yaml:"ban"`
+	Invite        *int64           `yaml:"invite"`
+	Kick          *int64           `yaml:"kick"`
+	Redact        *int64           `yaml:"redact"`
+	UsersDefault  *int64           `yaml:"users_default"`
+	EventsDefault *int64           `yaml:"events_default"`
+	StateDefault  *int64           `yaml:"state_default"`
+	Events        map[string]int64 `yaml:"events"`
+	Notifications map[string]int64 `yaml:"notifications"`
+}
+
+// Apply overrides the levels in the given power levels content.
+func (o *PowerLevelContentOverride) Apply(c *gomatrixserverlib.PowerLevelContent) {
+	for _, level := range []struct {
+		override *int64
+		target   *int64
+	}{
+		{o.Ban, &c.Ban},
+		{o.Invite, &c.Invite},
+		{o.Kick, &c.Kick},
+		{o.Redact, &c.Redact},
+		{o.UsersDefault, &c.UsersDefault},
+		{o.EventsDefault, &c.EventsDefault},
+		{o.StateDefault, &c.StateDefault},
+	} {
+		if level.override != nil {
+			*level.target = *level.override
+		}
+	}
+	if len(o.Events) > 0 && c.Events == nil {
+		c.Events = make(map[string]int64, len(o.Events))
+	}
+	for eventType, level := range o.Events {
+		c.Events[eventType] = level
+	}
+	if len(o.Notifications) > 0 && c.Notifications == nil {
+		c.Notifications = make(map[string]int64, len(o.Notifications))
+	}
+	for key, level := range o.Notifications {
+		c.Notifications[key] = level
+	}
+}
+
+// AuthDebug contains the rooms which the room server records the event auth
+// decisions of. The decisions can be queried through the admin API, which can
+// also start and stop recording them for other rooms.
+type AuthDebug struct {
+	// The rooms to record auth decisions for from startup.
+	Rooms []string `yaml:"rooms"`
+	// How many of the most recent decisions are kept for each room.
+	MaxDecisionsPerRoom int `yaml:"max_decisions_per_room"`
+}
+
+// JoinRestrictions contains the rooms that local users aren't allowed to
+// join. A room is identified with a server by the domain of its room ID,
+// and the servers that a join is made through are checked as well. Rooms
+// on this server are never restricted by server.
+type JoinRestrictions struct {
+	// If not empty, local users may only join rooms on these servers.
+	AllowedServers []gomatrixserverlib.ServerName `yaml:"allowed_servers"`
+	// Local users may not join rooms on these servers.
+	DeniedServers []gomatrixserverlib.ServerName `yaml:"denied_servers"`
+	// Local users may not join these rooms, wherever they are.
+	DeniedRooms []string `yaml:"denied_rooms"`
+}
+
+// AllowsServer returns whether local users may join rooms on, or join rooms
+// through, the given server.
+func (j *JoinRestrictions) AllowsServer(localServerName, serverName gomatrixserverlib.ServerName) bool {
+	if serverName == localServerName {
+		return true
+	}
+	for _, denied := range j.DeniedServers {
+		if denied == serverName {
+			return false
+		}
+	}
+	if len(j.AllowedServers) == 0 {
+		return true
+	}
+	for _, allowed := range j.AllowedServers {
+		if allowed == serverName {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRoom returns whether local users may join the given room ID or
+// alias.
+func (j *JoinRestrictions) AllowsRoom(localServerName gomatrixserverlib.ServerName, roomIDOrAlias string) bool {
+	if roomIDOrAlias == "" || containsString(j.DeniedRooms, roomIDOrAlias) {
+		return false
+	}
+	_, domain, err := gomatrixserverlib.SplitID(roomIDOrAlias[0], roomIDOrAlias)
+	if err != nil {
+		return false
+	}
+	return j.AllowsServer(localServerName, domain)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // ThumbnailSize contains a single thumbnail size configuration
 type ThumbnailSize struct {
 	// Maximum width of the thumbnail image
@@ -352,6 +923,79 @@ type ThumbnailSize struct {
 	ResizeMethod string `yaml:"method,omitempty"`
 }
 
+// FederationMutualTLS contains the configuration of mutual TLS between
+// homeservers, for closed federations in which every server has a
+// certificate issued by a certificate authority shared by the federation.
+type FederationMutualTLS struct {
+	// The PEM certificate and private key which this server presents to
+	// remote servers when making federation requests.
+	ClientCertificatePath Path `yaml:"client_certificate"`
+	ClientKeyPath         Path `yaml:"client_key"`
+	// PEM certificates of the authorities which issue the certificates of
+	// the servers in the federation. If set, the certificates of remote
+	// servers are verified against them both when they make federation
+	// requests to this server and when this server makes requests to them.
+	CACertificatePaths []Path `yaml:"ca_certificates"`
+	// If true, federation requests are rejected unless they were made with
+	// a verified client certificate. Requires ca_certificates.
+	RequireClientCertificates bool `yaml:"require_client_certificates"`
+	// The certificate and authorities loaded from the paths above.
+	ClientCertificate *tls.Certificate `yaml:"-"`
+	CACertificates    *x509.CertPool   `yaml:"-"`
+}
+
+// Enabled returns whether any mutual TLS options have been configured.
+func (m *FederationMutualTLS) Enabled() bool {
+	return m.ClientCertificate != nil || m.CACertificates != nil
+}
+
+// ServerTLSConfig returns the TLS configuration for listeners which accept
+// federation requests, or nil if no certificate authorities are configured.
+// Client certificates are verified if given, so that clients which don't
+// have one can still use the same listener. Whether federation requests
+// must have one is checked for each request instead.
+func (m *FederationMutualTLS) ServerTLSConfig() *tls.Config {
+	if m.CACertificates == nil {
+		return nil
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  m.CACertificates,
+	}
+}
+
+func (m *FederationMutualTLS) load(basePath string, readFile func(string) ([]byte, error)) error {
+	if m.ClientCertificatePath != "" {
+		certPEM, err := readFile(absPath(basePath, m.ClientCertificatePath))
+		if err != nil {
+			return err
+		}
+		keyPEM, err := readFile(absPath(basePath, m.ClientKeyPath))
+		if err != nil {
+			return err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("invalid federation client certificate: %w", err)
+		}
+		m.ClientCertificate = &cert
+	}
+	for _, caPath := range m.CACertificatePaths {
+		absCAPath := absPath(basePath, caPath)
+		pemData, err := readFile(absCAPath)
+		if err != nil {
+			return err
+		}
+		if m.CACertificates == nil {
+			m.CACertificates = x509.NewCertPool()
+		}
+		if !m.CACertificates.AppendCertsFromPEM(pemData) {
+			return fmt.Errorf("no certificate PEM data in %q", absCAPath)
+		}
+	}
+	return nil
+}
+
 // LogrusHook represents a single logrus hook. At this point, only parsing and
 // verification of the proper values for type and level are done.
 // Validity/integrity checks on the parameters are done when configuring logrus.
@@ -428,6 +1072,14 @@ func loadConfig(
 		config.Matrix.TLSFingerPrints = append(config.Matrix.TLSFingerPrints, *fingerprint)
 	}
 
+	if err = config.Matrix.FederationMutualTLS.load(basePath, readFile); err != nil {
+		return nil, err
+	}
+
+	if err = config.Matrix.SSO.load(basePath, readFile); err != nil {
+		return nil, err
+	}
+
 	config.Media.AbsBasePath = Path(absPath(basePath, config.Media.BasePath))
 
 	// Generate data from config options
@@ -446,16 +1098,32 @@ func (config *Dendrite) Derive() error {
 
 	config.Derived.Registration.Params = make(map[string]interface{})
 
-	// TODO: Add email auth type
 	// TODO: Add MSISDN auth type
 
+	var stages []authtypes.LoginType
+	if config.Matrix.RegistrationRequiresToken {
+		stages = append(stages, authtypes.LoginTypeRegistrationToken)
+	}
+	if config.Matrix.RegistrationRequiresEmail {
+		stages = append(stages, authtypes.LoginTypeEmail)
+	}
 	if config.Matrix.RecaptchaEnabled {
 		config.Derived.Registration.Params[authtypes.LoginTypeRecaptcha] = map[string]string{"public_key": config.Matrix.RecaptchaPublicKey}
-		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
-			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}})
-	} else {
-		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
-			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
+		stages = append(stages, authtypes.LoginTypeRecaptcha)
+	}
+	if len(stages) == 0 {
+		stages = append(stages, authtypes.LoginTypeDummy)
+	}
+	config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
+		authtypes.Flow{Stages: stages})
+
+	config.Derived.TrustedProxies = nil
+	for _, proxy := range config.Matrix.TrustedProxies {
+		network, err := parseTrustedProxy(proxy)
+		if err != nil {
+			return err
+		}
+		config.Derived.TrustedProxies = append(config.Derived.TrustedProxies, network)
 	}
 
 	// Load application service configuration files
@@ -476,6 +1144,102 @@ func (config *Dendrite) SetDefaults() {
 		config.Matrix.TrustedIDServers = []string{}
 	}
 
+	if config.Matrix.AccountDataLimits.MaxEventSizeBytes == nil {
+		defaultMaxEventSizeBytes := FileSizeBytes(65536)
+		config.Matrix.AccountDataLimits.MaxEventSizeBytes = &defaultMaxEventSizeBytes
+	}
+
+	if config.Matrix.AccountDataLimits.MaxTotalSizeBytes == nil {
+		defaultMaxTotalSizeBytes := FileSizeBytes(4194304)
+		config.Matrix.AccountDataLimits.MaxTotalSizeBytes = &defaultMaxTotalSizeBytes
+	}
+
+	if config.Matrix.LoginProtection.MaxFailedAttempts == 0 {
+		config.Matrix.LoginProtection.MaxFailedAttempts = 10
+	}
+
+	if config.Matrix.LoginProtection.FailureWindow == 0 {
+		config.Matrix.LoginProtection.FailureWindow = 15 * time.Minute
+	}
+
+	config.Matrix.RateLimiting.Login.setDefaults(3, 6*time.Second)
+	config.Matrix.RateLimiting.Registration.setDefaults(3, 6*time.Second)
+	config.Matrix.RateLimiting.Messages.setDefaults(10, 5*time.Second)
+	config.Matrix.RateLimiting.Joins.setDefaults(10, 10*time.Second)
+	config.Matrix.RateLimiting.Invites.setDefaults(10, 10*time.Second)
+	config.Matrix.RateLimiting.RoomCreation.setDefaults(5, 10*time.Second)
+	config.Matrix.RateLimiting.EmailTokens.setDefaults(3, time.Minute)
+
+	if config.Matrix.RefreshableAccessTokenLifetime == 0 {
+		config.Matrix.RefreshableAccessTokenLifetime = 5 * time.Minute
+	}
+
+	for i := range config.Matrix.SSO.OIDCProviders {
+		provider := &config.Matrix.SSO.OIDCProviders[i]
+		if provider.Scopes == nil {
+			provider.Scopes = []string{"profile"}
+		}
+		if provider.LocalpartClaim == "" {
+			provider.LocalpartClaim = "preferred_username"
+		}
+		if provider.DisplayNameClaim == "" {
+			provider.DisplayNameClaim = "name"
+		}
+	}
+
+	for i := range config.Matrix.SSO.SAMLProviders {
+		provider := &config.Matrix.SSO.SAMLProviders[i]
+		if provider.LocalpartAttribute == "" {
+			provider.LocalpartAttribute = "uid"
+		}
+		if provider.DisplayNameAttribute == "" {
+			provider.DisplayNameAttribute = "displayName"
+		}
+	}
+
+	for i := range config.Matrix.SSO.CASProviders {
+		provider := &config.Matrix.SSO.CASProviders[i]
+		if provider.DisplayNameAttribute == "" {
+			provider.DisplayNameAttribute = "displayName"
+		}
+	}
+
+	if config.Matrix.Email.TokenLifetime == 0 {
+		config.Matrix.Email.TokenLifetime = time.Hour
+	}
+
+	if config.Matrix.SyncLimits.MaxConcurrentRequestsPerUser == 0 {
+		config.Matrix.SyncLimits.MaxConcurrentRequestsPerUser = 10
+	}
+
+	if config.Matrix.SyncLimits.TimeoutJitter == 0 {
+		config.Matrix.SyncLimits.TimeoutJitter = 5 * time.Second
+	}
+
+	if config.Matrix.SyncRetention.Interval == 0 {
+		config.Matrix.SyncRetention.Interval = time.Hour
+	}
+
+	if config.Matrix.ServerNotices.Localpart == "" {
+		config.Matrix.ServerNotices.Localpart = "_server"
+	}
+
+	if config.Matrix.ServerNotices.DisplayName == "" {
+		config.Matrix.ServerNotices.DisplayName = "Server Alerts"
+	}
+
+	if config.Matrix.ServerNotices.RoomName == "" {
+		config.Matrix.ServerNotices.RoomName = "Server Alert"
+	}
+
+	if config.Matrix.AuthDebug.MaxDecisionsPerRoom == 0 {
+		config.Matrix.AuthDebug.MaxDecisionsPerRoom = 100
+	}
+
+	if config.Metrics.SlowPDUThreshold == 0 {
+		config.Metrics.SlowPDUThreshold = 5 * time.Second
+	}
+
 	if config.Media.MaxThumbnailGenerators == 0 {
 		config.Media.MaxThumbnailGenerators = 10
 	}
@@ -559,6 +1323,110 @@ func (config *Dendrite) checkMatrix(configErrs *configErrors) {
 		checkNotEmpty(configErrs, "matrix.recaptcha_private_key", string(config.Matrix.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "matrix.recaptcha_siteverify_api", string(config.Matrix.RecaptchaSiteVerifyAPI))
 	}
+	if !config.Matrix.LoginProtection.Disabled {
+		checkPositive(configErrs, "matrix.login_protection.max_failed_attempts", int64(config.Matrix.LoginProtection.MaxFailedAttempts))
+		checkPositive(configErrs, "matrix.login_protection.failure_window", int64(config.Matrix.LoginProtection.FailureWindow))
+		if config.Matrix.LoginProtection.CaptchaAfterFailedAttempts > 0 {
+			checkNotEmpty(configErrs, "matrix.recaptcha_public_key", string(config.Matrix.RecaptchaPublicKey))
+			checkNotEmpty(configErrs, "matrix.recaptcha_private_key", string(config.Matrix.RecaptchaPrivateKey))
+			checkNotEmpty(configErrs, "matrix.recaptcha_siteverify_api", string(config.Matrix.RecaptchaSiteVerifyAPI))
+		}
+	}
+	for _, proxy := range config.Matrix.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "matrix.trusted_proxies", err))
+		}
+	}
+	if !config.Matrix.RateLimiting.Disabled {
+		for key, limit := range map[string]RateLimit{
+			"login":         config.Matrix.RateLimiting.Login,
+			"registration":  config.Matrix.RateLimiting.Registration,
+			"messages":      config.Matrix.RateLimiting.Messages,
+			"joins":         config.Matrix.RateLimiting.Joins,
+			"invites":       config.Matrix.RateLimiting.Invites,
+			"room_creation": config.Matrix.RateLimiting.RoomCreation,
+			"email_tokens":  config.Matrix.RateLimiting.EmailTokens,
+		} {
+			checkPositive(configErrs, "matrix.rate_limiting."+key+".burst", int64(limit.Burst))
+			checkPositive(configErrs, "matrix.rate_limiting."+key+".interval", int64(limit.Interval))
+		}
+	}
+	checkPositive(configErrs, "matrix.refreshable_access_token_lifetime", int64(config.Matrix.RefreshableAccessTokenLifetime))
+	if config.Matrix.SSO.Enabled() {
+		checkNotEmpty(configErrs, "matrix.sso.public_base_url", config.Matrix.SSO.PublicBaseURL)
+	}
+	providerIDs := map[string]bool{}
+	for i, provider := range config.Matrix.SSO.OIDCProviders {
+		key := fmt.Sprintf("matrix.sso.oidc_providers[%d]", i)
+		checkNotEmpty(configErrs, key+".id", provider.ID)
+		checkNotEmpty(configErrs, key+".issuer", provider.Issuer)
+		checkNotEmpty(configErrs, key+".client_id", provider.ClientID)
+		checkUniqueID(configErrs, providerIDs, key+".id", provider.ID)
+	}
+	for i, provider := range config.Matrix.SSO.SAMLProviders {
+		key := fmt.Sprintf("matrix.sso.saml_providers[%d]", i)
+		checkNotEmpty(configErrs, key+".id", provider.ID)
+		if (provider.MetadataURL == "") == (provider.MetadataPath == "") {
+			configErrs.Add(fmt.Sprintf("exactly one of config keys %q and %q must be given", key+".metadata_url", key+".metadata_path"))
+		}
+		checkUniqueID(configErrs, providerIDs, key+".id", provider.ID)
+	}
+	for i, provider := range config.Matrix.SSO.CASProviders {
+		key := fmt.Sprintf("matrix.sso.cas_providers[%d]", i)
+		checkNotEmpty(configErrs, key+".id", provider.ID)
+		checkNotEmpty(configErrs, key+".server_url", provider.ServerURL)
+		checkUniqueID(configErrs, providerIDs, key+".id", provider.ID)
+	}
+	if config.Matrix.RegistrationRequiresEmail {
+		checkNotEmpty(configErrs, "matrix.email.smtp_address", config.Matrix.Email.SMTPAddress)
+	}
+	if config.Matrix.Email.Enabled() {
+		checkNotEmpty(configErrs, "matrix.email.from", config.Matrix.Email.From)
+		checkNotEmpty(configErrs, "matrix.email.public_base_url", config.Matrix.Email.PublicBaseURL)
+		checkPositive(configErrs, "matrix.email.token_lifetime", int64(config.Matrix.Email.TokenLifetime))
+	}
+	if !strings.HasPrefix(config.Matrix.ServerNotices.Localpart, "_") {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s, it must start with '_'", "matrix.server_notices.localpart", config.Matrix.ServerNotices.Localpart))
+	}
+	checkUserIDs(configErrs, "matrix.room_creation.allowed_creators", config.Matrix.RoomCreation.AllowedCreators)
+	checkUserIDs(configErrs, "matrix.room_creation.allowed_alias_creators", config.Matrix.RoomCreation.AllowedAliasCreators)
+	for i, pinned := range config.Matrix.PinnedServerKeys {
+		checkNotEmpty(configErrs, fmt.Sprintf("matrix.pinned_server_keys[%d].server_name", i), string(pinned.ServerName))
+		checkNotZero(configErrs, fmt.Sprintf("matrix.pinned_server_keys[%d].keys", i), int64(len(pinned.Keys)))
+		for j, key := range pinned.Keys {
+			if !strings.HasPrefix(string(key.KeyID), "ed25519:") {
+				configErrs.Add(fmt.Sprintf("invalid key ID for config key %q: %s", fmt.Sprintf("matrix.pinned_server_keys[%d].keys[%d].key_id", i, j), key.KeyID))
+			}
+			if raw, err := base64.RawStdEncoding.DecodeString(key.PublicKey); err != nil || len(raw) != ed25519.PublicKeySize {
+				configErrs.Add(fmt.Sprintf("invalid public key for config key %q: %s", fmt.Sprintf("matrix.pinned_server_keys[%d].keys[%d].public_key", i, j), key.PublicKey))
+			}
+		}
+	}
+	mutualTLS := &config.Matrix.FederationMutualTLS
+	if (mutualTLS.ClientCertificatePath == "") != (mutualTLS.ClientKeyPath == "") {
+		configErrs.Add("matrix.federation_mutual_tls.client_certificate and matrix.federation_mutual_tls.client_key must be given together")
+	}
+	if mutualTLS.RequireClientCertificates {
+		checkNotZero(configErrs, "matrix.federation_mutual_tls.ca_certificates", int64(len(mutualTLS.CACertificatePaths)))
+	}
+}
+
+// checkUniqueID verifies that an ID given for a config key hasn't already been
+// given for another one, adding it to the IDs which have been seen.
+func checkUniqueID(configErrs *configErrors, seen map[string]bool, key, id string) {
+	if seen[id] {
+		configErrs.Add(fmt.Sprintf("duplicate ID for config key %q: %s", key, id))
+	}
+	seen[id] = true
+}
+
+// checkUserIDs verifies that every value given for a config key is a user ID.
+func checkUserIDs(configErrs *configErrors, key string, userIDs []string) {
+	for _, userID := range userIDs {
+		if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid user ID for config key %q: %s", key, userID))
+		}
+	}
 }
 
 // checkMedia verifies the parameters media.* are valid.
@@ -567,6 +1435,8 @@ func (config *Dendrite) checkMedia(configErrs *configErrors) {
 	checkPositive(configErrs, "media.max_file_size_bytes", int64(*config.Media.MaxFileSizeBytes))
 	checkPositive(configErrs, "media.max_thumbnail_generators", int64(config.Media.MaxThumbnailGenerators))
 
+	checkPositive(configErrs, "media.remote_media.max_cache_size_bytes", int64(config.Media.RemoteMedia.MaxCacheSizeBytes))
+
 	for i, size := range config.Media.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media.thumbnail_sizes[%d].height", i), int64(size.Height))
@@ -602,6 +1472,17 @@ func (config *Dendrite) checkDatabase(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "database.sync_api", string(config.Database.SyncAPI))
 	checkNotEmpty(configErrs, "database.room_server", string(config.Database.RoomServer))
 	checkNotEmpty(configErrs, "database.current_state", string(config.Database.CurrentState))
+	checkNotEmpty(configErrs, "database.key_server", string(config.Database.KeyServer))
+	checkReadReplica(configErrs, "database.read_replicas.sync_api", config.Database.ReadReplicas.SyncAPI)
+	checkReadReplica(configErrs, "database.read_replicas.current_state", config.Database.ReadReplicas.CurrentState)
+	checkReadReplica(configErrs, "database.read_replicas.room_server", config.Database.ReadReplicas.RoomServer)
+}
+
+// checkReadReplica verifies that a read replica, if given, is a postgres database.
+func checkReadReplica(configErrs *configErrors, key string, value DataSource) {
+	if value != "" && !strings.HasPrefix(string(value), "postgres://") {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q, read replicas must be postgres databases", key, value))
+	}
 }
 
 // checkListen verifies the parameters listen.* are valid.
@@ -643,6 +1524,7 @@ func (config *Dendrite) check(monolithic bool) error {
 	config.checkKafka(&configErrs, monolithic)
 	config.checkDatabase(&configErrs)
 	config.checkLogging(&configErrs)
+	config.checkFeatureFlags(&configErrs)
 
 	if !monolithic {
 		config.checkListen(&configErrs)
@@ -719,6 +1601,21 @@ func (config *Dendrite) AppServiceURL() string {
 	return "http://" + string(config.Listen.AppServiceAPI)
 }
 
+// IsEDUTypeEnabled returns false if the given EDU type belongs to a feature
+// which has been disabled in the config, e.g. typing notifications.
+func (config *Dendrite) IsEDUTypeEnabled(eduType string) bool {
+	switch eduType {
+	case "m.presence":
+		return !config.Matrix.DisablePresence
+	case "m.typing":
+		return !config.Matrix.DisableTyping
+	case "m.receipt":
+		return !config.Matrix.DisableReceipts
+	default:
+		return true
+	}
+}
+
 // RoomServerURL returns an HTTP URL for where the roomserver is listening.
 func (config *Dendrite) RoomServerURL() string {
 	// Hard code the roomserver to talk HTTP for now.
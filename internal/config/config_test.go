@@ -16,7 +16,15 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestLoadConfigRelative(t *testing.T) {
@@ -56,6 +64,7 @@ database:
   room_server: "postgresql:///room_server"
   appservice: "postgresql:///appservice"
   current_state: "postgresql:///current_state"
+  key_server: "postgresql:///key_server"
 listen:
   room_server: "localhost:7770"
   client_api: "localhost:7771"
@@ -83,6 +92,201 @@ func (m mockReadFile) readFile(path string) ([]byte, error) {
 	return []byte(data), nil
 }
 
+func TestPowerLevelContentOverride(t *testing.T) {
+	var o PowerLevelContentOverride
+	if err := yaml.Unmarshal([]byte("invite: 50\nevents:\n  m.room.topic: 100\n"), &o); err != nil {
+		t.Fatalf("failed to unmarshal override: %s", err)
+	}
+	var c gomatrixserverlib.PowerLevelContent
+	c.Defaults()
+	c.Events = map[string]int64{"m.room.name": 50}
+	o.Apply(&c)
+	if c.Invite != 50 {
+		t.Errorf("wanted invite level 50, got %d", c.Invite)
+	}
+	if c.Kick != 50 || c.StateDefault != 50 {
+		t.Errorf("levels which weren't overridden changed: %+v", c)
+	}
+	if c.Events["m.room.topic"] != 100 || c.Events["m.room.name"] != 50 {
+		t.Errorf("wanted event levels to be merged, got %v", c.Events)
+	}
+}
+
+func TestJoinRestrictions(t *testing.T) {
+	j := JoinRestrictions{
+		AllowedServers: []gomatrixserverlib.ServerName{"allowed.org", "denied.org"},
+		DeniedServers:  []gomatrixserverlib.ServerName{"denied.org"},
+		DeniedRooms:    []string{"!banned:allowed.org"},
+	}
+	for roomIDOrAlias, want := range map[string]bool{
+		"!room:localhost":     true,
+		"!room:allowed.org":   true,
+		"#alias:allowed.org":  true,
+		"!room:denied.org":    false,
+		"!room:other.org":     false,
+		"!banned:allowed.org": false,
+		"":                    false,
+	} {
+		if got := j.AllowsRoom("localhost", roomIDOrAlias); got != want {
+			t.Errorf("AllowsRoom(%q): got %v, want %v", roomIDOrAlias, got, want)
+		}
+	}
+}
+
+func TestIsEDUTypeEnabled(t *testing.T) {
+	var c Dendrite
+	c.Matrix.DisableTyping = true
+	c.Matrix.DisableReceipts = true
+	for eduType, want := range map[string]bool{
+		"m.presence":                      true,
+		"m.typing":                        false,
+		"m.receipt":                       false,
+		gomatrixserverlib.MDirectToDevice: true,
+	} {
+		if got := c.IsEDUTypeEnabled(eduType); got != want {
+			t.Errorf("IsEDUTypeEnabled(%q): got %v, want %v", eduType, got, want)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	var c Dendrite
+	c.Matrix.TrustedProxies = []string{"10.0.0.1", "192.168.0.0/16", "::1"}
+	var configErrs configErrors
+	c.checkMatrix(&configErrs)
+	for _, err := range configErrs {
+		if strings.Contains(err, "trusted_proxies") {
+			t.Errorf("valid trusted proxies were rejected: %s", err)
+		}
+	}
+	if err := c.Derive(); err != nil {
+		t.Fatalf("Derive failed: %s", err)
+	}
+	if len(c.Derived.TrustedProxies) != 3 || c.Derived.TrustedProxies[0].String() != "10.0.0.1/32" || c.Derived.TrustedProxies[2].String() != "::1/128" {
+		t.Errorf("got trusted proxies %v", c.Derived.TrustedProxies)
+	}
+
+	c.Matrix.TrustedProxies = []string{"proxy.local", "10.0.0.0/33"}
+	configErrs = nil
+	c.checkMatrix(&configErrs)
+	var found int
+	for _, err := range configErrs {
+		if strings.Contains(err, "matrix.trusted_proxies") {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("got %d errors for invalid trusted proxies, want 2: %v", found, configErrs)
+	}
+}
+
+func TestAppServiceTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dendrite-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	registration := func(id string, transactions string) string {
+		path := filepath.Join(dir, id+".yaml")
+		data := fmt.Sprintf("id: %s\nurl: http://localhost\nas_token: %s-as\nhs_token: %s-hs\nsender_localpart: %s\n%s", id, id, id, id, transactions)
+		if err = ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	var c Dendrite
+	c.ApplicationServices.ConfigFiles = []string{
+		registration("bot", ""),
+		registration("bridge", "transactions:\n  max_events: 100\n  push_interval: 1s\n"),
+	}
+	c.ApplicationServices.Transactions = map[string]ApplicationServiceTransactions{
+		"bridge": {MaxEvents: 500, MaxConcurrentRequests: 4},
+	}
+	if err = loadAppServices(&c); err != nil {
+		t.Fatalf("loadAppServices: %s", err)
+	}
+	want := map[string]ApplicationServiceTransactions{
+		"bot":    {MaxEvents: defaultTransactionMaxEvents},
+		"bridge": {MaxEvents: 500, PushInterval: time.Second, MaxConcurrentRequests: 4},
+	}
+	for _, as := range c.Derived.ApplicationServices {
+		if as.Transactions != want[as.ID] {
+			t.Errorf("application service %s: got %+v, want %+v", as.ID, as.Transactions, want[as.ID])
+		}
+	}
+
+	c = Dendrite{}
+	c.ApplicationServices.ConfigFiles = []string{registration("bot", "")}
+	c.ApplicationServices.Transactions = map[string]ApplicationServiceTransactions{
+		"unknown": {MaxEvents: 10},
+	}
+	if err = loadAppServices(&c); err == nil {
+		t.Errorf("expected settings for an unknown application service to be rejected")
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	var c Dendrite
+	if err := yaml.Unmarshal([]byte("feature_flags:\n  peeking: false\n"), &c); err != nil {
+		t.Fatalf("failed to unmarshal feature flags: %s", err)
+	}
+	if c.FeatureEnabled(FeaturePeeking) {
+		t.Errorf("expected peeking to be turned off")
+	}
+	if !(&Dendrite{}).FeatureEnabled(FeaturePeeking) {
+		t.Errorf("expected peeking to be on by default")
+	}
+	var configErrs configErrors
+	c.checkFeatureFlags(&configErrs)
+	if len(configErrs) != 0 {
+		t.Errorf("unexpected errors for known feature flags: %v", configErrs)
+	}
+	c.FeatureFlags["peaking"] = true
+	c.checkFeatureFlags(&configErrs)
+	if len(configErrs) != 1 {
+		t.Errorf("expected an error for an unknown feature flag, got %v", configErrs)
+	}
+}
+
+func TestFederationMutualTLS(t *testing.T) {
+	var m FederationMutualTLS
+	if m.Enabled() || m.ServerTLSConfig() != nil {
+		t.Fatal("expected mutual TLS to be disabled by default")
+	}
+
+	m.CACertificatePaths = []Path{"ca.pem"}
+	readFile := mockReadFile{"/my/config/dir/ca.pem": testCert}.readFile
+	if err := m.load("/my/config/dir", readFile); err != nil {
+		t.Fatal("failed to load CA certificates:", err)
+	}
+	if !m.Enabled() {
+		t.Error("expected mutual TLS to be enabled")
+	}
+	if tlsConfig := m.ServerTLSConfig(); tlsConfig == nil || tlsConfig.ClientCAs == nil {
+		t.Errorf("expected a server TLS config with client CAs, got %+v", tlsConfig)
+	}
+
+	m = FederationMutualTLS{CACertificatePaths: []Path{"ca.pem"}}
+	if err := m.load("/my/config/dir", mockReadFile{"/my/config/dir/ca.pem": testKey}.readFile); err == nil {
+		t.Error("expected an error loading a CA file without certificates")
+	}
+
+	var cfg Dendrite
+	cfg.Matrix.FederationMutualTLS.ClientCertificatePath = "client.pem"
+	cfg.Matrix.FederationMutualTLS.RequireClientCertificates = true
+	var configErrs configErrors
+	cfg.checkMatrix(&configErrs)
+	var keyErr, caErr bool
+	for _, err := range configErrs {
+		keyErr = keyErr || strings.Contains(err, "client_key")
+		caErr = caErr || strings.Contains(err, "ca_certificates")
+	}
+	if !keyErr || !caErr {
+		t.Errorf("expected errors for the missing client key and CA certificates, got %v", configErrs)
+	}
+}
+
 func TestReadKey(t *testing.T) {
 	keyID, _, err := readKeyPEM("path/to/key", []byte(testKey))
 	if err != nil {
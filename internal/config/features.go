@@ -0,0 +1,65 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Feature is an experimental feature, which can be turned on or off for a
+// deployment with feature_flags in the config.
+type Feature string
+
+const (
+	// FeaturePeeking allows users to peek into rooms without joining them.
+	FeaturePeeking Feature = "peeking"
+	// FeatureKnocking allows users to knock on rooms to ask to join them, as
+	// proposed by MSC2403.
+	FeatureKnocking Feature = "knocking"
+)
+
+// featureDefaults says whether each feature is turned on in this release
+// when the config doesn't mention it. Features which aren't ready yet are
+// shipped turned off.
+var featureDefaults = map[Feature]bool{
+	FeaturePeeking:  true,
+	FeatureKnocking: false,
+}
+
+// FeatureFlags turns features on or off, overriding their defaults.
+type FeatureFlags map[Feature]bool
+
+// FeatureEnabled returns whether the given feature is turned on.
+func (config *Dendrite) FeatureEnabled(feature Feature) bool {
+	if enabled, ok := config.FeatureFlags[feature]; ok {
+		return enabled
+	}
+	return featureDefaults[feature]
+}
+
+func (config *Dendrite) checkFeatureFlags(configErrs *configErrors) {
+	for feature := range config.FeatureFlags {
+		if _, ok := featureDefaults[feature]; ok {
+			continue
+		}
+		known := make([]string, 0, len(featureDefaults))
+		for f := range featureDefaults {
+			known = append(known, string(f))
+		}
+		sort.Strings(known)
+		configErrs.Add(fmt.Sprintf("unknown feature flag %q, expected one of %v", feature, known))
+	}
+}
@@ -16,6 +16,7 @@ package eventutil
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -73,6 +74,12 @@ func AddPrevEventsToEvent(
 	if err != nil {
 		return "", fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
 	}
+	if builder.Type == gomatrixserverlib.MRoomMember {
+		var content gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(builder.Content, &content); err == nil && content.Membership == Knock {
+			eventsNeeded.JoinRules = true
+		}
+	}
 
 	if len(eventsNeeded.Tuples()) == 0 {
 		return "", errors.New("expecting state tuples for event builder, got none")
@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Knock is both the membership of a user who has asked to join a room and
+// the join rule of rooms which users can ask to join, as proposed by MSC2403.
+const Knock = "knock"
+
+// Allowed checks whether an event is allowed by the given auth events, in the
+// same way as gomatrixserverlib.Allowed but also following the MSC2403 rules
+// for knocking in room versions which allow knocking. A user may knock on a
+// room with the knock join rule unless they are already joined, invited or
+// banned. A user who has knocked may be invited, or may withdraw their knock
+// by leaving, and invited users may join the room. Everything else, and every
+// event in other room versions, is left to gomatrixserverlib.
+func Allowed(event gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider) error {
+	if !version.AllowsKnocking(event.Version()) {
+		return gomatrixserverlib.Allowed(event, authEvents)
+	}
+	if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+		return gomatrixserverlib.Allowed(event, authEvents)
+	}
+	newMember, err := gomatrixserverlib.NewMemberContentFromEvent(event)
+	if err != nil {
+		return gomatrixserverlib.Allowed(event, authEvents)
+	}
+	targetID, senderID := *event.StateKey(), event.Sender()
+	oldMember, err := gomatrixserverlib.NewMemberContentFromAuthEvents(authEvents, targetID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case newMember.Membership == Knock:
+		if senderID != targetID {
+			return fmt.Errorf("%q cannot knock on behalf of %q", senderID, targetID)
+		}
+		if err = checkKnockRoom(event, authEvents); err != nil {
+			return err
+		}
+		switch oldMember.Membership {
+		case gomatrixserverlib.Join, gomatrixserverlib.Invite, gomatrixserverlib.Ban:
+			return fmt.Errorf("%q cannot knock with membership %q", targetID, oldMember.Membership)
+		}
+		return nil
+
+	case oldMember.Membership == Knock && newMember.Membership == gomatrixserverlib.Invite && newMember.ThirdPartyInvite == nil:
+		if err = checkCreate(event, authEvents); err != nil {
+			return err
+		}
+		senderMember, err := gomatrixserverlib.NewMemberContentFromAuthEvents(authEvents, senderID)
+		if err != nil {
+			return err
+		}
+		if senderMember.Membership != gomatrixserverlib.Join {
+			return fmt.Errorf("sender %q is not in the room", senderID)
+		}
+		powerLevels, err := powerLevelsFromAuthEvents(authEvents)
+		if err != nil {
+			return err
+		}
+		if powerLevels.UserLevel(senderID) < powerLevels.Invite {
+			return fmt.Errorf("%q is not allowed to invite %q", senderID, targetID)
+		}
+		return nil
+
+	case oldMember.Membership == Knock && newMember.Membership == gomatrixserverlib.Leave && senderID == targetID:
+		return checkCreate(event, authEvents)
+
+	case oldMember.Membership == gomatrixserverlib.Invite && newMember.Membership == gomatrixserverlib.Join && senderID == targetID:
+		if checkKnockRoom(event, authEvents) == nil {
+			return nil
+		}
+	}
+	return gomatrixserverlib.Allowed(event, authEvents)
+}
+
+// StateNeededForAuth returns the state needed to check the events with
+// Allowed, which is the same as for gomatrixserverlib.Allowed except that
+// knocks also need the join rules.
+func StateNeededForAuth(events []gomatrixserverlib.Event) gomatrixserverlib.StateNeeded {
+	result := gomatrixserverlib.StateNeededForAuth(events)
+	for i := range events {
+		if !version.AllowsKnocking(events[i].Version()) {
+			continue
+		}
+		if membership, err := events[i].Membership(); err == nil && membership == Knock {
+			result.JoinRules = true
+		}
+	}
+	return result
+}
+
+// checkKnockRoom returns an error unless the room has the knock join rule.
+func checkKnockRoom(event gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider) error {
+	if err := checkCreate(event, authEvents); err != nil {
+		return err
+	}
+	joinRule, err := gomatrixserverlib.NewJoinRuleContentFromAuthEvents(authEvents)
+	if err != nil {
+		return err
+	}
+	if joinRule.JoinRule != Knock {
+		return fmt.Errorf("the join rule of the room is %q, not %q", joinRule.JoinRule, Knock)
+	}
+	return nil
+}
+
+// checkCreate makes the checks against the create event which
+// gomatrixserverlib.Allowed makes for every event.
+func checkCreate(event gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider) error {
+	create, err := authEvents.Create()
+	if err != nil {
+		return err
+	}
+	if create == nil {
+		return fmt.Errorf("missing create event")
+	}
+	if create.RoomID() != event.RoomID() {
+		return fmt.Errorf("create event has different roomID: %q != %q", event.RoomID(), create.RoomID())
+	}
+	content, err := gomatrixserverlib.NewCreateContentFromAuthEvents(authEvents)
+	if err != nil {
+		return err
+	}
+	if err = content.UserIDAllowed(event.Sender()); err != nil {
+		return err
+	}
+	return content.UserIDAllowed(*event.StateKey())
+}
+
+func powerLevelsFromAuthEvents(authEvents gomatrixserverlib.AuthEventProvider) (gomatrixserverlib.PowerLevelContent, error) {
+	content, err := gomatrixserverlib.NewCreateContentFromAuthEvents(authEvents)
+	if err != nil {
+		return gomatrixserverlib.PowerLevelContent{}, err
+	}
+	return gomatrixserverlib.NewPowerLevelContentFromAuthEvents(authEvents, content.Creator)
+}
@@ -46,6 +46,21 @@ type DisplayName struct {
 	DisplayName string `json:"displayname"`
 }
 
+// IgnoredUsers is the content of the m.ignored_user_list account data
+// https://matrix.org/docs/spec/client_server/r0.6.1#m-ignored-user-list
+type IgnoredUsers struct {
+	List map[string]interface{} `json:"ignored_users"`
+}
+
+// IsIgnored returns true if the given user ID is in the ignored users list
+func (i *IgnoredUsers) IsIgnored(userID string) bool {
+	if i == nil {
+		return false
+	}
+	_, ok := i.List[userID]
+	return ok
+}
+
 // WeakBoolean is a type that will Unmarshal to true or false even if the encoded
 // representation is "true"/1 or "false"/0, as well as whatever other forms are
 // recognised by strconv.ParseBool
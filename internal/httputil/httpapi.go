@@ -16,6 +16,7 @@ package httputil
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -27,6 +28,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationsenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -47,15 +49,55 @@ type BasicAuth struct {
 }
 
 // MakeAuthAPI turns a util.JSONRequestHandler function into an http.Handler which authenticates the request.
+// Guests are refused, see MakeGuestAuthAPI.
 func MakeAuthAPI(
 	metricsName string, userAPI userapi.UserInternalAPI,
 	f func(*http.Request, *userapi.Device) util.JSONResponse,
+) http.Handler {
+	return makeAuthAPI(metricsName, userAPI, false, f)
+}
+
+// MakeGuestAuthAPI is like MakeAuthAPI, but guests can make requests too. It
+// should only be used for the endpoints which the spec allows guests to use.
+func MakeGuestAuthAPI(
+	metricsName string, userAPI userapi.UserInternalAPI,
+	f func(*http.Request, *userapi.Device) util.JSONResponse,
+) http.Handler {
+	return makeAuthAPI(metricsName, userAPI, true, f)
+}
+
+// MakeAdminAPI is like MakeAuthAPI, but only server administrators can make
+// requests.
+func MakeAdminAPI(
+	metricsName string, userAPI userapi.UserInternalAPI,
+	f func(*http.Request, *userapi.Device) util.JSONResponse,
+) http.Handler {
+	return MakeAuthAPI(metricsName, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		if !device.IsAdmin {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Only server administrators can use this endpoint"),
+			}
+		}
+		return f(req, device)
+	})
+}
+
+func makeAuthAPI(
+	metricsName string, userAPI userapi.UserInternalAPI, allowGuests bool,
+	f func(*http.Request, *userapi.Device) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
 		device, err := auth.VerifyUserFromRequest(req, userAPI)
 		if err != nil {
 			return *err
 		}
+		if device.IsGuest && !allowGuests {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guests can't use this endpoint"),
+			}
+		}
 		// add the user ID to the logger
 		logger := util.GetLogger((req.Context()))
 		logger = logger.WithField("user_id", device.UserID)
@@ -75,7 +117,10 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	if os.Getenv("DENDRITE_TRACE_HTTP") == "1" {
 		verbose = true
 	}
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	// Make sure that every error has its errcode, however it was built.
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		return jsonerror.Normalise(f(req))
+	}))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
 		nextWriter := w
 		if verbose {
@@ -137,7 +182,7 @@ func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request)
 		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
 		if err := f(w, req); err != nil {
 			h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
-				return *err
+				return jsonerror.Normalise(*err)
 			}))
 			h.ServeHTTP(w, req)
 		}
@@ -196,6 +241,16 @@ func MakeFedAPI(
 		if fedReq == nil {
 			return errResp
 		}
+		// If the request was made with a client certificate then it has been
+		// verified already, but it must also belong to the origin server.
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			if err := req.TLS.PeerCertificates[0].VerifyHostname(string(fedReq.Origin())); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("The client certificate doesn't belong to the origin server"),
+				}
+			}
+		}
 		go wakeup.Wakeup(req.Context(), fedReq.Origin())
 		vars, err := URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
@@ -265,6 +320,21 @@ func WrapHandlerInBasicAuth(h http.Handler, b BasicAuth) http.HandlerFunc {
 	}
 }
 
+// WrapHandlerInClientCertificateCheck rejects requests which weren't made
+// with a verified TLS client certificate, for federations which require
+// mutual TLS.
+func WrapHandlerInClientCertificateCheck(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(jsonerror.Forbidden("A verified client certificate is required"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 // WrapHandlerInCORS adds CORS headers to all responses, including all error
 // responses.
 // Handles OPTIONS requests directly.
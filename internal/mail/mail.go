@@ -0,0 +1,82 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mail sends emails to users through an SMTP server.
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// A Sender sends plain text emails.
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPSender sends emails through the SMTP server in the config.
+type SMTPSender struct {
+	cfg *config.Email
+}
+
+// NewSMTPSender creates a sender for the given config, which must be enabled.
+func NewSMTPSender(cfg *config.Email) *SMTPSender {
+	return &SMTPSender{cfg: cfg}
+}
+
+// Send sends an email to a single address. STARTTLS is used if the SMTP
+// server supports it.
+func (s *SMTPSender) Send(to, subject, body string) error {
+	from, err := mail.ParseAddress(s.cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+
+	var auth smtp.Auth
+	if s.cfg.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(s.cfg.SMTPAddress)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.cfg.SMTPUsername, s.cfg.SMTPPassword, host)
+	}
+	msg := message(from, recipient, subject, body, time.Now())
+	return smtp.SendMail(s.cfg.SMTPAddress, auth, from.Address, []string{recipient.Address}, msg)
+}
+
+// message formats an email with the headers that mail servers expect.
+func message(from, to *mail.Address, subject, body string, date time.Time) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return msg.Bytes()
+}
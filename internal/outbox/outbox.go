@@ -0,0 +1,122 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package outbox produces Kafka messages which were stored in a database
+// in the same transaction as the writes which caused them. That way the
+// messages can't be lost if the server stops after the transaction commits
+// but before they have been produced.
+//
+// Only the roomserver's output events go through an outbox so far. The
+// eduserver has no database to share a transaction with, and the client API
+// produces account data for the sync API (clientapi/producers) after the user
+// API has stored it, so those messages are still lost if the server stops in
+// between, or if Kafka is unavailable.
+package outbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// How often the relay tries to produce messages which previously failed.
+const retryInterval = 10 * time.Second
+
+// The most messages which are produced in one go.
+const batchSize = 100
+
+// A Message is waiting in an outbox to be produced.
+type Message struct {
+	// Assigned by the database when the message is stored.
+	ID    int64
+	Topic string
+	Key   string
+	Value []byte
+}
+
+// Database is implemented by the databases of components with an outbox.
+type Database interface {
+	// SelectOutboxMessages returns up to limit messages, oldest first.
+	SelectOutboxMessages(ctx context.Context, limit int) ([]Message, error)
+	// DeleteOutboxMessages removes messages once they have been produced.
+	DeleteOutboxMessages(ctx context.Context, ids []int64) error
+}
+
+// A Relay produces the messages in an outbox, in the order that they were
+// stored. Messages may be produced more than once if the relay stops after
+// producing them but before removing them from the outbox.
+type Relay struct {
+	db       Database
+	producer sarama.SyncProducer
+	// Only one flush runs at a time, so that messages are produced in order.
+	mu sync.Mutex
+}
+
+// NewRelay creates a relay for the outbox in db.
+func NewRelay(db Database, producer sarama.SyncProducer) *Relay {
+	return &Relay{
+		db:       db,
+		producer: producer,
+	}
+}
+
+// Start produces any messages which were left in the outbox when the server
+// last stopped, and then keeps retrying any messages which fail to be
+// produced in the background.
+func (r *Relay) Start() {
+	go func() {
+		for {
+			if err := r.Flush(context.Background()); err != nil {
+				logrus.WithError(err).Warn("Failed to produce the messages in the outbox, will retry")
+			}
+			time.Sleep(retryInterval)
+		}
+	}()
+}
+
+// Flush produces all of the messages in the outbox. Components call this once
+// the transaction storing new messages has been committed. If it fails then
+// the messages are left in the outbox for the relay to retry.
+func (r *Relay) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		messages, err := r.db.SelectOutboxMessages(ctx, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		produce := make([]*sarama.ProducerMessage, len(messages))
+		ids := make([]int64, len(messages))
+		for i, msg := range messages {
+			produce[i] = &sarama.ProducerMessage{
+				Topic: msg.Topic,
+				Key:   sarama.StringEncoder(msg.Key),
+				Value: sarama.ByteEncoder(msg.Value),
+			}
+			ids[i] = msg.ID
+		}
+		if err = r.producer.SendMessages(produce); err != nil {
+			return err
+		}
+		if err = r.db.DeleteOutboxMessages(ctx, ids); err != nil {
+			return err
+		}
+	}
+}
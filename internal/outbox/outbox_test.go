@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbox
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+type memoryDatabase struct {
+	messages []Message
+}
+
+func (d *memoryDatabase) SelectOutboxMessages(ctx context.Context, limit int) ([]Message, error) {
+	if len(d.messages) < limit {
+		limit = len(d.messages)
+	}
+	return append([]Message(nil), d.messages[:limit]...), nil
+}
+
+func (d *memoryDatabase) DeleteOutboxMessages(ctx context.Context, ids []int64) error {
+	deleted := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	var kept []Message
+	for _, msg := range d.messages {
+		if !deleted[msg.ID] {
+			kept = append(kept, msg)
+		}
+	}
+	d.messages = kept
+	return nil
+}
+
+type memoryProducer struct {
+	sarama.SyncProducer
+	fail     bool
+	produced []string
+}
+
+func (p *memoryProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	if p.fail {
+		return errors.New("kafka is down")
+	}
+	for _, msg := range msgs {
+		value, _ := msg.Value.Encode()
+		p.produced = append(p.produced, string(value))
+	}
+	return nil
+}
+
+func TestRelayFlush(t *testing.T) {
+	ctx := context.Background()
+	db := &memoryDatabase{}
+	var want []string
+	for i := 0; i < batchSize+5; i++ {
+		value := strconv.Itoa(i)
+		db.messages = append(db.messages, Message{ID: int64(i + 1), Topic: "topic", Key: "key", Value: []byte(value)})
+		want = append(want, value)
+	}
+	producer := &memoryProducer{fail: true}
+	relay := NewRelay(db, producer)
+
+	if err := relay.Flush(ctx); err == nil {
+		t.Fatalf("expected Flush to fail when the producer fails")
+	}
+	if len(db.messages) != len(want) {
+		t.Fatalf("messages which failed to be produced were removed from the outbox")
+	}
+
+	producer.fail = false
+	if err := relay.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %s", err)
+	}
+	if len(db.messages) != 0 {
+		t.Fatalf("expected the outbox to be empty, %d messages are left", len(db.messages))
+	}
+	if len(producer.produced) != len(want) {
+		t.Fatalf("got %d messages produced, want %d", len(producer.produced), len(want))
+	}
+	for i := range want {
+		if producer.produced[i] != want[i] {
+			t.Fatalf("message %d was produced out of order", i)
+		}
+	}
+}
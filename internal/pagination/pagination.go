@@ -0,0 +1,153 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pagination provides short-lived server-side storage for the state of
+// paginated requests, such as walking a space hierarchy, which can't be
+// encoded into the pagination token itself.
+package pagination
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// DefaultSessionLifetime is the default time after which a pagination session expires.
+const DefaultSessionLifetime time.Duration = 5 * time.Minute
+
+// tokenByteLength is the number of random bytes in a pagination token.
+const tokenByteLength = 16
+
+// Session is the server-side state behind a pagination token.
+type Session struct {
+	// UserID is the user who made the request. Tokens can't be used by anyone else.
+	UserID string
+	// Params identifies the request parameters, e.g. the room ID and filters.
+	// Tokens can only be used to continue a request with the same parameters.
+	Params string
+	// State is the caller's iteration state, such as the rooms still to visit.
+	State interface{}
+}
+
+type sessionEntry struct {
+	session Session
+	expires time.Time
+}
+
+// Store holds pagination sessions keyed by their token.
+// Sessions are evicted once they are older than the lifetime of the store.
+type Store struct {
+	sync.Mutex
+	sessions map[string]sessionEntry
+	lifetime time.Duration
+	now      func() time.Time
+	// stopped is closed once expired sessions are no longer being removed.
+	stopped chan struct{}
+}
+
+// New is a wrapper which calls NewWithLifetime with DefaultSessionLifetime as argument.
+func New(ctx context.Context) *Store {
+	return NewWithLifetime(ctx, DefaultSessionLifetime)
+}
+
+// NewWithLifetime creates a new Store whose sessions expire after the given
+// lifetime, and starts a goroutine to remove expired sessions until the
+// context is done. The context should last as long as the store is in use,
+// e.g. the request context for a store which only one request uses.
+func NewWithLifetime(ctx context.Context, lifetime time.Duration) *Store {
+	s := &Store{
+		sessions: make(map[string]sessionEntry),
+		lifetime: lifetime,
+		now:      time.Now,
+		stopped:  make(chan struct{}),
+	}
+	go storeCleanService(ctx, s)
+	return s
+}
+
+// Create stores the session and returns a new token which refers to it.
+func (s *Store) Create(session Session) (string, error) {
+	b := make([]byte, tokenByteLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	s.Lock()
+	defer s.Unlock()
+	s.sessions[token] = sessionEntry{
+		session: session,
+		expires: s.now().Add(s.lifetime),
+	}
+	return token, nil
+}
+
+// Fetch looks up the session for the token. The returned bool is false if the
+// token is unknown, has expired, or was issued for a different user or
+// different request parameters. Sessions are not removed when they are
+// fetched, so that a client can safely retry a request.
+func (s *Store) Fetch(token, userID, params string) (*Session, bool) {
+	s.Lock()
+	defer s.Unlock()
+	entry, ok := s.sessions[token]
+	if !ok {
+		return nil, false
+	}
+	if !s.now().Before(entry.expires) {
+		delete(s.sessions, token)
+		return nil, false
+	}
+	if entry.session.UserID != userID || entry.session.Params != params {
+		return nil, false
+	}
+	return &entry.session, true
+}
+
+// Delete removes the session for the token, if there is one.
+func (s *Store) Delete(token string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, token)
+}
+
+// removeExpired removes all sessions which have expired.
+func (s *Store) removeExpired() {
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	for token, entry := range s.sessions {
+		if !now.Before(entry.expires) {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// storeCleanService is responsible for removing sessions once they have expired,
+// so that abandoned pagination doesn't hold on to memory. It returns when the
+// context is done.
+func storeCleanService(ctx context.Context, s *Store) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.lifetime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.removeExpired()
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pagination
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	fakeUserID  = "@alice:localhost"
+	fakeUserID2 = "@bob:localhost"
+	fakeParams  = "!space:localhost"
+)
+
+// fakeClock lets tests control when sessions expire.
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestStore(lifetime time.Duration) (*Store, *fakeClock, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	s := NewWithLifetime(ctx, lifetime)
+	s.Lock()
+	s.now = clock.now
+	s.Unlock()
+	return s, clock, cancel
+}
+
+// TestStore creates a session and checks that only the same user with the same parameters can fetch it
+func TestStore(t *testing.T) {
+	s, _, cancel := newTestStore(time.Hour)
+	defer cancel()
+	token, err := s.Create(Session{UserID: fakeUserID, Params: fakeParams, State: []string{"!a:localhost"}})
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+
+	session, ok := s.Fetch(token, fakeUserID, fakeParams)
+	if !ok {
+		t.Fatalf("Failed to fetch session for token %q", token)
+	}
+	if rooms, _ := session.State.([]string); len(rooms) != 1 || rooms[0] != "!a:localhost" {
+		t.Errorf("Fetched session has the wrong state: %v", session.State)
+	}
+	// sessions should survive being fetched so that requests can be retried
+	if _, ok = s.Fetch(token, fakeUserID, fakeParams); !ok {
+		t.Errorf("Session was removed after being fetched")
+	}
+
+	if _, ok = s.Fetch(token, fakeUserID2, fakeParams); ok {
+		t.Errorf("Session was returned for a different user")
+	}
+	if _, ok = s.Fetch(token, fakeUserID, "!other:localhost"); ok {
+		t.Errorf("Session was returned for different parameters")
+	}
+	if _, ok = s.Fetch("notAToken", fakeUserID, fakeParams); ok {
+		t.Errorf("Session was returned for an unknown token")
+	}
+
+	s.Delete(token)
+	if _, ok = s.Fetch(token, fakeUserID, fakeParams); ok {
+		t.Errorf("Session was returned after being deleted")
+	}
+}
+
+// TestStoreExpiry checks that sessions can't be fetched once they have expired
+func TestStoreExpiry(t *testing.T) {
+	s, clock, cancel := newTestStore(time.Hour)
+	defer cancel()
+	token, err := s.Create(Session{UserID: fakeUserID, Params: fakeParams})
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	token2, err := s.Create(Session{UserID: fakeUserID, Params: fakeParams})
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if token == token2 {
+		t.Fatalf("Create returned the same token twice")
+	}
+
+	clock.advance(59 * time.Minute)
+	if _, ok := s.Fetch(token, fakeUserID, fakeParams); !ok {
+		t.Fatalf("Session expired too early")
+	}
+
+	clock.advance(time.Minute)
+	if _, ok := s.Fetch(token, fakeUserID, fakeParams); ok {
+		t.Errorf("Session was returned after it expired")
+	}
+
+	s.removeExpired()
+	s.Lock()
+	remaining := len(s.sessions)
+	s.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected expired sessions to be removed, %d remain", remaining)
+	}
+}
+
+// TestStoreStops checks that expired sessions stop being removed once the context is done
+func TestStoreStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewWithLifetime(ctx, time.Hour)
+	cancel()
+	select {
+	case <-s.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Store kept removing expired sessions after the context was done")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushgateway implements the client side of the push gateway API,
+// which homeservers use to send notifications to push gateways.
+// https://matrix.org/docs/spec/push_gateway/r0.1.1
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// NotifyPath is the path of the push gateway endpoint that notifications are sent to.
+const NotifyPath = "/_matrix/push/v1/notify"
+
+// NotifyRequest is the body of a request to the notify endpoint.
+type NotifyRequest struct {
+	Notification Notification `json:"notification"`
+}
+
+// NotifyResponse is the body of a response from the notify endpoint.
+type NotifyResponse struct {
+	// The push keys which the push gateway no longer accepts notifications
+	// for. The homeserver should remove the pushers with these push keys.
+	Rejected []string `json:"rejected"`
+}
+
+// Notification is a notification of an event for one or more devices.
+type Notification struct {
+	EventID           string          `json:"event_id,omitempty"`
+	RoomID            string          `json:"room_id,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	RoomAlias         string          `json:"room_alias,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+	Prio              Prio            `json:"prio,omitempty"`
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            *Counts         `json:"counts,omitempty"`
+	Devices           []*Device       `json:"devices"`
+}
+
+// Prio is the priority of a notification.
+type Prio string
+
+const (
+	HighPrio Prio = "high"
+	LowPrio  Prio = "low"
+)
+
+// Counts are the unread counts of the user being notified.
+type Counts struct {
+	Unread      int `json:"unread"`
+	MissedCalls int `json:"missed_calls,omitempty"`
+}
+
+// Device is a device which a notification is for, identified by the app
+// ID and push key of its pusher.
+type Device struct {
+	AppID   string                 `json:"app_id"`
+	PushKey string                 `json:"pushkey"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+	Tweaks  map[string]interface{} `json:"tweaks,omitempty"`
+}
+
+// HTTPError is returned by Notify when the push gateway responds with a
+// status other than 200 OK.
+type HTTPError struct {
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("push gateway responded with HTTP %d", e.StatusCode)
+}
+
+// Temporary returns whether the request might succeed if it is retried.
+// Push gateways which are overloaded or broken can recover, but a request
+// which it can't handle will never be accepted.
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// A Client sends notifications to push gateways.
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient creates a client which gives up on requests to push gateways
+// after the given timeout.
+func NewClient(timeout time.Duration) *Client {
+	return &Client{
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Notify sends a notification to the notify endpoint at the given URL.
+// Returns an *HTTPError if the push gateway doesn't accept it. A response
+// which can't be read doesn't count as an error, since the push gateway
+// has still accepted the notification and sending it again would only
+// notify the user twice.
+func (c *Client) Notify(ctx context.Context, url string, req *NotifyRequest, res *NotifyResponse) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpRes, err := c.httpClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close() // nolint: errcheck
+	if httpRes.StatusCode != http.StatusOK {
+		// Reading the body lets the connection be reused for the retry.
+		_, _ = io.Copy(ioutil.Discard, httpRes.Body)
+		return &HTTPError{StatusCode: httpRes.StatusCode}
+	}
+	if err = json.NewDecoder(httpRes.Body).Decode(res); err != nil {
+		*res = NotifyResponse{}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	var got NotifyRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != NotifyPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"rejected":["bad_key"]}`))
+	}))
+	defer srv.Close()
+
+	client := NewClient(time.Second * 5)
+	req := &NotifyRequest{Notification: Notification{
+		EventID: "$event:localhost",
+		Counts:  &Counts{Unread: 2},
+		Devices: []*Device{{AppID: "app", PushKey: "bad_key"}},
+	}}
+	var res NotifyResponse
+	if err := client.Notify(context.Background(), srv.URL+NotifyPath, req, &res); err != nil {
+		t.Fatalf("Notify failed: %s", err)
+	}
+	if got.Notification.EventID != "$event:localhost" || got.Notification.Counts.Unread != 2 {
+		t.Errorf("push gateway got the wrong notification: %+v", got.Notification)
+	}
+	if len(res.Rejected) != 1 || res.Rejected[0] != "bad_key" {
+		t.Errorf("wrong rejected push keys: %v", res.Rejected)
+	}
+
+	err := client.Notify(context.Background(), srv.URL+"/wrong", req, &res)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected HTTP 404 error, got %v", err)
+	}
+	if httpErr.Temporary() {
+		t.Errorf("HTTP 404 should not be temporary")
+	}
+	if !(&HTTPError{StatusCode: http.StatusBadGateway}).Temporary() {
+		t.Errorf("HTTP 502 should be temporary")
+	}
+}
@@ -0,0 +1,490 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultAccountRuleSets is the complete set of default push rules
+// for an account.
+func DefaultAccountRuleSets(localpart string, serverName gomatrixserverlib.ServerName) *AccountRuleSets {
+	return &AccountRuleSets{
+		Global: *DefaultGlobalRuleSet(localpart, serverName),
+	}
+}
+
+// AccountRuleSetsFromAccountData parses the m.push_rules account data
+// of an account, which may be nil if the account has none, and merges
+// it with the current server-default rules. Within each kind the master
+// rule comes first, then the rules of the account, then the rest of the
+// server-default rules with any changes which the account has made to
+// them. Changes to server-default rules which no longer exist are
+// dropped.
+func AccountRuleSetsFromAccountData(
+	data json.RawMessage, localpart string, serverName gomatrixserverlib.ServerName,
+) (*AccountRuleSets, error) {
+	var stored AccountRuleSets
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, err
+		}
+	}
+	defaults := DefaultGlobalRuleSet(localpart, serverName)
+	ruleSets := &AccountRuleSets{}
+	for _, kar := range stored.Global.KindOrder() {
+		*ruleSets.Global.ForKind(kar.Kind) = mergeDefaultRules(kar.Rules, *defaults.ForKind(kar.Kind))
+	}
+	return ruleSets, nil
+}
+
+// AccountDataFromAccountRuleSets returns the m.push_rules account data to
+// store for the rule sets of an account. Only the rules of the account are
+// stored in full. Server-default rules are only stored if they have been
+// enabled, disabled or given other actions, and then only those changes,
+// so that the account picks up any later changes to the server-default
+// rules when they are read with AccountRuleSetsFromAccountData.
+func AccountDataFromAccountRuleSets(
+	ruleSets *AccountRuleSets, localpart string, serverName gomatrixserverlib.ServerName,
+) (json.RawMessage, error) {
+	defaults := DefaultGlobalRuleSet(localpart, serverName)
+	var stored AccountRuleSets
+	for _, kar := range ruleSets.Global.KindOrder() {
+		defaultRules := map[string]*Rule{}
+		for _, rule := range *defaults.ForKind(kar.Kind) {
+			defaultRules[rule.RuleID] = rule
+		}
+		var rules []*Rule
+		for _, rule := range kar.Rules {
+			if !rule.Default {
+				rules = append(rules, rule)
+				continue
+			}
+			def, ok := defaultRules[rule.RuleID]
+			if !ok {
+				continue
+			}
+			changed, err := defaultRuleChanged(rule, def)
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				rules = append(rules, &Rule{
+					RuleID:  rule.RuleID,
+					Default: true,
+					Enabled: rule.Enabled,
+					Actions: rule.Actions,
+				})
+			}
+		}
+		*stored.Global.ForKind(kar.Kind) = rules
+	}
+	return json.Marshal(&stored)
+}
+
+// mergeDefaultRules returns the stored rules of one kind merged with the
+// server-default rules of that kind. The server-default rules are shared,
+// so the changes are made to copies of them.
+func mergeDefaultRules(stored, defaults []*Rule) []*Rule {
+	changes := map[string]*Rule{}
+	var rules []*Rule
+	for _, rule := range stored {
+		switch {
+		case rule == nil:
+		case rule.Default:
+			changes[rule.RuleID] = rule
+		default:
+			rules = append(rules, rule)
+		}
+	}
+	merged := make([]*Rule, 0, len(rules)+len(defaults))
+	for i, def := range defaults {
+		if i == 0 && def.RuleID != MRuleMaster {
+			merged = append(merged, rules...)
+		}
+		rule := def
+		if change, ok := changes[def.RuleID]; ok {
+			copied := *def
+			copied.Enabled = change.Enabled
+			if change.Actions != nil {
+				copied.Actions = change.Actions
+			}
+			rule = &copied
+		}
+		merged = append(merged, rule)
+		if i == 0 && def.RuleID == MRuleMaster {
+			merged = append(merged, rules...)
+		}
+	}
+	if len(defaults) == 0 {
+		merged = append(merged, rules...)
+	}
+	return merged
+}
+
+// defaultRuleChanged returns whether the rule has been enabled, disabled or
+// given other actions than the server-default rule.
+func defaultRuleChanged(rule, def *Rule) (bool, error) {
+	if rule.Enabled != def.Enabled {
+		return true, nil
+	}
+	actions, err := json.Marshal(rule.Actions)
+	if err != nil {
+		return false, err
+	}
+	defActions, err := json.Marshal(def.Actions)
+	if err != nil {
+		return false, err
+	}
+	return string(actions) != string(defActions), nil
+}
+
+// DefaultGlobalRuleSet returns the default ruleset for a given (fully
+// qualified) MXID. The rules themselves are shared and mustn't be changed,
+// but the slices of them are the caller's own.
+func DefaultGlobalRuleSet(localpart string, serverName gomatrixserverlib.ServerName) *RuleSet {
+	return &RuleSet{
+		Override:  defaultOverrideRules("@" + localpart + ":" + string(serverName)),
+		Content:   defaultContentRules(localpart),
+		Underride: append([]*Rule(nil), defaultUnderrideRules...),
+	}
+}
+
+const (
+	MRuleMaster                = ".m.rule.master"
+	MRuleSuppressNotices       = ".m.rule.suppress_notices"
+	MRuleInviteForMe           = ".m.rule.invite_for_me"
+	MRuleMemberEvent           = ".m.rule.member_event"
+	MRuleContainsDisplayName   = ".m.rule.contains_display_name"
+	MRuleTombstone             = ".m.rule.tombstone"
+	MRuleRoomNotif             = ".m.rule.roomnotif"
+	MRuleContainsUserName      = ".m.rule.contains_user_name"
+	MRuleCall                  = ".m.rule.call"
+	MRuleEncryptedRoomOneToOne = ".m.rule.encrypted_room_one_to_one"
+	MRuleRoomOneToOne          = ".m.rule.room_one_to_one"
+	MRuleMessage               = ".m.rule.message"
+	MRuleEncrypted             = ".m.rule.encrypted"
+)
+
+func defaultOverrideRules(userID string) []*Rule {
+	return []*Rule{
+		&mRuleMasterDefinition,
+		&mRuleSuppressNoticesDefinition,
+		mRuleInviteForMeDefinition(userID),
+		&mRuleMemberEventDefinition,
+		&mRuleContainsDisplayNameDefinition,
+		&mRuleTombstoneDefinition,
+		&mRuleRoomNotifDefinition,
+	}
+}
+
+func defaultContentRules(localpart string) []*Rule {
+	return []*Rule{
+		mRuleContainsUserNameDefinition(localpart),
+	}
+}
+
+var defaultUnderrideRules = []*Rule{
+	&mRuleCallDefinition,
+	&mRuleEncryptedRoomOneToOneDefinition,
+	&mRuleRoomOneToOneDefinition,
+	&mRuleMessageDefinition,
+	&mRuleEncryptedDefinition,
+}
+
+var (
+	mRuleMasterDefinition = Rule{
+		RuleID:     MRuleMaster,
+		Default:    true,
+		Enabled:    false,
+		Conditions: []*Condition{},
+		Actions:    []*Action{{Kind: DontNotifyAction}},
+	}
+	mRuleSuppressNoticesDefinition = Rule{
+		RuleID:  MRuleSuppressNotices,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "content.msgtype",
+				Pattern: "m.notice",
+			},
+		},
+		Actions: []*Action{{Kind: DontNotifyAction}},
+	}
+	mRuleMemberEventDefinition = Rule{
+		RuleID:  MRuleMemberEvent,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.member",
+			},
+		},
+		Actions: []*Action{{Kind: DontNotifyAction}},
+	}
+	mRuleContainsDisplayNameDefinition = Rule{
+		RuleID:     MRuleContainsDisplayName,
+		Default:    true,
+		Enabled:    true,
+		Conditions: []*Condition{{Kind: ContainsDisplayNameCondition}},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+	mRuleTombstoneDefinition = Rule{
+		RuleID:  MRuleTombstone,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.tombstone",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "state_key",
+				Pattern: "",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+	mRuleRoomNotifDefinition = Rule{
+		RuleID:  MRuleRoomNotif,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "content.body",
+				Pattern: "@room",
+			},
+			{
+				Kind: SenderNotificationPermissionCondition,
+				Key:  "room",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+	mRuleCallDefinition = Rule{
+		RuleID:  MRuleCall,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.call.invite",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "ring",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+	mRuleEncryptedRoomOneToOneDefinition = Rule{
+		RuleID:  MRuleEncryptedRoomOneToOne,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind: RoomMemberCountCondition,
+				Is:   "2",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.encrypted",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+	mRuleRoomOneToOneDefinition = Rule{
+		RuleID:  MRuleRoomOneToOne,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind: RoomMemberCountCondition,
+				Is:   "2",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.message",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+	mRuleMessageDefinition = Rule{
+		RuleID:  MRuleMessage,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.message",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+	mRuleEncryptedDefinition = Rule{
+		RuleID:  MRuleEncrypted,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.encrypted",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+)
+
+func mRuleInviteForMeDefinition(userID string) *Rule {
+	return &Rule{
+		RuleID:  MRuleInviteForMe,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: "m.room.member",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "content.membership",
+				Pattern: "invite",
+			},
+			{
+				Kind:    EventMatchCondition,
+				Key:     "state_key",
+				Pattern: userID,
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+				Value: false,
+			},
+		},
+	}
+}
+
+func mRuleContainsUserNameDefinition(localpart string) *Rule {
+	return &Rule{
+		RuleID:  MRuleContainsUserName,
+		Default: true,
+		Enabled: true,
+		Pattern: localpart,
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+}
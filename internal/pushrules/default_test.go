@@ -0,0 +1,161 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAccountRuleSetsFromAccountData(t *testing.T) {
+	ruleSets, err := AccountRuleSetsFromAccountData(nil, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("AccountRuleSetsFromAccountData failed: %s", err)
+	}
+	if len(ruleSets.Global.Override) == 0 || len(ruleSets.Global.Underride) == 0 {
+		t.Fatalf("expected the default rules with no account data, got %+v", ruleSets.Global)
+	}
+
+	// The stored rules are merged with the defaults, which are kept for
+	// every kind.
+	data := json.RawMessage(`{"global":{"sender":[{"rule_id":"@bob:example.com","enabled":true,"actions":["dont_notify"]}]}}`)
+	ruleSets, err = AccountRuleSetsFromAccountData(data, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("AccountRuleSetsFromAccountData failed: %s", err)
+	}
+	sender := ruleSets.Global.ForKind(SenderKind)
+	if sender == nil || len(*sender) != 1 || (*sender)[0].RuleID != "@bob:example.com" {
+		t.Errorf("got sender rules %+v, want the stored rule", sender)
+	}
+	if len(ruleSets.Global.Override) == 0 {
+		t.Errorf("expected the default override rules to be kept")
+	}
+
+	if ruleSets.Global.ForKind(Kind("unknown")) != nil {
+		t.Errorf("ForKind should return nil for an unknown kind")
+	}
+}
+
+func TestAccountDataFromAccountRuleSets(t *testing.T) {
+	ruleSets := DefaultAccountRuleSets("alice", "example.com")
+	global := &ruleSets.Global
+	// The server-default rules are shared, so they're changed in copies.
+	suppressNotices := *global.Override[1]
+	suppressNotices.Enabled = false
+	global.Override[1] = &suppressNotices
+	message := *global.Underride[len(global.Underride)-2]
+	message.Actions = []*Action{{Kind: DontNotifyAction}}
+	global.Underride[len(global.Underride)-2] = &message
+	global.Override = append(global.Override[:1:1], append([]*Rule{{
+		RuleID:  "a",
+		Enabled: true,
+		Actions: []*Action{{Kind: NotifyAction}},
+	}}, global.Override[1:]...)...)
+	global.Sender = []*Rule{{RuleID: "@bob:example.com", Enabled: true, Actions: []*Action{{Kind: DontNotifyAction}}}}
+
+	data, err := AccountDataFromAccountRuleSets(ruleSets, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("AccountDataFromAccountRuleSets failed: %s", err)
+	}
+
+	// Only the account's own rules and the changed server-default rules are
+	// stored, and the server-default rules without their conditions.
+	var stored AccountRuleSets
+	if err = json.Unmarshal(data, &stored); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	gotIDs := func(rules []*Rule) string {
+		var ruleIDs []string
+		for _, rule := range rules {
+			ruleIDs = append(ruleIDs, rule.RuleID)
+		}
+		return strings.Join(ruleIDs, ",")
+	}
+	if got, want := gotIDs(stored.Global.Override), "a,"+MRuleSuppressNotices; got != want {
+		t.Errorf("got stored override rules %s, want %s", got, want)
+	}
+	if got, want := gotIDs(stored.Global.Underride), MRuleMessage; got != want {
+		t.Errorf("got stored underride rules %s, want %s", got, want)
+	}
+	if len(stored.Global.Content) != 0 || len(stored.Global.Override) < 2 || stored.Global.Override[1].Conditions != nil {
+		t.Errorf("got stored rules %s, want only the changes to the server-default rules", data)
+	}
+
+	// Reading the rules back gives the same rules as were stored.
+	read, err := AccountRuleSetsFromAccountData(data, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("AccountRuleSetsFromAccountData failed: %s", err)
+	}
+	want, err := json.Marshal(ruleSets)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	got, err := json.Marshal(read)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got rules read back\n%s\nwant\n%s", got, want)
+	}
+
+	// The complete rules which used to be stored are read back the same.
+	if read, err = AccountRuleSetsFromAccountData(want, "alice", "example.com"); err != nil {
+		t.Fatalf("AccountRuleSetsFromAccountData failed: %s", err)
+	}
+	if got, err = json.Marshal(read); err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got complete rules read back\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAccountRuleSetsFromAccountDataMergesDefaults(t *testing.T) {
+	// The conditions of the server-default rules always come from the
+	// server, and changes to rules which the server no longer has are
+	// dropped.
+	data := json.RawMessage(`{"global":{"override":[
+		{"rule_id":"` + MRuleMaster + `","default":true,"enabled":true,"actions":["dont_notify"]},
+		{"rule_id":"` + MRuleTombstone + `","default":true,"enabled":false,"actions":["notify"],"conditions":[]},
+		{"rule_id":".m.rule.gone","default":true,"enabled":true,"actions":["notify"]},
+		{"rule_id":"a","enabled":true,"actions":["notify"]}
+	]}}`)
+	ruleSets, err := AccountRuleSetsFromAccountData(data, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("AccountRuleSetsFromAccountData failed: %s", err)
+	}
+	defaults := DefaultGlobalRuleSet("alice", "example.com")
+	override := ruleSets.Global.Override
+	if len(override) != len(defaults.Override)+1 {
+		t.Fatalf("got %d override rules, want the %d defaults and one more", len(override), len(defaults.Override))
+	}
+	if override[0].RuleID != MRuleMaster || !override[0].Enabled || override[1].RuleID != "a" {
+		t.Errorf("got override rules starting with %s and %s, want the enabled master rule and then a", override[0].RuleID, override[1].RuleID)
+	}
+	for _, rule := range override {
+		if rule.RuleID == ".m.rule.gone" {
+			t.Errorf("got a change to a server-default rule which doesn't exist")
+		}
+		if rule.RuleID == MRuleTombstone && (rule.Enabled || len(rule.Conditions) == 0) {
+			t.Errorf("got tombstone rule %+v, want it disabled with the server's conditions", rule)
+		}
+	}
+
+	// The server-default rules themselves are left alone.
+	if defaults.Override[0].Enabled {
+		t.Errorf("got the server-default master rule enabled")
+	}
+}
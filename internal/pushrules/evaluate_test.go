@@ -0,0 +1,129 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeEvaluationContext struct {
+	displayName string
+	memberCount int
+}
+
+func (fakeEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) { return true, nil }
+func (c fakeEvaluationContext) RoomMemberCount() (int, error)                     { return c.memberCount, nil }
+func (c fakeEvaluationContext) UserDisplayName() string                           { return c.displayName }
+
+func mustEventFromJSON(t *testing.T, json string) *gomatrixserverlib.Event {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(json), false, gomatrixserverlib.RoomVersionV5)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON failed: %s", err)
+	}
+	return &ev
+}
+
+func TestDefaultRuleSetEvaluation(t *testing.T) {
+	tsts := []struct {
+		Name        string
+		EventJSON   string
+		MemberCount int
+		WantRuleID  string
+		WantKind    ActionKind
+		WantHighlit bool
+	}{
+		{"message", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"hello"}}`, 3, MRuleMessage, NotifyAction, false},
+		{"oneToOne", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"hello"}}`, 2, MRuleRoomOneToOne, NotifyAction, false},
+		{"notice", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"msgtype":"m.notice","body":"hello"}}`, 3, MRuleSuppressNotices, DontNotifyAction, false},
+		{"displayName", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"hi Alice Smith!"}}`, 3, MRuleContainsDisplayName, NotifyAction, true},
+		{"userName", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"ping alice"}}`, 3, MRuleContainsUserName, NotifyAction, true},
+		{"notUserNameSubstring", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"malice"}}`, 3, MRuleMessage, NotifyAction, false},
+		{"roomNotif", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"@room: look"}}`, 3, MRuleRoomNotif, NotifyAction, true},
+		{"member", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.member","state_key":"@bob:b","content":{"membership":"join"}}`, 3, MRuleMemberEvent, DontNotifyAction, false},
+		{"noMatch", `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.reaction","content":{}}`, 3, "", UnknownAction, false},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			rse := NewRuleSetEvaluator(fakeEvaluationContext{"Alice Smith", tst.MemberCount}, DefaultGlobalRuleSet("alice", "b"))
+			rule, err := rse.MatchEvent(mustEventFromJSON(t, tst.EventJSON))
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %v", err)
+			}
+			if rule == nil {
+				if tst.WantRuleID != "" {
+					t.Fatalf("MatchEvent: got no rule, want %q", tst.WantRuleID)
+				}
+				return
+			}
+			if rule.RuleID != tst.WantRuleID {
+				t.Fatalf("MatchEvent rule: got %q, want %q", rule.RuleID, tst.WantRuleID)
+			}
+			kind, tweaks, err := ActionsToTweaks(rule.Actions)
+			if err != nil {
+				t.Fatalf("ActionsToTweaks failed: %v", err)
+			}
+			if kind != tst.WantKind {
+				t.Errorf("action kind: got %q, want %q", kind, tst.WantKind)
+			}
+			if got := BoolTweakOr(tweaks, HighlightTweak, false); got != tst.WantHighlit {
+				t.Errorf("highlight: got %v, want %v", got, tst.WantHighlit)
+			}
+		})
+	}
+}
+
+func TestActionJSONRoundTrip(t *testing.T) {
+	as := mRuleContainsUserNameDefinition("alice").Actions
+	for _, a := range as {
+		bs, err := a.MarshalJSON()
+		if err != nil {
+			t.Fatalf("MarshalJSON failed: %v", err)
+		}
+		var got Action
+		if err = got.UnmarshalJSON(bs); err != nil {
+			t.Fatalf("UnmarshalJSON(%s) failed: %v", string(bs), err)
+		}
+		if got.Kind != a.Kind || got.Tweak != a.Tweak || got.Value != a.Value {
+			t.Errorf("round trip of %s: got %+v, want %+v", string(bs), got, *a)
+		}
+	}
+}
+
+func TestMasterRuleEvaluatedFirst(t *testing.T) {
+	ruleSet := DefaultGlobalRuleSet("alice", "b")
+	master := *ruleSet.Override[0]
+	master.Enabled = true
+	ruleSet.Override = append([]*Rule{
+		{
+			RuleID:     "mine",
+			Enabled:    true,
+			Conditions: []*Condition{},
+			Actions:    []*Action{{Kind: NotifyAction}},
+		},
+		&master,
+	}, ruleSet.Override[1:]...)
+
+	rse := NewRuleSetEvaluator(fakeEvaluationContext{"Alice Smith", 3}, ruleSet)
+	rule, err := rse.MatchEvent(mustEventFromJSON(t, `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"hello"}}`))
+	if err != nil {
+		t.Fatalf("MatchEvent failed: %v", err)
+	}
+	if rule == nil || rule.RuleID != MRuleMaster {
+		t.Fatalf("MatchEvent: got %+v, want the enabled master rule", rule)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushrules implements the push rules described in
+// https://matrix.org/docs/spec/client_server/r0.6.1#push-rules,
+// including the default rules which every account starts with and
+// an evaluator which works out which actions apply to an event.
+package pushrules
+
+// AccountRuleSets is the structure of the m.push_rules account data
+// and of the body returned by GET /pushrules.
+type AccountRuleSets struct {
+	Global RuleSet `json:"global"` // Required
+}
+
+// RuleSet contains all the various push rules for an account, in
+// the order that they are evaluated.
+type RuleSet struct {
+	Override  []*Rule `json:"override,omitempty"`
+	Content   []*Rule `json:"content,omitempty"`
+	Room      []*Rule `json:"room,omitempty"`
+	Sender    []*Rule `json:"sender,omitempty"`
+	Underride []*Rule `json:"underride,omitempty"`
+}
+
+// ForKind returns a pointer to the rules of the given kind, so that
+// they can be changed in place, or nil if the kind isn't known.
+func (rs *RuleSet) ForKind(kind Kind) *[]*Rule {
+	switch kind {
+	case OverrideKind:
+		return &rs.Override
+	case ContentKind:
+		return &rs.Content
+	case RoomKind:
+		return &rs.Room
+	case SenderKind:
+		return &rs.Sender
+	case UnderrideKind:
+		return &rs.Underride
+	default:
+		return nil
+	}
+}
+
+// KindAndRules pairs a rule kind with the rules of that kind, so
+// that callers can walk the rule set in evaluation order.
+type KindAndRules struct {
+	Kind  Kind
+	Rules []*Rule
+}
+
+// KindOrder returns the kinds of the rule set in the order that the
+// spec says they should be evaluated.
+func (rs *RuleSet) KindOrder() []KindAndRules {
+	return []KindAndRules{
+		{OverrideKind, rs.Override},
+		{ContentKind, rs.Content},
+		{RoomKind, rs.Room},
+		{SenderKind, rs.Sender},
+		{UnderrideKind, rs.Underride},
+	}
+}
+
+// Kind is the type of a push rule. Rules of different kinds are
+// evaluated in a fixed order and have different shapes.
+type Kind string
+
+const (
+	UnknownKind   Kind = ""
+	OverrideKind  Kind = "override"
+	ContentKind   Kind = "content"
+	RoomKind      Kind = "room"
+	SenderKind    Kind = "sender"
+	UnderrideKind Kind = "underride"
+)
+
+// Rule contains the matching conditions and the actions to take
+// when an event matches.
+type Rule struct {
+	// RuleID is either a server-defined ID, beginning with a period,
+	// or a client-defined ID. Room and sender rules use the room or
+	// user ID respectively.
+	RuleID string `json:"rule_id"` // Required
+
+	// Default is true if this is a server-defined rule.
+	Default bool `json:"default"` // Required
+
+	// Enabled allows the user to disable rules while keeping them
+	// around.
+	Enabled bool `json:"enabled"` // Required
+
+	// Actions describe the desired outcome, should the rule match.
+	Actions []*Action `json:"actions"` // Required
+
+	// Conditions provide the rule's conditions for OverrideKind and
+	// UnderrideKind. Not allowed for other kinds.
+	Conditions []*Condition `json:"conditions,omitempty"`
+
+	// Pattern is the body pattern to match for ContentKind. Required
+	// for that kind. The interpretation is the same as that of
+	// Condition.Pattern.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Scope only has one valid value. See also AccountRuleSets.
+const GlobalScope = "global"
@@ -0,0 +1,124 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import "fmt"
+
+// RoomNotificationMode is the simplified notification setting for a single
+// room which most clients offer. Each mode is stored as ordinary push rules
+// with the room ID as their rule ID, in the same way as those clients do, so
+// that the rules can be changed through either API.
+type RoomNotificationMode string
+
+const (
+	// RoomNotifyAll leaves the room to the account's other rules.
+	RoomNotifyAll RoomNotificationMode = "all"
+
+	// RoomNotifyMentions is stored as a room rule which doesn't
+	// notify, so that only the override and content rules, which
+	// include mentions of the user, notify for the room.
+	RoomNotifyMentions RoomNotificationMode = "mentions"
+
+	// RoomNotifyMute is stored as an override rule matching the room
+	// which doesn't notify, so that nothing in the room notifies.
+	RoomNotifyMute RoomNotificationMode = "mute"
+)
+
+// RoomNotificationMode returns the notification mode of the given room.
+// Rules for the room which don't correspond to a mode are treated as
+// RoomNotifyAll.
+func (rs *RuleSet) RoomNotificationMode(roomID string) RoomNotificationMode {
+	for _, rule := range rs.Override {
+		if isRoomMuteRule(rule, roomID) {
+			return RoomNotifyMute
+		}
+	}
+	for _, rule := range rs.Room {
+		if rule.RuleID == roomID && rule.Enabled && isDontNotify(rule.Actions) {
+			return RoomNotifyMentions
+		}
+	}
+	return RoomNotifyAll
+}
+
+// SetRoomNotificationMode replaces the rules for the given room with the
+// ones for the mode. The override rule for muting is placed before the
+// account's other override rules.
+func (rs *RuleSet) SetRoomNotificationMode(roomID string, mode RoomNotificationMode) error {
+	switch mode {
+	case RoomNotifyAll, RoomNotifyMentions, RoomNotifyMute:
+	default:
+		return fmt.Errorf("unknown room notification mode %q", mode)
+	}
+	rs.Override = removeRule(rs.Override, roomID)
+	rs.Room = removeRule(rs.Room, roomID)
+	dontNotify := []*Action{{Kind: DontNotifyAction}}
+	switch mode {
+	case RoomNotifyMentions:
+		rs.Room = append([]*Rule{{
+			RuleID:  roomID,
+			Enabled: true,
+			Actions: dontNotify,
+		}}, rs.Room...)
+	case RoomNotifyMute:
+		rs.Override = append([]*Rule{{
+			RuleID:  roomID,
+			Enabled: true,
+			Actions: dontNotify,
+			Conditions: []*Condition{
+				{Kind: EventMatchCondition, Key: "room_id", Pattern: roomID},
+			},
+		}}, rs.Override...)
+	}
+	return nil
+}
+
+// MutedRooms returns the IDs of the rooms which are set to RoomNotifyMute.
+func (rs *RuleSet) MutedRooms() []string {
+	var roomIDs []string
+	for _, rule := range rs.Override {
+		if isRoomMuteRule(rule, rule.RuleID) {
+			roomIDs = append(roomIDs, rule.RuleID)
+		}
+	}
+	return roomIDs
+}
+
+// isRoomMuteRule returns whether the override rule stops everything in the
+// given room from notifying.
+func isRoomMuteRule(rule *Rule, roomID string) bool {
+	if rule.RuleID != roomID || !rule.Enabled || !isDontNotify(rule.Actions) || len(rule.Conditions) != 1 {
+		return false
+	}
+	cond := rule.Conditions[0]
+	return cond.Kind == EventMatchCondition && cond.Key == "room_id" && cond.Pattern == roomID
+}
+
+// isDontNotify returns whether the actions never notify. An empty list of
+// actions doesn't notify either.
+func isDontNotify(actions []*Action) bool {
+	kind, _, err := ActionsToTweaks(actions)
+	return err == nil && (kind == DontNotifyAction || kind == UnknownAction)
+}
+
+func removeRule(rules []*Rule, ruleID string) []*Rule {
+	var kept []*Rule
+	for _, rule := range rules {
+		if rule.RuleID != ruleID {
+			kept = append(kept, rule)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoomNotificationMode(t *testing.T) {
+	const roomID = "!r:b"
+	message := `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"hello"}}`
+	mention := `{"event_id":"$a","room_id":"!r:b","sender":"@bob:b","type":"m.room.message","content":{"body":"ping alice"}}`
+	tsts := []struct {
+		Mode       RoomNotificationMode
+		EventJSON  string
+		WantNotify bool
+		WantMuted  []string
+	}{
+		{RoomNotifyAll, message, true, nil},
+		{RoomNotifyMentions, message, false, nil},
+		{RoomNotifyMentions, mention, true, nil},
+		{RoomNotifyMute, mention, false, []string{roomID}},
+		// Going back to all must remove the rules for the other modes.
+		{RoomNotifyAll, mention, true, nil},
+	}
+	ruleSet := DefaultGlobalRuleSet("alice", "b")
+	for _, tst := range tsts {
+		if err := ruleSet.SetRoomNotificationMode(roomID, tst.Mode); err != nil {
+			t.Fatalf("SetRoomNotificationMode(%q) failed: %s", tst.Mode, err)
+		}
+		if got := ruleSet.RoomNotificationMode(roomID); got != tst.Mode {
+			t.Errorf("RoomNotificationMode: got %q, want %q", got, tst.Mode)
+		}
+		if got := ruleSet.RoomNotificationMode("!other:b"); got != RoomNotifyAll {
+			t.Errorf("RoomNotificationMode of another room: got %q, want %q", got, RoomNotifyAll)
+		}
+		if got := ruleSet.MutedRooms(); !reflect.DeepEqual(got, tst.WantMuted) {
+			t.Errorf("MutedRooms in mode %q: got %v, want %v", tst.Mode, got, tst.WantMuted)
+		}
+
+		rse := NewRuleSetEvaluator(fakeEvaluationContext{"Alice Smith", 3}, ruleSet)
+		rule, err := rse.MatchEvent(mustEventFromJSON(t, tst.EventJSON))
+		if err != nil {
+			t.Fatalf("MatchEvent failed: %v", err)
+		}
+		notify := false
+		if rule != nil {
+			kind, _, err := ActionsToTweaks(rule.Actions)
+			if err != nil {
+				t.Fatalf("ActionsToTweaks failed: %v", err)
+			}
+			notify = kind == NotifyAction
+		}
+		if notify != tst.WantNotify {
+			t.Errorf("mode %q for %s: got notify %v, want %v", tst.Mode, tst.EventJSON, notify, tst.WantNotify)
+		}
+	}
+
+	if err := ruleSet.SetRoomNotificationMode(roomID, "loud"); err == nil {
+		t.Errorf("SetRoomNotificationMode should fail for an unknown mode")
+	}
+}
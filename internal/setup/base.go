@@ -48,6 +48,7 @@ import (
 	keyinthttp "github.com/matrix-org/dendrite/keyserver/inthttp"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	rsinthttp "github.com/matrix-org/dendrite/roomserver/inthttp"
+	"github.com/matrix-org/dendrite/roomserver/version"
 	serverKeyAPI "github.com/matrix-org/dendrite/serverkeyapi/api"
 	skinthttp "github.com/matrix-org/dendrite/serverkeyapi/inthttp"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -67,15 +68,17 @@ type BaseDendrite struct {
 	tracerCloser  io.Closer
 
 	// PublicAPIMux should be used to register new public matrix api endpoints
-	PublicAPIMux   *mux.Router
-	InternalAPIMux *mux.Router
-	BaseMux        *mux.Router // base router which created public/internal subrouters
-	UseHTTPAPIs    bool
-	httpClient     *http.Client
-	Cfg            *config.Dendrite
-	Caches         *caching.Caches
-	KafkaConsumer  sarama.Consumer
-	KafkaProducer  sarama.SyncProducer
+	PublicAPIMux *mux.Router
+	// DendriteAdminMux is for admin endpoints which aren't part of the matrix APIs
+	DendriteAdminMux *mux.Router
+	InternalAPIMux   *mux.Router
+	BaseMux          *mux.Router // base router which created public/internal subrouters
+	UseHTTPAPIs      bool
+	httpClient       *http.Client
+	Cfg              *config.Dendrite
+	Caches           *caching.Caches
+	KafkaConsumer    sarama.Consumer
+	KafkaProducer    sarama.SyncProducer
 }
 
 const HTTPServerTimeout = time.Minute * 5
@@ -89,6 +92,10 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 	internal.SetupHookLogging(cfg.Logging, componentName)
 	internal.SetupPprof()
 
+	if cfg.FeatureEnabled(config.FeatureKnocking) {
+		version.EnableKnocking()
+	}
+
 	closer, err := cfg.SetupTracing("Dendrite" + componentName)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to start opentracing")
@@ -129,17 +136,18 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 	httpmux := mux.NewRouter().SkipClean(true)
 
 	return &BaseDendrite{
-		componentName:  componentName,
-		UseHTTPAPIs:    useHTTPAPIs,
-		tracerCloser:   closer,
-		Cfg:            cfg,
-		Caches:         cache,
-		BaseMux:        httpmux,
-		PublicAPIMux:   httpmux.PathPrefix(httputil.PublicPathPrefix).Subrouter().UseEncodedPath(),
-		InternalAPIMux: httpmux.PathPrefix(httputil.InternalPathPrefix).Subrouter().UseEncodedPath(),
-		httpClient:     &client,
-		KafkaConsumer:  kafkaConsumer,
-		KafkaProducer:  kafkaProducer,
+		componentName:    componentName,
+		UseHTTPAPIs:      useHTTPAPIs,
+		tracerCloser:     closer,
+		Cfg:              cfg,
+		Caches:           cache,
+		BaseMux:          httpmux,
+		PublicAPIMux:     httpmux.PathPrefix(httputil.PublicPathPrefix).Subrouter().UseEncodedPath(),
+		DendriteAdminMux: httpmux.PathPrefix(httputil.DendriteAdminPathPrefix).Subrouter().UseEncodedPath(),
+		InternalAPIMux:   httpmux.PathPrefix(httputil.InternalPathPrefix).Subrouter().UseEncodedPath(),
+		httpClient:       &client,
+		KafkaConsumer:    kafkaConsumer,
+		KafkaProducer:    kafkaProducer,
 	}
 }
 
@@ -247,9 +255,26 @@ func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
 	return db
 }
 
+// CreateClient creates a new client for making unauthenticated requests to
+// other servers, e.g. for fetching remote media.
+func (b *BaseDendrite) CreateClient() *gomatrixserverlib.Client {
+	if b.Cfg.Matrix.FederationMutualTLS.Enabled() {
+		return gomatrixserverlib.NewClientWithTransport(
+			newMutualTLSTransport(&b.Cfg.Matrix.FederationMutualTLS),
+		)
+	}
+	return gomatrixserverlib.NewClient()
+}
+
 // CreateFederationClient creates a new federation client. Should only be called
 // once per component.
 func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationClient {
+	if b.Cfg.Matrix.FederationMutualTLS.Enabled() {
+		return gomatrixserverlib.NewFederationClientWithTransport(
+			b.Cfg.Matrix.ServerName, b.Cfg.Matrix.KeyID, b.Cfg.Matrix.PrivateKey,
+			newMutualTLSTransport(&b.Cfg.Matrix.FederationMutualTLS),
+		)
+	}
 	return gomatrixserverlib.NewFederationClient(
 		b.Cfg.Matrix.ServerName, b.Cfg.Matrix.KeyID, b.Cfg.Matrix.PrivateKey,
 	)
@@ -0,0 +1,174 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package setup
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
+)
+
+// testCA is a certificate authority which issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func mustCreateCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Federation CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// mustIssue returns a certificate for the given server name, which can be
+// used both by servers and by clients.
+func (ca *testCA) mustIssue(t *testing.T, serverName string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// mustStartFederationServer starts a server which requires the certificates
+// of clients to be issued by the given authority, as federation listeners
+// do when require_client_certificates is set.
+func mustStartFederationServer(t *testing.T, ca *testCA, cert *tls.Certificate) *httptest.Server {
+	mutualTLS := config.FederationMutualTLS{CACertificates: ca.pool}
+	srv := httptest.NewUnstartedServer(httputil.WrapHandlerInClientCertificateCheck(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	))
+	srv.TLS = mutualTLS.ServerTLSConfig()
+	srv.TLS.Certificates = []tls.Certificate{*cert}
+	srv.StartTLS()
+	return srv
+}
+
+func TestMutualTLSTransport(t *testing.T) {
+	ca := mustCreateCA(t)
+	srv := mustStartFederationServer(t, ca, ca.mustIssue(t, "server.test"))
+	defer srv.Close()
+
+	testCases := []struct {
+		Name     string
+		Config   config.FederationMutualTLS
+		WantCode int
+		WantErr  bool
+	}{
+		{
+			Name: "client certificate from the federation",
+			Config: config.FederationMutualTLS{
+				ClientCertificate: ca.mustIssue(t, "client.test"),
+				CACertificates:    ca.pool,
+			},
+			WantCode: http.StatusOK,
+		},
+		{
+			Name:     "no client certificate",
+			Config:   config.FederationMutualTLS{CACertificates: ca.pool},
+			WantCode: http.StatusForbidden,
+		},
+		{
+			Name: "client certificate from another authority",
+			Config: config.FederationMutualTLS{
+				ClientCertificate: mustCreateCA(t).mustIssue(t, "client.test"),
+				CACertificates:    ca.pool,
+			},
+			WantErr: true,
+		},
+		{
+			Name: "server certificate from another authority",
+			Config: config.FederationMutualTLS{
+				ClientCertificate: ca.mustIssue(t, "client.test"),
+				CACertificates:    mustCreateCA(t).pool,
+			},
+			WantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		tripper := &mutualTLSTripper{
+			cfg:        &tc.Config,
+			transports: make(map[string]http.RoundTripper),
+		}
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/_matrix/federation/v1/version", nil)
+		if err != nil {
+			t.Fatalf("%s: failed to create request: %s", tc.Name, err)
+		}
+		res, err := tripper.getTransport("server.test").RoundTrip(req)
+		if tc.WantErr {
+			if err == nil {
+				_ = res.Body.Close()
+				t.Errorf("%s: got status %d, want the request to fail", tc.Name, res.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: request failed: %s", tc.Name, err)
+			continue
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != tc.WantCode {
+			t.Errorf("%s: got status %d, want %d", tc.Name, res.StatusCode, tc.WantCode)
+		}
+	}
+}
@@ -24,8 +24,8 @@ import (
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/federationapi"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/config"
-	"github.com/matrix-org/dendrite/internal/transactions"
 	keyAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/mediaapi"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -48,6 +48,7 @@ type Monolith struct {
 	FedClient     *gomatrixserverlib.FederationClient
 	KafkaConsumer sarama.Consumer
 	KafkaProducer sarama.SyncProducer
+	Caches        *caching.Caches
 
 	AppserviceAPI       appserviceAPI.AppServiceQueryAPI
 	EDUInternalAPI      eduServerAPI.EDUServerInputAPI
@@ -62,21 +63,21 @@ type Monolith struct {
 	ExtPublicRoomsProvider api.ExtraPublicRoomsProvider
 }
 
-// AddAllPublicRoutes attaches all public paths to the given router
-func (m *Monolith) AddAllPublicRoutes(publicMux *mux.Router) {
+// AddAllPublicRoutes attaches all public paths to the given routers
+func (m *Monolith) AddAllPublicRoutes(publicMux, dendriteAdminMux *mux.Router) {
 	clientapi.AddPublicRoutes(
-		publicMux, m.Config, m.KafkaProducer, m.DeviceDB, m.AccountDB,
+		publicMux, dendriteAdminMux, m.Config, m.KafkaProducer, m.DeviceDB, m.AccountDB,
 		m.FedClient, m.RoomserverAPI,
-		m.EDUInternalAPI, m.AppserviceAPI, m.StateAPI, transactions.New(),
+		m.EDUInternalAPI, m.AppserviceAPI, m.StateAPI,
 		m.FederationSenderAPI, m.UserAPI, m.ExtPublicRoomsProvider,
 	)
 	federationapi.AddPublicRoutes(
 		publicMux, m.Config, m.UserAPI, m.FedClient,
 		m.KeyRing, m.RoomserverAPI, m.FederationSenderAPI,
-		m.EDUInternalAPI, m.StateAPI,
+		m.EDUInternalAPI, m.StateAPI, m.Caches,
 	)
-	mediaapi.AddPublicRoutes(publicMux, m.Config, m.UserAPI, m.Client)
+	mediaapi.AddPublicRoutes(publicMux, m.Config, m.UserAPI, m.FederationSenderAPI, m.Client)
 	syncapi.AddPublicRoutes(
-		publicMux, m.KafkaConsumer, m.UserAPI, m.RoomserverAPI, m.FedClient, m.Config,
+		publicMux, m.KafkaConsumer, m.UserAPI, m.RoomserverAPI, m.FedClient, m.Config, m.Caches,
 	)
 }
@@ -0,0 +1,52 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SQLiteAddColumn adds a column to a SQLite table which was created before the
+// column was added to its schema. SQLite has no "ADD COLUMN IF NOT EXISTS", so
+// this does nothing if the table doesn't exist yet or already has the column.
+// It must be called before the schema is executed so that any indexes in the
+// schema can refer to the new column.
+func SQLiteAddColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info($1)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	found, exists := false, false
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		found = true
+		if name == column {
+			exists = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if !found || exists {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
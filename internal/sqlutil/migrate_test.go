@@ -0,0 +1,53 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLiteAddColumn(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+
+	// The table doesn't exist yet, so its CREATE TABLE will add the column.
+	if err = SQLiteAddColumn(db, "test_table", "added", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		t.Fatalf("SQLiteAddColumn on missing table: %s", err)
+	}
+	if _, err = db.Exec("CREATE TABLE test_table (id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatalf("CREATE TABLE: %s", err)
+	}
+	if _, err = db.Exec("INSERT INTO test_table (id) VALUES (1)"); err != nil {
+		t.Fatalf("INSERT: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = SQLiteAddColumn(db, "test_table", "added", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			t.Fatalf("SQLiteAddColumn attempt %d: %s", i, err)
+		}
+	}
+	var added int
+	if err = db.QueryRow("SELECT added FROM test_table WHERE id = 1").Scan(&added); err != nil {
+		t.Fatalf("SELECT: %s", err)
+	}
+	if added != 0 {
+		t.Fatalf("got added=%d, want 0", added)
+	}
+}
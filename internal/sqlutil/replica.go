@@ -0,0 +1,111 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"time"
+
+	"github.com/ngrok/sqlmw"
+	"github.com/sirupsen/logrus"
+)
+
+// How long reads go to the primary database after a read on the replica fails,
+// before the replica is tried again.
+const replicaRetryInterval = 30 * time.Second
+
+// OpenReadReplica opens a postgres read replica. Statements executed directly
+// on the database without any arguments are skipped, so that the same table
+// constructors as for the primary can be used to prepare statements on the
+// replica: their schema is created on the primary and replicated from there,
+// and CREATE statements would fail on the read-only replica.
+func OpenReadReplica(dsn string, dbProperties DbProperties) (*sql.DB, error) {
+	return Open("postgres-replica", dsn, dbProperties)
+}
+
+// ReadReplica decides whether reads are sent to a read replica of a database
+// or to the primary. A nil ReadReplica sends everything to the primary.
+type ReadReplica struct {
+	mu        sync.Mutex
+	downUntil time.Time
+	// caughtUp returns whether the replica has replayed everything which
+	// had been written to the primary when it was called.
+	caughtUp func(ctx context.Context) (bool, error)
+}
+
+// NewReadReplica returns a ReadReplica which sends reads to the replica
+// whenever it has caught up with the primary.
+func NewReadReplica(primary, replica *sql.DB) *ReadReplica {
+	return &ReadReplica{
+		caughtUp: func(ctx context.Context) (bool, error) {
+			var lsn string
+			if err := primary.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&lsn); err != nil {
+				return false, err
+			}
+			var caughtUp bool
+			err := replica.QueryRowContext(ctx, "SELECT COALESCE(pg_last_wal_replay_lsn() >= $1::pg_lsn, FALSE)", lsn).Scan(&caughtUp)
+			return caughtUp, err
+		},
+	}
+}
+
+// Read calls read with onReplica set if the replica is available and has
+// caught up with the writes made to the primary before the read, so that a
+// client never reads anything older than what it has just written. If the
+// read fails on the replica then it is retried on the primary, and the
+// replica isn't used again until replicaRetryInterval has passed. read must
+// be safe to retry.
+func (r *ReadReplica) Read(ctx context.Context, read func(onReplica bool) error) error {
+	if r == nil || !r.available() {
+		return read(false)
+	}
+	caughtUp, err := r.caughtUp(ctx)
+	if err == nil {
+		if !caughtUp {
+			return read(false)
+		}
+		err = read(true)
+	}
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	logrus.WithError(err).Warn("Read from replica failed, using the primary database instead")
+	r.mu.Lock()
+	r.downUntil = time.Now().Add(replicaRetryInterval)
+	r.mu.Unlock()
+	return read(false)
+}
+
+func (r *ReadReplica) available() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Now().After(r.downUntil)
+}
+
+// replicaInterceptor skips executing statements without arguments, which are
+// schema changes in the table constructors, on read replicas.
+type replicaInterceptor struct {
+	sqlmw.Interceptor
+}
+
+func (in *replicaInterceptor) ConnExecContext(ctx context.Context, conn driver.ExecerContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	if len(args) == 0 {
+		return driver.ResultNoRows, nil
+	}
+	return in.Interceptor.ConnExecContext(ctx, conn, query, args)
+}
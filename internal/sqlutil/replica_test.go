@@ -0,0 +1,92 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestReadReplicaFallback(t *testing.T) {
+	ctx := context.Background()
+	var reads []bool
+	replicaErr := errors.New("replica unavailable")
+	failingRead := func(onReplica bool) error {
+		reads = append(reads, onReplica)
+		if onReplica {
+			return replicaErr
+		}
+		return nil
+	}
+
+	var noReplica *ReadReplica
+	if err := noReplica.Read(ctx, failingRead); err != nil || len(reads) != 1 || reads[0] {
+		t.Fatalf("reads without a replica should go to the primary, got %v, %v", reads, err)
+	}
+
+	reads = nil
+	r := &ReadReplica{caughtUp: func(ctx context.Context) (bool, error) {
+		return true, nil
+	}}
+	if err := r.Read(ctx, failingRead); err != nil {
+		t.Fatalf("expected the read to fall back to the primary, got %s", err)
+	}
+	if len(reads) != 2 || !reads[0] || reads[1] {
+		t.Fatalf("expected a read on the replica and then the primary, got %v", reads)
+	}
+
+	// The replica isn't tried again straight away.
+	reads = nil
+	if err := r.Read(ctx, failingRead); err != nil || len(reads) != 1 || reads[0] {
+		t.Fatalf("expected only a read on the primary, got %v, %v", reads, err)
+	}
+}
+
+func TestReadReplicaLagging(t *testing.T) {
+	ctx := context.Background()
+	var reads []bool
+	read := func(onReplica bool) error {
+		reads = append(reads, onReplica)
+		return nil
+	}
+	caughtUp := false
+	var checkErr error
+	r := &ReadReplica{caughtUp: func(ctx context.Context) (bool, error) {
+		return caughtUp, checkErr
+	}}
+
+	// Reads go to the primary until the replica has replayed its writes.
+	if err := r.Read(ctx, read); err != nil || len(reads) != 1 || reads[0] {
+		t.Fatalf("expected only a read on the primary while the replica lags, got %v, %v", reads, err)
+	}
+	reads = nil
+	caughtUp = true
+	if err := r.Read(ctx, read); err != nil || len(reads) != 1 || !reads[0] {
+		t.Fatalf("expected only a read on the replica once it caught up, got %v, %v", reads, err)
+	}
+
+	// A replica which can't say how far it has got isn't used for a while.
+	reads = nil
+	checkErr = errors.New("replica unavailable")
+	if err := r.Read(ctx, read); err != nil || len(reads) != 1 || reads[0] {
+		t.Fatalf("expected only a read on the primary, got %v, %v", reads, err)
+	}
+	reads = nil
+	checkErr = nil
+	if err := r.Read(ctx, read); err != nil || len(reads) != 1 || reads[0] {
+		t.Fatalf("expected the replica to be skipped after failing, got %v, %v", reads, err)
+	}
+}
@@ -27,6 +27,10 @@ import (
 // ErrUserExists is returned if a username already exists in the database.
 var ErrUserExists = errors.New("Username already exists")
 
+// Err3PIDInUse is returned if a third-party identifier is already associated
+// with a user in the database.
+var Err3PIDInUse = errors.New("This third-party identifier is already in use")
+
 // A Transaction is something that can be committed or rolledback.
 type Transaction interface {
 	// Commit the transaction
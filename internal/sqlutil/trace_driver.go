@@ -25,11 +25,14 @@ import (
 )
 
 func registerDrivers() {
+	// read replicas are always opened with a wrapped driver, see OpenReadReplica
+	sql.Register("postgres-replica", sqlmw.Driver(&pq.Driver{}, &replicaInterceptor{sqlmw.NullInterceptor{}}))
 	if !tracingEnabled {
 		return
 	}
 	// install the wrapped drivers
 	sql.Register("postgres-trace", sqlmw.Driver(&pq.Driver{}, new(traceInterceptor)))
+	sql.Register("postgres-replica-trace", sqlmw.Driver(&pq.Driver{}, &replicaInterceptor{new(traceInterceptor)}))
 	sql.Register("sqlite3-trace", sqlmw.Driver(&sqlite.SQLiteDriver{}, new(traceInterceptor)))
 
 }
@@ -97,6 +97,7 @@ func MakeConfig(configDir, kafkaURI, database, host string, startPort int) (*con
 	cfg.Database.ServerKey = config.DataSource(database)
 	cfg.Database.SyncAPI = config.DataSource(database)
 	cfg.Database.CurrentState = config.DataSource(database)
+	cfg.Database.KeyServer = config.DataSource(database)
 
 	cfg.Listen.ClientAPI = assignAddress()
 	cfg.Listen.AppServiceAPI = assignAddress()
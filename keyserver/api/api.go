@@ -23,6 +23,9 @@ type KeyInternalAPI interface {
 	PerformUploadKeys(ctx context.Context, req *PerformUploadKeysRequest, res *PerformUploadKeysResponse)
 	PerformClaimKeys(ctx context.Context, req *PerformClaimKeysRequest, res *PerformClaimKeysResponse)
 	QueryKeys(ctx context.Context, req *QueryKeysRequest, res *QueryKeysResponse)
+	// PerformDeleteKeys deletes the keys of devices which have been deleted,
+	// telling other users that they have gone from the user's device list.
+	PerformDeleteKeys(ctx context.Context, req *PerformDeleteKeysRequest, res *PerformDeleteKeysResponse)
 }
 
 // KeyError is returned if there was a problem performing/querying the server
@@ -95,6 +98,17 @@ type PerformClaimKeysResponse struct {
 	Error *KeyError
 }
 
+// PerformDeleteKeysRequest is the request to PerformDeleteKeys
+type PerformDeleteKeysRequest struct {
+	UserID    string
+	DeviceIDs []string
+}
+
+// PerformDeleteKeysResponse is the response to PerformDeleteKeys
+type PerformDeleteKeysResponse struct {
+	Error *KeyError
+}
+
 type QueryKeysRequest struct {
 }
 
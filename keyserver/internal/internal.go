@@ -25,7 +25,7 @@ import (
 )
 
 type KeyInternalAPI struct {
-	db storage.Database
+	DB storage.Database
 }
 
 func (a *KeyInternalAPI) PerformUploadKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
@@ -40,6 +40,33 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 
 }
 
+func (a *KeyInternalAPI) PerformDeleteKeys(ctx context.Context, req *api.PerformDeleteKeysRequest, res *api.PerformDeleteKeysResponse) {
+	existingKeys := make([]api.DeviceKeys, len(req.DeviceIDs))
+	deletedKeys := make([]api.DeviceKeys, len(req.DeviceIDs))
+	for i, deviceID := range req.DeviceIDs {
+		existingKeys[i] = api.DeviceKeys{
+			UserID:   req.UserID,
+			DeviceID: deviceID,
+		}
+		deletedKeys[i] = existingKeys[i]
+	}
+	if err := a.DB.DeviceKeysJSON(ctx, existingKeys); err != nil {
+		res.Error = &api.KeyError{
+			Error: fmt.Sprintf("failed to query existing device keys: %s", err.Error()),
+		}
+		return
+	}
+	if err := a.DB.DeleteDeviceKeys(ctx, req.UserID, req.DeviceIDs); err != nil {
+		res.Error = &api.KeyError{
+			Error: fmt.Sprintf("failed to delete device keys: %s", err.Error()),
+		}
+		return
+	}
+	// the deleted devices are emitted without any keys, so that they are
+	// removed from other users' device lists
+	a.emitDeviceKeyChanges(existingKeys, deletedKeys)
+}
+
 func (a *KeyInternalAPI) uploadDeviceKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
 	var keysToStore []api.DeviceKeys
 	// assert that the user ID / device ID are not lying for each key
@@ -66,14 +93,14 @@ func (a *KeyInternalAPI) uploadDeviceKeys(ctx context.Context, req *api.PerformU
 			DeviceID: keysToStore[i].DeviceID,
 		}
 	}
-	if err := a.db.DeviceKeysJSON(ctx, existingKeys); err != nil {
+	if err := a.DB.DeviceKeysJSON(ctx, existingKeys); err != nil {
 		res.Error = &api.KeyError{
 			Error: fmt.Sprintf("failed to query existing device keys: %s", err.Error()),
 		}
 		return
 	}
 	// store the device keys and emit changes
-	if err := a.db.StoreDeviceKeys(ctx, keysToStore); err != nil {
+	if err := a.DB.StoreDeviceKeys(ctx, keysToStore); err != nil {
 		res.Error = &api.KeyError{
 			Error: fmt.Sprintf("failed to store device keys: %s", err.Error()),
 		}
@@ -91,7 +118,7 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 			keyIDsWithAlgorithms[i] = keyIDWithAlgo
 			i++
 		}
-		existingKeys, err := a.db.ExistingOneTimeKeys(ctx, key.UserID, key.DeviceID, keyIDsWithAlgorithms)
+		existingKeys, err := a.DB.ExistingOneTimeKeys(ctx, key.UserID, key.DeviceID, keyIDsWithAlgorithms)
 		if err != nil {
 			res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
 				Error: "failed to query existing one-time keys: " + err.Error(),
@@ -108,7 +135,7 @@ func (a *KeyInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perform
 			}
 		}
 		// store one-time keys
-		if err := a.db.StoreOneTimeKeys(ctx, key); err != nil {
+		if err := a.DB.StoreOneTimeKeys(ctx, key); err != nil {
 			res.KeyError(key.UserID, key.DeviceID, &api.KeyError{
 				Error: fmt.Sprintf("%s device %s : failed to store one-time keys: %s", key.UserID, key.DeviceID, err.Error()),
 			})
@@ -28,6 +28,7 @@ import (
 const (
 	PerformUploadKeysPath = "/keyserver/performUploadKeys"
 	PerformClaimKeysPath  = "/keyserver/performClaimKeys"
+	PerformDeleteKeysPath = "/keyserver/performDeleteKeys"
 	QueryKeysPath         = "/keyserver/queryKeys"
 )
 
@@ -101,3 +102,20 @@ func (h *httpKeyInternalAPI) QueryKeys(
 		}
 	}
 }
+
+func (h *httpKeyInternalAPI) PerformDeleteKeys(
+	ctx context.Context,
+	request *api.PerformDeleteKeysRequest,
+	response *api.PerformDeleteKeysResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeleteKeys")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformDeleteKeysPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.KeyError{
+			Error: err.Error(),
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/internal"
+)
+
+const userID = "@alice:localhost"
+
+func deviceKeys(deviceID string) api.DeviceKeys {
+	return api.DeviceKeys{
+		UserID:   userID,
+		DeviceID: deviceID,
+		KeyJSON:  []byte(fmt.Sprintf(`{"user_id":%q,"device_id":%q,"algorithms":["m.olm.v1.curve25519-aes-sha2"]}`, userID, deviceID)),
+	}
+}
+
+func oneTimeKeys(deviceID string) api.OneTimeKeys {
+	return api.OneTimeKeys{
+		UserID:   userID,
+		DeviceID: deviceID,
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:AAAAHQ": json.RawMessage(`{"key":"j3fR3HemM16M7CWhoI4Sk5ZsdmdfQHsKL1xuSft6MSw"}`),
+		},
+	}
+}
+
+func TestPerformDeleteKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyserver")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	cfg := &config.Dendrite{}
+	cfg.Database.KeyServer = config.DataSource("file:" + filepath.Join(dir, "keyserver.db"))
+	keyAPI := NewInternalAPI(cfg)
+	db := keyAPI.(*internal.KeyInternalAPI).DB
+	ctx := context.Background()
+
+	var uploadRes api.PerformUploadKeysResponse
+	keyAPI.PerformUploadKeys(ctx, &api.PerformUploadKeysRequest{
+		DeviceKeys:  []api.DeviceKeys{deviceKeys("DELETED"), deviceKeys("KEPT")},
+		OneTimeKeys: []api.OneTimeKeys{oneTimeKeys("DELETED"), oneTimeKeys("KEPT")},
+	}, &uploadRes)
+	if uploadRes.Error != nil || len(uploadRes.KeyErrors) > 0 {
+		t.Fatalf("PerformUploadKeys failed: %+v %+v", uploadRes.Error, uploadRes.KeyErrors)
+	}
+
+	var deleteRes api.PerformDeleteKeysResponse
+	keyAPI.PerformDeleteKeys(ctx, &api.PerformDeleteKeysRequest{
+		UserID:    userID,
+		DeviceIDs: []string{"DELETED"},
+	}, &deleteRes)
+	if deleteRes.Error != nil {
+		t.Fatalf("PerformDeleteKeys failed: %s", deleteRes.Error.Error)
+	}
+
+	keys := []api.DeviceKeys{
+		{UserID: userID, DeviceID: "DELETED"},
+		{UserID: userID, DeviceID: "KEPT"},
+	}
+	if err = db.DeviceKeysJSON(ctx, keys); err != nil {
+		t.Fatalf("DeviceKeysJSON failed: %s", err)
+	}
+	if keys[0].KeyJSON != nil {
+		t.Errorf("device keys of the deleted device were not deleted: %s", keys[0].KeyJSON)
+	}
+	if string(keys[1].KeyJSON) != string(deviceKeys("KEPT").KeyJSON) {
+		t.Errorf("device keys of the kept device were changed: got %s", keys[1].KeyJSON)
+	}
+
+	for deviceID, wantCount := range map[string]int{"DELETED": 0, "KEPT": 1} {
+		existing, err := db.ExistingOneTimeKeys(ctx, userID, deviceID, []string{"signed_curve25519:AAAAHQ"})
+		if err != nil {
+			t.Fatalf("ExistingOneTimeKeys failed: %s", err)
+		}
+		if len(existing) != wantCount {
+			t.Errorf("device %s: got %d one-time keys, want %d", deviceID, len(existing), wantCount)
+		}
+	}
+}
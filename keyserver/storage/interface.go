@@ -35,4 +35,7 @@ type Database interface {
 	// StoreDeviceKeys persists the given keys. Keys with the same user ID and device ID will be replaced.
 	// Returns an error if there was a problem storing the keys.
 	StoreDeviceKeys(ctx context.Context, keys []api.DeviceKeys) error
+
+	// DeleteDeviceKeys removes the device keys and one-time keys of the given devices.
+	DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []string) error
 }
@@ -0,0 +1,106 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/api"
+)
+
+const deviceKeysSchema = `
+-- Stores device keys for users
+CREATE TABLE IF NOT EXISTS keyserver_device_keys (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    -- The signed device keys JSON, as uploaded by the device
+    key_json TEXT NOT NULL,
+
+    PRIMARY KEY (user_id, device_id)
+);
+`
+
+const upsertDeviceKeysSQL = "" +
+	"INSERT INTO keyserver_device_keys (user_id, device_id, key_json)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT (user_id, device_id)" +
+	" DO UPDATE SET key_json = $3"
+
+const selectDeviceKeysSQL = "" +
+	"SELECT key_json FROM keyserver_device_keys WHERE user_id = $1 AND device_id = $2"
+
+const deleteDeviceKeysSQL = "" +
+	"DELETE FROM keyserver_device_keys WHERE user_id = $1 AND device_id = $2"
+
+type deviceKeysStatements struct {
+	upsertDeviceKeysStmt *sql.Stmt
+	selectDeviceKeysStmt *sql.Stmt
+	deleteDeviceKeysStmt *sql.Stmt
+}
+
+func (s *deviceKeysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(deviceKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertDeviceKeysStmt, err = db.Prepare(upsertDeviceKeysSQL); err != nil {
+		return
+	}
+	if s.selectDeviceKeysStmt, err = db.Prepare(selectDeviceKeysSQL); err != nil {
+		return
+	}
+	if s.deleteDeviceKeysStmt, err = db.Prepare(deleteDeviceKeysSQL); err != nil {
+		return
+	}
+	return
+}
+
+// selectDeviceKeysJSON populates the KeyJSON of the given keys, leaving it
+// empty for devices which have no keys stored.
+func (s *deviceKeysStatements) selectDeviceKeysJSON(
+	ctx context.Context, keys []api.DeviceKeys,
+) error {
+	for i, key := range keys {
+		var keyJSON string
+		err := s.selectDeviceKeysStmt.QueryRowContext(ctx, key.UserID, key.DeviceID).Scan(&keyJSON)
+		if err == sql.ErrNoRows {
+			keys[i].KeyJSON = nil
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		keys[i].KeyJSON = []byte(keyJSON)
+	}
+	return nil
+}
+
+func (s *deviceKeysStatements) upsertDeviceKeys(
+	ctx context.Context, txn *sql.Tx, key api.DeviceKeys,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertDeviceKeysStmt).ExecContext(
+		ctx, key.UserID, key.DeviceID, string(key.KeyJSON),
+	)
+	return err
+}
+
+func (s *deviceKeysStatements) deleteDeviceKeys(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteDeviceKeysStmt).ExecContext(ctx, userID, deviceID)
+	return err
+}
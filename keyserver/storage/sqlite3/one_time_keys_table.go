@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const oneTimeKeysSchema = `
+-- Stores one-time keys for devices
+CREATE TABLE IF NOT EXISTS keyserver_one_time_keys (
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    key_id TEXT NOT NULL,
+    algorithm TEXT NOT NULL,
+    -- The signed one-time key JSON, as uploaded by the device
+    key_json TEXT NOT NULL,
+
+    PRIMARY KEY (user_id, device_id, key_id, algorithm)
+);
+`
+
+const upsertOneTimeKeySQL = "" +
+	"INSERT INTO keyserver_one_time_keys (user_id, device_id, key_id, algorithm, key_json)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, device_id, key_id, algorithm)" +
+	" DO UPDATE SET key_json = $5"
+
+const selectOneTimeKeySQL = "" +
+	"SELECT key_json FROM keyserver_one_time_keys" +
+	" WHERE user_id = $1 AND device_id = $2 AND key_id = $3 AND algorithm = $4"
+
+const deleteOneTimeKeysSQL = "" +
+	"DELETE FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2"
+
+type oneTimeKeysStatements struct {
+	upsertOneTimeKeyStmt  *sql.Stmt
+	selectOneTimeKeyStmt  *sql.Stmt
+	deleteOneTimeKeysStmt *sql.Stmt
+}
+
+func (s *oneTimeKeysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(oneTimeKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertOneTimeKeyStmt, err = db.Prepare(upsertOneTimeKeySQL); err != nil {
+		return
+	}
+	if s.selectOneTimeKeyStmt, err = db.Prepare(selectOneTimeKeySQL); err != nil {
+		return
+	}
+	if s.deleteOneTimeKeysStmt, err = db.Prepare(deleteOneTimeKeysSQL); err != nil {
+		return
+	}
+	return
+}
+
+// selectOneTimeKey returns the JSON of the given one-time key, or nil if the
+// device has no such key.
+func (s *oneTimeKeysStatements) selectOneTimeKey(
+	ctx context.Context, userID, deviceID, keyID, algorithm string,
+) (json.RawMessage, error) {
+	var keyJSON string
+	err := s.selectOneTimeKeyStmt.QueryRowContext(ctx, userID, deviceID, keyID, algorithm).Scan(&keyJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(keyJSON), nil
+}
+
+func (s *oneTimeKeysStatements) upsertOneTimeKey(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, keyID, algorithm string, keyJSON json.RawMessage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertOneTimeKeyStmt).ExecContext(
+		ctx, userID, deviceID, keyID, algorithm, string(keyJSON),
+	)
+	return err
+}
+
+func (s *oneTimeKeysStatements) deleteOneTimeKeys(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteOneTimeKeysStmt).ExecContext(ctx, userID, deviceID)
+	return err
+}
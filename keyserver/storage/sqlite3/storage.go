@@ -0,0 +1,138 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/api"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Database represents a key server database.
+type Database struct {
+	db          *sql.DB
+	writer      *sqlutil.TransactionWriter
+	deviceKeys  deviceKeysStatements
+	oneTimeKeys oneTimeKeysStatements
+}
+
+// NewDatabase creates a new key server database
+func NewDatabase(dataSourceName string) (*Database, error) {
+	cs, err := sqlutil.ParseFileURI(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqlutil.Open(sqlutil.SQLiteDriverName(), cs, nil)
+	if err != nil {
+		return nil, err
+	}
+	d := &Database{
+		db:     db,
+		writer: sqlutil.NewTransactionWriter(),
+	}
+	if err = d.deviceKeys.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.oneTimeKeys.prepare(db); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ExistingOneTimeKeys implements storage.Database
+func (d *Database) ExistingOneTimeKeys(
+	ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string,
+) (map[string]json.RawMessage, error) {
+	result := make(map[string]json.RawMessage)
+	for _, keyIDWithAlgo := range keyIDsWithAlgorithms {
+		algorithm, keyID, err := splitKeyIDWithAlgorithm(keyIDWithAlgo)
+		if err != nil {
+			return nil, err
+		}
+		keyJSON, err := d.oneTimeKeys.selectOneTimeKey(ctx, userID, deviceID, keyID, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if keyJSON != nil {
+			result[keyIDWithAlgo] = keyJSON
+		}
+	}
+	return result, nil
+}
+
+// StoreOneTimeKeys implements storage.Database
+func (d *Database) StoreOneTimeKeys(ctx context.Context, keys api.OneTimeKeys) error {
+	return d.writer.Do(d.db, func(txn *sql.Tx) error {
+		for keyIDWithAlgo, keyJSON := range keys.KeyJSON {
+			algorithm, keyID, err := splitKeyIDWithAlgorithm(keyIDWithAlgo)
+			if err != nil {
+				return err
+			}
+			if err = d.oneTimeKeys.upsertOneTimeKey(ctx, txn, keys.UserID, keys.DeviceID, keyID, algorithm, keyJSON); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeviceKeysJSON implements storage.Database
+func (d *Database) DeviceKeysJSON(ctx context.Context, keys []api.DeviceKeys) error {
+	return d.deviceKeys.selectDeviceKeysJSON(ctx, keys)
+}
+
+// StoreDeviceKeys implements storage.Database
+func (d *Database) StoreDeviceKeys(ctx context.Context, keys []api.DeviceKeys) error {
+	return d.writer.Do(d.db, func(txn *sql.Tx) error {
+		for _, key := range keys {
+			if err := d.deviceKeys.upsertDeviceKeys(ctx, txn, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteDeviceKeys implements storage.Database
+func (d *Database) DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []string) error {
+	return d.writer.Do(d.db, func(txn *sql.Tx) error {
+		for _, deviceID := range deviceIDs {
+			if err := d.deviceKeys.deleteDeviceKeys(ctx, txn, userID, deviceID); err != nil {
+				return err
+			}
+			if err := d.oneTimeKeys.deleteOneTimeKeys(ctx, txn, userID, deviceID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// splitKeyIDWithAlgorithm splits an "algorithm:key_id" string, as used for
+// the keys of one-time key maps.
+func splitKeyIDWithAlgorithm(keyIDWithAlgo string) (algorithm, keyID string, err error) {
+	parts := strings.SplitN(keyIDWithAlgo, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("malformed one-time key ID %q", keyIDWithAlgo)
+	}
+	return parts[0], parts[1], nil
+}
@@ -24,6 +24,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -62,10 +63,49 @@ func GetPathFromBase64Hash(base64Hash types.Base64Hash, absBasePath config.Path)
 	return filePath, nil
 }
 
+// hashLock is held while the file stored for a hash is being added or removed.
+type hashLock struct {
+	sync.Mutex
+	// The number of goroutines holding or waiting for the lock
+	waiters int
+}
+
+var (
+	hashLocksMu sync.Mutex
+	hashLocks   = make(map[types.Base64Hash]*hashLock)
+)
+
+// LockHash stops anything else in this process from adding or removing the
+// file stored for the hash until the returned function is called. Media with
+// the same content share a file, so whatever moves a file into place and
+// stores the metadata which refers to it must hold the lock for both, as must
+// whatever checks that no metadata refers to a file before removing it.
+func LockHash(base64Hash types.Base64Hash) (unlock func()) {
+	hashLocksMu.Lock()
+	l, ok := hashLocks[base64Hash]
+	if !ok {
+		l = &hashLock{}
+		hashLocks[base64Hash] = l
+	}
+	l.waiters++
+	hashLocksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		hashLocksMu.Lock()
+		defer hashLocksMu.Unlock()
+		if l.waiters--; l.waiters == 0 {
+			delete(hashLocks, base64Hash)
+		}
+	}
+}
+
 // MoveFileWithHashCheck checks for hash collisions when moving a temporary file to its final path based on metadata
 // The final path is based on the hash of the file.
 // If the final path exists and the file size matches, the file does not need to be moved.
 // In error cases where the file is not a duplicate, the caller may decide to remove the final path.
+// The caller should hold LockHash for the hash of the file.
 // Returns the final path of the file, whether it is a duplicate and an error.
 func MoveFileWithHashCheck(tmpDir types.Path, mediaMetadata *types.MediaMetadata, absBasePath config.Path, logger *log.Entry) (types.Path, bool, error) {
 	// Note: in all error and success cases, we need to remove the temporary directory
@@ -0,0 +1,266 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package integrity verifies the media repository metadata against the files
+// stored on disk.
+package integrity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Options controls how thorough a Check is and whether it repairs anything.
+type Options struct {
+	// Repair removes orphaned files and dangling metadata. Without it the
+	// check only reports what it would have removed.
+	Repair bool
+	// HashCheckEvery hashes the contents of every Nth media file and compares
+	// it against the hash it is stored under. Zero disables the spot-checks.
+	HashCheckEvery int
+}
+
+// Usage is the space taken up by a set of media files.
+type Usage struct {
+	Files int
+	Bytes types.FileSizeBytes
+}
+
+func (u *Usage) add(size types.FileSizeBytes) {
+	u.Files++
+	u.Bytes += size
+}
+
+// Report is the outcome of a Check.
+type Report struct {
+	// FilesChecked is the number of distinct media files found on disk.
+	FilesChecked int
+	// HashesChecked is the number of media files which were hashed.
+	HashesChecked int
+	// HashMismatches are media files whose contents do not match their hash.
+	// These are never removed, as the metadata may still be correct.
+	HashMismatches []types.Path
+	// SizeMismatches are media files whose size does not match their metadata.
+	SizeMismatches []types.Path
+	// DanglingMedia are media metadata rows whose file does not exist.
+	DanglingMedia []*types.MediaMetadata
+	// DanglingThumbnails are thumbnail metadata rows whose file does not exist.
+	DanglingThumbnails []*types.ThumbnailMetadata
+	// OrphanedFiles are files in the media repository which no metadata refers to.
+	OrphanedFiles []types.Path
+	// OrphanedBytes is the total size of the orphaned files.
+	OrphanedBytes types.FileSizeBytes
+	// OriginUsage is the space used by the media from each origin.
+	OriginUsage map[gomatrixserverlib.ServerName]*Usage
+	// UserUsage is the space used by the media uploaded by each local user.
+	UserUsage map[types.MatrixUserID]*Usage
+}
+
+// Check compares the media metadata in the database with the files below
+// absBasePath. Media which share a hash share a file, so each file is only
+// checked once but is counted towards the usage of every upload of it.
+func Check(
+	ctx context.Context, db storage.Database, absBasePath config.Path, opts Options,
+) (*Report, error) {
+	report := &Report{
+		OriginUsage: make(map[gomatrixserverlib.ServerName]*Usage),
+		UserUsage:   make(map[types.MatrixUserID]*Usage),
+	}
+
+	media, err := db.GetAllMediaMetadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db.GetAllMediaMetadata: %w", err)
+	}
+
+	// referenced tracks whether the file for each hash exists on disk.
+	referenced := make(map[types.Base64Hash]bool)
+	for _, mediaMetadata := range media {
+		// Quarantined media is never served, so it doesn't need a file and
+		// doesn't keep one from being orphaned.
+		quarantined, qErr := db.IsMediaQuarantined(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+		if qErr != nil {
+			return nil, fmt.Errorf("db.IsMediaQuarantined: %w", qErr)
+		}
+		if quarantined {
+			continue
+		}
+		exists, seen := referenced[mediaMetadata.Base64Hash]
+		filePath, pathErr := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, absBasePath)
+		if !seen {
+			if pathErr == nil {
+				exists, err = report.checkFile(types.Path(filePath), mediaMetadata, opts)
+				if err != nil {
+					return nil, err
+				}
+			}
+			referenced[mediaMetadata.Base64Hash] = exists
+		}
+
+		if !exists {
+			report.DanglingMedia = append(report.DanglingMedia, mediaMetadata)
+			if opts.Repair {
+				if err = db.DeleteMediaMetadata(ctx, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+					return nil, fmt.Errorf("db.DeleteMediaMetadata: %w", err)
+				}
+			}
+			continue
+		}
+
+		if _, ok := report.OriginUsage[mediaMetadata.Origin]; !ok {
+			report.OriginUsage[mediaMetadata.Origin] = &Usage{}
+		}
+		report.OriginUsage[mediaMetadata.Origin].add(mediaMetadata.FileSizeBytes)
+		if mediaMetadata.UserID != "" {
+			if _, ok := report.UserUsage[mediaMetadata.UserID]; !ok {
+				report.UserUsage[mediaMetadata.UserID] = &Usage{}
+			}
+			report.UserUsage[mediaMetadata.UserID].add(mediaMetadata.FileSizeBytes)
+		}
+
+		if err = report.checkThumbnails(ctx, db, types.Path(filePath), mediaMetadata, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = report.findOrphans(absBasePath, referenced, opts); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// checkFile checks that the file for some media exists, is the expected size
+// and, if it is due a spot-check, that its contents match its hash.
+func (r *Report) checkFile(filePath types.Path, mediaMetadata *types.MediaMetadata, opts Options) (bool, error) {
+	stat, err := os.Stat(string(filePath))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("os.Stat: %w", err)
+	}
+
+	r.FilesChecked++
+	if types.FileSizeBytes(stat.Size()) != mediaMetadata.FileSizeBytes {
+		r.SizeMismatches = append(r.SizeMismatches, filePath)
+	}
+	if opts.HashCheckEvery > 0 && r.FilesChecked%opts.HashCheckEvery == 0 {
+		hash, hashErr := hashFile(filePath)
+		if hashErr != nil {
+			return false, hashErr
+		}
+		r.HashesChecked++
+		if hash != mediaMetadata.Base64Hash {
+			r.HashMismatches = append(r.HashMismatches, filePath)
+		}
+	}
+	return true, nil
+}
+
+// checkThumbnails finds the thumbnails of some media whose files are missing.
+func (r *Report) checkThumbnails(
+	ctx context.Context, db storage.Database, filePath types.Path, mediaMetadata *types.MediaMetadata, opts Options,
+) error {
+	thumbnails, err := db.GetThumbnails(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return fmt.Errorf("db.GetThumbnails: %w", err)
+	}
+	for _, thumbnail := range thumbnails {
+		thumbnailPath := thumbnailer.GetThumbnailPath(filePath, thumbnail.ThumbnailSize)
+		if _, err = os.Stat(string(thumbnailPath)); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("os.Stat: %w", err)
+		}
+		r.DanglingThumbnails = append(r.DanglingThumbnails, thumbnail)
+		if opts.Repair {
+			err = db.DeleteThumbnail(
+				ctx, mediaMetadata.MediaID, mediaMetadata.Origin,
+				thumbnail.ThumbnailSize.Width, thumbnail.ThumbnailSize.Height, thumbnail.ThumbnailSize.ResizeMethod,
+			)
+			if err != nil {
+				return fmt.Errorf("db.DeleteThumbnail: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// findOrphans walks the media repository looking for files stored under a
+// hash which no media refers to. Anything that isn't laid out the way
+// fileutils.GetPathFromBase64Hash would lay it out is left alone, as are the
+// temporary files of uploads and downloads which are still in progress.
+func (r *Report) findOrphans(absBasePath config.Path, referenced map[types.Base64Hash]bool, opts Options) error {
+	return filepath.Walk(string(absBasePath), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(string(absBasePath), path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if rel == "tmp" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		parts := strings.Split(filepath.ToSlash(filepath.Dir(rel)), "/")
+		if len(parts) != 3 || len(parts[0]) != 1 || len(parts[1]) != 1 {
+			return nil
+		}
+		if referenced[types.Base64Hash(strings.Join(parts, ""))] {
+			return nil
+		}
+		r.OrphanedFiles = append(r.OrphanedFiles, types.Path(path))
+		r.OrphanedBytes += types.FileSizeBytes(info.Size())
+		if opts.Repair {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+			// Tidy up the directories the file was in, stopping at the first
+			// which still has something else in it.
+			for dir := filepath.Dir(path); dir != string(absBasePath); dir = filepath.Dir(dir) {
+				if os.Remove(dir) != nil {
+					break
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func hashFile(filePath types.Path) (types.Base64Hash, error) {
+	file, err := os.Open(string(filePath))
+	if err != nil {
+		return "", fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("io.Copy: %w", err)
+	}
+	return types.Base64Hash(base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))), nil
+}
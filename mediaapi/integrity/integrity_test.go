@@ -0,0 +1,175 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integrity
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/sirupsen/logrus"
+)
+
+var ctx = context.Background()
+
+func mustStoreFile(
+	t *testing.T, db storage.Database, absBasePath config.Path, mediaID types.MediaID, userID types.MatrixUserID, content []byte,
+) *types.MediaMetadata {
+	hash, size, tmpDir, err := fileutils.WriteTempFile(bytes.NewReader(content), config.FileSizeBytes(len(content)), absBasePath)
+	if err != nil {
+		t.Fatalf("fileutils.WriteTempFile: %s", err)
+	}
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:       mediaID,
+		Origin:        "localhost",
+		ContentType:   "text/plain",
+		FileSizeBytes: size,
+		UploadName:    "file.txt",
+		Base64Hash:    hash,
+		UserID:        userID,
+	}
+	if _, _, err = fileutils.MoveFileWithHashCheck(tmpDir, mediaMetadata, absBasePath, logrus.WithField("test", t.Name())); err != nil {
+		t.Fatalf("fileutils.MoveFileWithHashCheck: %s", err)
+	}
+	if err = db.StoreMediaMetadata(ctx, mediaMetadata); err != nil {
+		t.Fatalf("db.StoreMediaMetadata: %s", err)
+	}
+	return mediaMetadata
+}
+
+func mustFilePath(t *testing.T, mediaMetadata *types.MediaMetadata, absBasePath config.Path) string {
+	filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, absBasePath)
+	if err != nil {
+		t.Fatalf("fileutils.GetPathFromBase64Hash: %s", err)
+	}
+	return filePath
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mediaapi-integrity")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	absBasePath := config.Path(filepath.Join(dir, "media"))
+	db, err := storage.Open("file:"+filepath.Join(dir, "mediaapi.db"), nil)
+	if err != nil {
+		t.Fatalf("storage.Open: %s", err)
+	}
+
+	alice := types.MatrixUserID("@alice:localhost")
+	bob := types.MatrixUserID("@bob:localhost")
+	good := mustStoreFile(t, db, absBasePath, "good", alice, []byte("good"))
+	// the same file uploaded twice is only stored once but counts twice
+	mustStoreFile(t, db, absBasePath, "duplicate", bob, []byte("good"))
+	corrupt := mustStoreFile(t, db, absBasePath, "corrupt", alice, []byte("corrupt"))
+	missing := mustStoreFile(t, db, absBasePath, "missing", bob, []byte("missing"))
+
+	// a thumbnail whose file has gone missing
+	thumbnail := &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{
+			MediaID:       good.MediaID,
+			Origin:        good.Origin,
+			ContentType:   "image/png",
+			FileSizeBytes: 1,
+		},
+		ThumbnailSize: types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: "crop"},
+	}
+	if err = db.StoreThumbnail(ctx, thumbnail); err != nil {
+		t.Fatalf("db.StoreThumbnail: %s", err)
+	}
+
+	if err = ioutil.WriteFile(mustFilePath(t, corrupt, absBasePath), []byte("CORRUPT"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile: %s", err)
+	}
+	if err = os.Remove(mustFilePath(t, missing, absBasePath)); err != nil {
+		t.Fatalf("os.Remove: %s", err)
+	}
+	orphan := &types.MediaMetadata{Base64Hash: "orphanedfilehash"}
+	orphanPath := mustFilePath(t, orphan, absBasePath)
+	if err = os.MkdirAll(filepath.Dir(orphanPath), 0770); err != nil {
+		t.Fatalf("os.MkdirAll: %s", err)
+	}
+	if err = ioutil.WriteFile(orphanPath, []byte("orphan"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile: %s", err)
+	}
+	orphanThumbnailPath := string(thumbnailer.GetThumbnailPath(types.Path(orphanPath), thumbnail.ThumbnailSize))
+	if err = ioutil.WriteFile(orphanThumbnailPath, []byte("o"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile: %s", err)
+	}
+
+	// without repairing, everything is reported but nothing is removed
+	report, err := Check(ctx, db, absBasePath, Options{HashCheckEvery: 1})
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+	if report.FilesChecked != 2 || report.HashesChecked != 2 {
+		t.Errorf("got %d files checked and %d hashed, want 2 and 2", report.FilesChecked, report.HashesChecked)
+	}
+	if len(report.HashMismatches) != 1 || string(report.HashMismatches[0]) != mustFilePath(t, corrupt, absBasePath) {
+		t.Errorf("got hash mismatches %v, want the corrupt file", report.HashMismatches)
+	}
+	if len(report.SizeMismatches) != 0 {
+		t.Errorf("got size mismatches %v, want none", report.SizeMismatches)
+	}
+	if len(report.DanglingMedia) != 1 || report.DanglingMedia[0].MediaID != missing.MediaID {
+		t.Errorf("got dangling media %v, want %s", report.DanglingMedia, missing.MediaID)
+	}
+	if len(report.DanglingThumbnails) != 1 {
+		t.Errorf("got %d dangling thumbnails, want 1", len(report.DanglingThumbnails))
+	}
+	if len(report.OrphanedFiles) != 2 || report.OrphanedBytes != 7 {
+		t.Errorf("got orphaned files %v taking %d bytes, want 2 taking 7", report.OrphanedFiles, report.OrphanedBytes)
+	}
+	if u := report.OriginUsage["localhost"]; u == nil || u.Files != 3 || u.Bytes != 15 {
+		t.Errorf("got origin usage %+v, want 3 files and 15 bytes", u)
+	}
+	if u := report.UserUsage[alice]; u == nil || u.Files != 2 || u.Bytes != 11 {
+		t.Errorf("got usage for %s %+v, want 2 files and 11 bytes", alice, u)
+	}
+	if u := report.UserUsage[bob]; u == nil || u.Files != 1 || u.Bytes != 4 {
+		t.Errorf("got usage for %s %+v, want 1 file and 4 bytes", bob, u)
+	}
+	if _, err = os.Stat(orphanPath); err != nil {
+		t.Errorf("orphaned file was removed without repairing: %s", err)
+	}
+
+	// repairing removes the orphans and the dangling metadata, after which
+	// there should be nothing left to repair
+	if _, err = Check(ctx, db, absBasePath, Options{Repair: true}); err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+	if _, err = os.Stat(filepath.Dir(orphanPath)); !os.IsNotExist(err) {
+		t.Errorf("expected directory of orphaned file to be removed, got %v", err)
+	}
+	if mediaMetadata, _ := db.GetMediaMetadata(ctx, missing.MediaID, missing.Origin); mediaMetadata != nil {
+		t.Errorf("expected metadata for missing file to be removed")
+	}
+	report, err = Check(ctx, db, absBasePath, Options{})
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+	if len(report.DanglingMedia) != 0 || len(report.DanglingThumbnails) != 0 || len(report.OrphanedFiles) != 0 {
+		t.Errorf("expected nothing left to repair, got %+v", report)
+	}
+}
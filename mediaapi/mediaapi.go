@@ -16,6 +16,7 @@ package mediaapi
 
 import (
 	"github.com/gorilla/mux"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
@@ -28,6 +29,7 @@ import (
 func AddPublicRoutes(
 	router *mux.Router, cfg *config.Dendrite,
 	userAPI userapi.UserInternalAPI,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
 	client *gomatrixserverlib.Client,
 ) {
 	mediaDB, err := storage.Open(string(cfg.Database.MediaAPI), cfg.DbProperties())
@@ -36,6 +38,6 @@ func AddPublicRoutes(
 	}
 
 	routing.Setup(
-		router, cfg, mediaDB, userAPI, client,
+		router, cfg, mediaDB, userAPI, fsAPI, client,
 	)
 }
@@ -0,0 +1,146 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package moderation deletes and quarantines media. Media with the same
+// content share a file, so the file is only removed from disk once nothing
+// which can still be served refers to it.
+package moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// ErrMediaNotFound is returned when the media to delete or quarantine isn't
+// known to the media repository.
+var ErrMediaNotFound = errors.New("media not found")
+
+// DeleteMedia forgets about some media entirely, removing its file and
+// thumbnails if no other media shares them.
+func DeleteMedia(
+	ctx context.Context, db storage.Database, absBasePath config.Path,
+	mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return fmt.Errorf("db.GetMediaMetadata: %w", err)
+	}
+	if mediaMetadata == nil {
+		return ErrMediaNotFound
+	}
+	if err = db.DeleteMediaMetadata(ctx, mediaID, mediaOrigin); err != nil {
+		return fmt.Errorf("db.DeleteMediaMetadata: %w", err)
+	}
+	return removeUnreferencedFile(ctx, db, absBasePath, mediaMetadata.Base64Hash)
+}
+
+// QuarantineMedia stops some media from being served. Its metadata is kept so
+// that quarantined remote media isn't fetched again, but its file and
+// thumbnails are removed if no other media which can be served shares them.
+func QuarantineMedia(
+	ctx context.Context, db storage.Database, absBasePath config.Path,
+	mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return fmt.Errorf("db.GetMediaMetadata: %w", err)
+	}
+	if mediaMetadata == nil {
+		return ErrMediaNotFound
+	}
+	if err = db.QuarantineMedia(ctx, mediaID, mediaOrigin); err != nil {
+		return fmt.Errorf("db.QuarantineMedia: %w", err)
+	}
+	return removeUnreferencedFile(ctx, db, absBasePath, mediaMetadata.Base64Hash)
+}
+
+// removeUnreferencedFile removes the directory holding the file with the given
+// hash, along with its thumbnails, once no media refers to it any more.
+func removeUnreferencedFile(
+	ctx context.Context, db storage.Database, absBasePath config.Path, base64Hash types.Base64Hash,
+) error {
+	unlock := fileutils.LockHash(base64Hash)
+	defer unlock()
+	count, err := db.GetMediaReferenceCount(ctx, base64Hash)
+	if err != nil {
+		return fmt.Errorf("db.GetMediaReferenceCount: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(base64Hash, absBasePath)
+	if err != nil {
+		return fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
+	}
+	if err = os.RemoveAll(filepath.Dir(filePath)); err != nil {
+		return fmt.Errorf("os.RemoveAll: %w", err)
+	}
+	return nil
+}
+
+// evictionBatchSize is the number of least recently used media looked up at a
+// time when evicting remote media from the cache.
+const evictionBatchSize = 50
+
+// EvictRemoteMedia removes the least recently used media fetched from other
+// servers until the remote media takes up no more than maxCacheSizeBytes.
+// Returns the number of media which were removed.
+func EvictRemoteMedia(
+	ctx context.Context, db storage.Database, absBasePath config.Path,
+	localServerName gomatrixserverlib.ServerName, maxCacheSizeBytes config.FileSizeBytes,
+) (evicted int, err error) {
+	var size types.FileSizeBytes
+	var media []*types.MediaMetadata
+	for {
+		size, err = db.GetRemoteMediaSize(ctx, localServerName)
+		if err != nil {
+			return evicted, fmt.Errorf("db.GetRemoteMediaSize: %w", err)
+		}
+		if size <= types.FileSizeBytes(maxCacheSizeBytes) {
+			return evicted, nil
+		}
+		media, err = db.GetLeastRecentlyUsedRemoteMedia(ctx, localServerName, evictionBatchSize)
+		if err != nil {
+			return evicted, fmt.Errorf("db.GetLeastRecentlyUsedRemoteMedia: %w", err)
+		}
+		if len(media) == 0 {
+			return evicted, nil
+		}
+		for _, mediaMetadata := range media {
+			err = DeleteMedia(ctx, db, absBasePath, mediaMetadata.MediaID, mediaMetadata.Origin)
+			if err == nil {
+				evicted++
+			} else if err != ErrMediaNotFound {
+				return evicted, err
+			}
+			// Media can share a file, so removing this one may not have freed
+			// up as much space as it takes up.
+			if size, err = db.GetRemoteMediaSize(ctx, localServerName); err != nil {
+				return evicted, fmt.Errorf("db.GetRemoteMediaSize: %w", err)
+			}
+			if size <= types.FileSizeBytes(maxCacheSizeBytes) {
+				return evicted, nil
+			}
+		}
+	}
+}
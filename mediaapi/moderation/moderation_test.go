@@ -0,0 +1,210 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+var ctx = context.Background()
+
+// storeFile stores the content as the given media in the same way as an upload.
+func storeFile(
+	db storage.Database, absBasePath config.Path,
+	mediaID types.MediaID, origin gomatrixserverlib.ServerName, content []byte,
+) (string, error) {
+	hash, size, tmpDir, err := fileutils.WriteTempFile(bytes.NewReader(content), config.FileSizeBytes(len(content)), absBasePath)
+	if err != nil {
+		return "", fmt.Errorf("fileutils.WriteTempFile: %w", err)
+	}
+	mediaMetadata := &types.MediaMetadata{
+		MediaID:       mediaID,
+		Origin:        origin,
+		ContentType:   "image/png",
+		FileSizeBytes: size,
+		Base64Hash:    hash,
+	}
+	unlock := fileutils.LockHash(hash)
+	defer unlock()
+	filePath, _, err := fileutils.MoveFileWithHashCheck(tmpDir, mediaMetadata, absBasePath, logrus.WithField("media_id", mediaID))
+	if err != nil {
+		return "", fmt.Errorf("fileutils.MoveFileWithHashCheck: %w", err)
+	}
+	if err = db.StoreMediaMetadata(ctx, mediaMetadata); err != nil {
+		return "", fmt.Errorf("db.StoreMediaMetadata: %w", err)
+	}
+	return string(filePath), nil
+}
+
+func mustStoreFile(
+	t *testing.T, db storage.Database, absBasePath config.Path,
+	mediaID types.MediaID, origin gomatrixserverlib.ServerName, content []byte,
+) string {
+	filePath, err := storeFile(db, absBasePath, mediaID, origin, content)
+	if err != nil {
+		t.Fatalf("storeFile: %s", err)
+	}
+	return filePath
+}
+
+func mustOpenDatabase(t *testing.T) (db storage.Database, absBasePath config.Path, cleanup func()) {
+	dir, err := ioutil.TempDir("", "mediaapi-moderation")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	db, err = storage.Open("file:"+filepath.Join(dir, "mediaapi.db"), nil)
+	if err != nil {
+		t.Fatalf("storage.Open: %s", err)
+	}
+	return db, config.Path(filepath.Join(dir, "media")), func() {
+		os.RemoveAll(dir) // nolint: errcheck
+	}
+}
+
+func TestDeleteAndQuarantineSharedMedia(t *testing.T) {
+	db, absBasePath, cleanup := mustOpenDatabase(t)
+	defer cleanup()
+
+	// the same sticker uploaded three times is stored once
+	filePath := mustStoreFile(t, db, absBasePath, "first", "localhost", []byte("sticker"))
+	for _, mediaID := range []types.MediaID{"second", "third"} {
+		if p := mustStoreFile(t, db, absBasePath, mediaID, "localhost", []byte("sticker")); p != filePath {
+			t.Fatalf("got file path %s for duplicate upload, want %s", p, filePath)
+		}
+	}
+
+	err := DeleteMedia(ctx, db, absBasePath, "first", "localhost")
+	if err != nil {
+		t.Fatalf("DeleteMedia: %s", err)
+	}
+	if _, err = os.Stat(filePath); err != nil {
+		t.Fatalf("file was removed while still referenced: %s", err)
+	}
+	if err = QuarantineMedia(ctx, db, absBasePath, "second", "localhost"); err != nil {
+		t.Fatalf("QuarantineMedia: %s", err)
+	}
+	if _, err = os.Stat(filePath); err != nil {
+		t.Fatalf("file was removed while still referenced: %s", err)
+	}
+	quarantined, err := db.IsMediaQuarantined(ctx, "second", "localhost")
+	if err != nil || !quarantined {
+		t.Fatalf("got quarantined %v (err %v), want true", quarantined, err)
+	}
+
+	// once the last servable reference goes, so does the file, but the
+	// quarantined media is still remembered
+	if err = DeleteMedia(ctx, db, absBasePath, "third", "localhost"); err != nil {
+		t.Fatalf("DeleteMedia: %s", err)
+	}
+	if _, err = os.Stat(filepath.Dir(filePath)); !os.IsNotExist(err) {
+		t.Fatalf("expected directory of unreferenced file to be removed, got %v", err)
+	}
+	if mediaMetadata, _ := db.GetMediaMetadata(ctx, "second", "localhost"); mediaMetadata == nil {
+		t.Fatalf("expected quarantined media metadata to be kept")
+	}
+
+	if err = DeleteMedia(ctx, db, absBasePath, "first", "localhost"); err != ErrMediaNotFound {
+		t.Fatalf("got %v deleting media twice, want %v", err, ErrMediaNotFound)
+	}
+}
+
+func TestStoreWhileDeletingSharedMedia(t *testing.T) {
+	db, absBasePath, cleanup := mustOpenDatabase(t)
+	defer cleanup()
+
+	// each time round, the same sticker is uploaded again while the previous
+	// upload of it is deleted, and the new upload must keep its file
+	prevMediaID := types.MediaID("sticker0")
+	filePath := mustStoreFile(t, db, absBasePath, prevMediaID, "localhost", []byte("sticker"))
+	for i := 1; i <= 20; i++ {
+		mediaID := types.MediaID(fmt.Sprintf("sticker%d", i))
+		var wg sync.WaitGroup
+		var storeErr, deleteErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, storeErr = storeFile(db, absBasePath, mediaID, "localhost", []byte("sticker"))
+		}()
+		go func() {
+			defer wg.Done()
+			deleteErr = DeleteMedia(ctx, db, absBasePath, prevMediaID, "localhost")
+		}()
+		wg.Wait()
+		if storeErr != nil {
+			t.Fatalf("storeFile: %s", storeErr)
+		}
+		if deleteErr != nil {
+			t.Fatalf("DeleteMedia: %s", deleteErr)
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			t.Fatalf("file of %s was removed while still referenced: %s", mediaID, err)
+		}
+		prevMediaID = mediaID
+	}
+}
+
+func TestEvictRemoteMedia(t *testing.T) {
+	db, absBasePath, cleanup := mustOpenDatabase(t)
+	defer cleanup()
+
+	localPath := mustStoreFile(t, db, absBasePath, "local", "localhost", []byte("local"))
+	mustStoreFile(t, db, absBasePath, "old1", "remote", []byte("old_1"))
+	mustStoreFile(t, db, absBasePath, "old2", "remote", []byte("old_2"))
+	recentPath := mustStoreFile(t, db, absBasePath, "recent", "remote", []byte("recent"))
+	// the same file from another server only takes up space once
+	mustStoreFile(t, db, absBasePath, "recent", "other", []byte("recent"))
+	for _, origin := range []gomatrixserverlib.ServerName{"remote", "other"} {
+		if err := db.MarkMediaAccessed(ctx, "recent", origin); err != nil {
+			t.Fatalf("db.MarkMediaAccessed: %s", err)
+		}
+	}
+
+	size, err := db.GetRemoteMediaSize(ctx, "localhost")
+	if err != nil || size != 16 {
+		t.Fatalf("got remote media size %d (err %v), want 16", size, err)
+	}
+	evicted, err := EvictRemoteMedia(ctx, db, absBasePath, "localhost", 11)
+	if err != nil {
+		t.Fatalf("EvictRemoteMedia: %s", err)
+	}
+	if evicted != 1 {
+		t.Errorf("got %d media evicted, want 1", evicted)
+	}
+	if size, err = db.GetRemoteMediaSize(ctx, "localhost"); err != nil || size != 11 {
+		t.Errorf("got remote media size %d (err %v) after eviction, want 11", size, err)
+	}
+	for _, p := range []string{localPath, recentPath} {
+		if _, err = os.Stat(p); err != nil {
+			t.Errorf("expected %s to be kept: %s", p, err)
+		}
+	}
+	if mediaMetadata, _ := db.GetMediaMetadata(ctx, "recent", "remote"); mediaMetadata == nil {
+		t.Errorf("expected recently used media to be kept")
+	}
+}
@@ -31,8 +31,10 @@ import (
 	"unicode"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/moderation"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -76,6 +78,7 @@ func Download(
 	cfg *config.Dendrite,
 	db storage.Database,
 	client *gomatrixserverlib.Client,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	isThumbnailRequest bool,
@@ -122,7 +125,7 @@ func Download(
 	}
 
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
+		req.Context(), w, cfg, db, client, fsAPI,
 		activeRemoteRequests, activeThumbnailGeneration,
 	)
 	if err != nil {
@@ -150,7 +153,10 @@ func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSON
 	if err != nil {
 		r.Logger.WithError(err).Error("Failed to marshal JSONResponse")
 		// this should never fail to be marshalled so drop err to the floor
-		res = util.MessageResponse(http.StatusNotFound, "Download request failed: "+err.Error())
+		res = util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Download request failed: " + err.Error()),
+		}
 		resBytes, _ = json.Marshal(res.JSON)
 	}
 
@@ -206,6 +212,7 @@ func (r *downloadRequest) doDownload(
 	cfg *config.Dendrite,
 	db storage.Database,
 	client *gomatrixserverlib.Client,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (*types.MediaMetadata, error) {
@@ -221,6 +228,22 @@ func (r *downloadRequest) doDownload(
 			// If we do not have a record and the origin is local, the file is not found
 			return nil, nil
 		}
+		if cfg.Media.RemoteMedia.RequireSharedRoom {
+			var res federationSenderAPI.QueryServerSharesRoomResponse
+			if err = fsAPI.QueryServerSharesRoom(ctx, &federationSenderAPI.QueryServerSharesRoomRequest{
+				ServerName: r.MediaMetadata.Origin,
+			}, &res); err != nil {
+				return nil, errors.Wrap(err, "error querying the federation sender")
+			}
+			if !res.SharesRoom {
+				r.Logger.Info("Not fetching remote file from a server which doesn't share a room with us")
+				return nil, nil
+			}
+		}
+		if cfg.Media.RemoteMedia.DisableCaching {
+			// Pass the remote file straight through without keeping a copy
+			return r.respondFromRemoteFile(ctx, w, client, *cfg.Media.MaxFileSizeBytes)
+		}
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
 			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
@@ -228,15 +251,56 @@ func (r *downloadRequest) doDownload(
 		if resErr != nil {
 			return nil, resErr
 		}
+		if cfg.Media.RemoteMedia.MaxCacheSizeBytes > 0 {
+			go evictRemoteMedia(cfg, db, r.Logger)
+		}
 	} else {
+		// Quarantined media keeps its record so that it isn't fetched again
+		// from a remote server, but it is never served.
+		quarantined, qErr := db.IsMediaQuarantined(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+		if qErr != nil {
+			return nil, errors.Wrap(qErr, "error querying the database")
+		}
+		if quarantined {
+			return nil, nil
+		}
 		// If we have a record, we can respond from the local file
 		r.MediaMetadata = mediaMetadata
 	}
-	return r.respondFromLocalFile(
+	metadata, err := r.respondFromLocalFile(
 		ctx, w, cfg.Media.AbsBasePath, activeThumbnailGeneration,
 		cfg.Media.MaxThumbnailGenerators, db,
 		cfg.Media.DynamicThumbnails, cfg.Media.ThumbnailSizes,
 	)
+	if err == nil && metadata != nil && r.MediaMetadata.Origin != cfg.Matrix.ServerName {
+		// Keep track of when cached remote media was last used, so that the
+		// least recently used media can be evicted from the cache first.
+		if accessErr := db.MarkMediaAccessed(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin); accessErr != nil {
+			r.Logger.WithError(accessErr).Warn("Failed to mark remote media as accessed")
+		}
+	}
+	return metadata, err
+}
+
+// remoteMediaEviction makes sure only one eviction from the remote media
+// cache happens at a time.
+var remoteMediaEviction sync.Mutex
+
+// evictRemoteMedia removes the least recently used remote media from the cache
+// until it is within media.remote_media.max_cache_size_bytes again.
+func evictRemoteMedia(cfg *config.Dendrite, db storage.Database, logger *log.Entry) {
+	remoteMediaEviction.Lock()
+	defer remoteMediaEviction.Unlock()
+	evicted, err := moderation.EvictRemoteMedia(
+		context.Background(), db, cfg.Media.AbsBasePath,
+		cfg.Matrix.ServerName, cfg.Media.RemoteMedia.MaxCacheSizeBytes,
+	)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to evict remote media from the cache")
+	}
+	if evicted > 0 {
+		logger.WithField("evicted", evicted).Info("Evicted remote media from the cache")
+	}
 }
 
 // respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
@@ -314,6 +378,52 @@ func (r *downloadRequest) respondFromLocalFile(
 		}
 	}
 
+	setMediaHeaders(w, responseMetadata)
+
+	if _, err := io.Copy(w, responseFile); err != nil {
+		return nil, errors.Wrap(err, "failed to copy from cache")
+	}
+	return responseMetadata, nil
+}
+
+// respondFromRemoteFile fetches a file from the remote server and writes it
+// straight to the http.ResponseWriter without storing it. Thumbnails can't
+// be generated without storing the file, so the whole file is always sent.
+// If no file was found then returns nil, nil
+func (r *downloadRequest) respondFromRemoteFile(
+	ctx context.Context,
+	w http.ResponseWriter,
+	client *gomatrixserverlib.Client,
+	maxFileSizeBytes config.FileSizeBytes,
+) (*types.MediaMetadata, error) {
+	r.Logger.Info("Passing through remote file")
+
+	resp, err := r.createRemoteRequest(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		// Remote file not found
+		return nil, nil
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if err = r.setMetadataFromRemoteResponse(resp, maxFileSizeBytes); err != nil {
+		return nil, err
+	}
+	if err = r.addDownloadFilenameToHeaders(w, r.MediaMetadata); err != nil {
+		return nil, err
+	}
+	setMediaHeaders(w, r.MediaMetadata)
+
+	if _, err = io.Copy(w, io.LimitReader(resp.Body, int64(r.MediaMetadata.FileSizeBytes))); err != nil {
+		return nil, errors.Wrap(err, "failed to copy from remote server")
+	}
+	return r.MediaMetadata, nil
+}
+
+// setMediaHeaders sets the headers for responding with a file
+func setMediaHeaders(w http.ResponseWriter, responseMetadata *types.MediaMetadata) {
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
@@ -322,11 +432,6 @@ func (r *downloadRequest) respondFromLocalFile(
 		" style-src 'unsafe-inline';" +
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
-
-	if _, err := io.Copy(w, responseFile); err != nil {
-		return nil, errors.Wrap(err, "failed to copy from cache")
-	}
-	return responseMetadata, nil
 }
 
 func (r *downloadRequest) addDownloadFilenameToHeaders(
@@ -622,13 +727,31 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) error {
-	finalPath, duplicate, err := r.fetchRemoteFile(
+	tmpDir, err := r.fetchRemoteFile(
 		ctx, client, absBasePath, maxFileSizeBytes,
 	)
 	if err != nil {
 		return err
 	}
 
+	// Hold the lock until the metadata is stored, so that the file can't be
+	// removed in between for having nothing referring to it.
+	unlock := fileutils.LockHash(r.MediaMetadata.Base64Hash)
+	defer unlock()
+	var finalPath types.Path
+	var duplicate bool
+	if tmpDir != "" {
+		// The database is the source of truth so we need to have moved the file first
+		finalPath, duplicate, err = fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+		if err != nil {
+			return errors.Wrap(err, "failed to move file")
+		}
+		if duplicate {
+			r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+			// Continue on to store the metadata in the database
+		}
+	}
+
 	r.Logger.WithFields(log.Fields{
 		"Base64Hash":    r.MediaMetadata.Base64Hash,
 		"UploadName":    r.MediaMetadata.UploadName,
@@ -673,53 +796,30 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	return nil
 }
 
+// fetchRemoteFile fetches the file from the remote server into a temporary
+// directory, which is returned. The path is empty if the remote server doesn't
+// have the file.
 func (r *downloadRequest) fetchRemoteFile(
 	ctx context.Context,
 	client *gomatrixserverlib.Client,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
-) (types.Path, bool, error) {
+) (types.Path, error) {
 	r.Logger.Info("Fetching remote file")
 
 	// create request for remote file
 	resp, err := r.createRemoteRequest(ctx, client)
 	if err != nil {
-		return "", false, err
+		return "", err
 	}
 	if resp == nil {
 		// Remote file not found
-		return "", false, nil
+		return "", nil
 	}
 	defer resp.Body.Close() // nolint: errcheck
 
-	// get metadata from request and set metadata on response
-	contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	if err != nil {
-		r.Logger.WithError(err).Warn("Failed to parse content length")
-		return "", false, errors.Wrap(err, "invalid response from remote server")
-	}
-	if contentLength > int64(maxFileSizeBytes) {
-		// TODO: Bubble up this as a 413
-		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
-	}
-	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
-	r.MediaMetadata.ContentType = types.ContentType(resp.Header.Get("Content-Type"))
-
-	dispositionHeader := resp.Header.Get("Content-Disposition")
-	if _, params, e := mime.ParseMediaType(dispositionHeader); e == nil {
-		if params["filename"] != "" {
-			r.MediaMetadata.UploadName = types.Filename(params["filename"])
-		} else if params["filename*"] != "" {
-			r.MediaMetadata.UploadName = types.Filename(params["filename*"])
-		}
-	} else {
-		if matches := rfc6266.FindStringSubmatch(dispositionHeader); len(matches) > 1 {
-			// Always prefer the RFC6266 UTF-8 name if possible
-			r.MediaMetadata.UploadName = types.Filename(matches[1])
-		} else if matches := rfc2183.FindStringSubmatch(dispositionHeader); len(matches) > 1 {
-			// Otherwise, see if an RFC2183 name was provided (ASCII only)
-			r.MediaMetadata.UploadName = types.Filename(matches[1])
-		}
+	if err = r.setMetadataFromRemoteResponse(resp, maxFileSizeBytes); err != nil {
+		return "", err
 	}
 
 	r.Logger.Info("Transferring remote file")
@@ -734,7 +834,7 @@ func (r *downloadRequest) fetchRemoteFile(
 			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while downloading file from remote server")
 		fileutils.RemoveDir(tmpDir, r.Logger)
-		return "", false, errors.New("file could not be downloaded from remote server")
+		return "", errors.New("file could not be downloaded from remote server")
 	}
 
 	r.Logger.Info("Remote file transferred")
@@ -745,17 +845,44 @@ func (r *downloadRequest) fetchRemoteFile(
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(bytesWritten)
 	r.MediaMetadata.Base64Hash = hash
 
-	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	return tmpDir, nil
+}
+
+// setMetadataFromRemoteResponse fills in the media metadata from the headers
+// of the remote server's response.
+func (r *downloadRequest) setMetadataFromRemoteResponse(
+	resp *http.Response, maxFileSizeBytes config.FileSizeBytes,
+) error {
+	// get metadata from request and set metadata on response
+	contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 	if err != nil {
-		return "", false, errors.Wrap(err, "failed to move file")
+		r.Logger.WithError(err).Warn("Failed to parse content length")
+		return errors.Wrap(err, "invalid response from remote server")
 	}
-	if duplicate {
-		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
-		// Continue on to store the metadata in the database
+	if contentLength > int64(maxFileSizeBytes) {
+		// TODO: Bubble up this as a 413
+		return fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
 	}
+	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
+	r.MediaMetadata.ContentType = types.ContentType(resp.Header.Get("Content-Type"))
 
-	return types.Path(finalPath), duplicate, nil
+	dispositionHeader := resp.Header.Get("Content-Disposition")
+	if _, params, e := mime.ParseMediaType(dispositionHeader); e == nil {
+		if params["filename"] != "" {
+			r.MediaMetadata.UploadName = types.Filename(params["filename"])
+		} else if params["filename*"] != "" {
+			r.MediaMetadata.UploadName = types.Filename(params["filename*"])
+		}
+	} else {
+		if matches := rfc6266.FindStringSubmatch(dispositionHeader); len(matches) > 1 {
+			// Always prefer the RFC6266 UTF-8 name if possible
+			r.MediaMetadata.UploadName = types.Filename(matches[1])
+		} else if matches := rfc2183.FindStringSubmatch(dispositionHeader); len(matches) > 1 {
+			// Otherwise, see if an RFC2183 name was provided (ASCII only)
+			r.MediaMetadata.UploadName = types.Filename(matches[1])
+		}
+	}
+	return nil
 }
 
 func (r *downloadRequest) createRemoteRequest(
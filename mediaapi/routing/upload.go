@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -30,6 +31,7 @@ import (
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
@@ -54,8 +56,8 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.Dendrite, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
-	r, resErr := parseAndValidateRequest(req, cfg)
+func Upload(req *http.Request, cfg *config.Dendrite, device *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+	r, resErr := parseAndValidateRequest(req, cfg, device)
 	if resErr != nil {
 		return *resErr
 	}
@@ -75,13 +77,14 @@ func Upload(req *http.Request, cfg *config.Dendrite, db storage.Database, active
 // parseAndValidateRequest parses the incoming upload request to validate and extract
 // all the metadata about the media being uploaded.
 // Returns either an uploadRequest or an error formatted as a util.JSONResponse
-func parseAndValidateRequest(req *http.Request, cfg *config.Dendrite) (*uploadRequest, *util.JSONResponse) {
+func parseAndValidateRequest(req *http.Request, cfg *config.Dendrite, device *userapi.Device) (*uploadRequest, *util.JSONResponse) {
 	r := &uploadRequest{
 		MediaMetadata: &types.MediaMetadata{
 			Origin:        cfg.Matrix.ServerName,
 			FileSizeBytes: types.FileSizeBytes(req.ContentLength),
 			ContentType:   types.ContentType(req.Header.Get("Content-Type")),
 			UploadName:    types.Filename(url.PathEscape(req.FormValue("filename"))),
+			UserID:        types.MatrixUserID(device.UserID),
 		},
 		Logger: util.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
 	}
@@ -106,7 +109,7 @@ func (r *uploadRequest) doUpload(
 		"ContentType":   r.MediaMetadata.ContentType,
 	}).Info("Uploading file")
 
-	// The file data is hashed and the hash is used as the MediaID. The hash is useful as a
+	// The file data is hashed and the file is stored under its hash. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
 	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
@@ -124,9 +127,13 @@ func (r *uploadRequest) doUpload(
 
 	r.MediaMetadata.FileSizeBytes = bytesWritten
 	r.MediaMetadata.Base64Hash = hash
-	r.MediaMetadata.MediaID = types.MediaID(base64.RawURLEncoding.EncodeToString(
-		[]byte(string(r.MediaMetadata.UploadName) + string(r.MediaMetadata.Base64Hash)),
+	// Identical files uploaded by different users share the same file on disk but
+	// are given different MediaIDs, so that each upload is attributed to the user
+	// who made it and deleting or quarantining one of them doesn't affect the others.
+	mediaIDHash := sha256.Sum256([]byte(
+		string(r.MediaMetadata.UserID) + "\x00" + string(r.MediaMetadata.UploadName) + "\x00" + string(r.MediaMetadata.Base64Hash),
 	))
+	r.MediaMetadata.MediaID = types.MediaID(base64.RawURLEncoding.EncodeToString(mediaIDHash[:]))
 
 	r.Logger = r.Logger.WithField("MediaID", r.MediaMetadata.MediaID)
 
@@ -222,8 +229,12 @@ func (r *uploadRequest) storeFileAndMetadata(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
+	// Hold the lock until the metadata is stored, so that the file can't be
+	// removed in between for having nothing referring to it.
+	unlock := fileutils.LockHash(r.MediaMetadata.Base64Hash)
 	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
 	if err != nil {
+		unlock()
 		r.Logger.WithError(err).Error("Failed to move file.")
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -242,11 +253,13 @@ func (r *uploadRequest) storeFileAndMetadata(
 		if !duplicate {
 			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
 		}
+		unlock()
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown("Failed to upload"),
 		}
 	}
+	unlock()
 
 	go func() {
 		busy, err := thumbnailer.GenerateThumbnails(
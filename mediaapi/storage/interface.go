@@ -27,4 +27,13 @@ type Database interface {
 	StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.ThumbnailMetadata, error)
+	GetAllMediaMetadata(ctx context.Context) ([]*types.MediaMetadata, error)
+	DeleteMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	DeleteThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) error
+	QuarantineMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	IsMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (bool, error)
+	GetMediaReferenceCount(ctx context.Context, base64Hash types.Base64Hash) (int, error)
+	MarkMediaAccessed(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
+	GetRemoteMediaSize(ctx context.Context, localServerName gomatrixserverlib.ServerName) (types.FileSizeBytes, error)
+	GetLeastRecentlyUsedRemoteMedia(ctx context.Context, localServerName gomatrixserverlib.ServerName, limit int) ([]*types.MediaMetadata, error)
 }
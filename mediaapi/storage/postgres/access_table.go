@@ -0,0 +1,135 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const accessSchema = `
+-- The mediaapi_access table holds when media was last served, so that the least
+-- recently used remote media can be evicted from the cache first.
+CREATE TABLE IF NOT EXISTS mediaapi_access (
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    -- When the media was last served in UNIX epoch ms.
+    last_access_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_access_index ON mediaapi_access (media_id, media_origin);
+`
+
+const upsertAccessSQL = `
+INSERT INTO mediaapi_access (media_id, media_origin, last_access_ts)
+    VALUES ($1, $2, $3)
+    ON CONFLICT (media_id, media_origin) DO UPDATE SET last_access_ts = $3
+`
+
+const deleteAccessSQL = `
+DELETE FROM mediaapi_access WHERE media_id = $1 AND media_origin = $2
+`
+
+// Media which shares a file is only counted once. Quarantined media has no
+// file of its own, so isn't counted.
+const selectRemoteMediaSizeSQL = `
+SELECT COALESCE(SUM(file_size_bytes), 0) FROM (
+    SELECT DISTINCT base64hash, file_size_bytes FROM mediaapi_media_repository m
+    WHERE media_origin != $1 AND NOT EXISTS (
+        SELECT 1 FROM mediaapi_quarantine q WHERE q.media_id = m.media_id AND q.media_origin = m.media_origin
+    )
+) AS remote_media
+`
+
+// Media which has never been served is treated as though it was last served
+// when it was stored.
+const selectLeastRecentlyUsedRemoteMediaSQL = `
+SELECT m.media_id, m.media_origin, m.file_size_bytes, m.base64hash FROM mediaapi_media_repository m
+    LEFT JOIN mediaapi_access a ON a.media_id = m.media_id AND a.media_origin = m.media_origin
+    WHERE m.media_origin != $1 AND NOT EXISTS (
+        SELECT 1 FROM mediaapi_quarantine q WHERE q.media_id = m.media_id AND q.media_origin = m.media_origin
+    )
+    ORDER BY COALESCE(a.last_access_ts, m.creation_ts) ASC LIMIT $2
+`
+
+type accessStatements struct {
+	upsertAccessStmt                       *sql.Stmt
+	deleteAccessStmt                       *sql.Stmt
+	selectRemoteMediaSizeStmt              *sql.Stmt
+	selectLeastRecentlyUsedRemoteMediaStmt *sql.Stmt
+}
+
+func (s *accessStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(accessSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertAccessStmt, upsertAccessSQL},
+		{&s.deleteAccessStmt, deleteAccessSQL},
+		{&s.selectRemoteMediaSizeStmt, selectRemoteMediaSizeSQL},
+		{&s.selectLeastRecentlyUsedRemoteMediaStmt, selectLeastRecentlyUsedRemoteMediaSQL},
+	}.prepare(db)
+}
+
+func (s *accessStatements) upsertAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.upsertAccessStmt.ExecContext(
+		ctx, mediaID, mediaOrigin, types.UnixMs(time.Now().UnixNano()/1000000),
+	)
+	return err
+}
+
+func (s *accessStatements) deleteAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deleteAccessStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *accessStatements) selectRemoteMediaSize(
+	ctx context.Context, localServerName gomatrixserverlib.ServerName,
+) (size types.FileSizeBytes, err error) {
+	err = s.selectRemoteMediaSizeStmt.QueryRowContext(ctx, localServerName).Scan(&size)
+	return
+}
+
+func (s *accessStatements) selectLeastRecentlyUsedRemoteMedia(
+	ctx context.Context, localServerName gomatrixserverlib.ServerName, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectLeastRecentlyUsedRemoteMediaStmt.QueryContext(ctx, localServerName, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectLeastRecentlyUsedRemoteMedia: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		mediaMetadata := &types.MediaMetadata{}
+		if err = rows.Scan(
+			&mediaMetadata.MediaID, &mediaMetadata.Origin, &mediaMetadata.FileSizeBytes, &mediaMetadata.Base64Hash,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, mediaMetadata)
+	}
+	return media, rows.Err()
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const quarantineSchema = `
+-- The mediaapi_quarantine table holds the media which has been quarantined. The metadata
+-- of quarantined media is kept so that it can't be fetched again from a remote server,
+-- but it no longer holds a reference to the file.
+CREATE TABLE IF NOT EXISTS mediaapi_quarantine (
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    -- When the media was quarantined in UNIX epoch ms.
+    quarantined_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_quarantine_index ON mediaapi_quarantine (media_id, media_origin);
+`
+
+const insertQuarantineSQL = `
+INSERT INTO mediaapi_quarantine (media_id, media_origin, quarantined_ts)
+    VALUES ($1, $2, $3)
+    ON CONFLICT (media_id, media_origin) DO NOTHING
+`
+
+const selectQuarantineSQL = `
+SELECT COUNT(*) FROM mediaapi_quarantine WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteQuarantineSQL = `
+DELETE FROM mediaapi_quarantine WHERE media_id = $1 AND media_origin = $2
+`
+
+// Quarantined media doesn't count as a reference to its file.
+const selectMediaReferenceCountSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository m WHERE base64hash = $1 AND NOT EXISTS (
+    SELECT 1 FROM mediaapi_quarantine q WHERE q.media_id = m.media_id AND q.media_origin = m.media_origin
+)
+`
+
+type quarantineStatements struct {
+	insertQuarantineStmt          *sql.Stmt
+	selectQuarantineStmt          *sql.Stmt
+	deleteQuarantineStmt          *sql.Stmt
+	selectMediaReferenceCountStmt *sql.Stmt
+}
+
+func (s *quarantineStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(quarantineSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.insertQuarantineStmt, insertQuarantineSQL},
+		{&s.selectQuarantineStmt, selectQuarantineSQL},
+		{&s.deleteQuarantineStmt, deleteQuarantineSQL},
+		{&s.selectMediaReferenceCountStmt, selectMediaReferenceCountSQL},
+	}.prepare(db)
+}
+
+func (s *quarantineStatements) insertQuarantine(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.insertQuarantineStmt.ExecContext(
+		ctx, mediaID, mediaOrigin, types.UnixMs(time.Now().UnixNano()/1000000),
+	)
+	return err
+}
+
+func (s *quarantineStatements) selectQuarantine(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (bool, error) {
+	var count int
+	err := s.selectQuarantineStmt.QueryRowContext(ctx, mediaID, mediaOrigin).Scan(&count)
+	return count > 0, err
+}
+
+func (s *quarantineStatements) deleteQuarantine(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deleteQuarantineStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *quarantineStatements) selectMediaReferenceCount(
+	ctx context.Context, base64Hash types.Base64Hash,
+) (count int, err error) {
+	err = s.selectMediaReferenceCountStmt.QueryRowContext(ctx, base64Hash).Scan(&count)
+	return
+}
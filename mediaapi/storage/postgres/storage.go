@@ -105,3 +105,70 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+func (d *Database) GetAllMediaMetadata(ctx context.Context) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectAllMedia(ctx)
+}
+
+func (d *Database) DeleteMediaMetadata(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	if err := d.statements.thumbnail.deleteThumbnails(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	if err := d.statements.quarantine.deleteQuarantine(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	if err := d.statements.access.deleteAccess(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	return d.statements.media.deleteMedia(ctx, mediaID, mediaOrigin)
+}
+
+func (d *Database) DeleteThumbnail(
+	ctx context.Context,
+	mediaID types.MediaID,
+	mediaOrigin gomatrixserverlib.ServerName,
+	width, height int,
+	resizeMethod string,
+) error {
+	return d.statements.thumbnail.deleteThumbnail(
+		ctx, mediaID, mediaOrigin, width, height, resizeMethod,
+	)
+}
+
+func (d *Database) QuarantineMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return d.statements.quarantine.insertQuarantine(ctx, mediaID, mediaOrigin)
+}
+
+func (d *Database) IsMediaQuarantined(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (bool, error) {
+	return d.statements.quarantine.selectQuarantine(ctx, mediaID, mediaOrigin)
+}
+
+func (d *Database) GetMediaReferenceCount(
+	ctx context.Context, base64Hash types.Base64Hash,
+) (int, error) {
+	return d.statements.quarantine.selectMediaReferenceCount(ctx, base64Hash)
+}
+
+func (d *Database) MarkMediaAccessed(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return d.statements.access.upsertAccess(ctx, mediaID, mediaOrigin)
+}
+
+func (d *Database) GetRemoteMediaSize(
+	ctx context.Context, localServerName gomatrixserverlib.ServerName,
+) (types.FileSizeBytes, error) {
+	return d.statements.access.selectRemoteMediaSize(ctx, localServerName)
+}
+
+func (d *Database) GetLeastRecentlyUsedRemoteMedia(
+	ctx context.Context, localServerName gomatrixserverlib.ServerName, limit int,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.access.selectLeastRecentlyUsedRemoteMedia(ctx, localServerName, limit)
+}
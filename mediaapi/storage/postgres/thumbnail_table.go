@@ -66,10 +66,20 @@ const selectThumbnailsSQL = `
 SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
 `
 
+const deleteThumbnailSQL = `
+DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 AND width = $3 AND height = $4 AND resize_method = $5
+`
+
+const deleteThumbnailsSQL = `
+DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
+`
+
 type thumbnailStatements struct {
 	insertThumbnailStmt  *sql.Stmt
 	selectThumbnailStmt  *sql.Stmt
 	selectThumbnailsStmt *sql.Stmt
+	deleteThumbnailStmt  *sql.Stmt
+	deleteThumbnailsStmt *sql.Stmt
 }
 
 func (s *thumbnailStatements) prepare(db *sql.DB) (err error) {
@@ -82,6 +92,8 @@ func (s *thumbnailStatements) prepare(db *sql.DB) (err error) {
 		{&s.insertThumbnailStmt, insertThumbnailSQL},
 		{&s.selectThumbnailStmt, selectThumbnailSQL},
 		{&s.selectThumbnailsStmt, selectThumbnailsSQL},
+		{&s.deleteThumbnailStmt, deleteThumbnailSQL},
+		{&s.deleteThumbnailsStmt, deleteThumbnailsSQL},
 	}.prepare(db)
 }
 
@@ -171,3 +183,23 @@ func (s *thumbnailStatements) selectThumbnails(
 
 	return thumbnails, rows.Err()
 }
+
+func (s *thumbnailStatements) deleteThumbnail(
+	ctx context.Context,
+	mediaID types.MediaID,
+	mediaOrigin gomatrixserverlib.ServerName,
+	width, height int,
+	resizeMethod string,
+) error {
+	_, err := s.deleteThumbnailStmt.ExecContext(
+		ctx, mediaID, mediaOrigin, width, height, resizeMethod,
+	)
+	return err
+}
+
+func (s *thumbnailStatements) deleteThumbnails(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deleteThumbnailsStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -59,9 +60,19 @@ const selectMediaSQL = `
 SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
+const selectAllMediaSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
 type mediaStatements struct {
-	insertMediaStmt *sql.Stmt
-	selectMediaStmt *sql.Stmt
+	insertMediaStmt    *sql.Stmt
+	selectMediaStmt    *sql.Stmt
+	selectAllMediaStmt *sql.Stmt
+	deleteMediaStmt    *sql.Stmt
 }
 
 func (s *mediaStatements) prepare(db *sql.DB) (err error) {
@@ -73,6 +84,8 @@ func (s *mediaStatements) prepare(db *sql.DB) (err error) {
 	return statementList{
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
+		{&s.selectAllMediaStmt, selectAllMediaSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
 	}.prepare(db)
 }
 
@@ -113,3 +126,41 @@ func (s *mediaStatements) selectMedia(
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) selectAllMedia(
+	ctx context.Context,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectAllMediaStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAllMedia: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) deleteMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deleteMediaStmt.ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
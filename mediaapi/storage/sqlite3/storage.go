@@ -109,3 +109,86 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+// GetAllMediaMetadata returns metadata about every media file known to this server,
+// both uploaded and cached from remote servers.
+func (d *Database) GetAllMediaMetadata(ctx context.Context) ([]*types.MediaMetadata, error) {
+	return d.statements.media.selectAllMedia(ctx)
+}
+
+// DeleteMediaMetadata removes the metadata about a media file, along with the
+// metadata of any of its thumbnails and whether it was quarantined. The files
+// themselves are not touched.
+func (d *Database) DeleteMediaMetadata(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	if err := d.statements.thumbnail.deleteThumbnails(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	if err := d.statements.quarantine.deleteQuarantine(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	if err := d.statements.access.deleteAccess(ctx, mediaID, mediaOrigin); err != nil {
+		return err
+	}
+	return d.statements.media.deleteMedia(ctx, mediaID, mediaOrigin)
+}
+
+// DeleteThumbnail removes the metadata about a specific thumbnail.
+func (d *Database) DeleteThumbnail(
+	ctx context.Context,
+	mediaID types.MediaID,
+	mediaOrigin gomatrixserverlib.ServerName,
+	width, height int,
+	resizeMethod string,
+) error {
+	return d.statements.thumbnail.deleteThumbnail(
+		ctx, mediaID, mediaOrigin, width, height, resizeMethod,
+	)
+}
+
+// QuarantineMedia marks media as quarantined so that it is no longer served,
+// and no longer counts as a reference to its file.
+func (d *Database) QuarantineMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return d.statements.quarantine.insertQuarantine(ctx, mediaID, mediaOrigin)
+}
+
+// IsMediaQuarantined returns whether the media has been quarantined.
+func (d *Database) IsMediaQuarantined(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (bool, error) {
+	return d.statements.quarantine.selectQuarantine(ctx, mediaID, mediaOrigin)
+}
+
+// GetMediaReferenceCount returns the number of media which are stored in the
+// file with the given hash and haven't been quarantined.
+func (d *Database) GetMediaReferenceCount(
+	ctx context.Context, base64Hash types.Base64Hash,
+) (int, error) {
+	return d.statements.quarantine.selectMediaReferenceCount(ctx, base64Hash)
+}
+
+// MarkMediaAccessed records that the media has just been served.
+func (d *Database) MarkMediaAccessed(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	return d.statements.access.upsertAccess(ctx, mediaID, mediaOrigin)
+}
+
+// GetRemoteMediaSize returns the space taken up by the media cached from
+// servers other than the local server.
+func (d *Database) GetRemoteMediaSize(
+	ctx context.Context, localServerName gomatrixserverlib.ServerName,
+) (types.FileSizeBytes, error) {
+	return d.statements.access.selectRemoteMediaSize(ctx, localServerName)
+}
+
+// GetLeastRecentlyUsedRemoteMedia returns up to limit of the media cached from
+// servers other than the local server, least recently served first.
+func (d *Database) GetLeastRecentlyUsedRemoteMedia(
+	ctx context.Context, localServerName gomatrixserverlib.ServerName, limit int,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.access.selectLeastRecentlyUsedRemoteMedia(ctx, localServerName, limit)
+}
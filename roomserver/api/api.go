@@ -30,6 +30,18 @@ type RoomserverInternalAPI interface {
 		res *PerformJoinResponse,
 	)
 
+	PerformPeek(
+		ctx context.Context,
+		req *PerformPeekRequest,
+		res *PerformPeekResponse,
+	)
+
+	PerformUnpeek(
+		ctx context.Context,
+		req *PerformUnpeekRequest,
+		res *PerformUnpeekResponse,
+	)
+
 	PerformLeave(
 		ctx context.Context,
 		req *PerformLeaveRequest,
@@ -42,12 +54,112 @@ type RoomserverInternalAPI interface {
 		res *PerformPublishResponse,
 	)
 
+	// Replace a room with a new room in a different room version.
+	PerformRoomUpgrade(
+		ctx context.Context,
+		req *PerformRoomUpgradeRequest,
+		res *PerformRoomUpgradeResponse,
+	)
+
+	// Record a user's report of an event, for server administrators to review.
+	PerformReportEvent(
+		ctx context.Context,
+		req *PerformReportEventRequest,
+		res *PerformReportEventResponse,
+	)
+
+	// Mark a report as having been dealt with.
+	PerformResolveEventReport(
+		ctx context.Context,
+		req *PerformResolveEventReportRequest,
+		res *PerformResolveEventReportResponse,
+	)
+
+	// Start or stop recording the auth decisions made for events in a room.
+	PerformAuthDebug(
+		ctx context.Context,
+		req *PerformAuthDebugRequest,
+		res *PerformAuthDebugResponse,
+	)
+
+	// Redact the events which a local user has sent in the given rooms, for
+	// erasing their account. The user must still be joined to the rooms.
+	PerformUserRedaction(
+		ctx context.Context,
+		req *PerformUserRedactionRequest,
+		res *PerformUserRedactionResponse,
+	)
+
+	// Make a user leave a room, checking that the sender has the power to kick them.
+	PerformKick(
+		ctx context.Context,
+		req *PerformModerationRequest,
+		res *PerformModerationResponse,
+	)
+
+	// Ban a user from a room, checking that the sender has the power to ban them.
+	PerformBan(
+		ctx context.Context,
+		req *PerformModerationRequest,
+		res *PerformModerationResponse,
+	)
+
+	// Unban a user from a room, checking that the sender has the power to do so.
+	PerformUnban(
+		ctx context.Context,
+		req *PerformModerationRequest,
+		res *PerformModerationResponse,
+	)
+
+	// Knock on a room to ask to join it, over federation if this server isn't in the room.
+	PerformKnock(
+		ctx context.Context,
+		req *PerformKnockRequest,
+		res *PerformKnockResponse,
+	)
+
+	// Remove a room completely, after making its local members leave it.
+	PerformPurgeRoom(
+		ctx context.Context,
+		req *PerformPurgeRoomRequest,
+		res *PerformPurgeRoomResponse,
+	)
+
 	QueryPublishedRooms(
 		ctx context.Context,
 		req *QueryPublishedRoomsRequest,
 		res *QueryPublishedRoomsResponse,
 	) error
 
+	// Query the rooms known to the room server, for server administrators.
+	QueryRooms(
+		ctx context.Context,
+		req *QueryRoomsRequest,
+		res *QueryRoomsResponse,
+	) error
+
+	// Query the reports of events made by users, for server administrators.
+	QueryEventReports(
+		ctx context.Context,
+		req *QueryEventReportsRequest,
+		res *QueryEventReportsResponse,
+	) error
+
+	// Query the most recent auth decisions recorded for events in a room.
+	QueryAuthDecisions(
+		ctx context.Context,
+		req *QueryAuthDecisionsRequest,
+		res *QueryAuthDecisionsResponse,
+	) error
+
+	// Claim an annotation, e.g. a reaction, which a local user is about to send,
+	// or give up the claim if it couldn't be sent.
+	PerformClaimAnnotation(
+		ctx context.Context,
+		req *PerformClaimAnnotationRequest,
+		res *PerformClaimAnnotationResponse,
+	) error
+
 	// Query the latest events and state for a room from the room server.
 	QueryLatestEventsAndState(
 		ctx context.Context,
@@ -83,6 +195,14 @@ type RoomserverInternalAPI interface {
 		response *QueryMembershipsForRoomResponse,
 	) error
 
+	// Query the users who are joined to a room, without loading their
+	// membership events.
+	QueryJoinedUsers(
+		ctx context.Context,
+		request *QueryJoinedUsersRequest,
+		response *QueryJoinedUsersResponse,
+	) error
+
 	// Query whether a server is allowed to see an event
 	QueryServerAllowedToSeeEvent(
 		ctx context.Context,
@@ -90,6 +210,13 @@ type RoomserverInternalAPI interface {
 		response *QueryServerAllowedToSeeEventResponse,
 	) error
 
+	// Query which of the given events a user is allowed to see
+	QueryUserAllowedToSeeEvents(
+		ctx context.Context,
+		request *QueryUserAllowedToSeeEventsRequest,
+		response *QueryUserAllowedToSeeEventsResponse,
+	) error
+
 	// Query missing events for a room from roomserver
 	QueryMissingEvents(
 		ctx context.Context,
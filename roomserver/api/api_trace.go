@@ -47,6 +47,24 @@ func (t *RoomserverInternalAPITrace) PerformJoin(
 	util.GetLogger(ctx).Infof("PerformJoin req=%+v res=%+v", js(req), js(res))
 }
 
+func (t *RoomserverInternalAPITrace) PerformPeek(
+	ctx context.Context,
+	req *PerformPeekRequest,
+	res *PerformPeekResponse,
+) {
+	t.Impl.PerformPeek(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformPeek req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformUnpeek(
+	ctx context.Context,
+	req *PerformUnpeekRequest,
+	res *PerformUnpeekResponse,
+) {
+	t.Impl.PerformUnpeek(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformUnpeek req=%+v res=%+v", js(req), js(res))
+}
+
 func (t *RoomserverInternalAPITrace) PerformLeave(
 	ctx context.Context,
 	req *PerformLeaveRequest,
@@ -66,6 +84,96 @@ func (t *RoomserverInternalAPITrace) PerformPublish(
 	util.GetLogger(ctx).Infof("PerformPublish req=%+v res=%+v", js(req), js(res))
 }
 
+func (t *RoomserverInternalAPITrace) PerformRoomUpgrade(
+	ctx context.Context,
+	req *PerformRoomUpgradeRequest,
+	res *PerformRoomUpgradeResponse,
+) {
+	t.Impl.PerformRoomUpgrade(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformRoomUpgrade req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformReportEvent(
+	ctx context.Context,
+	req *PerformReportEventRequest,
+	res *PerformReportEventResponse,
+) {
+	t.Impl.PerformReportEvent(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformReportEvent req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformResolveEventReport(
+	ctx context.Context,
+	req *PerformResolveEventReportRequest,
+	res *PerformResolveEventReportResponse,
+) {
+	t.Impl.PerformResolveEventReport(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformResolveEventReport req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformAuthDebug(
+	ctx context.Context,
+	req *PerformAuthDebugRequest,
+	res *PerformAuthDebugResponse,
+) {
+	t.Impl.PerformAuthDebug(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformAuthDebug req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformUserRedaction(
+	ctx context.Context,
+	req *PerformUserRedactionRequest,
+	res *PerformUserRedactionResponse,
+) {
+	t.Impl.PerformUserRedaction(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformUserRedaction req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformKick(
+	ctx context.Context,
+	req *PerformModerationRequest,
+	res *PerformModerationResponse,
+) {
+	t.Impl.PerformKick(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformKick req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformBan(
+	ctx context.Context,
+	req *PerformModerationRequest,
+	res *PerformModerationResponse,
+) {
+	t.Impl.PerformBan(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformBan req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformUnban(
+	ctx context.Context,
+	req *PerformModerationRequest,
+	res *PerformModerationResponse,
+) {
+	t.Impl.PerformUnban(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformUnban req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformKnock(
+	ctx context.Context,
+	req *PerformKnockRequest,
+	res *PerformKnockResponse,
+) {
+	t.Impl.PerformKnock(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformKnock req=%+v res=%+v", js(req), js(res))
+}
+
+func (t *RoomserverInternalAPITrace) PerformPurgeRoom(
+	ctx context.Context,
+	req *PerformPurgeRoomRequest,
+	res *PerformPurgeRoomResponse,
+) {
+	t.Impl.PerformPurgeRoom(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformPurgeRoom req=%+v res=%+v", js(req), js(res))
+}
+
 func (t *RoomserverInternalAPITrace) QueryPublishedRooms(
 	ctx context.Context,
 	req *QueryPublishedRoomsRequest,
@@ -76,6 +184,46 @@ func (t *RoomserverInternalAPITrace) QueryPublishedRooms(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryRooms(
+	ctx context.Context,
+	req *QueryRoomsRequest,
+	res *QueryRoomsResponse,
+) error {
+	err := t.Impl.QueryRooms(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRooms req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryAuthDecisions(
+	ctx context.Context,
+	req *QueryAuthDecisionsRequest,
+	res *QueryAuthDecisionsResponse,
+) error {
+	err := t.Impl.QueryAuthDecisions(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryAuthDecisions req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryEventReports(
+	ctx context.Context,
+	req *QueryEventReportsRequest,
+	res *QueryEventReportsResponse,
+) error {
+	err := t.Impl.QueryEventReports(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventReports req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformClaimAnnotation(
+	ctx context.Context,
+	req *PerformClaimAnnotationRequest,
+	res *PerformClaimAnnotationResponse,
+) error {
+	err := t.Impl.PerformClaimAnnotation(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformClaimAnnotation req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryLatestEventsAndState(
 	ctx context.Context,
 	req *QueryLatestEventsAndStateRequest,
@@ -126,6 +274,16 @@ func (t *RoomserverInternalAPITrace) QueryMembershipsForRoom(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryJoinedUsers(
+	ctx context.Context,
+	req *QueryJoinedUsersRequest,
+	res *QueryJoinedUsersResponse,
+) error {
+	err := t.Impl.QueryJoinedUsers(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryJoinedUsers req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryServerAllowedToSeeEvent(
 	ctx context.Context,
 	req *QueryServerAllowedToSeeEventRequest,
@@ -136,6 +294,16 @@ func (t *RoomserverInternalAPITrace) QueryServerAllowedToSeeEvent(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	req *QueryUserAllowedToSeeEventsRequest,
+	res *QueryUserAllowedToSeeEventsResponse,
+) error {
+	err := t.Impl.QueryUserAllowedToSeeEvents(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryUserAllowedToSeeEvents req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryMissingEvents(
 	ctx context.Context,
 	req *QueryMissingEventsRequest,
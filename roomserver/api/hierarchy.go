@@ -0,0 +1,169 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// MSpaceChild is the type of the state events which add rooms to spaces.
+const MSpaceChild = "m.space.child"
+
+// The state events which a room's summary in a space hierarchy is made from,
+// besides its children.
+var hierarchyRoomState = []gomatrixserverlib.StateKeyTuple{
+	{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+	{EventType: gomatrixserverlib.MRoomName, StateKey: ""},
+	{EventType: "m.room.topic", StateKey: ""},
+	{EventType: "m.room.avatar", StateKey: ""},
+	{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""},
+	{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""},
+	{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+	{EventType: "m.room.guest_access", StateKey: ""},
+}
+
+// GetHierarchyRoom summarises a room which this server is in for a space
+// hierarchy (MSC2946), along with the memberships of the joined users and
+// of the given user, if there is one, so that callers can check who is
+// allowed to see it. Returns nil if this server isn't in the room.
+func GetHierarchyRoom(
+	ctx context.Context, rsAPI RoomserverInternalAPI, roomID, userID string, suggestedOnly bool,
+) (*fsAPI.HierarchyRoom, map[string]string, error) {
+	// The child events are keyed on the child room IDs, so all of them are
+	// fetched by their type.
+	stateToFetch := hierarchyRoomState
+	if userID != "" {
+		stateToFetch = append(stateToFetch[:len(stateToFetch):len(stateToFetch)], gomatrixserverlib.StateKeyTuple{
+			EventType: gomatrixserverlib.MRoomMember, StateKey: userID,
+		})
+	}
+	var res QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &QueryLatestEventsAndStateRequest{
+		RoomID:            roomID,
+		StateToFetch:      stateToFetch,
+		StateTypesToFetch: []string{MSpaceChild},
+	}, &res); err != nil {
+		return nil, nil, err
+	}
+	if !res.RoomExists {
+		return nil, nil, nil
+	}
+	var joinedRes QueryJoinedUsersResponse
+	if err := rsAPI.QueryJoinedUsers(ctx, &QueryJoinedUsersRequest{RoomID: roomID}, &joinedRes); err != nil {
+		return nil, nil, err
+	}
+
+	room := &fsAPI.HierarchyRoom{
+		PublicRoom: gomatrixserverlib.PublicRoom{
+			RoomID:             roomID,
+			JoinedMembersCount: len(joinedRes.UserIDs),
+		},
+		ChildrenState: []fsAPI.HierarchyChildEvent{},
+	}
+	memberships := make(map[string]string, len(joinedRes.UserIDs)+1)
+	for _, joinedUserID := range joinedRes.UserIDs {
+		memberships[joinedUserID] = gomatrixserverlib.Join
+	}
+	orders := map[string]string{}
+	var guestAccess string
+	for _, event := range res.StateEvents {
+		if event.StateKey() == nil {
+			continue
+		}
+		stateKey := *event.StateKey()
+		if event.Type() == gomatrixserverlib.MRoomMember {
+			if membership, err := event.Membership(); err == nil {
+				memberships[stateKey] = membership
+			}
+			continue
+		}
+		if event.Type() == MSpaceChild {
+			var content fsAPI.HierarchyChildContent
+			if err := json.Unmarshal(event.Content(), &content); err != nil || len(content.Via) == 0 {
+				continue
+			}
+			if suggestedOnly && !content.Suggested {
+				continue
+			}
+			orders[stateKey] = content.Order
+			room.ChildrenState = append(room.ChildrenState, fsAPI.HierarchyChildEvent{
+				Type:           event.Type(),
+				StateKey:       stateKey,
+				Sender:         event.Sender(),
+				Content:        event.Content(),
+				OriginServerTS: event.OriginServerTS(),
+			})
+			continue
+		}
+		if stateKey != "" {
+			continue
+		}
+		content := event.Content()
+		switch event.Type() {
+		case gomatrixserverlib.MRoomCreate:
+			room.RoomType = gjson.GetBytes(content, "type").Str
+		case gomatrixserverlib.MRoomName:
+			room.Name = gjson.GetBytes(content, "name").Str
+		case "m.room.topic":
+			room.Topic = gjson.GetBytes(content, "topic").Str
+		case "m.room.avatar":
+			room.AvatarURL = gjson.GetBytes(content, "url").Str
+		case gomatrixserverlib.MRoomCanonicalAlias:
+			room.CanonicalAlias = gjson.GetBytes(content, "alias").Str
+		case gomatrixserverlib.MRoomJoinRules:
+			room.JoinRule = gjson.GetBytes(content, "join_rule").Str
+		case gomatrixserverlib.MRoomHistoryVisibility:
+			room.WorldReadable = gjson.GetBytes(content, "history_visibility").Str == "world_readable"
+		case "m.room.guest_access":
+			guestAccess = gjson.GetBytes(content, "guest_access").Str
+		}
+	}
+	room.GuestCanJoin = room.JoinRule == gomatrixserverlib.Public && guestAccess == "can_join"
+
+	// Children are ordered by their order strings, with the children without
+	// one last, and then by when they were added.
+	sort.SliceStable(room.ChildrenState, func(i, j int) bool {
+		a, b := room.ChildrenState[i], room.ChildrenState[j]
+		orderA, orderB := validChildOrder(orders[a.StateKey]), validChildOrder(orders[b.StateKey])
+		if orderA != orderB {
+			return orderB == "" || (orderA != "" && orderA < orderB)
+		}
+		if a.OriginServerTS != b.OriginServerTS {
+			return a.OriginServerTS < b.OriginServerTS
+		}
+		return a.StateKey < b.StateKey
+	})
+	return room, memberships, nil
+}
+
+// validChildOrder returns the order string of an m.space.child event, or the
+// empty string if it isn't valid, in which case it is ignored.
+func validChildOrder(order string) string {
+	if len(order) > 50 {
+		return ""
+	}
+	for _, c := range order {
+		if c < 0x20 || c > 0x7e {
+			return ""
+		}
+	}
+	return order
+}
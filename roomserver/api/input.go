@@ -31,7 +31,9 @@ const (
 	// have a copy of.
 	KindNew = 2
 	// KindBackfill event extend the contiguous graph going backwards.
-	// They always have state.
+	// They don't change the latest events or the current state of the
+	// room, and are sent to downstream components as old room events.
+	// If the state isn't given then it is calculated from the prev_events.
 	KindBackfill = 3
 )
 
@@ -24,10 +24,14 @@ type OutputType string
 const (
 	// OutputTypeNewRoomEvent indicates that the event is an OutputNewRoomEvent
 	OutputTypeNewRoomEvent OutputType = "new_room_event"
+	// OutputTypeOldRoomEvent indicates that the event is an OutputOldRoomEvent
+	OutputTypeOldRoomEvent OutputType = "old_room_event"
 	// OutputTypeNewInviteEvent indicates that the event is an OutputNewInviteEvent
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
 	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypeNewKnockEvent indicates that the event is an OutputNewKnockEvent
+	OutputTypeNewKnockEvent OutputType = "new_knock_event"
 	// OutputTypeRedactedEvent indicates that the event is an OutputRedactedEvent
 	//
 	// This event is emitted when a redaction has been 'validated' (meaning both the redaction and the event to redact are known).
@@ -46,6 +50,13 @@ const (
 	// - Redact the event and set the corresponding `unsigned` fields to indicate it as redacted.
 	// - Replace the event in the database.
 	OutputTypeRedactedEvent OutputType = "redacted_event"
+
+	// OutputTypeNewPeek indicates that the kafka event is an OutputNewPeek
+	OutputTypeNewPeek OutputType = "new_peek"
+	// OutputTypeRetirePeek indicates that the kafka event is an OutputRetirePeek
+	OutputTypeRetirePeek OutputType = "retire_peek"
+	// OutputTypePurgeRoom indicates that the kafka event is an OutputPurgeRoom
+	OutputTypePurgeRoom OutputType = "purge_room"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -55,12 +66,22 @@ type OutputEvent struct {
 	Type OutputType `json:"type"`
 	// The content of event with type OutputTypeNewRoomEvent
 	NewRoomEvent *OutputNewRoomEvent `json:"new_room_event,omitempty"`
+	// The content of event with type OutputTypeOldRoomEvent
+	OldRoomEvent *OutputOldRoomEvent `json:"old_room_event,omitempty"`
 	// The content of event with type OutputTypeNewInviteEvent
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
+	// The content of event with type OutputTypeNewKnockEvent
+	NewKnockEvent *OutputNewKnockEvent `json:"new_knock_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
 	RetireInviteEvent *OutputRetireInviteEvent `json:"retire_invite_event,omitempty"`
 	// The content of event with type  OutputTypeRedactedEvent
 	RedactedEvent *OutputRedactedEvent `json:"redacted_event,omitempty"`
+	// The content of event with type OutputTypeNewPeek
+	NewPeek *OutputNewPeek `json:"new_peek,omitempty"`
+	// The content of event with type OutputTypeRetirePeek
+	RetirePeek *OutputRetirePeek `json:"retire_peek,omitempty"`
+	// The content of event with type OutputTypePurgeRoom
+	PurgeRoom *OutputPurgeRoom `json:"purge_room,omitempty"`
 }
 
 // An OutputNewRoomEvent is written when the roomserver receives a new event.
@@ -159,6 +180,15 @@ func (ore *OutputNewRoomEvent) AddsState() []gomatrixserverlib.HeaderedEvent {
 	return append(ore.AddStateEvents, ore.Event)
 }
 
+// An OutputOldRoomEvent is written when the roomserver receives an event
+// which belongs in the past of the room, such as history being imported by
+// an application service. The event doesn't change the current state of the
+// room and consumers shouldn't treat it as a new message.
+type OutputOldRoomEvent struct {
+	// The Event.
+	Event gomatrixserverlib.HeaderedEvent `json:"event"`
+}
+
 // An OutputNewInviteEvent is written whenever an invite becomes active.
 // Invite events can be received outside of an existing room so have to be
 // tracked separately from the room events themselves.
@@ -169,6 +199,18 @@ type OutputNewInviteEvent struct {
 	Event gomatrixserverlib.HeaderedEvent `json:"event"`
 }
 
+// An OutputNewKnockEvent is written whenever a local user knocks on a room.
+// Knocks on remote rooms happen outside of any room that we are in, so like
+// invites they have to be tracked separately from the room events themselves.
+// The knock stops being active once the user is invited to, joins or leaves
+// the room.
+type OutputNewKnockEvent struct {
+	// The room version of the room which was knocked on.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// The "m.room.member" knock event.
+	Event gomatrixserverlib.HeaderedEvent `json:"event"`
+}
+
 // An OutputRetireInviteEvent is written whenever an existing invite is no longer
 // active. An invite stops being active if the user joins the room or if the
 // invite is rejected by the user.
@@ -195,3 +237,25 @@ type OutputRedactedEvent struct {
 	// The value of `unsigned.redacted_because` - the redaction event itself
 	RedactedBecause gomatrixserverlib.HeaderedEvent
 }
+
+// An OutputNewPeek is written whenever a user starts peeking into a room
+// using a given device.
+type OutputNewPeek struct {
+	RoomID   string
+	UserID   string
+	DeviceID string
+}
+
+// An OutputRetirePeek is written whenever a user stops peeking into a room
+// using a given device.
+type OutputRetirePeek struct {
+	RoomID   string
+	UserID   string
+	DeviceID string
+}
+
+// An OutputPurgeRoom is written when a room has been removed from the
+// roomserver. Downstream components should forget about the room as well.
+type OutputPurgeRoom struct {
+	RoomID string
+}
@@ -79,6 +79,8 @@ type PerformJoinRequest struct {
 	UserID        string                         `json:"user_id"`
 	Content       map[string]interface{}         `json:"content"`
 	ServerNames   []gomatrixserverlib.ServerName `json:"server_names"`
+	// Whether the user is a guest, who can only join rooms which allow guests.
+	IsGuest bool `json:"is_guest"`
 }
 
 type PerformJoinResponse struct {
@@ -96,6 +98,31 @@ type PerformLeaveRequest struct {
 type PerformLeaveResponse struct {
 }
 
+type PerformPeekRequest struct {
+	RoomIDOrAlias string                         `json:"room_id_or_alias"`
+	UserID        string                         `json:"user_id"`
+	DeviceID      string                         `json:"device_id"`
+	ServerNames   []gomatrixserverlib.ServerName `json:"server_names"`
+}
+
+type PerformPeekResponse struct {
+	// The room ID, populated on success.
+	RoomID string `json:"room_id"`
+	// If non-nil, the peek request failed. Contains more information why it failed.
+	Error *PerformError
+}
+
+type PerformUnpeekRequest struct {
+	RoomID   string `json:"room_id"`
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+type PerformUnpeekResponse struct {
+	// If non-nil, the unpeek request failed. Contains more information why it failed.
+	Error *PerformError
+}
+
 type PerformInviteRequest struct {
 	RoomVersion     gomatrixserverlib.RoomVersion             `json:"room_version"`
 	Event           gomatrixserverlib.HeaderedEvent           `json:"event"`
@@ -146,3 +173,134 @@ type PerformPublishResponse struct {
 	// If non-nil, the publish request failed. Contains more information why it failed.
 	Error *PerformError
 }
+
+type PerformRoomUpgradeRequest struct {
+	RoomID      string                        `json:"room_id"`
+	UserID      string                        `json:"user_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+}
+
+type PerformRoomUpgradeResponse struct {
+	// The ID of the room which replaces the old one, populated on success.
+	NewRoomID string `json:"new_room_id"`
+	// If non-nil, the upgrade failed. Contains more information why it failed.
+	Error *PerformError
+}
+
+type PerformReportEventRequest struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
+	// The user reporting the event, who must be able to see it.
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+	// How offensive the event is, from -100 (most offensive) to 0 (inoffensive).
+	Score int `json:"score"`
+}
+
+type PerformReportEventResponse struct {
+	// The ID of the new report, populated on success.
+	ReportID int64 `json:"report_id"`
+	// If non-nil, the report failed. Contains more information why it failed.
+	Error *PerformError
+}
+
+type PerformResolveEventReportRequest struct {
+	ReportID int64 `json:"report_id"`
+	// Who resolved the report, if known.
+	ResolvedBy string `json:"resolved_by,omitempty"`
+}
+
+type PerformResolveEventReportResponse struct {
+	// If non-nil, the report couldn't be resolved. Contains more information why.
+	Error *PerformError
+}
+
+// PerformClaimAnnotationRequest is a request to PerformClaimAnnotation.
+type PerformClaimAnnotationRequest struct {
+	// The ID of the annotation event.
+	EventID string `json:"event_id"`
+	// The ID of the annotated event.
+	RelatesToID string `json:"relates_to_id"`
+	Sender      string `json:"sender"`
+	Type        string `json:"type"`
+	Key         string `json:"key"`
+	// The most annotations which the sender can make on the event.
+	Limit int `json:"limit"`
+	// If set, the claim on the annotation event is given up instead.
+	Release bool `json:"release,omitempty"`
+}
+
+// PerformClaimAnnotationResponse is a response to PerformClaimAnnotation. The
+// annotation was claimed unless one of the fields is set.
+type PerformClaimAnnotationResponse struct {
+	// The sender has already annotated the event with the same key.
+	Duplicate bool `json:"duplicate"`
+	// The sender has already made as many annotations on the event as the limit.
+	LimitReached bool `json:"limit_reached"`
+}
+
+type PerformAuthDebugRequest struct {
+	RoomID string `json:"room_id"`
+	// Whether to record auth decisions for the room. Turning recording off
+	// forgets the decisions which have already been recorded.
+	Enabled bool `json:"enabled"`
+}
+
+type PerformAuthDebugResponse struct {
+	// If non-nil, recording couldn't be turned on or off. Contains more information why.
+	Error *PerformError
+}
+
+type PerformUserRedactionRequest struct {
+	UserID  string   `json:"user_id"`
+	RoomIDs []string `json:"room_ids"`
+	// The reason given in the redactions, if any.
+	Reason string `json:"reason,omitempty"`
+}
+
+type PerformUserRedactionResponse struct {
+	// How many events were redacted, including before any failure.
+	RedactedEvents int `json:"redacted_events"`
+	// If non-nil, not every event was redacted. Contains more information why.
+	Error *PerformError
+}
+
+type PerformModerationRequest struct {
+	RoomID string `json:"room_id"`
+	// The user who is kicking, banning or unbanning the target user.
+	UserID       string `json:"user_id"`
+	TargetUserID string `json:"target_user_id"`
+	Reason       string `json:"reason"`
+}
+
+type PerformModerationResponse struct {
+	// The ID of the membership event which was sent, populated on success.
+	EventID string `json:"event_id"`
+	// If non-nil, the membership wasn't changed. Contains more information why.
+	Error *PerformError
+}
+
+type PerformKnockRequest struct {
+	RoomIDOrAlias string                         `json:"room_id_or_alias"`
+	UserID        string                         `json:"user_id"`
+	Reason        string                         `json:"reason"`
+	ServerNames   []gomatrixserverlib.ServerName `json:"server_names"`
+}
+
+type PerformKnockResponse struct {
+	// The room ID, populated on success.
+	RoomID string `json:"room_id"`
+	// If non-nil, the knock failed. Contains more information why it failed.
+	Error *PerformError
+}
+
+type PerformPurgeRoomRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type PerformPurgeRoomResponse struct {
+	// The local users who were made to leave the room before it was purged.
+	EvacuatedUsers []string `json:"evacuated_users"`
+	// If non-nil, the room wasn't purged. Contains more information why.
+	Error *PerformError
+}
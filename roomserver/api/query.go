@@ -25,8 +25,12 @@ type QueryLatestEventsAndStateRequest struct {
 	// The room ID to query the latest events for.
 	RoomID string `json:"room_id"`
 	// The state key tuples to fetch from the room current state.
-	// If this list is empty or nil then *ALL* current state events are returned.
+	// If this list and StateTypesToFetch are empty or nil then *ALL* current
+	// state events are returned.
 	StateToFetch []gomatrixserverlib.StateKeyTuple `json:"state_to_fetch"`
+	// Event types to fetch all of the current state events of, whatever
+	// their state keys, as well as the StateToFetch tuples.
+	StateTypesToFetch []string `json:"state_types_to_fetch,omitempty"`
 }
 
 // QueryLatestEventsAndStateResponse is a response to QueryLatestEventsAndState
@@ -124,6 +128,10 @@ type QueryMembershipsForRoomRequest struct {
 	RoomID string `json:"room_id"`
 	// ID of the user sending the request
 	Sender string `json:"sender"`
+	// Optional ID of an event to return the memberships in the state after,
+	// rather than the current state. Users who have left the room never get
+	// the memberships after they left.
+	AtEventID string `json:"at_event_id"`
 }
 
 // QueryMembershipsForRoomResponse is a response to QueryMembershipsForRoom
@@ -135,6 +143,19 @@ type QueryMembershipsForRoomResponse struct {
 	HasBeenInRoom bool `json:"has_been_in_room"`
 }
 
+// QueryJoinedUsersRequest is a request to QueryJoinedUsers
+type QueryJoinedUsersRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryJoinedUsersResponse is a response to QueryJoinedUsers
+type QueryJoinedUsersResponse struct {
+	// Whether this server knows about the room.
+	RoomExists bool `json:"room_exists"`
+	// The users who are currently joined to the room.
+	UserIDs []string `json:"user_ids"`
+}
+
 // QueryServerAllowedToSeeEventRequest is a request to QueryServerAllowedToSeeEvent
 type QueryServerAllowedToSeeEventRequest struct {
 	// The event ID to look up invites in.
@@ -149,6 +170,21 @@ type QueryServerAllowedToSeeEventResponse struct {
 	AllowedToSeeEvent bool `json:"can_see_event"`
 }
 
+// QueryUserAllowedToSeeEventsRequest is a request to QueryUserAllowedToSeeEvents
+type QueryUserAllowedToSeeEventsRequest struct {
+	// The user interested in the events
+	UserID string `json:"user_id"`
+	// The events to check the history visibility of
+	EventIDs []string `json:"event_ids"`
+}
+
+// QueryUserAllowedToSeeEventsResponse is a response to QueryUserAllowedToSeeEvents
+type QueryUserAllowedToSeeEventsResponse struct {
+	// The event IDs that the user is allowed to see. Events that the user isn't
+	// allowed to see, or which the roomserver doesn't know about, are omitted.
+	AllowedEventIDs map[string]bool `json:"allowed_event_ids"`
+}
+
 // QueryMissingEventsRequest is a request to QueryMissingEvents
 type QueryMissingEventsRequest struct {
 	// Events which are known previous to the gap in the timeline.
@@ -225,3 +261,139 @@ type QueryPublishedRoomsResponse struct {
 	// The list of published rooms.
 	RoomIDs []string
 }
+
+// Orderings for QueryRoomsRequest.OrderBy.
+const (
+	QueryRoomsOrderByRoomID        = "room_id"
+	QueryRoomsOrderByName          = "name"
+	QueryRoomsOrderByJoinedMembers = "joined_members"
+	QueryRoomsOrderByRoomVersion   = "room_version"
+)
+
+// QueryRoomsRequest is a request to QueryRooms. All filters are optional, and
+// only rooms which match all of the given filters are returned.
+type QueryRoomsRequest struct {
+	// Only return rooms with this room version.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version,omitempty"`
+	// Only return rooms with at least this many joined members.
+	MinJoinedMembers int `json:"min_joined_members,omitempty"`
+	// Only return rooms with at most this many joined members.
+	MaxJoinedMembers *int `json:"max_joined_members,omitempty"`
+	// Only return rooms which do, or don't, have encryption enabled.
+	Encrypted *bool `json:"encrypted,omitempty"`
+	// Only return rooms which do, or don't, have a public join rule.
+	Public *bool `json:"public,omitempty"`
+	// How to sort the rooms, one of the QueryRoomsOrderBy constants.
+	// Defaults to QueryRoomsOrderByRoomID.
+	OrderBy string `json:"order_by,omitempty"`
+	// Sort the rooms in descending order rather than ascending.
+	Descending bool `json:"descending,omitempty"`
+	// The number of matching rooms to skip, for pagination.
+	Offset int `json:"offset,omitempty"`
+	// The maximum number of rooms to return. Zero means no limit.
+	Limit int `json:"limit,omitempty"`
+}
+
+// QueryRoomsResponse is a response to QueryRooms
+type QueryRoomsResponse struct {
+	// The matching rooms, after Offset and Limit have been applied.
+	Rooms []RoomDetails `json:"rooms"`
+	// The total number of matching rooms.
+	TotalRooms int `json:"total_rooms"`
+}
+
+// RoomDetails describes a room for server administrators.
+type RoomDetails struct {
+	RoomID             string                        `json:"room_id"`
+	RoomVersion        gomatrixserverlib.RoomVersion `json:"room_version"`
+	Name               string                        `json:"name,omitempty"`
+	CanonicalAlias     string                        `json:"canonical_alias,omitempty"`
+	Creator            string                        `json:"creator,omitempty"`
+	JoinRule           string                        `json:"join_rule,omitempty"`
+	JoinedMembers      int                           `json:"joined_members"`
+	JoinedLocalMembers int                           `json:"joined_local_members"`
+	Encrypted          bool                          `json:"encrypted"`
+	Public             bool                          `json:"public"`
+	Published          bool                          `json:"published"`
+}
+
+// QueryEventReportsRequest is a request to QueryEventReports.
+type QueryEventReportsRequest struct {
+	// Only return reports about events in this room.
+	RoomID string `json:"room_id,omitempty"`
+	// Return reports which have already been resolved, as well as the
+	// outstanding ones.
+	IncludeResolved bool `json:"include_resolved,omitempty"`
+	// The number of matching reports to skip, for pagination.
+	Offset int `json:"offset,omitempty"`
+	// The maximum number of reports to return. Defaults to 100.
+	Limit int `json:"limit,omitempty"`
+}
+
+// QueryEventReportsResponse is a response to QueryEventReports
+type QueryEventReportsResponse struct {
+	// The matching reports, newest first, after Offset and Limit have been applied.
+	Reports []EventReport `json:"reports"`
+	// The total number of matching reports.
+	TotalReports int `json:"total_reports"`
+}
+
+// EventReport is a report of an event by a user, for server administrators.
+type EventReport struct {
+	ID         int64                       `json:"id"`
+	RoomID     string                      `json:"room_id"`
+	EventID    string                      `json:"event_id"`
+	UserID     string                      `json:"user_id"`
+	Reason     string                      `json:"reason,omitempty"`
+	Score      int                         `json:"score"`
+	ReceivedTS gomatrixserverlib.Timestamp `json:"received_ts"`
+	// ResolvedTS is zero until the report is resolved.
+	ResolvedBy string                      `json:"resolved_by,omitempty"`
+	ResolvedTS gomatrixserverlib.Timestamp `json:"resolved_ts,omitempty"`
+}
+
+// Annotation is an event which annotates another, e.g. a reaction.
+type Annotation struct {
+	EventID string `json:"event_id"`
+	// The type of the annotation event.
+	Type string `json:"type"`
+	// The aggregation key, e.g. the emoji of a reaction.
+	Key string `json:"key"`
+}
+
+// QueryAuthDecisionsRequest is a request to QueryAuthDecisions.
+type QueryAuthDecisionsRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// QueryAuthDecisionsResponse is a response to QueryAuthDecisions.
+type QueryAuthDecisionsResponse struct {
+	// Whether auth decisions are being recorded for the room.
+	Enabled bool `json:"enabled"`
+	// The most recent decisions, oldest first.
+	Decisions []AuthDecision `json:"decisions"`
+}
+
+// AuthDecision records whether an event passed the event auth rules, for
+// server administrators diagnosing rejected events.
+type AuthDecision struct {
+	EventID  string  `json:"event_id"`
+	Type     string  `json:"type"`
+	StateKey *string `json:"state_key,omitempty"`
+	Sender   string  `json:"sender"`
+	Allowed  bool    `json:"allowed"`
+	// The auth rule which the event failed, if it was rejected.
+	Reason string `json:"reason,omitempty"`
+	// The auth events which the event listed.
+	AuthEventIDs []string `json:"auth_event_ids"`
+	// The state which the event was checked against.
+	AuthState []AuthStateEvent            `json:"auth_state"`
+	DecidedTS gomatrixserverlib.Timestamp `json:"decided_ts"`
+}
+
+// AuthStateEvent is one of the state events which an auth decision was made against.
+type AuthStateEvent struct {
+	Type     string `json:"type"`
+	StateKey string `json:"state_key"`
+	EventID  string `json:"event_id"`
+}
@@ -52,6 +52,37 @@ func IsServerAllowed(
 	return false
 }
 
+// IsUserAllowed returns true if the user is allowed to see an event given their
+// membership at the event and the state before the event. This function implements
+// https://matrix.org/docs/spec/client_server/r0.6.0#id87
+func IsUserAllowed(
+	membershipAtEvent string,
+	userCurrentlyJoined bool,
+	stateBeforeEvent []gomatrixserverlib.Event,
+) bool {
+	historyVisibility := HistoryVisibilityForRoom(stateBeforeEvent)
+
+	// 1. If the history_visibility was set to world_readable, allow.
+	if historyVisibility == "world_readable" {
+		return true
+	}
+	// 2. If the user's membership was join, allow.
+	if membershipAtEvent == gomatrixserverlib.Join {
+		return true
+	}
+	// 3. If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
+	if historyVisibility == "shared" && userCurrentlyJoined {
+		return true
+	}
+	// 4. If the user's membership was invite, and the history_visibility was set to invited, allow.
+	if membershipAtEvent == gomatrixserverlib.Invite && historyVisibility == "invited" {
+		return true
+	}
+
+	// 5. Otherwise, deny.
+	return false
+}
+
 func HistoryVisibilityForRoom(authEvents []gomatrixserverlib.Event) string {
 	// https://matrix.org/docs/spec/client_server/r0.6.0#id87
 	// By default if no history_visibility is set, or if the value is not understood, the visibility is assumed to be shared.
@@ -18,10 +18,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
 )
 
 // RoomserverInternalAPIDatabase has the storage APIs needed to implement the alias API.
@@ -32,6 +34,10 @@ type RoomserverInternalAPIDatabase interface {
 	// Look up the room ID a given alias refers to.
 	// Returns an error if there was a problem talking to the database.
 	GetRoomIDForAlias(ctx context.Context, alias string) (string, error)
+	// Look up an alias regardless of its case, returning the alias as it was
+	// saved, or an empty string if there is no such alias.
+	// Returns an error if there was a problem talking to the database.
+	GetAliasIgnoringCase(ctx context.Context, alias string) (string, error)
 	// Look up all aliases referring to a given room ID.
 	// Returns an error if there was a problem talking to the database.
 	GetAliasesForRoomID(ctx context.Context, roomID string) ([]string, error)
@@ -54,7 +60,11 @@ func (r *RoomserverInternalAPI) SetRoomAlias(
 	response *api.SetRoomAliasResponse,
 ) error {
 	// Check if the alias isn't already referring to a room
-	roomID, err := r.DB.GetRoomIDForAlias(ctx, request.Alias)
+	alias, err := r.storedAlias(ctx, request.Alias)
+	if err != nil {
+		return err
+	}
+	roomID, err := r.DB.GetRoomIDForAlias(ctx, alias)
 	if err != nil {
 		return err
 	}
@@ -69,6 +79,7 @@ func (r *RoomserverInternalAPI) SetRoomAlias(
 	if err := r.DB.SetRoomAlias(ctx, request.Alias, request.RoomID, request.UserID); err != nil {
 		return err
 	}
+	r.AliasCache.InvalidateRoomAlias(r.aliasCacheKey(request.Alias))
 
 	// Send a m.room.aliases event with the updated list of aliases for this room
 	// At this point we've already committed the alias to the database so we
@@ -84,7 +95,7 @@ func (r *RoomserverInternalAPI) GetRoomIDForAlias(
 	response *api.GetRoomIDForAliasResponse,
 ) error {
 	// Look up the room ID in the database
-	roomID, err := r.DB.GetRoomIDForAlias(ctx, request.Alias)
+	roomID, err := r.resolveLocalAlias(ctx, request.Alias)
 	if err != nil {
 		return err
 	}
@@ -138,8 +149,12 @@ func (r *RoomserverInternalAPI) GetCreatorIDForAlias(
 	request *api.GetCreatorIDForAliasRequest,
 	response *api.GetCreatorIDForAliasResponse,
 ) error {
+	alias, err := r.storedAlias(ctx, request.Alias)
+	if err != nil {
+		return err
+	}
 	// Look up the aliases in the database for the given RoomID
-	creatorID, err := r.DB.GetCreatorIDForAlias(ctx, request.Alias)
+	creatorID, err := r.DB.GetCreatorIDForAlias(ctx, alias)
 	if err != nil {
 		return err
 	}
@@ -154,22 +169,144 @@ func (r *RoomserverInternalAPI) RemoveRoomAlias(
 	request *api.RemoveRoomAliasRequest,
 	response *api.RemoveRoomAliasResponse,
 ) error {
+	alias, err := r.storedAlias(ctx, request.Alias)
+	if err != nil {
+		return err
+	}
 	// Look up the room ID in the database
-	roomID, err := r.DB.GetRoomIDForAlias(ctx, request.Alias)
+	roomID, err := r.DB.GetRoomIDForAlias(ctx, alias)
 	if err != nil {
 		return err
 	}
 
 	// Remove the dalias from the database
-	if err := r.DB.RemoveRoomAlias(ctx, request.Alias); err != nil {
+	if err = r.DB.RemoveRoomAlias(ctx, alias); err != nil {
 		return err
 	}
+	r.AliasCache.InvalidateRoomAlias(r.aliasCacheKey(alias))
 
 	// Send an updated m.room.aliases event
 	// At this point we've already committed the alias to the database so we
 	// shouldn't cancel this request.
 	// TODO: Ensure that we send unsent events when if server restarts.
-	return r.sendUpdatedAliasesEvent(context.TODO(), request.UserID, roomID)
+	if err = r.sendUpdatedAliasesEvent(context.TODO(), request.UserID, roomID); err != nil {
+		return err
+	}
+	// The alias is gone either way, so this is only best effort: the user
+	// might not be allowed to change the canonical alias.
+	if err = r.removeFromCanonicalAlias(context.TODO(), request.UserID, roomID, alias); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Warnf("Failed to remove alias %q from the canonical alias", alias)
+	}
+	return nil
+}
+
+// resolveLocalAlias returns the ID of the room which an alias points to, or
+// an empty string if there is no such alias. Lookups of local aliases are
+// cached.
+func (r *RoomserverInternalAPI) resolveLocalAlias(ctx context.Context, alias string) (string, error) {
+	// Only local aliases are cached here, so that entries don't collide
+	// with remote aliases cached by the federation sender.
+	_, domain, err := gomatrixserverlib.SplitID('#', alias)
+	local := err == nil && domain == r.Cfg.Matrix.ServerName
+	key := r.aliasCacheKey(alias)
+	if local {
+		if roomID, _, ok := r.AliasCache.GetRoomAlias(key); ok {
+			return roomID, nil
+		}
+	}
+	stored, err := r.storedAlias(ctx, alias)
+	if err != nil {
+		return "", err
+	}
+	roomID, err := r.DB.GetRoomIDForAlias(ctx, stored)
+	if err != nil {
+		return "", err
+	}
+	if local {
+		r.AliasCache.StoreRoomAlias(key, roomID, nil)
+	}
+	return roomID, nil
+}
+
+// aliasCacheKey returns the key of an alias in the alias cache, which is the
+// same for every case of the alias if aliases are case-insensitive.
+func (r *RoomserverInternalAPI) aliasCacheKey(alias string) string {
+	if r.Cfg.Matrix.CaseInsensitiveAliases {
+		return strings.ToLower(alias)
+	}
+	return alias
+}
+
+// storedAlias returns the alias as it was saved if aliases are
+// case-insensitive, so that it can be looked up in the database.
+func (r *RoomserverInternalAPI) storedAlias(ctx context.Context, alias string) (string, error) {
+	if !r.Cfg.Matrix.CaseInsensitiveAliases {
+		return alias, nil
+	}
+	stored, err := r.DB.GetAliasIgnoringCase(ctx, alias)
+	if err != nil || stored == "" {
+		return alias, err
+	}
+	return stored, nil
+}
+
+// removeFromCanonicalAlias removes a deleted alias from the alias and
+// alt_aliases of the room's m.room.canonical_alias event.
+func (r *RoomserverInternalAPI) removeFromCanonicalAlias(
+	ctx context.Context, userID, roomID, alias string,
+) error {
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
+			EventType: gomatrixserverlib.MRoomCanonicalAlias,
+			StateKey:  "",
+		}},
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := r.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return err
+	}
+	if len(res.StateEvents) == 0 {
+		return nil
+	}
+	matches := func(value interface{}) bool {
+		s, ok := value.(string)
+		if r.Cfg.Matrix.CaseInsensitiveAliases {
+			return ok && strings.EqualFold(s, alias)
+		}
+		return ok && s == alias
+	}
+
+	// Change the old content so that any other fields are kept.
+	var content map[string]interface{}
+	if err := json.Unmarshal(res.StateEvents[0].Content(), &content); err != nil {
+		return err
+	}
+	changed := false
+	if matches(content["alias"]) {
+		delete(content, "alias")
+		changed = true
+	}
+	if altAliases, ok := content["alt_aliases"].([]interface{}); ok {
+		kept := []interface{}{}
+		for _, altAlias := range altAliases {
+			if matches(altAlias) {
+				changed = true
+			} else {
+				kept = append(kept, altAlias)
+			}
+		}
+		content["alt_aliases"] = kept
+	}
+	if !changed {
+		return nil
+	}
+
+	event, perr := r.buildStateEvent(ctx, userID, roomID, gomatrixserverlib.MRoomCanonicalAlias, content)
+	if perr != nil {
+		return perr
+	}
+	return r.sendLocalEvents(ctx, *event)
 }
 
 type roomAliasesContent struct {
@@ -3,10 +3,10 @@ package internal
 import (
 	"sync"
 
-	"github.com/Shopify/sarama"
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/outbox"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -15,12 +15,14 @@ import (
 type RoomserverInternalAPI struct {
 	DB                   storage.Database
 	Cfg                  *config.Dendrite
-	Producer             sarama.SyncProducer
+	Outbox               *outbox.Relay // Produces the output events stored in DB
 	Cache                caching.RoomVersionCache
+	AliasCache           caching.RoomAliasCache // Caches lookups of local aliases
 	ServerName           gomatrixserverlib.ServerName
 	KeyRing              gomatrixserverlib.JSONVerifier
 	FedClient            *gomatrixserverlib.FederationClient
-	OutputRoomEventTopic string     // Kafka topic for new output room events
-	mutex                sync.Mutex // Protects calls to processRoomEvent
+	OutputRoomEventTopic string        // Kafka topic for new output room events
+	AuthDebug            *AuthDebugger // Records auth decisions in the rooms being debugged
+	mutex                sync.Mutex    // Protects calls to processRoomEvent
 	fsAPI                fsAPI.FederationSenderInternalAPI
 }
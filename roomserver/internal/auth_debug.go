@@ -0,0 +1,156 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// AuthDebugger records the auth decisions made for events in the rooms which
+// are being debugged, keeping only the most recent ones for each room.
+type AuthDebugger struct {
+	mutex        sync.Mutex
+	maxDecisions int
+	rooms        map[string]*authDecisions
+}
+
+// authDecisions is a ring buffer of the decisions made in a room.
+type authDecisions struct {
+	decisions []api.AuthDecision
+	// Where the next decision goes once the buffer is full.
+	next int
+}
+
+// NewAuthDebugger returns an AuthDebugger which records decisions for the
+// rooms in the config.
+func NewAuthDebugger(cfg *config.AuthDebug) *AuthDebugger {
+	d := &AuthDebugger{
+		maxDecisions: cfg.MaxDecisionsPerRoom,
+		rooms:        make(map[string]*authDecisions),
+	}
+	for _, roomID := range cfg.Rooms {
+		d.rooms[roomID] = &authDecisions{}
+	}
+	return d
+}
+
+func (d *AuthDebugger) setEnabled(roomID string, enabled bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !enabled {
+		delete(d.rooms, roomID)
+	} else if d.rooms[roomID] == nil {
+		d.rooms[roomID] = &authDecisions{}
+	}
+}
+
+// record stores the decision made about the event, if its room is being
+// debugged. The state is nil if the auth events couldn't be loaded.
+func (d *AuthDebugger) record(
+	event gomatrixserverlib.HeaderedEvent, authEventIDs []string, state *authEvents, err error,
+) {
+	if d == nil || d.maxDecisions <= 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	room := d.rooms[event.RoomID()]
+	if room == nil {
+		return
+	}
+
+	decision := api.AuthDecision{
+		EventID:      event.EventID(),
+		Type:         event.Type(),
+		StateKey:     event.StateKey(),
+		Sender:       event.Sender(),
+		Allowed:      err == nil,
+		AuthEventIDs: authEventIDs,
+		AuthState:    []api.AuthStateEvent{},
+		DecidedTS:    gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	if err != nil {
+		decision.Reason = err.Error()
+	}
+	if state != nil {
+		for _, ev := range state.events {
+			if ev.StateKey() == nil {
+				continue
+			}
+			decision.AuthState = append(decision.AuthState, api.AuthStateEvent{
+				Type:     ev.Type(),
+				StateKey: *ev.StateKey(),
+				EventID:  ev.EventID(),
+			})
+		}
+	}
+
+	if len(room.decisions) < d.maxDecisions {
+		room.decisions = append(room.decisions, decision)
+		return
+	}
+	room.decisions[room.next] = decision
+	room.next = (room.next + 1) % len(room.decisions)
+}
+
+// decisions returns whether the room is being debugged and the decisions
+// which have been recorded for it, oldest first.
+func (d *AuthDebugger) decisions(roomID string) (bool, []api.AuthDecision) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	room := d.rooms[roomID]
+	if room == nil {
+		return false, nil
+	}
+	decisions := make([]api.AuthDecision, 0, len(room.decisions))
+	decisions = append(decisions, room.decisions[room.next:]...)
+	decisions = append(decisions, room.decisions[:room.next]...)
+	return true, decisions
+}
+
+// PerformAuthDebug implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformAuthDebug(
+	ctx context.Context,
+	req *api.PerformAuthDebugRequest,
+	res *api.PerformAuthDebugResponse,
+) {
+	if req.RoomID == "" {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "missing room ID",
+		}
+		return
+	}
+	r.AuthDebug.setEnabled(req.RoomID, req.Enabled)
+}
+
+// QueryAuthDecisions implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryAuthDecisions(
+	ctx context.Context,
+	req *api.QueryAuthDecisionsRequest,
+	res *api.QueryAuthDecisionsResponse,
+) error {
+	res.Enabled, res.Decisions = r.AuthDebug.decisions(req.RoomID)
+	if res.Decisions == nil {
+		res.Decisions = []api.AuthDecision{}
+	}
+	return nil
+}
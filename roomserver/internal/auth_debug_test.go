@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestAuthDebugger(t *testing.T) {
+	d := NewAuthDebugger(&config.AuthDebug{MaxDecisionsPerRoom: 2})
+	member := func(userID string) gomatrixserverlib.HeaderedEvent {
+		return mustMakeStateEvent(t, gomatrixserverlib.MRoomMember, userID, map[string]interface{}{"membership": "join"}).Headered(gomatrixserverlib.RoomVersionV1)
+	}
+	eventIDs := func() []string {
+		var ids []string
+		_, decisions := d.decisions("!room:localhost")
+		for _, decision := range decisions {
+			ids = append(ids, decision.EventID)
+		}
+		return ids
+	}
+
+	d.record(member("@alice:localhost"), nil, nil, nil)
+	if enabled, decisions := d.decisions("!room:localhost"); enabled || len(decisions) != 0 {
+		t.Fatalf("expected nothing to be recorded for a room which isn't being debugged, got %v, %+v", enabled, decisions)
+	}
+
+	d.setEnabled("!room:localhost", true)
+	create := types.Event{Event: mustMakeStateEvent(t, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{})}
+	d.record(member("@alice:localhost"), []string{create.EventID()}, &authEvents{events: eventMap{create}}, errors.New("not allowed"))
+	_, decisions := d.decisions("!room:localhost")
+	if len(decisions) != 1 || decisions[0].Allowed || decisions[0].Reason != "not allowed" {
+		t.Fatalf("expected one rejection to be recorded, got %+v", decisions)
+	}
+	if len(decisions[0].AuthState) != 1 || decisions[0].AuthState[0].EventID != create.EventID() {
+		t.Errorf("expected the rejection to be recorded against the create event, got %+v", decisions[0].AuthState)
+	}
+
+	// only the most recent decisions are kept
+	d.record(member("@bob:localhost"), nil, nil, nil)
+	d.record(member("@charlie:localhost"), nil, nil, nil)
+	d.record(member("@dave:localhost"), nil, nil, nil)
+	want := []string{"$m.room.member@charlie:localhost:localhost", "$m.room.member@dave:localhost:localhost"}
+	if got := eventIDs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got decisions for %v, want %v", got, want)
+	}
+
+	d.setEnabled("!room:localhost", false)
+	if enabled, decisions := d.decisions("!room:localhost"); enabled || len(decisions) != 0 {
+		t.Errorf("expected the decisions to be forgotten, got %v, %+v", enabled, decisions)
+	}
+}
@@ -18,8 +18,9 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"time"
 
-	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal/outbox"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	log "github.com/sirupsen/logrus"
 
@@ -33,13 +34,28 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 	r.fsAPI = fsAPI
 }
 
-// WriteOutputEvents implements OutputRoomEventWriter
-func (r *RoomserverInternalAPI) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
-	messages := make([]*sarama.ProducerMessage, len(updates))
+// WriteOutputEvents stores events in the outbox and then produces them to
+// the output log. If producing them fails then they stay in the outbox for
+// the relay to retry.
+func (r *RoomserverInternalAPI) WriteOutputEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error {
+	messages, err := r.outputMessages(roomID, updates)
+	if err != nil {
+		return err
+	}
+	if err = r.DB.StoreOutboxMessages(ctx, messages); err != nil {
+		return err
+	}
+	r.flushOutbox(ctx)
+	return nil
+}
+
+// outputMessages prepares events to be stored in the outbox.
+func (r *RoomserverInternalAPI) outputMessages(roomID string, updates []api.OutputEvent) ([]outbox.Message, error) {
+	messages := make([]outbox.Message, len(updates))
 	for i := range updates {
 		value, err := json.Marshal(updates[i])
 		if err != nil {
-			return err
+			return nil, err
 		}
 		logger := log.WithFields(log.Fields{
 			"room_id": roomID,
@@ -56,13 +72,23 @@ func (r *RoomserverInternalAPI) WriteOutputEvents(roomID string, updates []api.O
 			})
 		}
 		logger.Infof("Producing to topic '%s'", r.OutputRoomEventTopic)
-		messages[i] = &sarama.ProducerMessage{
+		messages[i] = outbox.Message{
 			Topic: r.OutputRoomEventTopic,
-			Key:   sarama.StringEncoder(roomID),
-			Value: sarama.ByteEncoder(value),
+			Key:   roomID,
+			Value: value,
 		}
 	}
-	return r.Producer.SendMessages(messages)
+	return messages, nil
+}
+
+// flushOutbox produces the events in the outbox once the transaction which
+// stored them has been committed. Failures are only logged, since the events
+// are safely in the outbox and the relay will retry them.
+func (r *RoomserverInternalAPI) flushOutbox(ctx context.Context) {
+	defer observeStage("kafka_emit", time.Now())
+	if err := r.Outbox.Flush(ctx); err != nil {
+		log.WithError(err).Warn("Failed to produce output events, the outbox relay will retry")
+	}
 }
 
 // InputRoomEvents implements api.RoomserverInternalAPI
@@ -18,6 +18,7 @@ import (
 	"context"
 	"sort"
 
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -25,21 +26,24 @@ import (
 
 // checkAuthEvents checks that the event passes authentication checks
 // Returns the numeric IDs for the auth events.
+// The decision is recorded with the auth debugger, which may be nil.
 func checkAuthEvents(
 	ctx context.Context,
 	db storage.Database,
+	authDebug *AuthDebugger,
 	event gomatrixserverlib.HeaderedEvent,
 	authEventIDs []string,
 ) ([]types.EventNID, error) {
 	// Grab the numeric IDs for the supplied auth state events from the database.
 	authStateEntries, err := db.StateEntriesForEventIDs(ctx, authEventIDs)
 	if err != nil {
+		authDebug.record(event, authEventIDs, nil, err)
 		return nil, err
 	}
 	// TODO: check for duplicate state keys here.
 
 	// Work out which of the state events we actually need.
-	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event.Unwrap()})
+	stateNeeded := eventutil.StateNeededForAuth([]gomatrixserverlib.Event{event.Unwrap()})
 
 	// Load the actual auth events from the database.
 	authEvents, err := loadAuthEvents(ctx, db, stateNeeded, authStateEntries)
@@ -48,7 +52,9 @@ func checkAuthEvents(
 	}
 
 	// Check if the event is allowed.
-	if err = gomatrixserverlib.Allowed(event.Event, &authEvents); err != nil {
+	err = eventutil.Allowed(event.Event, &authEvents)
+	authDebug.record(event, authEventIDs, &authEvents, err)
+	if err != nil {
 		return nil, err
 	}
 
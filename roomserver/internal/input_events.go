@@ -18,15 +18,40 @@ package internal
 
 import (
 	"context"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
+// processRoomEventDuration breaks down the time spent processing input room
+// events, so that slow federation transactions can be narrowed down to a
+// particular part of the roomserver.
+var processRoomEventDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "process_room_event_stage_duration_seconds",
+		Help:      "Time spent in each stage of processing an input room event.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10},
+	},
+	[]string{"stage"},
+)
+
+func init() {
+	prometheus.MustRegister(processRoomEventDuration)
+}
+
+// observeStage records how long has passed since start for the given stage.
+func observeStage(stage string, start time.Time) {
+	processRoomEventDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
 // processRoomEvent can only be called once at a time
 //
 // TODO(#375): This should be rewritten to allow concurrent calls. The
@@ -44,7 +69,9 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 
 	// Check that the event passes authentication checks and work out
 	// the numeric IDs for the auth events.
-	authEventNIDs, err := checkAuthEvents(ctx, r.DB, headered, input.AuthEventIDs)
+	start := time.Now()
+	authEventNIDs, err := checkAuthEvents(ctx, r.DB, r.AuthDebug, headered, input.AuthEventIDs)
+	observeStage("auth", start)
 	if err != nil {
 		logrus.WithError(err).WithField("event_id", event.EventID()).WithField("auth_event_ids", input.AuthEventIDs).Error("processRoomEvent.checkAuthEvents failed for event")
 		return
@@ -63,7 +90,9 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 	}
 
 	// Store the event.
+	start = time.Now()
 	roomNID, stateAtEvent, redactionEvent, redactedEventID, err := r.DB.StoreEvent(ctx, event, input.TransactionID, authEventNIDs)
+	observeStage("storage", start)
 	if err != nil {
 		return
 	}
@@ -91,10 +120,29 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 	if stateAtEvent.BeforeStateSnapshotNID == 0 {
 		// We haven't calculated a state for this event yet.
 		// Lets calculate one.
+		start = time.Now()
 		err = r.calculateAndSetState(ctx, input, roomNID, &stateAtEvent, event)
+		observeStage("state_resolution", start)
+		if err != nil {
+			return
+		}
+	}
+
+	// Backfilled events are in the past of the room, so they mustn't move the
+	// forward extremities on or change the current state.
+	if input.Kind == api.KindBackfill {
+		err = r.WriteOutputEvents(ctx, event.RoomID(), []api.OutputEvent{
+			{
+				Type: api.OutputTypeOldRoomEvent,
+				OldRoomEvent: &api.OutputOldRoomEvent{
+					Event: event.Headered(headered.RoomVersion),
+				},
+			},
+		})
 		if err != nil {
 			return
 		}
+		return event.EventID(), nil
 	}
 
 	if err = r.updateLatestEvents(
@@ -113,7 +161,7 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 	// so notify downstream components to redact this event - they should have it if they've
 	// been tracking our output log.
 	if redactedEventID != "" {
-		err = r.WriteOutputEvents(event.RoomID(), []api.OutputEvent{
+		err = r.WriteOutputEvents(ctx, event.RoomID(), []api.OutputEvent{
 			{
 				Type: api.OutputTypeRedactedEvent,
 				RedactedEvent: &api.OutputRedactedEvent{
@@ -54,7 +54,7 @@ func (r *RoomserverInternalAPI) updateLatestEvents(
 	sendAsServer string,
 	transactionID *api.TransactionID,
 ) (err error) {
-	updater, err := r.DB.GetLatestEventsForUpdate(ctx, roomNID)
+	updater, err := r.DB.GetLatestEventsForUpdate(ctx, event.RoomID(), roomNID)
 	if err != nil {
 		return
 	}
@@ -64,6 +64,9 @@ func (r *RoomserverInternalAPI) updateLatestEvents(
 		if err == nil && txerr != nil {
 			err = txerr
 		}
+		if err == nil {
+			r.flushOutbox(ctx)
+		}
 	}()
 
 	u := latestEventsUpdater{
@@ -188,15 +191,15 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	}
 	updates = append(updates, *update)
 
-	// Send the event to the output logs.
-	// We do this inside the database transaction to ensure that we only mark an event as sent if we sent it.
-	// (n.b. this means that it's possible that the same event will be sent twice if the transaction fails but
-	//  the write to the output log succeeds)
-	// TODO: This assumes that writing the event to the output log is synchronous. It should be possible to
-	// send the event asynchronously but we would need to ensure that 1) the events are written to the log in
-	// the correct order, 2) that pending writes are resent across restarts. In order to avoid writing all the
-	// necessary bookkeeping we'll keep the event sending synchronous for now.
-	if err = u.api.WriteOutputEvents(u.event.RoomID(), updates); err != nil {
+	// Store the output events in the outbox inside the database transaction, so that the event is only
+	// marked as sent if its output events will be sent too. They are produced to the output log once the
+	// transaction has been committed, and the outbox relay resends them if producing them fails, including
+	// across restarts.
+	messages, err := u.api.outputMessages(u.event.RoomID(), updates)
+	if err != nil {
+		return err
+	}
+	if err = u.updater.StoreOutboxMessages(messages); err != nil {
 		return err
 	}
 
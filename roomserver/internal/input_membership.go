@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -124,6 +125,8 @@ func (r *RoomserverInternalAPI) updateMembership(
 		return updateToJoinMembership(mu, add, updates)
 	case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
 		return updateToLeaveMembership(mu, add, newMembership, updates)
+	case eventutil.Knock:
+		return updateToKnockMembership(mu, add, updates, updater.RoomVersion(), r.isLocalTarget(add))
 	default:
 		panic(fmt.Errorf(
 			"input: membership %q is not one of the allowed values", newMembership,
@@ -170,6 +173,32 @@ func updateToInviteMembership(
 	return updates, nil
 }
 
+func updateToKnockMembership(
+	mu types.MembershipUpdater, add *gomatrixserverlib.Event, updates []api.OutputEvent,
+	roomVersion gomatrixserverlib.RoomVersion, isTargetLocal bool,
+) ([]api.OutputEvent, error) {
+	// We may have already sent the knock to the consumers if we are
+	// reprocessing this event, in which case we don't need to send it again.
+	needsSending, err := mu.SetToKnock(*add)
+	if err != nil {
+		return nil, err
+	}
+	if needsSending && isTargetLocal {
+		// As with invites, we notify the consumers with a special event so
+		// that they handle knocks on rooms that we are in the same way as
+		// knocks on remote rooms, which never reach the room event stream.
+		onke := api.OutputNewKnockEvent{
+			Event:       add.Headered(roomVersion),
+			RoomVersion: roomVersion,
+		}
+		updates = append(updates, api.OutputEvent{
+			Type:          api.OutputTypeNewKnockEvent,
+			NewKnockEvent: &onke,
+		})
+	}
+	return updates, nil
+}
+
 func updateToJoinMembership(
 	mu types.MembershipUpdater, add *gomatrixserverlib.Event, updates []api.OutputEvent,
 ) ([]api.OutputEvent, error) {
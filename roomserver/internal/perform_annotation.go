@@ -0,0 +1,36 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// PerformClaimAnnotation implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformClaimAnnotation(
+	ctx context.Context,
+	request *api.PerformClaimAnnotationRequest,
+	response *api.PerformClaimAnnotationResponse,
+) (err error) {
+	if request.Release {
+		return r.DB.ReleaseAnnotation(ctx, request.EventID)
+	}
+	response.Duplicate, response.LimitReached, err = r.DB.ClaimAnnotation(
+		ctx, request.EventID, request.RelatesToID, request.Sender, request.Type, request.Key, request.Limit,
+	)
+	return err
+}
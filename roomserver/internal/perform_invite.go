@@ -88,6 +88,9 @@ func (r *RoomserverInternalAPI) processInviteEvent(
 		if err == nil && txerr != nil {
 			err = txerr
 		}
+		if succeeded && txerr == nil {
+			r.flushOutbox(ctx)
+		}
 	}()
 
 	if updater.IsJoin() {
@@ -140,7 +143,7 @@ func (r *RoomserverInternalAPI) processInviteEvent(
 	// check that the user is allowed to do this. We can only do this check if it is
 	// a local invite as we have the auth events, else we have to take it on trust.
 	if loopback != nil {
-		_, err = checkAuthEvents(ctx, r.DB, input.Event, input.Event.AuthEventIDs())
+		_, err = checkAuthEvents(ctx, r.DB, r.AuthDebug, input.Event, input.Event.AuthEventIDs())
 		if err != nil {
 			log.WithError(err).WithField("event_id", event.EventID()).WithField("auth_event_ids", event.AuthEventIDs()).Error(
 				"processInviteEvent.checkAuthEvents failed for event",
@@ -179,7 +182,11 @@ func (r *RoomserverInternalAPI) processInviteEvent(
 		return nil, err
 	}
 
-	if err = ow.WriteOutputEvents(roomID, outputUpdates); err != nil {
+	messages, err := ow.outputMessages(roomID, outputUpdates)
+	if err != nil {
+		return nil, err
+	}
+	if err = updater.StoreOutboxMessages(messages); err != nil {
 		return nil, err
 	}
 
@@ -222,8 +229,8 @@ func buildInviteStrippedState(
 	db storage.Database,
 	input *api.PerformInviteRequest,
 ) ([]gomatrixserverlib.InviteV2StrippedState, error) {
-	roomNID, err := db.RoomNID(ctx, input.Event.RoomID())
-	if err != nil || roomNID == 0 {
+	roomInfo, err := db.RoomInfo(ctx, input.Event.RoomID())
+	if err != nil || roomInfo == nil {
 		return nil, fmt.Errorf("room %q unknown", input.Event.RoomID())
 	}
 	stateWanted := []gomatrixserverlib.StateKeyTuple{}
@@ -239,13 +246,14 @@ func buildInviteStrippedState(
 			StateKey:  "",
 		})
 	}
-	_, currentStateSnapshotNID, _, err := db.LatestEventIDs(ctx, roomNID)
-	if err != nil {
-		return nil, err
-	}
+	// Include the inviter's membership so that clients can show who the invite is from.
+	stateWanted = append(stateWanted, gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomMember,
+		StateKey:  input.Event.Sender(),
+	})
 	roomState := state.NewStateResolution(db)
 	stateEntries, err := roomState.LoadStateAtSnapshotForStringTuples(
-		ctx, currentStateSnapshotNID, stateWanted,
+		ctx, roomInfo.StateSnapshotNID, stateWanted,
 	)
 	if err != nil {
 		return nil, err
@@ -261,7 +269,6 @@ func buildInviteStrippedState(
 	inviteState := []gomatrixserverlib.InviteV2StrippedState{
 		gomatrixserverlib.NewInviteV2StrippedState(&input.Event.Event),
 	}
-	stateEvents = append(stateEvents, types.Event{Event: input.Event.Unwrap()})
 	for _, event := range stateEvents {
 		inviteState = append(inviteState, gomatrixserverlib.NewInviteV2StrippedState(&event.Event))
 	}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -51,6 +52,9 @@ func (r *RoomserverInternalAPI) performJoin(
 			Msg:  fmt.Sprintf("User %q does not belong to this homeserver", req.UserID),
 		}
 	}
+	if err = r.checkJoinAllowed(req.RoomIDOrAlias); err != nil {
+		return "", err
+	}
 	if strings.HasPrefix(req.RoomIDOrAlias, "!") {
 		return r.performJoinRoomByID(ctx, req)
 	}
@@ -94,7 +98,7 @@ func (r *RoomserverInternalAPI) performJoinRoomByAlias(
 		req.ServerNames = append(req.ServerNames, dirRes.ServerNames...)
 	} else {
 		// Otherwise, look up if we know this room alias locally.
-		roomID, err = r.DB.GetRoomIDForAlias(ctx, req.RoomIDOrAlias)
+		roomID, err = r.resolveLocalAlias(ctx, req.RoomIDOrAlias)
 		if err != nil {
 			return "", fmt.Errorf("Lookup room alias %q failed: %w", req.RoomIDOrAlias, err)
 		}
@@ -105,6 +109,11 @@ func (r *RoomserverInternalAPI) performJoinRoomByAlias(
 		return "", fmt.Errorf("Alias %q not found", req.RoomIDOrAlias)
 	}
 
+	// The alias was allowed, but the room it points to might not be.
+	if err = r.checkJoinAllowed(roomID); err != nil {
+		return "", err
+	}
+
 	// If we do, then pluck out the room ID and continue the join.
 	req.RoomIDOrAlias = roomID
 	return r.performJoinRoomByID(ctx, req)
@@ -215,6 +224,11 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 		// If we haven't already joined the room then send an event
 		// into the room changing our membership status.
 		if !alreadyJoined {
+			if req.IsGuest {
+				if err = r.checkGuestCanJoin(ctx, req.RoomIDOrAlias); err != nil {
+					return "", err
+				}
+			}
 			inputReq := api.InputRoomEventsRequest{
 				InputRoomEvents: []api.InputRoomEvent{
 					{
@@ -273,6 +287,14 @@ func (r *RoomserverInternalAPI) performFederatedJoinRoomByID(
 	ctx context.Context,
 	req *api.PerformJoinRequest,
 ) error {
+	// We can't tell whether a room allows guests until we're in it.
+	if req.IsGuest {
+		return &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "Guests can only join rooms which this server is already in",
+		}
+	}
+
 	// Try joining by all of the supplied server names.
 	fedReq := fsAPI.PerformJoinRequest{
 		RoomID:      req.RoomIDOrAlias, // the room ID to try and join
@@ -291,3 +313,40 @@ func (r *RoomserverInternalAPI) performFederatedJoinRoomByID(
 	}
 	return nil
 }
+
+// checkJoinAllowed returns a PerformError if the join restrictions in the
+// config don't let local users join the given room ID or alias.
+func (r *RoomserverInternalAPI) checkJoinAllowed(roomIDOrAlias string) error {
+	if !r.Cfg.Matrix.JoinRestrictions.AllowsRoom(r.Cfg.Matrix.ServerName, roomIDOrAlias) {
+		return &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "Joining this room is not allowed on this server",
+		}
+	}
+	return nil
+}
+
+// checkGuestCanJoin returns a PerformError unless the room's guest access
+// rules let guests join it.
+func (r *RoomserverInternalAPI) checkGuestCanJoin(ctx context.Context, roomID string) error {
+	res := api.QueryLatestEventsAndStateResponse{}
+	err := r.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.guest_access", StateKey: ""},
+		},
+	}, &res)
+	if err != nil {
+		return fmt.Errorf("r.QueryLatestEventsAndState: %w", err)
+	}
+	for _, ev := range res.StateEvents {
+		var content eventutil.GuestAccessContent
+		if err = json.Unmarshal(ev.Content(), &content); err == nil && content.GuestAccess == "can_join" {
+			return nil
+		}
+	}
+	return &api.PerformError{
+		Code: api.PerformErrorNotAllowed,
+		Msg:  "Guests aren't allowed to join this room",
+	}
+}
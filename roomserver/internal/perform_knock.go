@@ -0,0 +1,261 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PerformKnock implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+	res *api.PerformKnockResponse,
+) {
+	res.RoomID, res.Error = r.performKnock(ctx, req)
+}
+
+// performKnock knocks on a room, which sends the knock into the room if
+// this server is in it and otherwise asks the federation sender to knock
+// through one of the given servers.
+func (r *RoomserverInternalAPI) performKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) (string, *api.PerformError) {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil || domain != r.Cfg.Matrix.ServerName {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("User %q does not belong to this homeserver", req.UserID),
+		}
+	}
+	roomID, serverNames, perr := r.resolveKnockRoom(ctx, req.RoomIDOrAlias)
+	if perr != nil {
+		return "", perr
+	}
+	serverNames = append(req.ServerNames, serverNames...)
+
+	content := gomatrixserverlib.MemberContent{
+		Membership: eventutil.Knock,
+		Reason:     req.Reason,
+	}
+	userID := req.UserID
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &userID,
+	}
+	if err = builder.SetContent(content); err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("builder.SetContent: %s", err),
+		}
+	}
+	buildRes := api.QueryLatestEventsAndStateResponse{}
+	event, err := eventutil.BuildEvent(ctx, &builder, r.Cfg, time.Now(), r, &buildRes)
+	switch err {
+	case nil:
+	case eventutil.ErrRoomNoExists:
+		return roomID, r.performFederatedKnock(ctx, req, roomID, serverNames)
+	default:
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("eventutil.BuildEvent: %s", err),
+		}
+	}
+
+	// Check the knock here rather than leaving it to the input, so that the
+	// user is told why they can't knock.
+	if !version.AllowsKnocking(event.RoomVersion) {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("Room version %q does not allow knocking", event.RoomVersion),
+		}
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range buildRes.StateEvents {
+		if err = authEvents.AddEvent(&buildRes.StateEvents[i].Event); err != nil {
+			return "", &api.PerformError{
+				Msg: fmt.Sprintf("authEvents.AddEvent: %s", err),
+			}
+		}
+	}
+	if err = eventutil.Allowed(event.Event, &authEvents); err != nil {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("You are not allowed to knock on this room: %s", err),
+		}
+	}
+	if err = r.sendLocalEvents(ctx, *event); err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("r.sendLocalEvents: %s", err),
+		}
+	}
+	return roomID, nil
+}
+
+// resolveKnockRoom returns the ID of the room to knock on, along with the
+// servers which are worth knocking through if this server isn't in it.
+func (r *RoomserverInternalAPI) resolveKnockRoom(
+	ctx context.Context, roomIDOrAlias string,
+) (string, []gomatrixserverlib.ServerName, *api.PerformError) {
+	switch {
+	case strings.HasPrefix(roomIDOrAlias, "!"):
+		_, domain, err := gomatrixserverlib.SplitID('!', roomIDOrAlias)
+		if err != nil {
+			return "", nil, &api.PerformError{
+				Code: api.PerformErrorBadRequest,
+				Msg:  fmt.Sprintf("Room ID %q is invalid: %s", roomIDOrAlias, err),
+			}
+		}
+		if domain == r.Cfg.Matrix.ServerName {
+			return roomIDOrAlias, nil, nil
+		}
+		return roomIDOrAlias, []gomatrixserverlib.ServerName{domain}, nil
+
+	case strings.HasPrefix(roomIDOrAlias, "#"):
+		_, domain, err := gomatrixserverlib.SplitID('#', roomIDOrAlias)
+		if err != nil {
+			return "", nil, &api.PerformError{
+				Code: api.PerformErrorBadRequest,
+				Msg:  fmt.Sprintf("Alias %q is not in the correct format", roomIDOrAlias),
+			}
+		}
+		var roomID string
+		var serverNames []gomatrixserverlib.ServerName
+		if domain == r.Cfg.Matrix.ServerName {
+			if roomID, err = r.resolveLocalAlias(ctx, roomIDOrAlias); err != nil {
+				return "", nil, &api.PerformError{
+					Msg: fmt.Sprintf("Lookup room alias %q failed: %s", roomIDOrAlias, err),
+				}
+			}
+		} else {
+			dirReq := fsAPI.PerformDirectoryLookupRequest{
+				RoomAlias:  roomIDOrAlias,
+				ServerName: domain,
+			}
+			dirRes := fsAPI.PerformDirectoryLookupResponse{}
+			if err = r.fsAPI.PerformDirectoryLookup(ctx, &dirReq, &dirRes); err != nil {
+				return "", nil, &api.PerformError{
+					Msg: fmt.Sprintf("Looking up alias %q over federation failed: %s", roomIDOrAlias, err),
+				}
+			}
+			roomID = dirRes.RoomID
+			serverNames = append(dirRes.ServerNames, domain)
+		}
+		if roomID == "" {
+			return "", nil, &api.PerformError{
+				Code: api.PerformErrorNoRoom,
+				Msg:  fmt.Sprintf("Alias %q not found", roomIDOrAlias),
+			}
+		}
+		return roomID, serverNames, nil
+	}
+	return "", nil, &api.PerformError{
+		Code: api.PerformErrorBadRequest,
+		Msg:  fmt.Sprintf("Room ID or alias %q is invalid", roomIDOrAlias),
+	}
+}
+
+func (r *RoomserverInternalAPI) performFederatedKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+	roomID string,
+	serverNames []gomatrixserverlib.ServerName,
+) *api.PerformError {
+	if len(serverNames) == 0 {
+		return &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room ID %q does not exist", roomID),
+		}
+	}
+	fedReq := fsAPI.PerformKnockRequest{
+		RoomID:      roomID,
+		UserID:      req.UserID,
+		Reason:      req.Reason,
+		ServerNames: serverNames,
+	}
+	fedRes := fsAPI.PerformKnockResponse{}
+	if err := r.fsAPI.PerformKnock(ctx, &fedReq, &fedRes); err != nil {
+		return &api.PerformError{
+			Code: api.PerformErrRemote,
+			Msg:  err.Error(),
+		}
+	}
+	if err := r.storeFederatedKnock(ctx, fedRes.KnockEvent, fedRes.KnockStateEvents); err != nil {
+		return &api.PerformError{
+			Msg: fmt.Sprintf("r.storeFederatedKnock: %s", err),
+		}
+	}
+	return nil
+}
+
+// storeFederatedKnock records that a local user has knocked on a room which
+// this server isn't in, along with the stripped state of the room which the
+// remote server returned, so that the knock shows up when the user syncs.
+func (r *RoomserverInternalAPI) storeFederatedKnock(
+	ctx context.Context,
+	knockEvent gomatrixserverlib.HeaderedEvent,
+	knockRoomState []gomatrixserverlib.InviteV2StrippedState,
+) (err error) {
+	event := knockEvent.Unwrap()
+	knockRoomState = append(knockRoomState, gomatrixserverlib.NewInviteV2StrippedState(&event))
+	if err = event.SetUnsignedField("knock_room_state", knockRoomState); err != nil {
+		return err
+	}
+
+	updater, err := r.DB.MembershipUpdater(ctx, event.RoomID(), *event.StateKey(), true, knockEvent.RoomVersion)
+	if err != nil {
+		return err
+	}
+	succeeded := false
+	defer func() {
+		txerr := sqlutil.EndTransaction(updater, &succeeded)
+		if err == nil && txerr != nil {
+			err = txerr
+		}
+		if succeeded && txerr == nil {
+			r.flushOutbox(ctx)
+		}
+	}()
+
+	if updater.IsInvite() || updater.IsJoin() {
+		// The user was invited to or joined the room while we were knocking,
+		// which takes precedence over the knock.
+		return nil
+	}
+	outputUpdates, err := updateToKnockMembership(updater, &event, nil, knockEvent.RoomVersion, true)
+	if err != nil {
+		return err
+	}
+	messages, err := r.outputMessages(event.RoomID(), outputUpdates)
+	if err != nil {
+		return err
+	}
+	if err = updater.StoreOutboxMessages(messages); err != nil {
+		return err
+	}
+	succeeded = true
+	return nil
+}
@@ -155,7 +155,7 @@ func (r *RoomserverInternalAPI) performRejectInvite(
 
 	// Withdraw the invite, so that the sync API etc are
 	// notified that we rejected it.
-	return r.WriteOutputEvents(req.RoomID, []api.OutputEvent{
+	return r.WriteOutputEvents(ctx, req.RoomID, []api.OutputEvent{
 		{
 			Type: api.OutputTypeRetireInviteEvent,
 			RetireInviteEvent: &api.OutputRetireInviteEvent{
@@ -0,0 +1,229 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PerformKick implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformKick(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+	res.EventID, res.Error = r.performModeration(ctx, req, "kick")
+}
+
+// PerformBan implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformBan(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+	res.EventID, res.Error = r.performModeration(ctx, req, "ban")
+}
+
+// PerformUnban implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformUnban(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+	res.EventID, res.Error = r.performModeration(ctx, req, "unban")
+}
+
+// performModeration kicks, bans or unbans the target user, depending on the
+// action. The sender's power is checked against the room's
+// power levels first, so that the caller gets a useful error rather than the
+// event being rejected by the event auth checks once it has been sent.
+// nolint:gocyclo
+func (r *RoomserverInternalAPI) performModeration(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	action string,
+) (string, *api.PerformError) {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil || domain != r.Cfg.Matrix.ServerName {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("User %q does not belong to this homeserver", req.UserID),
+		}
+	}
+	if _, _, err = gomatrixserverlib.SplitID('@', req.TargetUserID); err != nil {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("User ID %q is invalid: %s", req.TargetUserID, err),
+		}
+	}
+
+	latestReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: req.RoomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: req.UserID},
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: req.TargetUserID},
+		},
+	}
+	latestRes := api.QueryLatestEventsAndStateResponse{}
+	if err = r.QueryLatestEventsAndState(ctx, &latestReq, &latestRes); err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("r.QueryLatestEventsAndState: %s", err),
+		}
+	}
+	if !latestRes.RoomExists {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %q does not exist", req.RoomID),
+		}
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	var creator string
+	var targetEvent *gomatrixserverlib.Event
+	for i := range latestRes.StateEvents {
+		event := &latestRes.StateEvents[i].Event
+		if err = authEvents.AddEvent(event); err != nil {
+			return "", &api.PerformError{
+				Msg: fmt.Sprintf("authEvents.AddEvent: %s", err),
+			}
+		}
+		switch {
+		case event.Type() == gomatrixserverlib.MRoomCreate:
+			creator = event.Sender()
+		case event.Type() == gomatrixserverlib.MRoomMember && event.StateKeyEquals(req.TargetUserID):
+			targetEvent = event
+		}
+	}
+
+	if membership, _ := membershipOf(&authEvents, req.UserID); membership != gomatrixserverlib.Join {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "You are not in the room",
+		}
+	}
+	targetMembership, err := membershipOf(&authEvents, req.TargetUserID)
+	if err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("membershipOf: %s", err),
+		}
+	}
+	switch action {
+	case "kick":
+		if targetMembership == gomatrixserverlib.Ban {
+			return "", &api.PerformError{
+				Code: api.PerformErrorNotAllowed,
+				Msg:  "Cannot kick banned users",
+			}
+		}
+		if targetMembership != gomatrixserverlib.Join && targetMembership != gomatrixserverlib.Invite {
+			return "", &api.PerformError{
+				Code: api.PerformErrorNoOperation,
+				Msg:  "The user is not in the room",
+			}
+		}
+	case "unban":
+		if targetMembership != gomatrixserverlib.Ban {
+			return "", &api.PerformError{
+				Code: api.PerformErrorBadRequest,
+				Msg:  "Can only unban users that are banned",
+			}
+		}
+	}
+
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&authEvents, creator)
+	if err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("gomatrixserverlib.NewPowerLevelContentFromAuthEvents: %s", err),
+		}
+	}
+	senderLevel := powerLevels.UserLevel(req.UserID)
+	needed := powerLevels.Ban
+	if action == "kick" {
+		needed = powerLevels.Kick
+	}
+	if senderLevel < needed {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("You don't have the power to %s users in the room", action),
+		}
+	}
+	// Unbanning only needs the ban level, but kicks and bans can only be
+	// used on users with less power than the sender.
+	if action != "unban" && powerLevels.UserLevel(req.TargetUserID) >= senderLevel {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("You don't have the power to %s this user", action),
+		}
+	}
+
+	// The target's display name and avatar are kept from their current
+	// membership, if they have one.
+	var content gomatrixserverlib.MemberContent
+	if targetEvent != nil {
+		if err = json.Unmarshal(targetEvent.Content(), &content); err != nil {
+			content = gomatrixserverlib.MemberContent{}
+		}
+	}
+	content.Membership = gomatrixserverlib.Leave
+	if action == "ban" {
+		content.Membership = gomatrixserverlib.Ban
+	}
+	content.Reason = req.Reason
+	content.IsDirect = false
+	content.ThirdPartyInvite = nil
+
+	stateKey := req.TargetUserID
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   req.UserID,
+		RoomID:   req.RoomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &stateKey,
+	}
+	if err = builder.SetContent(content); err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("builder.SetContent: %s", err),
+		}
+	}
+	event, err := eventutil.BuildEvent(ctx, &builder, r.Cfg, time.Now(), r, &api.QueryLatestEventsAndStateResponse{})
+	if err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("eventutil.BuildEvent: %s", err),
+		}
+	}
+	if err = r.sendLocalEvents(ctx, *event); err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("r.sendLocalEvents: %s", err),
+		}
+	}
+	return event.EventID(), nil
+}
+
+// membershipOf returns the membership of the user in the given state, or
+// leave if they don't have one.
+func membershipOf(authEvents gomatrixserverlib.AuthEventProvider, userID string) (string, error) {
+	event, err := authEvents.Member(userID)
+	if err != nil || event == nil {
+		return gomatrixserverlib.Leave, err
+	}
+	return event.Membership()
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PerformPeek handles peeking into matrix rooms. Only local world-readable rooms
+// can currently be peeked into, as peeking over federation isn't supported yet.
+func (r *RoomserverInternalAPI) PerformPeek(
+	ctx context.Context,
+	req *api.PerformPeekRequest,
+	res *api.PerformPeekResponse,
+) {
+	roomID, err := r.performPeek(ctx, req)
+	if err != nil {
+		perr, ok := err.(*api.PerformError)
+		if ok {
+			res.Error = perr
+		} else {
+			res.Error = &api.PerformError{
+				Msg: err.Error(),
+			}
+		}
+	}
+	res.RoomID = roomID
+}
+
+func (r *RoomserverInternalAPI) performPeek(
+	ctx context.Context,
+	req *api.PerformPeekRequest,
+) (string, error) {
+	if err := r.checkLocalUser(req.UserID); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(req.RoomIDOrAlias, "!") {
+		return r.performPeekRoomByID(ctx, req)
+	}
+	if strings.HasPrefix(req.RoomIDOrAlias, "#") {
+		return r.performPeekRoomByAlias(ctx, req)
+	}
+	return "", &api.PerformError{
+		Code: api.PerformErrorBadRequest,
+		Msg:  fmt.Sprintf("Room ID or alias %q is invalid", req.RoomIDOrAlias),
+	}
+}
+
+func (r *RoomserverInternalAPI) performPeekRoomByAlias(
+	ctx context.Context,
+	req *api.PerformPeekRequest,
+) (string, error) {
+	_, domain, err := gomatrixserverlib.SplitID('#', req.RoomIDOrAlias)
+	if err != nil {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("Alias %q is not in the correct format", req.RoomIDOrAlias),
+		}
+	}
+	if domain != r.Cfg.Matrix.ServerName {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("Peeking into rooms over federation is not supported (alias %q)", req.RoomIDOrAlias),
+		}
+	}
+
+	roomID, err := r.DB.GetRoomIDForAlias(ctx, req.RoomIDOrAlias)
+	if err != nil {
+		return "", fmt.Errorf("Lookup room alias %q failed: %w", req.RoomIDOrAlias, err)
+	}
+	if roomID == "" {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Alias %q not found", req.RoomIDOrAlias),
+		}
+	}
+
+	req.RoomIDOrAlias = roomID
+	return r.performPeekRoomByID(ctx, req)
+}
+
+func (r *RoomserverInternalAPI) performPeekRoomByID(
+	ctx context.Context,
+	req *api.PerformPeekRequest,
+) (string, error) {
+	roomID := req.RoomIDOrAlias
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("Room ID %q is invalid: %s", roomID, err),
+		}
+	}
+
+	latestReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{
+				EventType: gomatrixserverlib.MRoomHistoryVisibility,
+				StateKey:  "",
+			},
+		},
+	}
+	latestRes := api.QueryLatestEventsAndStateResponse{}
+	if err := r.QueryLatestEventsAndState(ctx, &latestReq, &latestRes); err != nil {
+		return "", err
+	}
+	if !latestRes.RoomExists {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %q is not known to this server", roomID),
+		}
+	}
+
+	stateEvents := gomatrixserverlib.UnwrapEventHeaders(latestRes.StateEvents)
+	if auth.HistoryVisibilityForRoom(stateEvents) != "world_readable" {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "Room is not world-readable",
+		}
+	}
+
+	// Let the sync API know that this device is now peeking into the room.
+	// It is responsible for keeping track of peeks from here on.
+	err := r.WriteOutputEvents(ctx, roomID, []api.OutputEvent{
+		{
+			Type: api.OutputTypeNewPeek,
+			NewPeek: &api.OutputNewPeek{
+				RoomID:   roomID,
+				UserID:   req.UserID,
+				DeviceID: req.DeviceID,
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return roomID, nil
+}
+
+// PerformUnpeek stops a device from peeking into a room.
+func (r *RoomserverInternalAPI) PerformUnpeek(
+	ctx context.Context,
+	req *api.PerformUnpeekRequest,
+	res *api.PerformUnpeekResponse,
+) {
+	if err := r.performUnpeek(ctx, req); err != nil {
+		perr, ok := err.(*api.PerformError)
+		if ok {
+			res.Error = perr
+		} else {
+			res.Error = &api.PerformError{
+				Msg: err.Error(),
+			}
+		}
+	}
+}
+
+func (r *RoomserverInternalAPI) performUnpeek(
+	ctx context.Context,
+	req *api.PerformUnpeekRequest,
+) error {
+	if err := r.checkLocalUser(req.UserID); err != nil {
+		return err
+	}
+	if _, _, err := gomatrixserverlib.SplitID('!', req.RoomID); err != nil {
+		return &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("Room ID %q is invalid: %s", req.RoomID, err),
+		}
+	}
+	return r.WriteOutputEvents(ctx, req.RoomID, []api.OutputEvent{
+		{
+			Type: api.OutputTypeRetirePeek,
+			RetirePeek: &api.OutputRetirePeek{
+				RoomID:   req.RoomID,
+				UserID:   req.UserID,
+				DeviceID: req.DeviceID,
+			},
+		},
+	})
+}
+
+func (r *RoomserverInternalAPI) checkLocalUser(userID string) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("Supplied user ID %q in incorrect format", userID),
+		}
+	}
+	if domain != r.Cfg.Matrix.ServerName {
+		return &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("User %q does not belong to this homeserver", userID),
+		}
+	}
+	return nil
+}
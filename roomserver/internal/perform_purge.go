@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// PerformPurgeRoom implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformPurgeRoom(
+	ctx context.Context,
+	req *api.PerformPurgeRoomRequest,
+	res *api.PerformPurgeRoomResponse,
+) {
+	res.EvacuatedUsers, res.Error = r.performPurgeRoom(ctx, req)
+}
+
+func (r *RoomserverInternalAPI) performPurgeRoom(
+	ctx context.Context,
+	req *api.PerformPurgeRoomRequest,
+) ([]string, *api.PerformError) {
+	logger := log.WithField("room_id", req.RoomID)
+	roomInfo, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return nil, &api.PerformError{Msg: err.Error()}
+	}
+	if roomInfo == nil {
+		return nil, &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("room %q not found", req.RoomID),
+		}
+	}
+
+	// Make the local members leave first, so that the other servers in the
+	// room and the users' clients find out that they've gone. The room is
+	// going either way, so a failure to leave is only logged.
+	var evacuated []string
+	if !roomInfo.IsStub {
+		eventNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+		if err != nil {
+			return nil, &api.PerformError{Msg: err.Error()}
+		}
+		events, err := r.DB.Events(ctx, eventNIDs)
+		if err != nil {
+			return nil, &api.PerformError{Msg: err.Error()}
+		}
+		for _, event := range events {
+			userID := *event.StateKey()
+			leaveRes := api.PerformLeaveResponse{}
+			err = r.PerformLeave(ctx, &api.PerformLeaveRequest{
+				RoomID: req.RoomID,
+				UserID: userID,
+			}, &leaveRes)
+			if err != nil {
+				logger.WithError(err).Warnf("Failed to make %q leave the room being purged", userID)
+				continue
+			}
+			evacuated = append(evacuated, userID)
+		}
+	}
+
+	aliases, err := r.DB.GetAliasesForRoomID(ctx, req.RoomID)
+	if err != nil {
+		return evacuated, &api.PerformError{Msg: err.Error()}
+	}
+	messages, err := r.outputMessages(req.RoomID, []api.OutputEvent{
+		{
+			Type:      api.OutputTypePurgeRoom,
+			PurgeRoom: &api.OutputPurgeRoom{RoomID: req.RoomID},
+		},
+	})
+	if err != nil {
+		return evacuated, &api.PerformError{Msg: err.Error()}
+	}
+	// Events mustn't be processed for the room while it is being deleted.
+	r.mutex.Lock()
+	err = r.DB.PurgeRoom(ctx, req.RoomID, messages)
+	r.mutex.Unlock()
+	if err != nil {
+		return evacuated, &api.PerformError{Msg: err.Error()}
+	}
+	for _, alias := range aliases {
+		r.AliasCache.InvalidateRoomAlias(r.aliasCacheKey(alias))
+	}
+	r.flushOutbox(ctx)
+	logger.Infof("Purged the room, evacuating %d local users", len(evacuated))
+	return evacuated, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	defaultEventReportsLimit = 100
+	maxEventReportsLimit     = 1000
+)
+
+// PerformReportEvent implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformReportEvent(
+	ctx context.Context,
+	req *api.PerformReportEventRequest,
+	res *api.PerformReportEventResponse,
+) {
+	res.ReportID, res.Error = r.performReportEvent(ctx, req)
+}
+
+func (r *RoomserverInternalAPI) performReportEvent(
+	ctx context.Context,
+	req *api.PerformReportEventRequest,
+) (int64, *api.PerformError) {
+	if req.Score < -100 || req.Score > 0 {
+		return 0, &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "score must be between -100 and 0",
+		}
+	}
+	// Users can only report events which they can see, and we don't let
+	// them find out whether other events exist.
+	notFound := &api.PerformError{
+		Code: api.PerformErrorNoRoom,
+		Msg:  fmt.Sprintf("event %q not found in room %q", req.EventID, req.RoomID),
+	}
+	events, err := r.DB.EventsFromIDs(ctx, []string{req.EventID})
+	if err != nil {
+		return 0, &api.PerformError{Msg: err.Error()}
+	}
+	if len(events) != 1 || events[0].RoomID() != req.RoomID {
+		return 0, notFound
+	}
+	var visibility api.QueryUserAllowedToSeeEventsResponse
+	err = r.QueryUserAllowedToSeeEvents(ctx, &api.QueryUserAllowedToSeeEventsRequest{
+		UserID:   req.UserID,
+		EventIDs: []string{req.EventID},
+	}, &visibility)
+	if err != nil {
+		return 0, &api.PerformError{Msg: err.Error()}
+	}
+	if !visibility.AllowedEventIDs[req.EventID] {
+		return 0, notFound
+	}
+
+	reportID, err := r.DB.StoreEventReport(ctx, &api.EventReport{
+		RoomID:     req.RoomID,
+		EventID:    req.EventID,
+		UserID:     req.UserID,
+		Reason:     req.Reason,
+		Score:      req.Score,
+		ReceivedTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		return 0, &api.PerformError{Msg: err.Error()}
+	}
+	return reportID, nil
+}
+
+// PerformResolveEventReport implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformResolveEventReport(
+	ctx context.Context,
+	req *api.PerformResolveEventReportRequest,
+	res *api.PerformResolveEventReportResponse,
+) {
+	report, err := r.DB.GetEventReport(ctx, req.ReportID)
+	if err != nil {
+		res.Error = &api.PerformError{Msg: err.Error()}
+		return
+	}
+	if report == nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("report %d not found", req.ReportID),
+		}
+		return
+	}
+	if report.ResolvedTS != 0 {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoOperation,
+			Msg:  fmt.Sprintf("report %d has already been resolved", req.ReportID),
+		}
+		return
+	}
+	err = r.DB.ResolveEventReport(ctx, req.ReportID, req.ResolvedBy, gomatrixserverlib.AsTimestamp(time.Now()))
+	if err != nil {
+		res.Error = &api.PerformError{Msg: err.Error()}
+	}
+}
+
+// QueryEventReports implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryEventReports(
+	ctx context.Context,
+	req *api.QueryEventReportsRequest,
+	res *api.QueryEventReportsResponse,
+) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultEventReportsLimit
+	} else if limit > maxEventReportsLimit {
+		limit = maxEventReportsLimit
+	}
+	offset := req.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	var err error
+	res.Reports, res.TotalReports, err = r.DB.GetEventReports(ctx, req.RoomID, req.IncludeResolved, offset, limit)
+	return err
+}
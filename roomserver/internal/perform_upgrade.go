@@ -0,0 +1,445 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// The state which is copied from the old room into the new room, in the order
+// that it is sent. The create event, the upgrading user's membership and the
+// power levels are always sent first.
+var upgradedStateTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomHistoryVisibility,
+	"m.room.guest_access",
+	"m.room.encryption",
+	"m.room.server_acl",
+	"m.room.related_groups",
+	gomatrixserverlib.MRoomName,
+	"m.room.topic",
+	"m.room.avatar",
+	gomatrixserverlib.MRoomCanonicalAlias,
+}
+
+// PerformRoomUpgrade implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformRoomUpgrade(
+	ctx context.Context,
+	req *api.PerformRoomUpgradeRequest,
+	res *api.PerformRoomUpgradeResponse,
+) {
+	res.NewRoomID, res.Error = r.performRoomUpgrade(ctx, req)
+	if res.Error != nil {
+		log.WithFields(log.Fields{
+			"room_id": req.RoomID,
+			"user_id": req.UserID,
+		}).WithError(res.Error).Warn("Failed to upgrade room")
+	}
+}
+
+// performRoomUpgrade creates the new room, sends a tombstone into the old room
+// pointing at it and then moves the room's aliases across. Once the tombstone
+// has been sent the upgrade has happened, so failing to tidy up the old room
+// afterwards is only logged.
+// nolint:gocyclo
+func (r *RoomserverInternalAPI) performRoomUpgrade(
+	ctx context.Context,
+	req *api.PerformRoomUpgradeRequest,
+) (string, *api.PerformError) {
+	if _, err := version.SupportedRoomVersion(req.RoomVersion); err != nil {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  err.Error(),
+		}
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil || domain != r.Cfg.Matrix.ServerName {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("User %q does not belong to this homeserver", req.UserID),
+		}
+	}
+
+	// Load the whole of the current state of the old room.
+	latestReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: req.RoomID,
+	}
+	latestRes := api.QueryLatestEventsAndStateResponse{}
+	if err = r.QueryLatestEventsAndState(ctx, &latestReq, &latestRes); err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("r.QueryLatestEventsAndState: %s", err),
+		}
+	}
+	if !latestRes.RoomExists {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %q does not exist", req.RoomID),
+		}
+	}
+	oldState := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event, len(latestRes.StateEvents))
+	for i := range latestRes.StateEvents {
+		event := &latestRes.StateEvents[i].Event
+		oldState[gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}] = event
+	}
+	if _, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: "m.room.tombstone", StateKey: ""}]; ok {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "The room has already been upgraded",
+		}
+	}
+	memberEvent, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: req.UserID}]
+	if !ok {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "You are not in the room",
+		}
+	}
+	if membership, merr := memberEvent.Membership(); merr != nil || membership != gomatrixserverlib.Join {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "You are not in the room",
+		}
+	}
+
+	// The tombstone is built first because the new room refers back to it.
+	// Checking that it is allowed also checks that the user may upgrade the
+	// room at all.
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), r.Cfg.Matrix.ServerName)
+	tombstone, perr := r.buildStateEvent(ctx, req.UserID, req.RoomID, "m.room.tombstone", map[string]interface{}{
+		"body":             "This room has been replaced",
+		"replacement_room": newRoomID,
+	})
+	if perr != nil {
+		return "", perr
+	}
+
+	newRoomEvents, err := r.buildUpgradedRoom(req, newRoomID, oldState, memberEvent, tombstone.EventID())
+	if err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("Failed to build the new room: %s", err),
+		}
+	}
+	if err = r.sendLocalEvents(ctx, newRoomEvents...); err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("Failed to create the new room: %s", err),
+		}
+	}
+	if err = r.sendLocalEvents(ctx, *tombstone); err != nil {
+		return "", &api.PerformError{
+			Msg: fmt.Sprintf("Failed to send the tombstone: %s", err),
+		}
+	}
+
+	logger := log.WithFields(log.Fields{
+		"room_id":     req.RoomID,
+		"new_room_id": newRoomID,
+		"user_id":     req.UserID,
+	})
+	logger.Info("Upgraded room")
+	r.moveRoomAliases(ctx, req.UserID, req.RoomID, newRoomID, oldState)
+	if err = r.restrictUpgradedRoom(ctx, req.UserID, req.RoomID, oldState); err != nil {
+		logger.WithError(err).Warn("Failed to restrict the power levels in the old room")
+	}
+	return newRoomID, nil
+}
+
+// buildStateEvent builds a state event with an empty state key, returning an
+// error if the user isn't allowed to send it.
+func (r *RoomserverInternalAPI) buildStateEvent(
+	ctx context.Context, userID, roomID, eventType string, content interface{},
+) (*gomatrixserverlib.HeaderedEvent, *api.PerformError) {
+	stateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     eventType,
+		StateKey: &stateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		return nil, &api.PerformError{
+			Msg: fmt.Sprintf("builder.SetContent: %s", err),
+		}
+	}
+	buildRes := api.QueryLatestEventsAndStateResponse{}
+	event, err := eventutil.BuildEvent(ctx, &builder, r.Cfg, time.Now(), r, &buildRes)
+	if err != nil {
+		return nil, &api.PerformError{
+			Msg: fmt.Sprintf("eventutil.BuildEvent: %s", err),
+		}
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range buildRes.StateEvents {
+		if err = authEvents.AddEvent(&buildRes.StateEvents[i].Event); err != nil {
+			return nil, &api.PerformError{
+				Msg: fmt.Sprintf("authEvents.AddEvent: %s", err),
+			}
+		}
+	}
+	if err = gomatrixserverlib.Allowed(event.Event, &authEvents); err != nil {
+		return nil, &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("You are not allowed to send %s events in the room", eventType),
+		}
+	}
+	return event, nil
+}
+
+// buildUpgradedRoom builds the events which create the new room, copying the
+// state of the old room.
+func (r *RoomserverInternalAPI) buildUpgradedRoom(
+	req *api.PerformRoomUpgradeRequest, newRoomID string,
+	oldState map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+	memberEvent *gomatrixserverlib.Event, tombstoneEventID string,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	type fledglingEvent struct {
+		Type     string
+		StateKey string
+		Content  interface{}
+	}
+
+	createContent := map[string]interface{}{
+		"creator":      req.UserID,
+		"room_version": req.RoomVersion,
+		"predecessor": map[string]string{
+			"room_id":  req.RoomID,
+			"event_id": tombstoneEventID,
+		},
+	}
+	if oldCreate, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}]; ok {
+		var oldContent map[string]interface{}
+		if err := json.Unmarshal(oldCreate.Content(), &oldContent); err != nil {
+			return nil, err
+		}
+		if federate, ok := oldContent["m.federate"]; ok {
+			createContent["m.federate"] = federate
+		}
+	}
+
+	var memberContent gomatrixserverlib.MemberContent
+	if err := json.Unmarshal(memberEvent.Content(), &memberContent); err != nil {
+		return nil, err
+	}
+	memberContent.Membership = gomatrixserverlib.Join
+
+	// The power levels are copied from the old room, but the user who is
+	// upgrading the room may not have the power to send all of the copied
+	// state. If so, they are given enough power to do so until all of the
+	// state has been sent, and then the old power levels are put back.
+	var oldPowerLevels json.RawMessage
+	powerLevels := eventutil.InitialPowerLevelsContent(req.UserID)
+	if oldPLEvent, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]; ok {
+		var err error
+		if powerLevels, err = gomatrixserverlib.NewPowerLevelContentFromEvent(*oldPLEvent); err != nil {
+			return nil, err
+		}
+		oldPowerLevels = oldPLEvent.Content()
+	}
+	needed := powerLevels.EventLevel(gomatrixserverlib.MRoomPowerLevels, true)
+	for _, eventType := range upgradedStateTypes {
+		if level := powerLevels.EventLevel(eventType, true); level > needed {
+			needed = level
+		}
+	}
+	var restorePowerLevels bool
+	initialPowerLevels := interface{}(powerLevels)
+	if oldPowerLevels != nil {
+		initialPowerLevels = oldPowerLevels
+		if powerLevels.UserLevel(req.UserID) < needed {
+			users := make(map[string]int64, len(powerLevels.Users)+1)
+			for userID, level := range powerLevels.Users {
+				users[userID] = level
+			}
+			users[req.UserID] = needed
+			powerLevels.Users = users
+			initialPowerLevels = powerLevels
+			restorePowerLevels = true
+		}
+	}
+
+	eventsToMake := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, "", createContent},
+		{gomatrixserverlib.MRoomMember, req.UserID, memberContent},
+		{gomatrixserverlib.MRoomPowerLevels, "", initialPowerLevels},
+	}
+	for _, eventType := range upgradedStateTypes {
+		if event, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: ""}]; ok {
+			eventsToMake = append(eventsToMake, fledglingEvent{eventType, "", json.RawMessage(event.Content())})
+		}
+	}
+	if restorePowerLevels {
+		eventsToMake = append(eventsToMake, fledglingEvent{gomatrixserverlib.MRoomPowerLevels, "", oldPowerLevels})
+	}
+
+	now := time.Now()
+	var builtEvents []gomatrixserverlib.HeaderedEvent
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i, e := range eventsToMake {
+		stateKey := e.StateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   req.UserID,
+			RoomID:   newRoomID,
+			Type:     e.Type,
+			StateKey: &stateKey,
+			Depth:    int64(i + 1),
+		}
+		if err := builder.SetContent(e.Content); err != nil {
+			return nil, fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
+		}
+		eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+		}
+		if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(&authEvents); err != nil {
+			return nil, fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
+		}
+		event, err := builder.Build(
+			now, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID,
+			r.Cfg.Matrix.PrivateKey, req.RoomVersion,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("builder.Build: %w", err)
+		}
+		if err = gomatrixserverlib.Allowed(event, &authEvents); err != nil {
+			return nil, fmt.Errorf("the %s event is not allowed: %w", e.Type, err)
+		}
+		if err = authEvents.AddEvent(&event); err != nil {
+			return nil, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+		builtEvents = append(builtEvents, event.Headered(req.RoomVersion))
+	}
+	return builtEvents, nil
+}
+
+// sendLocalEvents sends events which this server has built into their rooms.
+func (r *RoomserverInternalAPI) sendLocalEvents(
+	ctx context.Context, events ...gomatrixserverlib.HeaderedEvent,
+) error {
+	inputReq := api.InputRoomEventsRequest{}
+	for _, event := range events {
+		inputReq.InputRoomEvents = append(inputReq.InputRoomEvents, api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        event,
+			AuthEventIDs: event.AuthEventIDs(),
+			SendAsServer: string(r.Cfg.Matrix.ServerName),
+		})
+	}
+	inputRes := api.InputRoomEventsResponse{}
+	return r.InputRoomEvents(ctx, &inputReq, &inputRes)
+}
+
+// moveRoomAliases points the local aliases of the old room at the new room,
+// and removes the canonical alias from the old room, since it was copied into
+// the new one.
+func (r *RoomserverInternalAPI) moveRoomAliases(
+	ctx context.Context, userID, oldRoomID, newRoomID string,
+	oldState map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+) {
+	logger := log.WithFields(log.Fields{
+		"room_id":     oldRoomID,
+		"new_room_id": newRoomID,
+	})
+	aliases, err := r.DB.GetAliasesForRoomID(ctx, oldRoomID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to look up the aliases of the old room")
+		return
+	}
+	for _, alias := range aliases {
+		creatorID, err := r.DB.GetCreatorIDForAlias(ctx, alias)
+		if err != nil {
+			logger.WithError(err).Warnf("Failed to look up the creator of alias %q", alias)
+			continue
+		}
+		if err = r.DB.RemoveRoomAlias(ctx, alias); err != nil {
+			logger.WithError(err).Warnf("Failed to remove alias %q from the old room", alias)
+			continue
+		}
+		if err = r.DB.SetRoomAlias(ctx, alias, newRoomID, creatorID); err != nil {
+			logger.WithError(err).Warnf("Failed to add alias %q to the new room", alias)
+		}
+		r.AliasCache.InvalidateRoomAlias(r.aliasCacheKey(alias))
+	}
+	if len(aliases) > 0 {
+		for _, roomID := range []string{oldRoomID, newRoomID} {
+			if err = r.sendUpdatedAliasesEvent(ctx, userID, roomID); err != nil {
+				logger.WithError(err).Warnf("Failed to send the updated aliases of room %q", roomID)
+			}
+		}
+	}
+
+	if _, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}]; ok {
+		event, perr := r.buildStateEvent(ctx, userID, oldRoomID, gomatrixserverlib.MRoomCanonicalAlias, struct{}{})
+		if perr == nil {
+			err = r.sendLocalEvents(ctx, *event)
+		} else {
+			err = perr
+		}
+		if err != nil {
+			logger.WithError(err).Warn("Failed to remove the canonical alias from the old room")
+		}
+	}
+}
+
+// restrictUpgradedRoom raises the power levels needed to send events and to
+// invite users in the old room, so that people move to the new room.
+func (r *RoomserverInternalAPI) restrictUpgradedRoom(
+	ctx context.Context, userID, roomID string,
+	oldState map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+) error {
+	plEvent, ok := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]
+	if !ok {
+		return nil
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(*plEvent)
+	if err != nil {
+		return err
+	}
+	restricted := powerLevels.UsersDefault + 1
+	if restricted < 50 {
+		restricted = 50
+	}
+	if powerLevels.EventsDefault >= restricted && powerLevels.Invite >= restricted {
+		return nil
+	}
+	// Change the old content rather than powerLevels so that any fields which
+	// gomatrixserverlib doesn't know about are kept.
+	var content map[string]interface{}
+	if err = json.Unmarshal(plEvent.Content(), &content); err != nil {
+		return err
+	}
+	if powerLevels.EventsDefault < restricted {
+		content["events_default"] = restricted
+	}
+	if powerLevels.Invite < restricted {
+		content["invite"] = restricted
+	}
+	event, perr := r.buildStateEvent(ctx, userID, roomID, gomatrixserverlib.MRoomPowerLevels, content)
+	if perr != nil {
+		return perr
+	}
+	return r.sendLocalEvents(ctx, *event)
+}
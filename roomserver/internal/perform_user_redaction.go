@@ -0,0 +1,117 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PerformUserRedaction implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformUserRedaction(
+	ctx context.Context,
+	req *api.PerformUserRedactionRequest,
+	res *api.PerformUserRedactionResponse,
+) {
+	res.RedactedEvents, res.Error = r.performUserRedaction(ctx, req)
+}
+
+func (r *RoomserverInternalAPI) performUserRedaction(
+	ctx context.Context,
+	req *api.PerformUserRedactionRequest,
+) (int, *api.PerformError) {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return 0, &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("user ID %q is invalid: %s", req.UserID, err),
+		}
+	}
+	if domain != r.Cfg.Matrix.ServerName {
+		return 0, &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("cannot redact the events of remote user %q", req.UserID),
+		}
+	}
+	redacted := 0
+	for _, roomID := range req.RoomIDs {
+		roomNID, err := r.DB.RoomNID(ctx, roomID)
+		if err != nil {
+			return redacted, &api.PerformError{Msg: err.Error()}
+		}
+		if roomNID == 0 {
+			continue
+		}
+		eventIDs, err := r.DB.GetEventIDsBySender(ctx, roomNID, req.UserID)
+		if err != nil {
+			return redacted, &api.PerformError{Msg: err.Error()}
+		}
+		events, err := r.DB.EventsFromIDs(ctx, eventIDs)
+		if err != nil {
+			return redacted, &api.PerformError{Msg: err.Error()}
+		}
+		for _, event := range events {
+			// Redactions have nothing left to redact.
+			if event.Type() == gomatrixserverlib.MRoomRedaction {
+				continue
+			}
+			redaction, perr := r.buildRedaction(ctx, req.UserID, roomID, event.EventID(), req.Reason)
+			if perr != nil {
+				return redacted, perr
+			}
+			// The events are sent one at a time so that each one builds
+			// on the last.
+			if err = r.sendLocalEvents(ctx, *redaction); err != nil {
+				return redacted, &api.PerformError{Msg: err.Error()}
+			}
+			redacted++
+		}
+	}
+	return redacted, nil
+}
+
+// buildRedaction builds an event from the given user which redacts one of
+// their own events.
+func (r *RoomserverInternalAPI) buildRedaction(
+	ctx context.Context, userID, roomID, eventID, reason string,
+) (*gomatrixserverlib.HeaderedEvent, *api.PerformError) {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:  userID,
+		RoomID:  roomID,
+		Type:    gomatrixserverlib.MRoomRedaction,
+		Redacts: eventID,
+	}
+	content := map[string]interface{}{}
+	if reason != "" {
+		content["reason"] = reason
+	}
+	if err := builder.SetContent(content); err != nil {
+		return nil, &api.PerformError{
+			Msg: fmt.Sprintf("builder.SetContent: %s", err),
+		}
+	}
+	event, err := eventutil.BuildEvent(ctx, &builder, r.Cfg, time.Now(), r, &api.QueryLatestEventsAndStateResponse{})
+	if err != nil {
+		return nil, &api.PerformError{
+			Msg: fmt.Sprintf("eventutil.BuildEvent: %s", err),
+		}
+	}
+	return event, nil
+}
@@ -19,6 +19,7 @@ package internal
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -30,6 +31,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // QueryLatestEventsAndState implements api.RoomserverInternalAPI
@@ -38,24 +40,19 @@ func (r *RoomserverInternalAPI) QueryLatestEventsAndState(
 	request *api.QueryLatestEventsAndStateRequest,
 	response *api.QueryLatestEventsAndStateResponse,
 ) error {
-	roomVersion, err := r.DB.GetRoomVersionForRoom(ctx, request.RoomID)
-	if err != nil {
-		response.RoomExists = false
-		return nil
-	}
-
-	roomState := state.NewStateResolution(r.DB)
-
-	roomNID, err := r.DB.RoomNIDExcludingStubs(ctx, request.RoomID)
+	roomInfo, err := r.DB.RoomInfo(ctx, request.RoomID)
 	if err != nil {
 		return err
 	}
-	if roomNID == 0 {
+	if roomInfo == nil || roomInfo.IsStub {
 		return nil
 	}
+	roomNID, roomVersion := roomInfo.RoomNID, roomInfo.RoomVersion
 	response.RoomExists = true
 	response.RoomVersion = roomVersion
 
+	roomState := state.NewStateResolution(r.DB)
+
 	var currentStateSnapshotNID types.StateSnapshotNID
 	response.LatestEvents, currentStateSnapshotNID, response.Depth, err =
 		r.DB.LatestEventIDs(ctx, roomNID)
@@ -64,12 +61,12 @@ func (r *RoomserverInternalAPI) QueryLatestEventsAndState(
 	}
 
 	var stateEntries []types.StateEntry
-	if len(request.StateToFetch) == 0 {
+	if len(request.StateToFetch) == 0 && len(request.StateTypesToFetch) == 0 {
 		// Look up all room state.
 		stateEntries, err = roomState.LoadStateAtSnapshot(
 			ctx, currentStateSnapshotNID,
 		)
-	} else {
+	} else if len(request.StateToFetch) > 0 {
 		// Look up the current state for the requested tuples.
 		stateEntries, err = roomState.LoadStateAtSnapshotForStringTuples(
 			ctx, currentStateSnapshotNID, request.StateToFetch,
@@ -78,6 +75,14 @@ func (r *RoomserverInternalAPI) QueryLatestEventsAndState(
 	if err != nil {
 		return err
 	}
+	if len(request.StateTypesToFetch) > 0 {
+		var typeEntries []types.StateEntry
+		typeEntries, err = r.loadStateAtSnapshotForTypes(ctx, currentStateSnapshotNID, request.StateTypesToFetch)
+		if err != nil {
+			return err
+		}
+		stateEntries = append(stateEntries, typeEntries...)
+	}
 
 	stateEvents, err := r.loadStateEvents(ctx, stateEntries)
 	if err != nil {
@@ -97,24 +102,19 @@ func (r *RoomserverInternalAPI) QueryStateAfterEvents(
 	request *api.QueryStateAfterEventsRequest,
 	response *api.QueryStateAfterEventsResponse,
 ) error {
-	roomVersion, err := r.DB.GetRoomVersionForRoom(ctx, request.RoomID)
-	if err != nil {
-		response.RoomExists = false
-		return nil
-	}
-
-	roomState := state.NewStateResolution(r.DB)
-
-	roomNID, err := r.DB.RoomNIDExcludingStubs(ctx, request.RoomID)
+	roomInfo, err := r.DB.RoomInfo(ctx, request.RoomID)
 	if err != nil {
 		return err
 	}
-	if roomNID == 0 {
+	if roomInfo == nil || roomInfo.IsStub {
 		return nil
 	}
+	roomNID, roomVersion := roomInfo.RoomNID, roomInfo.RoomVersion
 	response.RoomExists = true
 	response.RoomVersion = roomVersion
 
+	roomState := state.NewStateResolution(r.DB)
+
 	prevStates, err := r.DB.StateAtEventIDs(ctx, request.PrevEventIDs)
 	if err != nil {
 		switch err.(type) {
@@ -179,6 +179,36 @@ func (r *RoomserverInternalAPI) QueryEventsByID(
 	return nil
 }
 
+// loadStateAtSnapshotForTypes returns the state entries in the snapshot which
+// have one of the event types, whatever their state keys. Tuples are matched
+// on their numeric IDs, so that only the events which are wanted are loaded.
+func (r *RoomserverInternalAPI) loadStateAtSnapshotForTypes(
+	ctx context.Context, stateNID types.StateSnapshotNID, eventTypes []string,
+) ([]types.StateEntry, error) {
+	eventTypeNIDs, err := r.DB.EventTypeNIDs(ctx, eventTypes)
+	if err != nil {
+		return nil, err
+	}
+	if len(eventTypeNIDs) == 0 {
+		return nil, nil
+	}
+	wanted := make(map[types.EventTypeNID]bool, len(eventTypeNIDs))
+	for _, nid := range eventTypeNIDs {
+		wanted[nid] = true
+	}
+	entries, err := state.NewStateResolution(r.DB).LoadStateAtSnapshot(ctx, stateNID)
+	if err != nil {
+		return nil, err
+	}
+	var result []types.StateEntry
+	for _, entry := range entries {
+		if wanted[entry.EventTypeNID] {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
 func (r *RoomserverInternalAPI) loadStateEvents(
 	ctx context.Context, stateEntries []types.StateEntry,
 ) ([]gomatrixserverlib.Event, error) {
@@ -240,6 +270,58 @@ func (r *RoomserverInternalAPI) QueryMembershipForUser(
 	return err
 }
 
+// QueryJoinedUsers implements api.RoomserverInternalAPI. The joined users are
+// found from the numeric IDs in the current state, so that none of the
+// membership events have to be loaded.
+func (r *RoomserverInternalAPI) QueryJoinedUsers(
+	ctx context.Context,
+	request *api.QueryJoinedUsersRequest,
+	response *api.QueryJoinedUsersResponse,
+) error {
+	roomInfo, err := r.DB.RoomInfo(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomInfo == nil || roomInfo.IsStub {
+		return nil
+	}
+	response.RoomExists = true
+	response.UserIDs = []string{}
+
+	joinedNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, false)
+	if err != nil {
+		return err
+	}
+	joined := make(map[types.EventNID]bool, len(joinedNIDs))
+	for _, nid := range joinedNIDs {
+		joined[nid] = true
+	}
+	entries, err := state.NewStateResolution(r.DB).LoadStateAtSnapshot(ctx, roomInfo.StateSnapshotNID)
+	if err != nil {
+		return err
+	}
+	var stateKeyNIDs []types.EventStateKeyNID
+	for _, entry := range entries {
+		if entry.EventTypeNID == types.MRoomMemberNID && joined[entry.EventNID] {
+			stateKeyNIDs = append(stateKeyNIDs, entry.EventStateKeyNID)
+		}
+	}
+	if len(stateKeyNIDs) == 0 {
+		return nil
+	}
+	userIDs, err := r.DB.EventStateKeys(ctx, stateKeyNIDs)
+	if err != nil {
+		return err
+	}
+	for _, nid := range stateKeyNIDs {
+		if userID, ok := userIDs[nid]; ok {
+			response.UserIDs = append(response.UserIDs, userID)
+		}
+	}
+	sort.Strings(response.UserIDs)
+	return nil
+}
+
 // QueryMembershipsForRoom implements api.RoomserverInternalAPI
 func (r *RoomserverInternalAPI) QueryMembershipsForRoom(
 	ctx context.Context,
@@ -265,9 +347,19 @@ func (r *RoomserverInternalAPI) QueryMembershipsForRoom(
 	response.HasBeenInRoom = true
 	response.JoinEvents = []gomatrixserverlib.ClientEvent{}
 
+	// Users who have left the room see the memberships as they were when
+	// they left it.
+	atEventNID := membershipEventNID
+	if request.AtEventID != "" {
+		atEventNID, err = r.membershipsAtEventNID(ctx, request.RoomID, request.AtEventID, membershipEventNID, stillInRoom)
+		if err != nil {
+			return err
+		}
+	}
+
 	var events []types.Event
 	var stateEntries []types.StateEntry
-	if stillInRoom {
+	if stillInRoom && request.AtEventID == "" && request.JoinedOnly {
 		var eventNIDs []types.EventNID
 		eventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(ctx, roomNID, request.JoinedOnly, false)
 		if err != nil {
@@ -275,10 +367,22 @@ func (r *RoomserverInternalAPI) QueryMembershipsForRoom(
 		}
 
 		events, err = r.DB.Events(ctx, eventNIDs)
+	} else if stillInRoom && request.AtEventID == "" {
+		// The membership table doesn't have the events of invites, so the
+		// memberships of everyone come from the current state instead.
+		var stateNID types.StateSnapshotNID
+		if _, stateNID, _, err = r.DB.LatestEventIDs(ctx, roomNID); err != nil {
+			return err
+		}
+		stateEntries, err = state.NewStateResolution(r.DB).LoadStateAtSnapshot(ctx, stateNID)
+		if err != nil {
+			return err
+		}
+		events, err = getMembershipsAtState(ctx, r.DB, stateEntries, false)
 	} else {
-		stateEntries, err = stateBeforeEvent(ctx, r.DB, membershipEventNID)
+		stateEntries, err = stateBeforeEvent(ctx, r.DB, atEventNID)
 		if err != nil {
-			logrus.WithField("membership_event_nid", membershipEventNID).WithError(err).Error("failed to load state before event")
+			logrus.WithField("membership_event_nid", atEventNID).WithError(err).Error("failed to load state before event")
 			return err
 		}
 		events, err = getMembershipsAtState(ctx, r.DB, stateEntries, request.JoinedOnly)
@@ -296,6 +400,42 @@ func (r *RoomserverInternalAPI) QueryMembershipsForRoom(
 	return nil
 }
 
+// membershipsAtEventNID returns the NID of the event to load the memberships
+// after for a QueryMembershipsForRoom request with an AtEventID. The event
+// must be in the room, so that it can't be used to get the memberships of
+// other rooms. If the user has left the room and the event is later than their
+// leave then their membership event is used instead.
+func (r *RoomserverInternalAPI) membershipsAtEventNID(
+	ctx context.Context, roomID, atEventID string, membershipEventNID types.EventNID, stillInRoom bool,
+) (types.EventNID, error) {
+	eventNIDs, err := r.DB.EventNIDs(ctx, []string{atEventID})
+	if err != nil {
+		return 0, err
+	}
+	atEventNID, ok := eventNIDs[atEventID]
+	if !ok {
+		return 0, fmt.Errorf("event %q not found", atEventID)
+	}
+	events, err := r.DB.Events(ctx, []types.EventNID{atEventNID, membershipEventNID})
+	if err != nil {
+		return 0, err
+	}
+	depths := make(map[types.EventNID]int64, len(events))
+	for _, ev := range events {
+		if ev.EventNID == atEventNID && ev.RoomID() != roomID {
+			return 0, fmt.Errorf("event %q is not in room %q", atEventID, roomID)
+		}
+		depths[ev.EventNID] = ev.Depth()
+	}
+	if stillInRoom {
+		return atEventNID, nil
+	}
+	if depths[atEventNID] > depths[membershipEventNID] {
+		return membershipEventNID, nil
+	}
+	return atEventNID, nil
+}
+
 func stateBeforeEvent(ctx context.Context, db storage.Database, eventNID types.EventNID) ([]types.StateEntry, error) {
 	roomState := state.NewStateResolution(db)
 	// Lookup the event NID
@@ -398,6 +538,87 @@ func (r *RoomserverInternalAPI) checkServerAllowedToSeeEvent(
 	return auth.IsServerAllowed(serverName, isServerInRoom, stateAtEvent), nil
 }
 
+// QueryUserAllowedToSeeEvents implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	response.AllowedEventIDs = make(map[string]bool, len(request.EventIDs))
+	events, err := r.DB.EventsFromIDs(ctx, request.EventIDs)
+	if err != nil {
+		return err
+	}
+
+	roomState := state.NewStateResolution(r.DB)
+	stateNeeded := []gomatrixserverlib.StateKeyTuple{
+		{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: request.UserID},
+	}
+	// Consecutive events will often share the same state snapshot and will
+	// usually be in the same room, so avoid looking these up more than once.
+	stateAtSnapshot := make(map[types.StateSnapshotNID][]gomatrixserverlib.Event)
+	joinedToRoom := make(map[string]bool)
+	for _, event := range events {
+		var snapshotNID types.StateSnapshotNID
+		if snapshotNID, err = r.DB.SnapshotNIDFromEventID(ctx, event.EventID()); err != nil {
+			return err
+		}
+		if snapshotNID == 0 {
+			// This is an outlier, so we don't know the state before it.
+			continue
+		}
+		stateBeforeEvent, ok := stateAtSnapshot[snapshotNID]
+		if !ok {
+			var stateEntries []types.StateEntry
+			stateEntries, err = roomState.LoadStateAtSnapshotForStringTuples(ctx, snapshotNID, stateNeeded)
+			if err != nil {
+				return err
+			}
+			if stateBeforeEvent, err = r.loadStateEvents(ctx, stateEntries); err != nil {
+				return err
+			}
+			stateAtSnapshot[snapshotNID] = stateBeforeEvent
+		}
+		currentlyJoined, ok := joinedToRoom[event.RoomID()]
+		if !ok {
+			if currentlyJoined, err = r.isUserCurrentlyJoined(ctx, request.UserID, event.RoomID()); err != nil {
+				return err
+			}
+			joinedToRoom[event.RoomID()] = currentlyJoined
+		}
+		if auth.IsUserAllowed(membershipAtEvent(request.UserID, event.Event, stateBeforeEvent), currentlyJoined, stateBeforeEvent) {
+			response.AllowedEventIDs[event.EventID()] = true
+		}
+	}
+	return nil
+}
+
+// membershipAtEvent returns the membership of the user at the given event. A
+// user's own membership event uses the membership it sets, so that users can
+// see the event that they joined or were invited with.
+func membershipAtEvent(userID string, event gomatrixserverlib.Event, stateBeforeEvent []gomatrixserverlib.Event) string {
+	events := append([]gomatrixserverlib.Event{event}, stateBeforeEvent...)
+	for _, ev := range events {
+		if ev.Type() != gomatrixserverlib.MRoomMember || !ev.StateKeyEquals(userID) {
+			continue
+		}
+		if membership, err := ev.Membership(); err == nil {
+			return membership
+		}
+	}
+	return gomatrixserverlib.Leave
+}
+
+func (r *RoomserverInternalAPI) isUserCurrentlyJoined(ctx context.Context, userID, roomID string) (bool, error) {
+	roomNID, err := r.DB.RoomNID(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+	_, stillInRoom, err := r.DB.GetMembership(ctx, roomNID, userID)
+	return stillInRoom, err
+}
+
 // QueryMissingEvents implements api.RoomserverInternalAPI
 func (r *RoomserverInternalAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -959,3 +1180,171 @@ func (r *RoomserverInternalAPI) QueryPublishedRooms(
 	res.RoomIDs = rooms
 	return nil
 }
+
+// QueryRooms implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryRooms(
+	ctx context.Context,
+	req *api.QueryRoomsRequest,
+	res *api.QueryRoomsResponse,
+) error {
+	switch req.OrderBy {
+	case "", api.QueryRoomsOrderByRoomID, api.QueryRoomsOrderByName,
+		api.QueryRoomsOrderByJoinedMembers, api.QueryRoomsOrderByRoomVersion:
+	default:
+		return fmt.Errorf("unknown room ordering %q", req.OrderBy)
+	}
+	roomIDs, err := r.DB.GetKnownRooms(ctx)
+	if err != nil {
+		return err
+	}
+	publishedRoomIDs, err := r.DB.GetPublishedRooms(ctx)
+	if err != nil {
+		return err
+	}
+	published := make(map[string]bool, len(publishedRoomIDs))
+	for _, roomID := range publishedRoomIDs {
+		published[roomID] = true
+	}
+
+	rooms := []api.RoomDetails{}
+	for _, roomID := range roomIDs {
+		details, detailsErr := r.roomDetails(ctx, roomID)
+		if detailsErr != nil {
+			return detailsErr
+		}
+		if details == nil {
+			continue
+		}
+		details.Published = published[roomID]
+		if roomMatchesQuery(details, req) {
+			rooms = append(rooms, *details)
+		}
+	}
+	sortRooms(rooms, req.OrderBy, req.Descending)
+
+	res.TotalRooms = len(rooms)
+	if offset := req.Offset; offset > 0 {
+		if offset > len(rooms) {
+			offset = len(rooms)
+		}
+		rooms = rooms[offset:]
+	}
+	if req.Limit > 0 && req.Limit < len(rooms) {
+		rooms = rooms[:req.Limit]
+	}
+	res.Rooms = rooms
+	return nil
+}
+
+// roomDetails works out the details of a room from its current state.
+// Returns nil if the room isn't known or is a stub.
+func (r *RoomserverInternalAPI) roomDetails(ctx context.Context, roomID string) (*api.RoomDetails, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub {
+		return nil, nil
+	}
+	details := &api.RoomDetails{
+		RoomID:      roomID,
+		RoomVersion: roomInfo.RoomVersion,
+	}
+
+	roomState := state.NewStateResolution(r.DB)
+	stateEntries, err := roomState.LoadStateAtSnapshotForStringTuples(
+		ctx, roomInfo.StateSnapshotNID, []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomName, StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""},
+			{EventType: "m.room.encryption", StateKey: ""},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	stateNIDs := make([]types.EventNID, len(stateEntries))
+	for i := range stateEntries {
+		stateNIDs[i] = stateEntries[i].EventNID
+	}
+	stateEvents, err := r.DB.Events(ctx, stateNIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range stateEvents {
+		switch event.Type() {
+		case gomatrixserverlib.MRoomCreate:
+			details.Creator = gjson.GetBytes(event.Content(), "creator").Str
+		case gomatrixserverlib.MRoomName:
+			details.Name = gjson.GetBytes(event.Content(), "name").Str
+		case gomatrixserverlib.MRoomCanonicalAlias:
+			details.CanonicalAlias = gjson.GetBytes(event.Content(), "alias").Str
+		case gomatrixserverlib.MRoomJoinRules:
+			if details.JoinRule, err = event.JoinRule(); err != nil {
+				return nil, err
+			}
+		case "m.room.encryption":
+			details.Encrypted = true
+		}
+	}
+	details.Public = details.JoinRule == gomatrixserverlib.Public
+
+	joinedNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, false)
+	if err != nil {
+		return nil, err
+	}
+	details.JoinedMembers = len(joinedNIDs)
+	localJoinedNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, err
+	}
+	details.JoinedLocalMembers = len(localJoinedNIDs)
+	return details, nil
+}
+
+// roomMatchesQuery returns true if the room passes all of the filters in the request.
+func roomMatchesQuery(room *api.RoomDetails, req *api.QueryRoomsRequest) bool {
+	if req.RoomVersion != "" && room.RoomVersion != req.RoomVersion {
+		return false
+	}
+	if room.JoinedMembers < req.MinJoinedMembers {
+		return false
+	}
+	if req.MaxJoinedMembers != nil && room.JoinedMembers > *req.MaxJoinedMembers {
+		return false
+	}
+	if req.Encrypted != nil && room.Encrypted != *req.Encrypted {
+		return false
+	}
+	if req.Public != nil && room.Public != *req.Public {
+		return false
+	}
+	return true
+}
+
+// sortRooms sorts the rooms by the given ordering. Rooms which are equal under
+// the ordering are sorted by room ID, so that pagination is stable.
+func sortRooms(rooms []api.RoomDetails, orderBy string, descending bool) {
+	sort.Slice(rooms, func(i, j int) bool {
+		a, b := rooms[i], rooms[j]
+		if descending {
+			a, b = b, a
+		}
+		switch orderBy {
+		case api.QueryRoomsOrderByName:
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+		case api.QueryRoomsOrderByJoinedMembers:
+			if a.JoinedMembers != b.JoinedMembers {
+				return a.JoinedMembers < b.JoinedMembers
+			}
+		case api.QueryRoomsOrderByRoomVersion:
+			if a.RoomVersion != b.RoomVersion {
+				return a.RoomVersion < b.RoomVersion
+			}
+		}
+		return a.RoomID < b.RoomID
+	})
+}
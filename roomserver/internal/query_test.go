@@ -17,9 +17,12 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"reflect"
 	"testing"
 
 	"github.com/matrix-org/dendrite/internal/test"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -155,3 +158,110 @@ func TestGetAuthChainMultiple(t *testing.T) {
 		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
 	}
 }
+
+func TestQueryRoomsFilterAndSort(t *testing.T) {
+	rooms := []api.RoomDetails{
+		{RoomID: "!c:a", Name: "Beta", RoomVersion: "5", JoinedMembers: 3, Encrypted: true},
+		{RoomID: "!a:a", Name: "Alpha", RoomVersion: "5", JoinedMembers: 10, Public: true},
+		{RoomID: "!b:a", Name: "Beta", RoomVersion: "1", JoinedMembers: 1},
+	}
+	two := 2
+	encrypted := false
+	testCases := []struct {
+		req  api.QueryRoomsRequest
+		want []string
+	}{
+		{
+			req:  api.QueryRoomsRequest{},
+			want: []string{"!a:a", "!b:a", "!c:a"},
+		},
+		{
+			req:  api.QueryRoomsRequest{OrderBy: api.QueryRoomsOrderByName, Descending: true},
+			want: []string{"!c:a", "!b:a", "!a:a"},
+		},
+		{
+			req:  api.QueryRoomsRequest{OrderBy: api.QueryRoomsOrderByJoinedMembers, MinJoinedMembers: 2},
+			want: []string{"!c:a", "!a:a"},
+		},
+		{
+			req:  api.QueryRoomsRequest{RoomVersion: "5", MaxJoinedMembers: &two},
+			want: []string{},
+		},
+		{
+			req:  api.QueryRoomsRequest{Encrypted: &encrypted, OrderBy: api.QueryRoomsOrderByRoomVersion},
+			want: []string{"!b:a", "!a:a"},
+		},
+	}
+	for _, tc := range testCases {
+		got := []string{}
+		var matched []api.RoomDetails
+		for i := range rooms {
+			if roomMatchesQuery(&rooms[i], &tc.req) {
+				matched = append(matched, rooms[i])
+			}
+		}
+		sortRooms(matched, tc.req.OrderBy, tc.req.Descending)
+		for _, room := range matched {
+			got = append(got, room.RoomID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("rooms for request %+v are wrong, got %v want %v", tc.req, got, tc.want)
+		}
+	}
+}
+
+func mustMakeStateEvent(t *testing.T, eventType, stateKey string, content map[string]interface{}) gomatrixserverlib.Event {
+	eventJSON, err := json.Marshal(map[string]interface{}{
+		"event_id":  "$" + eventType + stateKey + ":localhost",
+		"room_id":   "!room:localhost",
+		"type":      eventType,
+		"state_key": stateKey,
+		"sender":    "@creator:localhost",
+		"content":   content,
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("gomatrixserverlib.NewEventFromTrustedJSON: %s", err)
+	}
+	return event
+}
+
+func TestUserAllowedToSeeEvent(t *testing.T) {
+	alice := "@alice:localhost"
+	visibility := func(v string) gomatrixserverlib.Event {
+		return mustMakeStateEvent(t, gomatrixserverlib.MRoomHistoryVisibility, "", map[string]interface{}{"history_visibility": v})
+	}
+	member := func(membership string) gomatrixserverlib.Event {
+		return mustMakeStateEvent(t, gomatrixserverlib.MRoomMember, alice, map[string]interface{}{"membership": membership})
+	}
+	message := mustMakeStateEvent(t, "m.room.topic", "", map[string]interface{}{"topic": "hello"})
+
+	testCases := []struct {
+		name            string
+		event           gomatrixserverlib.Event
+		stateBefore     []gomatrixserverlib.Event
+		currentlyJoined bool
+		want            bool
+	}{
+		{"world_readable without membership", message, []gomatrixserverlib.Event{visibility("world_readable")}, false, true},
+		{"joined while joined", message, []gomatrixserverlib.Event{visibility("joined"), member(gomatrixserverlib.Join)}, true, true},
+		{"joined before joining", message, []gomatrixserverlib.Event{visibility("joined")}, true, false},
+		{"joined after leaving", message, []gomatrixserverlib.Event{visibility("joined"), member(gomatrixserverlib.Leave)}, true, false},
+		{"joined sees own join", member(gomatrixserverlib.Join), []gomatrixserverlib.Event{visibility("joined")}, true, true},
+		{"shared before joining", message, []gomatrixserverlib.Event{visibility("shared")}, true, true},
+		{"shared without joining", message, []gomatrixserverlib.Event{visibility("shared")}, false, false},
+		{"default is shared", message, nil, true, true},
+		{"invited while invited", message, []gomatrixserverlib.Event{visibility("invited"), member(gomatrixserverlib.Invite)}, false, true},
+		{"invited before invite", message, []gomatrixserverlib.Event{visibility("invited")}, true, false},
+		{"joined while invited", message, []gomatrixserverlib.Event{visibility("joined"), member(gomatrixserverlib.Invite)}, false, false},
+	}
+	for _, tc := range testCases {
+		membership := membershipAtEvent(alice, tc.event, tc.stateBefore)
+		if got := auth.IsUserAllowed(membership, tc.currentlyJoined, tc.stateBefore); got != tc.want {
+			t.Errorf("%s: got allowed %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -25,11 +25,24 @@ const (
 	RoomserverInputRoomEventsPath = "/roomserver/inputRoomEvents"
 
 	// Perform operations
-	RoomserverPerformInvitePath   = "/roomserver/performInvite"
-	RoomserverPerformJoinPath     = "/roomserver/performJoin"
-	RoomserverPerformLeavePath    = "/roomserver/performLeave"
-	RoomserverPerformBackfillPath = "/roomserver/performBackfill"
-	RoomserverPerformPublishPath  = "/roomserver/performPublish"
+	RoomserverPerformInvitePath             = "/roomserver/performInvite"
+	RoomserverPerformJoinPath               = "/roomserver/performJoin"
+	RoomserverPerformPeekPath               = "/roomserver/performPeek"
+	RoomserverPerformUnpeekPath             = "/roomserver/performUnpeek"
+	RoomserverPerformLeavePath              = "/roomserver/performLeave"
+	RoomserverPerformBackfillPath           = "/roomserver/performBackfill"
+	RoomserverPerformPublishPath            = "/roomserver/performPublish"
+	RoomserverPerformRoomUpgradePath        = "/roomserver/performRoomUpgrade"
+	RoomserverPerformReportEventPath        = "/roomserver/performReportEvent"
+	RoomserverPerformResolveEventReportPath = "/roomserver/performResolveEventReport"
+	RoomserverPerformClaimAnnotationPath    = "/roomserver/performClaimAnnotation"
+	RoomserverPerformAuthDebugPath          = "/roomserver/performAuthDebug"
+	RoomserverPerformUserRedactionPath      = "/roomserver/performUserRedaction"
+	RoomserverPerformPurgeRoomPath          = "/roomserver/performPurgeRoom"
+	RoomserverPerformKickPath               = "/roomserver/performKick"
+	RoomserverPerformBanPath                = "/roomserver/performBan"
+	RoomserverPerformUnbanPath              = "/roomserver/performUnban"
+	RoomserverPerformKnockPath              = "/roomserver/performKnock"
 
 	// Query operations
 	RoomserverQueryLatestEventsAndStatePath    = "/roomserver/queryLatestEventsAndState"
@@ -37,12 +50,17 @@ const (
 	RoomserverQueryEventsByIDPath              = "/roomserver/queryEventsByID"
 	RoomserverQueryMembershipForUserPath       = "/roomserver/queryMembershipForUser"
 	RoomserverQueryMembershipsForRoomPath      = "/roomserver/queryMembershipsForRoom"
+	RoomserverQueryJoinedUsersPath             = "/roomserver/queryJoinedUsers"
 	RoomserverQueryServerAllowedToSeeEventPath = "/roomserver/queryServerAllowedToSeeEvent"
+	RoomserverQueryUserAllowedToSeeEventsPath  = "/roomserver/queryUserAllowedToSeeEvents"
 	RoomserverQueryMissingEventsPath           = "/roomserver/queryMissingEvents"
 	RoomserverQueryStateAndAuthChainPath       = "/roomserver/queryStateAndAuthChain"
 	RoomserverQueryRoomVersionCapabilitiesPath = "/roomserver/queryRoomVersionCapabilities"
 	RoomserverQueryRoomVersionForRoomPath      = "/roomserver/queryRoomVersionForRoom"
 	RoomserverQueryPublishedRoomsPath          = "/roomserver/queryPublishedRooms"
+	RoomserverQueryRoomsPath                   = "/roomserver/queryRooms"
+	RoomserverQueryEventReportsPath            = "/roomserver/queryEventReports"
+	RoomserverQueryAuthDecisionsPath           = "/roomserver/queryAuthDecisions"
 )
 
 type httpRoomserverInternalAPI struct {
@@ -184,6 +202,40 @@ func (h *httpRoomserverInternalAPI) PerformJoin(
 	}
 }
 
+func (h *httpRoomserverInternalAPI) PerformPeek(
+	ctx context.Context,
+	request *api.PerformPeekRequest,
+	response *api.PerformPeekResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPeek")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformPeekPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformUnpeek(
+	ctx context.Context,
+	request *api.PerformUnpeekRequest,
+	response *api.PerformUnpeekResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUnpeek")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformUnpeekPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
 func (h *httpRoomserverInternalAPI) PerformLeave(
 	ctx context.Context,
 	request *api.PerformLeaveRequest,
@@ -213,6 +265,176 @@ func (h *httpRoomserverInternalAPI) PerformPublish(
 	}
 }
 
+func (h *httpRoomserverInternalAPI) PerformRoomUpgrade(
+	ctx context.Context,
+	req *api.PerformRoomUpgradeRequest,
+	res *api.PerformRoomUpgradeResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformRoomUpgrade")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformRoomUpgradePath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformReportEvent(
+	ctx context.Context,
+	req *api.PerformReportEventRequest,
+	res *api.PerformReportEventResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformReportEvent")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformReportEventPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformResolveEventReport(
+	ctx context.Context,
+	req *api.PerformResolveEventReportRequest,
+	res *api.PerformResolveEventReportResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformResolveEventReport")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformResolveEventReportPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformAuthDebug(
+	ctx context.Context,
+	req *api.PerformAuthDebugRequest,
+	res *api.PerformAuthDebugResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAuthDebug")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformAuthDebugPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformUserRedaction(
+	ctx context.Context,
+	req *api.PerformUserRedactionRequest,
+	res *api.PerformUserRedactionResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUserRedaction")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformUserRedactionPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformPurgeRoom(
+	ctx context.Context,
+	req *api.PerformPurgeRoomRequest,
+	res *api.PerformPurgeRoomResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPurgeRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformPurgeRoomPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformKick(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformKick")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformKickPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformBan(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformBan")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformBanPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformUnban(
+	ctx context.Context,
+	req *api.PerformModerationRequest,
+	res *api.PerformModerationResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUnban")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformUnbanPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
+func (h *httpRoomserverInternalAPI) PerformKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+	res *api.PerformKnockResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformKnock")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformKnockPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
 // QueryLatestEventsAndState implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryLatestEventsAndState(
 	ctx context.Context,
@@ -264,6 +486,54 @@ func (h *httpRoomserverInternalAPI) QueryPublishedRooms(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpRoomserverInternalAPI) QueryRooms(
+	ctx context.Context,
+	request *api.QueryRoomsRequest,
+	response *api.QueryRoomsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRooms")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryEventReports(
+	ctx context.Context,
+	request *api.QueryEventReportsRequest,
+	response *api.QueryEventReportsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventReports")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventReportsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) PerformClaimAnnotation(
+	ctx context.Context,
+	request *api.PerformClaimAnnotationRequest,
+	response *api.PerformClaimAnnotationResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformClaimAnnotation")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformClaimAnnotationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpRoomserverInternalAPI) QueryAuthDecisions(
+	ctx context.Context,
+	request *api.QueryAuthDecisionsRequest,
+	response *api.QueryAuthDecisionsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAuthDecisions")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryAuthDecisionsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMembershipForUser implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMembershipForUser(
 	ctx context.Context,
@@ -290,6 +560,19 @@ func (h *httpRoomserverInternalAPI) QueryMembershipsForRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryJoinedUsers implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryJoinedUsers(
+	ctx context.Context,
+	request *api.QueryJoinedUsersRequest,
+	response *api.QueryJoinedUsersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryJoinedUsers")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryJoinedUsersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryServerAllowedToSeeEvent implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryServerAllowedToSeeEvent(
 	ctx context.Context,
@@ -303,6 +586,19 @@ func (h *httpRoomserverInternalAPI) QueryServerAllowedToSeeEvent(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryUserAllowedToSeeEvents implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryUserAllowedToSeeEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryUserAllowedToSeeEventsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMissingEvents implements RoomServerQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMissingEvents(
 	ctx context.Context,
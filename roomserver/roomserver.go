@@ -20,6 +20,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/inthttp"
 	"github.com/matrix-org/gomatrixserverlib"
 
+	"github.com/matrix-org/dendrite/internal/outbox"
 	"github.com/matrix-org/dendrite/internal/setup"
 	"github.com/matrix-org/dendrite/roomserver/internal"
 	"github.com/matrix-org/dendrite/roomserver/storage"
@@ -39,19 +40,26 @@ func NewInternalAPI(
 	keyRing gomatrixserverlib.JSONVerifier,
 	fedClient *gomatrixserverlib.FederationClient,
 ) api.RoomserverInternalAPI {
-	roomserverDB, err := storage.Open(string(base.Cfg.Database.RoomServer), base.Cfg.DbProperties())
+	roomserverDB, err := storage.Open(string(base.Cfg.Database.RoomServer), string(base.Cfg.Database.ReadReplicas.RoomServer), base.Cfg.DbProperties(), base.Caches)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
 
+	// Produce any output events which were left in the outbox when the
+	// roomserver last stopped.
+	relay := outbox.NewRelay(roomserverDB, base.KafkaProducer)
+	relay.Start()
+
 	return &internal.RoomserverInternalAPI{
 		DB:                   roomserverDB,
 		Cfg:                  base.Cfg,
-		Producer:             base.KafkaProducer,
+		Outbox:               relay,
 		OutputRoomEventTopic: string(base.Cfg.Kafka.Topics.OutputRoomEvent),
 		Cache:                base.Caches,
+		AliasCache:           base.Caches,
 		ServerName:           base.Cfg.Matrix.ServerName,
 		FedClient:            fedClient,
 		KeyRing:              keyRing,
+		AuthDebug:            internal.NewAuthDebugger(&base.Cfg.Matrix.AuthDebug),
 	}
 }
@@ -2,19 +2,27 @@ package roomserver
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
+	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/setup"
 	"github.com/matrix-org/dendrite/internal/test"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal"
+	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 const (
@@ -93,16 +101,54 @@ func mustLoadEvents(t *testing.T, ver gomatrixserverlib.RoomVersion, events []js
 	return hs
 }
 
+// mustSendLocalEvent sends a state event from @userid:kaer.morhen into
+// !roomid:kaer.morhen, filling out the prev and auth events from the room.
+// Returns the ID of the event.
+func mustSendLocalEvent(t *testing.T, rsAPI api.RoomserverInternalAPI, eventType, stateKey string, content interface{}) string {
+	t.Helper()
+	return mustSendLocalEventInRoom(t, rsAPI, "!roomid:kaer.morhen", eventType, stateKey, content)
+}
+
+// mustSendLocalEventInRoom sends a state event from @userid:kaer.morhen into
+// the given room, filling out the prev and auth events from the room.
+// Returns the ID of the event.
+func mustSendLocalEventInRoom(t *testing.T, rsAPI api.RoomserverInternalAPI, roomID, eventType, stateKey string, content interface{}) string {
+	t.Helper()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = testOrigin
+	cfg.Matrix.KeyID = "ed25519:auto"
+	cfg.Matrix.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   "@userid:kaer.morhen",
+		RoomID:   roomID,
+		Type:     eventType,
+		StateKey: &stateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	event, err := eventutil.BuildEvent(ctx, &builder, cfg, time.Now(), rsAPI, &api.QueryLatestEventsAndStateResponse{})
+	if err != nil {
+		t.Fatalf("failed to build the %s event: %s", eventType, err)
+	}
+	if _, err = api.SendEvents(ctx, rsAPI, []gomatrixserverlib.HeaderedEvent{*event}, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	return event.EventID()
+}
+
 func mustSendEvents(t *testing.T, ver gomatrixserverlib.RoomVersion, events []json.RawMessage) (api.RoomserverInternalAPI, *dummyProducer, []gomatrixserverlib.HeaderedEvent) {
 	cfg := &config.Dendrite{}
 	cfg.Database.RoomServer = roomserverDBFileURI
 	cfg.Kafka.Topics.OutputRoomEvent = "output_room_event"
 	cfg.Matrix.ServerName = testOrigin
+	cfg.Matrix.KeyID = "ed25519:auto"
+	cfg.Matrix.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
 	cfg.Kafka.UseNaffka = true
 	dp := &dummyProducer{
 		topic: string(cfg.Kafka.Topics.OutputRoomEvent),
 	}
-	cache, err := caching.NewInMemoryLRUCache(true)
+	cache, err := caching.NewInMemoryLRUCache(false)
 	if err != nil {
 		t.Fatalf("failed to make caches: %s", err)
 	}
@@ -171,3 +217,652 @@ func TestOutputRedactedEvent(t *testing.T) {
 		}
 	}
 }
+
+func TestOutputOldRoomEvent(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+	}
+	backfilled := mustLoadEvents(t, gomatrixserverlib.RoomVersionV1, []json.RawMessage{
+		// room name
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}],["$6sUiGPQ0a3tqYGKo:kaer.morhen",{"sha256":"IS4HSMqpqVUGh1Z3qgC99YcaizjCoO4yFhYYe8j53IE"}]],"content":{"name":"My Room Name"},"depth":2,"event_id":"$VC1zZ9YWwuUbSNHD:kaer.morhen","hashes":{"sha256":"bpqTkfLx6KHzWz7/wwpsXnXwJWEGW14aV63ffexzDFg"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$6sUiGPQ0a3tqYGKo:kaer.morhen",{"sha256":"IS4HSMqpqVUGh1Z3qgC99YcaizjCoO4yFhYYe8j53IE"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"mhJZ3X4bAKrF/T0mtPf1K2Tmls0h6xGY1IPDpJ/SScQBqDlu3HQR2BPa7emqj5bViyLTWVNh+ZCpzx/6STTrAg"}},"state_key":"","type":"m.room.name"}`),
+	})[0]
+	deleteDatabase()
+	rsAPI, producer, hevents := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+
+	producer.producedMessages = nil
+	if _, err := api.SendInputRoomEvents(ctx, rsAPI, []api.InputRoomEvent{
+		{
+			Kind:         api.KindBackfill,
+			Event:        backfilled,
+			AuthEventIDs: backfilled.AuthEventIDs(),
+		},
+	}); err != nil {
+		t.Fatalf("failed to SendInputRoomEvents: %s", err)
+	}
+	if len(producer.producedMessages) != 1 || producer.producedMessages[0].Type != api.OutputTypeOldRoomEvent {
+		t.Fatalf("got output events %+v, want a single old room event", producer.producedMessages)
+	}
+	if got := producer.producedMessages[0].OldRoomEvent.Event.EventID(); got != backfilled.EventID() {
+		t.Errorf("got old room event %s, want %s", got, backfilled.EventID())
+	}
+
+	// The backfilled event mustn't become the latest event in the room.
+	var res api.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: backfilled.RoomID(),
+	}, &res); err != nil {
+		t.Fatalf("failed to QueryLatestEventsAndState: %s", err)
+	}
+	if len(res.LatestEvents) != 1 || res.LatestEvents[0].EventID != hevents[1].EventID() {
+		t.Errorf("got latest events %+v, want only %s", res.LatestEvents, hevents[1].EventID())
+	}
+}
+
+func TestPerformRoomUpgrade(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+		// room name
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}],["$6sUiGPQ0a3tqYGKo:kaer.morhen",{"sha256":"IS4HSMqpqVUGh1Z3qgC99YcaizjCoO4yFhYYe8j53IE"}]],"content":{"name":"My Room Name"},"depth":2,"event_id":"$VC1zZ9YWwuUbSNHD:kaer.morhen","hashes":{"sha256":"bpqTkfLx6KHzWz7/wwpsXnXwJWEGW14aV63ffexzDFg"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$6sUiGPQ0a3tqYGKo:kaer.morhen",{"sha256":"IS4HSMqpqVUGh1Z3qgC99YcaizjCoO4yFhYYe8j53IE"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"mhJZ3X4bAKrF/T0mtPf1K2Tmls0h6xGY1IPDpJ/SScQBqDlu3HQR2BPa7emqj5bViyLTWVNh+ZCpzx/6STTrAg"}},"state_key":"","type":"m.room.name"}`),
+	}
+	deleteDatabase()
+	rsAPI, _, _ := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+
+	var res api.PerformRoomUpgradeResponse
+	rsAPI.PerformRoomUpgrade(ctx, &api.PerformRoomUpgradeRequest{
+		RoomID:      "!roomid:kaer.morhen",
+		UserID:      "@userid:kaer.morhen",
+		RoomVersion: gomatrixserverlib.RoomVersionV5,
+	}, &res)
+	if res.Error != nil {
+		t.Fatalf("PerformRoomUpgrade failed: %s", res.Error)
+	}
+
+	var oldRes api.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID:       "!roomid:kaer.morhen",
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{EventType: "m.room.tombstone", StateKey: ""}},
+	}, &oldRes); err != nil {
+		t.Fatalf("failed to QueryLatestEventsAndState: %s", err)
+	}
+	if len(oldRes.StateEvents) != 1 {
+		t.Fatalf("expected a tombstone in the old room, got %+v", oldRes.StateEvents)
+	}
+	var tombstone struct {
+		ReplacementRoom string `json:"replacement_room"`
+	}
+	if err := json.Unmarshal(oldRes.StateEvents[0].Content(), &tombstone); err != nil || tombstone.ReplacementRoom != res.NewRoomID {
+		t.Fatalf("tombstone points to %q, want %q", tombstone.ReplacementRoom, res.NewRoomID)
+	}
+
+	var newRes api.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: res.NewRoomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.create", StateKey: ""},
+			{EventType: "m.room.name", StateKey: ""},
+		},
+	}, &newRes); err != nil {
+		t.Fatalf("failed to QueryLatestEventsAndState: %s", err)
+	}
+	if !newRes.RoomExists || newRes.RoomVersion != gomatrixserverlib.RoomVersionV5 {
+		t.Fatalf("expected the new room to exist in version 5, got %v in version %q", newRes.RoomExists, newRes.RoomVersion)
+	}
+	for _, event := range newRes.StateEvents {
+		switch event.Type() {
+		case "m.room.create":
+			var content struct {
+				Predecessor struct {
+					RoomID  string `json:"room_id"`
+					EventID string `json:"event_id"`
+				} `json:"predecessor"`
+			}
+			if err := json.Unmarshal(event.Content(), &content); err != nil {
+				t.Fatalf("failed to unmarshal the create event: %s", err)
+			}
+			if content.Predecessor.RoomID != "!roomid:kaer.morhen" || content.Predecessor.EventID != oldRes.StateEvents[0].EventID() {
+				t.Errorf("wrong predecessor in the new room: %+v", content.Predecessor)
+			}
+		case "m.room.name":
+			if string(event.Content()) != `{"name":"My Room Name"}` {
+				t.Errorf("wrong name copied to the new room: %s", event.Content())
+			}
+		}
+	}
+	if len(newRes.StateEvents) != 2 {
+		t.Errorf("expected the create and name events in the new room, got %d events", len(newRes.StateEvents))
+	}
+}
+
+func TestPerformUserRedaction(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+		// room name
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}],["$6sUiGPQ0a3tqYGKo:kaer.morhen",{"sha256":"IS4HSMqpqVUGh1Z3qgC99YcaizjCoO4yFhYYe8j53IE"}]],"content":{"name":"My Room Name"},"depth":2,"event_id":"$VC1zZ9YWwuUbSNHD:kaer.morhen","hashes":{"sha256":"bpqTkfLx6KHzWz7/wwpsXnXwJWEGW14aV63ffexzDFg"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$6sUiGPQ0a3tqYGKo:kaer.morhen",{"sha256":"IS4HSMqpqVUGh1Z3qgC99YcaizjCoO4yFhYYe8j53IE"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"mhJZ3X4bAKrF/T0mtPf1K2Tmls0h6xGY1IPDpJ/SScQBqDlu3HQR2BPa7emqj5bViyLTWVNh+ZCpzx/6STTrAg"}},"state_key":"","type":"m.room.name"}`),
+		// redact room name
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}],["$6sUiGPQ0a3tqYGKo:kaer.morhen",{"sha256":"IS4HSMqpqVUGh1Z3qgC99YcaizjCoO4yFhYYe8j53IE"}]],"content":{"reason":"Spamming"},"depth":3,"event_id":"$tJI0pE3b8u9UMYpT:kaer.morhen","hashes":{"sha256":"/3TStqa5SQqYaEtl7ajEvSRvu6d12MMKfICUzrBpd2Q"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$VC1zZ9YWwuUbSNHD:kaer.morhen",{"sha256":"+l8cNa7syvm0EF7CAmQRlYknLEMjivnI4FLhB/TUBEY"}]],"redacts":"$VC1zZ9YWwuUbSNHD:kaer.morhen","room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"QBOh+amf0vTJbm6+9VwAcR9uJviBIor2KON0Y7+EyQx5YbUZEzW1HPeJxarLIHBcxMzgOVzjuM+StzjbUgDzAg"}},"type":"m.room.redaction"}`),
+		// message
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}],["$6sUiGPQ0a3tqYGKo:kaer.morhen",{"sha256":"IS4HSMqpqVUGh1Z3qgC99YcaizjCoO4yFhYYe8j53IE"}]],"content":{"body":"Test Message"},"depth":4,"event_id":"$o8KHsgSIYbJrddnd:kaer.morhen","hashes":{"sha256":"IE/rGVlKOpiGWeIo887g1CK1drYqcWDZhL6THZHkJ1c"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$tJI0pE3b8u9UMYpT:kaer.morhen",{"sha256":"zvmwyXuDox7jpA16JRH6Fc1zbfQht2tpkBbMTUOi3Jw"}]],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"/3z+pJjiJXWhwfqIEzmNksvBHCoXTktK/y0rRuWJXw6i1+ygRG/suDCKhFuuz6gPapRmEMPVILi2mJqHHXPKAg"}},"type":"m.room.message"}`),
+	}
+	deleteDatabase()
+	rsAPI, producer, hevents := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+
+	// Only the message should be redacted: the room name is state, and the
+	// other event is a redaction itself.
+	req := &api.PerformUserRedactionRequest{
+		UserID:  "@userid:kaer.morhen",
+		RoomIDs: []string{"!roomid:kaer.morhen", "!unknown:kaer.morhen"},
+		Reason:  "Erased",
+	}
+	var res api.PerformUserRedactionResponse
+	rsAPI.PerformUserRedaction(ctx, req, &res)
+	if res.Error != nil {
+		t.Fatalf("PerformUserRedaction failed: %s", res.Error)
+	}
+	if res.RedactedEvents != 1 {
+		t.Fatalf("got %d redacted events, want 1", res.RedactedEvents)
+	}
+	var redactedEventIDs []string
+	for _, msg := range producer.producedMessages {
+		if msg.Type == api.OutputTypeRedactedEvent {
+			redactedEventIDs = append(redactedEventIDs, msg.RedactedEvent.RedactedEventID)
+		}
+	}
+	if len(redactedEventIDs) != 2 || redactedEventIDs[1] != hevents[4].EventID() {
+		t.Fatalf("expected the message to be redacted, got redactions of %v", redactedEventIDs)
+	}
+
+	// Events which have already been redacted are skipped.
+	res = api.PerformUserRedactionResponse{}
+	rsAPI.PerformUserRedaction(ctx, req, &res)
+	if res.Error != nil || res.RedactedEvents != 0 {
+		t.Fatalf("expected nothing to be redacted again, got %d, %v", res.RedactedEvents, res.Error)
+	}
+
+	res = api.PerformUserRedactionResponse{}
+	rsAPI.PerformUserRedaction(ctx, &api.PerformUserRedactionRequest{
+		UserID:  "@someone:remote",
+		RoomIDs: []string{"!roomid:kaer.morhen"},
+	}, &res)
+	if res.Error == nil || res.Error.Code != api.PerformErrorBadRequest {
+		t.Fatalf("expected redacting a remote user's events to be a bad request, got %v", res.Error)
+	}
+}
+
+func TestPerformPurgeRoom(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+	}
+	deleteDatabase()
+	rsAPI, producer, _ := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+
+	var res api.PerformPurgeRoomResponse
+	rsAPI.PerformPurgeRoom(ctx, &api.PerformPurgeRoomRequest{RoomID: "!roomid:kaer.morhen"}, &res)
+	if res.Error != nil {
+		t.Fatalf("PerformPurgeRoom failed: %s", res.Error)
+	}
+	if len(res.EvacuatedUsers) != 1 || res.EvacuatedUsers[0] != "@userid:kaer.morhen" {
+		t.Fatalf("got evacuated users %v, want [@userid:kaer.morhen]", res.EvacuatedUsers)
+	}
+	var left, purged bool
+	for _, msg := range producer.producedMessages {
+		switch msg.Type {
+		case api.OutputTypeNewRoomEvent:
+			if ev := msg.NewRoomEvent.Event; ev.Type() == gomatrixserverlib.MRoomMember {
+				membership, _ := ev.Membership()
+				left = left || membership == gomatrixserverlib.Leave
+			}
+		case api.OutputTypePurgeRoom:
+			purged = msg.PurgeRoom.RoomID == "!roomid:kaer.morhen"
+		}
+	}
+	if !left || !purged {
+		t.Fatalf("expected the user to leave and the room to be purged, got leave %v and purge %v", left, purged)
+	}
+
+	res = api.PerformPurgeRoomResponse{}
+	rsAPI.PerformPurgeRoom(ctx, &api.PerformPurgeRoomRequest{RoomID: "!roomid:kaer.morhen"}, &res)
+	if res.Error == nil || res.Error.Code != api.PerformErrorNoRoom {
+		t.Fatalf("expected the purged room to be gone, got %v", res.Error)
+	}
+}
+
+func TestPerformJoinRestrictions(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+	}
+	deleteDatabase()
+	rsAPI, _, _ := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+	mustSendLocalEvent(t, rsAPI, gomatrixserverlib.MRoomJoinRules, "", map[string]string{"join_rule": gomatrixserverlib.Public})
+	var aliasRes api.SetRoomAliasResponse
+	if err := rsAPI.SetRoomAlias(ctx, &api.SetRoomAliasRequest{
+		UserID: "@userid:kaer.morhen",
+		Alias:  "#room:kaer.morhen",
+		RoomID: "!roomid:kaer.morhen",
+	}, &aliasRes); err != nil {
+		t.Fatalf("failed to SetRoomAlias: %s", err)
+	}
+
+	join := func(roomIDOrAlias string) *api.PerformError {
+		var res api.PerformJoinResponse
+		rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{
+			RoomIDOrAlias: roomIDOrAlias,
+			UserID:        "@other:kaer.morhen",
+		}, &res)
+		return res.Error
+	}
+
+	// Local rooms are restricted too, and aliases are checked against the
+	// room that they point to.
+	restrictions := &rsAPI.(*internal.RoomserverInternalAPI).Cfg.Matrix.JoinRestrictions
+	restrictions.DeniedRooms = []string{"!roomid:kaer.morhen"}
+	for _, roomIDOrAlias := range []string{"!roomid:kaer.morhen", "#room:kaer.morhen"} {
+		if perr := join(roomIDOrAlias); perr == nil || perr.Code != api.PerformErrorNotAllowed {
+			t.Fatalf("expected joining %s to not be allowed, got %v", roomIDOrAlias, perr)
+		}
+	}
+
+	restrictions.DeniedRooms = nil
+	if perr := join("#room:kaer.morhen"); perr != nil {
+		t.Fatalf("PerformJoin failed: %s", perr)
+	}
+}
+
+func TestPerformModeration(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+	}
+	deleteDatabase()
+	rsAPI, _, _ := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+
+	moderate := func(
+		perform func(context.Context, *api.PerformModerationRequest, *api.PerformModerationResponse),
+		userID, targetUserID string,
+	) *api.PerformError {
+		var res api.PerformModerationResponse
+		perform(ctx, &api.PerformModerationRequest{
+			RoomID:       "!roomid:kaer.morhen",
+			UserID:       userID,
+			TargetUserID: targetUserID,
+			Reason:       "spam",
+		}, &res)
+		if res.Error == nil && res.EventID == "" {
+			t.Fatalf("expected an event ID when the membership was changed")
+		}
+		return res.Error
+	}
+	expectError := func(perr *api.PerformError, code api.PerformErrorCode, what string) {
+		t.Helper()
+		if perr == nil || perr.Code != code {
+			t.Errorf("expected error code %d %s, got %v", code, what, perr)
+		}
+	}
+
+	expectError(moderate(rsAPI.PerformKick, "@userid:kaer.morhen", "@other:kaer.morhen"), api.PerformErrorNoOperation, "kicking a user who isn't in the room")
+	expectError(moderate(rsAPI.PerformUnban, "@userid:kaer.morhen", "@other:kaer.morhen"), api.PerformErrorBadRequest, "unbanning a user who isn't banned")
+	expectError(moderate(rsAPI.PerformBan, "@other:kaer.morhen", "@userid:kaer.morhen"), api.PerformErrorNotAllowed, "banning from outside the room")
+	expectError(moderate(rsAPI.PerformBan, "@userid:kaer.morhen", "@userid:kaer.morhen"), api.PerformErrorNotAllowed, "banning a user with as much power")
+
+	if perr := moderate(rsAPI.PerformBan, "@userid:kaer.morhen", "@other:kaer.morhen"); perr != nil {
+		t.Fatalf("PerformBan failed: %s", perr)
+	}
+	expectError(moderate(rsAPI.PerformKick, "@userid:kaer.morhen", "@other:kaer.morhen"), api.PerformErrorNotAllowed, "kicking a banned user")
+	if perr := moderate(rsAPI.PerformUnban, "@userid:kaer.morhen", "@other:kaer.morhen"); perr != nil {
+		t.Fatalf("PerformUnban failed: %s", perr)
+	}
+	expectError(moderate(rsAPI.PerformUnban, "@userid:kaer.morhen", "@other:kaer.morhen"), api.PerformErrorBadRequest, "unbanning a user twice")
+}
+
+func TestPerformKnock(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+	}
+	version.EnableKnocking()
+	deleteDatabase()
+	rsAPI, dp, _ := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+
+	knock := func(roomID string) *api.PerformError {
+		var res api.PerformKnockResponse
+		rsAPI.PerformKnock(ctx, &api.PerformKnockRequest{
+			RoomIDOrAlias: roomID,
+			UserID:        "@other:kaer.morhen",
+			Reason:        "let me in",
+		}, &res)
+		if res.Error == nil && res.RoomID != roomID {
+			t.Fatalf("got room ID %q, want %s", res.RoomID, roomID)
+		}
+		return res.Error
+	}
+
+	// Room version 1 doesn't allow knocking, even with the knock join rule.
+	mustSendLocalEvent(t, rsAPI, gomatrixserverlib.MRoomJoinRules, "", map[string]string{"join_rule": eventutil.Knock})
+	if perr := knock("!roomid:kaer.morhen"); perr == nil || perr.Code != api.PerformErrorNotAllowed {
+		t.Fatalf("expected knocking on a version 1 room to not be allowed, got %v", perr)
+	}
+
+	// Create a room with the room version which allows knocking.
+	roomID := "!knock:kaer.morhen"
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   "@userid:kaer.morhen",
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomCreate,
+		StateKey: new(string),
+	}
+	if err := builder.SetContent(map[string]interface{}{
+		"creator":      "@userid:kaer.morhen",
+		"room_version": version.RoomVersionKnock,
+	}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	create, err := builder.Build(time.Now(), testOrigin, "ed25519:auto", ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), version.RoomVersionKnock)
+	if err != nil {
+		t.Fatalf("failed to build the create event: %s", err)
+	}
+	if _, err = api.SendEvents(ctx, rsAPI, []gomatrixserverlib.HeaderedEvent{create.Headered(version.RoomVersionKnock)}, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	mustSendLocalEventInRoom(t, rsAPI, roomID, gomatrixserverlib.MRoomMember, "@userid:kaer.morhen", map[string]string{"membership": gomatrixserverlib.Join})
+
+	// The room doesn't have the knock join rule yet.
+	if perr := knock(roomID); perr == nil || perr.Code != api.PerformErrorNotAllowed {
+		t.Fatalf("expected knocking on an invite-only room to not be allowed, got %v", perr)
+	}
+
+	mustSendLocalEventInRoom(t, rsAPI, roomID, gomatrixserverlib.MRoomJoinRules, "", map[string]string{"join_rule": eventutil.Knock})
+
+	if perr := knock(roomID); perr != nil {
+		t.Fatalf("PerformKnock failed: %s", perr)
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err = rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{EventType: gomatrixserverlib.MRoomMember, StateKey: "@other:kaer.morhen"}},
+	}, &res); err != nil {
+		t.Fatalf("failed to QueryLatestEventsAndState: %s", err)
+	}
+	if len(res.StateEvents) != 1 {
+		t.Fatalf("expected a membership event for the user who knocked, got %+v", res.StateEvents)
+	}
+	if membership, _ := res.StateEvents[0].Membership(); membership != eventutil.Knock {
+		t.Fatalf("got membership %q, want %q", membership, eventutil.Knock)
+	}
+	var membershipRes api.QueryMembershipForUserResponse
+	if err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: "@other:kaer.morhen",
+	}, &membershipRes); err != nil {
+		t.Fatalf("failed to QueryMembershipForUser: %s", err)
+	}
+	if membershipRes.Membership != eventutil.Knock || membershipRes.IsInRoom {
+		t.Fatalf("expected the user to be knocking on the room, got %+v", membershipRes)
+	}
+	var knockEvent *api.OutputNewKnockEvent
+	for _, msg := range dp.producedMessages {
+		if msg.Type == api.OutputTypeNewKnockEvent {
+			knockEvent = msg.NewKnockEvent
+		}
+	}
+	if knockEvent == nil || knockEvent.Event.EventID() != res.StateEvents[0].EventID() {
+		t.Fatalf("expected the knock to be sent to the consumers, got %+v", knockEvent)
+	}
+
+	// Users who are already in the room can't knock.
+	var joinedRes api.PerformKnockResponse
+	rsAPI.PerformKnock(ctx, &api.PerformKnockRequest{
+		RoomIDOrAlias: roomID,
+		UserID:        "@userid:kaer.morhen",
+	}, &joinedRes)
+	if joinedRes.Error == nil || joinedRes.Error.Code != api.PerformErrorNotAllowed {
+		t.Fatalf("expected knocking while joined to not be allowed, got %v", joinedRes.Error)
+	}
+}
+
+// fakeFederationSender knocks on remote rooms by building the knock event
+// itself, rather than doing the make_knock and send_knock requests.
+type fakeFederationSender struct {
+	fsAPI.FederationSenderInternalAPI
+	knockRoomState []gomatrixserverlib.InviteV2StrippedState
+}
+
+func (f *fakeFederationSender) PerformKnock(
+	ctx context.Context, req *fsAPI.PerformKnockRequest, res *fsAPI.PerformKnockResponse,
+) error {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   req.UserID,
+		RoomID:   req.RoomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &req.UserID,
+	}
+	if err := builder.SetContent(map[string]string{"membership": eventutil.Knock}); err != nil {
+		return err
+	}
+	event, err := builder.Build(time.Now(), testOrigin, "ed25519:auto", ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), version.RoomVersionKnock)
+	if err != nil {
+		return err
+	}
+	res.KnockEvent = event.Headered(version.RoomVersionKnock)
+	res.KnockStateEvents = f.knockRoomState
+	return nil
+}
+
+func TestPerformFederatedKnock(t *testing.T) {
+	version.EnableKnocking()
+	deleteDatabase()
+	rsAPI, dp, _ := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, nil)
+	defer deleteDatabase()
+
+	var nameEvent gomatrixserverlib.InviteV2StrippedState
+	if err := json.Unmarshal([]byte(`{"type":"m.room.name","state_key":"","content":{"name":"Remote Room"},"sender":"@userid:other.server"}`), &nameEvent); err != nil {
+		t.Fatalf("failed to unmarshal stripped state: %s", err)
+	}
+	rsAPI.SetFederationSenderAPI(&fakeFederationSender{
+		knockRoomState: []gomatrixserverlib.InviteV2StrippedState{nameEvent},
+	})
+
+	var res api.PerformKnockResponse
+	rsAPI.PerformKnock(ctx, &api.PerformKnockRequest{
+		RoomIDOrAlias: "!remote:other.server",
+		UserID:        "@other:kaer.morhen",
+	}, &res)
+	if res.Error != nil {
+		t.Fatalf("PerformKnock failed: %s", res.Error)
+	}
+
+	// The knock is sent to the consumers along with the state of the room
+	// which the remote server gave us.
+	var knockEvent *api.OutputNewKnockEvent
+	for _, msg := range dp.producedMessages {
+		if msg.Type == api.OutputTypeNewKnockEvent {
+			knockEvent = msg.NewKnockEvent
+		}
+	}
+	if knockEvent == nil {
+		t.Fatalf("expected the knock to be sent to the consumers")
+	}
+	var knockRoomState []gomatrixserverlib.InviteV2StrippedState
+	if err := json.Unmarshal([]byte(gjson.GetBytes(knockEvent.Event.Unsigned(), "knock_room_state").Raw), &knockRoomState); err != nil {
+		t.Fatalf("failed to unmarshal the knock room state: %s", err)
+	}
+	if len(knockRoomState) != 2 || knockRoomState[0].Type() != gomatrixserverlib.MRoomName || knockRoomState[1].Type() != gomatrixserverlib.MRoomMember {
+		t.Fatalf("expected the room name and the knock in the knock room state, got %+v", knockRoomState)
+	}
+}
+
+func TestGetHierarchyRoom(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+	}
+	deleteDatabase()
+	rsAPI, _, _ := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+
+	mustSendLocalEvent(t, rsAPI, gomatrixserverlib.MRoomName, "", map[string]string{"name": "My Space"})
+	mustSendLocalEvent(t, rsAPI, gomatrixserverlib.MRoomJoinRules, "", map[string]string{"join_rule": gomatrixserverlib.Public})
+	mustSendLocalEvent(t, rsAPI, api.MSpaceChild, "!unordered:kaer.morhen", map[string]interface{}{"via": []string{"kaer.morhen"}, "suggested": true})
+	mustSendLocalEvent(t, rsAPI, api.MSpaceChild, "!second:kaer.morhen", map[string]interface{}{"via": []string{"kaer.morhen"}, "order": "b"})
+	mustSendLocalEvent(t, rsAPI, api.MSpaceChild, "!first:kaer.morhen", map[string]interface{}{"via": []string{"kaer.morhen"}, "order": "a"})
+	// Children without any servers to reach them through have been removed.
+	mustSendLocalEvent(t, rsAPI, api.MSpaceChild, "!removed:kaer.morhen", map[string]interface{}{})
+
+	room, memberships, err := api.GetHierarchyRoom(ctx, rsAPI, "!roomid:kaer.morhen", "@other:kaer.morhen", false)
+	if err != nil {
+		t.Fatalf("GetHierarchyRoom failed: %s", err)
+	}
+	if room.Name != "My Space" || room.JoinRule != gomatrixserverlib.Public || room.JoinedMembersCount != 1 {
+		t.Errorf("wrong summary of the room: %+v", room.PublicRoom)
+	}
+	if memberships["@userid:kaer.morhen"] != gomatrixserverlib.Join {
+		t.Errorf("expected @userid:kaer.morhen to be joined, got memberships %v", memberships)
+	}
+	if membership, ok := memberships["@other:kaer.morhen"]; ok {
+		t.Errorf("expected no membership for @other:kaer.morhen, got %q", membership)
+	}
+	var children []string
+	for _, child := range room.ChildrenState {
+		children = append(children, child.StateKey)
+	}
+	if want := []string{"!first:kaer.morhen", "!second:kaer.morhen", "!unordered:kaer.morhen"}; !reflect.DeepEqual(children, want) {
+		t.Errorf("got children %v, want %v", children, want)
+	}
+
+	room, _, err = api.GetHierarchyRoom(ctx, rsAPI, "!roomid:kaer.morhen", "", true)
+	if err != nil {
+		t.Fatalf("GetHierarchyRoom failed: %s", err)
+	}
+	if len(room.ChildrenState) != 1 || room.ChildrenState[0].StateKey != "!unordered:kaer.morhen" {
+		t.Errorf("expected only the suggested child, got %+v", room.ChildrenState)
+	}
+
+	if room, _, err = api.GetHierarchyRoom(ctx, rsAPI, "!unknown:kaer.morhen", "", false); err != nil || room != nil {
+		t.Errorf("expected no summary of an unknown room, got %+v, %v", room, err)
+	}
+}
+
+func TestQueryMembershipsForRoom(t *testing.T) {
+	events := []json.RawMessage{
+		// create event
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:kaer.morhen"},"depth":0,"event_id":"$N4us6vqqq3RjvpKd:kaer.morhen","hashes":{"sha256":"WTdrCn/YsiounXcJPsLP8xT0ZjHiO5Ov0NvXYmK2onE"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"9+5JcpaN5b5KlHYHGp6r+GoNDH98lbfzGYwjfxensa5C5D/bDACaYnMDLnhwsHOE5nxgI+jT/GV271pz6PMSBQ"}},"state_key":"","type":"m.room.create"}`),
+		// join event
+		[]byte(`{"auth_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"content":{"membership":"join"},"depth":1,"event_id":"$6sUiGPQ0a3tqYGKo:kaer.morhen","hashes":{"sha256":"eYVBC7RO+FlxRyW1aXYf/ad4Dzi7T93tArdGw3r4RwQ"},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N4us6vqqq3RjvpKd:kaer.morhen",{"sha256":"SylirfgfXFhscZL7p10NmOa1nFFEckiwz0lAideQMIM"}]],"prev_state":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{"kaer.morhen":{"ed25519:auto":"tiDBTPFa53YMfHiupX3vSRE/ZcCiCjmGt7gDpIpDpwZapeays5Vqqcqb7KiywrDldpTkrrdJBAw2jXcq6ZyhDw"}},"state_key":"@userid:kaer.morhen","type":"m.room.member"}`),
+	}
+	deleteDatabase()
+	rsAPI, _, _ := mustSendEvents(t, gomatrixserverlib.RoomVersionV1, events)
+	defer deleteDatabase()
+
+	joinEventID := "$6sUiGPQ0a3tqYGKo:kaer.morhen"
+	inviteBobEventID := mustSendLocalEvent(t, rsAPI, gomatrixserverlib.MRoomMember, "@bob:kaer.morhen", map[string]string{"membership": gomatrixserverlib.Invite})
+	mustSendLocalEvent(t, rsAPI, gomatrixserverlib.MRoomMember, "@carol:kaer.morhen", map[string]string{"membership": gomatrixserverlib.Invite})
+
+	// A room which the user is in too, to check that its events can't be used
+	// to get the memberships of the first room.
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   "@userid:kaer.morhen",
+		RoomID:   "!other:kaer.morhen",
+		Type:     gomatrixserverlib.MRoomCreate,
+		StateKey: new(string),
+	}
+	if err := builder.SetContent(map[string]interface{}{"creator": "@userid:kaer.morhen"}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	create, err := builder.Build(time.Now(), testOrigin, "ed25519:auto", ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to build the create event: %s", err)
+	}
+	if _, err = api.SendEvents(ctx, rsAPI, []gomatrixserverlib.HeaderedEvent{create.Headered(gomatrixserverlib.RoomVersionV1)}, testOrigin, nil); err != nil {
+		t.Fatalf("failed to SendEvents: %s", err)
+	}
+	otherRoomEventID := mustSendLocalEventInRoom(t, rsAPI, "!other:kaer.morhen", gomatrixserverlib.MRoomMember, "@userid:kaer.morhen", map[string]string{"membership": gomatrixserverlib.Join})
+
+	testCases := []struct {
+		name        string
+		req         api.QueryMembershipsForRoomRequest
+		wantMembers []string
+		wantErr     bool
+	}{
+		{
+			name:        "current memberships",
+			req:         api.QueryMembershipsForRoomRequest{Sender: "@userid:kaer.morhen"},
+			wantMembers: []string{"@bob:kaer.morhen", "@carol:kaer.morhen", "@userid:kaer.morhen"},
+		},
+		{
+			name:        "memberships after the join",
+			req:         api.QueryMembershipsForRoomRequest{Sender: "@userid:kaer.morhen", AtEventID: joinEventID},
+			wantMembers: []string{"@userid:kaer.morhen"},
+		},
+		{
+			name:        "memberships after the first invite",
+			req:         api.QueryMembershipsForRoomRequest{Sender: "@userid:kaer.morhen", AtEventID: inviteBobEventID},
+			wantMembers: []string{"@bob:kaer.morhen", "@userid:kaer.morhen"},
+		},
+		{
+			name:        "joined memberships after the first invite",
+			req:         api.QueryMembershipsForRoomRequest{Sender: "@userid:kaer.morhen", AtEventID: inviteBobEventID, JoinedOnly: true},
+			wantMembers: []string{"@userid:kaer.morhen"},
+		},
+		{
+			name:    "event in another room",
+			req:     api.QueryMembershipsForRoomRequest{Sender: "@userid:kaer.morhen", AtEventID: otherRoomEventID},
+			wantErr: true,
+		},
+		{
+			name: "user who has never been in the room",
+			req:  api.QueryMembershipsForRoomRequest{Sender: "@other:kaer.morhen", AtEventID: inviteBobEventID},
+		},
+	}
+	for _, tc := range testCases {
+		tc.req.RoomID = "!roomid:kaer.morhen"
+		var res api.QueryMembershipsForRoomResponse
+		err := rsAPI.QueryMembershipsForRoom(ctx, &tc.req, &res)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tc.name, res)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: QueryMembershipsForRoom failed: %s", tc.name, err)
+			continue
+		}
+		if res.HasBeenInRoom != (tc.wantMembers != nil) {
+			t.Errorf("%s: got HasBeenInRoom %v", tc.name, res.HasBeenInRoom)
+		}
+		var members []string
+		for _, ev := range res.JoinEvents {
+			members = append(members, *ev.StateKey)
+		}
+		sort.Strings(members)
+		if !reflect.DeepEqual(members, tc.wantMembers) {
+			t.Errorf("%s: got members %v, want %v", tc.name, members, tc.wantMembers)
+		}
+	}
+}
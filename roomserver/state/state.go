@@ -667,6 +667,13 @@ func (v StateResolution) calculateStateAfterManyEvents(
 			}
 		}
 
+		// Resolving the conflicts is expensive, so don't start if nobody is
+		// waiting for the result any more.
+		if err = ctx.Err(); err != nil {
+			algorithm = "_cancelled"
+			return
+		}
+
 		var resolved []types.StateEntry
 		resolved, err = v.resolveConflicts(ctx, roomVersion, notConflicted, conflicts)
 		if err != nil {
@@ -822,6 +829,9 @@ func (v StateResolution) resolveConflictsV1(
 	if err != nil {
 		return nil, err
 	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// Resolve the conflicts.
 	resolvedEvents := gomatrixserverlib.ResolveStateConflicts(conflictedEvents, authEvents)
@@ -880,6 +890,10 @@ func (v StateResolution) resolveConflictsV2(
 
 	// For each conflicted event, let's try and get the needed auth events.
 	for _, conflictedEvent := range conflictedEvents {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		// Work out which auth events we need to load.
 		key := conflictedEvent.EventID()
 		needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{conflictedEvent})
@@ -942,6 +956,10 @@ func (v StateResolution) resolveConflictsV2(
 		}
 	}
 
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Resolve the conflicts.
 	resolvedEvents := gomatrixserverlib.ResolveStateConflictsV2(
 		conflictedEvents,
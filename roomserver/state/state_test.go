@@ -17,9 +17,13 @@
 package state
 
 import (
+	"context"
+	"errors"
 	"testing"
 
+	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestFindDuplicateStateKeys(t *testing.T) {
@@ -56,3 +60,54 @@ func TestFindDuplicateStateKeys(t *testing.T) {
 		}
 	}
 }
+
+// snapshotDatabase has a state snapshot with a single block for each state
+// entry given to it.
+type snapshotDatabase struct {
+	storage.Database
+	entries []types.StateEntry
+}
+
+func (d *snapshotDatabase) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	lists := make([]types.StateBlockNIDList, len(stateNIDs))
+	for i, stateNID := range stateNIDs {
+		lists[i] = types.StateBlockNIDList{
+			StateSnapshotNID: stateNID,
+			StateBlockNIDs:   []types.StateBlockNID{types.StateBlockNID(stateNID)},
+		}
+	}
+	return lists, nil
+}
+
+func (d *snapshotDatabase) StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	lists := make([]types.StateEntryList, len(stateBlockNIDs))
+	for i, stateBlockNID := range stateBlockNIDs {
+		lists[i] = types.StateEntryList{
+			StateBlockNID: stateBlockNID,
+			StateEntries:  []types.StateEntry{d.entries[stateBlockNID-1]},
+		}
+	}
+	return lists, nil
+}
+
+func TestStateResolutionCancelled(t *testing.T) {
+	db := &snapshotDatabase{entries: []types.StateEntry{
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 1, EventStateKeyNID: 1}, EventNID: 1},
+		{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 1, EventStateKeyNID: 1}, EventNID: 2},
+	}}
+	prevStates := []types.StateAtEvent{
+		{BeforeStateSnapshotNID: 1},
+		{BeforeStateSnapshotNID: 2},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v := NewStateResolution(db)
+	_, algorithm, conflictLength, err := v.calculateStateAfterManyEvents(ctx, gomatrixserverlib.RoomVersionV2, prevStates)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the state resolution to be cancelled, got %v", err)
+	}
+	if algorithm != "_cancelled" || conflictLength != 2 {
+		t.Fatalf("got algorithm %q with %d conflicts, want _cancelled with 2", algorithm, conflictLength)
+	}
+}
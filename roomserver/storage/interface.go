@@ -17,6 +17,7 @@ package storage
 import (
 	"context"
 
+	"github.com/matrix-org/dendrite/internal/outbox"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -86,11 +87,15 @@ type Database interface {
 	// The RoomRecentEventsUpdater must have Commit or Rollback called on it if this doesn't return an error.
 	// Returns the latest events in the room and the last eventID sent to the log along with an updater.
 	// If this returns an error then no further action is required.
-	GetLatestEventsForUpdate(ctx context.Context, roomNID types.RoomNID) (types.RoomRecentEventsUpdater, error)
+	GetLatestEventsForUpdate(ctx context.Context, roomID string, roomNID types.RoomNID) (types.RoomRecentEventsUpdater, error)
 	// Look up event ID by transaction's info.
 	// This is used to determine if the room event is processed/processing already.
 	// Returns an empty string if no such event exists.
 	GetTransactionEventID(ctx context.Context, transactionID string, sessionID int64, userID string) (string, error)
+	// Look up the metadata for a room, i.e. its numeric ID, version and current state snapshot.
+	// Returns nil if the room doesn't exist.
+	// Returns an error if there was a problem talking to the database.
+	RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error)
 	// Look up the numeric ID for the room.
 	// Returns 0 if the room doesn't exists.
 	// Returns an error if there was a problem talking to the database.
@@ -113,6 +118,10 @@ type Database interface {
 	// Look up the room ID a given alias refers to.
 	// Returns an error if there was a problem talking to the database.
 	GetRoomIDForAlias(ctx context.Context, alias string) (string, error)
+	// Look up an alias regardless of its case, returning the alias as it was
+	// saved, or an empty string if there is no such alias.
+	// Returns an error if there was a problem talking to the database.
+	GetAliasIgnoringCase(ctx context.Context, alias string) (string, error)
 	// Look up all aliases referring to a given room ID.
 	// Returns an error if there was a problem talking to the database.
 	GetAliasesForRoomID(ctx context.Context, roomID string) ([]string, error)
@@ -145,4 +154,30 @@ type Database interface {
 	PublishRoom(ctx context.Context, roomID string, publish bool) error
 	// Returns a list of room IDs for rooms which are published.
 	GetPublishedRooms(ctx context.Context) ([]string, error)
+	// Returns a list of room IDs for all rooms known to the server, excluding stubs.
+	GetKnownRooms(ctx context.Context) ([]string, error)
+	// Delete everything stored about a room, including its events, state and aliases,
+	// and store output events about it in the same transaction. Does nothing if the
+	// room isn't known.
+	PurgeRoom(ctx context.Context, roomID string, messages []outbox.Message) error
+	// Store a user's report of an event, returning the ID of the report.
+	StoreEventReport(ctx context.Context, report *api.EventReport) (int64, error)
+	// Look up a report by ID. Returns nil if there is no such report.
+	GetEventReport(ctx context.Context, id int64) (*api.EventReport, error)
+	// Returns a page of reports, newest first, along with the total number of matching reports.
+	// An empty room ID matches reports in every room.
+	GetEventReports(ctx context.Context, roomID string, includeResolved bool, offset, limit int) ([]api.EventReport, int, error)
+	// Claims an annotation which a user is about to send, unless they have already annotated the event with
+	// the same key or have made limit annotations on it. Redacted annotations don't count.
+	ClaimAnnotation(ctx context.Context, eventID, relatesToID, sender, eventType, key string, limit int) (duplicate, limitReached bool, err error)
+	// Gives up the claim on an annotation which couldn't be sent.
+	ReleaseAnnotation(ctx context.Context, eventID string) error
+	// Returns the IDs of the events which aren't state events that a user has sent in a room, oldest first,
+	// excluding any which have been redacted.
+	GetEventIDsBySender(ctx context.Context, roomNID types.RoomNID, sender string) ([]string, error)
+	// Mark a report as resolved.
+	ResolveEventReport(ctx context.Context, id int64, resolvedBy string, resolvedTS gomatrixserverlib.Timestamp) error
+	// Store output events to be produced by the outbox relay.
+	StoreOutboxMessages(ctx context.Context, messages []outbox.Message) error
+	outbox.Database
 }
@@ -65,13 +65,21 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     -- Needed for setting reference hashes when sending new events.
     reference_sha256 BYTEA NOT NULL,
     -- A list of numeric IDs for events that can authenticate this event.
-    auth_event_nids BIGINT[] NOT NULL
+    auth_event_nids BIGINT[] NOT NULL,
+    -- Local numeric ID for the sender of the event, from the
+    -- roomserver_event_state_keys table.
+    sender_nid BIGINT NOT NULL DEFAULT 0
 );
+
+-- Tables created before senders were tracked don't have the sender_nid column.
+ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS sender_nid BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS roomserver_events_sender_nid_idx ON roomserver_events (sender_nid, room_nid);
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, sender_nid)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
 	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique" +
 	" DO NOTHING" +
 	" RETURNING event_nid, state_snapshot_nid"
@@ -122,6 +130,17 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDForEventNIDSQL = "" +
 	"SELECT room_nid FROM roomserver_events WHERE event_nid = $1"
 
+const selectEventIDsBySenderSQL = "" +
+	"SELECT event_id FROM roomserver_events WHERE room_nid = $1 AND sender_nid = $2 AND event_state_key_nid = 0" +
+	" ORDER BY event_nid ASC"
+
+const selectEventNIDsWithoutSenderSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE sender_nid = 0 AND event_nid > $1" +
+	" ORDER BY event_nid ASC LIMIT $2"
+
+const updateEventSenderNIDSQL = "" +
+	"UPDATE roomserver_events SET sender_nid = $1 WHERE event_nid = $2"
+
 type eventStatements struct {
 	insertEventStmt                        *sql.Stmt
 	selectEventStmt                        *sql.Stmt
@@ -137,6 +156,9 @@ type eventStatements struct {
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
 	selectRoomNIDForEventNIDStmt           *sql.Stmt
+	selectEventIDsBySenderStmt             *sql.Stmt
+	selectEventNIDsWithoutSenderStmt       *sql.Stmt
+	updateEventSenderNIDStmt               *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -161,6 +183,9 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
+		{&s.selectEventIDsBySenderStmt, selectEventIDsBySenderSQL},
+		{&s.selectEventNIDsWithoutSenderStmt, selectEventNIDsWithoutSenderSQL},
+		{&s.updateEventSenderNIDStmt, updateEventSenderNIDSQL},
 	}.Prepare(db)
 }
 
@@ -174,12 +199,13 @@ func (s *eventStatements) InsertEvent(
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	senderNID types.EventStateKeyNID,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
 	err := s.insertEventStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, int64(senderNID),
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -434,6 +460,51 @@ func (s *eventStatements) SelectRoomNIDForEventNID(
 	return
 }
 
+func (s *eventStatements) SelectEventIDsBySender(
+	ctx context.Context, roomNID types.RoomNID, senderNID types.EventStateKeyNID,
+) ([]string, error) {
+	rows, err := s.selectEventIDsBySenderStmt.QueryContext(ctx, int64(roomNID), int64(senderNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectEventIDsBySender: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *eventStatements) SelectEventNIDsWithoutSender(
+	ctx context.Context, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectEventNIDsWithoutSenderStmt.QueryContext(ctx, int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectEventNIDsWithoutSender: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) UpdateEventSenderNID(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, senderNID types.EventStateKeyNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateEventSenderNIDStmt).ExecContext(ctx, int64(senderNID), int64(eventNID))
+	return err
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
@@ -29,10 +29,11 @@ import (
 const membershipSchema = `
 -- The membership table is used to coordinate updates between the invite table
 -- and the room state tables.
--- This table is updated in one of 3 ways:
+-- This table is updated in one of 4 ways:
 --   1) The membership of a user changes within the current state of the room.
 --   2) An invite is received outside of a room over federation.
 --   3) An invite is rejected outside of a room over federation.
+--   4) A local user knocks on a room over federation.
 CREATE TABLE IF NOT EXISTS roomserver_membership (
 	room_nid BIGINT NOT NULL,
 	-- Numeric state key ID for the user ID this state is for.
@@ -48,6 +49,8 @@ CREATE TABLE IF NOT EXISTS roomserver_membership (
 	-- It refers to the join membership event if the membership_nid is join (3),
 	-- and to the leave/ban membership event if the membership_nid is leave or
 	-- ban (1).
+	-- It refers to the knock membership event if the membership_nid is knock (4)
+	-- and the knock was made in a room which we are in, and is 0 otherwise.
 	-- If the membership_nid is invite (2) and the user has been in the room
 	-- before, it will refer to the previous leave/ban membership event, and will
 	-- be equals to 0 (its default) if the user never joined the room before.
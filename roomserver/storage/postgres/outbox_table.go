@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/outbox"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+const outboxSchema = `
+-- Stores output events which haven't been produced to Kafka yet. They are
+-- stored in the same transaction as the events which caused them.
+CREATE TABLE IF NOT EXISTS roomserver_outbox (
+    -- The order in which the messages are produced
+    id BIGSERIAL PRIMARY KEY,
+    -- The Kafka topic, key and value of the message
+    topic TEXT NOT NULL,
+    message_key TEXT NOT NULL,
+    message_value BYTEA NOT NULL
+);
+`
+
+// Messages are produced in the order of their IDs, but IDs are handed out when
+// messages are inserted rather than when their transactions commit. Locking the
+// outbox until the transaction commits stops a transaction which inserted
+// messages later from committing, and so being produced, first.
+const lockOutboxSQL = "" +
+	"LOCK TABLE roomserver_outbox IN EXCLUSIVE MODE"
+
+const insertOutboxMessageSQL = "" +
+	"INSERT INTO roomserver_outbox (topic, message_key, message_value) VALUES ($1, $2, $3)"
+
+const selectOutboxMessagesSQL = "" +
+	"SELECT id, topic, message_key, message_value FROM roomserver_outbox ORDER BY id ASC LIMIT $1"
+
+const deleteOutboxMessagesSQL = "" +
+	"DELETE FROM roomserver_outbox WHERE id = ANY($1)"
+
+type outboxStatements struct {
+	insertOutboxMessageStmt  *sql.Stmt
+	selectOutboxMessagesStmt *sql.Stmt
+	deleteOutboxMessagesStmt *sql.Stmt
+}
+
+func NewPostgresOutboxTable(db *sql.DB) (tables.Outbox, error) {
+	s := &outboxStatements{}
+	_, err := db.Exec(outboxSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertOutboxMessageStmt, insertOutboxMessageSQL},
+		{&s.selectOutboxMessagesStmt, selectOutboxMessagesSQL},
+		{&s.deleteOutboxMessagesStmt, deleteOutboxMessagesSQL},
+	}.Prepare(db)
+}
+
+func (s *outboxStatements) InsertMessage(
+	ctx context.Context, txn *sql.Tx, topic, key string, value []byte,
+) error {
+	if txn != nil {
+		if _, err := txn.ExecContext(ctx, lockOutboxSQL); err != nil {
+			return err
+		}
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertOutboxMessageStmt)
+	_, err := stmt.ExecContext(ctx, topic, key, value)
+	return err
+}
+
+func (s *outboxStatements) SelectMessages(
+	ctx context.Context, limit int,
+) ([]outbox.Message, error) {
+	rows, err := s.selectOutboxMessagesStmt.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectOutboxMessagesStmt: rows.close() failed")
+
+	var messages []outbox.Message
+	for rows.Next() {
+		var msg outbox.Message
+		if err = rows.Scan(&msg.ID, &msg.Topic, &msg.Key, &msg.Value); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func (s *outboxStatements) DeleteMessages(
+	ctx context.Context, ids []int64,
+) error {
+	_, err := s.deleteOutboxMessagesStmt.ExecContext(ctx, pq.Int64Array(ids))
+	return err
+}
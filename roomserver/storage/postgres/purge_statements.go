@@ -0,0 +1,141 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const purgeStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = ANY(" +
+	" SELECT DISTINCT UNNEST(state_block_nids) FROM roomserver_state_snapshots WHERE room_nid = $1" +
+	")"
+
+const purgeStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY(" +
+	" SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgePreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id = ANY(" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeRedactionsSQL = "" +
+	"DELETE FROM roomserver_redactions WHERE redaction_event_id = ANY(" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeAnnotationsSQL = "" +
+	"DELETE FROM roomserver_annotations WHERE event_id = ANY(" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeTransactionsSQL = "" +
+	"DELETE FROM roomserver_transactions WHERE event_id = ANY(" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
+const purgeEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE room_nid = $1"
+
+const purgeRoomSQL = "" +
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
+
+const purgePublishedSQL = "" +
+	"DELETE FROM roomserver_published WHERE room_id = $1"
+
+const purgeRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
+
+const purgeEventReportsSQL = "" +
+	"DELETE FROM roomserver_event_reports WHERE room_id = $1"
+
+type purgeStatements struct {
+	purgeStateBlocksStmt    *sql.Stmt
+	purgeStateSnapshotsStmt *sql.Stmt
+	purgeEventJSONStmt      *sql.Stmt
+	purgePreviousEventsStmt *sql.Stmt
+	purgeRedactionsStmt     *sql.Stmt
+	purgeAnnotationsStmt    *sql.Stmt
+	purgeTransactionsStmt   *sql.Stmt
+	purgeInvitesStmt        *sql.Stmt
+	purgeMembershipsStmt    *sql.Stmt
+	purgeEventsStmt         *sql.Stmt
+	purgeRoomStmt           *sql.Stmt
+	purgePublishedStmt      *sql.Stmt
+	purgeRoomAliasesStmt    *sql.Stmt
+	purgeEventReportsStmt   *sql.Stmt
+}
+
+func NewPostgresPurgeStatements(db *sql.DB) (tables.Purge, error) {
+	s := &purgeStatements{}
+	return s, shared.StatementList{
+		{&s.purgeStateBlocksStmt, purgeStateBlocksSQL},
+		{&s.purgeStateSnapshotsStmt, purgeStateSnapshotsSQL},
+		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
+		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
+		{&s.purgeRedactionsStmt, purgeRedactionsSQL},
+		{&s.purgeAnnotationsStmt, purgeAnnotationsSQL},
+		{&s.purgeTransactionsStmt, purgeTransactionsSQL},
+		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.purgeRoomStmt, purgeRoomSQL},
+		{&s.purgePublishedStmt, purgePublishedSQL},
+		{&s.purgeRoomAliasesStmt, purgeRoomAliasesSQL},
+		{&s.purgeEventReportsStmt, purgeEventReportsSQL},
+	}.Prepare(db)
+}
+
+func (s *purgeStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
+) error {
+	// The rows which refer to the room's events and state snapshots have to
+	// go before the events and snapshots themselves.
+	for _, stmt := range []*sql.Stmt{
+		s.purgeStateBlocksStmt, s.purgeStateSnapshotsStmt, s.purgeEventJSONStmt,
+		s.purgePreviousEventsStmt, s.purgeRedactionsStmt, s.purgeAnnotationsStmt,
+		s.purgeTransactionsStmt, s.purgeInvitesStmt, s.purgeMembershipsStmt,
+		s.purgeEventsStmt, s.purgeRoomStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, int64(roomNID)); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range []*sql.Stmt{
+		s.purgePublishedStmt, s.purgeRoomAliasesStmt, s.purgeEventReportsStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -36,6 +36,8 @@ CREATE TABLE IF NOT EXISTS roomserver_room_aliases (
 );
 
 CREATE INDEX IF NOT EXISTS roomserver_room_id_idx ON roomserver_room_aliases(room_id);
+-- Used to look up aliases when they are case-insensitive
+CREATE INDEX IF NOT EXISTS roomserver_room_alias_lower_idx ON roomserver_room_aliases(LOWER(alias));
 `
 
 const insertRoomAliasSQL = "" +
@@ -44,6 +46,9 @@ const insertRoomAliasSQL = "" +
 const selectRoomIDFromAliasSQL = "" +
 	"SELECT room_id FROM roomserver_room_aliases WHERE alias = $1"
 
+const selectAliasIgnoringCaseSQL = "" +
+	"SELECT alias FROM roomserver_room_aliases WHERE LOWER(alias) = LOWER($1)"
+
 const selectAliasesFromRoomIDSQL = "" +
 	"SELECT alias FROM roomserver_room_aliases WHERE room_id = $1"
 
@@ -56,6 +61,7 @@ const deleteRoomAliasSQL = "" +
 type roomAliasesStatements struct {
 	insertRoomAliasStmt          *sql.Stmt
 	selectRoomIDFromAliasStmt    *sql.Stmt
+	selectAliasIgnoringCaseStmt  *sql.Stmt
 	selectAliasesFromRoomIDStmt  *sql.Stmt
 	selectCreatorIDFromAliasStmt *sql.Stmt
 	deleteRoomAliasStmt          *sql.Stmt
@@ -70,6 +76,7 @@ func NewPostgresRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
 	return s, shared.StatementList{
 		{&s.insertRoomAliasStmt, insertRoomAliasSQL},
 		{&s.selectRoomIDFromAliasStmt, selectRoomIDFromAliasSQL},
+		{&s.selectAliasIgnoringCaseStmt, selectAliasIgnoringCaseSQL},
 		{&s.selectAliasesFromRoomIDStmt, selectAliasesFromRoomIDSQL},
 		{&s.selectCreatorIDFromAliasStmt, selectCreatorIDFromAliasSQL},
 		{&s.deleteRoomAliasStmt, deleteRoomAliasSQL},
@@ -93,6 +100,16 @@ func (s *roomAliasesStatements) SelectRoomIDFromAlias(
 	return
 }
 
+func (s *roomAliasesStatements) SelectAliasIgnoringCase(
+	ctx context.Context, alias string,
+) (storedAlias string, err error) {
+	err = s.selectAliasIgnoringCaseStmt.QueryRowContext(ctx, alias).Scan(&storedAlias)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
 func (s *roomAliasesStatements) SelectAliasesFromRoomID(
 	ctx context.Context, roomID string,
 ) ([]string, error) {
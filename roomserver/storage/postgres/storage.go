@@ -16,8 +16,10 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 
 	// Import the postgres database driver.
@@ -28,74 +30,118 @@ import (
 // A Database is used to store room events and stream offsets.
 type Database struct {
 	shared.Database
+	// The room directory is read from the replica if one was configured.
+	replica   *sqlutil.ReadReplica
+	replicaDB *shared.Database
 }
 
-// Open a postgres database.
-// nolint: gocyclo
-func Open(dataSourceName string, dbProperties sqlutil.DbProperties) (*Database, error) {
+// Open a postgres database. The replica data source name is optional.
+func Open(dataSourceName, replicaDataSourceName string, dbProperties sqlutil.DbProperties, cache caching.RoomInfoCache) (*Database, error) {
 	var d Database
 	var db *sql.DB
 	var err error
 	if db, err = sqlutil.Open("postgres", dataSourceName, dbProperties); err != nil {
 		return nil, err
 	}
-	eventStateKeys, err := NewPostgresEventStateKeysTable(db)
+	if d.Database, err = prepareDatabase(db, cache); err != nil {
+		return nil, err
+	}
+	if err = d.Database.BackfillSenderNIDs(context.Background()); err != nil {
+		return nil, err
+	}
+	if replicaDataSourceName == "" {
+		return &d, nil
+	}
+
+	replicaDB, err := sqlutil.OpenReadReplica(replicaDataSourceName, dbProperties)
 	if err != nil {
 		return nil, err
 	}
-	eventTypes, err := NewPostgresEventTypesTable(db)
+	replica, err := prepareDatabase(replicaDB, cache)
 	if err != nil {
 		return nil, err
 	}
+	d.replica = sqlutil.NewReadReplica(db, replicaDB)
+	d.replicaDB = &replica
+	return &d, nil
+}
+
+// prepareDatabase prepares the statements for all of the tables in db.
+// nolint: gocyclo
+func prepareDatabase(db *sql.DB, cache caching.RoomInfoCache) (shared.Database, error) {
+	eventStateKeys, err := NewPostgresEventStateKeysTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	eventTypes, err := NewPostgresEventTypesTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
 	eventJSON, err := NewPostgresEventJSONTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	events, err := NewPostgresEventsTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	rooms, err := NewPostgresRoomsTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	transactions, err := NewPostgresTransactionsTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	stateBlock, err := NewPostgresStateBlockTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	stateSnapshot, err := NewPostgresStateSnapshotTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	roomAliases, err := NewPostgresRoomAliasesTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	prevEvents, err := NewPostgresPreviousEventsTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	invites, err := NewPostgresInvitesTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	membership, err := NewPostgresMembershipTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
 	published, err := NewPostgresPublishedTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
+	}
+	outboxTable, err := NewPostgresOutboxTable(db)
+	if err != nil {
+		return shared.Database{}, err
 	}
 	redactions, err := NewPostgresRedactionsTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
-	d.Database = shared.Database{
+	eventReports, err := NewPostgresEventReportsTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	annotations, err := NewPostgresAnnotationsTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	purge, err := NewPostgresPurgeStatements(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	return shared.Database{
 		DB:                  db,
 		EventTypesTable:     eventTypes,
 		EventStateKeysTable: eventStateKeys,
@@ -111,6 +157,23 @@ func Open(dataSourceName string, dbProperties sqlutil.DbProperties) (*Database,
 		MembershipTable:     membership,
 		PublishedTable:      published,
 		RedactionsTable:     redactions,
-	}
-	return &d, nil
+		OutboxTable:         outboxTable,
+		EventReportsTable:   eventReports,
+		AnnotationsTable:    annotations,
+		PurgeTable:          purge,
+		Cache:               cache,
+	}, nil
+}
+
+// GetPublishedRooms lists the rooms in the room directory.
+func (d *Database) GetPublishedRooms(ctx context.Context) (roomIDs []string, err error) {
+	err = d.replica.Read(ctx, func(onReplica bool) error {
+		db := &d.Database
+		if onReplica {
+			db = d.replicaDB
+		}
+		roomIDs, err = db.GetPublishedRooms(ctx)
+		return err
+	})
+	return
 }
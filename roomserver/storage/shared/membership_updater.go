@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal/outbox"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -93,6 +94,11 @@ func (u *membershipUpdater) IsLeave() bool {
 	return u.membership == tables.MembershipStateLeaveOrBan
 }
 
+// IsKnock implements types.MembershipUpdater
+func (u *membershipUpdater) IsKnock() bool {
+	return u.membership == tables.MembershipStateKnock
+}
+
 // SetToInvite implements types.MembershipUpdater
 func (u *membershipUpdater) SetToInvite(event gomatrixserverlib.Event) (bool, error) {
 	senderUserNID, err := u.d.assignStateKeyNID(u.ctx, u.txn, event.Sender())
@@ -181,3 +187,32 @@ func (u *membershipUpdater) SetToLeave(senderUserID string, eventID string) ([]s
 	}
 	return inviteEventIDs, nil
 }
+
+// SetToKnock implements types.MembershipUpdater
+func (u *membershipUpdater) SetToKnock(event gomatrixserverlib.Event) (bool, error) {
+	if u.membership == tables.MembershipStateKnock {
+		return false, nil
+	}
+	senderUserNID, err := u.d.assignStateKeyNID(u.ctx, u.txn, event.Sender())
+	if err != nil {
+		return false, err
+	}
+	// The knock event will only have a NID if it was sent in a room that we
+	// are in, rather than being sent to a remote server with send_knock.
+	nIDs, err := u.d.EventNIDs(u.ctx, []string{event.EventID()})
+	if err != nil {
+		return false, err
+	}
+	if err = u.d.MembershipTable.UpdateMembership(
+		u.ctx, u.txn, u.roomNID, u.targetUserNID, senderUserNID,
+		tables.MembershipStateKnock, nIDs[event.EventID()],
+	); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// StoreOutboxMessages implements types.MembershipUpdater
+func (u *membershipUpdater) StoreOutboxMessages(messages []outbox.Message) error {
+	return u.d.storeOutboxMessages(u.ctx, u.txn, messages)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal/outbox"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -11,13 +12,17 @@ import (
 type roomRecentEventsUpdater struct {
 	transaction
 	d                       *Database
+	roomID                  string
 	roomNID                 types.RoomNID
 	latestEvents            []types.StateAtEventAndReference
 	lastEventIDSent         string
 	currentStateSnapshotNID types.StateSnapshotNID
+	// true if SetLatestEvents has been called, so the cached room info needs
+	// to be thrown away once the changes are committed
+	latestEventsChanged bool
 }
 
-func NewRoomRecentEventsUpdater(d *Database, ctx context.Context, roomNID types.RoomNID, useTxns bool) (types.RoomRecentEventsUpdater, error) {
+func NewRoomRecentEventsUpdater(d *Database, ctx context.Context, roomID string, roomNID types.RoomNID, useTxns bool) (types.RoomRecentEventsUpdater, error) {
 	txn, err := d.DB.Begin()
 	if err != nil {
 		return nil, err
@@ -46,7 +51,7 @@ func NewRoomRecentEventsUpdater(d *Database, ctx context.Context, roomNID types.
 		txn = nil
 	}
 	return &roomRecentEventsUpdater{
-		transaction{ctx, txn}, d, roomNID, stateAndRefs, lastEventIDSent, currentStateSnapshotNID,
+		transaction{ctx, txn}, d, roomID, roomNID, stateAndRefs, lastEventIDSent, currentStateSnapshotNID, false,
 	}, nil
 }
 
@@ -102,9 +107,21 @@ func (u *roomRecentEventsUpdater) SetLatestEvents(
 	for i := range latest {
 		eventNIDs[i] = latest[i].EventNID
 	}
+	u.latestEventsChanged = true
 	return u.d.RoomsTable.UpdateLatestEventNIDs(u.ctx, u.txn, roomNID, eventNIDs, lastEventNIDSent, currentStateSnapshotNID)
 }
 
+// Commit implements types.Transaction
+func (u *roomRecentEventsUpdater) Commit() error {
+	if err := u.transaction.Commit(); err != nil {
+		return err
+	}
+	if u.latestEventsChanged {
+		u.d.Cache.InvalidateRoomInfo(u.roomID)
+	}
+	return nil
+}
+
 // HasEventBeenSent implements types.RoomRecentEventsUpdater
 func (u *roomRecentEventsUpdater) HasEventBeenSent(eventNID types.EventNID) (bool, error) {
 	return u.d.EventsTable.SelectEventSentToOutput(u.ctx, u.txn, eventNID)
@@ -118,3 +135,8 @@ func (u *roomRecentEventsUpdater) MarkEventAsSent(eventNID types.EventNID) error
 func (u *roomRecentEventsUpdater) MembershipUpdater(targetUserNID types.EventStateKeyNID, targetLocal bool) (types.MembershipUpdater, error) {
 	return u.d.membershipUpdaterTxn(u.ctx, u.txn, u.roomNID, targetUserNID, targetLocal)
 }
+
+// StoreOutboxMessages implements types.RoomRecentEventsUpdater
+func (u *roomRecentEventsUpdater) StoreOutboxMessages(messages []outbox.Message) error {
+	return u.d.storeOutboxMessages(u.ctx, u.txn, messages)
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/outbox"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
@@ -40,6 +43,11 @@ type Database struct {
 	MembershipTable     tables.Membership
 	PublishedTable      tables.Published
 	RedactionsTable     tables.Redactions
+	OutboxTable         tables.Outbox
+	EventReportsTable   tables.EventReports
+	AnnotationsTable    tables.Annotations
+	PurgeTable          tables.Purge
+	Cache               caching.RoomInfoCache
 }
 
 func (d *Database) EventTypeNIDs(
@@ -145,28 +153,28 @@ func (d *Database) EventsFromIDs(ctx context.Context, eventIDs []string) ([]type
 	return d.Events(ctx, nids)
 }
 
+// RoomInfo returns the metadata for the given room, or nil if the room is
+// not known. The result is served from the cache where possible.
+func (d *Database) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	return d.Cache.GetOrLoadRoomInfo(roomID, func() (*types.RoomInfo, error) {
+		return d.RoomsTable.SelectRoomInfo(ctx, roomID)
+	})
+}
+
 func (d *Database) RoomNID(ctx context.Context, roomID string) (types.RoomNID, error) {
-	roomNID, err := d.RoomsTable.SelectRoomNID(ctx, nil, roomID)
-	if err == sql.ErrNoRows {
-		return 0, nil
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil || roomInfo == nil {
+		return 0, err
 	}
-	return roomNID, err
+	return roomInfo.RoomNID, nil
 }
 
-func (d *Database) RoomNIDExcludingStubs(ctx context.Context, roomID string) (roomNID types.RoomNID, err error) {
-	roomNID, err = d.RoomNID(ctx, roomID)
-	if err != nil {
-		return
-	}
-	latestEvents, _, err := d.RoomsTable.SelectLatestEventNIDs(ctx, nil, roomNID)
-	if err != nil {
-		return
-	}
-	if len(latestEvents) == 0 {
-		roomNID = 0
-		return
+func (d *Database) RoomNIDExcludingStubs(ctx context.Context, roomID string) (types.RoomNID, error) {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil || roomInfo == nil || roomInfo.IsStub {
+		return 0, err
 	}
-	return
+	return roomInfo.RoomNID, nil
 }
 
 func (d *Database) LatestEventIDs(
@@ -206,9 +214,14 @@ func (d *Database) StateEntries(
 func (d *Database) GetRoomVersionForRoom(
 	ctx context.Context, roomID string,
 ) (gomatrixserverlib.RoomVersion, error) {
-	return d.RoomsTable.SelectRoomVersionForRoomID(
-		ctx, nil, roomID,
-	)
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+	if roomInfo == nil {
+		return "", errors.New("room not found")
+	}
+	return roomInfo.RoomVersion, nil
 }
 
 func (d *Database) GetRoomVersionForRoomNID(
@@ -227,6 +240,10 @@ func (d *Database) GetRoomIDForAlias(ctx context.Context, alias string) (string,
 	return d.RoomAliasesTable.SelectRoomIDFromAlias(ctx, alias)
 }
 
+func (d *Database) GetAliasIgnoringCase(ctx context.Context, alias string) (string, error) {
+	return d.RoomAliasesTable.SelectAliasIgnoringCase(ctx, alias)
+}
+
 func (d *Database) GetAliasesForRoomID(ctx context.Context, roomID string) ([]string, error) {
 	return d.RoomAliasesTable.SelectAliasesFromRoomID(ctx, roomID)
 }
@@ -336,9 +353,9 @@ func (d *Database) MembershipUpdater(
 }
 
 func (d *Database) GetLatestEventsForUpdate(
-	ctx context.Context, roomNID types.RoomNID,
+	ctx context.Context, roomID string, roomNID types.RoomNID,
 ) (types.RoomRecentEventsUpdater, error) {
-	return NewRoomRecentEventsUpdater(d, ctx, roomNID, true)
+	return NewRoomRecentEventsUpdater(d, ctx, roomID, roomNID, true)
 }
 
 func (d *Database) StoreEvent(
@@ -349,6 +366,7 @@ func (d *Database) StoreEvent(
 		roomNID          types.RoomNID
 		eventTypeNID     types.EventTypeNID
 		eventStateKeyNID types.EventStateKeyNID
+		senderNID        types.EventStateKeyNID
 		eventNID         types.EventNID
 		stateNID         types.StateSnapshotNID
 		redactionEvent   *gomatrixserverlib.Event
@@ -397,6 +415,10 @@ func (d *Database) StoreEvent(
 			}
 		}
 
+		if senderNID, err = d.assignStateKeyNID(ctx, txn, event.Sender()); err != nil {
+			return err
+		}
+
 		if eventNID, stateNID, err = d.EventsTable.InsertEvent(
 			ctx,
 			txn,
@@ -407,6 +429,7 @@ func (d *Database) StoreEvent(
 			event.EventReference().EventSHA256,
 			authEventNIDs,
 			event.Depth(),
+			senderNID,
 		); err != nil {
 			if err == sql.ErrNoRows {
 				// We've already inserted the event so select the numeric event ID
@@ -420,6 +443,9 @@ func (d *Database) StoreEvent(
 		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
 			return err
 		}
+		if err = d.indexAnnotation(ctx, txn, event); err != nil {
+			return err
+		}
 		redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
 		return err
 	})
@@ -447,6 +473,181 @@ func (d *Database) GetPublishedRooms(ctx context.Context) ([]string, error) {
 	return d.PublishedTable.SelectAllPublishedRooms(ctx, true)
 }
 
+func (d *Database) StoreEventReport(ctx context.Context, report *api.EventReport) (int64, error) {
+	return d.EventReportsTable.InsertEventReport(ctx, report)
+}
+
+func (d *Database) GetEventReport(ctx context.Context, id int64) (*api.EventReport, error) {
+	return d.EventReportsTable.SelectEventReport(ctx, id)
+}
+
+func (d *Database) GetEventReports(
+	ctx context.Context, roomID string, includeResolved bool, offset, limit int,
+) ([]api.EventReport, int, error) {
+	total, err := d.EventReportsTable.SelectEventReportCount(ctx, roomID, includeResolved)
+	if err != nil {
+		return nil, 0, err
+	}
+	reports, err := d.EventReportsTable.SelectEventReports(ctx, roomID, includeResolved, offset, limit)
+	return reports, total, err
+}
+
+func (d *Database) ResolveEventReport(
+	ctx context.Context, id int64, resolvedBy string, resolvedTS gomatrixserverlib.Timestamp,
+) error {
+	return d.EventReportsTable.UpdateEventReportResolved(ctx, id, resolvedBy, resolvedTS)
+}
+
+// ClaimAnnotation stores an annotation before it is sent, so that concurrent
+// duplicates are rejected. Does nothing if the annotation event is already
+// known.
+func (d *Database) ClaimAnnotation(
+	ctx context.Context, eventID, relatesToID, sender, eventType, key string, limit int,
+) (duplicate, limitReached bool, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		stored, err := d.AnnotationsTable.InsertAnnotationWithinLimit(ctx, txn, eventID, relatesToID, sender, eventType, key, limit)
+		if err != nil || stored {
+			return err
+		}
+		// Work out why it wasn't stored from what was there instead.
+		annotations, err := d.AnnotationsTable.SelectAnnotationsBySender(ctx, txn, relatesToID, sender)
+		if err != nil {
+			return err
+		}
+		for _, annotation := range annotations {
+			if annotation.EventID == eventID {
+				return nil
+			}
+			if annotation.Type == eventType && annotation.Key == key {
+				duplicate = true
+				return nil
+			}
+		}
+		limitReached = true
+		return nil
+	})
+	return
+}
+
+// ReleaseAnnotation forgets an annotation which was claimed but couldn't be sent.
+func (d *Database) ReleaseAnnotation(ctx context.Context, eventID string) error {
+	return d.AnnotationsTable.DeleteAnnotation(ctx, nil, eventID)
+}
+
+func (d *Database) GetEventIDsBySender(
+	ctx context.Context, roomNID types.RoomNID, sender string,
+) ([]string, error) {
+	senderNID, err := d.EventStateKeysTable.SelectEventStateKeyNID(ctx, nil, sender)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	eventIDs, err := d.EventsTable.SelectEventIDsBySender(ctx, roomNID, senderNID)
+	if err != nil {
+		return nil, err
+	}
+	unredacted := eventIDs[:0]
+	for _, eventID := range eventIDs {
+		info, err := d.RedactionsTable.SelectRedactionInfoByEventBeingRedacted(ctx, nil, eventID)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil || !info.Validated {
+			unredacted = append(unredacted, eventID)
+		}
+	}
+	return unredacted, nil
+}
+
+// senderBackfillBatchSize is how many events BackfillSenderNIDs updates at a time.
+const senderBackfillBatchSize = 1000
+
+// BackfillSenderNIDs sets the sender of events which were stored before senders
+// were tracked, using the sender from the stored event JSON. It is cheap to run
+// once the backfill has completed.
+func (d *Database) BackfillSenderNIDs(ctx context.Context) error {
+	var after types.EventNID
+	for {
+		eventNIDs, err := d.EventsTable.SelectEventNIDsWithoutSender(ctx, after, senderBackfillBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(eventNIDs) == 0 {
+			return nil
+		}
+		// Events without JSON are skipped rather than selected again, since
+		// they would otherwise never leave the batch.
+		after = eventNIDs[len(eventNIDs)-1]
+		eventJSONs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, eventNIDs)
+		if err != nil {
+			return err
+		}
+		err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+			for _, eventJSON := range eventJSONs {
+				sender := gjson.GetBytes(eventJSON.EventJSON, "sender").String()
+				if sender == "" {
+					continue
+				}
+				senderNID, err := d.assignStateKeyNID(ctx, txn, sender)
+				if err != nil {
+					return err
+				}
+				if err = d.EventsTable.UpdateEventSenderNID(ctx, txn, eventJSON.EventNID, senderNID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Database) PurgeRoom(ctx context.Context, roomID string, messages []outbox.Message) error {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil || roomInfo == nil {
+		return err
+	}
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		if err = d.PurgeTable.PurgeRoom(ctx, txn, roomInfo.RoomNID, roomID); err != nil {
+			return err
+		}
+		return d.storeOutboxMessages(ctx, txn, messages)
+	})
+	d.Cache.InvalidateRoomInfo(roomID)
+	return err
+}
+
+func (d *Database) GetKnownRooms(ctx context.Context) ([]string, error) {
+	return d.RoomsTable.SelectRoomIDs(ctx)
+}
+
+func (d *Database) StoreOutboxMessages(ctx context.Context, messages []outbox.Message) error {
+	return sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		return d.storeOutboxMessages(ctx, txn, messages)
+	})
+}
+
+func (d *Database) storeOutboxMessages(ctx context.Context, txn *sql.Tx, messages []outbox.Message) error {
+	for _, msg := range messages {
+		if err := d.OutboxTable.InsertMessage(ctx, txn, msg.Topic, msg.Key, msg.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) SelectOutboxMessages(ctx context.Context, limit int) ([]outbox.Message, error) {
+	return d.OutboxTable.SelectMessages(ctx, limit)
+}
+
+func (d *Database) DeleteOutboxMessages(ctx context.Context, ids []int64) error {
+	return d.OutboxTable.DeleteMessages(ctx, ids)
+}
+
 func (d *Database) assignRoomNID(
 	ctx context.Context, txn *sql.Tx,
 	roomID string, roomVersion gomatrixserverlib.RoomVersion,
@@ -581,10 +782,29 @@ func (d *Database) handleRedactions(
 	if err != nil {
 		return nil, "", err
 	}
+	// a redacted annotation no longer counts, so the sender is free to annotate again
+	err = d.AnnotationsTable.DeleteAnnotation(ctx, txn, redactedEvent.EventID())
+	if err != nil {
+		return nil, "", err
+	}
 
 	return &redactionEvent.Event, redactedEvent.EventID(), d.RedactionsTable.MarkRedactionValidated(ctx, txn, redactionEvent.EventID(), true)
 }
 
+// indexAnnotation remembers who annotated which event with which key, if the
+// event is an annotation.
+func (d *Database) indexAnnotation(ctx context.Context, txn *sql.Tx, event gomatrixserverlib.Event) error {
+	relatesTo := gjson.GetBytes(event.Content(), "m\\.relates_to")
+	if relatesTo.Get("rel_type").Str != "m.annotation" {
+		return nil
+	}
+	relatesToID, key := relatesTo.Get("event_id").Str, relatesTo.Get("key").Str
+	if relatesToID == "" || key == "" {
+		return nil
+	}
+	return d.AnnotationsTable.InsertAnnotation(ctx, txn, event.EventID(), relatesToID, event.Sender(), event.Type(), key)
+}
+
 // loadRedactionPair returns both the redaction event and the redacted event, else nil.
 func (d *Database) loadRedactionPair(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, event gomatrixserverlib.Event,
@@ -0,0 +1,133 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+const annotationsSchema = `
+-- Stores the annotations of events, e.g. reactions, so that users can be
+-- stopped from annotating an event with the same key more than once. Local
+-- annotations are claimed here before they are sent, and only the first of
+-- any duplicates received over federation is kept
+CREATE TABLE IF NOT EXISTS roomserver_annotations (
+    -- The ID of the annotation event
+    event_id TEXT NOT NULL PRIMARY KEY,
+    -- The ID of the event being annotated
+    relates_to_id TEXT NOT NULL,
+    sender TEXT NOT NULL,
+    -- The type of the annotation event, e.g. m.reaction
+    event_type TEXT NOT NULL,
+    -- The key of the annotation, e.g. an emoji
+    aggregation_key TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_annotations_key_idx ON roomserver_annotations(relates_to_id, sender, event_type, aggregation_key);
+`
+
+const insertAnnotationSQL = "" +
+	"INSERT INTO roomserver_annotations (event_id, relates_to_id, sender, event_type, aggregation_key)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT DO NOTHING"
+
+// Inserts the annotation unless the sender has already made as many as the
+// limit on the event. Duplicates are left out by the unique index.
+const insertAnnotationWithinLimitSQL = "" +
+	"INSERT INTO roomserver_annotations (event_id, relates_to_id, sender, event_type, aggregation_key)" +
+	" SELECT $1, $2, $3, $4, $5" +
+	" WHERE (SELECT COUNT(*) FROM roomserver_annotations WHERE relates_to_id = $2 AND sender = $3) < $6" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteAnnotationSQL = "" +
+	"DELETE FROM roomserver_annotations WHERE event_id = $1"
+
+const selectAnnotationsBySenderSQL = "" +
+	"SELECT event_id, event_type, aggregation_key FROM roomserver_annotations" +
+	" WHERE relates_to_id = $1 AND sender = $2"
+
+type annotationsStatements struct {
+	insertAnnotationStmt            *sql.Stmt
+	insertAnnotationWithinLimitStmt *sql.Stmt
+	deleteAnnotationStmt            *sql.Stmt
+	selectAnnotationsBySenderStmt   *sql.Stmt
+}
+
+func NewSqliteAnnotationsTable(db *sql.DB) (tables.Annotations, error) {
+	s := &annotationsStatements{}
+	_, err := db.Exec(annotationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertAnnotationStmt, insertAnnotationSQL},
+		{&s.insertAnnotationWithinLimitStmt, insertAnnotationWithinLimitSQL},
+		{&s.deleteAnnotationStmt, deleteAnnotationSQL},
+		{&s.selectAnnotationsBySenderStmt, selectAnnotationsBySenderSQL},
+	}.Prepare(db)
+}
+
+func (s *annotationsStatements) InsertAnnotation(
+	ctx context.Context, txn *sql.Tx, eventID, relatesToID, sender, eventType, key string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertAnnotationStmt).ExecContext(ctx, eventID, relatesToID, sender, eventType, key)
+	return err
+}
+
+func (s *annotationsStatements) InsertAnnotationWithinLimit(
+	ctx context.Context, txn *sql.Tx, eventID, relatesToID, sender, eventType, key string, limit int,
+) (bool, error) {
+	// SQLite only lets one transaction write at a time, so nothing can be
+	// inserted between counting the sender's annotations and the insert.
+	res, err := sqlutil.TxStmt(txn, s.insertAnnotationWithinLimitStmt).ExecContext(ctx, eventID, relatesToID, sender, eventType, key, limit)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *annotationsStatements) DeleteAnnotation(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteAnnotationStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *annotationsStatements) SelectAnnotationsBySender(
+	ctx context.Context, txn *sql.Tx, relatesToID, sender string,
+) ([]api.Annotation, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectAnnotationsBySenderStmt).QueryContext(ctx, relatesToID, sender)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAnnotationsBySenderStmt: rows.close() failed")
+
+	var annotations []api.Annotation
+	for rows.Next() {
+		var annotation api.Annotation
+		if err = rows.Scan(&annotation.EventID, &annotation.Type, &annotation.Key); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, annotation)
+	}
+	return annotations, rows.Err()
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func TestAnnotations(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(sqlutil.SQLiteDriverName(), "file::memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	table, err := NewSqliteAnnotationsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create annotations table: %s", err)
+	}
+	for _, a := range []struct{ eventID, relatesToID, sender, key string }{
+		{"$1", "$original", "@alice:localhost", "👍"},
+		{"$2", "$original", "@alice:localhost", "🎉"},
+		{"$3", "$original", "@bob:localhost", "👍"},
+		{"$4", "$other", "@alice:localhost", "👍"},
+		// inserting the same annotation event again is ignored
+		{"$1", "$original", "@alice:localhost", "👍"},
+	} {
+		if err = table.InsertAnnotation(ctx, nil, a.eventID, a.relatesToID, a.sender, "m.reaction", a.key); err != nil {
+			t.Fatalf("failed to insert annotation: %s", err)
+		}
+	}
+
+	annotations, err := table.SelectAnnotationsBySender(ctx, nil, "$original", "@alice:localhost")
+	if err != nil {
+		t.Fatalf("SelectAnnotationsBySender failed: %s", err)
+	}
+	if len(annotations) != 2 {
+		t.Fatalf("got annotations %+v, want 2", annotations)
+	}
+	for _, annotation := range annotations {
+		if annotation.Type != "m.reaction" || (annotation.EventID == "$1") != (annotation.Key == "👍") {
+			t.Errorf("got the wrong annotation %+v", annotation)
+		}
+	}
+
+	if err = table.DeleteAnnotation(ctx, nil, "$1"); err != nil {
+		t.Fatalf("DeleteAnnotation failed: %s", err)
+	}
+	annotations, err = table.SelectAnnotationsBySender(ctx, nil, "$original", "@alice:localhost")
+	if err != nil || len(annotations) != 1 || annotations[0].EventID != "$2" {
+		t.Errorf("got annotations %+v, %v after deleting one, want only $2", annotations, err)
+	}
+}
+
+func TestInsertAnnotationWithinLimit(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(sqlutil.SQLiteDriverName(), "file::memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	table, err := NewSqliteAnnotationsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create annotations table: %s", err)
+	}
+	for _, a := range []struct {
+		eventID, sender, key string
+		wantStored           bool
+	}{
+		{"$1", "@alice:localhost", "👍", true},
+		// the same key again is a duplicate
+		{"$2", "@alice:localhost", "👍", false},
+		{"$3", "@alice:localhost", "🎉", true},
+		// alice has reached the limit of two
+		{"$4", "@alice:localhost", "🚀", false},
+		// other senders have limits of their own
+		{"$5", "@bob:localhost", "🚀", true},
+	} {
+		stored, err := table.InsertAnnotationWithinLimit(ctx, nil, a.eventID, "$original", a.sender, "m.reaction", a.key, 2)
+		if err != nil {
+			t.Fatalf("InsertAnnotationWithinLimit failed: %s", err)
+		}
+		if stored != a.wantStored {
+			t.Errorf("annotation %s: got stored %v want %v", a.eventID, stored, a.wantStored)
+		}
+	}
+}
+
+func TestClaimAnnotation(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "annotations")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	d, err := Open("file:"+filepath.Join(dir, "roomserver.db"), nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	// Only one of the same annotations sent at once is claimed.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed, duplicates := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			duplicate, limitReached, err := d.ClaimAnnotation(ctx, fmt.Sprintf("$%d", i), "$original", "@alice:localhost", "m.reaction", "👍", 50)
+			if err != nil {
+				t.Errorf("ClaimAnnotation failed: %s", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if limitReached {
+				t.Errorf("ClaimAnnotation reached the limit")
+			}
+			if duplicate {
+				duplicates++
+			} else {
+				claimed++
+			}
+		}(i)
+	}
+	wg.Wait()
+	if claimed != 1 || duplicates != 9 {
+		t.Fatalf("got %d claimed and %d duplicates, want 1 and 9", claimed, duplicates)
+	}
+
+	// Claiming an annotation which is already known is fine, and the limit
+	// counts the annotations with other keys.
+	annotations, err := d.AnnotationsTable.SelectAnnotationsBySender(ctx, nil, "$original", "@alice:localhost")
+	if err != nil || len(annotations) != 1 {
+		t.Fatalf("got annotations %+v, %v, want one", annotations, err)
+	}
+	duplicate, limitReached, err := d.ClaimAnnotation(ctx, annotations[0].EventID, "$original", "@alice:localhost", "m.reaction", "👍", 1)
+	if err != nil || duplicate || limitReached {
+		t.Errorf("claiming a known annotation returned %v, %v, %v", duplicate, limitReached, err)
+	}
+	duplicate, limitReached, err = d.ClaimAnnotation(ctx, "$new", "$original", "@alice:localhost", "m.reaction", "🎉", 1)
+	if err != nil || duplicate || !limitReached {
+		t.Errorf("claiming an annotation over the limit returned %v, %v, %v", duplicate, limitReached, err)
+	}
+
+	// Releasing the claim lets the annotation be made again.
+	if err = d.ReleaseAnnotation(ctx, annotations[0].EventID); err != nil {
+		t.Fatalf("ReleaseAnnotation failed: %s", err)
+	}
+	duplicate, limitReached, err = d.ClaimAnnotation(ctx, "$again", "$original", "@alice:localhost", "m.reaction", "👍", 1)
+	if err != nil || duplicate || limitReached {
+		t.Errorf("claiming a released annotation returned %v, %v, %v", duplicate, limitReached, err)
+	}
+}
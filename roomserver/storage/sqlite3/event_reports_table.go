@@ -0,0 +1,155 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const eventReportsSchema = `
+-- Stores reports of events by users, for server administrators to review
+CREATE TABLE IF NOT EXISTS roomserver_event_reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- The reported event and the room it was sent in
+    room_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    -- The user who made the report
+    user_id TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    -- From -100 (most offensive) to 0 (inoffensive)
+    score INTEGER NOT NULL DEFAULT 0,
+    received_ts BIGINT NOT NULL,
+    -- Who resolved the report and when, or zero if it is outstanding
+    resolved_by TEXT NOT NULL DEFAULT '',
+    resolved_ts BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS roomserver_event_reports_room_id_idx ON roomserver_event_reports(room_id);
+`
+
+const insertEventReportSQL = "" +
+	"INSERT INTO roomserver_event_reports (room_id, event_id, user_id, reason, score, received_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectEventReportSQL = "" +
+	"SELECT id, room_id, event_id, user_id, reason, score, received_ts, resolved_by, resolved_ts" +
+	" FROM roomserver_event_reports WHERE id = $1"
+
+// An empty room ID matches reports in every room.
+const selectEventReportsSQL = "" +
+	"SELECT id, room_id, event_id, user_id, reason, score, received_ts, resolved_by, resolved_ts" +
+	" FROM roomserver_event_reports WHERE ($1 = '' OR room_id = $1) AND ($2 OR resolved_ts = 0)" +
+	" ORDER BY id DESC LIMIT $3 OFFSET $4"
+
+const selectEventReportCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_event_reports WHERE ($1 = '' OR room_id = $1) AND ($2 OR resolved_ts = 0)"
+
+const updateEventReportResolvedSQL = "" +
+	"UPDATE roomserver_event_reports SET resolved_by = $1, resolved_ts = $2 WHERE id = $3"
+
+type eventReportsStatements struct {
+	insertEventReportStmt         *sql.Stmt
+	selectEventReportStmt         *sql.Stmt
+	selectEventReportsStmt        *sql.Stmt
+	selectEventReportCountStmt    *sql.Stmt
+	updateEventReportResolvedStmt *sql.Stmt
+}
+
+func NewSqliteEventReportsTable(db *sql.DB) (tables.EventReports, error) {
+	s := &eventReportsStatements{}
+	_, err := db.Exec(eventReportsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertEventReportStmt, insertEventReportSQL},
+		{&s.selectEventReportStmt, selectEventReportSQL},
+		{&s.selectEventReportsStmt, selectEventReportsSQL},
+		{&s.selectEventReportCountStmt, selectEventReportCountSQL},
+		{&s.updateEventReportResolvedStmt, updateEventReportResolvedSQL},
+	}.Prepare(db)
+}
+
+func (s *eventReportsStatements) InsertEventReport(
+	ctx context.Context, report *api.EventReport,
+) (int64, error) {
+	res, err := s.insertEventReportStmt.ExecContext(
+		ctx, report.RoomID, report.EventID, report.UserID, report.Reason, report.Score, report.ReceivedTS,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *eventReportsStatements) SelectEventReport(
+	ctx context.Context, id int64,
+) (*api.EventReport, error) {
+	var report api.EventReport
+	err := s.selectEventReportStmt.QueryRowContext(ctx, id).Scan(
+		&report.ID, &report.RoomID, &report.EventID, &report.UserID, &report.Reason,
+		&report.Score, &report.ReceivedTS, &report.ResolvedBy, &report.ResolvedTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (s *eventReportsStatements) SelectEventReports(
+	ctx context.Context, roomID string, includeResolved bool, offset, limit int,
+) ([]api.EventReport, error) {
+	rows, err := s.selectEventReportsStmt.QueryContext(ctx, roomID, includeResolved, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventReportsStmt: rows.close() failed")
+
+	reports := []api.EventReport{}
+	for rows.Next() {
+		var report api.EventReport
+		if err = rows.Scan(
+			&report.ID, &report.RoomID, &report.EventID, &report.UserID, &report.Reason,
+			&report.Score, &report.ReceivedTS, &report.ResolvedBy, &report.ResolvedTS,
+		); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (s *eventReportsStatements) SelectEventReportCount(
+	ctx context.Context, roomID string, includeResolved bool,
+) (count int, err error) {
+	err = s.selectEventReportCountStmt.QueryRowContext(ctx, roomID, includeResolved).Scan(&count)
+	return
+}
+
+func (s *eventReportsStatements) UpdateEventReportResolved(
+	ctx context.Context, id int64, resolvedBy string, resolvedTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := s.updateEventReportResolvedStmt.ExecContext(ctx, resolvedBy, resolvedTS, id)
+	return err
+}
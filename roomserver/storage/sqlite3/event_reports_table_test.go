@@ -0,0 +1,100 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+func TestEventReports(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(sqlutil.SQLiteDriverName(), "file::memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	table, err := NewSqliteEventReportsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create event reports table: %s", err)
+	}
+	var ids []int64
+	for _, report := range []api.EventReport{
+		{RoomID: "!a:localhost", EventID: "$1", UserID: "@alice:localhost", Reason: "spam", Score: -100, ReceivedTS: 1000},
+		{RoomID: "!a:localhost", EventID: "$2", UserID: "@bob:localhost", ReceivedTS: 2000},
+		{RoomID: "!b:localhost", EventID: "$3", UserID: "@alice:localhost", Score: -50, ReceivedTS: 3000},
+	} {
+		report := report
+		id, err := table.InsertEventReport(ctx, &report)
+		if err != nil {
+			t.Fatalf("failed to insert report: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if err = table.UpdateEventReportResolved(ctx, ids[1], "@admin:localhost", 4000); err != nil {
+		t.Fatalf("failed to resolve report: %s", err)
+	}
+
+	report, err := table.SelectEventReport(ctx, ids[1])
+	if err != nil || report == nil {
+		t.Fatalf("SelectEventReport returned %+v, %v", report, err)
+	}
+	if report.EventID != "$2" || report.ResolvedBy != "@admin:localhost" || report.ResolvedTS != 4000 {
+		t.Errorf("SelectEventReport returned the wrong report: %+v", report)
+	}
+	if report, err = table.SelectEventReport(ctx, ids[2]+1); err != nil || report != nil {
+		t.Errorf("SelectEventReport returned %+v, %v for an unknown report", report, err)
+	}
+
+	tests := []struct {
+		roomID          string
+		includeResolved bool
+		offset, limit   int
+		wantEventIDs    []string
+		wantCount       int
+	}{
+		{"", false, 0, 10, []string{"$3", "$1"}, 2},
+		{"", true, 0, 10, []string{"$3", "$2", "$1"}, 3},
+		{"", true, 1, 1, []string{"$2"}, 3},
+		{"!a:localhost", false, 0, 10, []string{"$1"}, 1},
+		{"!a:localhost", true, 0, 10, []string{"$2", "$1"}, 2},
+	}
+	for _, tt := range tests {
+		reports, err := table.SelectEventReports(ctx, tt.roomID, tt.includeResolved, tt.offset, tt.limit)
+		if err != nil {
+			t.Fatalf("SelectEventReports failed: %s", err)
+		}
+		var eventIDs []string
+		for _, report := range reports {
+			eventIDs = append(eventIDs, report.EventID)
+		}
+		if len(eventIDs) != len(tt.wantEventIDs) {
+			t.Errorf("SelectEventReports(%q, %v, %d, %d) returned %v, want %v", tt.roomID, tt.includeResolved, tt.offset, tt.limit, eventIDs, tt.wantEventIDs)
+			continue
+		}
+		for i := range eventIDs {
+			if eventIDs[i] != tt.wantEventIDs[i] {
+				t.Errorf("SelectEventReports(%q, %v, %d, %d) returned %v, want %v", tt.roomID, tt.includeResolved, tt.offset, tt.limit, eventIDs, tt.wantEventIDs)
+				break
+			}
+		}
+		count, err := table.SelectEventReportCount(ctx, tt.roomID, tt.includeResolved)
+		if err != nil || count != tt.wantCount {
+			t.Errorf("SelectEventReportCount(%q, %v) returned %d, %v, want %d", tt.roomID, tt.includeResolved, count, err, tt.wantCount)
+		}
+	}
+}
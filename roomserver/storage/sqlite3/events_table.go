@@ -41,13 +41,15 @@ const eventsSchema = `
     depth INTEGER NOT NULL,
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
-    auth_event_nids TEXT NOT NULL DEFAULT '[]'
+    auth_event_nids TEXT NOT NULL DEFAULT '[]',
+    sender_nid INTEGER NOT NULL DEFAULT 0
   );
+  CREATE INDEX IF NOT EXISTS roomserver_events_sender_nid_idx ON roomserver_events (sender_nid, room_nid);
 `
 
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, sender_nid)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	  ON CONFLICT DO NOTHING;
 `
 
@@ -97,6 +99,17 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDForEventNIDSQL = "" +
 	"SELECT room_nid FROM roomserver_events WHERE event_nid = $1"
 
+const selectEventIDsBySenderSQL = "" +
+	"SELECT event_id FROM roomserver_events WHERE room_nid = $1 AND sender_nid = $2 AND event_state_key_nid = 0" +
+	" ORDER BY event_nid ASC"
+
+const selectEventNIDsWithoutSenderSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE sender_nid = 0 AND event_nid > $1" +
+	" ORDER BY event_nid ASC LIMIT $2"
+
+const updateEventSenderNIDSQL = "" +
+	"UPDATE roomserver_events SET sender_nid = $1 WHERE event_nid = $2"
+
 type eventStatements struct {
 	db                                     *sql.DB
 	insertEventStmt                        *sql.Stmt
@@ -112,12 +125,19 @@ type eventStatements struct {
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectRoomNIDForEventNIDStmt           *sql.Stmt
+	selectEventIDsBySenderStmt             *sql.Stmt
+	selectEventNIDsWithoutSenderStmt       *sql.Stmt
+	updateEventSenderNIDStmt               *sql.Stmt
 }
 
 func NewSqliteEventsTable(db *sql.DB) (tables.Events, error) {
 	s := &eventStatements{}
 	s.db = db
-	_, err := db.Exec(eventsSchema)
+	err := sqlutil.SQLiteAddColumn(db, "roomserver_events", "sender_nid", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(eventsSchema)
 	if err != nil {
 		return nil, err
 	}
@@ -136,6 +156,9 @@ func NewSqliteEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
+		{&s.selectEventIDsBySenderStmt, selectEventIDsBySenderSQL},
+		{&s.selectEventNIDsWithoutSenderStmt, selectEventNIDsWithoutSenderSQL},
+		{&s.updateEventSenderNIDStmt, updateEventSenderNIDSQL},
 	}.Prepare(db)
 }
 
@@ -149,12 +172,13 @@ func (s *eventStatements) InsertEvent(
 	referenceSHA256 []byte,
 	authEventNIDs []types.EventNID,
 	depth int64,
+	senderNID types.EventStateKeyNID,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	// attempt to insert: the last_row_id is the event NID
 	insertStmt := sqlutil.TxStmt(txn, s.insertEventStmt)
 	result, err := insertStmt.ExecContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, int64(senderNID),
 	)
 	if err != nil {
 		return 0, 0, err
@@ -477,6 +501,51 @@ func (s *eventStatements) SelectRoomNIDForEventNID(
 	return
 }
 
+func (s *eventStatements) SelectEventIDsBySender(
+	ctx context.Context, roomNID types.RoomNID, senderNID types.EventStateKeyNID,
+) ([]string, error) {
+	rows, err := s.selectEventIDsBySenderStmt.QueryContext(ctx, int64(roomNID), int64(senderNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectEventIDsBySender: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *eventStatements) SelectEventNIDsWithoutSender(
+	ctx context.Context, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectEventNIDsWithoutSenderStmt.QueryContext(ctx, int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectEventNIDsWithoutSender: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) UpdateEventSenderNID(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, senderNID types.EventStateKeyNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateEventSenderNIDStmt).ExecContext(ctx, int64(senderNID), int64(eventNID))
+	return err
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
@@ -0,0 +1,80 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// Databases created before senders were tracked get the sender_nid column
+// added, and filled in from the event JSON, when they are opened.
+func TestBackfillSenderNIDs(t *testing.T) {
+	ctx := context.Background()
+	dataSourceName := "file:" + filepath.Join(t.TempDir(), "roomserver.db")
+	cs, err := sqlutil.ParseFileURI(dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to parse data source name: %s", err)
+	}
+	db, err := sqlutil.Open(sqlutil.SQLiteDriverName(), cs, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	_, err = db.Exec(`
+	  CREATE TABLE roomserver_events (
+	    event_nid INTEGER PRIMARY KEY AUTOINCREMENT,
+	    room_nid INTEGER NOT NULL,
+	    event_type_nid INTEGER NOT NULL,
+	    event_state_key_nid INTEGER NOT NULL,
+	    sent_to_output BOOLEAN NOT NULL DEFAULT FALSE,
+	    state_snapshot_nid INTEGER NOT NULL DEFAULT 0,
+	    depth INTEGER NOT NULL,
+	    event_id TEXT NOT NULL UNIQUE,
+	    reference_sha256 BLOB NOT NULL,
+	    auth_event_nids TEXT NOT NULL DEFAULT '[]'
+	  );
+	  INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, depth, event_id, reference_sha256)
+	    VALUES (1, 5, 0, 1, '$message:localhost', ''), (1, 5, 0, 2, '$missing:localhost', '');
+	`)
+	if err != nil {
+		t.Fatalf("failed to create the old events table: %s", err)
+	}
+	eventJSON, err := NewSqliteEventJSONTable(db)
+	if err != nil {
+		t.Fatalf("failed to create event JSON table: %s", err)
+	}
+	// The second event has no JSON, which mustn't stop the backfill.
+	if err = eventJSON.InsertEventJSON(ctx, nil, 1, []byte(`{"sender":"@alice:localhost"}`)); err != nil {
+		t.Fatalf("failed to insert event JSON: %s", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err)
+	}
+
+	d, err := Open(dataSourceName, nil)
+	if err != nil {
+		t.Fatalf("failed to open the old database: %s", err)
+	}
+	eventIDs, err := d.GetEventIDsBySender(ctx, 1, "@alice:localhost")
+	if err != nil {
+		t.Fatalf("GetEventIDsBySender failed: %s", err)
+	}
+	if len(eventIDs) != 1 || eventIDs[0] != "$message:localhost" {
+		t.Fatalf("got event IDs %v, want [$message:localhost]", eventIDs)
+	}
+}
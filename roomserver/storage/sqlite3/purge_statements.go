@@ -0,0 +1,184 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The state block NIDs are stored as JSON, so the blocks are deleted one at
+// a time.
+const selectStateBlockNIDsForRoomSQL = "" +
+	"SELECT state_block_nids FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeStateBlockSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = $1"
+
+const purgeStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid IN (" +
+	" SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgePreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id IN (" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeRedactionsSQL = "" +
+	"DELETE FROM roomserver_redactions WHERE redaction_event_id IN (" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeAnnotationsSQL = "" +
+	"DELETE FROM roomserver_annotations WHERE event_id IN (" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeTransactionsSQL = "" +
+	"DELETE FROM roomserver_transactions WHERE event_id IN (" +
+	" SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
+const purgeEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE room_nid = $1"
+
+const purgeRoomSQL = "" +
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
+
+const purgePublishedSQL = "" +
+	"DELETE FROM roomserver_published WHERE room_id = $1"
+
+const purgeRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
+
+const purgeEventReportsSQL = "" +
+	"DELETE FROM roomserver_event_reports WHERE room_id = $1"
+
+type purgeStatements struct {
+	selectStateBlockNIDsStmt *sql.Stmt
+	purgeStateBlockStmt      *sql.Stmt
+	purgeStateSnapshotsStmt  *sql.Stmt
+	purgeEventJSONStmt       *sql.Stmt
+	purgePreviousEventsStmt  *sql.Stmt
+	purgeRedactionsStmt      *sql.Stmt
+	purgeAnnotationsStmt     *sql.Stmt
+	purgeTransactionsStmt    *sql.Stmt
+	purgeInvitesStmt         *sql.Stmt
+	purgeMembershipsStmt     *sql.Stmt
+	purgeEventsStmt          *sql.Stmt
+	purgeRoomStmt            *sql.Stmt
+	purgePublishedStmt       *sql.Stmt
+	purgeRoomAliasesStmt     *sql.Stmt
+	purgeEventReportsStmt    *sql.Stmt
+}
+
+func NewSqlitePurgeStatements(db *sql.DB) (tables.Purge, error) {
+	s := &purgeStatements{}
+	return s, shared.StatementList{
+		{&s.selectStateBlockNIDsStmt, selectStateBlockNIDsForRoomSQL},
+		{&s.purgeStateBlockStmt, purgeStateBlockSQL},
+		{&s.purgeStateSnapshotsStmt, purgeStateSnapshotsSQL},
+		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
+		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
+		{&s.purgeRedactionsStmt, purgeRedactionsSQL},
+		{&s.purgeAnnotationsStmt, purgeAnnotationsSQL},
+		{&s.purgeTransactionsStmt, purgeTransactionsSQL},
+		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.purgeRoomStmt, purgeRoomSQL},
+		{&s.purgePublishedStmt, purgePublishedSQL},
+		{&s.purgeRoomAliasesStmt, purgeRoomAliasesSQL},
+		{&s.purgeEventReportsStmt, purgeEventReportsSQL},
+	}.Prepare(db)
+}
+
+func (s *purgeStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
+) error {
+	if err := s.purgeStateBlocks(ctx, txn, roomNID); err != nil {
+		return err
+	}
+	// The rows which refer to the room's events and state snapshots have to
+	// go before the events and snapshots themselves.
+	for _, stmt := range []*sql.Stmt{
+		s.purgeStateSnapshotsStmt, s.purgeEventJSONStmt,
+		s.purgePreviousEventsStmt, s.purgeRedactionsStmt, s.purgeAnnotationsStmt,
+		s.purgeTransactionsStmt, s.purgeInvitesStmt, s.purgeMembershipsStmt,
+		s.purgeEventsStmt, s.purgeRoomStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, int64(roomNID)); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range []*sql.Stmt{
+		s.purgePublishedStmt, s.purgeRoomAliasesStmt, s.purgeEventReportsStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *purgeStatements) purgeStateBlocks(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	rows, err := sqlutil.TxStmt(txn, s.selectStateBlockNIDsStmt).QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "purgeStateBlocks: rows.close() failed")
+	stateBlockNIDs := map[types.StateBlockNID]struct{}{}
+	for rows.Next() {
+		var stateBlockNIDsJSON string
+		if err = rows.Scan(&stateBlockNIDsJSON); err != nil {
+			return err
+		}
+		var nids []types.StateBlockNID
+		if err = json.Unmarshal([]byte(stateBlockNIDsJSON), &nids); err != nil {
+			return err
+		}
+		for _, nid := range nids {
+			stateBlockNIDs[nid] = struct{}{}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for nid := range stateBlockNIDs {
+		if _, err = sqlutil.TxStmt(txn, s.purgeStateBlockStmt).ExecContext(ctx, int64(nid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
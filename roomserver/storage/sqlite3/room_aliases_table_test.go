@@ -0,0 +1,54 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func TestSelectAliasIgnoringCase(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlutil.Open(sqlutil.SQLiteDriverName(), "file::memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	table, err := NewSqliteRoomAliasesTable(db)
+	if err != nil {
+		t.Fatalf("failed to create room aliases table: %s", err)
+	}
+	if err = table.InsertRoomAlias(ctx, "#Dendrite:localhost", "!room:localhost", "@alice:localhost"); err != nil {
+		t.Fatalf("failed to insert alias: %s", err)
+	}
+
+	for _, alias := range []string{"#Dendrite:localhost", "#dendrite:localhost", "#DENDRITE:LOCALHOST"} {
+		stored, err := table.SelectAliasIgnoringCase(ctx, alias)
+		if err != nil {
+			t.Fatalf("SelectAliasIgnoringCase(%q) failed: %s", alias, err)
+		}
+		if stored != "#Dendrite:localhost" {
+			t.Errorf("SelectAliasIgnoringCase(%q) returned %q, want %q", alias, stored, "#Dendrite:localhost")
+		}
+	}
+	if stored, err := table.SelectAliasIgnoringCase(ctx, "#other:localhost"); err != nil || stored != "" {
+		t.Errorf("SelectAliasIgnoringCase returned %q, %v for an unknown alias", stored, err)
+	}
+	// Lookups by the exact alias are still case-sensitive.
+	if roomID, err := table.SelectRoomIDFromAlias(ctx, "#dendrite:localhost"); err != nil || roomID != "" {
+		t.Errorf("SelectRoomIDFromAlias returned %q, %v for a differently cased alias", roomID, err)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
@@ -44,7 +45,7 @@ type Database struct {
 
 // Open a sqlite database.
 // nolint: gocyclo
-func Open(dataSourceName string) (*Database, error) {
+func Open(dataSourceName string, cache caching.RoomInfoCache) (*Database, error) {
 	var d Database
 	cs, err := sqlutil.ParseFileURI(dataSourceName)
 	if err != nil {
@@ -114,10 +115,26 @@ func Open(dataSourceName string) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	outboxTable, err := NewSqliteOutboxTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	redactions, err := NewSqliteRedactionsTable(d.db)
 	if err != nil {
 		return nil, err
 	}
+	eventReports, err := NewSqliteEventReportsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := NewSqliteAnnotationsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	purge, err := NewSqlitePurgeStatements(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		EventsTable:         d.events,
@@ -134,12 +151,20 @@ func Open(dataSourceName string) (*Database, error) {
 		MembershipTable:     d.membership,
 		PublishedTable:      published,
 		RedactionsTable:     redactions,
+		OutboxTable:         outboxTable,
+		EventReportsTable:   eventReports,
+		AnnotationsTable:    annotations,
+		PurgeTable:          purge,
+		Cache:               cache,
+	}
+	if err = d.Database.BackfillSenderNIDs(context.Background()); err != nil {
+		return nil, err
 	}
 	return &d, nil
 }
 
 func (d *Database) GetLatestEventsForUpdate(
-	ctx context.Context, roomNID types.RoomNID,
+	ctx context.Context, roomID string, roomNID types.RoomNID,
 ) (types.RoomRecentEventsUpdater, error) {
 	// TODO: Do not use transactions. We should be holding open this transaction but we cannot have
 	// multiple write transactions on sqlite. The code will perform additional
@@ -147,7 +172,7 @@ func (d *Database) GetLatestEventsForUpdate(
 	// 'database is locked' errors. As sqlite doesn't support multi-process on the
 	// same DB anyway, and we only execute updates sequentially, the only worries
 	// are for rolling back when things go wrong. (atomicity)
-	return shared.NewRoomRecentEventsUpdater(&d.Database, ctx, roomNID, false)
+	return shared.NewRoomRecentEventsUpdater(&d.Database, ctx, roomID, roomNID, false)
 }
 
 func (d *Database) MembershipUpdater(
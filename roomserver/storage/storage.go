@@ -19,23 +19,25 @@ package storage
 import (
 	"net/url"
 
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
 	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
 )
 
-// Open opens a database connection.
-func Open(dataSourceName string, dbProperties sqlutil.DbProperties) (Database, error) {
+// Open opens a database connection. The room directory is read from the
+// replica if one is given, which must be a postgres database.
+func Open(dataSourceName, replicaDataSourceName string, dbProperties sqlutil.DbProperties, cache caching.RoomInfoCache) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgres.Open(dataSourceName, dbProperties)
+		return postgres.Open(dataSourceName, replicaDataSourceName, dbProperties, cache)
 	}
 	switch uri.Scheme {
 	case "postgres":
-		return postgres.Open(dataSourceName, dbProperties)
+		return postgres.Open(dataSourceName, replicaDataSourceName, dbProperties, cache)
 	case "file":
-		return sqlite3.Open(dataSourceName)
+		return sqlite3.Open(dataSourceName, cache)
 	default:
-		return postgres.Open(dataSourceName, dbProperties)
+		return postgres.Open(dataSourceName, replicaDataSourceName, dbProperties, cache)
 	}
 }
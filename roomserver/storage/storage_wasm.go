@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"net/url"
 
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
 )
@@ -25,7 +26,9 @@ import (
 // NewPublicRoomsServerDatabase opens a database connection.
 func Open(
 	dataSourceName string,
+	replicaDataSourceName string, // nolint:unparam
 	dbProperties sqlutil.DbProperties, // nolint:unparam
+	cache caching.RoomInfoCache,
 ) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
@@ -35,7 +38,7 @@ func Open(
 	case "postgres":
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	case "file":
-		return sqlite3.Open(dataSourceName)
+		return sqlite3.Open(dataSourceName, cache)
 	default:
 		return nil, fmt.Errorf("Cannot use postgres implementation")
 	}
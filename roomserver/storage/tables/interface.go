@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal/outbox"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -33,7 +35,7 @@ type EventStateKeys interface {
 }
 
 type Events interface {
-	InsertEvent(c context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, eventID string, referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64) (types.EventNID, types.StateSnapshotNID, error)
+	InsertEvent(c context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, eventID string, referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, senderNID types.EventStateKeyNID) (types.EventNID, types.StateSnapshotNID, error)
 	SelectEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, types.StateSnapshotNID, error)
 	// bulkSelectStateEventByID lookups a list of state events by event ID.
 	// If any of the requested events are missing from the database it returns a types.MissingEventError
@@ -55,6 +57,13 @@ type Events interface {
 	BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDForEventNID(ctx context.Context, eventNID types.EventNID) (roomNID types.RoomNID, err error)
+	// SelectEventIDsBySender returns the IDs of the events which aren't state
+	// events that the given sender has sent in the given room, oldest first.
+	SelectEventIDsBySender(ctx context.Context, roomNID types.RoomNID, senderNID types.EventStateKeyNID) ([]string, error)
+	// SelectEventNIDsWithoutSender returns up to limit numeric IDs of events after
+	// the given one which were stored before senders were tracked, oldest first.
+	SelectEventNIDsWithoutSender(ctx context.Context, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	UpdateEventSenderNID(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, senderNID types.EventStateKeyNID) error
 }
 
 type Rooms interface {
@@ -65,6 +74,10 @@ type Rooms interface {
 	UpdateLatestEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID, lastEventSentNID types.EventNID, stateSnapshotNID types.StateSnapshotNID) error
 	SelectRoomVersionForRoomID(ctx context.Context, txn *sql.Tx, roomID string) (gomatrixserverlib.RoomVersion, error)
 	SelectRoomVersionForRoomNID(ctx context.Context, roomNID types.RoomNID) (gomatrixserverlib.RoomVersion, error)
+	// SelectRoomInfo returns the metadata for the given room, or nil if the room is not known.
+	SelectRoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error)
+	// SelectRoomIDs returns the IDs of all rooms which have events, i.e. excluding stubs.
+	SelectRoomIDs(ctx context.Context) ([]string, error)
 }
 
 type Transactions interface {
@@ -86,6 +99,7 @@ type StateBlock interface {
 type RoomAliases interface {
 	InsertRoomAlias(ctx context.Context, alias string, roomID string, creatorUserID string) (err error)
 	SelectRoomIDFromAlias(ctx context.Context, alias string) (roomID string, err error)
+	SelectAliasIgnoringCase(ctx context.Context, alias string) (storedAlias string, err error)
 	SelectAliasesFromRoomID(ctx context.Context, roomID string) ([]string, error)
 	SelectCreatorIDFromAlias(ctx context.Context, alias string) (creatorID string, err error)
 	DeleteRoomAlias(ctx context.Context, alias string) (err error)
@@ -111,6 +125,7 @@ const (
 	MembershipStateLeaveOrBan MembershipState = 1
 	MembershipStateInvite     MembershipState = 2
 	MembershipStateJoin       MembershipState = 3
+	MembershipStateKnock      MembershipState = 4
 )
 
 type Membership interface {
@@ -147,3 +162,39 @@ type Redactions interface {
 	// successfully redacted the event JSON.
 	MarkRedactionValidated(ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool) error
 }
+
+type Purge interface {
+	// PurgeRoom deletes everything which is stored about a room, apart from
+	// the event types and state keys, which are shared between rooms.
+	PurgeRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string) error
+}
+
+type EventReports interface {
+	// InsertEventReport stores a new report, ignoring its ID and resolution, and returns the ID it was given.
+	InsertEventReport(ctx context.Context, report *api.EventReport) (int64, error)
+	// SelectEventReport returns the report with the given ID, or nil if there is no such report.
+	SelectEventReport(ctx context.Context, id int64) (*api.EventReport, error)
+	// SelectEventReports returns reports newest first, optionally only those in the given room.
+	SelectEventReports(ctx context.Context, roomID string, includeResolved bool, offset, limit int) ([]api.EventReport, error)
+	SelectEventReportCount(ctx context.Context, roomID string, includeResolved bool) (int, error)
+	UpdateEventReportResolved(ctx context.Context, id int64, resolvedBy string, resolvedTS gomatrixserverlib.Timestamp) error
+}
+
+type Annotations interface {
+	// InsertAnnotation stores an annotation, doing nothing if the annotation event is already known or
+	// the sender has already annotated the event with the same key.
+	InsertAnnotation(ctx context.Context, txn *sql.Tx, eventID, relatesToID, sender, eventType, key string) error
+	// InsertAnnotationWithinLimit stores an annotation in the same way as InsertAnnotation, unless the
+	// sender has already made limit annotations on the event. Returns whether it was stored.
+	InsertAnnotationWithinLimit(ctx context.Context, txn *sql.Tx, eventID, relatesToID, sender, eventType, key string, limit int) (bool, error)
+	DeleteAnnotation(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectAnnotationsBySender returns the annotations which the sender has made on the given event.
+	SelectAnnotationsBySender(ctx context.Context, txn *sql.Tx, relatesToID, sender string) ([]api.Annotation, error)
+}
+
+type Outbox interface {
+	InsertMessage(ctx context.Context, txn *sql.Tx, topic, key string, value []byte) error
+	// SelectMessages returns up to limit messages, oldest first.
+	SelectMessages(ctx context.Context, limit int) ([]outbox.Message, error)
+	DeleteMessages(ctx context.Context, ids []int64) error
+}
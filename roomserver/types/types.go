@@ -16,6 +16,7 @@
 package types
 
 import (
+	"github.com/matrix-org/dendrite/internal/outbox"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -173,6 +174,8 @@ type RoomRecentEventsUpdater interface {
 	// Build a membership updater for the target user in this room.
 	// It will share the same transaction as this updater.
 	MembershipUpdater(targetUserNID EventStateKeyNID, isTargetLocalUser bool) (MembershipUpdater, error)
+	// Store output events in the outbox, to be produced once the transaction is committed.
+	StoreOutboxMessages(messages []outbox.Message) error
 	// Implements Transaction so it can be committed or rolledback
 	sqlutil.Transaction
 }
@@ -180,15 +183,17 @@ type RoomRecentEventsUpdater interface {
 // A MembershipUpdater is used to update the membership of a user in a room.
 // (On postgresql this wraps a database transaction that holds a "FOR UPDATE"
 //  lock on the row in the membership table for this user in the room)
-// The caller should call one of SetToInvite, SetToJoin or SetToLeave once to
+// The caller should call one of SetToInvite, SetToJoin, SetToLeave or SetToKnock once to
 // make the update, or none of them if no update is required.
 type MembershipUpdater interface {
 	// True if the target user is invited to the room before updating.
 	IsInvite() bool
 	// True if the target user is joined to the room before updating.
 	IsJoin() bool
-	// True if the target user is not invited or joined to the room before updating.
+	// True if the target user is not invited, joined or knocking on the room before updating.
 	IsLeave() bool
+	// True if the target user has knocked on the room before updating.
+	IsKnock() bool
 	// Set the state to invite.
 	// Returns whether this invite needs to be sent
 	SetToInvite(event gomatrixserverlib.Event) (needsSending bool, err error)
@@ -198,6 +203,11 @@ type MembershipUpdater interface {
 	// Set the state to leave.
 	// Returns a list of invite event IDs that this state change retired.
 	SetToLeave(senderUserID string, eventID string) (inviteEventIDs []string, err error)
+	// Set the state to knock.
+	// Returns whether this knock needs to be sent
+	SetToKnock(event gomatrixserverlib.Event) (needsSending bool, err error)
+	// Store output events in the outbox, to be produced once the transaction is committed.
+	StoreOutboxMessages(messages []outbox.Message) error
 	// Implements Transaction so it can be committed or rolledback.
 	sqlutil.Transaction
 }
@@ -207,3 +217,14 @@ type MembershipUpdater interface {
 type MissingEventError string
 
 func (e MissingEventError) Error() string { return string(e) }
+
+// RoomInfo contains metadata about a room which is needed by almost every
+// input and query operation.
+type RoomInfo struct {
+	RoomNID          RoomNID
+	RoomVersion      gomatrixserverlib.RoomVersion
+	StateSnapshotNID StateSnapshotNID
+	// True if the server hasn't joined the room yet, i.e. the room has no
+	// latest events, only events which were stored as part of its state.
+	IsStub bool
+}
@@ -26,6 +26,27 @@ func DefaultRoomVersion() gomatrixserverlib.RoomVersion {
 	return gomatrixserverlib.RoomVersionV5
 }
 
+// RoomVersionKnock is the unstable room version proposed by MSC2403,
+// which is room version 6 with auth rules that let users knock on rooms.
+const RoomVersionKnock gomatrixserverlib.RoomVersion = "xyz.amorgan.knock"
+
+// EnableKnocking makes RoomVersionKnock a supported, unstable room
+// version, as gomatrixserverlib doesn't know about it yet. It must be
+// called before any events are handled, since the known room versions
+// can't be changed safely while they are in use.
+func EnableKnocking() {
+	versions := gomatrixserverlib.RoomVersions()
+	knock := versions[gomatrixserverlib.RoomVersionV6]
+	knock.Stable = false
+	versions[RoomVersionKnock] = knock
+}
+
+// AllowsKnocking returns whether the auth rules of the given room
+// version let users knock on rooms.
+func AllowsKnocking(version gomatrixserverlib.RoomVersion) bool {
+	return version == RoomVersionKnock
+}
+
 // RoomVersions returns a map of all known room versions to this
 // server.
 func RoomVersions() map[gomatrixserverlib.RoomVersion]gomatrixserverlib.RoomVersionDescription {
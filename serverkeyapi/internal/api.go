@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"fmt"
@@ -21,6 +22,9 @@ type ServerKeyAPI struct {
 
 	OurKeyRing gomatrixserverlib.KeyRing
 	FedClient  *gomatrixserverlib.FederationClient
+
+	// The only keys which are accepted for specific remote servers.
+	PinnedKeys map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey
 }
 
 func (s *ServerKeyAPI) KeyRing() *gomatrixserverlib.KeyRing {
@@ -153,6 +157,11 @@ func (s *ServerKeyAPI) handleDatabaseKeys(
 
 	// We successfully got some keys. Add them to the results.
 	for req, res := range dbResults {
+		// The key might have been stored before it was pinned.
+		if !s.isPinnedKey(req, res, s.OurKeyRing.KeyDatabase) {
+			continue
+		}
+
 		// The key we've retrieved from the database/cache might
 		// have passed its validity period, but right now, it's
 		// the best thing we've got, and it might be sufficient to
@@ -201,6 +210,12 @@ func (s *ServerKeyAPI) handleFetcherKeys(
 
 	// Now let's look at the results that we got from this fetcher.
 	for req, res := range fetcherResults {
+		// Don't use or store keys which contradict the pinned keys. The
+		// request is left outstanding so that other fetchers can try.
+		if !s.isPinnedKey(req, res, fetcher) {
+			continue
+		}
+
 		if prev, ok := results[req]; ok {
 			// We've already got a previous entry for this request
 			// so let's see if the newly retrieved one contains a more
@@ -248,3 +263,27 @@ func (s *ServerKeyAPI) handleFetcherKeys(
 
 	return nil
 }
+
+// isPinnedKey returns whether the given key is allowed by the pinned keys.
+// Any key is allowed for servers that don't have pinned keys. Otherwise a
+// key which doesn't match is rejected, since it means that the source of
+// the key has been compromised or is being spoofed.
+func (s *ServerKeyAPI) isPinnedKey(
+	req gomatrixserverlib.PublicKeyLookupRequest,
+	res gomatrixserverlib.PublicKeyLookupResult,
+	source gomatrixserverlib.KeyFetcher,
+) bool {
+	pinned, ok := s.PinnedKeys[req.ServerName]
+	if !ok {
+		return true
+	}
+	if key, ok := pinned[req.KeyID]; ok && bytes.Equal(key, res.Key) {
+		return true
+	}
+	logrus.WithFields(logrus.Fields{
+		"server_name":  req.ServerName,
+		"key_id":       req.KeyID,
+		"fetcher_name": source.FetcherName(),
+	}).Error("Rejecting server key which doesn't match the pinned keys for the server")
+	return false
+}
@@ -92,5 +92,28 @@ func NewInternalAPI(
 		}).Info("Enabled perspective key fetcher")
 	}
 
+	// The pinned keys have already been validated when loading the config.
+	internalAPI.PinnedKeys = map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey{}
+	for _, ps := range cfg.Matrix.PinnedServerKeys {
+		if _, ok := internalAPI.PinnedKeys[ps.ServerName]; !ok {
+			internalAPI.PinnedKeys[ps.ServerName] = map[gomatrixserverlib.KeyID]ed25519.PublicKey{}
+		}
+		for _, key := range ps.Keys {
+			rawkey, err := b64e.DecodeString(key.PublicKey)
+			if err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"server_name": ps.ServerName,
+					"public_key":  key.PublicKey,
+				}).Panic("Couldn't parse pinned server key")
+			}
+			internalAPI.PinnedKeys[ps.ServerName][key.KeyID] = rawkey
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"server_name":     ps.ServerName,
+			"num_public_keys": len(ps.Keys),
+		}).Info("Pinned server keys")
+	}
+
 	return &internalAPI
 }
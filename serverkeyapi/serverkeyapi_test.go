@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -18,6 +19,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/serverkeyapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	yaml "gopkg.in/yaml.v2"
 )
 
 type server struct {
@@ -313,3 +315,57 @@ func TestRenewalBehaviour(t *testing.T) {
 	}
 	t.Log(res)
 }
+
+func TestPinnedServerKeys(t *testing.T) {
+	// A server which pins server C's key should only accept the key
+	// that server C really has.
+
+	req := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: serverC.name,
+		KeyID:      serverKeyID,
+	}
+	realKey := serverC.config.Matrix.PrivateKey.Public().(ed25519.PublicKey)
+	wrongKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("can't generate key: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		pinnedKey ed25519.PublicKey
+		wantErr   bool
+	}{
+		{"wrong key", wrongKey, true},
+		{"right key", realKey, false},
+	} {
+		cache, err := caching.NewInMemoryLRUCache(false)
+		if err != nil {
+			t.Fatalf("can't create cache: %s", err)
+		}
+		cfg := *serverA.config
+		pinned := fmt.Sprintf(
+			`[{server_name: %s, keys: [{key_id: "%s", public_key: "%s"}]}]`,
+			serverC.name, serverKeyID, base64.RawStdEncoding.EncodeToString(tc.pinnedKey),
+		)
+		if err = yaml.Unmarshal([]byte(pinned), &cfg.Matrix.PinnedServerKeys); err != nil {
+			t.Fatalf("can't parse pinned keys: %s", err)
+		}
+		pinningAPI := NewInternalAPI(&cfg, serverA.fedclient, cache)
+
+		_, err = pinningAPI.FetchKeys(
+			context.Background(),
+			map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+				req: gomatrixserverlib.AsTimestamp(time.Now()),
+			},
+		)
+		if tc.wantErr && err == nil {
+			t.Errorf("%s: expected server C's key to be rejected", tc.name)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("%s: expected server C's key to be accepted, got %s", tc.name, err)
+		}
+		if _, ok := cache.GetServerKey(req, gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Minute*90))); ok == tc.wantErr {
+			t.Errorf("%s: got cached %v for server C's key, want %v", tc.name, ok, !tc.wantErr)
+		}
+	}
+}
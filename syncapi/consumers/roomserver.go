@@ -17,24 +17,48 @@ package consumers
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/dendrite/syncapi/push"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 )
 
 // OutputRoomEventConsumer consumes events that originated in the room server.
 type OutputRoomEventConsumer struct {
+	cfg        *config.Dendrite
 	rsAPI      api.RoomserverInternalAPI
+	userAPI    userapi.UserInternalAPI
 	rsConsumer *internal.ContinualConsumer
 	db         storage.Database
 	notifier   *sync.Notifier
+	pushSender *push.Sender
+	pushRules  caching.PushRulesCache
+	backoff    func(attempt int) time.Duration
+}
+
+const (
+	initialPurgeBackoff = time.Second * 5
+	maxPurgeBackoff     = time.Minute * 10
+)
+
+func purgeBackoff(attempt int) time.Duration {
+	backoff := initialPurgeBackoff << uint(attempt-1)
+	if backoff > maxPurgeBackoff || backoff <= 0 {
+		return maxPurgeBackoff
+	}
+	return backoff
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -44,6 +68,8 @@ func NewOutputRoomEventConsumer(
 	n *sync.Notifier,
 	store storage.Database,
 	rsAPI api.RoomserverInternalAPI,
+	userAPI userapi.UserInternalAPI,
+	pushRules caching.PushRulesCache,
 ) *OutputRoomEventConsumer {
 
 	consumer := internal.ContinualConsumer{
@@ -52,10 +78,15 @@ func NewOutputRoomEventConsumer(
 		PartitionStore: store,
 	}
 	s := &OutputRoomEventConsumer{
+		cfg:        cfg,
 		rsConsumer: &consumer,
 		db:         store,
 		notifier:   n,
 		rsAPI:      rsAPI,
+		userAPI:    userAPI,
+		pushSender: push.NewSender(store, userAPI),
+		pushRules:  pushRules,
+		backoff:    purgeBackoff,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -92,12 +123,22 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 			}
 		}
 		return s.onNewRoomEvent(context.TODO(), *output.NewRoomEvent)
+	case api.OutputTypeOldRoomEvent:
+		return s.onOldRoomEvent(context.TODO(), *output.OldRoomEvent)
 	case api.OutputTypeNewInviteEvent:
 		return s.onNewInviteEvent(context.TODO(), *output.NewInviteEvent)
 	case api.OutputTypeRetireInviteEvent:
 		return s.onRetireInviteEvent(context.TODO(), *output.RetireInviteEvent)
+	case api.OutputTypeNewKnockEvent:
+		return s.onNewKnockEvent(context.TODO(), *output.NewKnockEvent)
 	case api.OutputTypeRedactedEvent:
 		return s.onRedactEvent(context.TODO(), *output.RedactedEvent)
+	case api.OutputTypeNewPeek:
+		return s.onNewPeek(context.TODO(), *output.NewPeek)
+	case api.OutputTypeRetirePeek:
+		return s.onRetirePeek(context.TODO(), *output.RetirePeek)
+	case api.OutputTypePurgeRoom:
+		return s.onPurgeRoom(context.TODO(), *output.PurgeRoom)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -158,8 +199,72 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		}).Panicf("roomserver output log: write event failure")
 		return nil
 	}
-	s.notifier.OnNewEvent(&ev, "", nil, types.NewStreamToken(pduPos, 0))
 
+	peekPos, err := s.updatePeeks(ctx, &ev)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"event_id":   ev.EventID(),
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: failed to update peeks")
+		return nil
+	}
+	if peekPos > pduPos {
+		pduPos = peekPos
+	}
+
+	knockPos, err := s.retireKnocks(ctx, &ev)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"event_id":   ev.EventID(),
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: failed to retire knocks")
+		return nil
+	}
+	if knockPos > pduPos {
+		pduPos = knockPos
+	}
+
+	notifPos, err := s.updateNotificationCounts(ctx, &ev)
+	if err != nil {
+		// The event has already been stored, so don't hold up the stream
+		// just because we couldn't work out the notification counts.
+		log.WithError(err).WithField("event_id", ev.EventID()).Error(
+			"roomserver output log: failed to update notification counts",
+		)
+	}
+	s.notifier.OnNewEvent(&ev, "", nil, types.StreamingToken{
+		PDUPosition:     pduPos,
+		ReceiptPosition: notifPos,
+	})
+
+	return nil
+}
+
+// onOldRoomEvent stores an event from the past of the room in the same way as
+// events fetched through backfill, so that it appears in /messages but isn't
+// sent to clients as a new message in /sync.
+func (s *OutputRoomEventConsumer) onOldRoomEvent(
+	ctx context.Context, msg api.OutputOldRoomEvent,
+) error {
+	ev := msg.Event
+	_, err := s.db.WriteEvent(
+		ctx,
+		&ev,
+		[]gomatrixserverlib.HeaderedEvent{},
+		[]string{},
+		[]string{},
+		nil, true,
+	)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"event":      string(ev.JSON()),
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: write old event failure")
+		return nil
+	}
 	return nil
 }
 
@@ -176,7 +281,34 @@ func (s *OutputRoomEventConsumer) onNewInviteEvent(
 		}).Panicf("roomserver output log: write invite failure")
 		return nil
 	}
-	s.notifier.OnNewEvent(&msg.Event, "", nil, types.NewStreamToken(pduPos, 0))
+	if pduPos == 0 {
+		// we've already seen this invite
+		return nil
+	}
+	s.notifier.OnNewEvent(&msg.Event, "", nil, types.StreamingToken{PDUPosition: pduPos})
+	return nil
+}
+
+func (s *OutputRoomEventConsumer) onNewKnockEvent(
+	ctx context.Context, msg api.OutputNewKnockEvent,
+) error {
+	pduPos, err := s.db.AddInviteEvent(ctx, msg.Event)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"event":      string(msg.Event.JSON()),
+			"pdupos":     pduPos,
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: write knock failure")
+		return nil
+	}
+	if pduPos == 0 {
+		// we've already seen this knock
+		return nil
+	}
+	// The knock may be for a room which we aren't in, so wake up the user
+	// who knocked directly rather than through the room.
+	s.notifier.OnNewEvent(nil, "", []string{*msg.Event.StateKey()}, types.StreamingToken{PDUPosition: pduPos})
 	return nil
 }
 
@@ -192,12 +324,131 @@ func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 		}).Panicf("roomserver output log: remove invite failure")
 		return nil
 	}
+	if sp == 0 {
+		// the invite was never stored or has already been retired
+		return nil
+	}
 	// Notify any active sync requests that the invite has been retired.
-	// Invites share the same stream counter as PDUs
-	s.notifier.OnNewEvent(nil, "", []string{msg.TargetUserID}, types.NewStreamToken(sp, 0))
+	// Invites are part of the same stream as PDUs
+	s.notifier.OnNewEvent(nil, "", []string{msg.TargetUserID}, types.StreamingToken{PDUPosition: sp})
 	return nil
 }
 
+func (s *OutputRoomEventConsumer) onNewPeek(
+	ctx context.Context, msg api.OutputNewPeek,
+) error {
+	sp, err := s.db.AddPeek(ctx, msg.RoomID, msg.UserID, msg.DeviceID)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: write peek failure")
+		return nil
+	}
+	// Peeks are part of the same stream as PDUs
+	s.notifier.OnNewPeek(msg.RoomID, msg.UserID, msg.DeviceID, types.StreamingToken{PDUPosition: sp})
+	return nil
+}
+
+func (s *OutputRoomEventConsumer) onRetirePeek(
+	ctx context.Context, msg api.OutputRetirePeek,
+) error {
+	sp, err := s.db.DeletePeek(ctx, msg.RoomID, msg.UserID, msg.DeviceID)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: remove peek failure")
+		return nil
+	}
+	if sp == 0 {
+		// The device wasn't peeking into the room, so there is nothing to
+		// tell it about.
+		return nil
+	}
+	s.notifier.OnRetirePeek(msg.RoomID, msg.UserID, msg.DeviceID, types.StreamingToken{PDUPosition: sp})
+	return nil
+}
+
+// onPurgeRoom deletes a room which the roomserver has purged. The local
+// members were made to leave it first, and their leave events are kept, so
+// only the invited users and the peeking devices need waking up. A failed
+// purge is retried, as skipping it would leave the room behind for good.
+func (s *OutputRoomEventConsumer) onPurgeRoom(
+	ctx context.Context, msg api.OutputPurgeRoom,
+) error {
+	var pduPos types.StreamPosition
+	var invitees []string
+	for attempt := 1; ; attempt++ {
+		sp, retired, err := s.db.PurgeRoom(ctx, msg.RoomID)
+		if sp > pduPos {
+			pduPos = sp
+		}
+		invitees = append(invitees, retired...)
+		if err == nil {
+			break
+		}
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Warn("roomserver output log: purge room failure, will retry")
+		time.Sleep(s.backoff(attempt))
+	}
+	s.notifier.OnPurgeRoom(msg.RoomID, invitees, types.StreamingToken{PDUPosition: pduPos})
+	return nil
+}
+
+// updatePeeks stops peeks which are no longer valid after the given event:
+// users who join a room stop peeking into it, and nobody can peek into a room
+// which is no longer world-readable. Returns the stream position of the
+// change, or 0 if no peeks were affected.
+func (s *OutputRoomEventConsumer) updatePeeks(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent,
+) (types.StreamPosition, error) {
+	if ev.StateKey() == nil {
+		return 0, nil
+	}
+	switch ev.Type() {
+	case gomatrixserverlib.MRoomMember:
+		membership, err := ev.Membership()
+		if err != nil || membership != gomatrixserverlib.Join {
+			return 0, nil
+		}
+		return s.db.DeletePeeks(ctx, ev.RoomID(), *ev.StateKey())
+	case gomatrixserverlib.MRoomHistoryVisibility:
+		if *ev.StateKey() != "" {
+			return 0, nil
+		}
+		if auth.HistoryVisibilityForRoom([]gomatrixserverlib.Event{ev.Event}) == "world_readable" {
+			return 0, nil
+		}
+		return s.db.DeleteRoomPeeks(ctx, ev.RoomID())
+	}
+	return 0, nil
+}
+
+// retireKnocks retires the knock of a local user once they join, leave or
+// are banned from the room. Knocks which are followed by an invite don't need
+// retiring, as only the newest invite or knock for a room is sent to clients.
+func (s *OutputRoomEventConsumer) retireKnocks(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent,
+) (types.StreamPosition, error) {
+	if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+		return 0, nil
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+	if err != nil || domain != s.cfg.Matrix.ServerName {
+		return 0, nil
+	}
+	switch membership, _ := ev.Membership(); membership {
+	case gomatrixserverlib.Join, gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+		return s.db.RetireInviteEventsForUser(ctx, ev.RoomID(), *ev.StateKey())
+	}
+	return 0, nil
+}
+
 func (s *OutputRoomEventConsumer) updateStateEvent(event gomatrixserverlib.HeaderedEvent) (gomatrixserverlib.HeaderedEvent, error) {
 	if event.StateKey() == nil {
 		return event, nil
@@ -224,3 +475,178 @@ func (s *OutputRoomEventConsumer) updateStateEvent(event gomatrixserverlib.Heade
 	event.Event, err = event.SetUnsigned(prev)
 	return event, err
 }
+
+// updateNotificationCounts evaluates the push rules of every local user joined
+// to the room of the given event, and increments their unread notification
+// counts if the event should notify them, sending the notification on to
+// their push gateways. Returns the highest stream position
+// of the updated counts, or 0 if no counts were updated.
+func (s *OutputRoomEventConsumer) updateNotificationCounts(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent,
+) (types.StreamPosition, error) {
+	stateFilter := gomatrixserverlib.StateFilter{
+		Types: []string{gomatrixserverlib.MRoomMember},
+	}
+	stateEvents, err := s.db.GetStateEventsForRoom(ctx, ev.RoomID(), &stateFilter)
+	if err != nil {
+		return 0, err
+	}
+
+	// Work out who is joined to the room, remembering the member event content
+	// for local users so that we know their display names.
+	localMembers := make(map[string]gomatrixserverlib.MemberContent)
+	memberCount := 0
+	for _, stateEvent := range stateEvents {
+		if stateEvent.Type() != gomatrixserverlib.MRoomMember || stateEvent.StateKey() == nil {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(stateEvent.Content(), &content); err != nil {
+			continue
+		}
+		if content.Membership != gomatrixserverlib.Join {
+			continue
+		}
+		memberCount++
+		userID := *stateEvent.StateKey()
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != s.cfg.Matrix.ServerName || userID == ev.Sender() {
+			continue
+		}
+		localMembers[userID] = content
+	}
+	if len(localMembers) == 0 {
+		return 0, nil
+	}
+
+	var powerLevels *gomatrixserverlib.PowerLevelContent
+
+	var maxPos types.StreamPosition
+	for userID, content := range localMembers {
+		ruleSet, err := s.pushRulesForUser(ctx, userID)
+		if err != nil {
+			return maxPos, err
+		}
+		ec := &pushEvaluationContext{
+			displayName: content.DisplayName,
+			memberCount: memberCount,
+			powerLevels: func() (*gomatrixserverlib.PowerLevelContent, error) {
+				if powerLevels == nil {
+					pl, err := s.powerLevelsForRoom(ctx, ev.RoomID())
+					if err != nil {
+						return nil, err
+					}
+					powerLevels = pl
+				}
+				return powerLevels, nil
+			},
+		}
+		rule, err := pushrules.NewRuleSetEvaluator(ec, ruleSet).MatchEvent(&ev.Event)
+		if err != nil {
+			return maxPos, err
+		}
+		if rule == nil {
+			continue
+		}
+		kind, tweaks, err := pushrules.ActionsToTweaks(rule.Actions)
+		if err != nil {
+			return maxPos, err
+		}
+		if kind != pushrules.NotifyAction && kind != pushrules.CoalesceAction {
+			continue
+		}
+		highlights := 0
+		if pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false) {
+			highlights = 1
+		}
+		pos, err := s.db.IncrementNotificationCounts(ctx, userID, ev.RoomID(), 1, highlights)
+		if err != nil {
+			return maxPos, err
+		}
+		if pos > maxPos {
+			maxPos = pos
+		}
+		if err = s.pushSender.Notify(ctx, userID, ev, tweaks); err != nil {
+			// The counts are still right even if the push gateways don't
+			// hear about the event.
+			log.WithError(err).WithFields(log.Fields{
+				"event_id": ev.EventID(),
+				"user_id":  userID,
+			}).Error("roomserver output log: failed to send push notifications")
+		}
+	}
+	return maxPos, nil
+}
+
+// pushRulesForUser returns the global push rules for the given local user,
+// merged with the server-default rules. They are cached until the client data
+// consumer hears that the user's m.push_rules account data has changed, so
+// that the user API isn't asked for them for every event.
+func (s *OutputRoomEventConsumer) pushRulesForUser(
+	ctx context.Context, userID string,
+) (*pushrules.RuleSet, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.pushRules.GetOrLoadPushRules(userID, func() (*pushrules.RuleSet, error) {
+		req := userapi.QueryAccountDataRequest{
+			UserID:   userID,
+			DataType: "m.push_rules",
+		}
+		res := userapi.QueryAccountDataResponse{}
+		if err := s.userAPI.QueryAccountData(ctx, &req, &res); err != nil {
+			return nil, err
+		}
+		ruleSets, err := pushrules.AccountRuleSetsFromAccountData(
+			res.GlobalAccountData["m.push_rules"], localpart, s.cfg.Matrix.ServerName,
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &ruleSets.Global, nil
+	})
+}
+
+func (s *OutputRoomEventConsumer) powerLevelsForRoom(
+	ctx context.Context, roomID string,
+) (*gomatrixserverlib.PowerLevelContent, error) {
+	plEvent, err := s.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomPowerLevels, "")
+	if err != nil {
+		return nil, err
+	}
+	if plEvent == nil {
+		var pl gomatrixserverlib.PowerLevelContent
+		pl.Defaults()
+		return &pl, nil
+	}
+	pl, err := gomatrixserverlib.NewPowerLevelContentFromEvent(plEvent.Event)
+	if err != nil {
+		return nil, err
+	}
+	return &pl, nil
+}
+
+// pushEvaluationContext implements pushrules.EvaluationContext for a single
+// user in the room of the event being evaluated.
+type pushEvaluationContext struct {
+	displayName string
+	memberCount int
+	powerLevels func() (*gomatrixserverlib.PowerLevelContent, error)
+}
+
+func (c *pushEvaluationContext) UserDisplayName() string {
+	return c.displayName
+}
+
+func (c *pushEvaluationContext) RoomMemberCount() (int, error) {
+	return c.memberCount, nil
+}
+
+func (c *pushEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	pl, err := c.powerLevels()
+	if err != nil {
+		return false, err
+	}
+	return pl.UserLevel(userID) >= pl.NotificationLevel(levelKey), nil
+}
@@ -0,0 +1,302 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package push sends notifications of events to the push gateways of the
+// pushers which local users have set up.
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long to wait for a push gateway to respond.
+	notifyTimeout = time.Second * 30
+	// How long to wait before retrying a failed notification. This doubles
+	// after each failure, up to the maximum.
+	initialBackoff = time.Second * 5
+	maxBackoff     = time.Minute * 10
+	// How many times to try sending a notification before giving up on it.
+	maxAttempts = 10
+	// How many notifications can be waiting for a push gateway. The oldest
+	// are dropped after that, since they aren't of much use to anyone once
+	// they are that far out of date.
+	maxQueuedNotifications = 1000
+)
+
+// Sender sends notifications to push gateways. Each push gateway has its
+// own queue, so that one which is slow or unavailable doesn't hold up the
+// notifications for the others.
+type Sender struct {
+	db          storage.Database
+	userAPI     userapi.UserInternalAPI
+	client      *pushgateway.Client
+	backoff     func(attempt int) time.Duration
+	queues      map[string]*gatewayQueue // push gateway URL -> queue
+	queuesMutex sync.Mutex
+}
+
+// NewSender creates a new push notification sender.
+func NewSender(db storage.Database, userAPI userapi.UserInternalAPI) *Sender {
+	return &Sender{
+		db:      db,
+		userAPI: userAPI,
+		client:  pushgateway.NewClient(notifyTimeout),
+		backoff: exponentialBackoff,
+		queues:  make(map[string]*gatewayQueue),
+	}
+}
+
+func exponentialBackoff(attempt int) time.Duration {
+	backoff := initialBackoff << uint(attempt-1)
+	if backoff > maxBackoff || backoff <= 0 {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// Notify queues a notification of the event for each of the HTTP pushers
+// of the given local user, using the tweaks of the push rule which matched
+// the event. The event must already be stored, and the notification counts
+// of the user updated.
+func (s *Sender) Notify(
+	ctx context.Context, userID string, ev *gomatrixserverlib.HeaderedEvent, tweaks map[string]interface{},
+) error {
+	pushersReq := userapi.QueryPushersRequest{
+		UserID: userID,
+	}
+	pushersRes := userapi.QueryPushersResponse{}
+	if err := s.userAPI.QueryPushers(ctx, &pushersReq, &pushersRes); err != nil {
+		return err
+	}
+
+	// The notification is only built once we know that the user has
+	// somewhere to send it.
+	var full *pushgateway.Notification
+	for _, pusher := range pushersRes.Pushers {
+		url, _ := pusher.Data["url"].(string)
+		if pusher.Kind != userapi.HTTPKind || url == "" {
+			continue
+		}
+		if full == nil {
+			unread, err := s.db.UnreadNotificationCount(ctx, userID)
+			if err != nil {
+				return err
+			}
+			if full, err = s.notificationForEvent(ctx, userID, ev, tweaks); err != nil {
+				return err
+			}
+			full.Counts = &pushgateway.Counts{Unread: unread}
+		}
+
+		// The event ID only format leaves it to the client to fetch the
+		// event, so that the push gateway never sees what's in it. The
+		// priority is still needed to decide how to wake the device.
+		n := *full
+		if format, _ := pusher.Data["format"].(string); format == "event_id_only" {
+			n = pushgateway.Notification{
+				EventID: full.EventID,
+				RoomID:  full.RoomID,
+				Prio:    full.Prio,
+				Counts:  full.Counts,
+			}
+		}
+		data := make(map[string]interface{}, len(pusher.Data))
+		for k, v := range pusher.Data {
+			if k != "url" {
+				data[k] = v
+			}
+		}
+		n.Devices = []*pushgateway.Device{{
+			AppID:   pusher.AppID,
+			PushKey: pusher.PushKey,
+			Data:    data,
+			Tweaks:  tweaks,
+		}}
+		s.queueFor(url).push(&queuedNotification{
+			userID:  userID,
+			request: &pushgateway.NotifyRequest{Notification: n},
+		})
+	}
+	return nil
+}
+
+// notificationForEvent builds the full notification of an event, without
+// the devices or counts.
+func (s *Sender) notificationForEvent(
+	ctx context.Context, userID string, ev *gomatrixserverlib.HeaderedEvent, tweaks map[string]interface{},
+) (*pushgateway.Notification, error) {
+	n := &pushgateway.Notification{
+		EventID:      ev.EventID(),
+		RoomID:       ev.RoomID(),
+		Type:         ev.Type(),
+		Sender:       ev.Sender(),
+		UserIsTarget: ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(userID),
+		Prio:         pushgateway.LowPrio,
+		Content:      ev.Content(),
+	}
+	if pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false) || tweaks[string(pushrules.SoundTweak)] != nil {
+		n.Prio = pushgateway.HighPrio
+	}
+
+	var name struct {
+		Name  string `json:"name"`
+		Alias string `json:"alias"`
+	}
+	var member gomatrixserverlib.MemberContent
+	for _, state := range []struct {
+		evType, stateKey string
+		content          interface{}
+	}{
+		{gomatrixserverlib.MRoomName, "", &name},
+		{gomatrixserverlib.MRoomCanonicalAlias, "", &name},
+		{gomatrixserverlib.MRoomMember, ev.Sender(), &member},
+	} {
+		stateEvent, err := s.db.GetStateEvent(ctx, ev.RoomID(), state.evType, state.stateKey)
+		if err != nil {
+			return nil, err
+		}
+		if stateEvent == nil {
+			continue
+		}
+		// Badly formed state just leaves the notification without a name.
+		_ = json.Unmarshal(stateEvent.Content(), state.content)
+	}
+	n.RoomName, n.RoomAlias, n.SenderDisplayName = name.Name, name.Alias, member.DisplayName
+	return n, nil
+}
+
+// queueFor returns the queue for the push gateway at the given URL, creating
+// it if there isn't one yet.
+func (s *Sender) queueFor(url string) *gatewayQueue {
+	s.queuesMutex.Lock()
+	defer s.queuesMutex.Unlock()
+	q, ok := s.queues[url]
+	if !ok {
+		q = &gatewayQueue{sender: s, url: url}
+		s.queues[url] = q
+	}
+	return q
+}
+
+type queuedNotification struct {
+	userID  string
+	request *pushgateway.NotifyRequest
+}
+
+// gatewayQueue sends notifications to a single push gateway in the order
+// that they were queued. A goroutine runs while there are notifications
+// waiting to be sent.
+type gatewayQueue struct {
+	sender  *Sender
+	url     string
+	mutex   sync.Mutex
+	pending []*queuedNotification
+	running bool
+}
+
+func (q *gatewayQueue) push(n *queuedNotification) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.pending) >= maxQueuedNotifications {
+		log.WithField("url", q.url).Warn("Too many notifications waiting for push gateway, dropping the oldest")
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, n)
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *gatewayQueue) run() {
+	for {
+		q.mutex.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mutex.Unlock()
+			return
+		}
+		n := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mutex.Unlock()
+
+		q.send(n)
+	}
+}
+
+// send sends a notification, retrying for as long as the push gateway might
+// still accept it.
+func (q *gatewayQueue) send(n *queuedNotification) {
+	logger := log.WithFields(log.Fields{
+		"url":      q.url,
+		"event_id": n.request.Notification.EventID,
+	})
+	for attempt := 1; ; attempt++ {
+		var res pushgateway.NotifyResponse
+		err := q.sender.client.Notify(context.Background(), q.url, n.request, &res)
+		if err == nil {
+			q.removeRejectedPushers(n, res.Rejected)
+			return
+		}
+		var httpErr *pushgateway.HTTPError
+		if errors.As(err, &httpErr) && !httpErr.Temporary() {
+			logger.WithError(err).Warn("Push gateway refused notification")
+			return
+		}
+		if attempt == maxAttempts {
+			logger.WithError(err).Error("Failed to send notification to push gateway, giving up")
+			return
+		}
+		logger.WithError(err).Warn("Failed to send notification to push gateway, will retry")
+		time.Sleep(q.sender.backoff(attempt))
+	}
+}
+
+// removeRejectedPushers removes the pushers which the push gateway doesn't
+// accept notifications for anymore, e.g. because the app was uninstalled.
+func (q *gatewayQueue) removeRejectedPushers(n *queuedNotification, rejected []string) {
+	for _, pushKey := range rejected {
+		for _, device := range n.request.Notification.Devices {
+			if device.PushKey != pushKey {
+				continue
+			}
+			req := userapi.PerformPusherDeletionRequest{
+				UserID:  n.userID,
+				AppID:   device.AppID,
+				PushKey: device.PushKey,
+			}
+			res := userapi.PerformPusherDeletionResponse{}
+			if err := q.sender.userAPI.PerformPusherDeletion(context.Background(), &req, &res); err != nil {
+				log.WithError(err).WithField("url", q.url).Error("Failed to remove rejected pusher")
+				continue
+			}
+			log.WithFields(log.Fields{
+				"url":    q.url,
+				"app_id": device.AppID,
+			}).Info("Removed pusher rejected by push gateway")
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeDatabase struct {
+	storage.Database
+	state map[string]*gomatrixserverlib.HeaderedEvent // event type -> state event
+}
+
+func (d *fakeDatabase) UnreadNotificationCount(ctx context.Context, userID string) (int, error) {
+	return 3, nil
+}
+
+func (d *fakeDatabase) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	return d.state[evType], nil
+}
+
+type fakeUserAPI struct {
+	userapi.UserInternalAPI
+	pushers []userapi.Pusher
+	mu      sync.Mutex
+	deleted []userapi.PerformPusherDeletionRequest
+}
+
+func (u *fakeUserAPI) QueryPushers(ctx context.Context, req *userapi.QueryPushersRequest, res *userapi.QueryPushersResponse) error {
+	res.Pushers = u.pushers
+	return nil
+}
+
+func (u *fakeUserAPI) PerformPusherDeletion(ctx context.Context, req *userapi.PerformPusherDeletionRequest, res *userapi.PerformPusherDeletionResponse) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.deleted = append(u.deleted, *req)
+	return nil
+}
+
+// fakeGateway is a push gateway which responds to each notification with
+// the next of the given responses, repeating the last one once they run out.
+type fakeGateway struct {
+	*httptest.Server
+	notifications chan pushgateway.Notification
+}
+
+func newFakeGateway(t *testing.T, responses ...func(w http.ResponseWriter)) *fakeGateway {
+	g := &fakeGateway{notifications: make(chan pushgateway.Notification, 100)}
+	var mu sync.Mutex
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req pushgateway.NotifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("push gateway got a bad request: %s", err)
+		}
+		mu.Lock()
+		respond := responses[0]
+		if len(responses) > 1 {
+			responses = responses[1:]
+		}
+		mu.Unlock()
+		respond(w)
+		g.notifications <- req.Notification
+	}))
+	return g
+}
+
+func (g *fakeGateway) next(t *testing.T) pushgateway.Notification {
+	t.Helper()
+	select {
+	case n := <-g.notifications:
+		return n
+	case <-time.After(time.Second * 5):
+		t.Fatalf("push gateway didn't get a notification")
+		return pushgateway.Notification{}
+	}
+}
+
+func (g *fakeGateway) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case n := <-g.notifications:
+		t.Fatalf("push gateway got an unexpected notification: %+v", n)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func respondWith(code int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func mustHeaderedEvent(t *testing.T, eventJSON string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON failed: %s", err)
+	}
+	h := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	return &h
+}
+
+func newTestSender(t *testing.T, gatewayURL string, pushers ...userapi.Pusher) (*Sender, *fakeUserAPI) {
+	for i := range pushers {
+		pushers[i].Kind = userapi.HTTPKind
+		if pushers[i].Data == nil {
+			pushers[i].Data = map[string]interface{}{}
+		}
+		pushers[i].Data["url"] = gatewayURL + pushgateway.NotifyPath
+	}
+	userAPI := &fakeUserAPI{pushers: pushers}
+	db := &fakeDatabase{state: map[string]*gomatrixserverlib.HeaderedEvent{
+		gomatrixserverlib.MRoomName: mustHeaderedEvent(t, `{"event_id":"$name:localhost","room_id":"!room:localhost","sender":"@bob:localhost","type":"m.room.name","state_key":"","content":{"name":"Lounge"}}`),
+	}}
+	s := NewSender(db, userAPI)
+	s.backoff = func(attempt int) time.Duration { return time.Millisecond }
+	return s, userAPI
+}
+
+const testEventJSON = `{"event_id":"$event:localhost","room_id":"!room:localhost","sender":"@bob:localhost","type":"m.room.message","content":{"body":"hello"}}`
+
+func TestNotify(t *testing.T) {
+	g := newFakeGateway(t, respondWith(http.StatusOK, `{"rejected":[]}`))
+	defer g.Close()
+	s, _ := newTestSender(t, g.URL,
+		userapi.Pusher{AppID: "full", PushKey: "key1", Data: map[string]interface{}{"extra": "x"}},
+		userapi.Pusher{AppID: "short", PushKey: "key2", Data: map[string]interface{}{"format": "event_id_only"}},
+	)
+	tweaks := map[string]interface{}{string(pushrules.HighlightTweak): true}
+	if err := s.Notify(context.Background(), "@alice:localhost", mustHeaderedEvent(t, testEventJSON), tweaks); err != nil {
+		t.Fatalf("Notify failed: %s", err)
+	}
+
+	// Notifications for the same push gateway are sent in order.
+	full := g.next(t)
+	if full.EventID != "$event:localhost" || full.RoomName != "Lounge" || full.Sender != "@bob:localhost" ||
+		full.Prio != pushgateway.HighPrio || full.Counts == nil || full.Counts.Unread != 3 || len(full.Content) == 0 {
+		t.Errorf("wrong full notification: %+v", full)
+	}
+	if len(full.Devices) != 1 || full.Devices[0].PushKey != "key1" || full.Devices[0].Data["url"] != nil || full.Devices[0].Data["extra"] != "x" {
+		t.Errorf("wrong devices in full notification: %+v", full.Devices)
+	}
+	short := g.next(t)
+	if short.EventID != "$event:localhost" || short.Prio != pushgateway.HighPrio || short.Counts == nil ||
+		short.RoomName != "" || short.Sender != "" || len(short.Content) != 0 {
+		t.Errorf("wrong event ID only notification: %+v", short)
+	}
+	if len(short.Devices) != 1 || short.Devices[0].PushKey != "key2" {
+		t.Errorf("wrong devices in event ID only notification: %+v", short.Devices)
+	}
+}
+
+func TestNotifyIgnoresOtherPushers(t *testing.T) {
+	g := newFakeGateway(t, respondWith(http.StatusOK, `{"rejected":[]}`))
+	defer g.Close()
+	s, userAPI := newTestSender(t, g.URL, userapi.Pusher{AppID: "app", PushKey: "key"})
+	userAPI.pushers = append(userAPI.pushers, userapi.Pusher{
+		AppID: "mail", PushKey: "alice@example.com", Kind: userapi.EmailKind,
+	})
+	if err := s.Notify(context.Background(), "@alice:localhost", mustHeaderedEvent(t, testEventJSON), nil); err != nil {
+		t.Fatalf("Notify failed: %s", err)
+	}
+	if n := g.next(t); n.Devices[0].AppID != "app" || n.Prio != pushgateway.LowPrio {
+		t.Errorf("wrong notification: %+v", n)
+	}
+	g.expectNothing(t)
+}
+
+func TestNotifyRetries(t *testing.T) {
+	testCases := []struct {
+		name      string
+		responses []func(w http.ResponseWriter)
+		wantSends int
+	}{
+		{
+			name:      "temporary failure is retried",
+			responses: []func(w http.ResponseWriter){respondWith(http.StatusBadGateway, ""), respondWith(http.StatusTooManyRequests, ""), respondWith(http.StatusOK, `{}`)},
+			wantSends: 3,
+		},
+		{
+			name:      "refused notification isn't retried",
+			responses: []func(w http.ResponseWriter){respondWith(http.StatusBadRequest, "")},
+			wantSends: 1,
+		},
+		{
+			name:      "accepted notification with a bad response isn't retried",
+			responses: []func(w http.ResponseWriter){respondWith(http.StatusOK, "not JSON")},
+			wantSends: 1,
+		},
+		{
+			name:      "gives up after the maximum attempts",
+			responses: []func(w http.ResponseWriter){respondWith(http.StatusServiceUnavailable, "")},
+			wantSends: maxAttempts,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newFakeGateway(t, tc.responses...)
+			defer g.Close()
+			s, _ := newTestSender(t, g.URL, userapi.Pusher{AppID: "app", PushKey: "key"})
+			if err := s.Notify(context.Background(), "@alice:localhost", mustHeaderedEvent(t, testEventJSON), nil); err != nil {
+				t.Fatalf("Notify failed: %s", err)
+			}
+			for i := 0; i < tc.wantSends; i++ {
+				g.next(t)
+			}
+			g.expectNothing(t)
+		})
+	}
+}
+
+func TestNotifyRemovesRejectedPushers(t *testing.T) {
+	g := newFakeGateway(t, respondWith(http.StatusOK, `{"rejected":["old"]}`), respondWith(http.StatusOK, `{"rejected":[]}`))
+	defer g.Close()
+	s, userAPI := newTestSender(t, g.URL,
+		userapi.Pusher{AppID: "app", PushKey: "old"},
+		userapi.Pusher{AppID: "app", PushKey: "new"},
+	)
+	if err := s.Notify(context.Background(), "@alice:localhost", mustHeaderedEvent(t, testEventJSON), nil); err != nil {
+		t.Fatalf("Notify failed: %s", err)
+	}
+	g.next(t)
+	g.next(t)
+
+	// The pusher is removed before the next notification is sent.
+	userAPI.mu.Lock()
+	defer userAPI.mu.Unlock()
+	want := userapi.PerformPusherDeletionRequest{UserID: "@alice:localhost", AppID: "app", PushKey: "old"}
+	if len(userAPI.deleted) != 1 || userAPI.deleted[0] != want {
+		t.Errorf("got deleted pushers %+v, want %+v", userAPI.deleted, want)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	if got := exponentialBackoff(1); got != initialBackoff {
+		t.Errorf("first backoff: got %s want %s", got, initialBackoff)
+	}
+	if got := exponentialBackoff(2); got != initialBackoff*2 {
+		t.Errorf("second backoff: got %s want %s", got, initialBackoff*2)
+	}
+	for _, attempt := range []int{10, 64, 100} {
+		if got := exponentialBackoff(attempt); got != maxBackoff {
+			t.Errorf("backoff after %d attempts: got %s want %s", attempt, got, maxBackoff)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// runRetention removes old data from the sync API database each time the
+// retention interval passes. It never returns.
+func runRetention(db storage.Database, retention config.SyncRetention) {
+	ticker := time.NewTicker(retention.Interval)
+	for range ticker.C {
+		applyRetention(context.Background(), db, retention)
+	}
+}
+
+// applyRetention removes the events and send-to-device messages which are
+// beyond the limits of the retention policy.
+func applyRetention(ctx context.Context, db storage.Database, retention config.SyncRetention) {
+	if retention.MaxEventAge > 0 || retention.MaxEventsPerRoom > 0 {
+		var olderThan gomatrixserverlib.Timestamp
+		if retention.MaxEventAge > 0 {
+			olderThan = gomatrixserverlib.AsTimestamp(time.Now().Add(-retention.MaxEventAge))
+		}
+		purged, err := db.PurgeOldEvents(ctx, olderThan, retention.MaxEventsPerRoom)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to purge old events")
+		} else if purged > 0 {
+			logrus.WithField("events", purged).Info("Purged old events")
+		}
+	}
+	if retention.MaxSendToDeviceMessagesPerDevice > 0 {
+		purged, err := db.PurgeSendToDeviceMessages(ctx, retention.MaxSendToDeviceMessagesPerDevice)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to purge old send-to-device messages")
+		} else if purged > 0 {
+			logrus.WithField("messages", purged).Info("Purged old send-to-device messages")
+		}
+	}
+}
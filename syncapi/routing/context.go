@@ -0,0 +1,194 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// defaultContextLimit is the number of events returned around the event
+	// when the request doesn't specify a limit.
+	defaultContextLimit = 10
+	// maxContextLimit is the most events we'll return around the event.
+	maxContextLimit = 100
+)
+
+type contextResponse struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	State        []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+// GetContext implements GET /rooms/{roomID}/context/{eventID}. The limit is
+// split between the events before and after the event, as the spec asks,
+// and the aggregations of their relations are bundled the same way as for
+// /messages. The start and end tokens can be given to /messages to carry on
+// paginating from either end.
+// See: https://matrix.org/docs/spec/client_server/latest#get-matrix-client-r0-rooms-roomid-context-eventid
+func GetContext(
+	req *http.Request, device *userapi.Device, syncDB storage.Database,
+	rsAPI api.RoomserverInternalAPI, roomID, eventID string,
+) util.JSONResponse {
+	limit := defaultContextLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid limit parameter"),
+			}
+		}
+	}
+	if limit > maxContextLimit {
+		limit = maxContextLimit
+	}
+
+	ctx := req.Context()
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+	if events, err = filterHistoryVisible(ctx, rsAPI, device.UserID, events); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("filterHistoryVisible failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't allowed to see this event"),
+		}
+	}
+	event := events[0]
+
+	res, err := getContextEvents(ctx, syncDB, rsAPI, device.UserID, event, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("getContextEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// getContextEvents fetches the events either side of the given event, along
+// with the state of the room after the last of them.
+func getContextEvents(
+	ctx context.Context, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	userID string, event gomatrixserverlib.HeaderedEvent, limit int,
+) (*contextResponse, error) {
+	roomID := event.RoomID()
+	pos, err := syncDB.EventPositionInTopology(ctx, event.EventID())
+	if err != nil {
+		return nil, fmt.Errorf("EventPositionInTopology: %w", err)
+	}
+
+	// The topological range is exclusive of its lower bound and inclusive of
+	// its upper bound, so the event itself is left out of both sides by
+	// stopping just short of it going backwards and starting from it going
+	// forwards. Tokens share their positions when copied, so this one is
+	// made afresh.
+	beforePos := types.NewTopologyToken(pos.Depth(), pos.PDUPosition())
+	beforePos.Decrement()
+	startPos := types.NewTopologyToken(0, 0)
+	before, err := syncDB.GetEventsInTopologicalRange(ctx, &beforePos, &startPos, roomID, limit/2, true)
+	if err != nil {
+		return nil, fmt.Errorf("GetEventsInTopologicalRange: %w", err)
+	}
+	endPos, err := syncDB.MaxTopologicalPosition(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("MaxTopologicalPosition: %w", err)
+	}
+	after, err := syncDB.GetEventsInTopologicalRange(ctx, &pos, &endPos, roomID, limit-limit/2, false)
+	if err != nil {
+		return nil, fmt.Errorf("GetEventsInTopologicalRange: %w", err)
+	}
+
+	// The tokens are worked out before filtering out the events the user
+	// can't see, so that paginating from them carries on from where these
+	// events stopped.
+	start := types.NewTopologyToken(beforePos.Depth(), beforePos.PDUPosition())
+	end := pos
+	if len(before) > 0 {
+		if start, err = syncDB.EventPositionInTopology(ctx, before[len(before)-1].EventID()); err != nil {
+			return nil, fmt.Errorf("EventPositionInTopology: %w", err)
+		}
+		start.Decrement()
+	}
+	lastEventID := event.EventID()
+	if len(after) > 0 {
+		lastEventID = after[len(after)-1].EventID()
+		if end, err = syncDB.EventPositionInTopology(ctx, lastEventID); err != nil {
+			return nil, fmt.Errorf("EventPositionInTopology: %w", err)
+		}
+	}
+
+	beforeEvents, err := filterHistoryVisible(ctx, rsAPI, userID, syncDB.StreamEventsToEvents(nil, before))
+	if err != nil {
+		return nil, err
+	}
+	afterEvents, err := filterHistoryVisible(ctx, rsAPI, userID, syncDB.StreamEventsToEvents(nil, after))
+	if err != nil {
+		return nil, err
+	}
+
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{lastEventID},
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err = rsAPI.QueryStateAfterEvents(ctx, &stateReq, &stateRes); err != nil {
+		return nil, fmt.Errorf("QueryStateAfterEvents: %w", err)
+	}
+
+	// Bundle the aggregations of all the events in one go, as they're all
+	// shown to the client as part of the timeline.
+	clientEvents := gomatrixserverlib.HeaderedToClientEvents(
+		append(append(beforeEvents, event), afterEvents...), gomatrixserverlib.FormatAll,
+	)
+	if err = syncDB.BundleAggregations(ctx, roomID, clientEvents); err != nil {
+		return nil, fmt.Errorf("BundleAggregations: %w", err)
+	}
+	return &contextResponse{
+		Start:        start.String(),
+		End:          end.String(),
+		EventsBefore: clientEvents[:len(beforeEvents)],
+		Event:        clientEvents[len(beforeEvents)],
+		EventsAfter:  clientEvents[len(beforeEvents)+1:],
+		State:        gomatrixserverlib.HeaderedToClientEvents(stateRes.StateEvents, gomatrixserverlib.FormatAll),
+	}, nil
+}
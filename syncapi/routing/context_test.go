@@ -0,0 +1,235 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeContextRoomserverAPI hides some events from the user and gives the
+// state after any event as the event itself.
+type fakeContextRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	hidden map[string]bool
+	events map[string]gomatrixserverlib.HeaderedEvent
+}
+
+func (r *fakeContextRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context, req *api.QueryUserAllowedToSeeEventsRequest, res *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	res.AllowedEventIDs = make(map[string]bool)
+	for _, eventID := range req.EventIDs {
+		res.AllowedEventIDs[eventID] = !r.hidden[eventID]
+	}
+	return nil
+}
+
+func (r *fakeContextRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context, req *api.QueryStateAfterEventsRequest, res *api.QueryStateAfterEventsResponse,
+) error {
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	for _, eventID := range req.PrevEventIDs {
+		res.StateEvents = append(res.StateEvents, r.events[eventID])
+	}
+	return nil
+}
+
+// fakeContextSyncDB holds the events of a single room, with the depth of
+// each event being its stream position, and marks the edited events when
+// bundling aggregations.
+type fakeContextSyncDB struct {
+	storage.Database
+	events []types.StreamEvent
+	edited map[string]bool
+}
+
+func (d *fakeContextSyncDB) Events(ctx context.Context, eventIDs []string) ([]gomatrixserverlib.HeaderedEvent, error) {
+	var events []gomatrixserverlib.HeaderedEvent
+	for _, ev := range d.events {
+		for _, eventID := range eventIDs {
+			if ev.EventID() == eventID {
+				events = append(events, ev.HeaderedEvent)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (d *fakeContextSyncDB) EventPositionInTopology(ctx context.Context, eventID string) (types.TopologyToken, error) {
+	for _, ev := range d.events {
+		if ev.EventID() == eventID {
+			return types.NewTopologyToken(ev.StreamPosition, ev.StreamPosition), nil
+		}
+	}
+	return types.TopologyToken{}, fmt.Errorf("unknown event %s", eventID)
+}
+
+func (d *fakeContextSyncDB) MaxTopologicalPosition(ctx context.Context, roomID string) (types.TopologyToken, error) {
+	pos := d.events[len(d.events)-1].StreamPosition
+	return types.NewTopologyToken(pos, pos), nil
+}
+
+func (d *fakeContextSyncDB) GetEventsInTopologicalRange(
+	ctx context.Context, from, to *types.TopologyToken, roomID string, limit int, backwardOrdering bool,
+) ([]types.StreamEvent, error) {
+	lower, upper := from.PDUPosition(), to.PDUPosition()
+	if backwardOrdering {
+		lower, upper = upper, lower
+	}
+	var events []types.StreamEvent
+	for i := range d.events {
+		if backwardOrdering {
+			i = len(d.events) - 1 - i
+		}
+		if pos := d.events[i].StreamPosition; pos > lower && pos <= upper && len(events) < limit {
+			events = append(events, d.events[i])
+		}
+	}
+	return events, nil
+}
+
+func (d *fakeContextSyncDB) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent {
+	out := make([]gomatrixserverlib.HeaderedEvent, len(in))
+	for i := range in {
+		out[i] = in[i].HeaderedEvent
+	}
+	return out
+}
+
+func (d *fakeContextSyncDB) BundleAggregations(ctx context.Context, roomID string, events []gomatrixserverlib.ClientEvent) error {
+	for i := range events {
+		if d.edited[events[i].EventID] {
+			events[i].Unsigned = []byte(`{"m.relations":{"m.replace":{"event_id":"$edit:localhost"}}}`)
+		}
+	}
+	return nil
+}
+
+func TestGetContext(t *testing.T) {
+	syncDB := &fakeContextSyncDB{
+		edited: map[string]bool{"$3:localhost": true, "$4:localhost": true, "$5:localhost": true},
+	}
+	rsAPI := &fakeContextRoomserverAPI{
+		hidden: map[string]bool{"$2:localhost": true},
+		events: make(map[string]gomatrixserverlib.HeaderedEvent),
+	}
+	for i := 1; i <= 7; i++ {
+		eventJSON := fmt.Sprintf(`{"auth_events":[],"content":{"body":"%d"},"depth":%d,"event_id":"$%d:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","type":"m.room.message","hashes":{"sha256":""},"signatures":{}}`, i, i, i)
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		headered := ev.Headered(gomatrixserverlib.RoomVersionV1)
+		syncDB.events = append(syncDB.events, types.StreamEvent{
+			HeaderedEvent:  headered,
+			StreamPosition: types.StreamPosition(i),
+		})
+		rsAPI.events[ev.EventID()] = headered
+	}
+	getContext := func(roomID, eventID, query string) (int, *contextResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+roomID+"/context/"+eventID+query, nil)
+		res := GetContext(req, &userapi.Device{UserID: "@alice:localhost"}, syncDB, rsAPI, roomID, eventID)
+		if res.Code != http.StatusOK {
+			return res.Code, nil
+		}
+		// round trip the response to check what clients get
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %s", err)
+		}
+		var out contextResponse
+		if err = json.Unmarshal(body, &out); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		return res.Code, &out
+	}
+	eventIDs := func(events []gomatrixserverlib.ClientEvent) []string {
+		ids := []string{}
+		for _, ev := range events {
+			ids = append(ids, ev.EventID)
+		}
+		return ids
+	}
+
+	code, res := getContext("!room:localhost", "$4:localhost", "?limit=4")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	// $2 is fetched but hidden, so the start token still points before it
+	if got, want := fmt.Sprint(eventIDs(res.EventsBefore)), "[$3:localhost]"; got != want {
+		t.Errorf("got events before %s, want %s", got, want)
+	}
+	if res.Event.EventID != "$4:localhost" {
+		t.Errorf("got event %s, want $4:localhost", res.Event.EventID)
+	}
+	if got, want := fmt.Sprint(eventIDs(res.EventsAfter)), "[$5:localhost $6:localhost]"; got != want {
+		t.Errorf("got events after %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(eventIDs(res.State)), "[$6:localhost]"; got != want {
+		t.Errorf("got state %s, want the state after the last event %s", got, want)
+	}
+	if want := types.NewTopologyToken(2, 1); res.Start != want.String() {
+		t.Errorf("got start %s, want %s", res.Start, want.String())
+	}
+	if want := types.NewTopologyToken(6, 6); res.End != want.String() {
+		t.Errorf("got end %s, want %s", res.End, want.String())
+	}
+	for _, ev := range append(append(res.EventsBefore, res.Event), res.EventsAfter...) {
+		if bundled := syncDB.edited[ev.EventID]; bundled != (len(ev.Unsigned) > 0) {
+			t.Errorf("event %s: got unsigned %s, want edits bundled: %v", ev.EventID, ev.Unsigned, bundled)
+		}
+	}
+
+	// with nothing left either side, the tokens point either side of the event
+	code, res = getContext("!room:localhost", "$1:localhost", "?limit=0")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if len(res.EventsBefore) != 0 || len(res.EventsAfter) != 0 {
+		t.Errorf("got events %v and %v either side with a limit of 0", eventIDs(res.EventsBefore), eventIDs(res.EventsAfter))
+	}
+	if want := types.NewTopologyToken(1, 0); res.Start != want.String() {
+		t.Errorf("got start %s, want %s", res.Start, want.String())
+	}
+	if want := types.NewTopologyToken(1, 1); res.End != want.String() {
+		t.Errorf("got end %s, want %s", res.End, want.String())
+	}
+
+	for _, tt := range []struct {
+		roomID, eventID, query string
+		want                   int
+	}{
+		{"!room:localhost", "$4:localhost", "?limit=nonsense", http.StatusBadRequest},
+		{"!room:localhost", "$unknown:localhost", "", http.StatusNotFound},
+		{"!other:localhost", "$4:localhost", "", http.StatusNotFound},
+		{"!room:localhost", "$2:localhost", "", http.StatusForbidden},
+	} {
+		if code, _ := getContext(tt.roomID, tt.eventID, tt.query); code != tt.want {
+			t.Errorf("event %s in %s with query %q: got status %d, want %d", tt.eventID, tt.roomID, tt.query, code, tt.want)
+		}
+	}
+}
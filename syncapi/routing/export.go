@@ -0,0 +1,187 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// defaultExportLimit is the number of events exported per request when
+	// the request doesn't specify a limit.
+	defaultExportLimit = 1000
+	// maxExportLimit is the most events we'll export in a single request.
+	maxExportLimit = 10000
+	// exportBatchSize is the number of events which are read from the
+	// database and checked against the history visibility at a time.
+	exportBatchSize = 100
+)
+
+type exportedEvent struct {
+	StreamPosition types.StreamPosition          `json:"stream_position"`
+	Event          gomatrixserverlib.ClientEvent `json:"event"`
+}
+
+// ExportRoomEvents implements GET /rooms/{roomID}/export, which streams the
+// events of a room that the user is allowed to see as newline-delimited JSON,
+// oldest first, so that clients can archive rooms without paginating through
+// /messages. Events are exported as they were sent, so end-to-end encrypted
+// events have to be decrypted by the client.
+// Only users who are or were in the room may export it.
+// Each line holds an event and its stream position. An interrupted export is
+// resumed by passing the stream position of the last line received as from.
+// At most limit events are exported by each request, so the export is only
+// complete once a request returns fewer than limit lines.
+func ExportRoomEvents(
+	w http.ResponseWriter, req *http.Request,
+	userAPI userapi.UserInternalAPI, syncDB storage.Database,
+	rsAPI api.RoomserverInternalAPI, roomID string,
+) *util.JSONResponse {
+	util.SetCORSHeaders(w)
+	if req.Method == http.MethodOptions {
+		return nil
+	}
+	device, resErr := auth.VerifyUserFromRequest(req, userAPI)
+	if resErr != nil {
+		return resErr
+	}
+
+	var from types.StreamPosition
+	if f := req.URL.Query().Get("from"); f != "" {
+		pos, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || pos < 0 {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid from parameter"),
+			}
+		}
+		from = types.StreamPosition(pos)
+	}
+	limit := defaultExportLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid limit parameter"),
+			}
+		}
+	}
+	if limit > maxExportLimit {
+		limit = maxExportLimit
+	}
+
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithField("user_id", device.UserID).WithField("room_id", roomID)
+	membershipReq := api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}
+	var membershipRes api.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(ctx, &membershipReq, &membershipRes); err != nil {
+		logger.WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !membershipRes.HasBeenInRoom {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+		}
+	}
+
+	// Export up to the current position, so that an export of a busy room
+	// finishes rather than following new events forever.
+	to, err := syncDB.SyncPosition(ctx)
+	if err != nil {
+		logger.WithError(err).Error("syncDB.SyncPosition failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	fromToken := types.StreamingToken{PDUPosition: from}
+
+	// Once the first line has been written, errors can't be returned to the
+	// client any more, so the export just stops and can be resumed.
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+	fail := func(msg string, err error) *util.JSONResponse {
+		logger.WithError(err).Error(msg)
+		if started {
+			return nil
+		}
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	exported := 0
+	for exported < limit {
+		streamEvents, err := syncDB.GetEventsInStreamingRange(ctx, &fromToken, &to, roomID, exportBatchSize, false)
+		if err != nil {
+			return fail("syncDB.GetEventsInStreamingRange failed", err)
+		}
+		if len(streamEvents) == 0 {
+			break
+		}
+		positions := make(map[string]types.StreamPosition, len(streamEvents))
+		for _, streamEvent := range streamEvents {
+			positions[streamEvent.EventID()] = streamEvent.StreamPosition
+		}
+		events, err := filterHistoryVisible(ctx, rsAPI, device.UserID, syncDB.StreamEventsToEvents(nil, streamEvents))
+		if err != nil {
+			return fail("filterHistoryVisible failed", err)
+		}
+		start()
+		for _, event := range events {
+			if exported == limit {
+				break
+			}
+			line := exportedEvent{
+				StreamPosition: positions[event.EventID()],
+				Event:          gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+			}
+			if err = encoder.Encode(line); err != nil {
+				// The client has most likely gone away.
+				logger.WithError(err).Warn("Failed to write exported event")
+				return nil
+			}
+			exported++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		fromToken.PDUPosition = streamEvents[len(streamEvents)-1].StreamPosition
+	}
+	start()
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeExportUserAPI gives every access token to its user.
+type fakeExportUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *fakeExportUserAPI) QueryAccessToken(
+	ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse,
+) error {
+	res.Device = &userapi.Device{UserID: req.AccessToken, ID: "DEVICE"}
+	return nil
+}
+
+// fakeExportRoomserverAPI knows who has been in the room and which events
+// they may see.
+type fakeExportRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	members map[string]bool
+	hidden  map[string]bool
+}
+
+func (r *fakeExportRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *api.QueryMembershipForUserRequest, res *api.QueryMembershipForUserResponse,
+) error {
+	res.HasBeenInRoom = r.members[req.UserID]
+	return nil
+}
+
+func (r *fakeExportRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context, req *api.QueryUserAllowedToSeeEventsRequest, res *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	res.AllowedEventIDs = make(map[string]bool)
+	for _, eventID := range req.EventIDs {
+		res.AllowedEventIDs[eventID] = !r.hidden[eventID]
+	}
+	return nil
+}
+
+// fakeExportSyncDB holds the events of a single room, in stream order.
+type fakeExportSyncDB struct {
+	storage.Database
+	events []types.StreamEvent
+}
+
+func (d *fakeExportSyncDB) SyncPosition(ctx context.Context) (types.StreamingToken, error) {
+	return types.StreamingToken{PDUPosition: d.events[len(d.events)-1].StreamPosition}, nil
+}
+
+func (d *fakeExportSyncDB) GetEventsInStreamingRange(
+	ctx context.Context, from, to *types.StreamingToken, roomID string, limit int, backwardOrdering bool,
+) ([]types.StreamEvent, error) {
+	var events []types.StreamEvent
+	for _, ev := range d.events {
+		if ev.StreamPosition > from.PDUPosition && ev.StreamPosition <= to.PDUPosition && len(events) < limit {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func (d *fakeExportSyncDB) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent {
+	out := make([]gomatrixserverlib.HeaderedEvent, len(in))
+	for i := range in {
+		out[i] = in[i].HeaderedEvent
+	}
+	return out
+}
+
+func TestExportRoomEvents(t *testing.T) {
+	syncDB := &fakeExportSyncDB{}
+	for i := 1; i <= 3; i++ {
+		eventJSON := fmt.Sprintf(`{"auth_events":[],"content":{"body":"%d"},"depth":%d,"event_id":"$%d:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","type":"m.room.message","hashes":{"sha256":""},"signatures":{}}`, i, i, i)
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		syncDB.events = append(syncDB.events, types.StreamEvent{
+			HeaderedEvent:  ev.Headered(gomatrixserverlib.RoomVersionV1),
+			StreamPosition: types.StreamPosition(i),
+		})
+	}
+	rsAPI := &fakeExportRoomserverAPI{
+		members: map[string]bool{"@alice:localhost": true},
+		hidden:  map[string]bool{"$2:localhost": true},
+	}
+	export := func(userID, query string) (int, []string) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/rooms/!room:localhost/export"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+userID)
+		w := httptest.NewRecorder()
+		if resErr := ExportRoomEvents(w, req, &fakeExportUserAPI{}, syncDB, rsAPI, "!room:localhost"); resErr != nil {
+			return resErr.Code, nil
+		}
+		var eventIDs []string
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var line exportedEvent
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("failed to parse exported line %q: %s", scanner.Text(), err)
+			}
+			eventIDs = append(eventIDs, line.Event.EventID)
+		}
+		return w.Code, eventIDs
+	}
+
+	if code, _ := export("@mallory:localhost", ""); code != http.StatusForbidden {
+		t.Errorf("got status %d for a user who was never in the room, want %d", code, http.StatusForbidden)
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// events which the user can't see are left out
+		{"", []string{"$1:localhost", "$3:localhost"}},
+		{"?limit=1", []string{"$1:localhost"}},
+		{"?from=1", []string{"$3:localhost"}},
+		{"?from=3", nil},
+	}
+	for _, tt := range tests {
+		code, eventIDs := export("@alice:localhost", tt.query)
+		if code != http.StatusOK {
+			t.Errorf("query %q: got status %d, want %d", tt.query, code, http.StatusOK)
+			continue
+		}
+		if fmt.Sprint(eventIDs) != fmt.Sprint(tt.want) {
+			t.Errorf("query %q: got events %v, want %v", tt.query, eventIDs, tt.want)
+		}
+	}
+	if code, _ := export("@alice:localhost", "?from=-1"); code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid from, want %d", code, http.StatusBadRequest)
+	}
+}
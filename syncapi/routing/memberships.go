@@ -0,0 +1,128 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+type getMembershipResponse struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+}
+
+// GetMemberships implements GET /rooms/{roomId}/members
+// The at parameter takes a sync or pagination token, and returns the members
+// of the room at that point rather than now. The membership and
+// not_membership parameters filter the members by their membership.
+func GetMemberships(
+	req *http.Request, device *userapi.Device, roomID string,
+	db storage.Database, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+	membership, notMembership := query.Get("membership"), query.Get("not_membership")
+	for param, value := range map[string]string{"membership": membership, "not_membership": notMembership} {
+		if value != "" && !isMembership(value) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid " + param + " parameter"),
+			}
+		}
+	}
+
+	queryReq := api.QueryMembershipsForRoomRequest{
+		RoomID: roomID,
+		Sender: device.UserID,
+	}
+	if at := query.Get("at"); at != "" {
+		atEventID, err := eventIDAtToken(ctx, db, roomID, at)
+		if err == errInvalidToken {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid at parameter"),
+			}
+		} else if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("eventIDAtToken failed")
+			return jsonerror.InternalServerError()
+		}
+		queryReq.AtEventID = atEventID
+	}
+	var queryRes api.QueryMembershipsForRoomResponse
+	if err := rsAPI.QueryMembershipsForRoom(ctx, &queryReq, &queryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryMembershipsForRoom failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if !queryRes.HasBeenInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+		}
+	}
+
+	chunk := make([]gomatrixserverlib.ClientEvent, 0, len(queryRes.JoinEvents))
+	for _, ev := range queryRes.JoinEvents {
+		evMembership := gjson.GetBytes(ev.Content, "membership").Str
+		if (membership != "" && evMembership != membership) || (notMembership != "" && evMembership == notMembership) {
+			continue
+		}
+		chunk = append(chunk, ev)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: getMembershipResponse{chunk},
+	}
+}
+
+// eventIDAtToken returns the ID of the latest event in the room at the
+// position of the given sync or pagination token. Returns errInvalidToken if
+// the token can't be parsed or is earlier than every event in the room.
+func eventIDAtToken(
+	ctx context.Context, db storage.Database, roomID, tok string,
+) (string, error) {
+	at, err := toTopologyToken(ctx, db, roomID, tok)
+	if err != nil {
+		return "", err
+	}
+	// The range is inclusive of the token's position, so this gets the event
+	// which the token comes after.
+	start := types.NewTopologyToken(0, 0)
+	events, err := db.GetEventsInTopologicalRange(ctx, &at, &start, roomID, 1, true)
+	if err != nil {
+		return "", err
+	}
+	if len(events) == 0 {
+		return "", errInvalidToken
+	}
+	return events[0].EventID(), nil
+}
+
+func isMembership(membership string) bool {
+	switch membership {
+	case gomatrixserverlib.Join, gomatrixserverlib.Invite, gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeMembershipsRoomserverAPI returns the memberships of the room after the
+// requested event, where each event adds one membership.
+type fakeMembershipsRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	memberships []gomatrixserverlib.ClientEvent
+}
+
+func (r *fakeMembershipsRoomserverAPI) QueryMembershipsForRoom(
+	ctx context.Context, req *api.QueryMembershipsForRoomRequest, res *api.QueryMembershipsForRoomResponse,
+) error {
+	if req.Sender != "@alice:localhost" {
+		return nil
+	}
+	res.HasBeenInRoom = true
+	for _, ev := range r.memberships {
+		res.JoinEvents = append(res.JoinEvents, ev)
+		if ev.EventID == req.AtEventID {
+			break
+		}
+	}
+	return nil
+}
+
+// fakeMembershipsSyncDB holds the events of a single room, with the depth of
+// each event being its stream position.
+type fakeMembershipsSyncDB struct {
+	storage.Database
+	events []types.StreamEvent
+}
+
+func (d *fakeMembershipsSyncDB) GetEventsInTopologicalRange(
+	ctx context.Context, from, to *types.TopologyToken, roomID string, limit int, backwardOrdering bool,
+) ([]types.StreamEvent, error) {
+	var events []types.StreamEvent
+	for i := len(d.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if pos := d.events[i].StreamPosition; pos <= from.Depth() && pos >= to.Depth() {
+			events = append(events, d.events[i])
+		}
+	}
+	return events, nil
+}
+
+func TestGetMemberships(t *testing.T) {
+	syncDB := &fakeMembershipsSyncDB{}
+	rsAPI := &fakeMembershipsRoomserverAPI{}
+	for i, member := range []struct{ userID, membership string }{
+		{"@alice:localhost", "join"},
+		{"@bob:localhost", "invite"},
+		{"@carol:localhost", "join"},
+	} {
+		eventJSON := fmt.Sprintf(`{"auth_events":[],"content":{"membership":%q},"depth":%d,"event_id":"$%d:localhost","origin_server_ts":0,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","state_key":%q,"type":"m.room.member","hashes":{"sha256":""},"signatures":{}}`, member.membership, i+1, i+1, member.userID)
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		syncDB.events = append(syncDB.events, types.StreamEvent{
+			HeaderedEvent:  ev.Headered(gomatrixserverlib.RoomVersionV1),
+			StreamPosition: types.StreamPosition(i + 1),
+		})
+		rsAPI.memberships = append(rsAPI.memberships, gomatrixserverlib.ToClientEvent(ev, gomatrixserverlib.FormatAll))
+	}
+	getMemberships := func(userID, query string) (int, []string) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/!room:localhost/members"+query, nil)
+		res := GetMemberships(req, &userapi.Device{UserID: userID}, "!room:localhost", syncDB, rsAPI)
+		if res.Code != http.StatusOK {
+			return res.Code, nil
+		}
+		// round trip the response to check what clients get
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %s", err)
+		}
+		var chunk getMembershipResponse
+		if err = json.Unmarshal(body, &chunk); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		var members []string
+		for _, ev := range chunk.Chunk {
+			members = append(members, *ev.StateKey)
+		}
+		return res.Code, members
+	}
+
+	atBob := types.NewTopologyToken(2, 2)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"@alice:localhost", "@bob:localhost", "@carol:localhost"}},
+		// the memberships after the event at the token, not the current ones
+		{"?at=" + atBob.String(), []string{"@alice:localhost", "@bob:localhost"}},
+		{"?at=" + atBob.String() + "&membership=join", []string{"@alice:localhost"}},
+		{"?not_membership=join", []string{"@bob:localhost"}},
+	}
+	for _, tt := range tests {
+		code, members := getMemberships("@alice:localhost", tt.query)
+		if code != http.StatusOK {
+			t.Errorf("query %q: got status %d, want %d", tt.query, code, http.StatusOK)
+			continue
+		}
+		if fmt.Sprint(members) != fmt.Sprint(tt.want) {
+			t.Errorf("query %q: got members %v, want %v", tt.query, members, tt.want)
+		}
+	}
+	for _, query := range []string{"?at=nonsense", "?membership=nonsense"} {
+		if code, _ := getMemberships("@alice:localhost", query); code != http.StatusBadRequest {
+			t.Errorf("query %q: got status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+	if code, _ := getMemberships("@mallory:localhost", ""); code != http.StatusForbidden {
+		t.Errorf("got status %d for a user who was never in the room, want %d", code, http.StatusForbidden)
+	}
+}
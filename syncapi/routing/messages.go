@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -26,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
@@ -37,10 +39,10 @@ type messagesReq struct {
 	rsAPI            api.RoomserverInternalAPI
 	federation       *gomatrixserverlib.FederationClient
 	cfg              *config.Dendrite
+	device           *userapi.Device
 	roomID           string
 	from             *types.TopologyToken
 	to               *types.TopologyToken
-	fromStream       *types.StreamingToken
 	wasToProvided    bool
 	limit            int
 	backwardOrdering bool
@@ -54,11 +56,30 @@ type messagesResp struct {
 
 const defaultMessagesLimit = 10
 
+var errInvalidToken = errors.New("invalid pagination token")
+
+// toTopologyToken parses a pagination token given to /messages. Stream tokens,
+// such as the next_batch of a /sync response, are turned into the topological
+// position covering the same events, as backfilled events are given stream
+// positions later than events which come after them in the room.
+func toTopologyToken(
+	ctx context.Context, db storage.Database, roomID, tok string,
+) (types.TopologyToken, error) {
+	if topologyToken, err := types.NewTopologyTokenFromString(tok); err == nil {
+		return topologyToken, nil
+	}
+	streamToken, err := types.NewStreamTokenFromString(tok)
+	if err != nil {
+		return types.TopologyToken{}, errInvalidToken
+	}
+	return db.StreamToTopologicalPosition(ctx, roomID, streamToken.PDUPosition)
+}
+
 // OnIncomingMessagesRequest implements the /messages endpoint from the
 // client-server API.
 // See: https://matrix.org/docs/spec/client_server/latest.html#get-matrix-client-r0-rooms-roomid-messages
 func OnIncomingMessagesRequest(
-	req *http.Request, db storage.Database, roomID string,
+	req *http.Request, device *userapi.Device, db storage.Database, roomID string,
 	federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
 	cfg *config.Dendrite,
@@ -67,17 +88,15 @@ func OnIncomingMessagesRequest(
 
 	// Extract parameters from the request's URL.
 	// Pagination tokens.
-	var fromStream *types.StreamingToken
-	from, err := types.NewTopologyTokenFromString(req.URL.Query().Get("from"))
-	if err != nil {
-		fs, err2 := types.NewStreamTokenFromString(req.URL.Query().Get("from"))
-		fromStream = &fs
-		if err2 != nil {
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.InvalidArgumentValue("Invalid from parameter: " + err2.Error()),
-			}
+	from, err := toTopologyToken(req.Context(), db, roomID, req.URL.Query().Get("from"))
+	if err == errInvalidToken {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid from parameter"),
 		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("toTopologyToken failed")
+		return jsonerror.InternalServerError()
 	}
 
 	// Direction to return events from.
@@ -97,12 +116,15 @@ func OnIncomingMessagesRequest(
 	var to types.TopologyToken
 	wasToProvided := true
 	if s := req.URL.Query().Get("to"); len(s) > 0 {
-		to, err = types.NewTopologyTokenFromString(s)
-		if err != nil {
+		to, err = toTopologyToken(req.Context(), db, roomID, s)
+		if err == errInvalidToken {
 			return util.JSONResponse{
 				Code: http.StatusBadRequest,
-				JSON: jsonerror.InvalidArgumentValue("Invalid to parameter: " + err.Error()),
+				JSON: jsonerror.InvalidArgumentValue("Invalid to parameter"),
 			}
+		} else if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("toTopologyToken failed")
+			return jsonerror.InternalServerError()
 		}
 	} else {
 		// If "to" isn't provided, it defaults to either the earliest stream
@@ -144,10 +166,10 @@ func OnIncomingMessagesRequest(
 		rsAPI:            rsAPI,
 		federation:       federation,
 		cfg:              cfg,
+		device:           device,
 		roomID:           roomID,
 		from:             &from,
 		to:               &to,
-		fromStream:       fromStream,
 		wasToProvided:    wasToProvided,
 		limit:            limit,
 		backwardOrdering: backwardOrdering,
@@ -189,17 +211,9 @@ func (r *messagesReq) retrieveEvents() (
 	end types.TopologyToken, err error,
 ) {
 	// Retrieve the events from the local database.
-	var streamEvents []types.StreamEvent
-	if r.fromStream != nil {
-		toStream := r.to.StreamToken()
-		streamEvents, err = r.db.GetEventsInStreamingRange(
-			r.ctx, r.fromStream, &toStream, r.roomID, r.limit, r.backwardOrdering,
-		)
-	} else {
-		streamEvents, err = r.db.GetEventsInTopologicalRange(
-			r.ctx, r.from, r.to, r.roomID, r.limit, r.backwardOrdering,
-		)
-	}
+	streamEvents, err := r.db.GetEventsInTopologicalRange(
+		r.ctx, r.from, r.to, r.roomID, r.limit, r.backwardOrdering,
+	)
 	if err != nil {
 		err = fmt.Errorf("GetEventsInRange: %w", err)
 		return
@@ -239,17 +253,58 @@ func (r *messagesReq) retrieveEvents() (
 		events = reversed(events)
 	}
 
-	// Convert all of the events into client events.
-	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
 	// Get the position of the first and the last event in the room's topology.
 	// This position is currently determined by the event's depth, so we could
 	// also use it instead of retrieving from the database. However, if we ever
 	// change the way topological positions are defined (as depth isn't the most
 	// reliable way to define it), it would be easier and less troublesome to
-	// only have to change it in one place, i.e. the database.
+	// only have to change it in one place, i.e. the database. This is done
+	// before filtering out the events the user can't see, so that the next
+	// page carries on from where this one stopped.
 	start, end, err = r.getStartEnd(events)
+	if err != nil {
+		return
+	}
+
+	if events, err = filterHistoryVisible(r.ctx, r.rsAPI, r.device.UserID, events); err != nil {
+		return
+	}
 
-	return clientEvents, start, end, err
+	// Convert all of the events into client events.
+	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
+	if err = r.db.BundleAggregations(r.ctx, r.roomID, clientEvents); err != nil {
+		err = fmt.Errorf("BundleAggregations: %w", err)
+		return
+	}
+
+	return clientEvents, start, end, nil
+}
+
+// filterHistoryVisible removes the events which the history visibility of the
+// room doesn't allow the user to see, preserving the order of the remaining
+// events.
+func filterHistoryVisible(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, userID string,
+	events []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	queryReq := api.QueryUserAllowedToSeeEventsRequest{
+		UserID:   userID,
+		EventIDs: make([]string, 0, len(events)),
+	}
+	for _, event := range events {
+		queryReq.EventIDs = append(queryReq.EventIDs, event.EventID())
+	}
+	var queryRes api.QueryUserAllowedToSeeEventsResponse
+	if err := rsAPI.QueryUserAllowedToSeeEvents(ctx, &queryReq, &queryRes); err != nil {
+		return nil, fmt.Errorf("QueryUserAllowedToSeeEvents: %w", err)
+	}
+	allowed := make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, event := range events {
+		if queryRes.AllowedEventIDs[event.EventID()] {
+			allowed = append(allowed, event)
+		}
+	}
+	return allowed, nil
 }
 
 func (r *messagesReq) getStartEnd(events []gomatrixserverlib.HeaderedEvent) (start, end types.TopologyToken, err error) {
@@ -260,6 +315,11 @@ func (r *messagesReq) getStartEnd(events []gomatrixserverlib.HeaderedEvent) (sta
 		err = fmt.Errorf("EventPositionInTopology: for start event %s: %w", events[0].EventID(), err)
 		return
 	}
+	if !r.backwardOrdering {
+		// The start token needs to be before the first event so that paginating
+		// forwards from it again returns that event.
+		start.Decrement()
+	}
 	if r.backwardOrdering && events[len(events)-1].Type() == gomatrixserverlib.MRoomCreate {
 		// We've hit the beginning of the room so there's really nowhere else
 		// to go. This seems to fix Riot iOS from looping on /messages endlessly.
@@ -357,9 +417,18 @@ func (r *messagesReq) handleNonEmptyEventsSlice(streamEvents []types.StreamEvent
 		events = append(events, pdus...)
 	}
 
-	// Append the events ve previously retrieved locally.
-	events = append(events, r.db.StreamEventsToEvents(nil, streamEvents)...)
-	sort.Sort(eventsByDepth(events))
+	// Append the events ve previously retrieved locally. These are in reverse
+	// topological order if we're going backward, so put them back in order
+	// first, as the sort below has to keep events with the same depth in the
+	// order of their stream positions.
+	localEvents := r.db.StreamEventsToEvents(nil, streamEvents)
+	if r.backwardOrdering {
+		for i, j := 0, len(localEvents)-1; i < j; i, j = i+1, j-1 {
+			localEvents[i], localEvents[j] = localEvents[j], localEvents[i]
+		}
+	}
+	events = append(events, localEvents...)
+	sort.Stable(eventsByDepth(events))
 
 	return
 }
@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// SetReceipt implements POST /_matrix/client/r0/rooms/{roomId}/receipt/{receiptType}/{eventId}
+// TODO: Send the receipt to the other members of the room. For now all this
+// does is mark the room as read, resetting the user's unread notification counts.
+// Only the counts of each room are stored rather than the events which were
+// counted, so the whole room is marked as read whichever event the receipt is
+// for, including any notifications for events after it. Clients send receipts
+// for the latest event which the user has seen, so this only undercounts
+// events which arrived while the receipt was being sent, and the next receipt
+// is sent once the user sees those.
+func SetReceipt(
+	req *http.Request, device *api.Device, syncDB storage.Database, notifier *sync.Notifier,
+	roomID, receiptType, eventID string,
+) util.JSONResponse {
+	if receiptType != "m.read" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Receipt type must be m.read"),
+		}
+	}
+
+	pos, err := syncDB.ResetNotificationCounts(req.Context(), device.UserID, roomID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.ResetNotificationCounts failed")
+		return jsonerror.InternalServerError()
+	}
+	if pos > 0 {
+		// Wake up the user's /sync streams so that their other devices find
+		// out that the room has been read.
+		notifier.OnNewEvent(nil, "", []string{device.UserID}, types.StreamingToken{ReceiptPosition: pos})
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// fakeReceiptSyncDB holds the unread notification counts of one user in each
+// room.
+type fakeReceiptSyncDB struct {
+	storage.Database
+	counts map[string]int
+	pos    types.StreamPosition
+}
+
+func (d *fakeReceiptSyncDB) ResetNotificationCounts(ctx context.Context, userID, roomID string) (types.StreamPosition, error) {
+	if d.counts[roomID] == 0 {
+		return 0, nil
+	}
+	d.counts[roomID] = 0
+	d.pos++
+	return d.pos, nil
+}
+
+func TestSetReceipt(t *testing.T) {
+	syncDB := &fakeReceiptSyncDB{counts: map[string]int{"!a:localhost": 3, "!b:localhost": 2}}
+	notifier := sync.NewNotifier(types.StreamingToken{})
+	device := &userapi.Device{UserID: "@alice:localhost"}
+	setReceipt := func(roomID, receiptType, eventID string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/rooms/"+roomID+"/receipt/"+receiptType+"/"+eventID, nil)
+		return SetReceipt(req, device, syncDB, notifier, roomID, receiptType, eventID).Code
+	}
+
+	if code := setReceipt("!a:localhost", "m.unknown", "$a"); code != http.StatusBadRequest {
+		t.Errorf("unknown receipt type: got status %d want %d", code, http.StatusBadRequest)
+	}
+	if syncDB.counts["!a:localhost"] != 3 {
+		t.Errorf("unknown receipt type: got the counts reset")
+	}
+
+	// The whole room is marked as read, whichever event the receipt is for,
+	// and only that room.
+	if code := setReceipt("!a:localhost", "m.read", "$older"); code != http.StatusOK {
+		t.Errorf("got status %d want %d", code, http.StatusOK)
+	}
+	if syncDB.counts["!a:localhost"] != 0 || syncDB.counts["!b:localhost"] != 2 {
+		t.Errorf("got counts %v, want only !a:localhost reset", syncDB.counts)
+	}
+	if got := notifier.CurrentPosition().ReceiptPosition; got != 1 {
+		t.Errorf("got receipt position %d, want the user's syncs woken at 1", got)
+	}
+
+	// Nothing is reset the second time, so the syncs aren't woken again.
+	if code := setReceipt("!a:localhost", "m.read", "$newer"); code != http.StatusOK {
+		t.Errorf("got status %d want %d", code, http.StatusOK)
+	}
+	if got := notifier.CurrentPosition().ReceiptPosition; got != 1 {
+		t.Errorf("got receipt position %d after nothing was reset, want 1", got)
+	}
+}
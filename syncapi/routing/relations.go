@@ -0,0 +1,173 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// defaultRelationsLimit is the number of relations returned per page when
+	// the request doesn't specify a limit.
+	defaultRelationsLimit = 5
+	// maxRelationsLimit is the most relations we'll return in a single page.
+	maxRelationsLimit = 100
+)
+
+type relationsResponse struct {
+	Chunk         []gomatrixserverlib.ClientEvent `json:"chunk"`
+	OriginalEvent gomatrixserverlib.ClientEvent   `json:"original_event"`
+	NextBatch     *string                         `json:"next_batch,omitempty"`
+}
+
+// GetRelations implements GET /rooms/{roomID}/relations/{eventID}/{relType}/{eventType}
+// as described by MSC2675, where the relation type and event type are optional.
+// Relations are returned newest first. The pagination tokens are stream
+// positions: from is the position of the last relation the client received
+// and to is the position to stop at, both exclusive.
+func GetRelations(
+	req *http.Request, device *api.Device, syncDB storage.Database,
+	roomID, eventID, relType, eventType string,
+) util.JSONResponse {
+	r := types.Range{
+		From:      types.StreamPosition(math.MaxInt64),
+		Backwards: true,
+	}
+	if from := req.URL.Query().Get("from"); from != "" {
+		pos, err := strconv.ParseInt(from, 10, 64)
+		if err != nil || pos <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid from parameter"),
+			}
+		}
+		r.From = types.StreamPosition(pos - 1)
+	}
+	if to := req.URL.Query().Get("to"); to != "" {
+		pos, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || pos < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid to parameter"),
+			}
+		}
+		r.To = types.StreamPosition(pos)
+	}
+
+	limit := defaultRelationsLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid limit parameter"),
+			}
+		}
+	}
+	if limit > maxRelationsLimit {
+		limit = maxRelationsLimit
+	}
+
+	ctx := req.Context()
+	joinedRoomIDs, err := syncDB.RoomIDsWithMembership(ctx, device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.RoomIDsWithMembership failed")
+		return jsonerror.InternalServerError()
+	}
+	var joined bool
+	for _, joinedRoomID := range joinedRoomIDs {
+		if joinedRoomID == roomID {
+			joined = true
+			break
+		}
+	}
+	if !joined {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room"),
+		}
+	}
+
+	originalEvents, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(originalEvents) == 0 || originalEvents[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+
+	relations, err := syncDB.RelationsForEvent(ctx, roomID, eventID, relType, eventType, r, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.RelationsForEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	relationIDs := make([]string, 0, len(relations))
+	for _, relation := range relations {
+		relationIDs = append(relationIDs, relation.EventID)
+	}
+	events, err := syncDB.Events(ctx, relationIDs)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	eventsByID := make(map[string]gomatrixserverlib.HeaderedEvent, len(events))
+	for _, event := range events {
+		eventsByID[event.EventID()] = event
+	}
+
+	res := relationsResponse{
+		Chunk:         []gomatrixserverlib.ClientEvent{},
+		OriginalEvent: gomatrixserverlib.HeaderedToClientEvent(originalEvents[0], gomatrixserverlib.FormatAll),
+	}
+	for _, relation := range relations {
+		// An event can claim to relate to an event in another room, but it
+		// is only a relation of this event if it's in the same room.
+		event, ok := eventsByID[relation.EventID]
+		if !ok || event.RoomID() != roomID {
+			continue
+		}
+		res.Chunk = append(res.Chunk, gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll))
+	}
+	if len(relations) == limit {
+		nextBatch := strconv.FormatInt(int64(relations[len(relations)-1].StreamPosition), 10)
+		res.NextBatch = &nextBatch
+	}
+
+	// The original event has its aggregations bundled along with the chunk.
+	bundled := append(res.Chunk, res.OriginalEvent)
+	if err = syncDB.BundleAggregations(ctx, roomID, bundled); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.BundleAggregations failed")
+		return jsonerror.InternalServerError()
+	}
+	res.Chunk, res.OriginalEvent = bundled[:len(bundled)-1], bundled[len(bundled)-1]
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
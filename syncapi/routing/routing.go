@@ -29,6 +29,7 @@ import (
 )
 
 const pathPrefixR0 = "/client/r0"
+const pathPrefixUnstable = "/client/unstable"
 
 // Setup configures the given mux with sync-server listeners
 //
@@ -37,27 +38,94 @@ const pathPrefixR0 = "/client/r0"
 // nolint: gocyclo
 func Setup(
 	publicAPIMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
+	notifier *sync.Notifier,
 	userAPI userapi.UserInternalAPI, federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
 	cfg *config.Dendrite,
 ) {
 	r0mux := publicAPIMux.PathPrefix(pathPrefixR0).Subrouter()
+	unstableMux := publicAPIMux.PathPrefix(pathPrefixUnstable).Subrouter()
 
 	// TODO: Add AS support for all handlers below.
-	r0mux.Handle("/sync", httputil.MakeAuthAPI("sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	r0mux.Handle("/sync", httputil.MakeGuestAuthAPI("sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingSyncRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/messages", httputil.MakeAuthAPI("room_messages", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/messages", httputil.MakeGuestAuthAPI("room_messages", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], federation, rsAPI, cfg)
+		return OnIncomingMessagesRequest(req, device, syncDB, vars["roomID"], federation, rsAPI, cfg)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/rooms/{roomID}/context/{eventID}",
+		httputil.MakeGuestAuthAPI("room_context", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetContext(req, device, syncDB, rsAPI, vars["roomID"], vars["eventID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/members",
+		httputil.MakeGuestAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetMemberships(req, device, vars["roomID"], syncDB, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/receipt/{receiptType}/{eventID}",
+		httputil.MakeGuestAuthAPI("set_receipt", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return SetReceipt(req, device, syncDB, notifier, vars["roomID"], vars["receiptType"], vars["eventID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/search",
+		httputil.MakeAuthAPI("search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Search(req, device, syncDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	// The relation type and event type are optional, so the same handler
+	// serves all three forms of the path. Clients use the unstable prefix
+	// until MSC2675 is merged into the spec.
+	relations := httputil.MakeAuthAPI("relations", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return GetRelations(req, device, syncDB, vars["roomID"], vars["eventID"], vars["relType"], vars["eventType"])
+	})
+	for _, m := range []*mux.Router{r0mux, unstableMux} {
+		m.Handle("/rooms/{roomID}/relations/{eventID}", relations).Methods(http.MethodGet, http.MethodOptions)
+		m.Handle("/rooms/{roomID}/relations/{eventID}/{relType}", relations).Methods(http.MethodGet, http.MethodOptions)
+		m.Handle("/rooms/{roomID}/relations/{eventID}/{relType}/{eventType}", relations).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	// Exporting isn't in the spec, so is only available with the unstable
+	// prefix.
+	unstableMux.Handle("/rooms/{roomID}/export",
+		httputil.MakeHTMLAPI("room_export", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				resErr := util.ErrorResponse(err)
+				return &resErr
+			}
+			return ExportRoomEvents(w, req, userAPI, syncDB, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/user/{userId}/filter",
-		httputil.MakeAuthAPI("put_filter", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("put_filter", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -67,7 +135,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/user/{userId}/filter/{filterId}",
-		httputil.MakeAuthAPI("get_filter", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeGuestAuthAPI("get_filter", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -0,0 +1,378 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// defaultSearchLimit is the number of results returned per page when the
+	// request doesn't specify a filter limit.
+	defaultSearchLimit = 10
+	// maxSearchLimit is the most results we'll return in a single page.
+	maxSearchLimit = 100
+	// maxSearchContextLimit is the most events we'll return either side of a
+	// result when the client asks for event context.
+	maxSearchContextLimit = 20
+)
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm   string                             `json:"search_term"`
+	Keys         []string                           `json:"keys"`
+	Filter       *gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                             `json:"order_by"`
+	EventContext *searchEventContext                `json:"event_context"`
+}
+
+type searchEventContext struct {
+	BeforeLimit    *int `json:"before_limit"`
+	AfterLimit     *int `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type searchResponse struct {
+	SearchCategories struct {
+		RoomEvents roomEventsResults `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsResults struct {
+	Count      int            `json:"count"`
+	Results    []searchResult `json:"results"`
+	Highlights []string       `json:"highlights"`
+	NextBatch  *string        `json:"next_batch,omitempty"`
+}
+
+type searchResult struct {
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+	Context *searchResultContext          `json:"context,omitempty"`
+}
+
+type searchResultContext struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	ProfileInfo  map[string]searchProfile        `json:"profile_info,omitempty"`
+}
+
+type searchProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// searchKeys are the keys which are searched when the request doesn't
+// specify any, which are all of the keys that we index.
+var searchKeys = []string{"content.body", "content.name", "content.topic"}
+
+// Search implements POST /_matrix/client/r0/search
+// Only the room_events category is supported. Results are limited to the
+// rooms that the user is currently joined to.
+func Search(req *http.Request, device *api.Device, syncDB storage.Database) util.JSONResponse {
+	var searchReq searchRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &searchReq); resErr != nil {
+		return *resErr
+	}
+	criteria := searchReq.SearchCategories.RoomEvents
+	if criteria == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Only the room_events search category is supported"),
+		}
+	}
+	if strings.TrimSpace(criteria.SearchTerm) == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("search_term must not be empty"),
+		}
+	}
+
+	keys := criteria.Keys
+	if len(keys) == 0 {
+		keys = searchKeys
+	}
+	for _, key := range keys {
+		if !isSearchKey(key) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unsupported search key " + key),
+			}
+		}
+	}
+
+	var orderByRank bool
+	switch criteria.OrderBy {
+	case "", "rank":
+		orderByRank = true
+	case "recent":
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("order_by must be one of rank or recent"),
+		}
+	}
+
+	// The next_batch token we hand out is the offset into the results.
+	var offset int
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		var err error
+		if offset, err = strconv.Atoi(nextBatch); err != nil || offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid next_batch token"),
+			}
+		}
+	}
+
+	limit := defaultSearchLimit
+	if criteria.Filter != nil && criteria.Filter.Limit > 0 {
+		limit = criteria.Filter.Limit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	ctx := req.Context()
+	joinedRoomIDs, err := syncDB.RoomIDsWithMembership(ctx, device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.RoomIDsWithMembership failed")
+		return jsonerror.InternalServerError()
+	}
+	roomIDs := filterSearchRooms(joinedRoomIDs, criteria.Filter)
+
+	var res searchResponse
+	results := &res.SearchCategories.RoomEvents
+	results.Results = []searchResult{}
+	results.Highlights = strings.Fields(strings.ToLower(criteria.SearchTerm))
+	if len(roomIDs) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+
+	matches, count, err := syncDB.SearchRoomEvents(ctx, criteria.SearchTerm, roomIDs, keys, orderByRank, limit, offset)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.SearchRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	results.Count = count
+	if offset+len(matches) < count {
+		nextBatch := strconv.Itoa(offset + len(matches))
+		results.NextBatch = &nextBatch
+	}
+
+	eventIDs := make([]string, 0, len(matches))
+	for _, match := range matches {
+		eventIDs = append(eventIDs, match.EventID)
+	}
+	events, err := syncDB.Events(ctx, eventIDs)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	eventsByID := make(map[string]gomatrixserverlib.HeaderedEvent, len(events))
+	for _, event := range events {
+		eventsByID[event.EventID()] = event
+	}
+
+	var latest types.StreamPosition
+	if criteria.EventContext != nil {
+		if latest, err = syncDB.SyncStreamPosition(ctx); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("syncDB.SyncStreamPosition failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	for _, match := range matches {
+		event, ok := eventsByID[match.EventID]
+		if !ok {
+			continue
+		}
+		result := searchResult{
+			Rank:   match.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+		}
+		if criteria.EventContext != nil {
+			result.Context, err = searchContext(ctx, device, syncDB, criteria.EventContext, match, latest)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("searchContext failed")
+				return jsonerror.InternalServerError()
+			}
+			if criteria.EventContext.IncludeProfile {
+				senders := append([]gomatrixserverlib.ClientEvent{result.Result}, result.Context.EventsBefore...)
+				senders = append(senders, result.Context.EventsAfter...)
+				result.Context.ProfileInfo, err = senderProfiles(ctx, syncDB, match.RoomID, senders)
+				if err != nil {
+					util.GetLogger(ctx).WithError(err).Error("senderProfiles failed")
+					return jsonerror.InternalServerError()
+				}
+			}
+		}
+		results.Results = append(results.Results, result)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// searchContext fetches the events either side of a search result, in
+// stream order.
+func searchContext(
+	ctx context.Context, device *api.Device, syncDB storage.Database,
+	eventContext *searchEventContext, match types.SearchResult, latest types.StreamPosition,
+) (*searchResultContext, error) {
+	beforeLimit := contextLimit(eventContext.BeforeLimit)
+	afterLimit := contextLimit(eventContext.AfterLimit)
+	res := &searchResultContext{
+		EventsBefore: []gomatrixserverlib.ClientEvent{},
+		EventsAfter:  []gomatrixserverlib.ClientEvent{},
+	}
+
+	start := types.StreamingToken{PDUPosition: match.StreamPosition - 1}
+	end := types.StreamingToken{PDUPosition: match.StreamPosition}
+	if beforeLimit > 0 {
+		from := types.StreamingToken{PDUPosition: match.StreamPosition - 1}
+		to := types.StreamingToken{}
+		before, err := syncDB.GetEventsInStreamingRange(ctx, &from, &to, match.RoomID, beforeLimit, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(before) > 0 {
+			start = types.StreamingToken{PDUPosition: before[len(before)-1].StreamPosition - 1}
+		}
+		events := syncDB.StreamEventsToEvents(device, before)
+		res.EventsBefore = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
+	}
+	if afterLimit > 0 && latest > match.StreamPosition {
+		from := types.StreamingToken{PDUPosition: match.StreamPosition}
+		to := types.StreamingToken{PDUPosition: latest}
+		after, err := syncDB.GetEventsInStreamingRange(ctx, &from, &to, match.RoomID, afterLimit, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(after) > 0 {
+			end = types.StreamingToken{PDUPosition: after[len(after)-1].StreamPosition}
+		}
+		events := syncDB.StreamEventsToEvents(device, after)
+		res.EventsAfter = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
+	}
+	res.Start = start.String()
+	res.End = end.String()
+	return res, nil
+}
+
+// senderProfiles returns the display names and avatars that the senders of
+// the given events currently have in the room. Senders who are no longer in
+// the room are left out.
+func senderProfiles(
+	ctx context.Context, syncDB storage.Database, roomID string, events []gomatrixserverlib.ClientEvent,
+) (map[string]searchProfile, error) {
+	profiles := make(map[string]searchProfile)
+	seen := make(map[string]bool)
+	for _, event := range events {
+		if seen[event.Sender] {
+			continue
+		}
+		seen[event.Sender] = true
+		memberEvent, err := syncDB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, event.Sender)
+		if err != nil {
+			return nil, err
+		}
+		if memberEvent == nil {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(memberEvent.Content(), &content); err != nil {
+			// A member event we can't parse just means no profile.
+			continue
+		}
+		profiles[event.Sender] = searchProfile{
+			DisplayName: content.DisplayName,
+			AvatarURL:   content.AvatarURL,
+		}
+	}
+	return profiles, nil
+}
+
+// contextLimit returns the number of context events to fetch, which
+// defaults to 5 as per the spec.
+func contextLimit(limit *int) int {
+	switch {
+	case limit == nil:
+		return 5
+	case *limit < 0:
+		return 0
+	case *limit > maxSearchContextLimit:
+		return maxSearchContextLimit
+	default:
+		return *limit
+	}
+}
+
+func isSearchKey(key string) bool {
+	for _, k := range searchKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSearchRooms restricts the joined rooms to those allowed by the
+// rooms and not_rooms fields of the filter.
+func filterSearchRooms(joinedRoomIDs []string, filter *gomatrixserverlib.RoomEventFilter) []string {
+	if filter == nil {
+		return joinedRoomIDs
+	}
+	allowed := make(map[string]bool, len(filter.Rooms))
+	for _, roomID := range filter.Rooms {
+		allowed[roomID] = true
+	}
+	excluded := make(map[string]bool, len(filter.NotRooms))
+	for _, roomID := range filter.NotRooms {
+		excluded[roomID] = true
+	}
+	roomIDs := make([]string, 0, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		if excluded[roomID] || (len(allowed) > 0 && !allowed[roomID]) {
+			continue
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
@@ -30,6 +30,8 @@ type Database interface {
 	internal.PartitionStorer
 	// AllJoinedUsersInRooms returns a map of room ID to a list of all joined user IDs.
 	AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error)
+	// AllPeekingDevicesInRooms returns a map of room ID to a list of all peeking devices.
+	AllPeekingDevicesInRooms(ctx context.Context) (map[string][]types.PeekingDevice, error)
 	// Events lookups a list of event by their event ID.
 	// Returns a list of events matching the requested IDs found in the database.
 	// If an event is not found in the database then it will be omitted from the list.
@@ -60,9 +62,11 @@ type Database interface {
 	IncrementalSync(ctx context.Context, res *types.Response, device userapi.Device, fromPos, toPos types.StreamingToken, numRecentEventsPerRoom int, wantFullState bool) (*types.Response, error)
 	// CompleteSync returns a complete /sync API response for the given user. A response object
 	// must be provided for CompleteSync to populate - it will not create one.
-	CompleteSync(ctx context.Context, res *types.Response, device userapi.Device, numRecentEventsPerRoom int) (*types.Response, error)
+	// If includeLeave is true then rooms which the user has left or been banned from are also returned.
+	CompleteSync(ctx context.Context, res *types.Response, device userapi.Device, numRecentEventsPerRoom int, includeLeave bool) (*types.Response, error)
 	// GetAccountDataInRange returns all account data for a given user inserted or
 	// updated between two given positions
+	// Room account data is only returned for rooms which the user is joined to
 	// Returns a map following the format data[roomID] = []dataTypes
 	// If no data is retrieved, returns an empty map
 	// If there was an issue with the retrieval, returns an error
@@ -74,13 +78,41 @@ type Database interface {
 	// creates a new row, else update the existing one
 	// Returns an error if there was an issue with the upsert
 	UpsertAccountData(ctx context.Context, userID, roomID, dataType string) (types.StreamPosition, error)
-	// AddInviteEvent stores a new invite event for a user.
-	// If the invite was successfully stored this returns the stream ID it was stored at.
+	// IncrementNotificationCounts adds to the unread notification and highlight counts for the given user in the
+	// given room. Returns the stream position of the update.
+	IncrementNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	// ResetNotificationCounts clears the unread notification counts for the given user in the given room, e.g.
+	// because the user has sent a read receipt. All of the counts are cleared, as the events which they were
+	// counted from aren't stored. Returns a stream position of 0 if there was nothing to reset.
+	ResetNotificationCounts(ctx context.Context, userID, roomID string) (types.StreamPosition, error)
+	// UnreadNotificationCount returns the total number of unread notifications of the given user across
+	// all rooms.
+	UnreadNotificationCount(ctx context.Context, userID string) (int, error)
+	// AddInviteEvent stores a new invite or knock event for a user.
+	// If the invite was successfully stored this returns the stream ID it was stored at, or 0 if the invite was
+	// already known.
 	// Returns an error if there was a problem communicating with the database.
 	AddInviteEvent(ctx context.Context, inviteEvent gomatrixserverlib.HeaderedEvent) (types.StreamPosition, error)
-	// RetireInviteEvent removes an old invite event from the database. Returns the new position of the retired invite.
+	// RetireInviteEvent removes an old invite event from the database. Returns the new position of the retired invite,
+	// or 0 if there was no active invite with that event ID.
 	// Returns an error if there was a problem communicating with the database.
 	RetireInviteEvent(ctx context.Context, inviteEventID string) (types.StreamPosition, error)
+	// RetireInviteEventsForUser retires the invite and knock events for the user in the room which are still active,
+	// e.g. because they have joined or left the room. Returns the new position of the retired events, or 0 if there
+	// were none.
+	// Returns an error if there was a problem communicating with the database.
+	RetireInviteEventsForUser(ctx context.Context, roomID, userID string) (types.StreamPosition, error)
+	// AddPeek adds a new peek to our DB for a given room by a given user's device.
+	// Returns the stream position of the peek if it was successfully stored.
+	AddPeek(ctx context.Context, roomID, userID, deviceID string) (types.StreamPosition, error)
+	// DeletePeek removes the peek into a given room by a given user's device. Returns a stream position of 0 if
+	// there was no such peek.
+	DeletePeek(ctx context.Context, roomID, userID, deviceID string) (types.StreamPosition, error)
+	// DeletePeeks removes the peeks into a given room by all of a user's devices. Returns a stream position of 0
+	// if there were no such peeks.
+	DeletePeeks(ctx context.Context, roomID, userID string) (types.StreamPosition, error)
+	// DeleteRoomPeeks removes all peeks into a given room. Returns a stream position of 0 if there were no peeks.
+	DeleteRoomPeeks(ctx context.Context, roomID string) (types.StreamPosition, error)
 	// SetTypingTimeoutCallback sets a callback function that is called right after
 	// a user is removed from the typing user list due to timeout.
 	SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn)
@@ -100,14 +132,15 @@ type Database interface {
 	BackwardExtremitiesForRoom(ctx context.Context, roomID string) (backwardExtremities map[string][]string, err error)
 	// MaxTopologicalPosition returns the highest topological position for a given room.
 	MaxTopologicalPosition(ctx context.Context, roomID string) (types.TopologyToken, error)
+	// StreamToTopologicalPosition returns the topological position in a given room which covers the same events as the
+	// given stream position, so that /sync tokens can be used to paginate /messages.
+	StreamToTopologicalPosition(ctx context.Context, roomID string, streamPos types.StreamPosition) (types.TopologyToken, error)
 	// StreamEventsToEvents converts streamEvent to Event. If device is non-nil and
 	// matches the streamevent.transactionID device then the transaction ID gets
 	// added to the unsigned section of the output event.
 	StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent
 	// SyncStreamPosition returns the latest position in the sync stream. Returns 0 if there are no events yet.
 	SyncStreamPosition(ctx context.Context) (types.StreamPosition, error)
-	// AddSendToDevice increases the EDU position in the cache and returns the stream position.
-	AddSendToDevice() types.StreamPosition
 	// SendToDeviceUpdatesForSync returns a list of send-to-device updates. It returns three lists:
 	// - "events": a list of send-to-device events that should be included in the sync
 	// - "changes": a list of send-to-device events that should be updated in the database by
@@ -117,8 +150,9 @@ type Database interface {
 	// The token supplied should be the current requested sync token, e.g. from the "since"
 	// parameter.
 	SendToDeviceUpdatesForSync(ctx context.Context, userID, deviceID string, token types.StreamingToken) (events []types.SendToDeviceEvent, changes []types.SendToDeviceNID, deletions []types.SendToDeviceNID, err error)
-	// StoreNewSendForDeviceMessage stores a new send-to-device event for a user's device.
-	StoreNewSendForDeviceMessage(ctx context.Context, streamPos types.StreamPosition, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) (types.StreamPosition, error)
+	// StoreNewSendForDeviceMessage stores a new send-to-device event for a user's device
+	// and returns the send-to-device stream position of the new event.
+	StoreNewSendForDeviceMessage(ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) (types.StreamPosition, error)
 	// CleanSendToDeviceUpdates will update or remove any send-to-device updates based on the
 	// result to a previous call to SendDeviceUpdatesForSync. This is separate as it allows
 	// SendToDeviceUpdatesForSync to be called multiple times if needed (e.g. before and after
@@ -138,4 +172,30 @@ type Database interface {
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
+	// SearchRoomEvents returns the events in the given rooms whose indexed keys match the search term, along
+	// with the total number of matching events. Results are ordered by rank, or by recency if orderByRank is false.
+	SearchRoomEvents(ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
+	// RoomIDsWithMembership returns the IDs of the rooms in which the user has the given membership.
+	RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error)
+	// RelationsForEvent returns the events in the room relating to the given event within the range, optionally
+	// restricted to a relation type and event type.
+	RelationsForEvent(ctx context.Context, roomID, relatesToID, relType, eventType string, r types.Range, limit int) ([]types.Relation, error)
+	// BundleAggregations adds the aggregations of the relations of each of the events, which are all in the given
+	// room, to their unsigned data.
+	BundleAggregations(ctx context.Context, roomID string, events []gomatrixserverlib.ClientEvent) error
+	// PurgeOldEvents deletes the events in each room which are older than the given timestamp, if it isn't zero,
+	// or which are beyond the newest maxEventsPerRoom events, if that isn't zero. The newest event in each room is
+	// always kept. Returns the number of events which were deleted.
+	PurgeOldEvents(ctx context.Context, olderThan gomatrixserverlib.Timestamp, maxEventsPerRoom int) (int64, error)
+	// RoomsPurgedSince returns the rooms which have had events purged after the given stream position. Incremental
+	// syncs of these rooms from that position can't be worked out correctly.
+	RoomsPurgedSince(ctx context.Context, since types.StreamPosition) ([]string, error)
+	// PurgeRoom deletes the room's events, state and account data, for a room which the roomserver has purged. The
+	// members' leave events are kept and the room's invites and peeks are retired, so that clients find out that
+	// the room has gone. Returns the stream position of the retirements and the users whose invites were retired,
+	// which are valid even if the purge then fails.
+	PurgeRoom(ctx context.Context, roomID string) (types.StreamPosition, []string, error)
+	// PurgeSendToDeviceMessages deletes all but the newest `keep` send-to-device messages waiting for each device.
+	// Returns the number of messages which were deleted.
+	PurgeSendToDeviceMessages(ctx context.Context, keep int) (int64, error)
 }
@@ -61,6 +61,10 @@ const selectAccountDataInRangeSQL = "" +
 	" WHERE user_id = $1 AND id > $2 AND id <= $3" +
 	" AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
 	" AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
+	" AND ( room_id = '' OR room_id IN (" +
+	"  SELECT room_id FROM syncapi_current_room_state" +
+	"  WHERE type = 'm.room.member' AND state_key = $1 AND membership = 'join'" +
+	" ) )" +
 	" ORDER BY id ASC LIMIT $6"
 
 const selectMaxAccountDataIDSQL = "" +
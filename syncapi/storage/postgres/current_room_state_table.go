@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 const currentRoomStateSchema = `
@@ -72,6 +73,9 @@ const deleteRoomStateByEventIDSQL = "" +
 const selectRoomIDsWithMembershipSQL = "" +
 	"SELECT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2"
 
+const selectMembershipPositionsSQL = "" +
+	"SELECT room_id, added_at FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2"
+
 const selectCurrentStateSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1" +
 	" AND ( $2::text[] IS NULL OR     sender  = ANY($2)  )" +
@@ -84,6 +88,16 @@ const selectCurrentStateSQL = "" +
 const selectJoinedUsersSQL = "" +
 	"SELECT room_id, state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND membership = 'join'"
 
+const selectMembershipCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_current_room_state WHERE type = 'm.room.member' AND room_id = $1 AND membership = $2"
+
+// Prefer members who are joined or invited, falling back to those who have
+// left or been banned if there aren't enough of them.
+const selectHeroesSQL = "" +
+	"SELECT state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND room_id = $1 AND state_key != $2" +
+	" ORDER BY CASE WHEN membership = 'join' OR membership = 'invite' THEN 0 ELSE 1 END, added_at ASC" +
+	" LIMIT $3"
+
 const selectStateEventSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
 
@@ -99,10 +113,13 @@ type currentRoomStateStatements struct {
 	upsertRoomStateStmt             *sql.Stmt
 	deleteRoomStateByEventIDStmt    *sql.Stmt
 	selectRoomIDsWithMembershipStmt *sql.Stmt
+	selectMembershipPositionsStmt   *sql.Stmt
 	selectCurrentStateStmt          *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
 	selectEventsWithEventIDsStmt    *sql.Stmt
 	selectStateEventStmt            *sql.Stmt
+	selectMembershipCountStmt       *sql.Stmt
+	selectHeroesStmt                *sql.Stmt
 }
 
 func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
@@ -120,6 +137,9 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 	if s.selectRoomIDsWithMembershipStmt, err = db.Prepare(selectRoomIDsWithMembershipSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMembershipPositionsStmt, err = db.Prepare(selectMembershipPositionsSQL); err != nil {
+		return nil, err
+	}
 	if s.selectCurrentStateStmt, err = db.Prepare(selectCurrentStateSQL); err != nil {
 		return nil, err
 	}
@@ -132,9 +152,47 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMembershipCountStmt, err = db.Prepare(selectMembershipCountSQL); err != nil {
+		return nil, err
+	}
+	if s.selectHeroesStmt, err = db.Prepare(selectHeroesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+// SelectMembershipCount returns the number of users in the given room with the given membership.
+func (s *currentRoomStateStatements) SelectMembershipCount(
+	ctx context.Context, txn *sql.Tx, roomID, membership string,
+) (count int, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipCountStmt)
+	err = stmt.QueryRowContext(ctx, roomID, membership).Scan(&count)
+	return
+}
+
+// SelectHeroes returns up to limit user IDs from the membership of the given room, excluding
+// the given user. Joined and invited users are returned before those who have left.
+func (s *currentRoomStateStatements) SelectHeroes(
+	ctx context.Context, txn *sql.Tx, roomID, excludeUserID string, limit int,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectHeroesStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, excludeUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectHeroes: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		result = append(result, userID)
+	}
+	return result, rows.Err()
+}
+
 // SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 func (s *currentRoomStateStatements) SelectJoinedUsers(
 	ctx context.Context,
@@ -184,6 +242,33 @@ func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 	return result, rows.Err()
 }
 
+// SelectMembershipPositions returns the rooms in which the given user has the
+// given membership, along with the stream position at which they got it.
+func (s *currentRoomStateStatements) SelectMembershipPositions(
+	ctx context.Context,
+	txn *sql.Tx,
+	userID string,
+	membership string,
+) (map[string]types.StreamPosition, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipPositionsStmt)
+	rows, err := stmt.QueryContext(ctx, userID, membership)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMembershipPositions: rows.close() failed")
+
+	result := make(map[string]types.StreamPosition)
+	for rows.Next() {
+		var roomID string
+		var addedAt sql.NullInt64
+		if err := rows.Scan(&roomID, &addedAt); err != nil {
+			return nil, err
+		}
+		result[roomID] = types.StreamPosition(addedAt.Int64)
+	}
+	return result, rows.Err()
+}
+
 // SelectCurrentState returns all the current state events for the given room.
 func (s *currentRoomStateStatements) SelectCurrentState(
 	ctx context.Context, txn *sql.Tx, roomID string,
@@ -218,13 +303,8 @@ func (s *currentRoomStateStatements) UpsertRoomState(
 	ctx context.Context, txn *sql.Tx,
 	event gomatrixserverlib.HeaderedEvent, membership *string, addedAt types.StreamPosition,
 ) error {
-	// Parse content as JSON and search for an "url" key
-	containsURL := false
-	var content map[string]interface{}
-	if json.Unmarshal(event.Content(), &content) != nil {
-		// Set containsURL to true if url is present
-		_, containsURL = content["url"]
-	}
+	// Look for a "url" key without decoding the whole of the content
+	containsURL := gjson.GetBytes(event.Content(), "url").Exists()
 
 	headeredJSON, err := json.Marshal(event)
 	if err != nil {
@@ -46,27 +46,42 @@ CREATE INDEX IF NOT EXISTS syncapi_invites_event_id_idx
 	ON syncapi_invite_events (event_id);
 `
 
+// An invite which we already know about, even if it has since been retired,
+// is ignored so that it isn't sent to the user again.
 const insertInviteEventSQL = "" +
 	"INSERT INTO syncapi_invite_events (" +
 	" room_id, event_id, target_user_id, headered_event_json, deleted" +
-	") VALUES ($1, $2, $3, $4, FALSE) RETURNING id"
+	") SELECT $1, $2, $3, $4, FALSE" +
+	" WHERE NOT EXISTS (SELECT 1 FROM syncapi_invite_events WHERE event_id = $2)" +
+	" RETURNING id"
 
 const deleteInviteEventSQL = "" +
-	"UPDATE syncapi_invite_events SET deleted=TRUE, id=nextval('syncapi_stream_id') WHERE event_id = $1 RETURNING id"
+	"UPDATE syncapi_invite_events SET deleted=TRUE, id=nextval('syncapi_stream_id')" +
+	" WHERE event_id = $1 AND deleted = FALSE RETURNING id"
 
 const selectInviteEventsInRangeSQL = "" +
 	"SELECT room_id, headered_event_json, deleted FROM syncapi_invite_events" +
 	" WHERE target_user_id = $1 AND id > $2 AND id <= $3" +
 	" ORDER BY id DESC"
 
+const selectActiveInviteEventIDsSQL = "" +
+	"SELECT event_id FROM syncapi_invite_events" +
+	" WHERE room_id = $1 AND target_user_id = $2 AND deleted = FALSE"
+
+const selectActiveRoomInvitesSQL = "" +
+	"SELECT event_id, target_user_id FROM syncapi_invite_events" +
+	" WHERE room_id = $1 AND deleted = FALSE"
+
 const selectMaxInviteIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_invite_events"
 
 type inviteEventsStatements struct {
-	insertInviteEventStmt         *sql.Stmt
-	selectInviteEventsInRangeStmt *sql.Stmt
-	deleteInviteEventStmt         *sql.Stmt
-	selectMaxInviteIDStmt         *sql.Stmt
+	insertInviteEventStmt          *sql.Stmt
+	selectInviteEventsInRangeStmt  *sql.Stmt
+	deleteInviteEventStmt          *sql.Stmt
+	selectActiveInviteEventIDsStmt *sql.Stmt
+	selectActiveRoomInvitesStmt    *sql.Stmt
+	selectMaxInviteIDStmt          *sql.Stmt
 }
 
 func NewPostgresInvitesTable(db *sql.DB) (tables.Invites, error) {
@@ -84,6 +99,12 @@ func NewPostgresInvitesTable(db *sql.DB) (tables.Invites, error) {
 	if s.deleteInviteEventStmt, err = db.Prepare(deleteInviteEventSQL); err != nil {
 		return nil, err
 	}
+	if s.selectActiveInviteEventIDsStmt, err = db.Prepare(selectActiveInviteEventIDsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectActiveRoomInvitesStmt, err = db.Prepare(selectActiveRoomInvitesSQL); err != nil {
+		return nil, err
+	}
 	if s.selectMaxInviteIDStmt, err = db.Prepare(selectMaxInviteIDSQL); err != nil {
 		return nil, err
 	}
@@ -106,6 +127,9 @@ func (s *inviteEventsStatements) InsertInviteEvent(
 		*inviteEvent.StateKey(),
 		headeredJSON,
 	).Scan(&streamPos)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 	return
 }
 
@@ -113,11 +137,16 @@ func (s *inviteEventsStatements) DeleteInviteEvent(
 	ctx context.Context, inviteEventID string,
 ) (sp types.StreamPosition, err error) {
 	err = s.deleteInviteEventStmt.QueryRowContext(ctx, inviteEventID).Scan(&sp)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 	return
 }
 
 // selectInviteEventsInRange returns a map of room ID to invite event for the
-// active invites for the target user ID in the supplied range.
+// active invites for the target user ID in the supplied range, and another for
+// the retired ones. Only the newest invite for each room is returned, so a room
+// is never both invited and retired.
 func (s *inviteEventsStatements) SelectInviteEventsInRange(
 	ctx context.Context, txn *sql.Tx, targetUserID string, r types.Range,
 ) (map[string]gomatrixserverlib.HeaderedEvent, map[string]gomatrixserverlib.HeaderedEvent, error) {
@@ -138,6 +167,13 @@ func (s *inviteEventsStatements) SelectInviteEventsInRange(
 		if err = rows.Scan(&roomID, &eventJSON, &deleted); err != nil {
 			return nil, nil, err
 		}
+		// the rows are newest first
+		if _, ok := result[roomID]; ok {
+			continue
+		}
+		if _, ok := retired[roomID]; ok {
+			continue
+		}
 
 		var event gomatrixserverlib.HeaderedEvent
 		if err := json.Unmarshal(eventJSON, &event); err != nil {
@@ -153,6 +189,46 @@ func (s *inviteEventsStatements) SelectInviteEventsInRange(
 	return result, retired, rows.Err()
 }
 
+func (s *inviteEventsStatements) SelectActiveInviteEventIDs(
+	ctx context.Context, txn *sql.Tx, roomID, targetUserID string,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectActiveInviteEventIDsStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, targetUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectActiveInviteEventIDs: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *inviteEventsStatements) SelectActiveRoomInvites(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (map[string]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectActiveRoomInvitesStmt)
+	rows, err := stmt.QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectActiveRoomInvites: rows.close() failed")
+	invites := make(map[string]string)
+	for rows.Next() {
+		var eventID, targetUserID string
+		if err = rows.Scan(&eventID, &targetUserID); err != nil {
+			return nil, err
+		}
+		invites[eventID] = targetUserID
+	}
+	return invites, rows.Err()
+}
+
 func (s *inviteEventsStatements) SelectMaxInviteID(
 	ctx context.Context, txn *sql.Tx,
 ) (id int64, err error) {
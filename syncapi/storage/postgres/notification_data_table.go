@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const notificationDataSchema = `
+-- This sequence is shared between all the tables generated from kafka logs.
+CREATE SEQUENCE IF NOT EXISTS syncapi_stream_id;
+
+-- Stores the unread notification counts for each user in each room, and
+-- the stream ID when the counts were last changed.
+CREATE TABLE IF NOT EXISTS syncapi_notification_data (
+    -- An incrementing ID which denotes the position in the log that this update resides at.
+    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+    -- ID of the user the counts belong to
+    user_id TEXT NOT NULL,
+    -- ID of the room the counts are for
+    room_id TEXT NOT NULL,
+    -- The number of unread events which matched a notify push rule
+    notification_count BIGINT NOT NULL DEFAULT 0,
+    -- The number of unread events which matched a highlight push rule
+    highlight_count BIGINT NOT NULL DEFAULT 0,
+
+    CONSTRAINT syncapi_notification_data_unique UNIQUE (user_id, room_id)
+);
+`
+
+const incrementNotificationCountsSQL = "" +
+	"INSERT INTO syncapi_notification_data (user_id, room_id, notification_count, highlight_count)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_notification_data_unique" +
+	" DO UPDATE SET id = EXCLUDED.id," +
+	"  notification_count = syncapi_notification_data.notification_count + EXCLUDED.notification_count," +
+	"  highlight_count = syncapi_notification_data.highlight_count + EXCLUDED.highlight_count" +
+	" RETURNING id"
+
+const resetNotificationCountsSQL = "" +
+	"UPDATE syncapi_notification_data" +
+	" SET id = nextval('syncapi_stream_id'), notification_count = 0, highlight_count = 0" +
+	" WHERE user_id = $1 AND room_id = $2 AND (notification_count > 0 OR highlight_count > 0)" +
+	" RETURNING id"
+
+const selectUserNotificationCountsSQL = "" +
+	"SELECT room_id, id, notification_count, highlight_count FROM syncapi_notification_data" +
+	" WHERE user_id = $1"
+
+const selectMaxNotificationIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_notification_data"
+
+type notificationDataStatements struct {
+	incrementNotificationCountsStmt  *sql.Stmt
+	resetNotificationCountsStmt      *sql.Stmt
+	selectUserNotificationCountsStmt *sql.Stmt
+	selectMaxNotificationIDStmt      *sql.Stmt
+}
+
+func NewPostgresNotificationDataTable(db *sql.DB) (tables.NotificationData, error) {
+	s := &notificationDataStatements{}
+	_, err := db.Exec(notificationDataSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.incrementNotificationCountsStmt, err = db.Prepare(incrementNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.resetNotificationCountsStmt, err = db.Prepare(resetNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectUserNotificationCountsStmt, err = db.Prepare(selectUserNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxNotificationIDStmt, err = db.Prepare(selectMaxNotificationIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *notificationDataStatements) IncrementNotificationCounts(
+	ctx context.Context, txn *sql.Tx,
+	userID, roomID string, notificationCount, highlightCount int,
+) (pos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, s.incrementNotificationCountsStmt)
+	err = stmt.QueryRowContext(ctx, userID, roomID, notificationCount, highlightCount).Scan(&pos)
+	return
+}
+
+func (s *notificationDataStatements) ResetNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) (pos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, s.resetNotificationCountsStmt)
+	err = stmt.QueryRowContext(ctx, userID, roomID).Scan(&pos)
+	if err == sql.ErrNoRows {
+		// There was nothing to reset.
+		return 0, nil
+	}
+	return
+}
+
+func (s *notificationDataStatements) SelectUserNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (map[string]types.NotificationData, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectUserNotificationCountsStmt)
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUserNotificationCounts: rows.close() failed")
+
+	counts := make(map[string]types.NotificationData)
+	for rows.Next() {
+		var roomID string
+		var data types.NotificationData
+		if err = rows.Scan(&roomID, &data.StreamPosition, &data.NotificationCount, &data.HighlightCount); err != nil {
+			return nil, err
+		}
+		counts[roomID] = data
+	}
+	return counts, rows.Err()
+}
+
+func (s *notificationDataStatements) SelectMaxNotificationID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxNotificationIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 const outputRoomEventsSchema = `
@@ -115,15 +116,35 @@ const selectStateInRangeSQL = "" +
 	" ORDER BY id ASC" +
 	" LIMIT $8"
 
+const selectRemovedStateEventIDsSQL = "" +
+	"SELECT remove_state_ids FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND id > $2 AND remove_state_ids IS NOT NULL" +
+	" AND ( $3::text[] IS NULL OR     type LIKE ANY($3)  )" +
+	" AND ( $4::text[] IS NULL OR NOT(type LIKE ANY($4)) )"
+
+const selectRoomIDsWithEventsSQL = "" +
+	"SELECT DISTINCT room_id FROM syncapi_output_room_events"
+
+const selectPositionOfNthNewestEventSQL = "" +
+	"SELECT id FROM syncapi_output_room_events WHERE room_id = $1" +
+	" ORDER BY id DESC LIMIT 1 OFFSET $2"
+
+const deleteEventsUpToSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1 AND id <= $2"
+
 type outputRoomEventsStatements struct {
-	insertEventStmt               *sql.Stmt
-	selectEventsStmt              *sql.Stmt
-	selectMaxEventIDStmt          *sql.Stmt
-	selectRecentEventsStmt        *sql.Stmt
-	selectRecentEventsForSyncStmt *sql.Stmt
-	selectEarlyEventsStmt         *sql.Stmt
-	selectStateInRangeStmt        *sql.Stmt
-	updateEventJSONStmt           *sql.Stmt
+	insertEventStmt                    *sql.Stmt
+	selectEventsStmt                   *sql.Stmt
+	selectMaxEventIDStmt               *sql.Stmt
+	selectRecentEventsStmt             *sql.Stmt
+	selectRecentEventsForSyncStmt      *sql.Stmt
+	selectEarlyEventsStmt              *sql.Stmt
+	selectStateInRangeStmt             *sql.Stmt
+	selectRemovedStateEventIDsStmt     *sql.Stmt
+	updateEventJSONStmt                *sql.Stmt
+	selectRoomIDsWithEventsStmt        *sql.Stmt
+	selectPositionOfNthNewestEventStmt *sql.Stmt
+	deleteEventsUpToStmt               *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -153,9 +174,21 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 	if s.selectStateInRangeStmt, err = db.Prepare(selectStateInRangeSQL); err != nil {
 		return nil, err
 	}
+	if s.selectRemovedStateEventIDsStmt, err = db.Prepare(selectRemovedStateEventIDsSQL); err != nil {
+		return nil, err
+	}
 	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONSQL); err != nil {
 		return nil, err
 	}
+	if s.selectRoomIDsWithEventsStmt, err = db.Prepare(selectRoomIDsWithEventsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectPositionOfNthNewestEventStmt, err = db.Prepare(selectPositionOfNthNewestEventSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteEventsUpToStmt, err = db.Prepare(deleteEventsUpToSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -278,13 +311,8 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		txnID = &transactionID.TransactionID
 	}
 
-	// Parse content as JSON and search for an "url" key
-	containsURL := false
-	var content map[string]interface{}
-	if json.Unmarshal(event.Content(), &content) != nil {
-		// Set containsURL to true if url is present
-		_, containsURL = content["url"]
-	}
+	// Look for a "url" key without decoding the whole of the content
+	containsURL := gjson.GetBytes(event.Content(), "url").Exists()
 
 	var headeredJSON []byte
 	headeredJSON, err = json.Marshal(event)
@@ -431,3 +459,71 @@ func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 	}
 	return result, rows.Err()
 }
+
+func (s *outputRoomEventsStatements) SelectRoomIDsWithEvents(
+	ctx context.Context, txn *sql.Tx,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomIDsWithEventsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomIDsWithEvents: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) SelectRemovedStateEventIDs(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition,
+	stateFilter *gomatrixserverlib.StateFilter,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRemovedStateEventIDsStmt)
+	rows, err := stmt.QueryContext(
+		ctx, roomID, pos,
+		pq.StringArray(filterConvertTypeWildcardToSQL(stateFilter.Types)),
+		pq.StringArray(filterConvertTypeWildcardToSQL(stateFilter.NotTypes)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRemovedStateEventIDs: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var delIDs pq.StringArray
+		if err = rows.Scan(&delIDs); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, delIDs...)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) SelectPositionOfNthNewestEvent(
+	ctx context.Context, txn *sql.Tx, roomID string, n int,
+) (types.StreamPosition, error) {
+	var pos types.StreamPosition
+	stmt := sqlutil.TxStmt(txn, s.selectPositionOfNthNewestEventStmt)
+	err := stmt.QueryRowContext(ctx, roomID, n).Scan(&pos)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return pos, err
+}
+
+func (s *outputRoomEventsStatements) DeleteEventsUpTo(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition,
+) (int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteEventsUpToStmt)
+	res, err := stmt.ExecContext(ctx, roomID, pos)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
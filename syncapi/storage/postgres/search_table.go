@@ -0,0 +1,134 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const searchSchema = `
+-- Stores a full-text index of the searchable parts of room events.
+CREATE TABLE IF NOT EXISTS syncapi_search (
+    -- The event ID of the indexed event
+    event_id TEXT PRIMARY KEY,
+    -- The room ID of the indexed event
+    room_id TEXT NOT NULL,
+    -- The part of the event which was indexed, e.g. content.body
+    key TEXT NOT NULL,
+    -- The stream position of the event, used for ordering by recency
+    stream_pos BIGINT NOT NULL,
+    -- The indexed text
+    vector TSVECTOR NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_search_vector_idx ON syncapi_search USING GIN(vector);
+CREATE INDEX IF NOT EXISTS syncapi_search_room_id_idx ON syncapi_search(room_id);
+`
+
+const insertSearchEntrySQL = "" +
+	"INSERT INTO syncapi_search (event_id, room_id, key, stream_pos, vector)" +
+	" VALUES ($1, $2, $3, $4, to_tsvector('english', $5))" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const deleteSearchEntrySQL = "" +
+	"DELETE FROM syncapi_search WHERE event_id = $1"
+
+const selectSearchResultsByRankSQL = "" +
+	"SELECT event_id, room_id, stream_pos, ts_rank_cd(vector, query) AS rank, COUNT(*) OVER () AS total" +
+	" FROM syncapi_search, plainto_tsquery('english', $1) query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT $4 OFFSET $5"
+
+const selectSearchResultsByRecencySQL = "" +
+	"SELECT event_id, room_id, stream_pos, ts_rank_cd(vector, query) AS rank, COUNT(*) OVER () AS total" +
+	" FROM syncapi_search, plainto_tsquery('english', $1) query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY stream_pos DESC LIMIT $4 OFFSET $5"
+
+type searchStatements struct {
+	insertSearchEntryStmt            *sql.Stmt
+	deleteSearchEntryStmt            *sql.Stmt
+	selectSearchResultsByRankStmt    *sql.Stmt
+	selectSearchResultsByRecencyStmt *sql.Stmt
+}
+
+func NewPostgresSearchTable(db *sql.DB) (tables.Search, error) {
+	s := &searchStatements{}
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertSearchEntryStmt, err = db.Prepare(insertSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEntryStmt, err = db.Prepare(deleteSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultsByRankStmt, err = db.Prepare(selectSearchResultsByRankSQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultsByRecencyStmt, err = db.Prepare(selectSearchResultsByRecencySQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEntry(
+	ctx context.Context, txn *sql.Tx,
+	eventID, roomID, key string, pos types.StreamPosition, content string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertSearchEntryStmt)
+	_, err := stmt.ExecContext(ctx, eventID, roomID, key, pos, content)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEntry(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteSearchEntryStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, txn *sql.Tx,
+	searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int,
+) (results []types.SearchResult, count int, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectSearchResultsByRecencyStmt)
+	if orderByRank {
+		stmt = sqlutil.TxStmt(txn, s.selectSearchResultsByRankStmt)
+	}
+	rows, err := stmt.QueryContext(ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys), limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSearchResults: rows.close() failed")
+
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.StreamPosition, &result.Rank, &count); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
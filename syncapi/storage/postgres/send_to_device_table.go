@@ -31,7 +31,8 @@ CREATE SEQUENCE IF NOT EXISTS syncapi_send_to_device_id;
 
 -- Stores send-to-device messages.
 CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
-	-- The ID that uniquely identifies this message.
+	-- The ID that uniquely identifies this message. This is also the
+	-- send-to-device stream position of the message.
 	id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_send_to_device_id'),
 	-- The user ID to send the message to.
 	user_id TEXT NOT NULL,
@@ -49,6 +50,7 @@ CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
 const insertSendToDeviceMessageSQL = `
 	INSERT INTO syncapi_send_to_device (user_id, device_id, content)
 	  VALUES ($1, $2, $3)
+	  RETURNING id
 `
 
 const countSendToDeviceMessagesSQL = `
@@ -61,7 +63,7 @@ const selectSendToDeviceMessagesSQL = `
 	SELECT id, user_id, device_id, content, sent_by_token
 	  FROM syncapi_send_to_device
 	  WHERE user_id = $1 AND device_id = $2
-	  ORDER BY id DESC
+	  ORDER BY id ASC
 `
 
 const updateSentSendToDeviceMessagesSQL = `
@@ -69,16 +71,35 @@ const updateSentSendToDeviceMessagesSQL = `
 	  WHERE id = ANY($2)
 `
 
+// Selects the last ID given out by the sequence, which unlike the highest ID in
+// the table doesn't go backwards when messages are deleted.
+const selectMaxSendToDeviceMessageIDSQL = "" +
+	"SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM syncapi_send_to_device_id"
+
 const deleteSendToDeviceMessagesSQL = `
 	DELETE FROM syncapi_send_to_device WHERE id = ANY($1)
 `
 
+// Deletes every message which has at least $1 newer messages waiting for the
+// same device.
+const deleteSendToDeviceMessagesBeyondLimitSQL = `
+	DELETE FROM syncapi_send_to_device
+	  WHERE (
+	    SELECT COUNT(*) FROM syncapi_send_to_device AS newer
+	      WHERE newer.user_id = syncapi_send_to_device.user_id
+	      AND newer.device_id = syncapi_send_to_device.device_id
+	      AND newer.id > syncapi_send_to_device.id
+	  ) >= $1
+`
+
 type sendToDeviceStatements struct {
-	insertSendToDeviceMessageStmt      *sql.Stmt
-	countSendToDeviceMessagesStmt      *sql.Stmt
-	selectSendToDeviceMessagesStmt     *sql.Stmt
-	updateSentSendToDeviceMessagesStmt *sql.Stmt
-	deleteSendToDeviceMessagesStmt     *sql.Stmt
+	insertSendToDeviceMessageStmt             *sql.Stmt
+	countSendToDeviceMessagesStmt             *sql.Stmt
+	selectSendToDeviceMessagesStmt            *sql.Stmt
+	updateSentSendToDeviceMessagesStmt        *sql.Stmt
+	deleteSendToDeviceMessagesStmt            *sql.Stmt
+	selectMaxSendToDeviceMessageIDStmt        *sql.Stmt
+	deleteSendToDeviceMessagesBeyondLimitStmt *sql.Stmt
 }
 
 func NewPostgresSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
@@ -102,13 +123,19 @@ func NewPostgresSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
 	if s.deleteSendToDeviceMessagesStmt, err = db.Prepare(deleteSendToDeviceMessagesSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMaxSendToDeviceMessageIDStmt, err = db.Prepare(selectMaxSendToDeviceMessageIDSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSendToDeviceMessagesBeyondLimitStmt, err = db.Prepare(deleteSendToDeviceMessagesBeyondLimitSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
 func (s *sendToDeviceStatements) InsertSendToDeviceMessage(
 	ctx context.Context, txn *sql.Tx, userID, deviceID, content string,
-) (err error) {
-	_, err = sqlutil.TxStmt(txn, s.insertSendToDeviceMessageStmt).ExecContext(ctx, userID, deviceID, content)
+) (pos types.StreamPosition, err error) {
+	err = sqlutil.TxStmt(txn, s.insertSendToDeviceMessageStmt).QueryRowContext(ctx, userID, deviceID, content).Scan(&pos)
 	return
 }
 
@@ -170,3 +197,20 @@ func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
 	_, err = txn.Stmt(s.deleteSendToDeviceMessagesStmt).ExecContext(ctx, pq.Array(nids))
 	return
 }
+
+func (s *sendToDeviceStatements) SelectMaxSendToDeviceMessageID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	err = sqlutil.TxStmt(txn, s.selectMaxSendToDeviceMessageIDStmt).QueryRowContext(ctx).Scan(&id)
+	return
+}
+
+func (s *sendToDeviceStatements) DeleteSendToDeviceMessagesBeyondLimit(
+	ctx context.Context, txn *sql.Tx, keep int,
+) (deleted int64, err error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteSendToDeviceMessagesBeyondLimitStmt).ExecContext(ctx, keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
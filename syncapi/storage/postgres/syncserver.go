@@ -16,6 +16,7 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 
 	// Import the postgres database driver.
@@ -23,6 +24,8 @@ import (
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/shared"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
 // SyncServerDatasource represents a sync server datasource which manages
@@ -31,10 +34,14 @@ type SyncServerDatasource struct {
 	shared.Database
 	db *sql.DB
 	sqlutil.PartitionOffsetStatements
+	// Initial syncs are read from the replica if one was configured.
+	replica   *sqlutil.ReadReplica
+	replicaDB *shared.Database
 }
 
-// NewDatabase creates a new sync server database
-func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*SyncServerDatasource, error) {
+// NewDatabase creates a new sync server database. The replica data source
+// name is optional.
+func NewDatabase(dbDataSourceName, replicaDataSourceName string, dbProperties sqlutil.DbProperties) (*SyncServerDatasource, error) {
 	var d SyncServerDatasource
 	var err error
 	if d.db, err = sqlutil.Open("postgres", dbDataSourceName, dbProperties); err != nil {
@@ -43,41 +50,95 @@ func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*S
 	if err = d.PartitionOffsetStatements.Prepare(d.db, "syncapi"); err != nil {
 		return nil, err
 	}
-	accountData, err := NewPostgresAccountDataTable(d.db)
-	if err != nil {
+	if d.Database, err = prepareDatabase(d.db); err != nil {
 		return nil, err
 	}
-	events, err := NewPostgresEventsTable(d.db)
+	d.SendToDeviceWriter = sqlutil.NewTransactionWriter()
+	d.EDUCache = cache.New()
+	if replicaDataSourceName == "" {
+		return &d, nil
+	}
+
+	replicaDB, err := sqlutil.OpenReadReplica(replicaDataSourceName, dbProperties)
 	if err != nil {
 		return nil, err
 	}
-	currState, err := NewPostgresCurrentRoomStateTable(d.db)
+	replica, err := prepareDatabase(replicaDB)
 	if err != nil {
 		return nil, err
 	}
-	invites, err := NewPostgresInvitesTable(d.db)
+	// EDUs are only held in memory, so they have to come from the same cache.
+	replica.SendToDeviceWriter = d.SendToDeviceWriter
+	replica.EDUCache = d.EDUCache
+	d.replica = sqlutil.NewReadReplica(d.db, replicaDB)
+	d.replicaDB = &replica
+	return &d, nil
+}
+
+// prepareDatabase prepares the statements for all of the tables in db.
+func prepareDatabase(db *sql.DB) (shared.Database, error) {
+	events, err := NewPostgresEventsTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
-	topology, err := NewPostgresTopologyTable(d.db)
+	currState, err := NewPostgresCurrentRoomStateTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
-	backwardExtremities, err := NewPostgresBackwardsExtremitiesTable(d.db)
+	// The account data table selects from the current room state, so it
+	// has to be made after it.
+	accountData, err := NewPostgresAccountDataTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
-	sendToDevice, err := NewPostgresSendToDeviceTable(d.db)
+	invites, err := NewPostgresInvitesTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
 	}
-	filter, err := NewPostgresFilterTable(d.db)
+	peeks, err := NewPostgresPeeksTable(db)
 	if err != nil {
-		return nil, err
+		return shared.Database{}, err
+	}
+	topology, err := NewPostgresTopologyTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	backwardExtremities, err := NewPostgresBackwardsExtremitiesTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	sendToDevice, err := NewPostgresSendToDeviceTable(db)
+	if err != nil {
+		return shared.Database{}, err
 	}
-	d.Database = shared.Database{
-		DB:                  d.db,
+	filter, err := NewPostgresFilterTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	notificationData, err := NewPostgresNotificationDataTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	search, err := NewPostgresSearchTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	relations, err := NewPostgresRelationsTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	retention, err := NewPostgresRetentionTable(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	purge, err := NewPostgresPurgeStatements(db)
+	if err != nil {
+		return shared.Database{}, err
+	}
+	return shared.Database{
+		DB:                  db,
 		Invites:             invites,
+		Peeks:               peeks,
 		AccountData:         accountData,
 		OutputEvents:        events,
 		Topology:            topology,
@@ -85,8 +146,35 @@ func NewDatabase(dbDataSourceName string, dbProperties sqlutil.DbProperties) (*S
 		BackwardExtremities: backwardExtremities,
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
-		SendToDeviceWriter:  sqlutil.NewTransactionWriter(),
-		EDUCache:            cache.New(),
+		NotificationData:    notificationData,
+		Search:              search,
+		Relations:           relations,
+		Retention:           retention,
+		Purge:               purge,
+	}, nil
+}
+
+// CompleteSync builds the response from the read replica if there is one and
+// it has caught up with the primary, since initial syncs read a lot.
+func (d *SyncServerDatasource) CompleteSync(
+	ctx context.Context, res *types.Response,
+	device userapi.Device, numRecentEventsPerRoom int,
+	includeLeave bool,
+) (*types.Response, error) {
+	triedReplica := false
+	err := d.replica.Read(ctx, func(onReplica bool) error {
+		db := &d.Database
+		if onReplica {
+			db, triedReplica = d.replicaDB, true
+		} else if triedReplica {
+			// The failed attempt may have filled in some of the response.
+			*res = *types.NewResponse()
+		}
+		_, err := db.CompleteSync(ctx, res, device, numRecentEventsPerRoom, includeLeave)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return &d, nil
+	return res, nil
 }
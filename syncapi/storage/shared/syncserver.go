@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -31,6 +32,8 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -38,6 +41,7 @@ import (
 type Database struct {
 	DB                  *sql.DB
 	Invites             tables.Invites
+	Peeks               tables.Peeks
 	AccountData         tables.AccountData
 	OutputEvents        tables.Events
 	Topology            tables.Topology
@@ -45,6 +49,11 @@ type Database struct {
 	BackwardExtremities tables.BackwardsExtremities
 	SendToDevice        tables.SendToDevice
 	Filter              tables.Filter
+	NotificationData    tables.NotificationData
+	Search              tables.Search
+	Relations           tables.Relations
+	Retention           tables.Retention
+	Purge               tables.Purge
 	SendToDeviceWriter  *sqlutil.TransactionWriter
 	EDUCache            *cache.EDUCache
 }
@@ -74,8 +83,8 @@ func (d *Database) GetEventsInStreamingRange(
 	backwardOrdering bool,
 ) (events []types.StreamEvent, err error) {
 	r := types.Range{
-		From:      from.PDUPosition(),
-		To:        to.PDUPosition(),
+		From:      from.PDUPosition,
+		To:        to.PDUPosition,
 		Backwards: backwardOrdering,
 	}
 	if backwardOrdering {
@@ -108,10 +117,6 @@ func (d *Database) RemoveTypingUser(
 	return types.StreamPosition(d.EDUCache.RemoveUser(userID, roomID))
 }
 
-func (d *Database) AddSendToDevice() types.StreamPosition {
-	return types.StreamPosition(d.EDUCache.AddSendToDeviceMessage())
-}
-
 func (d *Database) SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn) {
 	d.EDUCache.SetTimeoutCallback(fn)
 }
@@ -120,6 +125,10 @@ func (d *Database) AllJoinedUsersInRooms(ctx context.Context) (map[string][]stri
 	return d.CurrentRoomState.SelectJoinedUsers(ctx)
 }
 
+func (d *Database) AllPeekingDevicesInRooms(ctx context.Context) (map[string][]types.PeekingDevice, error) {
+	return d.Peeks.SelectPeekingDevices(ctx)
+}
+
 func (d *Database) GetStateEvent(
 	ctx context.Context, roomID, evType, stateKey string,
 ) (*gomatrixserverlib.HeaderedEvent, error) {
@@ -160,6 +169,22 @@ func (d *Database) SyncStreamPosition(ctx context.Context) (types.StreamPosition
 		if maxInviteID > maxID {
 			maxID = maxInviteID
 		}
+		var maxPeekID int64
+		maxPeekID, err = d.Peeks.SelectMaxPeekID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxPeekID > maxID {
+			maxID = maxPeekID
+		}
+		var maxNotificationID int64
+		maxNotificationID, err = d.NotificationData.SelectMaxNotificationID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxNotificationID > maxID {
+			maxID = maxNotificationID
+		}
 		return nil
 	})
 	return types.StreamPosition(maxID), err
@@ -167,6 +192,7 @@ func (d *Database) SyncStreamPosition(ctx context.Context) (types.StreamPosition
 
 // AddInviteEvent stores a new invite event for a user.
 // If the invite was successfully stored this returns the stream ID it was stored at.
+// Returns a stream ID of 0 if the invite has already been stored.
 // Returns an error if there was a problem communicating with the database.
 func (d *Database) AddInviteEvent(
 	ctx context.Context, inviteEvent gomatrixserverlib.HeaderedEvent,
@@ -179,6 +205,7 @@ func (d *Database) AddInviteEvent(
 }
 
 // RetireInviteEvent removes an old invite event from the database.
+// Returns a stream ID of 0 if there was no such invite, or it has already been retired.
 // Returns an error if there was a problem communicating with the database.
 func (d *Database) RetireInviteEvent(
 	ctx context.Context, inviteEventID string,
@@ -186,8 +213,82 @@ func (d *Database) RetireInviteEvent(
 	return d.Invites.DeleteInviteEvent(ctx, inviteEventID)
 }
 
+// RetireInviteEventsForUser retires the invite and knock events for the user
+// in the room which are still active.
+// Returns a stream ID of 0 if there were no such events.
+func (d *Database) RetireInviteEventsForUser(
+	ctx context.Context, roomID, userID string,
+) (sp types.StreamPosition, err error) {
+	eventIDs, err := d.Invites.SelectActiveInviteEventIDs(ctx, nil, roomID, userID)
+	if err != nil {
+		return 0, err
+	}
+	for _, eventID := range eventIDs {
+		var pos types.StreamPosition
+		if pos, err = d.Invites.DeleteInviteEvent(ctx, eventID); err != nil {
+			return 0, err
+		}
+		if pos > sp {
+			sp = pos
+		}
+	}
+	return sp, nil
+}
+
+// AddPeek tracks the fact that a user has started peeking into a room
+// from the given device.
+// If the peek was successfully stored this returns the stream ID it was stored at.
+func (d *Database) AddPeek(
+	ctx context.Context, roomID, userID, deviceID string,
+) (sp types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.Peeks.InsertPeek(ctx, txn, roomID, userID, deviceID)
+		return err
+	})
+	return
+}
+
+// DeletePeek stops the given device from peeking into a room. Returns a stream
+// position of 0 if the device wasn't peeking into the room.
+func (d *Database) DeletePeek(
+	ctx context.Context, roomID, userID, deviceID string,
+) (sp types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.Peeks.DeletePeek(ctx, txn, roomID, userID, deviceID)
+		return err
+	})
+	return
+}
+
+// DeletePeeks stops all of the user's devices from peeking into a room, e.g.
+// because the user has joined it. Returns a stream position of 0 if none of
+// the user's devices were peeking into the room.
+func (d *Database) DeletePeeks(
+	ctx context.Context, roomID, userID string,
+) (sp types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.Peeks.DeletePeeks(ctx, txn, roomID, userID)
+		return err
+	})
+	return
+}
+
+// DeleteRoomPeeks stops everyone from peeking into a room, e.g. because it is
+// no longer world-readable. Returns a stream position of 0 if nobody was
+// peeking into the room.
+func (d *Database) DeleteRoomPeeks(
+	ctx context.Context, roomID string,
+) (sp types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.Peeks.DeleteRoomPeeks(ctx, txn, roomID)
+		return err
+	})
+	return
+}
+
 // GetAccountDataInRange returns all account data for a given user inserted or
 // updated between two given positions
+// Room account data is only returned for rooms which the user is joined to
 // Returns a map following the format data[roomID] = []dataTypes
 // If no data is retrieved, returns an empty map
 // If there was an issue with the retrieval, returns an error
@@ -214,6 +315,45 @@ func (d *Database) UpsertAccountData(
 	return
 }
 
+// IncrementNotificationCounts adds to the unread notification counts for a
+// user in a room. Returns the stream position of the update.
+func (d *Database) IncrementNotificationCounts(
+	ctx context.Context, userID, roomID string, notificationCount, highlightCount int,
+) (sp types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.NotificationData.IncrementNotificationCounts(ctx, txn, userID, roomID, notificationCount, highlightCount)
+		return err
+	})
+	return
+}
+
+// UnreadNotificationCount returns the total number of unread notifications
+// of a user across all rooms.
+func (d *Database) UnreadNotificationCount(ctx context.Context, userID string) (int, error) {
+	counts, err := d.NotificationData.SelectUserNotificationCounts(ctx, nil, userID)
+	if err != nil {
+		return 0, err
+	}
+	unread := 0
+	for _, data := range counts {
+		unread += data.NotificationCount
+	}
+	return unread, nil
+}
+
+// ResetNotificationCounts clears the unread notification counts for a user
+// in a room. Returns the stream position of the update, or 0 if the counts
+// were already zero and nothing changed.
+func (d *Database) ResetNotificationCounts(
+	ctx context.Context, userID, roomID string,
+) (sp types.StreamPosition, err error) {
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.NotificationData.ResetNotificationCounts(ctx, txn, userID, roomID)
+		return err
+	})
+	return
+}
+
 func (d *Database) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent {
 	out := make([]gomatrixserverlib.HeaderedEvent, len(in))
 	for i := 0; i < len(in); i++ {
@@ -293,6 +433,14 @@ func (d *Database) WriteEvent(
 			return err
 		}
 
+		if err = d.indexEventForSearch(ctx, txn, ev, pos); err != nil {
+			return err
+		}
+
+		if err = d.indexEventRelation(ctx, txn, ev, pos); err != nil {
+			return err
+		}
+
 		if len(addStateEvents) == 0 && len(removeStateEventIDs) == 0 {
 			// Nothing to do, the event may have just been a message event.
 			return nil
@@ -345,25 +493,18 @@ func (d *Database) GetEventsInTopologicalRange(
 	roomID string, limit int,
 	backwardOrdering bool,
 ) (events []types.StreamEvent, err error) {
-	var minDepth, maxDepth, maxStreamPosForMaxDepth types.StreamPosition
+	// Backward ordering means the 'from' token is later in the topology than
+	// the 'to' token. The range is exclusive of its lower bound and inclusive
+	// of its upper bound, so a token refers to the event on its left.
+	lower, upper := from, to
 	if backwardOrdering {
-		// Backward ordering means the 'from' token has a higher depth than the 'to' token
-		minDepth = to.Depth()
-		maxDepth = from.Depth()
-		// for cases where we have say 5 events with the same depth, the TopologyToken needs to
-		// know which of the 5 the client has seen. This is done by using the PDU position.
-		// Events with the same maxDepth but less than this PDU position will be returned.
-		maxStreamPosForMaxDepth = from.PDUPosition()
-	} else {
-		// Forward ordering means the 'from' token has a lower depth than the 'to' token.
-		minDepth = from.Depth()
-		maxDepth = to.Depth()
+		lower, upper = to, from
 	}
 
 	// Select the event IDs from the defined range.
 	var eIDs []string
 	eIDs, err = d.Topology.SelectEventIDsInRange(
-		ctx, nil, roomID, minDepth, maxDepth, maxStreamPosForMaxDepth, limit, !backwardOrdering,
+		ctx, nil, roomID, lower.Depth(), lower.PDUPosition(), upper.Depth(), upper.PDUPosition(), limit, !backwardOrdering,
 	)
 	if err != nil {
 		return
@@ -402,6 +543,19 @@ func (d *Database) MaxTopologicalPosition(
 	return types.NewTopologyToken(depth, streamPos), nil
 }
 
+func (d *Database) StreamToTopologicalPosition(
+	ctx context.Context, roomID string, streamPos types.StreamPosition,
+) (types.TopologyToken, error) {
+	// Events which were backfilled after the stream position may be earlier in
+	// the topology, but events at the same depth which arrived after it aren't
+	// before the stream position, so the stream position breaks the tie.
+	depth, err := d.Topology.SelectStreamToTopologicalPosition(ctx, nil, roomID, streamPos)
+	if err != nil {
+		return types.NewTopologyToken(0, 0), err
+	}
+	return types.NewTopologyToken(depth, streamPos), nil
+}
+
 func (d *Database) EventPositionInTopology(
 	ctx context.Context, eventID string,
 ) (types.TopologyToken, error) {
@@ -420,21 +574,41 @@ func (d *Database) syncPositionTx(
 	if err != nil {
 		return sp, err
 	}
+	// Invites and peeks are delivered alongside room events, so they are part
+	// of the same stream.
+	maxInviteID, err := d.Invites.SelectMaxInviteID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxInviteID > maxEventID {
+		maxEventID = maxInviteID
+	}
+	maxPeekID, err := d.Peeks.SelectMaxPeekID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxPeekID > maxEventID {
+		maxEventID = maxPeekID
+	}
 	maxAccountDataID, err := d.AccountData.SelectMaxAccountDataID(ctx, txn)
 	if err != nil {
 		return sp, err
 	}
-	if maxAccountDataID > maxEventID {
-		maxEventID = maxAccountDataID
+	maxNotificationID, err := d.NotificationData.SelectMaxNotificationID(ctx, txn)
+	if err != nil {
+		return sp, err
 	}
-	maxInviteID, err := d.Invites.SelectMaxInviteID(ctx, txn)
+	maxSendToDeviceID, err := d.SendToDevice.SelectMaxSendToDeviceMessageID(ctx, txn)
 	if err != nil {
 		return sp, err
 	}
-	if maxInviteID > maxEventID {
-		maxEventID = maxInviteID
+	sp = types.StreamingToken{
+		PDUPosition:          types.StreamPosition(maxEventID),
+		TypingPosition:       types.StreamPosition(d.EDUCache.GetLatestSyncPosition()),
+		ReceiptPosition:      types.StreamPosition(maxNotificationID),
+		SendToDevicePosition: types.StreamPosition(maxSendToDeviceID),
+		AccountDataPosition:  types.StreamPosition(maxAccountDataID),
 	}
-	sp = types.NewStreamToken(types.StreamPosition(maxEventID), types.StreamPosition(d.EDUCache.GetLatestSyncPosition()))
 	return
 }
 
@@ -508,7 +682,7 @@ func (d *Database) addTypingDeltaToResponse(
 	var err error
 	for _, roomID := range joinedRoomIDs {
 		if typingUsers, updated := d.EDUCache.GetTypingUsersIfUpdatedAfter(
-			roomID, int64(since.EDUPosition()),
+			roomID, int64(since.TypingPosition),
 		); updated {
 			ev := gomatrixserverlib.ClientEvent{
 				Type: gomatrixserverlib.MTyping,
@@ -531,14 +705,14 @@ func (d *Database) addTypingDeltaToResponse(
 }
 
 // addEDUDeltaToResponse adds updates for EDUs of each type since fromPos if
-// the positions of that type are not equal in fromPos and toPos.
+// the positions of that type's stream are not equal in fromPos and toPos.
 func (d *Database) addEDUDeltaToResponse(
 	fromPos, toPos types.StreamingToken,
 	joinedRoomIDs []string,
 	res *types.Response,
 ) (err error) {
 
-	if fromPos.EDUPosition() != toPos.EDUPosition() {
+	if fromPos.TypingPosition != toPos.TypingPosition {
 		err = d.addTypingDeltaToResponse(
 			fromPos, joinedRoomIDs, res,
 		)
@@ -547,6 +721,92 @@ func (d *Database) addEDUDeltaToResponse(
 	return
 }
 
+// addNotificationCountsToResponse sets the unread notification counts for
+// every joined room in the response. Joined rooms whose counts changed within
+// the given range are added to the response if they aren't already in it, so
+// that clients find out when the counts are reset by a read receipt.
+func (d *Database) addNotificationCountsToResponse(
+	ctx context.Context, userID string, r types.Range,
+	joinedRoomIDs []string,
+	res *types.Response,
+) error {
+	counts, err := d.NotificationData.SelectUserNotificationCounts(ctx, nil, userID)
+	if err != nil {
+		return err
+	}
+	low, high := r.Low(), r.High()
+	for _, roomID := range joinedRoomIDs {
+		data, ok := counts[roomID]
+		jr, inResponse := res.Rooms.Join[roomID]
+		if !inResponse {
+			if !ok || data.StreamPosition <= low || data.StreamPosition > high {
+				continue
+			}
+			jr = *types.NewJoinResponse()
+		}
+		jr.UnreadNotifications.NotificationCount = data.NotificationCount
+		jr.UnreadNotifications.HighlightCount = data.HighlightCount
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
+// maxRoomHeroes is the number of heroes to include in a room summary, as
+// recommended by the spec.
+const maxRoomHeroes = 5
+
+// addRoomSummariesToResponse adds the room summary, computed from the current
+// membership, to each of the joined rooms in the response. Heroes are only
+// included for rooms lacking a name and canonical alias, as clients only need
+// them to generate a name for the room.
+func (d *Database) addRoomSummariesToResponse(
+	ctx context.Context, userID string, res *types.Response,
+) error {
+	for roomID, jr := range res.Rooms.Join {
+		joined, err := d.CurrentRoomState.SelectMembershipCount(ctx, nil, roomID, gomatrixserverlib.Join)
+		if err != nil {
+			return err
+		}
+		invited, err := d.CurrentRoomState.SelectMembershipCount(ctx, nil, roomID, gomatrixserverlib.Invite)
+		if err != nil {
+			return err
+		}
+		jr.Summary.JoinedMemberCount = joined
+		jr.Summary.InvitedMemberCount = invited
+
+		named, err := d.roomHasNameOrAlias(ctx, roomID)
+		if err != nil {
+			return err
+		}
+		if !named {
+			jr.Summary.Heroes, err = d.CurrentRoomState.SelectHeroes(ctx, nil, roomID, userID, maxRoomHeroes)
+			if err != nil {
+				return err
+			}
+		}
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
+// roomHasNameOrAlias returns true if the room has a non-empty m.room.name or
+// m.room.canonical_alias.
+func (d *Database) roomHasNameOrAlias(ctx context.Context, roomID string) (bool, error) {
+	for evType, key := range map[string]string{
+		"m.room.name":            "name",
+		"m.room.canonical_alias": "alias",
+	} {
+		ev, err := d.CurrentRoomState.SelectStateEvent(ctx, roomID, evType, "")
+		if err != nil {
+			return false, err
+		}
+		if ev != nil && gjson.GetBytes(ev.Content(), key).String() != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (d *Database) GetFilter(
 	ctx context.Context, localpart string, filterID string,
 ) (*gomatrixserverlib.Filter, error) {
@@ -571,10 +831,10 @@ func (d *Database) IncrementalSync(
 
 	var joinedRoomIDs []string
 	var err error
-	if fromPos.PDUPosition() != toPos.PDUPosition() || wantFullState {
+	if fromPos.PDUPosition != toPos.PDUPosition || wantFullState {
 		r := types.Range{
-			From: fromPos.PDUPosition(),
-			To:   toPos.PDUPosition(),
+			From: fromPos.PDUPosition,
+			To:   toPos.PDUPosition,
 		}
 		joinedRoomIDs, err = d.addPDUDeltaToResponse(
 			ctx, device, r, numRecentEventsPerRoom, wantFullState, res,
@@ -595,6 +855,18 @@ func (d *Database) IncrementalSync(
 		return nil, err
 	}
 
+	r := types.Range{
+		From: fromPos.ReceiptPosition,
+		To:   toPos.ReceiptPosition,
+	}
+	if err = d.addNotificationCountsToResponse(ctx, device.UserID, r, joinedRoomIDs, res); err != nil {
+		return nil, err
+	}
+
+	if err = d.addRoomSummariesToResponse(ctx, device.UserID, res); err != nil {
+		return nil, err
+	}
+
 	return res, nil
 }
 
@@ -615,7 +887,206 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 	}
 
 	newEvent := ev.Headered(redactedBecause.RoomVersion)
-	return d.OutputEvents.UpdateEventJSON(ctx, &newEvent)
+	if err = d.OutputEvents.UpdateEventJSON(ctx, &newEvent); err != nil {
+		return err
+	}
+	// The redacted content must no longer be searchable, and the event no
+	// longer relates to anything as m.relates_to has been removed.
+	if err = d.Search.DeleteSearchEntry(ctx, nil, redactedEventID); err != nil {
+		return err
+	}
+	return d.Relations.DeleteRelation(ctx, nil, redactedEventID)
+}
+
+// searchableKeys maps the event types which are indexed for search to the
+// content key that is indexed, as named in the /search API.
+var searchableKeys = map[string]string{
+	"m.room.message": "content.body",
+	"m.room.name":    "content.name",
+	"m.room.topic":   "content.topic",
+}
+
+// indexEventForSearch adds the searchable text of the event to the full-text
+// index, if the event has any.
+func (d *Database) indexEventForSearch(
+	ctx context.Context, txn *sql.Tx, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+) error {
+	key, ok := searchableKeys[ev.Type()]
+	if !ok {
+		return nil
+	}
+	value := gjson.GetBytes(ev.Content(), strings.TrimPrefix(key, "content."))
+	if value.Type != gjson.String || value.Str == "" {
+		return nil
+	}
+	return d.Search.InsertSearchEntry(ctx, txn, ev.EventID(), ev.RoomID(), key, pos, value.Str)
+}
+
+// SearchRoomEvents returns the events matching the search term in the given rooms,
+// along with the total number of matching events.
+func (d *Database) SearchRoomEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	return d.Search.SelectSearchResults(ctx, nil, searchTerm, roomIDs, keys, orderByRank, limit, offset)
+}
+
+const (
+	relTypeAnnotation = "m.annotation"
+	relTypeReference  = "m.reference"
+	relTypeReplace    = "m.replace"
+)
+
+// indexEventRelation stores the relation of the event to another event, if
+// its content has one.
+func (d *Database) indexEventRelation(
+	ctx context.Context, txn *sql.Tx, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+) error {
+	relatesTo := gjson.GetBytes(ev.Content(), `m\.relates_to`)
+	relType := relatesTo.Get("rel_type").Str
+	relatesToID := relatesTo.Get("event_id").Str
+	if relType == "" || relatesToID == "" {
+		return nil
+	}
+	var key string
+	if relType == relTypeAnnotation {
+		// Annotations are aggregated by their key, so are meaningless without one.
+		if key = relatesTo.Get("key").Str; key == "" {
+			return nil
+		}
+	}
+	return d.Relations.InsertRelation(
+		ctx, txn, ev.RoomID(), ev.EventID(), relatesToID, relType, ev.Type(), ev.Sender(), key, pos,
+	)
+}
+
+// RelationsForEvent returns the events relating to the given event within the range.
+func (d *Database) RelationsForEvent(
+	ctx context.Context, roomID, relatesToID, relType, eventType string, r types.Range, limit int,
+) ([]types.Relation, error) {
+	return d.Relations.SelectRelationsInRange(ctx, nil, roomID, relatesToID, relType, eventType, r, limit)
+}
+
+// maxBundledRelationsPerEvent is how many of the newest relations of each
+// event are looked at when bundling aggregations, so that an event with a
+// great many edits or references doesn't make every timeline expensive.
+const maxBundledRelationsPerEvent = 20
+
+// BundleAggregations adds the aggregations of the relations of each of the
+// events to the m.relations key of their unsigned data.
+func (d *Database) BundleAggregations(ctx context.Context, roomID string, events []gomatrixserverlib.ClientEvent) error {
+	return d.bundleAggregations(ctx, nil, roomID, events)
+}
+
+// bundleAggregations takes the room ID rather than getting it from the events
+// as client events in /sync responses don't have one.
+func (d *Database) bundleAggregations(
+	ctx context.Context, txn *sql.Tx, roomID string, events []gomatrixserverlib.ClientEvent,
+) error {
+	if len(events) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, 0, len(events))
+	originals := make(map[string]*gomatrixserverlib.ClientEvent, len(events))
+	for i := range events {
+		eventIDs = append(eventIDs, events[i].EventID)
+		originals[events[i].EventID] = &events[i]
+	}
+
+	aggregations := make(map[string]*types.RelationAggregations)
+	aggregationsFor := func(eventID string) *types.RelationAggregations {
+		if _, ok := aggregations[eventID]; !ok {
+			aggregations[eventID] = &types.RelationAggregations{}
+		}
+		return aggregations[eventID]
+	}
+
+	limit := maxBundledRelationsPerEvent * len(eventIDs)
+	counts, err := d.Relations.SelectAnnotationCounts(ctx, txn, roomID, eventIDs, limit)
+	if err != nil {
+		return fmt.Errorf("d.Relations.SelectAnnotationCounts: %w", err)
+	}
+	for _, count := range counts {
+		a := aggregationsFor(count.RelatesToID)
+		if a.Annotation == nil {
+			a.Annotation = &types.AnnotationChunk{}
+		}
+		a.Annotation.Chunk = append(a.Annotation.Chunk, types.AnnotationAggregation{
+			Type:  count.Type,
+			Key:   count.Key,
+			Count: count.Count,
+		})
+		a.Annotation.Count++
+	}
+
+	relations, err := d.Relations.SelectRelationsOfTypes(ctx, txn, roomID, eventIDs, []string{relTypeReference, relTypeReplace}, limit)
+	if err != nil {
+		return fmt.Errorf("d.Relations.SelectRelationsOfTypes: %w", err)
+	}
+	// Only edits by the original sender with the same event type count. The
+	// relations are newest first, so going through them backwards lists the
+	// references oldest first and leaves the latest edit last.
+	latestEdits := make(map[string]string)
+	for i := len(relations) - 1; i >= 0; i-- {
+		relation := relations[i]
+		switch relation.RelType {
+		case relTypeReference:
+			a := aggregationsFor(relation.RelatesToID)
+			if a.Reference == nil {
+				a.Reference = &types.ReferenceChunk{}
+			}
+			a.Reference.Chunk = append(a.Reference.Chunk, types.ReferenceAggregation{EventID: relation.EventID})
+			a.Reference.Count++
+		case relTypeReplace:
+			if isValidEdit(originals[relation.RelatesToID], relation) {
+				latestEdits[relation.RelatesToID] = relation.EventID
+			}
+		}
+	}
+	if len(latestEdits) > 0 {
+		editIDs := make([]string, 0, len(latestEdits))
+		editedIDs := make(map[string]string, len(latestEdits))
+		for eventID, editID := range latestEdits {
+			editIDs = append(editIDs, editID)
+			editedIDs[editID] = eventID
+		}
+		var edits []types.StreamEvent
+		if edits, err = d.OutputEvents.SelectEvents(ctx, txn, editIDs); err != nil {
+			return fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+		}
+		for _, edit := range edits {
+			eventID := editedIDs[edit.EventID()]
+			if edit.RoomID() != roomID {
+				continue
+			}
+			replace := gomatrixserverlib.HeaderedToClientEvent(edit.HeaderedEvent, gomatrixserverlib.FormatAll)
+			aggregationsFor(eventID).Replace = &replace
+		}
+	}
+
+	for i := range events {
+		a, ok := aggregations[events[i].EventID]
+		if !ok {
+			continue
+		}
+		if events[i].Unsigned, err = sjson.SetBytes(events[i].Unsigned, `m\.relations`, a); err != nil {
+			return fmt.Errorf("sjson.SetBytes: %w", err)
+		}
+	}
+	return nil
+}
+
+// isValidEdit returns whether the relation is an edit which may replace the
+// original event, as described in MSC2676. Edits can't themselves be edited.
+func isValidEdit(original *gomatrixserverlib.ClientEvent, relation types.Relation) bool {
+	if original == nil || relation.Sender != original.Sender || relation.EventType != original.Type {
+		return false
+	}
+	return gjson.GetBytes(original.Content, `m\.relates_to.rel_type`).Str != relTypeReplace
+}
+
+// RoomIDsWithMembership returns the IDs of the rooms in which the user has the given membership.
+func (d *Database) RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error) {
+	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, nil, userID, membership)
 }
 
 // getResponseWithPDUsForCompleteSync creates a response and adds all PDUs needed
@@ -623,8 +1094,9 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 // nolint:nakedret
 func (d *Database) getResponseWithPDUsForCompleteSync(
 	ctx context.Context, res *types.Response,
-	userID string,
+	device userapi.Device,
 	numRecentEventsPerRoom int,
+	includeLeave bool,
 ) (
 	toPos types.StreamingToken,
 	joinedRoomIDs []string,
@@ -653,13 +1125,13 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 	}
 	r := types.Range{
 		From: 0,
-		To:   toPos.PDUPosition(),
+		To:   toPos.PDUPosition,
 	}
 
 	res.NextBatch = toPos.String()
 
 	// Extract room state and recent events for all rooms the user is joined to.
-	joinedRoomIDs, err = d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, txn, userID, gomatrixserverlib.Join)
+	joinedRoomIDs, err = d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, txn, device.UserID, gomatrixserverlib.Join)
 	if err != nil {
 		return
 	}
@@ -668,62 +1140,106 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 
 	// Build up a /sync response. Add joined rooms.
 	for _, roomID := range joinedRoomIDs {
-		var stateEvents []gomatrixserverlib.HeaderedEvent
-		stateEvents, err = d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, &stateFilter)
-		if err != nil {
+		// Users can be in a great many rooms, so give up between rooms if
+		// the client has gone away.
+		if err = ctx.Err(); err != nil {
 			return
 		}
-		// TODO: When filters are added, we may need to call this multiple times to get enough events.
-		//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
-		var recentStreamEvents []types.StreamEvent
-		var limited bool
-		recentStreamEvents, limited, err = d.OutputEvents.SelectRecentEvents(
-			ctx, txn, roomID, r, numRecentEventsPerRoom, true, true,
-		)
+		var jr *types.JoinResponse
+		jr, err = d.getJoinResponseForCompleteSync(ctx, txn, roomID, r, &stateFilter, numRecentEventsPerRoom)
 		if err != nil {
 			return
 		}
+		res.Rooms.Join[roomID] = *jr
+	}
 
-		// Retrieve the backward topology position, i.e. the position of the
-		// oldest event in the room's topology.
-		var prevBatchStr string
-		if len(recentStreamEvents) > 0 {
-			var backwardTopologyPos, backwardStreamPos types.StreamPosition
-			backwardTopologyPos, backwardStreamPos, err = d.Topology.SelectPositionInTopology(ctx, txn, recentStreamEvents[0].EventID())
-			if err != nil {
-				return
-			}
-			prevBatch := types.NewTopologyToken(backwardTopologyPos, backwardStreamPos)
-			prevBatch.Decrement()
-			prevBatchStr = prevBatch.String()
+	// Add peeked rooms.
+	var peeks []types.Peek
+	peeks, err = d.Peeks.SelectPeeksInRange(ctx, txn, device.UserID, device.ID, r)
+	if err != nil {
+		return
+	}
+	for _, peek := range peeks {
+		if peek.Deleted {
+			continue
 		}
-
-		// We don't include a device here as we don't need to send down
-		// transaction IDs for complete syncs
-		recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
-		stateEvents = removeDuplicates(stateEvents, recentEvents)
-		jr := types.NewJoinResponse()
-		jr.Timeline.PrevBatch = prevBatchStr
-		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = limited
-		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
-		res.Rooms.Join[roomID] = *jr
+		if _, joined := res.Rooms.Join[peek.RoomID]; joined {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var jr *types.JoinResponse
+		jr, err = d.getJoinResponseForCompleteSync(ctx, txn, peek.RoomID, r, &stateFilter, numRecentEventsPerRoom)
+		if err != nil {
+			return
+		}
+		res.Rooms.Peek[peek.RoomID] = *jr
 	}
 
-	if err = d.addInvitesToResponse(ctx, txn, userID, r, res); err != nil {
+	if err = d.addInvitesToResponse(ctx, txn, device.UserID, r, res); err != nil {
 		return
 	}
 
+	if includeLeave {
+		if err = d.addArchivedRoomsToResponse(ctx, txn, device.UserID, r, &stateFilter, numRecentEventsPerRoom, res); err != nil {
+			return
+		}
+	}
+
 	succeeded = true
 	return //res, toPos, joinedRoomIDs, err
 }
 
+// getJoinResponseForCompleteSync returns the current state and the most recent
+// events for the room, for rooms that are joined or peeked into.
+func (d *Database) getJoinResponseForCompleteSync(
+	ctx context.Context, txn *sql.Tx,
+	roomID string,
+	r types.Range,
+	stateFilter *gomatrixserverlib.StateFilter,
+	numRecentEventsPerRoom int,
+) (*types.JoinResponse, error) {
+	stateEvents, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, stateFilter)
+	if err != nil {
+		return nil, err
+	}
+	// TODO: When filters are added, we may need to call this multiple times to get enough events.
+	//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
+	recentStreamEvents, limited, err := d.OutputEvents.SelectRecentEvents(
+		ctx, txn, roomID, r, numRecentEventsPerRoom, true, true,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, roomID, r, recentStreamEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	// We don't include a device here as we don't need to send down
+	// transaction IDs for complete syncs
+	recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
+	stateEvents = removeDuplicates(stateEvents, recentEvents)
+	jr := types.NewJoinResponse()
+	jr.Timeline.PrevBatch = prevBatch.String()
+	jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+	if err = d.bundleAggregations(ctx, txn, roomID, jr.Timeline.Events); err != nil {
+		return nil, err
+	}
+	jr.Timeline.Limited = limited
+	jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
+	return jr, nil
+}
+
 func (d *Database) CompleteSync(
 	ctx context.Context, res *types.Response,
 	device userapi.Device, numRecentEventsPerRoom int,
+	includeLeave bool,
 ) (*types.Response, error) {
 	toPos, joinedRoomIDs, err := d.getResponseWithPDUsForCompleteSync(
-		ctx, res, device.UserID, numRecentEventsPerRoom,
+		ctx, res, device, numRecentEventsPerRoom, includeLeave,
 	)
 	if err != nil {
 		return nil, err
@@ -731,12 +1247,24 @@ func (d *Database) CompleteSync(
 
 	// Use a zero value SyncPosition for fromPos so all EDU states are added.
 	err = d.addEDUDeltaToResponse(
-		types.NewStreamToken(0, 0), toPos, joinedRoomIDs, res,
+		types.StreamingToken{}, toPos, joinedRoomIDs, res,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	r := types.Range{
+		From: 0,
+		To:   toPos.ReceiptPosition,
+	}
+	if err = d.addNotificationCountsToResponse(ctx, device.UserID, r, joinedRoomIDs, res); err != nil {
+		return nil, err
+	}
+
+	if err = d.addRoomSummariesToResponse(ctx, device.UserID, res); err != nil {
+		return nil, err
+	}
+
 	return res, nil
 }
 
@@ -763,25 +1291,209 @@ func (d *Database) addInvitesToResponse(
 		return err
 	}
 	for roomID, inviteEvent := range invites {
+		if _, ok := res.Rooms.Join[roomID]; ok {
+			// the user has already joined the room, so the invite is stale
+			continue
+		}
+		// Knocks are stored alongside invites, and only differ in which
+		// section of the response they go in.
+		stateField := "invite_room_state"
+		membership, _ := inviteEvent.Membership()
+		if membership == eventutil.Knock {
+			stateField = "knock_room_state"
+		}
+		if !gjson.GetBytes(inviteEvent.Unsigned(), stateField).Exists() {
+			// The invite didn't come with any room state, so build it from
+			// what we know about the room, if anything.
+			inviteState, stateErr := d.inviteStrippedState(ctx, txn, inviteEvent)
+			if stateErr != nil {
+				return stateErr
+			}
+			if err = inviteEvent.SetUnsignedField(stateField, inviteState); err != nil {
+				return err
+			}
+		}
+		if membership == eventutil.Knock {
+			kr := types.NewKnockResponse(inviteEvent)
+			res.Rooms.Knock[roomID] = *kr
+			continue
+		}
 		ir := types.NewInviteResponse(inviteEvent)
 		res.Rooms.Invite[roomID] = *ir
 	}
 	for roomID := range retiredInvites {
+		// If the invite was retired because the user joined or left the room
+		// then the room is already in the response, along with the membership
+		// change, which the client needs more than an empty leave.
+		if _, ok := res.Rooms.Join[roomID]; ok {
+			continue
+		}
+		if _, ok := res.Rooms.Leave[roomID]; ok {
+			continue
+		}
 		lr := types.NewLeaveResponse()
 		res.Rooms.Leave[roomID] = *lr
 	}
 	return nil
 }
 
-// Retrieve the backward topology position, i.e. the position of the
-// oldest event in the room's topology.
+// addArchivedRoomsToResponse adds the rooms which the user has left or been
+// banned from to the leave section of a complete sync. The timeline stops at
+// the user's leave event, and the state is the state of the room when they
+// left, so that nothing that happened since leaks to them.
+func (d *Database) addArchivedRoomsToResponse(
+	ctx context.Context, txn *sql.Tx,
+	userID string,
+	r types.Range,
+	stateFilter *gomatrixserverlib.StateFilter,
+	numRecentEventsPerRoom int,
+	res *types.Response,
+) error {
+	for _, membership := range []string{gomatrixserverlib.Leave, gomatrixserverlib.Ban} {
+		leavePositions, err := d.CurrentRoomState.SelectMembershipPositions(ctx, txn, userID, membership)
+		if err != nil {
+			return err
+		}
+		for roomID, leavePos := range leavePositions {
+			if leavePos > r.High() {
+				continue
+			}
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			var lr *types.LeaveResponse
+			lr, err = d.getLeaveResponseForCompleteSync(ctx, txn, roomID, types.Range{From: r.From, To: leavePos}, stateFilter, numRecentEventsPerRoom)
+			if err != nil {
+				return err
+			}
+			res.Rooms.Leave[roomID] = *lr
+		}
+	}
+	return nil
+}
+
+// getLeaveResponseForCompleteSync returns the state and the most recent events
+// of a room as they were at the end of the given range.
+func (d *Database) getLeaveResponseForCompleteSync(
+	ctx context.Context, txn *sql.Tx,
+	roomID string,
+	r types.Range,
+	stateFilter *gomatrixserverlib.StateFilter,
+	numRecentEventsPerRoom int,
+) (*types.LeaveResponse, error) {
+	currentState, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, stateFilter)
+	if err != nil {
+		return nil, err
+	}
+	// The state at the end of the range is the current state, with the
+	// state events which were replaced since then put back.
+	removedEventIDs, err := d.OutputEvents.SelectRemovedStateEventIDs(ctx, txn, roomID, r.High(), stateFilter)
+	if err != nil {
+		return nil, err
+	}
+	stateEventIDs := make([]string, 0, len(currentState)+len(removedEventIDs))
+	for i := range currentState {
+		stateEventIDs = append(stateEventIDs, currentState[i].EventID())
+	}
+	stateEventIDs = append(stateEventIDs, removedEventIDs...)
+	stateStreamEvents, err := d.OutputEvents.SelectEvents(ctx, txn, stateEventIDs)
+	if err != nil {
+		return nil, err
+	}
+	// State events which we don't have a stream position for, such as
+	// those we got when joining over federation, are from before any
+	// events that we have.
+	statePositions := make(map[string]types.StreamPosition, len(stateStreamEvents))
+	for _, ev := range stateStreamEvents {
+		statePositions[ev.EventID()] = ev.StreamPosition
+	}
+	stateEvents := make([]gomatrixserverlib.HeaderedEvent, 0, len(stateEventIDs))
+	seen := make(map[string]bool, len(stateEventIDs))
+	for _, ev := range currentState {
+		if statePositions[ev.EventID()] <= r.High() {
+			stateEvents = append(stateEvents, ev)
+			seen[ev.EventID()] = true
+		}
+	}
+	// Events which were added and replaced after the range weren't part
+	// of the state at the end of it.
+	for _, ev := range stateStreamEvents {
+		if ev.StreamPosition <= r.High() && !seen[ev.EventID()] {
+			stateEvents = append(stateEvents, ev.HeaderedEvent)
+			seen[ev.EventID()] = true
+		}
+	}
+
+	recentStreamEvents, limited, err := d.OutputEvents.SelectRecentEvents(
+		ctx, txn, roomID, r, numRecentEventsPerRoom, true, true,
+	)
+	if err != nil {
+		return nil, err
+	}
+	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, roomID, r, recentStreamEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
+	stateEvents = removeDuplicates(stateEvents, recentEvents)
+	lr := types.NewLeaveResponse()
+	lr.Timeline.PrevBatch = prevBatch.String()
+	lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+	if err = d.bundleAggregations(ctx, txn, roomID, lr.Timeline.Events); err != nil {
+		return nil, err
+	}
+	lr.Timeline.Limited = limited
+	lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
+	return lr, nil
+}
+
+// inviteStrippedState returns the stripped state to send alongside an invite,
+// built from the current state of the room. This contains the invite event
+// itself, the inviter's membership and the events which clients need to
+// render a preview of the room.
+func (d *Database) inviteStrippedState(
+	ctx context.Context, txn *sql.Tx,
+	inviteEvent gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.InviteV2StrippedState, error) {
+	inviteState := []gomatrixserverlib.InviteV2StrippedState{
+		gomatrixserverlib.NewInviteV2StrippedState(&inviteEvent.Event),
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	stateFilter.Types = []string{
+		gomatrixserverlib.MRoomName, gomatrixserverlib.MRoomCanonicalAlias,
+		gomatrixserverlib.MRoomJoinRules, gomatrixserverlib.MRoomMember,
+		"m.room.avatar",
+	}
+	stateEvents, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, inviteEvent.RoomID(), &stateFilter)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range stateEvents {
+		if ev.Type() == gomatrixserverlib.MRoomMember && !ev.StateKeyEquals(inviteEvent.Sender()) {
+			continue
+		}
+		inviteState = append(inviteState, gomatrixserverlib.NewInviteV2StrippedState(&ev.Event))
+	}
+	return inviteState, nil
+}
+
+// Retrieve the backward topology position, i.e. the position just before the
+// oldest event in the timeline, so that clients can fill in any gap between
+// their previous sync and the timeline with /messages. If there are no events
+// in the timeline then the position of the end of the range is used instead,
+// as there may be events before it which were left out by the timeline limit.
 func (d *Database) getBackwardTopologyPos(
 	ctx context.Context, txn *sql.Tx,
-	events []types.StreamEvent,
+	roomID string, r types.Range, events []types.StreamEvent,
 ) (types.TopologyToken, error) {
 	zeroToken := types.NewTopologyToken(0, 0)
 	if len(events) == 0 {
-		return zeroToken, nil
+		depth, err := d.Topology.SelectStreamToTopologicalPosition(ctx, txn, roomID, r.High())
+		if err != nil {
+			return zeroToken, err
+		}
+		return types.NewTopologyToken(depth, r.High()), nil
 	}
 	pos, spos, err := d.Topology.SelectPositionInTopology(ctx, txn, events[0].EventID())
 	if err != nil {
@@ -802,6 +1514,14 @@ func (d *Database) addRoomDeltaToResponse(
 	numRecentEventsPerRoom int,
 	res *types.Response,
 ) error {
+	if delta.membership == membershipUnpeek {
+		// The device has stopped peeking into the room, so tell it to forget
+		// about the room unless it is already being sent down as a leave.
+		if _, ok := res.Rooms.Leave[delta.roomID]; !ok {
+			res.Rooms.Leave[delta.roomID] = *types.NewLeaveResponse()
+		}
+		return nil
+	}
 	if delta.membershipPos > 0 && delta.membership == gomatrixserverlib.Leave {
 		// make sure we don't leak recent events after the leave event.
 		// TODO: History visibility makes this somewhat complex to handle correctly. For example:
@@ -820,20 +1540,27 @@ func (d *Database) addRoomDeltaToResponse(
 	}
 	recentEvents := d.StreamEventsToEvents(device, recentStreamEvents)
 	delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents) // roll back
-	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
+	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, delta.roomID, r, recentStreamEvents)
 	if err != nil {
 		return err
 	}
 
 	switch delta.membership {
-	case gomatrixserverlib.Join:
+	case gomatrixserverlib.Join, membershipPeek:
 		jr := types.NewJoinResponse()
 
 		jr.Timeline.PrevBatch = prevBatch.String()
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+		if err = d.bundleAggregations(ctx, txn, delta.roomID, jr.Timeline.Events); err != nil {
+			return err
+		}
 		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
-		res.Rooms.Join[delta.roomID] = *jr
+		if delta.membership == membershipPeek {
+			res.Rooms.Peek[delta.roomID] = *jr
+		} else {
+			res.Rooms.Join[delta.roomID] = *jr
+		}
 	case gomatrixserverlib.Leave:
 		fallthrough // transitions to leave are the same as ban
 	case gomatrixserverlib.Ban:
@@ -842,7 +1569,10 @@ func (d *Database) addRoomDeltaToResponse(
 		lr := types.NewLeaveResponse()
 		lr.Timeline.PrevBatch = prevBatch.String()
 		lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		lr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		if err = d.bundleAggregations(ctx, txn, delta.roomID, lr.Timeline.Events); err != nil {
+			return err
+		}
+		lr.Timeline.Limited = limited
 		lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Leave[delta.roomID] = *lr
 	}
@@ -987,7 +1717,7 @@ func (d *Database) getStateDeltas(
 				deltas = append(deltas, stateDelta{
 					membership:    membership,
 					membershipPos: ev.StreamPosition,
-					stateEvents:   d.StreamEventsToEvents(device, stateStreamEvents),
+					stateEvents:   d.StreamEventsToEvents(device, stateUpTo(stateStreamEvents, ev.StreamPosition)),
 					roomID:        roomID,
 				})
 				break
@@ -1008,6 +1738,13 @@ func (d *Database) getStateDeltas(
 		})
 	}
 
+	// Add in rooms that this device is peeking into
+	peekDeltas, err := d.getPeekDeltas(ctx, device, txn, r, joinedRoomIDs, state, stateFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+	deltas = append(deltas, peekDeltas...)
+
 	return deltas, joinedRoomIDs, nil
 }
 
@@ -1058,7 +1795,7 @@ func (d *Database) getStateDeltasForFullStateSync(
 					deltas = append(deltas, stateDelta{
 						membership:    membership,
 						membershipPos: ev.StreamPosition,
-						stateEvents:   d.StreamEventsToEvents(device, stateStreamEvents),
+						stateEvents:   d.StreamEventsToEvents(device, stateUpTo(stateStreamEvents, ev.StreamPosition)),
 						roomID:        roomID,
 					})
 				}
@@ -1068,9 +1805,63 @@ func (d *Database) getStateDeltasForFullStateSync(
 		}
 	}
 
+	// Passing no state makes sure that full state is sent for peeked rooms too.
+	peekDeltas, err := d.getPeekDeltas(ctx, device, txn, r, joinedRoomIDs, nil, stateFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+	deltas = append(deltas, peekDeltas...)
+
 	return deltas, joinedRoomIDs, nil
 }
 
+// getPeekDeltas returns the state deltas for the rooms which the device is
+// peeking into, or has stopped peeking into, within the given range. Rooms
+// which the user has joined are skipped as they are already covered. The full
+// room state is sent for new peeks, and for all peeks if state is nil.
+func (d *Database) getPeekDeltas(
+	ctx context.Context, device *userapi.Device, txn *sql.Tx,
+	r types.Range, joinedRoomIDs []string,
+	state map[string][]types.StreamEvent,
+	stateFilter *gomatrixserverlib.StateFilter,
+) ([]stateDelta, error) {
+	peeks, err := d.Peeks.SelectPeeksInRange(ctx, txn, device.UserID, device.ID, r)
+	if err != nil {
+		return nil, err
+	}
+	joined := make(map[string]bool, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		joined[roomID] = true
+	}
+
+	var deltas []stateDelta
+	for _, peek := range peeks {
+		if joined[peek.RoomID] {
+			continue
+		}
+		if peek.Deleted {
+			deltas = append(deltas, stateDelta{
+				membership: membershipUnpeek,
+				roomID:     peek.RoomID,
+			})
+			continue
+		}
+		stateStreamEvents := state[peek.RoomID]
+		if peek.New || state == nil {
+			stateStreamEvents, err = d.currentStateStreamEventsForRoom(ctx, txn, peek.RoomID, stateFilter)
+			if err != nil {
+				return nil, err
+			}
+		}
+		deltas = append(deltas, stateDelta{
+			membership:  membershipPeek,
+			stateEvents: d.StreamEventsToEvents(device, stateStreamEvents),
+			roomID:      peek.RoomID,
+		})
+	}
+	return deltas, nil
+}
+
 func (d *Database) currentStateStreamEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 	stateFilter *gomatrixserverlib.StateFilter,
@@ -1099,28 +1890,29 @@ func (d *Database) SendToDeviceUpdatesWaiting(
 func (d *Database) AddSendToDeviceEvent(
 	ctx context.Context, txn *sql.Tx,
 	userID, deviceID, content string,
-) error {
+) (types.StreamPosition, error) {
 	return d.SendToDevice.InsertSendToDeviceMessage(
 		ctx, txn, userID, deviceID, content,
 	)
 }
 
 func (d *Database) StoreNewSendForDeviceMessage(
-	ctx context.Context, streamPos types.StreamPosition, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent,
-) (types.StreamPosition, error) {
+	ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent,
+) (streamPos types.StreamPosition, err error) {
 	j, err := json.Marshal(event)
 	if err != nil {
-		return streamPos, err
+		return 0, err
 	}
 	// Delegate the database write task to the SendToDeviceWriter. It'll guarantee
 	// that we don't lock the table for writes in more than one place.
 	err = d.SendToDeviceWriter.Do(d.DB, func(txn *sql.Tx) error {
-		return d.AddSendToDeviceEvent(
+		streamPos, err = d.AddSendToDeviceEvent(
 			ctx, txn, userID, deviceID, string(j),
 		)
+		return err
 	})
 	if err != nil {
-		return streamPos, err
+		return 0, err
 	}
 	return streamPos, nil
 }
@@ -1187,7 +1979,7 @@ func (d *Database) CleanSendToDeviceUpdates(
 
 		// Now update any outstanding send-to-device messages with the new sync token.
 		if e := d.SendToDevice.UpdateSentSendToDeviceMessages(ctx, txn, token.String(), toUpdate); e != nil {
-			return fmt.Errorf("d.SendToDevice.UpdateSentSendToDeviceMessages: %w", err)
+			return fmt.Errorf("d.SendToDevice.UpdateSentSendToDeviceMessages: %w", e)
 		}
 
 		return nil
@@ -1195,6 +1987,146 @@ func (d *Database) CleanSendToDeviceUpdates(
 	return
 }
 
+// purgeEventsBatchSize is how many events are looked at in one go when finding
+// the events in a room which are older than the retention period.
+const purgeEventsBatchSize = 100
+
+// PurgeOldEvents implements Database.
+func (d *Database) PurgeOldEvents(
+	ctx context.Context, olderThan gomatrixserverlib.Timestamp, maxEventsPerRoom int,
+) (purged int64, err error) {
+	roomIDs, err := d.OutputEvents.SelectRoomIDsWithEvents(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("d.OutputEvents.SelectRoomIDsWithEvents: %w", err)
+	}
+	for _, roomID := range roomIDs {
+		var upTo types.StreamPosition
+		upTo, err = d.purgePositionForRoom(ctx, roomID, olderThan, maxEventsPerRoom)
+		if err != nil {
+			return purged, err
+		}
+		if upTo == 0 {
+			continue
+		}
+		err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+			deleted, e := d.OutputEvents.DeleteEventsUpTo(ctx, txn, roomID, upTo)
+			if e != nil {
+				return fmt.Errorf("d.OutputEvents.DeleteEventsUpTo: %w", e)
+			}
+			if e = d.Topology.DeleteTopologyUpTo(ctx, txn, roomID, upTo); e != nil {
+				return fmt.Errorf("d.Topology.DeleteTopologyUpTo: %w", e)
+			}
+			if e = d.Retention.UpdatePurgedPosition(ctx, txn, roomID, upTo); e != nil {
+				return fmt.Errorf("d.Retention.UpdatePurgedPosition: %w", e)
+			}
+			purged += deleted
+			return nil
+		})
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// purgePositionForRoom returns the stream position at or before which events
+// in the room should be purged, or 0 if none should be.
+func (d *Database) purgePositionForRoom(
+	ctx context.Context, roomID string, olderThan gomatrixserverlib.Timestamp, maxEventsPerRoom int,
+) (types.StreamPosition, error) {
+	// The newest event is never purged, so that the room still has a timeline.
+	keepFrom, err := d.OutputEvents.SelectPositionOfNthNewestEvent(ctx, nil, roomID, 1)
+	if err != nil {
+		return 0, fmt.Errorf("d.OutputEvents.SelectPositionOfNthNewestEvent: %w", err)
+	}
+	if keepFrom == 0 {
+		return 0, nil
+	}
+
+	var upTo types.StreamPosition
+	if maxEventsPerRoom > 0 {
+		upTo, err = d.OutputEvents.SelectPositionOfNthNewestEvent(ctx, nil, roomID, maxEventsPerRoom)
+		if err != nil {
+			return 0, fmt.Errorf("d.OutputEvents.SelectPositionOfNthNewestEvent: %w", err)
+		}
+	}
+
+	if olderThan != 0 {
+		// Timestamps aren't necessarily in stream order, so we stop at the
+		// first event which is new enough rather than purging any later
+		// events which happen to be older.
+		r := types.Range{From: upTo, To: keepFrom}
+	scan:
+		for r.From < r.To {
+			var events []types.StreamEvent
+			events, err = d.OutputEvents.SelectEarlyEvents(ctx, nil, roomID, r, purgeEventsBatchSize)
+			if err != nil {
+				return 0, fmt.Errorf("d.OutputEvents.SelectEarlyEvents: %w", err)
+			}
+			for _, event := range events {
+				if event.OriginServerTS() >= olderThan {
+					break scan
+				}
+				upTo = event.StreamPosition
+			}
+			if len(events) < purgeEventsBatchSize {
+				break
+			}
+			r.From = events[len(events)-1].StreamPosition
+		}
+	}
+
+	if upTo > keepFrom {
+		upTo = keepFrom
+	}
+	return upTo, nil
+}
+
+// RoomsPurgedSince implements Database.
+func (d *Database) RoomsPurgedSince(ctx context.Context, since types.StreamPosition) ([]string, error) {
+	return d.Retention.SelectRoomsPurgedAfter(ctx, nil, since)
+}
+
+// PurgeRoom implements Database.
+func (d *Database) PurgeRoom(
+	ctx context.Context, roomID string,
+) (sp types.StreamPosition, invitees []string, err error) {
+	invites, err := d.Invites.SelectActiveRoomInvites(ctx, nil, roomID)
+	if err != nil {
+		return 0, nil, err
+	}
+	for eventID, targetUserID := range invites {
+		var pos types.StreamPosition
+		if pos, err = d.Invites.DeleteInviteEvent(ctx, eventID); err != nil {
+			return sp, invitees, err
+		}
+		if pos > sp {
+			sp = pos
+		}
+		invitees = append(invitees, targetUserID)
+	}
+	err = sqlutil.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		pos, err := d.Peeks.DeleteRoomPeeks(ctx, txn, roomID)
+		if err != nil {
+			return err
+		}
+		if pos > sp {
+			sp = pos
+		}
+		return d.Purge.PurgeRoom(ctx, txn, roomID)
+	})
+	return sp, invitees, err
+}
+
+// PurgeSendToDeviceMessages implements Database.
+func (d *Database) PurgeSendToDeviceMessages(ctx context.Context, keep int) (purged int64, err error) {
+	err = d.SendToDeviceWriter.Do(d.DB, func(txn *sql.Tx) error {
+		purged, err = d.SendToDevice.DeleteSendToDeviceMessagesBeyondLimit(ctx, txn, keep)
+		return err
+	})
+	return
+}
+
 // There may be some overlap where events in stateEvents are already in recentEvents, so filter
 // them out so we don't include them twice in the /sync response. They should be in recentEvents
 // only, so clients get to the correct state once they have rolled forward.
@@ -1222,6 +2154,19 @@ func removeDuplicates(stateEvents, recentEvents []gomatrixserverlib.HeaderedEven
 
 // getMembershipFromEvent returns the value of content.membership iff the event is a state event
 // with type 'm.room.member' and state_key of userID. Otherwise, an empty string is returned.
+// stateUpTo returns the state events which happened at or before the given
+// stream position. This is used for rooms which the user is no longer in, so
+// that state changes made after they left don't leak to them.
+func stateUpTo(events []types.StreamEvent, pos types.StreamPosition) []types.StreamEvent {
+	filtered := make([]types.StreamEvent, 0, len(events))
+	for _, ev := range events {
+		if ev.StreamPosition <= pos {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
 func getMembershipFromEvent(ev *gomatrixserverlib.Event, userID string) string {
 	if ev.Type() == "m.room.member" && ev.StateKeyEquals(userID) {
 		membership, err := ev.Membership()
@@ -1233,6 +2178,13 @@ func getMembershipFromEvent(ev *gomatrixserverlib.Event, userID string) string {
 	return ""
 }
 
+// Rooms which a device is peeking into are sent down in their own section of
+// the sync response, so they are treated as pseudo-memberships in state deltas.
+const (
+	membershipPeek   = "peek"
+	membershipUnpeek = "unpeek"
+)
+
 type stateDelta struct {
 	roomID      string
 	stateEvents []gomatrixserverlib.HeaderedEvent
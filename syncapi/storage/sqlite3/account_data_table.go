@@ -18,6 +18,7 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
@@ -40,23 +41,28 @@ const insertAccountDataSQL = "" +
 	" ON CONFLICT (user_id, room_id, type) DO UPDATE" +
 	" SET id = EXCLUDED.id"
 
+// The filter conditions, ordering and limit are added by SelectAccountDataInRange.
 const selectAccountDataInRangeSQL = "" +
 	"SELECT room_id, type FROM syncapi_account_data_type" +
 	" WHERE user_id = $1 AND id > $2 AND id <= $3" +
-	" ORDER BY id ASC"
+	" AND ( room_id = '' OR room_id IN (" +
+	"  SELECT room_id FROM syncapi_current_room_state" +
+	"  WHERE type = 'm.room.member' AND state_key = $1 AND membership = 'join'" +
+	" ) )"
 
 const selectMaxAccountDataIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_account_data_type"
 
 type accountDataStatements struct {
-	streamIDStatements           *streamIDStatements
-	insertAccountDataStmt        *sql.Stmt
-	selectMaxAccountDataIDStmt   *sql.Stmt
-	selectAccountDataInRangeStmt *sql.Stmt
+	db                         *sql.DB
+	streamIDStatements         *streamIDStatements
+	insertAccountDataStmt      *sql.Stmt
+	selectMaxAccountDataIDStmt *sql.Stmt
 }
 
 func NewSqliteAccountDataTable(db *sql.DB, streamID *streamIDStatements) (tables.AccountData, error) {
 	s := &accountDataStatements{
+		db:                 db,
 		streamIDStatements: streamID,
 	}
 	_, err := db.Exec(accountDataSchema)
@@ -69,9 +75,6 @@ func NewSqliteAccountDataTable(db *sql.DB, streamID *streamIDStatements) (tables
 	if s.selectMaxAccountDataIDStmt, err = db.Prepare(selectMaxAccountDataIDSQL); err != nil {
 		return nil, err
 	}
-	if s.selectAccountDataInRangeStmt, err = db.Prepare(selectAccountDataInRangeSQL); err != nil {
-		return nil, err
-	}
 	return s, nil
 }
 
@@ -95,14 +98,19 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 ) (data map[string][]string, err error) {
 	data = make(map[string][]string)
 
-	rows, err := s.selectAccountDataInRangeStmt.QueryContext(ctx, userID, r.Low(), r.High())
+	query, params := appendFilters(
+		selectAccountDataInRangeSQL, []interface{}{userID, r.Low(), r.High()},
+		nil, nil, accountDataFilterPart.Types, accountDataFilterPart.NotTypes, nil,
+	)
+	query += fmt.Sprintf(" ORDER BY id ASC LIMIT $%d", len(params)+1)
+	params = append(params, accountDataFilterPart.Limit)
+
+	rows, err := queryTxn(ctx, s.db, nil, query, params...)
 	if err != nil {
 		return
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "selectAccountDataInRange: rows.close() failed")
 
-	var entries int
-
 	for rows.Next() {
 		var dataType string
 		var roomID string
@@ -111,34 +119,10 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 			return
 		}
 
-		// check if we should add this by looking at the filter.
-		// It would be nice if we could do this in SQL-land, but the mix of variadic
-		// and positional parameters makes the query annoyingly hard to do, it's easier
-		// and clearer to do it in Go-land. If there are no filters for [not]types then
-		// this gets skipped.
-		for _, includeType := range accountDataFilterPart.Types {
-			if includeType != dataType { // TODO: wildcard support
-				continue
-			}
-		}
-		for _, excludeType := range accountDataFilterPart.NotTypes {
-			if excludeType == dataType { // TODO: wildcard support
-				continue
-			}
-		}
-
-		if len(data[roomID]) > 0 {
-			data[roomID] = append(data[roomID], dataType)
-		} else {
-			data[roomID] = []string{dataType}
-		}
-		entries++
-		if entries >= accountDataFilterPart.Limit {
-			break
-		}
+		data[roomID] = append(data[roomID], dataType)
 	}
 
-	return data, nil
+	return data, rows.Err()
 }
 
 func (s *accountDataStatements) SelectMaxAccountDataID(
@@ -19,6 +19,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"strings"
 
 	"github.com/matrix-org/dendrite/internal"
@@ -26,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 const currentRoomStateSchema = `
@@ -60,18 +62,26 @@ const deleteRoomStateByEventIDSQL = "" +
 const selectRoomIDsWithMembershipSQL = "" +
 	"SELECT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2"
 
+const selectMembershipPositionsSQL = "" +
+	"SELECT room_id, added_at FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2"
+
+// The filter conditions and limit are added by SelectCurrentState.
 const selectCurrentStateSQL = "" +
-	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1" +
-	" AND ( $2 IS NULL OR     sender IN ($2)  )" +
-	" AND ( $3 IS NULL OR NOT(sender IN ($3)) )" +
-	" AND ( $4 IS NULL OR     type   IN ($4)  )" +
-	" AND ( $5 IS NULL OR NOT(type   IN ($5)) )" +
-	" AND ( $6 IS NULL OR     contains_url = $6  )" +
-	" LIMIT $7"
+	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1"
 
 const selectJoinedUsersSQL = "" +
 	"SELECT room_id, state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND membership = 'join'"
 
+const selectMembershipCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_current_room_state WHERE type = 'm.room.member' AND room_id = $1 AND membership = $2"
+
+// Prefer members who are joined or invited, falling back to those who have
+// left or been banned if there aren't enough of them.
+const selectHeroesSQL = "" +
+	"SELECT state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND room_id = $1 AND state_key != $2" +
+	" ORDER BY CASE WHEN membership = 'join' OR membership = 'invite' THEN 0 ELSE 1 END, added_at ASC" +
+	" LIMIT $3"
+
 const selectStateEventSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
 
@@ -84,17 +94,21 @@ const selectEventsWithEventIDsSQL = "" +
 	" FROM syncapi_current_room_state WHERE event_id IN ($1)"
 
 type currentRoomStateStatements struct {
+	db                              *sql.DB
 	streamIDStatements              *streamIDStatements
 	upsertRoomStateStmt             *sql.Stmt
 	deleteRoomStateByEventIDStmt    *sql.Stmt
 	selectRoomIDsWithMembershipStmt *sql.Stmt
-	selectCurrentStateStmt          *sql.Stmt
+	selectMembershipPositionsStmt   *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
 	selectStateEventStmt            *sql.Stmt
+	selectMembershipCountStmt       *sql.Stmt
+	selectHeroesStmt                *sql.Stmt
 }
 
 func NewSqliteCurrentRoomStateTable(db *sql.DB, streamID *streamIDStatements) (tables.CurrentRoomState, error) {
 	s := &currentRoomStateStatements{
+		db:                 db,
 		streamIDStatements: streamID,
 	}
 	_, err := db.Exec(currentRoomStateSchema)
@@ -110,7 +124,7 @@ func NewSqliteCurrentRoomStateTable(db *sql.DB, streamID *streamIDStatements) (t
 	if s.selectRoomIDsWithMembershipStmt, err = db.Prepare(selectRoomIDsWithMembershipSQL); err != nil {
 		return nil, err
 	}
-	if s.selectCurrentStateStmt, err = db.Prepare(selectCurrentStateSQL); err != nil {
+	if s.selectMembershipPositionsStmt, err = db.Prepare(selectMembershipPositionsSQL); err != nil {
 		return nil, err
 	}
 	if s.selectJoinedUsersStmt, err = db.Prepare(selectJoinedUsersSQL); err != nil {
@@ -119,9 +133,47 @@ func NewSqliteCurrentRoomStateTable(db *sql.DB, streamID *streamIDStatements) (t
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMembershipCountStmt, err = db.Prepare(selectMembershipCountSQL); err != nil {
+		return nil, err
+	}
+	if s.selectHeroesStmt, err = db.Prepare(selectHeroesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+// SelectMembershipCount returns the number of users in the given room with the given membership.
+func (s *currentRoomStateStatements) SelectMembershipCount(
+	ctx context.Context, txn *sql.Tx, roomID, membership string,
+) (count int, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipCountStmt)
+	err = stmt.QueryRowContext(ctx, roomID, membership).Scan(&count)
+	return
+}
+
+// SelectHeroes returns up to limit user IDs from the membership of the given room, excluding
+// the given user. Joined and invited users are returned before those who have left.
+func (s *currentRoomStateStatements) SelectHeroes(
+	ctx context.Context, txn *sql.Tx, roomID, excludeUserID string, limit int,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectHeroesStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, excludeUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectHeroes: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		result = append(result, userID)
+	}
+	return result, rows.Err()
+}
+
 // JoinedMemberLists returns a map of room ID to a list of joined user IDs.
 func (s *currentRoomStateStatements) SelectJoinedUsers(
 	ctx context.Context,
@@ -143,7 +195,7 @@ func (s *currentRoomStateStatements) SelectJoinedUsers(
 		users = append(users, userID)
 		result[roomID] = users
 	}
-	return result, nil
+	return result, rows.Err()
 }
 
 // SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
@@ -168,7 +220,34 @@ func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 		}
 		result = append(result, roomID)
 	}
-	return result, nil
+	return result, rows.Err()
+}
+
+// SelectMembershipPositions returns the rooms in which the given user has the
+// given membership, along with the stream position at which they got it.
+func (s *currentRoomStateStatements) SelectMembershipPositions(
+	ctx context.Context,
+	txn *sql.Tx,
+	userID string,
+	membership string,
+) (map[string]types.StreamPosition, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipPositionsStmt)
+	rows, err := stmt.QueryContext(ctx, userID, membership)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMembershipPositions: rows.close() failed")
+
+	result := make(map[string]types.StreamPosition)
+	for rows.Next() {
+		var roomID string
+		var addedAt sql.NullInt64
+		if err := rows.Scan(&roomID, &addedAt); err != nil {
+			return nil, err
+		}
+		result[roomID] = types.StreamPosition(addedAt.Int64)
+	}
+	return result, rows.Err()
 }
 
 // CurrentState returns all the current state events for the given room.
@@ -176,15 +255,15 @@ func (s *currentRoomStateStatements) SelectCurrentState(
 	ctx context.Context, txn *sql.Tx, roomID string,
 	stateFilterPart *gomatrixserverlib.StateFilter,
 ) ([]gomatrixserverlib.HeaderedEvent, error) {
-	stmt := sqlutil.TxStmt(txn, s.selectCurrentStateStmt)
-	rows, err := stmt.QueryContext(ctx, roomID,
-		nil, // FIXME: pq.StringArray(stateFilterPart.Senders),
-		nil, // FIXME: pq.StringArray(stateFilterPart.NotSenders),
-		nil, // FIXME: pq.StringArray(filterConvertTypeWildcardToSQL(stateFilterPart.Types)),
-		nil, // FIXME: pq.StringArray(filterConvertTypeWildcardToSQL(stateFilterPart.NotTypes)),
+	query, params := appendFilters(
+		selectCurrentStateSQL, []interface{}{roomID},
+		stateFilterPart.Senders, stateFilterPart.NotSenders,
+		stateFilterPart.Types, stateFilterPart.NotTypes,
 		stateFilterPart.ContainsURL,
-		stateFilterPart.Limit,
 	)
+	query += fmt.Sprintf(" LIMIT $%d", len(params)+1)
+	params = append(params, stateFilterPart.Limit)
+	rows, err := queryTxn(ctx, s.db, txn, query, params...)
 	if err != nil {
 		return nil, err
 	}
@@ -205,13 +284,8 @@ func (s *currentRoomStateStatements) UpsertRoomState(
 	ctx context.Context, txn *sql.Tx,
 	event gomatrixserverlib.HeaderedEvent, membership *string, addedAt types.StreamPosition,
 ) error {
-	// Parse content as JSON and search for an "url" key
-	containsURL := false
-	var content map[string]interface{}
-	if json.Unmarshal(event.Content(), &content) != nil {
-		// Set containsURL to true if url is present
-		_, containsURL = content["url"]
-	}
+	// Look for a "url" key without decoding the whole of the content
+	containsURL := gjson.GetBytes(event.Content(), "url").Exists()
 
 	headeredJSON, err := json.Marshal(event)
 	if err != nil {
@@ -243,7 +317,7 @@ func (s *currentRoomStateStatements) SelectEventsWithEventIDs(
 		iEventIDs[k] = v
 	}
 	query := strings.Replace(selectEventsWithEventIDsSQL, "($1)", sqlutil.QueryVariadic(len(iEventIDs)), 1)
-	rows, err := txn.QueryContext(ctx, query, iEventIDs...)
+	rows, err := queryTxn(ctx, s.db, txn, query, iEventIDs...)
 	if err != nil {
 		return nil, err
 	}
@@ -265,7 +339,7 @@ func rowsToEvents(rows *sql.Rows) ([]gomatrixserverlib.HeaderedEvent, error) {
 		}
 		result = append(result, ev)
 	}
-	return result, nil
+	return result, rows.Err()
 }
 
 func (s *currentRoomStateStatements) SelectStateEvent(
@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// appendFilters appends conditions for the given filter fields to the query,
+// along with their parameters. SQLite has no array types, so unlike Postgres
+// we can't pass the lists as a single parameter and have to expand them into
+// the query instead. Empty lists and a nil containsURL are ignored. The query
+// must already have a WHERE clause. Types are matched with GLOB, which is
+// case-sensitive like event types and uses the same '*' wildcard as filters.
+func appendFilters(
+	query string, params []interface{},
+	senders, notSenders, types, notTypes []string,
+	containsURL *bool,
+) (string, []interface{}) {
+	var b strings.Builder
+	b.WriteString(query)
+	if len(senders) > 0 {
+		b.WriteString(" AND sender IN " + queryVariadicFrom(len(senders), len(params)))
+		params = appendStrings(params, senders)
+	}
+	if len(notSenders) > 0 {
+		b.WriteString(" AND sender NOT IN " + queryVariadicFrom(len(notSenders), len(params)))
+		params = appendStrings(params, notSenders)
+	}
+	if len(types) > 0 {
+		b.WriteString(" AND (" + globConditions("type", len(types), len(params)) + ")")
+		params = appendStrings(params, types)
+	}
+	if len(notTypes) > 0 {
+		b.WriteString(" AND NOT (" + globConditions("type", len(notTypes), len(params)) + ")")
+		params = appendStrings(params, notTypes)
+	}
+	if containsURL != nil {
+		b.WriteString(fmt.Sprintf(" AND contains_url = $%d", len(params)+1))
+		params = append(params, *containsURL)
+	}
+	return b.String(), params
+}
+
+// queryVariadicFrom returns a list of count parameters, numbered after the
+// given number of existing parameters, e.g. "($3, $4)".
+func queryVariadicFrom(count, existing int) string {
+	placeholders := make([]string, count)
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", existing+i+1)
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")"
+}
+
+// globConditions returns count GLOB conditions on the column joined with OR,
+// numbered after the given number of existing parameters.
+func globConditions(column string, count, existing int) string {
+	conditions := make([]string, count)
+	for i := range conditions {
+		conditions[i] = fmt.Sprintf("%s GLOB $%d", column, existing+i+1)
+	}
+	return strings.Join(conditions, " OR ")
+}
+
+func appendStrings(params []interface{}, values []string) []interface{} {
+	for _, v := range values {
+		params = append(params, v)
+	}
+	return params
+}
+
+// queryTxn runs a query which couldn't be prepared up front, in the
+// transaction if there is one.
+func queryTxn(
+	ctx context.Context, db *sql.DB, txn *sql.Tx, query string, params ...interface{},
+) (*sql.Rows, error) {
+	if txn != nil {
+		return txn.QueryContext(ctx, query, params...)
+	}
+	return db.QueryContext(ctx, query, params...)
+}
@@ -41,28 +41,41 @@ CREATE INDEX IF NOT EXISTS syncapi_invites_target_user_id_idx ON syncapi_invite_
 CREATE INDEX IF NOT EXISTS syncapi_invites_event_id_idx ON syncapi_invite_events (event_id);
 `
 
+// An invite which we already know about, even if it has since been retired,
+// is ignored so that it isn't sent to the user again.
 const insertInviteEventSQL = "" +
 	"INSERT INTO syncapi_invite_events" +
 	" (id, room_id, event_id, target_user_id, headered_event_json, deleted)" +
-	" VALUES ($1, $2, $3, $4, $5, false)"
+	" SELECT $1, $2, $3, $4, $5, false" +
+	" WHERE NOT EXISTS (SELECT 1 FROM syncapi_invite_events WHERE event_id = $3)"
 
 const deleteInviteEventSQL = "" +
-	"UPDATE syncapi_invite_events SET deleted=true, id=$1 WHERE event_id = $2"
+	"UPDATE syncapi_invite_events SET deleted=true, id=$1 WHERE event_id = $2 AND deleted = false"
 
 const selectInviteEventsInRangeSQL = "" +
 	"SELECT room_id, headered_event_json, deleted FROM syncapi_invite_events" +
 	" WHERE target_user_id = $1 AND id > $2 AND id <= $3" +
 	" ORDER BY id DESC"
 
+const selectActiveInviteEventIDsSQL = "" +
+	"SELECT event_id FROM syncapi_invite_events" +
+	" WHERE room_id = $1 AND target_user_id = $2 AND deleted = false"
+
+const selectActiveRoomInvitesSQL = "" +
+	"SELECT event_id, target_user_id FROM syncapi_invite_events" +
+	" WHERE room_id = $1 AND deleted = false"
+
 const selectMaxInviteIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_invite_events"
 
 type inviteEventsStatements struct {
-	streamIDStatements            *streamIDStatements
-	insertInviteEventStmt         *sql.Stmt
-	selectInviteEventsInRangeStmt *sql.Stmt
-	deleteInviteEventStmt         *sql.Stmt
-	selectMaxInviteIDStmt         *sql.Stmt
+	streamIDStatements             *streamIDStatements
+	insertInviteEventStmt          *sql.Stmt
+	selectInviteEventsInRangeStmt  *sql.Stmt
+	deleteInviteEventStmt          *sql.Stmt
+	selectActiveInviteEventIDsStmt *sql.Stmt
+	selectActiveRoomInvitesStmt    *sql.Stmt
+	selectMaxInviteIDStmt          *sql.Stmt
 }
 
 func NewSqliteInvitesTable(db *sql.DB, streamID *streamIDStatements) (tables.Invites, error) {
@@ -82,6 +95,12 @@ func NewSqliteInvitesTable(db *sql.DB, streamID *streamIDStatements) (tables.Inv
 	if s.deleteInviteEventStmt, err = db.Prepare(deleteInviteEventSQL); err != nil {
 		return nil, err
 	}
+	if s.selectActiveInviteEventIDsStmt, err = db.Prepare(selectActiveInviteEventIDsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectActiveRoomInvitesStmt, err = db.Prepare(selectActiveRoomInvitesSQL); err != nil {
+		return nil, err
+	}
 	if s.selectMaxInviteIDStmt, err = db.Prepare(selectMaxInviteIDSQL); err != nil {
 		return nil, err
 	}
@@ -102,7 +121,7 @@ func (s *inviteEventsStatements) InsertInviteEvent(
 		return
 	}
 
-	_, err = txn.Stmt(s.insertInviteEventStmt).ExecContext(
+	res, err := txn.Stmt(s.insertInviteEventStmt).ExecContext(
 		ctx,
 		streamPos,
 		inviteEvent.RoomID(),
@@ -110,6 +129,12 @@ func (s *inviteEventsStatements) InsertInviteEvent(
 		*inviteEvent.StateKey(),
 		headeredJSON,
 	)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, err
+	}
 	return
 }
 
@@ -120,12 +145,20 @@ func (s *inviteEventsStatements) DeleteInviteEvent(
 	if err != nil {
 		return streamPos, err
 	}
-	_, err = s.deleteInviteEventStmt.ExecContext(ctx, streamPos, inviteEventID)
-	return streamPos, err
+	res, err := s.deleteInviteEventStmt.ExecContext(ctx, streamPos, inviteEventID)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, err
+	}
+	return streamPos, nil
 }
 
 // selectInviteEventsInRange returns a map of room ID to invite event for the
-// active invites for the target user ID in the supplied range.
+// active invites for the target user ID in the supplied range, and another for
+// the retired ones. Only the newest invite for each room is returned, so a room
+// is never both invited and retired.
 func (s *inviteEventsStatements) SelectInviteEventsInRange(
 	ctx context.Context, txn *sql.Tx, targetUserID string, r types.Range,
 ) (map[string]gomatrixserverlib.HeaderedEvent, map[string]gomatrixserverlib.HeaderedEvent, error) {
@@ -146,6 +179,13 @@ func (s *inviteEventsStatements) SelectInviteEventsInRange(
 		if err = rows.Scan(&roomID, &eventJSON, &deleted); err != nil {
 			return nil, nil, err
 		}
+		// the rows are newest first
+		if _, ok := result[roomID]; ok {
+			continue
+		}
+		if _, ok := retired[roomID]; ok {
+			continue
+		}
 
 		var event gomatrixserverlib.HeaderedEvent
 		if err := json.Unmarshal(eventJSON, &event); err != nil {
@@ -157,7 +197,47 @@ func (s *inviteEventsStatements) SelectInviteEventsInRange(
 			result[roomID] = event
 		}
 	}
-	return result, retired, nil
+	return result, retired, rows.Err()
+}
+
+func (s *inviteEventsStatements) SelectActiveInviteEventIDs(
+	ctx context.Context, txn *sql.Tx, roomID, targetUserID string,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectActiveInviteEventIDsStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, targetUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectActiveInviteEventIDs: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *inviteEventsStatements) SelectActiveRoomInvites(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (map[string]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectActiveRoomInvitesStmt)
+	rows, err := stmt.QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectActiveRoomInvites: rows.close() failed")
+	invites := make(map[string]string)
+	for rows.Next() {
+		var eventID, targetUserID string
+		if err = rows.Scan(&eventID, &targetUserID); err != nil {
+			return nil, err
+		}
+		invites[eventID] = targetUserID
+	}
+	return invites, rows.Err()
 }
 
 func (s *inviteEventsStatements) SelectMaxInviteID(
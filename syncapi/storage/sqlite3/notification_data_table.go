@@ -0,0 +1,161 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const notificationDataSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_notification_data (
+    id INTEGER PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    notification_count BIGINT NOT NULL DEFAULT 0,
+    highlight_count BIGINT NOT NULL DEFAULT 0,
+    UNIQUE (user_id, room_id)
+);
+`
+
+const incrementNotificationCountsSQL = "" +
+	"INSERT INTO syncapi_notification_data (id, user_id, room_id, notification_count, highlight_count)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, room_id) DO UPDATE SET id = excluded.id," +
+	"  notification_count = notification_count + excluded.notification_count," +
+	"  highlight_count = highlight_count + excluded.highlight_count"
+
+const selectNotificationCountsSQL = "" +
+	"SELECT notification_count, highlight_count FROM syncapi_notification_data" +
+	" WHERE user_id = $1 AND room_id = $2"
+
+const resetNotificationCountsSQL = "" +
+	"UPDATE syncapi_notification_data SET id = $1, notification_count = 0, highlight_count = 0" +
+	" WHERE user_id = $2 AND room_id = $3"
+
+const selectUserNotificationCountsSQL = "" +
+	"SELECT room_id, id, notification_count, highlight_count FROM syncapi_notification_data" +
+	" WHERE user_id = $1"
+
+const selectMaxNotificationIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_notification_data"
+
+type notificationDataStatements struct {
+	streamIDStatements               *streamIDStatements
+	incrementNotificationCountsStmt  *sql.Stmt
+	selectNotificationCountsStmt     *sql.Stmt
+	resetNotificationCountsStmt      *sql.Stmt
+	selectUserNotificationCountsStmt *sql.Stmt
+	selectMaxNotificationIDStmt      *sql.Stmt
+}
+
+func NewSqliteNotificationDataTable(db *sql.DB, streamID *streamIDStatements) (tables.NotificationData, error) {
+	s := &notificationDataStatements{
+		streamIDStatements: streamID,
+	}
+	_, err := db.Exec(notificationDataSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.incrementNotificationCountsStmt, err = db.Prepare(incrementNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectNotificationCountsStmt, err = db.Prepare(selectNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.resetNotificationCountsStmt, err = db.Prepare(resetNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectUserNotificationCountsStmt, err = db.Prepare(selectUserNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxNotificationIDStmt, err = db.Prepare(selectMaxNotificationIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *notificationDataStatements) IncrementNotificationCounts(
+	ctx context.Context, txn *sql.Tx,
+	userID, roomID string, notificationCount, highlightCount int,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextStreamID(ctx, txn)
+	if err != nil {
+		return
+	}
+	stmt := sqlutil.TxStmt(txn, s.incrementNotificationCountsStmt)
+	_, err = stmt.ExecContext(ctx, pos, userID, roomID, notificationCount, highlightCount)
+	return
+}
+
+func (s *notificationDataStatements) ResetNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) (pos types.StreamPosition, err error) {
+	var notificationCount, highlightCount int
+	stmt := sqlutil.TxStmt(txn, s.selectNotificationCountsStmt)
+	err = stmt.QueryRowContext(ctx, userID, roomID).Scan(&notificationCount, &highlightCount)
+	if err == sql.ErrNoRows || (err == nil && notificationCount == 0 && highlightCount == 0) {
+		// There was nothing to reset.
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+	pos, err = s.streamIDStatements.nextStreamID(ctx, txn)
+	if err != nil {
+		return
+	}
+	stmt = sqlutil.TxStmt(txn, s.resetNotificationCountsStmt)
+	_, err = stmt.ExecContext(ctx, pos, userID, roomID)
+	return
+}
+
+func (s *notificationDataStatements) SelectUserNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (map[string]types.NotificationData, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectUserNotificationCountsStmt)
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUserNotificationCounts: rows.close() failed")
+
+	counts := make(map[string]types.NotificationData)
+	for rows.Next() {
+		var roomID string
+		var data types.NotificationData
+		if err = rows.Scan(&roomID, &data.StreamPosition, &data.NotificationCount, &data.HighlightCount); err != nil {
+			return nil, err
+		}
+		counts[roomID] = data
+	}
+	return counts, rows.Err()
+}
+
+func (s *notificationDataStatements) SelectMaxNotificationID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxNotificationIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"sort"
 
 	"github.com/matrix-org/dendrite/internal"
@@ -29,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 const outputRoomEventsSchema = `
@@ -80,43 +82,46 @@ const updateEventJSONSQL = "" +
 	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
 
 // In order for us to apply the state updates correctly, rows need to be ordered in the order they were received (id).
-/*
-	$1 = oldPos,
-	$2 = newPos,
-	$3 = pq.StringArray(stateFilterPart.Senders),
-	$4 = pq.StringArray(stateFilterPart.NotSenders),
-	$5 = pq.StringArray(filterConvertTypeWildcardToSQL(stateFilterPart.Types)),
-	$6 = pq.StringArray(filterConvertTypeWildcardToSQL(stateFilterPart.NotTypes)),
-	$7 = stateFilterPart.ContainsURL,
-	$8 = stateFilterPart.Limit,
-*/
+// The filter conditions, ordering and limit are added by SelectStateInRange.
 const selectStateInRangeSQL = "" +
 	"SELECT id, headered_event_json, exclude_from_sync, add_state_ids, remove_state_ids" +
 	" FROM syncapi_output_room_events" +
 	" WHERE (id > $1 AND id <= $2)" + // old/new pos
-	" AND (add_state_ids IS NOT NULL OR remove_state_ids IS NOT NULL)" +
-	/*	" AND ( $3 IS NULL OR     sender  IN ($3)  )" + // sender
-		" AND ( $4 IS NULL OR NOT(sender  IN ($4)) )" + // not sender
-		" AND ( $5 IS NULL OR     type    IN ($5)  )" + // type
-		" AND ( $6 IS NULL OR NOT(type    IN ($6)) )" + // not type
-		" AND ( $7 IS NULL OR     contains_url = $7)" + // contains URL? */
-	" ORDER BY id ASC" +
-	" LIMIT $8" // limit
+	" AND (add_state_ids IS NOT NULL OR remove_state_ids IS NOT NULL)"
+
+// The type filters are added by SelectRemovedStateEventIDs.
+const selectRemovedStateEventIDsSQL = "" +
+	"SELECT remove_state_ids FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND id > $2 AND remove_state_ids IS NOT NULL"
+
+const selectRoomIDsWithEventsSQL = "" +
+	"SELECT DISTINCT room_id FROM syncapi_output_room_events"
+
+const selectPositionOfNthNewestEventSQL = "" +
+	"SELECT id FROM syncapi_output_room_events WHERE room_id = $1" +
+	" ORDER BY id DESC LIMIT 1 OFFSET $2"
+
+const deleteEventsUpToSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1 AND id <= $2"
 
 type outputRoomEventsStatements struct {
-	streamIDStatements            *streamIDStatements
-	insertEventStmt               *sql.Stmt
-	selectEventsStmt              *sql.Stmt
-	selectMaxEventIDStmt          *sql.Stmt
-	selectRecentEventsStmt        *sql.Stmt
-	selectRecentEventsForSyncStmt *sql.Stmt
-	selectEarlyEventsStmt         *sql.Stmt
-	selectStateInRangeStmt        *sql.Stmt
-	updateEventJSONStmt           *sql.Stmt
+	db                                 *sql.DB
+	streamIDStatements                 *streamIDStatements
+	insertEventStmt                    *sql.Stmt
+	selectEventsStmt                   *sql.Stmt
+	selectMaxEventIDStmt               *sql.Stmt
+	selectRecentEventsStmt             *sql.Stmt
+	selectRecentEventsForSyncStmt      *sql.Stmt
+	selectEarlyEventsStmt              *sql.Stmt
+	updateEventJSONStmt                *sql.Stmt
+	selectRoomIDsWithEventsStmt        *sql.Stmt
+	selectPositionOfNthNewestEventStmt *sql.Stmt
+	deleteEventsUpToStmt               *sql.Stmt
 }
 
 func NewSqliteEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Events, error) {
 	s := &outputRoomEventsStatements{
+		db:                 db,
 		streamIDStatements: streamID,
 	}
 	_, err := db.Exec(outputRoomEventsSchema)
@@ -141,10 +146,16 @@ func NewSqliteEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Even
 	if s.selectEarlyEventsStmt, err = db.Prepare(selectEarlyEventsSQL); err != nil {
 		return nil, err
 	}
-	if s.selectStateInRangeStmt, err = db.Prepare(selectStateInRangeSQL); err != nil {
+	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONSQL); err != nil {
 		return nil, err
 	}
-	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONSQL); err != nil {
+	if s.selectRoomIDsWithEventsStmt, err = db.Prepare(selectRoomIDsWithEventsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectPositionOfNthNewestEventStmt, err = db.Prepare(selectPositionOfNthNewestEventSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteEventsUpToStmt, err = db.Prepare(deleteEventsUpToSQL); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -166,17 +177,16 @@ func (s *outputRoomEventsStatements) SelectStateInRange(
 	ctx context.Context, txn *sql.Tx, r types.Range,
 	stateFilterPart *gomatrixserverlib.StateFilter,
 ) (map[string]map[string]bool, map[string]types.StreamEvent, error) {
-	stmt := sqlutil.TxStmt(txn, s.selectStateInRangeStmt)
-
-	rows, err := stmt.QueryContext(
-		ctx, r.Low(), r.High(),
-		/*pq.StringArray(stateFilterPart.Senders),
-		pq.StringArray(stateFilterPart.NotSenders),
-		pq.StringArray(filterConvertTypeWildcardToSQL(stateFilterPart.Types)),
-		pq.StringArray(filterConvertTypeWildcardToSQL(stateFilterPart.NotTypes)),
-		stateFilterPart.ContainsURL,*/
-		stateFilterPart.Limit,
+	query, params := appendFilters(
+		selectStateInRangeSQL, []interface{}{r.Low(), r.High()},
+		stateFilterPart.Senders, stateFilterPart.NotSenders,
+		stateFilterPart.Types, stateFilterPart.NotTypes,
+		stateFilterPart.ContainsURL,
 	)
+	query += fmt.Sprintf(" ORDER BY id ASC LIMIT $%d", len(params)+1)
+	params = append(params, stateFilterPart.Limit)
+
+	rows, err := queryTxn(ctx, s.db, txn, query, params...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -196,14 +206,14 @@ func (s *outputRoomEventsStatements) SelectStateInRange(
 			streamPos       types.StreamPosition
 			eventBytes      []byte
 			excludeFromSync bool
-			addIDsJSON      string
-			delIDsJSON      string
+			addIDsJSON      sql.NullString
+			delIDsJSON      sql.NullString
 		)
 		if err := rows.Scan(&streamPos, &eventBytes, &excludeFromSync, &addIDsJSON, &delIDsJSON); err != nil {
 			return nil, nil, err
 		}
 
-		addIDs, delIDs, err := unmarshalStateIDs(addIDsJSON, delIDsJSON)
+		addIDs, delIDs, err := unmarshalStateIDs(addIDsJSON.String, delIDsJSON.String)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -214,8 +224,8 @@ func (s *outputRoomEventsStatements) SelectStateInRange(
 			log.WithFields(log.Fields{
 				"since":   r.From,
 				"current": r.To,
-				"adds":    addIDsJSON,
-				"dels":    delIDsJSON,
+				"adds":    addIDsJSON.String,
+				"dels":    delIDsJSON.String,
 			}).Warn("StateBetween: ignoring deleted state")
 		}
 
@@ -275,13 +285,8 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		txnID = &transactionID.TransactionID
 	}
 
-	// Parse content as JSON and search for an "url" key
-	containsURL := false
-	var content map[string]interface{}
-	if json.Unmarshal(event.Content(), &content) != nil {
-		// Set containsURL to true if url is present
-		_, containsURL = content["url"]
-	}
+	// Look for a "url" key without decoding the whole of the content
+	containsURL := gjson.GetBytes(event.Content(), "url").Exists()
 
 	var headeredJSON []byte
 	headeredJSON, err = json.Marshal(event)
@@ -294,12 +299,13 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		return
 	}
 
-	addStateJSON, err := json.Marshal(addState)
-	if err != nil {
+	// Store NULL rather than a JSON "null" when there is no state delta,
+	// so that the event isn't picked up by selectStateInRange.
+	var addStateJSON, removeStateJSON *string
+	if addStateJSON, err = marshalStateIDs(addState); err != nil {
 		return
 	}
-	removeStateJSON, err := json.Marshal(removeState)
-	if err != nil {
+	if removeStateJSON, err = marshalStateIDs(removeState); err != nil {
 		return
 	}
 
@@ -313,8 +319,8 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		event.Type(),
 		event.Sender(),
 		containsURL,
-		string(addStateJSON),
-		string(removeStateJSON),
+		addStateJSON,
+		removeStateJSON,
 		sessionID,
 		txnID,
 		excludeFromSync,
@@ -446,6 +452,18 @@ func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 	return result, nil
 }
 
+func marshalStateIDs(stateIDs []string) (*string, error) {
+	if stateIDs == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(stateIDs)
+	if err != nil {
+		return nil, err
+	}
+	stateIDsJSON := string(b)
+	return &stateIDsJSON, nil
+}
+
 func unmarshalStateIDs(addIDsJSON, delIDsJSON string) (addIDs []string, delIDs []string, err error) {
 	if len(addIDsJSON) > 0 {
 		if err = json.Unmarshal([]byte(addIDsJSON), &addIDs); err != nil {
@@ -459,3 +477,74 @@ func unmarshalStateIDs(addIDsJSON, delIDsJSON string) (addIDs []string, delIDs [
 	}
 	return
 }
+
+func (s *outputRoomEventsStatements) SelectRemovedStateEventIDs(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition,
+	stateFilter *gomatrixserverlib.StateFilter,
+) ([]string, error) {
+	query, params := appendFilters(
+		selectRemovedStateEventIDsSQL, []interface{}{roomID, pos},
+		nil, nil, stateFilter.Types, stateFilter.NotTypes, nil,
+	)
+	rows, err := queryTxn(ctx, s.db, txn, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRemovedStateEventIDs: rows.close() failed")
+	var eventIDs []string
+	for rows.Next() {
+		var delIDsJSON string
+		var delIDs []string
+		if err = rows.Scan(&delIDsJSON); err != nil {
+			return nil, err
+		}
+		if _, delIDs, err = unmarshalStateIDs("", delIDsJSON); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, delIDs...)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) SelectRoomIDsWithEvents(
+	ctx context.Context, txn *sql.Tx,
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomIDsWithEventsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomIDsWithEvents: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) SelectPositionOfNthNewestEvent(
+	ctx context.Context, txn *sql.Tx, roomID string, n int,
+) (types.StreamPosition, error) {
+	var pos types.StreamPosition
+	stmt := sqlutil.TxStmt(txn, s.selectPositionOfNthNewestEventStmt)
+	err := stmt.QueryRowContext(ctx, roomID, n).Scan(&pos)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return pos, err
+}
+
+func (s *outputRoomEventsStatements) DeleteEventsUpTo(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition,
+) (int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteEventsUpToStmt)
+	res, err := stmt.ExecContext(ctx, roomID, pos)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -45,32 +46,43 @@ const insertEventInTopologySQL = "" +
 
 const selectEventIDsInRangeASCSQL = "" +
 	"SELECT event_id FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND (" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	") ORDER BY topological_position ASC, stream_position ASC LIMIT $6"
+	" WHERE room_id = $1" +
+	" AND (topological_position > $2 OR (topological_position = $2 AND stream_position > $3))" +
+	" AND (topological_position < $4 OR (topological_position = $4 AND stream_position <= $5))" +
+	" ORDER BY topological_position ASC, stream_position ASC LIMIT $6"
 
 const selectEventIDsInRangeDESCSQL = "" +
-	"SELECT event_id  FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND (" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	") ORDER BY topological_position DESC, stream_position DESC LIMIT $6"
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" AND (topological_position > $2 OR (topological_position = $2 AND stream_position > $3))" +
+	" AND (topological_position < $4 OR (topological_position = $4 AND stream_position <= $5))" +
+	" ORDER BY topological_position DESC, stream_position DESC LIMIT $6"
 
 const selectPositionInTopologySQL = "" +
 	"SELECT topological_position, stream_position FROM syncapi_output_room_events_topology" +
 	" WHERE event_id = $1"
 
 const selectMaxPositionInTopologySQL = "" +
-	"SELECT MAX(topological_position), stream_position FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 ORDER BY stream_position DESC"
+	"SELECT topological_position, stream_position FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND topological_position = (" +
+	"SELECT MAX(topological_position) FROM syncapi_output_room_events_topology WHERE room_id = $1" +
+	") ORDER BY stream_position DESC LIMIT 1"
+
+const selectStreamToTopologicalPositionSQL = "" +
+	"SELECT MAX(topological_position) FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND stream_position <= $2"
+
+const deleteTopologyUpToSQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1 AND stream_position <= $2"
 
 type outputRoomEventsTopologyStatements struct {
-	insertEventInTopologyStmt       *sql.Stmt
-	selectEventIDsInRangeASCStmt    *sql.Stmt
-	selectEventIDsInRangeDESCStmt   *sql.Stmt
-	selectPositionInTopologyStmt    *sql.Stmt
-	selectMaxPositionInTopologyStmt *sql.Stmt
+	insertEventInTopologyStmt             *sql.Stmt
+	selectEventIDsInRangeASCStmt          *sql.Stmt
+	selectEventIDsInRangeDESCStmt         *sql.Stmt
+	selectPositionInTopologyStmt          *sql.Stmt
+	selectMaxPositionInTopologyStmt       *sql.Stmt
+	selectStreamToTopologicalPositionStmt *sql.Stmt
+	deleteTopologyUpToStmt                *sql.Stmt
 }
 
 func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -94,6 +106,12 @@ func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.selectMaxPositionInTopologyStmt, err = db.Prepare(selectMaxPositionInTopologySQL); err != nil {
 		return nil, err
 	}
+	if s.selectStreamToTopologicalPositionStmt, err = db.Prepare(selectStreamToTopologicalPositionSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteTopologyUpToStmt, err = db.Prepare(deleteTopologyUpToSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -111,7 +129,7 @@ func (s *outputRoomEventsTopologyStatements) InsertEventInTopology(
 
 func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 	ctx context.Context, txn *sql.Tx, roomID string,
-	minDepth, maxDepth, maxStreamPos types.StreamPosition,
+	minDepth, minStreamPos, maxDepth, maxStreamPos types.StreamPosition,
 	limit int, chronologicalOrder bool,
 ) (eventIDs []string, err error) {
 	// Decide on the selection's order according to whether chronological order
@@ -124,13 +142,14 @@ func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 	}
 
 	// Query the event IDs.
-	rows, err := stmt.QueryContext(ctx, roomID, minDepth, maxDepth, maxDepth, maxStreamPos, limit)
+	rows, err := stmt.QueryContext(ctx, roomID, minDepth, minStreamPos, maxDepth, maxStreamPos, limit)
 	if err == sql.ErrNoRows {
 		// If no event matched the request, return an empty slice.
 		return []string{}, nil
 	} else if err != nil {
 		return
 	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventIDsInRange: rows.close() failed")
 
 	// Return the IDs.
 	var eventID string
@@ -141,7 +160,7 @@ func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 		eventIDs = append(eventIDs, eventID)
 	}
 
-	return
+	return eventIDs, rows.Err()
 }
 
 // selectPositionInTopology returns the position of a given event in the
@@ -161,3 +180,25 @@ func (s *outputRoomEventsTopologyStatements) SelectMaxPositionInTopology(
 	err = stmt.QueryRowContext(ctx, roomID).Scan(&pos, &spos)
 	return
 }
+
+// SelectStreamToTopologicalPosition returns the highest depth of the events in
+// the room which are at or before the given stream position.
+func (s *outputRoomEventsTopologyStatements) SelectStreamToTopologicalPosition(
+	ctx context.Context, txn *sql.Tx, roomID string, streamPos types.StreamPosition,
+) (topoPos types.StreamPosition, err error) {
+	var depth sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectStreamToTopologicalPositionStmt)
+	if err = stmt.QueryRowContext(ctx, roomID, streamPos).Scan(&depth); err != nil {
+		return
+	}
+	return types.StreamPosition(depth.Int64), nil
+}
+
+// DeleteTopologyUpTo removes the events in the room at or before the given
+// stream position from the topology.
+func (s *outputRoomEventsTopologyStatements) DeleteTopologyUpTo(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteTopologyUpToStmt).ExecContext(ctx, roomID, pos)
+	return
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const peeksSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_peeks (
+	id INTEGER,
+	room_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	deleted BOOL NOT NULL DEFAULT false,
+	-- When the peek was created in UNIX epoch ms.
+	creation_ts INTEGER NOT NULL,
+	UNIQUE(room_id, user_id, device_id)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_peeks_user_id_device_id_idx ON syncapi_peeks(user_id, device_id);
+`
+
+const insertPeekSQL = "" +
+	"INSERT INTO syncapi_peeks (id, room_id, user_id, device_id, creation_ts, deleted)" +
+	" VALUES ($1, $2, $3, $4, $5, false)" +
+	" ON CONFLICT (room_id, user_id, device_id)" +
+	" DO UPDATE SET id = excluded.id, creation_ts = excluded.creation_ts, deleted = false"
+
+const deletePeekSQL = "" +
+	"UPDATE syncapi_peeks SET deleted=true, id=$1" +
+	" WHERE room_id = $2 AND user_id = $3 AND device_id = $4 AND deleted=false"
+
+const deletePeeksSQL = "" +
+	"UPDATE syncapi_peeks SET deleted=true, id=$1" +
+	" WHERE room_id = $2 AND user_id = $3 AND deleted=false"
+
+const deleteRoomPeeksSQL = "" +
+	"UPDATE syncapi_peeks SET deleted=true, id=$1" +
+	" WHERE room_id = $2 AND deleted=false"
+
+const selectPeeksInRangeSQL = "" +
+	"SELECT room_id, id, deleted FROM syncapi_peeks" +
+	" WHERE user_id = $1 AND device_id = $2 AND (deleted=false OR id > $3) AND id <= $4"
+
+const selectPeekingDevicesSQL = "" +
+	"SELECT room_id, user_id, device_id FROM syncapi_peeks WHERE deleted=false"
+
+const selectMaxPeekIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_peeks"
+
+type peekStatements struct {
+	streamIDStatements       *streamIDStatements
+	insertPeekStmt           *sql.Stmt
+	deletePeekStmt           *sql.Stmt
+	deletePeeksStmt          *sql.Stmt
+	deleteRoomPeeksStmt      *sql.Stmt
+	selectPeeksInRangeStmt   *sql.Stmt
+	selectPeekingDevicesStmt *sql.Stmt
+	selectMaxPeekIDStmt      *sql.Stmt
+}
+
+func NewSqlitePeeksTable(db *sql.DB, streamID *streamIDStatements) (tables.Peeks, error) {
+	_, err := db.Exec(peeksSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &peekStatements{
+		streamIDStatements: streamID,
+	}
+	if s.insertPeekStmt, err = db.Prepare(insertPeekSQL); err != nil {
+		return nil, err
+	}
+	if s.deletePeekStmt, err = db.Prepare(deletePeekSQL); err != nil {
+		return nil, err
+	}
+	if s.deletePeeksStmt, err = db.Prepare(deletePeeksSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteRoomPeeksStmt, err = db.Prepare(deleteRoomPeeksSQL); err != nil {
+		return nil, err
+	}
+	if s.selectPeeksInRangeStmt, err = db.Prepare(selectPeeksInRangeSQL); err != nil {
+		return nil, err
+	}
+	if s.selectPeekingDevicesStmt, err = db.Prepare(selectPeekingDevicesSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxPeekIDStmt, err = db.Prepare(selectMaxPeekIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *peekStatements) InsertPeek(
+	ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string,
+) (streamPos types.StreamPosition, err error) {
+	streamPos, err = s.streamIDStatements.nextStreamID(ctx, txn)
+	if err != nil {
+		return
+	}
+	nowMilli := time.Now().UnixNano() / int64(time.Millisecond)
+	_, err = sqlutil.TxStmt(txn, s.insertPeekStmt).ExecContext(ctx, streamPos, roomID, userID, deviceID, nowMilli)
+	return
+}
+
+func (s *peekStatements) DeletePeek(
+	ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string,
+) (types.StreamPosition, error) {
+	return s.deleteWithNextStreamID(ctx, txn, s.deletePeekStmt, roomID, userID, deviceID)
+}
+
+func (s *peekStatements) DeletePeeks(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) (types.StreamPosition, error) {
+	return s.deleteWithNextStreamID(ctx, txn, s.deletePeeksStmt, roomID, userID)
+}
+
+func (s *peekStatements) DeleteRoomPeeks(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (types.StreamPosition, error) {
+	return s.deleteWithNextStreamID(ctx, txn, s.deleteRoomPeeksStmt, roomID)
+}
+
+// deleteWithNextStreamID marks the matching peeks as deleted at a new stream
+// position, returning 0 instead if no peeks matched.
+func (s *peekStatements) deleteWithNextStreamID(
+	ctx context.Context, txn *sql.Tx, stmt *sql.Stmt, args ...interface{},
+) (types.StreamPosition, error) {
+	streamPos, err := s.streamIDStatements.nextStreamID(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	result, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, append([]interface{}{streamPos}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return 0, err
+	}
+	return streamPos, nil
+}
+
+func (s *peekStatements) SelectPeeksInRange(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, r types.Range,
+) (peeks []types.Peek, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPeeksInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, userID, deviceID, r.Low(), r.High())
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPeeksInRange: rows.close() failed")
+
+	for rows.Next() {
+		var (
+			peek    types.Peek
+			id      types.StreamPosition
+			deleted bool
+		)
+		if err = rows.Scan(&peek.RoomID, &id, &deleted); err != nil {
+			return
+		}
+		peek.New = id > r.Low()
+		peek.Deleted = deleted
+		peeks = append(peeks, peek)
+	}
+	return peeks, rows.Err()
+}
+
+func (s *peekStatements) SelectPeekingDevices(
+	ctx context.Context,
+) (map[string][]types.PeekingDevice, error) {
+	rows, err := s.selectPeekingDevicesStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPeekingDevices: rows.close() failed")
+
+	result := make(map[string][]types.PeekingDevice)
+	for rows.Next() {
+		var roomID string
+		var peeker types.PeekingDevice
+		if err := rows.Scan(&roomID, &peeker.UserID, &peeker.DeviceID); err != nil {
+			return nil, err
+		}
+		result[roomID] = append(result[roomID], peeker)
+	}
+	return result, rows.Err()
+}
+
+func (s *peekStatements) SelectMaxPeekID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxPeekIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
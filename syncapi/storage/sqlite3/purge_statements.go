@@ -0,0 +1,88 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+// The members' leave events are kept, along with the retired invites, so that
+// clients which haven't synced since the room was purged still find out that
+// they have left it.
+const purgeOutputRoomEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1 AND event_id NOT IN (" +
+	" SELECT event_id FROM syncapi_current_room_state" +
+	" WHERE room_id = $1 AND type = 'm.room.member' AND membership = 'leave'" +
+	")"
+
+const purgeTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1 AND event_id NOT IN (" +
+	" SELECT event_id FROM syncapi_current_room_state" +
+	" WHERE room_id = $1 AND type = 'm.room.member' AND membership = 'leave'" +
+	")"
+
+const purgeCurrentRoomStateSQL = "" +
+	"DELETE FROM syncapi_current_room_state WHERE room_id = $1" +
+	" AND NOT (type = 'm.room.member' AND membership = 'leave')"
+
+const purgeAccountDataSQL = "" +
+	"DELETE FROM syncapi_account_data_type WHERE room_id = $1"
+
+const purgeBackwardExtremitiesSQL = "" +
+	"DELETE FROM syncapi_backward_extremities WHERE room_id = $1"
+
+const purgeRelationsSQL = "" +
+	"DELETE FROM syncapi_relations WHERE room_id = $1"
+
+const purgeSearchSQL = "" +
+	"DELETE FROM syncapi_search WHERE room_id = $1"
+
+const purgeNotificationDataSQL = "" +
+	"DELETE FROM syncapi_notification_data WHERE room_id = $1"
+
+type purgeStatements struct {
+	purgeStmts []*sql.Stmt
+}
+
+func NewSqlitePurgeStatements(db *sql.DB) (tables.Purge, error) {
+	s := &purgeStatements{}
+	for _, query := range []string{
+		purgeOutputRoomEventsSQL, purgeTopologySQL, purgeCurrentRoomStateSQL,
+		purgeAccountDataSQL, purgeBackwardExtremitiesSQL,
+		purgeRelationsSQL, purgeSearchSQL, purgeNotificationDataSQL,
+	} {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		s.purgeStmts = append(s.purgeStmts, stmt)
+	}
+	return s, nil
+}
+
+func (s *purgeStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	for _, stmt := range s.purgeStmts {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const relationsSchema = `
+-- Stores the relations between room events, as described by MSC2675.
+CREATE TABLE IF NOT EXISTS syncapi_relations (
+    -- The event ID of the event which relates to another event
+    event_id TEXT PRIMARY KEY,
+    -- The room ID of the event
+    room_id TEXT NOT NULL,
+    -- The event ID of the event being related to
+    relates_to_id TEXT NOT NULL,
+    -- The type of the relation, e.g. m.annotation
+    rel_type TEXT NOT NULL,
+    -- The type of the event which relates to another event, e.g. m.reaction
+    event_type TEXT NOT NULL,
+    -- The sender of the event which relates to another event
+    sender TEXT NOT NULL,
+    -- The key of an annotation, or empty for other relation types
+    aggregation_key TEXT NOT NULL DEFAULT '',
+    -- The stream position of the event which relates to another event
+    stream_pos INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_relations_relates_to_id_idx ON syncapi_relations(relates_to_id, rel_type, stream_pos);
+`
+
+const insertRelationSQL = "" +
+	"INSERT INTO syncapi_relations (room_id, event_id, relates_to_id, rel_type, event_type, sender, aggregation_key, stream_pos)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const deleteRelationSQL = "" +
+	"DELETE FROM syncapi_relations WHERE event_id = $1"
+
+const selectRelationsInRangeAscSQL = "" +
+	"SELECT event_id, relates_to_id, rel_type, event_type, sender, stream_pos FROM syncapi_relations" +
+	" WHERE room_id = $1 AND relates_to_id = $2 AND ($3 = '' OR rel_type = $3) AND ($4 = '' OR event_type = $4)" +
+	" AND stream_pos > $5 AND stream_pos <= $6" +
+	" ORDER BY stream_pos ASC LIMIT $7"
+
+const selectRelationsInRangeDescSQL = "" +
+	"SELECT event_id, relates_to_id, rel_type, event_type, sender, stream_pos FROM syncapi_relations" +
+	" WHERE room_id = $1 AND relates_to_id = $2 AND ($3 = '' OR rel_type = $3) AND ($4 = '' OR event_type = $4)" +
+	" AND stream_pos > $5 AND stream_pos <= $6" +
+	" ORDER BY stream_pos DESC LIMIT $7"
+
+const selectRelationsOfTypesSQL = "" +
+	"SELECT event_id, relates_to_id, rel_type, event_type, sender, stream_pos FROM syncapi_relations" +
+	" WHERE room_id = $1 AND relates_to_id IN ($2) AND rel_type IN ($3)" +
+	" ORDER BY stream_pos DESC LIMIT $4"
+
+const selectAnnotationCountsSQL = "" +
+	"SELECT relates_to_id, event_type, aggregation_key, COUNT(DISTINCT sender) AS count FROM syncapi_relations" +
+	" WHERE room_id = $1 AND relates_to_id IN ($2) AND rel_type = 'm.annotation'" +
+	" GROUP BY relates_to_id, event_type, aggregation_key" +
+	" ORDER BY count DESC, MIN(stream_pos) ASC LIMIT $3"
+
+type relationsStatements struct {
+	insertRelationStmt             *sql.Stmt
+	deleteRelationStmt             *sql.Stmt
+	selectRelationsInRangeAscStmt  *sql.Stmt
+	selectRelationsInRangeDescStmt *sql.Stmt
+	// selectRelationsOfTypesStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectAnnotationCountsStmt *sql.Stmt - prepared at runtime due to variadic
+	db *sql.DB
+}
+
+func NewSqliteRelationsTable(db *sql.DB) (tables.Relations, error) {
+	s := &relationsStatements{
+		db: db,
+	}
+	_, err := db.Exec(relationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertRelationStmt, err = db.Prepare(insertRelationSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteRelationStmt, err = db.Prepare(deleteRelationSQL); err != nil {
+		return nil, err
+	}
+	if s.selectRelationsInRangeAscStmt, err = db.Prepare(selectRelationsInRangeAscSQL); err != nil {
+		return nil, err
+	}
+	if s.selectRelationsInRangeDescStmt, err = db.Prepare(selectRelationsInRangeDescSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *relationsStatements) InsertRelation(
+	ctx context.Context, txn *sql.Tx,
+	roomID, eventID, relatesToID, relType, eventType, sender, key string, pos types.StreamPosition,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertRelationStmt)
+	_, err := stmt.ExecContext(ctx, roomID, eventID, relatesToID, relType, eventType, sender, key, pos)
+	return err
+}
+
+func (s *relationsStatements) DeleteRelation(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRelationStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *relationsStatements) SelectRelationsInRange(
+	ctx context.Context, txn *sql.Tx,
+	roomID, relatesToID, relType, eventType string, r types.Range, limit int,
+) ([]types.Relation, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRelationsInRangeAscStmt)
+	if r.Backwards {
+		stmt = sqlutil.TxStmt(txn, s.selectRelationsInRangeDescStmt)
+	}
+	rows, err := stmt.QueryContext(ctx, roomID, relatesToID, relType, eventType, r.Low(), r.High(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRelationsInRange: rows.close() failed")
+	return rowsToRelations(rows)
+}
+
+func (s *relationsStatements) SelectRelationsOfTypes(
+	ctx context.Context, txn *sql.Tx, roomID string, relatesToIDs, relTypes []string, limit int,
+) ([]types.Relation, error) {
+	if len(relatesToIDs) == 0 || len(relTypes) == 0 {
+		return nil, nil
+	}
+	query := strings.NewReplacer(
+		"($2)", sqlutil.QueryVariadicOffset(len(relatesToIDs), 1),
+		"($3)", sqlutil.QueryVariadicOffset(len(relTypes), 1+len(relatesToIDs)),
+		"$4", fmt.Sprintf("$%d", 2+len(relatesToIDs)+len(relTypes)),
+	).Replace(selectRelationsOfTypesSQL)
+	params := appendStrings(appendStrings([]interface{}{roomID}, relatesToIDs), relTypes)
+	params = append(params, limit)
+	rows, err := queryTxn(ctx, s.db, txn, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRelationsOfTypes: rows.close() failed")
+	return rowsToRelations(rows)
+}
+
+func (s *relationsStatements) SelectAnnotationCounts(
+	ctx context.Context, txn *sql.Tx, roomID string, relatesToIDs []string, limit int,
+) ([]types.AnnotationCount, error) {
+	if len(relatesToIDs) == 0 {
+		return nil, nil
+	}
+	query := strings.NewReplacer(
+		"($2)", sqlutil.QueryVariadicOffset(len(relatesToIDs), 1),
+		"$3", fmt.Sprintf("$%d", 2+len(relatesToIDs)),
+	).Replace(selectAnnotationCountsSQL)
+	params := append(appendStrings([]interface{}{roomID}, relatesToIDs), limit)
+	rows, err := queryTxn(ctx, s.db, txn, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAnnotationCounts: rows.close() failed")
+
+	var counts []types.AnnotationCount
+	for rows.Next() {
+		var count types.AnnotationCount
+		if err = rows.Scan(&count.RelatesToID, &count.Type, &count.Key, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func rowsToRelations(rows *sql.Rows) ([]types.Relation, error) {
+	var relations []types.Relation
+	for rows.Next() {
+		var relation types.Relation
+		if err := rows.Scan(
+			&relation.EventID, &relation.RelatesToID, &relation.RelType, &relation.EventType, &relation.Sender, &relation.StreamPosition,
+		); err != nil {
+			return nil, err
+		}
+		relations = append(relations, relation)
+	}
+	return relations, rows.Err()
+}
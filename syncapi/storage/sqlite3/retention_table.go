@@ -0,0 +1,90 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const retentionSchema = `
+-- Stores how far old events have been purged from each room's output room
+-- events.
+CREATE TABLE IF NOT EXISTS syncapi_retention (
+    -- The room ID of the room which events have been purged from
+    room_id TEXT NOT NULL PRIMARY KEY,
+    -- The highest stream position at or before which events have been
+    -- purged from the room
+    purged_position BIGINT NOT NULL
+);
+`
+
+const upsertPurgedPositionSQL = "" +
+	"INSERT INTO syncapi_retention (room_id, purged_position) VALUES ($1, $2)" +
+	" ON CONFLICT (room_id) DO UPDATE SET purged_position = MAX(syncapi_retention.purged_position, $2)"
+
+const selectRoomsPurgedAfterSQL = "" +
+	"SELECT room_id FROM syncapi_retention WHERE purged_position > $1"
+
+type retentionStatements struct {
+	upsertPurgedPositionStmt   *sql.Stmt
+	selectRoomsPurgedAfterStmt *sql.Stmt
+}
+
+func NewSqliteRetentionTable(db *sql.DB) (tables.Retention, error) {
+	s := &retentionStatements{}
+	_, err := db.Exec(retentionSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertPurgedPositionStmt, err = db.Prepare(upsertPurgedPositionSQL); err != nil {
+		return nil, err
+	}
+	if s.selectRoomsPurgedAfterStmt, err = db.Prepare(selectRoomsPurgedAfterSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *retentionStatements) UpdatePurgedPosition(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.upsertPurgedPositionStmt).ExecContext(ctx, roomID, pos)
+	return
+}
+
+func (s *retentionStatements) SelectRoomsPurgedAfter(
+	ctx context.Context, txn *sql.Tx, pos types.StreamPosition,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomsPurgedAfterStmt).QueryContext(ctx, pos)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomsPurgedAfter: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// SQLite's FTS4 module doesn't provide a ranking function, so results are
+// always ordered by recency, even when ordering by rank was requested.
+const searchSchema = `
+-- Stores a full-text index of the searchable parts of room events.
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search USING fts4(
+    event_id, room_id, key, stream_pos, content,
+    notindexed=event_id, notindexed=room_id, notindexed=key, notindexed=stream_pos
+);
+`
+
+const insertSearchEntrySQL = "" +
+	"INSERT INTO syncapi_search (event_id, room_id, key, stream_pos, content)" +
+	" VALUES ($1, $2, $3, $4, $5)"
+
+const deleteSearchEntrySQL = "" +
+	"DELETE FROM syncapi_search WHERE event_id = $1"
+
+// The rooms and keys to search vary in number, so are filtered on while
+// reading the matches rather than in the query, which lets the statement be
+// prepared once. Counting the matches had to read all of them anyway.
+const selectSearchResultsSQL = "" +
+	"SELECT event_id, room_id, key, stream_pos FROM syncapi_search" +
+	" WHERE content MATCH $1" +
+	" ORDER BY CAST(stream_pos AS INTEGER) DESC"
+
+type searchStatements struct {
+	insertSearchEntryStmt   *sql.Stmt
+	deleteSearchEntryStmt   *sql.Stmt
+	selectSearchResultsStmt *sql.Stmt
+}
+
+func NewSqliteSearchTable(db *sql.DB) (tables.Search, error) {
+	s := &searchStatements{}
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertSearchEntryStmt, err = db.Prepare(insertSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEntryStmt, err = db.Prepare(deleteSearchEntrySQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultsStmt, err = db.Prepare(selectSearchResultsSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEntry(
+	ctx context.Context, txn *sql.Tx,
+	eventID, roomID, key string, pos types.StreamPosition, content string,
+) error {
+	// FTS tables don't support unique constraints, so remove any existing
+	// entry for the event first in case we are asked to index it again.
+	if err := s.DeleteSearchEntry(ctx, txn, eventID); err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertSearchEntryStmt)
+	_, err := stmt.ExecContext(ctx, eventID, roomID, key, pos, content)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEntry(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteSearchEntryStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, txn *sql.Tx,
+	searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int,
+) (results []types.SearchResult, count int, err error) {
+	matchQuery := ftsMatchQuery(searchTerm)
+	if matchQuery == "" || len(roomIDs) == 0 || len(keys) == 0 {
+		return nil, 0, nil
+	}
+	wantRooms := make(map[string]bool, len(roomIDs))
+	for _, roomID := range roomIDs {
+		wantRooms[roomID] = true
+	}
+	wantKeys := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wantKeys[key] = true
+	}
+
+	stmt := sqlutil.TxStmt(txn, s.selectSearchResultsStmt)
+	rows, err := stmt.QueryContext(ctx, matchQuery)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSearchResults: rows.close() failed")
+
+	for rows.Next() {
+		var result types.SearchResult
+		var key string
+		if err = rows.Scan(&result.EventID, &result.RoomID, &key, &result.StreamPosition); err != nil {
+			return nil, 0, err
+		}
+		if !wantRooms[result.RoomID] || !wantKeys[key] {
+			continue
+		}
+		if count >= offset && count < offset+limit {
+			results = append(results, result)
+		}
+		count++
+	}
+	return results, count, rows.Err()
+}
+
+// ftsMatchQuery turns a search term from a client into an FTS query that
+// matches events containing all of the words in the term. Each word is
+// quoted so that FTS operators in the term are treated as plain text.
+func ftsMatchQuery(searchTerm string) string {
+	words := strings.Fields(searchTerm)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, "") + `"`
+	}
+	return strings.Join(words, " ")
+}
@@ -29,7 +29,8 @@ import (
 const sendToDeviceSchema = `
 -- Stores send-to-device messages.
 CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
-	-- The ID that uniquely identifies this message.
+	-- The ID that uniquely identifies this message. This is also the
+	-- send-to-device stream position of the message.
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	-- The user ID to send the message to.
 	user_id TEXT NOT NULL,
@@ -59,7 +60,7 @@ const selectSendToDeviceMessagesSQL = `
 	SELECT id, user_id, device_id, content, sent_by_token
 	  FROM syncapi_send_to_device
 	  WHERE user_id = $1 AND device_id = $2
-	  ORDER BY id DESC
+	  ORDER BY id ASC
 `
 
 const updateSentSendToDeviceMessagesSQL = `
@@ -67,14 +68,33 @@ const updateSentSendToDeviceMessagesSQL = `
 	  WHERE id IN ($2)
 `
 
+// Selects the last ID given out by AUTOINCREMENT, which unlike the highest ID
+// in the table doesn't go backwards when messages are deleted.
+const selectMaxSendToDeviceMessageIDSQL = "" +
+	"SELECT seq FROM sqlite_sequence WHERE name = 'syncapi_send_to_device'"
+
 const deleteSendToDeviceMessagesSQL = `
 	DELETE FROM syncapi_send_to_device WHERE id IN ($1)
 `
 
+// Deletes every message which has at least $1 newer messages waiting for the
+// same device.
+const deleteSendToDeviceMessagesBeyondLimitSQL = `
+	DELETE FROM syncapi_send_to_device
+	  WHERE (
+	    SELECT COUNT(*) FROM syncapi_send_to_device AS newer
+	      WHERE newer.user_id = syncapi_send_to_device.user_id
+	      AND newer.device_id = syncapi_send_to_device.device_id
+	      AND newer.id > syncapi_send_to_device.id
+	  ) >= $1
+`
+
 type sendToDeviceStatements struct {
-	insertSendToDeviceMessageStmt  *sql.Stmt
-	selectSendToDeviceMessagesStmt *sql.Stmt
-	countSendToDeviceMessagesStmt  *sql.Stmt
+	insertSendToDeviceMessageStmt             *sql.Stmt
+	selectSendToDeviceMessagesStmt            *sql.Stmt
+	countSendToDeviceMessagesStmt             *sql.Stmt
+	selectMaxSendToDeviceMessageIDStmt        *sql.Stmt
+	deleteSendToDeviceMessagesBeyondLimitStmt *sql.Stmt
 }
 
 func NewSqliteSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
@@ -92,14 +112,24 @@ func NewSqliteSendToDeviceTable(db *sql.DB) (tables.SendToDevice, error) {
 	if s.selectSendToDeviceMessagesStmt, err = db.Prepare(selectSendToDeviceMessagesSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMaxSendToDeviceMessageIDStmt, err = db.Prepare(selectMaxSendToDeviceMessageIDSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSendToDeviceMessagesBeyondLimitStmt, err = db.Prepare(deleteSendToDeviceMessagesBeyondLimitSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
 func (s *sendToDeviceStatements) InsertSendToDeviceMessage(
 	ctx context.Context, txn *sql.Tx, userID, deviceID, content string,
-) (err error) {
-	_, err = sqlutil.TxStmt(txn, s.insertSendToDeviceMessageStmt).ExecContext(ctx, userID, deviceID, content)
-	return
+) (pos types.StreamPosition, err error) {
+	res, err := sqlutil.TxStmt(txn, s.insertSendToDeviceMessageStmt).ExecContext(ctx, userID, deviceID, content)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return types.StreamPosition(id), err
 }
 
 func (s *sendToDeviceStatements) CountSendToDeviceMessages(
@@ -164,10 +194,31 @@ func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
 	ctx context.Context, txn *sql.Tx, nids []types.SendToDeviceNID,
 ) (err error) {
 	query := strings.Replace(deleteSendToDeviceMessagesSQL, "($1)", sqlutil.QueryVariadic(len(nids)), 1)
-	params := make([]interface{}, 1+len(nids))
+	params := make([]interface{}, len(nids))
 	for k, v := range nids {
 		params[k] = v
 	}
 	_, err = txn.ExecContext(ctx, query, params...)
 	return
 }
+
+func (s *sendToDeviceStatements) SelectMaxSendToDeviceMessageID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	err = sqlutil.TxStmt(txn, s.selectMaxSendToDeviceMessageIDStmt).QueryRowContext(ctx).Scan(&id)
+	if err == sql.ErrNoRows {
+		// Nothing has been inserted yet.
+		return 0, nil
+	}
+	return
+}
+
+func (s *sendToDeviceStatements) DeleteSendToDeviceMessagesBeyondLimit(
+	ctx context.Context, txn *sql.Tx, keep int,
+) (deleted int64, err error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteSendToDeviceMessagesBeyondLimitStmt).ExecContext(ctx, keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -75,6 +75,10 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	peeks, err := NewSqlitePeeksTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
 	topology, err := NewSqliteTopologyTable(d.db)
 	if err != nil {
 		return err
@@ -91,9 +95,30 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	notificationData, err := NewSqliteNotificationDataTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	search, err := NewSqliteSearchTable(d.db)
+	if err != nil {
+		return err
+	}
+	relations, err := NewSqliteRelationsTable(d.db)
+	if err != nil {
+		return err
+	}
+	retention, err := NewSqliteRetentionTable(d.db)
+	if err != nil {
+		return err
+	}
+	purge, err := NewSqlitePurgeStatements(d.db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
+		Peeks:               peeks,
 		AccountData:         accountData,
 		OutputEvents:        events,
 		BackwardExtremities: bwExtrem,
@@ -101,6 +126,11 @@ func (d *SyncServerDatasource) prepare() (err error) {
 		Topology:            topology,
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
+		NotificationData:    notificationData,
+		Search:              search,
+		Relations:           relations,
+		Retention:           retention,
+		Purge:               purge,
 		SendToDeviceWriter:  sqlutil.NewTransactionWriter(),
 		EDUCache:            cache.New(),
 	}
@@ -24,18 +24,19 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
 )
 
-// NewSyncServerDatasource opens a database connection.
-func NewSyncServerDatasource(dataSourceName string, dbProperties sqlutil.DbProperties) (Database, error) {
+// NewSyncServerDatasource opens a database connection. Initial syncs use the
+// replica if one is given, which must be a postgres database.
+func NewSyncServerDatasource(dataSourceName, replicaDataSourceName string, dbProperties sqlutil.DbProperties) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return postgres.NewDatabase(dataSourceName, replicaDataSourceName, dbProperties)
 	}
 	switch uri.Scheme {
 	case "postgres":
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return postgres.NewDatabase(dataSourceName, replicaDataSourceName, dbProperties)
 	case "file":
 		return sqlite3.NewDatabase(dataSourceName)
 	default:
-		return postgres.NewDatabase(dataSourceName, dbProperties)
+		return postgres.NewDatabase(dataSourceName, replicaDataSourceName, dbProperties)
 	}
 }
@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +16,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 var (
@@ -155,9 +159,9 @@ func TestSyncResponse(t *testing.T) {
 		{
 			Name: "IncrementalSync penultimate",
 			DoSync: func() (*types.Response, error) {
-				from := types.NewStreamToken( // pretend we are at the penultimate event
-					positions[len(positions)-2], types.StreamPosition(0),
-				)
+				from := types.StreamingToken{ // pretend we are at the penultimate event
+					PDUPosition: positions[len(positions)-2],
+				}
 				res := types.NewResponse()
 				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
 			},
@@ -168,9 +172,9 @@ func TestSyncResponse(t *testing.T) {
 		{
 			Name: "IncrementalSync limited",
 			DoSync: func() (*types.Response, error) {
-				from := types.NewStreamToken( // pretend we are 10 events behind
-					positions[len(positions)-11], types.StreamPosition(0),
-				)
+				from := types.StreamingToken{ // pretend we are 10 events behind
+					PDUPosition: positions[len(positions)-11],
+				}
 				res := types.NewResponse()
 				// limit is set to 5
 				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
@@ -178,6 +182,32 @@ func TestSyncResponse(t *testing.T) {
 			// want the last 5 events, NOT the last 10.
 			WantTimeline: events[len(events)-5:],
 		},
+		// The purpose of this test is to check that full_state=true on an incremental sync returns all of
+		// the current state for the room, whilst the timeline is still limited by the `since` token.
+		{
+			Name: "IncrementalSync full state",
+			DoSync: func() (*types.Response, error) {
+				from := types.StreamingToken{ // pretend we are at the penultimate event
+					PDUPosition: positions[len(positions)-2],
+				}
+				res := types.NewResponse()
+				return db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, true)
+			},
+			WantTimeline: events[len(events)-1:],
+			// want all state for the room
+			WantState: state,
+		},
+		// The purpose of this test is to check that full_state=true returns the room even if nothing
+		// has happened in it since the `since` token.
+		{
+			Name: "IncrementalSync full state no new events",
+			DoSync: func() (*types.Response, error) {
+				res := types.NewResponse()
+				return db.IncrementalSync(ctx, res, testUserDeviceA, latest, latest, 5, true)
+			},
+			// want all state for the room
+			WantState: state,
+		},
 		// The purpose of this test is to check that CompleteSync returns all the current state as well as
 		// honouring the `numRecentEventsPerRoom` value
 		{
@@ -185,7 +215,7 @@ func TestSyncResponse(t *testing.T) {
 			DoSync: func() (*types.Response, error) {
 				res := types.NewResponse()
 				// limit set to 5
-				return db.CompleteSync(ctx, res, testUserDeviceA, 5)
+				return db.CompleteSync(ctx, res, testUserDeviceA, 5, false)
 			},
 			// want the last 5 events
 			WantTimeline: events[len(events)-5:],
@@ -198,7 +228,7 @@ func TestSyncResponse(t *testing.T) {
 			Name: "CompleteSync",
 			DoSync: func() (*types.Response, error) {
 				res := types.NewResponse()
-				return db.CompleteSync(ctx, res, testUserDeviceA, len(events)+1)
+				return db.CompleteSync(ctx, res, testUserDeviceA, len(events)+1, false)
 			},
 			WantTimeline: events,
 			// We want no state at all as that field in /sync is the delta between the token (beginning of time)
@@ -212,9 +242,8 @@ func TestSyncResponse(t *testing.T) {
 			if err != nil {
 				st.Fatalf("failed to do sync: %s", err)
 			}
-			next := types.NewStreamToken(latest.PDUPosition(), latest.EDUPosition())
-			if res.NextBatch != next.String() {
-				st.Errorf("NextBatch got %s want %s", res.NextBatch, next.String())
+			if res.NextBatch != latest.String() {
+				st.Errorf("NextBatch got %s want %s", res.NextBatch, latest.String())
 			}
 			roomRes, ok := res.Rooms.Join[testRoomID]
 			if !ok {
@@ -226,6 +255,109 @@ func TestSyncResponse(t *testing.T) {
 	}
 }
 
+func TestRoomSummary(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	res := types.NewResponse()
+	res, err := db.CompleteSync(ctx, res, testUserDeviceA, 5, false)
+	if err != nil {
+		t.Fatalf("failed to CompleteSync: %s", err)
+	}
+	roomRes, ok := res.Rooms.Join[testRoomID]
+	if !ok {
+		t.Fatalf("CompleteSync response missing room %s - response: %+v", testRoomID, res)
+	}
+	if roomRes.Summary.JoinedMemberCount != 2 {
+		t.Errorf("got joined member count %d, want 2", roomRes.Summary.JoinedMemberCount)
+	}
+	if roomRes.Summary.InvitedMemberCount != 0 {
+		t.Errorf("got invited member count %d, want 0", roomRes.Summary.InvitedMemberCount)
+	}
+	if len(roomRes.Summary.Heroes) != 1 || roomRes.Summary.Heroes[0] != testUserIDB {
+		t.Errorf("got heroes %v, want [%s]", roomRes.Summary.Heroes, testUserIDB)
+	}
+}
+
+func TestGetStateEventsForRoomWithFilter(t *testing.T) {
+	t.Parallel()
+	// The state of the room built by SimpleRoom is the create event and the
+	// joins of both users, at these positions in its events.
+	const create, joinA, joinB = 0, 1, 12
+	testCases := []struct {
+		Name       string
+		Filter     gomatrixserverlib.StateFilter
+		WantEvents []int
+	}{
+		{
+			Name:       "types with wildcard",
+			Filter:     gomatrixserverlib.StateFilter{Limit: 10, Types: []string{"m.room.mem*"}},
+			WantEvents: []int{joinA, joinB},
+		},
+		{
+			Name:       "not types",
+			Filter:     gomatrixserverlib.StateFilter{Limit: 10, NotTypes: []string{"m.room.member"}},
+			WantEvents: []int{create},
+		},
+		{
+			Name:       "senders",
+			Filter:     gomatrixserverlib.StateFilter{Limit: 10, Senders: []string{testUserIDB}},
+			WantEvents: []int{joinB},
+		},
+		{
+			Name:       "not senders",
+			Filter:     gomatrixserverlib.StateFilter{Limit: 10, NotSenders: []string{testUserIDB}},
+			WantEvents: []int{create, joinA},
+		},
+		{
+			Name:       "limit with a filter",
+			Filter:     gomatrixserverlib.StateFilter{Limit: 1, Senders: []string{testUserIDB}},
+			WantEvents: []int{joinB},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(st *testing.T) {
+			st.Parallel()
+			db := MustCreateDatabase(st)
+			events, _ := SimpleRoom(st, testRoomID, testUserIDA, testUserIDB)
+			MustWriteEvents(st, db, events)
+
+			stateEvents, err := db.GetStateEventsForRoom(ctx, testRoomID, &tc.Filter)
+			if err != nil {
+				st.Fatalf("GetStateEventsForRoom failed: %s", err)
+			}
+			got := make(map[string]bool, len(stateEvents))
+			for i := range stateEvents {
+				got[stateEvents[i].EventID()] = true
+			}
+			want := make(map[string]bool, len(tc.WantEvents))
+			for _, i := range tc.WantEvents {
+				want[events[i].EventID()] = true
+			}
+			if len(stateEvents) != len(want) || !reflect.DeepEqual(got, want) {
+				st.Errorf("got state events %v, want %v", got, want)
+			}
+		})
+	}
+
+	// Without anything else to go on, the limit only caps how many of the
+	// state events are returned, as they aren't in any particular order.
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	filter := gomatrixserverlib.StateFilter{Limit: 2}
+	stateEvents, err := db.GetStateEventsForRoom(ctx, testRoomID, &filter)
+	if err != nil {
+		t.Fatalf("GetStateEventsForRoom failed: %s", err)
+	}
+	if len(stateEvents) != 2 {
+		t.Errorf("got %d state events with a limit of 2, want 2", len(stateEvents))
+	}
+}
+
 func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	t.Parallel()
 	db := MustCreateDatabase(t)
@@ -235,9 +367,9 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
-	from := types.NewStreamToken(
-		positions[len(positions)-2], types.StreamPosition(0),
-	)
+	from := types.StreamingToken{
+		PDUPosition: positions[len(positions)-2],
+	}
 
 	res := types.NewResponse()
 	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, from, latest, 5, false)
@@ -270,6 +402,100 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	assertEventsEqual(t, "", true, gots, reversed(events[len(events)-6:len(events)-1]))
 }
 
+// The purpose of this test is to make sure that building an initial sync stops
+// once the request has been cancelled, rather than carrying on for a client which
+// has gone away.
+func TestCompleteSyncCancelled(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := db.CompleteSync(cancelledCtx, types.NewResponse(), testUserDeviceA, 5, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected CompleteSync to be cancelled, got %v", err)
+	}
+}
+
+// The purpose of this test is to make sure that when there are more new events than the timeline
+// limit, the timeline is marked as limited and the prev_batch token can be used to fill in exactly
+// the events which were left out.
+func TestIncrementalSyncLimitedTimeline(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	testCases := []struct {
+		Name         string
+		Behind       int
+		Limit        int
+		WantLimited  bool
+		WantTimeline []gomatrixserverlib.HeaderedEvent
+	}{
+		{
+			Name:         "not limited",
+			Behind:       1,
+			Limit:        5,
+			WantLimited:  false,
+			WantTimeline: events[len(events)-1:],
+		},
+		{
+			Name:         "limited",
+			Behind:       10,
+			Limit:        5,
+			WantLimited:  true,
+			WantTimeline: events[len(events)-5:],
+		},
+		{
+			Name:        "limited to nothing",
+			Behind:      10,
+			Limit:       0,
+			WantLimited: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(st *testing.T) {
+			since := positions[len(positions)-tc.Behind-1]
+			res := types.NewResponse()
+			res, err := db.IncrementalSync(ctx, res, testUserDeviceA, types.StreamingToken{PDUPosition: since}, latest, tc.Limit, false)
+			if err != nil {
+				st.Fatalf("failed to IncrementalSync: %s", err)
+			}
+			roomRes, ok := res.Rooms.Join[testRoomID]
+			if !ok {
+				st.Fatalf("IncrementalSync response missing room %s - response: %+v", testRoomID, res)
+			}
+			if roomRes.Timeline.Limited != tc.WantLimited {
+				st.Errorf("got limited %v, want %v", roomRes.Timeline.Limited, tc.WantLimited)
+			}
+			assertEventsEqual(st, "timeline for "+testRoomID, false, roomRes.Timeline.Events, tc.WantTimeline)
+
+			// paginating back from prev_batch to the since token should return the gap
+			prevBatch, err := types.NewTopologyTokenFromString(roomRes.Timeline.PrevBatch)
+			if err != nil {
+				st.Fatalf("failed to NewTopologyTokenFromString: %s", err)
+			}
+			to, err := db.StreamToTopologicalPosition(ctx, testRoomID, since)
+			if err != nil {
+				st.Fatalf("failed to StreamToTopologicalPosition: %s", err)
+			}
+			gap, err := db.GetEventsInTopologicalRange(ctx, &prevBatch, &to, testRoomID, len(events), true)
+			if err != nil {
+				st.Fatalf("GetEventsInRange returned an error: %s", err)
+			}
+			gots := gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, gap), gomatrixserverlib.FormatAll)
+			assertEventsEqual(st, "gap for "+testRoomID, true, gots, reversed(events[len(events)-tc.Behind:len(events)-len(tc.WantTimeline)]))
+		})
+	}
+}
+
 // The purpose of this test is to ensure that backfill does indeed go backwards, using a stream token.
 func TestGetEventsInRangeWithStreamToken(t *testing.T) {
 	t.Parallel()
@@ -281,7 +507,7 @@ func TestGetEventsInRangeWithStreamToken(t *testing.T) {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
 	// head towards the beginning of time
-	to := types.NewStreamToken(0, 0)
+	to := types.StreamingToken{}
 
 	// backpaginate 5 messages starting at the latest position.
 	paginatedEvents, err := db.GetEventsInStreamingRange(ctx, &latest, &to, testRoomID, 5, true)
@@ -314,6 +540,67 @@ func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 	assertEventsEqual(t, "", true, gots, reversed(events[len(events)-5:]))
 }
 
+// The purpose of this test is to ensure that paginating forwards with topology tokens returns every event exactly once.
+func TestGetEventsInRangeForwardsWithTopologyToken(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	to, err := db.MaxTopologicalPosition(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("failed to get MaxTopologicalPosition: %s", err)
+	}
+	// start at the beginning of time
+	from := types.NewTopologyToken(0, 0)
+
+	var paginatedEvents []types.StreamEvent
+	for i := 0; i < len(events); i += 5 {
+		paginatedEvents, err = db.GetEventsInTopologicalRange(ctx, &from, &to, testRoomID, 5, false)
+		if err != nil {
+			t.Fatalf("GetEventsInRange returned an error: %s", err)
+		}
+		gots := gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, paginatedEvents), gomatrixserverlib.FormatAll)
+		end := i + 5
+		if end > len(events) {
+			end = len(events)
+		}
+		assertEventsEqual(t, fmt.Sprintf("page from %d", i), true, gots, events[i:end])
+		// carry on from the last event we were given
+		from, err = db.EventPositionInTopology(ctx, paginatedEvents[len(paginatedEvents)-1].EventID())
+		if err != nil {
+			t.Fatalf("failed to get EventPositionInTopology: %s", err)
+		}
+	}
+}
+
+// The purpose of this test is to ensure that a stream token converted to a topology token includes events which were
+// backfilled after it, as they are earlier in the room even though they have later stream positions.
+func TestStreamToTopologicalPosition(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	// the latest event arrives first, then the history before it is backfilled
+	latest := MustWriteEvents(t, db, events[len(events)-1:])[0]
+	MustWriteEvents(t, db, events[:len(events)-1])
+
+	from, err := db.StreamToTopologicalPosition(ctx, testRoomID, latest)
+	if err != nil {
+		t.Fatalf("failed to get StreamToTopologicalPosition: %s", err)
+	}
+	if from.Depth() != types.StreamPosition(events[len(events)-1].Depth()) || from.PDUPosition() != latest {
+		t.Fatalf("got topology token %s, want depth %d and stream position %d", from.String(), events[len(events)-1].Depth(), latest)
+	}
+	// head towards the beginning of time
+	to := types.NewTopologyToken(0, 0)
+
+	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &from, &to, testRoomID, 5, true)
+	if err != nil {
+		t.Fatalf("GetEventsInRange returned an error: %s", err)
+	}
+	gots := gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, paginatedEvents), gomatrixserverlib.FormatAll)
+	assertEventsEqual(t, "", true, gots, reversed(events[len(events)-5:]))
+}
+
 // The purpose of this test is to make sure that backpagination returns all events, even if some events have the same depth.
 // For cases where events have the same depth, the streaming token should be used to tie break so events written via WriteEvent
 // will appear FIRST when going backwards. This test creates a DAG like:
@@ -524,20 +811,20 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 
 	// At this point there should be no messages. We haven't sent anything
 	// yet.
-	events, updates, deletions, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, 0))
+	events, updates, deletions, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(events) != 0 || len(updates) != 0 || len(deletions) != 0 {
 		t.Fatal("first call should have no updates")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.NewStreamToken(0, 0))
+	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{})
 	if err != nil {
 		return
 	}
 
 	// Try sending a message.
-	streamPos, err := db.StoreNewSendForDeviceMessage(ctx, types.StreamPosition(0), "alice", "one", gomatrixserverlib.SendToDeviceEvent{
+	streamPos, err := db.StoreNewSendForDeviceMessage(ctx, "alice", "one", gomatrixserverlib.SendToDeviceEvent{
 		Sender:  "bob",
 		Type:    "m.type",
 		Content: json.RawMessage("{}"),
@@ -549,14 +836,14 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 	// At this point we should get exactly one message. We're sending the sync position
 	// that we were given from the update and the send-to-device update will be updated
 	// in the database to reflect that this was the sync position we sent the message at.
-	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, streamPos))
+	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(events) != 1 || len(updates) != 1 || len(deletions) != 0 {
 		t.Fatal("second call should have one update")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.NewStreamToken(0, streamPos))
+	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos})
 	if err != nil {
 		return
 	}
@@ -564,35 +851,35 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 	// At this point we should still have one message because we haven't progressed the
 	// sync position yet. This is equivalent to the client failing to /sync and retrying
 	// with the same position.
-	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, streamPos))
+	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(events) != 1 || len(updates) != 0 || len(deletions) != 0 {
 		t.Fatal("third call should have one update still")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.NewStreamToken(0, streamPos))
+	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos})
 	if err != nil {
 		return
 	}
 
 	// At this point we should now have no updates, because we've progressed the sync
 	// position. Therefore the update from before will not be sent again.
-	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, streamPos+1))
+	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos + 1})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(events) != 0 || len(updates) != 0 || len(deletions) != 1 {
 		t.Fatal("fourth call should have no updates")
 	}
-	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.NewStreamToken(0, streamPos+1))
+	err = db.CleanSendToDeviceUpdates(context.Background(), updates, deletions, types.StreamingToken{SendToDevicePosition: streamPos + 1})
 	if err != nil {
 		return
 	}
 
 	// At this point we should still have no updates, because no new updates have been
 	// sent.
-	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.NewStreamToken(0, streamPos+2))
+	events, updates, deletions, err = db.SendToDeviceUpdatesForSync(ctx, "alice", "one", types.StreamingToken{SendToDevicePosition: streamPos + 2})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -601,6 +888,84 @@ func TestSendToDeviceBehaviour(t *testing.T) {
 	}
 }
 
+func TestSendToDeviceRedelivery(t *testing.T) {
+	db := MustCreateDatabase(t)
+
+	var positions []types.StreamPosition
+	for _, msgType := range []string{"m.first", "m.second"} {
+		streamPos, err := db.StoreNewSendForDeviceMessage(ctx, "alice", "one", gomatrixserverlib.SendToDeviceEvent{
+			Sender:  "bob",
+			Type:    msgType,
+			Content: json.RawMessage("{}"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions = append(positions, streamPos)
+	}
+	if positions[1] <= positions[0] {
+		t.Fatalf("expected stream positions to increase, got %v", positions)
+	}
+
+	// The send-to-device position comes from the database, so it survives a
+	// restart and a token given out before then is still meaningful.
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.SendToDevicePosition != positions[1] {
+		t.Fatalf("got send-to-device position %d, want %d", latest.SendToDevicePosition, positions[1])
+	}
+
+	// Messages are delivered in the order that they were sent, and are sent
+	// again for as long as the client keeps syncing with the same token.
+	since := types.StreamingToken{}
+	for i := 0; i < 2; i++ {
+		events, updates, deletions, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].Type != "m.first" || events[1].Type != "m.second" {
+			t.Fatalf("sync %d: got events %+v, want m.first then m.second", i, events)
+		}
+		if len(deletions) != 0 {
+			t.Fatalf("sync %d: got %d deletions, want none", i, len(deletions))
+		}
+		if err = db.CleanSendToDeviceUpdates(ctx, updates, deletions, since); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the client moves past the token then the messages are gone.
+	events, updates, deletions, err := db.SendToDeviceUpdatesForSync(ctx, "alice", "one", latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 || len(deletions) != 2 {
+		t.Fatalf("got %d events and %d deletions, want none and 2", len(events), len(deletions))
+	}
+	if err = db.CleanSendToDeviceUpdates(ctx, updates, deletions, latest); err != nil {
+		t.Fatal(err)
+	}
+	waiting, err := db.SendToDeviceUpdatesWaiting(ctx, "alice", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waiting {
+		t.Fatal("expected no send-to-device messages to be waiting")
+	}
+
+	// Deleting the messages doesn't take the position backwards, otherwise
+	// the next message would reuse a position the client has already seen.
+	afterDelete, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if afterDelete.SendToDevicePosition != latest.SendToDevicePosition {
+		t.Fatalf("got send-to-device position %d after deleting, want %d", afterDelete.SendToDevicePosition, latest.SendToDevicePosition)
+	}
+}
+
 func TestInviteBehaviour(t *testing.T) {
 	db := MustCreateDatabase(t)
 	inviteRoom1 := "!inviteRoom1:somewhere"
@@ -629,7 +994,7 @@ func TestInviteBehaviour(t *testing.T) {
 	}
 	// both invite events should appear in a new sync
 	beforeRetireRes := types.NewResponse()
-	beforeRetireRes, err = db.IncrementalSync(ctx, beforeRetireRes, testUserDeviceA, types.NewStreamToken(0, 0), latest, 0, false)
+	beforeRetireRes, err = db.IncrementalSync(ctx, beforeRetireRes, testUserDeviceA, types.StreamingToken{}, latest, 0, false)
 	if err != nil {
 		t.Fatalf("IncrementalSync failed: %s", err)
 	}
@@ -644,7 +1009,7 @@ func TestInviteBehaviour(t *testing.T) {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
 	res := types.NewResponse()
-	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, types.NewStreamToken(0, 0), latest, 0, false)
+	res, err = db.IncrementalSync(ctx, res, testUserDeviceA, types.StreamingToken{}, latest, 0, false)
 	if err != nil {
 		t.Fatalf("IncrementalSync failed: %s", err)
 	}
@@ -666,38 +1031,879 @@ func TestInviteBehaviour(t *testing.T) {
 	}
 }
 
-func assertInvitedToRooms(t *testing.T, res *types.Response, roomIDs []string) {
-	t.Helper()
-	if len(res.Rooms.Invite) != len(roomIDs) {
-		t.Fatalf("got %d invited rooms, want %d", len(res.Rooms.Invite), len(roomIDs))
-	}
-	for _, roomID := range roomIDs {
-		if _, ok := res.Rooms.Invite[roomID]; !ok {
-			t.Fatalf("missing room ID %s", roomID)
+func TestInviteDeduplication(t *testing.T) {
+	db := MustCreateDatabase(t)
+	roomID := "!inviteDedupe:somewhere"
+	var events []gomatrixserverlib.HeaderedEvent
+	add := func(b *gomatrixserverlib.EventBuilder) gomatrixserverlib.HeaderedEvent {
+		var prevs []gomatrixserverlib.HeaderedEvent
+		if len(events) > 0 {
+			prevs = events[len(events)-1:]
 		}
+		b.Depth = int64(len(events) + 1)
+		events = append(events, MustCreateEvent(t, roomID, prevs, b))
+		return events[len(events)-1]
+	}
+	add(&gomatrixserverlib.EventBuilder{
+		Content:  []byte(fmt.Sprintf(`{"room_version":"4","creator":"%s"}`, testUserIDB)),
+		Type:     "m.room.create",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDB,
+	})
+	add(&gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"join"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDB,
+		Sender:   testUserIDB,
+	})
+	MustWriteEvents(t, db, events)
+	beforeInvite, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
-}
 
-func assertEventsEqual(t *testing.T, msg string, checkRoomID bool, gots []gomatrixserverlib.ClientEvent, wants []gomatrixserverlib.HeaderedEvent) {
-	if len(gots) != len(wants) {
-		t.Fatalf("%s response returned %d events, want %d", msg, len(gots), len(wants))
+	invite := add(&gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"invite"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDB,
+	})
+	MustWriteEvents(t, db, []gomatrixserverlib.HeaderedEvent{invite})
+	if pos, err := db.AddInviteEvent(ctx, invite); err != nil || pos == 0 {
+		t.Fatalf("AddInviteEvent returned %d, %v", pos, err)
 	}
-	for i := range gots {
-		g := gots[i]
-		w := wants[i]
-		if g.EventID != w.EventID() {
-			t.Errorf("%s event[%d] event_id mismatch: got %s want %s", msg, i, g.EventID, w.EventID())
-		}
-		if g.Sender != w.Sender() {
-			t.Errorf("%s event[%d] sender mismatch: got %s want %s", msg, i, g.Sender, w.Sender())
+	afterInvite, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	// being told about the same invite again mustn't send it to the user again
+	if pos, err := db.AddInviteEvent(ctx, invite); err != nil || pos != 0 {
+		t.Fatalf("AddInviteEvent for a known invite returned %d, %v, want 0", pos, err)
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res, err := db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, afterInvite, latest, 0, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertInvitedToRooms(t, res, []string{})
+
+	// the invite is retired once the user joins, and the room is then only joined
+	join := add(&gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"join"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+	})
+	if _, err = db.WriteEvent(
+		ctx, &join, []gomatrixserverlib.HeaderedEvent{join}, []string{join.EventID()}, []string{invite.EventID()}, nil, false,
+	); err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	if pos, err := db.RetireInviteEvent(ctx, invite.EventID()); err != nil || pos == 0 {
+		t.Fatalf("RetireInviteEvent returned %d, %v", pos, err)
+	}
+	if pos, err := db.RetireInviteEvent(ctx, invite.EventID()); err != nil || pos != 0 {
+		t.Fatalf("RetireInviteEvent for a retired invite returned %d, %v, want 0", pos, err)
+	}
+	if pos, err := db.RetireInviteEvent(ctx, "$unknown:somewhere"); err != nil || pos != 0 {
+		t.Fatalf("RetireInviteEvent for an unknown invite returned %d, %v, want 0", pos, err)
+	}
+	if pos, err := db.AddInviteEvent(ctx, invite); err != nil || pos != 0 {
+		t.Fatalf("AddInviteEvent for a retired invite returned %d, %v, want 0", pos, err)
+	}
+	latest, err = db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	for _, since := range []types.StreamingToken{beforeInvite, afterInvite} {
+		res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, since, latest, 0, false)
+		if err != nil {
+			t.Fatalf("IncrementalSync failed: %s", err)
 		}
-		if checkRoomID && g.RoomID != w.RoomID() {
-			t.Errorf("%s event[%d] room_id mismatch: got %s want %s", msg, i, g.RoomID, w.RoomID())
+		assertInvitedToRooms(t, res, []string{})
+		if _, ok := res.Rooms.Join[roomID]; !ok {
+			t.Errorf("IncrementalSync since %s: expected the room to be joined", since.String())
 		}
-		if g.Type != w.Type() {
-			t.Errorf("%s event[%d] event type mismatch: got %s want %s", msg, i, g.Type, w.Type())
+		if _, ok := res.Rooms.Leave[roomID]; ok {
+			t.Errorf("IncrementalSync since %s: the joined room was also left", since.String())
 		}
-		if g.OriginServerTS != w.OriginServerTS() {
+	}
+}
+
+func TestInviteStrippedState(t *testing.T) {
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	invitee := fmt.Sprintf("@nosk:%s", testOrigin)
+	inviteEvent := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"invite"}`),
+		Type:     "m.room.member",
+		StateKey: &invitee,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	})
+	if _, err := db.AddInviteEvent(ctx, inviteEvent); err != nil {
+		t.Fatalf("Failed to AddInviteEvent: %s", err)
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res := types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, userapi.Device{UserID: invitee, ID: "device_id_C"}, types.StreamingToken{}, latest, 0, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	ir, ok := res.Rooms.Invite[testRoomID]
+	if !ok {
+		t.Fatalf("IncrementalSync: expected to be invited to room %s", testRoomID)
+	}
+
+	// the invite came without any room state, so it should be built from the
+	// current state: the invite itself and the inviter's membership
+	var inviteState []gomatrixserverlib.InviteV2StrippedState
+	if err = json.Unmarshal(ir.InviteState.Events, &inviteState); err != nil {
+		t.Fatalf("failed to unmarshal invite_state: %s", err)
+	}
+	members := map[string]bool{}
+	for _, ev := range inviteState {
+		if ev.Type() == "m.room.member" && ev.StateKey() != nil {
+			members[*ev.StateKey()] = true
+		}
+	}
+	if !members[invitee] || !members[testUserIDA] {
+		t.Errorf("invite_state is missing the invite or the inviter's membership: %s", string(ir.InviteState.Events))
+	}
+	if members[testUserIDB] {
+		t.Errorf("invite_state contains the membership of an unrelated user: %s", string(ir.InviteState.Events))
+	}
+}
+
+func TestKnockBehaviour(t *testing.T) {
+	db := MustCreateDatabase(t)
+	roomID := "!knock:somewhere"
+	knock := MustCreateEvent(t, roomID, nil, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"knock"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+	})
+	if err := knock.SetUnsignedField("knock_room_state", []json.RawMessage{
+		[]byte(`{"type":"m.room.name","state_key":"","content":{"name":"Knock Knock"},"sender":"@other:somewhere"}`),
+	}); err != nil {
+		t.Fatalf("failed to set knock_room_state: %s", err)
+	}
+	if pos, err := db.AddInviteEvent(ctx, knock); err != nil || pos == 0 {
+		t.Fatalf("AddInviteEvent returned %d, %v", pos, err)
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res, err := db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, types.StreamingToken{}, latest, 0, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertInvitedToRooms(t, res, []string{})
+	kr, ok := res.Rooms.Knock[roomID]
+	if !ok {
+		t.Fatalf("IncrementalSync: expected to have knocked on room %s", roomID)
+	}
+	if !strings.Contains(string(kr.KnockState.Events), "Knock Knock") {
+		t.Errorf("knock_state is missing the room state from the knock: %s", string(kr.KnockState.Events))
+	}
+
+	// the knock is retired once the user leaves or joins the room
+	if pos, err := db.RetireInviteEventsForUser(ctx, roomID, testUserIDA); err != nil || pos == 0 {
+		t.Fatalf("RetireInviteEventsForUser returned %d, %v", pos, err)
+	}
+	if pos, err := db.RetireInviteEventsForUser(ctx, roomID, testUserIDA); err != nil || pos != 0 {
+		t.Fatalf("RetireInviteEventsForUser with nothing to retire returned %d, %v, want 0", pos, err)
+	}
+	latest, err = db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, types.StreamingToken{}, latest, 0, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if _, ok = res.Rooms.Knock[roomID]; ok {
+		t.Errorf("IncrementalSync: the retired knock was still returned")
+	}
+
+	// an invite after a knock replaces it
+	roomID = "!knockinvite:somewhere"
+	knock = MustCreateEvent(t, roomID, nil, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"knock"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+	})
+	invite := MustCreateEvent(t, roomID, []gomatrixserverlib.HeaderedEvent{knock}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"invite"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDB,
+	})
+	for _, ev := range []gomatrixserverlib.HeaderedEvent{knock, invite} {
+		if _, err = db.AddInviteEvent(ctx, ev); err != nil {
+			t.Fatalf("Failed to AddInviteEvent: %s", err)
+		}
+	}
+	latest, err = db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), testUserDeviceA, types.StreamingToken{}, latest, 0, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertInvitedToRooms(t, res, []string{roomID})
+	if _, ok = res.Rooms.Knock[roomID]; ok {
+		t.Errorf("IncrementalSync: the room was both knocked on and invited to")
+	}
+}
+
+func TestPeekBehaviour(t *testing.T) {
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	peekingDevice := userapi.Device{
+		UserID: fmt.Sprintf("@quirrel:%s", testOrigin),
+		ID:     "device_id_peeker",
+	}
+
+	beforePeek, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	if _, err = db.AddPeek(ctx, testRoomID, peekingDevice.UserID, peekingDevice.ID); err != nil {
+		t.Fatalf("failed to AddPeek: %s", err)
+	}
+
+	// the peeked room should appear in a complete sync, with full state
+	res := types.NewResponse()
+	res, err = db.CompleteSync(ctx, res, peekingDevice, 5, false)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	if len(res.Rooms.Join) != 0 {
+		t.Fatalf("CompleteSync: expected no joined rooms, got %d", len(res.Rooms.Join))
+	}
+	pr, ok := res.Rooms.Peek[testRoomID]
+	if !ok {
+		t.Fatalf("CompleteSync: expected peeked room %s but it wasn't there", testRoomID)
+	}
+	assertEventsEqual(t, "CompleteSync timeline", false, pr.Timeline.Events, events[len(events)-5:])
+	if len(pr.State.Events) != len(state) {
+		t.Fatalf("CompleteSync: expected %d state events, got %d", len(state), len(pr.State.Events))
+	}
+
+	// an incremental sync from before the peek should also send full state
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res = types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, peekingDevice, beforePeek, latest, 5, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if pr, ok = res.Rooms.Peek[testRoomID]; !ok || len(pr.State.Events) != len(state) {
+		t.Fatalf("IncrementalSync: expected peeked room %s with full state", testRoomID)
+	}
+
+	// new events in the room should be sent to the peeking device
+	afterPeek := latest
+	msg := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{"body":"Peek-a-boo"}`),
+		Type:    "m.room.message",
+		Sender:  testUserIDA,
+		Depth:   int64(len(events) + 1),
+	})
+	MustWriteEvents(t, db, []gomatrixserverlib.HeaderedEvent{msg})
+	latest, err = db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res = types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, peekingDevice, afterPeek, latest, 5, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if pr, ok = res.Rooms.Peek[testRoomID]; !ok {
+		t.Fatalf("IncrementalSync: expected peeked room %s but it wasn't there", testRoomID)
+	}
+	assertEventsEqual(t, "IncrementalSync timeline", false, pr.Timeline.Events, []gomatrixserverlib.HeaderedEvent{msg})
+	if len(pr.State.Events) != 0 {
+		t.Fatalf("IncrementalSync: expected no state events, got %d", len(pr.State.Events))
+	}
+
+	// once the peek is removed, the room should be sent down as a leave
+	beforeUnpeek := latest
+	if _, err = db.DeletePeek(ctx, testRoomID, peekingDevice.UserID, peekingDevice.ID); err != nil {
+		t.Fatalf("failed to DeletePeek: %s", err)
+	}
+	latest, err = db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	res = types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, peekingDevice, beforeUnpeek, latest, 5, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if _, ok = res.Rooms.Peek[testRoomID]; ok {
+		t.Fatalf("IncrementalSync: expected room %s to no longer be peeked", testRoomID)
+	}
+	if _, ok = res.Rooms.Leave[testRoomID]; !ok {
+		t.Fatalf("IncrementalSync: expected room %s to be left after unpeeking", testRoomID)
+	}
+
+	// deleting peeks again should be a no-op
+	sp, err := db.DeleteRoomPeeks(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("failed to DeleteRoomPeeks: %s", err)
+	}
+	if sp != 0 {
+		t.Fatalf("DeleteRoomPeeks: expected stream position 0 when there are no peeks, got %d", sp)
+	}
+}
+
+func TestLeaveBehaviour(t *testing.T) {
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	deviceB := userapi.Device{
+		UserID: testUserIDB,
+		ID:     "device_id_B",
+	}
+	beforeKick, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	// user A kicks user B, then carries on talking and changes the topic
+	kick := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"leave"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDB,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	})
+	msg := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{kick}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{"body":"Good riddance"}`),
+		Type:    "m.room.message",
+		Sender:  testUserIDA,
+		Depth:   int64(len(events) + 2),
+	})
+	topic := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{msg}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"topic":"No paleking allowed"}`),
+		Type:     "m.room.topic",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 3),
+	})
+	// the kick replaces user B's join in the current state
+	_, err = db.WriteEvent(ctx, &kick, []gomatrixserverlib.HeaderedEvent{kick}, []string{kick.EventID()}, []string{state[2].EventID()}, nil, false)
+	if err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	MustWriteEvents(t, db, []gomatrixserverlib.HeaderedEvent{msg, topic})
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	// the room should be sent down as a leave, ending with the kick and
+	// without anything which happened afterwards
+	res := types.NewResponse()
+	res, err = db.IncrementalSync(ctx, res, deviceB, beforeKick, latest, 5, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	if _, ok := res.Rooms.Join[testRoomID]; ok {
+		t.Fatalf("IncrementalSync: expected room %s to no longer be joined", testRoomID)
+	}
+	lr, ok := res.Rooms.Leave[testRoomID]
+	if !ok {
+		t.Fatalf("IncrementalSync: expected room %s to be left after the kick", testRoomID)
+	}
+	assertEventsEqual(t, "IncrementalSync timeline", false, lr.Timeline.Events, []gomatrixserverlib.HeaderedEvent{kick})
+	for _, ev := range lr.State.Events {
+		if ev.Type == "m.room.topic" {
+			t.Fatalf("IncrementalSync: topic changed after the kick leaked into the left room state")
+		}
+	}
+}
+
+func TestCompleteSyncIncludeLeave(t *testing.T) {
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	deviceB := userapi.Device{
+		UserID: testUserIDB,
+		ID:     "device_id_B",
+	}
+
+	// user B leaves, then user A carries on talking and changes the topic
+	leave := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"leave"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDB,
+		Sender:   testUserIDB,
+		Depth:    int64(len(events) + 1),
+	})
+	msg := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{leave}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{"body":"Where did they go?"}`),
+		Type:    "m.room.message",
+		Sender:  testUserIDA,
+		Depth:   int64(len(events) + 2),
+	})
+	topic := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{msg}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"topic":"Nobody here but us"}`),
+		Type:     "m.room.topic",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 3),
+	})
+	// user A also changes their display name, replacing a state event which
+	// user B saw before leaving
+	rename := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{topic}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"join","displayname":"Alice"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 4),
+	})
+	_, err := db.WriteEvent(ctx, &leave, []gomatrixserverlib.HeaderedEvent{leave}, []string{leave.EventID()}, []string{state[2].EventID()}, nil, false)
+	if err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	MustWriteEvents(t, db, []gomatrixserverlib.HeaderedEvent{msg, topic})
+	_, err = db.WriteEvent(ctx, &rename, []gomatrixserverlib.HeaderedEvent{rename}, []string{rename.EventID()}, []string{state[1].EventID()}, nil, false)
+	if err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+
+	// without include_leave the room isn't sent down at all
+	res := types.NewResponse()
+	res, err = db.CompleteSync(ctx, res, deviceB, 5, false)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	if _, ok := res.Rooms.Leave[testRoomID]; ok {
+		t.Fatalf("CompleteSync: expected room %s to be excluded without include_leave", testRoomID)
+	}
+
+	// with include_leave the room ends with the leave, without anything
+	// which happened afterwards
+	res = types.NewResponse()
+	res, err = db.CompleteSync(ctx, res, deviceB, 5, true)
+	if err != nil {
+		t.Fatalf("CompleteSync failed: %s", err)
+	}
+	if _, ok := res.Rooms.Join[testRoomID]; ok {
+		t.Fatalf("CompleteSync: expected room %s to not be joined", testRoomID)
+	}
+	lr, ok := res.Rooms.Leave[testRoomID]
+	if !ok {
+		t.Fatalf("CompleteSync: expected room %s to be returned as left", testRoomID)
+	}
+	timeline := lr.Timeline.Events
+	if len(timeline) == 0 || timeline[len(timeline)-1].EventID != leave.EventID() {
+		t.Fatalf("CompleteSync: expected timeline to end with the leave event, got %v", timeline)
+	}
+	for _, ev := range timeline {
+		if ev.EventID == msg.EventID() || ev.EventID == topic.EventID() {
+			t.Fatalf("CompleteSync: event %s sent after the leave leaked into the timeline", ev.EventID)
+		}
+	}
+	var sawMemberA bool
+	for _, ev := range timeline {
+		if ev.EventID == state[1].EventID() {
+			sawMemberA = true
+		}
+	}
+	for _, ev := range lr.State.Events {
+		if ev.Type == "m.room.topic" {
+			t.Fatalf("CompleteSync: topic changed after the leave leaked into the left room state")
+		}
+		if ev.EventID == rename.EventID() {
+			t.Fatalf("CompleteSync: member event sent after the leave leaked into the left room state")
+		}
+		if ev.EventID == state[1].EventID() {
+			sawMemberA = true
+		}
+	}
+	if !sawMemberA {
+		t.Fatalf("CompleteSync: expected user A's membership from before the leave to be returned")
+	}
+}
+
+func TestPurgeOldEvents(t *testing.T) {
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	before := latest
+	to := types.StreamingToken{}
+
+	// only the newest 3 events are kept
+	purged, err := db.PurgeOldEvents(ctx, 0, 3)
+	if err != nil {
+		t.Fatalf("PurgeOldEvents failed: %s", err)
+	}
+	if purged != int64(len(events)-3) {
+		t.Errorf("PurgeOldEvents: got %d events purged, want %d", purged, len(events)-3)
+	}
+	remaining, err := db.GetEventsInStreamingRange(ctx, &latest, &to, testRoomID, 100, true)
+	if err != nil {
+		t.Fatalf("GetEventsInStreamingRange failed: %s", err)
+	}
+	assertEventsEqual(t, "after limiting events", true, gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(nil, remaining), gomatrixserverlib.FormatAll), reversed(events[len(events)-3:]))
+
+	// every event is older than this, but the newest is kept anyway
+	if _, err = db.PurgeOldEvents(ctx, gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)), 0); err != nil {
+		t.Fatalf("PurgeOldEvents failed: %s", err)
+	}
+	remaining, err = db.GetEventsInStreamingRange(ctx, &latest, &to, testRoomID, 100, true)
+	if err != nil {
+		t.Fatalf("GetEventsInStreamingRange failed: %s", err)
+	}
+	if len(remaining) != 1 || remaining[0].EventID() != events[len(events)-1].EventID() {
+		t.Fatalf("after purging by age: got %d events, want only the newest", len(remaining))
+	}
+
+	// tokens from before the purge are recognised as such, but only for the
+	// room which was purged
+	for _, tt := range []struct {
+		since types.StreamPosition
+		want  []string
+	}{
+		{before.PDUPosition - 2, []string{testRoomID}},
+		{before.PDUPosition - 1, nil},
+	} {
+		roomIDs, err := db.RoomsPurgedSince(ctx, tt.since)
+		if err != nil {
+			t.Fatalf("RoomsPurgedSince failed: %s", err)
+		}
+		if fmt.Sprint(roomIDs) != fmt.Sprint(tt.want) {
+			t.Errorf("RoomsPurgedSince(%d): got %v, want %v", tt.since, roomIDs, tt.want)
+		}
+	}
+}
+
+func TestPurgeRoom(t *testing.T) {
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	before, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	// the roomserver makes the local members leave before purging the room
+	leave := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"leave"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDB,
+		Sender:   testUserIDB,
+		Depth:    int64(len(events) + 1),
+	})
+	if _, err = db.WriteEvent(ctx, &leave, []gomatrixserverlib.HeaderedEvent{leave}, []string{leave.EventID()}, []string{state[2].EventID()}, nil, false); err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	inviteeID := fmt.Sprintf("@zote:%s", testOrigin)
+	invite := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"invite"}`),
+		Type:     "m.room.member",
+		StateKey: &inviteeID,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	})
+	if _, err = db.AddInviteEvent(ctx, invite); err != nil {
+		t.Fatalf("AddInviteEvent failed: %s", err)
+	}
+	if _, err = db.UpsertAccountData(ctx, testUserIDB, testRoomID, "m.fully_read"); err != nil {
+		t.Fatalf("UpsertAccountData failed: %s", err)
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	sp, invitees, err := db.PurgeRoom(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("PurgeRoom failed: %s", err)
+	}
+	if sp <= latest.PDUPosition {
+		t.Errorf("PurgeRoom returned stream position %d, want one after %d", sp, latest.PDUPosition)
+	}
+	if len(invitees) != 1 || invitees[0] != inviteeID {
+		t.Errorf("PurgeRoom retired the invites of %v, want [%s]", invitees, inviteeID)
+	}
+
+	// only the leave event survives, so that clients still find out they have left
+	to := types.StreamingToken{}
+	remaining, err := db.GetEventsInStreamingRange(ctx, &latest, &to, testRoomID, 100, true)
+	if err != nil {
+		t.Fatalf("GetEventsInStreamingRange failed: %s", err)
+	}
+	if len(remaining) != 1 || remaining[0].EventID() != leave.EventID() {
+		t.Errorf("got %d events after purging the room, want only the leave event", len(remaining))
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	remainingState, err := db.GetStateEventsForRoom(ctx, testRoomID, &stateFilter)
+	if err != nil {
+		t.Fatalf("GetStateEventsForRoom failed: %s", err)
+	}
+	if len(remainingState) != 1 || remainingState[0].EventID() != leave.EventID() {
+		t.Errorf("got %d state events after purging the room, want only the leave event", len(remainingState))
+	}
+
+	now, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	deviceB := userapi.Device{UserID: testUserIDB, ID: "device_id_B"}
+	res, err := db.IncrementalSync(ctx, types.NewResponse(), deviceB, before, now, 10, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	lr, ok := res.Rooms.Leave[testRoomID]
+	if !ok || len(lr.Timeline.Events) == 0 {
+		t.Errorf("IncrementalSync after the purge: want the leave event for the room")
+	}
+	accountDataFilter := gomatrixserverlib.DefaultEventFilter()
+	accountData, err := db.GetAccountDataInRange(ctx, testUserIDB, types.Range{From: 0, To: now.PDUPosition}, &accountDataFilter)
+	if err != nil {
+		t.Fatalf("GetAccountDataInRange failed: %s", err)
+	}
+	if _, ok = accountData[testRoomID]; ok {
+		t.Errorf("the room's account data survived the purge")
+	}
+
+	deviceInvitee := userapi.Device{UserID: inviteeID, ID: "device_id_zote"}
+	res, err = db.IncrementalSync(ctx, types.NewResponse(), deviceInvitee, latest, now, 10, false)
+	if err != nil {
+		t.Fatalf("IncrementalSync failed: %s", err)
+	}
+	assertInvitedToRooms(t, res, []string{})
+	if _, ok = res.Rooms.Leave[testRoomID]; !ok {
+		t.Errorf("IncrementalSync after the purge: want the retired invite for the room")
+	}
+}
+
+func TestSearchRoomEvents(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	keys := []string{"content.body"}
+
+	results, count, err := db.SearchRoomEvents(ctx, "message", []string{testRoomID}, keys, false, 5, 0)
+	if err != nil {
+		t.Fatalf("SearchRoomEvents returned an error: %s", err)
+	}
+	if count != 20 {
+		t.Errorf("SearchRoomEvents got count %d want 20", count)
+	}
+	if len(results) != 5 {
+		t.Fatalf("SearchRoomEvents got %d results want 5", len(results))
+	}
+	if results[0].EventID != events[len(events)-1].EventID() {
+		t.Errorf("SearchRoomEvents ordered by recency got first result %s want %s", results[0].EventID, events[len(events)-1].EventID())
+	}
+
+	results, count, err = db.SearchRoomEvents(ctx, "Message A 3", []string{testRoomID}, keys, true, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchRoomEvents returned an error: %s", err)
+	}
+	if count != 1 || len(results) != 1 || results[0].EventID != events[4].EventID() {
+		t.Errorf("SearchRoomEvents got %d results (count %d) want only %s", len(results), count, events[4].EventID())
+	}
+
+	results, count, err = db.SearchRoomEvents(ctx, "message", []string{testRoomID}, keys, false, 5, 18)
+	if err != nil {
+		t.Fatalf("SearchRoomEvents returned an error: %s", err)
+	}
+	if count != 20 || len(results) != 2 {
+		t.Errorf("SearchRoomEvents from offset 18 got %d results (count %d) want 2 (count 20)", len(results), count)
+	}
+
+	_, count, err = db.SearchRoomEvents(ctx, "message", []string{"!unknown:" + string(testOrigin)}, keys, true, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchRoomEvents returned an error: %s", err)
+	}
+	if count != 0 {
+		t.Errorf("SearchRoomEvents got count %d in another room want 0", count)
+	}
+
+	_, count, err = db.SearchRoomEvents(ctx, "message", []string{testRoomID}, []string{"content.name"}, true, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchRoomEvents returned an error: %s", err)
+	}
+	if count != 0 {
+		t.Errorf("SearchRoomEvents got count %d in room names want 0", count)
+	}
+}
+
+func assertInvitedToRooms(t *testing.T, res *types.Response, roomIDs []string) {
+	t.Helper()
+	if len(res.Rooms.Invite) != len(roomIDs) {
+		t.Fatalf("got %d invited rooms, want %d", len(res.Rooms.Invite), len(roomIDs))
+	}
+	for _, roomID := range roomIDs {
+		if _, ok := res.Rooms.Invite[roomID]; !ok {
+			t.Fatalf("missing room ID %s", roomID)
+		}
+	}
+}
+
+func TestRelations(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	original := events[len(events)-1] // sent by B
+
+	relate := func(sender, eventType, content string) gomatrixserverlib.HeaderedEvent {
+		ev := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+			Content: []byte(content),
+			Type:    eventType,
+			Sender:  sender,
+			Depth:   int64(len(events) + 1),
+		})
+		events = append(events, ev)
+		MustWriteEvents(t, db, []gomatrixserverlib.HeaderedEvent{ev})
+		return ev
+	}
+	annotation := fmt.Sprintf(`{"m.relates_to":{"rel_type":"m.annotation","event_id":"%s","key":"%%s"}}`, original.EventID())
+	thumbsA := relate(testUserIDA, "m.reaction", fmt.Sprintf(annotation, "👍"))
+	relate(testUserIDB, "m.reaction", fmt.Sprintf(annotation, "👍"))
+	relate(testUserIDA, "m.reaction", fmt.Sprintf(annotation, "🎉"))
+	edit := relate(testUserIDB, "m.room.message", fmt.Sprintf(
+		`{"body":"* edited","m.new_content":{"body":"edited"},"m.relates_to":{"rel_type":"m.replace","event_id":"%s"}}`, original.EventID(),
+	))
+	// edits by anyone other than the original sender are ignored
+	relate(testUserIDA, "m.room.message", fmt.Sprintf(
+		`{"body":"* hijacked","m.relates_to":{"rel_type":"m.replace","event_id":"%s"}}`, original.EventID(),
+	))
+	// as are edits which would change the type of the event
+	relate(testUserIDB, "m.sticker", fmt.Sprintf(
+		`{"body":"* sticker","m.relates_to":{"rel_type":"m.replace","event_id":"%s"}}`, original.EventID(),
+	))
+	reference := relate(testUserIDA, "m.room.message", fmt.Sprintf(
+		`{"body":"see above","m.relates_to":{"rel_type":"m.reference","event_id":"%s"}}`, original.EventID(),
+	))
+
+	// relations from another room are never returned or aggregated
+	otherRoomID := "!other:" + string(testOrigin)
+	MustWriteEvents(t, db, []gomatrixserverlib.HeaderedEvent{
+		MustCreateEvent(t, otherRoomID, nil, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(annotation, "👎")),
+			Type:    "m.reaction",
+			Sender:  testUserIDA,
+			Depth:   1,
+		}),
+	})
+
+	r := types.Range{From: types.StreamPosition(1 << 62), Backwards: true}
+	relations, err := db.RelationsForEvent(ctx, testRoomID, original.EventID(), "m.annotation", "m.reaction", r, 2)
+	if err != nil {
+		t.Fatalf("RelationsForEvent failed: %s", err)
+	}
+	if len(relations) != 2 || relations[0].EventID != events[len(events)-5].EventID() {
+		t.Fatalf("RelationsForEvent: got %+v, want the two newest reactions", relations)
+	}
+	r.From = relations[1].StreamPosition - 1
+	relations, err = db.RelationsForEvent(ctx, testRoomID, original.EventID(), "m.annotation", "", r, 2)
+	if err != nil {
+		t.Fatalf("RelationsForEvent failed: %s", err)
+	}
+	if len(relations) != 1 || relations[0].EventID != thumbsA.EventID() {
+		t.Fatalf("RelationsForEvent: got %+v, want the oldest reaction", relations)
+	}
+
+	// events in /sync responses don't have a room ID, so bundling mustn't
+	// depend on it
+	bundle := func() types.RelationAggregations {
+		clientEvents := gomatrixserverlib.HeaderedToClientEvents(
+			[]gomatrixserverlib.HeaderedEvent{original}, gomatrixserverlib.FormatSync,
+		)
+		if err = db.BundleAggregations(ctx, testRoomID, clientEvents); err != nil {
+			t.Fatalf("BundleAggregations failed: %s", err)
+		}
+		var unsigned struct {
+			Relations types.RelationAggregations `json:"m.relations"`
+		}
+		if err = json.Unmarshal(clientEvents[0].Unsigned, &unsigned); err != nil {
+			t.Fatalf("failed to unmarshal unsigned %s: %s", string(clientEvents[0].Unsigned), err)
+		}
+		return unsigned.Relations
+	}
+	// a duplicate annotation, e.g. from a remote server, doesn't count twice
+	relate(testUserIDB, "m.reaction", fmt.Sprintf(annotation, "👍"))
+	aggregations := bundle()
+	if aggregations.Annotation == nil || len(aggregations.Annotation.Chunk) != 2 {
+		t.Fatalf("got annotations %+v, want 2 keys", aggregations.Annotation)
+	}
+	if got := aggregations.Annotation.Chunk[0]; got.Key != "👍" || got.Count != 2 || got.Type != "m.reaction" {
+		t.Errorf("got most common annotation %+v, want 2 of 👍", got)
+	}
+	if aggregations.Replace == nil || aggregations.Replace.EventID != edit.EventID() {
+		t.Errorf("got replacement %+v, want %s", aggregations.Replace, edit.EventID())
+	} else if got := gjson.GetBytes(aggregations.Replace.Content, `m\.new_content.body`).Str; got != "edited" {
+		t.Errorf("got replacement content %s, want the new content of the edit", string(aggregations.Replace.Content))
+	}
+	if aggregations.Reference == nil || len(aggregations.Reference.Chunk) != 1 || aggregations.Reference.Chunk[0].EventID != reference.EventID() {
+		t.Errorf("got references %+v, want %s", aggregations.Reference, reference.EventID())
+	}
+
+	// redacting a reaction removes it from the aggregations
+	redaction := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{}`),
+		Type:    gomatrixserverlib.MRoomRedaction,
+		Sender:  testUserIDA,
+		Redacts: thumbsA.EventID(),
+		Depth:   int64(len(events) + 1),
+	})
+	if err = db.RedactEvent(ctx, thumbsA.EventID(), &redaction); err != nil {
+		t.Fatalf("RedactEvent failed: %s", err)
+	}
+	aggregations = bundle()
+	if got := aggregations.Annotation.Chunk; len(got) != 2 || got[0].Count != 1 || got[1].Count != 1 {
+		t.Errorf("got annotations %+v after redaction, want 1 of each", got)
+	}
+}
+
+func assertEventsEqual(t *testing.T, msg string, checkRoomID bool, gots []gomatrixserverlib.ClientEvent, wants []gomatrixserverlib.HeaderedEvent) {
+	if len(gots) != len(wants) {
+		t.Fatalf("%s response returned %d events, want %d", msg, len(gots), len(wants))
+	}
+	for i := range gots {
+		g := gots[i]
+		w := wants[i]
+		if g.EventID != w.EventID() {
+			t.Errorf("%s event[%d] event_id mismatch: got %s want %s", msg, i, g.EventID, w.EventID())
+		}
+		if g.Sender != w.Sender() {
+			t.Errorf("%s event[%d] sender mismatch: got %s want %s", msg, i, g.Sender, w.Sender())
+		}
+		if checkRoomID && g.RoomID != w.RoomID() {
+			t.Errorf("%s event[%d] room_id mismatch: got %s want %s", msg, i, g.RoomID, w.RoomID())
+		}
+		if g.Type != w.Type() {
+			t.Errorf("%s event[%d] event type mismatch: got %s want %s", msg, i, g.Type, w.Type())
+		}
+		if g.OriginServerTS != w.OriginServerTS() {
 			t.Errorf("%s event[%d] origin_server_ts mismatch: got %v want %v", msg, i, g.OriginServerTS, w.OriginServerTS())
 		}
 		if string(g.Content) != string(w.Content()) {
@@ -734,3 +1940,76 @@ func reversed(in []gomatrixserverlib.HeaderedEvent) []gomatrixserverlib.Headered
 	}
 	return out
 }
+
+func TestAccountDataOnlyForJoinedRooms(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	if _, err := db.UpsertAccountData(ctx, testUserIDB, "", "m.push_rules"); err != nil {
+		t.Fatalf("UpsertAccountData failed: %s", err)
+	}
+	pos, err := db.UpsertAccountData(ctx, testUserIDB, testRoomID, "m.tag")
+	if err != nil {
+		t.Fatalf("UpsertAccountData failed: %s", err)
+	}
+	accountDataFilter := gomatrixserverlib.DefaultEventFilter()
+	accountData, err := db.GetAccountDataInRange(ctx, testUserIDB, types.Range{From: 0, To: pos}, &accountDataFilter)
+	if err != nil {
+		t.Fatalf("GetAccountDataInRange failed: %s", err)
+	}
+	if !reflect.DeepEqual(accountData, map[string][]string{"": {"m.push_rules"}, testRoomID: {"m.tag"}}) {
+		t.Errorf("GetAccountDataInRange while joined: got %v, want the global and room account data", accountData)
+	}
+
+	// once user B is kicked, only their global account data is returned
+	kick := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"leave"}`),
+		Type:     "m.room.member",
+		StateKey: &testUserIDB,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	})
+	if _, err = db.WriteEvent(ctx, &kick, []gomatrixserverlib.HeaderedEvent{kick}, []string{kick.EventID()}, []string{state[2].EventID()}, nil, false); err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	accountData, err = db.GetAccountDataInRange(ctx, testUserIDB, types.Range{From: 0, To: pos}, &accountDataFilter)
+	if err != nil {
+		t.Fatalf("GetAccountDataInRange failed: %s", err)
+	}
+	if !reflect.DeepEqual(accountData, map[string][]string{"": {"m.push_rules"}}) {
+		t.Errorf("GetAccountDataInRange after leaving: got %v, want only the global account data", accountData)
+	}
+}
+
+func TestResetNotificationCounts(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	const otherRoomID = "!other:localhost"
+	if _, err := db.IncrementNotificationCounts(ctx, testUserIDA, testRoomID, 2, 1); err != nil {
+		t.Fatalf("IncrementNotificationCounts failed: %s", err)
+	}
+	if _, err := db.IncrementNotificationCounts(ctx, testUserIDA, otherRoomID, 3, 0); err != nil {
+		t.Fatalf("IncrementNotificationCounts failed: %s", err)
+	}
+
+	// All of the counts of the room are cleared, and only those.
+	pos, err := db.ResetNotificationCounts(ctx, testUserIDA, testRoomID)
+	if err != nil {
+		t.Fatalf("ResetNotificationCounts failed: %s", err)
+	}
+	if pos == 0 {
+		t.Errorf("ResetNotificationCounts: got stream position 0, want the position of the reset")
+	}
+	if unread, err := db.UnreadNotificationCount(ctx, testUserIDA); err != nil || unread != 3 {
+		t.Errorf("UnreadNotificationCount: got %d, %v, want the 3 in the other room", unread, err)
+	}
+
+	if pos, err = db.ResetNotificationCounts(ctx, testUserIDA, testRoomID); err != nil {
+		t.Fatalf("ResetNotificationCounts failed: %s", err)
+	}
+	if pos != 0 {
+		t.Errorf("ResetNotificationCounts with nothing to reset: got stream position %d, want 0", pos)
+	}
+}
@@ -25,6 +25,7 @@ import (
 // NewPublicRoomsServerDatabase opens a database connection.
 func NewSyncServerDatasource(
 	dataSourceName string,
+	replicaDataSourceName string, // nolint:unparam
 	dbProperties sqlutil.DbProperties, // nolint:unparam
 ) (Database, error) {
 	uri, err := url.Parse(dataSourceName)
@@ -26,21 +26,54 @@ import (
 type AccountData interface {
 	InsertAccountData(ctx context.Context, txn *sql.Tx, userID, roomID, dataType string) (pos types.StreamPosition, err error)
 	// SelectAccountDataInRange returns a map of room ID to a list of `dataType`.
+	// Room account data is only returned for rooms which the user is joined to.
 	SelectAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataEventFilter *gomatrixserverlib.EventFilter) (data map[string][]string, err error)
 	SelectMaxAccountDataID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
+// Invites stores the invites for local users, along with the knocks which
+// they have made, as both are delivered to the user outside of the rooms
+// that they are in.
 type Invites interface {
 	InsertInviteEvent(ctx context.Context, txn *sql.Tx, inviteEvent gomatrixserverlib.HeaderedEvent) (streamPos types.StreamPosition, err error)
 	DeleteInviteEvent(ctx context.Context, inviteEventID string) (types.StreamPosition, error)
 	// SelectInviteEventsInRange returns a map of room ID to invite events.
 	SelectInviteEventsInRange(ctx context.Context, txn *sql.Tx, targetUserID string, r types.Range) (invites map[string]gomatrixserverlib.HeaderedEvent, retired map[string]gomatrixserverlib.HeaderedEvent, err error)
+	// SelectActiveInviteEventIDs returns the IDs of the invite events for the target user in the room which
+	// haven't been retired.
+	SelectActiveInviteEventIDs(ctx context.Context, txn *sql.Tx, roomID, targetUserID string) ([]string, error)
+	// SelectActiveRoomInvites returns a map of event ID to target user ID for the invite events in the room which
+	// haven't been retired.
+	SelectActiveRoomInvites(ctx context.Context, txn *sql.Tx, roomID string) (map[string]string, error)
 	SelectMaxInviteID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
+// Peeks tracks which devices are peeking into which rooms. Peeks share the stream
+// position space with room events so that starting or stopping a peek shows up
+// in the PDU part of a sync.
+type Peeks interface {
+	InsertPeek(ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string) (streamPos types.StreamPosition, err error)
+	// DeletePeek stops the device from peeking into the room. This, DeletePeeks and DeleteRoomPeeks return a stream
+	// position of 0 if there were no matching peeks.
+	DeletePeek(ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string) (streamPos types.StreamPosition, err error)
+	// DeletePeeks stops all of the user's devices from peeking into the room.
+	DeletePeeks(ctx context.Context, txn *sql.Tx, roomID, userID string) (streamPos types.StreamPosition, err error)
+	// DeleteRoomPeeks stops all devices from peeking into the room.
+	DeleteRoomPeeks(ctx context.Context, txn *sql.Tx, roomID string) (streamPos types.StreamPosition, err error)
+	// SelectPeeksInRange returns the peeks for the device which were active at the end of the range, along with
+	// the peeks which were stopped within the range.
+	SelectPeeksInRange(ctx context.Context, txn *sql.Tx, userID, deviceID string, r types.Range) (peeks []types.Peek, err error)
+	// SelectPeekingDevices returns a map of room ID to the devices currently peeking into that room.
+	SelectPeekingDevices(ctx context.Context) (peekingDevices map[string][]types.PeekingDevice, err error)
+	SelectMaxPeekID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
 type Events interface {
 	SelectStateInRange(ctx context.Context, txn *sql.Tx, r types.Range, stateFilter *gomatrixserverlib.StateFilter) (map[string]map[string]bool, map[string]types.StreamEvent, error)
 	SelectMaxEventID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectRemovedStateEventIDs returns the IDs of the state events which were removed from the
+	// room's state by events after the given stream position. Only the types of the stateFilter apply.
+	SelectRemovedStateEventIDs(ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition, stateFilter *gomatrixserverlib.StateFilter) ([]string, error)
 	InsertEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, addState, removeState []string, transactionID *api.TransactionID, excludeFromSync bool) (streamPos types.StreamPosition, err error)
 	// SelectRecentEvents returns events between the two stream positions: exclusive of low and inclusive of high.
 	// If onlySyncEvents has a value of true, only returns the events that aren't marked as to exclude from sync.
@@ -50,6 +83,13 @@ type Events interface {
 	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int) ([]types.StreamEvent, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
 	UpdateEventJSON(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error
+	// SelectRoomIDsWithEvents returns the IDs of all of the rooms which have events stored.
+	SelectRoomIDsWithEvents(ctx context.Context, txn *sql.Tx) ([]string, error)
+	// SelectPositionOfNthNewestEvent returns the stream position of the event in the room which has n newer events
+	// than it, or 0 if the room doesn't have that many events.
+	SelectPositionOfNthNewestEvent(ctx context.Context, txn *sql.Tx, roomID string, n int) (types.StreamPosition, error)
+	// DeleteEventsUpTo deletes the events in the room at or before the given stream position.
+	DeleteEventsUpTo(ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition) (deleted int64, err error)
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -58,15 +98,20 @@ type Topology interface {
 	// InsertEventInTopology inserts the given event in the room's topology, based on the event's depth.
 	// `pos` is the stream position of this event in the events table, and is used to order events which have the same depth.
 	InsertEventInTopology(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition) (err error)
-	// SelectEventIDsInRange selects the IDs of events whose depths are within a given range in a given room's topological order.
-	// Events with `minDepth` are *exclusive*, as is the event which has exactly `minDepth`,`maxStreamPos`.
-	// `maxStreamPos` is only used when events have the same depth as `maxDepth`, which results in events less than `maxStreamPos` being returned.
+	// SelectEventIDsInRange selects the IDs of events whose positions are within a given range in a given room's topological order.
+	// Events are ordered by depth, and then by stream position for events with the same depth. The lower bound `minDepth`,`minStreamPos`
+	// is *exclusive* and the upper bound `maxDepth`,`maxStreamPos` is *inclusive*.
 	// Returns an empty slice if no events match the given range.
-	SelectEventIDsInRange(ctx context.Context, txn *sql.Tx, roomID string, minDepth, maxDepth, maxStreamPos types.StreamPosition, limit int, chronologicalOrder bool) (eventIDs []string, err error)
+	SelectEventIDsInRange(ctx context.Context, txn *sql.Tx, roomID string, minDepth, minStreamPos, maxDepth, maxStreamPos types.StreamPosition, limit int, chronologicalOrder bool) (eventIDs []string, err error)
 	// SelectPositionInTopology returns the depth and stream position of a given event in the topology of the room it belongs to.
 	SelectPositionInTopology(ctx context.Context, txn *sql.Tx, eventID string) (depth, spos types.StreamPosition, err error)
 	// SelectMaxPositionInTopology returns the event which has the highest depth, and if there are multiple, the event with the highest stream position.
 	SelectMaxPositionInTopology(ctx context.Context, txn *sql.Tx, roomID string) (depth types.StreamPosition, spos types.StreamPosition, err error)
+	// SelectStreamToTopologicalPosition returns the highest depth of the events in the room at or before the given stream position,
+	// or 0 if there are none.
+	SelectStreamToTopologicalPosition(ctx context.Context, txn *sql.Tx, roomID string, streamPos types.StreamPosition) (depth types.StreamPosition, err error)
+	// DeleteTopologyUpTo removes the events in the room at or before the given stream position.
+	DeleteTopologyUpTo(ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition) (err error)
 }
 
 type CurrentRoomState interface {
@@ -78,8 +123,16 @@ type CurrentRoomState interface {
 	SelectCurrentState(ctx context.Context, txn *sql.Tx, roomID string, stateFilter *gomatrixserverlib.StateFilter) ([]gomatrixserverlib.HeaderedEvent, error)
 	// SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
 	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
+	// SelectMembershipPositions returns the rooms which have the given user in the given membership state, along
+	// with the stream position of the event which gave them that membership.
+	SelectMembershipPositions(ctx context.Context, txn *sql.Tx, userID string, membership string) (map[string]types.StreamPosition, error)
 	// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 	SelectJoinedUsers(ctx context.Context) (map[string][]string, error)
+	// SelectMembershipCount returns the number of users in the given room with the given membership.
+	SelectMembershipCount(ctx context.Context, txn *sql.Tx, roomID, membership string) (count int, err error)
+	// SelectHeroes returns up to `limit` user IDs from the membership of the given room, excluding the
+	// given user. Joined and invited users are preferred over those who have left or been banned.
+	SelectHeroes(ctx context.Context, txn *sql.Tx, roomID, excludeUserID string, limit int) ([]string, error)
 }
 
 // BackwardsExtremities keeps track of backwards extremities for a room.
@@ -127,15 +180,88 @@ type BackwardsExtremities interface {
 // the recorded one, we drop the entry from the DB as it's "sent". If the
 // sync parameter isn't later then we will keep including the updates in the
 // sync response, as the client is seemingly trying to repeat the same /sync.
+//
+// The ID of each message is also its position in the send-to-device stream,
+// so that positions carry on from where they left off after a restart and
+// tokens held by clients from before the restart are still meaningful.
 type SendToDevice interface {
-	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string) (err error)
+	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string) (pos types.StreamPosition, err error)
 	SelectSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string) (events []types.SendToDeviceEvent, err error)
 	UpdateSentSendToDeviceMessages(ctx context.Context, txn *sql.Tx, token string, nids []types.SendToDeviceNID) (err error)
 	DeleteSendToDeviceMessages(ctx context.Context, txn *sql.Tx, nids []types.SendToDeviceNID) (err error)
 	CountSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string) (count int, err error)
+	// SelectMaxSendToDeviceMessageID returns the last ID given to a message, even if that message has since been
+	// deleted, or 0 if there have never been any messages.
+	SelectMaxSendToDeviceMessageID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// DeleteSendToDeviceMessagesBeyondLimit deletes all but the newest `keep` messages waiting for each device.
+	DeleteSendToDeviceMessagesBeyondLimit(ctx context.Context, txn *sql.Tx, keep int) (deleted int64, err error)
 }
 
 type Filter interface {
 	SelectFilter(ctx context.Context, localpart string, filterID string) (*gomatrixserverlib.Filter, error)
 	InsertFilter(ctx context.Context, filter *gomatrixserverlib.Filter, localpart string) (filterID string, err error)
 }
+
+// NotificationData stores the unread notification counts for each user in
+// each room. The counts are incremented as new events match the user's push
+// rules and are reset when the user sends a read receipt for the room.
+type NotificationData interface {
+	IncrementNotificationCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int) (pos types.StreamPosition, err error)
+	// ResetNotificationCounts zeroes the counts for the given user and room. Returns a stream position of 0 if
+	// there was nothing to reset.
+	ResetNotificationCounts(ctx context.Context, txn *sql.Tx, userID, roomID string) (pos types.StreamPosition, err error)
+	// SelectUserNotificationCounts returns a map of room ID to the notification counts for the given user.
+	SelectUserNotificationCounts(ctx context.Context, txn *sql.Tx, userID string) (map[string]types.NotificationData, error)
+	SelectMaxNotificationID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// Search stores a full-text index of the searchable parts of room events, i.e. the body of messages and the names
+// and topics of rooms, for the client-server /search API.
+type Search interface {
+	InsertSearchEntry(ctx context.Context, txn *sql.Tx, eventID, roomID, key string, pos types.StreamPosition, content string) error
+	DeleteSearchEntry(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectSearchResults returns the events matching the search term in the given rooms and keys, either ordered by
+	// rank or by recency, along with the total number of matching events.
+	SelectSearchResults(
+		ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int,
+	) (results []types.SearchResult, count int, err error)
+}
+
+// Relations stores the relations between room events described by the m.relates_to key of their content, such
+// as reactions and edits, so that they can be paginated and aggregated.
+type Relations interface {
+	InsertRelation(
+		ctx context.Context, txn *sql.Tx, roomID, eventID, relatesToID, relType, eventType, sender, key string,
+		pos types.StreamPosition,
+	) error
+	DeleteRelation(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectRelationsInRange returns the events in the room relating to the given event within the range, newest
+	// first if the range is backwards. The relation type and event type are not filtered on if empty.
+	SelectRelationsInRange(
+		ctx context.Context, txn *sql.Tx, roomID, relatesToID, relType, eventType string, r types.Range, limit int,
+	) ([]types.Relation, error)
+	// SelectRelationsOfTypes returns up to limit of the newest relations of the given types in the room to any of
+	// the given events, newest first.
+	SelectRelationsOfTypes(
+		ctx context.Context, txn *sql.Tx, roomID string, relatesToIDs, relTypes []string, limit int,
+	) ([]types.Relation, error)
+	// SelectAnnotationCounts returns the number of annotations in the room of each of the given events, grouped by
+	// their event type and key, most common first, up to limit groups.
+	SelectAnnotationCounts(
+		ctx context.Context, txn *sql.Tx, roomID string, relatesToIDs []string, limit int,
+	) ([]types.AnnotationCount, error)
+}
+
+// Retention records how far old events have been purged from each room, so that sync tokens from before the
+// purge can be recognised. The purged position of a room only ever increases.
+type Retention interface {
+	UpdatePurgedPosition(ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition) error
+	// SelectRoomsPurgedAfter returns the rooms which have had events purged after the given stream position.
+	SelectRoomsPurgedAfter(ctx context.Context, txn *sql.Tx, pos types.StreamPosition) ([]string, error)
+}
+
+type Purge interface {
+	// PurgeRoom deletes everything stored about the room apart from the members' leave events, which clients still
+	// need to sync. Invites and peeks aren't touched, as they must be retired rather than deleted.
+	PurgeRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
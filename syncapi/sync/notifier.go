@@ -16,9 +16,11 @@ package sync
 
 import (
 	"context"
+	"hash/fnv"
 	"sync"
 	"time"
 
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -30,16 +32,40 @@ import (
 // they can use to get at it. This is done to prevent races whereby we tell the caller
 // the event, but the token has already advanced by the time they fetch it, resulting
 // in missed events.
+//
+// The user device streams are split across a number of shards, each with their
+// own lock, so that a new event only has to touch the shards which contain the
+// users in the event's room. Incoming /sync requests only lock the shard for
+// their own user, so they don't contend with events for unrelated rooms.
 type Notifier struct {
 	// A map of RoomID => Set<UserID> : Must only be accessed by the OnNewEvent goroutine
 	roomIDToJoinedUsers map[string]userIDSet
-	// Protects currPos and userStreams.
-	streamLock *sync.Mutex
+	// A map of RoomID => Set<PeekingDevice> : Must only be accessed by the OnNewEvent goroutine
+	roomIDToPeekingDevices map[string]peekingDeviceSet
+	// A map of UserID => Set<RoomID> of the rooms which the user has muted
+	userIDToMutedRooms map[string]map[string]bool
+	// Serialises updates so that streams are always woken up in position order.
+	// Protects roomIDToJoinedUsers, roomIDToPeekingDevices and userIDToMutedRooms.
+	updateLock *sync.Mutex
+	// Protects currPos.
+	posLock *sync.RWMutex
 	// The latest sync position
 	currPos types.StreamingToken
-	// A map of user_id => device_id => UserStream which can be used to wake a given user's /sync request.
-	userDeviceStreams map[string]map[string]*UserDeviceStream
-	// The last time we cleaned out stale entries from the userStreams map
+	// The user device streams which can be used to wake a given user's /sync request,
+	// sharded by user ID.
+	shards [notifierShardCount]*userDeviceStreamShard
+}
+
+// notifierShardCount is the number of shards that the user device streams are split across.
+const notifierShardCount = 64
+
+// userDeviceStreamShard holds the user device streams for a subset of users.
+type userDeviceStreamShard struct {
+	// Protects streams and lastCleanUpTime.
+	lock sync.Mutex
+	// A map of user_id => device_id => UserStream
+	streams map[string]map[string]*UserDeviceStream
+	// The last time we cleaned out stale entries from the streams map
 	lastCleanUpTime time.Time
 }
 
@@ -47,13 +73,21 @@ type Notifier struct {
 // In order for this to be of any use, the Notifier needs to be told all rooms and
 // the joined users within each of them by calling Notifier.Load(*storage.SyncServerDatabase).
 func NewNotifier(pos types.StreamingToken) *Notifier {
-	return &Notifier{
-		currPos:             pos,
-		roomIDToJoinedUsers: make(map[string]userIDSet),
-		userDeviceStreams:   make(map[string]map[string]*UserDeviceStream),
-		streamLock:          &sync.Mutex{},
-		lastCleanUpTime:     time.Now(),
+	n := &Notifier{
+		currPos:                pos,
+		roomIDToJoinedUsers:    make(map[string]userIDSet),
+		roomIDToPeekingDevices: make(map[string]peekingDeviceSet),
+		userIDToMutedRooms:     make(map[string]map[string]bool),
+		updateLock:             &sync.Mutex{},
+		posLock:                &sync.RWMutex{},
 	}
+	for i := range n.shards {
+		n.shards[i] = &userDeviceStreamShard{
+			streams:         make(map[string]map[string]*UserDeviceStream),
+			lastCleanUpTime: time.Now(),
+		}
+	}
+	return n
 }
 
 // OnNewEvent is called when a new event is received from the room server. Must only be
@@ -62,6 +96,8 @@ func NewNotifier(pos types.StreamingToken) *Notifier {
 // Chooses which user sync streams to update by a provided *gomatrixserverlib.Event
 // (based on the users in the event's room),
 // a roomID directly, or a list of user IDs, prioritised by parameter ordering.
+// A roomID is only given for ephemeral events such as typing notifications, so
+// users who have muted the room aren't woken up for them.
 // posUpdate contains the latest position(s) for one or more types of events.
 // If a position in posUpdate is 0, it means no updates are available of that type.
 // Typically a consumer supplies a posUpdate with the latest sync position for the
@@ -72,16 +108,15 @@ func (n *Notifier) OnNewEvent(
 ) {
 	// update the current position then notify relevant /sync streams.
 	// This needs to be done PRIOR to waking up users as they will read this value.
-	n.streamLock.Lock()
-	defer n.streamLock.Unlock()
-	latestPos := n.currPos.WithUpdates(posUpdate)
-	n.currPos = latestPos
-
-	n.removeEmptyUserStreams()
+	n.updateLock.Lock()
+	defer n.updateLock.Unlock()
+	latestPos := n.advancePosition(posUpdate)
 
 	if ev != nil {
 		// Map this event's room_id to a list of joined users, and wake them up.
 		usersToNotify := n.joinedUsers(ev.RoomID())
+		// Map this event's room_id to a list of peeking devices, and wake them up.
+		peekingDevicesToNotify := n.peekingDevices(ev.RoomID())
 		// If this is an invite, also add in the invitee to this list.
 		if ev.Type() == "m.room.member" && ev.StateKey() != nil {
 			targetUserID := *ev.StateKey()
@@ -100,6 +135,8 @@ func (n *Notifier) OnNewEvent(
 					// along all members in the room
 					usersToNotify = append(usersToNotify, targetUserID)
 					n.addJoinedUser(ev.RoomID(), targetUserID)
+					// Joining the room supersedes any peeks into it.
+					n.removePeekingUser(ev.RoomID(), targetUserID)
 				case gomatrixserverlib.Leave:
 					fallthrough
 				case gomatrixserverlib.Ban:
@@ -108,9 +145,20 @@ func (n *Notifier) OnNewEvent(
 			}
 		}
 
+		// If the room is no longer world-readable then nobody can peek into it.
+		// The peeking devices are still woken up so they learn that their peeks
+		// have ended.
+		if ev.Type() == gomatrixserverlib.MRoomHistoryVisibility && ev.StateKey() != nil && *ev.StateKey() == "" {
+			if auth.HistoryVisibilityForRoom([]gomatrixserverlib.Event{ev.Event}) != "world_readable" {
+				n.removePeekingDevices(ev.RoomID())
+			}
+		}
+
 		n.wakeupUsers(usersToNotify, latestPos)
+		n.wakeupPeekingDevices(peekingDevicesToNotify, latestPos)
 	} else if roomID != "" {
-		n.wakeupUsers(n.joinedUsers(roomID), latestPos)
+		n.wakeupUsers(n.unmutedUsers(roomID, n.joinedUsers(roomID)), latestPos)
+		n.wakeupPeekingDevices(n.peekingDevices(roomID), latestPos)
 	} else if len(userIDs) > 0 {
 		n.wakeupUsers(userIDs, latestPos)
 	} else {
@@ -120,14 +168,78 @@ func (n *Notifier) OnNewEvent(
 	}
 }
 
+// SetMutedRooms replaces the set of rooms which the given user has muted in
+// their push rules.
+func (n *Notifier) SetMutedRooms(userID string, roomIDs []string) {
+	n.updateLock.Lock()
+	defer n.updateLock.Unlock()
+	if len(roomIDs) == 0 {
+		delete(n.userIDToMutedRooms, userID)
+		return
+	}
+	mutedRooms := make(map[string]bool, len(roomIDs))
+	for _, roomID := range roomIDs {
+		mutedRooms[roomID] = true
+	}
+	n.userIDToMutedRooms[userID] = mutedRooms
+}
+
+// OnNewPeek is called when a device starts peeking into a room. Must only be
+// called from the same goroutine as OnNewEvent.
+func (n *Notifier) OnNewPeek(
+	roomID, userID, deviceID string,
+	posUpdate types.StreamingToken,
+) {
+	n.updateLock.Lock()
+	defer n.updateLock.Unlock()
+	latestPos := n.advancePosition(posUpdate)
+
+	n.addPeekingDevice(roomID, userID, deviceID)
+	n.wakeupUserDevice(userID, []string{deviceID}, latestPos)
+}
+
+// OnRetirePeek is called when a device stops peeking into a room. Must only be
+// called from the same goroutine as OnNewEvent.
+func (n *Notifier) OnRetirePeek(
+	roomID, userID, deviceID string,
+	posUpdate types.StreamingToken,
+) {
+	n.updateLock.Lock()
+	defer n.updateLock.Unlock()
+	latestPos := n.advancePosition(posUpdate)
+
+	n.removePeekingDevice(roomID, userID, deviceID)
+	n.wakeupUserDevice(userID, []string{deviceID}, latestPos)
+}
+
+// OnPurgeRoom is called when a room has been purged. The devices which were
+// peeking into it and the given users, whose invites to it were retired, are
+// woken up so they find out, and the room is forgotten. Must only be called
+// from the same goroutine as OnNewEvent.
+func (n *Notifier) OnPurgeRoom(
+	roomID string, userIDs []string,
+	posUpdate types.StreamingToken,
+) {
+	n.updateLock.Lock()
+	defer n.updateLock.Unlock()
+	latestPos := n.advancePosition(posUpdate)
+
+	peekingDevices := n.peekingDevices(roomID)
+	n.removePeekingDevices(roomID)
+	delete(n.roomIDToJoinedUsers, roomID)
+	n.wakeupUsers(userIDs, latestPos)
+	n.wakeupPeekingDevices(peekingDevices, latestPos)
+}
+
+// OnNewSendToDevice is called when new send-to-device messages are available for
+// the given devices of a user.
 func (n *Notifier) OnNewSendToDevice(
 	userID string, deviceIDs []string,
 	posUpdate types.StreamingToken,
 ) {
-	n.streamLock.Lock()
-	defer n.streamLock.Unlock()
-	latestPos := n.currPos.WithUpdates(posUpdate)
-	n.currPos = latestPos
+	n.updateLock.Lock()
+	defer n.updateLock.Unlock()
+	latestPos := n.advancePosition(posUpdate)
 
 	n.wakeupUserDevice(userID, deviceIDs, latestPos)
 }
@@ -144,32 +256,60 @@ func (n *Notifier) GetListener(req syncRequest) UserDeviceStreamListener {
 	// TODO: v1 /events 'peeking' has an 'explicit room ID' which is also tracked,
 	//       but given we don't do /events, let's pretend it doesn't exist.
 
-	n.streamLock.Lock()
-	defer n.streamLock.Unlock()
+	shard := n.shardFor(req.device.UserID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
 
-	n.removeEmptyUserStreams()
+	shard.removeEmptyUserStreams()
 
-	return n.fetchUserDeviceStream(req.device.UserID, req.device.ID, true).GetListener(req.ctx)
+	return shard.fetchUserDeviceStream(req.device.UserID, req.device.ID, n.CurrentPosition(), true).GetListener(req.ctx)
 }
 
 // Load the membership states required to notify users correctly.
 func (n *Notifier) Load(ctx context.Context, db storage.Database) error {
+	n.updateLock.Lock()
+	defer n.updateLock.Unlock()
+
 	roomToUsers, err := db.AllJoinedUsersInRooms(ctx)
 	if err != nil {
 		return err
 	}
 	n.setUsersJoinedToRooms(roomToUsers)
+
+	roomToPeekingDevices, err := db.AllPeekingDevicesInRooms(ctx)
+	if err != nil {
+		return err
+	}
+	n.setPeekingDevices(roomToPeekingDevices)
 	return nil
 }
 
 // CurrentPosition returns the current sync position
 func (n *Notifier) CurrentPosition() types.StreamingToken {
-	n.streamLock.Lock()
-	defer n.streamLock.Unlock()
+	n.posLock.RLock()
+	defer n.posLock.RUnlock()
+
+	return n.currPos
+}
 
+// advancePosition applies the given updates to the current sync position and
+// returns the new position.
+// NB: Callers should have locked updateLock before calling this function.
+func (n *Notifier) advancePosition(posUpdate types.StreamingToken) types.StreamingToken {
+	n.posLock.Lock()
+	defer n.posLock.Unlock()
+
+	n.currPos = n.currPos.WithUpdates(posUpdate)
 	return n.currPos
 }
 
+// shardFor returns the shard which holds the streams for the given user.
+func (n *Notifier) shardFor(userID string) *userDeviceStreamShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return n.shards[h.Sum32()%notifierShardCount]
+}
+
 // setUsersJoinedToRooms marks the given users as 'joined' to the given rooms, such that new events from
 // these rooms will wake the given users /sync requests. This should be called prior to ANY calls to
 // OnNewEvent (eg on startup) to prevent racing.
@@ -185,71 +325,110 @@ func (n *Notifier) setUsersJoinedToRooms(roomIDToUserIDs map[string][]string) {
 	}
 }
 
+// setPeekingDevices marks the given devices as peeking into the given rooms, such that new events from
+// these rooms will wake the given devices' /sync requests. This should be called prior to ANY calls to
+// OnNewEvent (eg on startup) to prevent racing.
+func (n *Notifier) setPeekingDevices(roomIDToPeekingDevices map[string][]types.PeekingDevice) {
+	// This is just the bulk form of addPeekingDevice
+	for roomID, peekingDevices := range roomIDToPeekingDevices {
+		if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
+			n.roomIDToPeekingDevices[roomID] = make(peekingDeviceSet)
+		}
+		for _, peekingDevice := range peekingDevices {
+			n.roomIDToPeekingDevices[roomID].add(peekingDevice)
+		}
+	}
+}
+
 // wakeupUsers will wake up the sync strems for all of the devices for all of the
-// specified user IDs.
+// specified user IDs. The users are grouped by shard so that each shard is only
+// locked once, and shards with none of the users in them aren't touched at all.
 func (n *Notifier) wakeupUsers(userIDs []string, newPos types.StreamingToken) {
+	byShard := make(map[*userDeviceStreamShard][]string)
 	for _, userID := range userIDs {
-		for _, stream := range n.fetchUserStreams(userID) {
-			if stream == nil {
-				continue
-			}
-			stream.Broadcast(newPos) // wake up all goroutines Wait()ing on this stream
-		}
+		shard := n.shardFor(userID)
+		byShard[shard] = append(byShard[shard], userID)
+	}
+	for shard, shardUserIDs := range byShard {
+		shard.wakeupUsers(shardUserIDs, newPos)
+	}
+}
+
+// wakeupPeekingDevices will wake up the sync streams for the given peeking devices.
+func (n *Notifier) wakeupPeekingDevices(peekingDevices []types.PeekingDevice, newPos types.StreamingToken) {
+	for _, peekingDevice := range peekingDevices {
+		n.wakeupUserDevice(peekingDevice.UserID, []string{peekingDevice.DeviceID}, newPos)
 	}
 }
 
 // wakeupUserDevice will wake up the sync stream for a specific user device. Other
 // device streams will be left alone.
-// nolint:unused
 func (n *Notifier) wakeupUserDevice(userID string, deviceIDs []string, newPos types.StreamingToken) {
+	shard := n.shardFor(userID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	shard.removeEmptyUserStreams()
+
 	for _, deviceID := range deviceIDs {
-		if stream := n.fetchUserDeviceStream(userID, deviceID, false); stream != nil {
+		if stream := shard.fetchUserDeviceStream(userID, deviceID, newPos, false); stream != nil {
 			stream.Broadcast(newPos) // wake up all goroutines Wait()ing on this stream
 		}
 	}
 }
 
-// fetchUserDeviceStream retrieves a stream unique to the given device. If makeIfNotExists is true,
-// a stream will be made for this device if one doesn't exist and it will be returned. This
-// function does not wait for data to be available on the stream.
-// NB: Callers should have locked the mutex before calling this function.
+// fetchUserDeviceStream retrieves a stream unique to the given device, respecting
+// the lock of the shard that the stream belongs to. If makeIfNotExists is true, a
+// stream will be made for this device if one doesn't exist and it will be returned.
 func (n *Notifier) fetchUserDeviceStream(userID, deviceID string, makeIfNotExists bool) *UserDeviceStream {
-	_, ok := n.userDeviceStreams[userID]
+	shard := n.shardFor(userID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	return shard.fetchUserDeviceStream(userID, deviceID, n.CurrentPosition(), makeIfNotExists)
+}
+
+// wakeupUsers will wake up the sync streams for all of the devices for all of the
+// specified user IDs, all of which must belong to this shard.
+func (s *userDeviceStreamShard) wakeupUsers(userIDs []string, newPos types.StreamingToken) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.removeEmptyUserStreams()
+
+	for _, userID := range userIDs {
+		for _, stream := range s.streams[userID] {
+			stream.Broadcast(newPos) // wake up all goroutines Wait()ing on this stream
+		}
+	}
+}
+
+// fetchUserDeviceStream retrieves a stream unique to the given device. If makeIfNotExists is true,
+// a stream will be made at currPos for this device if one doesn't exist and it will be returned.
+// This function does not wait for data to be available on the stream.
+// NB: Callers should have locked the shard before calling this function.
+func (s *userDeviceStreamShard) fetchUserDeviceStream(
+	userID, deviceID string, currPos types.StreamingToken, makeIfNotExists bool,
+) *UserDeviceStream {
+	_, ok := s.streams[userID]
 	if !ok {
 		if !makeIfNotExists {
 			return nil
 		}
-		n.userDeviceStreams[userID] = map[string]*UserDeviceStream{}
+		s.streams[userID] = map[string]*UserDeviceStream{}
 	}
-	stream, ok := n.userDeviceStreams[userID][deviceID]
+	stream, ok := s.streams[userID][deviceID]
 	if !ok {
 		if !makeIfNotExists {
 			return nil
 		}
-		// TODO: Unbounded growth of streams (1 per user)
-		if stream = NewUserDeviceStream(userID, deviceID, n.currPos); stream != nil {
-			n.userDeviceStreams[userID][deviceID] = stream
+		if stream = NewUserDeviceStream(userID, deviceID, currPos); stream != nil {
+			s.streams[userID][deviceID] = stream
 		}
 	}
 	return stream
 }
 
-// fetchUserStreams retrieves all streams for the given user. If makeIfNotExists is true,
-// a stream will be made for this user if one doesn't exist and it will be returned. This
-// function does not wait for data to be available on the stream.
-// NB: Callers should have locked the mutex before calling this function.
-func (n *Notifier) fetchUserStreams(userID string) []*UserDeviceStream {
-	user, ok := n.userDeviceStreams[userID]
-	if !ok {
-		return []*UserDeviceStream{}
-	}
-	streams := []*UserDeviceStream{}
-	for _, stream := range user {
-		streams = append(streams, stream)
-	}
-	return streams
-}
-
 // Not thread-safe: must be called on the OnNewEvent goroutine only
 func (n *Notifier) addJoinedUser(roomID, userID string) {
 	if _, ok := n.roomIDToJoinedUsers[roomID]; !ok {
@@ -274,31 +453,81 @@ func (n *Notifier) joinedUsers(roomID string) (userIDs []string) {
 	return n.roomIDToJoinedUsers[roomID].values()
 }
 
-// removeEmptyUserStreams iterates through the user stream map and removes any
+// unmutedUsers returns the given users, apart from those who have muted the room.
+// Not thread-safe: must be called on the OnNewEvent goroutine only
+func (n *Notifier) unmutedUsers(roomID string, userIDs []string) []string {
+	var unmuted []string
+	for _, userID := range userIDs {
+		if !n.userIDToMutedRooms[userID][roomID] {
+			unmuted = append(unmuted, userID)
+		}
+	}
+	return unmuted
+}
+
+// Not thread-safe: must be called on the OnNewEvent goroutine only
+func (n *Notifier) addPeekingDevice(roomID, userID, deviceID string) {
+	if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
+		n.roomIDToPeekingDevices[roomID] = make(peekingDeviceSet)
+	}
+	n.roomIDToPeekingDevices[roomID].add(types.PeekingDevice{UserID: userID, DeviceID: deviceID})
+}
+
+// Not thread-safe: must be called on the OnNewEvent goroutine only
+func (n *Notifier) removePeekingDevice(roomID, userID, deviceID string) {
+	if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
+		return
+	}
+	n.roomIDToPeekingDevices[roomID].remove(types.PeekingDevice{UserID: userID, DeviceID: deviceID})
+}
+
+// Not thread-safe: must be called on the OnNewEvent goroutine only
+func (n *Notifier) removePeekingUser(roomID, userID string) {
+	for peekingDevice := range n.roomIDToPeekingDevices[roomID] {
+		if peekingDevice.UserID == userID {
+			n.roomIDToPeekingDevices[roomID].remove(peekingDevice)
+		}
+	}
+}
+
+// Not thread-safe: must be called on the OnNewEvent goroutine only
+func (n *Notifier) removePeekingDevices(roomID string) {
+	delete(n.roomIDToPeekingDevices, roomID)
+}
+
+// Not thread-safe: must be called on the OnNewEvent goroutine only
+func (n *Notifier) peekingDevices(roomID string) (peekingDevices []types.PeekingDevice) {
+	if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
+		return
+	}
+	return n.roomIDToPeekingDevices[roomID].values()
+}
+
+// removeEmptyUserStreams iterates through the streams in the shard and removes any
 // that have been empty for a certain amount of time. This is a crude way of
-// ensuring that the userStreams map doesn't grow forver.
-// This should be called when the notifier gets called for whatever reason,
+// ensuring that the streams map doesn't grow forver.
+// This should be called when the shard gets used for whatever reason,
 // the function itself is responsible for ensuring it doesn't iterate too
 // often.
-// NB: Callers should have locked the mutex before calling this function.
-func (n *Notifier) removeEmptyUserStreams() {
+// NB: Callers should have locked the shard before calling this function.
+func (s *userDeviceStreamShard) removeEmptyUserStreams() {
 	// Only clean up  now and again
 	now := time.Now()
-	if n.lastCleanUpTime.Add(time.Minute).After(now) {
+	if s.lastCleanUpTime.Add(time.Minute).After(now) {
 		return
 	}
-	n.lastCleanUpTime = now
+	s.lastCleanUpTime = now
 
 	deleteBefore := now.Add(-5 * time.Minute)
-	for user, byUser := range n.userDeviceStreams {
+	for user, byUser := range s.streams {
 		for device, stream := range byUser {
 			if stream.TimeOfLastNonEmpty().Before(deleteBefore) {
-				delete(n.userDeviceStreams[user], device)
-			}
-			if len(n.userDeviceStreams[user]) == 0 {
-				delete(n.userDeviceStreams, user)
+				delete(s.streams[user], device)
 			}
 		}
+		if len(s.streams[user]) == 0 {
+			delete(s.streams, user)
+		}
 	}
 }
 
@@ -319,3 +548,21 @@ func (s userIDSet) values() (vals []string) {
 	}
 	return
 }
+
+// A set of peeking devices, mainly existing for improving clarity of structs in this file.
+type peekingDeviceSet map[types.PeekingDevice]bool
+
+func (s peekingDeviceSet) add(d types.PeekingDevice) {
+	s[d] = true
+}
+
+func (s peekingDeviceSet) remove(d types.PeekingDevice) {
+	delete(s, d)
+}
+
+func (s peekingDeviceSet) values() (vals []types.PeekingDevice) {
+	for d := range s {
+		vals = append(vals, d)
+	}
+	return
+}
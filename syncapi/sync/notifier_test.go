@@ -32,11 +32,11 @@ var (
 	randomMessageEvent  gomatrixserverlib.HeaderedEvent
 	aliceInviteBobEvent gomatrixserverlib.HeaderedEvent
 	bobLeaveEvent       gomatrixserverlib.HeaderedEvent
-	syncPositionVeryOld = types.NewStreamToken(5, 0)
-	syncPositionBefore  = types.NewStreamToken(11, 0)
-	syncPositionAfter   = types.NewStreamToken(12, 0)
-	syncPositionNewEDU  = types.NewStreamToken(syncPositionAfter.PDUPosition(), 1)
-	syncPositionAfter2  = types.NewStreamToken(13, 0)
+	syncPositionVeryOld = types.StreamingToken{PDUPosition: 5}
+	syncPositionBefore  = types.StreamingToken{PDUPosition: 11}
+	syncPositionAfter   = types.StreamingToken{PDUPosition: 12}
+	syncPositionNewEDU  = types.StreamingToken{PDUPosition: syncPositionAfter.PDUPosition, TypingPosition: 1}
+	syncPositionAfter2  = types.StreamingToken{PDUPosition: 13}
 )
 
 var (
@@ -230,6 +230,40 @@ func TestEDUWakeup(t *testing.T) {
 	wg.Wait()
 }
 
+// Test that typing notifications don't wake up users who have muted the room,
+// but that new events in the room still do.
+func TestMutedRoomEDUWakeup(t *testing.T) {
+	n := NewNotifier(syncPositionAfter)
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: {alice, bob},
+	})
+	n.SetMutedRooms(bob, []string{roomID})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionAfter))
+		if err != nil {
+			t.Errorf("TestMutedRoomEDUWakeup error: %s", err)
+		}
+		// Bob's stream is only woken by the new event, which carries the
+		// typing position along with it.
+		mustEqualPositions(t, pos, types.StreamingToken{PDUPosition: 13, TypingPosition: 1})
+		wg.Done()
+	}()
+
+	stream := lockedFetchUserStream(n, bob, bobDev)
+	waitForBlocking(stream, 1)
+
+	n.OnNewEvent(nil, roomID, nil, syncPositionNewEDU)
+	if got := stream.NumWaiting(); got != 1 {
+		t.Fatalf("expected bob to still be waiting after a typing notification, got %d waiting", got)
+	}
+	n.OnNewEvent(&aliceInviteBobEvent, "", nil, types.StreamingToken{PDUPosition: 13})
+
+	wg.Wait()
+}
+
 // Test that all blocked requests get woken up on a new event.
 func TestMultipleRequestWakeup(t *testing.T) {
 	n := NewNotifier(syncPositionBefore)
@@ -264,6 +298,48 @@ func TestMultipleRequestWakeup(t *testing.T) {
 	}
 }
 
+// Test that a room event wakes up members in every shard, but not users in the
+// same shards who aren't in the room.
+func TestNewEventWakesMembersAcrossShards(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	var members, others []*UserDeviceStream
+	var memberIDs []string
+	for i := 0; i < notifierShardCount*2; i++ {
+		userID := fmt.Sprintf("@user%d:localhost", i)
+		stream := lockedFetchUserStream(n, userID, "device")
+		if i%2 == 0 {
+			memberIDs = append(memberIDs, userID)
+			members = append(members, stream)
+		} else {
+			others = append(others, stream)
+		}
+	}
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: memberIDs,
+	})
+
+	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter)
+
+	for _, stream := range members {
+		listener := stream.GetListener(context.TODO())
+		select {
+		case <-listener.GetNotifyChannel(syncPositionBefore):
+		default:
+			t.Errorf("expected %s to be woken up", stream.UserID)
+		}
+		listener.Close()
+	}
+	for _, stream := range others {
+		listener := stream.GetListener(context.TODO())
+		select {
+		case <-listener.GetNotifyChannel(syncPositionBefore):
+			t.Errorf("expected %s not to be woken up", stream.UserID)
+		default:
+		}
+		listener.Close()
+	}
+}
+
 // Test that you stop getting woken up when you leave a room.
 func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	// listen as bob. Make bob leave room. Make alice send event to room.
@@ -345,12 +421,9 @@ func waitForBlocking(s *UserDeviceStream, numBlocking uint) {
 	}
 }
 
-// lockedFetchUserStream invokes Notifier.fetchUserStream, respecting Notifier.streamLock.
-// A new stream is made if it doesn't exist already.
+// lockedFetchUserStream invokes Notifier.fetchUserDeviceStream, which respects the
+// lock of the shard the stream belongs to. A new stream is made if it doesn't exist already.
 func lockedFetchUserStream(n *Notifier, userID, deviceID string) *UserDeviceStream {
-	n.streamLock.Lock()
-	defer n.streamLock.Unlock()
-
 	return n.fetchUserDeviceStream(userID, deviceID, true)
 }
 
@@ -34,7 +34,8 @@ const DefaultTimelineLimit = 20
 
 type filter struct {
 	Room struct {
-		Timeline struct {
+		IncludeLeave bool `json:"include_leave"`
+		Timeline     struct {
 			Limit *int `json:"limit"`
 		} `json:"timeline"`
 	} `json:"room"`
@@ -48,6 +49,7 @@ type syncRequest struct {
 	timeout       time.Duration
 	since         *types.StreamingToken // nil means that no since token was supplied
 	wantFullState bool
+	includeLeave  bool
 	log           *log.Entry
 }
 
@@ -64,11 +66,8 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		}
 		since = &tok
 	}
-	if since == nil {
-		tok := types.NewStreamToken(0, 0)
-		since = &tok
-	}
 	timelineLimit := DefaultTimelineLimit
+	includeLeave := false
 	// TODO: read from stored filters too
 	filterQuery := req.URL.Query().Get("filter")
 	if filterQuery != "" {
@@ -76,8 +75,11 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			// attempt to parse the timeline limit at least
 			var f filter
 			err := json.Unmarshal([]byte(filterQuery), &f)
-			if err == nil && f.Room.Timeline.Limit != nil {
-				timelineLimit = *f.Room.Timeline.Limit
+			if err == nil {
+				if f.Room.Timeline.Limit != nil {
+					timelineLimit = *f.Room.Timeline.Limit
+				}
+				includeLeave = f.Room.IncludeLeave
 			}
 		} else {
 			// attempt to load the filter ID
@@ -89,6 +91,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			f, err := syncDB.GetFilter(req.Context(), localpart, filterQuery)
 			if err == nil {
 				timelineLimit = f.Room.Timeline.Limit
+				includeLeave = f.Room.IncludeLeave
 			}
 		}
 	}
@@ -99,6 +102,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		timeout:       timeout,
 		since:         since,
 		wantFullState: wantFullState,
+		includeLeave:  includeLeave,
 		limit:         timelineLimit,
 		log:           util.GetLogger(req.Context()),
 	}, nil
@@ -0,0 +1,48 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestNewSyncRequestWithoutSince(t *testing.T) {
+	device := userapi.Device{UserID: "@alice:localhost", ID: "device"}
+	filter := url.QueryEscape(`{"room":{"include_leave":true}}`)
+	req := httptest.NewRequest("GET", "/sync?filter="+filter, nil)
+	syncReq, err := newSyncRequest(req, device, nil)
+	if err != nil {
+		t.Fatalf("newSyncRequest failed: %s", err)
+	}
+	if syncReq.since != nil {
+		t.Fatalf("got since %v without a since parameter, want nil so a complete sync is done", syncReq.since)
+	}
+	if !syncReq.includeLeave {
+		t.Fatalf("include_leave from the filter was not honoured")
+	}
+
+	req = httptest.NewRequest("GET", "/sync?since=s1_0_0_0_0_0", nil)
+	syncReq, err = newSyncRequest(req, device, nil)
+	if err != nil {
+		t.Fatalf("newSyncRequest failed: %s", err)
+	}
+	if syncReq.since == nil {
+		t.Fatalf("got no since token, want the one given")
+	}
+}
@@ -18,16 +18,23 @@ package sync
 
 import (
 	"context"
+	"encoding/json"
+	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // RequestPool manages HTTP long-poll connections for /sync
@@ -35,11 +42,59 @@ type RequestPool struct {
 	db       storage.Database
 	userAPI  userapi.UserInternalAPI
 	notifier *Notifier
+	limits   config.SyncLimits
+	// The number of long-polling requests each user has waiting.
+	longPollsMutex sync.Mutex
+	longPolls      map[string]int
 }
 
 // NewRequestPool makes a new RequestPool
-func NewRequestPool(db storage.Database, n *Notifier, userAPI userapi.UserInternalAPI) *RequestPool {
-	return &RequestPool{db, userAPI, n}
+func NewRequestPool(db storage.Database, n *Notifier, userAPI userapi.UserInternalAPI, limits config.SyncLimits) *RequestPool {
+	return &RequestPool{
+		db:        db,
+		userAPI:   userAPI,
+		notifier:  n,
+		limits:    limits,
+		longPolls: make(map[string]int),
+	}
+}
+
+// startLongPoll records that the user has another request waiting for new
+// data. It returns false, and doesn't record anything, if the user already
+// has as many waiting as they are allowed.
+func (rp *RequestPool) startLongPoll(userID string) bool {
+	rp.longPollsMutex.Lock()
+	defer rp.longPollsMutex.Unlock()
+	if limit := rp.limits.MaxConcurrentRequestsPerUser; limit >= 0 && rp.longPolls[userID] >= limit {
+		return false
+	}
+	rp.longPolls[userID]++
+	return true
+}
+
+// finishLongPoll records that one of the user's waiting requests has returned.
+func (rp *RequestPool) finishLongPoll(userID string) {
+	rp.longPollsMutex.Lock()
+	defer rp.longPollsMutex.Unlock()
+	if rp.longPolls[userID] <= 1 {
+		delete(rp.longPolls, userID)
+	} else {
+		rp.longPolls[userID]--
+	}
+}
+
+// jitterTimeout takes up to the configured jitter off the timeout at random.
+// No more than half of the timeout is ever taken off, so that short timeouts
+// are still honoured roughly.
+func (rp *RequestPool) jitterTimeout(timeout time.Duration) time.Duration {
+	jitter := rp.limits.TimeoutJitter
+	if jitter > timeout/2 {
+		jitter = timeout / 2
+	}
+	if jitter <= 0 {
+		return timeout
+	}
+	return timeout - time.Duration(rand.Int63n(int64(jitter)))
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -58,11 +113,12 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	}
 
 	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
-		"user_id":   device.UserID,
-		"device_id": device.ID,
-		"since":     syncReq.since,
-		"timeout":   syncReq.timeout,
-		"limit":     syncReq.limit,
+		"user_id":    device.UserID,
+		"device_id":  device.ID,
+		"since":      syncReq.since,
+		"timeout":    syncReq.timeout,
+		"limit":      syncReq.limit,
+		"full_state": syncReq.wantFullState,
 	})
 
 	currPos := rp.notifier.CurrentPosition()
@@ -83,7 +139,16 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	// Otherwise, we wait for the notifier to tell us if something *may* have
 	// happened. We loop in case it turns out that nothing did happen.
 
-	timer := time.NewTimer(syncReq.timeout) // case of timeout=0 is handled above
+	if !rp.startLongPoll(device.UserID) {
+		logger.Warn("Refusing sync as the user has too many waiting already")
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many concurrent /sync requests", syncReq.timeout.Milliseconds()),
+		}
+	}
+	defer rp.finishLongPoll(device.UserID)
+
+	timer := time.NewTimer(rp.jitterTimeout(syncReq.timeout)) // case of timeout=0 is handled above
 	defer timer.Stop()
 
 	userStreamListener := rp.notifier.GetListener(*syncReq)
@@ -95,7 +160,10 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	// respond with, so we skip the return an go back to waiting for content to
 	// be sent down or the request timing out.
 	var hasTimedOut bool
-	sincePos := *syncReq.since
+	var sincePos types.StreamingToken
+	if syncReq.since != nil {
+		sincePos = *syncReq.since
+	}
 	for {
 		select {
 		// Wait for notifier to wake us up
@@ -138,7 +206,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.StreamingToken) (res *types.Response, err error) {
 	res = types.NewResponse()
 
-	since := types.NewStreamToken(0, 0)
+	since := types.StreamingToken{}
 	if req.since != nil {
 		since = *req.since
 	}
@@ -149,9 +217,18 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 		return nil, err
 	}
 
-	// TODO: handle ignored users
-	if req.since == nil {
-		res, err = rp.db.CompleteSync(req.ctx, res, req.device, req.limit)
+	fullSync := req.since == nil
+	if !fullSync {
+		// If events which the client hasn't seen yet have been purged from
+		// one of its rooms then we can't work out what changed, so the client
+		// gets everything again.
+		if fullSync, err = rp.joinedRoomPurgedSince(req.ctx, req.device.UserID, req.since.PDUPosition); err != nil {
+			return nil, err
+		}
+	}
+
+	if fullSync {
+		res, err = rp.db.CompleteSync(req.ctx, res, req.device, req.limit, req.includeLeave)
 	} else {
 		res, err = rp.db.IncrementalSync(req.ctx, res, req.device, *req.since, latestPos, req.limit, req.wantFullState)
 	}
@@ -159,12 +236,28 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 		return
 	}
 
+	ignoredUsers, err := rp.ignoredUsersForUser(req.ctx, req.device.UserID)
+	if err != nil {
+		return
+	}
+	if len(ignoredUsers.List) > 0 {
+		filterIgnoredUsersFromResponse(req.device.UserID, ignoredUsers, res)
+	}
+
 	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
-	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition(), &accountDataFilter)
+	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.AccountDataPosition, &accountDataFilter)
 	if err != nil {
 		return
 	}
 
+	// The push rules come down with the account data whenever they change, so
+	// the rooms which the user has muted are kept up to date from them. This
+	// stops typing notifications in those rooms from waking the user's syncs.
+	if err = rp.expandPushRules(req.device.UserID, res.AccountData.Events); err != nil {
+		util.GetLogger(req.ctx).WithError(err).Warn("rp.expandPushRules failed")
+		err = nil
+	}
+
 	// Before we return the sync response, make sure that we take action on
 	// any send-to-device database updates or deletions that we need to do.
 	// Then add the updates into the sync response.
@@ -175,21 +268,122 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 			return
 		}
 	}
-	if len(events) > 0 {
-		// Add the updates into the sync response.
-		for _, event := range events {
-			res.ToDevice.Events = append(res.ToDevice.Events, event.SendToDeviceEvent)
+	// Add the updates into the sync response.
+	for _, event := range events {
+		res.ToDevice.Events = append(res.ToDevice.Events, event.SendToDeviceEvent)
+	}
+
+	return
+}
+
+// joinedRoomPurgedSince returns whether events have been purged from any of
+// the user's joined rooms after the given stream position.
+func (rp *RequestPool) joinedRoomPurgedSince(ctx context.Context, userID string, since types.StreamPosition) (bool, error) {
+	purgedRoomIDs, err := rp.db.RoomsPurgedSince(ctx, since)
+	if err != nil || len(purgedRoomIDs) == 0 {
+		return false, err
+	}
+	joinedRoomIDs, err := rp.db.RoomIDsWithMembership(ctx, userID, gomatrixserverlib.Join)
+	if err != nil {
+		return false, err
+	}
+	joined := make(map[string]bool, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		joined[roomID] = true
+	}
+	for _, roomID := range purgedRoomIDs {
+		if joined[roomID] {
+			return true, nil
 		}
+	}
+	return false, nil
+}
 
-		// Get the next_batch from the sync response and increase the
-		// EDU counter.
-		if pos, perr := types.NewStreamTokenFromString(res.NextBatch); perr == nil {
-			pos.Positions[1]++
-			res.NextBatch = pos.String()
+// ignoredUsersForUser returns the contents of the m.ignored_user_list account
+// data for the given user, or an empty list if the user hasn't set one.
+func (rp *RequestPool) ignoredUsersForUser(ctx context.Context, userID string) (*eventutil.IgnoredUsers, error) {
+	dataReq := userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: "m.ignored_user_list",
+	}
+	dataRes := userapi.QueryAccountDataResponse{}
+	if err := rp.userAPI.QueryAccountData(ctx, &dataReq, &dataRes); err != nil {
+		return nil, err
+	}
+	ignoredUsers := &eventutil.IgnoredUsers{}
+	data, ok := dataRes.GlobalAccountData["m.ignored_user_list"]
+	if !ok {
+		return ignoredUsers, nil
+	}
+	if err := json.Unmarshal(data, ignoredUsers); err != nil {
+		return nil, err
+	}
+	return ignoredUsers, nil
+}
+
+// expandPushRules replaces the m.push_rules among the global account data
+// being sent to the given user, which only hold the changes they have made,
+// with their complete push rules, and tells the notifier which rooms they
+// have muted.
+func (rp *RequestPool) expandPushRules(userID string, accountData []gomatrixserverlib.ClientEvent) error {
+	for i, ev := range accountData {
+		if ev.Type != "m.push_rules" {
+			continue
+		}
+		localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return err
+		}
+		ruleSets, err := pushrules.AccountRuleSetsFromAccountData(json.RawMessage(ev.Content), localpart, domain)
+		if err != nil {
+			return err
+		}
+		content, err := json.Marshal(ruleSets)
+		if err != nil {
+			return err
 		}
+		accountData[i].Content = content
+		rp.notifier.SetMutedRooms(userID, ruleSets.Global.MutedRooms())
+		return nil
 	}
+	return nil
+}
 
-	return
+// filterIgnoredUsersFromResponse removes timeline events sent by ignored users
+// and invites from ignored users from the sync response. State events are kept
+// so that the client still has an accurate view of the room state.
+func filterIgnoredUsersFromResponse(userID string, ignoredUsers *eventutil.IgnoredUsers, res *types.Response) {
+	filterTimeline := func(events []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+		filtered := events[:0]
+		for _, ev := range events {
+			if ev.StateKey == nil && ignoredUsers.IsIgnored(ev.Sender) {
+				continue
+			}
+			filtered = append(filtered, ev)
+		}
+		return filtered
+	}
+	for roomID, jr := range res.Rooms.Join {
+		jr.Timeline.Events = filterTimeline(jr.Timeline.Events)
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		lr.Timeline.Events = filterTimeline(lr.Timeline.Events)
+		res.Rooms.Leave[roomID] = lr
+	}
+	for roomID, ir := range res.Rooms.Invite {
+		// The invite room state contains the invite event itself, which
+		// tells us who sent the invite.
+		for _, ev := range gjson.ParseBytes(ir.InviteState.Events).Array() {
+			if ev.Get("type").Str != gomatrixserverlib.MRoomMember || ev.Get("state_key").Str != userID {
+				continue
+			}
+			if ignoredUsers.IsIgnored(ev.Get("sender").Str) {
+				delete(res.Rooms.Invite, roomID)
+			}
+			break
+		}
+	}
 }
 
 // nolint:gocyclo
@@ -197,11 +391,6 @@ func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
 	accountDataFilter *gomatrixserverlib.EventFilter,
 ) (*types.Response, error) {
-	// TODO: Account data doesn't have a sync position of its own, meaning that
-	// account data might be sent multiple time to the client if multiple account
-	// data keys were set between two message. This isn't a huge issue since the
-	// duplicate data doesn't represent a huge quantity of data, but an optimisation
-	// here would be making sure each data is sent only once to the client.
 	if req.since == nil {
 		// If this is the initial sync, we don't need to check if a data has
 		// already been sent. Instead, we send the whole batch.
@@ -237,15 +426,9 @@ func (rp *RequestPool) appendAccountData(
 	}
 
 	r := types.Range{
-		From: req.since.PDUPosition(),
+		From: req.since.AccountDataPosition,
 		To:   currentPos,
 	}
-	// If both positions are the same, it means that the data was saved after the
-	// latest room event. In that case, we need to decrement the old position as
-	// results are exclusive of Low.
-	if r.Low() == r.High() {
-		r.From--
-	}
 
 	// Sync is not initial, get all account data since the latest sync
 	dataTypes, err := rp.db.GetAccountDataInRange(
@@ -286,7 +469,10 @@ func (rp *RequestPool) appendAccountData(
 				}
 			} else {
 				if roomData, ok := dataRes.RoomAccountData[roomID][dataType]; ok {
-					joinData := data.Rooms.Join[roomID]
+					joinData, ok := data.Rooms.Join[roomID]
+					if !ok {
+						joinData = *types.NewJoinResponse()
+					}
 					joinData.AccountData.Events = append(
 						joinData.AccountData.Events,
 						gomatrixserverlib.ClientEvent{
@@ -0,0 +1,181 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestLongPollLimit(t *testing.T) {
+	rp := NewRequestPool(nil, nil, nil, config.SyncLimits{MaxConcurrentRequestsPerUser: 2})
+	for i := 0; i < 2; i++ {
+		if !rp.startLongPoll(alice) {
+			t.Fatalf("long poll %d was refused, want it allowed", i)
+		}
+	}
+	if rp.startLongPoll(alice) {
+		t.Fatalf("third long poll was allowed, want it refused")
+	}
+	if !rp.startLongPoll(bob) {
+		t.Fatalf("long poll for another user was refused, want it allowed")
+	}
+	rp.finishLongPoll(alice)
+	if !rp.startLongPoll(alice) {
+		t.Fatalf("long poll after one finished was refused, want it allowed")
+	}
+	rp.finishLongPoll(alice)
+	rp.finishLongPoll(alice)
+	rp.finishLongPoll(bob)
+	if len(rp.longPolls) != 0 {
+		t.Fatalf("got %d users with long polls after all finished, want 0", len(rp.longPolls))
+	}
+
+	rp = NewRequestPool(nil, nil, nil, config.SyncLimits{MaxConcurrentRequestsPerUser: -1})
+	for i := 0; i < 100; i++ {
+		if !rp.startLongPoll(alice) {
+			t.Fatalf("long poll %d was refused without a limit", i)
+		}
+	}
+}
+
+func TestJitterTimeout(t *testing.T) {
+	rp := NewRequestPool(nil, nil, nil, config.SyncLimits{TimeoutJitter: 5 * time.Second})
+	for i := 0; i < 100; i++ {
+		if got := rp.jitterTimeout(30 * time.Second); got <= 25*time.Second || got > 30*time.Second {
+			t.Fatalf("got a 30s timeout jittered to %s, want between 25s and 30s", got)
+		}
+		// no more than half of a short timeout is taken off
+		if got := rp.jitterTimeout(time.Second); got <= 500*time.Millisecond || got > time.Second {
+			t.Fatalf("got a 1s timeout jittered to %s, want between 500ms and 1s", got)
+		}
+	}
+
+	rp = NewRequestPool(nil, nil, nil, config.SyncLimits{TimeoutJitter: -1})
+	if got := rp.jitterTimeout(30 * time.Second); got != 30*time.Second {
+		t.Fatalf("got a 30s timeout jittered to %s with jitter disabled", got)
+	}
+}
+
+func TestExpandPushRules(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	rp := NewRequestPool(nil, n, nil, config.SyncLimits{})
+
+	ruleSets := pushrules.DefaultAccountRuleSets("bob", "localhost")
+	if err := ruleSets.Global.SetRoomNotificationMode(roomID, pushrules.RoomNotifyMute); err != nil {
+		t.Fatalf("SetRoomNotificationMode failed: %s", err)
+	}
+	content, err := pushrules.AccountDataFromAccountRuleSets(ruleSets, "bob", "localhost")
+	if err != nil {
+		t.Fatalf("AccountDataFromAccountRuleSets failed: %s", err)
+	}
+
+	// Account data without the push rules in it leaves the muted rooms alone.
+	if err = rp.expandPushRules(bob, []gomatrixserverlib.ClientEvent{
+		{Type: "m.ignored_user_list", Content: gomatrixserverlib.RawJSON(`{"ignored_users":{}}`)},
+	}); err != nil {
+		t.Fatalf("expandPushRules failed: %s", err)
+	}
+	if len(n.userIDToMutedRooms) != 0 {
+		t.Fatalf("got muted rooms %v without any push rules, want none", n.userIDToMutedRooms)
+	}
+
+	accountData := []gomatrixserverlib.ClientEvent{
+		{Type: "m.push_rules", Content: gomatrixserverlib.RawJSON(content)},
+	}
+	if err = rp.expandPushRules(bob, accountData); err != nil {
+		t.Fatalf("expandPushRules failed: %s", err)
+	}
+	if !n.userIDToMutedRooms[bob][roomID] {
+		t.Fatalf("got muted rooms %v, want %s muted for %s", n.userIDToMutedRooms, roomID, bob)
+	}
+
+	// The server-default rules are sent along with the user's own rules.
+	var sent pushrules.AccountRuleSets
+	if err = json.Unmarshal(accountData[0].Content, &sent); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	if len(sent.Global.Override) != len(ruleSets.Global.Override) || len(sent.Global.Underride) == 0 {
+		t.Errorf("got push rules %s sent, want the complete push rules", accountData[0].Content)
+	}
+
+	// Unmuting the room in the push rules unmutes it in the notifier too.
+	if err = ruleSets.Global.SetRoomNotificationMode(roomID, pushrules.RoomNotifyAll); err != nil {
+		t.Fatalf("SetRoomNotificationMode failed: %s", err)
+	}
+	if content, err = pushrules.AccountDataFromAccountRuleSets(ruleSets, "bob", "localhost"); err != nil {
+		t.Fatalf("AccountDataFromAccountRuleSets failed: %s", err)
+	}
+	if err = rp.expandPushRules(bob, []gomatrixserverlib.ClientEvent{
+		{Type: "m.push_rules", Content: gomatrixserverlib.RawJSON(content)},
+	}); err != nil {
+		t.Fatalf("expandPushRules failed: %s", err)
+	}
+	if n.userIDToMutedRooms[bob][roomID] {
+		t.Fatalf("got %s still muted for %s after unmuting it", roomID, bob)
+	}
+}
+
+func TestFilterIgnoredUsersFromResponse(t *testing.T) {
+	const ignored = "@mallory:localhost"
+	ignoredUsers := &eventutil.IgnoredUsers{List: map[string]interface{}{ignored: struct{}{}}}
+	stateKey := ignored
+	res := types.NewResponse()
+	jr := types.NewJoinResponse()
+	jr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+		{EventID: "$fromalice", Sender: alice, Type: "m.room.message"},
+		{EventID: "$frommallory", Sender: ignored, Type: "m.room.message"},
+		// state events are kept so that the room state stays accurate
+		{EventID: "$mallorysname", Sender: ignored, Type: "m.room.member", StateKey: &stateKey},
+	}
+	res.Rooms.Join[roomID] = *jr
+	lr := types.NewLeaveResponse()
+	lr.Timeline.Events = []gomatrixserverlib.ClientEvent{
+		{EventID: "$frommallory", Sender: ignored, Type: "m.room.message"},
+	}
+	res.Rooms.Leave["!left:localhost"] = *lr
+	for inviteRoomID, sender := range map[string]string{"!frommallory:localhost": ignored, "!fromalice:localhost": alice} {
+		var ir types.InviteResponse
+		ir.InviteState.Events = []byte(`[{"type":"m.room.member","state_key":"` + bob + `","sender":"` + sender + `","content":{"membership":"invite"}}]`)
+		res.Rooms.Invite[inviteRoomID] = ir
+	}
+
+	filterIgnoredUsersFromResponse(bob, ignoredUsers, res)
+
+	var got []string
+	for _, ev := range res.Rooms.Join[roomID].Timeline.Events {
+		got = append(got, ev.EventID)
+	}
+	if want := []string{"$fromalice", "$mallorysname"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got joined room timeline %v, want %v", got, want)
+	}
+	if n := len(res.Rooms.Leave["!left:localhost"].Timeline.Events); n != 0 {
+		t.Errorf("got %d events in the left room's timeline, want the ignored user's event dropped", n)
+	}
+	if _, ok := res.Rooms.Invite["!frommallory:localhost"]; ok {
+		t.Errorf("the invite from the ignored user was sent down")
+	}
+	if _, ok := res.Rooms.Invite["!fromalice:localhost"]; !ok {
+		t.Errorf("the invite from another user was dropped")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -41,8 +42,9 @@ func AddPublicRoutes(
 	rsAPI api.RoomserverInternalAPI,
 	federation *gomatrixserverlib.FederationClient,
 	cfg *config.Dendrite,
+	caches *caching.Caches,
 ) {
-	syncDB, err := storage.NewSyncServerDatasource(string(cfg.Database.SyncAPI), cfg.DbProperties())
+	syncDB, err := storage.NewSyncServerDatasource(string(cfg.Database.SyncAPI), string(cfg.Database.ReadReplicas.SyncAPI), cfg.DbProperties())
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to sync db")
 	}
@@ -58,27 +60,29 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start notifier")
 	}
 
-	requestPool := sync.NewRequestPool(syncDB, notifier, userAPI)
+	requestPool := sync.NewRequestPool(syncDB, notifier, userAPI, cfg.Matrix.SyncLimits)
 
 	roomConsumer := consumers.NewOutputRoomEventConsumer(
-		cfg, consumer, notifier, syncDB, rsAPI,
+		cfg, consumer, notifier, syncDB, rsAPI, userAPI, caches,
 	)
 	if err = roomConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start room server consumer")
 	}
 
 	clientConsumer := consumers.NewOutputClientDataConsumer(
-		cfg, consumer, notifier, syncDB,
+		cfg, consumer, notifier, syncDB, caches,
 	)
 	if err = clientConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start client data consumer")
 	}
 
-	typingConsumer := consumers.NewOutputTypingEventConsumer(
-		cfg, consumer, notifier, syncDB,
-	)
-	if err = typingConsumer.Start(); err != nil {
-		logrus.WithError(err).Panicf("failed to start typing consumer")
+	if !cfg.Matrix.DisableTyping {
+		typingConsumer := consumers.NewOutputTypingEventConsumer(
+			cfg, consumer, notifier, syncDB,
+		)
+		if err = typingConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start typing consumer")
+		}
 	}
 
 	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
@@ -88,5 +92,9 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start send-to-device consumer")
 	}
 
-	routing.Setup(router, requestPool, syncDB, userAPI, federation, rsAPI, cfg)
+	if cfg.Matrix.SyncRetention.Enabled() {
+		go runRetention(syncDB, cfg.Matrix.SyncRetention)
+	}
+
+	routing.Setup(router, requestPool, syncDB, notifier, userAPI, federation, rsAPI, cfg)
 }
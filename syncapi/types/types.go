@@ -88,24 +88,51 @@ const (
 	SyncTokenTypeTopology SyncTokenType = "t"
 )
 
+// StreamingToken is the token used by /sync. It holds the position that the
+// client has reached in each of the streams that make up a sync response, so
+// that each stream can advance independently of the others.
 type StreamingToken struct {
-	syncToken
+	// The position in the stream of room events, which also includes invites.
+	PDUPosition StreamPosition
+	// The position in the stream of typing notifications.
+	TypingPosition StreamPosition
+	// The position in the stream of read receipts, which includes the changes
+	// to unread notification counts caused by new events and by receipts.
+	ReceiptPosition StreamPosition
+	// The position in the stream of send-to-device messages.
+	SendToDevicePosition StreamPosition
+	// The position in the stream of device list updates.
+	DeviceListPosition StreamPosition
+	// The position in the stream of account data updates.
+	AccountDataPosition StreamPosition
+}
+
+// positions returns pointers to the positions in the token, in the order
+// that they appear in the string form of the token.
+func (t *StreamingToken) positions() []*StreamPosition {
+	return []*StreamPosition{
+		&t.PDUPosition, &t.TypingPosition, &t.ReceiptPosition,
+		&t.SendToDevicePosition, &t.DeviceListPosition, &t.AccountDataPosition,
+	}
 }
 
-func (t *StreamingToken) PDUPosition() StreamPosition {
-	return t.Positions[0]
-}
-func (t *StreamingToken) EDUPosition() StreamPosition {
-	return t.Positions[1]
-}
 func (t *StreamingToken) String() string {
-	return t.syncToken.String()
+	positions := t.positions()
+	token := syncToken{
+		Type:      SyncTokenTypeStream,
+		Positions: make([]StreamPosition, len(positions)),
+	}
+	for i, pos := range positions {
+		token.Positions[i] = *pos
+	}
+	return token.String()
 }
 
 // IsAfter returns true if ANY position in this token is greater than `other`.
 func (t *StreamingToken) IsAfter(other StreamingToken) bool {
-	for i := range other.Positions {
-		if t.Positions[i] > other.Positions[i] {
+	otherPositions := other.positions()
+	for i, pos := range t.positions() {
+		if *pos > *otherPositions[i] {
 			return true
 		}
 	}
@@ -115,15 +142,13 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 // WithUpdates returns a copy of the StreamingToken with updates applied from another StreamingToken.
 // If the latter StreamingToken contains a field that is not 0, it is considered an update,
 // and its value will replace the corresponding value in the StreamingToken on which WithUpdates is called.
-func (t *StreamingToken) WithUpdates(other StreamingToken) (ret StreamingToken) {
-	ret.Type = t.Type
-	ret.Positions = make([]StreamPosition, len(t.Positions))
-	for i := range t.Positions {
-		ret.Positions[i] = t.Positions[i]
-		if other.Positions[i] == 0 {
-			continue
+func (t *StreamingToken) WithUpdates(other StreamingToken) StreamingToken {
+	ret := *t
+	otherPositions := other.positions()
+	for i, pos := range ret.positions() {
+		if *otherPositions[i] != 0 {
+			*pos = *otherPositions[i]
 		}
-		ret.Positions[i] = other.Positions[i]
 	}
 	return ret
 }
@@ -139,32 +164,18 @@ func (t *TopologyToken) PDUPosition() StreamPosition {
 	return t.Positions[1]
 }
 func (t *TopologyToken) StreamToken() StreamingToken {
-	return NewStreamToken(t.PDUPosition(), 0)
+	return StreamingToken{PDUPosition: t.PDUPosition()}
 }
 func (t *TopologyToken) String() string {
 	return t.syncToken.String()
 }
 
-// Decrement the topology token to one event earlier.
+// Decrement the topology token to one event earlier. Events are ordered by
+// depth and then by stream position, so a token with the same depth and the
+// previous stream position refers to the position just before the event.
 func (t *TopologyToken) Decrement() {
-	depth := t.Positions[0]
-	pduPos := t.Positions[1]
-	if depth-1 <= 0 {
-		// nothing can be lower than this
-		depth = 1
-	} else {
-		// this assumes that we will never have 1000 events all with the same
-		// depth. TODO: work out what the right PDU position is to use, probably needs a db hit.
-		depth--
-		pduPos += 1000
-	}
-	// The lowest token value is 1, therefore we need to manually set it to that
-	// value if we're below it.
-	if depth < 1 {
-		depth = 1
-	}
-	t.Positions = []StreamPosition{
-		depth, pduPos,
+	if t.Positions[1] > 0 {
+		t.Positions[1]--
 	}
 }
 
@@ -232,15 +243,10 @@ func NewTopologyTokenFromString(tok string) (token TopologyToken, err error) {
 	}, nil
 }
 
-// NewStreamToken creates a new sync token for /sync
-func NewStreamToken(pduPos, eduPos StreamPosition) StreamingToken {
-	return StreamingToken{
-		syncToken: syncToken{
-			Type:      SyncTokenTypeStream,
-			Positions: []StreamPosition{pduPos, eduPos},
-		},
-	}
-}
+// NewStreamTokenFromString parses a /sync token. Tokens from before the
+// streams were split out only have a PDU and an EDU position. As every
+// stream other than typing and send-to-device used to share the PDU
+// position, those streams are given the PDU position of the old token.
 func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 	t, err := newSyncTokenFromString(tok)
 	if err != nil {
@@ -250,13 +256,26 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 		err = fmt.Errorf("token %s is not a streaming token", tok)
 		return
 	}
-	if len(t.Positions) < 2 {
-		err = fmt.Errorf("token %s wrong number of values, got %d want at least 2", tok, len(t.Positions))
+	positions := token.positions()
+	switch len(t.Positions) {
+	case 2:
+		pduPos, eduPos := t.Positions[0], t.Positions[1]
+		return StreamingToken{
+			PDUPosition:          pduPos,
+			TypingPosition:       eduPos,
+			ReceiptPosition:      pduPos,
+			SendToDevicePosition: eduPos,
+			AccountDataPosition:  pduPos,
+		}, nil
+	case len(positions):
+		for i, pos := range positions {
+			*pos = t.Positions[i]
+		}
+		return token, nil
+	default:
+		err = fmt.Errorf("token %s wrong number of values, got %d want %d", tok, len(t.Positions), len(positions))
 		return
 	}
-	return StreamingToken{
-		syncToken: *t,
-	}, nil
 }
 
 // syncToken represents a syncapi token, used for interactions with
@@ -296,7 +315,9 @@ type Response struct {
 	} `json:"presence,omitempty"`
 	Rooms struct {
 		Join   map[string]JoinResponse   `json:"join"`
+		Peek   map[string]JoinResponse   `json:"peek"`
 		Invite map[string]InviteResponse `json:"invite"`
+		Knock  map[string]KnockResponse  `json:"knock"`
 		Leave  map[string]LeaveResponse  `json:"leave"`
 	} `json:"rooms"`
 	ToDevice struct {
@@ -310,7 +331,9 @@ func NewResponse() *Response {
 	// Pre-initialise the maps. Synapse will return {} even if there are no rooms under a specific section,
 	// so let's do the same thing. Bonus: this means we can't get dreaded 'assignment to entry in nil map' errors.
 	res.Rooms.Join = make(map[string]JoinResponse)
+	res.Rooms.Peek = make(map[string]JoinResponse)
 	res.Rooms.Invite = make(map[string]InviteResponse)
+	res.Rooms.Knock = make(map[string]KnockResponse)
 	res.Rooms.Leave = make(map[string]LeaveResponse)
 
 	// Also pre-intialise empty slices or else we'll insert 'null' instead of '[]' for the value.
@@ -328,7 +351,9 @@ func NewResponse() *Response {
 // to return the response immediately to the client or to wait for more data.
 func (r *Response) IsEmpty() bool {
 	return len(r.Rooms.Join) == 0 &&
+		len(r.Rooms.Peek) == 0 &&
 		len(r.Rooms.Invite) == 0 &&
+		len(r.Rooms.Knock) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
 		len(r.AccountData.Events) == 0 &&
 		len(r.Presence.Events) == 0 &&
@@ -337,6 +362,11 @@ func (r *Response) IsEmpty() bool {
 
 // JoinResponse represents a /sync response for a room which is under the 'join' key.
 type JoinResponse struct {
+	Summary struct {
+		Heroes             []string `json:"m.heroes,omitempty"`
+		JoinedMemberCount  int      `json:"m.joined_member_count"`
+		InvitedMemberCount int      `json:"m.invited_member_count"`
+	} `json:"summary"`
 	State struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"state"`
@@ -351,6 +381,10 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications struct {
+		HighlightCount    int `json:"highlight_count"`
+		NotificationCount int `json:"notification_count"`
+	} `json:"unread_notifications"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -380,6 +414,23 @@ func NewInviteResponse(event gomatrixserverlib.HeaderedEvent) *InviteResponse {
 	return &res
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type KnockResponse struct {
+	KnockState struct {
+		Events json.RawMessage `json:"events"`
+	} `json:"knock_state"`
+}
+
+// NewKnockResponse creates an empty response with initialised arrays.
+func NewKnockResponse(event gomatrixserverlib.HeaderedEvent) *KnockResponse {
+	res := KnockResponse{}
+	res.KnockState.Events = json.RawMessage{'[', ']'}
+	if knockRoomState := gjson.GetBytes(event.Unsigned(), "knock_room_state"); knockRoomState.Exists() {
+		res.KnockState.Events = json.RawMessage(knockRoomState.Raw)
+	}
+	return &res
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type LeaveResponse struct {
 	State struct {
@@ -409,3 +460,92 @@ type SendToDeviceEvent struct {
 	DeviceID    string
 	SentByToken *StreamingToken
 }
+
+// NotificationData contains the unread notification counts for a user in a
+// room, along with the stream position at which they last changed.
+type NotificationData struct {
+	StreamPosition    StreamPosition
+	NotificationCount int
+	HighlightCount    int
+}
+
+// SearchResult is a single event matching a /search request.
+type SearchResult struct {
+	EventID        string
+	RoomID         string
+	StreamPosition StreamPosition
+	Rank           float64
+}
+
+// Peek is a device peeking into a room, as seen from a given sync range.
+type Peek struct {
+	RoomID string
+	// New is true if the peek started within the sync range, in which case
+	// the full room state needs to be sent down.
+	New bool
+	// Deleted is true if the peek stopped within the sync range.
+	Deleted bool
+}
+
+// PeekingDevice is a device that is peeking into a room.
+type PeekingDevice struct {
+	UserID   string
+	DeviceID string
+}
+
+// Relation is an event which relates to another event through its
+// m.relates_to content, as described in MSC2675.
+type Relation struct {
+	EventID        string
+	RelatesToID    string
+	RelType        string
+	EventType      string
+	Sender         string
+	StreamPosition StreamPosition
+}
+
+// AnnotationCount is the number of annotations of an event sharing the same
+// event type and key, e.g. the number of times a message was reacted to with
+// a given emoji.
+type AnnotationCount struct {
+	RelatesToID string
+	Type        string
+	Key         string
+	Count       int
+}
+
+// RelationAggregations are the aggregations of the relations of an event
+// which are bundled into the m.relations key of its unsigned data.
+type RelationAggregations struct {
+	Annotation *AnnotationChunk `json:"m.annotation,omitempty"`
+	Reference  *ReferenceChunk  `json:"m.reference,omitempty"`
+	// Replace is the most recent edit of the event, bundled in full so that
+	// clients can show the edited content straight away.
+	Replace *gomatrixserverlib.ClientEvent `json:"m.replace,omitempty"`
+}
+
+// AnnotationChunk is the bundled aggregation of the m.annotation relations of an event.
+type AnnotationChunk struct {
+	Chunk   []AnnotationAggregation `json:"chunk"`
+	Limited bool                    `json:"limited"`
+	Count   int                     `json:"count"`
+}
+
+// AnnotationAggregation counts the annotations of an event with the same event type and key.
+type AnnotationAggregation struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// ReferenceChunk is the bundled aggregation of the m.reference relations of an event.
+type ReferenceChunk struct {
+	Chunk   []ReferenceAggregation `json:"chunk"`
+	Limited bool                   `json:"limited"`
+	Count   int                    `json:"count"`
+}
+
+// ReferenceAggregation is a single event which references another event.
+type ReferenceAggregation struct {
+	EventID string `json:"event_id"`
+}
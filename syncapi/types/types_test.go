@@ -4,9 +4,10 @@ import "testing"
 
 func TestNewSyncTokenFromString(t *testing.T) {
 	shouldPass := map[string]syncToken{
-		"s4_0": NewStreamToken(4, 0).syncToken,
-		"s3_1": NewStreamToken(3, 1).syncToken,
-		"t3_1": NewTopologyToken(3, 1).syncToken,
+		"s4_0":         {Type: SyncTokenTypeStream, Positions: []StreamPosition{4, 0}},
+		"s3_1":         {Type: SyncTokenTypeStream, Positions: []StreamPosition{3, 1}},
+		"s3_1_4_1_5_9": {Type: SyncTokenTypeStream, Positions: []StreamPosition{3, 1, 4, 1, 5, 9}},
+		"t3_1":         NewTopologyToken(3, 1).syncToken,
 	}
 
 	shouldFail := []string{
@@ -36,3 +37,67 @@ func TestNewSyncTokenFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestNewStreamTokenFromString(t *testing.T) {
+	shouldPass := map[string]StreamingToken{
+		"s3_1_4_1_5_9": {
+			PDUPosition:          3,
+			TypingPosition:       1,
+			ReceiptPosition:      4,
+			SendToDevicePosition: 1,
+			DeviceListPosition:   5,
+			AccountDataPosition:  9,
+		},
+		// tokens from before the streams were split out
+		"s7_2": {
+			PDUPosition:          7,
+			TypingPosition:       2,
+			ReceiptPosition:      7,
+			SendToDevicePosition: 2,
+			AccountDataPosition:  7,
+		},
+	}
+
+	shouldFail := []string{
+		"s4",
+		"s1_2_3",
+		"s1_2_3_4_5_6_7",
+		"t3_1",
+	}
+
+	for test, expected := range shouldPass {
+		result, err := NewStreamTokenFromString(test)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if result != expected {
+			t.Errorf("%s expected %+v but got %+v", test, expected, result)
+		}
+		roundTrip, err := NewStreamTokenFromString(result.String())
+		if err != nil || roundTrip != result {
+			t.Errorf("%s did not survive a round trip through %s", test, result.String())
+		}
+	}
+
+	for _, test := range shouldFail {
+		if _, err := NewStreamTokenFromString(test); err == nil {
+			t.Errorf("input '%v' should have errored but didn't", test)
+		}
+	}
+}
+
+func TestStreamingTokenWithUpdates(t *testing.T) {
+	current := StreamingToken{PDUPosition: 5, TypingPosition: 3, AccountDataPosition: 4}
+	updated := current.WithUpdates(StreamingToken{TypingPosition: 6, SendToDevicePosition: 1})
+	expected := StreamingToken{PDUPosition: 5, TypingPosition: 6, SendToDevicePosition: 1, AccountDataPosition: 4}
+	if updated != expected {
+		t.Errorf("WithUpdates expected %+v but got %+v", expected, updated)
+	}
+	if !updated.IsAfter(current) {
+		t.Errorf("expected %+v to be after %+v", updated, current)
+	}
+	if current.IsAfter(updated) {
+		t.Errorf("expected %+v not to be after %+v", current, updated)
+	}
+}
@@ -26,10 +26,36 @@ type UserInternalAPI interface {
 	InputAccountData(ctx context.Context, req *InputAccountDataRequest, res *InputAccountDataResponse) error
 	PerformAccountCreation(ctx context.Context, req *PerformAccountCreationRequest, res *PerformAccountCreationResponse) error
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
+	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
+	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
+	PerformPasswordUpdate(ctx context.Context, req *PerformPasswordUpdateRequest, res *PerformPasswordUpdateResponse) error
+	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
 	QueryProfile(ctx context.Context, req *QueryProfileRequest, res *QueryProfileResponse) error
 	QueryAccessToken(ctx context.Context, req *QueryAccessTokenRequest, res *QueryAccessTokenResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
+	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *PerformPusherSetResponse) error
+	PerformPusherDeletion(ctx context.Context, req *PerformPusherDeletionRequest, res *PerformPusherDeletionResponse) error
+	// PerformRoomAccountDataDeletion deletes every local user's account data for a room which has been purged.
+	PerformRoomAccountDataDeletion(ctx context.Context, req *PerformRoomAccountDataDeletionRequest, res *PerformRoomAccountDataDeletionResponse) error
+	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
+	PerformOpenIDTokenCreation(ctx context.Context, req *PerformOpenIDTokenCreationRequest, res *PerformOpenIDTokenCreationResponse) error
+	QueryOpenIDToken(ctx context.Context, req *QueryOpenIDTokenRequest, res *QueryOpenIDTokenResponse) error
+	// Issue a short-lived token which can be used once to log in as a user with m.login.token.
+	// This is only for other components, e.g. SSO logins in the client API, and isn't
+	// exposed as an admin API: anything which can reach the internal API can log in as
+	// any user with it.
+	PerformLoginTokenCreation(ctx context.Context, req *PerformLoginTokenCreationRequest, res *PerformLoginTokenCreationResponse) error
+	// Exchange a login token for the user who it was issued to. The token can't be used again.
+	PerformLoginTokenClaim(ctx context.Context, req *PerformLoginTokenClaimRequest, res *PerformLoginTokenClaimResponse) error
+	// Create, update or deactivate accounts managed by an external directory, for server administrators.
+	PerformUserProvisioning(ctx context.Context, req *PerformUserProvisioningRequest, res *PerformUserProvisioningResponse) error
+	// Query the accounts managed by an external directory, for server administrators.
+	QueryProvisionedUsers(ctx context.Context, req *QueryProvisionedUsersRequest, res *QueryProvisionedUsersResponse) error
+	// Make a user a server administrator, or stop them from being one.
+	PerformAdminUpdate(ctx context.Context, req *PerformAdminUpdateRequest, res *PerformAdminUpdateResponse) error
+	// Query all of the accounts on this server, for server administrators.
+	QueryAccounts(ctx context.Context, req *QueryAccountsRequest, res *QueryAccountsResponse) error
 }
 
 // InputAccountDataRequest is the request for InputAccountData
@@ -38,10 +64,18 @@ type InputAccountDataRequest struct {
 	RoomID      string          // optional: the room to associate the account data with
 	DataType    string          // required: the data type of the data
 	AccountData json.RawMessage // required: the message content
+	// optional: only save the account data if it is still PrevAccountData, which
+	// is nil if there wasn't any, so that it can be changed without losing
+	// changes made at the same time
+	IfUnchanged     bool
+	PrevAccountData json.RawMessage
 }
 
 // InputAccountDataResponse is the response for InputAccountData
 type InputAccountDataResponse struct {
+	// Set if IfUnchanged was given and the account data had been changed, in which
+	// case nothing was saved.
+	Changed bool
 }
 
 // QueryAccessTokenRequest is the request for QueryAccessToken
@@ -56,6 +90,9 @@ type QueryAccessTokenRequest struct {
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    error // e.g ErrorForbidden
+	// Whether the access token belongs to a device but has expired, in which
+	// case Device is nil and the client should refresh it.
+	Expired bool
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -106,6 +143,13 @@ type PerformAccountCreationRequest struct {
 	AppServiceID string // optional: the application service ID (not user ID) creating this account, if any.
 	Password     string // optional: if missing then this account will be a passwordless account
 	OnConflict   Conflict
+	// optional: if set, the existing guest account with this localpart is upgraded to a full
+	// account with the given password instead of a new account being created. Returns
+	// ErrorForbidden if there is no such guest account.
+	UpgradeGuest bool
+	// optional: if set, the new account belongs to a server administrator from the start.
+	// Ignored when upgrading a guest account.
+	IsAdmin bool
 }
 
 // PerformAccountCreationResponse is the response for PerformAccountCreation
@@ -123,6 +167,10 @@ type PerformDeviceCreationRequest struct {
 	DeviceID *string
 	// optional: if nil no display name will be associated with this device.
 	DeviceDisplayName *string
+	// optional: if set, the access token expires at AccessTokenExpiresTS and
+	// can be replaced using this refresh token.
+	RefreshToken         string
+	AccessTokenExpiresTS gomatrixserverlib.Timestamp
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
@@ -131,6 +179,233 @@ type PerformDeviceCreationResponse struct {
 	Device        *Device
 }
 
+// PerformDeviceUpdateRequest is the request for PerformDeviceUpdate
+type PerformDeviceUpdateRequest struct {
+	UserID   string // required: the user who owns the device
+	DeviceID string // required: the device to update
+	// optional: if nil the display name is left as it is
+	DisplayName *string
+}
+
+// PerformDeviceUpdateResponse is the response for PerformDeviceUpdate
+type PerformDeviceUpdateResponse struct {
+	DeviceExists bool
+}
+
+// PerformDeviceDeletionRequest is the request for PerformDeviceDeletion
+type PerformDeviceDeletionRequest struct {
+	UserID string // required: the user who owns the devices
+	// required: the devices to delete, whose access tokens stop working immediately
+	DeviceIDs []string
+}
+
+// PerformDeviceDeletionResponse is the response for PerformDeviceDeletion
+type PerformDeviceDeletionResponse struct {
+}
+
+// PerformPasswordUpdateRequest is the request for PerformPasswordUpdate
+type PerformPasswordUpdateRequest struct {
+	UserID   string // required: the user to change the password of
+	Password string // required: the new password
+	// optional: if true, logs out all of the user's devices apart from KeepDeviceID
+	LogoutDevices bool
+	KeepDeviceID  string
+}
+
+// PerformPasswordUpdateResponse is the response for PerformPasswordUpdate
+type PerformPasswordUpdateResponse struct {
+	PasswordUpdated bool
+}
+
+// PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
+type PerformAccountDeactivationRequest struct {
+	Localpart string // required: the localpart of the account to deactivate
+	// Whether to also remove the account's profile and third-party identifiers,
+	// for erasing it.
+	RemovePersonalData bool
+}
+
+// PerformAccountDeactivationResponse is the response for PerformAccountDeactivation
+type PerformAccountDeactivationResponse struct {
+	AccountDeactivated bool
+}
+
+// PerformAdminUpdateRequest is the request for PerformAdminUpdate
+type PerformAdminUpdateRequest struct {
+	UserID  string // required: the user to update
+	IsAdmin bool   // required: whether the user should be a server administrator
+}
+
+// PerformAdminUpdateResponse is the response for PerformAdminUpdate
+type PerformAdminUpdateResponse struct {
+}
+
+// QueryAccountsRequest is the request for QueryAccounts
+type QueryAccountsRequest struct {
+	// The number of accounts to skip, for pagination.
+	Offset int `json:"offset,omitempty"`
+	// The maximum number of accounts to return. Defaults to 100.
+	Limit int `json:"limit,omitempty"`
+}
+
+// QueryAccountsResponse is the response for QueryAccounts
+type QueryAccountsResponse struct {
+	// The accounts, ordered by localpart, after Offset and Limit have been applied.
+	Accounts []Account `json:"accounts"`
+	// The total number of accounts.
+	TotalAccounts int `json:"total_accounts"`
+}
+
+// PerformPusherSetRequest is the request for PerformPusherSet
+type PerformPusherSetRequest struct {
+	UserID string // required: the user to set the pusher for
+	Pusher Pusher // required: the pusher, replacing any of the user's pushers with the same app ID and push key
+	// optional: if false, removes the pushers of other users with the same app ID and push key
+	Append bool
+}
+
+// PerformPusherSetResponse is the response for PerformPusherSet
+type PerformPusherSetResponse struct {
+}
+
+// PerformPusherDeletionRequest is the request for PerformPusherDeletion
+type PerformPusherDeletionRequest struct {
+	UserID  string // required: the user to remove the pusher of
+	AppID   string // required: the app ID of the pusher
+	PushKey string // required: the push key of the pusher
+}
+
+// PerformPusherDeletionResponse is the response for PerformPusherDeletion
+type PerformPusherDeletionResponse struct {
+}
+
+// PerformRoomAccountDataDeletionRequest is the request for PerformRoomAccountDataDeletion
+type PerformRoomAccountDataDeletionRequest struct {
+	RoomID string // required: the room to remove the account data for
+}
+
+// PerformRoomAccountDataDeletionResponse is the response for PerformRoomAccountDataDeletion
+type PerformRoomAccountDataDeletionResponse struct {
+}
+
+// QueryPushersRequest is the request for QueryPushers
+type QueryPushersRequest struct {
+	UserID string
+}
+
+// QueryPushersResponse is the response for QueryPushers
+type QueryPushersResponse struct {
+	Pushers []Pusher
+}
+
+// PerformOpenIDTokenCreationRequest is the request for PerformOpenIDTokenCreation
+type PerformOpenIDTokenCreationRequest struct {
+	UserID string // required: the user to issue the token to
+}
+
+// PerformOpenIDTokenCreationResponse is the response for PerformOpenIDTokenCreation
+type PerformOpenIDTokenCreationResponse struct {
+	Token      string
+	ExpiresTS  gomatrixserverlib.Timestamp
+	ServerName gomatrixserverlib.ServerName
+}
+
+// QueryOpenIDTokenRequest is the request for QueryOpenIDToken
+type QueryOpenIDTokenRequest struct {
+	Token string
+}
+
+// QueryOpenIDTokenResponse is the response for QueryOpenIDToken
+type QueryOpenIDTokenResponse struct {
+	// The user who the token was issued to, or empty if the token doesn't
+	// exist or has expired.
+	UserID string
+}
+
+// PerformLoginTokenCreationRequest is the request for PerformLoginTokenCreation
+type PerformLoginTokenCreationRequest struct {
+	UserID string // required: the user who the token logs in as
+}
+
+// PerformLoginTokenCreationResponse is the response for PerformLoginTokenCreation
+type PerformLoginTokenCreationResponse struct {
+	Token     string
+	ExpiresTS gomatrixserverlib.Timestamp
+}
+
+// PerformLoginTokenClaimRequest is the request for PerformLoginTokenClaim
+type PerformLoginTokenClaimRequest struct {
+	Token string
+}
+
+// PerformLoginTokenClaimResponse is the response for PerformLoginTokenClaim
+type PerformLoginTokenClaimResponse struct {
+	// The user who the token was issued to, or empty if the token doesn't
+	// exist, has expired or has already been used.
+	UserID string
+}
+
+// PerformUserProvisioningRequest is the request for PerformUserProvisioning
+type PerformUserProvisioningRequest struct {
+	// The users to create or update. Sending the same users again is harmless,
+	// so a whole directory can be synced periodically.
+	Users []ProvisionedUserUpdate `json:"users"`
+}
+
+// ProvisionedUserUpdate creates the account for a user in an external
+// directory if there isn't one yet, otherwise updates it.
+type ProvisionedUserUpdate struct {
+	// required: the ID of the user in the external directory, which never changes.
+	ExternalID string `json:"external_id"`
+	// required when creating the account: the localpart of its user ID, which can't be changed afterwards.
+	Localpart string `json:"localpart,omitempty"`
+	// optional: if nil then the display name is left alone, or defaults to the localpart for new accounts.
+	DisplayName *string `json:"display_name,omitempty"`
+	// optional: if set then replaces the password. Accounts created without one can't log in with a password.
+	Password string `json:"password,omitempty"`
+	// optional: false deactivates the account and true reactivates it. Accounts are created active.
+	Active *bool `json:"active,omitempty"`
+}
+
+// PerformUserProvisioningResponse is the response for PerformUserProvisioning
+type PerformUserProvisioningResponse struct {
+	// The outcome for each user, in the same order as the request.
+	Results []ProvisionedUserResult `json:"results"`
+}
+
+// ProvisionedUserResult is the outcome of a ProvisionedUserUpdate.
+type ProvisionedUserResult struct {
+	ExternalID string `json:"external_id"`
+	// The user ID of the account, unless it couldn't be created.
+	UserID string `json:"user_id,omitempty"`
+	// Whether the account was created rather than updated.
+	Created bool `json:"created"`
+	// Why the user couldn't be created or updated, if they couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// QueryProvisionedUsersRequest is the request for QueryProvisionedUsers
+type QueryProvisionedUsersRequest struct {
+	// The number of users to skip, for pagination.
+	Offset int `json:"offset,omitempty"`
+	// The maximum number of users to return. Defaults to 100.
+	Limit int `json:"limit,omitempty"`
+}
+
+// QueryProvisionedUsersResponse is the response for QueryProvisionedUsers
+type QueryProvisionedUsersResponse struct {
+	// The users, ordered by external ID, after Offset and Limit have been applied.
+	Users []ProvisionedUser `json:"users"`
+	// The total number of provisioned users.
+	TotalUsers int `json:"total_users"`
+}
+
+// OpenIDTokenAttributes are the stored details of an OpenID token.
+type OpenIDTokenAttributes struct {
+	UserID    string
+	ExpiresTS gomatrixserverlib.Timestamp
+}
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -144,6 +419,14 @@ type Device struct {
 	SessionID int64
 	// TODO: display name, last used timestamp, keys, etc
 	DisplayName string
+	// Whether the device belongs to a guest account, which can only use some
+	// endpoints and only join rooms which allow guests.
+	IsGuest bool
+	// Whether the device belongs to a server administrator.
+	IsAdmin bool
+	// When the access token expires, or 0 if it never expires. Only access
+	// tokens which were issued along with a refresh token expire.
+	AccessTokenExpiresTS gomatrixserverlib.Timestamp
 }
 
 // Account represents a Matrix account on this home server.
@@ -152,10 +435,52 @@ type Account struct {
 	Localpart    string
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	// Whether this is a guest account which hasn't been upgraded yet.
+	IsGuest bool
+	// Whether the account has been deactivated, so can't be logged into.
+	Deactivated bool
+	// Whether the account belongs to a server administrator.
+	IsAdmin bool
 	// TODO: Associations (e.g. with application services)
 }
 
+// ProvisionedUser is an account which is managed by an external directory,
+// e.g. an HR system, rather than by its user.
+type ProvisionedUser struct {
+	ExternalID  string `json:"external_id"`
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	Active      bool   `json:"active"`
+}
+
+// Pusher represents a push gateway which is sent notifications for a user
+// on behalf of one of their devices.
+type Pusher struct {
+	// The device which set the pusher.
+	DeviceID string
+	// Identifies the device to the push gateway, e.g. an APNS token.
+	PushKey           string
+	Kind              PusherKind
+	AppID             string
+	AppDisplayName    string
+	DeviceDisplayName string
+	ProfileTag        string
+	Language          string
+	// Sent to the push gateway along with notifications. For HTTP pushers
+	// this includes the URL of the push gateway.
+	Data map[string]interface{}
+}
+
+// PusherKind is the kind of a pusher
+type PusherKind string
+
+const (
+	// HTTPKind is the kind of pusher which sends notifications to an HTTP push gateway
+	HTTPKind PusherKind = "http"
+	// EmailKind is the kind of pusher which sends notifications by email
+	EmailKind PusherKind = "email"
+)
+
 // ErrorForbidden is an error indicating that the supplied access token is forbidden
 type ErrorForbidden struct {
 	Message string
@@ -0,0 +1,82 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// accountFlagsLifetime is how long whether an account is a guest's or an
+// admin's is remembered for, so that every authenticated request doesn't
+// have to look the account up as well as the device. Changes made through
+// this API are seen straight away, but changes made to the database by
+// something else, such as the create-account command, only once the flags
+// have been forgotten.
+const accountFlagsLifetime = time.Minute
+
+type accountFlags struct {
+	isGuest   bool
+	isAdmin   bool
+	expiresAt time.Time
+}
+
+// accountFlagsCache remembers the flags of recently used accounts by
+// localpart. The zero value is ready to use.
+type accountFlagsCache struct {
+	mu        sync.Mutex
+	flags     map[string]accountFlags
+	lastPrune time.Time
+}
+
+func (c *accountFlagsCache) get(localpart string, now time.Time) (accountFlags, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flags, ok := c.flags[localpart]
+	if !ok || !flags.expiresAt.After(now) {
+		return accountFlags{}, false
+	}
+	return flags, true
+}
+
+func (c *accountFlagsCache) set(localpart string, isGuest, isAdmin bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flags == nil {
+		c.flags = make(map[string]accountFlags)
+	}
+	// Forget accounts which haven't been used for a while, so that the
+	// cache doesn't grow with every account which has ever been used.
+	if now.Sub(c.lastPrune) > accountFlagsLifetime {
+		for k, flags := range c.flags {
+			if !flags.expiresAt.After(now) {
+				delete(c.flags, k)
+			}
+		}
+		c.lastPrune = now
+	}
+	c.flags[localpart] = accountFlags{
+		isGuest:   isGuest,
+		isAdmin:   isAdmin,
+		expiresAt: now.Add(accountFlagsLifetime),
+	}
+}
+
+// forget makes the next request for the account look it up again.
+func (c *accountFlagsCache) forget(localpart string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.flags, localpart)
+}
@@ -16,27 +16,68 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"regexp"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/dendrite/userapi/storage/devices"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
+// openIDTokenLifetime is how long OpenID tokens can be used for after they
+// are issued.
+const openIDTokenLifetime = time.Hour
+
+// loginTokenLifetime is how long login tokens can be used for after they are
+// issued. They are only meant to be passed straight back to the server by the
+// client, e.g. in a redirect after logging in with SSO.
+const loginTokenLifetime = 2 * time.Minute
+
+const (
+	// The most users which can be provisioned in a single request.
+	maxProvisionedUsers = 1000
+	// The default and maximum number of provisioned users returned at once.
+	defaultProvisionedUsersLimit = 100
+	maxProvisionedUsersLimit     = 1000
+	// The default and maximum number of accounts returned at once.
+	defaultAccountsLimit = 100
+	maxAccountsLimit     = 1000
+)
+
+// The characters allowed in the localparts of provisioned accounts, which are
+// the same as for accounts which users register themselves.
+var validLocalpartRegex = regexp.MustCompile(`^[0-9a-z_\-./]+$`)
+
 type UserInternalAPI struct {
 	AccountDB  accounts.Database
 	DeviceDB   devices.Database
 	ServerName gomatrixserverlib.ServerName
 	// AppServices is the list of all registered AS
 	AppServices []config.ApplicationService
+	// KeyAPI is told about deleted devices so that it can delete their keys.
+	// Optional: if nil, keys are left for the key server to tidy up.
+	KeyAPI keyapi.KeyInternalAPI
+	// StateAPI is told about the global profiles of local users so that they
+	// can be found in the user directory.
+	// Optional: if nil, the user directory only knows the IDs of joined users.
+	StateAPI currentstateAPI.CurrentStateInternalAPI
+
+	accountFlags accountFlagsCache
 }
 
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
@@ -50,7 +91,41 @@ func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAc
 	if req.DataType == "" {
 		return fmt.Errorf("data type must not be empty")
 	}
-	return a.AccountDB.SaveAccountData(ctx, local, req.RoomID, req.DataType, req.AccountData)
+	if !req.IfUnchanged {
+		return a.AccountDB.SaveAccountData(ctx, local, req.RoomID, req.DataType, req.AccountData)
+	}
+	// The previous account data may have been re-encoded on its way here, so
+	// it is compared as JSON, and then the stored bytes are only replaced if
+	// they are still there.
+	stored, err := a.AccountDB.GetAccountDataByType(ctx, local, req.RoomID, req.DataType)
+	if err != nil {
+		return err
+	}
+	if equal, err := jsonEqual(stored, req.PrevAccountData); err != nil || !equal {
+		res.Changed = true
+		return err
+	}
+	saved, err := a.AccountDB.SaveAccountDataIfUnchanged(ctx, local, req.RoomID, req.DataType, stored, req.AccountData)
+	res.Changed = !saved
+	return err
+}
+
+// jsonEqual returns whether two pieces of JSON have the same value. Missing
+// JSON, which becomes null when sent over HTTP, is only equal to itself.
+func jsonEqual(a, b json.RawMessage) (bool, error) {
+	aMissing := len(a) == 0 || string(a) == "null"
+	bMissing := len(b) == 0 || string(b) == "null"
+	if aMissing || bMissing {
+		return aMissing && bMissing, nil
+	}
+	var aVal, bVal interface{}
+	if err := json.Unmarshal(a, &aVal); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, &bVal); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(aVal, bVal), nil
 }
 
 func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse) error {
@@ -63,7 +138,31 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 		res.Account = acc
 		return nil
 	}
-	acc, err := a.AccountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID)
+	if req.UpgradeGuest {
+		err := a.AccountDB.UpgradeGuestAccount(ctx, req.Localpart, req.Password)
+		if err == sql.ErrNoRows {
+			return &api.ErrorForbidden{
+				Message: "not a guest account",
+			}
+		} else if err != nil {
+			return err
+		}
+		a.accountFlags.forget(req.Localpart)
+		res.AccountCreated = true
+		res.Account = &api.Account{
+			Localpart:  req.Localpart,
+			ServerName: a.ServerName,
+			UserID:     fmt.Sprintf("@%s:%s", req.Localpart, a.ServerName),
+		}
+		return nil
+	}
+	var acc *api.Account
+	var err error
+	if req.IsAdmin {
+		acc, err = a.AccountDB.CreateAdminAccount(ctx, req.Localpart, req.Password)
+	} else {
+		acc, err = a.AccountDB.CreateAccount(ctx, req.Localpart, req.Password, req.AppServiceID)
+	}
 	if err != nil {
 		if errors.Is(err, sqlutil.ErrUserExists) { // This account already exists
 			switch req.OnConflict {
@@ -89,6 +188,11 @@ func (a *UserInternalAPI) PerformAccountCreation(ctx context.Context, req *api.P
 	if err = a.AccountDB.SetDisplayName(ctx, req.Localpart, req.Localpart); err != nil {
 		return err
 	}
+	// The account exists by now, so failing the request would only make the
+	// client retry with a user ID that is already taken.
+	if err = a.updateUserDirectory(ctx, req.Localpart); err != nil {
+		logrus.WithError(err).WithField("localpart", req.Localpart).Warn("Failed to add new account to the user directory")
+	}
 
 	res.AccountCreated = true
 	res.Account = acc
@@ -99,11 +203,74 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	if err != nil {
 		return err
 	}
+	if req.RefreshToken != "" {
+		if err = a.DeviceDB.SetRefreshToken(ctx, dev.AccessToken, req.RefreshToken, req.AccessTokenExpiresTS); err != nil {
+			return err
+		}
+		dev.AccessTokenExpiresTS = req.AccessTokenExpiresTS
+	}
 	res.DeviceCreated = true
 	res.Device = dev
 	return nil
 }
 
+// PerformDeviceUpdate changes the display name of one of a user's devices.
+func (a *UserInternalAPI) PerformDeviceUpdate(ctx context.Context, req *api.PerformDeviceUpdateRequest, res *api.PerformDeviceUpdateResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot update the devices of remote users: got %s want %s", domain, a.ServerName)
+	}
+	_, err = a.DeviceDB.GetDeviceByID(ctx, local, req.DeviceID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.DeviceExists = true
+	return a.DeviceDB.UpdateDevice(ctx, local, req.DeviceID, req.DisplayName)
+}
+
+// PerformDeviceDeletion logs out some of a user's devices and deletes their
+// end-to-end keys.
+func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot delete the devices of remote users: got %s want %s", domain, a.ServerName)
+	}
+	return a.deleteDevices(ctx, local, req.DeviceIDs)
+}
+
+func (a *UserInternalAPI) deleteDevices(ctx context.Context, localpart string, deviceIDs []string) error {
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	if err := a.DeviceDB.RemoveDevices(ctx, localpart, deviceIDs); err != nil {
+		return err
+	}
+	return a.deleteDeviceKeys(ctx, localpart, deviceIDs)
+}
+
+func (a *UserInternalAPI) deleteDeviceKeys(ctx context.Context, localpart string, deviceIDs []string) error {
+	if a.KeyAPI == nil || len(deviceIDs) == 0 {
+		return nil
+	}
+	var res keyapi.PerformDeleteKeysResponse
+	a.KeyAPI.PerformDeleteKeys(ctx, &keyapi.PerformDeleteKeysRequest{
+		UserID:    userutil.MakeUserID(localpart, a.ServerName),
+		DeviceIDs: deviceIDs,
+	}, &res)
+	if res.Error != nil {
+		return fmt.Errorf("failed to delete device keys: %s", res.Error.Error)
+	}
+	return nil
+}
+
 func (a *UserInternalAPI) QueryProfile(ctx context.Context, req *api.QueryProfileRequest, res *api.QueryProfileResponse) error {
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
@@ -192,6 +359,31 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		}
 		return err
 	}
+	if device.AccessTokenExpiresTS != 0 && !device.AccessTokenExpiresTS.Time().After(time.Now()) {
+		res.Expired = true
+		return nil
+	}
+	// Whether the device is a guest's or an admin's comes from the account
+	// rather than the device, so that changes to the account apply to all
+	// of its devices.
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	flags, ok := a.accountFlags.get(localpart, now)
+	if !ok {
+		acc, err := a.AccountDB.GetAccountByLocalpart(ctx, localpart)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if acc != nil {
+			flags.isGuest, flags.isAdmin = acc.IsGuest, acc.IsAdmin
+			a.accountFlags.set(localpart, acc.IsGuest, acc.IsAdmin, now)
+		}
+	}
+	device.IsGuest = flags.isGuest
+	device.IsAdmin = flags.isAdmin
 	res.Device = device
 	return nil
 }
@@ -240,3 +432,396 @@ func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appSe
 	dev.UserID = appService.SenderLocalpart
 	return &dev, nil
 }
+
+func (a *UserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot set pushers of remote users: got %s want %s", domain, a.ServerName)
+	}
+	if req.Pusher.AppID == "" || req.Pusher.PushKey == "" {
+		return fmt.Errorf("app ID and push key must not be empty")
+	}
+	return a.AccountDB.UpsertPusher(ctx, local, req.Pusher, req.Append)
+}
+
+func (a *UserInternalAPI) PerformPasswordUpdate(ctx context.Context, req *api.PerformPasswordUpdateRequest, res *api.PerformPasswordUpdateResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot update the password of remote users: got %s want %s", domain, a.ServerName)
+	}
+	if err = a.AccountDB.SetPassword(ctx, local, req.Password); err != nil {
+		return err
+	}
+	res.PasswordUpdated = true
+	if !req.LogoutDevices {
+		return nil
+	}
+
+	devs, err := a.DeviceDB.GetDevicesByLocalpart(ctx, local)
+	if err != nil {
+		return err
+	}
+	deviceIDs := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		if dev.ID != req.KeepDeviceID {
+			deviceIDs = append(deviceIDs, dev.ID)
+		}
+	}
+	return a.deleteDevices(ctx, local, deviceIDs)
+}
+
+// PerformAccountDeactivation deactivates an account and logs out all of its
+// devices. Leaving the account's rooms is up to the caller.
+func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *api.PerformAccountDeactivationRequest, res *api.PerformAccountDeactivationResponse) error {
+	if err := a.AccountDB.DeactivateAccount(ctx, req.Localpart); err != nil {
+		return err
+	}
+	res.AccountDeactivated = true
+	devs, err := a.DeviceDB.GetDevicesByLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	if err = a.DeviceDB.RemoveAllDevices(ctx, req.Localpart); err != nil {
+		return err
+	}
+	deviceIDs := make([]string, len(devs))
+	for i := range devs {
+		deviceIDs[i] = devs[i].ID
+	}
+	if err = a.deleteDeviceKeys(ctx, req.Localpart, deviceIDs); err != nil {
+		return err
+	}
+	// Tokens issued just before the deactivation mustn't log in new devices.
+	if err = a.AccountDB.RemoveLoginTokensForLocalpart(ctx, req.Localpart); err != nil {
+		return err
+	}
+	// Deactivated accounts shouldn't be sent any more push notifications.
+	pushers, err := a.AccountDB.GetPushers(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	for _, pusher := range pushers {
+		if err = a.AccountDB.RemovePusher(ctx, req.Localpart, pusher.AppID, pusher.PushKey); err != nil {
+			return err
+		}
+	}
+	if !req.RemovePersonalData {
+		return nil
+	}
+	if err = a.AccountDB.SetDisplayName(ctx, req.Localpart, ""); err != nil {
+		return err
+	}
+	if err = a.AccountDB.SetAvatarURL(ctx, req.Localpart, ""); err != nil {
+		return err
+	}
+	if err = a.updateUserDirectory(ctx, req.Localpart); err != nil {
+		return err
+	}
+	threepids, err := a.AccountDB.GetThreePIDsForLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return err
+	}
+	for _, threepid := range threepids {
+		if err = a.AccountDB.RemoveThreePIDAssociation(ctx, threepid.Address, threepid.Medium); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *UserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot remove pushers of remote users: got %s want %s", domain, a.ServerName)
+	}
+	return a.AccountDB.RemovePusher(ctx, local, req.AppID, req.PushKey)
+}
+
+func (a *UserInternalAPI) PerformRoomAccountDataDeletion(ctx context.Context, req *api.PerformRoomAccountDataDeletionRequest, res *api.PerformRoomAccountDataDeletionResponse) error {
+	return a.AccountDB.RemoveRoomAccountData(ctx, req.RoomID)
+}
+
+func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query pushers of remote users: got %s want %s", domain, a.ServerName)
+	}
+	res.Pushers, err = a.AccountDB.GetPushers(ctx, local)
+	return err
+}
+
+// PerformOpenIDTokenCreation issues an OpenID token to a user, which other
+// servers can exchange for the user's ID to check who they are.
+func (a *UserInternalAPI) PerformOpenIDTokenCreation(ctx context.Context, req *api.PerformOpenIDTokenCreationRequest, res *api.PerformOpenIDTokenCreationResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot issue OpenID tokens to remote users: got %s want %s", domain, a.ServerName)
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expiresTS := gomatrixserverlib.AsTimestamp(time.Now().Add(openIDTokenLifetime))
+	if err = a.AccountDB.CreateOpenIDToken(ctx, token, local, expiresTS); err != nil {
+		return err
+	}
+	res.Token = token
+	res.ExpiresTS = expiresTS
+	res.ServerName = a.ServerName
+	return nil
+}
+
+// QueryOpenIDToken looks up the user who an OpenID token was issued to.
+func (a *UserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.QueryOpenIDTokenRequest, res *api.QueryOpenIDTokenResponse) error {
+	attributes, err := a.AccountDB.GetOpenIDTokenAttributes(ctx, req.Token)
+	if err != nil {
+		return err
+	}
+	if attributes != nil && attributes.ExpiresTS.Time().After(time.Now()) {
+		res.UserID = attributes.UserID
+	}
+	return nil
+}
+
+// PerformLoginTokenCreation issues a login token to a user, which can be
+// exchanged once for an access token with an m.login.token login.
+func (a *UserInternalAPI) PerformLoginTokenCreation(ctx context.Context, req *api.PerformLoginTokenCreationRequest, res *api.PerformLoginTokenCreationResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot issue login tokens to remote users: got %s want %s", domain, a.ServerName)
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expiresTS := gomatrixserverlib.AsTimestamp(time.Now().Add(loginTokenLifetime))
+	if err = a.AccountDB.CreateLoginToken(ctx, token, local, expiresTS); err != nil {
+		return err
+	}
+	res.Token = token
+	res.ExpiresTS = expiresTS
+	return nil
+}
+
+// PerformLoginTokenClaim looks up the user who a login token was issued to,
+// using up the token. Tokens of accounts which no longer exist or have been
+// deactivated don't log in, as with passwords.
+func (a *UserInternalAPI) PerformLoginTokenClaim(ctx context.Context, req *api.PerformLoginTokenClaimRequest, res *api.PerformLoginTokenClaimResponse) error {
+	local, err := a.AccountDB.ConsumeLoginToken(ctx, req.Token)
+	if err != nil || local == "" {
+		return err
+	}
+	acc, err := a.AccountDB.GetAccountByLocalpart(ctx, local)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !acc.Deactivated {
+		res.UserID = userutil.MakeUserID(local, a.ServerName)
+	}
+	return nil
+}
+
+func (a *UserInternalAPI) PerformUserProvisioning(ctx context.Context, req *api.PerformUserProvisioningRequest, res *api.PerformUserProvisioningResponse) error {
+	if len(req.Users) > maxProvisionedUsers {
+		return fmt.Errorf("cannot provision more than %d users at once", maxProvisionedUsers)
+	}
+	res.Results = make([]api.ProvisionedUserResult, 0, len(req.Users))
+	for _, update := range req.Users {
+		result := api.ProvisionedUserResult{ExternalID: update.ExternalID}
+		localpart, created, err := a.provisionUser(ctx, &update)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if localpart != "" {
+			result.UserID = userutil.MakeUserID(localpart, a.ServerName)
+		}
+		result.Created = created
+		res.Results = append(res.Results, result)
+	}
+	return nil
+}
+
+// provisionUser applies a single update, returning the localpart of the
+// account and whether it had to be created. Updates which change nothing
+// about an existing account do nothing, so that they are safe to repeat.
+func (a *UserInternalAPI) provisionUser(ctx context.Context, update *api.ProvisionedUserUpdate) (string, bool, error) {
+	if update.ExternalID == "" {
+		return "", false, errors.New("external_id must be given")
+	}
+	localpart, err := a.AccountDB.GetLocalpartForExternalID(ctx, update.ExternalID)
+	if err != nil {
+		return "", false, err
+	}
+	created := false
+	if localpart == "" {
+		if !validLocalpartRegex.MatchString(update.Localpart) {
+			return "", false, errors.New("a valid localpart must be given for new users")
+		}
+		if _, err = a.AccountDB.CreateProvisionedAccount(ctx, update.ExternalID, update.Localpart, update.Password); err != nil {
+			if errors.Is(err, sqlutil.ErrUserExists) {
+				return "", false, errors.New("the user ID is already in use")
+			}
+			return "", false, err
+		}
+		localpart, created = update.Localpart, true
+		if update.DisplayName == nil {
+			update.DisplayName = &localpart
+		}
+	} else if update.Localpart != "" && update.Localpart != localpart {
+		return localpart, false, errors.New("the localpart of an existing user can't be changed")
+	}
+
+	if update.DisplayName != nil {
+		profile, err := a.AccountDB.GetProfileByLocalpart(ctx, localpart)
+		if err != nil {
+			return localpart, created, err
+		}
+		if profile.DisplayName != *update.DisplayName {
+			if err = a.AccountDB.SetDisplayName(ctx, localpart, *update.DisplayName); err != nil {
+				return localpart, created, err
+			}
+			if err = a.updateUserDirectory(ctx, localpart); err != nil {
+				return localpart, created, err
+			}
+		}
+	}
+	if update.Password != "" && !created {
+		if err = a.AccountDB.SetPassword(ctx, localpart, update.Password); err != nil {
+			return localpart, created, err
+		}
+	}
+	if update.Active != nil {
+		acc, err := a.AccountDB.GetAccountByLocalpart(ctx, localpart)
+		if err != nil {
+			return localpart, created, err
+		}
+		if *update.Active && acc.Deactivated {
+			err = a.AccountDB.ReactivateAccount(ctx, localpart)
+		} else if !*update.Active && !acc.Deactivated {
+			err = a.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+				Localpart: localpart,
+			}, &api.PerformAccountDeactivationResponse{})
+		}
+		if err != nil {
+			return localpart, created, err
+		}
+	}
+	return localpart, created, nil
+}
+
+func (a *UserInternalAPI) QueryProvisionedUsers(ctx context.Context, req *api.QueryProvisionedUsersRequest, res *api.QueryProvisionedUsersResponse) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultProvisionedUsersLimit
+	} else if limit > maxProvisionedUsersLimit {
+		limit = maxProvisionedUsersLimit
+	}
+	var err error
+	res.Users, res.TotalUsers, err = a.AccountDB.GetProvisionedUsers(ctx, req.Offset, limit)
+	return err
+}
+
+// PerformAdminUpdate implements UserInternalAPI
+func (a *UserInternalAPI) PerformAdminUpdate(ctx context.Context, req *api.PerformAdminUpdateRequest, res *api.PerformAdminUpdateResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot make remote users admins: got %s want %s", domain, a.ServerName)
+	}
+	if err = a.AccountDB.SetAdmin(ctx, local, req.IsAdmin); err != nil {
+		return err
+	}
+	a.accountFlags.forget(local)
+	return nil
+}
+
+// QueryAccounts implements UserInternalAPI
+func (a *UserInternalAPI) QueryAccounts(ctx context.Context, req *api.QueryAccountsRequest, res *api.QueryAccountsResponse) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultAccountsLimit
+	} else if limit > maxAccountsLimit {
+		limit = maxAccountsLimit
+	}
+	var err error
+	res.Accounts, res.TotalAccounts, err = a.AccountDB.GetAccounts(ctx, req.Offset, limit)
+	return err
+}
+
+// updateUserDirectory replaces what the user directory has for a local user
+// with their global profile.
+func (a *UserInternalAPI) updateUserDirectory(ctx context.Context, localpart string) error {
+	if a.StateAPI == nil {
+		return nil
+	}
+	profile, err := a.AccountDB.GetProfileByLocalpart(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	return a.StateAPI.PerformUpdateUserDirectory(ctx, &currentstateAPI.PerformUpdateUserDirectoryRequest{
+		Profiles: []currentstateAPI.UserDirectoryEntry{{
+			UserID:      userutil.MakeUserID(localpart, a.ServerName),
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}},
+	}, &currentstateAPI.PerformUpdateUserDirectoryResponse{})
+}
+
+// BackfillUserDirectory adds the global profiles of all existing accounts to
+// the user directory, a page at a time, so that accounts made before the
+// user directory was told about new accounts can be found too.
+func (a *UserInternalAPI) BackfillUserDirectory(ctx context.Context) error {
+	if a.StateAPI == nil {
+		return nil
+	}
+	for offset := 0; ; offset += defaultAccountsLimit {
+		accs, _, err := a.AccountDB.GetAccounts(ctx, offset, defaultAccountsLimit)
+		if err != nil {
+			return err
+		}
+		if len(accs) == 0 {
+			return nil
+		}
+		req := currentstateAPI.PerformUpdateUserDirectoryRequest{
+			Profiles: make([]currentstateAPI.UserDirectoryEntry, 0, len(accs)),
+		}
+		for _, acc := range accs {
+			profile, err := a.AccountDB.GetProfileByLocalpart(ctx, acc.Localpart)
+			if err != nil {
+				return err
+			}
+			req.Profiles = append(req.Profiles, currentstateAPI.UserDirectoryEntry{
+				UserID:      userutil.MakeUserID(acc.Localpart, a.ServerName),
+				DisplayName: profile.DisplayName,
+				AvatarURL:   profile.AvatarURL,
+			})
+		}
+		if err = a.StateAPI.PerformUpdateUserDirectory(ctx, &req, &currentstateAPI.PerformUpdateUserDirectoryResponse{}); err != nil {
+			return err
+		}
+	}
+}
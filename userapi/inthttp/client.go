@@ -28,13 +28,29 @@ import (
 const (
 	InputAccountDataPath = "/userapi/inputAccountData"
 
-	PerformDeviceCreationPath  = "/userapi/performDeviceCreation"
-	PerformAccountCreationPath = "/userapi/performAccountCreation"
+	PerformDeviceCreationPath          = "/userapi/performDeviceCreation"
+	PerformDeviceUpdatePath            = "/userapi/performDeviceUpdate"
+	PerformDeviceDeletionPath          = "/userapi/performDeviceDeletion"
+	PerformAccountCreationPath         = "/userapi/performAccountCreation"
+	PerformPasswordUpdatePath          = "/userapi/performPasswordUpdate"
+	PerformAccountDeactivationPath     = "/userapi/performAccountDeactivation"
+	PerformPusherSetPath               = "/userapi/performPusherSet"
+	PerformPusherDeletionPath          = "/userapi/performPusherDeletion"
+	PerformRoomAccountDataDeletionPath = "/userapi/performRoomAccountDataDeletion"
+	PerformOpenIDTokenCreationPath     = "/userapi/performOpenIDTokenCreation"
+	PerformUserProvisioningPath        = "/userapi/performUserProvisioning"
+	PerformLoginTokenCreationPath      = "/userapi/performLoginTokenCreation"
+	PerformLoginTokenClaimPath         = "/userapi/performLoginTokenClaim"
+	PerformAdminUpdatePath             = "/userapi/performAdminUpdate"
 
-	QueryProfilePath     = "/userapi/queryProfile"
-	QueryAccessTokenPath = "/userapi/queryAccessToken"
-	QueryDevicesPath     = "/userapi/queryDevices"
-	QueryAccountDataPath = "/userapi/queryAccountData"
+	QueryProfilePath          = "/userapi/queryProfile"
+	QueryAccessTokenPath      = "/userapi/queryAccessToken"
+	QueryDevicesPath          = "/userapi/queryDevices"
+	QueryAccountDataPath      = "/userapi/queryAccountData"
+	QueryPushersPath          = "/userapi/queryPushers"
+	QueryOpenIDTokenPath      = "/userapi/queryOpenIDToken"
+	QueryProvisionedUsersPath = "/userapi/queryProvisionedUsers"
+	QueryAccountsPath         = "/userapi/queryAccounts"
 )
 
 // NewUserAPIClient creates a UserInternalAPI implemented by talking to a HTTP POST API.
@@ -128,3 +144,131 @@ func (h *httpUserInternalAPI) QueryAccountData(ctx context.Context, req *api.Que
 	apiURL := h.apiURL + QueryAccountDataPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
+
+func (h *httpUserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPusherSet")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPusherSetPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformDeviceUpdate(ctx context.Context, req *api.PerformDeviceUpdateRequest, res *api.PerformDeviceUpdateResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeviceUpdate")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformDeviceUpdatePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeviceDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformDeviceDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPasswordUpdate(ctx context.Context, req *api.PerformPasswordUpdateRequest, res *api.PerformPasswordUpdateResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPasswordUpdate")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPasswordUpdatePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *api.PerformAccountDeactivationRequest, res *api.PerformAccountDeactivationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAccountDeactivation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformAccountDeactivationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.PerformPusherDeletionRequest, res *api.PerformPusherDeletionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPusherDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPusherDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformRoomAccountDataDeletion(ctx context.Context, req *api.PerformRoomAccountDataDeletionRequest, res *api.PerformRoomAccountDataDeletionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformRoomAccountDataDeletion")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformRoomAccountDataDeletionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPushers")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryPushersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformOpenIDTokenCreation(ctx context.Context, req *api.PerformOpenIDTokenCreationRequest, res *api.PerformOpenIDTokenCreationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformOpenIDTokenCreation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformOpenIDTokenCreationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.QueryOpenIDTokenRequest, res *api.QueryOpenIDTokenResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryOpenIDToken")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryOpenIDTokenPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformLoginTokenCreation(ctx context.Context, req *api.PerformLoginTokenCreationRequest, res *api.PerformLoginTokenCreationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformLoginTokenCreation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformLoginTokenCreationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformLoginTokenClaim(ctx context.Context, req *api.PerformLoginTokenClaimRequest, res *api.PerformLoginTokenClaimResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformLoginTokenClaim")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformLoginTokenClaimPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformUserProvisioning(ctx context.Context, req *api.PerformUserProvisioningRequest, res *api.PerformUserProvisioningResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUserProvisioning")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformUserProvisioningPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryProvisionedUsers(ctx context.Context, req *api.QueryProvisionedUsersRequest, res *api.QueryProvisionedUsersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryProvisionedUsers")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryProvisionedUsersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformAdminUpdate(ctx context.Context, req *api.PerformAdminUpdateRequest, res *api.PerformAdminUpdateResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAdminUpdate")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformAdminUpdatePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryAccounts(ctx context.Context, req *api.QueryAccountsRequest, res *api.QueryAccountsResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAccounts")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryAccountsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
@@ -17,16 +17,27 @@ package accounts
 import (
 	"context"
 	"encoding/json"
-	"errors"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
 	internal.PartitionStorer
 	GetAccountByPassword(ctx context.Context, localpart, plaintextPassword string) (*api.Account, error)
+	// SetPassword replaces the password of an account. Returns sql.ErrNoRows if there is no such account.
+	SetPassword(ctx context.Context, localpart, plaintextPassword string) error
+	// UpgradeGuestAccount turns a guest account into a full account with the given password. Returns
+	// sql.ErrNoRows if there is no such guest account.
+	UpgradeGuestAccount(ctx context.Context, localpart, plaintextPassword string) error
+	// DeactivateAccount stops an account from being logged into. Returns sql.ErrNoRows if there is no such account.
+	DeactivateAccount(ctx context.Context, localpart string) error
+	// ReactivateAccount allows a deactivated account to be logged into again. Returns sql.ErrNoRows
+	// if there is no such account.
+	ReactivateAccount(ctx context.Context, localpart string) error
 	GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error)
 	SetAvatarURL(ctx context.Context, localpart string, avatarURL string) error
 	SetDisplayName(ctx context.Context, localpart string, displayName string) error
@@ -35,13 +46,42 @@ type Database interface {
 	// account already exists, it will return nil, ErrUserExists.
 	CreateAccount(ctx context.Context, localpart, plaintextPassword, appserviceID string) (*api.Account, error)
 	CreateGuestAccount(ctx context.Context) (*api.Account, error)
+	// CreateAdminAccount creates an account in the same way as CreateAccount which belongs to a server administrator.
+	CreateAdminAccount(ctx context.Context, localpart, plaintextPassword string) (*api.Account, error)
+	// CreateProvisionedAccount creates an account for a user in an external directory, e.g. an HR
+	// system, recording the external ID which it was created for.
+	CreateProvisionedAccount(ctx context.Context, externalID, localpart, plaintextPassword string) (*api.Account, error)
+	// GetLocalpartForExternalID returns the localpart of the account created for the external ID, or
+	// an empty string if there isn't one.
+	GetLocalpartForExternalID(ctx context.Context, externalID string) (string, error)
+	// CreateSSOAccount creates a passwordless account for a user of a single sign-on identity provider,
+	// recording the subject which the provider knows them by. If the account already exists, it will
+	// return nil, ErrUserExists.
+	CreateSSOAccount(ctx context.Context, idpID, subject, localpart string) (*api.Account, error)
+	// GetLocalpartForSSOIdentity returns the localpart of the account which the user of a single sign-on
+	// identity provider logs in as, or an empty string if there isn't one.
+	GetLocalpartForSSOIdentity(ctx context.Context, idpID, subject string) (string, error)
+	// SetAdmin sets whether an account belongs to a server administrator. Returns sql.ErrNoRows if there
+	// is no such account.
+	SetAdmin(ctx context.Context, localpart string, isAdmin bool) error
+	// GetAccounts returns a page of all of the accounts, ordered by localpart, along with the total number
+	// of accounts.
+	GetAccounts(ctx context.Context, offset, limit int) ([]api.Account, int, error)
+	// GetProvisionedUsers returns a page of the accounts created for external IDs, along with the total
+	// number of them.
+	GetProvisionedUsers(ctx context.Context, offset, limit int) ([]api.ProvisionedUser, int, error)
 	SaveAccountData(ctx context.Context, localpart, roomID, dataType string, content json.RawMessage) error
+	// SaveAccountDataIfUnchanged saves the account data if the stored account data is still prev, which
+	// is nil if there wasn't any. Returns false without saving anything if it has been changed since.
+	SaveAccountDataIfUnchanged(ctx context.Context, localpart, roomID, dataType string, prev, content json.RawMessage) (bool, error)
 	GetAccountData(ctx context.Context, localpart string) (global map[string]json.RawMessage, rooms map[string]map[string]json.RawMessage, err error)
 	// GetAccountDataByType returns account data matching a given
 	// localpart, room ID and type.
 	// If no account data could be found, returns nil
 	// Returns an error if there was an issue with the retrieval
 	GetAccountDataByType(ctx context.Context, localpart, roomID, dataType string) (data json.RawMessage, err error)
+	// RemoveRoomAccountData deletes every user's account data for the room, e.g. because it has been purged.
+	RemoveRoomAccountData(ctx context.Context, roomID string) error
 	GetNewNumericLocalpart(ctx context.Context) (int64, error)
 	SaveThreePIDAssociation(ctx context.Context, threepid, localpart, medium string) (err error)
 	RemoveThreePIDAssociation(ctx context.Context, threepid string, medium string) (err error)
@@ -49,8 +89,70 @@ type Database interface {
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string) (threepids []authtypes.ThreePID, err error)
 	CheckAccountAvailability(ctx context.Context, localpart string) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
+	// GetLoginFailures returns the number of failed login attempts of the given kind recorded against
+	// the key since the given time, along with when the most recent one happened.
+	GetLoginFailures(ctx context.Context, kind, key string, since gomatrixserverlib.Timestamp) (int, gomatrixserverlib.Timestamp, error)
+	// RecordLoginFailure records a failed login attempt of the given kind against the key. Failures
+	// from before windowStart are forgotten.
+	RecordLoginFailure(ctx context.Context, kind, key string, now, windowStart gomatrixserverlib.Timestamp) error
+	// ResetLoginFailures forgets all failed login attempts of the given kind against the key.
+	ResetLoginFailures(ctx context.Context, kind, key string) error
+	// UpsertPusher stores a pusher for the given localpart, replacing any pusher that they have with
+	// the same app ID and push key. Unless appending, pushers of other users with the same app ID and
+	// push key are removed.
+	UpsertPusher(ctx context.Context, localpart string, pusher api.Pusher, appendPusher bool) error
+	// RemovePusher removes the pusher of the given localpart with the given app ID and push key.
+	RemovePusher(ctx context.Context, localpart, appID, pushKey string) error
+	// GetPushers returns the pushers of the given localpart.
+	GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error)
+	// SaveThreePIDSession stores a session validating a third-party identifier, replacing the session
+	// with the same ID if there is one.
+	SaveThreePIDSession(ctx context.Context, session *authtypes.ThreePIDSession) error
+	// GetThreePIDSession returns the session with the given ID, or nil if there isn't one.
+	GetThreePIDSession(ctx context.Context, sessionID string) (*authtypes.ThreePIDSession, error)
+	// GetThreePIDSessionByClientSecret returns the session which the client with the given secret
+	// started for the third-party identifier, or nil if there isn't one.
+	GetThreePIDSessionByClientSecret(ctx context.Context, clientSecret, medium, address string) (*authtypes.ThreePIDSession, error)
+	// RemoveThreePIDSession removes the session with the given ID. Returns
+	// false if there was no such session.
+	RemoveThreePIDSession(ctx context.Context, sessionID string) (bool, error)
+	// CreateOpenIDToken stores an OpenID token issued to the given localpart.
+	CreateOpenIDToken(ctx context.Context, token, localpart string, expiresTS gomatrixserverlib.Timestamp) error
+	// GetOpenIDTokenAttributes returns the attributes of an OpenID token, or nil if there is no such token.
+	GetOpenIDTokenAttributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error)
+	// CreateLoginToken stores a login token issued to the given localpart.
+	CreateLoginToken(ctx context.Context, token, localpart string, expiresTS gomatrixserverlib.Timestamp) error
+	// ConsumeLoginToken returns the localpart which a login token was issued to and deletes the token.
+	// Returns an empty string if there is no such token or it has expired.
+	ConsumeLoginToken(ctx context.Context, token string) (string, error)
+	// RemoveLoginTokensForLocalpart deletes all of the login tokens issued to the given localpart.
+	RemoveLoginTokensForLocalpart(ctx context.Context, localpart string) error
+	// CreateRegistrationToken stores a new registration token. Returns false if there is already a token
+	// with the same value.
+	CreateRegistrationToken(ctx context.Context, token *authtypes.RegistrationToken) (bool, error)
+	// GetRegistrationToken returns the registration token with the given value, or nil if there isn't one.
+	GetRegistrationToken(ctx context.Context, token string) (*authtypes.RegistrationToken, error)
+	// GetRegistrationTokens returns all of the registration tokens.
+	GetRegistrationTokens(ctx context.Context) ([]authtypes.RegistrationToken, error)
+	// UpdateRegistrationToken replaces the use limit and expiry time of a registration token, returning
+	// the updated token or nil if there is no such token.
+	UpdateRegistrationToken(ctx context.Context, token string, usesAllowed *int32, expiryTime *gomatrixserverlib.Timestamp) (*authtypes.RegistrationToken, error)
+	// RemoveRegistrationToken deletes a registration token. Returns false if there was no such token.
+	RemoveRegistrationToken(ctx context.Context, token string) (bool, error)
+	// UseRegistrationToken counts a completed registration against a token. Returns false if the token
+	// doesn't exist, has been used up or has expired.
+	UseRegistrationToken(ctx context.Context, token string) (bool, error)
+	// ReleaseRegistrationToken undoes UseRegistrationToken, for when the registration failed afterwards.
+	ReleaseRegistrationToken(ctx context.Context, token string) error
 }
 
+const (
+	// LoginFailureAccount is the kind of login failure counted against the localpart of an account.
+	LoginFailureAccount = "account"
+	// LoginFailureIP is the kind of login failure counted against the IP address of a client.
+	LoginFailureIP = "ip"
+)
+
 // Err3PIDInUse is the error returned when trying to save an association involving
 // a third-party identifier which is already associated to a local user.
-var Err3PIDInUse = errors.New("This third-party identifier is already in use")
+var Err3PIDInUse = sqlutil.Err3PIDInUse
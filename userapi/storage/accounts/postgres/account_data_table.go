@@ -43,16 +43,31 @@ const insertAccountDataSQL = `
 	ON CONFLICT (localpart, room_id, type) DO UPDATE SET content = EXCLUDED.content
 `
 
+// Only updates the account data if it hasn't been changed since it was read.
+const updateAccountDataIfUnchangedSQL = "" +
+	"UPDATE account_data SET content = $1" +
+	" WHERE localpart = $2 AND room_id = $3 AND type = $4 AND content = $5"
+
+const insertAccountDataIfAbsentSQL = "" +
+	"INSERT INTO account_data(localpart, room_id, type, content) VALUES($1, $2, $3, $4)" +
+	" ON CONFLICT (localpart, room_id, type) DO NOTHING"
+
 const selectAccountDataSQL = "" +
 	"SELECT room_id, type, content FROM account_data WHERE localpart = $1"
 
 const selectAccountDataByTypeSQL = "" +
 	"SELECT content FROM account_data WHERE localpart = $1 AND room_id = $2 AND type = $3"
 
+const deleteRoomAccountDataSQL = "" +
+	"DELETE FROM account_data WHERE room_id = $1"
+
 type accountDataStatements struct {
-	insertAccountDataStmt       *sql.Stmt
-	selectAccountDataStmt       *sql.Stmt
-	selectAccountDataByTypeStmt *sql.Stmt
+	insertAccountDataStmt            *sql.Stmt
+	selectAccountDataStmt            *sql.Stmt
+	selectAccountDataByTypeStmt      *sql.Stmt
+	deleteRoomAccountDataStmt        *sql.Stmt
+	updateAccountDataIfUnchangedStmt *sql.Stmt
+	insertAccountDataIfAbsentStmt    *sql.Stmt
 }
 
 func (s *accountDataStatements) prepare(db *sql.DB) (err error) {
@@ -69,6 +84,15 @@ func (s *accountDataStatements) prepare(db *sql.DB) (err error) {
 	if s.selectAccountDataByTypeStmt, err = db.Prepare(selectAccountDataByTypeSQL); err != nil {
 		return
 	}
+	if s.deleteRoomAccountDataStmt, err = db.Prepare(deleteRoomAccountDataSQL); err != nil {
+		return
+	}
+	if s.updateAccountDataIfUnchangedStmt, err = db.Prepare(updateAccountDataIfUnchangedSQL); err != nil {
+		return
+	}
+	if s.insertAccountDataIfAbsentStmt, err = db.Prepare(insertAccountDataIfAbsentSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -80,6 +104,33 @@ func (s *accountDataStatements) insertAccountData(
 	return
 }
 
+// insertAccountDataIfUnchanged stores the account data if the stored data is
+// still prev, or if there is none stored and prev is nil. Returns whether it
+// was stored.
+func (s *accountDataStatements) insertAccountDataIfUnchanged(
+	ctx context.Context, txn *sql.Tx, localpart, roomID, dataType string, prev, content json.RawMessage,
+) (bool, error) {
+	var res sql.Result
+	var err error
+	if prev == nil {
+		res, err = txn.Stmt(s.insertAccountDataIfAbsentStmt).ExecContext(ctx, localpart, roomID, dataType, content)
+	} else {
+		res, err = txn.Stmt(s.updateAccountDataIfUnchangedStmt).ExecContext(ctx, content, localpart, roomID, dataType, prev)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *accountDataStatements) deleteRoomAccountData(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (err error) {
+	_, err = txn.Stmt(s.deleteRoomAccountDataStmt).ExecContext(ctx, roomID)
+	return
+}
+
 func (s *accountDataStatements) selectAccountData(
 	ctx context.Context, localpart string,
 ) (
@@ -20,6 +20,8 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 
@@ -36,33 +38,69 @@ CREATE TABLE IF NOT EXISTS account_accounts (
     -- The password hash for this account. Can be NULL if this is a passwordless account.
     password_hash TEXT,
     -- Identifies which application service this account belongs to, if any.
-    appservice_id TEXT
+    appservice_id TEXT,
+    -- Whether the account has been deactivated, in which case it can't be logged into.
+    is_deactivated BOOLEAN DEFAULT FALSE,
+    -- Whether this is a guest account which hasn't been upgraded to a full account yet.
+    is_guest BOOLEAN DEFAULT FALSE,
+    -- Whether the account belongs to a server administrator, who can use the admin API.
+    is_admin BOOLEAN DEFAULT FALSE
     -- TODO:
-    -- is_guest, is_admin, upgraded_ts, devices, any email reset stuff?
+    -- upgraded_ts, devices, any email reset stuff?
 );
+ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS is_deactivated BOOLEAN DEFAULT FALSE;
+ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS is_guest BOOLEAN DEFAULT FALSE;
+ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS is_admin BOOLEAN DEFAULT FALSE;
 -- Create sequence for autogenerated numeric usernames
 CREATE SEQUENCE IF NOT EXISTS numeric_username_seq START 1;
 `
 
 const insertAccountSQL = "" +
-	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id) VALUES ($1, $2, $3, $4)"
+	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id, is_guest) VALUES ($1, $2, $3, $4, $5)"
 
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, appservice_id FROM account_accounts WHERE localpart = $1"
+	"SELECT localpart, appservice_id, is_guest, is_deactivated, is_admin FROM account_accounts WHERE localpart = $1"
 
 const selectPasswordHashSQL = "" +
-	"SELECT password_hash FROM account_accounts WHERE localpart = $1"
+	"SELECT password_hash FROM account_accounts WHERE localpart = $1 AND is_deactivated = FALSE"
 
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT nextval('numeric_username_seq')"
 
-// TODO: Update password
+const updatePasswordSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1 WHERE localpart = $2"
+
+const deactivateAccountSQL = "" +
+	"UPDATE account_accounts SET is_deactivated = TRUE WHERE localpart = $1"
+
+const reactivateAccountSQL = "" +
+	"UPDATE account_accounts SET is_deactivated = FALSE WHERE localpart = $1"
+
+const upgradeGuestAccountSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1, is_guest = FALSE WHERE localpart = $2 AND is_guest = TRUE"
+
+const updateIsAdminSQL = "" +
+	"UPDATE account_accounts SET is_admin = $1 WHERE localpart = $2"
+
+const selectAccountsSQL = "" +
+	"SELECT localpart, appservice_id, is_guest, is_deactivated, is_admin FROM account_accounts" +
+	" ORDER BY localpart LIMIT $1 OFFSET $2"
+
+const selectAccountsCountSQL = "" +
+	"SELECT COUNT(*) FROM account_accounts"
 
 type accountsStatements struct {
 	insertAccountStmt             *sql.Stmt
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
+	updatePasswordStmt            *sql.Stmt
+	deactivateAccountStmt         *sql.Stmt
+	reactivateAccountStmt         *sql.Stmt
+	upgradeGuestAccountStmt       *sql.Stmt
+	updateIsAdminStmt             *sql.Stmt
+	selectAccountsStmt            *sql.Stmt
+	selectAccountsCountStmt       *sql.Stmt
 	serverName                    gomatrixserverlib.ServerName
 }
 
@@ -83,6 +121,27 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if s.selectNewNumericLocalpartStmt, err = db.Prepare(selectNewNumericLocalpartSQL); err != nil {
 		return
 	}
+	if s.updatePasswordStmt, err = db.Prepare(updatePasswordSQL); err != nil {
+		return
+	}
+	if s.deactivateAccountStmt, err = db.Prepare(deactivateAccountSQL); err != nil {
+		return
+	}
+	if s.reactivateAccountStmt, err = db.Prepare(reactivateAccountSQL); err != nil {
+		return
+	}
+	if s.upgradeGuestAccountStmt, err = db.Prepare(upgradeGuestAccountSQL); err != nil {
+		return
+	}
+	if s.updateIsAdminStmt, err = db.Prepare(updateIsAdminSQL); err != nil {
+		return
+	}
+	if s.selectAccountsStmt, err = db.Prepare(selectAccountsSQL); err != nil {
+		return
+	}
+	if s.selectAccountsCountStmt, err = db.Prepare(selectAccountsCountSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -91,16 +150,16 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 // this account will be passwordless. Returns an error if this account already exists. Returns the account
 // on success.
 func (s *accountsStatements) insertAccount(
-	ctx context.Context, txn *sql.Tx, localpart, hash, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, hash, appserviceID string, isGuest bool,
 ) (*api.Account, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	stmt := txn.Stmt(s.insertAccountStmt)
 
 	var err error
 	if appserviceID == "" {
-		_, err = stmt.ExecContext(ctx, localpart, createdTimeMS, hash, nil)
+		_, err = stmt.ExecContext(ctx, localpart, createdTimeMS, hash, nil, isGuest)
 	} else {
-		_, err = stmt.ExecContext(ctx, localpart, createdTimeMS, hash, appserviceID)
+		_, err = stmt.ExecContext(ctx, localpart, createdTimeMS, hash, appserviceID, isGuest)
 	}
 	if err != nil {
 		return nil, err
@@ -111,6 +170,7 @@ func (s *accountsStatements) insertAccount(
 		UserID:       userutil.MakeUserID(localpart, s.serverName),
 		ServerName:   s.serverName,
 		AppServiceID: appserviceID,
+		IsGuest:      isGuest,
 	}, nil
 }
 
@@ -121,6 +181,122 @@ func (s *accountsStatements) selectPasswordHash(
 	return
 }
 
+// updatePassword replaces the password hash of an account. Returns
+// sql.ErrNoRows if there is no such account.
+func (s *accountsStatements) updatePassword(
+	ctx context.Context, localpart, hash string,
+) error {
+	res, err := s.updatePasswordStmt.ExecContext(ctx, hash, localpart)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// deactivateAccount marks an account as deactivated. Returns sql.ErrNoRows
+// if there is no such account.
+func (s *accountsStatements) deactivateAccount(
+	ctx context.Context, localpart string,
+) error {
+	res, err := s.deactivateAccountStmt.ExecContext(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// reactivateAccount allows a deactivated account to be logged into again.
+// Returns sql.ErrNoRows if there is no such account.
+func (s *accountsStatements) reactivateAccount(
+	ctx context.Context, localpart string,
+) error {
+	res, err := s.reactivateAccountStmt.ExecContext(ctx, localpart)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// upgradeGuestAccount turns a guest account into a full account with the
+// given password hash. Returns sql.ErrNoRows if there is no such guest
+// account.
+func (s *accountsStatements) upgradeGuestAccount(
+	ctx context.Context, localpart, hash string,
+) error {
+	res, err := s.upgradeGuestAccountStmt.ExecContext(ctx, hash, localpart)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// updateIsAdmin sets whether an account belongs to a server administrator.
+// Returns sql.ErrNoRows if there is no such account.
+func (s *accountsStatements) updateIsAdmin(
+	ctx context.Context, txn *sql.Tx, localpart string, isAdmin bool,
+) error {
+	res, err := sqlutil.TxStmt(txn, s.updateIsAdminStmt).ExecContext(ctx, isAdmin, localpart)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// selectAccounts returns a page of all accounts, ordered by localpart.
+func (s *accountsStatements) selectAccounts(
+	ctx context.Context, offset, limit int,
+) ([]api.Account, error) {
+	rows, err := s.selectAccountsStmt.QueryContext(ctx, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAccounts: rows.close() failed")
+
+	accounts := []api.Account{}
+	for rows.Next() {
+		var acc api.Account
+		var appserviceIDPtr sql.NullString
+		if err = rows.Scan(&acc.Localpart, &appserviceIDPtr, &acc.IsGuest, &acc.Deactivated, &acc.IsAdmin); err != nil {
+			return nil, err
+		}
+		acc.AppServiceID = appserviceIDPtr.String
+		acc.UserID = userutil.MakeUserID(acc.Localpart, s.serverName)
+		acc.ServerName = s.serverName
+		accounts = append(accounts, acc)
+	}
+	return accounts, rows.Err()
+}
+
+func (s *accountsStatements) selectAccountsCount(ctx context.Context) (count int, err error) {
+	err = s.selectAccountsCountStmt.QueryRowContext(ctx).Scan(&count)
+	return
+}
+
 func (s *accountsStatements) selectAccountByLocalpart(
 	ctx context.Context, localpart string,
 ) (*api.Account, error) {
@@ -128,7 +304,7 @@ func (s *accountsStatements) selectAccountByLocalpart(
 	var acc api.Account
 
 	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr)
+	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr, &acc.IsGuest, &acc.Deactivated, &acc.IsAdmin)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
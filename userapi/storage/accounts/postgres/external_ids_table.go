@@ -0,0 +1,131 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const externalIDsSchema = `
+-- Maps the IDs of users in an external directory, e.g. an HR system, to the
+-- accounts which have been provisioned for them
+CREATE TABLE IF NOT EXISTS account_external_ids (
+	external_id TEXT NOT NULL PRIMARY KEY,
+	-- The localpart of the account provisioned for the user
+	localpart TEXT NOT NULL UNIQUE
+);
+`
+
+const insertExternalIDSQL = "" +
+	"INSERT INTO account_external_ids (external_id, localpart) VALUES ($1, $2)"
+
+const selectLocalpartForExternalIDSQL = "" +
+	"SELECT localpart FROM account_external_ids WHERE external_id = $1"
+
+const selectProvisionedUsersSQL = "" +
+	"SELECT e.external_id, e.localpart, COALESCE(p.display_name, ''), a.is_deactivated = FALSE" +
+	" FROM account_external_ids e" +
+	" JOIN account_accounts a ON a.localpart = e.localpart" +
+	" LEFT JOIN account_profiles p ON p.localpart = e.localpart" +
+	" ORDER BY e.external_id LIMIT $1 OFFSET $2"
+
+const selectProvisionedUsersCountSQL = "" +
+	"SELECT COUNT(*) FROM account_external_ids"
+
+type externalIDsStatements struct {
+	insertExternalIDStmt             *sql.Stmt
+	selectLocalpartForExternalIDStmt *sql.Stmt
+	selectProvisionedUsersStmt       *sql.Stmt
+	selectProvisionedUsersCountStmt  *sql.Stmt
+	serverName                       gomatrixserverlib.ServerName
+}
+
+func (s *externalIDsStatements) prepare(db *sql.DB, serverName gomatrixserverlib.ServerName) (err error) {
+	_, err = db.Exec(externalIDsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertExternalIDStmt, err = db.Prepare(insertExternalIDSQL); err != nil {
+		return
+	}
+	if s.selectLocalpartForExternalIDStmt, err = db.Prepare(selectLocalpartForExternalIDSQL); err != nil {
+		return
+	}
+	if s.selectProvisionedUsersStmt, err = db.Prepare(selectProvisionedUsersSQL); err != nil {
+		return
+	}
+	if s.selectProvisionedUsersCountStmt, err = db.Prepare(selectProvisionedUsersCountSQL); err != nil {
+		return
+	}
+	s.serverName = serverName
+	return
+}
+
+func (s *externalIDsStatements) insertExternalID(
+	ctx context.Context, txn *sql.Tx, externalID, localpart string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.insertExternalIDStmt).ExecContext(ctx, externalID, localpart)
+	return
+}
+
+// selectLocalpartForExternalID returns the localpart of the account which was
+// provisioned for the external ID, or an empty string if there isn't one.
+func (s *externalIDsStatements) selectLocalpartForExternalID(
+	ctx context.Context, externalID string,
+) (localpart string, err error) {
+	err = s.selectLocalpartForExternalIDStmt.QueryRowContext(ctx, externalID).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+// selectProvisionedUsers returns a page of the provisioned users, ordered by
+// their external IDs.
+func (s *externalIDsStatements) selectProvisionedUsers(
+	ctx context.Context, offset, limit int,
+) ([]api.ProvisionedUser, error) {
+	rows, err := s.selectProvisionedUsersStmt.QueryContext(ctx, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectProvisionedUsers: rows.close() failed")
+
+	users := []api.ProvisionedUser{}
+	for rows.Next() {
+		var user api.ProvisionedUser
+		var localpart string
+		if err = rows.Scan(&user.ExternalID, &localpart, &user.DisplayName, &user.Active); err != nil {
+			return nil, err
+		}
+		user.UserID = userutil.MakeUserID(localpart, s.serverName)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *externalIDsStatements) selectProvisionedUsersCount(
+	ctx context.Context,
+) (count int, err error) {
+	err = s.selectProvisionedUsersCountStmt.QueryRowContext(ctx).Scan(&count)
+	return
+}
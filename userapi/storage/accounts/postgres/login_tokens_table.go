@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const loginTokenSchema = `
+-- Stores the short-lived tokens which can be exchanged for an access token
+-- with an m.login.token login, e.g. after a user has logged in with SSO
+CREATE TABLE IF NOT EXISTS account_login_tokens (
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The localpart of the user who the token logs in as
+	localpart TEXT NOT NULL,
+	-- When the token stops being accepted
+	expires_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_login_tokens_expires_ts ON account_login_tokens(expires_ts);
+`
+
+const insertLoginTokenSQL = "" +
+	"INSERT INTO account_login_tokens (token, localpart, expires_ts) VALUES ($1, $2, $3)"
+
+// Tokens can only be used once, so they are deleted as they are looked up.
+const deleteLoginTokenSQL = "" +
+	"DELETE FROM account_login_tokens WHERE token = $1 RETURNING localpart, expires_ts"
+
+const deleteExpiredLoginTokensSQL = "" +
+	"DELETE FROM account_login_tokens WHERE expires_ts < $1"
+
+const deleteLoginTokensForLocalpartSQL = "" +
+	"DELETE FROM account_login_tokens WHERE localpart = $1"
+
+type loginTokenStatements struct {
+	insertLoginTokenStmt              *sql.Stmt
+	deleteLoginTokenStmt              *sql.Stmt
+	deleteExpiredLoginTokensStmt      *sql.Stmt
+	deleteLoginTokensForLocalpartStmt *sql.Stmt
+}
+
+func (s *loginTokenStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(loginTokenSchema)
+	if err != nil {
+		return
+	}
+	if s.insertLoginTokenStmt, err = db.Prepare(insertLoginTokenSQL); err != nil {
+		return
+	}
+	if s.deleteLoginTokenStmt, err = db.Prepare(deleteLoginTokenSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredLoginTokensStmt, err = db.Prepare(deleteExpiredLoginTokensSQL); err != nil {
+		return
+	}
+	if s.deleteLoginTokensForLocalpartStmt, err = db.Prepare(deleteLoginTokensForLocalpartSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *loginTokenStatements) insertLoginToken(
+	ctx context.Context, txn *sql.Tx, token, localpart string, expiresTS gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.insertLoginTokenStmt).ExecContext(ctx, token, localpart, expiresTS)
+	return
+}
+
+// deleteLoginToken deletes a token, returning the localpart which it was
+// issued to if it hadn't expired, or an empty string if it had or there is no
+// such token.
+func (s *loginTokenStatements) deleteLoginToken(
+	ctx context.Context, txn *sql.Tx, token string, now gomatrixserverlib.Timestamp,
+) (string, error) {
+	var localpart string
+	var expiresTS gomatrixserverlib.Timestamp
+	err := sqlutil.TxStmt(txn, s.deleteLoginTokenStmt).QueryRowContext(ctx, token).Scan(&localpart, &expiresTS)
+	if err == sql.ErrNoRows || (err == nil && expiresTS < now) {
+		return "", nil
+	}
+	return localpart, err
+}
+
+func (s *loginTokenStatements) deleteExpiredLoginTokens(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteExpiredLoginTokensStmt).ExecContext(ctx, before)
+	return
+}
+
+func (s *loginTokenStatements) deleteLoginTokensForLocalpart(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteLoginTokensForLocalpartStmt).ExecContext(ctx, localpart)
+	return
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const registrationTokensSchema = `
+-- Stores the tokens which admins have created to let people register
+CREATE TABLE IF NOT EXISTS account_registration_tokens (
+	token TEXT NOT NULL PRIMARY KEY,
+	-- How many registrations the token can be used for, or NULL for no limit
+	uses_allowed INTEGER,
+	-- How many registrations have been completed with the token
+	completed INTEGER NOT NULL DEFAULT 0,
+	-- When the token stops being accepted, or NULL if it never expires
+	expiry_time BIGINT
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO account_registration_tokens (token, uses_allowed, expiry_time) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (token) DO NOTHING"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM account_registration_tokens WHERE token = $1"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM account_registration_tokens ORDER BY token"
+
+const updateRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET uses_allowed = $1, expiry_time = $2 WHERE token = $3"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM account_registration_tokens WHERE token = $1"
+
+// Only counts the registration if the token is still valid, so that two
+// registrations can't both use the last use of a token.
+const useRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed + 1" +
+	" WHERE token = $1 AND (uses_allowed IS NULL OR completed < uses_allowed)" +
+	" AND (expiry_time IS NULL OR expiry_time > $2)"
+
+const releaseRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET completed = completed - 1 WHERE token = $1 AND completed > 0"
+
+type registrationTokensStatements struct {
+	insertRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokensStmt *sql.Stmt
+	updateRegistrationTokenStmt  *sql.Stmt
+	deleteRegistrationTokenStmt  *sql.Stmt
+	useRegistrationTokenStmt     *sql.Stmt
+	releaseRegistrationTokenStmt *sql.Stmt
+}
+
+func (s *registrationTokensStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(registrationTokensSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRegistrationTokenStmt, err = db.Prepare(insertRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokenStmt, err = db.Prepare(selectRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokensStmt, err = db.Prepare(selectRegistrationTokensSQL); err != nil {
+		return
+	}
+	if s.updateRegistrationTokenStmt, err = db.Prepare(updateRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.deleteRegistrationTokenStmt, err = db.Prepare(deleteRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.useRegistrationTokenStmt, err = db.Prepare(useRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.releaseRegistrationTokenStmt, err = db.Prepare(releaseRegistrationTokenSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertRegistrationToken stores a new token, returning false if there is
+// already a token with the same value.
+func (s *registrationTokensStatements) insertRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token *authtypes.RegistrationToken,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.insertRegistrationTokenStmt).ExecContext(
+		ctx, token.Token, nullInt32(token.UsesAllowed), nullTimestamp(token.ExpiryTime),
+	)
+	return rowAffected(res, err)
+}
+
+func (s *registrationTokensStatements) selectRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (*authtypes.RegistrationToken, error) {
+	t, err := scanRegistrationToken(sqlutil.TxStmt(txn, s.selectRegistrationTokenStmt).QueryRowContext(ctx, token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (s *registrationTokensStatements) selectRegistrationTokens(
+	ctx context.Context,
+) ([]authtypes.RegistrationToken, error) {
+	rows, err := s.selectRegistrationTokensStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRegistrationTokens: rows.close() failed")
+
+	tokens := []authtypes.RegistrationToken{}
+	for rows.Next() {
+		t, err := scanRegistrationToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *registrationTokensStatements) updateRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token *authtypes.RegistrationToken,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.updateRegistrationTokenStmt).ExecContext(
+		ctx, nullInt32(token.UsesAllowed), nullTimestamp(token.ExpiryTime), token.Token,
+	)
+	return
+}
+
+// deleteRegistrationToken deletes a token, returning false if there was no
+// such token.
+func (s *registrationTokensStatements) deleteRegistrationToken(
+	ctx context.Context, token string,
+) (bool, error) {
+	return rowAffected(s.deleteRegistrationTokenStmt.ExecContext(ctx, token))
+}
+
+// useRegistrationToken counts a registration against a token, returning false
+// if the token doesn't exist, has been used up or has expired.
+func (s *registrationTokensStatements) useRegistrationToken(
+	ctx context.Context, token string, now gomatrixserverlib.Timestamp,
+) (bool, error) {
+	return rowAffected(s.useRegistrationTokenStmt.ExecContext(ctx, token, now))
+}
+
+func (s *registrationTokensStatements) releaseRegistrationToken(
+	ctx context.Context, token string,
+) (err error) {
+	_, err = s.releaseRegistrationTokenStmt.ExecContext(ctx, token)
+	return
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRegistrationToken(row rowScanner) (*authtypes.RegistrationToken, error) {
+	var t authtypes.RegistrationToken
+	var usesAllowed, expiryTime sql.NullInt64
+	if err := row.Scan(&t.Token, &usesAllowed, &t.Completed, &expiryTime); err != nil {
+		return nil, err
+	}
+	if usesAllowed.Valid {
+		n := int32(usesAllowed.Int64)
+		t.UsesAllowed = &n
+	}
+	if expiryTime.Valid {
+		ts := gomatrixserverlib.Timestamp(expiryTime.Int64)
+		t.ExpiryTime = &ts
+	}
+	return &t, nil
+}
+
+func nullInt32(n *int32) sql.NullInt64 {
+	if n == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*n), Valid: true}
+}
+
+func nullTimestamp(ts *gomatrixserverlib.Timestamp) sql.NullInt64 {
+	if ts == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*ts), Valid: true}
+}
+
+func rowAffected(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -18,10 +18,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"errors"
 	"strconv"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -35,11 +36,19 @@ import (
 type Database struct {
 	db *sql.DB
 	sqlutil.PartitionOffsetStatements
-	accounts     accountsStatements
-	profiles     profilesStatements
-	accountDatas accountDataStatements
-	threepids    threepidStatements
-	serverName   gomatrixserverlib.ServerName
+	accounts      accountsStatements
+	profiles      profilesStatements
+	accountDatas  accountDataStatements
+	threepids     threepidStatements
+	loginFailures loginFailuresStatements
+	pushers       pushersStatements
+	sessions      threepidSessionsStatements
+	openIDTokens  openIDTokenStatements
+	loginTokens   loginTokenStatements
+	externalIDs   externalIDsStatements
+	ssoIdentities ssoIdentitiesStatements
+	regTokens     registrationTokensStatements
+	serverName    gomatrixserverlib.ServerName
 }
 
 // NewDatabase creates a new accounts and profiles database
@@ -69,7 +78,39 @@ func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties, serve
 	if err = t.prepare(db); err != nil {
 		return nil, err
 	}
-	return &Database{db, partitions, a, p, ac, t, serverName}, nil
+	lf := loginFailuresStatements{}
+	if err = lf.prepare(db); err != nil {
+		return nil, err
+	}
+	ps := pushersStatements{}
+	if err = ps.prepare(db); err != nil {
+		return nil, err
+	}
+	ts := threepidSessionsStatements{}
+	if err = ts.prepare(db); err != nil {
+		return nil, err
+	}
+	ot := openIDTokenStatements{}
+	if err = ot.prepare(db, serverName); err != nil {
+		return nil, err
+	}
+	lt := loginTokenStatements{}
+	if err = lt.prepare(db); err != nil {
+		return nil, err
+	}
+	ei := externalIDsStatements{}
+	if err = ei.prepare(db, serverName); err != nil {
+		return nil, err
+	}
+	si := ssoIdentitiesStatements{}
+	if err = si.prepare(db); err != nil {
+		return nil, err
+	}
+	rt := registrationTokensStatements{}
+	if err = rt.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, partitions, a, p, ac, t, lf, ps, ts, ot, lt, ei, si, rt, serverName}, nil
 }
 
 // GetAccountByPassword returns the account associated with the given localpart and password.
@@ -87,6 +128,45 @@ func (d *Database) GetAccountByPassword(
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
 
+// SetPassword replaces the password of the account with the given localpart.
+// Returns sql.ErrNoRows if no account exists which matches the given localpart.
+func (d *Database) SetPassword(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return d.accounts.updatePassword(ctx, localpart, hash)
+}
+
+// UpgradeGuestAccount turns the guest account with the given localpart into a
+// full account which can be logged into with the password. Returns
+// sql.ErrNoRows if no guest account exists which matches the given localpart.
+func (d *Database) UpgradeGuestAccount(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return d.accounts.upgradeGuestAccount(ctx, localpart, hash)
+}
+
+// DeactivateAccount marks the account with the given localpart as deactivated,
+// so that it can no longer be logged into. Returns sql.ErrNoRows if no account
+// exists which matches the given localpart.
+func (d *Database) DeactivateAccount(ctx context.Context, localpart string) error {
+	return d.accounts.deactivateAccount(ctx, localpart)
+}
+
+// ReactivateAccount allows the deactivated account with the given localpart to
+// be logged into again. Returns sql.ErrNoRows if no account exists which
+// matches the given localpart.
+func (d *Database) ReactivateAccount(ctx context.Context, localpart string) error {
+	return d.accounts.reactivateAccount(ctx, localpart)
+}
+
 // GetProfileByLocalpart returns the profile associated with the given localpart.
 // Returns sql.ErrNoRows if no profile exists which matches the given localpart.
 func (d *Database) GetProfileByLocalpart(
@@ -121,7 +201,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", true)
 		return err
 	})
 	return acc, err
@@ -134,14 +214,106 @@ func (d *Database) CreateAccount(
 	ctx context.Context, localpart, plaintextPassword, appserviceID string,
 ) (acc *api.Account, err error) {
 	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, false)
 		return err
 	})
 	return
 }
 
+// CreateAdminAccount makes a new account in the same way as CreateAccount,
+// which belongs to a server administrator from the start. If the account
+// already exists, it will return nil, ErrUserExists.
+func (d *Database) CreateAdminAccount(
+	ctx context.Context, localpart, plaintextPassword string,
+) (acc *api.Account, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, "", false)
+		if err != nil {
+			return err
+		}
+		acc.IsAdmin = true
+		return d.accounts.updateIsAdmin(ctx, txn, localpart, true)
+	})
+	return
+}
+
+// CreateProvisionedAccount makes a new account in the same way as CreateAccount,
+// and records that it was provisioned for the given external ID. If the
+// account already exists, it will return nil, ErrUserExists.
+func (d *Database) CreateProvisionedAccount(
+	ctx context.Context, externalID, localpart, plaintextPassword string,
+) (acc *api.Account, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, "", false)
+		if err != nil {
+			return err
+		}
+		return d.externalIDs.insertExternalID(ctx, txn, externalID, localpart)
+	})
+	return
+}
+
+// CreateSSOAccount makes a new passwordless account in the same way as
+// CreateAccount, and records that the user of the identity provider with the
+// given subject logs in as it. If the account already exists, it will return
+// nil, ErrUserExists.
+func (d *Database) CreateSSOAccount(
+	ctx context.Context, idpID, subject, localpart string,
+) (acc *api.Account, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", false)
+		if err != nil {
+			return err
+		}
+		return d.ssoIdentities.insertSSOIdentity(ctx, txn, idpID, subject, localpart)
+	})
+	return
+}
+
+// GetLocalpartForSSOIdentity returns the localpart of the account which the
+// user of the identity provider with the given subject logs in as, or an
+// empty string if there isn't one.
+func (d *Database) GetLocalpartForSSOIdentity(ctx context.Context, idpID, subject string) (string, error) {
+	return d.ssoIdentities.selectLocalpartForSSOIdentity(ctx, idpID, subject)
+}
+
+// GetLocalpartForExternalID returns the localpart of the account which was
+// provisioned for the external ID, or an empty string if there isn't one.
+func (d *Database) GetLocalpartForExternalID(ctx context.Context, externalID string) (string, error) {
+	return d.externalIDs.selectLocalpartForExternalID(ctx, externalID)
+}
+
+// GetProvisionedUsers returns a page of the accounts which were provisioned
+// for external IDs, ordered by external ID, along with the total number of
+// them.
+func (d *Database) GetProvisionedUsers(ctx context.Context, offset, limit int) ([]api.ProvisionedUser, int, error) {
+	users, err := d.externalIDs.selectProvisionedUsers(ctx, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := d.externalIDs.selectProvisionedUsersCount(ctx)
+	return users, total, err
+}
+
+// SetAdmin sets whether an account belongs to a server administrator.
+// Returns sql.ErrNoRows if there is no such account.
+func (d *Database) SetAdmin(ctx context.Context, localpart string, isAdmin bool) error {
+	return d.accounts.updateIsAdmin(ctx, nil, localpart, isAdmin)
+}
+
+// GetAccounts returns a page of all of the accounts, ordered by localpart,
+// along with the total number of accounts.
+func (d *Database) GetAccounts(ctx context.Context, offset, limit int) ([]api.Account, int, error) {
+	accounts, err := d.accounts.selectAccounts(ctx, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := d.accounts.selectAccountsCount(ctx)
+	return accounts, total, err
+}
+
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, isGuest bool,
 ) (*api.Account, error) {
 	var err error
 
@@ -160,18 +332,16 @@ func (d *Database) createAccount(
 		return nil, err
 	}
 
-	if err := d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", json.RawMessage(`{
-		"global": {
-			"content": [],
-			"override": [],
-			"room": [],
-			"sender": [],
-			"underride": []
-		}
-	}`)); err != nil {
+	// The server-default push rules aren't stored until they are changed, so
+	// new accounts start off without any push rules of their own.
+	pushRules, err := json.Marshal(&pushrules.AccountRuleSets{})
+	if err != nil {
 		return nil, err
 	}
-	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
+	if err := d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", pushRules); err != nil {
+		return nil, err
+	}
+	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, isGuest)
 }
 
 // SaveAccountData saves new account data for a given user and a given room.
@@ -187,6 +357,27 @@ func (d *Database) SaveAccountData(
 	})
 }
 
+// SaveAccountDataIfUnchanged saves new account data for a given user and a
+// given room, as long as the stored account data is still prev, which is nil
+// if there wasn't any. Returns false without saving anything if it has been
+// changed since.
+func (d *Database) SaveAccountDataIfUnchanged(
+	ctx context.Context, localpart, roomID, dataType string, prev, content json.RawMessage,
+) (saved bool, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		saved, err = d.accountDatas.insertAccountDataIfUnchanged(ctx, txn, localpart, roomID, dataType, prev, content)
+		return err
+	})
+	return
+}
+
+// RemoveRoomAccountData deletes every user's account data for a room.
+func (d *Database) RemoveRoomAccountData(ctx context.Context, roomID string) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.accountDatas.deleteRoomAccountData(ctx, txn, roomID)
+	})
+}
+
 // GetAccountData returns account data related to a given localpart
 // If no account data could be found, returns an empty arrays
 // Returns an error if there was an issue with the retrieval
@@ -224,7 +415,7 @@ func hashPassword(plaintext string) (hash string, err error) {
 
 // Err3PIDInUse is the error returned when trying to save an association involving
 // a third-party identifier which is already associated to a local user.
-var Err3PIDInUse = errors.New("This third-party identifier is already in use")
+var Err3PIDInUse = sqlutil.Err3PIDInUse
 
 // SaveThreePIDAssociation saves the association between a third party identifier
 // and a local Matrix user (identified by the user's ID's local part).
@@ -245,7 +436,13 @@ func (d *Database) SaveThreePIDAssociation(
 			return Err3PIDInUse
 		}
 
-		return d.threepids.insertThreePID(ctx, txn, threepid, medium, localpart)
+		// The identifier may have been associated by another request since
+		// it was looked up.
+		err = d.threepids.insertThreePID(ctx, txn, threepid, medium, localpart)
+		if sqlutil.IsUniqueConstraintViolationErr(err) {
+			return Err3PIDInUse
+		}
+		return err
 	})
 }
 
@@ -298,3 +495,195 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 ) (*api.Account, error) {
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
+
+// GetLoginFailures returns the number of failed login attempts recorded
+// against the given key since the given time, along with when the most
+// recent one happened.
+func (d *Database) GetLoginFailures(
+	ctx context.Context, kind, key string, since gomatrixserverlib.Timestamp,
+) (int, gomatrixserverlib.Timestamp, error) {
+	return d.loginFailures.selectLoginFailures(ctx, kind, key, since)
+}
+
+// RecordLoginFailure records a failed login attempt against the given key.
+// Failures from before windowStart are forgotten.
+func (d *Database) RecordLoginFailure(
+	ctx context.Context, kind, key string, now, windowStart gomatrixserverlib.Timestamp,
+) error {
+	if err := d.loginFailures.upsertLoginFailure(ctx, kind, key, now, windowStart); err != nil {
+		return err
+	}
+	return d.loginFailures.deleteExpiredLoginFailures(ctx, windowStart)
+}
+
+// ResetLoginFailures forgets all failed login attempts against the given key.
+func (d *Database) ResetLoginFailures(ctx context.Context, kind, key string) error {
+	return d.loginFailures.deleteLoginFailures(ctx, kind, key)
+}
+
+// UpsertPusher stores a pusher for the given localpart, replacing any pusher
+// that they have with the same app ID and push key. Unless appending, the
+// pushers of other users with the same app ID and push key are removed.
+func (d *Database) UpsertPusher(
+	ctx context.Context, localpart string, pusher api.Pusher, appendPusher bool,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if !appendPusher {
+			if err := d.pushers.deleteOtherUsersPushers(ctx, txn, localpart, pusher.AppID, pusher.PushKey); err != nil {
+				return err
+			}
+		}
+		return d.pushers.upsertPusher(ctx, txn, localpart, pusher)
+	})
+}
+
+// RemovePusher removes the pusher of the given localpart with the given app
+// ID and push key.
+func (d *Database) RemovePusher(ctx context.Context, localpart, appID, pushKey string) error {
+	return d.pushers.deletePusher(ctx, nil, localpart, appID, pushKey)
+}
+
+// GetPushers returns the pushers of the given localpart.
+func (d *Database) GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error) {
+	return d.pushers.selectPushers(ctx, localpart)
+}
+
+// SaveThreePIDSession stores a session validating a third-party identifier,
+// replacing the session with the same ID if there is one. Expired sessions
+// are removed at the same time.
+func (d *Database) SaveThreePIDSession(ctx context.Context, session *authtypes.ThreePIDSession) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.sessions.deleteExpiredThreePIDSessions(ctx, txn, gomatrixserverlib.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+		return d.sessions.upsertThreePIDSession(ctx, txn, session)
+	})
+}
+
+// GetThreePIDSession returns the session with the given ID, or nil if there
+// isn't one.
+func (d *Database) GetThreePIDSession(ctx context.Context, sessionID string) (*authtypes.ThreePIDSession, error) {
+	return d.sessions.selectThreePIDSession(ctx, sessionID)
+}
+
+// GetThreePIDSessionByClientSecret returns the session which the client with
+// the given secret started for the third-party identifier, or nil if there
+// isn't one.
+func (d *Database) GetThreePIDSessionByClientSecret(
+	ctx context.Context, clientSecret, medium, address string,
+) (*authtypes.ThreePIDSession, error) {
+	return d.sessions.selectThreePIDSessionByClientSecret(ctx, clientSecret, medium, address)
+}
+
+// RemoveThreePIDSession removes the session with the given ID. Returns false
+// if there was no such session, e.g. because it has already been removed.
+func (d *Database) RemoveThreePIDSession(ctx context.Context, sessionID string) (bool, error) {
+	return d.sessions.deleteThreePIDSession(ctx, sessionID)
+}
+
+// CreateOpenIDToken stores an OpenID token issued to the given localpart.
+// Expired tokens are removed at the same time.
+func (d *Database) CreateOpenIDToken(
+	ctx context.Context, token, localpart string, expiresTS gomatrixserverlib.Timestamp,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.openIDTokens.deleteExpiredOpenIDTokens(ctx, txn, gomatrixserverlib.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+		return d.openIDTokens.insertOpenIDToken(ctx, txn, token, localpart, expiresTS)
+	})
+}
+
+// GetOpenIDTokenAttributes returns the attributes of an OpenID token, or nil
+// if there is no such token.
+func (d *Database) GetOpenIDTokenAttributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error) {
+	return d.openIDTokens.selectOpenIDToken(ctx, token)
+}
+
+// CreateLoginToken stores a login token issued to the given localpart.
+// Expired tokens are removed at the same time.
+func (d *Database) CreateLoginToken(
+	ctx context.Context, token, localpart string, expiresTS gomatrixserverlib.Timestamp,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.loginTokens.deleteExpiredLoginTokens(ctx, txn, gomatrixserverlib.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+		return d.loginTokens.insertLoginToken(ctx, txn, token, localpart, expiresTS)
+	})
+}
+
+// ConsumeLoginToken returns the localpart which a login token was issued to
+// and deletes the token, so that it can't be used again. Returns an empty
+// string if there is no such token or it has expired.
+func (d *Database) ConsumeLoginToken(ctx context.Context, token string) (localpart string, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		localpart, err = d.loginTokens.deleteLoginToken(ctx, txn, token, gomatrixserverlib.AsTimestamp(time.Now()))
+		return err
+	})
+	return
+}
+
+// RemoveLoginTokensForLocalpart deletes all of the login tokens issued to the
+// given localpart, e.g. because the account has been deactivated.
+func (d *Database) RemoveLoginTokensForLocalpart(ctx context.Context, localpart string) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.loginTokens.deleteLoginTokensForLocalpart(ctx, txn, localpart)
+	})
+}
+
+// CreateRegistrationToken stores a new registration token. Returns false if
+// there is already a token with the same value.
+func (d *Database) CreateRegistrationToken(ctx context.Context, token *authtypes.RegistrationToken) (bool, error) {
+	return d.regTokens.insertRegistrationToken(ctx, nil, token)
+}
+
+// GetRegistrationToken returns the registration token with the given value,
+// or nil if there isn't one.
+func (d *Database) GetRegistrationToken(ctx context.Context, token string) (*authtypes.RegistrationToken, error) {
+	return d.regTokens.selectRegistrationToken(ctx, nil, token)
+}
+
+// GetRegistrationTokens returns all of the registration tokens.
+func (d *Database) GetRegistrationTokens(ctx context.Context) ([]authtypes.RegistrationToken, error) {
+	return d.regTokens.selectRegistrationTokens(ctx)
+}
+
+// UpdateRegistrationToken replaces the use limit and expiry time of a
+// registration token, returning the updated token or nil if there is no such
+// token.
+func (d *Database) UpdateRegistrationToken(
+	ctx context.Context, token string, usesAllowed *int32, expiryTime *gomatrixserverlib.Timestamp,
+) (updated *authtypes.RegistrationToken, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		err = d.regTokens.updateRegistrationToken(ctx, txn, &authtypes.RegistrationToken{
+			Token:       token,
+			UsesAllowed: usesAllowed,
+			ExpiryTime:  expiryTime,
+		})
+		if err != nil {
+			return err
+		}
+		updated, err = d.regTokens.selectRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+// RemoveRegistrationToken deletes a registration token. Returns false if
+// there was no such token.
+func (d *Database) RemoveRegistrationToken(ctx context.Context, token string) (bool, error) {
+	return d.regTokens.deleteRegistrationToken(ctx, token)
+}
+
+// UseRegistrationToken counts a completed registration against a token.
+// Returns false if the token doesn't exist, has been used up or has expired.
+func (d *Database) UseRegistrationToken(ctx context.Context, token string) (bool, error) {
+	return d.regTokens.useRegistrationToken(ctx, token, gomatrixserverlib.AsTimestamp(time.Now()))
+}
+
+// ReleaseRegistrationToken undoes UseRegistrationToken, for when the
+// registration failed after the token was counted.
+func (d *Database) ReleaseRegistrationToken(ctx context.Context, token string) error {
+	return d.regTokens.releaseRegistrationToken(ctx, token)
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// Accounts tables created before accounts could be deactivated, be guests or
+// be admins get the columns added when they are opened.
+func TestAccountsTableMigration(t *testing.T) {
+	dataSourceName := "file:" + filepath.Join(t.TempDir(), "account.db")
+	cs, err := sqlutil.ParseFileURI(dataSourceName)
+	if err != nil {
+		t.Fatalf("failed to parse data source name: %s", err)
+	}
+	db, err := sqlutil.Open(sqlutil.SQLiteDriverName(), cs, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	_, err = db.Exec(`
+	  CREATE TABLE account_accounts (
+	    localpart TEXT NOT NULL PRIMARY KEY,
+	    created_ts BIGINT NOT NULL,
+	    password_hash TEXT,
+	    appservice_id TEXT
+	  );
+	  INSERT INTO account_accounts (localpart, created_ts) VALUES ('alice', 0);
+	`)
+	if err != nil {
+		t.Fatalf("failed to create the old accounts table: %s", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err)
+	}
+
+	d, err := NewDatabase(dataSourceName, "localhost")
+	if err != nil {
+		t.Fatalf("failed to open the old database: %s", err)
+	}
+	acc, err := d.GetAccountByLocalpart(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("GetAccountByLocalpart failed: %s", err)
+	}
+	if acc.Deactivated || acc.IsGuest || acc.IsAdmin {
+		t.Fatalf("expected an existing account to be an active, full, non-admin account, got %+v", acc)
+	}
+}
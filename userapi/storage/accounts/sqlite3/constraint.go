@@ -23,5 +23,6 @@ import (
 )
 
 func isConstraintError(err error) bool {
-	return errors.Is(err, sqlite3.ErrConstraint)
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint
 }
@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const loginFailuresSchema = `
+-- Stores the number of recent failed login attempts, per account or per IP address
+CREATE TABLE IF NOT EXISTS account_login_failures (
+	-- What the failures are counted against, either 'account' or 'ip'
+	kind TEXT NOT NULL,
+	-- The localpart or IP address that the failures are counted against
+	key TEXT NOT NULL,
+	-- The number of failures since the counter was last reset
+	failure_count INTEGER NOT NULL,
+	-- When the most recent failure happened
+	last_failure_ts BIGINT NOT NULL,
+
+	PRIMARY KEY(kind, key)
+);
+
+CREATE INDEX IF NOT EXISTS account_login_failures_last_failure_ts ON account_login_failures(last_failure_ts);
+`
+
+// If the last failure fell outside of the window then the counter starts
+// again from one.
+const upsertLoginFailureSQL = "" +
+	"INSERT INTO account_login_failures (kind, key, failure_count, last_failure_ts) VALUES ($1, $2, 1, $3)" +
+	" ON CONFLICT (kind, key) DO UPDATE SET" +
+	" failure_count = CASE WHEN account_login_failures.last_failure_ts < $4 THEN 1 ELSE account_login_failures.failure_count + 1 END," +
+	" last_failure_ts = $3"
+
+const selectLoginFailuresSQL = "" +
+	"SELECT failure_count, last_failure_ts FROM account_login_failures" +
+	" WHERE kind = $1 AND key = $2 AND last_failure_ts >= $3"
+
+const deleteLoginFailuresSQL = "" +
+	"DELETE FROM account_login_failures WHERE kind = $1 AND key = $2"
+
+const deleteExpiredLoginFailuresSQL = "" +
+	"DELETE FROM account_login_failures WHERE last_failure_ts < $1"
+
+type loginFailuresStatements struct {
+	upsertLoginFailureStmt         *sql.Stmt
+	selectLoginFailuresStmt        *sql.Stmt
+	deleteLoginFailuresStmt        *sql.Stmt
+	deleteExpiredLoginFailuresStmt *sql.Stmt
+}
+
+func (s *loginFailuresStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(loginFailuresSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertLoginFailureStmt, err = db.Prepare(upsertLoginFailureSQL); err != nil {
+		return
+	}
+	if s.selectLoginFailuresStmt, err = db.Prepare(selectLoginFailuresSQL); err != nil {
+		return
+	}
+	if s.deleteLoginFailuresStmt, err = db.Prepare(deleteLoginFailuresSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredLoginFailuresStmt, err = db.Prepare(deleteExpiredLoginFailuresSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *loginFailuresStatements) upsertLoginFailure(
+	ctx context.Context, kind, key string, now, windowStart gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = s.upsertLoginFailureStmt.ExecContext(ctx, kind, key, now, windowStart)
+	return
+}
+
+func (s *loginFailuresStatements) selectLoginFailures(
+	ctx context.Context, kind, key string, since gomatrixserverlib.Timestamp,
+) (count int, lastFailure gomatrixserverlib.Timestamp, err error) {
+	err = s.selectLoginFailuresStmt.QueryRowContext(ctx, kind, key, since).Scan(&count, &lastFailure)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return
+}
+
+func (s *loginFailuresStatements) deleteLoginFailures(
+	ctx context.Context, kind, key string,
+) (err error) {
+	_, err = s.deleteLoginFailuresStmt.ExecContext(ctx, kind, key)
+	return
+}
+
+func (s *loginFailuresStatements) deleteExpiredLoginFailures(
+	ctx context.Context, before gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = s.deleteExpiredLoginFailuresStmt.ExecContext(ctx, before)
+	return
+}
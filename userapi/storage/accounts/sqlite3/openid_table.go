@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const openIDTokenSchema = `
+-- Stores the OpenID tokens which users have requested, so that other servers
+-- can look up which user a token was issued to
+CREATE TABLE IF NOT EXISTS account_openid_tokens (
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The localpart of the user who requested the token
+	localpart TEXT NOT NULL,
+	-- When the token stops being accepted
+	expires_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_openid_tokens_expires_ts ON account_openid_tokens(expires_ts);
+`
+
+const insertOpenIDTokenSQL = "" +
+	"INSERT INTO account_openid_tokens (token, localpart, expires_ts) VALUES ($1, $2, $3)"
+
+const selectOpenIDTokenSQL = "" +
+	"SELECT localpart, expires_ts FROM account_openid_tokens WHERE token = $1"
+
+const deleteExpiredOpenIDTokensSQL = "" +
+	"DELETE FROM account_openid_tokens WHERE expires_ts < $1"
+
+type openIDTokenStatements struct {
+	insertOpenIDTokenStmt         *sql.Stmt
+	selectOpenIDTokenStmt         *sql.Stmt
+	deleteExpiredOpenIDTokensStmt *sql.Stmt
+	serverName                    gomatrixserverlib.ServerName
+}
+
+func (s *openIDTokenStatements) prepare(db *sql.DB, serverName gomatrixserverlib.ServerName) (err error) {
+	_, err = db.Exec(openIDTokenSchema)
+	if err != nil {
+		return
+	}
+	if s.insertOpenIDTokenStmt, err = db.Prepare(insertOpenIDTokenSQL); err != nil {
+		return
+	}
+	if s.selectOpenIDTokenStmt, err = db.Prepare(selectOpenIDTokenSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredOpenIDTokensStmt, err = db.Prepare(deleteExpiredOpenIDTokensSQL); err != nil {
+		return
+	}
+	s.serverName = serverName
+	return
+}
+
+func (s *openIDTokenStatements) insertOpenIDToken(
+	ctx context.Context, txn *sql.Tx, token, localpart string, expiresTS gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.insertOpenIDTokenStmt).ExecContext(ctx, token, localpart, expiresTS)
+	return
+}
+
+// selectOpenIDToken returns the attributes of the token, or nil if there is
+// no such token.
+func (s *openIDTokenStatements) selectOpenIDToken(
+	ctx context.Context, token string,
+) (*api.OpenIDTokenAttributes, error) {
+	var localpart string
+	var attributes api.OpenIDTokenAttributes
+	err := s.selectOpenIDTokenStmt.QueryRowContext(ctx, token).Scan(&localpart, &attributes.ExpiresTS)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	attributes.UserID = userutil.MakeUserID(localpart, s.serverName)
+	return &attributes, nil
+}
+
+func (s *openIDTokenStatements) deleteExpiredOpenIDTokens(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteExpiredOpenIDTokensStmt).ExecContext(ctx, before)
+	return
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const pushersSchema = `
+-- Stores the push gateways which are sent notifications for each account
+CREATE TABLE IF NOT EXISTS account_pushers (
+	-- The Matrix user ID localpart for this account
+	localpart TEXT NOT NULL,
+	-- The device which set the pusher
+	device_id TEXT NOT NULL,
+	-- The kind of pusher, e.g. 'http'
+	kind TEXT NOT NULL,
+	-- Identifies the application the pusher is for
+	app_id TEXT NOT NULL,
+	app_display_name TEXT NOT NULL,
+	device_display_name TEXT NOT NULL,
+	-- Identifies the device to the push gateway
+	pushkey TEXT NOT NULL,
+	profile_tag TEXT NOT NULL,
+	lang TEXT NOT NULL,
+	-- The JSON data which is sent to the push gateway with notifications
+	data TEXT NOT NULL,
+
+	PRIMARY KEY(localpart, app_id, pushkey)
+);
+
+CREATE INDEX IF NOT EXISTS account_pushers_app_id_pushkey ON account_pushers(app_id, pushkey);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO account_pushers (localpart, device_id, kind, app_id, app_display_name, device_display_name, pushkey, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT (localpart, app_id, pushkey) DO UPDATE SET" +
+	" device_id = $2, kind = $3, app_display_name = $5, device_display_name = $6, profile_tag = $8, lang = $9, data = $10"
+
+const deletePusherSQL = "" +
+	"DELETE FROM account_pushers WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const deleteOtherUsersPushersSQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart != $3"
+
+const selectPushersSQL = "" +
+	"SELECT device_id, kind, app_id, app_display_name, device_display_name, pushkey, profile_tag, lang, data" +
+	" FROM account_pushers WHERE localpart = $1"
+
+type pushersStatements struct {
+	upsertPusherStmt            *sql.Stmt
+	deletePusherStmt            *sql.Stmt
+	deleteOtherUsersPushersStmt *sql.Stmt
+	selectPushersStmt           *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pushersSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deleteOtherUsersPushersStmt, err = db.Prepare(deleteOtherUsersPushersSQL); err != nil {
+		return
+	}
+	if s.selectPushersStmt, err = db.Prepare(selectPushersSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, txn *sql.Tx, localpart string, pusher api.Pusher,
+) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.upsertPusherStmt).ExecContext(
+		ctx, localpart, pusher.DeviceID, pusher.Kind, pusher.AppID, pusher.AppDisplayName,
+		pusher.DeviceDisplayName, pusher.PushKey, pusher.ProfileTag, pusher.Language, data,
+	)
+	return err
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deletePusherStmt).ExecContext(ctx, localpart, appID, pushKey)
+	return
+}
+
+func (s *pushersStatements) deleteOtherUsersPushers(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteOtherUsersPushersStmt).ExecContext(ctx, appID, pushKey, localpart)
+	return
+}
+
+func (s *pushersStatements) selectPushers(
+	ctx context.Context, localpart string,
+) ([]api.Pusher, error) {
+	rows, err := s.selectPushersStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPushers: rows.close() failed")
+
+	pushers := []api.Pusher{}
+	for rows.Next() {
+		var pusher api.Pusher
+		var data []byte
+		if err = rows.Scan(
+			&pusher.DeviceID, &pusher.Kind, &pusher.AppID, &pusher.AppDisplayName,
+			&pusher.DeviceDisplayName, &pusher.PushKey, &pusher.ProfileTag, &pusher.Language, &data,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
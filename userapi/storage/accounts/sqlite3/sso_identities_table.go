@@ -0,0 +1,81 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const ssoIdentitiesSchema = `
+-- Maps the users of single sign-on identity providers to the accounts which
+-- they log in as
+CREATE TABLE IF NOT EXISTS account_sso_identities (
+	-- The ID of the identity provider in the config
+	idp_id TEXT NOT NULL,
+	-- The ID which the identity provider knows the user by
+	subject TEXT NOT NULL,
+	-- The localpart of the account which the user logs in as
+	localpart TEXT NOT NULL,
+	PRIMARY KEY (idp_id, subject)
+);
+`
+
+const insertSSOIdentitySQL = "" +
+	"INSERT INTO account_sso_identities (idp_id, subject, localpart) VALUES ($1, $2, $3)"
+
+const selectLocalpartForSSOIdentitySQL = "" +
+	"SELECT localpart FROM account_sso_identities WHERE idp_id = $1 AND subject = $2"
+
+type ssoIdentitiesStatements struct {
+	insertSSOIdentityStmt             *sql.Stmt
+	selectLocalpartForSSOIdentityStmt *sql.Stmt
+}
+
+func (s *ssoIdentitiesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(ssoIdentitiesSchema)
+	if err != nil {
+		return
+	}
+	if s.insertSSOIdentityStmt, err = db.Prepare(insertSSOIdentitySQL); err != nil {
+		return
+	}
+	if s.selectLocalpartForSSOIdentityStmt, err = db.Prepare(selectLocalpartForSSOIdentitySQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *ssoIdentitiesStatements) insertSSOIdentity(
+	ctx context.Context, txn *sql.Tx, idpID, subject, localpart string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.insertSSOIdentityStmt).ExecContext(ctx, idpID, subject, localpart)
+	return
+}
+
+// selectLocalpartForSSOIdentity returns the localpart of the account which the
+// user of the identity provider logs in as, or an empty string if there isn't
+// one.
+func (s *ssoIdentitiesStatements) selectLocalpartForSSOIdentity(
+	ctx context.Context, idpID, subject string,
+) (localpart string, err error) {
+	err = s.selectLocalpartForSSOIdentityStmt.QueryRowContext(ctx, idpID, subject).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
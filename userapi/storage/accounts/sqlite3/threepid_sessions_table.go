@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const threepidSessionsSchema = `
+-- Stores the attempts to validate third party identifiers which the server
+-- sent tokens to itself
+CREATE TABLE IF NOT EXISTS account_threepid_sessions (
+	session_id TEXT NOT NULL PRIMARY KEY,
+	-- The secret which the client chose, and has to give to use the session
+	client_secret TEXT NOT NULL,
+	-- The 3PID medium and the third party identifier being validated
+	medium TEXT NOT NULL,
+	address TEXT NOT NULL,
+	-- The token which was sent to the third party identifier
+	token TEXT NOT NULL,
+	-- The send_attempt of the request which the token was sent for
+	send_attempt INTEGER NOT NULL,
+	-- How many tokens have been sent for the session since it last expired
+	send_count INTEGER NOT NULL DEFAULT 0,
+	-- When the token stops being accepted
+	expires_ts BIGINT NOT NULL,
+	-- When the token was submitted, or 0 if it hasn't been yet
+	validated_ts BIGINT NOT NULL DEFAULT 0,
+
+	UNIQUE(client_secret, medium, address)
+);
+
+CREATE INDEX IF NOT EXISTS account_threepid_sessions_expires_ts ON account_threepid_sessions(expires_ts);
+`
+
+const upsertThreePIDSessionSQL = "" +
+	"INSERT INTO account_threepid_sessions (session_id, client_secret, medium, address, token, send_attempt, send_count, expires_ts, validated_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
+	" ON CONFLICT (session_id) DO UPDATE SET token = $5, send_attempt = $6, send_count = $7, expires_ts = $8, validated_ts = $9"
+
+const selectThreePIDSessionSQL = "" +
+	"SELECT session_id, client_secret, medium, address, token, send_attempt, send_count, expires_ts, validated_ts" +
+	" FROM account_threepid_sessions WHERE session_id = $1"
+
+const selectThreePIDSessionByClientSecretSQL = "" +
+	"SELECT session_id, client_secret, medium, address, token, send_attempt, send_count, expires_ts, validated_ts" +
+	" FROM account_threepid_sessions WHERE client_secret = $1 AND medium = $2 AND address = $3"
+
+const deleteThreePIDSessionSQL = "" +
+	"DELETE FROM account_threepid_sessions WHERE session_id = $1"
+
+const deleteExpiredThreePIDSessionsSQL = "" +
+	"DELETE FROM account_threepid_sessions WHERE expires_ts < $1"
+
+type threepidSessionsStatements struct {
+	upsertThreePIDSessionStmt               *sql.Stmt
+	selectThreePIDSessionStmt               *sql.Stmt
+	selectThreePIDSessionByClientSecretStmt *sql.Stmt
+	deleteThreePIDSessionStmt               *sql.Stmt
+	deleteExpiredThreePIDSessionsStmt       *sql.Stmt
+}
+
+func (s *threepidSessionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(threepidSessionsSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertThreePIDSessionStmt, err = db.Prepare(upsertThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.selectThreePIDSessionStmt, err = db.Prepare(selectThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.selectThreePIDSessionByClientSecretStmt, err = db.Prepare(selectThreePIDSessionByClientSecretSQL); err != nil {
+		return
+	}
+	if s.deleteThreePIDSessionStmt, err = db.Prepare(deleteThreePIDSessionSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredThreePIDSessionsStmt, err = db.Prepare(deleteExpiredThreePIDSessionsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *threepidSessionsStatements) upsertThreePIDSession(
+	ctx context.Context, txn *sql.Tx, session *authtypes.ThreePIDSession,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.upsertThreePIDSessionStmt).ExecContext(
+		ctx, session.SessionID, session.ClientSecret, session.Medium, session.Address,
+		session.Token, session.SendAttempt, session.SendCount, session.ExpiresTS, session.ValidatedTS,
+	)
+	return
+}
+
+func (s *threepidSessionsStatements) selectThreePIDSession(
+	ctx context.Context, sessionID string,
+) (*authtypes.ThreePIDSession, error) {
+	return scanThreePIDSession(s.selectThreePIDSessionStmt.QueryRowContext(ctx, sessionID))
+}
+
+func (s *threepidSessionsStatements) selectThreePIDSessionByClientSecret(
+	ctx context.Context, clientSecret, medium, address string,
+) (*authtypes.ThreePIDSession, error) {
+	return scanThreePIDSession(s.selectThreePIDSessionByClientSecretStmt.QueryRowContext(ctx, clientSecret, medium, address))
+}
+
+// scanThreePIDSession returns the session in the row, or nil if there isn't one.
+func scanThreePIDSession(row *sql.Row) (*authtypes.ThreePIDSession, error) {
+	var session authtypes.ThreePIDSession
+	err := row.Scan(
+		&session.SessionID, &session.ClientSecret, &session.Medium, &session.Address,
+		&session.Token, &session.SendAttempt, &session.SendCount, &session.ExpiresTS, &session.ValidatedTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *threepidSessionsStatements) deleteThreePIDSession(
+	ctx context.Context, sessionID string,
+) (bool, error) {
+	res, err := s.deleteThreePIDSessionStmt.ExecContext(ctx, sessionID)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func (s *threepidSessionsStatements) deleteExpiredThreePIDSessions(
+	ctx context.Context, txn *sql.Tx, before gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteExpiredThreePIDSessionsStmt).ExecContext(ctx, before)
+	return
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
@@ -35,4 +36,16 @@ type Database interface {
 	RemoveDevice(ctx context.Context, deviceID, localpart string) error
 	RemoveDevices(ctx context.Context, localpart string, devices []string) error
 	RemoveAllDevices(ctx context.Context, localpart string) error
+	// SetRefreshToken gives the device with the access token a refresh token, and makes the access token expire
+	// at the given time.
+	SetRefreshToken(ctx context.Context, accessToken, refreshToken string, accessTokenExpiresTS gomatrixserverlib.Timestamp) error
+	// RefreshAccessToken replaces the access token and refresh token of the device which was given the refresh
+	// token. Returns sql.ErrNoRows if no device has the refresh token.
+	RefreshAccessToken(ctx context.Context, refreshToken, newAccessToken, newRefreshToken string, accessTokenExpiresTS gomatrixserverlib.Timestamp) (*api.Device, error)
+	// GetTransaction returns the result of the request which the device made to the endpoint with the transaction
+	// ID, and whether there was one. Transaction IDs are forgotten after a day.
+	GetTransaction(ctx context.Context, userID, deviceID, endpoint, txnID string) (string, bool, error)
+	// StoreTransaction records the result of the request which the device made to the endpoint with the transaction
+	// ID. If a result was already recorded, it is kept.
+	StoreTransaction(ctx context.Context, userID, deviceID, endpoint, txnID, result string) error
 }
@@ -51,12 +51,24 @@ CREATE TABLE IF NOT EXISTS device_devices (
     -- When this devices was first recognised on the network, as a unix timestamp (ms resolution).
     created_ts BIGINT NOT NULL,
     -- The display name, human friendlier than device_id and updatable
-    display_name TEXT
+    display_name TEXT,
+    -- The refresh token which can be exchanged for a new access token, if the
+    -- client asked for one when logging in.
+    refresh_token TEXT,
+    -- When the access token expires, as a unix timestamp (ms resolution), or 0
+    -- if it never expires. Only access tokens with refresh tokens expire.
+    access_token_expires_ts BIGINT NOT NULL DEFAULT 0
     -- TODO: device keys, device display names, last used ts and IP address?, token restrictions (if 3rd-party OAuth app)
 );
 
+-- Tables created before refresh tokens were supported don't have their columns.
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS refresh_token TEXT;
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS access_token_expires_ts BIGINT NOT NULL DEFAULT 0;
+
 -- Device IDs must be unique for a given user.
 CREATE UNIQUE INDEX IF NOT EXISTS device_localpart_id_idx ON device_devices(localpart, device_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS device_refresh_token_idx ON device_devices(refresh_token);
 `
 
 const insertDeviceSQL = "" +
@@ -64,7 +76,7 @@ const insertDeviceSQL = "" +
 	" RETURNING session_id"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, access_token_expires_ts FROM device_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
@@ -75,6 +87,12 @@ const selectDevicesByLocalpartSQL = "" +
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
+const updateDeviceRefreshTokenSQL = "" +
+	"UPDATE device_devices SET refresh_token = $1, access_token_expires_ts = $2 WHERE access_token = $3"
+
+const updateDeviceAccessTokenSQL = "" +
+	"UPDATE device_devices SET access_token = $1, refresh_token = $2, access_token_expires_ts = $3 WHERE refresh_token = $4"
+
 const deleteDeviceSQL = "" +
 	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2"
 
@@ -90,6 +108,8 @@ type devicesStatements struct {
 	selectDeviceByIDStmt         *sql.Stmt
 	selectDevicesByLocalpartStmt *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
+	updateDeviceRefreshTokenStmt *sql.Stmt
+	updateDeviceAccessTokenStmt  *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	deleteDevicesStmt            *sql.Stmt
@@ -116,6 +136,12 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.updateDeviceNameStmt, err = db.Prepare(updateDeviceNameSQL); err != nil {
 		return
 	}
+	if s.updateDeviceRefreshTokenStmt, err = db.Prepare(updateDeviceRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.updateDeviceAccessTokenStmt, err = db.Prepare(updateDeviceAccessTokenSQL); err != nil {
+		return
+	}
 	if s.deleteDeviceStmt, err = db.Prepare(deleteDeviceSQL); err != nil {
 		return
 	}
@@ -187,13 +213,44 @@ func (s *devicesStatements) updateDeviceName(
 	return err
 }
 
+func (s *devicesStatements) updateDeviceRefreshToken(
+	ctx context.Context, txn *sql.Tx, accessToken, refreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken, accessTokenExpiresTS, accessToken)
+	return err
+}
+
+// updateDeviceAccessToken replaces the access token and refresh token of the
+// device which was given the old refresh token. Returns sql.ErrNoRows if there
+// isn't one, which includes the refresh token having been used already.
+func (s *devicesStatements) updateDeviceAccessToken(
+	ctx context.Context, txn *sql.Tx, oldRefreshToken, newAccessToken, newRefreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceAccessTokenStmt)
+	res, err := stmt.ExecContext(ctx, newAccessToken, newRefreshToken, accessTokenExpiresTS, oldRefreshToken)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func (s *devicesStatements) selectDeviceByToken(
 	ctx context.Context, accessToken string,
 ) (*api.Device, error) {
 	var dev api.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.AccessTokenExpiresTS)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -207,11 +264,15 @@ func (s *devicesStatements) selectDeviceByID(
 	ctx context.Context, localpart, deviceID string,
 ) (*api.Device, error) {
 	var dev api.Device
+	var displayName sql.NullString
 	stmt := s.selectDeviceByIDStmt
-	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&dev.DisplayName)
+	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName)
 	if err == nil {
 		dev.ID = deviceID
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+		if displayName.Valid {
+			dev.DisplayName = displayName.String
+		}
 	}
 	return &dev, err
 }
@@ -30,8 +30,9 @@ var deviceIDByteLength = 6
 
 // Database represents a device database.
 type Database struct {
-	db      *sql.DB
-	devices devicesStatements
+	db           *sql.DB
+	devices      devicesStatements
+	transactions transactionsStatements
 }
 
 // NewDatabase creates a new device database
@@ -45,7 +46,11 @@ func NewDatabase(dataSourceName string, dbProperties sqlutil.DbProperties, serve
 	if err = d.prepare(db, serverName); err != nil {
 		return nil, err
 	}
-	return &Database{db, d}, nil
+	t := transactionsStatements{}
+	if err = t.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, d, t}, nil
 }
 
 // GetDeviceByAccessToken returns the device matching the given access token.
@@ -180,3 +185,50 @@ func (d *Database) RemoveAllDevices(
 		return nil
 	})
 }
+
+// SetRefreshToken gives the device with the access token a refresh token, and
+// makes the access token expire at the given time.
+func (d *Database) SetRefreshToken(
+	ctx context.Context, accessToken, refreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.devices.updateDeviceRefreshToken(ctx, txn, accessToken, refreshToken, accessTokenExpiresTS)
+	})
+}
+
+// RefreshAccessToken replaces the access token and refresh token of the device
+// which was given the refresh token, so that the old ones can't be used again.
+// Returns sql.ErrNoRows if no device has the refresh token.
+func (d *Database) RefreshAccessToken(
+	ctx context.Context, refreshToken, newAccessToken, newRefreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) (*api.Device, error) {
+	// The refresh token is replaced by the same statement that checks it, so
+	// concurrent refreshes with the same token can't both succeed.
+	err := sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.devices.updateDeviceAccessToken(ctx, txn, refreshToken, newAccessToken, newRefreshToken, accessTokenExpiresTS)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.devices.selectDeviceByToken(ctx, newAccessToken)
+}
+
+// GetTransaction returns the result of the request which the device made to
+// the endpoint with the transaction ID, and whether there was one.
+func (d *Database) GetTransaction(
+	ctx context.Context, userID, deviceID, endpoint, txnID string,
+) (string, bool, error) {
+	return d.transactions.selectTransactionResult(ctx, userID, deviceID, endpoint, txnID)
+}
+
+// StoreTransaction records the result of the request which the device made
+// to the endpoint with the transaction ID.
+func (d *Database) StoreTransaction(
+	ctx context.Context, userID, deviceID, endpoint, txnID, result string,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.transactions.insertTransaction(ctx, txn, userID, deviceID, endpoint, txnID, result)
+	})
+}
@@ -39,9 +39,13 @@ CREATE TABLE IF NOT EXISTS device_devices (
     localpart TEXT ,
     created_ts BIGINT,
     display_name TEXT,
+    refresh_token TEXT,
+    access_token_expires_ts BIGINT NOT NULL DEFAULT 0,
 
 		UNIQUE (localpart, device_id)
 );
+
+CREATE UNIQUE INDEX IF NOT EXISTS device_refresh_token_idx ON device_devices(refresh_token);
 `
 
 const insertDeviceSQL = "" +
@@ -52,7 +56,7 @@ const selectDevicesCountSQL = "" +
 	"SELECT COUNT(access_token) FROM device_devices"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, access_token_expires_ts FROM device_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
@@ -63,6 +67,12 @@ const selectDevicesByLocalpartSQL = "" +
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
+const updateDeviceRefreshTokenSQL = "" +
+	"UPDATE device_devices SET refresh_token = $1, access_token_expires_ts = $2 WHERE access_token = $3"
+
+const updateDeviceAccessTokenSQL = "" +
+	"UPDATE device_devices SET access_token = $1, refresh_token = $2, access_token_expires_ts = $3 WHERE refresh_token = $4"
+
 const deleteDeviceSQL = "" +
 	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2"
 
@@ -80,6 +90,8 @@ type devicesStatements struct {
 	selectDeviceByIDStmt         *sql.Stmt
 	selectDevicesByLocalpartStmt *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
+	updateDeviceRefreshTokenStmt *sql.Stmt
+	updateDeviceAccessTokenStmt  *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	serverName                   gomatrixserverlib.ServerName
@@ -87,6 +99,14 @@ type devicesStatements struct {
 
 func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerName) (err error) {
 	s.db = db
+	// SQLite can't add a UNIQUE column, which is why the refresh token has a
+	// separate index.
+	if err = sqlutil.SQLiteAddColumn(db, "device_devices", "refresh_token", "TEXT"); err != nil {
+		return
+	}
+	if err = sqlutil.SQLiteAddColumn(db, "device_devices", "access_token_expires_ts", "BIGINT NOT NULL DEFAULT 0"); err != nil {
+		return
+	}
 	_, err = db.Exec(devicesSchema)
 	if err != nil {
 		return
@@ -109,6 +129,12 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.updateDeviceNameStmt, err = db.Prepare(updateDeviceNameSQL); err != nil {
 		return
 	}
+	if s.updateDeviceRefreshTokenStmt, err = db.Prepare(updateDeviceRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.updateDeviceAccessTokenStmt, err = db.Prepare(updateDeviceAccessTokenSQL); err != nil {
+		return
+	}
 	if s.deleteDeviceStmt, err = db.Prepare(deleteDeviceSQL); err != nil {
 		return
 	}
@@ -156,18 +182,17 @@ func (s *devicesStatements) deleteDevice(
 func (s *devicesStatements) deleteDevices(
 	ctx context.Context, txn *sql.Tx, localpart string, devices []string,
 ) error {
-	orig := strings.Replace(deleteDevicesSQL, "($1)", sqlutil.QueryVariadic(len(devices)), 1)
-	prep, err := s.db.Prepare(orig)
+	orig := strings.Replace(deleteDevicesSQL, "($2)", sqlutil.QueryVariadicOffset(len(devices), 1), 1)
+	stmt, err := txn.PrepareContext(ctx, orig)
 	if err != nil {
 		return err
 	}
-	stmt := sqlutil.TxStmt(txn, prep)
+	defer stmt.Close() // nolint: errcheck
 	params := make([]interface{}, len(devices)+1)
 	params[0] = localpart
 	for i, v := range devices {
 		params[i+1] = v
 	}
-	params = append(params, params...)
 	_, err = stmt.ExecContext(ctx, params...)
 	return err
 }
@@ -188,13 +213,44 @@ func (s *devicesStatements) updateDeviceName(
 	return err
 }
 
+func (s *devicesStatements) updateDeviceRefreshToken(
+	ctx context.Context, txn *sql.Tx, accessToken, refreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken, accessTokenExpiresTS, accessToken)
+	return err
+}
+
+// updateDeviceAccessToken replaces the access token and refresh token of the
+// device which was given the old refresh token. Returns sql.ErrNoRows if there
+// isn't one, which includes the refresh token having been used already.
+func (s *devicesStatements) updateDeviceAccessToken(
+	ctx context.Context, txn *sql.Tx, oldRefreshToken, newAccessToken, newRefreshToken string,
+	accessTokenExpiresTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceAccessTokenStmt)
+	res, err := stmt.ExecContext(ctx, newAccessToken, newRefreshToken, accessTokenExpiresTS, oldRefreshToken)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func (s *devicesStatements) selectDeviceByToken(
 	ctx context.Context, accessToken string,
 ) (*api.Device, error) {
 	var dev api.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.AccessTokenExpiresTS)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -208,11 +264,15 @@ func (s *devicesStatements) selectDeviceByID(
 	ctx context.Context, localpart, deviceID string,
 ) (*api.Device, error) {
 	var dev api.Device
+	var displayName sql.NullString
 	stmt := s.selectDeviceByIDStmt
-	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&dev.DisplayName)
+	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName)
 	if err == nil {
 		dev.ID = deviceID
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+		if displayName.Valid {
+			dev.DisplayName = displayName.String
+		}
 	}
 	return &dev, err
 }
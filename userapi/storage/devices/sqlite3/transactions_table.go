@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// How long transaction IDs are remembered for. Clients only retry requests
+// for a short while, so this is plenty.
+const transactionLifetime = 24 * time.Hour
+
+const transactionsSchema = `
+-- Stores the results of the requests which were made with each transaction ID,
+-- so that requests which are retried aren't acted on again.
+CREATE TABLE IF NOT EXISTS device_transactions (
+    -- The user and device which made the request, as transaction IDs are
+    -- scoped to devices
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    -- The endpoint which the request was made to, as clients can use the same
+    -- transaction IDs with different endpoints
+    endpoint TEXT NOT NULL,
+    -- The transaction ID given by the client
+    txn_id TEXT NOT NULL,
+    -- The result of the request, e.g. the ID of the event which was sent
+    result TEXT NOT NULL,
+    -- When the request was made, in milliseconds
+    created_ts BIGINT NOT NULL,
+
+    PRIMARY KEY (user_id, device_id, endpoint, txn_id)
+);
+
+CREATE INDEX IF NOT EXISTS device_transactions_created_ts_idx ON device_transactions(created_ts);
+`
+
+const insertTransactionSQL = "" +
+	"INSERT INTO device_transactions (user_id, device_id, endpoint, txn_id, result, created_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (user_id, device_id, endpoint, txn_id) DO NOTHING"
+
+const selectTransactionResultSQL = "" +
+	"SELECT result FROM device_transactions" +
+	" WHERE user_id = $1 AND device_id = $2 AND endpoint = $3 AND txn_id = $4 AND created_ts > $5"
+
+const deleteTransactionsBeforeSQL = "" +
+	"DELETE FROM device_transactions WHERE created_ts <= $1"
+
+type transactionsStatements struct {
+	insertTransactionStmt        *sql.Stmt
+	selectTransactionResultStmt  *sql.Stmt
+	deleteTransactionsBeforeStmt *sql.Stmt
+}
+
+func (s *transactionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(transactionsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertTransactionStmt, err = db.Prepare(insertTransactionSQL); err != nil {
+		return
+	}
+	if s.selectTransactionResultStmt, err = db.Prepare(selectTransactionResultSQL); err != nil {
+		return
+	}
+	if s.deleteTransactionsBeforeStmt, err = db.Prepare(deleteTransactionsBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertTransaction records the result of the request made with the
+// transaction ID, and forgets the transactions which are too old to be
+// retried.
+func (s *transactionsStatements) insertTransaction(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, endpoint, txnID, result string,
+) error {
+	now := time.Now()
+	stmt := sqlutil.TxStmt(txn, s.deleteTransactionsBeforeStmt)
+	if _, err := stmt.ExecContext(ctx, now.Add(-transactionLifetime).UnixNano()/1000000); err != nil {
+		return err
+	}
+	stmt = sqlutil.TxStmt(txn, s.insertTransactionStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID, endpoint, txnID, result, now.UnixNano()/1000000)
+	return err
+}
+
+// selectTransactionResult returns the result of the request made with the
+// transaction ID, and whether there was one.
+func (s *transactionsStatements) selectTransactionResult(
+	ctx context.Context, userID, deviceID, endpoint, txnID string,
+) (result string, ok bool, err error) {
+	since := time.Now().Add(-transactionLifetime).UnixNano() / 1000000
+	err = s.selectTransactionResultStmt.QueryRowContext(ctx, userID, deviceID, endpoint, txnID, since).Scan(&result)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return result, err == nil, err
+}
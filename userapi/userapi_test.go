@@ -2,14 +2,23 @@ package userapi_test
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	currentstateAPI "github.com/matrix-org/dendrite/currentstateserver/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/test"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/userapi"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
@@ -32,7 +41,7 @@ func MustMakeInternalAPI(t *testing.T) (api.UserInternalAPI, accounts.Database,
 		t.Fatalf("failed to create device DB: %s", err)
 	}
 
-	return userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil), accountDB, deviceDB
+	return userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, nil, nil), accountDB, deviceDB
 }
 
 func TestQueryProfile(t *testing.T) {
@@ -110,3 +119,908 @@ func TestQueryProfile(t *testing.T) {
 		runCases(userAPI)
 	})
 }
+
+func TestPushers(t *testing.T) {
+	alice := fmt.Sprintf("@alice:%s", serverName)
+	bob := fmt.Sprintf("@bob:%s", serverName)
+	pusher := api.Pusher{
+		DeviceID:          "ALICEDEVICE",
+		PushKey:           "pushkey",
+		Kind:              api.HTTPKind,
+		AppID:             "org.example.app",
+		AppDisplayName:    "Example",
+		DeviceDisplayName: "Phone",
+		Language:          "en",
+		Data:              map[string]interface{}{"url": "https://push.example.com/_matrix/push/v1/notify"},
+	}
+
+	mustSet := func(testAPI api.UserInternalAPI, userID string, appendPusher bool) {
+		t.Helper()
+		req := api.PerformPusherSetRequest{UserID: userID, Pusher: pusher, Append: appendPusher}
+		if err := testAPI.PerformPusherSet(context.TODO(), &req, &api.PerformPusherSetResponse{}); err != nil {
+			t.Fatalf("PerformPusherSet failed: %s", err)
+		}
+	}
+	countPushers := func(testAPI api.UserInternalAPI, userID string) int {
+		t.Helper()
+		var res api.QueryPushersResponse
+		if err := testAPI.QueryPushers(context.TODO(), &api.QueryPushersRequest{UserID: userID}, &res); err != nil {
+			t.Fatalf("QueryPushers failed: %s", err)
+		}
+		for _, p := range res.Pushers {
+			if !reflect.DeepEqual(p, pusher) {
+				t.Errorf("QueryPushers got %+v want %+v", p, pusher)
+			}
+		}
+		return len(res.Pushers)
+	}
+
+	runCases := func(testAPI api.UserInternalAPI) {
+		mustSet(testAPI, alice, false)
+		mustSet(testAPI, alice, false)
+		if n := countPushers(testAPI, alice); n != 1 {
+			t.Fatalf("got %d pushers for alice after setting the same pusher twice, want 1", n)
+		}
+		// Appending keeps the pushers of other users with the same push key.
+		mustSet(testAPI, bob, true)
+		if n := countPushers(testAPI, alice); n != 1 {
+			t.Fatalf("got %d pushers for alice after bob appended, want 1", n)
+		}
+		// Not appending replaces them.
+		mustSet(testAPI, bob, false)
+		if n := countPushers(testAPI, alice); n != 0 {
+			t.Fatalf("got %d pushers for alice after bob replaced them, want 0", n)
+		}
+		delReq := api.PerformPusherDeletionRequest{UserID: bob, AppID: pusher.AppID, PushKey: pusher.PushKey}
+		if err := testAPI.PerformPusherDeletion(context.TODO(), &delReq, &api.PerformPusherDeletionResponse{}); err != nil {
+			t.Fatalf("PerformPusherDeletion failed: %s", err)
+		}
+		if n := countPushers(testAPI, bob); n != 0 {
+			t.Fatalf("got %d pushers for bob after deleting, want 0", n)
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		userAPI, _, _ := MustMakeInternalAPI(t)
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		userAPI, _, _ := MustMakeInternalAPI(t)
+		runCases(userAPI)
+	})
+}
+
+func TestPerformAccountDeactivation(t *testing.T) {
+	ctx := context.TODO()
+	userAPI, accountDB, deviceDB := MustMakeInternalAPI(t)
+	if _, err := accountDB.CreateAccount(ctx, "alice", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	var devRes api.PerformDeviceCreationResponse
+	err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{Localpart: "alice"}, &devRes)
+	if err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+
+	var res api.PerformAccountDeactivationResponse
+	if err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{Localpart: "alice"}, &res); err != nil {
+		t.Fatalf("PerformAccountDeactivation failed: %s", err)
+	}
+	if !res.AccountDeactivated {
+		t.Errorf("expected the account to be deactivated")
+	}
+	if _, err = accountDB.GetAccountByPassword(ctx, "alice", "foobar"); err == nil {
+		t.Errorf("expected logging into a deactivated account to fail")
+	}
+	devs, err := deviceDB.GetDevicesByLocalpart(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetDevicesByLocalpart failed: %s", err)
+	}
+	if len(devs) != 0 {
+		t.Errorf("expected the devices of a deactivated account to be removed, got %d", len(devs))
+	}
+	if err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{Localpart: "bob"}, &res); err == nil {
+		t.Errorf("expected deactivating a nonexistent account to fail")
+	}
+
+	// Erasing an account also removes its profile and third-party identifiers.
+	if _, err = accountDB.CreateAccount(ctx, "carol", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	if err = accountDB.SetDisplayName(ctx, "carol", "Carol"); err != nil {
+		t.Fatalf("SetDisplayName failed: %s", err)
+	}
+	if err = accountDB.SetAvatarURL(ctx, "carol", "mxc://localhost/carol"); err != nil {
+		t.Fatalf("SetAvatarURL failed: %s", err)
+	}
+	if err = accountDB.SaveThreePIDAssociation(ctx, "carol@localhost", "carol", "email"); err != nil {
+		t.Fatalf("SaveThreePIDAssociation failed: %s", err)
+	}
+	err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart:          "carol",
+		RemovePersonalData: true,
+	}, &res)
+	if err != nil {
+		t.Fatalf("PerformAccountDeactivation failed: %s", err)
+	}
+	profile, err := accountDB.GetProfileByLocalpart(ctx, "carol")
+	if err != nil {
+		t.Fatalf("GetProfileByLocalpart failed: %s", err)
+	}
+	if profile.DisplayName != "" || profile.AvatarURL != "" {
+		t.Errorf("expected the profile of an erased account to be removed, got %+v", profile)
+	}
+	threepids, err := accountDB.GetThreePIDsForLocalpart(ctx, "carol")
+	if err != nil {
+		t.Fatalf("GetThreePIDsForLocalpart failed: %s", err)
+	}
+	if len(threepids) != 0 {
+		t.Errorf("expected the third-party identifiers of an erased account to be removed, got %+v", threepids)
+	}
+}
+
+type fakeKeyAPI struct {
+	keyapi.KeyInternalAPI
+	deleted []keyapi.PerformDeleteKeysRequest
+}
+
+func (k *fakeKeyAPI) PerformDeleteKeys(ctx context.Context, req *keyapi.PerformDeleteKeysRequest, res *keyapi.PerformDeleteKeysResponse) {
+	k.deleted = append(k.deleted, *req)
+}
+
+func TestPerformDeviceDeletion(t *testing.T) {
+	ctx := context.TODO()
+	accountDB, err := accounts.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	keyAPI := &fakeKeyAPI{}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, keyAPI, nil)
+	alice := fmt.Sprintf("@alice:%s", serverName)
+
+	tokens := map[string]string{"PHONE": "phone_token", "LAPTOP": "laptop_token", "TABLET": "tablet_token"}
+	for deviceID, token := range tokens {
+		deviceID := deviceID
+		req := api.PerformDeviceCreationRequest{Localpart: "alice", DeviceID: &deviceID, AccessToken: token}
+		if err = userAPI.PerformDeviceCreation(ctx, &req, &api.PerformDeviceCreationResponse{}); err != nil {
+			t.Fatalf("PerformDeviceCreation failed: %s", err)
+		}
+	}
+
+	displayName := "Work laptop"
+	var updateRes api.PerformDeviceUpdateResponse
+	err = userAPI.PerformDeviceUpdate(ctx, &api.PerformDeviceUpdateRequest{UserID: alice, DeviceID: "LAPTOP", DisplayName: &displayName}, &updateRes)
+	if err != nil || !updateRes.DeviceExists {
+		t.Fatalf("PerformDeviceUpdate returned %+v, %v", updateRes, err)
+	}
+	if dev, err := deviceDB.GetDeviceByID(ctx, "alice", "LAPTOP"); err != nil || dev.DisplayName != displayName {
+		t.Errorf("expected the device to be renamed, got %+v, %v", dev, err)
+	}
+	updateRes = api.PerformDeviceUpdateResponse{}
+	err = userAPI.PerformDeviceUpdate(ctx, &api.PerformDeviceUpdateRequest{UserID: alice, DeviceID: "UNKNOWN", DisplayName: &displayName}, &updateRes)
+	if err != nil || updateRes.DeviceExists {
+		t.Errorf("PerformDeviceUpdate of an unknown device returned %+v, %v", updateRes, err)
+	}
+
+	req := api.PerformDeviceDeletionRequest{UserID: alice, DeviceIDs: []string{"PHONE", "TABLET"}}
+	if err = userAPI.PerformDeviceDeletion(ctx, &req, &api.PerformDeviceDeletionResponse{}); err != nil {
+		t.Fatalf("PerformDeviceDeletion failed: %s", err)
+	}
+	for deviceID, token := range tokens {
+		var res api.QueryAccessTokenResponse
+		if err = userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: token}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		if deleted := deviceID != "LAPTOP"; deleted != (res.Device == nil) {
+			t.Errorf("device %s: got device %+v for its access token", deviceID, res.Device)
+		}
+	}
+	want := []keyapi.PerformDeleteKeysRequest{{UserID: alice, DeviceIDs: []string{"PHONE", "TABLET"}}}
+	if !reflect.DeepEqual(keyAPI.deleted, want) {
+		t.Errorf("deleted keys %+v, want %+v", keyAPI.deleted, want)
+	}
+}
+
+type fakeStateAPI struct {
+	currentstateAPI.CurrentStateInternalAPI
+	mu       sync.Mutex
+	profiles map[string]currentstateAPI.UserDirectoryEntry
+}
+
+func (s *fakeStateAPI) PerformUpdateUserDirectory(ctx context.Context, req *currentstateAPI.PerformUpdateUserDirectoryRequest, res *currentstateAPI.PerformUpdateUserDirectoryResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, profile := range req.Profiles {
+		s.profiles[profile.UserID] = profile
+	}
+	return nil
+}
+
+func (s *fakeStateAPI) profile(userID string) (currentstateAPI.UserDirectoryEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	profile, ok := s.profiles[userID]
+	return profile, ok
+}
+
+func TestUserDirectoryUpdates(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "userapi")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	// the backfill runs in the background, so needs to see the same database
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "accounts.db"), nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase("file::memory:", nil, serverName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	// an account which existed before the user directory was told about new accounts
+	if _, err = accountDB.CreateAccount(ctx, "alice", "", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	if err = accountDB.SetDisplayName(ctx, "alice", "Alice"); err != nil {
+		t.Fatalf("failed to set display name: %s", err)
+	}
+	stateAPI := &fakeStateAPI{profiles: map[string]currentstateAPI.UserDirectoryEntry{}}
+	userAPI := userapi.NewInternalAPI(accountDB, deviceDB, serverName, nil, nil, stateAPI)
+	alice := fmt.Sprintf("@alice:%s", serverName)
+	bob := fmt.Sprintf("@bob:%s", serverName)
+
+	want := currentstateAPI.UserDirectoryEntry{UserID: alice, DisplayName: "Alice"}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if profile, _ := stateAPI.profile(alice); profile == want {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("existing account wasn't backfilled into the user directory")
+		}
+	}
+
+	err = userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+		AccountType: api.AccountTypeUser, Localpart: "bob", Password: "password",
+	}, &api.PerformAccountCreationResponse{})
+	if err != nil {
+		t.Fatalf("PerformAccountCreation failed: %s", err)
+	}
+	// new accounts are in the user directory even before they join any rooms
+	want = currentstateAPI.UserDirectoryEntry{UserID: bob, DisplayName: "bob"}
+	if profile, _ := stateAPI.profile(bob); profile != want {
+		t.Errorf("new account has user directory entry %+v, want %+v", profile, want)
+	}
+
+	err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart: "bob", RemovePersonalData: true,
+	}, &api.PerformAccountDeactivationResponse{})
+	if err != nil {
+		t.Fatalf("PerformAccountDeactivation failed: %s", err)
+	}
+	want = currentstateAPI.UserDirectoryEntry{UserID: bob}
+	if profile, _ := stateAPI.profile(bob); profile != want {
+		t.Errorf("erased account has user directory entry %+v, want %+v", profile, want)
+	}
+}
+
+func TestPerformRoomAccountDataDeletion(t *testing.T) {
+	ctx := context.TODO()
+	userAPI, accountDB, _ := MustMakeInternalAPI(t)
+	if err := accountDB.SaveAccountData(ctx, "alice", "!purged:localhost", "m.fully_read", json.RawMessage(`{"event_id":"$a"}`)); err != nil {
+		t.Fatalf("failed to save account data: %s", err)
+	}
+	if err := accountDB.SaveAccountData(ctx, "alice", "!other:localhost", "m.fully_read", json.RawMessage(`{"event_id":"$b"}`)); err != nil {
+		t.Fatalf("failed to save account data: %s", err)
+	}
+	if err := accountDB.SaveAccountData(ctx, "alice", "", "m.push_rules", json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("failed to save account data: %s", err)
+	}
+	err := userAPI.PerformRoomAccountDataDeletion(ctx, &api.PerformRoomAccountDataDeletionRequest{
+		RoomID: "!purged:localhost",
+	}, &api.PerformRoomAccountDataDeletionResponse{})
+	if err != nil {
+		t.Fatalf("PerformRoomAccountDataDeletion failed: %s", err)
+	}
+	global, rooms, err := accountDB.GetAccountData(ctx, "alice")
+	if err != nil {
+		t.Fatalf("failed to get account data: %s", err)
+	}
+	if _, ok := rooms["!purged:localhost"]; ok {
+		t.Errorf("the account data for the purged room wasn't deleted")
+	}
+	if _, ok := rooms["!other:localhost"]; !ok {
+		t.Errorf("the account data for another room was deleted")
+	}
+	if _, ok := global["m.push_rules"]; !ok {
+		t.Errorf("the global account data was deleted")
+	}
+}
+
+func TestInputAccountDataIfUnchanged(t *testing.T) {
+	userID := fmt.Sprintf("@alice:%s", serverName)
+	runCases := func(t *testing.T, testAPI api.UserInternalAPI) {
+		input := func(prev, data string) bool {
+			t.Helper()
+			req := api.InputAccountDataRequest{
+				UserID:      userID,
+				DataType:    "m.push_rules",
+				AccountData: json.RawMessage(data),
+				IfUnchanged: true,
+			}
+			if prev != "" {
+				req.PrevAccountData = json.RawMessage(prev)
+			}
+			var res api.InputAccountDataResponse
+			if err := testAPI.InputAccountData(context.TODO(), &req, &res); err != nil {
+				t.Fatalf("InputAccountData failed: %s", err)
+			}
+			return res.Changed
+		}
+		stored := func() string {
+			t.Helper()
+			var res api.QueryAccountDataResponse
+			if err := testAPI.QueryAccountData(context.TODO(), &api.QueryAccountDataRequest{
+				UserID:   userID,
+				DataType: "m.push_rules",
+			}, &res); err != nil {
+				t.Fatalf("QueryAccountData failed: %s", err)
+			}
+			return string(res.GlobalAccountData["m.push_rules"])
+		}
+
+		// The account data is only saved if it is still what the caller last
+		// saw, including when there wasn't any.
+		if !input(`{"a":1}`, `{"a":2}`) {
+			t.Errorf("account data instead of none: got saved, want changed")
+		}
+		if input("", `{"a":1}`) {
+			t.Errorf("missing account data: got changed, want saved")
+		}
+		if !input("", `{"a":2}`) {
+			t.Errorf("new account data instead of none: got saved, want changed")
+		}
+		if !input(`{"a":2}`, `{"a":3}`) {
+			t.Errorf("stale account data: got saved, want changed")
+		}
+		if got := stored(); got != `{"a":1}` {
+			t.Errorf("got account data %s, want the first which was saved", got)
+		}
+		if input(`{ "a": 1 }`, `{"a":2}`) {
+			t.Errorf("current account data: got changed, want saved")
+		}
+		if got := stored(); got != `{"a":2}` {
+			t.Errorf("got account data %s, want the last which was saved", got)
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		userAPI, _, _ := MustMakeInternalAPI(t)
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(t, httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		userAPI, _, _ := MustMakeInternalAPI(t)
+		runCases(t, userAPI)
+	})
+}
+
+func TestGuestAccountUpgrade(t *testing.T) {
+	ctx := context.TODO()
+	userAPI, accountDB, _ := MustMakeInternalAPI(t)
+	var guestRes api.PerformAccountCreationResponse
+	err := userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{AccountType: api.AccountTypeGuest}, &guestRes)
+	if err != nil {
+		t.Fatalf("PerformAccountCreation failed for a guest: %s", err)
+	}
+	if !guestRes.Account.IsGuest {
+		t.Fatalf("expected the new account to be a guest account")
+	}
+	localpart := guestRes.Account.Localpart
+	var devRes api.PerformDeviceCreationResponse
+	err = userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:   localpart,
+		AccessToken: "guest_token",
+	}, &devRes)
+	if err != nil {
+		t.Fatalf("PerformDeviceCreation failed for the guest: %s", err)
+	}
+	var tokenRes api.QueryAccessTokenResponse
+	if err = userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "guest_token"}, &tokenRes); err != nil {
+		t.Fatalf("QueryAccessToken failed: %s", err)
+	}
+	if tokenRes.Device == nil || !tokenRes.Device.IsGuest || tokenRes.Device.IsAdmin {
+		t.Fatalf("expected the guest's device to be a guest device, got %+v", tokenRes.Device)
+	}
+
+	var res api.PerformAccountCreationResponse
+	err = userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+		AccountType:  api.AccountTypeUser,
+		Localpart:    localpart,
+		Password:     "foobar",
+		UpgradeGuest: true,
+	}, &res)
+	if err != nil {
+		t.Fatalf("PerformAccountCreation failed to upgrade the guest: %s", err)
+	}
+	if err = userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "guest_token"}, &tokenRes); err != nil {
+		t.Fatalf("QueryAccessToken failed: %s", err)
+	}
+	if tokenRes.Device == nil || tokenRes.Device.IsGuest {
+		t.Errorf("expected the device to stop being a guest device after the upgrade, got %+v", tokenRes.Device)
+	}
+	if res.Account.UserID != guestRes.Account.UserID {
+		t.Errorf("upgraded account has user ID %q, want %q", res.Account.UserID, guestRes.Account.UserID)
+	}
+	acc, err := accountDB.GetAccountByPassword(ctx, localpart, "foobar")
+	if err != nil {
+		t.Fatalf("failed to log into the upgraded account: %s", err)
+	}
+	if acc.IsGuest {
+		t.Errorf("expected the upgraded account to no longer be a guest account")
+	}
+
+	err = userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+		AccountType:  api.AccountTypeUser,
+		Localpart:    localpart,
+		Password:     "hijacked",
+		UpgradeGuest: true,
+	}, &res)
+	if _, ok := err.(*api.ErrorForbidden); !ok {
+		t.Errorf("expected ErrorForbidden upgrading a full account, got %v", err)
+	}
+}
+
+func TestUserProvisioning(t *testing.T) {
+	alice, inactive := "Alice", false
+	runCases := func(testAPI api.UserInternalAPI) {
+		ctx := context.TODO()
+		req := api.PerformUserProvisioningRequest{
+			Users: []api.ProvisionedUserUpdate{
+				{ExternalID: "hr-1", Localpart: "alice", DisplayName: &alice, Password: "foobar"},
+				{ExternalID: "hr-2", Localpart: "bob"},
+				{ExternalID: "hr-3"},
+			},
+		}
+		var res api.PerformUserProvisioningResponse
+		if err := testAPI.PerformUserProvisioning(ctx, &req, &res); err != nil {
+			t.Fatalf("PerformUserProvisioning failed: %s", err)
+		}
+		if len(res.Results) != 3 || !res.Results[0].Created || !res.Results[1].Created || res.Results[2].Error == "" {
+			t.Fatalf("PerformUserProvisioning returned %+v", res.Results)
+		}
+
+		// Syncing the same users again mustn't create them again.
+		req.Users[1].Active = &inactive
+		if err := testAPI.PerformUserProvisioning(ctx, &req, &res); err != nil {
+			t.Fatalf("PerformUserProvisioning failed: %s", err)
+		}
+		if res.Results[0].Created || res.Results[0].Error != "" || res.Results[0].UserID != fmt.Sprintf("@alice:%s", serverName) {
+			t.Errorf("PerformUserProvisioning returned %+v for an existing user", res.Results[0])
+		}
+
+		var queryRes api.QueryProvisionedUsersResponse
+		if err := testAPI.QueryProvisionedUsers(ctx, &api.QueryProvisionedUsersRequest{Offset: 1, Limit: 1}, &queryRes); err != nil {
+			t.Fatalf("QueryProvisionedUsers failed: %s", err)
+		}
+		want := api.ProvisionedUser{ExternalID: "hr-2", UserID: fmt.Sprintf("@bob:%s", serverName), DisplayName: "bob", Active: false}
+		if queryRes.TotalUsers != 2 || len(queryRes.Users) != 1 || queryRes.Users[0] != want {
+			t.Errorf("QueryProvisionedUsers returned %+v, want one of two users %+v", queryRes, want)
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		userAPI, _, _ := MustMakeInternalAPI(t)
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		userAPI, _, _ := MustMakeInternalAPI(t)
+		runCases(userAPI)
+	})
+}
+
+func TestOpenIDTokens(t *testing.T) {
+	alice := fmt.Sprintf("@alice:%s", serverName)
+
+	runCases := func(testAPI api.UserInternalAPI) {
+		var createRes api.PerformOpenIDTokenCreationResponse
+		err := testAPI.PerformOpenIDTokenCreation(context.TODO(), &api.PerformOpenIDTokenCreationRequest{UserID: alice}, &createRes)
+		if err != nil {
+			t.Fatalf("PerformOpenIDTokenCreation failed: %s", err)
+		}
+		if createRes.Token == "" || createRes.ServerName != serverName || !createRes.ExpiresTS.Time().After(time.Now()) {
+			t.Fatalf("PerformOpenIDTokenCreation returned %+v", createRes)
+		}
+
+		for token, wantUserID := range map[string]string{createRes.Token: alice, "unknown": ""} {
+			var queryRes api.QueryOpenIDTokenResponse
+			if err = testAPI.QueryOpenIDToken(context.TODO(), &api.QueryOpenIDTokenRequest{Token: token}, &queryRes); err != nil {
+				t.Fatalf("QueryOpenIDToken failed: %s", err)
+			}
+			if queryRes.UserID != wantUserID {
+				t.Errorf("QueryOpenIDToken(%q) got user %q want %q", token, queryRes.UserID, wantUserID)
+			}
+		}
+
+		err = testAPI.PerformOpenIDTokenCreation(context.TODO(), &api.PerformOpenIDTokenCreationRequest{UserID: "@alice:wrongdomain.com"}, &createRes)
+		if err == nil {
+			t.Errorf("PerformOpenIDTokenCreation succeeded for a remote user")
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		userAPI, _, _ := MustMakeInternalAPI(t)
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		userAPI, _, _ := MustMakeInternalAPI(t)
+		runCases(userAPI)
+	})
+}
+
+func TestLoginTokens(t *testing.T) {
+	alice := fmt.Sprintf("@alice:%s", serverName)
+
+	runCases := func(testAPI api.UserInternalAPI) {
+		var createRes api.PerformLoginTokenCreationResponse
+		err := testAPI.PerformLoginTokenCreation(context.TODO(), &api.PerformLoginTokenCreationRequest{UserID: alice}, &createRes)
+		if err != nil {
+			t.Fatalf("PerformLoginTokenCreation failed: %s", err)
+		}
+		if createRes.Token == "" || !createRes.ExpiresTS.Time().After(time.Now()) {
+			t.Fatalf("PerformLoginTokenCreation returned %+v", createRes)
+		}
+
+		// The token can only be claimed once.
+		for i, wantUserID := range []string{alice, ""} {
+			var claimRes api.PerformLoginTokenClaimResponse
+			if err = testAPI.PerformLoginTokenClaim(context.TODO(), &api.PerformLoginTokenClaimRequest{Token: createRes.Token}, &claimRes); err != nil {
+				t.Fatalf("PerformLoginTokenClaim failed: %s", err)
+			}
+			if claimRes.UserID != wantUserID {
+				t.Errorf("claim %d got user %q want %q", i, claimRes.UserID, wantUserID)
+			}
+		}
+
+		err = testAPI.PerformLoginTokenCreation(context.TODO(), &api.PerformLoginTokenCreationRequest{UserID: "@alice:wrongdomain.com"}, &createRes)
+		if err == nil {
+			t.Errorf("PerformLoginTokenCreation succeeded for a remote user")
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		userAPI, accountDB, _ := MustMakeInternalAPI(t)
+		if _, err := accountDB.CreateAccount(context.TODO(), "alice", "", ""); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		userAPI, accountDB, _ := MustMakeInternalAPI(t)
+		if _, err := accountDB.CreateAccount(context.TODO(), "alice", "", ""); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+		runCases(userAPI)
+	})
+}
+
+func TestLoginTokensOfDeactivatedAccounts(t *testing.T) {
+	ctx := context.TODO()
+	userAPI, accountDB, _ := MustMakeInternalAPI(t)
+	for _, localpart := range []string{"alice", "bob"} {
+		if _, err := accountDB.CreateAccount(ctx, localpart, "", ""); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+	}
+	createToken := func(localpart string) string {
+		var res api.PerformLoginTokenCreationResponse
+		err := userAPI.PerformLoginTokenCreation(ctx, &api.PerformLoginTokenCreationRequest{
+			UserID: fmt.Sprintf("@%s:%s", localpart, serverName),
+		}, &res)
+		if err != nil {
+			t.Fatalf("PerformLoginTokenCreation failed: %s", err)
+		}
+		return res.Token
+	}
+	claimToken := func(token string) string {
+		var res api.PerformLoginTokenClaimResponse
+		if err := userAPI.PerformLoginTokenClaim(ctx, &api.PerformLoginTokenClaimRequest{Token: token}, &res); err != nil {
+			t.Fatalf("PerformLoginTokenClaim failed: %s", err)
+		}
+		return res.UserID
+	}
+
+	// Alice is deactivated after being issued a token.
+	aliceToken := createToken("alice")
+	if err := userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{Localpart: "alice"}, &api.PerformAccountDeactivationResponse{}); err != nil {
+		t.Fatalf("PerformAccountDeactivation failed: %s", err)
+	}
+	if userID := claimToken(aliceToken); userID != "" {
+		t.Errorf("token issued before the deactivation logged in as %q", userID)
+	}
+
+	// Bob's account is deactivated without going through the user API, so
+	// the token is still stored and has to be refused when it's claimed.
+	bobToken := createToken("bob")
+	if err := accountDB.DeactivateAccount(ctx, "bob"); err != nil {
+		t.Fatalf("DeactivateAccount failed: %s", err)
+	}
+	if userID := claimToken(bobToken); userID != "" {
+		t.Errorf("token of a deactivated account logged in as %q", userID)
+	}
+}
+
+// countingAccountDB counts how many times accounts are looked up.
+type countingAccountDB struct {
+	accounts.Database
+	lookups int
+}
+
+func (d *countingAccountDB) GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error) {
+	d.lookups++
+	return d.Database.GetAccountByLocalpart(ctx, localpart)
+}
+
+func TestQueryAccessTokenAccountFlags(t *testing.T) {
+	ctx := context.TODO()
+	_, accountDB, deviceDB := MustMakeInternalAPI(t)
+	countingDB := &countingAccountDB{Database: accountDB}
+	userAPI := userapi.NewInternalAPI(countingDB, deviceDB, serverName, nil, nil, nil)
+	if _, err := accountDB.CreateAccount(ctx, "alice", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	if _, err := deviceDB.CreateDevice(ctx, "alice", nil, "alice_token", nil); err != nil {
+		t.Fatalf("failed to make device: %s", err)
+	}
+	queryToken := func() *api.Device {
+		var res api.QueryAccessTokenResponse
+		if err := userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: "alice_token"}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		if res.Device == nil {
+			t.Fatalf("QueryAccessToken found no device")
+		}
+		return res.Device
+	}
+
+	// The account is only looked up once for many requests.
+	for i := 0; i < 3; i++ {
+		if device := queryToken(); device.IsAdmin || device.IsGuest {
+			t.Fatalf("got device %+v, want a normal user's device", device)
+		}
+	}
+	if countingDB.lookups != 1 {
+		t.Fatalf("the account was looked up %d times, want 1", countingDB.lookups)
+	}
+
+	// Becoming an admin applies to the account's devices straight away.
+	alice := fmt.Sprintf("@alice:%s", serverName)
+	if err := userAPI.PerformAdminUpdate(ctx, &api.PerformAdminUpdateRequest{UserID: alice, IsAdmin: true}, &api.PerformAdminUpdateResponse{}); err != nil {
+		t.Fatalf("PerformAdminUpdate failed: %s", err)
+	}
+	if device := queryToken(); !device.IsAdmin {
+		t.Fatalf("got device %+v after becoming an admin, want an admin's device", device)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	runCases := func(testAPI api.UserInternalAPI, accountDB accounts.Database) {
+		ctx := context.TODO()
+		for _, localpart := range []string{"bob", "alice", "charlie"} {
+			if _, err := accountDB.CreateAccount(ctx, localpart, "foobar", ""); err != nil {
+				t.Fatalf("failed to make account: %s", err)
+			}
+		}
+		alice := fmt.Sprintf("@alice:%s", serverName)
+		if err := testAPI.PerformAdminUpdate(ctx, &api.PerformAdminUpdateRequest{UserID: alice, IsAdmin: true}, &api.PerformAdminUpdateResponse{}); err != nil {
+			t.Fatalf("PerformAdminUpdate failed: %s", err)
+		}
+		err := testAPI.PerformAdminUpdate(ctx, &api.PerformAdminUpdateRequest{UserID: "@alice:wrongdomain.com", IsAdmin: true}, &api.PerformAdminUpdateResponse{})
+		if err == nil {
+			t.Errorf("PerformAdminUpdate succeeded for a remote user")
+		}
+
+		var res api.QueryAccountsResponse
+		if err = testAPI.QueryAccounts(ctx, &api.QueryAccountsRequest{Offset: 0, Limit: 2}, &res); err != nil {
+			t.Fatalf("QueryAccounts failed: %s", err)
+		}
+		if res.TotalAccounts != 3 || len(res.Accounts) != 2 {
+			t.Fatalf("got %d of %d accounts, want 2 of 3", len(res.Accounts), res.TotalAccounts)
+		}
+		if res.Accounts[0].UserID != alice || !res.Accounts[0].IsAdmin || res.Accounts[1].Localpart != "bob" || res.Accounts[1].IsAdmin {
+			t.Errorf("got accounts %+v, want alice as an admin then bob", res.Accounts)
+		}
+		if err = testAPI.QueryAccounts(ctx, &api.QueryAccountsRequest{Offset: 2, Limit: 2}, &res); err != nil {
+			t.Fatalf("QueryAccounts failed: %s", err)
+		}
+		if len(res.Accounts) != 1 || res.Accounts[0].Localpart != "charlie" {
+			t.Errorf("got accounts %+v on the second page, want charlie", res.Accounts)
+		}
+	}
+
+	t.Run("HTTP API", func(t *testing.T) {
+		userAPI, accountDB, _ := MustMakeInternalAPI(t)
+		router := mux.NewRouter().PathPrefix(httputil.InternalPathPrefix).Subrouter()
+		userapi.AddInternalRoutes(router, userAPI)
+		apiURL, cancel := test.ListenAndServe(t, router, false)
+		defer cancel()
+		httpAPI, err := inthttp.NewUserAPIClient(apiURL, &http.Client{})
+		if err != nil {
+			t.Fatalf("failed to create HTTP client")
+		}
+		runCases(httpAPI, accountDB)
+	})
+	t.Run("Monolith", func(t *testing.T) {
+		userAPI, accountDB, _ := MustMakeInternalAPI(t)
+		runCases(userAPI, accountDB)
+	})
+}
+
+func TestTransactions(t *testing.T) {
+	ctx := context.Background()
+	_, _, deviceDB := MustMakeInternalAPI(t)
+
+	if result, ok, err := deviceDB.GetTransaction(ctx, "@alice:localhost", "ALICE", "send", "txn"); err != nil || ok {
+		t.Fatalf("GetTransaction returned %q, %v, %v for an unknown transaction", result, ok, err)
+	}
+	if err := deviceDB.StoreTransaction(ctx, "@alice:localhost", "ALICE", "send", "txn", "$event"); err != nil {
+		t.Fatalf("StoreTransaction failed: %s", err)
+	}
+	// Storing the transaction again keeps the original result.
+	if err := deviceDB.StoreTransaction(ctx, "@alice:localhost", "ALICE", "send", "txn", "$other"); err != nil {
+		t.Fatalf("StoreTransaction failed: %s", err)
+	}
+	if result, ok, err := deviceDB.GetTransaction(ctx, "@alice:localhost", "ALICE", "send", "txn"); err != nil || !ok || result != "$event" {
+		t.Errorf("GetTransaction returned %q, %v, %v, want $event", result, ok, err)
+	}
+	// Transaction IDs are scoped to the device and the endpoint.
+	for _, tc := range []struct{ userID, deviceID, endpoint string }{
+		{"@alice:localhost", "OTHER", "send"},
+		{"@bob:localhost", "ALICE", "send"},
+		{"@alice:localhost", "ALICE", "sendToDevice"},
+	} {
+		if result, ok, err := deviceDB.GetTransaction(ctx, tc.userID, tc.deviceID, tc.endpoint, "txn"); err != nil || ok {
+			t.Errorf("GetTransaction returned %q, %v, %v for %+v", result, ok, err, tc)
+		}
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	userAPI, _, deviceDB := MustMakeInternalAPI(t)
+	queryAccessToken := func(token string) api.QueryAccessTokenResponse {
+		var res api.QueryAccessTokenResponse
+		if err := userAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: token}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		return res
+	}
+
+	var devRes api.PerformDeviceCreationResponse
+	err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:            "alice",
+		AccessToken:          "expired_token",
+		RefreshToken:         "refresh_token",
+		AccessTokenExpiresTS: gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Minute)),
+	}, &devRes)
+	if err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+	if res := queryAccessToken("expired_token"); !res.Expired || res.Device != nil {
+		t.Fatalf("expected the access token to have expired, got %+v", res)
+	}
+
+	expiresTS := gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute))
+	dev, err := deviceDB.RefreshAccessToken(ctx, "refresh_token", "new_token", "new_refresh_token", expiresTS)
+	if err != nil {
+		t.Fatalf("RefreshAccessToken failed: %s", err)
+	}
+	if dev.ID != devRes.Device.ID || dev.UserID != "@alice:"+string(serverName) || dev.AccessToken != "new_token" {
+		t.Fatalf("RefreshAccessToken returned the wrong device: %+v", dev)
+	}
+	if res := queryAccessToken("new_token"); res.Expired || res.Device == nil || res.Device.ID != devRes.Device.ID {
+		t.Fatalf("expected the new access token to work, got %+v", res)
+	}
+	if res := queryAccessToken("expired_token"); res.Expired || res.Device != nil {
+		t.Fatalf("expected the old access token to be unknown, got %+v", res)
+	}
+	// Refresh tokens can only be used once.
+	if _, err = deviceDB.RefreshAccessToken(ctx, "refresh_token", "other_token", "other_refresh_token", expiresTS); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows when reusing the refresh token, got %v", err)
+	}
+}
+
+func TestPerformPasswordUpdate(t *testing.T) {
+	ctx := context.TODO()
+	userAPI, accountDB, deviceDB := MustMakeInternalAPI(t)
+	if _, err := accountDB.CreateAccount(ctx, "alice", "oldpassword", ""); err != nil {
+		t.Fatalf("CreateAccount failed: %s", err)
+	}
+	for _, deviceID := range []string{"PHONE", "LAPTOP"} {
+		deviceID := deviceID
+		req := api.PerformDeviceCreationRequest{Localpart: "alice", DeviceID: &deviceID, AccessToken: deviceID + "_token"}
+		if err := userAPI.PerformDeviceCreation(ctx, &req, &api.PerformDeviceCreationResponse{}); err != nil {
+			t.Fatalf("PerformDeviceCreation failed: %s", err)
+		}
+	}
+
+	// Changing the password without logging out keeps every device.
+	alice := fmt.Sprintf("@alice:%s", serverName)
+	var res api.PerformPasswordUpdateResponse
+	req := api.PerformPasswordUpdateRequest{UserID: alice, Password: "newpassword"}
+	if err := userAPI.PerformPasswordUpdate(ctx, &req, &res); err != nil || !res.PasswordUpdated {
+		t.Fatalf("PerformPasswordUpdate returned %+v, %v", res, err)
+	}
+	if _, err := accountDB.GetAccountByPassword(ctx, "alice", "oldpassword"); err == nil {
+		t.Errorf("the old password still works")
+	}
+	if _, err := accountDB.GetAccountByPassword(ctx, "alice", "newpassword"); err != nil {
+		t.Errorf("the new password doesn't work: %s", err)
+	}
+	if devs, err := deviceDB.GetDevicesByLocalpart(ctx, "alice"); err != nil || len(devs) != 2 {
+		t.Fatalf("expected both devices to be kept, got %+v, %v", devs, err)
+	}
+
+	// Logging out keeps only the device which changed the password.
+	req = api.PerformPasswordUpdateRequest{UserID: alice, Password: "otherpassword", LogoutDevices: true, KeepDeviceID: "LAPTOP"}
+	if err := userAPI.PerformPasswordUpdate(ctx, &req, &api.PerformPasswordUpdateResponse{}); err != nil {
+		t.Fatalf("PerformPasswordUpdate failed: %s", err)
+	}
+	devs, err := deviceDB.GetDevicesByLocalpart(ctx, "alice")
+	if err != nil || len(devs) != 1 || devs[0].ID != "LAPTOP" {
+		t.Errorf("expected only the LAPTOP device to be kept, got %+v, %v", devs, err)
+	}
+
+	req = api.PerformPasswordUpdateRequest{UserID: "@bob:" + string(serverName), Password: "newpassword"}
+	if err = userAPI.PerformPasswordUpdate(ctx, &req, &api.PerformPasswordUpdateResponse{}); err == nil {
+		t.Errorf("expected an error updating the password of an unknown user")
+	}
+	req = api.PerformPasswordUpdateRequest{UserID: "@alice:elsewhere", Password: "newpassword"}
+	if err = userAPI.PerformPasswordUpdate(ctx, &req, &api.PerformPasswordUpdateResponse{}); err == nil {
+		t.Errorf("expected an error updating the password of a remote user")
+	}
+}